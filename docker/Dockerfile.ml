@@ -20,7 +20,7 @@ COPY go/ ./
 RUN rm -f main.go
 
 # Build the ML service binary
-RUN cd ml && CGO_ENABLED=0 GOOS=linux go build -a -installsuffix cgo -o ml-binary main.go && mv ml-binary ../
+RUN cd ml && CGO_ENABLED=0 GOOS=linux go build -a -installsuffix cgo -o ml-binary . && mv ml-binary ../
 
 # Final stage
 FROM alpine:latest
@@ -0,0 +1,343 @@
+// Package alerting evaluates alert rules against stored time series. A rule
+// compares the mean of a series over a window with a threshold, and fires an
+// alert once the comparison held for its sustained duration. A firing rule
+// keeps one alert, which is resolved when the comparison no longer holds.
+// Silences mute the alerts of a rule or severity for a while.
+package alerting
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"distributed-gradle-building/tsdb"
+)
+
+// Alert severities
+const (
+	SeverityInfo     = "info"
+	SeverityWarning  = "warning"
+	SeverityCritical = "critical"
+)
+
+// Alert states
+const (
+	// StatePending alerts met their condition for less than the rule's
+	// sustained duration
+	StatePending  = "pending"
+	StateFiring   = "firing"
+	StateResolved = "resolved"
+)
+
+// DefaultWindow is the window a rule averages its series over by default
+const DefaultWindow = 5 * time.Minute
+
+// maxResolved is how many resolved alerts are kept
+const maxResolved = 100
+
+// Severities lists the valid severities
+var Severities = []string{SeverityInfo, SeverityWarning, SeverityCritical}
+
+// operators compare a value with a threshold
+var operators = map[string]func(value, threshold float64) bool{
+	">":  func(value, threshold float64) bool { return value > threshold },
+	">=": func(value, threshold float64) bool { return value >= threshold },
+	"<":  func(value, threshold float64) bool { return value < threshold },
+	"<=": func(value, threshold float64) bool { return value <= threshold },
+	"==": func(value, threshold float64) bool { return value == threshold },
+	"!=": func(value, threshold float64) bool { return value != threshold },
+}
+
+// Rule fires an alert when the mean of Metric over Window compares with
+// Threshold by Operator for at least For, both durations such as 10m. A
+// window without samples does not meet the condition.
+type Rule struct {
+	Name        string  `json:"name"`
+	Metric      string  `json:"metric"`
+	Operator    string  `json:"operator"`
+	Threshold   float64 `json:"threshold"`
+	For         string  `json:"for,omitempty"`
+	Window      string  `json:"window,omitempty"`
+	Severity    string  `json:"severity"`
+	Description string  `json:"description,omitempty"`
+}
+
+// durations returns the sustained duration and window of a valid rule
+func (r Rule) durations() (sustained, window time.Duration) {
+	window = DefaultWindow
+	if r.For != "" {
+		sustained, _ = time.ParseDuration(r.For)
+	}
+	if r.Window != "" {
+		window, _ = time.ParseDuration(r.Window)
+	}
+	return sustained, window
+}
+
+// Validate checks a rule
+func (r Rule) Validate() error {
+	if r.Name == "" {
+		return fmt.Errorf("alert rule has no name")
+	}
+	if r.Metric == "" {
+		return fmt.Errorf("alert rule %s has no metric", r.Name)
+	}
+	if _, exists := operators[r.Operator]; !exists {
+		return fmt.Errorf("alert rule %s has unknown operator %q", r.Name, r.Operator)
+	}
+	if !slices.Contains(Severities, r.Severity) {
+		return fmt.Errorf("alert rule %s has unknown severity %q", r.Name, r.Severity)
+	}
+	for field, value := range map[string]string{"for": r.For, "window": r.Window} {
+		if value == "" {
+			continue
+		}
+		if parsed, err := time.ParseDuration(value); err != nil || parsed < 0 || (field == "window" && parsed == 0) {
+			return fmt.Errorf("alert rule %s has invalid %s %q", r.Name, field, value)
+		}
+	}
+	return nil
+}
+
+// Alert is an alert of a rule
+type Alert struct {
+	// ID identifies an alert of a rule by the time it started
+	ID        string  `json:"id"`
+	Rule      string  `json:"rule"`
+	Metric    string  `json:"metric"`
+	Severity  string  `json:"severity"`
+	State     string  `json:"state"`
+	Message   string  `json:"message"`
+	Value     float64 `json:"value"`
+	Threshold float64 `json:"threshold"`
+	// StartsAt is when the condition was first met
+	StartsAt   time.Time  `json:"starts_at"`
+	FiredAt    *time.Time `json:"fired_at,omitempty"`
+	ResolvedAt *time.Time `json:"resolved_at,omitempty"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+	// SilencedBy is the ID of the silence muting the alert
+	SilencedBy string `json:"silenced_by,omitempty"`
+}
+
+// Silence mutes the alerts of a rule, of a severity, or of both until
+// EndsAt. A silence without either mutes every alert.
+type Silence struct {
+	ID       string    `json:"id"`
+	Rule     string    `json:"rule,omitempty"`
+	Severity string    `json:"severity,omitempty"`
+	Comment  string    `json:"comment,omitempty"`
+	StartsAt time.Time `json:"starts_at"`
+	EndsAt   time.Time `json:"ends_at"`
+}
+
+// matches reports whether a silence mutes an alert at now
+func (s Silence) matches(alert *Alert, now time.Time) bool {
+	return !now.Before(s.StartsAt) && now.Before(s.EndsAt) &&
+		(s.Rule == "" || s.Rule == alert.Rule) &&
+		(s.Severity == "" || s.Severity == alert.Severity)
+}
+
+// Source queries the series rules are evaluated on, as tsdb.Store does
+type Source interface {
+	Query(series string, from, to time.Time, step time.Duration) ([]tsdb.Point, error)
+}
+
+// Engine evaluates rules and tracks their alerts
+type Engine struct {
+	mutex  sync.Mutex
+	source Source
+	rules  []Rule
+	// active holds the pending and firing alert of each rule
+	active   map[string]*Alert
+	resolved []Alert
+	silences []Silence
+	// silenceCount numbers the silences
+	silenceCount int
+}
+
+// NewEngine returns an engine evaluating rules on the series of source
+func NewEngine(source Source, rules []Rule) (*Engine, error) {
+	for i, rule := range rules {
+		if err := rule.Validate(); err != nil {
+			return nil, err
+		}
+		if slices.ContainsFunc(rules[:i], func(other Rule) bool { return other.Name == rule.Name }) {
+			return nil, fmt.Errorf("duplicate alert rule %s", rule.Name)
+		}
+	}
+	return &Engine{source: source, rules: slices.Clone(rules), active: make(map[string]*Alert)}, nil
+}
+
+// Rules returns the rules of the engine
+func (e *Engine) Rules() []Rule {
+	return slices.Clone(e.rules)
+}
+
+// Evaluate evaluates every rule at now and returns the alerts that fired or
+// were resolved
+func (e *Engine) Evaluate(now time.Time) ([]Alert, error) {
+	var changes []Alert
+	var errs []error
+	for _, rule := range e.rules {
+		sustained, window := rule.durations()
+		points, err := e.source.Query(rule.Metric, now.Add(-window), now, 0)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("alert rule %s: %v", rule.Name, err))
+			continue
+		}
+		var sum float64
+		var count int
+		for _, point := range points {
+			sum += point.Sum()
+			count += point.Count
+		}
+
+		if alert, changed := e.update(rule, count > 0, sum/float64(max(count, 1)), sustained, now); changed {
+			changes = append(changes, alert)
+		}
+	}
+	if len(errs) > 0 {
+		return changes, fmt.Errorf("failed to evaluate alert rules: %v", errs)
+	}
+	return changes, nil
+}
+
+// update records the evaluation of a rule, returning its alert and whether
+// it fired or was resolved
+func (e *Engine) update(rule Rule, sampled bool, value float64, sustained time.Duration, now time.Time) (Alert, bool) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	alert := e.active[rule.Name]
+	if !sampled || !operators[rule.Operator](value, rule.Threshold) {
+		if alert == nil {
+			return Alert{}, false
+		}
+		delete(e.active, rule.Name)
+		if alert.State == StatePending {
+			return Alert{}, false
+		}
+		alert.State = StateResolved
+		alert.ResolvedAt = &now
+		alert.UpdatedAt = now
+		e.resolved = append(e.resolved, *alert)
+		if len(e.resolved) > maxResolved {
+			e.resolved = e.resolved[1:]
+		}
+		return *alert, true
+	}
+
+	if alert == nil {
+		alert = &Alert{
+			ID:        fmt.Sprintf("%s-%d", rule.Name, now.Unix()),
+			Rule:      rule.Name,
+			Metric:    rule.Metric,
+			Severity:  rule.Severity,
+			State:     StatePending,
+			Threshold: rule.Threshold,
+			StartsAt:  now,
+		}
+		e.active[rule.Name] = alert
+	}
+	alert.Value = value
+	alert.UpdatedAt = now
+	alert.Message = fmt.Sprintf("%s is %g, %s %g", rule.Metric, value, rule.Operator, rule.Threshold)
+	if rule.Description != "" {
+		alert.Message = rule.Description + ": " + alert.Message
+	}
+	alert.SilencedBy = e.silencedBy(alert, now)
+	if alert.State == StatePending && now.Sub(alert.StartsAt) >= sustained {
+		alert.State = StateFiring
+		alert.FiredAt = &now
+		return *alert, true
+	}
+	return *alert, false
+}
+
+// silencedBy returns the ID of a silence muting an alert at now. Must be
+// called with the mutex held.
+func (e *Engine) silencedBy(alert *Alert, now time.Time) string {
+	for _, silence := range e.silences {
+		if silence.matches(alert, now) {
+			return silence.ID
+		}
+	}
+	return ""
+}
+
+// Alerts returns the pending and firing alerts, then the alerts resolved
+// most recently, with the silences in effect at now
+func (e *Engine) Alerts(now time.Time) []Alert {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	alerts := make([]Alert, 0, len(e.active)+len(e.resolved))
+	for _, alert := range e.active {
+		alert.SilencedBy = e.silencedBy(alert, now)
+		alerts = append(alerts, *alert)
+	}
+	sort.Slice(alerts, func(i, j int) bool {
+		return alerts[i].StartsAt.Before(alerts[j].StartsAt)
+	})
+	for i := len(e.resolved) - 1; i >= 0; i-- {
+		alerts = append(alerts, e.resolved[i])
+	}
+	return alerts
+}
+
+// Silence adds a silence from now on, for a duration
+func (e *Engine) Silence(silence Silence, duration time.Duration, now time.Time) (Silence, error) {
+	if duration <= 0 {
+		return Silence{}, fmt.Errorf("silence needs a positive duration")
+	}
+	if silence.Rule != "" && !slices.ContainsFunc(e.rules, func(rule Rule) bool { return rule.Name == silence.Rule }) {
+		return Silence{}, fmt.Errorf("unknown alert rule %s", silence.Rule)
+	}
+	if silence.Severity != "" && !slices.Contains(Severities, silence.Severity) {
+		return Silence{}, fmt.Errorf("unknown severity %q", silence.Severity)
+	}
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.expireSilences(now)
+	e.silenceCount++
+	silence.ID = fmt.Sprintf("silence-%d", e.silenceCount)
+	silence.StartsAt = now
+	silence.EndsAt = now.Add(duration)
+	e.silences = append(e.silences, silence)
+	return silence, nil
+}
+
+// Silences returns the silences in effect at now
+func (e *Engine) Silences(now time.Time) []Silence {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.expireSilences(now)
+	return slices.Clone(e.silences)
+}
+
+// Expire ends a silence, reporting whether it was in effect
+func (e *Engine) Expire(id string) bool {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	for i, silence := range e.silences {
+		if silence.ID == id {
+			e.silences = slices.Delete(e.silences, i, i+1)
+			return true
+		}
+	}
+	return false
+}
+
+// expireSilences drops the silences that ended. Must be called with the
+// mutex held.
+func (e *Engine) expireSilences(now time.Time) {
+	e.silences = slices.DeleteFunc(e.silences, func(silence Silence) bool {
+		return !now.Before(silence.EndsAt)
+	})
+}
@@ -0,0 +1,146 @@
+package alerting
+
+import (
+	"testing"
+	"time"
+
+	"distributed-gradle-building/tsdb"
+)
+
+func TestEvaluate(t *testing.T) {
+	store, err := tsdb.Open(t.TempDir(), tsdb.DefaultOptions())
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer store.Close()
+
+	engine, err := NewEngine(store, []Rule{
+		{Name: "slow-builds", Metric: "build_duration_seconds", Operator: ">", Threshold: 600, For: "10m", Severity: SeverityWarning},
+		{Name: "failing-builds", Metric: "build_success", Operator: "<", Threshold: 0.5, Window: "1h", Severity: SeverityCritical, Description: "Builds are failing"},
+	})
+	if err != nil {
+		t.Fatalf("NewEngine failed: %v", err)
+	}
+
+	start := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+	evaluate := func(at time.Time) []Alert {
+		changes, err := engine.Evaluate(at)
+		if err != nil {
+			t.Fatalf("Evaluate failed: %v", err)
+		}
+		return changes
+	}
+
+	// The slow builds must be sustained for 10 minutes, failing builds fire
+	// at once
+	store.Append("build_duration_seconds", start, 900)
+	store.Append("build_success", start, 0)
+	changes := evaluate(start.Add(time.Minute))
+	if len(changes) != 1 || changes[0].Rule != "failing-builds" || changes[0].State != StateFiring || changes[0].Message != "Builds are failing: build_success is 0, < 0.5" {
+		t.Fatalf("Expected the failing builds to fire, got %+v", changes)
+	}
+	if alerts := engine.Alerts(start.Add(time.Minute)); len(alerts) != 2 || alerts[0].State == alerts[1].State {
+		t.Errorf("Expected a pending and a firing alert, got %+v", alerts)
+	}
+
+	for at := start.Add(4 * time.Minute); at.Before(start.Add(12 * time.Minute)); at = at.Add(4 * time.Minute) {
+		store.Append("build_duration_seconds", at, 700)
+	}
+	changes = evaluate(start.Add(12 * time.Minute))
+	if len(changes) != 1 || changes[0].Rule != "slow-builds" || changes[0].State != StateFiring || changes[0].Value != 700 {
+		t.Fatalf("Expected the sustained slow builds to fire, got %+v", changes)
+	}
+
+	// Firing alerts are not repeated while their condition holds
+	store.Append("build_duration_seconds", start.Add(13*time.Minute), 800)
+	if changes := evaluate(start.Add(14 * time.Minute)); len(changes) != 0 {
+		t.Errorf("Expected the firing alerts to be deduplicated, got %+v", changes)
+	}
+
+	// The slow builds resolve once the window holds no slow builds
+	store.Append("build_duration_seconds", start.Add(20*time.Minute), 60)
+	changes = evaluate(start.Add(21 * time.Minute))
+	if len(changes) != 1 || changes[0].State != StateResolved || changes[0].ResolvedAt == nil {
+		t.Fatalf("Expected the slow builds to resolve, got %+v", changes)
+	}
+	alerts := engine.Alerts(start.Add(21 * time.Minute))
+	if len(alerts) != 2 || alerts[0].Rule != "failing-builds" || alerts[1].State != StateResolved {
+		t.Errorf("Expected the firing alert and the resolved one, got %+v", alerts)
+	}
+
+	// The slow builds fire again as a new alert
+	for at := start.Add(22 * time.Minute); at.Before(start.Add(35 * time.Minute)); at = at.Add(4 * time.Minute) {
+		store.Append("build_duration_seconds", at, 1200)
+	}
+	evaluate(start.Add(23 * time.Minute))
+	changes = evaluate(start.Add(35 * time.Minute))
+	if len(changes) != 1 || changes[0].State != StateFiring || changes[0].ID == alerts[1].ID {
+		t.Errorf("Expected a new slow builds alert, got %+v", changes)
+	}
+
+	// Alerts resolve once their window holds no samples
+	changes = evaluate(start.Add(61 * time.Minute))
+	if len(changes) != 2 || changes[0].State != StateResolved || changes[1].State != StateResolved {
+		t.Errorf("Expected both alerts to resolve, got %+v", changes)
+	}
+}
+
+func TestSilence(t *testing.T) {
+	store, _ := tsdb.Open(t.TempDir(), tsdb.DefaultOptions())
+	defer store.Close()
+	engine, _ := NewEngine(store, []Rule{{Name: "failing-builds", Metric: "build_success", Operator: "<", Threshold: 0.5, Severity: SeverityCritical}})
+
+	now := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+	silence, err := engine.Silence(Silence{Rule: "failing-builds", Comment: "maintenance"}, time.Hour, now)
+	if err != nil || silence.ID == "" || !silence.EndsAt.Equal(now.Add(time.Hour)) {
+		t.Fatalf("Expected the silence to be added, got %+v: %v", silence, err)
+	}
+	for name, invalid := range map[string]Silence{"unknown rule": {Rule: "other"}, "unknown severity": {Severity: "fatal"}} {
+		if _, err := engine.Silence(invalid, time.Hour, now); err == nil {
+			t.Errorf("Expected the silence of an %s to be rejected", name)
+		}
+	}
+
+	store.Append("build_success", now, 0)
+	changes, _ := engine.Evaluate(now.Add(time.Minute))
+	if len(changes) != 1 || changes[0].SilencedBy != silence.ID {
+		t.Fatalf("Expected the alert to fire silenced, got %+v", changes)
+	}
+
+	// Alerts are no longer silenced once the silence ends
+	if alerts := engine.Alerts(now.Add(time.Hour)); len(alerts) != 1 || alerts[0].SilencedBy != "" {
+		t.Errorf("Expected the silence to have ended, got %+v", alerts)
+	}
+	if silences := engine.Silences(now.Add(time.Hour)); len(silences) != 0 {
+		t.Errorf("Expected the silence to expire, got %+v", silences)
+	}
+
+	silence, _ = engine.Silence(Silence{Severity: SeverityCritical}, time.Hour, now)
+	if !engine.Expire(silence.ID) || engine.Expire(silence.ID) {
+		t.Error("Expected the silence to be expired once")
+	}
+}
+
+func TestNewEngine(t *testing.T) {
+	valid := Rule{Name: "slow-builds", Metric: "build_duration_seconds", Operator: ">", Threshold: 600, Severity: SeverityWarning}
+	invalid := map[string][]Rule{}
+	for name, change := range map[string]func(*Rule){
+		"unnamed":          func(r *Rule) { r.Name = "" },
+		"without metric":   func(r *Rule) { r.Metric = "" },
+		"unknown operator": func(r *Rule) { r.Operator = "=>" },
+		"unknown severity": func(r *Rule) { r.Severity = "fatal" },
+		"invalid for":      func(r *Rule) { r.For = "soon" },
+		"empty window":     func(r *Rule) { r.Window = "0s" },
+	} {
+		rule := valid
+		change(&rule)
+		invalid[name] = []Rule{rule}
+	}
+	invalid["duplicate"] = []Rule{valid, valid}
+
+	for name, rules := range invalid {
+		if _, err := NewEngine(nil, rules); err == nil {
+			t.Errorf("Expected the %s rules to be rejected", name)
+		}
+	}
+}
@@ -0,0 +1,317 @@
+// Package analytics computes historical build statistics from the build
+// store. Time series are bucketed and shaped like the responses of the
+// Grafana JSON datasource, so dashboards can chart them directly.
+package analytics
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"distributed-gradle-building/buildstore"
+)
+
+// Defaults applied by ParseQuery
+const (
+	DefaultRange    = 7 * 24 * time.Hour
+	DefaultInterval = time.Hour
+	DefaultLimit    = 10
+
+	// maxBuckets keeps a tiny interval over a long range from producing
+	// an unbounded response
+	maxBuckets = 10000
+)
+
+// Series is a time series in the Grafana JSON datasource format. Each
+// datapoint is a [value, unix milliseconds] pair.
+type Series struct {
+	Target     string       `json:"target"`
+	Datapoints [][2]float64 `json:"datapoints"`
+}
+
+// Column is a column of a Table
+type Column struct {
+	Text string `json:"text"`
+	Type string `json:"type"`
+}
+
+// Table is a table in the Grafana JSON datasource format
+type Table struct {
+	Type    string   `json:"type"`
+	Columns []Column `json:"columns"`
+	Rows    [][]any  `json:"rows"`
+}
+
+// Query selects the builds and bucketing of an analytics request
+type Query struct {
+	ProjectPath string
+	From        time.Time
+	To          time.Time
+	Interval    time.Duration
+	Limit       int
+	// Tags are tags the builds must all carry
+	Tags map[string]string
+}
+
+// ParseQuery reads a query from the parameters project, from and to
+// (RFC 3339), interval (a Go duration, or whole days such as "1d"), limit
+// and any number of tag filters as key:value. Without a range the last 7
+// days are used.
+func ParseQuery(values url.Values, now time.Time) (Query, error) {
+	query := Query{
+		ProjectPath: values.Get("project"),
+		To:          now,
+		Interval:    DefaultInterval,
+		Limit:       DefaultLimit,
+	}
+
+	var err error
+	if to := values.Get("to"); to != "" {
+		if query.To, err = time.Parse(time.RFC3339, to); err != nil {
+			return Query{}, fmt.Errorf("invalid to: %v", err)
+		}
+	}
+	query.From = query.To.Add(-DefaultRange)
+	if from := values.Get("from"); from != "" {
+		if query.From, err = time.Parse(time.RFC3339, from); err != nil {
+			return Query{}, fmt.Errorf("invalid from: %v", err)
+		}
+	}
+	if !query.From.Before(query.To) {
+		return Query{}, fmt.Errorf("from must be before to")
+	}
+
+	if interval := values.Get("interval"); interval != "" {
+		if query.Interval, err = parseInterval(interval); err != nil || query.Interval <= 0 {
+			return Query{}, fmt.Errorf("invalid interval: %s", interval)
+		}
+	}
+	if query.To.Sub(query.From)/query.Interval > maxBuckets {
+		return Query{}, fmt.Errorf("interval %s is too small for the requested range", query.Interval)
+	}
+
+	if limit := values.Get("limit"); limit != "" {
+		if query.Limit, err = strconv.Atoi(limit); err != nil || query.Limit <= 0 {
+			return Query{}, fmt.Errorf("invalid limit: %s", limit)
+		}
+	}
+	if query.Tags, err = buildstore.ParseTagFilter(values["tag"]); err != nil {
+		return Query{}, err
+	}
+
+	return query, nil
+}
+
+// parseInterval parses a Go duration, also accepting whole days ("1d")
+func parseInterval(value string) (time.Duration, error) {
+	if days, found := strings.CutSuffix(value, "d"); found {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(value)
+}
+
+// Filter returns the build store filter selecting the builds of a query
+func (q Query) Filter() buildstore.Filter {
+	return buildstore.Filter{ProjectPath: q.ProjectPath, Since: q.From, Until: q.To, Tags: q.Tags}
+}
+
+// bucket returns the start of the interval a time falls into
+func (q Query) bucket(t time.Time) time.Time {
+	return q.From.Add(t.Sub(q.From) / q.Interval * q.Interval)
+}
+
+// accumulator sums the values falling into a bucket
+type accumulator struct {
+	sum   float64
+	count int
+}
+
+// aggregate accumulates values per bucket
+type aggregate map[time.Time]*accumulator
+
+func (a aggregate) add(bucket time.Time, value float64) {
+	entry, exists := a[bucket]
+	if !exists {
+		entry = &accumulator{}
+		a[bucket] = entry
+	}
+	entry.sum += value
+	entry.count++
+}
+
+// datapoints returns the buckets in time order, valued by fn
+func (a aggregate) datapoints(fn func(sum float64, count int) float64) [][2]float64 {
+	buckets := make([]time.Time, 0, len(a))
+	for bucket := range a {
+		buckets = append(buckets, bucket)
+	}
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].Before(buckets[j]) })
+
+	points := make([][2]float64, 0, len(buckets))
+	for _, bucket := range buckets {
+		entry := a[bucket]
+		points = append(points, [2]float64{fn(entry.sum, entry.count), float64(bucket.UnixMilli())})
+	}
+	return points
+}
+
+func average(sum float64, count int) float64 { return sum / float64(count) }
+
+func total(sum float64, count int) float64 { return sum }
+
+// DurationTrends returns the average duration in seconds of completed builds
+// per interval, as one series per project
+func DurationTrends(records []buildstore.Record, query Query) []Series {
+	projects := map[string]aggregate{}
+	for _, record := range records {
+		if record.Status != buildstore.StatusCompleted {
+			continue
+		}
+		if projects[record.ProjectPath] == nil {
+			projects[record.ProjectPath] = aggregate{}
+		}
+		projects[record.ProjectPath].add(query.bucket(record.SubmittedAt), record.Duration.Seconds())
+	}
+
+	series := make([]Series, 0, len(projects))
+	for project, durations := range projects {
+		series = append(series, Series{Target: project, Datapoints: durations.datapoints(average)})
+	}
+	sort.Slice(series, func(i, j int) bool { return series[i].Target < series[j].Target })
+
+	return series
+}
+
+// FailureRates returns the fraction of finished builds that failed per
+// interval, with the number of finished builds alongside. Cancelled builds
+// are neither failures nor successes and are left out.
+func FailureRates(records []buildstore.Record, query Query) []Series {
+	failures := aggregate{}
+	builds := aggregate{}
+	for _, record := range records {
+		var failed float64
+		switch record.Status {
+		case buildstore.StatusCompleted:
+		case buildstore.StatusFailed:
+			failed = 1
+		default:
+			continue
+		}
+
+		bucket := query.bucket(record.SubmittedAt)
+		failures.add(bucket, failed)
+		builds.add(bucket, 1)
+	}
+
+	return []Series{
+		{Target: "failure_rate", Datapoints: failures.datapoints(average)},
+		{Target: "builds", Datapoints: builds.datapoints(total)},
+	}
+}
+
+// BusiestHours counts builds by UTC hour of day, busiest first, with their
+// average duration in seconds
+func BusiestHours(records []buildstore.Record) Table {
+	var counts [24]int
+	var durations [24]float64
+	for _, record := range records {
+		hour := record.SubmittedAt.UTC().Hour()
+		counts[hour]++
+		durations[hour] += record.Duration.Seconds()
+	}
+
+	hours := make([]int, 24)
+	for hour := range hours {
+		hours[hour] = hour
+	}
+	sort.SliceStable(hours, func(i, j int) bool { return counts[hours[i]] > counts[hours[j]] })
+
+	table := Table{
+		Type: "table",
+		Columns: []Column{
+			{Text: "hour", Type: "number"},
+			{Text: "builds", Type: "number"},
+			{Text: "average_duration_seconds", Type: "number"},
+		},
+		Rows: [][]any{},
+	}
+	for _, hour := range hours {
+		var averageDuration float64
+		if counts[hour] > 0 {
+			averageDuration = durations[hour] / float64(counts[hour])
+		}
+		table.Rows = append(table.Rows, []any{hour, counts[hour], averageDuration})
+	}
+
+	return table
+}
+
+// SlowestTasks returns the Gradle tasks with the highest average duration,
+// per project, up to the query limit
+func SlowestTasks(records []buildstore.Record, query Query) Table {
+	type taskKey struct{ project, task string }
+	type taskStats struct {
+		runs  int
+		total time.Duration
+		max   time.Duration
+	}
+
+	tasks := map[taskKey]*taskStats{}
+	for _, record := range records {
+		for _, timing := range record.Tasks {
+			key := taskKey{record.ProjectPath, timing.Name}
+			stats, exists := tasks[key]
+			if !exists {
+				stats = &taskStats{}
+				tasks[key] = stats
+			}
+			stats.runs++
+			stats.total += timing.Duration
+			if timing.Duration > stats.max {
+				stats.max = timing.Duration
+			}
+		}
+	}
+
+	keys := make([]taskKey, 0, len(tasks))
+	for key := range tasks {
+		keys = append(keys, key)
+	}
+	averageOf := func(key taskKey) time.Duration {
+		return tasks[key].total / time.Duration(tasks[key].runs)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if averageOf(keys[i]) != averageOf(keys[j]) {
+			return averageOf(keys[i]) > averageOf(keys[j])
+		}
+		return keys[i].task < keys[j].task
+	})
+	if len(keys) > query.Limit {
+		keys = keys[:query.Limit]
+	}
+
+	table := Table{
+		Type: "table",
+		Columns: []Column{
+			{Text: "task", Type: "string"},
+			{Text: "project", Type: "string"},
+			{Text: "runs", Type: "number"},
+			{Text: "average_seconds", Type: "number"},
+			{Text: "max_seconds", Type: "number"},
+		},
+		Rows: [][]any{},
+	}
+	for _, key := range keys {
+		stats := tasks[key]
+		table.Rows = append(table.Rows, []any{key.task, key.project, stats.runs, averageOf(key).Seconds(), stats.max.Seconds()})
+	}
+
+	return table
+}
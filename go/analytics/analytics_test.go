@@ -0,0 +1,144 @@
+package analytics
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"distributed-gradle-building/buildstore"
+)
+
+var start = time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+func testRecords() []buildstore.Record {
+	return []buildstore.Record{
+		{ProjectPath: "/projects/app", Status: buildstore.StatusCompleted, SubmittedAt: start.Add(10 * time.Minute), Duration: 60 * time.Second,
+			Tasks: []buildstore.TaskTiming{{Name: ":app:compileJava", Duration: 20 * time.Second}, {Name: ":app:test", Duration: 40 * time.Second}}},
+		{ProjectPath: "/projects/app", Status: buildstore.StatusCompleted, SubmittedAt: start.Add(20 * time.Minute), Duration: 120 * time.Second,
+			Tasks: []buildstore.TaskTiming{{Name: ":app:compileJava", Duration: 40 * time.Second}, {Name: ":app:test", Duration: 80 * time.Second}}},
+		{ProjectPath: "/projects/app", Status: buildstore.StatusFailed, SubmittedAt: start.Add(70 * time.Minute), Duration: 30 * time.Second},
+		{ProjectPath: "/projects/lib", Status: buildstore.StatusCompleted, SubmittedAt: start.Add(80 * time.Minute), Duration: 10 * time.Second,
+			Tasks: []buildstore.TaskTiming{{Name: ":lib:jar", Duration: 5 * time.Second}}},
+		{ProjectPath: "/projects/lib", Status: buildstore.StatusCancelled, SubmittedAt: start.Add(90 * time.Minute)},
+	}
+}
+
+func testQuery() Query {
+	return Query{From: start, To: start.Add(2 * time.Hour), Interval: time.Hour, Limit: DefaultLimit}
+}
+
+func TestParseQuery(t *testing.T) {
+	now := start.Add(24 * time.Hour)
+
+	query, err := ParseQuery(url.Values{}, now)
+	if err != nil {
+		t.Fatalf("ParseQuery failed: %v", err)
+	}
+	if !query.To.Equal(now) || !query.From.Equal(now.Add(-DefaultRange)) || query.Interval != DefaultInterval || query.Limit != DefaultLimit {
+		t.Errorf("Unexpected defaults %+v", query)
+	}
+
+	query, err = ParseQuery(url.Values{
+		"project":  {"/projects/app"},
+		"from":     {"2024-01-01T00:00:00Z"},
+		"to":       {"2024-01-08T00:00:00Z"},
+		"interval": {"1d"},
+		"limit":    {"5"},
+		"tag":      {"branch:main", "pr:42"},
+	}, now)
+	if err != nil {
+		t.Fatalf("ParseQuery failed: %v", err)
+	}
+	if query.ProjectPath != "/projects/app" || query.Interval != 24*time.Hour || query.Limit != 5 || query.To.Sub(query.From) != 7*24*time.Hour {
+		t.Errorf("Unexpected query %+v", query)
+	}
+	if filter := query.Filter(); filter.Tags["branch"] != "main" || filter.Tags["pr"] != "42" {
+		t.Errorf("Expected the tags to filter the builds, got %+v", filter)
+	}
+
+	for _, values := range []url.Values{
+		{"from": {"yesterday"}},
+		{"from": {"2024-01-02T00:00:00Z"}, "to": {"2024-01-01T00:00:00Z"}},
+		{"interval": {"hourly"}},
+		{"interval": {"-1h"}},
+		{"interval": {"1ms"}},
+		{"limit": {"0"}},
+		{"tag": {"main"}},
+	} {
+		if _, err := ParseQuery(values, now); err == nil {
+			t.Errorf("Expected error for %v", values)
+		}
+	}
+}
+
+func TestDurationTrends(t *testing.T) {
+	series := DurationTrends(testRecords(), testQuery())
+	if len(series) != 2 || series[0].Target != "/projects/app" || series[1].Target != "/projects/lib" {
+		t.Fatalf("Expected one series per project, got %+v", series)
+	}
+
+	// Failed builds are left out of the duration trend
+	app := series[0].Datapoints
+	if len(app) != 1 || app[0][0] != 90 || app[0][1] != float64(start.UnixMilli()) {
+		t.Errorf("Expected a 90s average in the first bucket, got %v", app)
+	}
+	lib := series[1].Datapoints
+	if len(lib) != 1 || lib[0][0] != 10 || lib[0][1] != float64(start.Add(time.Hour).UnixMilli()) {
+		t.Errorf("Expected a 10s average in the second bucket, got %v", lib)
+	}
+}
+
+func TestFailureRates(t *testing.T) {
+	series := FailureRates(testRecords(), testQuery())
+	if len(series) != 2 || series[0].Target != "failure_rate" || series[1].Target != "builds" {
+		t.Fatalf("Expected failure rate and build count series, got %+v", series)
+	}
+
+	expected := [][2]float64{{0, float64(start.UnixMilli())}, {0.5, float64(start.Add(time.Hour).UnixMilli())}}
+	rates := series[0].Datapoints
+	if len(rates) != 2 || rates[0] != expected[0] || rates[1] != expected[1] {
+		t.Errorf("Expected failure rates %v, got %v", expected, rates)
+	}
+	counts := series[1].Datapoints
+	if len(counts) != 2 || counts[0][0] != 2 || counts[1][0] != 2 {
+		t.Errorf("Expected 2 finished builds per bucket, got %v", counts)
+	}
+}
+
+func TestBusiestHours(t *testing.T) {
+	table := BusiestHours(testRecords())
+	if table.Type != "table" || len(table.Columns) != 3 || len(table.Rows) != 24 {
+		t.Fatalf("Expected a 24 row table, got %+v", table)
+	}
+
+	first, second := table.Rows[0], table.Rows[1]
+	if first[0] != 13 || first[1] != 3 || second[0] != 12 || second[1] != 2 {
+		t.Errorf("Expected 13:00 then 12:00 as busiest hours, got %v and %v", first, second)
+	}
+	if first[2] != 40.0/3 {
+		t.Errorf("Expected average duration %v, got %v", 40.0/3, first[2])
+	}
+}
+
+func TestSlowestTasks(t *testing.T) {
+	query := testQuery()
+	query.Limit = 2
+
+	table := SlowestTasks(testRecords(), query)
+	if len(table.Rows) != 2 {
+		t.Fatalf("Expected 2 tasks, got %+v", table.Rows)
+	}
+
+	expected := [][]any{
+		{":app:test", "/projects/app", 2, 60.0, 80.0},
+		{":app:compileJava", "/projects/app", 2, 30.0, 40.0},
+	}
+	for i, row := range table.Rows {
+		for j := range row {
+			if row[j] != expected[i][j] {
+				t.Errorf("Row %d: expected %v, got %v", i, expected[i], row)
+				break
+			}
+		}
+	}
+}
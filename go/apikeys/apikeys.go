@@ -0,0 +1,299 @@
+// Package apikeys manages the API keys non-interactive clients, such as CI
+// jobs, authenticate with in the X-API-Key header. Only a hash of each key is
+// stored; the key itself is shown once, when it is issued.
+package apikeys
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"distributed-gradle-building/auth"
+)
+
+// Scopes of API keys
+const (
+	// ScopeRead allows reading builds, workers and statistics
+	ScopeRead = "read"
+	// ScopeBuild allows submitting builds and pipelines
+	ScopeBuild = "build"
+	// ScopeArtifacts allows deleting build artifacts
+	ScopeArtifacts = "artifacts"
+	// ScopeWorker allows workers to connect over HTTP
+	ScopeWorker = "worker"
+	// ScopeAdmin allows everything, including managing API keys
+	ScopeAdmin = "admin"
+)
+
+// Scopes lists every scope a key may have
+var Scopes = []string{ScopeRead, ScopeBuild, ScopeArtifacts, ScopeWorker, ScopeAdmin}
+
+// ErrNotFound is returned for keys that were never issued
+var ErrNotFound = errors.New("API key not found")
+
+// keyPrefix starts every key, so leaked keys are easy to search for
+const keyPrefix = "dgb_"
+
+// Key is an issued API key
+type Key struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Scopes    []string  `json:"scopes"`
+	CreatedBy string    `json:"created_by,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	// ExpiresAt is nil for keys that do not expire
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+// Active reports whether the key is neither revoked nor expired at now
+func (k Key) Active(now time.Time) bool {
+	return k.RevokedAt == nil && (k.ExpiresAt == nil || now.Before(*k.ExpiresAt))
+}
+
+// HasScope reports whether the key allows a scope. Admin keys allow every
+// scope.
+func (k Key) HasScope(scope string) bool {
+	return slices.Contains(k.Scopes, scope) || slices.Contains(k.Scopes, ScopeAdmin)
+}
+
+// entry is a key as stored, with the hash of its secret
+type entry struct {
+	Key
+	Hash string `json:"hash"`
+}
+
+// Store is the set of issued keys. It is rewritten as a whole on every
+// change, like the worker registry. Keys are kept in memory only when the
+// store has no file.
+type Store struct {
+	mutex   sync.Mutex
+	path    string
+	entries map[string]entry
+	now     func() time.Time
+}
+
+// Open opens the store at path, loading the keys issued before. An empty
+// path keeps the keys in memory.
+func Open(path string) (*Store, error) {
+	s := &Store{path: path, entries: make(map[string]entry), now: time.Now}
+	if path == "" {
+		return s, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create API key directory: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read API keys: %v", err)
+	}
+
+	var entries []entry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("failed to parse API keys: %v", err)
+	}
+	for _, entry := range entries {
+		s.entries[entry.ID] = entry
+	}
+	return s, nil
+}
+
+// OpenFromEnv opens the store at API_KEYS_FILE, defaulting to
+// data/api-keys.json. It falls back to an in-memory store if the file cannot
+// be read, in which case keys issued before are not accepted.
+func OpenFromEnv() *Store {
+	path := os.Getenv("API_KEYS_FILE")
+	if path == "" {
+		path = filepath.Join("data", "api-keys.json")
+	}
+
+	s, err := Open(path)
+	if err != nil {
+		log.Printf("API key store unavailable, keeping keys in memory: %v", err)
+		s, _ = Open("")
+	}
+	return s
+}
+
+// Issue creates a key with scopes, expiring after ttl unless it is zero. It
+// returns the key and its secret, which is not stored.
+func (s *Store) Issue(name string, scopes []string, ttl time.Duration, createdBy string) (Key, string, error) {
+	if strings.TrimSpace(name) == "" {
+		return Key{}, "", fmt.Errorf("API key name is required")
+	}
+	if len(scopes) == 0 {
+		return Key{}, "", fmt.Errorf("API key needs at least one scope")
+	}
+	for _, scope := range scopes {
+		if !slices.Contains(Scopes, scope) {
+			return Key{}, "", fmt.Errorf("unknown scope %q, expected one of %s", scope, strings.Join(Scopes, ", "))
+		}
+	}
+	if ttl < 0 {
+		return Key{}, "", fmt.Errorf("API key lifetime must not be negative")
+	}
+
+	id, err := randomHex(6)
+	if err != nil {
+		return Key{}, "", err
+	}
+	random, err := randomHex(32)
+	if err != nil {
+		return Key{}, "", err
+	}
+	secret := keyPrefix + id + "_" + random
+
+	key := Key{
+		ID:        id,
+		Name:      name,
+		Scopes:    slices.Clone(scopes),
+		CreatedBy: createdBy,
+		CreatedAt: s.now().UTC(),
+	}
+	if ttl > 0 {
+		expires := key.CreatedAt.Add(ttl)
+		key.ExpiresAt = &expires
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.entries[id] = entry{Key: key, Hash: hash(secret)}
+	if err := s.save(); err != nil {
+		delete(s.entries, id)
+		return Key{}, "", err
+	}
+	return key, secret, nil
+}
+
+// Revoke revokes a key. Revoked keys are kept so the audit log can still be
+// related to their names.
+func (s *Store) Revoke(id string) (Key, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	stored, exists := s.entries[id]
+	if !exists {
+		return Key{}, fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+	if stored.RevokedAt == nil {
+		previous := stored
+		revoked := s.now().UTC()
+		stored.RevokedAt = &revoked
+		s.entries[id] = stored
+		if err := s.save(); err != nil {
+			s.entries[id] = previous
+			return Key{}, err
+		}
+	}
+	return stored.Key, nil
+}
+
+// List returns the issued keys sorted by creation time
+func (s *Store) List() []Key {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	keys := make([]Key, 0, len(s.entries))
+	for _, entry := range s.entries {
+		keys = append(keys, entry.Key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if !keys[i].CreatedAt.Equal(keys[j].CreatedAt) {
+			return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+		}
+		return keys[i].ID < keys[j].ID
+	})
+	return keys
+}
+
+// Authenticate returns the active key a secret belongs to
+func (s *Store) Authenticate(secret string) (Key, error) {
+	id, _, found := strings.Cut(strings.TrimPrefix(secret, keyPrefix), "_")
+	if !found || !strings.HasPrefix(secret, keyPrefix) {
+		return Key{}, fmt.Errorf("invalid API key")
+	}
+
+	s.mutex.Lock()
+	stored, exists := s.entries[id]
+	s.mutex.Unlock()
+	if !exists || subtle.ConstantTimeCompare([]byte(stored.Hash), []byte(hash(secret))) != 1 {
+		return Key{}, fmt.Errorf("invalid API key")
+	}
+	if stored.RevokedAt != nil {
+		return Key{}, fmt.Errorf("API key %s is revoked", id)
+	}
+	if !stored.Active(s.now()) {
+		return Key{}, fmt.Errorf("API key %s expired", id)
+	}
+	return stored.Key, nil
+}
+
+// ValidateAPIKey implements auth.APIKeyValidator. The claims carry the key ID
+// and its scopes as permissions.
+func (s *Store) ValidateAPIKey(secret string) (*auth.Claims, error) {
+	key, err := s.Authenticate(secret)
+	if err != nil {
+		return nil, err
+	}
+	return &auth.Claims{KeyID: key.ID, Permissions: slices.Clone(key.Scopes)}, nil
+}
+
+// save writes the store to a temporary file and renames it over the store,
+// readable only by the coordinator. Must be called with the mutex held.
+func (s *Store) save() error {
+	if s.path == "" {
+		return nil
+	}
+
+	entries := make([]entry, 0, len(s.entries))
+	for _, entry := range s.entries {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ID < entries[j].ID })
+
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode API keys: %v", err)
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write API keys: %v", err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("failed to replace API keys: %v", err)
+	}
+	return nil
+}
+
+// hash returns the hex SHA-256 of a secret. Keys are random enough that a
+// fast unsalted hash cannot be reversed.
+func hash(secret string) string {
+	digest := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(digest[:])
+}
+
+// randomHex returns n random bytes as hex
+func randomHex(n int) (string, error) {
+	data := make([]byte, n)
+	if _, err := rand.Read(data); err != nil {
+		return "", fmt.Errorf("failed to generate API key: %v", err)
+	}
+	return hex.EncodeToString(data), nil
+}
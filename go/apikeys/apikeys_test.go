@@ -0,0 +1,111 @@
+package apikeys
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIssueAndAuthenticate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys", "api-keys.json")
+	store, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+
+	key, secret, err := store.Issue("jenkins", []string{ScopeBuild, ScopeRead}, 0, "user:root")
+	if err != nil {
+		t.Fatalf("Issue failed: %v", err)
+	}
+	if key.ExpiresAt != nil || key.CreatedBy != "user:root" || !strings.HasPrefix(secret, keyPrefix+key.ID+"_") {
+		t.Errorf("Unexpected key %+v with secret %s", key, secret)
+	}
+
+	// Only the hash of the secret is stored
+	data, _ := os.ReadFile(path)
+	if strings.Contains(string(data), secret) || !strings.Contains(string(data), hash(secret)) {
+		t.Errorf("Expected only the hash to be stored, got %s", data)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("Expected the store to be private, got %v", info.Mode())
+	}
+
+	// Keys survive a restart
+	reopened, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	claims, err := reopened.ValidateAPIKey(secret)
+	if err != nil {
+		t.Fatalf("ValidateAPIKey failed: %v", err)
+	}
+	if claims.KeyID != key.ID || len(claims.Permissions) != 2 {
+		t.Errorf("Expected the key ID and scopes in the claims, got %+v", claims)
+	}
+
+	for _, wrong := range []string{"", "dgb_", secret + "x", strings.Replace(secret, key.ID, "000000000000", 1), strings.TrimPrefix(secret, keyPrefix)} {
+		if _, err := reopened.Authenticate(wrong); err == nil {
+			t.Errorf("Expected %q to be rejected", wrong)
+		}
+	}
+}
+
+func TestRevokeAndExpiry(t *testing.T) {
+	store, _ := Open("")
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	store.now = func() time.Time { return now }
+
+	expiring, expiringSecret, _ := store.Issue("nightly", []string{ScopeRead}, time.Hour, "")
+	revoked, revokedSecret, _ := store.Issue("old-ci", []string{ScopeAdmin}, 0, "")
+
+	if _, err := store.Revoke(revoked.ID); err != nil {
+		t.Fatalf("Revoke failed: %v", err)
+	}
+	if _, err := store.Authenticate(revokedSecret); err == nil || !strings.Contains(err.Error(), "revoked") {
+		t.Errorf("Expected the revoked key to be rejected, got %v", err)
+	}
+	if _, err := store.Revoke("missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+
+	if _, err := store.Authenticate(expiringSecret); err != nil {
+		t.Errorf("Expected the key to be valid before it expires, got %v", err)
+	}
+	now = now.Add(time.Hour)
+	if _, err := store.Authenticate(expiringSecret); err == nil || !strings.Contains(err.Error(), "expired") {
+		t.Errorf("Expected the key to expire, got %v", err)
+	}
+
+	keys := store.List()
+	if len(keys) != 2 || keys[0].ID != expiring.ID || keys[1].RevokedAt == nil || keys[0].Active(now) {
+		t.Errorf("Expected both keys, the second revoked, got %+v", keys)
+	}
+	if !keys[1].HasScope(ScopeBuild) || keys[0].HasScope(ScopeBuild) {
+		t.Error("Expected admin keys to have every scope")
+	}
+}
+
+func TestIssueValidation(t *testing.T) {
+	store, _ := Open("")
+	invalid := map[string]struct {
+		name   string
+		scopes []string
+		ttl    time.Duration
+	}{
+		"no name":         {"", []string{ScopeRead}, 0},
+		"no scopes":       {"ci", nil, 0},
+		"unknown scope":   {"ci", []string{"write"}, 0},
+		"negative expiry": {"ci", []string{ScopeRead}, -time.Hour},
+	}
+	for name, tc := range invalid {
+		if _, _, err := store.Issue(tc.name, tc.scopes, tc.ttl, ""); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+	if len(store.List()) != 0 {
+		t.Errorf("Expected no key to be issued, got %+v", store.List())
+	}
+}
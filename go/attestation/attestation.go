@@ -0,0 +1,166 @@
+// Package attestation lets workers prove what they run when they register.
+// A worker signs a statement of its binary's checksum, its platform and its
+// public key with its private key, and the coordinator checks the statement
+// against an allowlist before it sends the worker any build, and with it the
+// project's source.
+package attestation
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime"
+	"slices"
+	"strings"
+	"time"
+
+	"distributed-gradle-building/protocol"
+	"distributed-gradle-building/signing"
+)
+
+// MaxAge is how far the time a statement was issued at may be from the
+// coordinator's clock, so a captured attestation cannot be replayed later
+const MaxAge = 5 * time.Minute
+
+// Statement is what a worker attests to
+type Statement struct {
+	WorkerID string `json:"worker_id"`
+	// BinarySHA256 is the hex encoded SHA-256 of the worker binary
+	BinarySHA256 string `json:"binary_sha256"`
+	// Platform is the operating system and architecture, such as linux/amd64
+	Platform string `json:"platform"`
+	// Key is the public key the statement is signed with
+	Key      signing.PublicKey `json:"key"`
+	IssuedAt time.Time         `json:"issued_at"`
+}
+
+// Attestation is a statement and its signature, as the signing.Header value
+// of the encoded statement
+type Attestation struct {
+	Statement []byte `json:"statement"`
+	Signature string `json:"signature"`
+}
+
+// Platform returns the platform of the running binary
+func Platform() string {
+	return runtime.GOOS + "/" + runtime.GOARCH
+}
+
+// Attest signs a statement that the binary at path runs as a worker
+func Attest(signer *signing.Signer, workerID, binary string, now time.Time) (*Attestation, error) {
+	checksum, err := protocol.FileSHA256(binary)
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash the worker binary: %v", err)
+	}
+	statement, err := json.Marshal(Statement{
+		WorkerID:     workerID,
+		BinarySHA256: checksum,
+		Platform:     Platform(),
+		Key:          signer.PublicKey(),
+		IssuedAt:     now.UTC(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Attestation{Statement: statement, Signature: signer.Sign(statement)}, nil
+}
+
+// Policy lists the keys, binaries and platforms of the workers allowed to
+// register. A worker must sign with one of the keys. The binary and platform
+// are reported by the worker itself, so they only keep enrolled workers on
+// approved releases; an empty list of either allows any.
+type Policy struct {
+	// Keys are base64 encoded Ed25519 public keys, as the PublicKey of
+	// signing.PublicKey. A policy without keys allows no worker.
+	Keys []string `json:"keys"`
+	// Binaries are hex encoded SHA-256 checksums of worker binaries
+	Binaries  []string `json:"binaries"`
+	Platforms []string `json:"platforms"`
+}
+
+// LoadPolicy reads a JSON policy, which must list at least one key
+func LoadPolicy(path string) (*Policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var policy Policy
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return nil, fmt.Errorf("invalid attestation policy %s: %v", path, err)
+	}
+	if len(policy.Keys) == 0 {
+		return nil, fmt.Errorf("invalid attestation policy %s: no keys, any worker could sign its own statement", path)
+	}
+	for _, key := range policy.Keys {
+		if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid attestation policy %s: %q is not an Ed25519 public key", path, key)
+		}
+	}
+	for _, checksum := range policy.Binaries {
+		if len(checksum) != 64 || strings.Trim(strings.ToLower(checksum), "0123456789abcdef") != "" {
+			return nil, fmt.Errorf("invalid attestation policy %s: %q is not a SHA-256 checksum", path, checksum)
+		}
+	}
+	return &policy, nil
+}
+
+// LoadPolicyFromEnv loads the policy at WORKER_ATTESTATION_POLICY. It
+// returns nil if the variable is unset, letting workers register without
+// attestation.
+func LoadPolicyFromEnv() (*Policy, error) {
+	path := os.Getenv("WORKER_ATTESTATION_POLICY")
+	if path == "" {
+		return nil, nil
+	}
+	return LoadPolicy(path)
+}
+
+// Verify checks that an attestation of a worker is signed by the key it
+// names, recent, and allowed by the policy, returning its statement.
+// Binaries in released are allowed besides those of the policy, so workers
+// keep registering after updating to a release the coordinator published.
+func (p *Policy) Verify(attestation *Attestation, workerID string, released []string, now time.Time) (*Statement, error) {
+	if attestation == nil {
+		return nil, fmt.Errorf("no attestation presented")
+	}
+	var statement Statement
+	if err := json.Unmarshal(attestation.Statement, &statement); err != nil {
+		return nil, fmt.Errorf("invalid statement: %v", err)
+	}
+	verifier, err := signing.NewVerifier(statement.Key)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifier.Verify(attestation.Statement, attestation.Signature); err != nil {
+		return nil, err
+	}
+	if statement.WorkerID != workerID {
+		return nil, fmt.Errorf("statement is for worker %s", statement.WorkerID)
+	}
+	if age := now.Sub(statement.IssuedAt); age > MaxAge || age < -MaxAge {
+		return nil, fmt.Errorf("statement was issued at %s, more than %v from now", statement.IssuedAt.Format(time.RFC3339), MaxAge)
+	}
+	if err := p.Allows(statement, released); err != nil {
+		return nil, err
+	}
+	return &statement, nil
+}
+
+// Allows checks a verified statement against the policy. The statement is
+// signed with the key it names, so it is only trusted if the key is listed.
+func (p *Policy) Allows(statement Statement, released []string) error {
+	if !slices.Contains(p.Keys, statement.Key.PublicKey) {
+		return fmt.Errorf("key %s is not allowed", statement.Key.KeyID)
+	}
+	if len(p.Binaries) > 0 && !slices.ContainsFunc(append(slices.Clone(p.Binaries), released...), func(checksum string) bool {
+		return strings.EqualFold(checksum, statement.BinarySHA256)
+	}) {
+		return fmt.Errorf("binary %s is not allowed", statement.BinarySHA256)
+	}
+	if len(p.Platforms) > 0 && !slices.Contains(p.Platforms, statement.Platform) {
+		return fmt.Errorf("platform %s is not allowed", statement.Platform)
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package attestation
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"distributed-gradle-building/protocol"
+	"distributed-gradle-building/signing"
+)
+
+func TestVerify(t *testing.T) {
+	binary := filepath.Join(t.TempDir(), "worker")
+	os.WriteFile(binary, []byte("worker binary"), 0755)
+	checksum, _ := protocol.FileSHA256(binary)
+	signer, err := signing.Generate()
+	if err != nil {
+		t.Fatalf("Generate failed: %v", err)
+	}
+	rogue, _ := signing.Generate()
+	now := time.Now()
+
+	attestation, err := Attest(signer, "worker-1", binary, now)
+	if err != nil {
+		t.Fatalf("Attest failed: %v", err)
+	}
+	policy := &Policy{Keys: []string{signer.PublicKey().PublicKey}, Binaries: []string{strings.ToUpper(checksum)}, Platforms: []string{Platform()}}
+	statement, err := policy.Verify(attestation, "worker-1", nil, now.Add(time.Minute))
+	if err != nil {
+		t.Fatalf("Expected the attestation to verify, got %v", err)
+	}
+	if statement.BinarySHA256 != checksum || statement.Key.KeyID != signer.KeyID() || statement.Platform != Platform() {
+		t.Errorf("Unexpected statement %+v", statement)
+	}
+
+	forged := *attestation
+	var altered Statement
+	json.Unmarshal(forged.Statement, &altered)
+	altered.BinarySHA256 = strings.Repeat("0", 64)
+	forged.Statement, _ = json.Marshal(altered)
+	rogueAttestation, _ := Attest(rogue, "worker-1", binary, now)
+
+	// A rogue worker signing its own claim to an allowed binary is rejected
+	// even by a policy listing no keys
+	selfSigned, _ := Attest(rogue, "worker-1", binary, now)
+	keyless := &Policy{Binaries: []string{checksum}, Platforms: []string{Platform()}}
+	_, selfSignedErr := keyless.Verify(selfSigned, "worker-1", nil, now)
+
+	verify := func(attestation *Attestation, workerID string, at time.Time) error {
+		_, err := policy.Verify(attestation, workerID, nil, at)
+		return err
+	}
+	key := []string{signer.PublicKey().PublicKey}
+	for name, err := range map[string]error{
+		"missing":        verify(nil, "worker-1", now),
+		"forged":         verify(&forged, "worker-1", now),
+		"other worker":   verify(attestation, "worker-2", now),
+		"replayed":       verify(attestation, "worker-1", now.Add(MaxAge+time.Second)),
+		"rogue key":      verify(rogueAttestation, "worker-1", now),
+		"self-signed":    selfSignedErr,
+		"other binary":   (&Policy{Keys: key, Binaries: []string{strings.Repeat("a", 64)}}).Allows(*statement, nil),
+		"other platform": (&Policy{Keys: key, Platforms: []string{"plan9/386"}}).Allows(*statement, nil),
+	} {
+		if err == nil {
+			t.Errorf("Expected the %s attestation to be rejected", name)
+		}
+	}
+
+	// Published releases are allowed besides the listed binaries
+	if err := (&Policy{Keys: key, Binaries: []string{strings.Repeat("a", 64)}}).Allows(*statement, []string{checksum}); err != nil {
+		t.Errorf("Expected the released binary to be allowed, got %v", err)
+	}
+	if err := (&Policy{Keys: key}).Allows(*statement, nil); err != nil {
+		t.Errorf("Expected a policy listing only keys to allow any binary and platform, got %v", err)
+	}
+}
+
+func TestLoadPolicy(t *testing.T) {
+	signer, _ := signing.Generate()
+	dir := t.TempDir()
+	write := func(policy string) string {
+		path := filepath.Join(dir, "policy.json")
+		os.WriteFile(path, []byte(policy), 0644)
+		return path
+	}
+
+	policy, err := LoadPolicy(write(`{"keys": ["` + signer.PublicKey().PublicKey + `"], "binaries": ["` + strings.Repeat("ab", 32) + `"], "platforms": ["linux/amd64"]}`))
+	if err != nil || len(policy.Keys) != 1 || len(policy.Binaries) != 1 || policy.Platforms[0] != "linux/amd64" {
+		t.Errorf("Expected the policy to load, got %+v: %v", policy, err)
+	}
+	valid := `"keys": ["` + signer.PublicKey().PublicKey + `"]`
+	for _, invalid := range []string{`{"keys": ["not a key"]}`, `{` + valid + `, "binaries": ["abc"]}`, `{"keys": `, `{}`, `{"binaries": ["` + strings.Repeat("ab", 32) + `"]}`} {
+		if _, err := LoadPolicy(write(invalid)); err == nil {
+			t.Errorf("Expected %s to be rejected", invalid)
+		}
+	}
+}
@@ -0,0 +1,372 @@
+// Package audit records an append-only log of API mutations: who did what,
+// when and from where. Events are stored as JSON lines so the log can be
+// shipped and inspected with standard tools.
+package audit
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"distributed-gradle-building/auth"
+	"distributed-gradle-building/openapi"
+)
+
+// Audited actions
+const (
+	ActionBuildSubmitted     = "build.submitted"
+	ActionBuildCancelled     = "build.cancelled"
+	ActionBuildPaused        = "build.paused"
+	ActionBuildResumed       = "build.resumed"
+	ActionBuildAnnotated     = "build.annotated"
+	ActionWorkerRegistered   = "worker.registered"
+	ActionWorkerUnregistered = "worker.unregistered"
+	ActionWorkerEvicted      = "worker.evicted"
+	ActionWorkerPreempted    = "worker.preempted"
+	ActionWorkerQuarantined  = "worker.quarantined"
+	ActionWorkerReleased     = "worker.released"
+	ActionWorkerRejected     = "worker.rejected"
+	ActionModelTrained       = "model.trained"
+	ActionModelRolledBack    = "model.rolled_back"
+	ActionDataImported       = "data.imported"
+	ActionChaosConfigured    = "chaos.configured"
+	ActionArtifactsDeleted   = "artifacts.deleted"
+	ActionArtifactsPublished = "artifacts.published"
+	ActionAccessDenied       = "access.denied"
+	ActionAPIKeyIssued       = "apikey.issued"
+	ActionAPIKeyRevoked      = "apikey.revoked"
+	ActionUserLoggedIn       = "user.logged_in"
+	ActionProjectUploaded    = "project.uploaded"
+)
+
+// DefaultLimit is the number of events returned by a query without a limit
+const DefaultLimit = 100
+
+// Event is a single audited mutation
+type Event struct {
+	ID        int64             `json:"id"`
+	Timestamp time.Time         `json:"timestamp"`
+	Action    string            `json:"action"`
+	Principal string            `json:"principal"`
+	SourceIP  string            `json:"source_ip"`
+	Resource  string            `json:"resource"`
+	Details   map[string]string `json:"details,omitempty"`
+}
+
+// Filter selects events from the log. Empty fields match every event.
+type Filter struct {
+	Action    string
+	Principal string
+	SourceIP  string
+	Resource  string
+	Since     time.Time
+	Until     time.Time
+	Limit     int
+}
+
+// Log is an append-only audit log. Events are kept in memory only when the
+// log has no file.
+type Log struct {
+	mutex  sync.Mutex
+	path   string
+	file   *os.File
+	events []Event
+	nextID int64
+}
+
+// Open opens the audit log at path, creating it if needed. An empty path
+// keeps events in memory.
+func Open(path string) (*Log, error) {
+	if path == "" {
+		return &Log{nextID: 1}, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create audit log directory: %v", err)
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %v", err)
+	}
+
+	l := &Log{path: path, file: file, nextID: 1}
+	err = l.scan(func(event Event) {
+		if event.ID >= l.nextID {
+			l.nextID = event.ID + 1
+		}
+	})
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// OpenFromEnv opens the audit log at AUDIT_LOG_FILE, defaulting to
+// data/audit.log. It falls back to an in-memory log if the file cannot be
+// opened so auditing never stops a service from starting.
+func OpenFromEnv() *Log {
+	path := os.Getenv("AUDIT_LOG_FILE")
+	if path == "" {
+		path = filepath.Join("data", "audit.log")
+	}
+
+	l, err := Open(path)
+	if err != nil {
+		log.Printf("Audit log unavailable, keeping events in memory: %v", err)
+		l, _ = Open("")
+	}
+	return l
+}
+
+// Record appends an event, assigning its ID and timestamp
+func (l *Log) Record(event Event) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	event.ID = l.nextID
+	if event.Timestamp.IsZero() {
+		event.Timestamp = time.Now().UTC()
+	}
+
+	if l.file == nil {
+		l.events = append(l.events, event)
+		l.nextID++
+		return nil
+	}
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to encode audit event: %v", err)
+	}
+	if _, err := l.file.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write audit event: %v", err)
+	}
+
+	l.nextID++
+	return nil
+}
+
+// RecordRequest records an event performed through an HTTP request, taking
+// the principal and source IP from the request. Failures are logged rather
+// than returned so auditing never fails the request itself.
+func (l *Log) RecordRequest(r *http.Request, action, resource string, details map[string]string) {
+	err := l.Record(Event{
+		Action:    action,
+		Principal: Principal(r),
+		SourceIP:  SourceIP(r),
+		Resource:  resource,
+		Details:   details,
+	})
+	if err != nil {
+		log.Printf("Failed to record audit event %s for %s: %v", action, resource, err)
+	}
+}
+
+// Query returns the events matching a filter in the order they were
+// recorded. When more events match than the limit, the most recent are kept.
+func (l *Log) Query(filter Filter) ([]Event, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = DefaultLimit
+	}
+
+	events := []Event{}
+	err := l.scan(func(event Event) {
+		if !filter.matches(event) {
+			return
+		}
+		events = append(events, event)
+		if len(events) > limit {
+			events = events[1:]
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return events, nil
+}
+
+// Close closes the log file
+func (l *Log) Close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.file == nil {
+		return nil
+	}
+	return l.file.Close()
+}
+
+// scan calls fn for every recorded event. Must be called with the mutex held.
+func (l *Log) scan(fn func(Event)) error {
+	if l.file == nil {
+		for _, event := range l.events {
+			fn(event)
+		}
+		return nil
+	}
+
+	file, err := os.Open(l.path)
+	if err != nil {
+		return fmt.Errorf("failed to read audit log: %v", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var event Event
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			// A torn write from a crash only affects the last line
+			continue
+		}
+		fn(event)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read audit log: %v", err)
+	}
+	return nil
+}
+
+// matches reports whether an event passes the filter
+func (f Filter) matches(event Event) bool {
+	switch {
+	case f.Action != "" && event.Action != f.Action:
+		return false
+	case f.Principal != "" && event.Principal != f.Principal:
+		return false
+	case f.SourceIP != "" && event.SourceIP != f.SourceIP:
+		return false
+	case f.Resource != "" && event.Resource != f.Resource:
+		return false
+	case !f.Since.IsZero() && event.Timestamp.Before(f.Since):
+		return false
+	case !f.Until.IsZero() && event.Timestamp.After(f.Until):
+		return false
+	}
+	return true
+}
+
+// ParseFilter reads a filter from the query parameters action, principal,
+// source_ip, resource, since, until (RFC 3339) and limit
+func ParseFilter(query url.Values) (Filter, error) {
+	filter := Filter{
+		Action:    query.Get("action"),
+		Principal: query.Get("principal"),
+		SourceIP:  query.Get("source_ip"),
+		Resource:  query.Get("resource"),
+	}
+
+	var err error
+	if since := query.Get("since"); since != "" {
+		if filter.Since, err = time.Parse(time.RFC3339, since); err != nil {
+			return Filter{}, fmt.Errorf("invalid since: %v", err)
+		}
+	}
+	if until := query.Get("until"); until != "" {
+		if filter.Until, err = time.Parse(time.RFC3339, until); err != nil {
+			return Filter{}, fmt.Errorf("invalid until: %v", err)
+		}
+	}
+	if limit := query.Get("limit"); limit != "" {
+		if filter.Limit, err = strconv.Atoi(limit); err != nil || filter.Limit <= 0 {
+			return Filter{}, fmt.Errorf("invalid limit: %s", limit)
+		}
+	}
+
+	return filter, nil
+}
+
+// Handler serves GET requests querying the log with the filters of ParseFilter
+func (l *Log) Handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		filter, err := ParseFilter(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		events, err := l.Query(filter)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(events)
+	}
+}
+
+// Route describes the GET /api/audit endpoint served by Handler
+func Route() openapi.Route {
+	return openapi.Route{
+		Method:      "GET",
+		Path:        "/api/audit",
+		Summary:     "Query the audit log of API mutations",
+		OperationID: "queryAuditLog",
+		Parameters: []openapi.Parameter{
+			openapi.QueryParam("action", "string", "", "Only events of this action, e.g. build.submitted"),
+			openapi.QueryParam("principal", "string", "", "Only events of this principal"),
+			openapi.QueryParam("source_ip", "string", "", "Only events from this source IP"),
+			openapi.QueryParam("resource", "string", "", "Only events on this build or worker ID"),
+			openapi.QueryParam("since", "string", "date-time", "Only events at or after this time"),
+			openapi.QueryParam("until", "string", "date-time", "Only events at or before this time"),
+			openapi.QueryParam("limit", "integer", "", "Maximum number of most recent events (default 100)"),
+		},
+		Response: []Event{},
+	}
+}
+
+// Principal identifies the caller of a request: the user of a JWT, the ID
+// of a managed API key, a digest of any other bearer token or API key, or
+// "anonymous". Raw tokens are never recorded.
+func Principal(r *http.Request) string {
+	if claims, ok := auth.GetClaimsFromContext(r); ok {
+		if claims.UserID != "" {
+			return "user:" + claims.UserID
+		}
+		if claims.KeyID != "" {
+			return "key:" + claims.KeyID
+		}
+	}
+
+	token := r.Header.Get("X-API-Key")
+	if bearer, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); found {
+		token = bearer
+	}
+	if token != "" {
+		digest := sha256.Sum256([]byte(token))
+		return "token:" + hex.EncodeToString(digest[:6])
+	}
+
+	return "anonymous"
+}
+
+// SourceIP returns the remote address of a request without its port
+func SourceIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,168 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"distributed-gradle-building/auth"
+)
+
+func TestLogPersistsEvents(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit", "audit.log")
+
+	l, err := Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open audit log: %v", err)
+	}
+	l.Record(Event{Action: ActionBuildSubmitted, Principal: "user:alice", Resource: "build-1"})
+	l.Record(Event{Action: ActionBuildCancelled, Principal: "user:bob", Resource: "build-1"})
+	l.Close()
+
+	// Reopening continues the sequence after the persisted events
+	l, err = Open(path)
+	if err != nil {
+		t.Fatalf("Failed to reopen audit log: %v", err)
+	}
+	defer l.Close()
+	l.Record(Event{Action: ActionWorkerRegistered, Principal: "worker:worker-1", Resource: "worker-1"})
+
+	events, err := l.Query(Filter{})
+	if err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+	if len(events) != 3 {
+		t.Fatalf("Expected 3 events, got %d", len(events))
+	}
+	for i, event := range events {
+		if event.ID != int64(i+1) {
+			t.Errorf("Expected event %d to have ID %d, got %d", i, i+1, event.ID)
+		}
+		if event.Timestamp.IsZero() {
+			t.Errorf("Expected event %d to have a timestamp", i)
+		}
+	}
+}
+
+func TestQueryFilters(t *testing.T) {
+	l, _ := Open("")
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	l.Record(Event{Timestamp: start, Action: ActionBuildSubmitted, Principal: "user:alice", SourceIP: "10.0.0.1", Resource: "build-1"})
+	l.Record(Event{Timestamp: start.Add(time.Minute), Action: ActionBuildSubmitted, Principal: "user:bob", SourceIP: "10.0.0.2", Resource: "build-2"})
+	l.Record(Event{Timestamp: start.Add(2 * time.Minute), Action: ActionBuildCancelled, Principal: "user:alice", SourceIP: "10.0.0.1", Resource: "build-2"})
+
+	tests := []struct {
+		name     string
+		filter   Filter
+		expected []int64
+	}{
+		{"all", Filter{}, []int64{1, 2, 3}},
+		{"action", Filter{Action: ActionBuildSubmitted}, []int64{1, 2}},
+		{"principal", Filter{Principal: "user:alice"}, []int64{1, 3}},
+		{"source ip", Filter{SourceIP: "10.0.0.2"}, []int64{2}},
+		{"resource", Filter{Resource: "build-2"}, []int64{2, 3}},
+		{"time range", Filter{Since: start.Add(30 * time.Second), Until: start.Add(90 * time.Second)}, []int64{2}},
+		{"limit keeps most recent", Filter{Limit: 2}, []int64{2, 3}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			events, err := l.Query(tt.filter)
+			if err != nil {
+				t.Fatalf("Query failed: %v", err)
+			}
+			if len(events) != len(tt.expected) {
+				t.Fatalf("Expected events %v, got %+v", tt.expected, events)
+			}
+			for i, event := range events {
+				if event.ID != tt.expected[i] {
+					t.Errorf("Expected event %d, got %d", tt.expected[i], event.ID)
+				}
+			}
+		})
+	}
+}
+
+func TestParseFilter(t *testing.T) {
+	filter, err := ParseFilter(url.Values{
+		"action":    {ActionBuildSubmitted},
+		"principal": {"user:alice"},
+		"since":     {"2024-01-01T12:00:00Z"},
+		"limit":     {"10"},
+	})
+	if err != nil {
+		t.Fatalf("ParseFilter failed: %v", err)
+	}
+	if filter.Action != ActionBuildSubmitted || filter.Principal != "user:alice" || filter.Limit != 10 {
+		t.Errorf("Unexpected filter %+v", filter)
+	}
+	if !filter.Since.Equal(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)) {
+		t.Errorf("Unexpected since %v", filter.Since)
+	}
+
+	for _, query := range []url.Values{{"since": {"yesterday"}}, {"until": {"1704110400"}}, {"limit": {"0"}}, {"limit": {"ten"}}} {
+		if _, err := ParseFilter(query); err == nil {
+			t.Errorf("Expected error for %v", query)
+		}
+	}
+}
+
+func TestRecordRequest(t *testing.T) {
+	l, _ := Open("")
+
+	r := httptest.NewRequest("POST", "/api/build", nil)
+	r.RemoteAddr = "192.168.1.10:53211"
+	r.Header.Set("Authorization", "Bearer service-token")
+	l.RecordRequest(r, ActionBuildSubmitted, "build-1", map[string]string{"task_name": "build"})
+
+	r = httptest.NewRequest("POST", "/api/build", nil)
+	r = r.WithContext(context.WithValue(r.Context(), "claims", &auth.Claims{UserID: "alice"}))
+	l.RecordRequest(r, ActionBuildSubmitted, "build-2", nil)
+
+	l.RecordRequest(httptest.NewRequest("POST", "/api/build", nil), ActionBuildSubmitted, "build-3", nil)
+
+	events, _ := l.Query(Filter{})
+	if events[0].SourceIP != "192.168.1.10" {
+		t.Errorf("Expected source IP without port, got %s", events[0].SourceIP)
+	}
+	if events[0].Principal == "" || events[0].Principal == "token:service-token" || events[0].Details["task_name"] != "build" {
+		t.Errorf("Expected hashed token principal and details, got %+v", events[0])
+	}
+	if events[1].Principal != "user:alice" {
+		t.Errorf("Expected JWT user principal, got %s", events[1].Principal)
+	}
+	if events[2].Principal != "anonymous" {
+		t.Errorf("Expected anonymous principal, got %s", events[2].Principal)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	l, _ := Open("")
+	l.Record(Event{Action: ActionBuildSubmitted, Resource: "build-1"})
+	l.Record(Event{Action: ActionWorkerRegistered, Resource: "worker-1"})
+
+	w := httptest.NewRecorder()
+	l.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/api/audit?action=worker.registered", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+
+	var events []Event
+	if err := json.Unmarshal(w.Body.Bytes(), &events); err != nil {
+		t.Fatalf("Failed to decode events: %v", err)
+	}
+	if len(events) != 1 || events[0].Resource != "worker-1" {
+		t.Errorf("Expected the worker registration, got %+v", events)
+	}
+
+	w = httptest.NewRecorder()
+	l.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/api/audit?limit=-1", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d for invalid filter, got %d", http.StatusBadRequest, w.Code)
+	}
+}
@@ -2,9 +2,12 @@ package auth
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"os"
 	"strings"
 	"time"
 
@@ -18,6 +21,7 @@ type AuthService struct {
 	tokenTTL      time.Duration
 	allowedTokens map[string]bool
 	adminTokens   map[string]bool
+	apiKeys       APIKeyValidator
 }
 
 // Claims represents JWT claims
@@ -25,9 +29,17 @@ type Claims struct {
 	UserID      string   `json:"user_id"`
 	Role        string   `json:"role"`
 	Permissions []string `json:"permissions"`
+	// KeyID is set instead of UserID for requests authenticated with an
+	// API key, whose scopes are the permissions
+	KeyID string `json:"key_id,omitempty"`
 	jwt.StandardClaims
 }
 
+// APIKeyValidator validates the API keys clients send in the X-API-Key header
+type APIKeyValidator interface {
+	ValidateAPIKey(key string) (*Claims, error)
+}
+
 // NewAuthService creates a new authentication service
 func NewAuthService(secretKey string, tokenTTL time.Duration) *AuthService {
 	return &AuthService{
@@ -38,6 +50,51 @@ func NewAuthService(secretKey string, tokenTTL time.Duration) *AuthService {
 	}
 }
 
+// NewAuthServiceFromEnv creates an authentication service from AUTH_JWT_SECRET,
+// AUTH_TOKEN_TTL and the comma separated service tokens in AUTH_API_TOKENS
+// and admin tokens in AUTH_ADMIN_TOKENS. It returns nil when neither a
+// secret nor tokens are configured.
+func NewAuthServiceFromEnv() *AuthService {
+	secret := os.Getenv("AUTH_JWT_SECRET")
+	tokens := os.Getenv("AUTH_API_TOKENS")
+	adminTokens := os.Getenv("AUTH_ADMIN_TOKENS")
+	if secret == "" && tokens == "" && adminTokens == "" {
+		return nil
+	}
+
+	if secret == "" {
+		// Without a configured secret only service tokens are accepted, so
+		// sign with a random key nobody can forge JWTs for
+		key := make([]byte, 32)
+		rand.Read(key)
+		secret = hex.EncodeToString(key)
+	}
+
+	ttl := 24 * time.Hour
+	if value, err := time.ParseDuration(os.Getenv("AUTH_TOKEN_TTL")); err == nil && value > 0 {
+		ttl = value
+	}
+
+	service := NewAuthService(secret, ttl)
+	for _, token := range strings.Split(tokens, ",") {
+		if token = strings.TrimSpace(token); token != "" {
+			service.AddAllowedToken(token)
+		}
+	}
+	for _, token := range strings.Split(adminTokens, ",") {
+		if token = strings.TrimSpace(token); token != "" {
+			service.AddAdminToken(token)
+		}
+	}
+	return service
+}
+
+// SetAPIKeys makes the middleware accept the keys of a validator in the
+// X-API-Key header
+func (a *AuthService) SetAPIKeys(validator APIKeyValidator) {
+	a.apiKeys = validator
+}
+
 // GenerateToken generates a new JWT token
 func (a *AuthService) GenerateToken(userID, role string, permissions []string) (string, error) {
 	claims := &Claims{
@@ -104,6 +161,18 @@ func (a *AuthService) AuthMiddleware(next http.Handler) http.Handler {
 			return
 		}
 
+		// Non-interactive clients authenticate with an API key
+		if key := r.Header.Get("X-API-Key"); key != "" && a.apiKeys != nil {
+			claims, err := a.apiKeys.ValidateAPIKey(key)
+			if err != nil {
+				sendAuthError(w, errors.NewAPIError(errors.ErrCodeUnauthorized, err.Error()))
+				return
+			}
+			ctx := context.WithValue(r.Context(), "claims", claims)
+			next.ServeHTTP(w, r.WithContext(ctx))
+			return
+		}
+
 		// Get token from Authorization header
 		authHeader := r.Header.Get("Authorization")
 		if authHeader == "" {
@@ -121,7 +190,7 @@ func (a *AuthService) AuthMiddleware(next http.Handler) http.Handler {
 		token := tokenParts[1]
 
 		// Check static token list first (for service tokens)
-		if a.IsAllowed(token) {
+		if a.IsAllowed(token) || a.IsAdmin(token) {
 			next.ServeHTTP(w, r)
 			return
 		}
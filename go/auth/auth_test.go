@@ -2,6 +2,7 @@ package auth
 
 import (
 	"context"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -301,3 +302,82 @@ func TestRequirePermissionMiddleware(t *testing.T) {
 		t.Errorf("Expected status 403 for missing permission, got %d", rr.Code)
 	}
 }
+
+func TestNewAuthServiceFromEnv(t *testing.T) {
+	t.Setenv("AUTH_JWT_SECRET", "")
+	t.Setenv("AUTH_API_TOKENS", "")
+	if service := NewAuthServiceFromEnv(); service != nil {
+		t.Error("Expected authentication to be disabled without configuration")
+	}
+
+	t.Setenv("AUTH_API_TOKENS", "token-a, token-b")
+	service := NewAuthServiceFromEnv()
+	if service == nil {
+		t.Fatal("Expected AuthService to be created")
+	}
+	if !service.IsAllowed("token-a") || !service.IsAllowed("token-b") {
+		t.Error("Expected configured service tokens to be allowed")
+	}
+
+	t.Setenv("AUTH_API_TOKENS", "")
+	t.Setenv("AUTH_ADMIN_TOKENS", "admin-token")
+	if service := NewAuthServiceFromEnv(); service == nil || !service.IsAdmin("admin-token") {
+		t.Error("Expected configured admin tokens to be admins")
+	}
+	t.Setenv("AUTH_API_TOKENS", "token-a, token-b")
+
+	// Without a secret nobody can sign a JWT the service accepts
+	forged := NewAuthService("", time.Hour)
+	token, _ := forged.GenerateToken("user", "admin", nil)
+	if _, err := service.ValidateToken(token); err == nil {
+		t.Error("Expected token signed with an empty secret to be rejected")
+	}
+}
+
+// staticKeys accepts a single API key
+type staticKeys string
+
+func (k staticKeys) ValidateAPIKey(key string) (*Claims, error) {
+	if key != string(k) {
+		return nil, fmt.Errorf("invalid API key")
+	}
+	return &Claims{KeyID: "key-1", Permissions: []string{"read"}}, nil
+}
+
+func TestAuthMiddlewareAPIKeys(t *testing.T) {
+	service := NewAuthService("test-secret", time.Hour)
+	service.AddAdminToken("admin-token")
+	service.SetAPIKeys(staticKeys("ci-key"))
+
+	var claims *Claims
+	handler := service.AuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, _ = GetClaimsFromContext(r)
+	}))
+
+	tests := []struct {
+		name           string
+		header         string
+		value          string
+		expectedStatus int
+	}{
+		{"Valid API key", "X-API-Key", "ci-key", http.StatusOK},
+		{"Invalid API key", "X-API-Key", "other-key", http.StatusUnauthorized},
+		{"Admin token", "Authorization", "Bearer admin-token", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims = nil
+			req := httptest.NewRequest("GET", "/test", nil)
+			req.Header.Set(tt.header, tt.value)
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+
+			if rr.Code != tt.expectedStatus {
+				t.Errorf("Expected status %d, got %d", tt.expectedStatus, rr.Code)
+			}
+			if tt.header == "X-API-Key" && rr.Code == http.StatusOK && (claims == nil || claims.KeyID != "key-1") {
+				t.Errorf("Expected the claims of the key, got %+v", claims)
+			}
+		})
+	}
+}
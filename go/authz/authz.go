@@ -0,0 +1,336 @@
+// Package authz decides whether a caller may perform an operation on the
+// coordinator, such as submitting a build of a project or deleting artifacts.
+// Authentication only establishes who the caller is; an Authorizer then
+// applies policies like "team A can only build projects under /projects/a",
+// either from built-in role bindings or by asking an Open Policy Agent.
+package authz
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Actions the coordinator authorizes
+const (
+	ActionBuildSubmit       = "build.submit"
+	ActionBuildPause        = "build.pause"
+	ActionBuildAnnotate     = "build.annotate"
+	ActionBuildHooks        = "build.hooks"
+	ActionArtifactsDelete   = "artifacts.delete"
+	ActionArtifactsPublish  = "artifacts.publish"
+	ActionChaosConfigure    = "chaos.configure"
+	ActionAuditRead         = "audit.read"
+	ActionAPIKeysManage     = "apikeys.manage"
+	ActionWorkersQuarantine = "workers.quarantine"
+)
+
+// Authorization backends
+const (
+	BackendNone = "none"
+	BackendRBAC = "rbac"
+	BackendOPA  = "opa"
+)
+
+// Subject is the caller of an operation
+type Subject struct {
+	// Principal identifies the caller like the audit log does: user:<id>,
+	// key:<id>, token:<digest> or anonymous
+	Principal string `json:"principal"`
+	// User, Role and Permissions are the claims of the caller's JWT; the
+	// permissions of an API key are its scopes
+	User        string   `json:"user,omitempty"`
+	Role        string   `json:"role,omitempty"`
+	Permissions []string `json:"permissions,omitempty"`
+	// Tenant is the team the caller's API key belongs to
+	Tenant string `json:"tenant,omitempty"`
+}
+
+// Resource is what an operation acts on. Builds of a repository have a
+// project path relative to its checkout.
+type Resource struct {
+	BuildID     string `json:"build_id,omitempty"`
+	ProjectPath string `json:"project_path,omitempty"`
+	RepoURL     string `json:"repo_url,omitempty"`
+	TaskName    string `json:"task_name,omitempty"`
+}
+
+// Input is an authorization request
+type Input struct {
+	Action   string   `json:"action"`
+	Subject  Subject  `json:"subject"`
+	Resource Resource `json:"resource"`
+}
+
+// Decision is the outcome of an authorization request
+type Decision struct {
+	Allowed bool   `json:"allowed"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// Authorizer decides whether a subject may perform an action. An error
+// means no decision could be made; callers must then deny the operation.
+type Authorizer interface {
+	Authorize(ctx context.Context, input Input) (Decision, error)
+}
+
+// Rule allows actions on resources. Rules without projects or repos apply
+// to every resource; otherwise a build of a project directory must be inside
+// one of the projects, and a build of a repository must match one of the
+// repos patterns.
+type Rule struct {
+	Actions  []string `json:"actions"`
+	Projects []string `json:"projects,omitempty"`
+	Repos    []string `json:"repos,omitempty"`
+}
+
+// Policy grants roles to subjects. Bindings map a subject, as user:<id>,
+// role:<JWT role>, tenant:<tenant>, key:<id>, token:<digest> or * for
+// everybody, to the names of its roles.
+type Policy struct {
+	Roles    map[string][]Rule   `json:"roles"`
+	Bindings map[string][]string `json:"bindings"`
+}
+
+// RBAC authorizes subjects by the rules of their roles, denying anything no
+// rule allows
+type RBAC struct {
+	policy Policy
+}
+
+// NewRBAC creates an authorizer checking a policy
+func NewRBAC(policy Policy) (*RBAC, error) {
+	for subject, roles := range policy.Bindings {
+		for _, role := range roles {
+			if _, exists := policy.Roles[role]; !exists {
+				return nil, fmt.Errorf("subject %s is bound to unknown role %q", subject, role)
+			}
+		}
+	}
+	for role, rules := range policy.Roles {
+		for _, rule := range rules {
+			if len(rule.Actions) == 0 {
+				return nil, fmt.Errorf("rule of role %s allows no actions", role)
+			}
+			for _, project := range rule.Projects {
+				if !filepath.IsAbs(project) {
+					return nil, fmt.Errorf("project %q of role %s is not an absolute path", project, role)
+				}
+			}
+			for _, pattern := range rule.Repos {
+				if _, err := path.Match(pattern, ""); err != nil {
+					return nil, fmt.Errorf("invalid repo pattern %q of role %s: %v", pattern, role, err)
+				}
+			}
+		}
+	}
+	return &RBAC{policy: policy}, nil
+}
+
+// LoadRBAC reads a policy from a JSON file
+func LoadRBAC(file string) (*RBAC, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read authorization policy: %v", err)
+	}
+	var policy Policy
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return nil, fmt.Errorf("invalid authorization policy %s: %v", file, err)
+	}
+	return NewRBAC(policy)
+}
+
+// Authorize implements Authorizer
+func (a *RBAC) Authorize(ctx context.Context, input Input) (Decision, error) {
+	for _, role := range a.roles(input.Subject) {
+		for _, rule := range a.policy.Roles[role] {
+			if rule.allows(input.Action, input.Resource) {
+				return Decision{Allowed: true, Reason: "allowed by role " + role}, nil
+			}
+		}
+	}
+	return Decision{Reason: fmt.Sprintf("no role of %s allows %s", input.Subject.Principal, describe(input))}, nil
+}
+
+// roles returns the roles bound to a subject
+func (a *RBAC) roles(subject Subject) []string {
+	identities := []string{"*", subject.Principal}
+	if subject.User != "" {
+		identities = append(identities, "user:"+subject.User)
+	}
+	if subject.Role != "" {
+		identities = append(identities, "role:"+subject.Role)
+	}
+	if subject.Tenant != "" {
+		identities = append(identities, "tenant:"+subject.Tenant)
+	}
+
+	var roles []string
+	for _, identity := range identities {
+		roles = append(roles, a.policy.Bindings[identity]...)
+	}
+	return roles
+}
+
+// allows reports whether the rule allows an action on a resource
+func (r Rule) allows(action string, resource Resource) bool {
+	allowed := false
+	for _, pattern := range r.Actions {
+		if pattern == "*" || pattern == action {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return false
+	}
+	if len(r.Projects) == 0 && len(r.Repos) == 0 {
+		return true
+	}
+
+	if resource.RepoURL != "" {
+		for _, pattern := range r.Repos {
+			if matched, _ := path.Match(pattern, resource.RepoURL); matched {
+				return true
+			}
+		}
+		return false
+	}
+	if resource.ProjectPath == "" {
+		return false
+	}
+	for _, project := range r.Projects {
+		if within(resource.ProjectPath, project) {
+			return true
+		}
+	}
+	return false
+}
+
+// within reports whether path is root or inside it
+func within(path, root string) bool {
+	rel, err := filepath.Rel(filepath.Clean(root), filepath.Clean(path))
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// describe names the action and resource of an input for denial reasons
+func describe(input Input) string {
+	switch {
+	case input.Resource.RepoURL != "":
+		return fmt.Sprintf("%s of %s", input.Action, input.Resource.RepoURL)
+	case input.Resource.ProjectPath != "":
+		return fmt.Sprintf("%s of %s", input.Action, input.Resource.ProjectPath)
+	case input.Resource.BuildID != "":
+		return fmt.Sprintf("%s of %s", input.Action, input.Resource.BuildID)
+	}
+	return input.Action
+}
+
+// OPA asks an Open Policy Agent for decisions. The input is posted to the
+// URL of a rule, such as http://opa:8181/v1/data/gradle/authz, which must
+// evaluate to a boolean or to an object with allow and reason.
+type OPA struct {
+	URL        string
+	HTTPClient *http.Client
+}
+
+// NewOPA creates an authorizer querying the rule at url
+func NewOPA(url string, timeout time.Duration) *OPA {
+	return &OPA{URL: url, HTTPClient: &http.Client{Timeout: timeout}}
+}
+
+// Authorize implements Authorizer
+func (o *OPA) Authorize(ctx context.Context, input Input) (Decision, error) {
+	data, err := json.Marshal(map[string]Input{"input": input})
+	if err != nil {
+		return Decision{}, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", o.URL, bytes.NewReader(data))
+	if err != nil {
+		return Decision{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := o.HTTPClient.Do(req)
+	if err != nil {
+		return Decision{}, fmt.Errorf("policy agent unavailable: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return Decision{}, fmt.Errorf("policy agent returned %d: %s", resp.StatusCode, strings.TrimSpace(string(message)))
+	}
+
+	var reply struct {
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		return Decision{}, fmt.Errorf("invalid policy agent reply: %v", err)
+	}
+	// An undefined rule has no result and denies
+	if len(reply.Result) == 0 {
+		return Decision{Reason: "policy is undefined for " + describe(input)}, nil
+	}
+
+	var allowed bool
+	if err := json.Unmarshal(reply.Result, &allowed); err == nil {
+		decision := Decision{Allowed: allowed}
+		if !allowed {
+			decision.Reason = "policy denies " + describe(input)
+		}
+		return decision, nil
+	}
+	var result struct {
+		Allow  bool   `json:"allow"`
+		Reason string `json:"reason"`
+	}
+	if err := json.Unmarshal(reply.Result, &result); err != nil {
+		return Decision{}, fmt.Errorf("policy result is neither a boolean nor an object with allow: %s", reply.Result)
+	}
+	decision := Decision{Allowed: result.Allow, Reason: result.Reason}
+	if !decision.Allowed && decision.Reason == "" {
+		decision.Reason = "policy denies " + describe(input)
+	}
+	return decision, nil
+}
+
+// FromEnv creates the authorizer selected by AUTHZ_BACKEND: rbac with the
+// policy in AUTHZ_POLICY_FILE, or opa querying AUTHZ_OPA_URL within
+// AUTHZ_OPA_TIMEOUT. It returns nil, allowing every authenticated caller
+// everything, when no backend is configured.
+func FromEnv() (Authorizer, error) {
+	switch backend := os.Getenv("AUTHZ_BACKEND"); backend {
+	case "", BackendNone:
+		return nil, nil
+	case BackendRBAC:
+		file := os.Getenv("AUTHZ_POLICY_FILE")
+		if file == "" {
+			return nil, fmt.Errorf("AUTHZ_POLICY_FILE is required by the rbac backend")
+		}
+		return LoadRBAC(file)
+	case BackendOPA:
+		url := os.Getenv("AUTHZ_OPA_URL")
+		if url == "" {
+			return nil, fmt.Errorf("AUTHZ_OPA_URL is required by the opa backend")
+		}
+		timeout := 2 * time.Second
+		if value := os.Getenv("AUTHZ_OPA_TIMEOUT"); value != "" {
+			parsed, err := time.ParseDuration(value)
+			if err != nil || parsed <= 0 {
+				return nil, fmt.Errorf("invalid AUTHZ_OPA_TIMEOUT %q", value)
+			}
+			timeout = parsed
+		}
+		return NewOPA(url, timeout), nil
+	default:
+		return nil, fmt.Errorf("unknown authorization backend %q", backend)
+	}
+}
@@ -0,0 +1,167 @@
+package authz
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRBAC(t *testing.T) {
+	authorizer, err := NewRBAC(Policy{
+		Roles: map[string][]Rule{
+			"team-a": {
+				{Actions: []string{ActionBuildSubmit}, Projects: []string{"/projects/a"}, Repos: []string{"https://git.example.com/team-a/*"}},
+			},
+			"cleanup": {{Actions: []string{ActionArtifactsDelete}}},
+			"admin":   {{Actions: []string{"*"}}},
+		},
+		Bindings: map[string][]string{
+			"tenant:team-a": {"team-a"},
+			"role:ops":      {"cleanup"},
+			"user:root":     {"admin"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewRBAC failed: %v", err)
+	}
+
+	teamA := Subject{Principal: "token:0123456789ab", Tenant: "team-a"}
+	tests := []struct {
+		name     string
+		input    Input
+		expected bool
+	}{
+		{"project of the team", Input{ActionBuildSubmit, teamA, Resource{ProjectPath: "/projects/a/app"}}, true},
+		{"project root", Input{ActionBuildSubmit, teamA, Resource{ProjectPath: "/projects/a"}}, true},
+		{"sibling of the project root", Input{ActionBuildSubmit, teamA, Resource{ProjectPath: "/projects/ab"}}, false},
+		{"escaping the project root", Input{ActionBuildSubmit, teamA, Resource{ProjectPath: "/projects/a/../b"}}, false},
+		{"repository of the team", Input{ActionBuildSubmit, teamA, Resource{ProjectPath: "app", RepoURL: "https://git.example.com/team-a/app"}}, true},
+		{"repository of another team", Input{ActionBuildSubmit, teamA, Resource{ProjectPath: "app", RepoURL: "https://git.example.com/team-b/app"}}, false},
+		{"action not granted", Input{ActionChaosConfigure, teamA, Resource{}}, false},
+		{"unscoped rule", Input{ActionArtifactsDelete, Subject{Principal: "user:bob", User: "bob", Role: "ops"}, Resource{BuildID: "build-1"}}, true},
+		{"wildcard action", Input{ActionAuditRead, Subject{Principal: "user:root", User: "root"}, Resource{}}, true},
+		{"unbound subject", Input{ActionBuildSubmit, Subject{Principal: "anonymous"}, Resource{ProjectPath: "/projects/a"}}, false},
+	}
+
+	for _, tc := range tests {
+		decision, err := authorizer.Authorize(context.Background(), tc.input)
+		if err != nil {
+			t.Fatalf("%s: Authorize failed: %v", tc.name, err)
+		}
+		if decision.Allowed != tc.expected {
+			t.Errorf("%s: expected allowed=%v, got %+v", tc.name, tc.expected, decision)
+		}
+		if !decision.Allowed && decision.Reason == "" {
+			t.Errorf("%s: expected a reason for the denial", tc.name)
+		}
+	}
+}
+
+func TestNewRBACRejectsInvalidPolicies(t *testing.T) {
+	invalid := map[string]Policy{
+		"unknown role":      {Bindings: map[string][]string{"user:alice": {"missing"}}},
+		"no actions":        {Roles: map[string][]Rule{"empty": {{}}}},
+		"relative project":  {Roles: map[string][]Rule{"team": {{Actions: []string{"*"}, Projects: []string{"projects/a"}}}}},
+		"malformed pattern": {Roles: map[string][]Rule{"team": {{Actions: []string{"*"}, Repos: []string{"[a-"}}}}},
+	}
+	for name, policy := range invalid {
+		if _, err := NewRBAC(policy); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestOPA(t *testing.T) {
+	var received Input
+	result := `true`
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Input Input `json:"input"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		received = body.Input
+		if result == "" {
+			w.Write([]byte(`{}`))
+			return
+		}
+		w.Write([]byte(`{"result":` + result + `}`))
+	}))
+	defer agent.Close()
+	authorizer := NewOPA(agent.URL, time.Second)
+
+	input := Input{
+		Action:   ActionBuildSubmit,
+		Subject:  Subject{Principal: "user:alice", User: "alice", Role: "team-a"},
+		Resource: Resource{ProjectPath: "/projects/a/app", TaskName: "build"},
+	}
+	decision, err := authorizer.Authorize(context.Background(), input)
+	if err != nil || !decision.Allowed {
+		t.Fatalf("Expected the build to be allowed, got %+v, %v", decision, err)
+	}
+	if received.Subject.User != "alice" || received.Resource.ProjectPath != "/projects/a/app" {
+		t.Errorf("Expected the input to be posted, got %+v", received)
+	}
+
+	result = `{"allow":false,"reason":"team-a may only build /projects/a"}`
+	if decision, err := authorizer.Authorize(context.Background(), input); err != nil || decision.Allowed || decision.Reason != "team-a may only build /projects/a" {
+		t.Errorf("Expected the reason of the policy, got %+v, %v", decision, err)
+	}
+	result = ""
+	if decision, err := authorizer.Authorize(context.Background(), input); err != nil || decision.Allowed {
+		t.Errorf("Expected an undefined policy to deny, got %+v, %v", decision, err)
+	}
+	result = `"yes"`
+	if _, err := authorizer.Authorize(context.Background(), input); err == nil {
+		t.Error("Expected an error for a result that is not a decision")
+	}
+
+	agent.Close()
+	if _, err := authorizer.Authorize(context.Background(), input); err == nil {
+		t.Error("Expected an error when the policy agent is unavailable")
+	}
+}
+
+func TestFromEnv(t *testing.T) {
+	t.Setenv("AUTHZ_BACKEND", "")
+	if authorizer, err := FromEnv(); err != nil || authorizer != nil {
+		t.Errorf("Expected no authorizer by default, got %v, %v", authorizer, err)
+	}
+
+	policy := filepath.Join(t.TempDir(), "policy.json")
+	os.WriteFile(policy, []byte(`{"roles":{"admin":[{"actions":["*"]}]},"bindings":{"user:root":["admin"]}}`), 0644)
+	t.Setenv("AUTHZ_BACKEND", BackendRBAC)
+	t.Setenv("AUTHZ_POLICY_FILE", policy)
+	if authorizer, err := FromEnv(); err != nil {
+		t.Errorf("Expected the RBAC policy to load, got %v", err)
+	} else if _, ok := authorizer.(*RBAC); !ok {
+		t.Errorf("Expected an RBAC authorizer, got %T", authorizer)
+	}
+	os.WriteFile(policy, []byte(`{"bindings":{"user:root":["admin"]}}`), 0644)
+	if _, err := FromEnv(); err == nil || !strings.Contains(err.Error(), "unknown role") {
+		t.Errorf("Expected an invalid policy to be rejected, got %v", err)
+	}
+
+	t.Setenv("AUTHZ_BACKEND", BackendOPA)
+	t.Setenv("AUTHZ_OPA_URL", "http://opa:8181/v1/data/gradle/authz")
+	t.Setenv("AUTHZ_OPA_TIMEOUT", "500ms")
+	if authorizer, err := FromEnv(); err != nil {
+		t.Errorf("Expected the OPA backend, got %v", err)
+	} else if opa, ok := authorizer.(*OPA); !ok || opa.HTTPClient.Timeout != 500*time.Millisecond {
+		t.Errorf("Expected an OPA authorizer with the timeout, got %+v", authorizer)
+	}
+	t.Setenv("AUTHZ_OPA_URL", "")
+	if _, err := FromEnv(); err == nil {
+		t.Error("Expected the OPA backend to require a URL")
+	}
+
+	t.Setenv("AUTHZ_BACKEND", "ldap")
+	if _, err := FromEnv(); err == nil {
+		t.Error("Expected an unknown backend to be rejected")
+	}
+}
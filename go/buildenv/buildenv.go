@@ -0,0 +1,132 @@
+// Package buildenv snapshots the environment a build ran in: the worker and
+// its labels, the Gradle and JDK versions, the environment variables Gradle
+// saw and the cache keys of its tasks. Replaying a build pins its snapshot so
+// a build that only passes on some workers can be run again under identical
+// conditions elsewhere.
+package buildenv
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Worker labels recorded in snapshots
+const (
+	LabelPool = "pool"
+	LabelType = "type"
+	LabelOS   = "os"
+	LabelArch = "arch"
+	LabelSpot = "spot"
+)
+
+// driftLabels are the labels a worker replaying a build must share with the
+// snapshot; the pool and type only say how it was scheduled
+var driftLabels = []string{LabelOS, LabelArch}
+
+// sensitiveName matches environment variables likely to hold credentials.
+// They are left out of snapshots even when they are not build secrets.
+var sensitiveName = regexp.MustCompile(`(?i)(PASSWORD|PASSWD|SECRET|TOKEN|CREDENTIAL|PRIVATE_KEY|ACCESS_KEY|API_KEY)`)
+
+// cacheKeyLine matches the build cache key Gradle logs for a task at info
+// level or with -Dorg.gradle.caching.debug=true
+var cacheKeyLine = regexp.MustCompile(`^Build cache key for task '([^']+)' is ([0-9a-f]+)$`)
+
+// Snapshot is the environment of one build
+type Snapshot struct {
+	WorkerID      string            `json:"worker_id"`
+	WorkerVersion string            `json:"worker_version,omitempty"`
+	Labels        map[string]string `json:"labels,omitempty"`
+	GradleVersion string            `json:"gradle_version,omitempty"`
+	JDKVersion    string            `json:"jdk_version,omitempty"`
+	// Commit is the commit checked out for builds of a repository
+	Commit string `json:"commit,omitempty"`
+	// Env holds the environment variables of the Gradle process, without
+	// the build's secrets and variables named like credentials
+	Env map[string]string `json:"env,omitempty"`
+	// CacheKeys are the build cache keys of the tasks by task path, when
+	// Gradle logged them
+	CacheKeys map[string]string `json:"cache_keys,omitempty"`
+	// ResultCacheKey identifies the build in the coordinator's result
+	// cache, for builds of a repository
+	ResultCacheKey string `json:"result_cache_key,omitempty"`
+}
+
+// Environment returns the "NAME=value" entries of env as a map, later
+// entries winning, without the variables in secretEnv, variables named like
+// credentials and variables whose value contains a secret
+func Environment(env []string, secretEnv map[string]string) map[string]string {
+	variables := make(map[string]string)
+	for _, entry := range env {
+		name, value, found := strings.Cut(entry, "=")
+		if !found || name == "" {
+			continue
+		}
+		if _, secret := secretEnv[name]; secret || sensitiveName.MatchString(name) || containsSecret(value, secretEnv) {
+			delete(variables, name)
+			continue
+		}
+		variables[name] = value
+	}
+	return variables
+}
+
+// containsSecret reports whether value contains one of the secret values
+func containsSecret(value string, secretEnv map[string]string) bool {
+	for _, secret := range secretEnv {
+		if secret != "" && strings.Contains(value, secret) {
+			return true
+		}
+	}
+	return false
+}
+
+// Environ returns the "NAME=value" entries of env with the variables of the
+// snapshot overriding those of the same name
+func (s Snapshot) Environ(env []string) []string {
+	pinned := make([]string, 0, len(env)+len(s.Env))
+	for _, entry := range env {
+		name, _, _ := strings.Cut(entry, "=")
+		if _, exists := s.Env[name]; !exists {
+			pinned = append(pinned, entry)
+		}
+	}
+	names := make([]string, 0, len(s.Env))
+	for name := range s.Env {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		pinned = append(pinned, name+"="+s.Env[name])
+	}
+	return pinned
+}
+
+// ParseCacheKey returns the task and build cache key of a line Gradle logged
+func ParseCacheKey(line string) (string, string, bool) {
+	match := cacheKeyLine.FindStringSubmatch(strings.TrimSpace(line))
+	if match == nil {
+		return "", "", false
+	}
+	return match[1], match[2], true
+}
+
+// Drift lists how the environment of a worker differs from a pinned
+// snapshot in the Gradle and JDK versions, operating system and
+// architecture. Versions or labels the pinned snapshot lacks are not
+// compared.
+func (s Snapshot) Drift(pinned Snapshot) []string {
+	var drift []string
+	compare := func(name, actual, expected string) {
+		if expected != "" && actual != expected {
+			drift = append(drift, fmt.Sprintf("%s is %q, pinned %q", name, actual, expected))
+		}
+	}
+	compare("gradle_version", s.GradleVersion, pinned.GradleVersion)
+	compare("jdk_version", s.JDKVersion, pinned.JDKVersion)
+	for _, label := range driftLabels {
+		compare(label, s.Labels[label], pinned.Labels[label])
+	}
+	return drift
+}
@@ -0,0 +1,74 @@
+package buildenv
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEnvironment(t *testing.T) {
+	env := []string{
+		"JAVA_HOME=/usr/lib/jvm/17",
+		"GRADLE_OPTS=-Xmx2g",
+		"NEXUS_PASSWORD=hunter2",
+		"GITHUB_TOKEN=ghp_123",
+		"SIGNING_KEY=secret-key",
+		"SIGNING_ARGS=-Psigning.key=secret-key",
+		"GRADLE_OPTS=-Xmx4g",
+		"malformed",
+		"=empty-name",
+	}
+	variables := Environment(env, map[string]string{"SIGNING_KEY": "secret-key"})
+
+	expected := map[string]string{"JAVA_HOME": "/usr/lib/jvm/17", "GRADLE_OPTS": "-Xmx4g"}
+	if !reflect.DeepEqual(variables, expected) {
+		t.Errorf("Expected %v, got %v", expected, variables)
+	}
+}
+
+func TestEnviron(t *testing.T) {
+	snapshot := Snapshot{Env: map[string]string{"TZ": "UTC", "LANG": "C.UTF-8"}}
+	env := snapshot.Environ([]string{"PATH=/usr/bin", "TZ=Europe/Belgrade"})
+
+	expected := []string{"PATH=/usr/bin", "LANG=C.UTF-8", "TZ=UTC"}
+	if !reflect.DeepEqual(env, expected) {
+		t.Errorf("Expected %v, got %v", expected, env)
+	}
+}
+
+func TestParseCacheKey(t *testing.T) {
+	task, key, ok := ParseCacheKey("Build cache key for task ':app:compileJava' is 8e2f3c1a9b\n")
+	if !ok || task != ":app:compileJava" || key != "8e2f3c1a9b" {
+		t.Errorf("Unexpected cache key %q %q %v", task, key, ok)
+	}
+	if _, _, ok := ParseCacheKey("> Task :app:compileJava"); ok {
+		t.Error("Expected other lines not to parse")
+	}
+}
+
+func TestDrift(t *testing.T) {
+	pinned := Snapshot{
+		GradleVersion: "8.5",
+		JDKVersion:    "17.0.9",
+		Labels:        map[string]string{LabelOS: "linux", LabelArch: "amd64", LabelPool: "default"},
+	}
+
+	same := Snapshot{
+		GradleVersion: "8.5",
+		JDKVersion:    "17.0.9",
+		Labels:        map[string]string{LabelOS: "linux", LabelArch: "amd64", LabelPool: "android"},
+	}
+	if drift := same.Drift(pinned); len(drift) != 0 {
+		t.Errorf("Expected no drift for a worker in another pool, got %v", drift)
+	}
+
+	other := Snapshot{GradleVersion: "8.5", JDKVersion: "21.0.1", Labels: map[string]string{LabelOS: "linux", LabelArch: "arm64"}}
+	drift := other.Drift(pinned)
+	if len(drift) != 2 || !strings.Contains(drift[0], "jdk_version") || !strings.Contains(drift[1], "arch") {
+		t.Errorf("Expected the JDK and architecture to drift, got %v", drift)
+	}
+
+	if drift := other.Drift(Snapshot{}); len(drift) != 0 {
+		t.Errorf("Expected an empty snapshot to pin nothing, got %v", drift)
+	}
+}
@@ -0,0 +1,411 @@
+// Package buildlogs keeps the complete output of builds. Each build's log is
+// a file of gzip members, one per batch of lines appended, so it stays
+// compressed while it grows and can be read with zcat. Logs are deleted once
+// they exceed their retention or the store its total size.
+package buildlogs
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Store limit defaults
+const (
+	DefaultMaxBytes      = 10 << 20
+	DefaultMaxTotalBytes = 1 << 30
+	DefaultRetention     = 7 * 24 * time.Hour
+)
+
+// fileSuffix is the file name suffix of logs
+const fileSuffix = ".log.gz"
+
+// subscriberBuffer is the number of batches a follower may fall behind
+// before it is disconnected
+const subscriberBuffer = 64
+
+// ErrNotFound is returned for builds without a log
+var ErrNotFound = errors.New("build log not found")
+
+// Limits bound the logs a store keeps
+type Limits struct {
+	// MaxBytes is the most output kept of a build; further lines are
+	// dropped after a truncation notice
+	MaxBytes int64
+	// MaxTotalBytes is the most compressed bytes kept of all logs; the
+	// logs of the builds that finished first are deleted beyond it
+	MaxTotalBytes int64
+	// Retention is how long the log of a finished build is kept
+	Retention time.Duration
+}
+
+// DefaultLimits returns the default store limits
+func DefaultLimits() Limits {
+	return Limits{MaxBytes: DefaultMaxBytes, MaxTotalBytes: DefaultMaxTotalBytes, Retention: DefaultRetention}
+}
+
+// LimitsFromEnv reads the limits from BUILD_LOG_MAX_BYTES,
+// BUILD_LOG_MAX_TOTAL_BYTES and BUILD_LOG_RETENTION. Unset variables keep
+// the defaults.
+func LimitsFromEnv() (Limits, error) {
+	limits := DefaultLimits()
+
+	sizes := map[string]*int64{
+		"BUILD_LOG_MAX_BYTES":       &limits.MaxBytes,
+		"BUILD_LOG_MAX_TOTAL_BYTES": &limits.MaxTotalBytes,
+	}
+	for name, size := range sizes {
+		value := os.Getenv(name)
+		if value == "" {
+			continue
+		}
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n <= 0 {
+			return DefaultLimits(), fmt.Errorf("invalid %s: %s", name, value)
+		}
+		*size = n
+	}
+
+	if value := os.Getenv("BUILD_LOG_RETENTION"); value != "" {
+		retention, err := time.ParseDuration(value)
+		if err != nil || retention <= 0 {
+			return DefaultLimits(), fmt.Errorf("invalid BUILD_LOG_RETENTION: %s", value)
+		}
+		limits.Retention = retention
+	}
+
+	return limits, nil
+}
+
+// buildLog is the state of one build's log
+type buildLog struct {
+	// size is the uncompressed size of the lines kept and compressed the
+	// size of the log file
+	size       int64
+	compressed int64
+	truncated  bool
+	finished   bool
+	updated    time.Time
+	// data holds the compressed log when the store has no directory
+	data        *bytes.Buffer
+	subscribers []chan []string
+}
+
+// Store keeps build logs in a directory, or in memory when it has none
+type Store struct {
+	mutex  sync.Mutex
+	dir    string
+	limits Limits
+	logs   map[string]*buildLog
+}
+
+// Open opens the log store in dir, creating it if needed. The logs already
+// in it are treated as finished. An empty dir keeps logs in memory.
+func Open(dir string, limits Limits) (*Store, error) {
+	s := &Store{dir: dir, limits: limits, logs: make(map[string]*buildLog)}
+	if dir == "" {
+		return s, nil
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create build log directory: %v", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read build log directory: %v", err)
+	}
+	for _, entry := range entries {
+		name, found := strings.CutSuffix(entry.Name(), fileSuffix)
+		buildID, err := url.PathUnescape(name)
+		if !found || err != nil || entry.IsDir() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		s.logs[buildID] = &buildLog{compressed: info.Size(), finished: true, updated: info.ModTime()}
+	}
+	return s, nil
+}
+
+// OpenFromEnv opens the log store in BUILD_LOG_DIR, defaulting to data/logs,
+// with the limits of LimitsFromEnv. It falls back to the default limits and
+// to keeping logs in memory so logs never stop the coordinator from
+// starting.
+func OpenFromEnv() *Store {
+	limits, err := LimitsFromEnv()
+	if err != nil {
+		log.Printf("Invalid build log limits, using the defaults: %v", err)
+	}
+
+	dir := os.Getenv("BUILD_LOG_DIR")
+	if dir == "" {
+		dir = filepath.Join("data", "logs")
+	}
+
+	s, err := Open(dir, limits)
+	if err != nil {
+		log.Printf("Build log directory unavailable, keeping build logs in memory: %v", err)
+		s, _ = Open("", limits)
+	}
+	return s
+}
+
+// path returns the file of a build's log. Build IDs are escaped so they
+// cannot name a file outside the directory.
+func (s *Store) path(buildID string) string {
+	return filepath.Join(s.dir, url.PathEscape(buildID)+fileSuffix)
+}
+
+// Append adds lines to the log of a running build and sends them to its
+// followers. Lines beyond the size limit are dropped.
+func (s *Store) Append(buildID string, lines []string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	l := s.logs[buildID]
+	if l == nil {
+		l = &buildLog{}
+		s.logs[buildID] = l
+	}
+	if l.finished {
+		return fmt.Errorf("build %s has finished", buildID)
+	}
+
+	var kept []string
+	for _, line := range lines {
+		if l.truncated {
+			break
+		}
+		if s.limits.MaxBytes > 0 && l.size+int64(len(line))+1 > s.limits.MaxBytes {
+			line = fmt.Sprintf("[log truncated at %d bytes]", l.size)
+			l.truncated = true
+		}
+		l.size += int64(len(line)) + 1
+		kept = append(kept, line)
+	}
+	if len(kept) == 0 {
+		return nil
+	}
+
+	if err := s.write(buildID, l, kept); err != nil {
+		return err
+	}
+	l.updated = time.Now()
+
+	for i := 0; i < len(l.subscribers); i++ {
+		select {
+		case l.subscribers[i] <- kept:
+		default:
+			// A follower too far behind is disconnected rather than
+			// holding up the build
+			close(l.subscribers[i])
+			l.subscribers = append(l.subscribers[:i], l.subscribers[i+1:]...)
+			i--
+		}
+	}
+	return nil
+}
+
+// write appends lines to a log as a gzip member. Must be called with the
+// mutex held.
+func (s *Store) write(buildID string, l *buildLog, lines []string) error {
+	var member bytes.Buffer
+	writer := gzip.NewWriter(&member)
+	for _, line := range lines {
+		writer.Write([]byte(line + "\n"))
+	}
+	if err := writer.Close(); err != nil {
+		return fmt.Errorf("failed to compress log of build %s: %v", buildID, err)
+	}
+
+	if s.dir == "" {
+		if l.data == nil {
+			l.data = &bytes.Buffer{}
+		}
+		l.data.Write(member.Bytes())
+	} else {
+		file, err := os.OpenFile(s.path(buildID), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return fmt.Errorf("failed to open log of build %s: %v", buildID, err)
+		}
+		_, err = file.Write(member.Bytes())
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("failed to write log of build %s: %v", buildID, err)
+		}
+	}
+	l.compressed += int64(member.Len())
+	return nil
+}
+
+// Finish marks the log of a build as complete, ending its followers. Builds
+// that never logged a line get an empty log.
+func (s *Store) Finish(buildID string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	l := s.logs[buildID]
+	if l == nil {
+		l = &buildLog{}
+		s.logs[buildID] = l
+	}
+	if l.finished {
+		return
+	}
+	l.finished = true
+	l.updated = time.Now()
+	for _, subscriber := range l.subscribers {
+		close(subscriber)
+	}
+	l.subscribers = nil
+}
+
+// Lines returns the last tail lines of a build's log, or all of them when
+// tail is 0
+func (s *Store) Lines(buildID string, tail int) ([]string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	l := s.logs[buildID]
+	if l == nil {
+		return nil, ErrNotFound
+	}
+	return s.read(buildID, l, tail)
+}
+
+// Follow returns the last tail lines of a build's log and a channel
+// receiving the lines appended from then on. The channel is closed when the
+// build finishes, at once if it already has. stop unsubscribes.
+func (s *Store) Follow(buildID string, tail int) (lines []string, updates <-chan []string, stop func(), err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	l := s.logs[buildID]
+	if l == nil {
+		l = &buildLog{}
+		s.logs[buildID] = l
+	}
+	if lines, err = s.read(buildID, l, tail); err != nil && err != ErrNotFound {
+		return nil, nil, nil, err
+	}
+
+	subscriber := make(chan []string, subscriberBuffer)
+	if l.finished {
+		close(subscriber)
+		return lines, subscriber, func() {}, nil
+	}
+	l.subscribers = append(l.subscribers, subscriber)
+
+	stop = func() {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		for i, other := range l.subscribers {
+			if other == subscriber {
+				l.subscribers = append(l.subscribers[:i], l.subscribers[i+1:]...)
+				close(subscriber)
+				return
+			}
+		}
+	}
+	return lines, subscriber, stop, nil
+}
+
+// read decompresses a log and returns its last tail lines. A member torn by
+// a crash ends the log. Must be called with the mutex held.
+func (s *Store) read(buildID string, l *buildLog, tail int) ([]string, error) {
+	var compressed io.Reader
+	switch {
+	case s.dir == "" && l.data == nil, s.dir != "" && l.compressed == 0:
+		return []string{}, nil
+	case s.dir == "":
+		compressed = bytes.NewReader(l.data.Bytes())
+	default:
+		file, err := os.Open(s.path(buildID))
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, ErrNotFound
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to open log of build %s: %v", buildID, err)
+		}
+		defer file.Close()
+		compressed = file
+	}
+
+	reader, err := gzip.NewReader(compressed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read log of build %s: %v", buildID, err)
+	}
+	lines := []string{}
+	buffered := bufio.NewReader(reader)
+	for {
+		line, err := buffered.ReadString('\n')
+		if err != nil {
+			// Only complete lines are returned
+			break
+		}
+		lines = append(lines, strings.TrimSuffix(line, "\n"))
+		if tail > 0 && len(lines) > 2*tail {
+			lines = append(lines[:0], lines[len(lines)-tail:]...)
+		}
+	}
+	if tail > 0 && len(lines) > tail {
+		lines = lines[len(lines)-tail:]
+	}
+	return lines, nil
+}
+
+// Prune deletes the logs of builds that finished longer than the retention
+// ago, then those of the builds that finished first while the logs exceed
+// the total size limit. It returns the number of logs deleted that had any
+// output.
+func (s *Store) Prune(now time.Time) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var finished []string
+	var total int64
+	for buildID, l := range s.logs {
+		total += l.compressed
+		if l.finished {
+			finished = append(finished, buildID)
+		}
+	}
+	sort.Slice(finished, func(i, j int) bool {
+		return s.logs[finished[i]].updated.Before(s.logs[finished[j]].updated)
+	})
+
+	deleted := 0
+	for _, buildID := range finished {
+		l := s.logs[buildID]
+		expired := s.limits.Retention > 0 && now.Sub(l.updated) > s.limits.Retention
+		if !expired && (s.limits.MaxTotalBytes <= 0 || total <= s.limits.MaxTotalBytes) {
+			// Logs are ordered by age, so the remaining ones are kept
+			break
+		}
+		if s.dir != "" && l.compressed > 0 {
+			if err := os.Remove(s.path(buildID)); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return deleted, fmt.Errorf("failed to delete log of build %s: %v", buildID, err)
+			}
+		}
+		if l.compressed > 0 {
+			deleted++
+		}
+		total -= l.compressed
+		delete(s.logs, buildID)
+	}
+	return deleted, nil
+}
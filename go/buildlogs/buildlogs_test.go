@@ -0,0 +1,137 @@
+package buildlogs
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStorePersistsLogs(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "logs")
+	s, err := Open(dir, DefaultLimits())
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+
+	s.Append("build-1", []string{"> Task :compileJava", "> Task :test"})
+	s.Append("build-1", []string{"BUILD SUCCESSFUL in 3s"})
+	s.Finish("build-1")
+	if err := s.Append("build-1", []string{"late"}); err == nil {
+		t.Error("Expected lines of a finished build to be rejected")
+	}
+
+	// The log is a gzip file readable with standard tools
+	file, _ := os.Open(filepath.Join(dir, "build-1.log.gz"))
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatalf("Expected a gzip file, got %v", err)
+	}
+	data, _ := io.ReadAll(reader)
+	file.Close()
+	if string(data) != "> Task :compileJava\n> Task :test\nBUILD SUCCESSFUL in 3s\n" {
+		t.Errorf("Unexpected log file contents %q", data)
+	}
+
+	// Logs survive reopening the store
+	reopened, _ := Open(dir, DefaultLimits())
+	if lines, err := reopened.Lines("build-1", 2); err != nil || !reflect.DeepEqual(lines, []string{"> Task :test", "BUILD SUCCESSFUL in 3s"}) {
+		t.Errorf("Expected the last 2 lines, got %v, %v", lines, err)
+	}
+	if _, err := reopened.Lines("build-2", 0); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound for a build without a log, got %v", err)
+	}
+
+	// Build IDs cannot escape the directory
+	s.Append("../escape", []string{"line"})
+	if _, err := os.Stat(filepath.Join(dir, "..%2Fescape.log.gz")); err != nil {
+		t.Errorf("Expected the build ID to be escaped, got %v", err)
+	}
+}
+
+func TestAppendTruncatesLargeLogs(t *testing.T) {
+	s, _ := Open("", Limits{MaxBytes: 20})
+	s.Append("build-1", []string{"0123456789", "0123456789", "dropped"})
+	s.Append("build-1", []string{"dropped"})
+
+	lines, _ := s.Lines("build-1", 0)
+	if len(lines) != 2 || lines[0] != "0123456789" || !strings.HasPrefix(lines[1], "[log truncated") {
+		t.Errorf("Expected the log to be truncated after the first line, got %v", lines)
+	}
+}
+
+func TestFollow(t *testing.T) {
+	s, _ := Open("", DefaultLimits())
+	s.Append("build-1", []string{"one", "two", "three"})
+
+	lines, updates, stop, err := s.Follow("build-1", 1)
+	if err != nil || !reflect.DeepEqual(lines, []string{"three"}) {
+		t.Fatalf("Expected the last line, got %v, %v", lines, err)
+	}
+	defer stop()
+
+	s.Append("build-1", []string{"four"})
+	if batch := <-updates; !reflect.DeepEqual(batch, []string{"four"}) {
+		t.Errorf("Expected the appended line, got %v", batch)
+	}
+	s.Finish("build-1")
+	if _, open := <-updates; open {
+		t.Error("Expected the updates to end with the build")
+	}
+
+	// Finished builds and builds without output are not followed
+	lines, updates, _, err = s.Follow("build-1", 0)
+	if _, open := <-updates; open || err != nil || len(lines) != 4 {
+		t.Errorf("Expected the whole log of a finished build, got %v, %v", lines, err)
+	}
+	s.Finish("build-2")
+	if lines, err := s.Lines("build-2", 0); err != nil || len(lines) != 0 {
+		t.Errorf("Expected an empty log, got %v, %v", lines, err)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	dir := t.TempDir()
+	s, _ := Open(dir, Limits{Retention: time.Hour, MaxTotalBytes: 1 << 20})
+	for _, buildID := range []string{"old", "recent", "running"} {
+		s.Append(buildID, []string{"output of " + buildID})
+	}
+	s.Finish("old")
+	s.Finish("recent")
+	s.logs["old"].updated = time.Now().Add(-2 * time.Hour)
+
+	if deleted, err := s.Prune(time.Now()); err != nil || deleted != 1 {
+		t.Fatalf("Expected 1 expired log to be deleted, got %d, %v", deleted, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "old.log.gz")); !os.IsNotExist(err) {
+		t.Errorf("Expected the expired log file to be removed, got %v", err)
+	}
+
+	// Over the size limit, finished logs go first and running ones stay
+	s.limits.MaxTotalBytes = 1
+	if deleted, _ := s.Prune(time.Now()); deleted != 1 {
+		t.Errorf("Expected the finished log to be deleted over the size limit, got %d", deleted)
+	}
+	if _, err := s.Lines("running", 0); err != nil {
+		t.Errorf("Expected the running build's log to be kept, got %v", err)
+	}
+}
+
+func TestLimitsFromEnv(t *testing.T) {
+	t.Setenv("BUILD_LOG_MAX_BYTES", "1048576")
+	t.Setenv("BUILD_LOG_MAX_TOTAL_BYTES", "")
+	t.Setenv("BUILD_LOG_RETENTION", "48h")
+	limits, err := LimitsFromEnv()
+	if err != nil || limits.MaxBytes != 1<<20 || limits.MaxTotalBytes != DefaultMaxTotalBytes || limits.Retention != 48*time.Hour {
+		t.Errorf("Unexpected limits %+v, %v", limits, err)
+	}
+
+	t.Setenv("BUILD_LOG_RETENTION", "forever")
+	if _, err := LimitsFromEnv(); err == nil {
+		t.Error("Expected an invalid retention to be rejected")
+	}
+}
@@ -0,0 +1,263 @@
+// Package buildopts translates the options of a build request into the
+// Gradle invocation a worker runs. A few options control the invocation
+// itself; any other option is passed to the build as a project property.
+package buildopts
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Build options controlling the Gradle invocation
+const (
+	// JVMArgs are whitespace separated arguments of the Gradle daemon JVM,
+	// such as "-Xmx4g -XX:+UseG1GC"
+	JVMArgs = "jvmArgs"
+	// GradleArgs are whitespace separated Gradle flags from
+	// AllowedGradleArgs, such as "--stacktrace --rerun-tasks"
+	GradleArgs = "gradleArgs"
+	// EnvVars are comma separated NAME=value environment variables of the
+	// build, such as "CI=true,TZ=UTC"
+	EnvVars = "envVars"
+	// OfflineMode runs the build without network access when "true"
+	OfflineMode = "offlineMode"
+	// Parallel turns parallel project execution on or off
+	Parallel = "parallel"
+	// MaxWorkers limits the concurrent Gradle workers of the build
+	MaxWorkers = "maxWorkers"
+)
+
+// MaxMaxWorkers is the largest maxWorkers accepted
+const MaxMaxWorkers = 256
+
+// AllowedGradleArgs are the flags accepted in gradleArgs. Flags that would
+// make Gradle load code or files from outside the project, such as
+// --init-script or --project-dir, are not among them.
+var AllowedGradleArgs = []string{
+	"--build-cache", "--no-build-cache",
+	"--configuration-cache", "--no-configuration-cache",
+	"--configure-on-demand", "--no-configure-on-demand",
+	"--continue", "--no-continue",
+	"--debug", "--info", "--quiet", "--warn",
+	"--profile", "--refresh-dependencies", "--rerun-tasks",
+	"--scan", "--no-scan",
+	"--stacktrace", "--full-stacktrace",
+	"--exclude-task", "-x",
+}
+
+// excludeTaskArgs are the gradleArgs flags followed by a task name
+var excludeTaskArgs = map[string]bool{"--exclude-task": true, "-x": true}
+
+// ReservedEnvVars are environment variables envVars may not set, as the
+// worker relies on them to find and run Gradle
+var ReservedEnvVars = []string{"GRADLE_USER_HOME", "HOME", "PATH"}
+
+// reservedEnvPrefixes are prefixes of variables changing how the dynamic
+// linker loads the worker's programs
+var reservedEnvPrefixes = []string{"DYLD_", "LD_"}
+
+var (
+	envVarPattern   = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	taskNamePattern = regexp.MustCompile(`^:?[A-Za-z0-9_][A-Za-z0-9_.:-]*$`)
+)
+
+// Invocation is what the options of a build add to its Gradle invocation
+type Invocation struct {
+	// Args follow the task name on the Gradle command line
+	Args []string
+	// Env are NAME=value variables added to the environment of the build
+	Env []string
+}
+
+// Parse validates build options and translates them into Gradle arguments
+// and environment variables. Options other than the supported ones become
+// -Pname=value project properties. The result does not depend on map order.
+func Parse(options map[string]string) (Invocation, error) {
+	var invocation Invocation
+	var properties []string
+
+	keys := make([]string, 0, len(options))
+	for key := range options {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value := options[key]
+		switch key {
+		case JVMArgs:
+			args, err := parseJVMArgs(value)
+			if err != nil {
+				return Invocation{}, fmt.Errorf("invalid %s: %v", key, err)
+			}
+			if args != "" {
+				invocation.Args = append(invocation.Args, "-Dorg.gradle.jvmargs="+args)
+			}
+		case GradleArgs:
+			args, err := parseGradleArgs(value)
+			if err != nil {
+				return Invocation{}, fmt.Errorf("invalid %s: %v", key, err)
+			}
+			invocation.Args = append(invocation.Args, args...)
+		case EnvVars:
+			env, err := parseEnvVars(value)
+			if err != nil {
+				return Invocation{}, fmt.Errorf("invalid %s: %v", key, err)
+			}
+			invocation.Env = env
+		case OfflineMode:
+			offline, err := parseBool(value)
+			if err != nil {
+				return Invocation{}, fmt.Errorf("invalid %s: %v", key, err)
+			}
+			if offline {
+				invocation.Args = append(invocation.Args, "--offline")
+			}
+		case Parallel:
+			parallel, err := parseBool(value)
+			if err != nil {
+				return Invocation{}, fmt.Errorf("invalid %s: %v", key, err)
+			}
+			if parallel {
+				invocation.Args = append(invocation.Args, "--parallel")
+			} else {
+				invocation.Args = append(invocation.Args, "--no-parallel")
+			}
+		case MaxWorkers:
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 || n > MaxMaxWorkers {
+				return Invocation{}, fmt.Errorf("invalid %s: %q is not a number between 1 and %d", key, value, MaxMaxWorkers)
+			}
+			invocation.Args = append(invocation.Args, fmt.Sprintf("--max-workers=%d", n))
+		default:
+			properties = append(properties, fmt.Sprintf("-P%s=%s", key, value))
+		}
+	}
+
+	invocation.Args = append(invocation.Args, properties...)
+	return invocation, nil
+}
+
+// parseBool accepts "true" and "false"
+func parseBool(value string) (bool, error) {
+	switch value {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	}
+	return false, fmt.Errorf("%q is not true or false", value)
+}
+
+// parseJVMArgs checks that every JVM argument is an option and joins them
+// with single spaces
+func parseJVMArgs(value string) (string, error) {
+	args := strings.Fields(value)
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "-") {
+			return "", fmt.Errorf("%q is not a JVM option", arg)
+		}
+	}
+	return strings.Join(args, " "), nil
+}
+
+// parseGradleArgs checks Gradle flags against AllowedGradleArgs. Excluded
+// tasks are given as "-x task", "--exclude-task task" or
+// "--exclude-task=task".
+func parseGradleArgs(value string) ([]string, error) {
+	allowed := make(map[string]bool, len(AllowedGradleArgs))
+	for _, arg := range AllowedGradleArgs {
+		allowed[arg] = true
+	}
+
+	args := strings.Fields(value)
+	for i := 0; i < len(args); i++ {
+		flag, task, hasTask := strings.Cut(args[i], "=")
+		if !allowed[flag] || (hasTask && flag != "--exclude-task") {
+			return nil, fmt.Errorf("gradle argument %q is not allowed", args[i])
+		}
+		if !excludeTaskArgs[flag] {
+			continue
+		}
+		if !hasTask {
+			if i+1 == len(args) {
+				return nil, fmt.Errorf("%s requires a task name", flag)
+			}
+			i++
+			task = args[i]
+		}
+		if !taskNamePattern.MatchString(task) {
+			return nil, fmt.Errorf("invalid excluded task %q", task)
+		}
+	}
+	return args, nil
+}
+
+// parseEnvVars parses comma separated NAME=value pairs, rejecting reserved
+// and repeated names
+func parseEnvVars(value string) ([]string, error) {
+	var env []string
+	seen := make(map[string]bool)
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		name, _, found := strings.Cut(pair, "=")
+		if !found || !envVarPattern.MatchString(name) {
+			return nil, fmt.Errorf("%q is not a NAME=value pair", pair)
+		}
+		if reservedEnvVar(name) {
+			return nil, fmt.Errorf("environment variable %s is reserved", name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("environment variable %s is set twice", name)
+		}
+		seen[name] = true
+		env = append(env, pair)
+	}
+	return env, nil
+}
+
+// reservedEnvVar reports whether envVars may not set a variable
+func reservedEnvVar(name string) bool {
+	upper := strings.ToUpper(name)
+	for _, reserved := range ReservedEnvVars {
+		if upper == reserved {
+			return true
+		}
+	}
+	for _, prefix := range reservedEnvPrefixes {
+		if strings.HasPrefix(upper, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// CommandLine formats a command and the environment variables it adds as a
+// shell would run it, quoting the words that need it
+func CommandLine(env, command []string) string {
+	words := make([]string, 0, len(env)+len(command))
+	for _, variable := range env {
+		name, value, _ := strings.Cut(variable, "=")
+		words = append(words, name+"="+quote(value))
+	}
+	for _, word := range command {
+		words = append(words, quote(word))
+	}
+	return strings.Join(words, " ")
+}
+
+// quote single-quotes a word containing characters a shell would interpret
+func quote(word string) string {
+	if word != "" && !strings.ContainsFunc(word, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_./:=+,@%", r))
+	}) {
+		return word
+	}
+	return "'" + strings.ReplaceAll(word, "'", `'\''`) + "'"
+}
@@ -0,0 +1,80 @@
+package buildopts
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	invocation, err := Parse(map[string]string{
+		JVMArgs:       " -Xmx4g   -XX:+UseG1GC ",
+		GradleArgs:    "--stacktrace -x lint --exclude-task=:app:test",
+		EnvVars:       "CI=true, TZ=UTC,",
+		OfflineMode:   "true",
+		Parallel:      "false",
+		MaxWorkers:    "4",
+		"flavor":      "free",
+		"versionName": "1.2 beta",
+	})
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	// Options are applied in key order, project properties last
+	expected := Invocation{
+		Args: []string{
+			"--stacktrace", "-x", "lint", "--exclude-task=:app:test",
+			"-Dorg.gradle.jvmargs=-Xmx4g -XX:+UseG1GC",
+			"--max-workers=4",
+			"--offline",
+			"--no-parallel",
+			"-Pflavor=free",
+			"-PversionName=1.2 beta",
+		},
+		Env: []string{"CI=true", "TZ=UTC"},
+	}
+	if !reflect.DeepEqual(invocation, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, invocation)
+	}
+
+	if invocation, err := Parse(map[string]string{OfflineMode: "false", Parallel: "true"}); err != nil || !reflect.DeepEqual(invocation.Args, []string{"--parallel"}) {
+		t.Errorf("Expected only --parallel, got %+v, %v", invocation, err)
+	}
+}
+
+func TestParseRejectsInvalidOptions(t *testing.T) {
+	for name, options := range map[string]map[string]string{
+		"jvm argument":         {JVMArgs: "-Xmx4g UseG1GC"},
+		"init script":          {GradleArgs: "--init-script /tmp/evil.gradle"},
+		"project dir":          {GradleArgs: "--project-dir=/etc"},
+		"flag with value":      {GradleArgs: "--info=true"},
+		"missing excluded":     {GradleArgs: "--stacktrace -x"},
+		"invalid excluded":     {GradleArgs: "-x --init-script"},
+		"offline flag":         {GradleArgs: "--offline"},
+		"env without value":    {EnvVars: "CI"},
+		"invalid env name":     {EnvVars: "CI-MODE=true"},
+		"reserved env":         {EnvVars: "PATH=/tmp"},
+		"linker env":           {EnvVars: "LD_PRELOAD=/tmp/evil.so"},
+		"repeated env":         {EnvVars: "CI=true,CI=false"},
+		"offline not bool":     {OfflineMode: "yes"},
+		"parallel not bool":    {Parallel: "1"},
+		"max workers zero":     {MaxWorkers: "0"},
+		"max workers too many": {MaxWorkers: "1000"},
+		"max workers text":     {MaxWorkers: "four"},
+	} {
+		if _, err := Parse(options); err == nil {
+			t.Errorf("Expected the %s to be rejected", name)
+		}
+	}
+}
+
+func TestCommandLine(t *testing.T) {
+	commandLine := CommandLine(
+		[]string{"CI=true", "GREETING=it's here"},
+		[]string{"/projects/app/gradlew", "build", "--console=plain", "-Dorg.gradle.jvmargs=-Xmx4g -XX:+UseG1GC", "-Pname="},
+	)
+	expected := `CI=true GREETING='it'\''s here' /projects/app/gradlew build --console=plain '-Dorg.gradle.jvmargs=-Xmx4g -XX:+UseG1GC' -Pname=`
+	if commandLine != expected {
+		t.Errorf("Expected %s, got %s", expected, commandLine)
+	}
+}
@@ -0,0 +1,281 @@
+// Package buildstore keeps a persistent history of finished builds for
+// analytics. Builds are appended as JSON lines so the history survives
+// coordinator restarts and can be inspected with standard tools.
+package buildstore
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Final statuses of recorded builds
+const (
+	StatusCompleted = "completed"
+	StatusFailed    = "failed"
+	StatusCancelled = "cancelled"
+)
+
+// Record is a finished build
+type Record struct {
+	BuildID      string        `json:"build_id"`
+	ProjectPath  string        `json:"project_path"`
+	TaskName     string        `json:"task_name"`
+	WorkerID     string        `json:"worker_id"`
+	Status       string        `json:"status"`
+	SubmittedAt  time.Time     `json:"submitted_at"`
+	StartedAt    time.Time     `json:"started_at"`
+	FinishedAt   time.Time     `json:"finished_at"`
+	Duration     time.Duration `json:"duration"`
+	CacheHitRate float64       `json:"cache_hit_rate"`
+	ErrorMessage string        `json:"error_message,omitempty"`
+	Tasks        []TaskTiming  `json:"tasks,omitempty"`
+	// RepoURL and Ref are the repository and ref of builds the worker
+	// checked out itself
+	RepoURL string `json:"repo_url,omitempty"`
+	Ref     string `json:"ref,omitempty"`
+	// Tenant is the team the build ran for, and CacheBytes how much the
+	// build cache of its worker grew while it ran
+	Tenant     string `json:"tenant,omitempty"`
+	CacheBytes int64  `json:"cache_bytes,omitempty"`
+	// ErrorCode classifies why a failed build failed, such as INFRA_ERROR
+	// or TEST_FAILURE
+	ErrorCode string `json:"error_code,omitempty"`
+	// Tags label the build, such as the branch, pull request and commit
+	// it was built for, with the annotations added after it was submitted
+	Tags map[string]string `json:"tags,omitempty"`
+}
+
+// ErrNotFound is returned when annotating a build the store has no record of
+var ErrNotFound = errors.New("build not found")
+
+// line is a line of the store file: a record, or the annotations added to
+// the record of the build it annotates
+type line struct {
+	Record
+	Annotates string `json:"annotates,omitempty"`
+}
+
+// annotation is a line of the store file adding tags to a record
+type annotation struct {
+	Annotates string            `json:"annotates"`
+	Tags      map[string]string `json:"tags"`
+}
+
+// TaskTiming is how long a single Gradle task of a build ran, with the
+// outcome Gradle printed for it, such as FROM-CACHE, if it did not run
+type TaskTiming struct {
+	Name     string        `json:"name"`
+	Duration time.Duration `json:"duration"`
+	Outcome  string        `json:"outcome,omitempty"`
+}
+
+// Filter selects records by project, submission time and tags. Empty fields
+// match every record.
+type Filter struct {
+	ProjectPath string
+	Since       time.Time
+	Until       time.Time
+	// Tags are tags the records must all carry
+	Tags map[string]string
+}
+
+// Store is an append-only build history. Records are kept in memory only
+// when the store has no file.
+type Store struct {
+	mutex   sync.Mutex
+	path    string
+	file    *os.File
+	records []Record
+}
+
+// Open opens the build store at path, creating it if needed. An empty path
+// keeps records in memory.
+func Open(path string) (*Store, error) {
+	if path == "" {
+		return &Store{}, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create build store directory: %v", err)
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open build store: %v", err)
+	}
+
+	return &Store{path: path, file: file}, nil
+}
+
+// OpenFromEnv opens the build store at BUILD_STORE_FILE, defaulting to
+// data/builds.log. It falls back to an in-memory store if the file cannot be
+// opened so analytics never stop the coordinator from starting.
+func OpenFromEnv() *Store {
+	path := os.Getenv("BUILD_STORE_FILE")
+	if path == "" {
+		path = filepath.Join("data", "builds.log")
+	}
+
+	s, err := Open(path)
+	if err != nil {
+		log.Printf("Build store unavailable, keeping build history in memory: %v", err)
+		s, _ = Open("")
+	}
+	return s
+}
+
+// Save appends a finished build
+func (s *Store) Save(record Record) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.file == nil {
+		s.records = append(s.records, record)
+		return nil
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to encode build %s: %v", record.BuildID, err)
+	}
+	if _, err := s.file.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write build %s: %v", record.BuildID, err)
+	}
+	return nil
+}
+
+// Annotate adds tags to the record of a finished build, replacing the
+// values of tags it already has. Annotations of builds recorded in a file
+// are appended to it like records.
+func (s *Store) Annotate(buildID string, tags map[string]string) (Record, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.file == nil {
+		for i := range s.records {
+			if s.records[i].BuildID != buildID {
+				continue
+			}
+			merged := MergeTags(s.records[i].Tags, tags)
+			if err := ValidateTags(merged); err != nil {
+				return Record{}, err
+			}
+			s.records[i].Tags = merged
+			return s.records[i], nil
+		}
+		return Record{}, ErrNotFound
+	}
+
+	records, err := s.scan()
+	if err != nil {
+		return Record{}, err
+	}
+	for _, record := range records {
+		if record.BuildID != buildID {
+			continue
+		}
+		record.Tags = MergeTags(record.Tags, tags)
+		if err := ValidateTags(record.Tags); err != nil {
+			return Record{}, err
+		}
+		data, err := json.Marshal(annotation{Annotates: buildID, Tags: tags})
+		if err != nil {
+			return Record{}, fmt.Errorf("failed to encode annotations of build %s: %v", buildID, err)
+		}
+		if _, err := s.file.Write(append(data, '\n')); err != nil {
+			return Record{}, fmt.Errorf("failed to write annotations of build %s: %v", buildID, err)
+		}
+		return record, nil
+	}
+	return Record{}, ErrNotFound
+}
+
+// Query returns the records matching a filter in the order they were saved
+func (s *Store) Query(filter Filter) ([]Record, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	saved := s.records
+	if s.file != nil {
+		var err error
+		if saved, err = s.scan(); err != nil {
+			return nil, err
+		}
+	}
+
+	records := []Record{}
+	for _, record := range saved {
+		if filter.matches(record) {
+			records = append(records, record)
+		}
+	}
+	return records, nil
+}
+
+// Close closes the store file
+func (s *Store) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.file == nil {
+		return nil
+	}
+	return s.file.Close()
+}
+
+// scan reads the records of the store file with their annotations. Must be
+// called with the mutex held.
+func (s *Store) scan() ([]Record, error) {
+	file, err := os.Open(s.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read build store: %v", err)
+	}
+	defer file.Close()
+
+	var records []Record
+	indexes := make(map[string]int)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		var entry line
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// A torn write from a crash only affects the last line
+			continue
+		}
+		if entry.Annotates != "" {
+			if i, exists := indexes[entry.Annotates]; exists {
+				records[i].Tags = MergeTags(records[i].Tags, entry.Tags)
+			}
+			continue
+		}
+		indexes[entry.BuildID] = len(records)
+		records = append(records, entry.Record)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read build store: %v", err)
+	}
+	return records, nil
+}
+
+// matches reports whether a record passes the filter
+func (f Filter) matches(record Record) bool {
+	switch {
+	case f.ProjectPath != "" && record.ProjectPath != f.ProjectPath:
+		return false
+	case !f.Since.IsZero() && record.SubmittedAt.Before(f.Since):
+		return false
+	case !f.Until.IsZero() && record.SubmittedAt.After(f.Until):
+		return false
+	case !HasTags(record.Tags, f.Tags):
+		return false
+	}
+	return true
+}
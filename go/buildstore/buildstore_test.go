@@ -0,0 +1,152 @@
+package buildstore
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStorePersistsRecords(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data", "builds.log")
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	s, err := Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open build store: %v", err)
+	}
+	s.Save(Record{BuildID: "build-1", ProjectPath: "/projects/app", Status: StatusCompleted, SubmittedAt: start,
+		Tasks: []TaskTiming{{Name: ":app:compileJava", Duration: 3 * time.Second}}})
+	s.Save(Record{BuildID: "build-2", ProjectPath: "/projects/lib", Status: StatusFailed, SubmittedAt: start.Add(time.Hour)})
+	s.Close()
+
+	// A torn last line from a crash is skipped
+	file, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	file.WriteString(`{"build_id":"build-3","proj`)
+	file.Close()
+
+	s, err = Open(path)
+	if err != nil {
+		t.Fatalf("Failed to reopen build store: %v", err)
+	}
+	defer s.Close()
+
+	records, err := s.Query(Filter{})
+	if err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+	if len(records) != 2 || records[0].BuildID != "build-1" || records[1].BuildID != "build-2" {
+		t.Fatalf("Expected both saved builds in order, got %+v", records)
+	}
+	if len(records[0].Tasks) != 1 || records[0].Tasks[0].Duration != 3*time.Second {
+		t.Errorf("Expected task timings to round-trip, got %+v", records[0].Tasks)
+	}
+}
+
+func TestQueryFilters(t *testing.T) {
+	s, _ := Open("")
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	s.Save(Record{BuildID: "build-1", ProjectPath: "/projects/app", SubmittedAt: start, Tags: map[string]string{"branch": "main"}})
+	s.Save(Record{BuildID: "build-2", ProjectPath: "/projects/lib", SubmittedAt: start.Add(time.Hour)})
+	s.Save(Record{BuildID: "build-3", ProjectPath: "/projects/app", SubmittedAt: start.Add(2 * time.Hour), Tags: map[string]string{"branch": "main", "pr": "42"}})
+
+	tests := []struct {
+		name     string
+		filter   Filter
+		expected []string
+	}{
+		{"all", Filter{}, []string{"build-1", "build-2", "build-3"}},
+		{"project", Filter{ProjectPath: "/projects/app"}, []string{"build-1", "build-3"}},
+		{"time range", Filter{Since: start.Add(30 * time.Minute), Until: start.Add(90 * time.Minute)}, []string{"build-2"}},
+		{"tag", Filter{Tags: map[string]string{"branch": "main"}}, []string{"build-1", "build-3"}},
+		{"tags", Filter{Tags: map[string]string{"branch": "main", "pr": "42"}}, []string{"build-3"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			records, err := s.Query(tt.filter)
+			if err != nil {
+				t.Fatalf("Query failed: %v", err)
+			}
+			if len(records) != len(tt.expected) {
+				t.Fatalf("Expected builds %v, got %+v", tt.expected, records)
+			}
+			for i, record := range records {
+				if record.BuildID != tt.expected[i] {
+					t.Errorf("Expected build %s, got %s", tt.expected[i], record.BuildID)
+				}
+			}
+		})
+	}
+}
+
+func TestAnnotate(t *testing.T) {
+	for name, path := range map[string]string{"file": filepath.Join(t.TempDir(), "builds.log"), "memory": ""} {
+		t.Run(name, func(t *testing.T) {
+			s, err := Open(path)
+			if err != nil {
+				t.Fatalf("Failed to open build store: %v", err)
+			}
+			s.Save(Record{BuildID: "build-1", Tags: map[string]string{"branch": "main", "pr": "41"}})
+			s.Save(Record{BuildID: "build-2"})
+
+			record, err := s.Annotate("build-1", map[string]string{"pr": "42", "release": "1.0"})
+			if err != nil {
+				t.Fatalf("Annotate failed: %v", err)
+			}
+			if record.Tags["pr"] != "42" || record.Tags["branch"] != "main" {
+				t.Errorf("Expected the annotations to be merged into the tags, got %v", record.Tags)
+			}
+			if _, err := s.Annotate("build-3", map[string]string{"pr": "42"}); err != ErrNotFound {
+				t.Errorf("Expected an unknown build to be rejected, got %v", err)
+			}
+			s.Close()
+
+			if path != "" {
+				if s, err = Open(path); err != nil {
+					t.Fatalf("Failed to reopen build store: %v", err)
+				}
+				defer s.Close()
+			}
+			records, _ := s.Query(Filter{Tags: map[string]string{"release": "1.0"}})
+			if len(records) != 1 || records[0].BuildID != "build-1" || len(records[0].Tags) != 3 {
+				t.Errorf("Expected the annotated build to be found by its annotations, got %+v", records)
+			}
+			if records, _ := s.Query(Filter{}); len(records) != 2 {
+				t.Errorf("Expected annotations not to be read as records, got %+v", records)
+			}
+		})
+	}
+}
+
+func TestValidateTags(t *testing.T) {
+	if err := ValidateTags(map[string]string{TagBranch: "feature/login", TagPullRequest: "42", TagCommit: "4f1c9a2", TagTriggeredBy: "alice@example.com"}); err != nil {
+		t.Errorf("Expected valid tags, got %v", err)
+	}
+
+	tooMany := map[string]string{}
+	for i := 0; i <= MaxTags; i++ {
+		tooMany[fmt.Sprintf("tag-%d", i)] = "value"
+	}
+	for name, tags := range map[string]map[string]string{
+		"key":      {"Branch": "main"},
+		"empty":    {"branch": ""},
+		"long":     {"branch": strings.Repeat("a", MaxTagValueLen+1)},
+		"control":  {"branch": "main\nforged"},
+		"too many": tooMany,
+	} {
+		if err := ValidateTags(tags); err == nil {
+			t.Errorf("%s: expected %v to be rejected", name, tags)
+		}
+	}
+
+	filter, err := ParseTagFilter([]string{"branch:main", "commit:sha256:abc"})
+	if err != nil || filter["branch"] != "main" || filter["commit"] != "sha256:abc" {
+		t.Errorf("Unexpected tag filter %v: %v", filter, err)
+	}
+	if _, err := ParseTagFilter([]string{"main"}); err == nil {
+		t.Errorf("Expected a filter without a key to be rejected")
+	}
+}
@@ -0,0 +1,93 @@
+package buildstore
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// Limits of the tags of a build
+const (
+	MaxTags        = 32
+	MaxTagValueLen = 256
+)
+
+// Tags conventionally set by CI systems submitting builds
+const (
+	TagBranch      = "branch"
+	TagPullRequest = "pr"
+	TagCommit      = "commit"
+	// TagRepository is the URL of the repository of the commit, when it is
+	// not the repository the build checks out
+	TagRepository  = "repo"
+	TagTriggeredBy = "triggered_by"
+)
+
+// ErrInvalidTags is wrapped by the errors of tags that fail validation
+var ErrInvalidTags = errors.New("invalid tags")
+
+var tagKeyPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{0,62}$`)
+
+// ValidateTags checks that tags have valid keys and printable, non-empty
+// values and that there are not too many of them
+func ValidateTags(tags map[string]string) error {
+	if len(tags) > MaxTags {
+		return fmt.Errorf("%w: %d tags, at most %d", ErrInvalidTags, len(tags), MaxTags)
+	}
+	for key, value := range tags {
+		if !tagKeyPattern.MatchString(key) {
+			return fmt.Errorf("%w: invalid key %q", ErrInvalidTags, key)
+		}
+		if value == "" || len(value) > MaxTagValueLen {
+			return fmt.Errorf("%w: %s must have a value of 1 to %d bytes", ErrInvalidTags, key, MaxTagValueLen)
+		}
+		if strings.IndexFunc(value, func(r rune) bool { return !unicode.IsPrint(r) }) >= 0 {
+			return fmt.Errorf("%w: %s has a value with unprintable characters", ErrInvalidTags, key)
+		}
+	}
+	return nil
+}
+
+// MergeTags returns the tags with the annotations added, replacing the
+// values of keys they already had
+func MergeTags(tags, annotations map[string]string) map[string]string {
+	merged := make(map[string]string, len(tags)+len(annotations))
+	for key, value := range tags {
+		merged[key] = value
+	}
+	for key, value := range annotations {
+		merged[key] = value
+	}
+	return merged
+}
+
+// ParseTagFilter reads tag filters given as key:value, such as branch:main
+func ParseTagFilter(values []string) (map[string]string, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+	tags := make(map[string]string, len(values))
+	for _, value := range values {
+		key, tag, found := strings.Cut(value, ":")
+		if !found {
+			return nil, fmt.Errorf("%w: filter %q is not key:value", ErrInvalidTags, value)
+		}
+		tags[key] = tag
+	}
+	if err := ValidateTags(tags); err != nil {
+		return nil, err
+	}
+	return tags, nil
+}
+
+// HasTags reports whether tags carry every tag of the filter
+func HasTags(tags, filter map[string]string) bool {
+	for key, value := range filter {
+		if tags[key] != value {
+			return false
+		}
+	}
+	return true
+}
@@ -1,15 +1,23 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
+	"distributed-gradle-building/chaos"
+	"distributed-gradle-building/encryption"
+	"distributed-gradle-building/internal/app"
+	"distributed-gradle-building/metrics"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
@@ -25,40 +33,42 @@ type CacheServer struct {
 	missCount  int64
 	startTime  time.Time
 	httpServer *http.Server
+	chaos      *chaos.Injector
+	cipher     *encryption.Cipher
 }
 
 // Prometheus metrics
 var (
 	cacheHitsTotal = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
-			Name: "cache_hits_total",
+			Name: metrics.CacheHitsTotal,
 			Help: "Total number of cache hits",
 		},
 		[]string{"operation"},
 	)
 	cacheMissesTotal = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
-			Name: "cache_misses_total",
+			Name: metrics.CacheMissesTotal,
 			Help: "Total number of cache misses",
 		},
 		[]string{"operation"},
 	)
 	cacheRequestsTotal = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
-			Name: "cache_requests_total",
+			Name: metrics.CacheRequestsTotal,
 			Help: "Total number of cache requests",
 		},
 		[]string{"operation"},
 	)
 	cacheSizeBytes = prometheus.NewGauge(
 		prometheus.GaugeOpts{
-			Name: "cache_size_bytes",
+			Name: metrics.CacheSizeBytes,
 			Help: "Current cache size in bytes",
 		},
 	)
 	cacheEntriesTotal = prometheus.NewGauge(
 		prometheus.GaugeOpts{
-			Name: "cache_entries_total",
+			Name: metrics.CacheEntriesTotal,
 			Help: "Total number of cache entries",
 		},
 	)
@@ -88,6 +98,9 @@ type CacheConfig struct {
 	Authentication  bool          `json:"authentication"`
 	AuthToken       string        `json:"auth_token"`
 	CleanupInterval time.Duration `json:"cleanup_interval"`
+	// Encryption encrypts entry data at rest with a key from Vault, AWS KMS
+	// or a file, whichever storage backend is used
+	Encryption encryption.Config `json:"encryption"`
 }
 
 // CacheEntry represents a cached build artifact
@@ -102,6 +115,8 @@ type CacheEntry struct {
 	Metadata     map[string]any `json:"metadata"`
 	AccessCount  int64          `json:"access_count"`
 	Compression  bool           `json:"compression"`
+	// EncryptionKeyID names the key the data is encrypted with, if any
+	EncryptionKeyID string `json:"encryption_key_id,omitempty"`
 }
 
 // CacheStorage interface for different storage backends
@@ -158,6 +173,7 @@ func NewCacheServer(config *CacheConfig) (*CacheServer, error) {
 		startTime:  time.Now(),
 		hitCount:   0,
 		missCount:  0,
+		chaos:      chaos.NewInjectorFromEnv(),
 	}
 
 	// Initialize storage
@@ -177,19 +193,19 @@ func NewCacheServer(config *CacheConfig) (*CacheServer, error) {
 		return nil, fmt.Errorf("failed to initialize storage: %v", err)
 	}
 
+	// Refuse to start rather than store entries in plaintext if encryption
+	// is configured but its key cannot be fetched
+	server.cipher, err = encryption.Load(config.Encryption)
+	if err != nil {
+		return nil, err
+	}
+	if server.cipher != nil {
+		log.Printf("Encrypting cache entries at rest with key %s from %s", server.cipher.KeyID(), config.Encryption.KeyProvider)
+	}
+
 	// Load existing cache entries
 	server.loadExistingEntries()
 
-	// Register Prometheus metrics
-	prometheus.MustRegister(
-		cacheHitsTotal,
-		cacheMissesTotal,
-		cacheRequestsTotal,
-		cacheSizeBytes,
-		cacheEntriesTotal,
-		httpRequestsTotal,
-	)
-
 	return server, nil
 }
 
@@ -584,6 +600,18 @@ func (cs *CacheServer) Put(key string, request *CacheRequest) error {
 		Compression:  cs.config.Compression,
 	}
 
+	// The cache key is authenticated with the data, so encrypted data cannot
+	// be served under another key
+	data := request.Data
+	if cs.cipher != nil {
+		sealed, err := cs.cipher.Seal(data, []byte(key))
+		if err != nil {
+			return err
+		}
+		data = sealed
+		entry.EncryptionKeyID = cs.cipher.KeyID()
+	}
+
 	if err := cs.storage.Put(key, entry); err != nil {
 		return err
 	}
@@ -592,7 +620,7 @@ func (cs *CacheServer) Put(key string, request *CacheRequest) error {
 
 	// Store actual data
 	dataPath := filepath.Join(cs.storageDir, key+".data")
-	if err := os.WriteFile(dataPath, request.Data, 0644); err != nil {
+	if err := os.WriteFile(dataPath, data, 0644); err != nil {
 		return err
 	}
 
@@ -624,15 +652,11 @@ func (cs *CacheServer) Get(key string) (*CacheResponse, error) {
 		return &CacheResponse{Found: false}, nil
 	}
 
-	// Update access info
-	entry.LastAccessed = time.Now()
-	entry.AccessCount++
-	cs.hitCount++
-	cacheHitsTotal.WithLabelValues("get").Inc()
-	cacheRequestsTotal.WithLabelValues("get").Inc()
-
 	// Load data
 	dataPath := filepath.Join(cs.storageDir, key+".data")
+	if cs.chaos.CorruptCacheEntry() {
+		cs.corruptEntry(key, dataPath)
+	}
 	data, err := os.ReadFile(dataPath)
 	if err != nil {
 		delete(cs.cache, key)
@@ -642,6 +666,24 @@ func (cs *CacheServer) Get(key string) (*CacheResponse, error) {
 		return &CacheResponse{Found: false}, err
 	}
 
+	// Evict entries that cannot be decrypted, such as entries stored before
+	// encryption was enabled or under another key, and entries whose data no
+	// longer matches the hash they were stored with
+	data, err = cs.plaintext(key, data)
+	if err != nil {
+		return cs.evictUnreadable(key, dataPath, err.Error()), nil
+	}
+	if !verifyHash(entry.Hash, data) {
+		return cs.evictUnreadable(key, dataPath, "data does not match its hash"), nil
+	}
+
+	// Update access info
+	entry.LastAccessed = time.Now()
+	entry.AccessCount++
+	cs.hitCount++
+	cacheHitsTotal.WithLabelValues("get").Inc()
+	cacheRequestsTotal.WithLabelValues("get").Inc()
+
 	return &CacheResponse{
 		Found:    true,
 		Entry:    entry,
@@ -650,6 +692,62 @@ func (cs *CacheServer) Get(key string) (*CacheResponse, error) {
 	}, nil
 }
 
+// plaintext returns the plaintext of stored entry data
+func (cs *CacheServer) plaintext(key string, data []byte) ([]byte, error) {
+	switch {
+	case cs.cipher != nil:
+		return cs.cipher.Open(data, []byte(key))
+	case encryption.IsSealed(data):
+		return nil, fmt.Errorf("data is encrypted but encryption is not configured")
+	default:
+		return data, nil
+	}
+}
+
+// evictUnreadable removes an entry whose data cannot be served and counts a
+// miss. Must be called with the mutex held.
+func (cs *CacheServer) evictUnreadable(key, dataPath, reason string) *CacheResponse {
+	log.Printf("Evicting cache entry %s: %s", key, reason)
+	delete(cs.cache, key)
+	cs.storage.Delete(key)
+	os.Remove(dataPath)
+	cs.missCount++
+	cacheMissesTotal.WithLabelValues("get").Inc()
+	cacheRequestsTotal.WithLabelValues("get").Inc()
+	return &CacheResponse{Found: false}
+}
+
+// corruptEntry damages the stored data of an entry for fault injection
+func (cs *CacheServer) corruptEntry(key, dataPath string) {
+	data, err := os.ReadFile(dataPath)
+	if err != nil {
+		return
+	}
+
+	cs.chaos.Corrupt(data)
+	if err := os.WriteFile(dataPath, data, 0644); err != nil {
+		log.Printf("Chaos: failed to corrupt cache entry %s: %v", key, err)
+		return
+	}
+	log.Printf("Chaos: corrupted cache entry %s", key)
+}
+
+// verifyHash reports whether data matches a SHA-256 hash given as hex digits,
+// optionally prefixed with "sha256:". Other hashes cannot be verified and
+// are accepted.
+func verifyHash(hash string, data []byte) bool {
+	digest := strings.TrimPrefix(hash, "sha256:")
+	if len(digest) != sha256.Size*2 {
+		return true
+	}
+	if _, err := hex.DecodeString(digest); err != nil {
+		return true
+	}
+
+	sum := sha256.Sum256(data)
+	return strings.EqualFold(digest, hex.EncodeToString(sum[:]))
+}
+
 // Delete removes an entry from the cache
 func (cs *CacheServer) Delete(key string) error {
 	cs.mutex.Lock()
@@ -723,6 +821,13 @@ func (cs *CacheServer) GetStats() map[string]any {
 
 // StartHTTPServer starts the cache server's HTTP API
 func (cs *CacheServer) StartHTTPServer() error {
+	cs.listen()
+	return cs.httpServer.ListenAndServe()
+}
+
+// listen creates the HTTP server of the cache, to be served with
+// ListenAndServe, and starts the cleanup and metrics routines
+func (cs *CacheServer) listen() {
 	mux := http.NewServeMux()
 
 	// API endpoints
@@ -732,6 +837,12 @@ func (cs *CacheServer) StartHTTPServer() error {
 	mux.HandleFunc("/health", cs.handleHealthCheck)
 	mux.Handle("/metrics", promhttp.Handler())
 
+	// Fault injection, only when enabled for resilience testing
+	if cs.chaos != nil {
+		mux.HandleFunc("GET /api/chaos", cs.chaos.Handler(nil))
+		mux.HandleFunc("PUT /api/chaos", cs.chaos.Handler(nil))
+	}
+
 	cs.httpServer = &http.Server{
 		Addr:    fmt.Sprintf("%s:%d", cs.config.Host, cs.config.Port),
 		Handler: cs.authMiddleware(mux),
@@ -744,7 +855,6 @@ func (cs *CacheServer) StartHTTPServer() error {
 	go cs.updateMetrics()
 
 	log.Printf("Starting cache server on %s:%d", cs.config.Host, cs.config.Port)
-	return cs.httpServer.ListenAndServe()
 }
 
 // authMiddleware adds authentication middleware if enabled
@@ -853,30 +963,58 @@ func (cs *CacheServer) updateMetrics() {
 	}
 }
 
-func cacheServerMain() {
-	// Load configuration
-	configFile := "cache_config.json"
-	if len(os.Args) > 1 {
-		configFile = os.Args[1]
-	}
+// cacheProcess runs the cache server as an app.Service
+type cacheProcess struct {
+	server *CacheServer
+}
 
-	config, err := loadCacheConfig(configFile)
-	if err != nil {
-		log.Fatalf("Failed to load cache config: %v", err)
-	}
+// Name identifies the cache server in logs
+func (p *cacheProcess) Name() string {
+	return "cache server"
+}
 
-	// Create and start cache server
-	server, err := NewCacheServer(config)
+// Init loads the configuration of the cache server from the file named by
+// the first argument and loads the existing cache entries
+func (p *cacheProcess) Init(ctx context.Context) error {
+	config, err := loadCacheConfig(app.ConfigFile("cache_config.json"))
 	if err != nil {
-		log.Fatalf("Failed to create cache server: %v", err)
+		return fmt.Errorf("failed to load cache config: %v", err)
+	}
+	if p.server, err = NewCacheServer(config); err != nil {
+		return fmt.Errorf("failed to create cache server: %v", err)
 	}
+	return nil
+}
 
-	log.Printf("Starting cache server on %s:%d", config.Host, config.Port)
-	if err := server.StartHTTPServer(); err != nil {
-		log.Fatalf("Failed to start HTTP server: %v", err)
+// Collectors returns the metrics of the cache and its HTTP requests
+func (p *cacheProcess) Collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		cacheHitsTotal,
+		cacheMissesTotal,
+		cacheRequestsTotal,
+		cacheSizeBytes,
+		cacheEntriesTotal,
+		httpRequestsTotal,
 	}
 }
 
+// Start starts the HTTP server. It is created before it is served, so Stop
+// shuts it down however early the service stops.
+func (p *cacheProcess) Start(ctx context.Context) error {
+	p.server.listen()
+	app.Go(ctx, p.server.httpServer.ListenAndServe)
+	return nil
+}
+
+// Stop shuts the HTTP server down
+func (p *cacheProcess) Stop(ctx context.Context, cause error) error {
+	return p.server.httpServer.Shutdown(ctx)
+}
+
+func cacheServerMain() {
+	app.Main(&cacheProcess{})
+}
+
 // loadCacheConfig loads cache configuration from file
 func loadCacheConfig(filename string) (*CacheConfig, error) {
 	data, err := os.ReadFile(filename)
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"distributed-gradle-building/chaos"
+	"distributed-gradle-building/encryption"
+)
+
+func newTestCacheServer(t *testing.T) *CacheServer {
+	dir := t.TempDir()
+	storage, err := NewFileSystemStorage(dir)
+	if err != nil {
+		t.Fatalf("Failed to create storage: %v", err)
+	}
+
+	return &CacheServer{
+		config:     &CacheConfig{},
+		cache:      make(map[string]*CacheEntry),
+		storageDir: dir,
+		storage:    storage,
+	}
+}
+
+func TestCacheServerEvictsCorruptedEntries(t *testing.T) {
+	server := newTestCacheServer(t)
+	data := []byte("compiled classes")
+	sum := sha256.Sum256(data)
+
+	if err := server.Put("classes", &CacheRequest{Data: data, Hash: "sha256:" + hex.EncodeToString(sum[:])}); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	response, err := server.Get("classes")
+	if err != nil || !response.Found || string(response.Data) != string(data) {
+		t.Fatalf("Expected intact entry to be served, got %+v, %v", response, err)
+	}
+
+	server.chaos, _ = chaos.NewInjector(chaos.Config{CacheCorruptionRate: 1})
+	response, err = server.Get("classes")
+	if err != nil || response.Found {
+		t.Fatalf("Expected corrupted entry to be a miss, got %+v, %v", response, err)
+	}
+	if _, exists := server.cache["classes"]; exists {
+		t.Error("Expected corrupted entry to be evicted")
+	}
+	if server.missCount != 1 || server.hitCount != 1 {
+		t.Errorf("Expected 1 hit and 1 miss, got %d and %d", server.hitCount, server.missCount)
+	}
+}
+
+func TestVerifyHash(t *testing.T) {
+	data := []byte("artifact")
+	sum := sha256.Sum256(data)
+	digest := hex.EncodeToString(sum[:])
+
+	tests := []struct {
+		hash     string
+		expected bool
+	}{
+		{digest, true},
+		{"sha256:" + digest, true},
+		{strings.Repeat("0", 64), false},
+		{"", true},
+		{"md5:0cc175b9c0f1b6a831c399e269772661", true},
+	}
+
+	for _, tc := range tests {
+		if got := verifyHash(tc.hash, data); got != tc.expected {
+			t.Errorf("verifyHash(%q): expected %v, got %v", tc.hash, tc.expected, got)
+		}
+	}
+}
+
+func TestCacheServerEncryptsEntries(t *testing.T) {
+	server := newTestCacheServer(t)
+	plain := []byte("plaintext stored before encryption")
+	if err := server.Put("legacy", &CacheRequest{Data: plain}); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	server.cipher, _ = encryption.NewCipher(bytes.Repeat([]byte{7}, encryption.KeySize), "cache-key")
+	data := []byte("proprietary compiled classes")
+	sum := sha256.Sum256(data)
+	if err := server.Put("classes", &CacheRequest{Data: data, Hash: hex.EncodeToString(sum[:])}); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	stored, err := os.ReadFile(filepath.Join(server.storageDir, "classes.data"))
+	if err != nil || bytes.Contains(stored, data) || !encryption.IsSealed(stored) {
+		t.Fatalf("Expected data to be encrypted at rest, got %q, %v", stored, err)
+	}
+
+	response, err := server.Get("classes")
+	if err != nil || !response.Found || !bytes.Equal(response.Data, data) {
+		t.Fatalf("Expected decrypted entry, got %+v, %v", response, err)
+	}
+	if response.Entry.EncryptionKeyID != "cache-key" || response.Entry.Size != int64(len(data)) {
+		t.Errorf("Unexpected entry %+v", response.Entry)
+	}
+
+	// Plaintext stored before encryption was enabled is not served
+	if response, err := server.Get("legacy"); err != nil || response.Found {
+		t.Errorf("Expected plaintext entry to be a miss, got %+v, %v", response, err)
+	}
+	if _, err := os.Stat(filepath.Join(server.storageDir, "legacy.data")); !os.IsNotExist(err) {
+		t.Errorf("Expected plaintext entry to be removed, got %v", err)
+	}
+
+	// Encrypted data is not served without the key
+	server.cipher = nil
+	if response, err := server.Get("classes"); err != nil || response.Found {
+		t.Errorf("Expected encrypted entry to be a miss without a key, got %+v, %v", response, err)
+	}
+}
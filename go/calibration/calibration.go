@@ -0,0 +1,227 @@
+// Package calibration benchmarks a worker when it registers, so that build
+// durations predicted from the whole fleet can be scaled to the worker a
+// build runs on. The benchmark measures single and multi core hashing
+// throughput, disk write throughput and the startup time of the JVM, and
+// takes about a second.
+package calibration
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Weights of the benchmark components in a worker's speed. Gradle builds
+// are dominated by parallel compilation and tests.
+const (
+	multiCoreWeight  = 0.4
+	singleCoreWeight = 0.3
+	diskWeight       = 0.2
+	jvmStartupWeight = 0.1
+)
+
+// hashBlockSize is the size of the blocks hashed by the CPU benchmarks
+const hashBlockSize = 64 * 1024
+
+// Scores are the results of a calibration benchmark. A zero score was not
+// measured.
+type Scores struct {
+	// CPUSingleCore and CPUMultiCore are the SHA-256 throughput in MB/s of
+	// one core and of all cores
+	CPUSingleCore float64 `json:"cpu_single_core"`
+	CPUMultiCore  float64 `json:"cpu_multi_core"`
+	Cores         int     `json:"cores"`
+	// DiskWrite is the throughput in MB/s of writing and syncing a file in
+	// the build directory
+	DiskWrite float64 `json:"disk_write"`
+	// JVMStartup is how long `java -version` takes, zero without a JDK
+	JVMStartup time.Duration `json:"jvm_startup"`
+	MeasuredAt time.Time     `json:"measured_at"`
+}
+
+// Config sizes the benchmark
+type Config struct {
+	// CPUDuration is how long each CPU benchmark hashes
+	CPUDuration time.Duration
+	// Dir is where the disk benchmark writes DiskBytes
+	Dir       string
+	DiskBytes int64
+	// Java is the java executable timed at startup; empty skips the JVM
+	// benchmark
+	Java string
+}
+
+// DefaultConfig benchmarks for 250ms per CPU test, writes 32 MiB to dir and
+// times the java of JAVA_HOME or the PATH
+func DefaultConfig(dir string) Config {
+	config := Config{CPUDuration: 250 * time.Millisecond, Dir: dir, DiskBytes: 32 << 20}
+	if home := os.Getenv("JAVA_HOME"); home != "" {
+		config.Java = filepath.Join(home, "bin", "java")
+	} else if java, err := exec.LookPath("java"); err == nil {
+		config.Java = java
+	}
+	return config
+}
+
+// Run benchmarks the machine. A failing disk or JVM benchmark leaves its
+// score zero and is reported with the CPU scores.
+func Run(config Config) (Scores, error) {
+	scores := Scores{Cores: runtime.NumCPU(), MeasuredAt: time.Now()}
+	scores.CPUSingleCore = hashThroughput(1, config.CPUDuration)
+	scores.CPUMultiCore = hashThroughput(scores.Cores, config.CPUDuration)
+
+	var errs []error
+	if config.DiskBytes > 0 {
+		throughput, err := diskThroughput(config.Dir, config.DiskBytes)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("disk benchmark failed: %v", err))
+		}
+		scores.DiskWrite = throughput
+	}
+	if config.Java != "" {
+		startup, err := jvmStartup(config.Java)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("JVM benchmark failed: %v", err))
+		}
+		scores.JVMStartup = startup
+	}
+
+	return scores, errors.Join(errs...)
+}
+
+// hashThroughput hashes blocks on the given number of goroutines for a
+// duration and returns the total throughput in MB/s
+func hashThroughput(goroutines int, duration time.Duration) float64 {
+	var wg sync.WaitGroup
+	counts := make([]int, goroutines)
+	start := time.Now()
+	for i := range counts {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			block := make([]byte, hashBlockSize)
+			for time.Since(start) < duration {
+				sum := sha256.Sum256(block)
+				block[0] = sum[0]
+				counts[i]++
+			}
+		}()
+	}
+	wg.Wait()
+
+	total := 0
+	for _, count := range counts {
+		total += count
+	}
+	return float64(total*hashBlockSize) / 1e6 / time.Since(start).Seconds()
+}
+
+// diskThroughput writes and syncs a file of size bytes in dir and returns
+// the throughput in MB/s
+func diskThroughput(dir string, size int64) (float64, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return 0, err
+	}
+	file, err := os.CreateTemp(dir, "calibration-")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	block := make([]byte, 1<<20)
+	start := time.Now()
+	for written := int64(0); written < size; written += int64(len(block)) {
+		if _, err := file.Write(block[:min(int64(len(block)), size-written)]); err != nil {
+			return 0, err
+		}
+	}
+	if err := file.Sync(); err != nil {
+		return 0, err
+	}
+	return float64(size) / 1e6 / time.Since(start).Seconds(), nil
+}
+
+// jvmStartup times `java -version`
+func jvmStartup(java string) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	if output, err := exec.CommandContext(ctx, java, "-version").CombinedOutput(); err != nil {
+		return 0, fmt.Errorf("%v: %s", err, output)
+	}
+	return time.Since(start), nil
+}
+
+// Speed returns how fast a worker is relative to reference scores, such as
+// the Reference of the fleet: 2 is twice as fast. Only the components both
+// measured count; without any the worker is as fast as the reference.
+func (s Scores) Speed(reference Scores) float64 {
+	var speed, weights float64
+	add := func(weight, ratio float64) {
+		speed += weight * ratio
+		weights += weight
+	}
+	if s.CPUMultiCore > 0 && reference.CPUMultiCore > 0 {
+		add(multiCoreWeight, s.CPUMultiCore/reference.CPUMultiCore)
+	}
+	if s.CPUSingleCore > 0 && reference.CPUSingleCore > 0 {
+		add(singleCoreWeight, s.CPUSingleCore/reference.CPUSingleCore)
+	}
+	if s.DiskWrite > 0 && reference.DiskWrite > 0 {
+		add(diskWeight, s.DiskWrite/reference.DiskWrite)
+	}
+	if s.JVMStartup > 0 && reference.JVMStartup > 0 {
+		add(jvmStartupWeight, float64(reference.JVMStartup)/float64(s.JVMStartup))
+	}
+
+	if weights == 0 {
+		return 1
+	}
+	return speed / weights
+}
+
+// Reference returns the median of each score over the workers that
+// measured it, the speed of a typical worker of the fleet
+func Reference(scores []Scores) Scores {
+	var singleCore, multiCore, disk, jvm []float64
+	for _, score := range scores {
+		singleCore = appendMeasured(singleCore, score.CPUSingleCore)
+		multiCore = appendMeasured(multiCore, score.CPUMultiCore)
+		disk = appendMeasured(disk, score.DiskWrite)
+		jvm = appendMeasured(jvm, float64(score.JVMStartup))
+	}
+	return Scores{
+		CPUSingleCore: median(singleCore),
+		CPUMultiCore:  median(multiCore),
+		DiskWrite:     median(disk),
+		JVMStartup:    time.Duration(median(jvm)),
+	}
+}
+
+func appendMeasured(values []float64, value float64) []float64 {
+	if value > 0 {
+		return append(values, value)
+	}
+	return values
+}
+
+func median(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sort.Float64s(values)
+	if len(values)%2 == 0 {
+		return (values[len(values)/2-1] + values[len(values)/2]) / 2
+	}
+	return values[len(values)/2]
+}
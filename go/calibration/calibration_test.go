@@ -0,0 +1,49 @@
+package calibration
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRun(t *testing.T) {
+	config := Config{CPUDuration: 20 * time.Millisecond, Dir: t.TempDir(), DiskBytes: 1 << 20}
+	scores, err := Run(config)
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if scores.CPUSingleCore <= 0 || scores.CPUMultiCore <= 0 || scores.DiskWrite <= 0 || scores.Cores <= 0 {
+		t.Errorf("Expected CPU and disk scores, got %+v", scores)
+	}
+	if scores.JVMStartup != 0 {
+		t.Errorf("Expected no JVM score without java, got %v", scores.JVMStartup)
+	}
+
+	// A missing JDK fails only its own benchmark
+	config.Java = "/nonexistent/java"
+	if scores, err := Run(config); err == nil || scores.CPUSingleCore <= 0 {
+		t.Errorf("Expected the JVM benchmark to fail alone, got %+v, %v", scores, err)
+	}
+}
+
+func TestSpeed(t *testing.T) {
+	reference := Reference([]Scores{
+		{CPUSingleCore: 100, CPUMultiCore: 800, DiskWrite: 200, JVMStartup: time.Second},
+		{CPUSingleCore: 200, CPUMultiCore: 1600, DiskWrite: 400, JVMStartup: 500 * time.Millisecond},
+		{CPUSingleCore: 300, CPUMultiCore: 2400},
+	})
+	if reference.CPUSingleCore != 200 || reference.CPUMultiCore != 1600 || reference.DiskWrite != 300 || reference.JVMStartup != 750*time.Millisecond {
+		t.Fatalf("Expected the median of the measured scores, got %+v", reference)
+	}
+
+	twice := Scores{CPUSingleCore: 400, CPUMultiCore: 3200, DiskWrite: 600, JVMStartup: 375 * time.Millisecond}
+	if speed := twice.Speed(reference); speed < 1.999 || speed > 2.001 {
+		t.Errorf("Expected twice the speed, got %v", speed)
+	}
+	// Components the worker did not measure are left out
+	if speed := (Scores{CPUMultiCore: 800}).Speed(reference); speed != 0.5 {
+		t.Errorf("Expected half the speed, got %v", speed)
+	}
+	if speed := (Scores{}).Speed(reference); speed != 1 {
+		t.Errorf("Expected an unmeasured worker to be typical, got %v", speed)
+	}
+}
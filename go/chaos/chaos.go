@@ -0,0 +1,286 @@
+// Package chaos injects faults into the services for resilience testing:
+// delayed RPCs, dropped heartbeats, builds killed mid-run and corrupted cache
+// entries. It is only active when CHAOS_ENABLED is set; a nil Injector never
+// injects anything, so call sites need no checks.
+package chaos
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"distributed-gradle-building/openapi"
+)
+
+// Injectable faults
+const (
+	FaultRPCDelay        = "rpc_delay"
+	FaultHeartbeatDrop   = "heartbeat_drop"
+	FaultBuildKill       = "build_kill"
+	FaultCacheCorruption = "cache_corruption"
+)
+
+// Config sets how often each fault is injected. Rates are probabilities
+// between 0 and 1; the zero Config injects nothing.
+type Config struct {
+	// RPCDelayRate is the probability an outgoing RPC is delayed by up to
+	// MaxRPCDelayMs milliseconds
+	RPCDelayRate  float64 `json:"rpc_delay_rate"`
+	MaxRPCDelayMs int     `json:"max_rpc_delay_ms"`
+	// HeartbeatDropRate is the probability a heartbeat is lost
+	HeartbeatDropRate float64 `json:"heartbeat_drop_rate"`
+	// BuildKillRate is the probability a build is killed when it starts a task
+	BuildKillRate float64 `json:"build_kill_rate"`
+	// CacheCorruptionRate is the probability a cache entry is corrupted when read
+	CacheCorruptionRate float64 `json:"cache_corruption_rate"`
+	// Seed reseeds the random source when non-zero, making runs reproducible
+	Seed int64 `json:"seed,omitempty"`
+}
+
+// Validate checks that rates are probabilities and delays are not negative
+func (c Config) Validate() error {
+	rates := map[string]float64{
+		"rpc_delay_rate":        c.RPCDelayRate,
+		"heartbeat_drop_rate":   c.HeartbeatDropRate,
+		"build_kill_rate":       c.BuildKillRate,
+		"cache_corruption_rate": c.CacheCorruptionRate,
+	}
+	for name, rate := range rates {
+		if rate < 0 || rate > 1 {
+			return fmt.Errorf("%s must be between 0 and 1, got %g", name, rate)
+		}
+	}
+
+	if c.MaxRPCDelayMs < 0 {
+		return fmt.Errorf("max_rpc_delay_ms must not be negative, got %d", c.MaxRPCDelayMs)
+	}
+	if c.RPCDelayRate > 0 && c.MaxRPCDelayMs == 0 {
+		return fmt.Errorf("max_rpc_delay_ms is required with rpc_delay_rate")
+	}
+	return nil
+}
+
+// State is the current configuration and how many faults have been injected
+type State struct {
+	Config   Config           `json:"config"`
+	Injected map[string]int64 `json:"injected"`
+}
+
+// Injector decides which faults to inject
+type Injector struct {
+	mutex    sync.Mutex
+	config   Config
+	random   *rand.Rand
+	injected map[string]int64
+}
+
+// NewInjector creates an injector with the given configuration
+func NewInjector(config Config) (*Injector, error) {
+	i := &Injector{
+		random:   rand.New(rand.NewSource(time.Now().UnixNano())),
+		injected: make(map[string]int64),
+	}
+	if err := i.SetConfig(config); err != nil {
+		return nil, err
+	}
+	return i, nil
+}
+
+// NewInjectorFromEnv creates an injector injecting nothing until configured
+// through the API if CHAOS_ENABLED is true, and returns nil otherwise.
+// CHAOS_SEED seeds the random source.
+func NewInjectorFromEnv() *Injector {
+	if enabled, _ := strconv.ParseBool(os.Getenv("CHAOS_ENABLED")); !enabled {
+		return nil
+	}
+
+	var config Config
+	if seed := os.Getenv("CHAOS_SEED"); seed != "" {
+		value, err := strconv.ParseInt(seed, 10, 64)
+		if err != nil {
+			log.Printf("Ignoring invalid CHAOS_SEED %q: %v", seed, err)
+		}
+		config.Seed = value
+	}
+
+	i, err := NewInjector(config)
+	if err != nil {
+		log.Printf("Chaos injection disabled: %v", err)
+		return nil
+	}
+
+	log.Printf("Chaos injection enabled; configure faults through /api/chaos")
+	return i
+}
+
+// Config returns the current configuration
+func (i *Injector) Config() Config {
+	if i == nil {
+		return Config{}
+	}
+
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	return i.config
+}
+
+// SetConfig replaces the configuration, reseeding the random source if the
+// new configuration has a seed
+func (i *Injector) SetConfig(config Config) error {
+	if i == nil {
+		return fmt.Errorf("chaos injection is not enabled")
+	}
+	if err := config.Validate(); err != nil {
+		return err
+	}
+
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	i.config = config
+	if config.Seed != 0 {
+		i.random.Seed(config.Seed)
+	}
+	return nil
+}
+
+// State returns the configuration and injected fault counts
+func (i *Injector) State() State {
+	if i == nil {
+		return State{Injected: map[string]int64{}}
+	}
+
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	injected := make(map[string]int64, len(i.injected))
+	for fault, count := range i.injected {
+		injected[fault] = count
+	}
+	return State{Config: i.config, Injected: injected}
+}
+
+// roll reports whether a fault with the given rate is injected now, counting
+// it if so. Must be called with the mutex held.
+func (i *Injector) roll(fault string, rate float64) bool {
+	if rate <= 0 || i.random.Float64() >= rate {
+		return false
+	}
+
+	i.injected[fault]++
+	return true
+}
+
+// inject reports whether a fault is injected now
+func (i *Injector) inject(fault string, rate func(Config) float64) bool {
+	if i == nil {
+		return false
+	}
+
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	return i.roll(fault, rate(i.config))
+}
+
+// RPCDelay returns how long to delay an outgoing RPC, usually zero
+func (i *Injector) RPCDelay() time.Duration {
+	if i == nil {
+		return 0
+	}
+
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	if !i.roll(FaultRPCDelay, i.config.RPCDelayRate) {
+		return 0
+	}
+	return time.Duration(1+i.random.Intn(i.config.MaxRPCDelayMs)) * time.Millisecond
+}
+
+// DelayRPC sleeps before an outgoing RPC if a delay is injected
+func (i *Injector) DelayRPC(method string) {
+	if delay := i.RPCDelay(); delay > 0 {
+		log.Printf("Chaos: delaying %s by %v", method, delay)
+		time.Sleep(delay)
+	}
+}
+
+// DropHeartbeat reports whether a heartbeat should be lost
+func (i *Injector) DropHeartbeat() bool {
+	return i.inject(FaultHeartbeatDrop, func(c Config) float64 { return c.HeartbeatDropRate })
+}
+
+// KillBuild reports whether a running build should be killed
+func (i *Injector) KillBuild() bool {
+	return i.inject(FaultBuildKill, func(c Config) float64 { return c.BuildKillRate })
+}
+
+// CorruptCacheEntry reports whether a cache entry being read should be
+// corrupted
+func (i *Injector) CorruptCacheEntry() bool {
+	return i.inject(FaultCacheCorruption, func(c Config) float64 { return c.CacheCorruptionRate })
+}
+
+// Corrupt flips the bits of one byte of data in place
+func (i *Injector) Corrupt(data []byte) {
+	if i == nil || len(data) == 0 {
+		return
+	}
+
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	data[i.random.Intn(len(data))] ^= 0xff
+}
+
+// Handler serves the state of the injector on GET and replaces its
+// configuration on PUT. onUpdate, if set, is called after a successful update.
+func (i *Injector) Handler(onUpdate func(r *http.Request, config Config)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			var config Config
+			if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+				http.Error(w, fmt.Sprintf("invalid chaos configuration: %v", err), http.StatusBadRequest)
+				return
+			}
+			if err := i.SetConfig(config); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			log.Printf("Chaos configuration updated: %+v", config)
+			if onUpdate != nil {
+				onUpdate(r, config)
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(i.State())
+	}
+}
+
+// Routes describes the GET and PUT /api/chaos endpoints served by Handler
+func Routes() []openapi.Route {
+	return []openapi.Route{
+		{
+			Method:      "GET",
+			Path:        "/api/chaos",
+			Summary:     "Get the fault injection configuration and injected fault counts (only with CHAOS_ENABLED)",
+			OperationID: "getChaos",
+			Response:    State{},
+		},
+		{
+			Method:      "PUT",
+			Path:        "/api/chaos",
+			Summary:     "Replace the fault injection configuration (only with CHAOS_ENABLED)",
+			OperationID: "setChaos",
+			Request:     Config{},
+			Response:    State{},
+		},
+	}
+}
@@ -0,0 +1,166 @@
+package chaos
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNilInjectorInjectsNothing(t *testing.T) {
+	var injector *Injector
+
+	if injector.RPCDelay() != 0 || injector.DropHeartbeat() || injector.KillBuild() || injector.CorruptCacheEntry() {
+		t.Error("Expected a nil injector to inject no faults")
+	}
+
+	data := []byte("artifact")
+	injector.Corrupt(data)
+	if string(data) != "artifact" {
+		t.Errorf("Expected a nil injector to leave data intact, got %q", data)
+	}
+
+	if err := injector.SetConfig(Config{BuildKillRate: 1}); err == nil {
+		t.Error("Expected configuring a nil injector to fail")
+	}
+}
+
+func TestNewInjectorFromEnv(t *testing.T) {
+	t.Setenv("CHAOS_ENABLED", "")
+	if NewInjectorFromEnv() != nil {
+		t.Error("Expected no injector without CHAOS_ENABLED")
+	}
+
+	t.Setenv("CHAOS_ENABLED", "true")
+	injector := NewInjectorFromEnv()
+	if injector == nil {
+		t.Fatal("Expected an injector with CHAOS_ENABLED")
+	}
+	if injector.KillBuild() {
+		t.Error("Expected an unconfigured injector to inject no faults")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		config Config
+		err    string
+	}{
+		{Config{}, ""},
+		{Config{RPCDelayRate: 0.5, MaxRPCDelayMs: 100, HeartbeatDropRate: 1}, ""},
+		{Config{BuildKillRate: 1.5}, "build_kill_rate must be between 0 and 1"},
+		{Config{CacheCorruptionRate: -0.1}, "cache_corruption_rate must be between 0 and 1"},
+		{Config{MaxRPCDelayMs: -1}, "max_rpc_delay_ms must not be negative"},
+		{Config{RPCDelayRate: 0.5}, "max_rpc_delay_ms is required"},
+	}
+
+	for _, tc := range tests {
+		err := tc.config.Validate()
+		if tc.err == "" && err != nil {
+			t.Errorf("%+v: unexpected error %v", tc.config, err)
+		}
+		if tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)) {
+			t.Errorf("%+v: expected error containing %q, got %v", tc.config, tc.err, err)
+		}
+	}
+}
+
+func TestFaultRates(t *testing.T) {
+	injector, err := NewInjector(Config{HeartbeatDropRate: 1, RPCDelayRate: 1, MaxRPCDelayMs: 5})
+	if err != nil {
+		t.Fatalf("NewInjector failed: %v", err)
+	}
+
+	for range 10 {
+		if !injector.DropHeartbeat() {
+			t.Fatal("Expected every heartbeat to be dropped at rate 1")
+		}
+		if injector.KillBuild() {
+			t.Fatal("Expected no build to be killed at rate 0")
+		}
+		if delay := injector.RPCDelay(); delay <= 0 || delay > 5*time.Millisecond {
+			t.Fatalf("Expected a delay of up to 5ms, got %v", delay)
+		}
+	}
+
+	injected := injector.State().Injected
+	if injected[FaultHeartbeatDrop] != 10 || injected[FaultRPCDelay] != 10 || injected[FaultBuildKill] != 0 {
+		t.Errorf("Unexpected injected fault counts: %v", injected)
+	}
+}
+
+func TestSeedMakesFaultsReproducible(t *testing.T) {
+	sequence := func() []bool {
+		injector, err := NewInjector(Config{BuildKillRate: 0.5, Seed: 42})
+		if err != nil {
+			t.Fatalf("NewInjector failed: %v", err)
+		}
+
+		kills := make([]bool, 20)
+		for i := range kills {
+			kills[i] = injector.KillBuild()
+		}
+		return kills
+	}
+
+	first, second := sequence(), sequence()
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatalf("Expected the same faults with the same seed, differed at %d", i)
+		}
+	}
+}
+
+func TestCorrupt(t *testing.T) {
+	injector, _ := NewInjector(Config{})
+	data := []byte("artifact")
+	injector.Corrupt(data)
+
+	changed := 0
+	for i := range data {
+		if data[i] != "artifact"[i] {
+			changed++
+		}
+	}
+	if changed != 1 {
+		t.Errorf("Expected exactly one corrupted byte, got %d", changed)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	injector, _ := NewInjector(Config{})
+	var updated *Config
+	handler := injector.Handler(func(r *http.Request, config Config) { updated = &config })
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("PUT", "/api/chaos", strings.NewReader(`{"build_kill_rate": 0.25}`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if updated == nil || updated.BuildKillRate != 0.25 {
+		t.Errorf("Expected update callback with the new configuration, got %+v", updated)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/chaos", nil))
+	var state State
+	if err := json.NewDecoder(w.Body).Decode(&state); err != nil {
+		t.Fatalf("Failed to decode state: %v", err)
+	}
+	if state.Config.BuildKillRate != 0.25 {
+		t.Errorf("Expected build kill rate 0.25, got %v", state.Config.BuildKillRate)
+	}
+
+	for _, body := range []string{`{"heartbeat_drop_rate": 2}`, `not json`} {
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("PUT", "/api/chaos", strings.NewReader(body)))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status %d, got %d", body, http.StatusBadRequest, w.Code)
+		}
+	}
+	if injector.Config().HeartbeatDropRate != 0 {
+		t.Error("Expected a rejected configuration to leave the injector unchanged")
+	}
+}
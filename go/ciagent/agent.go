@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// Supported CI agents
+const (
+	agentJenkins  = "jenkins"
+	agentTeamCity = "teamcity"
+)
+
+// Default agent locations, as in the jenkins/inbound-agent and
+// jetbrains/teamcity-agent images
+const (
+	defaultJenkinsAgentJar  = "/usr/share/jenkins/agent.jar"
+	defaultTeamCityAgentDir = "/opt/buildagent"
+)
+
+// agentCommand returns the command starting a CI agent: the Jenkins inbound
+// agent from JENKINS_AGENT_JAR, or the TeamCity agent in TEAMCITY_AGENT_HOME
+func agentCommand(kind string, args []string, getenv func(string) string) (*exec.Cmd, error) {
+	switch kind {
+	case agentJenkins:
+		jar := getenv("JENKINS_AGENT_JAR")
+		if jar == "" {
+			jar = defaultJenkinsAgentJar
+		}
+		return exec.Command("java", append([]string{"-jar", jar}, args...)...), nil
+	case agentTeamCity:
+		home := getenv("TEAMCITY_AGENT_HOME")
+		if home == "" {
+			home = defaultTeamCityAgentDir
+		}
+		if len(args) == 0 {
+			args = []string{"run"}
+		}
+		return exec.Command(filepath.Join(home, "bin", "agent.sh"), args...), nil
+	default:
+		return nil, fmt.Errorf("unknown agent %q", kind)
+	}
+}
+
+// installShim links gradle in dir to the ciagent executable
+func installShim(dir, executable string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create shim directory: %v", err)
+	}
+
+	link := filepath.Join(dir, "gradle")
+	os.Remove(link)
+	if err := os.Symlink(executable, link); err != nil {
+		return fmt.Errorf("failed to install gradle shim: %v", err)
+	}
+	return nil
+}
+
+// agentEnv returns the agent's environment with the shim directory first on
+// the PATH. The gradle the shim replaces becomes DGB_FALLBACK_GRADLE unless
+// that is set.
+func agentEnv(environ []string, shimDir, localGradle string) []string {
+	env := make([]string, 0, len(environ)+2)
+	path, hasFallback := "", false
+	for _, entry := range environ {
+		switch {
+		case strings.HasPrefix(entry, "PATH="):
+			path = strings.TrimPrefix(entry, "PATH=")
+			continue
+		case strings.HasPrefix(entry, "DGB_FALLBACK_GRADLE="):
+			hasFallback = true
+		}
+		env = append(env, entry)
+	}
+
+	if path == "" {
+		path = shimDir
+	} else {
+		path = shimDir + string(os.PathListSeparator) + path
+	}
+	env = append(env, "PATH="+path)
+	if !hasFallback && localGradle != "" {
+		env = append(env, "DGB_FALLBACK_GRADLE="+localGradle)
+	}
+	return env
+}
+
+// runAgent runs a CI agent whose Gradle steps are offloaded, until it exits
+func runAgent(kind string, args []string) int {
+	cmd, err := agentCommand(kind, args, os.Getenv)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ciagent: %v\n", err)
+		return 2
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ciagent: cannot locate the ciagent binary: %v\n", err)
+		return 1
+	}
+	localGradle, _ := exec.LookPath("gradle")
+	shimDir := os.Getenv("DGB_SHIM_DIR")
+	if shimDir == "" {
+		shimDir = filepath.Join(os.TempDir(), "ciagent-shims")
+	}
+	if filepath.Dir(localGradle) == shimDir {
+		localGradle = ""
+	}
+	if err := installShim(shimDir, executable); err != nil {
+		fmt.Fprintf(os.Stderr, "ciagent: %v\n", err)
+		return 1
+	}
+
+	cmd.Env = agentEnv(os.Environ(), shimDir, localGradle)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Start(); err != nil {
+		fmt.Fprintf(os.Stderr, "ciagent: failed to start %s agent: %v\n", kind, err)
+		return 1
+	}
+
+	// Let the agent shut down cleanly when the container is stopped
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		for sig := range signals {
+			cmd.Process.Signal(sig)
+		}
+	}()
+
+	return exitCode(cmd.Wait())
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestAgentCommand(t *testing.T) {
+	env := map[string]string{}
+	getenv := func(key string) string { return env[key] }
+
+	cmd, err := agentCommand(agentJenkins, []string{"-url", "https://jenkins.example.com", "-name", "gradle-pool"}, getenv)
+	if err != nil {
+		t.Fatalf("agentCommand failed: %v", err)
+	}
+	expected := []string{"java", "-jar", defaultJenkinsAgentJar, "-url", "https://jenkins.example.com", "-name", "gradle-pool"}
+	if !reflect.DeepEqual(cmd.Args, expected) {
+		t.Errorf("Expected %v, got %v", expected, cmd.Args)
+	}
+
+	env["TEAMCITY_AGENT_HOME"] = "/srv/teamcity-agent"
+	if cmd, err = agentCommand(agentTeamCity, nil, getenv); err != nil {
+		t.Fatalf("agentCommand failed: %v", err)
+	}
+	expected = []string{"/srv/teamcity-agent/bin/agent.sh", "run"}
+	if !reflect.DeepEqual(cmd.Args, expected) {
+		t.Errorf("Expected %v, got %v", expected, cmd.Args)
+	}
+
+	if _, err := agentCommand("bamboo", nil, getenv); err == nil {
+		t.Error("Expected error for an unknown agent")
+	}
+}
+
+func TestInstallShim(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "shims")
+	executable := filepath.Join(t.TempDir(), "ciagent")
+	os.WriteFile(executable, []byte("#!/bin/sh\n"), 0755)
+
+	// Installing again, as on every agent start, replaces the link
+	for i := 0; i < 2; i++ {
+		if err := installShim(dir, executable); err != nil {
+			t.Fatalf("installShim failed: %v", err)
+		}
+	}
+	if target, err := os.Readlink(filepath.Join(dir, "gradle")); err != nil || target != executable {
+		t.Errorf("Expected gradle to link to %s, got %s, %v", executable, target, err)
+	}
+	if !isShimName("gradle") || isShimName("ciagent") {
+		t.Error("Expected only gradle to run as the shim")
+	}
+}
+
+func TestAgentEnv(t *testing.T) {
+	env := agentEnv([]string{"HOME=/home/ci", "PATH=/usr/bin:/bin"}, "/tmp/shims", "/usr/bin/gradle")
+	expected := []string{"HOME=/home/ci", "PATH=/tmp/shims:/usr/bin:/bin", "DGB_FALLBACK_GRADLE=/usr/bin/gradle"}
+	if !reflect.DeepEqual(env, expected) {
+		t.Errorf("Expected %v, got %v", expected, env)
+	}
+
+	env = agentEnv([]string{"DGB_FALLBACK_GRADLE=/opt/gradle/bin/gradle"}, "/tmp/shims", "/usr/bin/gradle")
+	expected = []string{"DGB_FALLBACK_GRADLE=/opt/gradle/bin/gradle", "PATH=/tmp/shims"}
+	if !reflect.DeepEqual(env, expected) {
+		t.Errorf("Expected a configured fallback to be kept, got %v", env)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"distributed-gradle-building/transfer"
+)
+
+// storedArtifact is an artifact a worker uploaded for a build
+type storedArtifact struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+// openChunkCache opens the local chunk cache in dir, defaulting to the
+// user's cache directory. Without a cache every chunk is fetched.
+func openChunkCache(dir string) *transfer.Store {
+	if dir == "" {
+		cacheDir, err := os.UserCacheDir()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ciagent: no chunk cache: %v\n", err)
+			return nil
+		}
+		dir = filepath.Join(cacheDir, "distributed-gradle-building", "chunks")
+	}
+
+	cache, err := transfer.Open(dir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ciagent: no chunk cache: %v\n", err)
+		return nil
+	}
+	return cache
+}
+
+// chunkSource fetches compressed chunks from the coordinator
+type chunkSource struct {
+	shim *shim
+}
+
+func (c chunkSource) Chunk(hash string) ([]byte, error) {
+	return c.shim.fetch("/api/chunks/"+url.PathEscape(hash), "")
+}
+
+// downloadArtifacts downloads the artifacts of a build into the project
+// directory, where the local Gradle would have written them. Chunks found in
+// the chunk cache, typically from earlier builds, are not fetched again.
+func (s *shim) downloadArtifacts(buildID, projectDir string) error {
+	var artifacts []storedArtifact
+	if err := s.call("GET", "/api/builds/"+url.PathEscape(buildID)+"/artifacts", nil, &artifacts); err != nil {
+		return fmt.Errorf("failed to list artifacts of build %s: %v", buildID, err)
+	}
+
+	var total transfer.Stats
+	for _, artifact := range artifacts {
+		if !transfer.ValidName(artifact.Path) {
+			return fmt.Errorf("invalid artifact path %q", artifact.Path)
+		}
+
+		segments := strings.Split(artifact.Path, "/")
+		for i, segment := range segments {
+			segments[i] = url.PathEscape(segment)
+		}
+		data, err := s.fetch("/api/builds/"+url.PathEscape(buildID)+"/artifacts/"+strings.Join(segments, "/"), transfer.ManifestContentType)
+		if err != nil {
+			return fmt.Errorf("failed to get manifest of %s: %v", artifact.Path, err)
+		}
+		var manifest transfer.Manifest
+		if err := json.Unmarshal(data, &manifest); err != nil {
+			return fmt.Errorf("invalid manifest of %s: %v", artifact.Path, err)
+		}
+
+		stats, err := transfer.Download(chunkSource{s}, manifest, filepath.Join(projectDir, filepath.FromSlash(artifact.Path)), s.chunkCache)
+		if err != nil {
+			return fmt.Errorf("failed to download %s: %v", artifact.Path, err)
+		}
+		total.Bytes += stats.Bytes
+		total.SentBytes += stats.SentBytes
+		total.WireBytes += stats.WireBytes
+	}
+
+	if len(artifacts) > 0 {
+		fmt.Fprintf(s.out, "> Downloaded %d artifacts: %d of %d bytes fetched (%.0f%% deduplicated), %d bytes compressed\n",
+			len(artifacts), total.SentBytes, total.Bytes, total.DedupRatio()*100, total.WireBytes)
+	}
+	return nil
+}
+
+// fetch gets a coordinator resource as raw bytes, accepting the given type
+func (s *shim) fetch(path, accept string) ([]byte, error) {
+	req, err := http.NewRequest("GET", s.coordinatorURL+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	if s.authToken != "" {
+		req.Header.Set("Authorization", "Bearer "+s.authToken)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("coordinator returned %d: %s", resp.StatusCode, strings.TrimSpace(string(message)))
+	}
+	return io.ReadAll(resp.Body)
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"distributed-gradle-building/transfer"
+)
+
+// ignoredOptions only change how Gradle runs or reports locally and are
+// dropped when a command is offloaded
+var ignoredOptions = map[string]bool{
+	"--daemon": true, "--no-daemon": true,
+	"--build-cache": true, "--no-build-cache": true,
+	"--parallel": true, "--no-parallel": true,
+	"--scan": true, "--no-scan": true,
+	"--stacktrace": true, "-s": true, "--full-stacktrace": true, "-S": true,
+	"--info": true, "-i": true, "--debug": true, "-d": true,
+	"--quiet": true, "-q": true, "--warn": true, "-w": true,
+}
+
+// buildRequest is the coordinator's build request for a repository build
+type buildRequest struct {
+	ProjectPath  string            `json:"project_path"`
+	TaskName     string            `json:"task_name"`
+	CacheEnabled bool              `json:"cache_enabled"`
+	BuildOptions map[string]string `json:"build_options,omitempty"`
+	Secrets      []string          `json:"secrets,omitempty"`
+	RepoURL      string            `json:"repo_url"`
+	Ref          string            `json:"ref,omitempty"`
+	Credentials  string            `json:"credentials,omitempty"`
+	// projectDir is the local project directory artifacts are downloaded to
+	projectDir string
+}
+
+// buildStatus is the part of the coordinator's build status the shim reports
+type buildStatus struct {
+	Success      bool   `json:"success"`
+	WorkerID     string `json:"worker_id"`
+	ErrorMessage string `json:"error_message"`
+	Progress     struct {
+		Status   string  `json:"status"`
+		WorkerID string  `json:"worker_id"`
+		Progress float64 `json:"progress"`
+		Step     string  `json:"step"`
+		Message  string  `json:"message"`
+	} `json:"progress"`
+}
+
+// invocation is a Gradle command line
+type invocation struct {
+	Tasks      []string
+	ProjectDir string
+	Properties map[string]string
+}
+
+// source is the repository, commit and project directory a command builds
+type source struct {
+	RepoURL     string
+	Ref         string
+	ProjectPath string
+}
+
+// shim runs Gradle commands on the distributed pool
+type shim struct {
+	coordinatorURL string
+	authToken      string
+	credentials    string
+	secrets        []string
+	// fallback is the Gradle run locally for commands that cannot be offloaded
+	fallback     string
+	timeout      time.Duration
+	pollInterval time.Duration
+	client       *http.Client
+	out          io.Writer
+	getenv       func(string) string
+	// download downloads the artifacts of successful builds, keeping their
+	// chunks in chunkCache
+	download   bool
+	chunkCache *transfer.Store
+}
+
+// newShimFromEnv configures the shim from DGB_COORDINATOR_URL,
+// DGB_AUTH_TOKEN, DGB_CREDENTIALS, DGB_SECRETS, DGB_FALLBACK_GRADLE and
+// DGB_BUILD_TIMEOUT (default 2h). DGB_DOWNLOAD_ARTIFACTS downloads the
+// artifacts of successful builds, caching their chunks in DGB_CHUNK_CACHE.
+// Without DGB_AUTH_TOKEN the token saved by "ciagent login" is used.
+func newShimFromEnv() *shim {
+	s := &shim{
+		coordinatorURL: strings.TrimSuffix(os.Getenv("DGB_COORDINATOR_URL"), "/"),
+		authToken:      os.Getenv("DGB_AUTH_TOKEN"),
+		credentials:    os.Getenv("DGB_CREDENTIALS"),
+		fallback:       os.Getenv("DGB_FALLBACK_GRADLE"),
+		timeout:        2 * time.Hour,
+		pollInterval:   2 * time.Second,
+		client:         &http.Client{Timeout: 30 * time.Second},
+		out:            os.Stdout,
+		getenv:         os.Getenv,
+	}
+	if s.authToken == "" {
+		s.authToken = savedToken()
+	}
+	for _, name := range strings.Split(os.Getenv("DGB_SECRETS"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			s.secrets = append(s.secrets, name)
+		}
+	}
+	if value := os.Getenv("DGB_BUILD_TIMEOUT"); value != "" {
+		if timeout, err := time.ParseDuration(value); err == nil && timeout > 0 {
+			s.timeout = timeout
+		}
+	}
+	s.download, _ = strconv.ParseBool(os.Getenv("DGB_DOWNLOAD_ARTIFACTS"))
+	if s.download {
+		s.chunkCache = openChunkCache(os.Getenv("DGB_CHUNK_CACHE"))
+	}
+	return s
+}
+
+// run offloads a Gradle command run in dir and returns its exit code. Each
+// task runs as a build of its own, in order, stopping at the first failure.
+func (s *shim) run(dir string, args []string) int {
+	requests, err := s.translate(dir, args)
+	if err != nil {
+		if s.fallback != "" {
+			fmt.Fprintf(s.out, "> Not offloading gradle %s: %v; running it locally\n", strings.Join(args, " "), err)
+			return runLocally(s.fallback, dir, args)
+		}
+		fmt.Fprintf(s.out, "ciagent: %v\n", err)
+		return 1
+	}
+
+	for _, request := range requests {
+		if err := s.build(request); err != nil {
+			fmt.Fprintf(s.out, "\nFAILURE: %v\n", err)
+			return 1
+		}
+	}
+	fmt.Fprintln(s.out, "\nBUILD SUCCESSFUL")
+	return 0
+}
+
+// translate turns a Gradle command run in dir into build requests for the
+// coordinator
+func (s *shim) translate(dir string, args []string) ([]buildRequest, error) {
+	if s.coordinatorURL == "" {
+		return nil, fmt.Errorf("DGB_COORDINATOR_URL is not set")
+	}
+
+	command, err := parseGradleArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	if len(command.Tasks) == 0 {
+		return nil, fmt.Errorf("no tasks to run")
+	}
+
+	projectDir := dir
+	if command.ProjectDir != "" {
+		projectDir = command.ProjectDir
+		if !filepath.IsAbs(projectDir) {
+			projectDir = filepath.Join(dir, projectDir)
+		}
+	}
+	src, err := detectSource(projectDir, s.getenv)
+	if err != nil {
+		return nil, err
+	}
+
+	requests := make([]buildRequest, 0, len(command.Tasks))
+	for _, task := range command.Tasks {
+		requests = append(requests, buildRequest{
+			ProjectPath:  src.ProjectPath,
+			TaskName:     task,
+			CacheEnabled: true,
+			BuildOptions: command.Properties,
+			Secrets:      s.secrets,
+			RepoURL:      src.RepoURL,
+			Ref:          src.Ref,
+			Credentials:  s.credentials,
+			projectDir:   projectDir,
+		})
+	}
+	return requests, nil
+}
+
+// parseGradleArgs parses the tasks, project directory and project
+// properties of a Gradle command line. Options that would change what the
+// build does on the worker, such as init scripts or excluded tasks, are
+// refused rather than silently dropped.
+func parseGradleArgs(args []string) (invocation, error) {
+	command := invocation{}
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case ignoredOptions[arg] || strings.HasPrefix(arg, "--console="):
+		case arg == "-p" || arg == "--project-dir":
+			if i+1 == len(args) {
+				return command, fmt.Errorf("%s requires a directory", arg)
+			}
+			i++
+			command.ProjectDir = args[i]
+		case strings.HasPrefix(arg, "--project-dir="):
+			command.ProjectDir = strings.TrimPrefix(arg, "--project-dir=")
+		case strings.HasPrefix(arg, "-P") || strings.HasPrefix(arg, "--project-prop="):
+			property := strings.TrimPrefix(strings.TrimPrefix(arg, "-P"), "--project-prop=")
+			key, value, _ := strings.Cut(property, "=")
+			if key == "" {
+				return command, fmt.Errorf("invalid project property %s", arg)
+			}
+			if command.Properties == nil {
+				command.Properties = map[string]string{}
+			}
+			command.Properties[key] = value
+		case strings.HasPrefix(arg, "-"):
+			return command, fmt.Errorf("unsupported gradle option %s", arg)
+		default:
+			command.Tasks = append(command.Tasks, arg)
+		}
+	}
+	return command, nil
+}
+
+// detectSource finds the repository, commit and project directory of a
+// Gradle project checked out by the CI server. DGB_REPO_URL and DGB_REF
+// override the origin remote and the checked out commit.
+func detectSource(projectDir string, getenv func(string) string) (source, error) {
+	root, err := git(projectDir, "rev-parse", "--show-toplevel")
+	if err != nil {
+		return source{}, fmt.Errorf("project %s is not in a git checkout: %v", projectDir, err)
+	}
+
+	src := source{RepoURL: getenv("DGB_REPO_URL"), Ref: getenv("DGB_REF")}
+	if src.RepoURL == "" {
+		if src.RepoURL, err = git(root, "remote", "get-url", "origin"); err != nil {
+			return source{}, fmt.Errorf("failed to read the origin remote, set DGB_REPO_URL: %v", err)
+		}
+	}
+	src.RepoURL = withoutPassword(src.RepoURL)
+	if src.Ref == "" {
+		if src.Ref, err = git(root, "rev-parse", "HEAD"); err != nil {
+			return source{}, fmt.Errorf("failed to read the checked out commit: %v", err)
+		}
+	}
+
+	// Compare resolved paths, as CI workspaces are often behind symlinks
+	resolvedRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return source{}, err
+	}
+	resolvedDir, err := filepath.EvalSymlinks(projectDir)
+	if err != nil {
+		return source{}, err
+	}
+	rel, err := filepath.Rel(resolvedRoot, resolvedDir)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return source{}, fmt.Errorf("project %s is outside its repository %s", projectDir, root)
+	}
+	if rel != "." {
+		src.ProjectPath = filepath.ToSlash(rel)
+	}
+	return src, nil
+}
+
+// withoutPassword removes credentials embedded in a repository URL, which
+// CI servers add to their checkouts; the coordinator supplies its own
+func withoutPassword(repoURL string) string {
+	parsed, err := url.Parse(repoURL)
+	if err != nil || parsed.User == nil {
+		return repoURL
+	}
+	if _, hasPassword := parsed.User.Password(); hasPassword {
+		parsed.User = nil
+	}
+	return parsed.String()
+}
+
+// build submits a build and reports its progress until it finishes
+func (s *shim) build(request buildRequest) error {
+	fmt.Fprintf(s.out, "> Offloading task %s of %s at %s\n", request.TaskName, request.RepoURL, request.Ref)
+
+	var submitted struct {
+		BuildID string `json:"build_id"`
+	}
+	if err := s.call("POST", "/api/build", request, &submitted); err != nil {
+		return fmt.Errorf("failed to submit task %s: %v", request.TaskName, err)
+	}
+	fmt.Fprintf(s.out, "> Build %s queued\n", submitted.BuildID)
+
+	deadline := time.Now().Add(s.timeout)
+	reported := ""
+	for {
+		var status buildStatus
+		if err := s.call("GET", "/api/builds/"+url.PathEscape(submitted.BuildID), nil, &status); err != nil {
+			return fmt.Errorf("failed to get status of build %s: %v", submitted.BuildID, err)
+		}
+
+		progress := status.Progress
+		line := fmt.Sprintf("> [%s] %s", progress.Status, progress.Step)
+		if progress.WorkerID != "" {
+			line = fmt.Sprintf("> [%s on %s] %s (%.0f%%)", progress.Status, progress.WorkerID, progress.Step, progress.Progress)
+		}
+		if line != reported {
+			fmt.Fprintln(s.out, line)
+			reported = line
+		}
+
+		switch progress.Status {
+		case "completed":
+			if s.download {
+				return s.downloadArtifacts(submitted.BuildID, request.projectDir)
+			}
+			return nil
+		case "failed", "cancelled":
+			message := status.ErrorMessage
+			if message == "" {
+				message = progress.Message
+			}
+			return fmt.Errorf("build %s of task %s %s: %s", submitted.BuildID, request.TaskName, progress.Status, message)
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out after %v waiting for build %s", s.timeout, submitted.BuildID)
+		}
+		time.Sleep(s.pollInterval)
+	}
+}
+
+// call sends a JSON request to the coordinator and decodes its JSON reply
+func (s *shim) call(method, path string, body, reply any) error {
+	var payload io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		payload = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, s.coordinatorURL+path, payload)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.authToken != "" {
+		req.Header.Set("Authorization", "Bearer "+s.authToken)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("coordinator returned %d: %s", resp.StatusCode, strings.TrimSpace(string(message)))
+	}
+	return json.NewDecoder(resp.Body).Decode(reply)
+}
+
+// runLocally runs a Gradle command with the local Gradle and returns its
+// exit code
+func runLocally(gradle, dir string, args []string) int {
+	cmd := exec.Command(gradle, args...)
+	cmd.Dir = dir
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	return exitCode(cmd.Run())
+}
+
+// exitCode returns the exit code of a finished command
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			return 128 + int(status.Signal())
+		}
+		return exitErr.ExitCode()
+	}
+	fmt.Fprintf(os.Stderr, "ciagent: %v\n", err)
+	return 1
+}
+
+// git runs a git command in dir and returns its trimmed output
+func git(dir string, args ...string) (string, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(string(output)), nil
+}
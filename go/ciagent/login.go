@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"distributed-gradle-building/oidc"
+)
+
+// loginConfig is the identity provider the coordinator accepts logins of
+type loginConfig struct {
+	Issuer   string   `json:"issuer"`
+	ClientID string   `json:"client_id"`
+	Scopes   []string `json:"scopes"`
+}
+
+// loginResult is the coordinator token issued for a login
+type loginResult struct {
+	Token     string    `json:"token"`
+	User      string    `json:"user"`
+	Role      string    `json:"role"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// tokenFile returns where login saves the coordinator token: DGB_TOKEN_FILE,
+// defaulting to the user's config directory
+func tokenFile() (string, error) {
+	if path := os.Getenv("DGB_TOKEN_FILE"); path != "" {
+		return path, nil
+	}
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configDir, "distributed-gradle-building", "token"), nil
+}
+
+// savedToken returns the token of the last login, or "" without one
+func savedToken() string {
+	path, err := tokenFile()
+	if err != nil {
+		return ""
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// runLogin logs in to the coordinator in DGB_COORDINATOR_URL with the device
+// flow of its identity provider and saves the token for later commands
+func runLogin(args []string) int {
+	coordinatorURL := strings.TrimSuffix(os.Getenv("DGB_COORDINATOR_URL"), "/")
+	if len(args) != 0 || coordinatorURL == "" {
+		fmt.Fprintln(os.Stderr, "ciagent: login takes no arguments and requires DGB_COORDINATOR_URL")
+		return 2
+	}
+	path, err := tokenFile()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ciagent: %v\n", err)
+		return 1
+	}
+
+	result, err := login(context.Background(), &http.Client{Timeout: 30 * time.Second}, coordinatorURL, os.Stdout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ciagent: login failed: %v\n", err)
+		return 1
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		fmt.Fprintf(os.Stderr, "ciagent: %v\n", err)
+		return 1
+	}
+	if err := os.WriteFile(path, []byte(result.Token+"\n"), 0600); err != nil {
+		fmt.Fprintf(os.Stderr, "ciagent: %v\n", err)
+		return 1
+	}
+	fmt.Printf("Logged in as %s with role %s until %s\n", result.User, result.Role, result.ExpiresAt.Local().Format(time.RFC1123))
+	return 0
+}
+
+// login runs the device flow of the coordinator's identity provider, telling
+// the user where to approve it on out, and exchanges the ID token for a
+// coordinator token
+func login(ctx context.Context, client *http.Client, coordinatorURL string, out io.Writer) (*loginResult, error) {
+	resp, err := client.Get(coordinatorURL + "/api/auth/oidc/config")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("the coordinator has no single sign-on configured, use DGB_AUTH_TOKEN instead")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("coordinator returned %s", resp.Status)
+	}
+	var config loginConfig
+	if err := json.NewDecoder(resp.Body).Decode(&config); err != nil {
+		return nil, fmt.Errorf("invalid login configuration: %v", err)
+	}
+
+	metadata, err := oidc.Discover(ctx, client, config.Issuer)
+	if err != nil {
+		return nil, err
+	}
+	code, err := oidc.RequestDeviceCode(ctx, client, metadata, config.ClientID, config.Scopes)
+	if err != nil {
+		return nil, err
+	}
+	if code.VerificationURIComplete != "" {
+		fmt.Fprintf(out, "To log in, open %s and confirm the code %s\n", code.VerificationURIComplete, code.UserCode)
+	} else {
+		fmt.Fprintf(out, "To log in, open %s and enter the code %s\n", code.VerificationURI, code.UserCode)
+	}
+	tokens, err := oidc.PollDeviceToken(ctx, client, metadata, config.ClientID, code)
+	if err != nil {
+		return nil, err
+	}
+
+	body, _ := json.Marshal(map[string]string{"id_token": tokens.IDToken})
+	resp, err = client.Post(coordinatorURL+"/api/auth/oidc/token", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("coordinator refused the login: %s", strings.TrimSpace(string(message)))
+	}
+	var result loginResult
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("invalid login response: %v", err)
+	}
+	return &result, nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"distributed-gradle-building/oidc"
+)
+
+func TestLogin(t *testing.T) {
+	polls := 0
+	idp := http.NewServeMux()
+	server := httptest.NewServer(idp)
+	t.Cleanup(server.Close)
+	idp.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidc.Metadata{Issuer: server.URL, TokenEndpoint: server.URL + "/token", DeviceAuthorizationEndpoint: server.URL + "/device"})
+	})
+	idp.HandleFunc("POST /device", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("client_id") != "cli" || r.Form.Get("scope") != "openid email" {
+			t.Errorf("Unexpected device authorization %v", r.Form)
+		}
+		json.NewEncoder(w).Encode(oidc.DeviceCode{DeviceCode: "device-1", UserCode: "ABCD-EFGH", VerificationURI: server.URL + "/activate", ExpiresIn: 60, Interval: 1})
+	})
+	idp.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		if polls++; polls == 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(oidc.Error{Code: "authorization_pending"})
+			return
+		}
+		json.NewEncoder(w).Encode(oidc.Tokens{AccessToken: "access", TokenType: "Bearer", IDToken: "id-token-1"})
+	})
+
+	// The coordinator side
+	idp.HandleFunc("GET /api/auth/oidc/config", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(loginConfig{Issuer: server.URL, ClientID: "cli", Scopes: []string{"openid", "email"}})
+	})
+	idp.HandleFunc("POST /api/auth/oidc/token", func(w http.ResponseWriter, r *http.Request) {
+		var request map[string]string
+		json.NewDecoder(r.Body).Decode(&request)
+		if request["id_token"] != "id-token-1" {
+			http.Error(w, "invalid ID token", http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(loginResult{Token: "coordinator-token", User: "alice@example.com", Role: "developer", ExpiresAt: time.Now().Add(time.Hour)})
+	})
+
+	var out bytes.Buffer
+	result, err := login(context.Background(), server.Client(), server.URL, &out)
+	if err != nil {
+		t.Fatalf("login failed: %v", err)
+	}
+	if result.Token != "coordinator-token" || polls != 2 {
+		t.Errorf("Expected the coordinator token after approval, got %+v after %d polls", result, polls)
+	}
+	if !strings.Contains(out.String(), server.URL+"/activate") || !strings.Contains(out.String(), "ABCD-EFGH") {
+		t.Errorf("Expected the user to be told where to log in, got %s", out.String())
+	}
+}
+
+func TestLoginWithoutSingleSignOn(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	t.Cleanup(server.Close)
+	if _, err := login(context.Background(), server.Client(), server.URL, &bytes.Buffer{}); err == nil || !strings.Contains(err.Error(), "no single sign-on") {
+		t.Errorf("Expected a coordinator without OIDC to be reported, got %v", err)
+	}
+}
+
+func TestShimUsesSavedToken(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	t.Setenv("DGB_TOKEN_FILE", path)
+	t.Setenv("DGB_AUTH_TOKEN", "")
+	if token := newShimFromEnv().authToken; token != "" {
+		t.Errorf("Expected no token before login, got %q", token)
+	}
+
+	if err := os.WriteFile(path, []byte("saved-token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if token := newShimFromEnv().authToken; token != "saved-token" {
+		t.Errorf("Expected the saved token, got %q", token)
+	}
+	t.Setenv("DGB_AUTH_TOKEN", "ci-token")
+	if token := newShimFromEnv().authToken; token != "ci-token" {
+		t.Errorf("Expected DGB_AUTH_TOKEN to take precedence, got %q", token)
+	}
+}
@@ -0,0 +1,70 @@
+// Command ciagent offloads the Gradle steps of existing Jenkins and TeamCity
+// jobs to the distributed worker pool.
+//
+// Run as "ciagent jenkins <agent.jar arguments>" or "ciagent teamcity", it
+// starts the official inbound Jenkins agent or TeamCity build agent with a
+// gradle shim first on its PATH, so the CI server schedules jobs on it like
+// on any other agent. Every "gradle" the jobs run is translated into builds
+// of the job's repository and commit on the coordinator, whose progress and
+// result the shim reports as Gradle would. "ciagent gradle <arguments>" runs
+// the shim directly, for example from a pipeline step. "ciagent login" signs
+// in with the coordinator's identity provider from a terminal and saves the
+// token the shim then uses when DGB_AUTH_TOKEN is not set.
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const usage = `usage:
+  ciagent jenkins <agent.jar arguments>   run a Jenkins inbound agent offloading Gradle steps
+  ciagent teamcity [agent.sh arguments]   run a TeamCity build agent offloading Gradle steps
+  ciagent gradle <gradle arguments>       run a Gradle command on the distributed pool
+  ciagent login                           log in with the coordinator's identity provider`
+
+func main() {
+	os.Exit(run(filepath.Base(os.Args[0]), os.Args[1:]))
+}
+
+// run dispatches on the name the binary was invoked as, so the gradle shim
+// is a link to it, and otherwise on the first argument
+func run(name string, args []string) int {
+	if isShimName(name) {
+		return runGradle(args)
+	}
+
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+
+	switch args[0] {
+	case "gradle":
+		return runGradle(args[1:])
+	case "login":
+		return runLogin(args[1:])
+	case agentJenkins, agentTeamCity:
+		return runAgent(args[0], args[1:])
+	default:
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+}
+
+// isShimName reports whether the binary was invoked through a gradle shim
+func isShimName(name string) bool {
+	name = strings.TrimSuffix(name, ".exe")
+	return name == "gradle" || name == "gradlew"
+}
+
+func runGradle(args []string) int {
+	dir, err := os.Getwd()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ciagent: %v\n", err)
+		return 1
+	}
+	return newShimFromEnv().run(dir, args)
+}
@@ -4,8 +4,12 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
+	"net/url"
 	"time"
+
+	"distributed-gradle-building/signing"
 )
 
 // GradleBuildClient provides a Go client for the distributed build system
@@ -13,6 +17,10 @@ type GradleBuildClient struct {
 	BaseURL    string
 	HTTPClient *http.Client
 	AuthToken  string
+	// Verifier checks the signatures of build statuses and artifact lists,
+	// which are rejected unless signed by one of its keys. Nil accepts them
+	// unsigned.
+	Verifier *signing.Verifier
 }
 
 // NewClient creates a new client for the distributed build system
@@ -32,21 +40,38 @@ func NewAuthenticatedClient(baseURL, authToken string) *GradleBuildClient {
 	return client
 }
 
-// BuildRequest represents a build request
-type BuildRequest struct {
-	ProjectPath  string            `json:"project_path"`
-	TaskName     string            `json:"task_name"`
-	WorkerID     string            `json:"worker_id,omitempty"`
-	CacheEnabled bool              `json:"cache_enabled"`
-	BuildOptions map[string]string `json:"build_options,omitempty"`
+// decodeVerified decodes a response body into v, checking its signature
+// first if the client has a verifier
+func (c *GradleBuildClient) decodeVerified(resp *http.Response, v any) error {
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read response: %v", err)
+	}
+	if c.Verifier != nil {
+		if err := c.Verifier.Verify(body, resp.Header.Get(signing.Header)); err != nil {
+			return fmt.Errorf("failed to verify response: %v", err)
+		}
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("failed to decode response: %v", err)
+	}
+	return nil
 }
 
-// BuildResponse represents the response to a build request
-type BuildResponse struct {
-	BuildID string `json:"build_id"`
-	Status  string `json:"status"`
+// authorize adds the client's token to a request. X-Auth-Token is kept for
+// older coordinators; current ones read the bearer token.
+func (c *GradleBuildClient) authorize(req *http.Request) {
+	if c.AuthToken != "" {
+		req.Header.Set("Authorization", "Bearer "+c.AuthToken)
+		req.Header.Set("X-Auth-Token", c.AuthToken)
+	}
 }
 
+//go:generate go run ../openapi/cmd/openapi-gen -in openapi.json -out types_gen.go -package client
+
+// BuildResponse represents the response to a build request
+type BuildResponse = SubmitBuildResponse
+
 // BuildStatus represents the status of a build
 type BuildStatus struct {
 	BuildID      string        `json:"build_id"`
@@ -64,27 +89,10 @@ type BuildStatus struct {
 }
 
 // WorkerInfo represents information about a worker
-type WorkerInfo struct {
-	ID               string        `json:"id"`
-	Host             string        `json:"host"`
-	Status           string        `json:"status"`
-	CPU              float64       `json:"cpu"`
-	Memory           uint64        `json:"memory"`
-	DiskUsage        uint64        `json:"disk_usage"`
-	BuildCount       int           `json:"build_count"`
-	LastBuildTime    time.Time     `json:"last_build_time"`
-	AverageBuildTime time.Duration `json:"average_build_time"`
-	LastCheckin      time.Time     `json:"last_checkin"`
-	ResponseTime     time.Duration `json:"response_time"`
-}
+type WorkerInfo = Worker
 
-// SystemStatus represents the overall system status
-type SystemStatus struct {
-	Timestamp    time.Time `json:"timestamp"`
-	WorkerCount  int       `json:"worker_count"`
-	QueueLength  int       `json:"queue_length"`
-	ActiveBuilds int       `json:"active_builds"`
-}
+// AuditEvent is an audited API mutation
+type AuditEvent = Event
 
 // SubmitBuild submits a build request to the coordinator
 func (c *GradleBuildClient) SubmitBuild(req BuildRequest) (*BuildResponse, error) {
@@ -101,9 +109,7 @@ func (c *GradleBuildClient) SubmitBuild(req BuildRequest) (*BuildResponse, error
 	}
 
 	httpReq.Header.Set("Content-Type", "application/json")
-	if c.AuthToken != "" {
-		httpReq.Header.Set("X-Auth-Token", c.AuthToken)
-	}
+	c.authorize(httpReq)
 
 	resp, err := c.HTTPClient.Do(httpReq)
 	if err != nil {
@@ -132,9 +138,7 @@ func (c *GradleBuildClient) GetBuildStatus(buildID string) (*BuildStatus, error)
 		return nil, fmt.Errorf("failed to create request: %v", err)
 	}
 
-	if c.AuthToken != "" {
-		httpReq.Header.Set("X-Auth-Token", c.AuthToken)
-	}
+	c.authorize(httpReq)
 
 	resp, err := c.HTTPClient.Do(httpReq)
 	if err != nil {
@@ -147,8 +151,8 @@ func (c *GradleBuildClient) GetBuildStatus(buildID string) (*BuildStatus, error)
 	}
 
 	var status BuildStatus
-	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
-		return nil, fmt.Errorf("failed to decode response: %v", err)
+	if err := c.decodeVerified(resp, &status); err != nil {
+		return nil, err
 	}
 
 	return &status, nil
@@ -163,9 +167,7 @@ func (c *GradleBuildClient) GetWorkers() (map[string]*WorkerInfo, error) {
 		return nil, fmt.Errorf("failed to create request: %v", err)
 	}
 
-	if c.AuthToken != "" {
-		httpReq.Header.Set("X-Auth-Token", c.AuthToken)
-	}
+	c.authorize(httpReq)
 
 	resp, err := c.HTTPClient.Do(httpReq)
 	if err != nil {
@@ -194,9 +196,7 @@ func (c *GradleBuildClient) GetSystemStatus() (*SystemStatus, error) {
 		return nil, fmt.Errorf("failed to create request: %v", err)
 	}
 
-	if c.AuthToken != "" {
-		httpReq.Header.Set("X-Auth-Token", c.AuthToken)
-	}
+	c.authorize(httpReq)
 
 	resp, err := c.HTTPClient.Do(httpReq)
 	if err != nil {
@@ -216,6 +216,39 @@ func (c *GradleBuildClient) GetSystemStatus() (*SystemStatus, error) {
 	return &status, nil
 }
 
+// GetAuditEvents queries the audit log. The filter takes the query
+// parameters of GET /api/audit, e.g. action, principal or since.
+func (c *GradleBuildClient) GetAuditEvents(filter url.Values) ([]AuditEvent, error) {
+	endpoint := fmt.Sprintf("%s/api/audit", c.BaseURL)
+	if len(filter) > 0 {
+		endpoint += "?" + filter.Encode()
+	}
+
+	httpReq, err := http.NewRequest("GET", endpoint, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %v", err)
+	}
+
+	c.authorize(httpReq)
+
+	resp, err := c.HTTPClient.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	var events []AuditEvent
+	if err := json.NewDecoder(resp.Body).Decode(&events); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %v", err)
+	}
+
+	return events, nil
+}
+
 // WaitForBuild waits for a build to complete and returns its final status
 func (c *GradleBuildClient) WaitForBuild(buildID string, timeout time.Duration) (*BuildStatus, error) {
 	deadline := time.Now().Add(timeout)
@@ -245,9 +278,7 @@ func (c *GradleBuildClient) HealthCheck() error {
 		return fmt.Errorf("failed to create request: %v", err)
 	}
 
-	if c.AuthToken != "" {
-		httpReq.Header.Set("X-Auth-Token", c.AuthToken)
-	}
+	c.authorize(httpReq)
 
 	resp, err := c.HTTPClient.Do(httpReq)
 	if err != nil {
@@ -261,3 +292,32 @@ func (c *GradleBuildClient) HealthCheck() error {
 
 	return nil
 }
+
+// GetSigningKeys fetches the public keys the coordinator signs results with.
+// Keys fetched over the network are only as trustworthy as the connection;
+// pin them, for example in configuration, before building a verifier.
+func (c *GradleBuildClient) GetSigningKeys() ([]signing.PublicKey, error) {
+	url := fmt.Sprintf("%s/api/keys/signing", c.BaseURL)
+
+	httpReq, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %v", err)
+	}
+
+	resp, err := c.HTTPClient.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	var keys signing.KeySet
+	if err := json.NewDecoder(resp.Body).Decode(&keys); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %v", err)
+	}
+
+	return keys.Keys, nil
+}
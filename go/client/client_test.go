@@ -1,11 +1,21 @@
 package client
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
+
+	"distributed-gradle-building/openapi"
+	"distributed-gradle-building/projectarchive"
+	"distributed-gradle-building/signing"
 )
 
 func TestNewClient(t *testing.T) {
@@ -57,8 +67,9 @@ func TestSubmitBuild_Success(t *testing.T) {
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
 		json.NewEncoder(w).Encode(BuildResponse{
-			BuildID: "test-build-123",
-			Status:  "queued",
+			BuildID:            "test-build-123",
+			Status:             "queued",
+			EstimatedQueueWait: 3 * time.Minute,
 		})
 	}))
 	defer server.Close()
@@ -81,6 +92,9 @@ func TestSubmitBuild_Success(t *testing.T) {
 	if resp.Status != "queued" {
 		t.Errorf("Expected Status queued, got %s", resp.Status)
 	}
+	if resp.EstimatedQueueWait != 3*time.Minute {
+		t.Errorf("Expected EstimatedQueueWait 3m, got %v", resp.EstimatedQueueWait)
+	}
 }
 
 func TestSubmitBuild_WithAuth(t *testing.T) {
@@ -88,6 +102,9 @@ func TestSubmitBuild_WithAuth(t *testing.T) {
 		if authToken := r.Header.Get("X-Auth-Token"); authToken != "test-token" {
 			t.Errorf("Expected X-Auth-Token test-token, got %s", authToken)
 		}
+		if authorization := r.Header.Get("Authorization"); authorization != "Bearer test-token" {
+			t.Errorf("Expected bearer token, got %s", authorization)
+		}
 
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
@@ -224,30 +241,30 @@ func TestGetWorkers_Success(t *testing.T) {
 		w.WriteHeader(http.StatusOK)
 		workers := map[string]*WorkerInfo{
 			"worker-1": {
-				ID:               "worker-1",
-				Host:             "localhost:8081",
-				Status:           "active",
-				CPU:              0.25,
-				Memory:           1024 * 1024 * 100,
-				DiskUsage:        1024 * 1024 * 500,
-				BuildCount:       10,
-				LastBuildTime:    time.Now().Add(-5 * time.Minute),
-				AverageBuildTime: 2 * time.Minute,
-				LastCheckin:      time.Now(),
-				ResponseTime:     100 * time.Millisecond,
+				ID:           "worker-1",
+				Host:         "localhost",
+				Port:         8081,
+				Status:       "active",
+				LastCheckin:  time.Now(),
+				BuildCount:   10,
+				Capabilities: []string{"gradle", "java"},
+				Resources: ResourceMetrics{
+					CPUPercent:  25,
+					MemoryUsage: 1024 * 1024 * 100,
+				},
 			},
 			"worker-2": {
-				ID:               "worker-2",
-				Host:             "localhost:8082",
-				Status:           "idle",
-				CPU:              0.1,
-				Memory:           1024 * 1024 * 50,
-				DiskUsage:        1024 * 1024 * 200,
-				BuildCount:       5,
-				LastBuildTime:    time.Now().Add(-10 * time.Minute),
-				AverageBuildTime: 3 * time.Minute,
-				LastCheckin:      time.Now().Add(-30 * time.Second),
-				ResponseTime:     150 * time.Millisecond,
+				ID:           "worker-2",
+				Host:         "localhost",
+				Port:         8082,
+				Status:       "idle",
+				LastCheckin:  time.Now().Add(-30 * time.Second),
+				BuildCount:   5,
+				Capabilities: []string{"gradle", "java"},
+				Resources: ResourceMetrics{
+					CPUPercent:  10,
+					MemoryUsage: 1024 * 1024 * 50,
+				},
 			},
 		}
 		json.NewEncoder(w).Encode(workers)
@@ -274,6 +291,32 @@ func TestGetWorkers_Success(t *testing.T) {
 	}
 }
 
+func TestGetAuditEvents_Success(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/audit" {
+			t.Errorf("Expected path /api/audit, got %s", r.URL.Path)
+		}
+		if r.URL.Query().Get("action") != "build.submitted" {
+			t.Errorf("Expected action filter, got %s", r.URL.RawQuery)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode([]AuditEvent{
+			{ID: 7, Action: "build.submitted", Principal: "user:alice", SourceIP: "10.0.0.1", Resource: "build-1"},
+		})
+	}))
+	defer server.Close()
+
+	client := NewClient(server.URL)
+	events, err := client.GetAuditEvents(url.Values{"action": {"build.submitted"}})
+	if err != nil {
+		t.Fatalf("GetAuditEvents failed: %v", err)
+	}
+	if len(events) != 1 || events[0].Principal != "user:alice" || events[0].Resource != "build-1" {
+		t.Errorf("Unexpected events %+v", events)
+	}
+}
+
 func TestGetSystemStatus_Success(t *testing.T) {
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet {
@@ -491,17 +534,17 @@ func TestBuildStatus_JSONSerialization(t *testing.T) {
 func TestWorkerInfo_JSONSerialization(t *testing.T) {
 	now := time.Now()
 	worker := WorkerInfo{
-		ID:               "worker-1",
-		Host:             "localhost:8081",
-		Status:           "active",
-		CPU:              0.25,
-		Memory:           1024 * 1024 * 100,
-		DiskUsage:        1024 * 1024 * 500,
-		BuildCount:       10,
-		LastBuildTime:    now.Add(-5 * time.Minute),
-		AverageBuildTime: 2 * time.Minute,
-		LastCheckin:      now,
-		ResponseTime:     100 * time.Millisecond,
+		ID:           "worker-1",
+		Host:         "localhost",
+		Port:         8081,
+		Status:       "active",
+		LastCheckin:  now,
+		BuildCount:   10,
+		Capabilities: []string{"gradle", "java"},
+		Resources: ResourceMetrics{
+			CPUPercent:  25,
+			MemoryUsage: 1024 * 1024 * 100,
+		},
 	}
 
 	data, err := json.Marshal(worker)
@@ -520,11 +563,11 @@ func TestWorkerInfo_JSONSerialization(t *testing.T) {
 	if decodedWorker.Status != worker.Status {
 		t.Errorf("Expected Status %s, got %s", worker.Status, decodedWorker.Status)
 	}
-	if decodedWorker.CPU != worker.CPU {
-		t.Errorf("Expected CPU %f, got %f", worker.CPU, decodedWorker.CPU)
+	if decodedWorker.Resources.CPUPercent != worker.Resources.CPUPercent {
+		t.Errorf("Expected CPUPercent %f, got %f", worker.Resources.CPUPercent, decodedWorker.Resources.CPUPercent)
 	}
-	if decodedWorker.Memory != worker.Memory {
-		t.Errorf("Expected Memory %d, got %d", worker.Memory, decodedWorker.Memory)
+	if decodedWorker.Resources.MemoryUsage != worker.Resources.MemoryUsage {
+		t.Errorf("Expected MemoryUsage %d, got %d", worker.Resources.MemoryUsage, decodedWorker.Resources.MemoryUsage)
 	}
 	if decodedWorker.BuildCount != worker.BuildCount {
 		t.Errorf("Expected BuildCount %d, got %d", worker.BuildCount, decodedWorker.BuildCount)
@@ -560,3 +603,174 @@ func TestSystemStatus_JSONSerialization(t *testing.T) {
 		t.Errorf("Expected ActiveBuilds %d, got %d", status.ActiveBuilds, decodedStatus.ActiveBuilds)
 	}
 }
+
+func TestGeneratedTypesUpToDate(t *testing.T) {
+	data, err := os.ReadFile("openapi.json")
+	if err != nil {
+		t.Fatalf("Failed to read openapi.json: %v", err)
+	}
+
+	doc, err := openapi.Parse(data)
+	if err != nil {
+		t.Fatalf("Failed to parse openapi.json: %v", err)
+	}
+
+	expected, err := openapi.GenerateGo(doc, "client", "openapi.json")
+	if err != nil {
+		t.Fatalf("Failed to generate types: %v", err)
+	}
+
+	actual, err := os.ReadFile("types_gen.go")
+	if err != nil {
+		t.Fatalf("Failed to read types_gen.go: %v", err)
+	}
+	if string(actual) != string(expected) {
+		t.Error("types_gen.go is out of date; run go generate ./client")
+	}
+}
+
+func TestUploadProject(t *testing.T) {
+	project := t.TempDir()
+	os.WriteFile(filepath.Join(project, "build.gradle"), []byte("plugins { id 'java' }"), 0644)
+	os.MkdirAll(filepath.Join(project, "build", "libs"), 0755)
+	os.WriteFile(filepath.Join(project, "build", "libs", "app.jar"), []byte("stale"), 0644)
+
+	unpacked := t.TempDir()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/api/uploads" {
+			t.Errorf("Expected POST /api/uploads, got %s %s", r.Method, r.URL.Path)
+		}
+		if contentType := r.Header.Get("Content-Type"); contentType != projectarchive.ContentType {
+			t.Errorf("Expected Content-Type %s, got %s", projectarchive.ContentType, contentType)
+		}
+		if err := projectarchive.Extract(r.Body, unpacked, 1<<20); err != nil {
+			t.Errorf("Failed to unpack the upload: %v", err)
+		}
+		json.NewEncoder(w).Encode(ProjectUpload{UploadID: "upload-1", Size: 42})
+	}))
+	defer server.Close()
+
+	upload, err := NewClient(server.URL).UploadProject(project)
+	if err != nil {
+		t.Fatalf("UploadProject failed: %v", err)
+	}
+	if upload.UploadID != "upload-1" {
+		t.Errorf("Expected upload-1, got %s", upload.UploadID)
+	}
+	if _, err := os.Stat(filepath.Join(unpacked, "build.gradle")); err != nil {
+		t.Errorf("Expected the build script to be uploaded: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(unpacked, "build")); err == nil {
+		t.Error("Expected the build directory to be left out")
+	}
+
+	if _, err := NewClient(server.URL).UploadProject(filepath.Join(project, "missing")); err == nil {
+		t.Error("Expected a missing project directory to be rejected")
+	}
+}
+
+func TestDownloadArtifacts(t *testing.T) {
+	files := map[string]string{
+		"app/build/libs/app.jar":          "application",
+		"core/build/libs/core.jar":        "core classes",
+		"app/build/distributions/app.zip": "distribution",
+	}
+	corrupt := ""
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/builds/build-1/artifacts" {
+			artifacts := []StoredArtifact{}
+			for path, content := range files {
+				sum := sha256.Sum256([]byte(content))
+				artifacts = append(artifacts, StoredArtifact{Path: path, Size: int64(len(content)), SHA256: hex.EncodeToString(sum[:])})
+			}
+			json.NewEncoder(w).Encode(artifacts)
+			return
+		}
+		path := strings.TrimPrefix(r.URL.Path, "/api/builds/build-1/artifacts/")
+		content, exists := files[path]
+		if !exists {
+			http.NotFound(w, r)
+			return
+		}
+		if path == corrupt {
+			content += "!"
+		}
+		w.Write([]byte(content))
+	}))
+	defer server.Close()
+	client := NewClient(server.URL)
+
+	dest := t.TempDir()
+	paths, err := client.DownloadArtifacts("build-1", dest)
+	if err != nil {
+		t.Fatalf("DownloadArtifacts failed: %v", err)
+	}
+	if len(paths) != len(files) {
+		t.Errorf("Expected %d files, got %v", len(files), paths)
+	}
+	for path, content := range files {
+		if data, err := os.ReadFile(filepath.Join(dest, filepath.FromSlash(path))); err != nil || string(data) != content {
+			t.Errorf("Expected %s to hold %q, got %q: %v", path, content, data, err)
+		}
+	}
+
+	// A file that does not match its checksum leaves the earlier copy
+	corrupt = "core/build/libs/core.jar"
+	if _, err := client.DownloadArtifacts("build-1", dest); err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Errorf("Expected a checksum mismatch, got %v", err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dest, "core", "build", "libs", "core.jar")); string(data) != "core classes" {
+		t.Errorf("Expected the earlier copy to be kept, got %q", data)
+	}
+
+	files["../escape.jar"] = "outside"
+	if _, err := client.DownloadArtifacts("build-1", dest); err == nil {
+		t.Error("Expected artifact paths outside the destination to be rejected")
+	}
+}
+
+func TestVerifySignedResults(t *testing.T) {
+	signer, err := signing.Generate()
+	if err != nil {
+		t.Fatalf("Generate failed: %v", err)
+	}
+	tamper := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/keys/signing":
+			json.NewEncoder(w).Encode(signing.KeySet{Keys: []signing.PublicKey{signer.PublicKey()}})
+		case "/api/build/build-1":
+			recorder := httptest.NewRecorder()
+			signer.WriteJSON(recorder, "application/json", BuildStatus{BuildID: "build-1", Status: "completed", Success: true})
+			w.Header().Set(signing.Header, recorder.Header().Get(signing.Header))
+			body := recorder.Body.String()
+			if tamper {
+				body = strings.Replace(body, `"worker_id":""`, `"worker_id":"worker-evil"`, 1)
+			}
+			w.Write([]byte(body))
+		case "/api/builds/build-1/artifacts":
+			json.NewEncoder(w).Encode([]StoredArtifact{})
+		}
+	}))
+	defer server.Close()
+	client := NewClient(server.URL)
+
+	keys, err := client.GetSigningKeys()
+	if err != nil || len(keys) != 1 || keys[0].KeyID != signer.KeyID() {
+		t.Fatalf("Expected the coordinator's key, got %+v: %v", keys, err)
+	}
+	if client.Verifier, err = signing.NewVerifier(keys...); err != nil {
+		t.Fatalf("NewVerifier failed: %v", err)
+	}
+
+	if status, err := client.GetBuildStatus("build-1"); err != nil || !status.Success {
+		t.Errorf("Expected the signed status, got %+v: %v", status, err)
+	}
+	tamper = true
+	if _, err := client.GetBuildStatus("build-1"); err == nil || !strings.Contains(err.Error(), "invalid signature") {
+		t.Errorf("Expected the tampered status to be rejected, got %v", err)
+	}
+	if _, err := client.ListArtifacts("build-1"); err == nil || !strings.Contains(err.Error(), "not signed") {
+		t.Errorf("Expected the unsigned artifact list to be rejected, got %v", err)
+	}
+}
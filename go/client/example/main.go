@@ -64,6 +64,9 @@ func main() {
 		log.Fatalf("Failed to submit build: %v", err)
 	}
 	fmt.Printf("✓ Build submitted with ID: %s\n", buildResp.BuildID)
+	if buildResp.EstimatedQueueWait > 0 {
+		fmt.Printf("  Estimated start in ~%s\n", buildResp.EstimatedQueueWait.Round(time.Second))
+	}
 
 	// Wait for build completion
 	fmt.Println("Waiting for build to complete...")
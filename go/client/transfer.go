@@ -0,0 +1,213 @@
+package client
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"distributed-gradle-building/projectarchive"
+	"distributed-gradle-building/transfer"
+)
+
+// artifactDownloads is how many artifacts DownloadArtifacts fetches at once
+const artifactDownloads = 4
+
+// ProjectUpload is a project archive uploaded to the coordinator
+type ProjectUpload struct {
+	UploadID  string `json:"upload_id"`
+	Size      int64  `json:"size"`
+	SHA256    string `json:"sha256"`
+	SentBytes int64  `json:"sent_bytes"`
+}
+
+// StoredArtifact is an artifact a worker uploaded for a build
+type StoredArtifact struct {
+	Path      string    `json:"path"`
+	Size      int64     `json:"size"`
+	SHA256    string    `json:"sha256"`
+	Chunks    int       `json:"chunks"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// transferClient returns the HTTP client for uploads and downloads, which
+// take as long as the files they move rather than the client's timeout
+func (c *GradleBuildClient) transferClient() *http.Client {
+	client := *c.HTTPClient
+	client.Timeout = 0
+	return &client
+}
+
+// UploadProject packs the project in path into a gzipped tar archive and
+// streams it to the coordinator. Builds run on it by setting UploadID in
+// their request to the returned upload's; their project path is then
+// relative to path.
+func (c *GradleBuildClient) UploadProject(path string) (*ProjectUpload, error) {
+	if info, err := os.Stat(path); err != nil || !info.IsDir() {
+		return nil, fmt.Errorf("invalid project directory: %s", path)
+	}
+
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(projectarchive.Write(writer, path))
+	}()
+	defer reader.Close()
+
+	httpReq, err := http.NewRequest("POST", fmt.Sprintf("%s/api/uploads", c.BaseURL), reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %v", err)
+	}
+
+	httpReq.Header.Set("Content-Type", projectarchive.ContentType)
+	c.authorize(httpReq)
+
+	resp, err := c.transferClient().Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("failed to upload project: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	var upload ProjectUpload
+	if err := json.NewDecoder(resp.Body).Decode(&upload); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %v", err)
+	}
+
+	return &upload, nil
+}
+
+// ListArtifacts lists the artifacts stored for a build
+func (c *GradleBuildClient) ListArtifacts(buildID string) ([]StoredArtifact, error) {
+	url := fmt.Sprintf("%s/api/builds/%s/artifacts", c.BaseURL, url.PathEscape(buildID))
+
+	httpReq, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %v", err)
+	}
+
+	c.authorize(httpReq)
+
+	resp, err := c.HTTPClient.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+
+	var artifacts []StoredArtifact
+	if err := c.decodeVerified(resp, &artifacts); err != nil {
+		return nil, err
+	}
+
+	return artifacts, nil
+}
+
+// DownloadArtifacts downloads every artifact of a build into destDir, at
+// its path in the project, several at a time. Each file is checked against
+// the checksum the coordinator lists for it, signed if the client has a
+// verifier, before it replaces an existing one. It returns the paths of the files written.
+func (c *GradleBuildClient) DownloadArtifacts(buildID, destDir string) ([]string, error) {
+	artifacts, err := c.ListArtifacts(buildID)
+	if err != nil {
+		return nil, err
+	}
+	for _, artifact := range artifacts {
+		if !transfer.ValidName(artifact.Path) {
+			return nil, fmt.Errorf("invalid artifact path %s", artifact.Path)
+		}
+	}
+
+	paths := make([]string, len(artifacts))
+	errs := make([]error, len(artifacts))
+	next := make(chan int)
+	client := c.transferClient()
+	var wg sync.WaitGroup
+	for range min(artifactDownloads, len(artifacts)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				paths[i] = filepath.Join(destDir, filepath.FromSlash(artifacts[i].Path))
+				errs[i] = c.downloadArtifact(client, buildID, artifacts[i], paths[i])
+			}
+		}()
+	}
+	for i := range artifacts {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return paths, nil
+}
+
+// downloadArtifact writes an artifact to target through a temporary file
+// renamed into place once its checksum matches
+func (c *GradleBuildClient) downloadArtifact(client *http.Client, buildID string, artifact StoredArtifact, target string) error {
+	escaped := strings.Split(artifact.Path, "/")
+	for i, segment := range escaped {
+		escaped[i] = url.PathEscape(segment)
+	}
+	url := fmt.Sprintf("%s/api/builds/%s/artifacts/%s", c.BaseURL, url.PathEscape(buildID), strings.Join(escaped, "/"))
+
+	httpReq, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+
+	c.authorize(httpReq)
+
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return fmt.Errorf("failed to download %s: %v", artifact.Path, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to download %s: unexpected status code: %d", artifact.Path, resp.StatusCode)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	temp, err := os.CreateTemp(filepath.Dir(target), "."+filepath.Base(target)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(temp, hash), resp.Body); err != nil {
+		temp.Close()
+		return fmt.Errorf("failed to download %s: %v", artifact.Path, err)
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(temp.Name(), 0644); err != nil {
+		return err
+	}
+	if sum := hex.EncodeToString(hash.Sum(nil)); sum != artifact.SHA256 {
+		return fmt.Errorf("checksum mismatch for %s: expected %s, got %s", artifact.Path, artifact.SHA256, sum)
+	}
+
+	return os.Rename(temp.Name(), target)
+}
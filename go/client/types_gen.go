@@ -0,0 +1,76 @@
+// Code generated by openapi-gen from openapi.json. DO NOT EDIT.
+
+package client
+
+import "time"
+
+// BuildRequest is generated from the BuildRequest schema
+type BuildRequest struct {
+	ProjectPath   string            `json:"project_path"`
+	TaskName      string            `json:"task_name"`
+	GradleVersion string            `json:"gradle_version,omitempty"`
+	WorkerID      string            `json:"worker_id"`
+	CacheEnabled  bool              `json:"cache_enabled"`
+	BuildOptions  map[string]string `json:"build_options"`
+	Timestamp     time.Time         `json:"timestamp"`
+	RequestID     string            `json:"request_id"`
+	UploadID      string            `json:"upload_id,omitempty"`
+}
+
+// Event is generated from the Event schema
+type Event struct {
+	ID        int64             `json:"id"`
+	Timestamp time.Time         `json:"timestamp"`
+	Action    string            `json:"action"`
+	Principal string            `json:"principal"`
+	SourceIP  string            `json:"source_ip"`
+	Resource  string            `json:"resource"`
+	Details   map[string]string `json:"details,omitempty"`
+}
+
+// HealthStatus is generated from the HealthStatus schema
+type HealthStatus struct {
+	Status     string `json:"status"`
+	Service    string `json:"service"`
+	Version    string `json:"version"`
+	Timestamp  string `json:"timestamp"`
+	Workers    int    `json:"workers"`
+	BuildQueue int    `json:"build_queue"`
+	Uptime     string `json:"uptime"`
+}
+
+// ResourceMetrics is generated from the ResourceMetrics schema
+type ResourceMetrics struct {
+	CPUPercent    float64 `json:"cpu_percent"`
+	MemoryUsage   int64   `json:"memory_usage"`
+	DiskIO        int64   `json:"disk_io"`
+	NetworkIO     int64   `json:"network_io"`
+	MaxMemoryUsed int64   `json:"max_memory_used"`
+}
+
+// SubmitBuildResponse is generated from the SubmitBuildResponse schema
+type SubmitBuildResponse struct {
+	BuildID            string        `json:"build_id"`
+	Status             string        `json:"status"`
+	EstimatedQueueWait time.Duration `json:"estimated_queue_wait"`
+}
+
+// SystemStatus is generated from the SystemStatus schema
+type SystemStatus struct {
+	Timestamp    time.Time `json:"timestamp"`
+	WorkerCount  int       `json:"worker_count"`
+	QueueLength  int       `json:"queue_length"`
+	ActiveBuilds int       `json:"active_builds"`
+}
+
+// Worker is generated from the Worker schema
+type Worker struct {
+	ID           string          `json:"id"`
+	Host         string          `json:"host"`
+	Port         int             `json:"port"`
+	Status       string          `json:"status"`
+	LastCheckin  time.Time       `json:"last_checkin"`
+	BuildCount   int             `json:"build_count"`
+	Capabilities []string        `json:"capabilities"`
+	Resources    ResourceMetrics `json:"resources"`
+}
@@ -200,7 +200,8 @@ func LoadMonitorConfig(configPath string) (*types.MonitorConfig, error) {
 		AlertThresholds:  make(map[string]float64),
 		EnablePrometheus: false,
 		EnableJaeger:     false,
-		JaegerEndpoint:   "http://localhost:14268/api/traces",
+		JaegerEndpoint:   "http://localhost:4318/v1/traces",
+		JaegerSampleRate: 1.0,
 	}
 
 	// Set default alert thresholds
@@ -245,6 +246,12 @@ func LoadMonitorConfig(configPath string) (*types.MonitorConfig, error) {
 		config.JaegerEndpoint = endpoint
 	}
 
+	if rate := os.Getenv("MONITOR_JAEGER_SAMPLE_RATE"); rate != "" {
+		if r, err := strconv.ParseFloat(rate, 64); err == nil {
+			config.JaegerSampleRate = r
+		}
+	}
+
 	return config, nil
 }
 
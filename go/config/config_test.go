@@ -276,8 +276,11 @@ func TestLoadMonitorConfig(t *testing.T) {
 	if config.EnableJaeger {
 		t.Error("Expected EnableJaeger false")
 	}
-	if config.JaegerEndpoint != "http://localhost:14268/api/traces" {
-		t.Errorf("Expected JaegerEndpoint 'http://localhost:14268/api/traces', got %s", config.JaegerEndpoint)
+	if config.JaegerEndpoint != "http://localhost:4318/v1/traces" {
+		t.Errorf("Expected JaegerEndpoint 'http://localhost:4318/v1/traces', got %s", config.JaegerEndpoint)
+	}
+	if config.JaegerSampleRate != 1.0 {
+		t.Errorf("Expected JaegerSampleRate 1.0, got %f", config.JaegerSampleRate)
 	}
 
 	// Test environment variable overrides
@@ -286,6 +289,7 @@ func TestLoadMonitorConfig(t *testing.T) {
 	os.Setenv("MONITOR_ENABLE_PROMETHEUS", "true")
 	os.Setenv("MONITOR_ENABLE_JAEGER", "true")
 	os.Setenv("MONITOR_JAEGER_ENDPOINT", "http://jaeger:14268/api/traces")
+	os.Setenv("MONITOR_JAEGER_SAMPLE_RATE", "0.1")
 
 	config, err = LoadMonitorConfig("")
 	if err != nil {
@@ -307,6 +311,9 @@ func TestLoadMonitorConfig(t *testing.T) {
 	if config.JaegerEndpoint != "http://jaeger:14268/api/traces" {
 		t.Errorf("Expected JaegerEndpoint 'http://jaeger:14268/api/traces' from env, got %s", config.JaegerEndpoint)
 	}
+	if config.JaegerSampleRate != 0.1 {
+		t.Errorf("Expected JaegerSampleRate 0.1 from env, got %f", config.JaegerSampleRate)
+	}
 
 	// Clean up environment variables
 	os.Unsetenv("MONITOR_PORT")
@@ -314,6 +321,7 @@ func TestLoadMonitorConfig(t *testing.T) {
 	os.Unsetenv("MONITOR_ENABLE_PROMETHEUS")
 	os.Unsetenv("MONITOR_ENABLE_JAEGER")
 	os.Unsetenv("MONITOR_JAEGER_ENDPOINT")
+	os.Unsetenv("MONITOR_JAEGER_SAMPLE_RATE")
 }
 
 func TestLoadConfigFromFile(t *testing.T) {
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+
+	"distributed-gradle-building/buildstore"
+	"distributed-gradle-building/gitsource"
+)
+
+// AdmissionConfig configures the rejection of builds that are bound to fail:
+// a build of a commit that already failed CommitFailures times is rejected
+// when the ML service predicts a failure risk of at least RiskThreshold. A
+// zero RiskThreshold admits every build.
+type AdmissionConfig struct {
+	RiskThreshold  float64 `json:"risk_threshold"`
+	CommitFailures int     `json:"commit_failures"`
+}
+
+// Enabled reports whether builds may be rejected
+func (c AdmissionConfig) Enabled() bool {
+	return c.RiskThreshold > 0
+}
+
+// loadAdmissionConfig loads the admission policy from environment variables
+func loadAdmissionConfig() AdmissionConfig {
+	config := AdmissionConfig{CommitFailures: 3}
+
+	if value := os.Getenv("ADMISSION_FAILURE_RISK_THRESHOLD"); value != "" {
+		if threshold, err := strconv.ParseFloat(value, 64); err == nil && threshold > 0 && threshold <= 1 {
+			config.RiskThreshold = threshold
+		} else {
+			log.Printf("Invalid ADMISSION_FAILURE_RISK_THRESHOLD %q, admitting every build", value)
+		}
+	}
+	if value, err := strconv.Atoi(os.Getenv("ADMISSION_COMMIT_FAILURES")); err == nil && value > 0 {
+		config.CommitFailures = value
+	}
+
+	return config
+}
+
+// admissionError rejects a build predicted to fail like the earlier builds
+// of its commit
+type admissionError struct {
+	risk        float64
+	failures    int
+	lastFailure string
+	projectPath string
+}
+
+func (e *admissionError) Error() string {
+	return fmt.Sprintf("build rejected: predicted failure risk %.2f and this commit already failed %d times; "+
+		"see the log of build %s at /api/builds/%s/log and the failure analysis at /api/analytics/failures?project=%s",
+		e.risk, e.failures, e.lastFailure, e.lastFailure, url.QueryEscape(e.projectPath))
+}
+
+// admitBuild rejects a build of a commit that failed repeatedly when the ML
+// service predicts it fails again. Builds of a branch or tag, whose commit
+// is not known before checkout, are always admitted, as are all builds while
+// the ML service is unavailable.
+func (bc *BuildCoordinator) admitBuild(request BuildRequest) error {
+	if !bc.admission.Enabled() || bc.ml == nil || !gitsource.IsCommitHash(request.Ref) {
+		return nil
+	}
+
+	failures, lastFailure := bc.commitFailures(request)
+	if failures < bc.admission.CommitFailures {
+		return nil
+	}
+
+	prediction, err := bc.ml.Predict(context.Background(), request.ProjectPath, request.TaskName, request.BuildOptions)
+	if err != nil {
+		log.Printf("Admitting build of %s at %s without a failure prediction: %v", request.RepoURL, request.Ref, err)
+		return nil
+	}
+	if prediction.FailureRisk < bc.admission.RiskThreshold {
+		return nil
+	}
+
+	return &admissionError{
+		risk:        prediction.FailureRisk,
+		failures:    failures,
+		lastFailure: lastFailure,
+		projectPath: request.ProjectPath,
+	}
+}
+
+// commitFailures counts the failed builds of the same commit, project and
+// task, and returns the ID of the most recent one
+func (bc *BuildCoordinator) commitFailures(request BuildRequest) (int, string) {
+	records, err := bc.buildStore.Query(buildstore.Filter{ProjectPath: request.ProjectPath})
+	if err != nil {
+		log.Printf("Failed to read build history for %s: %v", request.ProjectPath, err)
+		return 0, ""
+	}
+
+	failures, lastFailure := 0, ""
+	for _, record := range records {
+		if record.RepoURL == request.RepoURL && record.Ref == request.Ref && record.TaskName == request.TaskName &&
+			record.Status == buildstore.StatusFailed {
+			failures++
+			lastFailure = record.BuildID
+		}
+	}
+	return failures, lastFailure
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"distributed-gradle-building/analytics"
+	"distributed-gradle-building/buildstore"
+	"distributed-gradle-building/events"
+	"distributed-gradle-building/metrics"
+	"distributed-gradle-building/usage"
+)
+
+// taskTimer times the Gradle tasks of a running build from its step reports
+type taskTimer struct {
+	step    string
+	outcome string
+	started time.Time
+	tasks   []buildstore.TaskTiming
+}
+
+// trackStep records a step reported by a worker. Gradle task paths start
+// with ":"; a task has finished once the build moves on to the next step.
+// The outcome Gradle printed for the task, if any, is kept with its timing.
+// Must be called with the mutex held.
+func (bc *BuildCoordinator) trackStep(buildID, step, outcome string, now time.Time) {
+	timer, exists := bc.timers[buildID]
+	if !exists {
+		timer = &taskTimer{}
+		bc.timers[buildID] = timer
+	}
+	if step == timer.step {
+		return
+	}
+
+	bc.finishStep(buildID, timer, now)
+	timer.step = step
+	timer.outcome = outcome
+	timer.started = now
+}
+
+// finishStep closes the timing of the current step and publishes it if it
+// was a task. Must be called with the mutex held.
+func (bc *BuildCoordinator) finishStep(buildID string, timer *taskTimer, now time.Time) {
+	finished := len(timer.tasks)
+	timer.finishTask(now)
+	for _, task := range timer.tasks[finished:] {
+		bc.publish(events.Event{
+			Type:     events.BuildStepCompleted,
+			BuildID:  buildID,
+			WorkerID: bc.progress[buildID].WorkerID,
+			Step:     task.Name,
+			Duration: task.Duration,
+		})
+	}
+}
+
+// finishTask closes the timing of the current step if it is a task
+func (t *taskTimer) finishTask(now time.Time) {
+	if strings.HasPrefix(t.step, ":") {
+		t.tasks = append(t.tasks, buildstore.TaskTiming{Name: t.step, Duration: now.Sub(t.started), Outcome: t.outcome})
+	}
+	t.step = ""
+	t.outcome = ""
+}
+
+// recordBuild counts a finished build and saves it to the build store. Must
+// be called with the mutex held, after the final status has been set.
+func (bc *BuildCoordinator) recordBuild(buildID string) {
+	progress, exists := bc.progress[buildID]
+	if !exists {
+		return
+	}
+
+	now := time.Now()
+	request := bc.requests[buildID]
+	record := buildstore.Record{
+		BuildID:     buildID,
+		ProjectPath: request.ProjectPath,
+		TaskName:    request.TaskName,
+		RepoURL:     request.RepoURL,
+		Ref:         request.Ref,
+		Tenant:      request.Tenant,
+		Tags:        bc.tags.get(buildID),
+		WorkerID:    progress.WorkerID,
+		Status:      progress.Status,
+		SubmittedAt: request.Timestamp,
+		StartedAt:   progress.StartedAt,
+		FinishedAt:  now,
+	}
+	if response, exists := bc.builds[buildID]; exists {
+		record.Duration = response.BuildDuration
+		record.CacheHitRate = response.Metrics.CacheHitRate
+		record.ErrorMessage = response.ErrorMessage
+		record.ErrorCode = string(response.ErrorCode)
+		record.CacheBytes = response.Metrics.ResourceUsage.CacheStorage
+	}
+	if timer, exists := bc.timers[buildID]; exists {
+		bc.finishStep(buildID, timer, now)
+		record.Tasks = timer.tasks
+		delete(bc.timers, buildID)
+	}
+
+	bc.publish(events.Event{
+		Type:         events.BuildFinished,
+		BuildID:      buildID,
+		WorkerID:     record.WorkerID,
+		Status:       record.Status,
+		Duration:     record.Duration,
+		CacheHitRate: record.CacheHitRate,
+		ErrorMessage: record.ErrorMessage,
+		ErrorCode:    record.ErrorCode,
+	})
+	metrics.BuildsFinished.WithLabelValues(record.Status).Inc()
+	if record.Status != buildstore.StatusCompleted {
+		code := record.ErrorCode
+		if code == "" {
+			code = metrics.BuildFailureUnknown
+		}
+		metrics.BuildFailures.WithLabelValues(code).Inc()
+	}
+	tenant, project := usage.Tenant(record.Tenant), usage.Project(record.ProjectPath, record.RepoURL)
+	metrics.ComputeSeconds.WithLabelValues(tenant, project).Add(usage.ComputeTime(record).Seconds())
+	metrics.CacheStorageBytes.WithLabelValues(tenant, project).Add(float64(record.CacheBytes))
+	bc.buildLogs.Finish(buildID)
+	if err := bc.buildStore.Save(record); err != nil {
+		log.Printf("Failed to record build %s in the build store: %v", buildID, err)
+	}
+
+	// The stages depending on a pipeline stage can start or are skipped
+	if request.PipelineID != "" {
+		go bc.advancePipeline(request.PipelineID)
+	}
+	// A bisection narrows down by the commits it built
+	if request.BisectID != "" {
+		go bc.advanceBisect(request.BisectID)
+	}
+	// The builds depending on the build can be scheduled or fail with it
+	bc.releaseDependents(buildID, record.Status)
+}
+
+// analyticsHandler serves an analytics computation over the stored builds
+// selected by the request's query parameters
+func (bc *BuildCoordinator) analyticsHandler(compute func([]buildstore.Record, analytics.Query) any) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query, err := analytics.ParseQuery(r.URL.Query(), time.Now())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		records, err := bc.buildStore.Query(query.Filter())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(compute(records, query))
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"distributed-gradle-building/apikeys"
+	"distributed-gradle-building/audit"
+	"distributed-gradle-building/auth"
+	"distributed-gradle-building/authz"
+	"distributed-gradle-building/middleware"
+)
+
+// IssueAPIKeyRequest is the request body for issuing an API key
+type IssueAPIKeyRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+	// ExpiresIn is a Go duration such as 720h; keys without it do not expire
+	ExpiresIn string `json:"expires_in,omitempty"`
+}
+
+// IssueAPIKeyResponse is an issued API key with its secret, which is only
+// ever returned here
+type IssueAPIKeyResponse struct {
+	apikeys.Key
+	Secret string `json:"key"`
+}
+
+// keyScopes rejects requests of API keys lacking the scope their route needs
+func keyScopes(mux *http.ServeMux) middleware.Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			claims, ok := auth.GetClaimsFromContext(r)
+			if !ok || claims.KeyID == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			_, pattern := mux.Handler(r)
+			scope := requiredScope(r.Method, pattern)
+			if !slices.Contains(claims.Permissions, scope) && !slices.Contains(claims.Permissions, apikeys.ScopeAdmin) {
+				http.Error(w, fmt.Sprintf("API key %s lacks the %s scope", claims.KeyID, scope), http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// requiredScope returns the scope an API key needs for a route. Reads need
+// the read scope except for the audit log and the keys themselves, the
+// calls of workers connected over HTTP need the worker scope, and every
+// other change needs the admin scope.
+func requiredScope(method, pattern string) string {
+	switch pattern {
+	case "POST /api/build", "POST /api/pipelines", "POST /api/bisect":
+		return apikeys.ScopeBuild
+	case "DELETE /api/builds/{id}/artifacts", "DELETE /api/builds/{id}/artifacts/{path...}":
+		return apikeys.ScopeArtifacts
+	case "POST /api/rpc", "GET /api/rpc/calls", "POST /api/rpc/calls":
+		return apikeys.ScopeWorker
+	case "GET /api/audit", "GET /api/keys":
+		return apikeys.ScopeAdmin
+	}
+	if method == http.MethodGet || method == http.MethodHead {
+		return apikeys.ScopeRead
+	}
+	return apikeys.ScopeAdmin
+}
+
+// requireAdmin allows only administrators to reach a handler: JWTs with the
+// admin role, admin service tokens and API keys with the admin scope. The
+// authorization policy is consulted as well when one is configured.
+func (bc *BuildCoordinator) requireAdmin(service *auth.AuthService, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		admin := false
+		if claims, ok := auth.GetClaimsFromContext(r); ok {
+			admin = claims.Role == "admin" || (claims.KeyID != "" && slices.Contains(claims.Permissions, apikeys.ScopeAdmin))
+		} else if token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); found {
+			admin = service.IsAdmin(token)
+		}
+		if !admin {
+			http.Error(w, "admin access required", http.StatusForbidden)
+			return
+		}
+		if bc.authorize(w, r, authz.ActionAPIKeysManage, authz.Resource{}) {
+			handler(w, r)
+		}
+	}
+}
+
+func (bc *BuildCoordinator) handleIssueAPIKey(w http.ResponseWriter, r *http.Request) {
+	var request IssueAPIKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	var ttl time.Duration
+	if request.ExpiresIn != "" {
+		parsed, err := time.ParseDuration(request.ExpiresIn)
+		if err != nil || parsed <= 0 {
+			http.Error(w, fmt.Sprintf("invalid expires_in %q", request.ExpiresIn), http.StatusBadRequest)
+			return
+		}
+		ttl = parsed
+	}
+
+	key, secret, err := bc.apiKeys.Issue(request.Name, request.Scopes, ttl, audit.Principal(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	details := map[string]string{"name": key.Name, "scopes": strings.Join(key.Scopes, ",")}
+	if key.ExpiresAt != nil {
+		details["expires_at"] = key.ExpiresAt.Format(time.RFC3339)
+	}
+	bc.auditLog.RecordRequest(r, audit.ActionAPIKeyIssued, key.ID, details)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(IssueAPIKeyResponse{Key: key, Secret: secret})
+}
+
+func (bc *BuildCoordinator) handleListAPIKeys(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(bc.apiKeys.List())
+}
+
+func (bc *BuildCoordinator) handleRevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	key, err := bc.apiKeys.Revoke(r.PathValue("id"))
+	if errors.Is(err, apikeys.ErrNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	bc.auditLog.RecordRequest(r, audit.ActionAPIKeyRevoked, key.ID, map[string]string{"name": key.Name})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(key)
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"distributed-gradle-building/audit"
+	"distributed-gradle-building/authz"
+	"distributed-gradle-building/metrics"
+	"distributed-gradle-building/retention"
+	"distributed-gradle-building/transfer"
+	"distributed-gradle-building/usage"
+)
+
+// DefaultArtifactRetention is how long the artifacts of builds no retention
+// policy matches are kept, unless ARTIFACT_RETENTION is set
+const DefaultArtifactRetention = 7 * 24 * time.Hour
+
+// artifactUploadGrace is how long chunks no artifact uses are kept, so the
+// chunks of artifacts still being uploaded survive until their commit
+const artifactUploadGrace = time.Hour
+
+// ArtifactRetentionFromEnv reads ARTIFACT_RETENTION
+func ArtifactRetentionFromEnv() time.Duration {
+	value := os.Getenv("ARTIFACT_RETENTION")
+	if value == "" {
+		return DefaultArtifactRetention
+	}
+
+	retention, err := time.ParseDuration(value)
+	if err != nil || retention <= 0 {
+		log.Printf("Invalid ARTIFACT_RETENTION %q, using %v", value, DefaultArtifactRetention)
+		return DefaultArtifactRetention
+	}
+	return retention
+}
+
+// RPC argument and reply types for artifact uploads
+type MissingChunksArgs struct {
+	BuildID  string   `json:"build_id"`
+	WorkerID string   `json:"worker_id"`
+	Hashes   []string `json:"hashes"`
+}
+
+type MissingChunksReply struct {
+	Missing []string `json:"missing"`
+}
+
+type UploadChunkArgs struct {
+	BuildID  string `json:"build_id"`
+	WorkerID string `json:"worker_id"`
+	Hash     string `json:"hash"`
+	Data     []byte `json:"data"`
+}
+
+type UploadChunkReply struct {
+	Message string `json:"message"`
+}
+
+type CommitArtifactArgs struct {
+	BuildID  string            `json:"build_id"`
+	WorkerID string            `json:"worker_id"`
+	Manifest transfer.Manifest `json:"manifest"`
+}
+
+type CommitArtifactReply struct {
+	Message string `json:"message"`
+}
+
+// DeleteArtifactsResponse reports the artifacts and chunks a delete removed
+type DeleteArtifactsResponse struct {
+	BuildID   string `json:"build_id"`
+	Artifacts int    `json:"artifacts"`
+	Chunks    int    `json:"chunks"`
+}
+
+// StoredArtifact is an artifact uploaded for a build
+type StoredArtifact struct {
+	Path      string    `json:"path"`
+	Size      int64     `json:"size"`
+	SHA256    string    `json:"sha256"`
+	Chunks    int       `json:"chunks"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// checkUploader returns an error unless the build exists and runs on the
+// worker. Both copies of a duplicated build may upload; the store keeps the
+// files of the last one to commit.
+func (bc *BuildCoordinator) checkUploader(buildID, workerID string) error {
+	bc.mutex.RLock()
+	defer bc.mutex.RUnlock()
+
+	if _, exists := bc.builds[buildID]; !exists {
+		return fmt.Errorf("build %s not found", buildID)
+	}
+	if spec, exists := bc.speculations[buildID]; exists && (workerID == spec.primary || workerID == spec.backup) {
+		return nil
+	}
+	if progress, exists := bc.progress[buildID]; exists && progress.WorkerID != workerID {
+		return fmt.Errorf("build %s is not assigned to worker %s", buildID, workerID)
+	}
+	return nil
+}
+
+// MissingChunks returns the chunks of an artifact the coordinator does not
+// have yet, so the worker only uploads those
+// RPC method signature: func (t *T) MethodName(args *ArgType, reply *ReplyType) error
+func (bc *BuildCoordinator) MissingChunks(args *MissingChunksArgs, reply *MissingChunksReply) error {
+	if err := bc.checkUploader(args.BuildID, args.WorkerID); err != nil {
+		return err
+	}
+
+	missing, err := bc.artifacts.Missing(args.Hashes)
+	if err != nil {
+		return err
+	}
+	reply.Missing = missing
+	return nil
+}
+
+// UploadChunk stores a compressed chunk of an artifact
+// RPC method signature: func (t *T) MethodName(args *ArgType, reply *ReplyType) error
+func (bc *BuildCoordinator) UploadChunk(args *UploadChunkArgs, reply *UploadChunkReply) error {
+	if err := bc.checkUploader(args.BuildID, args.WorkerID); err != nil {
+		return err
+	}
+	if err := bc.artifacts.PutChunk(args.Hash, args.Data); err != nil {
+		return err
+	}
+
+	metrics.TransferBytes.WithLabelValues(metrics.TransferUpload, metrics.TransferDeduplicated).Add(float64(transfer.PlainSize(args.Data)))
+	metrics.TransferBytes.WithLabelValues(metrics.TransferUpload, metrics.TransferCompressed).Add(float64(len(args.Data)))
+	reply.Message = fmt.Sprintf("Stored chunk %s", args.Hash)
+	return nil
+}
+
+// CommitArtifact stores the manifest of an artifact once its chunks are
+// uploaded. Artifacts are named after the build, as <build id>/<path>, and
+// record the project, repository and labels the retention policies match,
+// and the tenant their storage is accounted to.
+// RPC method signature: func (t *T) MethodName(args *ArgType, reply *ReplyType) error
+func (bc *BuildCoordinator) CommitArtifact(args *CommitArtifactArgs, reply *CommitArtifactReply) error {
+	if err := bc.checkUploader(args.BuildID, args.WorkerID); err != nil {
+		return err
+	}
+	if !strings.HasPrefix(args.Manifest.Name, args.BuildID+"/") {
+		return fmt.Errorf("artifact %s does not belong to build %s", args.Manifest.Name, args.BuildID)
+	}
+	bc.mutex.RLock()
+	request := bc.requests[args.BuildID]
+	bc.mutex.RUnlock()
+	args.Manifest.Attributes = retention.Attributes(request.ProjectPath, request.RepoURL, request.Ref, request.Labels)
+	args.Manifest.Attributes[usage.AttributeTenant] = usage.Tenant(request.Tenant)
+	if err := bc.artifacts.Commit(args.Manifest); err != nil {
+		return err
+	}
+
+	metrics.TransferBytes.WithLabelValues(metrics.TransferUpload, metrics.TransferRaw).Add(float64(args.Manifest.Size))
+	reply.Message = fmt.Sprintf("Stored artifact %s", args.Manifest.Name)
+	return nil
+}
+
+// collectArtifacts removes the artifacts the retention policies no longer
+// keep at now, and the chunks no remaining artifact uses. It returns how many
+// artifacts and chunks were removed.
+func (bc *BuildCoordinator) collectArtifacts(now time.Time) (int, int, error) {
+	manifests, err := bc.artifacts.List("")
+	if err != nil {
+		return 0, 0, err
+	}
+	expired := make(map[string]bool)
+	for _, name := range bc.retention.Expired(manifests, now) {
+		expired[name] = true
+	}
+	return bc.artifacts.Collect(func(manifest transfer.Manifest) bool {
+		// Artifacts committed again since the listing are judged next time
+		return expired[manifest.Name] && !manifest.CreatedAt.After(now)
+	}, now.Add(-artifactUploadGrace))
+}
+
+// pruneArtifacts garbage collects artifacts and measures the storage left
+// every hour until shutdown
+func (bc *BuildCoordinator) pruneArtifacts() {
+	bc.updateArtifactStorage()
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			files, chunks, err := bc.collectArtifacts(time.Now())
+			if err != nil {
+				log.Printf("Failed to prune artifacts: %v", err)
+			}
+			if files > 0 || chunks > 0 {
+				bc.recordEvent(audit.Event{
+					Action:    audit.ActionArtifactsDeleted,
+					Principal: "retention",
+					Resource:  "artifacts",
+					Details: map[string]string{
+						"artifacts": strconv.Itoa(files),
+						"chunks":    strconv.Itoa(chunks),
+					},
+				})
+				log.Printf("Pruned %d artifacts and %d chunks", files, chunks)
+			}
+			bc.updateArtifactStorage()
+		case <-bc.shutdown:
+			return
+		}
+	}
+}
+
+// handleListArtifacts lists the artifacts uploaded for a build
+func (bc *BuildCoordinator) handleListArtifacts(w http.ResponseWriter, r *http.Request) {
+	prefix := r.PathValue("id") + "/"
+	manifests, err := bc.artifacts.List(prefix)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	artifacts := make([]StoredArtifact, 0, len(manifests))
+	for _, manifest := range manifests {
+		artifacts = append(artifacts, StoredArtifact{
+			Path:      strings.TrimPrefix(manifest.Name, prefix),
+			Size:      manifest.Size,
+			SHA256:    manifest.SHA256,
+			Chunks:    len(manifest.Chunks),
+			CreatedAt: manifest.CreatedAt,
+		})
+	}
+
+	bc.signer.WriteJSON(w, "application/json", artifacts)
+}
+
+// handleGetArtifact serves an uploaded artifact. Clients accepting the
+// manifest content type get its chunk manifest and fetch the chunks they do
+// not have from /api/chunks; others get its content.
+func (bc *BuildCoordinator) handleGetArtifact(w http.ResponseWriter, r *http.Request) {
+	manifest, err := bc.artifacts.Manifest(r.PathValue("id") + "/" + r.PathValue("path"))
+	if errors.Is(err, fs.ErrNotExist) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if strings.Contains(r.Header.Get("Accept"), transfer.ManifestContentType) {
+		metrics.TransferBytes.WithLabelValues(metrics.TransferDownload, metrics.TransferRaw).Add(float64(manifest.Size))
+		bc.signer.WriteJSON(w, transfer.ManifestContentType, manifest)
+		return
+	}
+
+	for _, stage := range []string{metrics.TransferRaw, metrics.TransferDeduplicated, metrics.TransferCompressed} {
+		metrics.TransferBytes.WithLabelValues(metrics.TransferDownload, stage).Add(float64(manifest.Size))
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(manifest.Size, 10))
+	w.Header().Set("ETag", strconv.Quote(manifest.SHA256))
+	for _, chunk := range manifest.Chunks {
+		data, err := bc.artifacts.ReadChunk(chunk.Hash)
+		if err != nil {
+			// The status is sent already; the short body tells the client
+			log.Printf("Failed to serve artifact %s: %v", manifest.Name, err)
+			return
+		}
+		if _, err := w.Write(data); err != nil {
+			return
+		}
+	}
+}
+
+// handleDeleteArtifacts deletes every artifact of a build, or the one at
+// path, ahead of the retention policies
+func (bc *BuildCoordinator) handleDeleteArtifacts(w http.ResponseWriter, r *http.Request) {
+	buildID, path := r.PathValue("id"), r.PathValue("path")
+	if !bc.authorize(w, r, authz.ActionArtifactsDelete, bc.buildAuthzResource(buildID)) {
+		return
+	}
+	prefix := buildID + "/"
+	files, chunks, err := bc.artifacts.Collect(func(manifest transfer.Manifest) bool {
+		if path != "" {
+			return manifest.Name == prefix+path
+		}
+		return strings.HasPrefix(manifest.Name, prefix)
+	}, time.Now().Add(-artifactUploadGrace))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if files == 0 {
+		http.Error(w, fmt.Sprintf("no artifacts found for build %s", buildID), http.StatusNotFound)
+		return
+	}
+
+	details := map[string]string{
+		"artifacts": strconv.Itoa(files),
+		"chunks":    strconv.Itoa(chunks),
+	}
+	if path != "" {
+		details["path"] = path
+	}
+	bc.auditLog.RecordRequest(r, audit.ActionArtifactsDeleted, buildID, details)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(DeleteArtifactsResponse{BuildID: buildID, Artifacts: files, Chunks: chunks})
+}
+
+// handleGetChunk serves a compressed artifact chunk
+func (bc *BuildCoordinator) handleGetChunk(w http.ResponseWriter, r *http.Request) {
+	data, err := bc.artifacts.Chunk(r.PathValue("hash"))
+	if errors.Is(err, fs.ErrNotExist) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	metrics.TransferBytes.WithLabelValues(metrics.TransferDownload, metrics.TransferDeduplicated).Add(float64(transfer.PlainSize(data)))
+	metrics.TransferBytes.WithLabelValues(metrics.TransferDownload, metrics.TransferCompressed).Add(float64(len(data)))
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Write(data)
+}
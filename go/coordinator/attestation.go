@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"distributed-gradle-building/attestation"
+	"distributed-gradle-building/audit"
+)
+
+// attestWorker verifies the attestation a registering worker presented
+// against the attestation policy, returning its statement. Workers failing
+// it are rejected and audited. Without a policy workers register without
+// attestation. Must be called with the mutex held.
+func (bc *BuildCoordinator) attestWorker(args *RegisterWorkerArgs) (*attestation.Statement, error) {
+	if bc.attestation == nil {
+		return nil, nil
+	}
+	statement, err := bc.attestation.Verify(args.Attestation, args.ID, bc.releasedBinaries(), time.Now())
+	if err != nil {
+		bc.recordEvent(audit.Event{
+			Action:    audit.ActionWorkerRejected,
+			Principal: "worker:" + args.ID,
+			SourceIP:  args.Host,
+			Resource:  args.ID,
+			Details:   map[string]string{"reason": err.Error()},
+		})
+		log.Printf("Rejected worker %s from %s: attestation failed: %v", args.ID, args.Host, err)
+		return nil, fmt.Errorf("worker %s failed attestation: %v", args.ID, err)
+	}
+	log.Printf("Worker %s attested binary %s on %s with key %s", args.ID, statement.BinarySHA256, statement.Platform, statement.Key.KeyID)
+	return statement, nil
+}
+
+// releasedBinaries returns the checksum of the worker release the
+// coordinator publishes, which attested workers may run after updating
+func (bc *BuildCoordinator) releasedBinaries() []string {
+	if release := bc.workerRelease.Release(); release != nil {
+		return []string{release.SHA256}
+	}
+	return nil
+}
@@ -0,0 +1,15 @@
+package main
+
+import (
+	"log"
+
+	"distributed-gradle-building/audit"
+)
+
+// recordEvent appends an event to the audit log. RPC callers are not
+// identified by net/rpc, so their principal and source come from the call.
+func (bc *BuildCoordinator) recordEvent(event audit.Event) {
+	if err := bc.auditLog.Record(event); err != nil {
+		log.Printf("Failed to record audit event %s for %s: %v", event.Action, event.Resource, err)
+	}
+}
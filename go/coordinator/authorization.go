@@ -0,0 +1,111 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"path/filepath"
+
+	"distributed-gradle-building/audit"
+	"distributed-gradle-building/auth"
+	"distributed-gradle-building/authz"
+	"distributed-gradle-building/retention"
+)
+
+// subject identifies the caller of a request for the authorizer
+func (bc *BuildCoordinator) subject(r *http.Request) authz.Subject {
+	subject := authz.Subject{
+		Principal: audit.Principal(r),
+		Tenant:    bc.rateLimiter.Tenant(r),
+	}
+	if claims, ok := auth.GetClaimsFromContext(r); ok {
+		subject.User = claims.UserID
+		subject.Role = claims.Role
+		subject.Permissions = claims.Permissions
+	}
+	return subject
+}
+
+// authorize checks whether the caller may perform an action on a resource.
+// Denials are answered with 403 and recorded in the audit log; when the
+// authorizer cannot decide the request fails with 503 rather than being
+// allowed. Every request is allowed when no authorizer is configured.
+func (bc *BuildCoordinator) authorize(w http.ResponseWriter, r *http.Request, action string, resource authz.Resource) bool {
+	if bc.authorizer == nil {
+		return true
+	}
+
+	input := authz.Input{Action: action, Subject: bc.subject(r), Resource: resource}
+	decision, err := bc.authorizer.Authorize(r.Context(), input)
+	if err != nil {
+		log.Printf("Authorization of %s by %s failed: %v", action, input.Subject.Principal, err)
+		http.Error(w, "authorization unavailable", http.StatusServiceUnavailable)
+		return false
+	}
+	if !decision.Allowed {
+		details := map[string]string{"action": action, "reason": decision.Reason}
+		if resource.ProjectPath != "" {
+			details["project_path"] = resource.ProjectPath
+		}
+		if resource.RepoURL != "" {
+			details["repo_url"] = resource.RepoURL
+		}
+		bc.auditLog.RecordRequest(r, audit.ActionAccessDenied, resourceName(action, resource), details)
+		http.Error(w, "forbidden: "+decision.Reason, http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// requireAuthorization allows only callers authorized for an action to reach
+// an admin handler
+func (bc *BuildCoordinator) requireAuthorization(action string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if bc.authorize(w, r, action, authz.Resource{}) {
+			handler(w, r)
+		}
+	}
+}
+
+// buildResource describes a validated build request to the authorizer
+func buildResource(request BuildRequest) authz.Resource {
+	projectPath := request.ProjectPath
+	// The project path of a build on an upload is relative to the archive
+	// of the project the upload is of
+	if request.Upload != nil && request.Upload.Attributes[retention.AttributeProject] != "" {
+		projectPath = filepath.Join(request.Upload.Attributes[retention.AttributeProject], projectPath)
+	}
+	return authz.Resource{
+		ProjectPath: projectPath,
+		RepoURL:     request.RepoURL,
+		TaskName:    request.TaskName,
+	}
+}
+
+// resourceName names the resource of a denied request in the audit log
+func resourceName(action string, resource authz.Resource) string {
+	switch {
+	case resource.BuildID != "":
+		return resource.BuildID
+	case resource.RepoURL != "":
+		return resource.RepoURL
+	case resource.ProjectPath != "":
+		return resource.ProjectPath
+	}
+	return action
+}
+
+// buildAuthzResource describes an existing build to the authorizer, with the
+// project it built when the coordinator still knows the request
+func (bc *BuildCoordinator) buildAuthzResource(buildID string) authz.Resource {
+	bc.mutex.RLock()
+	request, exists := bc.requests[buildID]
+	bc.mutex.RUnlock()
+
+	resource := authz.Resource{BuildID: buildID}
+	if exists {
+		resource.ProjectPath = request.ProjectPath
+		resource.RepoURL = request.RepoURL
+		resource.TaskName = request.TaskName
+	}
+	return resource
+}
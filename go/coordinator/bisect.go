@@ -0,0 +1,479 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/bits"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"distributed-gradle-building/audit"
+	"distributed-gradle-building/authz"
+	"distributed-gradle-building/gitsource"
+	"distributed-gradle-building/gradledist"
+	"distributed-gradle-building/middleware"
+	"distributed-gradle-building/pools"
+)
+
+// BisectStatusResolving is the status of a bisection listing the commits
+// between its good and bad refs. It is running while it builds them.
+const BisectStatusResolving = "resolving"
+
+// bisectInterval is how often bisections waiting for idle capacity check
+// for it
+const bisectInterval = 10 * time.Second
+
+// webhookAttempts and webhookTimeout bound the delivery of a webhook
+const (
+	webhookAttempts = 3
+	webhookTimeout  = 10 * time.Second
+)
+
+// SignatureHeader carries the HMAC-SHA256 of a webhook's body, keyed with the
+// webhook secret, as sha256=<hex>
+const SignatureHeader = "X-Signature-256"
+
+// BisectRequest finds the first commit between a good and a bad ref of a
+// repository whose build fails. Build is the build to run on each commit;
+// its ref is replaced by the commits tested.
+type BisectRequest struct {
+	Build BuildRequest `json:"build"`
+	Good  string       `json:"good"`
+	Bad   string       `json:"bad"`
+	// WebhookURL is POSTed the bisection once it finished, signed with
+	// WebhookSecret if set
+	WebhookURL    string `json:"webhook_url,omitempty"`
+	WebhookSecret string `json:"webhook_secret,omitempty"`
+}
+
+// BisectStep is a commit a bisection built
+type BisectStep struct {
+	Commit  string `json:"commit"`
+	BuildID string `json:"build_id"`
+	Status  string `json:"status"`
+}
+
+// BisectStatus is a bisection with the builds it ran. Commits is the number
+// of commits after the good ref up to the bad ref, and RemainingSteps how
+// many more builds at most find the first bad one.
+type BisectStatus struct {
+	BisectID       string       `json:"bisect_id"`
+	Status         string       `json:"status"`
+	RepoURL        string       `json:"repo_url"`
+	ProjectPath    string       `json:"project_path,omitempty"`
+	TaskName       string       `json:"task_name"`
+	Good           string       `json:"good"`
+	Bad            string       `json:"bad"`
+	Commits        int          `json:"commits"`
+	RemainingSteps int          `json:"remaining_steps"`
+	FirstBadCommit string       `json:"first_bad_commit,omitempty"`
+	Message        string       `json:"message,omitempty"`
+	Steps          []BisectStep `json:"steps"`
+	CreatedAt      time.Time    `json:"created_at"`
+	FinishedAt     *time.Time   `json:"finished_at,omitempty"`
+}
+
+// bisectRun tracks a bisection. The first bad commit lies after good and
+// at or before bad, indexes into commits where -1 is the good ref.
+type bisectRun struct {
+	request    BisectRequest
+	pool       string
+	status     string
+	message    string
+	commits    []string
+	good, bad  int
+	steps      []bisectStep
+	createdAt  time.Time
+	finishedAt time.Time
+}
+
+// bisectStep is a commit of a bisection and its build
+type bisectStep struct {
+	index   int
+	buildID string
+}
+
+// SubmitBisect starts a bisection and returns its ID. The commits between
+// its refs are listed in the background.
+func (bc *BuildCoordinator) SubmitBisect(request BisectRequest) string {
+	bisectID := "bisect-" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	run := &bisectRun{
+		request:   request,
+		pool:      pools.Normalize(bc.router.Route(request.Build.ProjectPath, request.Build.RepoURL, request.Build.Labels)),
+		status:    BisectStatusResolving,
+		createdAt: time.Now(),
+	}
+
+	bc.mutex.Lock()
+	bc.bisects[bisectID] = run
+	bc.mutex.Unlock()
+
+	go bc.resolveBisect(bisectID)
+	return bisectID
+}
+
+// resolveBisect lists the commits of a bisection and starts building them
+func (bc *BuildCoordinator) resolveBisect(bisectID string) {
+	bc.mutex.RLock()
+	request := bc.bisects[bisectID].request
+	bc.mutex.RUnlock()
+
+	source := gitsource.Source{RepoURL: request.Build.RepoURL, Ref: request.Bad}
+	if request.Build.Credentials != "" {
+		credentials, err := bc.secretStore.Value(request.Build.Credentials)
+		if err != nil {
+			bc.finishBisect(bisectID, BuildStatusFailed, fmt.Sprintf("failed to resolve credentials: %v", err))
+			return
+		}
+		source.Credentials = credentials
+	}
+	commits, err := bc.checkouts.Commits(source, request.Good)
+	if err != nil {
+		bc.finishBisect(bisectID, BuildStatusFailed, err.Error())
+		return
+	}
+	if len(commits) == 0 {
+		bc.finishBisect(bisectID, BuildStatusFailed, fmt.Sprintf("%s has no commits after %s", request.Bad, request.Good))
+		return
+	}
+
+	bc.mutex.Lock()
+	run := bc.bisects[bisectID]
+	run.commits = commits
+	run.good, run.bad = -1, len(commits)-1
+	run.status = BuildStatusRunning
+	bc.mutex.Unlock()
+	log.Printf("Bisecting %d commits of %s between %s and %s as %s", len(commits), request.Build.RepoURL, request.Good, request.Bad, bisectID)
+
+	bc.advanceBisect(bisectID)
+}
+
+// advanceBisect narrows a bisection down by the build of its last commit
+// and queues the build of the next commit while its pool is idle
+func (bc *BuildCoordinator) advanceBisect(bisectID string) {
+	for {
+		request, next, finished := bc.nextBisectStep(bisectID)
+		if finished {
+			go bc.notifyBisect(bisectID)
+		}
+		if !next {
+			return
+		}
+		if _, err := bc.SubmitBuild(request); err != nil {
+			bc.finishBisect(bisectID, BuildStatusFailed, fmt.Sprintf("failed to queue the build of %s: %v", request.Ref, err))
+			return
+		}
+	}
+}
+
+// nextBisectStep returns the build of the next commit of a bisection to
+// queue, if any, recording it as a step. It reports whether the bisection
+// finished instead.
+func (bc *BuildCoordinator) nextBisectStep(bisectID string) (BuildRequest, bool, bool) {
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+
+	run, exists := bc.bisects[bisectID]
+	if !exists || run.status != BuildStatusRunning {
+		return BuildRequest{}, false, false
+	}
+
+	if len(run.steps) > 0 {
+		step := run.steps[len(run.steps)-1]
+		if run.good < step.index && step.index < run.bad {
+			progress, exists := bc.progress[step.buildID]
+			if !exists {
+				return BuildRequest{}, false, false
+			}
+			switch progress.Status {
+			case BuildStatusCompleted:
+				run.good = step.index
+			case BuildStatusFailed:
+				run.bad = step.index
+			case BuildStatusCancelled:
+				bc.endBisect(run, BuildStatusFailed, fmt.Sprintf("build %s was cancelled", step.buildID))
+				return BuildRequest{}, false, true
+			default:
+				return BuildRequest{}, false, false
+			}
+		}
+	}
+
+	if run.bad-run.good <= 1 {
+		bc.endBisect(run, BuildStatusCompleted, "")
+		log.Printf("Bisection %s found the first bad commit %s", bisectID, run.commits[run.bad])
+		return BuildRequest{}, false, true
+	}
+	if !bc.poolIdle(run.pool) {
+		return BuildRequest{}, false, false
+	}
+
+	index := (run.good + run.bad) / 2
+	commit := run.commits[index]
+	request := run.request.Build
+	request.Ref = commit
+	request.RequestID = fmt.Sprintf("%s-%s", bisectID, commit[:min(len(commit), 12)])
+	request.BisectID = bisectID
+	run.steps = append(run.steps, bisectStep{index: index, buildID: request.RequestID})
+	return request, true, false
+}
+
+// poolIdle reports whether a pool has a free worker and no queued builds,
+// so builds of bisections do not delay other builds. Must be called with
+// the mutex held.
+func (bc *BuildCoordinator) poolIdle(pool string) bool {
+	if len(bc.getPoolWorkers(pool)) == 0 {
+		return false
+	}
+	for id, progress := range bc.progress {
+		if progress.Status == BuildStatusQueued && !progress.Paused && pools.Normalize(bc.requests[id].Pool) == pool {
+			if _, forwarded := bc.forwarded[id]; !forwarded {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// finishBisect ends a bisection and sends its webhook
+func (bc *BuildCoordinator) finishBisect(bisectID, status, message string) {
+	bc.mutex.Lock()
+	bc.endBisect(bc.bisects[bisectID], status, message)
+	bc.mutex.Unlock()
+	go bc.notifyBisect(bisectID)
+}
+
+// endBisect sets the final status of a bisection. Must be called with the
+// mutex held.
+func (bc *BuildCoordinator) endBisect(run *bisectRun, status, message string) {
+	run.status = status
+	run.message = message
+	run.finishedAt = time.Now()
+	if message != "" {
+		log.Printf("Bisection of %s failed: %s", run.request.Build.RepoURL, message)
+	}
+}
+
+// runBisects retries the bisections waiting for idle capacity until the
+// coordinator shuts down
+func (bc *BuildCoordinator) runBisects() {
+	ticker := time.NewTicker(bisectInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			bc.mutex.RLock()
+			var running []string
+			for id, run := range bc.bisects {
+				if run.status == BuildStatusRunning {
+					running = append(running, id)
+				}
+			}
+			bc.mutex.RUnlock()
+			for _, id := range running {
+				bc.advanceBisect(id)
+			}
+		case <-bc.shutdown:
+			return
+		}
+	}
+}
+
+// GetBisect returns a bisection with the builds it ran
+func (bc *BuildCoordinator) GetBisect(bisectID string) (*BisectStatus, error) {
+	bc.mutex.RLock()
+	defer bc.mutex.RUnlock()
+
+	run, exists := bc.bisects[bisectID]
+	if !exists {
+		return nil, fmt.Errorf("bisection %s not found", bisectID)
+	}
+
+	status := &BisectStatus{
+		BisectID:    bisectID,
+		Status:      run.status,
+		RepoURL:     run.request.Build.RepoURL,
+		ProjectPath: run.request.Build.ProjectPath,
+		TaskName:    run.request.Build.TaskName,
+		Good:        run.request.Good,
+		Bad:         run.request.Bad,
+		Commits:     len(run.commits),
+		Message:     run.message,
+		Steps:       make([]BisectStep, 0, len(run.steps)),
+		CreatedAt:   run.createdAt,
+	}
+	if run.commits != nil && run.bad-run.good > 1 && run.status != BuildStatusFailed {
+		status.RemainingSteps = bits.Len(uint(run.bad - run.good - 1))
+	}
+	if run.status == BuildStatusCompleted {
+		status.FirstBadCommit = run.commits[run.bad]
+	}
+	if !run.finishedAt.IsZero() {
+		finishedAt := run.finishedAt
+		status.FinishedAt = &finishedAt
+	}
+	for _, step := range run.steps {
+		state := BisectStep{Commit: run.commits[step.index], BuildID: step.buildID, Status: BuildStatusQueued}
+		if progress, exists := bc.progress[step.buildID]; exists {
+			state.Status = progress.Status
+		}
+		status.Steps = append(status.Steps, state)
+	}
+	return status, nil
+}
+
+// bisectWebhookClient delivers the webhooks of bisections
+var bisectWebhookClient = &http.Client{Timeout: webhookTimeout}
+
+// notifyBisect POSTs a finished bisection to its webhook, retrying failed
+// deliveries with backoff
+func (bc *BuildCoordinator) notifyBisect(bisectID string) {
+	bc.mutex.RLock()
+	request := bc.bisects[bisectID].request
+	bc.mutex.RUnlock()
+	if request.WebhookURL == "" {
+		return
+	}
+
+	status, err := bc.GetBisect(bisectID)
+	if err != nil {
+		return
+	}
+	body, err := json.Marshal(status)
+	if err != nil {
+		log.Printf("Failed to encode the webhook of bisection %s: %v", bisectID, err)
+		return
+	}
+
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		err := sendWebhook(request.WebhookURL, request.WebhookSecret, body)
+		if err == nil {
+			return
+		}
+		if attempt == webhookAttempts {
+			log.Printf("Failed to deliver the webhook of bisection %s: %v", bisectID, err)
+			return
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// sendWebhook POSTs a JSON body to a webhook, signing it if it has a secret
+func sendWebhook(webhookURL, secret string, body []byte) error {
+	req, err := http.NewRequest("POST", webhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if secret != "" {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(body)
+		req.Header.Set(SignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := bisectWebhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+// validateWebhookURL checks that a webhook is an absolute HTTP(S) URL
+func validateWebhookURL(webhookURL string) error {
+	parsed, err := url.Parse(webhookURL)
+	if err != nil || (parsed.Scheme != "https" && parsed.Scheme != "http") || parsed.Host == "" {
+		return fmt.Errorf("invalid webhook URL %q: use an http or https URL", webhookURL)
+	}
+	return nil
+}
+
+// handleSubmitBisect validates a bisection before listing its commits
+func (bc *BuildCoordinator) handleSubmitBisect(w http.ResponseWriter, r *http.Request) {
+	var request BisectRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	request.Build = request.Build.withoutReplay()
+	request.Build.Ref = request.Bad
+	if bc.rejectWhileDraining(w) {
+		return
+	}
+
+	switch {
+	case request.Build.RepoURL == "":
+		http.Error(w, "bisection requires repo_url", http.StatusBadRequest)
+		return
+	case request.Good == "" || request.Bad == "":
+		http.Error(w, "bisection requires good and bad refs", http.StatusBadRequest)
+		return
+	case request.Build.Matrix != nil || request.Build.Sharding != nil || request.Build.Shard != nil:
+		http.Error(w, "bisection builds cannot be matrix or sharded builds", http.StatusBadRequest)
+		return
+	}
+	if err := gitsource.ValidateRef(request.Good); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := bc.validateBuildRequest(&request.Build); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if request.Build.GradleVersion != "" && !gradledist.ValidVersion(request.Build.GradleVersion) {
+		http.Error(w, fmt.Sprintf("invalid gradle version %q", request.Build.GradleVersion), http.StatusBadRequest)
+		return
+	}
+	if request.WebhookURL != "" {
+		if err := validateWebhookURL(request.WebhookURL); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if !bc.authorize(w, r, authz.ActionBuildSubmit, buildResource(request.Build)) {
+		return
+	}
+
+	request.Build.Tenant = bc.rateLimiter.Tenant(r)
+	request.Build.CorrelationID = middleware.RequestIDFromContext(r.Context())
+	bisectID := bc.SubmitBisect(request)
+	bc.auditLog.RecordRequest(r, audit.ActionBuildSubmitted, bisectID, map[string]string{
+		"repo_url":     request.Build.RepoURL,
+		"project_path": request.Build.ProjectPath,
+		"tenant":       request.Build.Tenant,
+		"good":         request.Good,
+		"bad":          request.Bad,
+	})
+
+	status, err := bc.GetBisect(bisectID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+func (bc *BuildCoordinator) handleGetBisect(w http.ResponseWriter, r *http.Request) {
+	status, err := bc.GetBisect(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
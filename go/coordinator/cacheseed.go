@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"distributed-gradle-building/audit"
+	"distributed-gradle-building/gitsource"
+	"distributed-gradle-building/ml/service"
+)
+
+// BuildTypeCacheSeed is the type of the builds the coordinator queues
+// off-peak to warm the caches of each worker pool. They run in the pool
+// they were queued for, whatever the routing rules.
+const BuildTypeCacheSeed = "cache-seed"
+
+// cacheSeedInterval is how often the coordinator checks whether caches are
+// due to be seeded
+const cacheSeedInterval = 5 * time.Minute
+
+// cacheSeedCooldown keeps the caches from being seeded more than once per
+// quiet stretch
+const cacheSeedCooldown = 12 * time.Hour
+
+// CacheSeedBuild is a build of a repository's main branch that warms the
+// caches for the builds of the working day
+type CacheSeedBuild struct {
+	RepoURL string `json:"repo_url"`
+	// Ref defaults to the default branch of the repository
+	Ref         string `json:"ref,omitempty"`
+	ProjectPath string `json:"project_path,omitempty"`
+	TaskName    string `json:"task_name"`
+	// Credentials names the build secret authenticating the checkout
+	Credentials string `json:"credentials,omitempty"`
+}
+
+// CacheSeedConfig configures cache seeding: Builds are queued in each pool
+// during the last off-peak hour before the load rises, as learned by the ML
+// service. An hour is off-peak when its expected load is at most MaxLoad
+// times that of the busiest hour of the week. No Builds disable seeding.
+type CacheSeedConfig struct {
+	Builds  []CacheSeedBuild `json:"builds"`
+	MaxLoad float64          `json:"max_load"`
+}
+
+// defaultCacheSeedConfig seeds nothing, treating hours with at most a
+// quarter of the peak load as off-peak once builds are configured
+func defaultCacheSeedConfig() CacheSeedConfig {
+	return CacheSeedConfig{MaxLoad: 0.25}
+}
+
+// loadCacheSeedConfig loads the builds seeding the caches from the JSON
+// array CACHE_SEED_BUILDS and the off-peak threshold from
+// CACHE_SEED_MAX_LOAD
+func loadCacheSeedConfig() (CacheSeedConfig, error) {
+	config := defaultCacheSeedConfig()
+
+	if value := os.Getenv("CACHE_SEED_BUILDS"); value != "" {
+		if err := json.Unmarshal([]byte(value), &config.Builds); err != nil {
+			return config, fmt.Errorf("failed to parse CACHE_SEED_BUILDS: %v", err)
+		}
+	}
+	for _, build := range config.Builds {
+		if build.RepoURL == "" || build.TaskName == "" {
+			return config, fmt.Errorf("cache seed builds require repo_url and task_name")
+		}
+		if err := gitsource.ValidateSource(build.RepoURL, build.Ref); err != nil {
+			return config, err
+		}
+	}
+	if value := os.Getenv("CACHE_SEED_MAX_LOAD"); value != "" {
+		if load, err := strconv.ParseFloat(value, 64); err != nil || load <= 0 || load > 1 {
+			log.Printf("Ignoring invalid CACHE_SEED_MAX_LOAD %q: must be above 0 and at most 1", value)
+		} else {
+			config.MaxLoad = load
+		}
+	}
+
+	return config, nil
+}
+
+// Enabled reports whether any builds seed the caches
+func (c CacheSeedConfig) Enabled() bool {
+	return len(c.Builds) > 0
+}
+
+// due reports whether now is the last off-peak hour before the load rises,
+// by the expected load of each hour of the week. Hours without a pattern
+// saw no builds. Nothing is due before the patterns were trained.
+func (c CacheSeedConfig) due(patterns []service.ScalingPattern, now time.Time) bool {
+	loads := make(map[[2]int]float64, len(patterns))
+	peak := 0.0
+	for _, pattern := range patterns {
+		loads[[2]int{pattern.HourOfDay, pattern.DayOfWeek}] = pattern.ExpectedLoad
+		peak = max(peak, pattern.ExpectedLoad)
+	}
+	if peak == 0 {
+		return false
+	}
+
+	offPeak := func(t time.Time) bool {
+		return loads[[2]int{t.Hour(), int(t.Weekday())}] <= c.MaxLoad*peak
+	}
+	return offPeak(now) && !offPeak(now.Add(time.Hour))
+}
+
+// runCacheSeeds seeds the caches when they are due until the coordinator
+// shuts down
+func (bc *BuildCoordinator) runCacheSeeds() {
+	if !bc.cacheSeed.Enabled() {
+		return
+	}
+
+	ticker := time.NewTicker(cacheSeedInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			bc.seedCaches(now)
+		case <-bc.shutdown:
+			return
+		}
+	}
+}
+
+// seedCaches queues the cache seed builds in each idle pool if they are due
+func (bc *BuildCoordinator) seedCaches(now time.Time) {
+	patterns, err := bc.ml.ScalingPatterns(context.Background())
+	if err != nil {
+		log.Printf("Failed to read the scaling patterns to seed caches: %v", err)
+		return
+	}
+	if !bc.cacheSeed.due(patterns, now) {
+		return
+	}
+
+	bc.mutex.Lock()
+	if now.Sub(bc.lastCacheSeed) < cacheSeedCooldown {
+		bc.mutex.Unlock()
+		return
+	}
+	bc.lastCacheSeed = now
+	var idle []string
+	for _, pool := range bc.router.Pools() {
+		if bc.poolIdle(pool) {
+			idle = append(idle, pool)
+		}
+	}
+	bc.mutex.Unlock()
+
+	for _, pool := range idle {
+		for _, build := range bc.cacheSeed.Builds {
+			request, err := bc.cacheSeedRequest(build, pool)
+			if err != nil {
+				log.Printf("Skipping cache seed build of %s: %v", build.RepoURL, err)
+				continue
+			}
+			buildID, err := bc.SubmitBuild(request)
+			if err != nil {
+				log.Printf("Failed to queue the cache seed build of %s in pool %s: %v", build.RepoURL, pool, err)
+				continue
+			}
+			log.Printf("Seeding the caches of pool %s with build %s of %s", pool, buildID, build.RepoURL)
+			bc.recordEvent(audit.Event{
+				Action:    audit.ActionBuildSubmitted,
+				Principal: "scheduler",
+				Resource:  buildID,
+				Details:   map[string]string{"type": BuildTypeCacheSeed, "pool": pool, "repo_url": build.RepoURL, "task_name": build.TaskName},
+			})
+		}
+	}
+}
+
+// cacheSeedRequest returns the request of a cache seed build in a pool. It
+// always runs rather than reusing a cached result, so the workers' local
+// caches are warmed too.
+func (bc *BuildCoordinator) cacheSeedRequest(build CacheSeedBuild, pool string) (BuildRequest, error) {
+	request := BuildRequest{
+		RepoURL:      build.RepoURL,
+		Ref:          build.Ref,
+		ProjectPath:  build.ProjectPath,
+		TaskName:     build.TaskName,
+		Credentials:  build.Credentials,
+		CacheEnabled: true,
+	}
+	if err := bc.validateBuildRequest(&request); err != nil {
+		return BuildRequest{}, err
+	}
+	request.Type = BuildTypeCacheSeed
+	request.Pool = pool
+	request.Force = true
+	return request, nil
+}
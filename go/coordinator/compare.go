@@ -0,0 +1,319 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"distributed-gradle-building/buildstore"
+	"distributed-gradle-building/testshard"
+	"distributed-gradle-building/types"
+)
+
+// taskFromCache is the outcome Gradle prints for tasks whose outputs were
+// taken from the build cache
+const taskFromCache = "FROM-CACHE"
+
+// errBuildNotFound is returned for comparisons of builds neither running
+// nor in the build store
+var errBuildNotFound = errors.New("build not found")
+
+// ComparedBuild summarizes one of the builds of a comparison
+type ComparedBuild struct {
+	BuildID      string        `json:"build_id"`
+	Status       string        `json:"status"`
+	WorkerID     string        `json:"worker_id,omitempty"`
+	Ref          string        `json:"ref,omitempty"`
+	Duration     time.Duration `json:"duration"`
+	CacheHitRate float64       `json:"cache_hit_rate"`
+	TestResults  *TestResults  `json:"test_results,omitempty"`
+}
+
+// TaskDiff is the change in a Gradle task from build A to build B. Change
+// is the duration in B less the duration in A; a task only one of the
+// builds ran counts as taking no time in the other.
+type TaskDiff struct {
+	Name      string        `json:"name"`
+	DurationA time.Duration `json:"duration_a"`
+	DurationB time.Duration `json:"duration_b"`
+	Change    time.Duration `json:"change"`
+	OutcomeA  string        `json:"outcome_a,omitempty"`
+	OutcomeB  string        `json:"outcome_b,omitempty"`
+	Added     bool          `json:"added,omitempty"`
+	Removed   bool          `json:"removed,omitempty"`
+}
+
+// TestCaseRef names a test case by its class
+type TestCaseRef struct {
+	Class string `json:"class"`
+	Name  string `json:"name"`
+}
+
+// ArtifactDiff is the change in the size of an artifact from build A to
+// build B, and Changed whether its content differs at all. Artifacts are
+// matched by their path from the directory of the project that built them,
+// as builds of different checkouts do not share their absolute paths.
+type ArtifactDiff struct {
+	Path    string `json:"path"`
+	SizeA   int64  `json:"size_a"`
+	SizeB   int64  `json:"size_b"`
+	Change  int64  `json:"change"`
+	Added   bool   `json:"added,omitempty"`
+	Removed bool   `json:"removed,omitempty"`
+	Changed bool   `json:"changed"`
+}
+
+// BuildComparison is the difference from build A to build B. Tasks are in
+// order of the largest change in duration first, so the tasks that made B
+// slower or faster lead.
+type BuildComparison struct {
+	A               ComparedBuild  `json:"a"`
+	B               ComparedBuild  `json:"b"`
+	DurationChange  time.Duration  `json:"duration_change"`
+	Tasks           []TaskDiff     `json:"tasks"`
+	CacheHitsGained []string       `json:"cache_hits_gained"`
+	CacheHitsLost   []string       `json:"cache_hits_lost"`
+	NewTestFailures []TestCaseRef  `json:"new_test_failures"`
+	FixedTests      []TestCaseRef  `json:"fixed_tests"`
+	Artifacts       []ArtifactDiff `json:"artifacts"`
+}
+
+// buildSnapshot is what a comparison knows of a build: the build store
+// record of a finished build, and its results while the coordinator still
+// has them
+type buildSnapshot struct {
+	summary   ComparedBuild
+	tasks     []buildstore.TaskTiming
+	classes   []testshard.ClassResult
+	artifacts []types.Artifact
+}
+
+// snapshot collects what is known of a build, live or stored
+func (bc *BuildCoordinator) snapshot(buildID string) (buildSnapshot, error) {
+	bc.mutex.RLock()
+	response, live := bc.builds[buildID]
+	var snapshot buildSnapshot
+	if live {
+		snapshot.summary = ComparedBuild{
+			BuildID:      buildID,
+			WorkerID:     response.WorkerID,
+			Ref:          bc.requests[buildID].Ref,
+			Duration:     response.BuildDuration,
+			CacheHitRate: response.Metrics.CacheHitRate,
+		}
+		if progress, exists := bc.progress[buildID]; exists {
+			snapshot.summary.Status = progress.Status
+		}
+		if response.TestClasses != nil {
+			results := response.Metrics.TestResults
+			snapshot.summary.TestResults = &results
+		}
+		snapshot.classes = response.TestClasses
+		snapshot.artifacts = response.ArtifactDetails
+		if timer, exists := bc.timers[buildID]; exists {
+			snapshot.tasks = slices.Clone(timer.tasks)
+		}
+	}
+	projectPath := bc.requests[buildID].ProjectPath
+	bc.mutex.RUnlock()
+
+	if live && snapshot.tasks != nil {
+		return snapshot, nil
+	}
+	records, err := bc.buildStore.Query(buildstore.Filter{ProjectPath: projectPath})
+	if err != nil {
+		return buildSnapshot{}, err
+	}
+	for _, record := range records {
+		if record.BuildID != buildID {
+			continue
+		}
+		snapshot.tasks = record.Tasks
+		if !live {
+			snapshot.summary = ComparedBuild{
+				BuildID:      buildID,
+				Status:       record.Status,
+				WorkerID:     record.WorkerID,
+				Ref:          record.Ref,
+				Duration:     record.Duration,
+				CacheHitRate: record.CacheHitRate,
+			}
+		}
+		return snapshot, nil
+	}
+	if !live {
+		return buildSnapshot{}, fmt.Errorf("%w: %s", errBuildNotFound, buildID)
+	}
+	return snapshot, nil
+}
+
+// CompareBuilds returns the difference from build a to build b
+func (bc *BuildCoordinator) CompareBuilds(a, b string) (*BuildComparison, error) {
+	snapshotA, err := bc.snapshot(a)
+	if err != nil {
+		return nil, err
+	}
+	snapshotB, err := bc.snapshot(b)
+	if err != nil {
+		return nil, err
+	}
+	return compareBuilds(snapshotA, snapshotB), nil
+}
+
+// compareBuilds diffs the snapshots of two builds
+func compareBuilds(a, b buildSnapshot) *BuildComparison {
+	comparison := &BuildComparison{
+		A:               a.summary,
+		B:               b.summary,
+		DurationChange:  b.summary.Duration - a.summary.Duration,
+		Tasks:           []TaskDiff{},
+		CacheHitsGained: []string{},
+		CacheHitsLost:   []string{},
+		NewTestFailures: []TestCaseRef{},
+		FixedTests:      []TestCaseRef{},
+		Artifacts:       []ArtifactDiff{},
+	}
+	comparison.compareTasks(a.tasks, b.tasks)
+	comparison.compareTests(a.classes, b.classes)
+	comparison.compareArtifacts(a.artifacts, b.artifacts)
+	return comparison
+}
+
+func (c *BuildComparison) compareTasks(a, b []buildstore.TaskTiming) {
+	byName := make(map[string]int)
+	for _, task := range a {
+		byName[task.Name] = len(c.Tasks)
+		c.Tasks = append(c.Tasks, TaskDiff{Name: task.Name, DurationA: task.Duration, OutcomeA: task.Outcome, Removed: true})
+	}
+	for _, task := range b {
+		i, exists := byName[task.Name]
+		if !exists {
+			c.Tasks = append(c.Tasks, TaskDiff{Name: task.Name, DurationB: task.Duration, OutcomeB: task.Outcome, Added: true})
+			continue
+		}
+		diff := &c.Tasks[i]
+		diff.DurationB, diff.OutcomeB, diff.Removed = task.Duration, task.Outcome, false
+		switch {
+		case diff.OutcomeA != taskFromCache && diff.OutcomeB == taskFromCache:
+			c.CacheHitsGained = append(c.CacheHitsGained, task.Name)
+		case diff.OutcomeA == taskFromCache && diff.OutcomeB != taskFromCache:
+			c.CacheHitsLost = append(c.CacheHitsLost, task.Name)
+		}
+	}
+
+	for i := range c.Tasks {
+		c.Tasks[i].Change = c.Tasks[i].DurationB - c.Tasks[i].DurationA
+	}
+	slices.SortStableFunc(c.Tasks, func(x, y TaskDiff) int {
+		return cmp.Compare(y.Change.Abs(), x.Change.Abs())
+	})
+	slices.Sort(c.CacheHitsGained)
+	slices.Sort(c.CacheHitsLost)
+}
+
+// caseOutcomes returns whether each test case of classes failed. A case run
+// more than once in a build, such as by retries, failed only if none of its
+// runs passed, like the build it failed.
+func caseOutcomes(classes []testshard.ClassResult) map[TestCaseRef]bool {
+	failed := make(map[TestCaseRef]bool)
+	for _, class := range classes {
+		for _, c := range class.Cases {
+			ref := TestCaseRef{Class: class.Name, Name: c.Name}
+			switch c.Outcome {
+			case testshard.CasePassed:
+				failed[ref] = false
+			case testshard.CaseFailed:
+				if _, seen := failed[ref]; !seen {
+					failed[ref] = true
+				}
+			}
+		}
+	}
+	return failed
+}
+
+func (c *BuildComparison) compareTests(a, b []testshard.ClassResult) {
+	before, after := caseOutcomes(a), caseOutcomes(b)
+	for ref, failed := range after {
+		if failed && !before[ref] {
+			c.NewTestFailures = append(c.NewTestFailures, ref)
+		}
+	}
+	for ref, failed := range before {
+		if failedNow, ran := after[ref]; failed && ran && !failedNow {
+			c.FixedTests = append(c.FixedTests, ref)
+		}
+	}
+
+	order := func(x, y TestCaseRef) int {
+		return cmp.Or(strings.Compare(x.Class, y.Class), strings.Compare(x.Name, y.Name))
+	}
+	slices.SortFunc(c.NewTestFailures, order)
+	slices.SortFunc(c.FixedTests, order)
+}
+
+// artifactPath returns the path of an artifact from the directory of the
+// project that built it: the directory holding its build directory
+func artifactPath(artifact types.Artifact) string {
+	slashed := strings.ReplaceAll(artifact.Path, "\\", "/")
+	i := strings.LastIndex(slashed, "/build/")
+	if i < 0 {
+		return path.Base(slashed)
+	}
+	return path.Join(path.Base(slashed[:i]), slashed[i+1:])
+}
+
+func (c *BuildComparison) compareArtifacts(a, b []types.Artifact) {
+	byPath := make(map[string]int)
+	hashes := make(map[string]string, len(a))
+	for _, artifact := range a {
+		name := artifactPath(artifact)
+		byPath[name] = len(c.Artifacts)
+		hashes[name] = artifact.SHA256
+		c.Artifacts = append(c.Artifacts, ArtifactDiff{Path: name, SizeA: artifact.Size, Removed: true, Changed: true})
+	}
+	for _, artifact := range b {
+		name := artifactPath(artifact)
+		i, exists := byPath[name]
+		if !exists {
+			c.Artifacts = append(c.Artifacts, ArtifactDiff{Path: name, SizeB: artifact.Size, Added: true, Changed: true})
+			continue
+		}
+		diff := &c.Artifacts[i]
+		diff.SizeB, diff.Removed = artifact.Size, false
+		diff.Changed = hashes[name] != artifact.SHA256
+	}
+
+	for i := range c.Artifacts {
+		c.Artifacts[i].Change = c.Artifacts[i].SizeB - c.Artifacts[i].SizeA
+	}
+	slices.SortFunc(c.Artifacts, func(x, y ArtifactDiff) int { return strings.Compare(x.Path, y.Path) })
+}
+
+// handleCompareBuilds diffs build b against build a
+func (bc *BuildCoordinator) handleCompareBuilds(w http.ResponseWriter, r *http.Request) {
+	a, b := r.URL.Query().Get("a"), r.URL.Query().Get("b")
+	if a == "" || b == "" {
+		http.Error(w, "the builds to compare are required as a and b", http.StatusBadRequest)
+		return
+	}
+
+	comparison, err := bc.CompareBuilds(a, b)
+	if errors.Is(err, errBuildNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(comparison)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"distributed-gradle-building/usage"
+)
+
+// ConcurrencyConfig limits how many builds of a project run at once, so
+// builds of the same project do not thrash each other's caches and git
+// mirrors. Limits holds the limit of projects by their repository URL, or by
+// project path for builds of a path on the workers; Default is the limit of
+// other projects. A limit of 0 is unlimited.
+type ConcurrencyConfig struct {
+	Limits  map[string]int `json:"limits,omitempty"`
+	Default int            `json:"default"`
+}
+
+// defaultConcurrencyConfig runs any number of builds of a project at once
+func defaultConcurrencyConfig() ConcurrencyConfig {
+	return ConcurrencyConfig{}
+}
+
+// loadConcurrencyConfig loads the project concurrency limits from
+// PROJECT_CONCURRENCY_LIMITS, a JSON object of limits by project, and the
+// limit of other projects from PROJECT_CONCURRENCY_DEFAULT_LIMIT
+func loadConcurrencyConfig() ConcurrencyConfig {
+	config := defaultConcurrencyConfig()
+
+	if value := os.Getenv("PROJECT_CONCURRENCY_LIMITS"); value != "" {
+		var limits map[string]int
+		if err := json.Unmarshal([]byte(value), &limits); err != nil {
+			log.Printf("Ignoring invalid PROJECT_CONCURRENCY_LIMITS: %v", err)
+		} else {
+			config.Limits = limits
+		}
+	}
+	if value, err := strconv.Atoi(os.Getenv("PROJECT_CONCURRENCY_DEFAULT_LIMIT")); err == nil && value >= 0 {
+		config.Default = value
+	}
+
+	return config
+}
+
+// limit returns the concurrency limit of a project, 0 if it is unlimited
+func (c ConcurrencyConfig) limit(project string) int {
+	if limit, exists := c.Limits[project]; exists {
+		return max(limit, 0)
+	}
+	return c.Default
+}
+
+// buildProject returns the project a build counts against: its repository
+// for checkouts and its project path otherwise
+func buildProject(request BuildRequest) string {
+	return usage.Project(request.ProjectPath, request.RepoURL)
+}
+
+// atConcurrencyLimit reports whether a build's project already runs as many
+// builds as its limit allows
+func (bc *BuildCoordinator) atConcurrencyLimit(request BuildRequest, running map[string]int) bool {
+	project := buildProject(request)
+	limit := bc.concurrency.limit(project)
+	return limit > 0 && running[project] >= limit
+}
+
+// runningBuildsByProject counts the running builds of each project across
+// all pools. Must be called with the mutex held.
+func (bc *BuildCoordinator) runningBuildsByProject() map[string]int {
+	running := make(map[string]int)
+	for id, progress := range bc.progress {
+		if _, forwarded := bc.forwarded[id]; forwarded {
+			continue
+		}
+		if progress.Status == BuildStatusRunning {
+			running[buildProject(bc.requests[id])]++
+		}
+	}
+	return running
+}
+
+// markThrottled shows which pending builds wait for a build of their project
+// to finish. Paused builds keep the reason they were paused for.
+func (bc *BuildCoordinator) markThrottled(requests map[string]BuildRequest, running map[string]int) {
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+
+	for id, request := range requests {
+		progress, exists := bc.progress[id]
+		if !exists || progress.Status != BuildStatusQueued || progress.Paused {
+			continue
+		}
+		throttled := bc.atConcurrencyLimit(request, running)
+		if throttled == progress.Throttled {
+			continue
+		}
+
+		progress.Throttled = throttled
+		progress.Message = ""
+		if throttled {
+			project := buildProject(request)
+			progress.Message = fmt.Sprintf("waiting for a build of %s to finish, %d may run at once", project, bc.concurrency.limit(project))
+		}
+		progress.UpdatedAt = time.Now()
+		bc.notifyProgress(id)
+	}
+}
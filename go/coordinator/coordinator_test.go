@@ -1,10 +1,72 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/rpc"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	"distributed-gradle-building/analytics"
+	"distributed-gradle-building/apikeys"
+	"distributed-gradle-building/attestation"
+	"distributed-gradle-building/audit"
+	"distributed-gradle-building/auth"
+	"distributed-gradle-building/authz"
+	"distributed-gradle-building/buildenv"
+	"distributed-gradle-building/buildstore"
+	"distributed-gradle-building/calibration"
+	"distributed-gradle-building/chaos"
+	"distributed-gradle-building/devices"
+	"distributed-gradle-building/events"
+	"distributed-gradle-building/fairshare"
+	"distributed-gradle-building/federation"
+	"distributed-gradle-building/gitsource"
+	"distributed-gradle-building/hooks"
+	"distributed-gradle-building/httprpc"
+	"distributed-gradle-building/metrics"
+	"distributed-gradle-building/middleware"
+	"distributed-gradle-building/ml/mlrpc"
+	"distributed-gradle-building/ml/service"
+	"distributed-gradle-building/oidc"
+	"distributed-gradle-building/pools"
+	"distributed-gradle-building/projectarchive"
+	"distributed-gradle-building/protocol"
+	"distributed-gradle-building/provenance"
+	"distributed-gradle-building/ratelimit"
+	"distributed-gradle-building/registry"
+	"distributed-gradle-building/retention"
+	"distributed-gradle-building/scmstatus"
+	"distributed-gradle-building/secrets"
+	"distributed-gradle-building/signing"
+	"distributed-gradle-building/testshard"
+	"distributed-gradle-building/transfer"
+	"distributed-gradle-building/types"
+	"distributed-gradle-building/usage"
+	"distributed-gradle-building/validation"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 )
 
 func TestNewBuildCoordinator(t *testing.T) {
@@ -122,12 +184,13 @@ func TestHandleBuildRequestHTTP(t *testing.T) {
 
 func TestHandleGetBuildHTTP(t *testing.T) {
 	coordinator := NewBuildCoordinator(5)
+	handler := coordinator.routes(nil)
 
 	// Test non-existent build
 	req := httptest.NewRequest("GET", "/api/builds/non-existent", nil)
 	w := httptest.NewRecorder()
 
-	coordinator.handleGetBuild(w, req)
+	handler.ServeHTTP(w, req)
 
 	if w.Code != http.StatusNotFound {
 		t.Errorf("Expected status 404 for non-existent build, got %d", w.Code)
@@ -144,7 +207,7 @@ func TestHandleGetBuildHTTP(t *testing.T) {
 	req = httptest.NewRequest("GET", "/api/builds/test-request-1", nil)
 	w = httptest.NewRecorder()
 
-	coordinator.handleGetBuild(w, req)
+	handler.ServeHTTP(w, req)
 
 	if w.Code != http.StatusOK {
 		t.Errorf("Expected status 200 for existing build, got %d", w.Code)
@@ -302,7 +365,7 @@ func TestMarkBuildFailed(t *testing.T) {
 	coordinator.builds["test-request-1"] = response
 
 	// Mark build as failed
-	coordinator.markBuildFailed("test-request-1", "build failed with error")
+	coordinator.markBuildFailed("test-request-1", protocol.ErrorCompile, "build failed with error")
 
 	// Check if build was marked as failed with error message
 	updatedResponse, exists := coordinator.builds["test-request-1"]
@@ -335,3 +398,4886 @@ func TestTestRPCMethod(t *testing.T) {
 		t.Errorf("Expected reply %s, got %s", expectedReply, reply)
 	}
 }
+
+func TestCancelQueuedBuild(t *testing.T) {
+	coordinator := NewBuildCoordinator(5)
+
+	buildID, err := coordinator.SubmitBuild(BuildRequest{ProjectPath: "/test/project", TaskName: "build"})
+	if err != nil {
+		t.Fatalf("Failed to submit build: %v", err)
+	}
+
+	var reply CancelBuildReply
+	if err := coordinator.CancelBuild(&CancelBuildArgs{BuildID: buildID, Reason: "superseded"}, &reply); err != nil {
+		t.Fatalf("CancelBuild failed: %v", err)
+	}
+
+	progress, err := coordinator.GetBuildProgress(buildID)
+	if err != nil {
+		t.Fatalf("GetBuildProgress failed: %v", err)
+	}
+	if progress.Status != BuildStatusCancelled {
+		t.Errorf("Expected status %s, got %s", BuildStatusCancelled, progress.Status)
+	}
+
+	// Cancelling twice is rejected
+	if err := coordinator.CancelBuild(&CancelBuildArgs{BuildID: buildID}, &reply); err == nil {
+		t.Error("Expected error when cancelling an already cancelled build")
+	}
+
+	// A failure after cancellation keeps the cancelled status
+	coordinator.markBuildFailed(buildID, protocol.ErrorInfra, "worker connection lost")
+	progress, _ = coordinator.GetBuildProgress(buildID)
+	if progress.Status != BuildStatusCancelled {
+		t.Errorf("Expected status to remain %s, got %s", BuildStatusCancelled, progress.Status)
+	}
+
+	if err := coordinator.CancelBuild(&CancelBuildArgs{BuildID: "non-existent"}, &reply); err == nil {
+		t.Error("Expected error when cancelling a non-existent build")
+	}
+}
+
+func TestPauseQueuedBuild(t *testing.T) {
+	coordinator := NewBuildCoordinator(5)
+	handler := coordinator.routes(nil)
+	post := func(path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("POST", path, strings.NewReader(body)))
+		return w
+	}
+
+	pending := fairshare.NewQueue(coordinator.weights)
+	requests := make(map[string]BuildRequest)
+	var buildIDs []string
+	for i := 0; i < 2; i++ {
+		buildID, err := coordinator.SubmitBuild(BuildRequest{ProjectPath: "/test/project", TaskName: "build"})
+		if err != nil {
+			t.Fatalf("Failed to submit build: %v", err)
+		}
+		request := <-coordinator.buildQueue
+		pending.Push(request.Tenant, request.RequestID)
+		requests[request.RequestID] = request
+		buildIDs = append(buildIDs, buildID)
+	}
+	paused, other := buildIDs[0], buildIDs[1]
+
+	w := post("/api/builds/"+paused+"/pause", `{"reason":"artifact repository down"}`)
+	var progress BuildProgress
+	if err := json.NewDecoder(w.Body).Decode(&progress); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("Expected the build to be paused, got %d: %v", w.Code, err)
+	}
+	if !progress.Paused || progress.Status != BuildStatusQueued || progress.Message != "artifact repository down" {
+		t.Errorf("Expected a paused queued build, got %+v", progress)
+	}
+
+	// The paused build keeps its place while the next one is scheduled
+	coordinator.workers["worker-1"] = &Worker{ID: "worker-1", Host: "127.0.0.1", Port: 1, Status: "idle", MaxBuilds: 2, LastPing: time.Now()}
+	coordinator.dispatchBuilds(pools.DefaultPool, pending, requests)
+	if _, waiting := requests[paused]; !waiting || pending.Len() != 1 {
+		t.Fatalf("Expected only the paused build to wait, got %d pending", pending.Len())
+	}
+	if _, waiting := requests[other]; waiting {
+		t.Error("Expected the other build to be scheduled")
+	}
+
+	if w := post("/api/builds/"+other+"/pause", ""); w.Code != http.StatusConflict {
+		t.Errorf("Expected status %d for a build that left the queue, got %d", http.StatusConflict, w.Code)
+	}
+	if w := post("/api/builds/non-existent/pause", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d for an unknown build, got %d", http.StatusNotFound, w.Code)
+	}
+
+	if w := post("/api/builds/"+paused+"/resume", ""); w.Code != http.StatusOK {
+		t.Fatalf("Expected the build to be resumed, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := post("/api/builds/"+paused+"/resume", ""); w.Code != http.StatusConflict {
+		t.Errorf("Expected status %d when resuming a running build, got %d", http.StatusConflict, w.Code)
+	}
+	for _, action := range []string{audit.ActionBuildPaused, audit.ActionBuildResumed} {
+		if events, _ := coordinator.auditLog.Query(audit.Filter{Action: action, Resource: paused}); len(events) != 1 {
+			t.Errorf("Expected the build to be audited as %s once, got %+v", action, events)
+		}
+	}
+
+	coordinator.dispatchBuilds(pools.DefaultPool, pending, requests)
+	if pending.Len() != 0 {
+		t.Errorf("Expected the resumed build to be scheduled, got %d pending", pending.Len())
+	}
+}
+
+func TestProjectConcurrencyLimit(t *testing.T) {
+	coordinator := NewBuildCoordinator(5)
+	coordinator.concurrency = ConcurrencyConfig{Limits: map[string]int{"/projects/app": 1}}
+	coordinator.workers["worker-1"] = &Worker{ID: "worker-1", Host: "127.0.0.1", Port: 1, Status: "idle", MaxBuilds: 4, LastPing: time.Now()}
+
+	pending := fairshare.NewQueue(coordinator.weights)
+	requests := make(map[string]BuildRequest)
+	var buildIDs []string
+	for _, project := range []string{"/projects/app", "/projects/app", "/projects/lib"} {
+		buildID, err := coordinator.SubmitBuild(BuildRequest{ProjectPath: project, TaskName: "build"})
+		if err != nil {
+			t.Fatalf("Failed to submit build: %v", err)
+		}
+		request := <-coordinator.buildQueue
+		pending.Push(request.Tenant, request.RequestID)
+		requests[request.RequestID] = request
+		buildIDs = append(buildIDs, buildID)
+	}
+	first, second, other := buildIDs[0], buildIDs[1], buildIDs[2]
+
+	// The second build of the project waits while the other project runs
+	coordinator.dispatchBuilds(pools.DefaultPool, pending, requests)
+	if _, waiting := requests[second]; !waiting || pending.Len() != 1 {
+		t.Fatalf("Expected only the second build of the project to wait, got %d pending", pending.Len())
+	}
+	if _, waiting := requests[other]; waiting {
+		t.Error("Expected the build of the other project to be scheduled")
+	}
+
+	builds := coordinator.ListBuilds(0, nil)
+	index := slices.IndexFunc(builds, func(build BuildSummary) bool { return build.BuildID == second })
+	if index < 0 || !builds[index].Throttled || !strings.Contains(builds[index].Message, "/projects/app") {
+		t.Errorf("Expected the waiting build to be listed as throttled, got %+v", builds)
+	}
+
+	// Once the first build finished, the waiting one is scheduled
+	coordinator.mutex.Lock()
+	coordinator.progress[first].Status = BuildStatusCompleted
+	coordinator.mutex.Unlock()
+	coordinator.dispatchBuilds(pools.DefaultPool, pending, requests)
+	if pending.Len() != 0 {
+		t.Fatalf("Expected the waiting build to be scheduled, got %d pending", pending.Len())
+	}
+	if progress, _ := coordinator.GetBuildProgress(second); progress.Throttled || progress.Message != "" {
+		t.Errorf("Expected the scheduled build not to be throttled, got %+v", progress)
+	}
+}
+
+func TestLoadConcurrencyConfig(t *testing.T) {
+	if config := loadConcurrencyConfig(); config.limit("/projects/app") != 0 {
+		t.Errorf("Expected projects to be unlimited by default, got %+v", config)
+	}
+	t.Setenv("PROJECT_CONCURRENCY_LIMITS", `{"https://git.example.com/app.git": 2, "/projects/lib": 0}`)
+	t.Setenv("PROJECT_CONCURRENCY_DEFAULT_LIMIT", "5")
+	config := loadConcurrencyConfig()
+	if config.limit("https://git.example.com/app.git") != 2 || config.limit("/projects/lib") != 0 || config.limit("/projects/api") != 5 {
+		t.Errorf("Unexpected concurrency configuration %+v", config)
+	}
+
+	t.Setenv("PROJECT_CONCURRENCY_LIMITS", "not json")
+	if config := loadConcurrencyConfig(); config.Limits != nil {
+		t.Errorf("Expected invalid limits to be ignored, got %+v", config)
+	}
+}
+
+func TestReplayBuild(t *testing.T) {
+	coordinator := NewBuildCoordinator(5)
+	handler := coordinator.routes(nil)
+	post := func(path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("POST", path, strings.NewReader(body)))
+		return w
+	}
+
+	// Environments and pinned workers cannot be submitted by clients
+	w := post("/api/build", `{"project_path":"/test/project","task_name":"build","environment":{"worker_id":"worker-9"},"pinned_worker_id":"worker-9"}`)
+	var submitted SubmitBuildResponse
+	if err := json.NewDecoder(w.Body).Decode(&submitted); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	original := <-coordinator.buildQueue
+	if original.Environment != nil || original.PinnedWorkerID != "" {
+		t.Errorf("Expected the submitted environment to be ignored, got %+v", original)
+	}
+
+	if w := post("/api/builds/"+submitted.BuildID+"/replay", ""); w.Code != http.StatusConflict {
+		t.Errorf("Expected status %d for a build without an environment, got %d", http.StatusConflict, w.Code)
+	}
+	if w := post("/api/builds/non-existent/replay", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d for an unknown build, got %d", http.StatusNotFound, w.Code)
+	}
+
+	environment := &buildenv.Snapshot{
+		WorkerID:      "worker-1",
+		GradleVersion: "8.5",
+		JDKVersion:    "17.0.9",
+		Labels:        map[string]string{buildenv.LabelOS: "linux", buildenv.LabelArch: "amd64"},
+		Env:           map[string]string{"TZ": "UTC"},
+		CacheKeys:     map[string]string{":compileJava": "8e2f3c1a9b"},
+	}
+	var reply ReportProgressReply
+	coordinator.ReportProgress(&ReportProgressArgs{BuildID: submitted.BuildID, WorkerID: "worker-1", Step: "started", Environment: environment}, &reply)
+	if response, _ := coordinator.GetBuildStatus(submitted.BuildID); response.Environment == nil || response.Environment.JDKVersion != "17.0.9" {
+		t.Fatalf("Expected the reported environment to be kept, got %+v", response.Environment)
+	}
+
+	coordinator.workers["worker-2"] = &Worker{ID: "worker-2", Pool: "android", Status: "idle", MaxBuilds: 1, LastPing: time.Now()}
+	if w := post("/api/builds/"+submitted.BuildID+"/replay", `{"worker_id":"worker-2"}`); w.Code != http.StatusConflict {
+		t.Errorf("Expected status %d for a worker of another pool, got %d", http.StatusConflict, w.Code)
+	}
+	if w := post("/api/builds/"+submitted.BuildID+"/replay", `{"worker_id":"worker-9"}`); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d for an unknown worker, got %d", http.StatusNotFound, w.Code)
+	}
+
+	coordinator.workers["worker-3"] = &Worker{ID: "worker-3", Status: "idle", MaxBuilds: 1, LastPing: time.Now()}
+	w = post("/api/builds/"+submitted.BuildID+"/replay", `{"worker_id":"worker-3"}`)
+	var replayed SubmitBuildResponse
+	if err := json.NewDecoder(w.Body).Decode(&replayed); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("Expected the build to be replayed, got %d: %v", w.Code, err)
+	}
+	replay := <-coordinator.buildQueue
+	if replay.RequestID != replayed.BuildID || replay.ReplayOf != submitted.BuildID || replay.PinnedWorkerID != "worker-3" || !replay.Force {
+		t.Errorf("Expected a forced replay pinned to worker-3, got %+v", replay)
+	}
+	if replay.GradleVersion != "8.5" || replay.Environment == nil || replay.Environment.Env["TZ"] != "UTC" || replay.Environment.CacheKeys != nil {
+		t.Errorf("Expected the environment to be pinned without cache keys, got %+v", replay.Environment)
+	}
+	if events, _ := coordinator.auditLog.Query(audit.Filter{Action: audit.ActionBuildSubmitted, Resource: replayed.BuildID}); len(events) != 1 || events[0].Details["replay_of"] != submitted.BuildID {
+		t.Errorf("Expected the replay to be audited, got %+v", events)
+	}
+}
+
+func TestReportProgress(t *testing.T) {
+	coordinator := NewBuildCoordinator(5)
+
+	buildID, _ := coordinator.SubmitBuild(BuildRequest{ProjectPath: "/test/project", TaskName: "build"})
+
+	var reply ReportProgressReply
+	args := &ReportProgressArgs{BuildID: buildID, WorkerID: "worker-1", Progress: 40, Step: ":app:compileJava"}
+	if err := coordinator.ReportProgress(args, &reply); err != nil {
+		t.Fatalf("ReportProgress failed: %v", err)
+	}
+	if reply.Cancelled {
+		t.Error("Expected build not to be cancelled")
+	}
+
+	progress, _ := coordinator.GetBuildProgress(buildID)
+	if progress.Status != BuildStatusRunning || progress.Progress != 40 || progress.Step != ":app:compileJava" {
+		t.Errorf("Unexpected progress %+v", progress)
+	}
+
+	// The command line reported when the build starts is kept
+	started := &ReportProgressArgs{BuildID: buildID, WorkerID: "worker-1", Step: "started", CommandLine: "/test/project/gradlew build --console=plain --offline"}
+	coordinator.ReportProgress(started, &reply)
+	coordinator.ReportProgress(args, &reply)
+	if response, _ := coordinator.GetBuildStatus(buildID); response.CommandLine != started.CommandLine {
+		t.Errorf("Expected the reported command line, got %q", response.CommandLine)
+	}
+
+	// Out of range progress is clamped
+	args.Progress = 150
+	coordinator.ReportProgress(args, &reply)
+	progress, _ = coordinator.GetBuildProgress(buildID)
+	if progress.Progress != 100 {
+		t.Errorf("Expected progress clamped to 100, got %f", progress.Progress)
+	}
+
+	// Workers learn about cancellation through the progress reply
+	coordinator.CancelBuild(&CancelBuildArgs{BuildID: buildID}, &CancelBuildReply{})
+	if err := coordinator.ReportProgress(args, &reply); err != nil {
+		t.Fatalf("ReportProgress failed: %v", err)
+	}
+	if !reply.Cancelled {
+		t.Error("Expected reply to report cancellation")
+	}
+
+	if err := coordinator.ReportProgress(&ReportProgressArgs{BuildID: "non-existent"}, &reply); err == nil {
+		t.Error("Expected error for non-existent build")
+	}
+}
+
+func TestBuildStatusRPC(t *testing.T) {
+	coordinator := NewBuildCoordinator(5)
+	buildID, _ := coordinator.SubmitBuild(BuildRequest{ProjectPath: "/test/project", TaskName: "build"})
+
+	server := rpc.NewServer()
+	if err := server.RegisterName("BuildCoordinator", &CoordinatorRPC{coordinator}); err != nil {
+		t.Fatalf("Failed to register RPC service: %v", err)
+	}
+
+	serverConn, clientConn := net.Pipe()
+	go server.ServeConn(serverConn)
+	client := rpc.NewClient(clientConn)
+	defer client.Close()
+
+	var progressReply ReportProgressReply
+	err := client.Call("BuildCoordinator.ReportProgress",
+		ReportProgressArgs{BuildID: buildID, WorkerID: "worker-1", Progress: 25, Step: ":app:test"}, &progressReply)
+	if err != nil {
+		t.Fatalf("ReportProgress RPC failed: %v", err)
+	}
+
+	var statusReply GetBuildStatusReply
+	if err := client.Call("BuildCoordinator.GetBuildStatus", GetBuildStatusArgs{BuildID: buildID}, &statusReply); err != nil {
+		t.Fatalf("GetBuildStatus RPC failed: %v", err)
+	}
+	if statusReply.Progress.Step != ":app:test" || statusReply.Progress.Progress != 25 {
+		t.Errorf("Unexpected progress %+v", statusReply.Progress)
+	}
+	if statusReply.Response.RequestID != buildID {
+		t.Errorf("Expected response for build %s, got %s", buildID, statusReply.Response.RequestID)
+	}
+
+	var cancelReply CancelBuildReply
+	if err := client.Call("BuildCoordinator.CancelBuild", CancelBuildArgs{BuildID: buildID}, &cancelReply); err != nil {
+		t.Fatalf("CancelBuild RPC failed: %v", err)
+	}
+
+	if err := client.Call("BuildCoordinator.GetBuildStatus", GetBuildStatusArgs{BuildID: "non-existent"}, &statusReply); err == nil {
+		t.Error("Expected error for non-existent build")
+	}
+}
+
+func TestHeartbeatTelemetry(t *testing.T) {
+	coordinator := NewBuildCoordinator(5)
+	coordinator.workers["worker-1"] = &Worker{ID: "worker-1", Status: "busy", LastPing: time.Now()}
+
+	args := &HeartbeatArgs{
+		ID:           "worker-1",
+		Status:       "idle",
+		CPUUsage:     0.35,
+		MemoryUsage:  0.6,
+		DiskUsage:    0.4,
+		LoadAverage:  1.5,
+		ActiveBuilds: 0,
+	}
+
+	var reply HeartbeatReply
+	if err := coordinator.Heartbeat(args, &reply); err != nil {
+		t.Fatalf("Heartbeat failed: %v", err)
+	}
+
+	worker := coordinator.workers["worker-1"]
+	if worker.Status != "idle" {
+		t.Errorf("Expected status idle, got %s", worker.Status)
+	}
+	if worker.Metrics.CPUUsage != 0.35 || worker.Metrics.MemoryUsage != 0.6 || worker.Metrics.LoadAverage != 1.5 {
+		t.Errorf("Telemetry not stored: %+v", worker.Metrics)
+	}
+	if worker.Metrics.LastTelemetry.IsZero() {
+		t.Error("Expected telemetry timestamp to be set")
+	}
+
+	// Workers without telemetry are neither idle nor busy
+	coordinator.workers["worker-2"] = &Worker{ID: "worker-2", Status: "idle", LastPing: time.Now()}
+	if err := coordinator.Heartbeat(&HeartbeatArgs{ID: "worker-2", Status: "idle", ActiveBuilds: 1, TelemetryUnavailable: true}, &reply); err != nil {
+		t.Fatalf("Heartbeat failed: %v", err)
+	}
+	if worker := coordinator.workers["worker-2"]; !worker.Metrics.LastTelemetry.IsZero() || worker.Metrics.ActiveBuilds != 1 || workerLoad(worker) != 0.5 {
+		t.Errorf("Expected the unavailable telemetry to be ignored, got %+v", worker.Metrics)
+	}
+
+	if err := coordinator.Heartbeat(&HeartbeatArgs{ID: "unknown"}, &reply); err == nil {
+		t.Error("Expected error for unknown worker")
+	}
+}
+
+func TestAvailableWorkersOrderedByLoad(t *testing.T) {
+	coordinator := NewBuildCoordinator(5)
+
+	for id, cpu := range map[string]float64{"busy-host": 0.9, "quiet-host": 0.1, "medium-host": 0.5} {
+		coordinator.workers[id] = &Worker{ID: id, Status: "idle", LastPing: time.Now()}
+		coordinator.Heartbeat(&HeartbeatArgs{ID: id, Status: "idle", CPUUsage: cpu, MemoryUsage: cpu}, &HeartbeatReply{})
+	}
+
+	available := coordinator.getAvailableWorkers()
+	if len(available) != 3 {
+		t.Fatalf("Expected 3 available workers, got %d", len(available))
+	}
+
+	expected := []string{"quiet-host", "medium-host", "busy-host"}
+	for i, id := range expected {
+		if available[i].ID != id {
+			t.Errorf("Expected worker %s at position %d, got %s", id, i, available[i].ID)
+		}
+	}
+}
+
+func TestSchedulingDecision(t *testing.T) {
+	coordinator := NewBuildCoordinator(5)
+	handler := coordinator.routes(nil)
+
+	get := func(path string) (*SchedulingDecision, int) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusOK {
+			return nil, w.Code
+		}
+		var decision SchedulingDecision
+		if err := json.NewDecoder(w.Body).Decode(&decision); err != nil {
+			t.Fatalf("Failed to decode scheduling decision: %v", err)
+		}
+		return &decision, w.Code
+	}
+
+	if _, code := get("/api/builds/missing/scheduling"); code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown build, got %d", code)
+	}
+
+	buildID, err := coordinator.SubmitBuild(BuildRequest{ProjectPath: "/projects/app", TaskName: "build"})
+	if err != nil {
+		t.Fatalf("SubmitBuild failed: %v", err)
+	}
+	request := <-coordinator.buildQueue
+	if decision, _ := get("/api/builds/" + buildID + "/scheduling"); decision == nil || len(decision.Attempts) != 0 || decision.Status != BuildStatusQueued {
+		t.Fatalf("Expected a queued build without attempts, got %+v", decision)
+	}
+
+	// Workers without a recent heartbeat are not considered
+	for _, id := range []string{"cached", "idle", "flaky"} {
+		coordinator.workers[id] = &Worker{ID: id, Host: "127.0.0.1", Port: 1, MaxBuilds: 1, Status: "idle"}
+	}
+	coordinator.workers["cached"].Builds = []BuildRequest{{ProjectPath: "/projects/app"}}
+	coordinator.reliability["flaky"] = workerReliability{failed: 8}
+	if coordinator.startBuild(request) {
+		t.Fatal("Expected no worker to take the build")
+	}
+
+	// The busier worker with a warm cache beats the idle workers, and the
+	// unreliable worker comes last
+	for id, usage := range map[string]float64{"cached": 0.4, "idle": 0.2, "flaky": 0.2} {
+		coordinator.Heartbeat(&HeartbeatArgs{ID: id, Status: "idle", CPUUsage: usage, MemoryUsage: usage}, &HeartbeatReply{})
+	}
+	if !coordinator.startBuild(request) {
+		t.Fatal("Expected the build to start")
+	}
+
+	decision, _ := get("/api/builds/" + buildID + "/scheduling")
+	if decision == nil || len(decision.Attempts) != 2 {
+		t.Fatalf("Expected two scheduling attempts, got %+v", decision)
+	}
+	if attempt := decision.Attempts[0]; attempt.Outcome != ScheduleNoCapacity || len(attempt.Candidates) != 0 {
+		t.Errorf("Expected the first attempt to find no capacity, got %+v", attempt)
+	}
+	attempt := decision.Attempts[1]
+	if attempt.Outcome != ScheduleAssigned || attempt.WorkerID != "cached" || len(attempt.Candidates) != 3 {
+		t.Fatalf("Expected the build to go to the cached worker, got %+v", attempt)
+	}
+	for i, id := range []string{"cached", "idle", "flaky"} {
+		if candidate := attempt.Candidates[i]; candidate.WorkerID != id || candidate.Chosen != (i == 0) {
+			t.Errorf("Expected worker %s at position %d, got %+v", id, i, candidate)
+		}
+	}
+	if candidate := attempt.Candidates[0]; candidate.CacheAffinity != 1 || candidate.Reliability != 0.5 || candidate.ResourceFit >= attempt.Candidates[1].ResourceFit {
+		t.Errorf("Unexpected score components for the cached worker: %+v", candidate)
+	}
+	if candidate := attempt.Candidates[2]; candidate.CacheAffinity != 0 || candidate.Reliability != 0.1 {
+		t.Errorf("Unexpected score components for the flaky worker: %+v", candidate)
+	}
+}
+
+func TestWorkerBuildSlots(t *testing.T) {
+	coordinator := NewBuildCoordinator(5)
+
+	var reply RegisterWorkerReply
+	if err := coordinator.RegisterWorker(&RegisterWorkerArgs{ID: "worker-1", Host: "localhost", Port: 8080, MaxBuilds: 2}, &reply); err != nil {
+		t.Fatalf("RegisterWorker failed: %v", err)
+	}
+	worker := coordinator.workers["worker-1"]
+
+	if !coordinator.assignBuildToWorker(worker, BuildRequest{RequestID: "build-1"}) {
+		t.Fatal("Expected first build to be assigned")
+	}
+	if worker.Status != "idle" || worker.availableSlots() != 1 {
+		t.Errorf("Expected one free slot after first build, got status %s with %d slots", worker.Status, worker.availableSlots())
+	}
+	if len(coordinator.getAvailableWorkers()) != 1 {
+		t.Error("Expected worker with a free slot to be available")
+	}
+
+	if !coordinator.assignBuildToWorker(worker, BuildRequest{RequestID: "build-2"}) {
+		t.Fatal("Expected second build to be assigned")
+	}
+	if worker.Status != "busy" || worker.availableSlots() != 0 {
+		t.Errorf("Expected full worker, got status %s with %d slots", worker.Status, worker.availableSlots())
+	}
+	if coordinator.assignBuildToWorker(worker, BuildRequest{RequestID: "build-3"}) {
+		t.Error("Expected third build to be rejected by a full worker")
+	}
+	if len(coordinator.getAvailableWorkers()) != 0 {
+		t.Error("Expected full worker to be unavailable")
+	}
+
+	// A heartbeat must not override slot accounting
+	coordinator.Heartbeat(&HeartbeatArgs{ID: "worker-1", Status: "idle"}, &HeartbeatReply{})
+	if worker.Status != "busy" {
+		t.Errorf("Expected heartbeat to keep status busy, got %s", worker.Status)
+	}
+
+	coordinator.releaseBuildSlot(worker)
+	if worker.ActiveBuilds != 1 || worker.Status != "idle" {
+		t.Errorf("Expected 1 active build and idle status after release, got %d and %s", worker.ActiveBuilds, worker.Status)
+	}
+}
+
+func TestOpenAPIDocument(t *testing.T) {
+	doc := coordinatorOpenAPI()
+
+	for _, path := range []string{"/api/build", "/api/builds/{id}", "/api/builds/{id}/stream", "/api/builds/{id}/log", "/api/builds/{id}/provenance", "/api/builds/{id}/pause", "/api/builds/{id}/resume", "/api/builds/{id}/replay", "/api/builds/{id}/annotations", "/api/builds", "/api/bisect", "/api/bisect/{id}", "/api/workers", "/api/workers/{id}/quarantine", "/api/rpc", "/api/rpc/calls", "/api/stats", "/api/analytics/durations", "/api/analytics/slowest-tasks", "/api/audit", "/api/tracing/check", "/api/health", "/api/system/health", "/api/keys", "/api/keys/{id}", "/api/keys/signing", "/api/auth/oidc/config", "/api/auth/oidc/token"} {
+		if _, exists := doc.Paths[path]; !exists {
+			t.Errorf("Expected path %s in document", path)
+		}
+	}
+
+	request := doc.Components.Schemas["BuildRequest"]
+	if request == nil || request.Properties[0].Name != "project_path" {
+		t.Errorf("Expected BuildRequest schema with snake_case properties, got %+v", request)
+	}
+}
+
+func TestQueueWait(t *testing.T) {
+	coordinator := NewBuildCoordinator(5)
+	buildID, err := coordinator.SubmitBuild(BuildRequest{ProjectPath: "/projects/app", TaskName: "build", Tenant: "mobile", Critical: true})
+	if err != nil {
+		t.Fatalf("SubmitBuild failed: %v", err)
+	}
+	request := <-coordinator.buildQueue
+	if request.RequestID != buildID || request.QueuedAt.IsZero() {
+		t.Fatalf("Expected the build to record when it was queued, got %+v", request)
+	}
+
+	observed := func(priority, tenant string) (uint64, float64) {
+		var metric dto.Metric
+		metrics.QueueWait.WithLabelValues(pools.DefaultPool, priority, tenant).(prometheus.Histogram).Write(&metric)
+		return metric.GetHistogram().GetSampleCount(), metric.GetHistogram().GetSampleSum()
+	}
+
+	request.QueuedAt = time.Now().Add(-90 * time.Second)
+	observeQueueWait(pools.DefaultPool, request)
+	if count, sum := observed(metrics.PriorityCritical, "mobile"); count != 1 || sum < 90 {
+		t.Errorf("Expected one wait of 90s for critical mobile builds, got %d totalling %vs", count, sum)
+	}
+
+	// Builds not queued locally, like those of tests, are not timed
+	observeQueueWait(pools.DefaultPool, BuildRequest{Tenant: "untimed"})
+	if count, _ := observed(metrics.PriorityNormal, "untimed"); count != 0 {
+		t.Errorf("Expected no wait without a queue time, got %d", count)
+	}
+}
+
+func TestRoutes(t *testing.T) {
+	coordinator := NewBuildCoordinator(5)
+	service := auth.NewAuthService("secret", time.Hour)
+	service.AddAllowedToken("service-token")
+	handler := coordinator.routes(service)
+
+	tests := []struct {
+		method   string
+		path     string
+		token    string
+		expected int
+	}{
+		{"GET", "/api/health", "", http.StatusOK},
+		{"GET", "/api/system/health", "", http.StatusOK},
+		{"GET", "/api/workers", "", http.StatusUnauthorized},
+		{"GET", "/api/workers", "service-token", http.StatusOK},
+		{"GET", "/api/build", "service-token", http.StatusMethodNotAllowed},
+		{"GET", "/api/builds/missing", "service-token", http.StatusNotFound},
+		{"GET", "/", "", http.StatusOK},
+		{"GET", "/api/builds", "", http.StatusUnauthorized},
+		{"GET", "/api/stats", "service-token", http.StatusOK},
+	}
+
+	for _, tc := range tests {
+		req := httptest.NewRequest(tc.method, tc.path, nil)
+		if tc.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tc.token)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		if w.Code != tc.expected {
+			t.Errorf("%s %s: expected %d, got %d", tc.method, tc.path, tc.expected, w.Code)
+		}
+		if w.Header().Get(middleware.RequestIDHeader) == "" {
+			t.Errorf("%s %s: expected a request ID header", tc.method, tc.path)
+		}
+	}
+
+	var metric dto.Metric
+	if err := httpRequestsTotal.WithLabelValues("GET", "GET /api/workers", "200").Write(&metric); err != nil {
+		t.Fatalf("Failed to read request counter: %v", err)
+	}
+	if value := metric.GetCounter().GetValue(); value != 1 {
+		t.Errorf("Expected 1 counted workers request, got %v", value)
+	}
+}
+
+func TestBuildProgressStream(t *testing.T) {
+	coordinator := NewBuildCoordinator(5)
+	server := httptest.NewServer(coordinator.routes(nil))
+	defer server.Close()
+
+	buildID, _ := coordinator.SubmitBuild(BuildRequest{ProjectPath: "/test/project", TaskName: "build"})
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(server.URL, "http://"))
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	fmt.Fprintf(conn, "GET /api/builds/%s/stream HTTP/1.1\r\nHost: test\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n"+
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n", buildID)
+
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil || resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Expected websocket upgrade, got %v %v", resp, err)
+	}
+
+	// readProgress reads one unmasked text frame holding a BuildProgress
+	readProgress := func() BuildProgress {
+		t.Helper()
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+		var header [2]byte
+		if _, err := io.ReadFull(reader, header[:]); err != nil {
+			t.Fatalf("Failed to read frame: %v", err)
+		}
+		length := int(header[1] & 0x7F)
+		if length == 126 {
+			var extended [2]byte
+			io.ReadFull(reader, extended[:])
+			length = int(extended[0])<<8 | int(extended[1])
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			t.Fatalf("Failed to read payload: %v", err)
+		}
+
+		var progress BuildProgress
+		if err := json.Unmarshal(payload, &progress); err != nil {
+			t.Fatalf("Failed to decode progress %q: %v", payload, err)
+		}
+		return progress
+	}
+
+	if progress := readProgress(); progress.Status != BuildStatusQueued {
+		t.Errorf("Expected queued status first, got %s", progress.Status)
+	}
+
+	coordinator.ReportProgress(&ReportProgressArgs{BuildID: buildID, WorkerID: "worker-1", Progress: 40, Step: ":app:test"}, &ReportProgressReply{})
+	if progress := readProgress(); progress.Progress != 40 || progress.Step != ":app:test" {
+		t.Errorf("Expected 40%% at :app:test, got %.0f%% at %s", progress.Progress, progress.Step)
+	}
+
+	coordinator.markBuildCompleted(buildID, "worker-1")
+	if progress := readProgress(); progress.Status != BuildStatusCompleted || progress.Progress != 100 {
+		t.Errorf("Expected completed at 100%%, got %s at %.0f%%", progress.Status, progress.Progress)
+	}
+
+	// The stream ends once the build has finished
+	var header [2]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil || header[0]&0x0F != 0x8 {
+		t.Errorf("Expected close frame after completion, got %v %v", header, err)
+	}
+}
+
+func TestBuildLog(t *testing.T) {
+	coordinator := NewBuildCoordinator(5)
+	server := httptest.NewServer(coordinator.routes(nil))
+	defer server.Close()
+
+	buildID, _ := coordinator.SubmitBuild(BuildRequest{ProjectPath: "/test/project", TaskName: "build"})
+	coordinator.ReportProgress(&ReportProgressArgs{BuildID: buildID, WorkerID: "worker-1", Step: "started"}, &ReportProgressReply{})
+
+	var reply ReportLogReply
+	if err := coordinator.ReportLog(&ReportLogArgs{BuildID: buildID, WorkerID: "worker-1", Lines: []string{"> Task :compileJava", "> Task :test"}}, &reply); err != nil {
+		t.Fatalf("ReportLog failed: %v", err)
+	}
+	// Only the worker running the build reports its output
+	coordinator.ReportLog(&ReportLogArgs{BuildID: buildID, WorkerID: "worker-2", Lines: []string{"stale output"}}, &reply)
+
+	get := func(query string) (int, string) {
+		t.Helper()
+		resp, err := http.Get(server.URL + "/api/builds/" + buildID + "/log" + query)
+		if err != nil {
+			t.Fatalf("GET log failed: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+	if code, body := get(""); code != http.StatusOK || body != "> Task :compileJava\n> Task :test\n" {
+		t.Errorf("Expected the whole log, got %d %q", code, body)
+	}
+	if code, body := get("?tail=1"); code != http.StatusOK || body != "> Task :test\n" {
+		t.Errorf("Expected the last line, got %d %q", code, body)
+	}
+	if code, _ := get("?tail=-1"); code != http.StatusBadRequest {
+		t.Errorf("Expected an invalid tail to be rejected, got %d", code)
+	}
+
+	// Following streams new lines until the build finishes
+	resp, err := http.Get(server.URL + "/api/builds/" + buildID + "/log?tail=1&follow=true")
+	if err != nil {
+		t.Fatalf("GET log failed: %v", err)
+	}
+	defer resp.Body.Close()
+	reader := bufio.NewReader(resp.Body)
+	if line, _ := reader.ReadString('\n'); line != "> Task :test\n" {
+		t.Errorf("Expected the last line first, got %q", line)
+	}
+	coordinator.ReportLog(&ReportLogArgs{BuildID: buildID, WorkerID: "worker-1", Lines: []string{"BUILD SUCCESSFUL"}}, &reply)
+	if line, _ := reader.ReadString('\n'); line != "BUILD SUCCESSFUL\n" {
+		t.Errorf("Expected the reported line to be streamed, got %q", line)
+	}
+	coordinator.markBuildCompleted(buildID, "worker-1")
+	if rest, err := io.ReadAll(reader); err != nil || len(rest) != 0 {
+		t.Errorf("Expected the stream to end with the build, got %q, %v", rest, err)
+	}
+
+	if err := coordinator.ReportLog(&ReportLogArgs{BuildID: buildID, WorkerID: "worker-1", Lines: []string{"late"}}, &reply); err == nil {
+		t.Error("Expected output of a finished build to be rejected")
+	}
+	if code, _ := get("?follow=true"); code != http.StatusOK {
+		t.Errorf("Expected the log of a finished build to be served without following, got %d", code)
+	}
+
+	resp, _ = http.Get(server.URL + "/api/builds/non-existent/log")
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown build, got %d", resp.StatusCode)
+	}
+}
+
+func TestGetBuildIncludesProgress(t *testing.T) {
+	coordinator := NewBuildCoordinator(5)
+	buildID, _ := coordinator.SubmitBuild(BuildRequest{ProjectPath: "/test/project", TaskName: "build"})
+	coordinator.ReportProgress(&ReportProgressArgs{BuildID: buildID, WorkerID: "worker-1", Progress: 60, Step: ":app:jar"}, &ReportProgressReply{})
+
+	w := httptest.NewRecorder()
+	coordinator.routes(nil).ServeHTTP(w, httptest.NewRequest("GET", "/api/builds/"+buildID, nil))
+
+	var status BuildStatusResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if status.RequestID != buildID {
+		t.Errorf("Expected request ID %s, got %s", buildID, status.RequestID)
+	}
+	if status.Progress.Progress != 60 || status.Progress.Status != BuildStatusRunning {
+		t.Errorf("Expected running at 60%%, got %s at %.0f%%", status.Progress.Status, status.Progress.Progress)
+	}
+}
+
+func TestBuildResourceUsage(t *testing.T) {
+	coordinator := NewBuildCoordinator(5)
+	buildID, _ := coordinator.SubmitBuild(BuildRequest{ProjectPath: "/test/project", TaskName: "build"})
+	coordinator.ReportProgress(&ReportProgressArgs{BuildID: buildID, WorkerID: "worker-1", Progress: 90}, &ReportProgressReply{})
+
+	usage := &ResourceMetrics{
+		CPUUsage:        0.4,
+		MemoryUsage:     1 << 30,
+		DiskIO:          1 << 20,
+		PeakCPUUsage:    0.9,
+		PeakMemoryUsage: 2 << 30,
+		Samples:         []types.ResourceSample{{Time: time.Now(), CPUUsage: 0.9, MemoryUsage: 2 << 30, DiskIO: 1 << 20}},
+	}
+	if err := coordinator.ReportArtifacts(&ReportArtifactsArgs{BuildID: buildID, WorkerID: "worker-1", ResourceUsage: usage}, &ReportArtifactsReply{}); err != nil {
+		t.Fatalf("ReportArtifacts failed: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	coordinator.routes(nil).ServeHTTP(w, httptest.NewRequest("GET", "/api/builds/"+buildID, nil))
+	var status struct {
+		Metrics BuildMetrics `json:"metrics"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	reported := status.Metrics.ResourceUsage
+	if reported.PeakMemoryUsage != 2<<30 || reported.CPUUsage != 0.4 || len(reported.Samples) != 1 {
+		t.Errorf("Expected the sampled resource usage, got %+v", reported)
+	}
+}
+
+func TestBuildProvenance(t *testing.T) {
+	coordinator := NewBuildCoordinator(5)
+	buildID, _ := coordinator.SubmitBuild(BuildRequest{ProjectPath: "/test/project", TaskName: "build"})
+	coordinator.ReportProgress(&ReportProgressArgs{BuildID: buildID, WorkerID: "worker-1", Progress: 90}, &ReportProgressReply{})
+
+	artifacts := []types.Artifact{{
+		Path:          "/test/project/build/libs/app.jar",
+		SHA256:        "abc123",
+		Size:          42,
+		WorkerID:      "worker-1",
+		GradleVersion: "8.5",
+		JDKVersion:    "17.0.9",
+	}}
+
+	var reply ReportArtifactsReply
+	if err := coordinator.ReportArtifacts(&ReportArtifactsArgs{BuildID: buildID, WorkerID: "worker-2", Artifacts: artifacts}, &reply); err == nil {
+		t.Error("Expected error when another worker reports artifacts")
+	}
+	if err := coordinator.ReportArtifacts(&ReportArtifactsArgs{BuildID: buildID, WorkerID: "worker-1", Artifacts: artifacts}, &reply); err != nil {
+		t.Fatalf("ReportArtifacts failed: %v", err)
+	}
+
+	handler := coordinator.routes(nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/builds/"+buildID+"/provenance", nil))
+	if w.Code != http.StatusConflict {
+		t.Errorf("Expected status %d before completion, got %d", http.StatusConflict, w.Code)
+	}
+
+	coordinator.markBuildCompleted(buildID, "worker-1")
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/builds/"+buildID+"/provenance", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+
+	var statement provenance.Statement
+	if err := json.Unmarshal(w.Body.Bytes(), &statement); err != nil {
+		t.Fatalf("Failed to decode provenance: %v", err)
+	}
+	if len(statement.Subject) != 1 || statement.Subject[0].Digest["sha256"] != "abc123" {
+		t.Errorf("Unexpected subjects %+v", statement.Subject)
+	}
+	if statement.Predicate.BuildDefinition.ExternalParameters.TaskName != "build" {
+		t.Errorf("Expected task name build, got %+v", statement.Predicate.BuildDefinition.ExternalParameters)
+	}
+	if statement.Predicate.RunDetails.Builder.Version["gradle"] != "8.5" {
+		t.Errorf("Expected gradle version in builder, got %+v", statement.Predicate.RunDetails.Builder)
+	}
+
+	status, _ := coordinator.GetBuildStatus(buildID)
+	if len(status.Artifacts) != 1 || status.Artifacts[0] != artifacts[0].Path || len(status.ArtifactDetails) != 1 {
+		t.Errorf("Expected artifacts on build response, got %+v", status)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/builds/unknown/provenance", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d for unknown build, got %d", http.StatusNotFound, w.Code)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	coordinator := NewBuildCoordinator(5)
+	handler := coordinator.routes(nil)
+
+	request := httptest.NewRequest("POST", "/api/build", strings.NewReader(`{"project_path":"/test/project","task_name":"build"}`))
+	request.RemoteAddr = "10.1.2.3:40000"
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, request)
+
+	var submitted SubmitBuildResponse
+	json.Unmarshal(w.Body.Bytes(), &submitted)
+
+	coordinator.RegisterWorker(&RegisterWorkerArgs{ID: "worker-1", Host: "10.0.0.5", Port: 8082, MaxBuilds: 2}, &RegisterWorkerReply{})
+	coordinator.CancelBuild(&CancelBuildArgs{BuildID: submitted.BuildID, Reason: "superseded"}, &CancelBuildReply{})
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/audit", nil))
+
+	var events []audit.Event
+	if err := json.Unmarshal(w.Body.Bytes(), &events); err != nil {
+		t.Fatalf("Failed to decode audit events: %v", err)
+	}
+	if len(events) != 3 {
+		t.Fatalf("Expected 3 audit events, got %+v", events)
+	}
+
+	expected := []audit.Event{
+		{Action: audit.ActionBuildSubmitted, Principal: "anonymous", SourceIP: "10.1.2.3", Resource: submitted.BuildID},
+		{Action: audit.ActionWorkerRegistered, Principal: "worker:worker-1", SourceIP: "10.0.0.5", Resource: "worker-1"},
+		{Action: audit.ActionBuildCancelled, Principal: "rpc", Resource: submitted.BuildID},
+	}
+	for i, event := range events {
+		if event.Action != expected[i].Action || event.Principal != expected[i].Principal ||
+			event.SourceIP != expected[i].SourceIP || event.Resource != expected[i].Resource {
+			t.Errorf("Expected event %+v, got %+v", expected[i], event)
+		}
+	}
+	if events[2].Details["reason"] != "superseded" {
+		t.Errorf("Expected cancellation reason in details, got %v", events[2].Details)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/audit?action=worker.registered", nil))
+	json.Unmarshal(w.Body.Bytes(), &events)
+	if len(events) != 1 || events[0].Resource != "worker-1" {
+		t.Errorf("Expected only the worker registration, got %+v", events)
+	}
+}
+
+func TestBuildRequestRejectsInvalidGradleVersion(t *testing.T) {
+	coordinator := NewBuildCoordinator(5)
+
+	w := httptest.NewRecorder()
+	body := `{"project_path":"/test/project","task_name":"build","gradle_version":"../../bin"}`
+	coordinator.routes(nil).ServeHTTP(w, httptest.NewRequest("POST", "/api/build", strings.NewReader(body)))
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d, got %d", http.StatusBadRequest, w.Code)
+	}
+	if len(coordinator.builds) != 0 {
+		t.Errorf("Expected no build to be queued, got %d", len(coordinator.builds))
+	}
+}
+
+func TestBuildRequestValidation(t *testing.T) {
+	coordinator := NewBuildCoordinator(5)
+	coordinator.buildPolicy = validation.BuildPolicy{
+		ProjectRoots:    []string{"/test"},
+		TaskPatterns:    []string{"build", "test"},
+		MaxBuildOptions: 2,
+	}
+	handler := coordinator.routes(nil)
+
+	rejected := map[string]string{
+		"outside project roots": `{"project_path":"/etc","task_name":"build"}`,
+		"sibling of root":       `{"project_path":"/testing/project","task_name":"build"}`,
+		"disallowed task":       `{"project_path":"/test/project","task_name":"publish"}`,
+		"option injection":      `{"project_path":"/test/project","task_name":"--init-script"}`,
+		"too many options":      `{"project_path":"/test/project","task_name":"build","build_options":{"a":"1","b":"2","c":"3"}}`,
+		"gradle argument":       `{"project_path":"/test/project","task_name":"build","build_options":{"gradleArgs":"--project-dir /etc"}}`,
+		"invalid max workers":   `{"project_path":"/test/project","task_name":"build","build_options":{"maxWorkers":"0"}}`,
+	}
+	for name, body := range rejected {
+		t.Run(name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest("POST", "/api/build", strings.NewReader(body)))
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("Expected status %d, got %d: %s", http.StatusBadRequest, w.Code, w.Body.String())
+			}
+		})
+	}
+	if len(coordinator.builds) != 0 {
+		t.Fatalf("Expected no build to be queued, got %d", len(coordinator.builds))
+	}
+
+	w := httptest.NewRecorder()
+	body := `{"project_path":"/test//project/","task_name":"build"}`
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/api/build", strings.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	for _, request := range coordinator.requests {
+		if request.ProjectPath != "/test/project" {
+			t.Errorf("Expected normalized project path /test/project, got %s", request.ProjectPath)
+		}
+	}
+}
+
+func TestDashboard(t *testing.T) {
+	coordinator := NewBuildCoordinator(5)
+	coordinator.workers["worker-1"] = &Worker{ID: "worker-1", Status: "busy", MaxBuilds: 2, ActiveBuilds: 1, LastPing: time.Now()}
+	coordinator.workers["worker-2"] = &Worker{ID: "worker-2", Status: "idle", LastPing: time.Now()}
+
+	queued, _ := coordinator.SubmitBuild(BuildRequest{ProjectPath: "/projects/queued", TaskName: "build"})
+	completed, _ := coordinator.SubmitBuild(BuildRequest{ProjectPath: "/projects/done", TaskName: "test"})
+	coordinator.progress[completed].StartedAt = time.Now().Add(-time.Minute)
+	coordinator.progress[completed].WorkerID = "worker-1"
+	coordinator.ReportArtifacts(&ReportArtifactsArgs{BuildID: completed, WorkerID: "worker-1", CacheHitRate: 0.75}, &ReportArtifactsReply{})
+	coordinator.markBuildCompleted(completed, "worker-1")
+	coordinator.requests[completed] = BuildRequest{ProjectPath: "/projects/done", TaskName: "test", Timestamp: time.Now().Add(time.Second)}
+
+	handler := coordinator.routes(nil)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "/api/stats") {
+		t.Errorf("Expected dashboard page, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/stats", nil))
+	var stats CoordinatorStats
+	if err := json.Unmarshal(w.Body.Bytes(), &stats); err != nil {
+		t.Fatalf("Failed to decode stats: %v", err)
+	}
+	if stats.QueuedBuilds != 1 || stats.CompletedBuilds != 1 || stats.Workers != 2 || stats.BusyWorkers != 1 {
+		t.Errorf("Unexpected build and worker counts %+v", stats)
+	}
+	if stats.TotalSlots != 3 || stats.UsedSlots != 1 || stats.CacheHitRate != 0.75 {
+		t.Errorf("Unexpected slots or cache hit rate %+v", stats)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/builds?limit=1", nil))
+	var builds []BuildSummary
+	if err := json.Unmarshal(w.Body.Bytes(), &builds); err != nil {
+		t.Fatalf("Failed to decode builds: %v", err)
+	}
+	if len(builds) != 1 || builds[0].BuildID != completed {
+		t.Fatalf("Expected only the most recent build, got %+v", builds)
+	}
+	if builds[0].Status != BuildStatusCompleted || builds[0].Duration < time.Minute || builds[0].TaskName != "test" {
+		t.Errorf("Unexpected build summary %+v", builds[0])
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/builds", nil))
+	builds = nil
+	json.Unmarshal(w.Body.Bytes(), &builds)
+	if len(builds) != 2 || builds[1].BuildID != queued || builds[1].Duration != 0 {
+		t.Errorf("Expected both builds newest first, got %+v", builds)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/builds?limit=0", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d for invalid limit, got %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestBuildAnalytics(t *testing.T) {
+	coordinator := NewBuildCoordinator(5)
+
+	buildID, _ := coordinator.SubmitBuild(BuildRequest{ProjectPath: "/projects/app", TaskName: "build"})
+	coordinator.progress[buildID].StartedAt = time.Now()
+	for _, step := range []string{"started", ":app:compileJava", ":app:test", "completed"} {
+		coordinator.ReportProgress(&ReportProgressArgs{BuildID: buildID, WorkerID: "worker-1", Step: step}, &ReportProgressReply{})
+	}
+	coordinator.markBuildCompleted(buildID, "worker-1")
+
+	cancelled, _ := coordinator.SubmitBuild(BuildRequest{ProjectPath: "/projects/app", TaskName: "test"})
+	coordinator.CancelBuild(&CancelBuildArgs{BuildID: cancelled}, &CancelBuildReply{})
+
+	records, _ := coordinator.buildStore.Query(buildstore.Filter{})
+	if len(records) != 2 {
+		t.Fatalf("Expected 2 recorded builds, got %+v", records)
+	}
+	if records[0].Status != BuildStatusCompleted || records[0].WorkerID != "worker-1" || records[0].TaskName != "build" {
+		t.Errorf("Unexpected completed build record %+v", records[0])
+	}
+	if len(records[0].Tasks) != 2 || records[0].Tasks[0].Name != ":app:compileJava" || records[0].Tasks[1].Name != ":app:test" {
+		t.Errorf("Expected timings of both tasks, got %+v", records[0].Tasks)
+	}
+	if records[1].Status != BuildStatusCancelled {
+		t.Errorf("Expected cancelled build record, got %+v", records[1])
+	}
+	if len(coordinator.timers) != 0 {
+		t.Errorf("Expected task timers to be released, got %d", len(coordinator.timers))
+	}
+
+	handler := coordinator.routes(nil)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/analytics/slowest-tasks?project=/projects/app", nil))
+	var table analytics.Table
+	if err := json.Unmarshal(w.Body.Bytes(), &table); err != nil {
+		t.Fatalf("Failed to decode slowest tasks: %v", err)
+	}
+	if table.Type != "table" || len(table.Rows) != 2 {
+		t.Errorf("Expected both tasks in the table, got %+v", table)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/analytics/failures?interval=1d", nil))
+	var series []analytics.Series
+	if err := json.Unmarshal(w.Body.Bytes(), &series); err != nil {
+		t.Fatalf("Failed to decode failure rates: %v", err)
+	}
+	if len(series) != 2 || len(series[1].Datapoints) != 1 || series[1].Datapoints[0][0] != 1 {
+		t.Errorf("Expected one finished build, got %+v", series)
+	}
+
+	for _, path := range []string{"/api/analytics/durations", "/api/analytics/busiest-hours"} {
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: expected status %d, got %d", path, http.StatusOK, w.Code)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/analytics/durations?interval=soon", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d for invalid interval, got %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestCoordinatorCollector(t *testing.T) {
+	coordinator := NewBuildCoordinator(5)
+
+	var reply RegisterWorkerReply
+	if err := coordinator.RegisterWorker(&RegisterWorkerArgs{ID: "worker-1", Host: "localhost", Port: 8080, MaxBuilds: 2}, &reply); err != nil {
+		t.Fatalf("RegisterWorker failed: %v", err)
+	}
+	coordinator.Heartbeat(&HeartbeatArgs{ID: "worker-1", Status: "idle", CPUUsage: 0.5, MemoryUsage: 0.25}, &HeartbeatReply{})
+	coordinator.assignBuildToWorker(coordinator.workers["worker-1"], BuildRequest{RequestID: "build-1"})
+	coordinator.progress["build-2"] = &BuildProgress{BuildID: "build-2", Status: BuildStatusQueued}
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(coordinatorCollector{coordinator})
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("Gather failed: %v", err)
+	}
+
+	values := map[string]float64{}
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			values[family.GetName()] = metric.GetGauge().GetValue()
+		}
+	}
+
+	expected := map[string]float64{
+		metrics.QueueDepth:         1,
+		metrics.WorkerBusy:         0,
+		metrics.WorkerSlots:        2,
+		metrics.WorkerActiveBuilds: 1,
+		metrics.WorkerCPUUsage:     0.5,
+		metrics.WorkerMemoryUsage:  0.25,
+	}
+	for name, value := range expected {
+		if got, exists := values[name]; !exists || got != value {
+			t.Errorf("Expected %s to be %v, got %v", name, value, got)
+		}
+	}
+}
+
+func TestChaos(t *testing.T) {
+	coordinator := NewBuildCoordinator(5)
+
+	w := httptest.NewRecorder()
+	coordinator.routes(nil).ServeHTTP(w, httptest.NewRequest("GET", "/api/chaos", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected chaos API to be absent unless enabled, got status %d", w.Code)
+	}
+
+	coordinator.chaos, _ = chaos.NewInjector(chaos.Config{})
+	handler := coordinator.routes(nil)
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("PUT", "/api/chaos", strings.NewReader(`{"heartbeat_drop_rate": 1}`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+	}
+
+	events, _ := coordinator.auditLog.Query(audit.Filter{Action: audit.ActionChaosConfigured})
+	if len(events) != 1 || !strings.Contains(events[0].Details["config"], `"heartbeat_drop_rate":1`) {
+		t.Errorf("Expected the chaos configuration to be audited, got %+v", events)
+	}
+
+	// A dropped heartbeat leaves the worker's last ping untouched, so it is
+	// eventually treated as unavailable
+	coordinator.RegisterWorker(&RegisterWorkerArgs{ID: "worker-1", Host: "localhost", Port: 8080, MaxBuilds: 1}, &RegisterWorkerReply{})
+	worker := coordinator.workers["worker-1"]
+	worker.LastPing = time.Now().Add(-time.Minute)
+
+	if err := coordinator.Heartbeat(&HeartbeatArgs{ID: "worker-1", CPUUsage: 0.5}, &HeartbeatReply{}); err != nil {
+		t.Fatalf("Heartbeat failed: %v", err)
+	}
+	if time.Since(worker.LastPing) < time.Minute || worker.Metrics.CPUUsage != 0 {
+		t.Error("Expected the heartbeat to be dropped")
+	}
+	if len(coordinator.getAvailableWorkers()) != 0 {
+		t.Error("Expected a worker without heartbeats to be unavailable")
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/chaos", nil))
+	var state chaos.State
+	json.Unmarshal(w.Body.Bytes(), &state)
+	if state.Injected[chaos.FaultHeartbeatDrop] != 1 {
+		t.Errorf("Expected 1 dropped heartbeat, got %v", state.Injected)
+	}
+}
+
+// secretWorker is a worker RPC service that records the secrets it receives
+// and fails, echoing them
+type secretWorker struct {
+	received chan map[string]string
+}
+
+func (s *secretWorker) Build(request BuildRequest, response *string) error {
+	s.received <- request.SecretEnv
+	return fmt.Errorf("signing with %s failed", request.SecretEnv["SIGNING_KEY"])
+}
+
+func TestBuildSecrets(t *testing.T) {
+	t.Setenv("TEST_SIGNING_KEY", "s3cr3t-signing-key")
+	coordinator := NewBuildCoordinator(5)
+	store, err := secrets.NewStore(map[string]secrets.Reference{
+		"signing-key": {EnvVar: "SIGNING_KEY", Backend: secrets.BackendEnv, Key: "TEST_SIGNING_KEY"},
+	}, nil)
+	if err != nil {
+		t.Fatalf("NewStore failed: %v", err)
+	}
+	coordinator.secretStore = store
+	handler := coordinator.routes(nil)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/secrets", nil))
+	if !strings.Contains(w.Body.String(), `"name":"signing-key"`) || strings.Contains(w.Body.String(), "TEST_SIGNING_KEY") {
+		t.Errorf("Expected secret names without their keys, got %s", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	body := `{"project_path":"/test/project","task_name":"build","secrets":["deploy-key"]}`
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/api/build", strings.NewReader(body)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d for an unknown secret, got %d", http.StatusBadRequest, w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	body = `{"project_path":"/test/project","task_name":"build","secrets":["signing-key"]}`
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/api/build", strings.NewReader(body)))
+	var submitted SubmitBuildResponse
+	if err := json.NewDecoder(w.Body).Decode(&submitted); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("Expected build to be queued, got %d: %v", w.Code, err)
+	}
+
+	// Dispatch the build to a worker echoing its secrets in its error
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+	fake := &secretWorker{received: make(chan map[string]string, 1)}
+	server := rpc.NewServer()
+	server.RegisterName("WorkerService", fake)
+	go server.Accept(listener)
+
+	worker := &Worker{ID: "worker-1", Host: "127.0.0.1", Port: listener.Addr().(*net.TCPAddr).Port, MaxBuilds: 1, ActiveBuilds: 1}
+	coordinator.executeBuildOnWorker(worker, <-coordinator.buildQueue)
+
+	if env := <-fake.received; env["SIGNING_KEY"] != "s3cr3t-signing-key" {
+		t.Errorf("Expected the worker to receive the secret, got %v", env)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/builds/"+submitted.BuildID, nil))
+	if strings.Contains(w.Body.String(), "s3cr3t-signing-key") {
+		t.Errorf("Expected the secret never to be returned, got %s", w.Body.String())
+	}
+	if message := coordinator.builds[submitted.BuildID].ErrorMessage; !strings.Contains(message, "signing with "+secrets.MaskedValue+" failed") {
+		t.Errorf("Expected the secret to be masked in the error, got %q", message)
+	}
+}
+
+// correlationWorker is a worker RPC service that records the request ID of
+// the builds it receives
+type correlationWorker struct {
+	received chan string
+}
+
+func (c *correlationWorker) Build(request BuildRequest, response *string) error {
+	c.received <- request.CorrelationID
+	return nil
+}
+
+func TestRequestIDReachesWorker(t *testing.T) {
+	coordinator := NewBuildCoordinator(5)
+	handler := coordinator.routes(nil)
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/api/build", strings.NewReader(`{"project_path":"/test/project","task_name":"build"}`))
+	req.Header.Set(middleware.RequestIDHeader, "request-1")
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || w.Header().Get(middleware.RequestIDHeader) != "request-1" {
+		t.Fatalf("Expected the build to be queued with the request ID echoed, got %d %v", w.Code, w.Header())
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+	fake := &correlationWorker{received: make(chan string, 1)}
+	server := rpc.NewServer()
+	server.RegisterName("WorkerService", fake)
+	go server.Accept(listener)
+
+	worker := &Worker{ID: "worker-1", Host: "127.0.0.1", Port: listener.Addr().(*net.TCPAddr).Port, MaxBuilds: 1, ActiveBuilds: 1}
+	coordinator.executeBuildOnWorker(worker, <-coordinator.buildQueue)
+	if id := <-fake.received; id != "request-1" {
+		t.Errorf("Expected the worker to receive the request ID, got %q", id)
+	}
+}
+
+func TestHTTPWorkerTransport(t *testing.T) {
+	coordinator := NewBuildCoordinator(5)
+	server := httptest.NewServer(coordinator.routes(nil))
+	defer server.Close()
+
+	// Workers register and send heartbeats over the HTTP port
+	client := httprpc.Dial(server.URL+"/api/rpc", nil, nil)
+	defer client.Close()
+	var reply RegisterWorkerReply
+	args := &RegisterWorkerArgs{ID: "http-worker", Host: "http-worker", Port: 8082, MaxBuilds: 1, Transport: TransportHTTP}
+	if err := client.Call("BuildCoordinator.RegisterWorker", args, &reply); err != nil {
+		t.Fatalf("RegisterWorker over HTTP failed: %v", err)
+	}
+	if worker := coordinator.workers["http-worker"]; worker == nil || worker.Transport != TransportHTTP {
+		t.Fatalf("Expected the worker to be registered over HTTP, got %+v", worker)
+	}
+	var heartbeat HeartbeatReply
+	if err := client.Call("BuildCoordinator.Heartbeat", &HeartbeatArgs{ID: "http-worker", Status: "idle"}, &heartbeat); err != nil {
+		t.Errorf("Heartbeat over HTTP failed: %v", err)
+	}
+	err := client.Call("BuildCoordinator.Heartbeat", &HeartbeatArgs{ID: "unknown"}, &heartbeat)
+	if _, rejected := err.(rpc.ServerError); !rejected || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("Expected the heartbeat of an unknown worker to be rejected, got %v", err)
+	}
+
+	// Builds are sent to the worker when it polls for calls
+	w := httptest.NewRecorder()
+	coordinator.routes(nil).ServeHTTP(w, httptest.NewRequest("POST", "/api/build", strings.NewReader(`{"project_path":"/test/project","task_name":"build"}`)))
+	var submitted SubmitBuildResponse
+	if err := json.NewDecoder(w.Body).Decode(&submitted); err != nil {
+		t.Fatalf("Expected the build to be queued, got %d: %v", w.Code, err)
+	}
+	request := <-coordinator.buildQueue
+	request.CorrelationID = "request-1"
+	worker := coordinator.workers["http-worker"]
+	worker.ActiveBuilds = 1
+	done := make(chan struct{})
+	go func() {
+		coordinator.executeBuildOnWorker(worker, request)
+		close(done)
+	}()
+
+	fake := &correlationWorker{received: make(chan string, 1)}
+	workerServer := rpc.NewServer()
+	workerServer.RegisterName("WorkerService", fake)
+	if err := httprpc.Poll(http.DefaultClient, server.URL+"/api/rpc/calls?worker=http-worker", nil, workerServer); err != nil {
+		t.Fatalf("Poll failed: %v", err)
+	}
+	if id := <-fake.received; id != "request-1" {
+		t.Errorf("Expected the worker to receive the build, got %q", id)
+	}
+	<-done
+	coordinator.mutex.RLock()
+	if response := coordinator.builds[submitted.BuildID]; !response.Success || response.WorkerID != "http-worker" {
+		t.Errorf("Expected the build to succeed on the HTTP worker, got %+v", response)
+	}
+	coordinator.mutex.RUnlock()
+
+	// Only workers registered over HTTP poll for calls
+	coordinator.RegisterWorker(&RegisterWorkerArgs{ID: "tcp-worker", Host: "localhost", Port: 8082}, &reply)
+	for _, id := range []string{"tcp-worker", "unknown"} {
+		w := httptest.NewRecorder()
+		coordinator.routes(nil).ServeHTTP(w, httptest.NewRequest("GET", "/api/rpc/calls?worker="+id, nil))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("Expected polling %s to be rejected, got %d", id, w.Code)
+		}
+	}
+	if _, err := coordinator.dialWorker(&Worker{ID: "gone", Transport: TransportHTTP}); err == nil {
+		t.Error("Expected dialing a worker that does not poll to fail")
+	}
+}
+
+func TestPullWorkerTransport(t *testing.T) {
+	coordinator := NewBuildCoordinator(5)
+	var reply RegisterWorkerReply
+	coordinator.RegisterWorker(&RegisterWorkerArgs{ID: "pull-worker", Host: "laptop", Port: 8082, MaxBuilds: 1, Transport: TransportPull}, &reply)
+	coordinator.RegisterWorker(&RegisterWorkerArgs{ID: "tcp-worker", Host: "localhost", Port: 8082}, &reply)
+
+	if _, err := coordinator.SubmitBuild(BuildRequest{ProjectPath: "/test/project", TaskName: "build", CorrelationID: "request-1"}); err != nil {
+		t.Fatalf("SubmitBuild failed: %v", err)
+	}
+	worker := coordinator.workers["pull-worker"]
+	worker.ActiveBuilds = 1
+	done := make(chan struct{})
+	go func() {
+		coordinator.executeBuildOnWorker(worker, <-coordinator.buildQueue)
+		close(done)
+	}()
+
+	// The worker pulls the build and replies over its own connection
+	var poll PollCallsReply
+	if err := coordinator.PollCalls(&PollCallsArgs{WorkerID: "pull-worker"}, &poll); err != nil || poll.Call == nil {
+		t.Fatalf("Expected the build to be pulled, got %+v: %v", poll, err)
+	}
+	fake := &correlationWorker{received: make(chan string, 1)}
+	workerServer := rpc.NewServer()
+	workerServer.RegisterName("WorkerService", fake)
+	data, err := httprpc.Serve(workerServer, bytes.NewReader(poll.Call.Data))
+	if err != nil {
+		t.Fatalf("Serve failed: %v", err)
+	}
+	if id := <-fake.received; id != "request-1" {
+		t.Errorf("Expected the worker to receive the build, got %q", id)
+	}
+	if err := coordinator.ReplyCall(&ReplyCallArgs{WorkerID: "pull-worker", CallID: poll.Call.ID, Reply: data}, &ReplyCallReply{}); err != nil {
+		t.Fatalf("ReplyCall failed: %v", err)
+	}
+	<-done
+	if err := coordinator.ReplyCall(&ReplyCallArgs{WorkerID: "pull-worker", CallID: poll.Call.ID, Reply: data}, &ReplyCallReply{}); err == nil {
+		t.Error("Expected a second reply to the call to be rejected")
+	}
+
+	// Only workers registered to pull poll for calls
+	if err := coordinator.PollCalls(&PollCallsArgs{WorkerID: "tcp-worker"}, &poll); err == nil {
+		t.Error("Expected the TCP worker's poll to be rejected")
+	}
+}
+
+func TestWorkerProtocolVersion(t *testing.T) {
+	coordinator := NewBuildCoordinator(1)
+	coordinator.minWorkerProtocol = 1
+
+	var reply RegisterWorkerReply
+	err := coordinator.RegisterWorker(&RegisterWorkerArgs{ID: "legacy", Host: "localhost", Port: 8082}, &reply)
+	if err == nil || !strings.Contains(err.Error(), "at least version 1 is required") {
+		t.Fatalf("Expected unversioned worker to be rejected, got %v", err)
+	}
+
+	args := &RegisterWorkerArgs{ID: "worker-1", Host: "localhost", Port: 8082, Version: "1.4.0", ProtocolVersion: 1}
+	if err := coordinator.RegisterWorker(args, &reply); err != nil {
+		t.Fatalf("RegisterWorker failed: %v", err)
+	}
+	if worker := coordinator.workers["worker-1"]; worker.Version != "1.4.0" || worker.ProtocolVersion != 1 {
+		t.Errorf("Unexpected worker %+v", worker)
+	}
+	if reply.Update != nil {
+		t.Errorf("Expected no update without a published release, got %+v", reply.Update)
+	}
+
+	// Re-registering, as after a self-update, does not count against the limit
+	args.Version = "1.5.0"
+	if err := coordinator.RegisterWorker(args, &reply); err != nil {
+		t.Fatalf("Expected worker to re-register, got %v", err)
+	}
+	if len(coordinator.workers) != 1 || coordinator.workers["worker-1"].Version != "1.5.0" {
+		t.Errorf("Expected re-registration to replace the worker, got %+v", coordinator.workers)
+	}
+}
+
+func TestWorkerRelease(t *testing.T) {
+	binary := filepath.Join(t.TempDir(), "worker")
+	os.WriteFile(binary, []byte("worker binary"), 0755)
+	publisher, err := protocol.NewPublisher(binary, "1.5.0", protocol.Version)
+	if err != nil {
+		t.Fatalf("NewPublisher failed: %v", err)
+	}
+
+	coordinator := NewBuildCoordinator(5)
+	coordinator.minWorkerProtocol = 1
+	coordinator.workerRelease = publisher
+
+	var registered RegisterWorkerReply
+	args := &RegisterWorkerArgs{ID: "worker-1", Host: "localhost", Port: 8082, ProtocolVersion: protocol.Version}
+	if err := coordinator.RegisterWorker(args, &registered); err != nil {
+		t.Fatalf("RegisterWorker failed: %v", err)
+	}
+	if registered.Update == nil || registered.Update.Version != "1.5.0" {
+		t.Errorf("Expected the published release on registration, got %+v", registered.Update)
+	}
+
+	var release GetWorkerReleaseReply
+	coordinator.GetWorkerRelease(&GetWorkerReleaseArgs{ID: "worker-1"}, &release)
+	if release.MinProtocolVersion != 1 || release.Release == nil || release.Release.SHA256 != registered.Update.SHA256 {
+		t.Errorf("Unexpected release %+v", release)
+	}
+
+	var download DownloadWorkerBinaryReply
+	if err := coordinator.DownloadWorkerBinary(&DownloadWorkerBinaryArgs{ID: "worker-1", SHA256: release.Release.SHA256}, &download); err != nil {
+		t.Fatalf("DownloadWorkerBinary failed: %v", err)
+	}
+	if string(download.Data) != "worker binary" {
+		t.Errorf("Unexpected binary %q", download.Data)
+	}
+
+	if err := coordinator.DownloadWorkerBinary(&DownloadWorkerBinaryArgs{ID: "worker-1", SHA256: "stale"}, &download); err == nil {
+		t.Error("Expected error for a release that is no longer published")
+	}
+
+	w := httptest.NewRecorder()
+	coordinator.routes(nil).ServeHTTP(w, httptest.NewRequest("GET", "/api/workers/release", nil))
+	if !strings.Contains(w.Body.String(), `"version":"1.5.0"`) {
+		t.Errorf("Expected the release to be served, got %s", w.Body.String())
+	}
+}
+
+// repoWorker records the repository requests it receives and fails them,
+// echoing the credentials
+type repoWorker struct {
+	received chan BuildRequest
+}
+
+func (r *repoWorker) Build(request BuildRequest, response *string) error {
+	r.received <- request
+	return fmt.Errorf("fetch with %s failed", request.GitCredentials)
+}
+
+func TestBuildFromRepository(t *testing.T) {
+	t.Setenv("TEST_GIT_TOKEN", "s3cr3t-git-token")
+	coordinator := NewBuildCoordinator(5)
+	coordinator.buildPolicy = validation.BuildPolicy{ProjectRoots: []string{"/test"}, TaskPatterns: []string{"build"}}
+	store, err := secrets.NewStore(map[string]secrets.Reference{
+		"git-token": {EnvVar: "GIT_TOKEN", Backend: secrets.BackendEnv, Key: "TEST_GIT_TOKEN"},
+	}, nil)
+	if err != nil {
+		t.Fatalf("NewStore failed: %v", err)
+	}
+	coordinator.secretStore = store
+	handler := coordinator.routes(nil)
+
+	rejected := map[string]string{
+		"local repository":    `{"repo_url":"file:///srv/app.git","task_name":"build"}`,
+		"option as ref":       `{"repo_url":"https://git.example.com/app.git","ref":"--upload-pack=x","task_name":"build"}`,
+		"absolute directory":  `{"repo_url":"https://git.example.com/app.git","project_path":"/test/app","task_name":"build"}`,
+		"directory escape":    `{"repo_url":"https://git.example.com/app.git","project_path":"../app","task_name":"build"}`,
+		"disallowed task":     `{"repo_url":"https://git.example.com/app.git","task_name":"publish"}`,
+		"unknown credentials": `{"repo_url":"https://git.example.com/app.git","task_name":"build","credentials":"deploy-key"}`,
+		"ref without repo":    `{"project_path":"/test/app","ref":"main","task_name":"build"}`,
+	}
+	for name, body := range rejected {
+		t.Run(name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, httptest.NewRequest("POST", "/api/build", strings.NewReader(body)))
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("Expected status %d, got %d: %s", http.StatusBadRequest, w.Code, w.Body.String())
+			}
+		})
+	}
+	if len(coordinator.builds) != 0 {
+		t.Fatalf("Expected no build to be queued, got %d", len(coordinator.builds))
+	}
+
+	w := httptest.NewRecorder()
+	body := `{"repo_url":"https://git.example.com/app.git","ref":"release/1.0","project_path":"android/","task_name":"build","credentials":"git-token"}`
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/api/build", strings.NewReader(body)))
+	var submitted SubmitBuildResponse
+	if err := json.NewDecoder(w.Body).Decode(&submitted); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("Expected build to be queued, got %d: %v", w.Code, err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+	fake := &repoWorker{received: make(chan BuildRequest, 1)}
+	server := rpc.NewServer()
+	server.RegisterName("WorkerService", fake)
+	go server.Accept(listener)
+
+	worker := &Worker{ID: "worker-1", Host: "127.0.0.1", Port: listener.Addr().(*net.TCPAddr).Port, MaxBuilds: 1, ActiveBuilds: 1}
+	coordinator.executeBuildOnWorker(worker, <-coordinator.buildQueue)
+
+	request := <-fake.received
+	if request.RepoURL != "https://git.example.com/app.git" || request.Ref != "release/1.0" || request.ProjectPath != "android" {
+		t.Errorf("Unexpected repository request %+v", request)
+	}
+	if request.GitCredentials != "s3cr3t-git-token" {
+		t.Errorf("Expected the worker to receive the credentials, got %q", request.GitCredentials)
+	}
+	if message := coordinator.builds[submitted.BuildID].ErrorMessage; !strings.Contains(message, "fetch with "+secrets.MaskedValue+" failed") {
+		t.Errorf("Expected the credentials to be masked in the error, got %q", message)
+	}
+}
+
+func TestResultCache(t *testing.T) {
+	coordinator := NewBuildCoordinator(5)
+	coordinator.buildPolicy = validation.BuildPolicy{TaskPatterns: []string{"build"}}
+	coordinator.resultTTL = time.Hour
+	handler := coordinator.routes(nil)
+
+	submit := func(body string) SubmitBuildResponse {
+		t.Helper()
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("POST", "/api/build", strings.NewReader(body)))
+		var submitted SubmitBuildResponse
+		if err := json.NewDecoder(w.Body).Decode(&submitted); err != nil || w.Code != http.StatusOK {
+			t.Fatalf("Expected build to be submitted, got %d: %v", w.Code, err)
+		}
+		return submitted
+	}
+
+	body := `{"repo_url":"https://git.example.com/app.git","ref":"v1.0","task_name":"build","build_options":{"a":"1","b":"2"},"secrets":[]}`
+	first := submit(body)
+	if first.Status != BuildStatusQueued {
+		t.Fatalf("Expected the first build to be queued, got %+v", first)
+	}
+	<-coordinator.buildQueue
+	coordinator.builds[first.BuildID].Artifacts = []string{"app.apk"}
+	coordinator.markBuildCompleted(first.BuildID, "worker-1")
+
+	// Option order and worker settings do not change the result
+	reused := submit(`{"task_name":"build","ref":"v1.0","repo_url":"https://git.example.com/app.git","build_options":{"b":"2","a":"1"},"cache_enabled":true}`)
+	if reused.Status != BuildStatusCompleted || reused.CachedFrom != first.BuildID || reused.BuildID == first.BuildID {
+		t.Fatalf("Expected the result of %s to be reused, got %+v", first.BuildID, reused)
+	}
+	response, _ := coordinator.GetBuildStatus(reused.BuildID)
+	if !response.Success || response.WorkerID != "worker-1" || len(response.Artifacts) != 1 || response.RequestID != reused.BuildID {
+		t.Errorf("Expected the cached response, got %+v", response)
+	}
+	if progress, _ := coordinator.GetBuildProgress(reused.BuildID); progress.Status != BuildStatusCompleted {
+		t.Errorf("Expected the reused build to be completed, got %s", progress.Status)
+	}
+	if len(coordinator.buildQueue) != 0 {
+		t.Error("Expected a reused build not to be queued")
+	}
+
+	for name, other := range map[string]string{
+		"forced":        `{"repo_url":"https://git.example.com/app.git","ref":"v1.0","task_name":"build","build_options":{"a":"1","b":"2"},"force":true}`,
+		"other ref":     `{"repo_url":"https://git.example.com/app.git","ref":"v1.1","task_name":"build","build_options":{"a":"1","b":"2"}}`,
+		"other options": `{"repo_url":"https://git.example.com/app.git","ref":"v1.0","task_name":"build","build_options":{"a":"1"}}`,
+	} {
+		if submitted := submit(other); submitted.Status != BuildStatusQueued || submitted.CachedFrom != "" {
+			t.Errorf("Expected the %s build to be queued, got %+v", name, submitted)
+		}
+		<-coordinator.buildQueue
+	}
+
+	// Expired results are rebuilt
+	coordinator.mutex.Lock()
+	for key, cached := range coordinator.results {
+		cached.expires = time.Now().Add(-time.Second)
+		coordinator.results[key] = cached
+	}
+	coordinator.mutex.Unlock()
+	if submitted := submit(body); submitted.Status != BuildStatusQueued {
+		t.Errorf("Expected an expired result to be rebuilt, got %+v", submitted)
+	}
+}
+
+func TestResultCacheSkipsLocalAndFailedBuilds(t *testing.T) {
+	coordinator := NewBuildCoordinator(5)
+	coordinator.resultTTL = time.Hour
+
+	local := BuildRequest{ProjectPath: "/test/app", TaskName: "build"}
+	id, _ := coordinator.SubmitBuild(local)
+	<-coordinator.buildQueue
+	coordinator.markBuildCompleted(id, "worker-1")
+
+	repo := BuildRequest{RepoURL: "https://git.example.com/app.git", TaskName: "build"}
+	id, _ = coordinator.SubmitBuild(repo)
+	<-coordinator.buildQueue
+	coordinator.markBuildFailed(id, protocol.ErrorCompile, "compilation failed")
+
+	if len(coordinator.results) != 0 {
+		t.Fatalf("Expected no cached result, got %d", len(coordinator.results))
+	}
+	for _, request := range []BuildRequest{local, repo} {
+		coordinator.SubmitBuild(request)
+		if len(coordinator.buildQueue) != 1 {
+			t.Fatalf("Expected %+v to be rebuilt", request)
+		}
+		<-coordinator.buildQueue
+	}
+}
+
+// copyWorker is a fake worker whose builds finish when told to
+type copyWorker struct {
+	id      string
+	started chan string
+	finish  chan error
+}
+
+func (c *copyWorker) Build(request BuildRequest, response *string) error {
+	c.started <- c.id
+	return <-c.finish
+}
+
+// newSpeculatingCoordinator returns a coordinator duplicating critical builds
+// of /test/app that run 50% past their predicted 20ms, with two fake workers
+func newSpeculatingCoordinator(t *testing.T) (*BuildCoordinator, chan string, map[string]*copyWorker) {
+	t.Helper()
+	coordinator := NewBuildCoordinator(5)
+	coordinator.speculation = SpeculationConfig{Enabled: true, ThresholdPercent: 50, MinDuration: time.Hour, MinSamples: 3, RetryInterval: time.Millisecond}
+	for i := 0; i < 3; i++ {
+		coordinator.buildStore.Save(buildstore.Record{ProjectPath: "/test/app", TaskName: "build", Status: buildstore.StatusCompleted, Duration: 20 * time.Millisecond})
+	}
+
+	started := make(chan string, 2)
+	fakes := make(map[string]*copyWorker)
+	for _, id := range []string{"worker-1", "worker-2"} {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Failed to listen: %v", err)
+		}
+		t.Cleanup(func() { listener.Close() })
+		fakes[id] = &copyWorker{id: id, started: started, finish: make(chan error, 1)}
+		server := rpc.NewServer()
+		server.RegisterName("WorkerService", fakes[id])
+		go server.Accept(listener)
+
+		coordinator.workers[id] = &Worker{ID: id, Host: "127.0.0.1", Port: listener.Addr().(*net.TCPAddr).Port, Status: "idle", MaxBuilds: 1, LastPing: time.Now()}
+	}
+	return coordinator, started, fakes
+}
+
+// waitForStatus waits until a build has reached a status
+func waitForStatus(t *testing.T, coordinator *BuildCoordinator, buildID, status string) BuildProgress {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		progress, _ := coordinator.GetBuildProgress(buildID)
+		if progress.Status == status || time.Now().After(deadline) {
+			if progress.Status != status {
+				t.Fatalf("Expected build %s to be %s, got %s", buildID, status, progress.Status)
+			}
+			return *progress
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// startCopies submits a build and returns the workers running its first copy
+// and its speculative copy
+func startCopies(t *testing.T, coordinator *BuildCoordinator, started chan string, request BuildRequest) (string, string, string) {
+	t.Helper()
+	buildID, err := coordinator.SubmitBuild(request)
+	if err != nil {
+		t.Fatalf("SubmitBuild failed: %v", err)
+	}
+	coordinator.startBuild(<-coordinator.buildQueue)
+
+	var copies []string
+	for len(copies) < 2 {
+		select {
+		case id := <-started:
+			copies = append(copies, id)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected the build to be duplicated, started on %v", copies)
+		}
+	}
+	return buildID, copies[0], copies[1]
+}
+
+func TestSpeculativeCopyWins(t *testing.T) {
+	coordinator, started, fakes := newSpeculatingCoordinator(t)
+	rpc := &CoordinatorRPC{coordinator}
+
+	buildID, primary, backup := startCopies(t, coordinator, started, BuildRequest{ProjectPath: "/test/app", TaskName: "build", Critical: true})
+
+	// Only the copy shown in the build's progress reports it
+	var progressReply ReportProgressReply
+	rpc.ReportProgress(&ReportProgressArgs{BuildID: buildID, WorkerID: backup, Step: ":compileJava", Progress: 50}, &progressReply)
+	if progress, _ := coordinator.GetBuildProgress(buildID); progress.WorkerID != primary || progress.Step == ":compileJava" {
+		t.Errorf("Expected the first copy's progress, got %+v", progress)
+	}
+
+	var artifactsReply ReportArtifactsReply
+	for _, id := range []string{primary, backup} {
+		args := &ReportArtifactsArgs{BuildID: buildID, WorkerID: id, Artifacts: []types.Artifact{{Path: id + ".jar"}}}
+		if err := rpc.ReportArtifacts(args, &artifactsReply); err != nil {
+			t.Fatalf("ReportArtifacts from %s failed: %v", id, err)
+		}
+	}
+
+	fakes[backup].finish <- nil
+	progress := waitForStatus(t, coordinator, buildID, BuildStatusCompleted)
+	response, _ := coordinator.GetBuildStatus(buildID)
+	if progress.WorkerID != backup || response.WorkerID != backup || len(response.Artifacts) != 1 || response.Artifacts[0] != backup+".jar" {
+		t.Errorf("Expected the speculative copy's result, got %+v", response)
+	}
+
+	// The losing copy is stopped and its failure ignored
+	progressReply = ReportProgressReply{}
+	rpc.ReportProgress(&ReportProgressArgs{BuildID: buildID, WorkerID: primary, Step: ":test"}, &progressReply)
+	if !progressReply.Cancelled {
+		t.Error("Expected the losing copy to be cancelled")
+	}
+	fakes[primary].finish <- fmt.Errorf("build cancelled by coordinator")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		coordinator.mutex.RLock()
+		remaining := len(coordinator.speculations)
+		coordinator.mutex.RUnlock()
+		if remaining == 0 || time.Now().After(deadline) {
+			if remaining != 0 {
+				t.Fatal("Expected the duplicated build to be forgotten")
+			}
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if progress, _ := coordinator.GetBuildProgress(buildID); progress.Status != BuildStatusCompleted {
+		t.Errorf("Expected the build to stay completed, got %s", progress.Status)
+	}
+}
+
+func TestSpeculativeBuildFailsWhenBothCopiesFail(t *testing.T) {
+	coordinator, started, fakes := newSpeculatingCoordinator(t)
+
+	buildID, primary, backup := startCopies(t, coordinator, started, BuildRequest{ProjectPath: "/test/app", TaskName: "build", Critical: true})
+
+	fakes[primary].finish <- fmt.Errorf("worker disk full")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		progress, _ := coordinator.GetBuildProgress(buildID)
+		if progress.WorkerID == backup || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if progress, _ := coordinator.GetBuildProgress(buildID); progress.Status != BuildStatusRunning || progress.WorkerID != backup {
+		t.Fatalf("Expected the build to continue on the other copy, got %+v", progress)
+	}
+
+	fakes[backup].finish <- fmt.Errorf("compilation failed")
+	waitForStatus(t, coordinator, buildID, BuildStatusFailed)
+	if response, _ := coordinator.GetBuildStatus(buildID); !strings.Contains(response.ErrorMessage, "compilation failed") {
+		t.Errorf("Expected the last copy's error, got %q", response.ErrorMessage)
+	}
+}
+
+func TestSpeculationDeadline(t *testing.T) {
+	coordinator, _, _ := newSpeculatingCoordinator(t)
+
+	if deadline, ok := coordinator.speculationDeadline(BuildRequest{ProjectPath: "/test/app", TaskName: "build", Critical: true}, nil); !ok || deadline != 30*time.Millisecond {
+		t.Errorf("Expected a critical build to be duplicated after 30ms, got %v, %v", deadline, ok)
+	}
+	if _, ok := coordinator.speculationDeadline(BuildRequest{ProjectPath: "/test/app", TaskName: "build"}, nil); ok {
+		t.Error("Expected a short build not to be duplicated")
+	}
+	if _, ok := coordinator.speculationDeadline(BuildRequest{ProjectPath: "/test/app", TaskName: "test", Critical: true}, nil); ok {
+		t.Error("Expected a build without history not to be duplicated")
+	}
+
+	coordinator.speculation.MinDuration = 10 * time.Millisecond
+	if _, ok := coordinator.speculationDeadline(BuildRequest{ProjectPath: "/test/app", TaskName: "build"}, nil); !ok {
+		t.Error("Expected a long build to be duplicated")
+	}
+	coordinator.speculation.Enabled = false
+	if _, ok := coordinator.speculationDeadline(BuildRequest{ProjectPath: "/test/app", TaskName: "build", Critical: true}, nil); ok {
+		t.Error("Expected no duplicates with speculation disabled")
+	}
+}
+
+func TestWorkerSpeedFromCalibration(t *testing.T) {
+	coordinator := NewBuildCoordinator(5)
+	for _, args := range []RegisterWorkerArgs{
+		{ID: "slow", Calibration: &calibration.Scores{CPUSingleCore: 100, CPUMultiCore: 400}},
+		{ID: "typical", Calibration: &calibration.Scores{CPUSingleCore: 200, CPUMultiCore: 800}},
+		{ID: "fast", Calibration: &calibration.Scores{CPUSingleCore: 400, CPUMultiCore: 1600}},
+		{ID: "uncalibrated"},
+	} {
+		if err := coordinator.RegisterWorker(&args, &RegisterWorkerReply{}); err != nil {
+			t.Fatalf("RegisterWorker failed: %v", err)
+		}
+	}
+
+	expected := map[string]float64{"slow": 0.5, "typical": 1, "fast": 2, "uncalibrated": 0}
+	for id, speed := range expected {
+		if actual := coordinator.workerSpeed(coordinator.workers[id]); actual != speed {
+			t.Errorf("Expected %s to run at %vx the typical speed, got %v", id, speed, actual)
+		}
+	}
+
+	// Durations predicted from the build history are scaled to the worker
+	coordinator.speculation.MinSamples = 3
+	for i := 0; i < 3; i++ {
+		coordinator.buildStore.Save(buildstore.Record{ProjectPath: "/test/app", TaskName: "build", Status: buildstore.StatusCompleted, Duration: time.Minute})
+	}
+	if duration, ok := coordinator.predictDuration(BuildRequest{ProjectPath: "/test/app", TaskName: "build"}, coordinator.workers["slow"]); !ok || duration != 2*time.Minute {
+		t.Errorf("Expected the slow worker to take twice the median, got %v, %v", duration, ok)
+	}
+}
+
+// stubMLService predicts every build to take three minutes, based on ten
+// builds
+type stubMLService struct{}
+
+func (stubMLService) Predict(args mlrpc.PredictArgs, reply *service.PredictionResult) error {
+	*reply = service.PredictionResult{PredictedTime: 3 * time.Minute, SampleSize: 10}
+	return nil
+}
+
+func TestPredictDurationWithMLService(t *testing.T) {
+	coordinator, _, _ := newSpeculatingCoordinator(t)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	server := rpc.NewServer()
+	server.RegisterName("MLService", stubMLService{})
+	go server.Accept(listener)
+
+	coordinator.ml = mlrpc.NewClient(listener.Addr().String(), 1, time.Second, localPredictor{coordinator})
+	if duration, ok := coordinator.predictDuration(BuildRequest{ProjectPath: "/test/app", TaskName: "build"}, nil); !ok || duration != 3*time.Minute {
+		t.Errorf("Expected the prediction of the ML service, got %v, %v", duration, ok)
+	}
+
+	// While the ML service is down the build history is used
+	listener.Close()
+	coordinator.ml.Close()
+	coordinator.ml = mlrpc.NewClient(listener.Addr().String(), 1, 100*time.Millisecond, localPredictor{coordinator})
+	if duration, ok := coordinator.predictDuration(BuildRequest{ProjectPath: "/test/app", TaskName: "build"}, nil); !ok || duration != 20*time.Millisecond {
+		t.Errorf("Expected the median of the build history, got %v, %v", duration, ok)
+	}
+	if _, ok := coordinator.predictDuration(BuildRequest{ProjectPath: "/test/app", TaskName: "test"}, nil); ok {
+		t.Error("Expected no prediction without history")
+	}
+}
+
+// riskyMLService predicts every build to fail with the same risk
+type riskyMLService struct {
+	risk float64
+}
+
+func (s riskyMLService) Predict(args mlrpc.PredictArgs, reply *service.PredictionResult) error {
+	*reply = service.PredictionResult{FailureRisk: s.risk, SampleSize: 10}
+	return nil
+}
+
+func TestAdmission(t *testing.T) {
+	coordinator := NewBuildCoordinator(5)
+	coordinator.admission = AdmissionConfig{RiskThreshold: 0.8, CommitFailures: 2}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	server := rpc.NewServer()
+	server.RegisterName("MLService", riskyMLService{risk: 0.9})
+	go server.Accept(listener)
+	coordinator.ml = mlrpc.NewClient(listener.Addr().String(), 1, time.Second, localPredictor{coordinator})
+	handler := coordinator.routes(nil)
+
+	commit := "0123456789abcdef0123456789abcdef01234567"
+	for _, id := range []string{"failed-1", "failed-2"} {
+		coordinator.buildStore.Save(buildstore.Record{BuildID: id, ProjectPath: "app", TaskName: "build", RepoURL: "https://git.example.com/app.git", Ref: commit, Status: buildstore.StatusFailed})
+	}
+	submit := func(ref string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		body := fmt.Sprintf(`{"repo_url":"https://git.example.com/app.git","ref":%q,"project_path":"app","task_name":"build"}`, ref)
+		handler.ServeHTTP(w, httptest.NewRequest("POST", "/api/build", strings.NewReader(body)))
+		return w
+	}
+
+	w := submit(commit)
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("Expected the build of a failing commit to be rejected, got %d", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "/api/builds/failed-2/log") || !strings.Contains(w.Body.String(), "/api/analytics/failures?project=app") {
+		t.Errorf("Expected links to the last failure and its analysis, got %q", w.Body.String())
+	}
+
+	// Branches and other commits are admitted
+	if w := submit("main"); w.Code != http.StatusOK {
+		t.Errorf("Expected a branch build to be admitted, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := submit("89abcdef0123456789abcdef0123456789abcdef"); w.Code != http.StatusOK {
+		t.Errorf("Expected another commit to be admitted, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// A risk below the threshold admits the build
+	coordinator.admission.RiskThreshold = 0.95
+	if w := submit(commit); w.Code != http.StatusOK {
+		t.Errorf("Expected a build below the risk threshold to be admitted, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestWorkerPools(t *testing.T) {
+	coordinator := NewBuildCoordinator(5)
+	router, err := pools.NewRouter([]pools.Rule{
+		{Label: "release", Pool: "release"},
+		{Project: "/projects/android/*", Pool: "android"},
+	})
+	if err != nil {
+		t.Fatalf("NewRouter failed: %v", err)
+	}
+	coordinator.setRouter(router)
+
+	var reply RegisterWorkerReply
+	for id, pool := range map[string]string{"android-1": "android", "backend-1": "", "release-1": "release"} {
+		if err := coordinator.RegisterWorker(&RegisterWorkerArgs{ID: id, Host: "127.0.0.1", Port: 1, MaxBuilds: 1, Pool: pool}, &reply); err != nil {
+			t.Fatalf("RegisterWorker failed: %v", err)
+		}
+	}
+	if coordinator.workers["backend-1"].Pool != pools.DefaultPool {
+		t.Errorf("Expected a worker without a pool to join the default pool, got %q", coordinator.workers["backend-1"].Pool)
+	}
+	if err := coordinator.RegisterWorker(&RegisterWorkerArgs{ID: "bad", Pool: "Android Fleet"}, &reply); err == nil {
+		t.Error("Expected an invalid pool name to be rejected")
+	}
+
+	handler := coordinator.routes(nil)
+	submit := func(body string) SubmitBuildResponse {
+		t.Helper()
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("POST", "/api/build", strings.NewReader(body)))
+		var submitted SubmitBuildResponse
+		if err := json.NewDecoder(w.Body).Decode(&submitted); err != nil || w.Code != http.StatusOK {
+			t.Fatalf("Expected build to be queued, got %d: %v", w.Code, err)
+		}
+		return submitted
+	}
+
+	builds := map[string]string{
+		"android": submit(`{"project_path":"/projects/android/app","task_name":"assembleDebug"}`).BuildID,
+		"release": submit(`{"project_path":"/projects/android/app","task_name":"assembleRelease","labels":["release"]}`).BuildID,
+		"default": submit(`{"project_path":"/projects/api","task_name":"build"}`).BuildID,
+	}
+	for pool, buildID := range builds {
+		if queued := len(coordinator.queues[pool]); queued != 1 {
+			t.Fatalf("Expected one build in the %s queue, got %d", pool, queued)
+		}
+		request := <-coordinator.queues[pool]
+		if request.RequestID != buildID || request.Pool != pool {
+			t.Errorf("Expected build %s in pool %s, got %s in %s", buildID, pool, request.RequestID, request.Pool)
+		}
+		coordinator.queues[pool] <- request
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/api/build", strings.NewReader(`{"project_path":"/projects/api","task_name":"build","labels":["Release Build"]}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected invalid labels to be rejected, got %d", w.Code)
+	}
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(coordinatorCollector{coordinator})
+	families, _ := registry.Gather()
+	depths := map[string]float64{}
+	for _, family := range families {
+		if family.GetName() != metrics.QueueDepth {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			depths[metric.GetLabel()[0].GetValue()] = metric.GetGauge().GetValue()
+		}
+	}
+	if len(depths) != 3 || depths["android"] != 1 || depths["release"] != 1 || depths[pools.DefaultPool] != 1 {
+		t.Errorf("Expected a queue depth per pool, got %v", depths)
+	}
+
+	// Builds only run on the workers of their pool
+	for pool := range builds {
+		coordinator.startBuild(<-coordinator.queues[pool])
+	}
+	for id, worker := range coordinator.workers {
+		if len(worker.Builds) != 1 || worker.Builds[0].Pool != worker.pool() {
+			t.Errorf("Expected worker %s to run one build of pool %s, got %+v", id, worker.pool(), worker.Builds)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/pools", nil))
+	var stats []PoolStats
+	if err := json.NewDecoder(w.Body).Decode(&stats); err != nil {
+		t.Fatalf("Failed to decode pools: %v", err)
+	}
+	if len(stats) != 3 || stats[0].Name != "android" || stats[0].Workers != 1 || stats[0].Slots != 1 || !stats[0].AcceptsBuilds {
+		t.Errorf("Unexpected pool statistics %+v", stats)
+	}
+}
+
+func TestFairShareScheduling(t *testing.T) {
+	coordinator, started, fakes := newSpeculatingCoordinator(t)
+	config := ratelimit.DefaultConfig()
+	config.Quotas = map[string]ratelimit.Quota{
+		"android-key": {Tenant: "android", RequestsPerSecond: 100, Burst: 100},
+		"backend-key": {Tenant: "backend", RequestsPerSecond: 100, Burst: 100},
+	}
+	coordinator.rateLimiter = ratelimit.NewLimiter(config, "coordinator")
+	handler := coordinator.routes(nil)
+
+	pending := fairshare.NewQueue(coordinator.weights)
+	requests := make(map[string]BuildRequest)
+	submit := func(apiKey string) string {
+		t.Helper()
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/api/build", strings.NewReader(`{"project_path":"/test/project","task_name":"build"}`))
+		r.Header.Set("X-API-Key", apiKey)
+		handler.ServeHTTP(w, r)
+		var submitted SubmitBuildResponse
+		if err := json.NewDecoder(w.Body).Decode(&submitted); err != nil || w.Code != http.StatusOK {
+			t.Fatalf("Expected build to be queued, got %d: %v", w.Code, err)
+		}
+		request := <-coordinator.buildQueue
+		pending.Push(request.Tenant, request.RequestID)
+		requests[request.RequestID] = request
+		return submitted.BuildID
+	}
+	dispatch := func() string {
+		t.Helper()
+		deadline := time.After(5 * time.Second)
+		for {
+			coordinator.dispatchBuilds(pools.DefaultPool, pending, requests)
+			select {
+			case id := <-started:
+				return id
+			case <-deadline:
+				t.Fatal("Expected a pending build to start")
+			case <-time.After(time.Millisecond):
+			}
+		}
+	}
+
+	// The android team fills both slots and keeps builds waiting
+	var android []string
+	for i := 0; i < 4; i++ {
+		android = append(android, submit("android-key"))
+	}
+	dispatch()
+	dispatch()
+	backend := []string{submit("backend-key"), submit("backend-key")}
+	if requests[backend[0]].Tenant != "backend" || pending.Pending()["android"] != 2 {
+		t.Fatalf("Expected two android and two backend builds pending, got %v", pending.Pending())
+	}
+
+	// The first freed slot goes to the backend team despite the older
+	// android builds
+	progress, _ := coordinator.GetBuildProgress(android[0])
+	fakes[progress.WorkerID].finish <- nil
+	waitForStatus(t, coordinator, android[0], BuildStatusCompleted)
+	if worker := dispatch(); worker != progress.WorkerID {
+		t.Errorf("Expected the build to start on %s, got %s", progress.WorkerID, worker)
+	}
+	waitForStatus(t, coordinator, backend[0], BuildStatusRunning)
+	if queued := pending.Pending(); queued["android"] != 2 || queued["backend"] != 1 {
+		t.Errorf("Expected the android builds to keep waiting, got %v", queued)
+	}
+
+	for _, fake := range fakes {
+		fake.finish <- nil
+	}
+}
+
+func TestFederation(t *testing.T) {
+	// The peer has free slots but never starts its builds by itself
+	peer := NewBuildCoordinator(5)
+	var reply RegisterWorkerReply
+	if err := peer.RegisterWorker(&RegisterWorkerArgs{ID: "worker-9", Host: "127.0.0.1", Port: 1, MaxBuilds: 2}, &reply); err != nil {
+		t.Fatalf("RegisterWorker failed: %v", err)
+	}
+	server := httptest.NewServer(peer.routes(nil))
+	defer server.Close()
+
+	coordinator := NewBuildCoordinator(5)
+	coordinator.federation = federation.Config{
+		Name: "dc-east",
+		Peers: []federation.Peer{
+			{Name: "dc-north", URL: "http://127.0.0.1:1"},
+			{Name: "dc-west", URL: server.URL},
+		},
+		Policy:       federation.PolicyOrdered,
+		PollInterval: 10 * time.Millisecond,
+	}
+	coordinator.peers = federation.NewClient("dc-east")
+	go coordinator.processQueue(pools.DefaultPool, coordinator.buildQueue)
+	defer close(coordinator.shutdown)
+
+	handler := coordinator.routes(nil)
+	submit := func(from string) string {
+		t.Helper()
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/api/build", strings.NewReader(`{"project_path":"/test/project","task_name":"build"}`))
+		if from != "" {
+			r.Header.Set(federation.ForwardedHeader, from)
+		}
+		handler.ServeHTTP(w, r)
+		var submitted SubmitBuildResponse
+		if err := json.NewDecoder(w.Body).Decode(&submitted); err != nil || w.Code != http.StatusOK {
+			t.Fatalf("Expected build to be queued, got %d: %v", w.Code, err)
+		}
+		return submitted.BuildID
+	}
+
+	// Without a local worker the build goes to the reachable peer; builds
+	// forwarded by another peer stay
+	received := submit("dc-south")
+	buildID := submit("")
+	waitForStatus(t, coordinator, buildID, BuildStatusRunning)
+	response, _ := coordinator.GetBuildStatus(buildID)
+	if response.ForwardedTo != "dc-west" || response.RemoteBuildID == "" {
+		t.Fatalf("Expected the build to be forwarded to dc-west, got %+v", response)
+	}
+	if progress, _ := coordinator.GetBuildProgress(received); progress.Status != BuildStatusQueued {
+		t.Errorf("Expected a build forwarded by a peer to stay queued, got %s", progress.Status)
+	}
+	peer.mutex.RLock()
+	forwarded := peer.requests[response.RemoteBuildID]
+	peer.mutex.RUnlock()
+	if forwarded.FederatedFrom != "dc-east" || forwarded.ProjectPath != "/test/project" {
+		t.Errorf("Expected the peer to know where the build came from, got %+v", forwarded)
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/status", nil))
+	var status FederatedStatus
+	if err := json.NewDecoder(w.Body).Decode(&status); err != nil {
+		t.Fatalf("Failed to decode status: %v", err)
+	}
+	if status.Coordinator != "dc-east" || len(status.Peers) != 2 || status.Peers[0].Reachable || status.Peers[0].Error == "" || !status.Peers[1].Reachable {
+		t.Errorf("Unexpected peer status %+v", status.Peers)
+	}
+	if status.Local.QueuedBuilds != 1 || status.Total.QueuedBuilds != 2 || status.Total.TotalSlots != 2 || status.Total.Workers != 1 {
+		t.Errorf("Expected the statistics of both coordinators to add up, got %+v", status.Total)
+	}
+
+	// The peer's result becomes the build's result
+	peer.mutex.Lock()
+	peer.builds[response.RemoteBuildID].Artifacts = []string{"app/build/libs/app.jar"}
+	peer.mutex.Unlock()
+	peer.markBuildCompleted(response.RemoteBuildID, "worker-9")
+	waitForStatus(t, coordinator, buildID, BuildStatusCompleted)
+	response, _ = coordinator.GetBuildStatus(buildID)
+	if !response.Success || response.WorkerID != "dc-west/worker-9" || len(response.Artifacts) != 1 {
+		t.Errorf("Expected the peer's result, got %+v", response)
+	}
+}
+
+type restartedWorker struct {
+	reply PingReply
+}
+
+func (p *restartedWorker) Ping(args PingArgs, reply *PingReply) error {
+	*reply = p.reply
+	return nil
+}
+
+func TestWorkerRegistryReconciliation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "workers.json")
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+	server := rpc.NewServer()
+	server.RegisterName("WorkerService", &restartedWorker{reply: PingReply{ID: "worker-1", ActiveBuilds: 1, MaxBuilds: 2, Version: "1.1.0", Pool: "android"}})
+	go server.Accept(listener)
+
+	// A worker that is gone by the time the coordinator restarts
+	gone, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	gone.Close()
+
+	first := NewBuildCoordinator(5)
+	first.registry, _ = registry.Open(path)
+	for _, args := range []RegisterWorkerArgs{
+		{ID: "worker-1", Host: "127.0.0.1", Port: listener.Addr().(*net.TCPAddr).Port, MaxBuilds: 2, Version: "1.0.0",
+			Calibration: &calibration.Scores{CPUSingleCore: 200, Cores: 4}},
+		{ID: "worker-2", Host: "127.0.0.1", Port: gone.Addr().(*net.TCPAddr).Port, MaxBuilds: 1},
+		{ID: "worker-3", Host: "127.0.0.1", Port: 1, MaxBuilds: 1},
+	} {
+		if err := first.RegisterWorker(&args, &RegisterWorkerReply{}); err != nil {
+			t.Fatalf("RegisterWorker failed: %v", err)
+		}
+	}
+	if err := first.UnregisterWorker(&UnregisterWorkerArgs{ID: "worker-3"}, &UnregisterWorkerReply{}); err != nil {
+		t.Fatalf("UnregisterWorker failed: %v", err)
+	}
+
+	restarted := NewBuildCoordinator(5)
+	restarted.registry, _ = registry.Open(path)
+	if entries := restarted.registry.List(); len(entries) != 2 {
+		t.Fatalf("Expected two registered workers to be persisted, got %+v", entries)
+	}
+	restarted.reconcileWorkers()
+
+	worker, exists := restarted.workers["worker-1"]
+	if !exists || len(restarted.workers) != 1 {
+		t.Fatalf("Expected only the reachable worker to be restored, got %v", restarted.workers)
+	}
+	if worker.ActiveBuilds != 1 || worker.Status != "idle" || worker.Version != "1.1.0" || worker.Pool != "android" ||
+		worker.Calibration == nil || worker.Calibration.CPUSingleCore != 200 {
+		t.Errorf("Expected the worker's current load and version, got %+v", worker)
+	}
+	if entries := restarted.registry.List(); len(entries) != 1 || entries[0].ID != "worker-1" {
+		t.Errorf("Expected the unreachable worker to be forgotten, got %+v", entries)
+	}
+
+	// The build running before the restart frees its slot once it finishes
+	restarted.Heartbeat(&HeartbeatArgs{ID: "worker-1", ActiveBuilds: 1}, &HeartbeatReply{})
+	if worker.ActiveBuilds != 1 {
+		t.Errorf("Expected the running build to hold its slot, got %d", worker.ActiveBuilds)
+	}
+	restarted.Heartbeat(&HeartbeatArgs{ID: "worker-1", ActiveBuilds: 0}, &HeartbeatReply{})
+	if worker.ActiveBuilds != 0 || worker.OrphanedBuilds != 0 {
+		t.Errorf("Expected the finished build to free its slot, got %+v", worker)
+	}
+}
+
+type hangingWorker struct {
+	release chan struct{}
+}
+
+func (h *hangingWorker) Build(request BuildRequest, response *string) error {
+	<-h.release
+	return nil
+}
+
+func TestStaleBuildRecovery(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+	fake := &hangingWorker{release: make(chan struct{})}
+	defer close(fake.release)
+	server := rpc.NewServer()
+	server.RegisterName("WorkerService", fake)
+	go server.Accept(listener)
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	coordinator := NewBuildCoordinator(5)
+	coordinator.recovery.MaxRequeues = 1
+	register := func(id string) *Worker {
+		args := RegisterWorkerArgs{ID: id, Host: "127.0.0.1", Port: port, MaxBuilds: 1}
+		if err := coordinator.RegisterWorker(&args, &RegisterWorkerReply{}); err != nil {
+			t.Fatalf("RegisterWorker failed: %v", err)
+		}
+		return coordinator.workers[id]
+	}
+	// waitForResult waits until the RPC to the evicted worker returned
+	waitForResult := func(worker *Worker) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			coordinator.mutex.RLock()
+			pending := len(worker.inflight)
+			coordinator.mutex.RUnlock()
+			if pending == 0 {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("Expected the wait for the evicted worker's result to end")
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	worker := register("worker-1")
+	buildID, err := coordinator.SubmitBuild(BuildRequest{ProjectPath: "/test/project", TaskName: "build"})
+	if err != nil {
+		t.Fatalf("SubmitBuild failed: %v", err)
+	}
+	if !coordinator.startBuild(<-coordinator.buildQueue) {
+		t.Fatal("Expected the build to start")
+	}
+	updates, stop, err := coordinator.watchProgress(buildID)
+	if err != nil {
+		t.Fatalf("watchProgress failed: %v", err)
+	}
+	defer stop()
+
+	// A worker with a recent heartbeat is kept
+	coordinator.evictStaleWorkers(time.Now())
+	if _, exists := coordinator.workers["worker-1"]; !exists {
+		t.Fatal("Expected a live worker to be kept")
+	}
+
+	// The build of a worker that missed its heartbeats is re-queued and
+	// watching clients are told
+	coordinator.evictStaleWorkers(time.Now().Add(2 * coordinator.recovery.HeartbeatTimeout))
+	if _, exists := coordinator.workers["worker-1"]; exists {
+		t.Fatal("Expected the stale worker to be evicted")
+	}
+	if update := <-updates; update.Status != BuildStatusQueued || !strings.Contains(update.Message, "worker-1 stopped sending heartbeats") {
+		t.Errorf("Expected watchers to see the build re-queued, got %+v", update)
+	}
+	waitForResult(worker)
+	if progress, _ := coordinator.GetBuildProgress(buildID); progress.Status != BuildStatusQueued {
+		t.Errorf("Expected the lost worker's result to be ignored, got %s", progress.Status)
+	}
+	requeued := <-coordinator.buildQueue
+	if requeued.RequestID != buildID || requeued.Requeues != 1 {
+		t.Fatalf("Expected the build back in its queue, got %+v", requeued)
+	}
+
+	// Once it ran out of re-queues the build fails
+	worker = register("worker-2")
+	if !coordinator.startBuild(requeued) {
+		t.Fatal("Expected the re-queued build to start")
+	}
+	waitForStatus(t, coordinator, buildID, BuildStatusRunning)
+	coordinator.evictStaleWorkers(time.Now().Add(2 * coordinator.recovery.HeartbeatTimeout))
+	waitForResult(worker)
+	response, _ := coordinator.GetBuildStatus(buildID)
+	if response.Success || !strings.Contains(response.ErrorMessage, "worker-2 stopped sending heartbeats") {
+		t.Errorf("Expected the build to fail, got %+v", response)
+	}
+	if events, _ := coordinator.auditLog.Query(audit.Filter{Action: audit.ActionWorkerEvicted}); len(events) != 2 {
+		t.Errorf("Expected both evictions to be audited, got %d", len(events))
+	}
+}
+
+func TestSpotPreemption(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+	fake := &hangingWorker{release: make(chan struct{})}
+	defer close(fake.release)
+	server := rpc.NewServer()
+	server.RegisterName("WorkerService", fake)
+	go server.Accept(listener)
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	coordinator := NewBuildCoordinator(5)
+	// Preempted builds are re-queued even without re-queues left
+	coordinator.recovery.MaxRequeues = 0
+	register := func(id string, spot bool) *Worker {
+		args := RegisterWorkerArgs{ID: id, Host: "127.0.0.1", Port: port, MaxBuilds: 1, Spot: spot}
+		if err := coordinator.RegisterWorker(&args, &RegisterWorkerReply{}); err != nil {
+			t.Fatalf("RegisterWorker failed: %v", err)
+		}
+		return coordinator.workers[id]
+	}
+
+	worker := register("spot-1", true)
+	buildID, _ := coordinator.SubmitBuild(BuildRequest{ProjectPath: "/projects/app", TaskName: "build"})
+	if !coordinator.startBuild(<-coordinator.buildQueue) {
+		t.Fatal("Expected the build to start on the spot worker")
+	}
+	updates, stop, err := coordinator.watchProgress(buildID)
+	if err != nil {
+		t.Fatalf("watchProgress failed: %v", err)
+	}
+	defer stop()
+
+	if err := coordinator.ReportPreemption(&ReportPreemptionArgs{ID: "unknown", Reason: "SIGTERM"}, &ReportPreemptionReply{}); err == nil {
+		t.Error("Expected an error for an unknown worker")
+	}
+	var reply ReportPreemptionReply
+	if err := coordinator.ReportPreemption(&ReportPreemptionArgs{ID: "spot-1", Reason: "metadata"}, &reply); err != nil || reply.Builds != 1 {
+		t.Fatalf("Expected the preemption to hand back the build, got %+v: %v", reply, err)
+	}
+	if _, exists := coordinator.workers["spot-1"]; exists {
+		t.Fatal("Expected the preempted worker to be removed")
+	}
+	if update := <-updates; update.Status != BuildStatusQueued || !strings.Contains(update.Message, "spot-1 was preempted") {
+		t.Errorf("Expected watchers to see the build re-queued, got %+v", update)
+	}
+	requeued := <-coordinator.buildQueue
+	if requeued.RequestID != buildID || !requeued.Preempted || requeued.Requeues != 0 {
+		t.Fatalf("Expected the build back in its queue as preempted, got %+v", requeued)
+	}
+	if events, _ := coordinator.auditLog.Query(audit.Filter{Action: audit.ActionWorkerPreempted}); len(events) != 1 || events[0].Details["reason"] != "metadata" {
+		t.Errorf("Expected the preemption to be audited, got %+v", events)
+	}
+	coordinator.mutex.RLock()
+	inflight := len(worker.inflight)
+	coordinator.mutex.RUnlock()
+	if inflight != 1 || !worker.inflight[buildID].recovered {
+		t.Errorf("Expected the preempted worker's result to be ignored")
+	}
+
+	// The preempted build prefers the worker that is not a spot instance,
+	// even if the spot worker has a warm cache
+	register("on-demand", false)
+	register("spot-2", true).Builds = []BuildRequest{{ProjectPath: "/projects/app"}}
+	if !coordinator.startBuild(requeued) {
+		t.Fatal("Expected the re-queued build to start")
+	}
+	if progress, _ := coordinator.GetBuildProgress(buildID); progress.WorkerID != "on-demand" {
+		t.Errorf("Expected the build to avoid the spot worker, got %s", progress.WorkerID)
+	}
+
+	// Builds predicted to run long avoid spot workers too
+	spot := []*Worker{coordinator.workers["spot-2"]}
+	for range 5 {
+		coordinator.buildStore.Save(buildstore.Record{ProjectPath: "/projects/long", TaskName: "build", Status: buildstore.StatusCompleted, Duration: time.Hour})
+		coordinator.buildStore.Save(buildstore.Record{ProjectPath: "/projects/short", TaskName: "build", Status: buildstore.StatusCompleted, Duration: time.Minute})
+	}
+	if !coordinator.avoidsSpotWorkers(BuildRequest{ProjectPath: "/projects/long", TaskName: "build"}, spot) {
+		t.Error("Expected a long build to avoid spot workers")
+	}
+	if coordinator.avoidsSpotWorkers(BuildRequest{ProjectPath: "/projects/short", TaskName: "build"}, spot) {
+		t.Error("Expected a short build to run on spot workers")
+	}
+	if coordinator.avoidsSpotWorkers(BuildRequest{ProjectPath: "/projects/unknown", TaskName: "build"}, spot) {
+		t.Error("Expected a build without a prediction to run on spot workers")
+	}
+}
+
+func TestLoadSpotConfig(t *testing.T) {
+	if config := loadSpotConfig(); config.MaxDuration != 10*time.Minute {
+		t.Errorf("Unexpected default spot configuration %+v", config)
+	}
+	t.Setenv("SPOT_MAX_BUILD_DURATION", "0")
+	if config := loadSpotConfig(); config.MaxDuration != 0 {
+		t.Errorf("Expected the duration preference to be disabled, got %+v", config)
+	}
+}
+
+func TestWorkerQuarantine(t *testing.T) {
+	coordinator := NewBuildCoordinator(5)
+	handler := coordinator.routes(nil)
+	request := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w
+	}
+	var reply RegisterWorkerReply
+	coordinator.RegisterWorker(&RegisterWorkerArgs{ID: "worker-1", Host: "localhost", Port: 8082, MaxBuilds: 2}, &reply)
+	coordinator.RegisterWorker(&RegisterWorkerArgs{ID: "worker-2", Host: "localhost", Port: 8083, MaxBuilds: 2}, &reply)
+
+	// Quarantined workers stay registered but are not selected
+	w := request("POST", "/api/workers/worker-1/quarantine", `{"reason":"corrupted artifacts"}`)
+	var worker Worker
+	if err := json.NewDecoder(w.Body).Decode(&worker); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("Expected the worker to be quarantined, got %d: %v", w.Code, err)
+	}
+	if worker.Quarantine == nil || worker.Quarantine.Reason != "corrupted artifacts" || worker.Quarantine.Automatic {
+		t.Errorf("Expected a manual quarantine, got %+v", worker.Quarantine)
+	}
+	available := coordinator.getAvailableWorkers()
+	if len(available) != 1 || available[0].ID != "worker-2" || len(coordinator.GetWorkers()) != 2 {
+		t.Errorf("Expected only worker-2 to be available, got %v", available)
+	}
+	if w := request("POST", "/api/workers/unknown/quarantine", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown worker, got %d", w.Code)
+	}
+
+	// The quarantine survives the worker registering again
+	coordinator.UnregisterWorker(&UnregisterWorkerArgs{ID: "worker-1"}, &UnregisterWorkerReply{})
+	coordinator.RegisterWorker(&RegisterWorkerArgs{ID: "worker-1", Host: "localhost", Port: 8082, MaxBuilds: 2}, &reply)
+	if coordinator.workers["worker-1"].Quarantine == nil {
+		t.Error("Expected the re-registered worker to stay quarantined")
+	}
+	if entries := coordinator.registry.List(); entries[0].Quarantine == nil {
+		t.Errorf("Expected the quarantine to be saved in the registry, got %+v", entries[0])
+	}
+
+	if w := request("DELETE", "/api/workers/worker-1/quarantine", ""); w.Code != http.StatusOK {
+		t.Fatalf("Expected the worker to be released, got %d", w.Code)
+	}
+	if len(coordinator.getAvailableWorkers()) != 2 {
+		t.Error("Expected the released worker to be available again")
+	}
+	if w := request("DELETE", "/api/workers/worker-1/quarantine", ""); w.Code != http.StatusConflict {
+		t.Errorf("Expected 409 for a worker that is not quarantined, got %d", w.Code)
+	}
+
+	// Workers failing too many of their recent builds are quarantined
+	coordinator.quarantine = QuarantineConfig{FailureRate: 0.75, Window: 4}
+	coordinator.mutex.Lock()
+	for _, success := range []bool{false, true, false, true, false, false} {
+		coordinator.recordBuildOutcome("worker-2", success)
+	}
+	coordinator.mutex.Unlock()
+	quarantine := coordinator.workers["worker-2"].Quarantine
+	if quarantine == nil || !quarantine.Automatic || quarantine.Reason != "failed 3 of its last 4 builds" {
+		t.Errorf("Expected worker-2 to be quarantined for its failure rate, got %+v", quarantine)
+	}
+	events, _ := coordinator.auditLog.Query(audit.Filter{Action: audit.ActionWorkerQuarantined})
+	if len(events) != 2 {
+		t.Errorf("Expected both quarantines to be audited, got %+v", events)
+	}
+}
+
+func TestLoadQuarantineConfig(t *testing.T) {
+	if config := loadQuarantineConfig(); config.FailureRate != 0 || config.Window != 10 {
+		t.Errorf("Unexpected default quarantine configuration %+v", config)
+	}
+	t.Setenv("WORKER_QUARANTINE_FAILURE_RATE", "0.9")
+	t.Setenv("WORKER_QUARANTINE_WINDOW", "-1")
+	if config := loadQuarantineConfig(); config.FailureRate != 0.9 || config.Window != 10 {
+		t.Errorf("Expected the failure rate only to be applied, got %+v", config)
+	}
+}
+
+func TestLoadRecoveryConfig(t *testing.T) {
+	t.Setenv("WORKER_HEARTBEAT_TIMEOUT", "2m")
+	t.Setenv("STALE_BUILD_POLICY", RecoveryFail)
+	t.Setenv("STALE_BUILD_MAX_REQUEUES", "0")
+	config := loadRecoveryConfig()
+	if config.HeartbeatTimeout != 2*time.Minute || config.Policy != RecoveryFail || config.MaxRequeues != 0 {
+		t.Errorf("Unexpected recovery configuration %+v", config)
+	}
+
+	t.Setenv("STALE_BUILD_POLICY", "retry")
+	if config := loadRecoveryConfig(); config.Policy != RecoveryRequeue {
+		t.Errorf("Expected an unknown policy to fall back to %s, got %s", RecoveryRequeue, config.Policy)
+	}
+}
+
+type steppingWorker struct {
+	coordinator *BuildCoordinator
+}
+
+func (s *steppingWorker) Build(request BuildRequest, response *string) error {
+	for _, step := range []string{":compileJava", ":test"} {
+		args := &ReportProgressArgs{BuildID: request.RequestID, WorkerID: "worker-1", Step: step}
+		if err := s.coordinator.ReportProgress(args, &ReportProgressReply{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestBuildLifecycleEvents(t *testing.T) {
+	coordinator := NewBuildCoordinator(5)
+	received := make(chan events.Event, 16)
+	stop, err := coordinator.events.Subscribe(func(event events.Event) { received <- event })
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	defer stop()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+	server := rpc.NewServer()
+	server.RegisterName("WorkerService", &steppingWorker{coordinator: coordinator})
+	go server.Accept(listener)
+
+	buildID, err := coordinator.SubmitBuild(BuildRequest{ProjectPath: "/test/project", TaskName: "build", Tenant: "team-a"})
+	if err != nil {
+		t.Fatalf("SubmitBuild failed: %v", err)
+	}
+	worker := &Worker{ID: "worker-1", Host: "127.0.0.1", Port: listener.Addr().(*net.TCPAddr).Port, MaxBuilds: 1}
+	coordinator.workers[worker.ID] = worker
+	coordinator.assignBuildToWorker(worker, <-coordinator.buildQueue)
+
+	expected := []struct{ kind, step string }{
+		{events.BuildSubmitted, ""},
+		{events.BuildScheduled, ""},
+		{events.BuildStarted, ""},
+		{events.BuildStepCompleted, ":compileJava"},
+		{events.BuildStepCompleted, ":test"},
+		{events.BuildFinished, ""},
+	}
+	for _, want := range expected {
+		var event events.Event
+		select {
+		case event = <-received:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for the %s event", want.kind)
+		}
+		if event.Type != want.kind || event.Step != want.step || event.BuildID != buildID {
+			t.Fatalf("Expected a %s event for step %q, got %+v", want.kind, want.step, event)
+		}
+		if event.ProjectPath != "/test/project" || event.Tenant != "team-a" || event.Timestamp.IsZero() {
+			t.Errorf("Expected the build's details in the event, got %+v", event)
+		}
+		if want.kind == events.BuildFinished && (event.Status != BuildStatusCompleted || event.WorkerID != "worker-1") {
+			t.Errorf("Expected the build to complete on worker-1, got %+v", event)
+		}
+	}
+}
+
+// uploader sends artifacts to the coordinator the way a worker does
+type uploader struct {
+	coordinator *BuildCoordinator
+	buildID     string
+	workerID    string
+}
+
+func (u uploader) Missing(hashes []string) ([]string, error) {
+	var reply MissingChunksReply
+	err := u.coordinator.MissingChunks(&MissingChunksArgs{BuildID: u.buildID, WorkerID: u.workerID, Hashes: hashes}, &reply)
+	return reply.Missing, err
+}
+
+func (u uploader) PutChunk(hash string, data []byte) error {
+	return u.coordinator.UploadChunk(&UploadChunkArgs{BuildID: u.buildID, WorkerID: u.workerID, Hash: hash, Data: data}, &UploadChunkReply{})
+}
+
+func (u uploader) Commit(manifest transfer.Manifest) error {
+	return u.coordinator.CommitArtifact(&CommitArtifactArgs{BuildID: u.buildID, WorkerID: u.workerID, Manifest: manifest}, &CommitArtifactReply{})
+}
+
+func TestArtifactTransfer(t *testing.T) {
+	coordinator := NewBuildCoordinator(5)
+	buildID, _ := coordinator.SubmitBuild(BuildRequest{ProjectPath: "/test/project", TaskName: "assemble"})
+	coordinator.ReportProgress(&ReportProgressArgs{BuildID: buildID, WorkerID: "worker-1", Progress: 90}, &ReportProgressReply{})
+
+	data := []byte(strings.Repeat("class files and resources\n", 40000))
+	file := filepath.Join(t.TempDir(), "app.apk")
+	os.WriteFile(file, data, 0644)
+
+	name := buildID + "/build/outputs/apk/app.apk"
+	if _, _, err := transfer.Upload(uploader{coordinator, buildID, "worker-2"}, name, file); err == nil {
+		t.Error("Expected an error when another worker uploads artifacts")
+	}
+
+	var before dto.Metric
+	metrics.TransferBytes.WithLabelValues(metrics.TransferUpload, metrics.TransferRaw).Write(&before)
+	manifest, stats, err := transfer.Upload(uploader{coordinator, buildID, "worker-1"}, name, file)
+	if err != nil {
+		t.Fatalf("Upload failed: %v", err)
+	}
+	if stats.WireBytes == 0 || stats.WireBytes >= stats.SentBytes {
+		t.Errorf("Expected the chunks to be compressed, got %+v", stats)
+	}
+	var after dto.Metric
+	metrics.TransferBytes.WithLabelValues(metrics.TransferUpload, metrics.TransferRaw).Write(&after)
+	if counted := after.GetCounter().GetValue() - before.GetCounter().GetValue(); counted != float64(len(data)) {
+		t.Errorf("Expected %d uploaded bytes to be counted, got %v", len(data), counted)
+	}
+	if _, _, err := transfer.Upload(uploader{coordinator, buildID, "worker-1"}, "other-build/app.apk", file); err == nil {
+		t.Error("Expected an error for an artifact named after another build")
+	}
+
+	handler := coordinator.routes(nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/builds/"+buildID+"/artifacts", nil))
+	var listed []StoredArtifact
+	json.Unmarshal(w.Body.Bytes(), &listed)
+	if len(listed) != 1 || listed[0].Path != "build/outputs/apk/app.apk" || listed[0].Size != int64(len(data)) {
+		t.Errorf("Expected the uploaded artifact, got %+v", listed)
+	}
+
+	request := httptest.NewRequest("GET", "/api/builds/"+buildID+"/artifacts/build/outputs/apk/app.apk", nil)
+	request.Header.Set("Accept", transfer.ManifestContentType)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, request)
+	var served transfer.Manifest
+	if err := json.Unmarshal(w.Body.Bytes(), &served); err != nil || served.SHA256 != manifest.SHA256 {
+		t.Errorf("Expected the manifest, got %d %s", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/chunks/"+manifest.Chunks[0].Hash, nil))
+	if w.Code != http.StatusOK || transfer.PlainSize(w.Body.Bytes()) != manifest.Chunks[0].Size {
+		t.Errorf("Expected the compressed chunk, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/builds/"+buildID+"/artifacts/build/outputs/apk/app.apk", nil))
+	if w.Code != http.StatusOK || w.Body.String() != string(data) {
+		t.Errorf("Expected the artifact content, got %d with %d bytes", w.Code, w.Body.Len())
+	}
+
+	for path, expected := range map[string]int{
+		"/api/builds/" + buildID + "/artifacts/missing.jar": http.StatusNotFound,
+		"/api/chunks/" + strings.Repeat("0", 64):            http.StatusNotFound,
+		"/api/chunks/not-a-hash":                            http.StatusBadRequest,
+	} {
+		w = httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != expected {
+			t.Errorf("GET %s: expected %d, got %d", path, expected, w.Code)
+		}
+	}
+}
+
+func TestArtifactRetention(t *testing.T) {
+	coordinator := NewBuildCoordinator(5)
+	coordinator.retention, _ = retention.New([]retention.Policy{
+		{Project: "/projects/*", KeepLast: 1, KeepLabels: []string{"release"}},
+	}, retention.Policy{KeepDays: 7})
+
+	file := filepath.Join(t.TempDir(), "app.jar")
+	os.WriteFile(file, []byte("compiled classes"), 0644)
+	upload := func(request BuildRequest) string {
+		t.Helper()
+		buildID, _ := coordinator.SubmitBuild(request)
+		coordinator.ReportProgress(&ReportProgressArgs{BuildID: buildID, WorkerID: "worker-1", Progress: 90}, &ReportProgressReply{})
+		if _, _, err := transfer.Upload(uploader{coordinator, buildID, "worker-1"}, buildID+"/app.jar", file); err != nil {
+			t.Fatalf("Upload failed: %v", err)
+		}
+		time.Sleep(time.Millisecond)
+		return buildID
+	}
+	release := upload(BuildRequest{ProjectPath: "/projects/app", TaskName: "assemble", Labels: []string{"release"}})
+	superseded := upload(BuildRequest{ProjectPath: "/projects/app", TaskName: "assemble"})
+	latest := upload(BuildRequest{ProjectPath: "/projects/app", TaskName: "assemble"})
+	other := upload(BuildRequest{ProjectPath: "/other/app", TaskName: "assemble"})
+
+	manifest, _ := coordinator.artifacts.Manifest(release + "/app.jar")
+	if manifest.Attributes[retention.AttributeProject] != "/projects/app" || manifest.Attributes[retention.AttributeLabels] != "release" {
+		t.Errorf("Expected the build recorded in the manifest, got %v", manifest.Attributes)
+	}
+
+	if files, _, err := coordinator.collectArtifacts(time.Now()); err != nil || files != 1 {
+		t.Fatalf("Expected the superseded build's artifact to be collected, got %d: %v", files, err)
+	}
+	for buildID, kept := range map[string]bool{release: true, superseded: false, latest: true, other: true} {
+		if _, err := coordinator.artifacts.Manifest(buildID + "/app.jar"); (err == nil) != kept {
+			t.Errorf("Expected artifact of %s kept %v, got %v", buildID, kept, err)
+		}
+	}
+	if files, _, _ := coordinator.collectArtifacts(time.Now().Add(8 * 24 * time.Hour)); files != 1 {
+		t.Errorf("Expected the unmatched build's artifact to expire after 7 days, got %d", files)
+	}
+
+	handler := coordinator.routes(nil)
+	for _, tc := range []struct {
+		path     string
+		expected int
+	}{
+		{"/api/builds/" + latest + "/artifacts/app.jar", http.StatusOK},
+		{"/api/builds/" + latest + "/artifacts/app.jar", http.StatusNotFound},
+		{"/api/builds/" + release + "/artifacts", http.StatusOK},
+		{"/api/builds/" + superseded + "/artifacts", http.StatusNotFound},
+	} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("DELETE", tc.path, nil))
+		if w.Code != tc.expected {
+			t.Errorf("DELETE %s: expected %d, got %d", tc.path, tc.expected, w.Code)
+		}
+	}
+	if remaining, _ := coordinator.artifacts.List(""); len(remaining) != 0 {
+		t.Errorf("Expected every artifact deleted, got %+v", remaining)
+	}
+
+	events, _ := coordinator.auditLog.Query(audit.Filter{Action: audit.ActionArtifactsDeleted})
+	if len(events) != 2 || events[0].Resource != latest || events[0].Details["path"] != "app.jar" || events[1].Resource != release {
+		t.Errorf("Expected the deletes to be audited, got %+v", events)
+	}
+}
+
+func TestPublishArtifacts(t *testing.T) {
+	var mutex sync.Mutex
+	stored := make(map[string]string)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if username, password, _ := r.BasicAuth(); username != "deployer" || password != "s3cret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		if r.Method == "PUT" {
+			data, _ := io.ReadAll(r.Body)
+			stored[r.URL.Path] = string(data)
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		data, exists := stored[r.URL.Path]
+		if !exists {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		io.WriteString(w, data)
+	}))
+	defer server.Close()
+
+	coordinator := NewBuildCoordinator(5)
+	handler := coordinator.routes(nil)
+	submit := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("POST", "/api/build", strings.NewReader(body)))
+		return w
+	}
+	body := `{"project_path":"/projects/app","task_name":"assemble","publish":{"group_id":"com.example","version":"1.2.0"}}`
+	if w := submit(body); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "not configured") {
+		t.Errorf("Expected publishing to be rejected without a repository, got %d: %s", w.Code, w.Body.String())
+	}
+
+	t.Setenv("TEST_MAVEN_USER", "deployer")
+	t.Setenv("TEST_MAVEN_PASSWORD", "s3cret")
+	store, err := secrets.NewStore(map[string]secrets.Reference{
+		"maven-user":     {EnvVar: "MAVEN_USER", Backend: secrets.BackendEnv, Key: "TEST_MAVEN_USER"},
+		"maven-password": {EnvVar: "MAVEN_PASSWORD", Backend: secrets.BackendEnv, Key: "TEST_MAVEN_PASSWORD"},
+	}, nil)
+	if err != nil {
+		t.Fatalf("NewStore failed: %v", err)
+	}
+	coordinator.secretStore = store
+	coordinator.maven = PublishConfig{URL: server.URL + "/libs-release", UsernameSecret: "maven-user", PasswordSecret: "maven-password"}
+	if w := submit(strings.Replace(body, "1.2.0", "../1.2.0", 1)); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d for an invalid version, got %d", http.StatusBadRequest, w.Code)
+	}
+
+	w := submit(body)
+	var submitted SubmitBuildResponse
+	if err := json.NewDecoder(w.Body).Decode(&submitted); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("Expected the build to be queued, got %d: %v", w.Code, err)
+	}
+	<-coordinator.buildQueue
+
+	dir := t.TempDir()
+	for name, content := range map[string]string{"app-1.2.0.jar": "compiled classes", "app-1.2.0-sources.jar": "sources", "app.apk": "package"} {
+		file := filepath.Join(dir, name)
+		os.WriteFile(file, []byte(content), 0644)
+		if _, _, err := transfer.Upload(coordinator.artifacts, submitted.BuildID+"/app/build/libs/"+name, file); err != nil {
+			t.Fatalf("Failed to store artifact %s: %v", name, err)
+		}
+	}
+	// The repository has an older JAR at the coordinates
+	mutex.Lock()
+	stored["/libs-release/com/example/app/1.2.0/app-1.2.0.jar.sha1"] = "da39a3ee5e6b4b0d3255bfef95601890afd80709"
+	mutex.Unlock()
+
+	coordinator.publishArtifacts(submitted.BuildID, PublishRequest{GroupID: "com.example", Version: "1.2.0"})
+	response, _ := coordinator.GetBuildStatus(submitted.BuildID)
+	if len(response.Published) != 2 {
+		t.Fatalf("Expected the two JARs to be published, got %+v", response.Published)
+	}
+	for _, artifact := range response.Published {
+		if artifact.Status != PublishPublished || artifact.Coordinates.GroupID != "com.example" || !strings.HasPrefix(artifact.URL, server.URL+"/libs-release/com/example/app/1.2.0/") {
+			t.Errorf("Unexpected published artifact %+v", artifact)
+		}
+	}
+	mutex.Lock()
+	if stored["/libs-release/com/example/app/1.2.0/app-1.2.0-sources.jar"] != "sources" {
+		t.Errorf("Expected the sources JAR in the repository, got %v", stored)
+	}
+	mutex.Unlock()
+
+	// Publishing again only uploads what changed
+	coordinator.publishArtifacts(submitted.BuildID, PublishRequest{GroupID: "com.example", Version: "1.2.0"})
+	response, _ = coordinator.GetBuildStatus(submitted.BuildID)
+	for _, artifact := range response.Published {
+		if artifact.Status != PublishUnchanged {
+			t.Errorf("Expected %s to be unchanged, got %s", artifact.Path, artifact.Status)
+		}
+	}
+
+	coordinator.maven.PasswordSecret = "unknown"
+	coordinator.publishArtifacts(submitted.BuildID, PublishRequest{GroupID: "com.example", Version: "1.2.0"})
+	response, _ = coordinator.GetBuildStatus(submitted.BuildID)
+	if response.Published[0].Status != PublishFailed || !strings.Contains(response.Published[0].Error, "unknown secret") {
+		t.Errorf("Expected publishing to fail without credentials, got %+v", response.Published)
+	}
+	if events, _ := coordinator.auditLog.Query(audit.Filter{Action: audit.ActionArtifactsPublished, Resource: submitted.BuildID}); len(events) != 3 {
+		t.Errorf("Expected every publish to be audited, got %+v", events)
+	}
+}
+
+func TestMatrixBuild(t *testing.T) {
+	coordinator := NewBuildCoordinator(5)
+	handler := coordinator.routes(nil)
+
+	post := func(body string) *httptest.ResponseRecorder {
+		t.Helper()
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("POST", "/api/build", strings.NewReader(body)))
+		return w
+	}
+	children := func(groupID string) BuildGroup {
+		t.Helper()
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/builds/"+groupID+"/children", nil))
+		var group BuildGroup
+		if err := json.NewDecoder(w.Body).Decode(&group); err != nil || w.Code != http.StatusOK {
+			t.Fatalf("Expected the matrix build, got %d: %v", w.Code, err)
+		}
+		return group
+	}
+
+	for name, body := range map[string]string{
+		"empty matrix":         `{"project_path":"/projects/app","task_name":"build","matrix":{}}`,
+		"empty option":         `{"project_path":"/projects/app","task_name":"build","matrix":{"options":{"flavor":[]}}}`,
+		"invalid version":      `{"project_path":"/projects/app","task_name":"build","matrix":{"gradle_versions":["8.5","latest"]}}`,
+		"invalid task":         `{"project_path":"/projects/app","matrix":{"tasks":["build","-Dexploit"]}}`,
+		"too many builds":      `{"project_path":"/projects/app","task_name":"build","matrix":{"options":{"a":["1","2","3","4","5","6","7","8"],"b":["1","2","3","4","5","6","7","8","9"]}}}`,
+		"shell metacharacters": `{"project_path":"/projects/app","task_name":"build","matrix":{"options":{"flavor":["free;rm -rf /"]}}}`,
+	} {
+		if w := post(body); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected the %s to be rejected, got %d", name, w.Code)
+		}
+	}
+	if len(coordinator.buildQueue) != 0 {
+		t.Fatal("Expected rejected matrices not to queue any build")
+	}
+
+	w := post(`{"project_path":"/projects//app/","task_name":"build","build_options":{"flavor":"free"},"matrix":{"tasks":["assembleDebug","assembleRelease"],"options":{"java_version":["11","17"]}}}`)
+	var submitted SubmitBuildResponse
+	if err := json.NewDecoder(w.Body).Decode(&submitted); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("Expected the matrix to be queued, got %d: %v", w.Code, err)
+	}
+	if submitted.Status != BuildStatusQueued || len(submitted.Children) != 4 || submitted.Children[0] != submitted.BuildID+"-1" {
+		t.Fatalf("Expected 4 child builds of the group, got %+v", submitted)
+	}
+	if len(coordinator.buildQueue) != 4 {
+		t.Fatalf("Expected 4 queued builds, got %d", len(coordinator.buildQueue))
+	}
+
+	expected := []struct{ task, java string }{
+		{"assembleDebug", "11"}, {"assembleDebug", "17"}, {"assembleRelease", "11"}, {"assembleRelease", "17"},
+	}
+	for i, want := range expected {
+		request := <-coordinator.buildQueue
+		if request.RequestID != submitted.Children[i] || request.GroupID != submitted.BuildID || request.Matrix != nil {
+			t.Errorf("Expected child %s of group %s, got %+v", submitted.Children[i], submitted.BuildID, request)
+		}
+		if request.TaskName != want.task || request.BuildOptions["java_version"] != want.java || request.BuildOptions["flavor"] != "free" || request.ProjectPath != "/projects/app" {
+			t.Errorf("Expected %s with Java %s, got %+v", want.task, want.java, request)
+		}
+	}
+
+	group := children(submitted.BuildID)
+	if group.Status != BuildStatusQueued || group.Total != 4 || group.Children[3].Values["task_name"] != "assembleRelease" || group.Children[3].Values["java_version"] != "17" {
+		t.Fatalf("Expected a queued group of 4 builds, got %+v", group)
+	}
+
+	coordinator.markBuildCompleted(submitted.Children[0], "worker-1")
+	if group := children(submitted.BuildID); group.Status != BuildStatusRunning || group.Counts[BuildStatusCompleted] != 1 || group.Children[0].WorkerID != "worker-1" {
+		t.Errorf("Expected a running group with one completed build, got %+v", group)
+	}
+	coordinator.markBuildFailed(submitted.Children[1], protocol.ErrorCompile, "compilation failed")
+	for _, buildID := range submitted.Children[2:] {
+		coordinator.markBuildCompleted(buildID, "worker-1")
+	}
+	if group := children(submitted.BuildID); group.Status != BuildStatusFailed || group.Counts[BuildStatusFailed] != 1 || group.Counts[BuildStatusCompleted] != 3 {
+		t.Errorf("Expected the group to fail with its failed build, got %+v", group)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/builds/"+submitted.Children[0]+"/children", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a build that is not a matrix, got %d", w.Code)
+	}
+}
+
+func TestGroupStatus(t *testing.T) {
+	tests := []struct {
+		counts   map[string]int
+		expected string
+	}{
+		{map[string]int{BuildStatusQueued: 3}, BuildStatusQueued},
+		{map[string]int{BuildStatusQueued: 2, BuildStatusCompleted: 1}, BuildStatusRunning},
+		{map[string]int{BuildStatusRunning: 1, BuildStatusFailed: 2}, BuildStatusRunning},
+		{map[string]int{BuildStatusCancelled: 1, BuildStatusFailed: 1, BuildStatusCompleted: 1}, BuildStatusFailed},
+		{map[string]int{BuildStatusCancelled: 1, BuildStatusCompleted: 2}, BuildStatusCancelled},
+		{map[string]int{BuildStatusCompleted: 3}, BuildStatusCompleted},
+	}
+	for _, tc := range tests {
+		if status := groupStatus(tc.counts, 3); status != tc.expected {
+			t.Errorf("Expected %v to be %s, got %s", tc.counts, tc.expected, status)
+		}
+	}
+}
+
+func TestShardedBuild(t *testing.T) {
+	coordinator := NewBuildCoordinator(5)
+	handler := coordinator.routes(nil)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	ml := service.NewMLService()
+	ml.RecordTestDurations("/projects/app", map[string]time.Duration{"AppTest": 3 * time.Second, "LibTest": time.Second})
+	go mlrpc.Serve(listener, ml, 1)
+	coordinator.ml = mlrpc.NewClient(listener.Addr().String(), 1, time.Second, localPredictor{coordinator})
+
+	post := func(body string) *httptest.ResponseRecorder {
+		t.Helper()
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("POST", "/api/build", strings.NewReader(body)))
+		return w
+	}
+	for name, body := range map[string]string{
+		"single shard":    `{"project_path":"/projects/app","task_name":"test","sharding":{"shards":1}}`,
+		"too many shards": `{"project_path":"/projects/app","task_name":"test","sharding":{"shards":33}}`,
+		"matrix":          `{"project_path":"/projects/app","task_name":"test","sharding":{"shards":2},"matrix":{"tasks":["test"]}}`,
+		"invalid task":    `{"project_path":"/projects/app","task_name":"-Dexploit","sharding":{"shards":2}}`,
+	} {
+		if w := post(body); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected the %s to be rejected, got %d", name, w.Code)
+		}
+	}
+
+	w := post(`{"project_path":"/projects/app","task_name":"test","sharding":{"shards":2}}`)
+	var submitted SubmitBuildResponse
+	if err := json.NewDecoder(w.Body).Decode(&submitted); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("Expected the shards to be queued, got %d: %v", w.Code, err)
+	}
+	if len(submitted.Children) != 2 || len(coordinator.buildQueue) != 2 {
+		t.Fatalf("Expected 2 queued shards, got %+v", submitted)
+	}
+	for i := range submitted.Children {
+		request := <-coordinator.buildQueue
+		if request.GroupID != submitted.BuildID || request.Sharding != nil || request.Shard == nil || request.Shard.Index != i || request.Shard.Count != 2 {
+			t.Fatalf("Expected shard %d of the group, got %+v", i+1, request)
+		}
+		if request.Shard.Durations["AppTest"] != 3*time.Second {
+			t.Errorf("Expected the test durations of the ML service, got %v", request.Shard.Durations)
+		}
+	}
+
+	results := [][]testshard.ClassResult{
+		{{Name: "AppTest", Tests: 10, Failures: 1, Duration: 4 * time.Second}},
+		{{Name: "LibTest", Tests: 5, Skipped: 1, Duration: time.Second}, {Name: "NewTest", Tests: 1, Duration: 2 * time.Second}},
+	}
+	for i, buildID := range submitted.Children {
+		coordinator.ReportProgress(&ReportProgressArgs{BuildID: buildID, WorkerID: "worker-1", Progress: 50}, &ReportProgressReply{})
+		if err := coordinator.ReportTestResults(&ReportTestResultsArgs{BuildID: buildID, WorkerID: "worker-2", Classes: results[i]}, &ReportTestResultsReply{}); err == nil {
+			t.Error("Expected test results of another worker to be rejected")
+		}
+		if err := coordinator.ReportTestResults(&ReportTestResultsArgs{BuildID: buildID, WorkerID: "worker-1", Classes: results[i]}, &ReportTestResultsReply{}); err != nil {
+			t.Fatalf("ReportTestResults failed: %v", err)
+		}
+	}
+	coordinator.markBuildFailed(submitted.Children[0], protocol.ErrorTestFailure, "tests failed")
+	coordinator.markBuildCompleted(submitted.Children[1], "worker-1")
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/builds/"+submitted.BuildID+"/children", nil))
+	var group BuildGroup
+	if err := json.NewDecoder(w.Body).Decode(&group); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("Expected the sharded build, got %d: %v", w.Code, err)
+	}
+	if group.Status != BuildStatusFailed || group.Matrix != nil || group.Sharding == nil || group.Sharding.Shards != 2 || group.Children[1].Values["shard"] != "2/2" {
+		t.Errorf("Expected a failed group of 2 shards, got %+v", group)
+	}
+	expected := TestResults{Total: 16, Passed: 14, Failed: 1, Skipped: 1, Duration: 7 * time.Second}
+	if group.TestResults == nil || *group.TestResults != expected || len(group.TestClasses) != 3 {
+		t.Errorf("Expected the combined results %+v, got %+v %+v", expected, group.TestResults, group.TestClasses)
+	}
+
+	// The durations of the classes balance the next shards
+	deadline := time.Now().Add(5 * time.Second)
+	for ml.GetTestDurations("/projects/app")["NewTest"] != 2*time.Second {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the test durations to be recorded, got %v", ml.GetTestDurations("/projects/app"))
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPipeline(t *testing.T) {
+	coordinator := NewBuildCoordinator(5)
+	handler := coordinator.routes(nil)
+
+	post := func(body string) *httptest.ResponseRecorder {
+		t.Helper()
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("POST", "/api/pipelines", strings.NewReader(body)))
+		return w
+	}
+	waitForStage := func(pipelineID, stage, status string) StageStatus {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			pipeline, err := coordinator.GetPipeline(pipelineID)
+			if err != nil {
+				t.Fatalf("GetPipeline failed: %v", err)
+			}
+			for _, state := range pipeline.Stages {
+				if state.Name == stage && state.Status == status {
+					return state
+				}
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Expected stage %s to be %s, got %+v", stage, status, pipeline.Stages)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	for name, stages := range map[string]string{
+		"no stages":       `[]`,
+		"invalid name":    `[{"name":"compile core","task_name":"compileJava"}]`,
+		"duplicate stage": `[{"name":"compile","task_name":"compileJava"},{"name":"compile","task_name":"test"}]`,
+		"unknown stage":   `[{"name":"test","task_name":"test","depends_on":["compile"]}]`,
+		"cycle":           `[{"name":"a","task_name":"test","depends_on":["b"]},{"name":"b","task_name":"test","depends_on":["a"]}]`,
+		"invalid task":    `[{"name":"compile","task_name":"compileJava"},{"name":"test","task_name":"-Dexploit","depends_on":["compile"]}]`,
+	} {
+		if w := post(`{"build":{"project_path":"/projects/app"},"stages":` + stages + `}`); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected a pipeline with %s to be rejected, got %d", name, w.Code)
+		}
+	}
+	if len(coordinator.buildQueue) != 0 {
+		t.Fatal("Expected rejected pipelines not to queue any build")
+	}
+
+	w := post(`{"name":"release","build":{"project_path":"/projects//app","build_options":{"java_version":"17"}},"stages":[
+		{"name":"publish","task_name":"publish","depends_on":["test","assemble"]},
+		{"name":"test","task_name":":core:test","depends_on":["compile"]},
+		{"name":"assemble","task_name":":app:assemble","build_options":{"flavor":"paid"},"depends_on":["compile"]},
+		{"name":"compile","task_name":":core:compileJava"}]}`)
+	var pipeline PipelineStatus
+	if err := json.NewDecoder(w.Body).Decode(&pipeline); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("Expected the pipeline to be submitted, got %d: %v", w.Code, err)
+	}
+	order := make([]string, 0, len(pipeline.Stages))
+	for _, stage := range pipeline.Stages {
+		order = append(order, stage.Name)
+	}
+	if !slices.Equal(order, []string{"compile", "test", "assemble", "publish"}) || pipeline.Status != BuildStatusQueued {
+		t.Fatalf("Expected the stages in dependency order, got %v with status %s", order, pipeline.Status)
+	}
+
+	// Only the stage without dependencies is queued
+	compile := <-coordinator.buildQueue
+	if len(coordinator.buildQueue) != 0 || compile.RequestID != pipeline.PipelineID+"-compile" || compile.Stage != "compile" || compile.ProjectPath != "/projects/app" {
+		t.Fatalf("Expected only the compile stage to be queued, got %+v", compile)
+	}
+
+	jar := filepath.Join(t.TempDir(), "core.jar")
+	os.WriteFile(jar, []byte("compiled classes"), 0644)
+	manifest, _, err := transfer.Upload(coordinator.artifacts, compile.RequestID+"/core/build/libs/core.jar", jar)
+	if err != nil {
+		t.Fatalf("Failed to store the compile stage's artifact: %v", err)
+	}
+	coordinator.markBuildCompleted(compile.RequestID, "worker-1")
+
+	// Both stages depending on it start with its artifact
+	waitForStage(pipeline.PipelineID, "test", BuildStatusQueued)
+	waitForStage(pipeline.PipelineID, "assemble", BuildStatusQueued)
+	started := map[string]BuildRequest{}
+	for range 2 {
+		request := <-coordinator.buildQueue
+		started[request.Stage] = request
+	}
+	test, assemble := started["test"], started["assemble"]
+	if test.TaskName != ":core:test" || len(test.Inputs) != 1 || test.Inputs[0].Name != manifest.Name {
+		t.Errorf("Expected the test stage to get the compiled jar, got %+v", test)
+	}
+	if assemble.BuildOptions["flavor"] != "paid" || assemble.BuildOptions["java_version"] != "17" {
+		t.Errorf("Expected the stage options on top of the pipeline's, got %v", assemble.BuildOptions)
+	}
+	if status, _ := coordinator.GetPipeline(pipeline.PipelineID); status.Status != BuildStatusRunning || status.Stages[1].Inputs[0] != manifest.Name {
+		t.Errorf("Expected a running pipeline listing the inputs, got %+v", status)
+	}
+
+	// Only the worker running a stage downloads its inputs
+	coordinator.progress[test.RequestID].WorkerID = "worker-2"
+	var chunk DownloadChunkReply
+	if err := coordinator.DownloadChunk(&DownloadChunkArgs{BuildID: test.RequestID, WorkerID: "worker-2", Hash: manifest.Chunks[0].Hash}, &chunk); err != nil || len(chunk.Data) == 0 {
+		t.Errorf("Expected the input chunk, got %v", err)
+	}
+	if err := coordinator.DownloadChunk(&DownloadChunkArgs{BuildID: test.RequestID, WorkerID: "worker-3", Hash: manifest.Chunks[0].Hash}, &chunk); err == nil {
+		t.Error("Expected another worker not to download the inputs")
+	}
+	if err := coordinator.DownloadChunk(&DownloadChunkArgs{BuildID: assemble.RequestID, WorkerID: "", Hash: strings.Repeat("0", 64)}, &chunk); err == nil {
+		t.Error("Expected chunks that are not inputs to be refused")
+	}
+
+	// A failed stage skips the stages depending on it
+	coordinator.markBuildCompleted(assemble.RequestID, "worker-1")
+	coordinator.markBuildFailed(test.RequestID, protocol.ErrorTestFailure, "2 tests failed")
+	publish := waitForStage(pipeline.PipelineID, "publish", StageStatusSkipped)
+	if publish.BuildID != "" || publish.Message != "stage test failed" {
+		t.Errorf("Expected publish to be skipped without a build, got %+v", publish)
+	}
+	status, _ := coordinator.GetPipeline(pipeline.PipelineID)
+	if status.Status != BuildStatusFailed || status.Counts[BuildStatusCompleted] != 2 || status.Counts[StageStatusSkipped] != 1 {
+		t.Errorf("Expected the pipeline to fail, got %+v", status)
+	}
+	if len(coordinator.buildQueue) != 0 {
+		t.Error("Expected no build for the skipped stage")
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/pipelines/"+pipeline.PipelineID, nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected the pipeline, got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/pipelines/missing", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown pipeline, got %d", w.Code)
+	}
+}
+
+func TestBisect(t *testing.T) {
+	t.Setenv("GIT_AUTHOR_NAME", "test")
+	t.Setenv("GIT_AUTHOR_EMAIL", "test@example.com")
+	t.Setenv("GIT_COMMITTER_NAME", "test")
+	t.Setenv("GIT_COMMITTER_EMAIL", "test@example.com")
+	origin := t.TempDir()
+	git := func(args ...string) string {
+		t.Helper()
+		output, err := exec.Command("git", append([]string{"-C", origin}, args...)...).CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v failed: %v: %s", args, err, output)
+		}
+		return strings.TrimSpace(string(output))
+	}
+	git("init", "--quiet", "-b", "main")
+	var commits []string
+	for i := range 8 {
+		git("commit", "--quiet", "--allow-empty", "-m", fmt.Sprintf("change %d", i))
+		commits = append(commits, git("rev-parse", "HEAD"))
+	}
+	good, firstBad := commits[0], commits[5]
+
+	coordinator := NewBuildCoordinator(5)
+	coordinator.checkouts = gitsource.NewCheckouts(t.TempDir())
+	handler := coordinator.routes(nil)
+	for name, body := range map[string]string{
+		"no repository":  `{"build":{"task_name":"build"},"good":"v1","bad":"main"}`,
+		"no good ref":    `{"build":{"repo_url":"https://git.example.com/app.git","task_name":"build"},"bad":"main"}`,
+		"invalid ref":    `{"build":{"repo_url":"https://git.example.com/app.git","task_name":"build"},"good":"--all","bad":"main"}`,
+		"local repo":     `{"build":{"repo_url":"file:///srv/app","task_name":"build"},"good":"v1","bad":"main"}`,
+		"invalid hook":   `{"build":{"repo_url":"https://git.example.com/app.git","task_name":"build"},"good":"v1","bad":"main","webhook_url":"file:///etc/passwd"}`,
+		"sharded builds": `{"build":{"repo_url":"https://git.example.com/app.git","task_name":"test","sharding":{"shards":2}},"good":"v1","bad":"main"}`,
+	} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("POST", "/api/bisect", strings.NewReader(body)))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected a bisection with %s to be rejected, got %d", name, w.Code)
+		}
+	}
+
+	hooks := make(chan *http.Request, 1)
+	bodies := make(chan []byte, 1)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		hooks <- r
+		bodies <- body
+	}))
+	defer webhook.Close()
+
+	// Without idle capacity no commit is built
+	bisectID := coordinator.SubmitBisect(BisectRequest{
+		Build:         BuildRequest{RepoURL: "file://" + origin, TaskName: "build"},
+		Good:          good,
+		Bad:           "main",
+		WebhookURL:    webhook.URL,
+		WebhookSecret: "hook-secret",
+	})
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		status, _ := coordinator.GetBisect(bisectID)
+		if status.Status == BuildStatusRunning {
+			if status.Commits != 7 || status.RemainingSteps != 3 || len(status.Steps) != 0 {
+				t.Fatalf("Expected 7 commits to bisect without a build, got %+v", status)
+			}
+			break
+		}
+		if status.Status != BisectStatusResolving || time.Now().After(deadline) {
+			t.Fatalf("Expected the commits to be listed, got %+v", status)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	var reply RegisterWorkerReply
+	coordinator.RegisterWorker(&RegisterWorkerArgs{ID: "worker-1", Host: "localhost", Port: 8082, MaxBuilds: 1}, &reply)
+	go coordinator.advanceBisect(bisectID)
+
+	// Each build halves the commits left
+	built := 0
+	for {
+		select {
+		case request := <-coordinator.buildQueue:
+			built++
+			if request.BisectID != bisectID || request.RepoURL != "file://"+origin {
+				t.Fatalf("Unexpected bisection build %+v", request)
+			}
+			if slices.Index(commits, request.Ref) >= slices.Index(commits, firstBad) {
+				coordinator.markBuildFailed(request.RequestID, protocol.ErrorTestFailure, "1 test failed")
+			} else {
+				coordinator.markBuildCompleted(request.RequestID, "worker-1")
+			}
+			continue
+		case r := <-hooks:
+			body := <-bodies
+			mac := hmac.New(sha256.New, []byte("hook-secret"))
+			mac.Write(body)
+			if r.Header.Get(SignatureHeader) != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+				t.Errorf("Expected a signed webhook, got %q", r.Header.Get(SignatureHeader))
+			}
+			var status BisectStatus
+			json.Unmarshal(body, &status)
+			if status.Status != BuildStatusCompleted || status.FirstBadCommit != firstBad || len(status.Steps) != built || built > 3 {
+				t.Errorf("Expected %s to be found in at most 3 builds, got %+v", firstBad, status)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for the bisection")
+		}
+		break
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/bisect/"+bisectID, nil))
+	var status BisectStatus
+	if err := json.NewDecoder(w.Body).Decode(&status); err != nil || status.FirstBadCommit != firstBad || status.FinishedAt == nil {
+		t.Errorf("Expected the finished bisection, got %+v: %v", status, err)
+	}
+}
+
+func TestSystemHealth(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+	server := rpc.NewServer()
+	server.RegisterName("WorkerService", &restartedWorker{reply: PingReply{ID: "worker-1"}})
+	go server.Accept(listener)
+	gone, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	gone.Close()
+
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(HealthStatus{Status: "healthy"})
+	}))
+	defer healthy.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+
+	t.Setenv("ML_SERVICE_URL", healthy.URL+"/")
+	t.Setenv("CACHE_SERVICE_URL", "")
+	t.Setenv("MONITOR_SERVICE_URL", healthy.URL)
+	coordinator := NewBuildCoordinator(5)
+	coordinator.systemHealth = loadSystemHealthConfig()
+	if len(coordinator.systemHealth.Services) != 2 || coordinator.systemHealth.Services[0].URL != healthy.URL+"/health" {
+		t.Fatalf("Expected the configured services to be checked, got %+v", coordinator.systemHealth.Services)
+	}
+	handler := coordinator.routes(nil)
+	check := func(expectedCode int, expectedStatus string) SystemHealth {
+		t.Helper()
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/system/health", nil))
+		var health SystemHealth
+		json.NewDecoder(w.Body).Decode(&health)
+		if w.Code != expectedCode || health.Status != expectedStatus {
+			t.Errorf("Expected %d %s, got %d %+v", expectedCode, expectedStatus, w.Code, health)
+		}
+		return health
+	}
+
+	// Without workers no build can run, but the coordinator itself is up
+	check(http.StatusOK, HealthDegraded)
+
+	port := listener.Addr().(*net.TCPAddr).Port
+	coordinator.workers["worker-1"] = &Worker{ID: "worker-1", Host: "127.0.0.1", Port: port}
+	health := check(http.StatusOK, HealthHealthy)
+	if len(health.Dependencies) != 3 || health.Dependencies[0].Name != "worker-1" || health.Dependencies[0].LatencyMS <= 0 {
+		t.Errorf("Expected the latency of each dependency, got %+v", health.Dependencies)
+	}
+
+	// A failing service or worker degrades the system
+	coordinator.systemHealth.Services = append(coordinator.systemHealth.Services, HealthService{Name: "cache", URL: failing.URL + "/health"})
+	coordinator.workers["worker-2"] = &Worker{ID: "worker-2", Host: "127.0.0.1", Port: gone.Addr().(*net.TCPAddr).Port}
+	health = check(http.StatusOK, HealthDegraded)
+	for _, dependency := range health.Dependencies {
+		if expected := dependency.Name != "cache" && dependency.Name != "worker-2"; (dependency.Status == HealthHealthy) != expected {
+			t.Errorf("Unexpected status of %s: %+v", dependency.Name, dependency)
+		}
+	}
+
+	// Slow dependencies are degraded
+	coordinator.systemHealth.SlowThreshold = time.Nanosecond
+	delete(coordinator.workers, "worker-2")
+	coordinator.systemHealth.Services = nil
+	if health := check(http.StatusOK, HealthDegraded); health.Dependencies[0].Status != HealthDegraded {
+		t.Errorf("Expected the slow worker to be degraded, got %+v", health.Dependencies[0])
+	}
+
+	// Without a reachable worker the system is unhealthy
+	coordinator.workers["worker-1"].Port = gone.Addr().(*net.TCPAddr).Port
+	check(http.StatusServiceUnavailable, HealthUnhealthy)
+}
+
+func TestAuthorization(t *testing.T) {
+	coordinator := NewBuildCoordinator(5)
+	authorizer, err := authz.NewRBAC(authz.Policy{
+		Roles: map[string][]authz.Rule{
+			"team-a": {{Actions: []string{authz.ActionBuildSubmit}, Projects: []string{"/projects/a"}}},
+			"admin":  {{Actions: []string{"*"}}},
+		},
+		Bindings: map[string][]string{
+			"role:team-a": {"team-a"},
+			"user:root":   {"admin"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewRBAC failed: %v", err)
+	}
+	coordinator.authorizer = authorizer
+	service := auth.NewAuthService("secret", time.Hour)
+	handler := coordinator.routes(service)
+	alice, _ := service.GenerateToken("alice", "team-a", nil)
+	root, _ := service.GenerateToken("root", "admin", nil)
+
+	request := func(method, path, token, body string) int {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if code := request("POST", "/api/build", alice, `{"project_path":"/projects/a/app","task_name":"build"}`); code != http.StatusOK {
+		t.Errorf("Expected a build under the team's projects to be allowed, got %d", code)
+	}
+	if code := request("POST", "/api/build", alice, `{"project_path":"/projects/b/app","task_name":"build"}`); code != http.StatusForbidden {
+		t.Errorf("Expected a build of another team's project to be forbidden, got %d", code)
+	}
+	if code := request("POST", "/api/pipelines", alice, `{"name":"ci","build":{"project_path":"/projects/b"},"stages":[{"name":"build","task_name":"build"}]}`); code != http.StatusForbidden {
+		t.Errorf("Expected a pipeline of another team's project to be forbidden, got %d", code)
+	}
+	if code := request("GET", "/api/audit", alice, ""); code != http.StatusForbidden {
+		t.Errorf("Expected the audit log to be forbidden, got %d", code)
+	}
+	if len(coordinator.builds) != 1 {
+		t.Errorf("Expected only the allowed build to be queued, got %d", len(coordinator.builds))
+	}
+
+	events, _ := coordinator.auditLog.Query(audit.Filter{Action: audit.ActionAccessDenied})
+	if len(events) != 3 || events[0].Principal != "user:alice" || events[0].Resource != "/projects/b/app" {
+		t.Errorf("Expected the denials to be audited, got %+v", events)
+	}
+	if code := request("GET", "/api/audit", root, ""); code != http.StatusOK {
+		t.Errorf("Expected an admin to read the audit log, got %d", code)
+	}
+
+	// Uploads are authorized for the project they are of, and so are the
+	// builds on them
+	var archive bytes.Buffer
+	projectarchive.Write(&archive, t.TempDir())
+	upload := func(project string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/uploads?project_path="+project, bytes.NewReader(archive.Bytes()))
+		req.Header.Set("Authorization", "Bearer "+alice)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+	for _, project := range []string{"", "/projects/b/app", "/projects/a/../b"} {
+		if w := upload(project); w.Code != http.StatusForbidden {
+			t.Errorf("Expected the upload of project %q to be forbidden, got %d", project, w.Code)
+		}
+	}
+	if w := upload("projects/a"); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected a relative project path to be rejected, got %d", w.Code)
+	}
+	w := upload("/projects/a/app")
+	var uploaded ProjectUpload
+	if err := json.NewDecoder(w.Body).Decode(&uploaded); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("Expected the upload of the team's project to be allowed, got %d: %v", w.Code, err)
+	}
+	if code := request("POST", "/api/build", alice, `{"upload_id":"`+uploaded.UploadID+`","project_path":"lib","task_name":"build"}`); code != http.StatusOK {
+		t.Errorf("Expected a build on the team's upload to be allowed, got %d", code)
+	}
+
+	// Requests fail closed when the policy agent cannot decide
+	agent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "policy error", http.StatusInternalServerError)
+	}))
+	defer agent.Close()
+	coordinator.authorizer = authz.NewOPA(agent.URL, time.Second)
+	if code := request("POST", "/api/build", root, `{"project_path":"/projects/a/app","task_name":"build"}`); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 without a decision, got %d", code)
+	}
+}
+
+func TestAPIKeys(t *testing.T) {
+	coordinator := NewBuildCoordinator(5)
+	service := auth.NewAuthService("secret", time.Hour)
+	service.AddAllowedToken("service-token")
+	service.AddAdminToken("admin-token")
+	handler := coordinator.routes(service)
+
+	request := func(method, path string, header http.Header, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+	bearer := func(token string) http.Header { return http.Header{"Authorization": {"Bearer " + token}} }
+	apiKey := func(key string) http.Header { return http.Header{"X-Api-Key": {key}} }
+
+	// Only administrators issue keys
+	body := `{"name":"jenkins","scopes":["build","read"],"expires_in":"720h"}`
+	if w := request("POST", "/api/keys", bearer("service-token"), body); w.Code != http.StatusForbidden {
+		t.Errorf("Expected a service token to be refused, got %d", w.Code)
+	}
+	w := request("POST", "/api/keys", bearer("admin-token"), body)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected the key to be issued, got %d: %s", w.Code, w.Body.String())
+	}
+	var issued IssueAPIKeyResponse
+	json.Unmarshal(w.Body.Bytes(), &issued)
+	if issued.ID == "" || !strings.HasPrefix(issued.Secret, "dgb_") || issued.ExpiresAt == nil {
+		t.Fatalf("Expected an expiring key with its secret, got %+v", issued)
+	}
+
+	// The key submits builds and reads, but nothing else
+	if w := request("POST", "/api/build", apiKey(issued.Secret), `{"project_path":"/test/project","task_name":"build"}`); w.Code != http.StatusOK {
+		t.Errorf("Expected the key to submit a build, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := request("GET", "/api/builds", apiKey(issued.Secret), ""); w.Code != http.StatusOK {
+		t.Errorf("Expected the key to list builds, got %d", w.Code)
+	}
+	if w := request("DELETE", "/api/builds/build-1/artifacts", apiKey(issued.Secret), ""); w.Code != http.StatusForbidden {
+		t.Errorf("Expected the key to lack the artifacts scope, got %d", w.Code)
+	}
+	if w := request("GET", "/api/keys", apiKey(issued.Secret), ""); w.Code != http.StatusForbidden {
+		t.Errorf("Expected the key to lack the admin scope, got %d", w.Code)
+	}
+	if w := request("GET", "/api/builds", apiKey("dgb_0000_unknown"), ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected an unknown key to be refused, got %d", w.Code)
+	}
+
+	events, _ := coordinator.auditLog.Query(audit.Filter{Action: audit.ActionBuildSubmitted})
+	if len(events) != 1 || events[0].Principal != "key:"+issued.ID {
+		t.Errorf("Expected the build to be audited with the key, got %+v", events)
+	}
+
+	// Listing never returns secrets or hashes
+	w = request("GET", "/api/keys", bearer("admin-token"), "")
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), issued.Secret) || strings.Contains(w.Body.String(), "hash") {
+		t.Errorf("Expected the keys without secrets, got %d: %s", w.Code, w.Body.String())
+	}
+
+	if w := request("DELETE", "/api/keys/"+issued.ID, bearer("admin-token"), ""); w.Code != http.StatusOK {
+		t.Errorf("Expected the key to be revoked, got %d", w.Code)
+	}
+	if w := request("GET", "/api/builds", apiKey(issued.Secret), ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected the revoked key to be refused, got %d", w.Code)
+	}
+	if w := request("DELETE", "/api/keys/missing", bearer("admin-token"), ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown key, got %d", w.Code)
+	}
+
+	events, _ = coordinator.auditLog.Query(audit.Filter{Resource: issued.ID})
+	if len(events) != 2 || events[0].Action != audit.ActionAPIKeyIssued || events[1].Action != audit.ActionAPIKeyRevoked {
+		t.Errorf("Expected the key issuance and revocation to be audited, got %+v", events)
+	}
+
+	for pattern, scope := range map[string]string{
+		"GET /api/builds/{id}":              apikeys.ScopeRead,
+		"POST /api/pipelines":               apikeys.ScopeBuild,
+		"POST /api/bisect":                  apikeys.ScopeBuild,
+		"DELETE /api/builds/{id}/artifacts": apikeys.ScopeArtifacts,
+		"PUT /api/chaos":                    apikeys.ScopeAdmin,
+		"GET /api/audit":                    apikeys.ScopeAdmin,
+		"GET /api/rpc/calls":                apikeys.ScopeWorker,
+	} {
+		method, _, _ := strings.Cut(pattern, " ")
+		if required := requiredScope(method, pattern); required != scope {
+			t.Errorf("%s: expected scope %s, got %s", pattern, scope, required)
+		}
+	}
+}
+
+// newTestIdentityProvider starts an identity provider that signs ID tokens
+// for a user in the given groups
+func newTestIdentityProvider(t *testing.T, groups ...string) (*httptest.Server, func(audience, nonce string) string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	var server *httptest.Server
+	var nonce string
+	sign := func(audience, nonce string) string {
+		claims := jwt.MapClaims{"iss": server.URL, "aud": audience, "sub": "user-1", "email": "alice@example.com", "groups": groups, "exp": time.Now().Add(time.Hour).Unix()}
+		if nonce != "" {
+			claims["nonce"] = nonce
+		}
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		token.Header["kid"] = "key-1"
+		signed, _ := token.SignedString(key)
+		return signed
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidc.Metadata{Issuer: server.URL, AuthorizationEndpoint: server.URL + "/authorize", TokenEndpoint: server.URL + "/token", JWKSURI: server.URL + "/keys"})
+	})
+	mux.HandleFunc("GET /keys", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kid": "key-1",
+			"kty": "RSA",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("GET /authorize", func(w http.ResponseWriter, r *http.Request) {
+		nonce = r.URL.Query().Get("nonce")
+		http.Redirect(w, r, r.URL.Query().Get("redirect_uri")+"?code=code-1&state="+r.URL.Query().Get("state"), http.StatusFound)
+	})
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidc.Tokens{AccessToken: "access", TokenType: "Bearer", IDToken: sign("dashboard", nonce)})
+	})
+	server = httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server, sign
+}
+
+func TestOIDCLogin(t *testing.T) {
+	idp, sign := newTestIdentityProvider(t, "engineering", "platform")
+	coordinator := NewBuildCoordinator(5)
+	coordinator.login = newOIDCLogin(oidc.NewProvider(oidc.Config{
+		Issuer:      idp.URL,
+		ClientID:    "dashboard",
+		CLIClientID: "cli",
+		RedirectURL: "http://coordinator/auth/callback",
+		Scopes:      oidc.DefaultScopes,
+		Roles:       map[string]string{"platform": "admin"},
+	}))
+	service := auth.NewAuthService("secret", time.Hour)
+	handler := coordinator.routes(service)
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+
+	// The dashboard is sent to the identity provider, which returns to the
+	// callback
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/auth/login", nil))
+	if w.Code != http.StatusFound {
+		t.Fatalf("Expected a redirect to the identity provider, got %d: %s", w.Code, w.Body.String())
+	}
+	resp, err := client.Get(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("Authorization request failed: %v", err)
+	}
+	resp.Body.Close()
+	callback := strings.TrimPrefix(resp.Header.Get("Location"), "http://coordinator")
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", callback, nil))
+	token, found := strings.CutPrefix(w.Header().Get("Location"), "/#token=")
+	if w.Code != http.StatusFound || !found {
+		t.Fatalf("Expected the token to be handed to the dashboard, got %d: %s", w.Code, w.Body.String())
+	}
+	claims, err := service.ValidateToken(token)
+	if err != nil || claims.UserID != "alice@example.com" || claims.Role != "admin" {
+		t.Errorf("Expected an admin token for the user, got %+v, %v", claims, err)
+	}
+
+	// A state is only accepted once
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", callback, nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected a replayed callback to be refused, got %d", w.Code)
+	}
+
+	// The CLI exchanges the ID token of its device login
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/auth/oidc/config", nil))
+	var config OIDCLoginConfig
+	json.Unmarshal(w.Body.Bytes(), &config)
+	if config.Issuer != idp.URL || config.ClientID != "cli" {
+		t.Errorf("Unexpected OIDC config %+v", config)
+	}
+	exchange := func(idToken string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("POST", "/api/auth/oidc/token", strings.NewReader(`{"id_token":"`+idToken+`"}`)))
+		return w
+	}
+	w = exchange(sign("cli", ""))
+	var login LoginResponse
+	json.Unmarshal(w.Body.Bytes(), &login)
+	if w.Code != http.StatusOK || login.Role != "admin" || login.ExpiresAt.Before(time.Now()) {
+		t.Errorf("Expected a coordinator token, got %d: %s", w.Code, w.Body.String())
+	}
+	req := httptest.NewRequest("GET", "/api/keys", nil)
+	req.Header.Set("Authorization", "Bearer "+login.Token)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected the mapped admin role to be honoured, got %d", w.Code)
+	}
+	if w := exchange(sign("other-app", "")); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected tokens of other clients to be refused, got %d", w.Code)
+	}
+
+	events, _ := coordinator.auditLog.Query(audit.Filter{Action: audit.ActionUserLoggedIn})
+	if len(events) != 2 || events[0].Principal != "user:alice@example.com" || events[0].Details["role"] != "admin" {
+		t.Errorf("Expected both logins to be audited, got %+v", events)
+	}
+
+	// Users in no mapped group are refused
+	idp, sign = newTestIdentityProvider(t, "engineering")
+	coordinator.login = newOIDCLogin(oidc.NewProvider(oidc.Config{Issuer: idp.URL, ClientID: "dashboard", CLIClientID: "cli", Roles: map[string]string{"platform": "admin"}}))
+	handler = coordinator.routes(service)
+	if w := exchange(sign("cli", "")); w.Code != http.StatusForbidden {
+		t.Errorf("Expected an unmapped user to be refused, got %d", w.Code)
+	}
+}
+
+func TestCompareBuilds(t *testing.T) {
+	coordinator := NewBuildCoordinator(5)
+	run := func(tasks map[string]string, cases []testshard.CaseResult, size int64) string {
+		t.Helper()
+		buildID, _ := coordinator.SubmitBuild(BuildRequest{ProjectPath: "/test/project", TaskName: "build"})
+		for _, task := range []string{":app:compileJava", ":app:test", ":app:jar"} {
+			if outcome, ok := tasks[task]; ok {
+				coordinator.ReportProgress(&ReportProgressArgs{BuildID: buildID, WorkerID: "worker-1", Step: task, Outcome: outcome}, &ReportProgressReply{})
+			}
+		}
+		classes := []testshard.ClassResult{{Name: "com.example.AppTest", Tests: len(cases), Cases: cases}}
+		if err := coordinator.ReportTestResults(&ReportTestResultsArgs{BuildID: buildID, WorkerID: "worker-1", Classes: classes}, &ReportTestResultsReply{}); err != nil {
+			t.Fatalf("ReportTestResults failed: %v", err)
+		}
+		artifacts := []types.Artifact{{Path: "/builds/" + buildID + "/app/build/libs/app.jar", SHA256: fmt.Sprint(size), Size: size}}
+		if err := coordinator.ReportArtifacts(&ReportArtifactsArgs{BuildID: buildID, WorkerID: "worker-1", Artifacts: artifacts}, &ReportArtifactsReply{}); err != nil {
+			t.Fatalf("ReportArtifacts failed: %v", err)
+		}
+		coordinator.markBuildCompleted(buildID, "worker-1")
+		return buildID
+	}
+	a := run(map[string]string{":app:compileJava": "FROM-CACHE", ":app:test": ""},
+		[]testshard.CaseResult{{Name: "works", Outcome: testshard.CasePassed}, {Name: "broken", Outcome: testshard.CaseFailed}}, 100)
+	b := run(map[string]string{":app:compileJava": "", ":app:test": "", ":app:jar": "FROM-CACHE"},
+		[]testshard.CaseResult{{Name: "works", Outcome: testshard.CaseFailed}, {Name: "broken", Outcome: testshard.CasePassed}}, 150)
+
+	handler := coordinator.routes(nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/builds/compare?a="+a+"&b="+b, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var comparison BuildComparison
+	if err := json.Unmarshal(w.Body.Bytes(), &comparison); err != nil {
+		t.Fatalf("Failed to decode comparison: %v", err)
+	}
+
+	if comparison.A.BuildID != a || comparison.B.BuildID != b || comparison.B.Status != BuildStatusCompleted {
+		t.Errorf("Unexpected builds %+v and %+v", comparison.A, comparison.B)
+	}
+	tasks := make(map[string]TaskDiff)
+	for _, task := range comparison.Tasks {
+		tasks[task.Name] = task
+	}
+	if len(tasks) != 3 || !tasks[":app:jar"].Added || tasks[":app:compileJava"].OutcomeA != "FROM-CACHE" || tasks[":app:test"].Added {
+		t.Errorf("Unexpected tasks %+v", comparison.Tasks)
+	}
+	if !slices.Equal(comparison.CacheHitsLost, []string{":app:compileJava"}) || len(comparison.CacheHitsGained) != 0 {
+		t.Errorf("Expected the cache hit of :app:compileJava to be lost, got %v and %v", comparison.CacheHitsGained, comparison.CacheHitsLost)
+	}
+	if !slices.Equal(comparison.NewTestFailures, []TestCaseRef{{Class: "com.example.AppTest", Name: "works"}}) ||
+		!slices.Equal(comparison.FixedTests, []TestCaseRef{{Class: "com.example.AppTest", Name: "broken"}}) {
+		t.Errorf("Unexpected test changes %v and %v", comparison.NewTestFailures, comparison.FixedTests)
+	}
+	expected := []ArtifactDiff{{Path: "app/build/libs/app.jar", SizeA: 100, SizeB: 150, Change: 50, Changed: true}}
+	if !slices.Equal(comparison.Artifacts, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, comparison.Artifacts)
+	}
+
+	for query, code := range map[string]int{"?a=" + a: http.StatusBadRequest, "?a=" + a + "&b=non-existent": http.StatusNotFound} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/builds/compare"+query, nil))
+		if w.Code != code {
+			t.Errorf("Expected %d for %s, got %d", code, query, w.Code)
+		}
+	}
+}
+
+func TestShutdownDrainsAndSavesQueue(t *testing.T) {
+	queueFile := filepath.Join(t.TempDir(), "queue.json")
+	coordinator := NewBuildCoordinator(5)
+	coordinator.drain = DrainConfig{Timeout: 10 * time.Second, QueueFile: queueFile}
+	handler := coordinator.routes(nil)
+
+	running, _ := coordinator.SubmitBuild(BuildRequest{ProjectPath: "/test/project", TaskName: "build"})
+	coordinator.ReportProgress(&ReportProgressArgs{BuildID: running, WorkerID: "worker-1", Progress: 50}, &ReportProgressReply{})
+	queued, _ := coordinator.SubmitBuild(BuildRequest{ProjectPath: "/test/project", TaskName: "test"})
+
+	rejected := make(chan int, 1)
+	go func() {
+		for !coordinator.isDraining() {
+			time.Sleep(10 * time.Millisecond)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("POST", "/api/build", strings.NewReader(`{"project_path":"/test/project","task_name":"build"}`)))
+		rejected <- w.Code
+		coordinator.markBuildCompleted(running, "worker-1")
+	}()
+	coordinator.Shutdown()
+
+	if code := <-rejected; code != http.StatusServiceUnavailable {
+		t.Errorf("Expected submissions to be refused while draining, got %d", code)
+	}
+	data, err := os.ReadFile(queueFile)
+	if err != nil {
+		t.Fatalf("Expected the queue to be saved: %v", err)
+	}
+	var saved []BuildRequest
+	if err := json.Unmarshal(data, &saved); err != nil || len(saved) != 1 || saved[0].RequestID != queued {
+		t.Fatalf("Expected only the queued build to be saved, got %s", data)
+	}
+
+	restarted := NewBuildCoordinator(5)
+	restarted.drain.QueueFile = queueFile
+	if err := restarted.restoreQueue(); err != nil {
+		t.Fatalf("restoreQueue failed: %v", err)
+	}
+	if progress, err := restarted.GetBuildProgress(queued); err != nil || progress.Status != BuildStatusQueued {
+		t.Errorf("Expected build %s to be queued again, got %+v, %v", queued, progress, err)
+	}
+	if _, err := os.Stat(queueFile); !os.IsNotExist(err) {
+		t.Errorf("Expected the queue file to be removed, got %v", err)
+	}
+}
+
+func TestUploadProject(t *testing.T) {
+	coordinator := NewBuildCoordinator(5)
+	handler := coordinator.routes(nil)
+
+	project := t.TempDir()
+	os.MkdirAll(filepath.Join(project, "app"), 0755)
+	os.WriteFile(filepath.Join(project, "settings.gradle"), []byte("include 'app'"), 0644)
+	os.WriteFile(filepath.Join(project, "app", "build.gradle"), []byte("plugins { id 'java' }"), 0644)
+	var archive bytes.Buffer
+	if err := projectarchive.Write(&archive, project); err != nil {
+		t.Fatalf("Failed to pack the project: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/api/uploads", bytes.NewReader(archive.Bytes())))
+	var upload ProjectUpload
+	if err := json.NewDecoder(w.Body).Decode(&upload); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("Expected the project to be uploaded, got %d: %v", w.Code, err)
+	}
+	if upload.Size != int64(archive.Len()) || upload.SentBytes != upload.Size {
+		t.Errorf("Expected the whole archive to be stored, got %+v", upload)
+	}
+
+	submit := func(body string) int {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("POST", "/api/build", strings.NewReader(body)))
+		return w.Code
+	}
+	if code := submit(`{"upload_id":"upload-1","task_name":"build"}`); code != http.StatusBadRequest {
+		t.Errorf("Expected an unknown upload to be rejected, got %d", code)
+	}
+	if code := submit(`{"upload_id":"build-1","task_name":"build"}`); code != http.StatusBadRequest {
+		t.Errorf("Expected the artifacts of builds not to be taken for uploads, got %d", code)
+	}
+	if code := submit(`{"upload_id":"` + upload.UploadID + `","repo_url":"https://example.com/app.git","task_name":"build"}`); code != http.StatusBadRequest {
+		t.Errorf("Expected an upload and a repository to be rejected, got %d", code)
+	}
+	if code := submit(`{"upload_id":"` + upload.UploadID + `","project_path":"../app","task_name":"build"}`); code != http.StatusBadRequest {
+		t.Errorf("Expected a project path outside of the upload to be rejected, got %d", code)
+	}
+	if code := submit(`{"upload_id":"` + upload.UploadID + `","project_path":"app","task_name":"build"}`); code != http.StatusOK {
+		t.Fatalf("Expected the build of the upload to be accepted, got %d", code)
+	}
+
+	request := <-coordinator.buildQueue
+	if request.Upload == nil || request.Upload.SHA256 != upload.SHA256 || request.ProjectPath != "app" {
+		t.Fatalf("Expected the build to carry the upload's manifest, got %+v", request)
+	}
+
+	// The worker running the build downloads the archive
+	coordinator.progress[request.RequestID].WorkerID = "worker-1"
+	var chunk DownloadChunkReply
+	if err := coordinator.DownloadChunk(&DownloadChunkArgs{BuildID: request.RequestID, WorkerID: "worker-1", Hash: request.Upload.Chunks[0].Hash}, &chunk); err != nil || len(chunk.Data) == 0 {
+		t.Errorf("Expected the chunk of the upload, got %v", err)
+	}
+}
+
+func TestSubmitTask(t *testing.T) {
+	coordinator := NewBuildCoordinator(5)
+	handler := coordinator.routes(nil)
+
+	project := t.TempDir()
+	os.WriteFile(filepath.Join(project, "settings.gradle"), []byte("include 'app'"), 0644)
+	var archive bytes.Buffer
+	projectarchive.Write(&archive, project)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/api/uploads", &archive))
+	var upload ProjectUpload
+	if err := json.NewDecoder(w.Body).Decode(&upload); err != nil {
+		t.Fatalf("Failed to upload the project: %v", err)
+	}
+
+	submit := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("POST", "/api/tasks", strings.NewReader(body)))
+		return w
+	}
+	for name, body := range map[string]string{
+		"no upload":      `{"task":":app:compileJava"}`,
+		"no task":        `{"upload_id":"` + upload.UploadID + `"}`,
+		"escaping":       `{"upload_id":"` + upload.UploadID + `","task":":app:compileJava","outputs":["../build"]}`,
+		"absolute":       `{"upload_id":"` + upload.UploadID + `","task":":app:compileJava","outputs":["/etc"]}`,
+		"unknown upload": `{"upload_id":"upload-1","task":":app:compileJava"}`,
+	} {
+		if w := submit(body); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected a task with %s to be rejected, got %d", name, w.Code)
+		}
+	}
+
+	w = submit(`{"upload_id":"` + upload.UploadID + `","task":":app:compileJava","outputs":["app/build/classes/java/main"],"gradle_version":"8.5"}`)
+	var submitted SubmitBuildResponse
+	if err := json.NewDecoder(w.Body).Decode(&submitted); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("Expected the task to be queued, got %d: %v", w.Code, err)
+	}
+	request := <-coordinator.buildQueue
+	if request.RequestID != submitted.BuildID || request.TaskName != ":app:compileJava" || request.Upload == nil ||
+		!slices.Equal(request.Outputs, []string{"app/build/classes/java/main"}) || request.GradleVersion != "8.5" {
+		t.Errorf("Expected a build of the task on the upload, got %+v", request)
+	}
+}
+
+func TestUsage(t *testing.T) {
+	coordinator := NewBuildCoordinator(5)
+	handler := coordinator.routes(nil)
+
+	buildID, _ := coordinator.SubmitBuild(BuildRequest{ProjectPath: "/projects/usage-app", TaskName: "build", Tenant: "android"})
+	coordinator.ReportProgress(&ReportProgressArgs{BuildID: buildID, WorkerID: "worker-1", Progress: 90}, &ReportProgressReply{})
+	coordinator.progress[buildID].StartedAt = time.Now().Add(-time.Minute)
+	coordinator.ReportArtifacts(&ReportArtifactsArgs{BuildID: buildID, WorkerID: "worker-1", ResourceUsage: &ResourceMetrics{CacheStorage: 4096}}, &ReportArtifactsReply{})
+
+	file := filepath.Join(t.TempDir(), "app.apk")
+	os.WriteFile(file, []byte("apk"), 0644)
+	if _, _, err := transfer.Upload(uploader{coordinator, buildID, "worker-1"}, buildID+"/app.apk", file); err != nil {
+		t.Fatalf("Upload failed: %v", err)
+	}
+
+	var before dto.Metric
+	metrics.CacheStorageBytes.WithLabelValues("android", "/projects/usage-app").Write(&before)
+	coordinator.markBuildCompleted(buildID, "worker-1")
+	var after dto.Metric
+	metrics.CacheStorageBytes.WithLabelValues("android", "/projects/usage-app").Write(&after)
+	if counted := after.GetCounter().GetValue() - before.GetCounter().GetValue(); counted != 4096 {
+		t.Errorf("Expected the cache growth to be counted, got %v", counted)
+	}
+
+	other, _ := coordinator.SubmitBuild(BuildRequest{ProjectPath: "/projects/usage-api", TaskName: "build", Tenant: "backend"})
+	coordinator.CancelBuild(&CancelBuildArgs{BuildID: other}, &CancelBuildReply{})
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/usage?tenant=android", nil))
+	var rows []usage.Row
+	if err := json.Unmarshal(w.Body.Bytes(), &rows); err != nil {
+		t.Fatalf("Failed to decode usage: %v", err)
+	}
+	if len(rows) != 1 || rows[0].Project != "/projects/usage-app" || rows[0].Builds != 1 || rows[0].ComputeSeconds < 60 ||
+		rows[0].CacheBytes != 4096 || rows[0].Artifacts != 1 || rows[0].ArtifactBytes != 3 {
+		t.Errorf("Unexpected usage of the tenant %+v", rows)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/usage?format=csv", nil))
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	if w.Header().Get("Content-Type") != "text/csv" || len(lines) != 3 || !strings.HasPrefix(lines[2], "backend,/projects/usage-api,1,") {
+		t.Errorf("Expected a CSV row per tenant, got %s", w.Body.String())
+	}
+
+	// Builds outside the range are not accounted
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/usage?to=2020-01-01T00:00:00Z&project=/projects/usage-api", nil))
+	if strings.TrimSpace(w.Body.String()) != "[]" {
+		t.Errorf("Expected no usage before the builds, got %s", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/usage?from=yesterday", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected an invalid range to be rejected, got %d", w.Code)
+	}
+}
+
+func TestCacheSeedDue(t *testing.T) {
+	config := defaultCacheSeedConfig()
+	// Mondays are busy from 9 to 17, with a few builds at 7
+	patterns := []service.ScalingPattern{{HourOfDay: 7, DayOfWeek: 1, ExpectedLoad: 1}}
+	for hour := 9; hour < 17; hour++ {
+		patterns = append(patterns, service.ScalingPattern{HourOfDay: hour, DayOfWeek: 1, ExpectedLoad: 10})
+	}
+	monday := time.Date(2026, 10, 12, 0, 30, 0, 0, time.Local)
+
+	for hour, due := range map[int]bool{3: false, 7: false, 8: true, 9: false, 16: false, 17: false} {
+		if config.due(patterns, monday.Add(time.Duration(hour)*time.Hour)) != due {
+			t.Errorf("Expected seeding at %d:30 to be due: %v", hour, due)
+		}
+	}
+	if config.due(nil, monday.Add(8*time.Hour)) {
+		t.Error("Expected nothing to be due before the patterns were trained")
+	}
+}
+
+func TestCacheSeed(t *testing.T) {
+	coordinator := NewBuildCoordinator(5)
+	router, err := pools.NewRouter([]pools.Rule{{Label: "android", Pool: "android"}, {Label: "release", Pool: "release"}})
+	if err != nil {
+		t.Fatalf("NewRouter failed: %v", err)
+	}
+	coordinator.setRouter(router)
+	var reply RegisterWorkerReply
+	for id, pool := range map[string]string{"android-1": "android", "backend-1": ""} {
+		if err := coordinator.RegisterWorker(&RegisterWorkerArgs{ID: id, Host: "127.0.0.1", Port: 1, MaxBuilds: 1, Pool: pool}, &reply); err != nil {
+			t.Fatalf("RegisterWorker failed: %v", err)
+		}
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	ml := service.NewMLService()
+	ml.Models.ScalingPredictor.Patterns = []service.ScalingPattern{{HourOfDay: 9, DayOfWeek: 1, ExpectedLoad: 10}}
+	go mlrpc.Serve(listener, ml, 1)
+	coordinator.ml = mlrpc.NewClient(listener.Addr().String(), 1, time.Second, localPredictor{coordinator})
+	coordinator.cacheSeed.Builds = []CacheSeedBuild{{RepoURL: "https://git.example.com/app.git", TaskName: "assemble"}}
+
+	monday := time.Date(2026, 10, 12, 8, 30, 0, 0, time.Local)
+	coordinator.seedCaches(monday.Add(-time.Hour))
+	if len(coordinator.builds) != 0 {
+		t.Fatalf("Expected no seeding before the last quiet hour, got %d builds", len(coordinator.builds))
+	}
+
+	// Each pool with a free worker is seeded once, outside the routing rules
+	coordinator.seedCaches(monday)
+	coordinator.seedCaches(monday.Add(5 * time.Minute))
+	for _, pool := range []string{"android", pools.DefaultPool} {
+		if queued := len(coordinator.queue(pool)); queued != 1 {
+			t.Fatalf("Expected one cache seed build in pool %s, got %d", pool, queued)
+		}
+		request := <-coordinator.queue(pool)
+		if request.Type != BuildTypeCacheSeed || request.Pool != pool || !request.Force || request.TaskName != "assemble" {
+			t.Errorf("Expected a forced cache seed build in pool %s, got %+v", pool, request)
+		}
+	}
+	if queued := len(coordinator.queues["release"]); queued != 0 {
+		t.Errorf("Expected the pool without workers not to be seeded, got %d builds", queued)
+	}
+
+	// Clients cannot submit builds of a coordinator type
+	w := httptest.NewRecorder()
+	coordinator.routes(nil).ServeHTTP(w, httptest.NewRequest("POST", "/api/build", strings.NewReader(`{"project_path":"/projects/app","task_name":"build","type":"cache-seed","pool":"android"}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected a cache seed build to be rejected, got %d", w.Code)
+	}
+}
+
+func TestLoadCacheSeedConfig(t *testing.T) {
+	if config, err := loadCacheSeedConfig(); err != nil || config.Enabled() || config.MaxLoad != 0.25 {
+		t.Errorf("Unexpected default cache seed configuration %+v, %v", config, err)
+	}
+	t.Setenv("CACHE_SEED_BUILDS", `[{"repo_url":"https://git.example.com/app.git","task_name":"assemble"}]`)
+	t.Setenv("CACHE_SEED_MAX_LOAD", "2")
+	if config, err := loadCacheSeedConfig(); err != nil || !config.Enabled() || config.MaxLoad != 0.25 {
+		t.Errorf("Expected the builds only to be applied, got %+v, %v", config, err)
+	}
+	t.Setenv("CACHE_SEED_BUILDS", `[{"repo_url":"https://git.example.com/app.git"}]`)
+	if _, err := loadCacheSeedConfig(); err == nil {
+		t.Error("Expected a build without a task to be rejected")
+	}
+}
+
+// readQueueEvents reads count events of the queue stream, resuming after
+// lastEventID if not empty
+func readQueueEvents(t *testing.T, serverURL, lastEventID string, count int) []QueueEvent {
+	t.Helper()
+	request, _ := http.NewRequest("GET", serverURL+"/api/queue/stream", nil)
+	if lastEventID != "" {
+		request.Header.Set("Last-Event-ID", lastEventID)
+	}
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(request)
+	if err != nil {
+		t.Fatalf("Failed to open the queue stream: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Expected an event stream, got %s", resp.Header.Get("Content-Type"))
+	}
+
+	var events []QueueEvent
+	scanner := bufio.NewScanner(resp.Body)
+	for len(events) < count && scanner.Scan() {
+		data, found := strings.CutPrefix(scanner.Text(), "data: ")
+		if !found {
+			continue
+		}
+		var event QueueEvent
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			t.Fatalf("Failed to decode queue event %s: %v", data, err)
+		}
+		events = append(events, event)
+	}
+	if len(events) < count {
+		t.Fatalf("Expected %d queue events, got %+v: %v", count, events, scanner.Err())
+	}
+	return events
+}
+
+func TestQueueStream(t *testing.T) {
+	coordinator := NewBuildCoordinator(5)
+	server := httptest.NewServer(coordinator.routes(nil))
+	defer server.Close()
+
+	pending := fairshare.NewQueue(coordinator.weights)
+	requests := make(map[string]BuildRequest)
+	var buildIDs []string
+	for i := 0; i < 3; i++ {
+		if _, err := coordinator.SubmitBuild(BuildRequest{ProjectPath: "/test/project", TaskName: "build"}); err != nil {
+			t.Fatalf("Failed to submit build: %v", err)
+		}
+		request := <-coordinator.buildQueue
+		pending.Push(request.Tenant, request.RequestID)
+		requests[request.RequestID] = request
+		buildIDs = append(buildIDs, request.RequestID)
+	}
+	coordinator.trackQueue(pools.DefaultPool, pending, requests)
+
+	// A paused build is scheduled after the others
+	if _, err := coordinator.PauseBuild(buildIDs[0], ""); err != nil {
+		t.Fatalf("Failed to pause build: %v", err)
+	}
+	coordinator.trackQueue(pools.DefaultPool, pending, requests)
+	reordered := []string{buildIDs[1], buildIDs[2], buildIDs[0]}
+
+	// A client connecting gets the queue of each pool first
+	snapshot := readQueueEvents(t, server.URL, "", 1)[0]
+	if snapshot.Type != QueueSnapshot || snapshot.ID != 4 || snapshot.Pool != pools.DefaultPool || !slices.Equal(snapshot.Queue, reordered) {
+		t.Errorf("Expected a snapshot of the reordered queue, got %+v", snapshot)
+	}
+	if stale := readQueueEvents(t, server.URL, "1000", 1)[0]; stale.Type != QueueSnapshot {
+		t.Errorf("Expected a snapshot for an unknown event ID, got %+v", stale)
+	}
+
+	// A client resuming gets the events it missed
+	missed := readQueueEvents(t, server.URL, "1", 3)
+	for i, want := range []struct {
+		eventType string
+		buildID   string
+		position  int
+	}{{QueueEnqueued, buildIDs[1], 2}, {QueueEnqueued, buildIDs[2], 3}, {QueueReprioritized, "", 0}} {
+		if event := missed[i]; event.ID != uint64(i+2) || event.Type != want.eventType || event.BuildID != want.buildID || event.Position != want.position {
+			t.Errorf("Expected event %d to be %s of %q at %d, got %+v", i+2, want.eventType, want.buildID, want.position, event)
+		}
+	}
+	if !slices.Equal(missed[2].Queue, reordered) {
+		t.Errorf("Expected the reprioritized queue %v, got %v", reordered, missed[2].Queue)
+	}
+
+	// Builds leave the queue as they are assigned
+	coordinator.workers["worker-1"] = &Worker{ID: "worker-1", Host: "127.0.0.1", Port: 1, Status: "idle", MaxBuilds: 1, LastPing: time.Now()}
+	coordinator.dispatchBuilds(pools.DefaultPool, pending, requests)
+	assigned := readQueueEvents(t, server.URL, "4", 1)[0]
+	if assigned.Type != QueueAssigned || assigned.BuildID != buildIDs[1] || assigned.WorkerID != "worker-1" || !slices.Equal(assigned.Queue, []string{buildIDs[2], buildIDs[0]}) {
+		t.Errorf("Expected %s to be assigned to worker-1, got %+v", buildIDs[1], assigned)
+	}
+}
+
+func TestBuildErrorCodes(t *testing.T) {
+	coordinator := NewBuildCoordinator(5)
+	coordinator.recovery.MaxRequeues = 1
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	fake := &copyWorker{id: "worker-1", started: make(chan string, 1), finish: make(chan error, 1)}
+	server := rpc.NewServer()
+	server.RegisterName("WorkerService", fake)
+	go server.Accept(listener)
+	coordinator.workers["worker-1"] = &Worker{ID: "worker-1", Host: "127.0.0.1", Port: listener.Addr().(*net.TCPAddr).Port, Status: "idle", MaxBuilds: 1, LastPing: time.Now()}
+
+	run := func(buildID string, failure error, status string) BuildProgress {
+		t.Helper()
+		coordinator.startBuild(<-coordinator.buildQueue)
+		<-fake.started
+		fake.finish <- failure
+		return waitForStatus(t, coordinator, buildID, status)
+	}
+
+	// Infrastructure errors are retried as long as the build has re-queues
+	// left, and count against the worker
+	buildID, _ := coordinator.SubmitBuild(BuildRequest{ProjectPath: "/test/app", TaskName: "build"})
+	progress := run(buildID, protocol.NewBuildError(protocol.ErrorInfra, "failed to check out"), BuildStatusQueued)
+	coordinator.mutex.RLock()
+	requeues := coordinator.requests[buildID].Requeues
+	coordinator.mutex.RUnlock()
+	if !strings.Contains(progress.Message, "INFRA_ERROR") || requeues != 1 {
+		t.Errorf("Expected the build to be re-queued after the infrastructure error, got %+v", progress)
+	}
+	run(buildID, protocol.NewBuildError(protocol.ErrorInfra, "failed to check out"), BuildStatusFailed)
+	response, _ := coordinator.GetBuildStatus(buildID)
+	if response.ErrorCode != protocol.ErrorInfra || response.ErrorMessage != "build failed: failed to check out" {
+		t.Errorf("Expected the infrastructure error once out of re-queues, got %q: %q", response.ErrorCode, response.ErrorMessage)
+	}
+
+	// Failures of the project fail the build at once and say nothing about
+	// the worker
+	buildID, _ = coordinator.SubmitBuild(BuildRequest{ProjectPath: "/test/app", TaskName: "test"})
+	run(buildID, protocol.NewBuildError(protocol.ErrorTestFailure, "gradle build failed: exit status 1"), BuildStatusFailed)
+	if response, _ := coordinator.GetBuildStatus(buildID); response.ErrorCode != protocol.ErrorTestFailure {
+		t.Errorf("Expected a test failure, got %q", response.ErrorCode)
+	}
+	coordinator.mutex.RLock()
+	failed := coordinator.reliability["worker-1"].failed
+	coordinator.mutex.RUnlock()
+	if failed != 2 {
+		t.Errorf("Expected only the 2 infrastructure errors to count against the worker, got %d", failed)
+	}
+
+	// Workers that do not classify their failures leave the code empty
+	buildID, _ = coordinator.SubmitBuild(BuildRequest{ProjectPath: "/test/app", TaskName: "assemble"})
+	run(buildID, fmt.Errorf("gradle build failed: exit status 1"), BuildStatusFailed)
+	if response, _ := coordinator.GetBuildStatus(buildID); response.ErrorCode != "" {
+		t.Errorf("Expected no error code, got %q", response.ErrorCode)
+	}
+}
+
+func TestBuildTags(t *testing.T) {
+	coordinator := NewBuildCoordinator(5)
+	handler := coordinator.routes(nil)
+	request := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w
+	}
+	listed := func(path string) []string {
+		t.Helper()
+		var builds []BuildSummary
+		if err := json.NewDecoder(request("GET", path, "").Body).Decode(&builds); err != nil {
+			t.Fatalf("Failed to decode builds: %v", err)
+		}
+		var buildIDs []string
+		for _, build := range builds {
+			buildIDs = append(buildIDs, build.BuildID)
+		}
+		slices.Sort(buildIDs)
+		return buildIDs
+	}
+
+	var buildIDs []string
+	for _, tags := range []string{`{"branch":"main","pr":"41"}`, `{"branch":"main","pr":"42"}`, `{}`} {
+		w := request("POST", "/api/build", `{"project_path":"/test/project","task_name":"build","tags":`+tags+`}`)
+		var submitted SubmitBuildResponse
+		if err := json.NewDecoder(w.Body).Decode(&submitted); err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		buildIDs = append(buildIDs, submitted.BuildID)
+		<-coordinator.buildQueue
+	}
+	if w := request("POST", "/api/build", `{"project_path":"/test/project","task_name":"build","tags":{"Branch":"main"}}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected invalid tags to be rejected, got %d", w.Code)
+	}
+
+	if found := listed("/api/builds?tag=branch:main"); !slices.Equal(found, slices.Sorted(slices.Values(buildIDs[:2]))) {
+		t.Errorf("Expected the builds of main, got %v", found)
+	}
+	if found := listed("/api/builds?tag=branch:main&tag=pr:42"); !slices.Equal(found, buildIDs[1:2]) {
+		t.Errorf("Expected the build of the pull request, got %v", found)
+	}
+	if w := request("GET", "/api/builds?tag=main", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected an invalid tag filter to be rejected, got %d", w.Code)
+	}
+
+	// Queued builds are recorded with their annotations when they finish
+	w := request("POST", "/api/builds/"+buildIDs[2]+"/annotations", `{"tags":{"release":"1.0"}}`)
+	var annotated BuildTags
+	if err := json.NewDecoder(w.Body).Decode(&annotated); err != nil || annotated.Tags["release"] != "1.0" {
+		t.Fatalf("Expected the build to be annotated, got %d %+v: %v", w.Code, annotated, err)
+	}
+	if found := listed("/api/builds?tag=release:1.0"); !slices.Equal(found, buildIDs[2:]) {
+		t.Errorf("Expected the annotated build, got %v", found)
+	}
+	for _, buildID := range buildIDs {
+		coordinator.CancelBuild(&CancelBuildArgs{BuildID: buildID}, &CancelBuildReply{})
+	}
+	if records, _ := coordinator.buildStore.Query(buildstore.Filter{Tags: map[string]string{"release": "1.0"}}); len(records) != 1 || records[0].BuildID != buildIDs[2] {
+		t.Errorf("Expected the annotated build to be recorded with its tags, got %+v", records)
+	}
+
+	// Finished builds are annotated in the build store, and filtered on in
+	// analytics
+	if w := request("POST", "/api/builds/"+buildIDs[1]+"/annotations", `{"tags":{"pr":"43"}}`); w.Code != http.StatusOK {
+		t.Errorf("Expected the finished build to be annotated, got %d: %s", w.Code, w.Body)
+	}
+	var table analytics.Table
+	if err := json.NewDecoder(request("GET", "/api/analytics/busiest-hours?tag=pr:43", "").Body).Decode(&table); err != nil {
+		t.Fatalf("Failed to decode busiest hours: %v", err)
+	}
+	if len(table.Rows) == 0 || table.Rows[0][1] != float64(1) {
+		t.Errorf("Expected the build of the annotated pull request, got %+v", table)
+	}
+	var status BuildStatusResponse
+	json.NewDecoder(request("GET", "/api/builds/"+buildIDs[1], "").Body).Decode(&status)
+	if status.Tags["pr"] != "43" || status.Tags["branch"] != "main" {
+		t.Errorf("Expected the build to have its annotated tags, got %v", status.Tags)
+	}
+
+	for path, expected := range map[string]int{
+		"/api/builds/" + buildIDs[0] + "/annotations": http.StatusBadRequest,
+		"/api/builds/non-existent/annotations":        http.StatusNotFound,
+	} {
+		body := `{"tags":{"pr":"44"}}`
+		if expected == http.StatusBadRequest {
+			body = `{"tags":{}}`
+		}
+		if w := request("POST", path, body); w.Code != expected {
+			t.Errorf("%s: expected status %d, got %d", path, expected, w.Code)
+		}
+	}
+	events, _ := coordinator.auditLog.Query(audit.Filter{Action: audit.ActionBuildAnnotated})
+	if len(events) != 2 {
+		t.Errorf("Expected 2 annotations in the audit log, got %+v", events)
+	}
+}
+
+// statusRecorder records the statuses reported by the coordinator
+type statusRecorder struct {
+	mutex    sync.Mutex
+	statuses []scmstatus.Status
+}
+
+func (r *statusRecorder) Kind() string {
+	return "recorder"
+}
+
+func (r *statusRecorder) Report(ctx context.Context, status scmstatus.Status) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.statuses = append(r.statuses, status)
+	return nil
+}
+
+func TestReportStatus(t *testing.T) {
+	recorder := &statusRecorder{}
+	scmstatus.Register("recorder", scmstatus.Plugin{Host: "scm.example.com", APIURL: "https://scm.example.com/api", New: func(scmstatus.Config, string, *http.Client) scmstatus.Reporter {
+		return recorder
+	}})
+	coordinator := NewBuildCoordinator(5)
+	coordinator.statusReports = defaultStatusReportConfig()
+	coordinator.statusReports.URL = "https://builds.example.com"
+	statuses, err := scmstatus.NewDispatcher([]scmstatus.Config{{Kind: "recorder", TokenSecret: "scm-token"}}, func(string) (string, error) {
+		return "token", nil
+	})
+	if err != nil {
+		t.Fatalf("NewDispatcher failed: %v", err)
+	}
+	coordinator.statuses = statuses
+
+	commit := strings.Repeat("ab", 20)
+	reported, err := coordinator.SubmitBuild(BuildRequest{
+		ProjectPath: "app",
+		TaskName:    "assemble",
+		Tags:        map[string]string{buildstore.TagRepository: "git@scm.example.com:team/app.git", buildstore.TagCommit: commit},
+	})
+	if err != nil {
+		t.Fatalf("SubmitBuild failed: %v", err)
+	}
+	<-coordinator.buildQueue
+	// Builds without a commit, or of hosts without a reporter, are skipped
+	for _, tags := range []map[string]string{
+		{buildstore.TagRepository: "git@scm.example.com:team/app.git", buildstore.TagCommit: "main"},
+		{buildstore.TagRepository: "https://github.com/team/app.git", buildstore.TagCommit: commit},
+	} {
+		if _, err := coordinator.SubmitBuild(BuildRequest{ProjectPath: "app", TaskName: "assemble", Tags: tags}); err != nil {
+			t.Fatalf("SubmitBuild failed: %v", err)
+		}
+		<-coordinator.buildQueue
+	}
+	coordinator.publishStarted(reported, "worker-1")
+	coordinator.CancelBuild(&CancelBuildArgs{BuildID: reported}, &CancelBuildReply{})
+	coordinator.statuses.Close()
+
+	var states []string
+	for _, status := range recorder.statuses {
+		states = append(states, status.State)
+		if status.BuildID != reported || status.Commit != commit || status.Repository.Path() != "team/app" {
+			t.Errorf("Unexpected status %+v", status)
+		}
+		if status.Context != "distributed-gradle/app assemble" || status.TargetURL != "https://builds.example.com/api/builds/"+reported+"/log" {
+			t.Errorf("Unexpected context or target URL of %+v", status)
+		}
+	}
+	if strings.Join(states, ",") != "pending,running,cancelled" {
+		t.Errorf("Expected the build to be reported pending, running and cancelled, got %v", states)
+	}
+
+	state, description := finishedStatus(events.Event{Status: BuildStatusFailed, ErrorCode: "compilation", ErrorMessage: strings.Repeat("error ", 50)})
+	if state != scmstatus.StateFailure || len(description) > maxStatusDescription || !strings.HasPrefix(description, "Failed (compilation): error") {
+		t.Errorf("Unexpected failure status %s %q", state, description)
+	}
+}
+
+// hookWorker is a worker RPC service that records the hooks of the builds
+// it receives and reports running them
+type hookWorker struct {
+	coordinator *BuildCoordinator
+	received    chan *hooks.Hooks
+}
+
+func (h *hookWorker) Build(request BuildRequest, response *string) error {
+	h.received <- request.Hooks
+	now := time.Now()
+	step := hooks.Step{Name: "emulator", Phase: hooks.PhasePre, Status: hooks.StatusSucceeded, Output: "emulator ready", StartTime: now.Add(-time.Second), EndTime: now}
+	return h.coordinator.ReportProgress(&ReportProgressArgs{BuildID: request.RequestID, WorkerID: "worker-1", Step: "pre-build hook emulator", Hook: &step}, &ReportProgressReply{})
+}
+
+func TestBuildHooks(t *testing.T) {
+	coordinator := NewBuildCoordinator(5)
+	coordinator.buildHooks = hooks.Rules{{Project: "/test/*", Hooks: hooks.Hooks{
+		Pre:  []hooks.Hook{{Name: "emulator", Run: "start-emulator"}},
+		Post: []hooks.Hook{{Name: "stop-emulator", Run: "stop-emulator", Always: true}},
+	}}}
+	handler := coordinator.routes(nil)
+	submit := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("POST", "/api/build", strings.NewReader(body)))
+		return w
+	}
+
+	if w := submit(`{"project_path":"/test/project","task_name":"build","hooks":{"pre":[{"name":"seed db","run":"seed"}]}}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected invalid hooks to be rejected, got %d", w.Code)
+	}
+	w := submit(`{"project_path":"/test/project","task_name":"build","hooks":{"pre":[{"name":"seed","run":"seed","timeout_seconds":60}],"post":[{"name":"sign","run":"sign"}]}}`)
+	var submitted SubmitBuildResponse
+	if err := json.NewDecoder(w.Body).Decode(&submitted); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("Expected build to be queued, got %d: %v", w.Code, err)
+	}
+
+	// The worker runs the hooks of the project around those of the build
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+	fake := &hookWorker{coordinator: coordinator, received: make(chan *hooks.Hooks, 1)}
+	server := rpc.NewServer()
+	server.RegisterName("WorkerService", fake)
+	go server.Accept(listener)
+
+	worker := &Worker{ID: "worker-1", Host: "127.0.0.1", Port: listener.Addr().(*net.TCPAddr).Port, MaxBuilds: 1, ActiveBuilds: 1}
+	coordinator.mutex.Lock()
+	coordinator.progress[submitted.BuildID].WorkerID = worker.ID
+	coordinator.mutex.Unlock()
+	coordinator.executeBuildOnWorker(worker, <-coordinator.buildQueue)
+
+	received := <-fake.received
+	var names []string
+	for _, hook := range append(received.Pre, received.Post...) {
+		names = append(names, hook.Name)
+	}
+	if strings.Join(names, ",") != "emulator,seed,sign,stop-emulator" || received.Pre[1].TimeoutSeconds != 60 {
+		t.Errorf("Expected the project's hooks around the build's, got %+v", received)
+	}
+	if request := coordinator.requests[submitted.BuildID]; len(request.Hooks.Pre) != 1 {
+		t.Errorf("Expected the build to keep its own hooks, got %+v", request.Hooks)
+	}
+
+	// Hooks are reported as build steps with their output
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/builds/"+submitted.BuildID, nil))
+	var status BuildStatusResponse
+	if err := json.NewDecoder(w.Body).Decode(&status); err != nil {
+		t.Fatalf("Failed to decode build: %v", err)
+	}
+	steps := status.Metrics.BuildSteps
+	if len(steps) != 1 || steps[0].Name != "pre-build hook emulator" || steps[0].Status != hooks.StatusSucceeded ||
+		steps[0].Output != "emulator ready" || steps[0].Duration != time.Second {
+		t.Errorf("Expected the hook's step, got %+v", steps)
+	}
+}
+
+// deviceWorker is a worker RPC service that reports the devices allocated to
+// the builds it receives and runs them until told to finish
+type deviceWorker struct {
+	id      string
+	started chan []string
+	finish  chan struct{}
+}
+
+func (d *deviceWorker) Build(request BuildRequest, response *string) error {
+	d.started <- append([]string{d.id}, request.DeviceSerials...)
+	<-d.finish
+	return nil
+}
+
+func TestDeviceScheduling(t *testing.T) {
+	coordinator := NewBuildCoordinator(5)
+	handler := coordinator.routes(nil)
+	started := make(chan []string, 2)
+	fakes := make(map[string]*deviceWorker)
+	attached := map[string][]devices.Device{
+		"worker-1": {{Serial: "emulator-5554", Kind: devices.KindEmulator, APILevel: 30, ABI: "x86_64"}},
+		"worker-2": {
+			{Serial: "emulator-5554", Kind: devices.KindEmulator, APILevel: 34, ABI: "x86_64"},
+			{Serial: "emulator-5556", Kind: devices.KindEmulator, APILevel: 34, ABI: "x86_64"},
+		},
+	}
+	for _, id := range []string{"worker-1", "worker-2"} {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Failed to listen: %v", err)
+		}
+		t.Cleanup(func() { listener.Close() })
+		fakes[id] = &deviceWorker{id: id, started: started, finish: make(chan struct{}, 1)}
+		server := rpc.NewServer()
+		server.RegisterName("WorkerService", fakes[id])
+		go server.Accept(listener)
+
+		args := RegisterWorkerArgs{ID: id, Host: "127.0.0.1", Port: listener.Addr().(*net.TCPAddr).Port, MaxBuilds: 2, Devices: attached[id]}
+		if err := coordinator.RegisterWorker(&args, &RegisterWorkerReply{}); err != nil {
+			t.Fatalf("RegisterWorker failed: %v", err)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/api/build", strings.NewReader(`{"project_path":"/test/app","task_name":"connectedAndroidTest","devices":{"kind":"simulator"}}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected an invalid device requirement to be rejected, got %d", w.Code)
+	}
+
+	// The build goes to the worker with a device of its API level
+	first, err := coordinator.SubmitBuild(BuildRequest{ProjectPath: "/test/app", TaskName: "connectedAndroidTest", Devices: &devices.Requirement{MinAPILevel: 33}})
+	if err != nil {
+		t.Fatalf("SubmitBuild failed: %v", err)
+	}
+	if !coordinator.startBuild(<-coordinator.buildQueue) {
+		t.Fatal("Expected the build to start")
+	}
+	if received := <-started; len(received) != 2 || received[0] != "worker-2" {
+		t.Fatalf("Expected one device of worker-2, got %v", received)
+	}
+	coordinator.mutex.RLock()
+	candidates := coordinator.scheduling[first][0].Candidates
+	coordinator.mutex.RUnlock()
+	for _, candidate := range candidates {
+		if candidate.WorkerID == "worker-1" && candidate.Skipped != "no suitable device" {
+			t.Errorf("Expected worker-1 to be skipped for its device, got %+v", candidate)
+		}
+	}
+
+	// Builds needing more devices than are free wait without holding up
+	// the others
+	second, _ := coordinator.SubmitBuild(BuildRequest{ProjectPath: "/test/app", TaskName: "connectedCheck", Devices: &devices.Requirement{Count: 2}})
+	request := <-coordinator.buildQueue
+	if coordinator.startBuild(request) {
+		t.Fatal("Expected the build to wait for a second free device")
+	}
+	coordinator.mutex.RLock()
+	state := coordinator.pendingState(pools.DefaultPool, map[string]BuildRequest{second: request})
+	coordinator.mutex.RUnlock()
+	if !state.waiting[second] {
+		t.Errorf("Expected the build to wait for devices")
+	}
+
+	// Heartbeats keep the allocations, and finished builds free their
+	// devices
+	heartbeat := HeartbeatArgs{ID: "worker-2", Status: "idle", Devices: attached["worker-2"]}
+	if err := coordinator.Heartbeat(&heartbeat, &HeartbeatReply{}); err != nil {
+		t.Fatalf("Heartbeat failed: %v", err)
+	}
+	coordinator.mutex.RLock()
+	allocated := slices.ContainsFunc(coordinator.workers["worker-2"].Devices, func(device devices.Device) bool { return device.BuildID == first })
+	coordinator.mutex.RUnlock()
+	if !allocated {
+		t.Errorf("Expected the heartbeat to keep the build's device allocated")
+	}
+	fakes["worker-2"].finish <- struct{}{}
+	waitForStatus(t, coordinator, first, BuildStatusCompleted)
+	deadline := time.Now().Add(5 * time.Second)
+	for !coordinator.startBuild(request) {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the build to start once the devices were freed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if received := <-started; !slices.Equal(received, []string{"worker-2", "emulator-5554", "emulator-5556"}) {
+		t.Errorf("Expected both devices of worker-2, got %v", received)
+	}
+	fakes["worker-2"].finish <- struct{}{}
+	waitForStatus(t, coordinator, second, BuildStatusCompleted)
+
+	// Other builds get no devices
+	coordinator.SubmitBuild(BuildRequest{ProjectPath: "/test/app", TaskName: "build"})
+	if !coordinator.startBuild(<-coordinator.buildQueue) {
+		t.Fatal("Expected the build to start")
+	}
+	received := <-started
+	if len(received) != 1 {
+		t.Errorf("Expected no devices for the build, got %v", received)
+	}
+	fakes[received[0]].finish <- struct{}{}
+}
+
+func TestBuildDependencies(t *testing.T) {
+	coordinator := NewBuildCoordinator(10)
+	handler := coordinator.routes(nil)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	fake := &copyWorker{id: "worker-1", started: make(chan string, 1), finish: make(chan error, 1)}
+	server := rpc.NewServer()
+	server.RegisterName("WorkerService", fake)
+	go server.Accept(listener)
+	coordinator.workers["worker-1"] = &Worker{ID: "worker-1", Host: "127.0.0.1", Port: listener.Addr().(*net.TCPAddr).Port, Status: "idle", MaxBuilds: 1, LastPing: time.Now()}
+
+	run := func(request BuildRequest, failure error, status string) {
+		t.Helper()
+		if !coordinator.startBuild(request) {
+			t.Fatalf("Expected build %s to start", request.RequestID)
+		}
+		<-fake.started
+		fake.finish <- failure
+		waitForStatus(t, coordinator, request.RequestID, status)
+	}
+	waiting := func(request BuildRequest) bool {
+		coordinator.mutex.RLock()
+		defer coordinator.mutex.RUnlock()
+		return coordinator.pendingState(pools.DefaultPool, map[string]BuildRequest{request.RequestID: request}).waiting[request.RequestID]
+	}
+
+	library, _ := coordinator.SubmitBuild(BuildRequest{ProjectPath: "/test/lib", TaskName: "publishToMavenLocal"})
+	libraryRequest := <-coordinator.buildQueue
+	for _, body := range []string{
+		`{"project_path":"/test/app","task_name":"build","depends_on":["build-unknown"]}`,
+		`{"project_path":"/test/app","task_name":"build","depends_on":["` + library + `","` + library + `"]}`,
+	} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("POST", "/api/build", strings.NewReader(body)))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected %s to be rejected, got %d", body, w.Code)
+		}
+	}
+
+	// The app waits in the queue until the library completed
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/api/build", strings.NewReader(`{"project_path":"/test/app","task_name":"build","depends_on":["`+library+`"]}`)))
+	var submitted SubmitBuildResponse
+	if err := json.NewDecoder(w.Body).Decode(&submitted); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("Expected the build to be queued, got %d: %v", w.Code, err)
+	}
+	app := <-coordinator.buildQueue
+	if progress, _ := coordinator.GetBuildProgress(submitted.BuildID); progress.Status != BuildStatusQueued || progress.Message != "waiting for build "+library {
+		t.Errorf("Expected the build to wait for the library, got %+v", progress)
+	}
+	if !waiting(app) {
+		t.Errorf("Expected the build to wait without holding up the queue")
+	}
+	run(libraryRequest, nil, BuildStatusCompleted)
+	if progress, _ := coordinator.GetBuildProgress(app.RequestID); progress.Message != "" || waiting(app) {
+		t.Errorf("Expected the build to be released, got %+v", progress)
+	}
+	run(app, nil, BuildStatusCompleted)
+
+	// Builds fail fast when a dependency fails, and so do the builds
+	// depending on them
+	failing, _ := coordinator.SubmitBuild(BuildRequest{ProjectPath: "/test/lib", TaskName: "check"})
+	failingRequest := <-coordinator.buildQueue
+	dependent, _ := coordinator.SubmitBuild(BuildRequest{ProjectPath: "/test/app", TaskName: "check", DependsOn: []string{library, failing}})
+	dependentRequest := <-coordinator.buildQueue
+	transitive, _ := coordinator.SubmitBuild(BuildRequest{ProjectPath: "/test/e2e", TaskName: "check", DependsOn: []string{dependent}})
+	<-coordinator.buildQueue
+	run(failingRequest, protocol.NewBuildError(protocol.ErrorTestFailure, "tests failed"), BuildStatusFailed)
+	for _, buildID := range []string{dependent, transitive} {
+		response, _ := coordinator.GetBuildStatus(buildID)
+		if progress, _ := coordinator.GetBuildProgress(buildID); progress.Status != BuildStatusFailed || !strings.HasPrefix(response.ErrorMessage, "dependency build ") {
+			t.Errorf("Expected %s to fail with its dependency, got %+v: %q", buildID, progress, response.ErrorMessage)
+		}
+	}
+	if response, _ := coordinator.GetBuildStatus(dependent); response.ErrorMessage != "dependency build "+failing+" failed" {
+		t.Errorf("Unexpected error %q", response.ErrorMessage)
+	}
+	if !coordinator.startBuild(dependentRequest) {
+		t.Errorf("Expected the failed build to leave the queue")
+	}
+	select {
+	case <-fake.started:
+		t.Errorf("Expected the failed build not to run")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	late, _ := coordinator.SubmitBuild(BuildRequest{ProjectPath: "/test/app", TaskName: "check", DependsOn: []string{failing}})
+	if progress, _ := coordinator.GetBuildProgress(late); progress.Status != BuildStatusFailed || len(coordinator.buildQueue) != 0 {
+		t.Errorf("Expected a build depending on a failed build to fail without being queued, got %+v", progress)
+	}
+	coordinator.mutex.RLock()
+	remaining := len(coordinator.dependents)
+	coordinator.mutex.RUnlock()
+	if remaining != 0 {
+		t.Errorf("Expected no builds left waiting, got %d", remaining)
+	}
+}
+
+func TestSubmitBuildQueueFull(t *testing.T) {
+	coordinator := NewBuildCoordinator(10)
+	library, _ := coordinator.SubmitBuild(BuildRequest{ProjectPath: "/test/lib", TaskName: "build"})
+	for len(coordinator.buildQueue) < cap(coordinator.buildQueue) {
+		if _, err := coordinator.SubmitBuild(BuildRequest{ProjectPath: "/test/lib", TaskName: "check"}); err != nil {
+			t.Fatalf("Failed to fill the queue: %v", err)
+		}
+	}
+
+	// A build the queue has no room for leaves nothing behind
+	_, err := coordinator.SubmitBuild(BuildRequest{RequestID: "build-rejected", ProjectPath: "/test/app", TaskName: "build", DependsOn: []string{library}, Tags: map[string]string{"team": "app"}})
+	if err == nil {
+		t.Fatal("Expected the build to be rejected with the queue full")
+	}
+	coordinator.mutex.RLock()
+	_, built := coordinator.builds["build-rejected"]
+	_, requested := coordinator.requests["build-rejected"]
+	_, progressed := coordinator.progress["build-rejected"]
+	waiting := len(coordinator.dependents)
+	tagged := len(coordinator.tags.matching(map[string]string{"team": "app"}))
+	coordinator.mutex.RUnlock()
+	if built || requested || progressed || waiting != 0 || tagged != 0 {
+		t.Errorf("Expected the rejected build to be forgotten, got build %v, request %v, progress %v, %d waiting and %d tagged", built, requested, progressed, waiting, tagged)
+	}
+	if _, err := coordinator.GetBuildStatus("build-rejected"); err == nil {
+		t.Error("Expected the rejected build to be unknown")
+	}
+}
+
+func TestResultSigning(t *testing.T) {
+	coordinator := NewBuildCoordinator(10)
+	handler := coordinator.routes(nil)
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+	buildID, _ := coordinator.SubmitBuild(BuildRequest{ProjectPath: "/test/app", TaskName: "build"})
+
+	// Without a key results are served unsigned
+	var keys signing.KeySet
+	if err := json.NewDecoder(get("/api/keys/signing").Body).Decode(&keys); err != nil || len(keys.Keys) != 0 {
+		t.Errorf("Expected no keys, got %+v: %v", keys, err)
+	}
+	if w := get("/api/builds/" + buildID); w.Code != http.StatusOK || w.Header().Get(signing.Header) != "" {
+		t.Errorf("Expected an unsigned status, got %d %q", w.Code, w.Header().Get(signing.Header))
+	}
+
+	signer, err := signing.Load(filepath.Join(t.TempDir(), "signing-key.pem"))
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	coordinator.signer = signer
+	if err := json.NewDecoder(get("/api/keys/signing").Body).Decode(&keys); err != nil || len(keys.Keys) != 1 {
+		t.Fatalf("Expected the signing key, got %+v: %v", keys, err)
+	}
+	verifier, err := signing.NewVerifier(keys.Keys...)
+	if err != nil {
+		t.Fatalf("NewVerifier failed: %v", err)
+	}
+	for _, path := range []string{"/api/builds/" + buildID, "/api/builds/" + buildID + "/artifacts"} {
+		w := get(path)
+		if err := verifier.Verify(w.Body.Bytes(), w.Header().Get(signing.Header)); err != nil || w.Header().Get("Content-Type") != "application/json" {
+			t.Errorf("Expected %s to be signed, got %v", path, err)
+		}
+	}
+}
+
+func TestWorkerAttestation(t *testing.T) {
+	binary := filepath.Join(t.TempDir(), "worker")
+	os.WriteFile(binary, []byte("worker binary"), 0755)
+	checksum, _ := protocol.FileSHA256(binary)
+	enrolled, _ := signing.Generate()
+	rogue, _ := signing.Generate()
+	policy := &attestation.Policy{Keys: []string{enrolled.PublicKey().PublicKey}, Binaries: []string{checksum}}
+	path := filepath.Join(t.TempDir(), "workers.json")
+
+	coordinator := NewBuildCoordinator(5)
+	coordinator.registry, _ = registry.Open(path)
+	coordinator.attestation = policy
+	register := func(signer *signing.Signer) error {
+		args := RegisterWorkerArgs{ID: "worker-1", Host: "10.0.0.5", Port: 8082, MaxBuilds: 2, Transport: TransportPull}
+		if signer != nil {
+			args.Attestation, _ = attestation.Attest(signer, "worker-1", binary, time.Now())
+		}
+		return coordinator.RegisterWorker(&args, &RegisterWorkerReply{})
+	}
+
+	for name, signer := range map[string]*signing.Signer{"unattested": nil, "rogue": rogue} {
+		if err := register(signer); err == nil || !strings.Contains(err.Error(), "failed attestation") {
+			t.Errorf("Expected the %s worker to be rejected, got %v", name, err)
+		}
+	}
+	if len(coordinator.workers) != 0 {
+		t.Fatalf("Expected no worker to join, got %v", coordinator.workers)
+	}
+	if events, _ := coordinator.auditLog.Query(audit.Filter{Action: audit.ActionWorkerRejected, Resource: "worker-1"}); len(events) != 2 || events[0].SourceIP != "10.0.0.5" {
+		t.Errorf("Expected the rejections to be audited, got %+v", events)
+	}
+
+	if err := register(enrolled); err != nil {
+		t.Fatalf("Expected the enrolled worker to register, got %v", err)
+	}
+	if worker := coordinator.workers["worker-1"]; worker.Attestation == nil || worker.Attestation.BinarySHA256 != checksum || worker.Attestation.Key.KeyID != enrolled.KeyID() {
+		t.Errorf("Expected the worker's attestation, got %+v", worker.Attestation)
+	}
+
+	// Restored workers must still satisfy the policy
+	restart := func(policy *attestation.Policy) *BuildCoordinator {
+		restarted := NewBuildCoordinator(5)
+		restarted.registry, _ = registry.Open(path)
+		restarted.attestation = policy
+		restarted.reconcileWorkers()
+		return restarted
+	}
+	if restarted := restart(policy); restarted.workers["worker-1"] == nil || restarted.workers["worker-1"].Attestation == nil {
+		t.Errorf("Expected the attested worker to be restored, got %v", restarted.workers)
+	}
+	if restarted := restart(&attestation.Policy{Keys: []string{rogue.PublicKey().PublicKey}}); len(restarted.workers) != 0 || len(restarted.registry.List()) != 0 {
+		t.Errorf("Expected a worker whose key is no longer allowed to be forgotten, got %v", restarted.workers)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"io/fs"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"distributed-gradle-building/buildstore"
+)
+
+// dashboardFiles holds the single-page dashboard served at /
+//
+//go:embed dashboard
+var dashboardFiles embed.FS
+
+// defaultBuildListLimit is the number of builds listed without a limit
+const defaultBuildListLimit = 50
+
+// BuildSummary is a build as listed by GET /api/builds
+type BuildSummary struct {
+	BuildID      string            `json:"build_id"`
+	ProjectPath  string            `json:"project_path"`
+	TaskName     string            `json:"task_name"`
+	WorkerID     string            `json:"worker_id"`
+	Status       string            `json:"status"`
+	Progress     float64           `json:"progress"`
+	Step         string            `json:"step"`
+	Message      string            `json:"message"`
+	SubmittedAt  time.Time         `json:"submitted_at"`
+	StartedAt    time.Time         `json:"started_at"`
+	UpdatedAt    time.Time         `json:"updated_at"`
+	Duration     time.Duration     `json:"duration"`
+	CacheHitRate float64           `json:"cache_hit_rate"`
+	Paused       bool              `json:"paused,omitempty"`
+	Throttled    bool              `json:"throttled,omitempty"`
+	Tags         map[string]string `json:"tags,omitempty"`
+}
+
+// CoordinatorStats summarises the queue, worker pool and cache effectiveness
+type CoordinatorStats struct {
+	QueuedBuilds    int       `json:"queued_builds"`
+	RunningBuilds   int       `json:"running_builds"`
+	CompletedBuilds int       `json:"completed_builds"`
+	FailedBuilds    int       `json:"failed_builds"`
+	CancelledBuilds int       `json:"cancelled_builds"`
+	Workers         int       `json:"workers"`
+	BusyWorkers     int       `json:"busy_workers"`
+	TotalSlots      int       `json:"total_slots"`
+	UsedSlots       int       `json:"used_slots"`
+	Utilization     float64   `json:"utilization"`
+	CacheHitRate    float64   `json:"cache_hit_rate"`
+	Timestamp       time.Time `json:"timestamp"`
+}
+
+// ListBuilds returns the most recently submitted builds carrying every tag
+// of a filter, newest first
+func (bc *BuildCoordinator) ListBuilds(limit int, tags map[string]string) []BuildSummary {
+	bc.mutex.RLock()
+	defer bc.mutex.RUnlock()
+
+	var tagged map[string]struct{}
+	if len(tags) > 0 {
+		tagged = bc.tags.matching(tags)
+	}
+
+	builds := make([]BuildSummary, 0, len(bc.progress))
+	for buildID, progress := range bc.progress {
+		if _, matches := tagged[buildID]; tagged != nil && !matches {
+			continue
+		}
+		request := bc.requests[buildID]
+		summary := BuildSummary{
+			BuildID:     buildID,
+			ProjectPath: request.ProjectPath,
+			TaskName:    request.TaskName,
+			WorkerID:    progress.WorkerID,
+			Status:      progress.Status,
+			Progress:    progress.Progress,
+			Step:        progress.Step,
+			Message:     progress.Message,
+			SubmittedAt: request.Timestamp,
+			StartedAt:   progress.StartedAt,
+			UpdatedAt:   progress.UpdatedAt,
+			Paused:      progress.Paused,
+			Throttled:   progress.Throttled,
+			Tags:        bc.tags.get(buildID),
+		}
+
+		if response, exists := bc.builds[buildID]; exists {
+			summary.Duration = response.BuildDuration
+			summary.CacheHitRate = response.Metrics.CacheHitRate
+		}
+		if progress.Status == BuildStatusRunning {
+			summary.Duration = bc.elapsed(buildID)
+		}
+
+		builds = append(builds, summary)
+	}
+
+	sort.Slice(builds, func(i, j int) bool {
+		return builds[i].SubmittedAt.After(builds[j].SubmittedAt)
+	})
+	if limit > 0 && len(builds) > limit {
+		builds = builds[:limit]
+	}
+
+	return builds
+}
+
+// GetStats counts builds by status and worker slot usage. The cache hit rate
+// is the average over completed builds.
+func (bc *BuildCoordinator) GetStats() CoordinatorStats {
+	bc.mutex.RLock()
+	defer bc.mutex.RUnlock()
+
+	stats := CoordinatorStats{Workers: len(bc.workers), Timestamp: time.Now()}
+
+	var hitRates float64
+	for buildID, progress := range bc.progress {
+		switch progress.Status {
+		case BuildStatusQueued:
+			stats.QueuedBuilds++
+		case BuildStatusRunning:
+			stats.RunningBuilds++
+		case BuildStatusCompleted:
+			stats.CompletedBuilds++
+			if response, exists := bc.builds[buildID]; exists {
+				hitRates += response.Metrics.CacheHitRate
+			}
+		case BuildStatusFailed:
+			stats.FailedBuilds++
+		case BuildStatusCancelled:
+			stats.CancelledBuilds++
+		}
+	}
+	if stats.CompletedBuilds > 0 {
+		stats.CacheHitRate = hitRates / float64(stats.CompletedBuilds)
+	}
+
+	for _, worker := range bc.workers {
+		if worker.Status == "busy" {
+			stats.BusyWorkers++
+		}
+		stats.TotalSlots += worker.capacity()
+		stats.UsedSlots += worker.ActiveBuilds
+	}
+	if stats.TotalSlots > 0 {
+		stats.Utilization = float64(stats.UsedSlots) / float64(stats.TotalSlots)
+	}
+
+	return stats
+}
+
+func (bc *BuildCoordinator) handleListBuilds(w http.ResponseWriter, r *http.Request) {
+	limit := defaultBuildListLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			http.Error(w, "invalid limit: "+value, http.StatusBadRequest)
+			return
+		}
+		limit = parsed
+	}
+	tags, err := buildstore.ParseTagFilter(r.URL.Query()["tag"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(bc.ListBuilds(limit, tags))
+}
+
+func (bc *BuildCoordinator) handleGetStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(bc.GetStats())
+}
+
+// dashboardHandler serves the embedded dashboard page. The page itself holds
+// no data; it reads everything from the JSON APIs.
+func dashboardHandler() http.Handler {
+	files, err := fs.Sub(dashboardFiles, "dashboard")
+	if err != nil {
+		panic(err)
+	}
+	return http.FileServer(http.FS(files))
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	"distributed-gradle-building/protocol"
+)
+
+// maxDependencies is the most builds a build may depend on
+const maxDependencies = 32
+
+// validateDependencies checks that the builds a build depends on are known
+// to the coordinator
+func (bc *BuildCoordinator) validateDependencies(request BuildRequest) error {
+	if len(request.DependsOn) == 0 {
+		return nil
+	}
+	if len(request.DependsOn) > maxDependencies {
+		return fmt.Errorf("a build may depend on at most %d builds", maxDependencies)
+	}
+
+	bc.mutex.RLock()
+	defer bc.mutex.RUnlock()
+	for i, dependency := range request.DependsOn {
+		if slices.Contains(request.DependsOn[:i], dependency) {
+			return fmt.Errorf("duplicate dependency %s", dependency)
+		}
+		if _, exists := bc.progress[dependency]; !exists {
+			return fmt.Errorf("dependency build %s not found", dependency)
+		}
+	}
+	return nil
+}
+
+// pendingDependencies returns the dependencies of a build that did not
+// complete yet, and the first one that failed, was cancelled or is unknown,
+// such as after a restart. Must be called with the mutex held.
+func (bc *BuildCoordinator) pendingDependencies(request BuildRequest) (pending []string, failed string) {
+	for _, dependency := range request.DependsOn {
+		progress, exists := bc.progress[dependency]
+		switch {
+		case !exists || progress.Status == BuildStatusFailed || progress.Status == BuildStatusCancelled:
+			return pending, dependency
+		case progress.Status != BuildStatusCompleted:
+			pending = append(pending, dependency)
+		}
+	}
+	return pending, ""
+}
+
+// waitForDependencies registers a queued build with the builds it waits
+// for. Must be called with the mutex held.
+func (bc *BuildCoordinator) waitForDependencies(request BuildRequest, pending []string) {
+	for _, dependency := range pending {
+		bc.dependents[dependency] = append(bc.dependents[dependency], request.RequestID)
+	}
+	if progress, exists := bc.progress[request.RequestID]; exists && len(pending) > 0 {
+		progress.Message = "waiting for build " + strings.Join(pending, ", ")
+	}
+}
+
+// stopWaiting unregisters a build that was not queued from the builds it
+// waited for. Must be called with the mutex held.
+func (bc *BuildCoordinator) stopWaiting(buildID string, pending []string) {
+	for _, dependency := range pending {
+		dependents := slices.DeleteFunc(bc.dependents[dependency], func(dependent string) bool {
+			return dependent == buildID
+		})
+		if len(dependents) == 0 {
+			delete(bc.dependents, dependency)
+		} else {
+			bc.dependents[dependency] = dependents
+		}
+	}
+}
+
+// releaseDependents updates the builds waiting for a finished build: they
+// fail if it did not complete, and are no longer shown waiting once the
+// last of their dependencies completed. Must be called with the mutex held.
+func (bc *BuildCoordinator) releaseDependents(buildID, status string) {
+	dependents := bc.dependents[buildID]
+	delete(bc.dependents, buildID)
+	for _, dependent := range dependents {
+		progress, exists := bc.progress[dependent]
+		if !exists || progress.Status != BuildStatusQueued {
+			continue
+		}
+		if status != BuildStatusCompleted {
+			bc.failDependent(dependent, buildID)
+			continue
+		}
+		if pending, _ := bc.pendingDependencies(bc.requests[dependent]); len(pending) == 0 {
+			progress.Message = ""
+			progress.UpdatedAt = time.Now()
+			bc.notifyProgress(dependent)
+		}
+	}
+}
+
+// failDependent fails a build whose dependency did not complete, and in
+// turn the builds depending on it. Must be called with the mutex held.
+func (bc *BuildCoordinator) failDependent(buildID, dependency string) {
+	message := fmt.Sprintf("dependency build %s did not complete", dependency)
+	if progress, exists := bc.progress[dependency]; exists {
+		message = fmt.Sprintf("dependency build %s %s", dependency, progress.Status)
+	}
+	log.Printf("Build %s failed: %s", buildID, message)
+	bc.failBuild(buildID, protocol.ErrorCompile, message)
+}
+
+// isBuildFailed reports whether a queued build failed, as builds do when a
+// dependency did not complete
+func (bc *BuildCoordinator) isBuildFailed(buildID string) bool {
+	bc.mutex.RLock()
+	defer bc.mutex.RUnlock()
+
+	progress, exists := bc.progress[buildID]
+	return exists && progress.Status == BuildStatusFailed
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"distributed-gradle-building/devices"
+)
+
+// deviceRequirement returns the Android devices a build needs: those it asks
+// for, or any one device for tasks running instrumentation tests. It returns
+// nil for builds needing no device.
+func deviceRequirement(request BuildRequest) *devices.Requirement {
+	if request.Devices != nil {
+		return request.Devices
+	}
+	if devices.NeedsDevices(request.TaskName) {
+		return &devices.Requirement{}
+	}
+	return nil
+}
+
+// setDevices records the devices a worker reported, marking those locked to
+// its builds. Must be called with the mutex held.
+func (w *Worker) setDevices(attached []devices.Device) {
+	if w.deviceLocks == nil {
+		w.deviceLocks = &devices.Locks{}
+	}
+	w.Devices = w.deviceLocks.Annotate(attached)
+}
+
+// hasFreeDevices reports whether enough of a worker's devices that no build
+// holds meet a requirement. Must be called with the mutex held.
+func (w *Worker) hasFreeDevices(requirement devices.Requirement) bool {
+	return w.deviceLocks != nil && w.deviceLocks.Available(w.Devices, requirement)
+}
+
+// acquireDevices allocates the devices a build needs on a worker and sets
+// them on the request sent to it. It returns false if the worker lacks free
+// suitable devices. Must be called with the mutex held.
+func (w *Worker) acquireDevices(request *BuildRequest) bool {
+	requirement := deviceRequirement(*request)
+	if requirement == nil {
+		return true
+	}
+	if !w.hasFreeDevices(*requirement) {
+		return false
+	}
+	allocated, err := w.deviceLocks.Acquire(request.RequestID, w.Devices, *requirement, nil)
+	if err != nil {
+		return false
+	}
+	w.Devices = w.deviceLocks.Annotate(w.Devices)
+	request.Devices, request.DeviceSerials = requirement, devices.Serials(allocated)
+	return true
+}
+
+// releaseDevices frees the devices of a build that ended on a worker
+func (bc *BuildCoordinator) releaseDevices(worker *Worker, buildID string) {
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+
+	if worker.deviceLocks != nil {
+		worker.deviceLocks.Release(buildID)
+		worker.Devices = worker.deviceLocks.Annotate(worker.Devices)
+	}
+}
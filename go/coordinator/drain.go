@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// DrainConfig configures how the coordinator shuts down. It stops accepting
+// builds, waits up to Timeout for the running builds to finish and saves the
+// builds left to QueueFile, which the next start queues again. An empty
+// QueueFile loses them.
+type DrainConfig struct {
+	Timeout   time.Duration `json:"timeout"`
+	QueueFile string        `json:"queue_file"`
+}
+
+// defaultDrainConfig waits five minutes for running builds and keeps the
+// queue in memory only
+func defaultDrainConfig() DrainConfig {
+	return DrainConfig{Timeout: 5 * time.Minute}
+}
+
+// loadDrainConfig loads shutdown settings from environment variables. The
+// queue is saved to data/queue.json unless BUILD_QUEUE_FILE says otherwise.
+func loadDrainConfig() DrainConfig {
+	config := defaultDrainConfig()
+	config.QueueFile = filepath.Join("data", "queue.json")
+
+	if value, err := time.ParseDuration(os.Getenv("SHUTDOWN_DRAIN_TIMEOUT")); err == nil && value >= 0 {
+		config.Timeout = value
+	}
+	if path := os.Getenv("BUILD_QUEUE_FILE"); path != "" {
+		config.QueueFile = path
+	}
+
+	return config
+}
+
+// isDraining reports whether the coordinator is shutting down
+func (bc *BuildCoordinator) isDraining() bool {
+	bc.mutex.RLock()
+	defer bc.mutex.RUnlock()
+	return bc.draining
+}
+
+// rejectWhileDraining answers 503 Service Unavailable to submissions made
+// while the coordinator is shutting down and reports whether it did
+func (bc *BuildCoordinator) rejectWhileDraining(w http.ResponseWriter) bool {
+	if !bc.isDraining() {
+		return false
+	}
+	http.Error(w, "coordinator is shutting down", http.StatusServiceUnavailable)
+	return true
+}
+
+// unfinishedBuilds returns the builds queued or running on this
+// coordinator's workers in the order they were queued. Must be called with
+// the mutex held.
+func (bc *BuildCoordinator) unfinishedBuilds() (queued, running []BuildRequest) {
+	for id, progress := range bc.progress {
+		if _, forwarded := bc.forwarded[id]; forwarded {
+			continue
+		}
+		switch progress.Status {
+		case BuildStatusQueued:
+			queued = append(queued, bc.requests[id])
+		case BuildStatusRunning:
+			running = append(running, bc.requests[id])
+		}
+	}
+	byQueueTime := func(a, b BuildRequest) int { return a.QueuedAt.Compare(b.QueuedAt) }
+	slices.SortFunc(queued, byQueueTime)
+	slices.SortFunc(running, byQueueTime)
+	return queued, running
+}
+
+// Drain stops accepting and dispatching builds and waits up to timeout for
+// the running builds to finish. It returns the number still running.
+func (bc *BuildCoordinator) Drain(timeout time.Duration) int {
+	bc.mutex.Lock()
+	bc.draining = true
+	queued, running := bc.unfinishedBuilds()
+	bc.mutex.Unlock()
+	log.Printf("Draining: waiting up to %s for %d running builds, %d builds queued", timeout, len(running), len(queued))
+
+	deadline := time.Now().Add(timeout)
+	ticker := time.NewTicker(dispatchInterval)
+	defer ticker.Stop()
+	for len(running) > 0 && time.Now().Before(deadline) {
+		<-ticker.C
+		bc.mutex.RLock()
+		_, running = bc.unfinishedBuilds()
+		bc.mutex.RUnlock()
+	}
+	return len(running)
+}
+
+// saveQueue writes the builds that did not finish to the queue file, the
+// queued ones first. Builds still running are run again from the start
+// after the restart, as their results can no longer be reported.
+func (bc *BuildCoordinator) saveQueue() (int, error) {
+	if bc.drain.QueueFile == "" {
+		return 0, nil
+	}
+
+	bc.mutex.RLock()
+	queued, running := bc.unfinishedBuilds()
+	bc.mutex.RUnlock()
+	builds := append(queued, running...)
+	if len(builds) == 0 {
+		if err := os.Remove(bc.drain.QueueFile); err != nil && !os.IsNotExist(err) {
+			return 0, err
+		}
+		return 0, nil
+	}
+
+	data, err := json.MarshalIndent(builds, "", "  ")
+	if err != nil {
+		return 0, err
+	}
+	if err := os.MkdirAll(filepath.Dir(bc.drain.QueueFile), 0755); err != nil {
+		return 0, fmt.Errorf("failed to create queue directory: %v", err)
+	}
+	temp := bc.drain.QueueFile + ".tmp"
+	if err := os.WriteFile(temp, data, 0600); err != nil {
+		return 0, err
+	}
+	return len(builds), os.Rename(temp, bc.drain.QueueFile)
+}
+
+// restoreQueue queues the builds saved at the last shutdown again under
+// their IDs and removes the queue file
+func (bc *BuildCoordinator) restoreQueue() error {
+	if bc.drain.QueueFile == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(bc.drain.QueueFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read build queue: %v", err)
+	}
+	var builds []BuildRequest
+	if err := json.Unmarshal(data, &builds); err != nil {
+		return fmt.Errorf("failed to parse build queue: %v", err)
+	}
+
+	restored := 0
+	for _, request := range builds {
+		if _, err := bc.SubmitBuild(request); err != nil {
+			log.Printf("Failed to queue build %s again: %v", request.RequestID, err)
+			continue
+		}
+		restored++
+	}
+	log.Printf("Queued %d builds saved at the last shutdown", restored)
+	return os.Remove(bc.drain.QueueFile)
+}
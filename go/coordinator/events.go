@@ -0,0 +1,35 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"distributed-gradle-building/events"
+)
+
+// publish sends a build lifecycle event to the event bus, filling in the
+// build's request details. Must be called with the mutex held.
+func (bc *BuildCoordinator) publish(event events.Event) {
+	event.Timestamp = time.Now()
+	event.Source = bc.federation.Name
+	if request, exists := bc.requests[event.BuildID]; exists {
+		event.ProjectPath = request.ProjectPath
+		event.TaskName = request.TaskName
+		event.Pool = request.Pool
+		event.Tenant = request.Tenant
+	}
+
+	bc.streamLifecycleEvent(event)
+	bc.reportStatus(event)
+
+	if err := bc.events.Publish(event); err != nil {
+		log.Printf("Failed to publish %s event of build %s: %v", event.Type, event.BuildID, err)
+	}
+}
+
+// publishStarted publishes that a build was sent to its worker
+func (bc *BuildCoordinator) publishStarted(buildID, workerID string) {
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+	bc.publish(events.Event{Type: events.BuildStarted, BuildID: buildID, WorkerID: workerID})
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"slices"
+	"time"
+
+	"distributed-gradle-building/fairshare"
+	"distributed-gradle-building/metrics"
+	"distributed-gradle-building/pools"
+)
+
+// dispatchInterval is how often a pool with pending builds is checked for
+// slots freed by finished builds
+const dispatchInterval = time.Second
+
+// processQueue assigns the builds of a pool's queue until shutdown. Builds
+// wait in a fair-share queue until the pool has a free slot, so a tenant with
+// many pending builds gets no more than its share of the pool while other
+// tenants are waiting.
+func (bc *BuildCoordinator) processQueue(pool string, queue chan BuildRequest) {
+	pending := fairshare.NewQueue(bc.weights)
+	requests := make(map[string]BuildRequest)
+	ticker := time.NewTicker(dispatchInterval)
+	defer ticker.Stop()
+
+	var lastForward time.Time
+	for {
+		select {
+		case request := <-queue:
+			// Builds lost to a preempted worker already waited their turn
+			if request.Preempted {
+				pending.PushFront(request.Tenant, request.RequestID)
+			} else {
+				pending.Push(request.Tenant, request.RequestID)
+			}
+			requests[request.RequestID] = request
+			bc.trackQueue(pool, pending, requests)
+		case <-ticker.C:
+		case <-bc.shutdown:
+			return
+		}
+		// Builds left queued while draining are saved at shutdown
+		if bc.isDraining() {
+			continue
+		}
+		bc.dispatchBuilds(pool, pending, requests)
+		bc.trackQueue(pool, pending, requests)
+
+		// Builds still pending found no free slot; offer them to peers
+		if bc.federation.Enabled() && pending.Len() > 0 && time.Since(lastForward) >= bc.federation.PollInterval {
+			if bc.forwardBuilds(pool, pending, requests) {
+				lastForward = time.Now()
+			}
+		}
+	}
+}
+
+// dispatchBuilds starts pending builds of a pool while it has free slots,
+// each time from the tenant furthest below its share. Paused builds, builds
+// pinned to a worker without a free slot, builds needing devices no free
+// worker has, builds waiting for their dependencies and builds of a project
+// at its concurrency limit keep their place in the queue.
+func (bc *BuildCoordinator) dispatchBuilds(pool string, pending *fairshare.Queue, requests map[string]BuildRequest) {
+	if pending.Len() == 0 {
+		return
+	}
+
+	bc.mutex.RLock()
+	state := bc.pendingState(pool, requests)
+	bc.mutex.RUnlock()
+	defer bc.markThrottled(requests, state.projects)
+
+	running, eligible := state.running, state.eligible(bc, requests)
+	for free := state.free; free > 0; free-- {
+		tenant, id, ok := pending.PopEligible(running, eligible)
+		if !ok {
+			return
+		}
+		request := requests[id]
+		delete(requests, id)
+
+		// A speculative copy may have taken the slot since it was counted
+		if !bc.startBuild(request) {
+			metrics.SchedulerDecisions.WithLabelValues(pool, metrics.DecisionNoCapacity).Inc()
+			pending.PushFront(tenant, id)
+			requests[id] = request
+			return
+		}
+		state.projects[buildProject(request)]++
+	}
+}
+
+// pendingState is what decides the order the pending builds of a pool are
+// started in: the free slots of the pool, the running builds of each tenant
+// in the pool and of each project, and the builds that wait without holding
+// up the others
+type pendingState struct {
+	free     int
+	running  map[string]int
+	projects map[string]int
+	waiting  map[string]bool
+}
+
+// pendingState returns the state of the pending builds of a pool. Must be
+// called with the mutex held.
+func (bc *BuildCoordinator) pendingState(pool string, requests map[string]BuildRequest) pendingState {
+	state := pendingState{
+		running:  bc.runningBuildsByTenant(pool),
+		projects: bc.runningBuildsByProject(),
+		waiting:  make(map[string]bool),
+	}
+	freeWorkers := make(map[string]bool)
+	poolWorkers := bc.getPoolWorkers(pool)
+	for _, worker := range poolWorkers {
+		state.free += worker.availableSlots()
+		freeWorkers[worker.ID] = worker.availableSlots() > 0
+	}
+	// Builds pinned to a busy worker, builds needing devices no free worker
+	// has and builds waiting for their dependencies wait without holding up
+	// the others
+	for id, request := range requests {
+		if progress, exists := bc.progress[id]; exists && progress.Paused {
+			state.waiting[id] = true
+		}
+		if request.PinnedWorkerID != "" && !freeWorkers[request.PinnedWorkerID] {
+			state.waiting[id] = true
+		}
+		if requirement := deviceRequirement(request); requirement != nil && !slices.ContainsFunc(poolWorkers, func(worker *Worker) bool {
+			return worker.availableSlots() > 0 && worker.hasFreeDevices(*requirement)
+		}) {
+			state.waiting[id] = true
+		}
+		if pending, _ := bc.pendingDependencies(request); len(pending) > 0 {
+			state.waiting[id] = true
+		}
+	}
+	return state
+}
+
+// eligible returns whether a pending build can be started: it does not wait
+// and its project is below its concurrency limit
+func (s pendingState) eligible(bc *BuildCoordinator, requests map[string]BuildRequest) func(id string) bool {
+	return func(id string) bool {
+		return !s.waiting[id] && !bc.atConcurrencyLimit(requests[id], s.projects)
+	}
+}
+
+// runningBuildsByTenant counts the running builds of each tenant in a pool.
+// Must be called with the mutex held.
+func (bc *BuildCoordinator) runningBuildsByTenant(pool string) map[string]int {
+	running := make(map[string]int)
+	for id, progress := range bc.progress {
+		request := bc.requests[id]
+		if _, forwarded := bc.forwarded[id]; forwarded {
+			continue
+		}
+		if progress.Status == BuildStatusRunning && pools.Normalize(request.Pool) == pool {
+			running[request.Tenant]++
+		}
+	}
+	return running
+}
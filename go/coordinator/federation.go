@@ -0,0 +1,320 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"distributed-gradle-building/events"
+	"distributed-gradle-building/fairshare"
+	"distributed-gradle-building/federation"
+	"distributed-gradle-building/metrics"
+	"distributed-gradle-building/protocol"
+)
+
+// maxProxyFailures is how many status requests in a row may fail before a
+// forwarded build is given up as lost
+const maxProxyFailures = 10
+
+// forwardedBuild is a build running on a peer coordinator
+type forwardedBuild struct {
+	peer     federation.Peer
+	remoteID string
+}
+
+// PeerStatus is the status of a peer coordinator
+type PeerStatus struct {
+	Name      string            `json:"name"`
+	URL       string            `json:"url"`
+	Reachable bool              `json:"reachable"`
+	Error     string            `json:"error,omitempty"`
+	Stats     *CoordinatorStats `json:"stats,omitempty"`
+}
+
+// FederatedStatus is the status of a coordinator and its peers
+type FederatedStatus struct {
+	Coordinator string           `json:"coordinator"`
+	Local       CoordinatorStats `json:"local"`
+	Peers       []PeerStatus     `json:"peers"`
+	// Total adds up the statistics of this coordinator and its reachable
+	// peers
+	Total CoordinatorStats `json:"total"`
+}
+
+// forwardBuilds forwards the pending builds of a pool that waited at least
+// FEDERATION_FORWARD_AFTER for a local slot to peers with free capacity,
+// oldest first. Builds forwarded by a peer are never forwarded again. It
+// reports whether any build was due, and peers were asked for capacity.
+func (bc *BuildCoordinator) forwardBuilds(pool string, pending *fairshare.Queue, requests map[string]BuildRequest) bool {
+	now := time.Now()
+	var due []BuildRequest
+	for _, request := range requests {
+		// Uploaded projects are only stored on this coordinator, replays pin
+		// the environment of a build that ran here, published builds use
+		// its Maven repository, cache seed builds warm its pools and builds
+		// with dependencies wait for builds here
+		if request.FederatedFrom == "" && request.UploadID == "" && request.ReplayOf == "" && request.Publish == nil && request.Type == "" &&
+			len(request.DependsOn) == 0 && now.Sub(request.Timestamp) >= bc.federation.ForwardAfter {
+			due = append(due, request)
+		}
+	}
+	if len(due) == 0 {
+		return false
+	}
+	sort.Slice(due, func(i, j int) bool { return due[i].Timestamp.Before(due[j].Timestamp) })
+
+	var peers []federation.Peer
+	for _, peer := range bc.federation.Peers {
+		if peer.Accepts(pool) {
+			peers = append(peers, peer)
+		}
+	}
+	capacities := bc.peerCapacities(peers)
+
+	for _, request := range due {
+		if bc.isBuildCancelled(request.RequestID) || bc.isBuildPaused(request.RequestID) {
+			continue
+		}
+		peer, ok := federation.Select(bc.federation.Policy, peers, capacities)
+		if !ok {
+			break
+		}
+
+		remoteID, err := bc.peers.Submit(peer, forwardedRequest(request), request.CorrelationID)
+		if err != nil {
+			log.Printf("Failed to forward build %s to peer %s: %v", request.RequestID, peer.Name, err)
+			metrics.FederatedBuilds.WithLabelValues(peer.Name, metrics.FederationForwardFailed).Inc()
+			delete(capacities, peer.Name)
+			continue
+		}
+		capacity := capacities[peer.Name]
+		capacity.QueuedBuilds++
+		capacities[peer.Name] = capacity
+
+		pending.Remove(request.Tenant, request.RequestID)
+		delete(requests, request.RequestID)
+		bc.startForwarded(request.RequestID, peer, remoteID)
+		go bc.proxyBuild(request.RequestID, peer, remoteID)
+	}
+	return true
+}
+
+// peerCapacities asks peers how busy they are. Unreachable peers are left
+// out.
+func (bc *BuildCoordinator) peerCapacities(peers []federation.Peer) map[string]federation.Capacity {
+	capacities := make(map[string]federation.Capacity)
+	for _, peer := range peers {
+		var capacity federation.Capacity
+		if err := bc.peers.Stats(peer, &capacity); err != nil {
+			log.Printf("Peer %s is unreachable: %v", peer.Name, err)
+			continue
+		}
+		capacities[peer.Name] = capacity
+	}
+	return capacities
+}
+
+// forwardedRequest returns the request sent to a peer, without the fields
+// the peer sets itself
+func forwardedRequest(request BuildRequest) BuildRequest {
+	request.RequestID = ""
+	request.WorkerID = ""
+	request.Pool = ""
+	request.Tenant = ""
+	request.FederatedFrom = ""
+	request.Timestamp = time.Time{}
+	return request
+}
+
+// startForwarded marks a build as running on a peer
+func (bc *BuildCoordinator) startForwarded(buildID string, peer federation.Peer, remoteID string) {
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+
+	bc.forwarded[buildID] = forwardedBuild{peer: peer, remoteID: remoteID}
+	if response, exists := bc.builds[buildID]; exists {
+		response.ForwardedTo = peer.Name
+		response.RemoteBuildID = remoteID
+	}
+	if progress, exists := bc.progress[buildID]; exists {
+		progress.Status = BuildStatusRunning
+		progress.WorkerID = peer.Name
+		progress.Message = fmt.Sprintf("forwarded to peer %s as build %s", peer.Name, remoteID)
+		progress.StartedAt = time.Now()
+		progress.UpdatedAt = progress.StartedAt
+		bc.notifyProgress(buildID)
+	}
+	bc.publish(events.Event{Type: events.BuildScheduled, BuildID: buildID, WorkerID: peer.Name})
+	metrics.FederatedBuilds.WithLabelValues(peer.Name, metrics.FederationForwarded).Inc()
+	log.Printf("Build %s forwarded to peer %s as build %s", buildID, peer.Name, remoteID)
+}
+
+// proxyBuild follows a forwarded build on its peer until it finishes, the
+// build is cancelled locally or the peer stops answering
+func (bc *BuildCoordinator) proxyBuild(buildID string, peer federation.Peer, remoteID string) {
+	defer func() {
+		bc.mutex.Lock()
+		delete(bc.forwarded, buildID)
+		bc.mutex.Unlock()
+	}()
+
+	ticker := time.NewTicker(bc.federation.PollInterval)
+	defer ticker.Stop()
+
+	failures := 0
+	for {
+		select {
+		case <-ticker.C:
+		case <-bc.shutdown:
+			return
+		}
+		if bc.isBuildCancelled(buildID) {
+			return
+		}
+
+		var status BuildStatusResponse
+		if err := bc.peers.Build(peer, remoteID, &status); err != nil {
+			if failures++; failures >= maxProxyFailures {
+				metrics.FederatedBuilds.WithLabelValues(peer.Name, metrics.FederationFailed).Inc()
+				bc.markBuildFailed(buildID, protocol.ErrorInfra, fmt.Sprintf("lost build %s on peer %s: %v", remoteID, peer.Name, err))
+				return
+			}
+			continue
+		}
+		failures = 0
+		if bc.applyRemoteStatus(buildID, peer, status) {
+			return
+		}
+	}
+}
+
+// applyRemoteStatus mirrors the progress of a forwarded build and finishes
+// it with the peer's result. It reports whether the build has finished.
+func (bc *BuildCoordinator) applyRemoteStatus(buildID string, peer federation.Peer, status BuildStatusResponse) bool {
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+
+	progress, exists := bc.progress[buildID]
+	if !exists || progress.finished() {
+		return true
+	}
+
+	remote := status.Progress
+	workerID := peer.Name
+	if remote.WorkerID != "" {
+		workerID = peer.Name + "/" + remote.WorkerID
+	} else if status.WorkerID != "" {
+		workerID = peer.Name + "/" + status.WorkerID
+	}
+	if response, exists := bc.builds[buildID]; exists && remote.finished() {
+		response.Artifacts = status.Artifacts
+		response.ArtifactDetails = status.ArtifactDetails
+		response.Metrics = status.Metrics
+	}
+
+	switch remote.Status {
+	case BuildStatusCompleted:
+		metrics.FederatedBuilds.WithLabelValues(peer.Name, metrics.FederationCompleted).Inc()
+		progress.WorkerID = workerID
+		bc.completeBuild(buildID, workerID)
+		return true
+	case BuildStatusFailed, BuildStatusCancelled:
+		message := status.ErrorMessage
+		if message == "" {
+			message = remote.Message
+		}
+		code := status.ErrorCode
+		if remote.Status == BuildStatusCancelled {
+			code = protocol.ErrorCancelled
+		}
+		metrics.FederatedBuilds.WithLabelValues(peer.Name, metrics.FederationFailed).Inc()
+		progress.WorkerID = workerID
+		bc.failBuild(buildID, code, fmt.Sprintf("build %s %s on peer %s: %s", status.RequestID, remote.Status, peer.Name, message))
+		return true
+	}
+
+	if remote.Progress != progress.Progress || remote.Step != progress.Step || workerID != progress.WorkerID {
+		progress.WorkerID = workerID
+		progress.Progress = remote.Progress
+		progress.Step = remote.Step
+		if remote.Message != "" {
+			progress.Message = remote.Message
+		}
+		progress.UpdatedAt = time.Now()
+		bc.notifyProgress(buildID)
+	}
+	return false
+}
+
+// federatedStatus returns the statistics of this coordinator and its peers
+func (bc *BuildCoordinator) federatedStatus() FederatedStatus {
+	status := FederatedStatus{
+		Coordinator: bc.federation.Name,
+		Local:       bc.GetStats(),
+		Peers:       make([]PeerStatus, len(bc.federation.Peers)),
+	}
+
+	var wg sync.WaitGroup
+	for i, peer := range bc.federation.Peers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			peerStatus := PeerStatus{Name: peer.Name, URL: peer.URL}
+			var stats CoordinatorStats
+			if err := bc.peers.Stats(peer, &stats); err != nil {
+				peerStatus.Error = err.Error()
+			} else {
+				peerStatus.Reachable = true
+				peerStatus.Stats = &stats
+			}
+			status.Peers[i] = peerStatus
+		}()
+	}
+	wg.Wait()
+
+	all := []CoordinatorStats{status.Local}
+	for _, peer := range status.Peers {
+		if peer.Stats != nil {
+			all = append(all, *peer.Stats)
+		}
+	}
+	status.Total = sumStats(all)
+	return status
+}
+
+// sumStats adds up the statistics of several coordinators. The cache hit
+// rate is weighted by completed builds.
+func sumStats(all []CoordinatorStats) CoordinatorStats {
+	total := CoordinatorStats{Timestamp: time.Now()}
+	var hitRates float64
+	for _, stats := range all {
+		total.QueuedBuilds += stats.QueuedBuilds
+		total.RunningBuilds += stats.RunningBuilds
+		total.CompletedBuilds += stats.CompletedBuilds
+		total.FailedBuilds += stats.FailedBuilds
+		total.CancelledBuilds += stats.CancelledBuilds
+		total.Workers += stats.Workers
+		total.BusyWorkers += stats.BusyWorkers
+		total.TotalSlots += stats.TotalSlots
+		total.UsedSlots += stats.UsedSlots
+		hitRates += stats.CacheHitRate * float64(stats.CompletedBuilds)
+	}
+	if total.TotalSlots > 0 {
+		total.Utilization = float64(total.UsedSlots) / float64(total.TotalSlots)
+	}
+	if total.CompletedBuilds > 0 {
+		total.CacheHitRate = hitRates / float64(total.CompletedBuilds)
+	}
+	return total
+}
+
+// handleFederatedStatus reports the statistics of this coordinator, of each
+// peer and their total
+func (bc *BuildCoordinator) handleFederatedStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(bc.federatedStatus())
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Health statuses, from best to worst
+const (
+	HealthHealthy   = "healthy"
+	HealthDegraded  = "degraded"
+	HealthUnhealthy = "unhealthy"
+)
+
+// HealthService is a service whose health endpoint the system health check
+// queries
+type HealthService struct {
+	Name string
+	URL  string
+}
+
+// SystemHealthConfig configures the system health check
+type SystemHealthConfig struct {
+	// Services are the ML, cache and monitor services that are configured
+	Services []HealthService
+	// Timeout bounds checking a single dependency, and dependencies slower
+	// than SlowThreshold are reported degraded
+	Timeout       time.Duration
+	SlowThreshold time.Duration
+}
+
+// healthServiceVars are the environment variables holding the base URL of
+// each service the system health check queries
+var healthServiceVars = []struct{ name, env string }{
+	{"ml", "ML_SERVICE_URL"},
+	{"cache", "CACHE_SERVICE_URL"},
+	{"monitor", "MONITOR_SERVICE_URL"},
+}
+
+// defaultSystemHealthConfig returns the system health check settings used
+// when none are configured
+func defaultSystemHealthConfig() SystemHealthConfig {
+	return SystemHealthConfig{
+		Timeout:       3 * time.Second,
+		SlowThreshold: time.Second,
+	}
+}
+
+// loadSystemHealthConfig loads the system health check settings from
+// environment variables. Services without a base URL are not checked.
+func loadSystemHealthConfig() SystemHealthConfig {
+	config := defaultSystemHealthConfig()
+
+	for _, service := range healthServiceVars {
+		if url := strings.TrimRight(os.Getenv(service.env), "/"); url != "" {
+			config.Services = append(config.Services, HealthService{Name: service.name, URL: url + "/health"})
+		}
+	}
+	if value, err := time.ParseDuration(os.Getenv("HEALTH_CHECK_TIMEOUT")); err == nil && value > 0 {
+		config.Timeout = value
+	}
+	if value, err := time.ParseDuration(os.Getenv("HEALTH_CHECK_SLOW_THRESHOLD")); err == nil && value > 0 {
+		config.SlowThreshold = value
+	}
+
+	return config
+}
+
+// DependencyHealth is the health of a worker or service the coordinator
+// depends on
+type DependencyHealth struct {
+	Name      string  `json:"name"`
+	Type      string  `json:"type"`
+	Status    string  `json:"status"`
+	LatencyMS float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// SystemHealth is the aggregated health of the coordinator and its
+// dependencies
+type SystemHealth struct {
+	Status       string             `json:"status"`
+	CheckedAt    time.Time          `json:"checked_at"`
+	Dependencies []DependencyHealth `json:"dependencies"`
+}
+
+// checkWorker pings a registered worker over RPC
+func (bc *BuildCoordinator) checkWorker(worker *Worker, timeout time.Duration) DependencyHealth {
+	health := DependencyHealth{Name: worker.ID, Type: "worker"}
+	start := time.Now()
+	reply, err := pingWorker(registryEntry(worker), bc.federation.Name, timeout)
+	health.LatencyMS = float64(time.Since(start).Microseconds()) / 1000
+	switch {
+	case err != nil:
+		health.Status = HealthUnhealthy
+		health.Error = err.Error()
+	case reply.ID != worker.ID:
+		health.Status = HealthUnhealthy
+		health.Error = fmt.Sprintf("worker %s answers at %s:%d", reply.ID, worker.Host, worker.Port)
+	default:
+		health.Status = HealthHealthy
+	}
+	return health
+}
+
+// checkService queries the health endpoint of a service. A service may
+// report itself degraded; one that does not answer with 200 is unhealthy.
+func checkService(client *http.Client, service HealthService) DependencyHealth {
+	health := DependencyHealth{Name: service.Name, Type: "service"}
+	start := time.Now()
+	resp, err := client.Get(service.URL)
+	health.LatencyMS = float64(time.Since(start).Microseconds()) / 1000
+	if err != nil {
+		health.Status = HealthUnhealthy
+		health.Error = err.Error()
+		return health
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		health.Status = HealthUnhealthy
+		health.Error = fmt.Sprintf("health endpoint returned %s", resp.Status)
+		return health
+	}
+
+	var status HealthStatus
+	json.NewDecoder(resp.Body).Decode(&status)
+	switch status.Status {
+	case HealthDegraded, HealthUnhealthy:
+		health.Status = status.Status
+		health.Error = fmt.Sprintf("service reports itself %s", status.Status)
+	default:
+		health.Status = HealthHealthy
+	}
+	return health
+}
+
+// checkSystemHealth checks every registered worker and configured service
+// concurrently and aggregates their statuses. Losing services or some of the
+// workers degrades the system; it is unhealthy only when no registered
+// worker can take builds.
+func (bc *BuildCoordinator) checkSystemHealth() SystemHealth {
+	bc.mutex.RLock()
+	config := bc.systemHealth
+	workers := make([]Worker, 0, len(bc.workers))
+	for _, worker := range bc.workers {
+		workers = append(workers, Worker{ID: worker.ID, Host: worker.Host, Port: worker.Port})
+	}
+	bc.mutex.RUnlock()
+
+	dependencies := make([]DependencyHealth, len(workers)+len(config.Services))
+	client := &http.Client{Timeout: config.Timeout}
+	var wg sync.WaitGroup
+	for i := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			dependencies[i] = bc.checkWorker(&workers[i], config.Timeout)
+		}()
+	}
+	for i, service := range config.Services {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			dependencies[len(workers)+i] = checkService(client, service)
+		}()
+	}
+	wg.Wait()
+
+	health := SystemHealth{Status: HealthHealthy, CheckedAt: time.Now(), Dependencies: dependencies}
+	availableWorkers := 0
+	for i := range dependencies {
+		dependency := &dependencies[i]
+		if dependency.Status == HealthHealthy && dependency.LatencyMS > float64(config.SlowThreshold.Milliseconds()) {
+			dependency.Status = HealthDegraded
+			dependency.Error = fmt.Sprintf("slower than %s", config.SlowThreshold)
+		}
+		if dependency.Type == "worker" && dependency.Status != HealthUnhealthy {
+			availableWorkers++
+		}
+		if dependency.Status != HealthHealthy {
+			health.Status = HealthDegraded
+		}
+	}
+	switch {
+	case len(workers) == 0:
+		health.Status = HealthDegraded
+	case availableWorkers == 0:
+		health.Status = HealthUnhealthy
+	}
+	return health
+}
+
+// handleSystemHealth reports the aggregated health of the coordinator and
+// its dependencies. It answers 503 when the system is unhealthy so load
+// balancers can act on the status code alone.
+func (bc *BuildCoordinator) handleSystemHealth(w http.ResponseWriter, r *http.Request) {
+	health := bc.checkSystemHealth()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if health.Status == HealthUnhealthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(health)
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"distributed-gradle-building/audit"
+	"distributed-gradle-building/auth"
+	"distributed-gradle-building/oidc"
+)
+
+// loginTimeout is how long a dashboard login may take at the identity
+// provider before its state is forgotten
+const loginTimeout = 10 * time.Minute
+
+// OIDCLoginConfig tells the CLI which identity provider and public client
+// to run the device flow with
+type OIDCLoginConfig struct {
+	Issuer   string   `json:"issuer"`
+	ClientID string   `json:"client_id"`
+	Scopes   []string `json:"scopes"`
+}
+
+// OIDCTokenRequest is the request body for exchanging an ID token
+type OIDCTokenRequest struct {
+	IDToken string `json:"id_token"`
+}
+
+// LoginResponse is a coordinator token issued for an identity provider login
+type LoginResponse struct {
+	Token     string    `json:"token"`
+	User      string    `json:"user"`
+	Role      string    `json:"role"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// pendingLogin is a dashboard login waiting for the identity provider
+type pendingLogin struct {
+	nonce    string
+	verifier string
+	started  time.Time
+}
+
+// oidcLogin signs users in with an identity provider and issues them
+// coordinator tokens carrying the role their groups map to
+type oidcLogin struct {
+	provider *oidc.Provider
+
+	mutex   sync.Mutex
+	pending map[string]pendingLogin
+}
+
+func newOIDCLogin(provider *oidc.Provider) *oidcLogin {
+	return &oidcLogin{provider: provider, pending: make(map[string]pendingLogin)}
+}
+
+// start remembers a new dashboard login and returns its state
+func (l *oidcLogin) start() (string, pendingLogin) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for state, login := range l.pending {
+		if time.Since(login.started) > loginTimeout {
+			delete(l.pending, state)
+		}
+	}
+	state := oidc.RandomString()
+	login := pendingLogin{nonce: oidc.RandomString(), verifier: oidc.RandomString(), started: time.Now()}
+	l.pending[state] = login
+	return state, login
+}
+
+// finish returns and forgets the login of a state, which can only be used
+// once
+func (l *oidcLogin) finish(state string) (pendingLogin, bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	login, exists := l.pending[state]
+	delete(l.pending, state)
+	return login, exists && time.Since(login.started) <= loginTimeout
+}
+
+// handleLogin sends the browser to the identity provider
+func (bc *BuildCoordinator) handleLogin(w http.ResponseWriter, r *http.Request) {
+	state, login := bc.login.start()
+	target, err := bc.login.provider.AuthCodeURL(r.Context(), state, login.nonce, login.verifier)
+	if err != nil {
+		log.Printf("OIDC login failed: %v", err)
+		http.Error(w, "identity provider unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+// handleLoginCallback completes a dashboard login and hands the coordinator
+// token to the dashboard in the URL fragment, which browsers do not send to
+// servers
+func (bc *BuildCoordinator) handleLoginCallback(authService *auth.AuthService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if message := query.Get("error"); message != "" {
+			http.Error(w, "login failed: "+message+" "+query.Get("error_description"), http.StatusUnauthorized)
+			return
+		}
+		login, ok := bc.login.finish(query.Get("state"))
+		if !ok {
+			http.Error(w, "login expired or unknown, please log in again", http.StatusBadRequest)
+			return
+		}
+
+		tokens, err := bc.login.provider.Exchange(r.Context(), query.Get("code"), login.verifier)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		response, status, err := bc.issueLoginToken(r, authService, tokens.IDToken, login.nonce)
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		http.Redirect(w, r, "/#token="+url.QueryEscape(response.Token), http.StatusFound)
+	}
+}
+
+// handleOIDCConfig describes the identity provider to the CLI
+func (bc *BuildCoordinator) handleOIDCConfig(w http.ResponseWriter, r *http.Request) {
+	config := bc.login.provider.Config()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(OIDCLoginConfig{Issuer: config.Issuer, ClientID: config.CLIClientID, Scopes: config.Scopes})
+}
+
+// handleOIDCToken exchanges an ID token the CLI obtained with the device
+// flow for a coordinator token
+func (bc *BuildCoordinator) handleOIDCToken(authService *auth.AuthService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request OIDCTokenRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.IDToken == "" {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		response, status, err := bc.issueLoginToken(r, authService, request.IDToken, "")
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+// issueLoginToken verifies an ID token, maps the user's groups to a role and
+// issues a coordinator token for them. It returns the status to fail with.
+func (bc *BuildCoordinator) issueLoginToken(r *http.Request, authService *auth.AuthService, idToken, nonce string) (*LoginResponse, int, error) {
+	identity, err := bc.login.provider.Verify(r.Context(), idToken, nonce)
+	if err != nil {
+		return nil, http.StatusUnauthorized, err
+	}
+	role, err := bc.login.provider.Config().Role(identity.Groups)
+	if err != nil {
+		log.Printf("OIDC login of %s refused: %v", identity.User(), err)
+		return nil, http.StatusForbidden, err
+	}
+
+	token, err := authService.GenerateToken(identity.User(), role, nil)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	claims, err := authService.ValidateToken(token)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	// The request carries no credentials yet, so name the principal here
+	err = bc.auditLog.Record(audit.Event{
+		Action:    audit.ActionUserLoggedIn,
+		Principal: "user:" + identity.User(),
+		SourceIP:  audit.SourceIP(r),
+		Resource:  identity.User(),
+		Details:   map[string]string{"role": role, "groups": strings.Join(identity.Groups, ",")},
+	})
+	if err != nil {
+		log.Printf("Failed to record audit event %s for %s: %v", audit.ActionUserLoggedIn, identity.User(), err)
+	}
+	return &LoginResponse{Token: token, User: identity.User(), Role: role, ExpiresAt: time.Unix(claims.ExpiresAt, 0).UTC()}, http.StatusOK, nil
+}
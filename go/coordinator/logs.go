@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"distributed-gradle-building/buildlogs"
+)
+
+// RPC argument and reply types for build output
+type ReportLogArgs struct {
+	BuildID  string   `json:"build_id"`
+	WorkerID string   `json:"worker_id"`
+	Lines    []string `json:"lines"`
+}
+
+type ReportLogReply struct {
+	Message string `json:"message"`
+}
+
+// ReportLog appends output lines of a running build to its log. Only the
+// worker whose progress the build shows may report them.
+// RPC method signature: func (t *T) MethodName(args *ArgType, reply *ReplyType) error
+func (bc *BuildCoordinator) ReportLog(args *ReportLogArgs, reply *ReportLogReply) error {
+	bc.mutex.RLock()
+	defer bc.mutex.RUnlock()
+
+	progress, exists := bc.progress[args.BuildID]
+	if !exists {
+		return fmt.Errorf("build %s not found", args.BuildID)
+	}
+	if winner, _ := bc.speculativeReport(args.BuildID, args.WorkerID); winner != "" || progress.WorkerID != args.WorkerID {
+		reply.Message = fmt.Sprintf("Build %s is reported by another worker", args.BuildID)
+		return nil
+	}
+
+	// The log is finished with the build, so appending under the read lock
+	// keeps late lines out of it
+	if err := bc.buildLogs.Append(args.BuildID, args.Lines); err != nil {
+		return err
+	}
+	reply.Message = fmt.Sprintf("Log recorded for build %s", args.BuildID)
+	return nil
+}
+
+// handleBuildLog serves the output of a build as plain text. tail limits it
+// to the last lines, and follow streams the lines appended until the build
+// finishes.
+func (bc *BuildCoordinator) handleBuildLog(w http.ResponseWriter, r *http.Request) {
+	buildID := r.PathValue("id")
+
+	tail := 0
+	if value := r.URL.Query().Get("tail"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			http.Error(w, "tail must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+		tail = n
+	}
+	follow := false
+	if value := r.URL.Query().Get("follow"); value != "" {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			http.Error(w, "follow must be true or false", http.StatusBadRequest)
+			return
+		}
+		follow = parsed
+	}
+
+	// Only builds still running are followed; the log of a build is
+	// finished under the write lock
+	var lines []string
+	var updates <-chan []string
+	stop := func() {}
+	var err error
+	bc.mutex.RLock()
+	progress, known := bc.progress[buildID]
+	if follow && known && (progress.Status == BuildStatusQueued || progress.Status == BuildStatusRunning) {
+		lines, updates, stop, err = bc.buildLogs.Follow(buildID, tail)
+	} else {
+		lines, err = bc.buildLogs.Lines(buildID, tail)
+		if errors.Is(err, buildlogs.ErrNotFound) && known {
+			lines, err = []string{}, nil
+		}
+	}
+	bc.mutex.RUnlock()
+	defer stop()
+
+	if errors.Is(err, buildlogs.ErrNotFound) {
+		http.Error(w, fmt.Sprintf("no log of build %s", buildID), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	controller := http.NewResponseController(w)
+	write := func(lines []string) bool {
+		for _, line := range lines {
+			if _, err := fmt.Fprintln(w, line); err != nil {
+				return false
+			}
+		}
+		if updates != nil {
+			controller.Flush()
+		}
+		return true
+	}
+
+	if !write(lines) || updates == nil {
+		return
+	}
+	for {
+		select {
+		case batch, open := <-updates:
+			if !open || !write(batch) {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		case <-bc.shutdown:
+			return
+		}
+	}
+}
+
+// pruneLogs deletes build logs beyond their retention and size limits every
+// hour until shutdown
+func (bc *BuildCoordinator) pruneLogs() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			deleted, err := bc.buildLogs.Prune(time.Now())
+			if err != nil {
+				log.Printf("Failed to prune build logs: %v", err)
+			}
+			if deleted > 0 {
+				log.Printf("Pruned %d build logs", deleted)
+			}
+		case <-bc.shutdown:
+			return
+		}
+	}
+}
@@ -5,43 +5,209 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"math"
 	"net"
 	"net/http"
 	"net/rpc"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
+
+	"distributed-gradle-building/analytics"
+	"distributed-gradle-building/apikeys"
+	"distributed-gradle-building/attestation"
+	"distributed-gradle-building/audit"
+	"distributed-gradle-building/auth"
+	"distributed-gradle-building/authz"
+	"distributed-gradle-building/buildenv"
+	"distributed-gradle-building/buildlogs"
+	"distributed-gradle-building/buildstore"
+	"distributed-gradle-building/calibration"
+	"distributed-gradle-building/chaos"
+	"distributed-gradle-building/devices"
+	"distributed-gradle-building/events"
+	"distributed-gradle-building/fairshare"
+	"distributed-gradle-building/federation"
+	"distributed-gradle-building/gitsource"
+	"distributed-gradle-building/gradledist"
+	"distributed-gradle-building/hooks"
+	"distributed-gradle-building/httprpc"
+	"distributed-gradle-building/internal/app"
+	"distributed-gradle-building/metrics"
+	"distributed-gradle-building/middleware"
+	"distributed-gradle-building/ml/mlrpc"
+	"distributed-gradle-building/oidc"
+	"distributed-gradle-building/pools"
+	"distributed-gradle-building/protocol"
+	"distributed-gradle-building/ratelimit"
+	"distributed-gradle-building/registry"
+	"distributed-gradle-building/retention"
+	"distributed-gradle-building/scmstatus"
+	"distributed-gradle-building/secrets"
+	"distributed-gradle-building/signing"
+	"distributed-gradle-building/testshard"
+	"distributed-gradle-building/tracing"
+	"distributed-gradle-building/transfer"
+	"distributed-gradle-building/types"
+	"distributed-gradle-building/validation"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 // BuildRequest represents a distributed build request
 type BuildRequest struct {
-	ProjectPath  string
-	TaskName     string
-	WorkerID     string
-	CacheEnabled bool
-	BuildOptions map[string]string
-	Timestamp    time.Time
-	RequestID    string
+	ProjectPath   string            `json:"project_path"`
+	TaskName      string            `json:"task_name"`
+	GradleVersion string            `json:"gradle_version,omitempty"`
+	WorkerID      string            `json:"worker_id,omitempty"`
+	CacheEnabled  bool              `json:"cache_enabled"`
+	BuildOptions  map[string]string `json:"build_options,omitempty"`
+	Secrets       []string          `json:"secrets,omitempty"`
+	Timestamp     time.Time         `json:"timestamp"`
+	RequestID     string            `json:"request_id"`
+	// RepoURL and Ref make the worker check out the repository itself
+	// instead of building an existing ProjectPath, which is then the project
+	// directory relative to the repository
+	RepoURL string `json:"repo_url,omitempty"`
+	Ref     string `json:"ref,omitempty"`
+	// Credentials names the build secret authenticating the checkout
+	Credentials string `json:"credentials,omitempty"`
+	// SecretEnv holds the values of the requested Secrets by environment
+	// variable. It is only set on the copy of the request sent to the worker
+	// and never serialized to JSON.
+	SecretEnv map[string]string `json:"-"`
+	// GitCredentials holds the value of Credentials, sent to the worker like
+	// SecretEnv
+	GitCredentials string `json:"-"`
+	// Force rebuilds even if an identical build has a cached result
+	Force bool `json:"force,omitempty"`
+	// Critical builds are duplicated on a second worker when they run late,
+	// whatever their predicted duration
+	Critical bool `json:"critical,omitempty"`
+	// Labels select the worker pool by the routing rules
+	Labels []string `json:"labels,omitempty"`
+	// Tags label the build for finding it later, such as the branch, pull
+	// request and commit it builds and who triggered it
+	Tags map[string]string `json:"tags,omitempty"`
+	// Pool is the worker pool the coordinator routed the build to
+	Pool string `json:"pool,omitempty"`
+	// Tenant is the team the build is scheduled for, identified by the API
+	// key it was submitted with
+	Tenant string `json:"tenant,omitempty"`
+	// FederatedFrom is the peer coordinator that forwarded the build
+	FederatedFrom string `json:"federated_from,omitempty"`
+	// Requeues counts how often the build was re-queued after its worker
+	// stopped sending heartbeats
+	Requeues int `json:"requeues,omitempty"`
+	// Preempted is set when the build was re-queued because its spot worker
+	// was preempted. It goes ahead of its tenant's other queued builds and
+	// prefers workers that are not spot instances.
+	Preempted bool `json:"preempted,omitempty"`
+	// QueuedAt is when the build last entered the queue, to time its wait
+	// for a worker
+	QueuedAt time.Time `json:"-"`
+	// Matrix fans the request out into child builds, and GroupID is the
+	// matrix build a child belongs to
+	Matrix  *BuildMatrix `json:"matrix,omitempty"`
+	GroupID string       `json:"group_id,omitempty"`
+	// Sharding splits the tests of the request across child builds, and
+	// Shard selects the test classes a child runs
+	Sharding *TestSharding    `json:"sharding,omitempty"`
+	Shard    *testshard.Shard `json:"shard,omitempty"`
+	// PipelineID and Stage identify the pipeline stage the build runs, and
+	// Inputs the artifacts of the stages it depends on
+	PipelineID string              `json:"pipeline_id,omitempty"`
+	Stage      string              `json:"stage,omitempty"`
+	Inputs     []transfer.Manifest `json:"inputs,omitempty"`
+	// BisectID is the bisection the build tests a commit for
+	BisectID string `json:"bisect_id,omitempty"`
+	// Type is set on builds the coordinator schedules itself, such as
+	// BuildTypeCacheSeed
+	Type string `json:"type,omitempty"`
+	// Outputs are files and directories, relative to the project
+	// directory, the worker uploads as artifacts of the build whether it
+	// succeeds or not, such as the outputs of a task run for a client
+	Outputs []string `json:"outputs,omitempty"`
+	// UploadID names a project archive uploaded to /api/uploads the worker
+	// unpacks and builds; ProjectPath is then relative to the archive.
+	// Upload is the manifest of the archive, set by the coordinator.
+	UploadID string             `json:"upload_id,omitempty"`
+	Upload   *transfer.Manifest `json:"upload,omitempty"`
+	// CorrelationID is the X-Request-ID of the API request that submitted
+	// the build. It travels with the build to the worker and peer
+	// coordinators and is logged by each of them.
+	CorrelationID string `json:"-"`
+	// ReplayOf is the build a replay runs again, Environment the
+	// environment of that build pinned for the replay, and PinnedWorkerID
+	// the only worker the replay may run on, if any. Only replays set them.
+	ReplayOf       string             `json:"replay_of,omitempty"`
+	Environment    *buildenv.Snapshot `json:"environment,omitempty"`
+	PinnedWorkerID string             `json:"pinned_worker_id,omitempty"`
+	// Publish publishes the JARs and AARs of the build to the Maven
+	// repository once it succeeded
+	Publish *PublishRequest `json:"publish,omitempty"`
+	// Hooks are commands the worker runs in the project directory before
+	// and after Gradle. The hooks of the build's project are added around
+	// them when the build is sent to its worker.
+	Hooks *hooks.Hooks `json:"hooks,omitempty"`
+	// Devices selects the Android emulators and devices the build runs
+	// instrumentation tests on. Builds of connected test tasks without it
+	// get any one device.
+	Devices *devices.Requirement `json:"devices,omitempty"`
+	// DeviceSerials are the devices allocated to the build on its worker,
+	// set on the copy of the request sent to the worker like SecretEnv
+	DeviceSerials []string `json:"-"`
+	// DependsOn are builds that must complete before the build is
+	// scheduled. It fails without running if one of them fails or is
+	// cancelled.
+	DependsOn []string `json:"depends_on,omitempty"`
 }
 
 // BuildResponse represents the response from a build worker
 type BuildResponse struct {
-	Success       bool
-	WorkerID      string
-	BuildDuration time.Duration
-	Artifacts     []string
-	ErrorMessage  string
-	Metrics       BuildMetrics
-	RequestID     string
-	Timestamp     time.Time
+	Success         bool             `json:"success"`
+	WorkerID        string           `json:"worker_id"`
+	BuildDuration   time.Duration    `json:"build_duration"`
+	Artifacts       []string         `json:"artifacts"`
+	ArtifactDetails []types.Artifact `json:"artifact_details,omitempty"`
+	ErrorMessage    string           `json:"error_message"`
+	Metrics         BuildMetrics     `json:"metrics"`
+	RequestID       string           `json:"request_id"`
+	Timestamp       time.Time        `json:"timestamp"`
+	// ErrorCode classifies why a failed build failed, empty if the worker
+	// did not tell
+	ErrorCode protocol.ErrorCode `json:"error_code,omitempty"`
+	// CachedFrom is the build whose result was reused instead of building
+	CachedFrom string `json:"cached_from,omitempty"`
+	// ForwardedTo is the peer coordinator the build was forwarded to for
+	// lack of local capacity, and RemoteBuildID its ID there
+	ForwardedTo   string `json:"forwarded_to,omitempty"`
+	RemoteBuildID string `json:"remote_build_id,omitempty"`
+	// CommandLine is the Gradle invocation the worker ran, with secrets
+	// masked
+	CommandLine string `json:"command_line,omitempty"`
+	// TestClasses are the JUnit results of each test class the build ran,
+	// summed up in Metrics.TestResults
+	TestClasses []testshard.ClassResult `json:"test_classes,omitempty"`
+	// Environment is the environment the worker ran the build in
+	Environment *buildenv.Snapshot `json:"environment,omitempty"`
+	// Published lists the artifacts of a build that asked to be published,
+	// once they were
+	Published []PublishedArtifact `json:"published,omitempty"`
 }
 
 // BuildMetrics contains detailed build performance metrics
 type BuildMetrics struct {
-	BuildSteps    []BuildStep
-	CacheHitRate  float64
-	CompiledFiles int
-	TestResults   TestResults
-	ResourceUsage ResourceMetrics
+	BuildSteps    []BuildStep     `json:"build_steps"`
+	CacheHitRate  float64         `json:"cache_hit_rate"`
+	CompiledFiles int             `json:"compiled_files"`
+	TestResults   TestResults     `json:"test_results"`
+	ResourceUsage ResourceMetrics `json:"resource_usage"`
 }
 
 // BuildStep represents individual build step metrics
@@ -52,6 +218,20 @@ type BuildStep struct {
 	Artifacts []string      `json:"artifacts"`
 	StartTime time.Time     `json:"start_time"`
 	EndTime   time.Time     `json:"end_time"`
+	// Output is the end of the output of a hook step
+	Output string `json:"output,omitempty"`
+}
+
+// hookStep returns the build step of a hook a worker ran
+func hookStep(name string, step hooks.Step) BuildStep {
+	return BuildStep{
+		Name:      name,
+		Duration:  step.EndTime.Sub(step.StartTime),
+		Status:    step.Status,
+		StartTime: step.StartTime,
+		EndTime:   step.EndTime,
+		Output:    step.Output,
+	}
 }
 
 // TestResults represents test execution results
@@ -63,12 +243,19 @@ type TestResults struct {
 	Duration time.Duration `json:"duration"`
 }
 
-// ResourceMetrics tracks resource usage during builds
+// ResourceMetrics tracks resource usage during builds. Workers sample the
+// process tree of a build: CPUUsage and MemoryUsage are averages over the
+// samples, DiskIO the bytes read and written and CacheStorage how much the
+// worker's local build cache grew.
 type ResourceMetrics struct {
-	CPUUsage    float64 `json:"cpu_usage"`
-	MemoryUsage int64   `json:"memory_usage"`
-	DiskIO      int64   `json:"disk_io"`
-	NetworkIO   int64   `json:"network_io"`
+	CPUUsage        float64                `json:"cpu_usage"`
+	MemoryUsage     int64                  `json:"memory_usage"`
+	DiskIO          int64                  `json:"disk_io"`
+	NetworkIO       int64                  `json:"network_io"`
+	PeakCPUUsage    float64                `json:"peak_cpu_usage,omitempty"`
+	PeakMemoryUsage int64                  `json:"peak_memory_usage,omitempty"`
+	CacheStorage    int64                  `json:"cache_storage,omitempty"`
+	Samples         []types.ResourceSample `json:"samples,omitempty"`
 }
 
 // Worker represents a build worker node
@@ -81,27 +268,249 @@ type Worker struct {
 	LastPing     time.Time      `json:"last_ping"`
 	Builds       []BuildRequest `json:"builds"`
 	Metrics      WorkerMetrics  `json:"metrics"`
+	MaxBuilds    int            `json:"max_builds"`
+	ActiveBuilds int            `json:"active_builds"`
+	// Version and ProtocolVersion are the release and RPC protocol version
+	// the worker registered with
+	Version         string `json:"version"`
+	ProtocolVersion int    `json:"protocol_version"`
+	// Pool is the worker pool the worker registered in
+	Pool string `json:"pool"`
+	// Calibration are the benchmark scores the worker registered with, nil
+	// for workers that were not calibrated
+	Calibration *calibration.Scores `json:"calibration,omitempty"`
+	// Spot workers run on preemptible instances, which the cloud provider
+	// may terminate at short notice
+	Spot bool `json:"spot,omitempty"`
+	// Transport is http for workers reaching the coordinator over its HTTP
+	// port only, pull for workers polling its calls over the RPC port, and
+	// tcp or empty for workers the coordinator connects to
+	Transport string `json:"transport,omitempty"`
+	// Quarantine is set for workers that stay registered but are not
+	// scheduled any builds
+	Quarantine *registry.Quarantine `json:"quarantine,omitempty"`
+	// OrphanedBuilds are builds a worker restored after a coordinator
+	// restart was already running; they hold slots until its heartbeats
+	// show they finished
+	OrphanedBuilds int `json:"orphaned_builds,omitempty"`
+	// Devices are the Android emulators and devices attached to the
+	// worker, with the builds they are allocated to
+	Devices []devices.Device `json:"devices,omitempty"`
+	// Attestation is the statement the worker registered with, verified
+	// against the coordinator's attestation policy
+	Attestation *attestation.Statement `json:"attestation,omitempty"`
+	// deviceLocks allocate the devices to builds, kept when the worker
+	// registers again
+	deviceLocks *devices.Locks
+	// inflight tracks the builds dispatched to the worker that have not
+	// returned
+	inflight map[string]*inflightBuild
+}
+
+// capacity returns how many builds the worker can run concurrently
+func (w *Worker) capacity() int {
+	if w.MaxBuilds > 0 {
+		return w.MaxBuilds
+	}
+	return 1
+}
+
+// availableSlots returns how many more builds the worker can accept.
+// Workers without slot accounting are single-slot and tracked by status.
+// Quarantined workers accept none.
+func (w *Worker) availableSlots() int {
+	if w.Quarantine != nil {
+		return 0
+	}
+	if w.MaxBuilds <= 0 {
+		if w.Status == "idle" && w.ActiveBuilds == 0 {
+			return 1
+		}
+		return 0
+	}
+
+	if free := w.MaxBuilds - w.ActiveBuilds; free > 0 {
+		return free
+	}
+	return 0
 }
 
-// WorkerMetrics tracks worker performance
+// updateStatus derives the worker status from its slot usage
+func (w *Worker) updateStatus() {
+	if w.ActiveBuilds >= w.capacity() {
+		w.Status = "busy"
+	} else {
+		w.Status = "idle"
+	}
+}
+
+// WorkerMetrics tracks worker performance and self-reported resource usage
 type WorkerMetrics struct {
 	BuildCount       int           `json:"build_count"`
 	TotalBuildTime   time.Duration `json:"total_build_time"`
 	AverageBuildTime time.Duration `json:"average_build_time"`
 	SuccessRate      float64       `json:"success_rate"`
 	LastBuildTime    time.Time     `json:"last_build_time"`
+	CPUUsage         float64       `json:"cpu_usage"`
+	MemoryUsage      float64       `json:"memory_usage"`
+	DiskUsage        float64       `json:"disk_usage"`
+	LoadAverage      float64       `json:"load_average"`
+	ActiveBuilds     int           `json:"active_builds"`
+	LastTelemetry    time.Time     `json:"last_telemetry"`
+}
+
+// Build lifecycle states tracked by the coordinator
+const (
+	BuildStatusQueued    = "queued"
+	BuildStatusRunning   = "running"
+	BuildStatusCompleted = "completed"
+	BuildStatusFailed    = "failed"
+	BuildStatusCancelled = "cancelled"
+)
+
+// BuildProgress tracks the live state of a build as reported by its worker
+type BuildProgress struct {
+	BuildID   string    `json:"build_id"`
+	WorkerID  string    `json:"worker_id"`
+	Status    string    `json:"status"`
+	Progress  float64   `json:"progress"`
+	Step      string    `json:"step"`
+	Message   string    `json:"message"`
+	StartedAt time.Time `json:"started_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// Paused holds a queued build in the queue without scheduling it
+	Paused bool `json:"paused,omitempty"`
+	// Throttled is set on a queued build while its project runs as many
+	// builds as its concurrency limit allows
+	Throttled bool `json:"throttled,omitempty"`
 }
 
 // BuildCoordinator manages the distributed build system
 type BuildCoordinator struct {
 	workers    map[string]*Worker
 	buildQueue chan BuildRequest
-	builds     map[string]*BuildResponse
-	mutex      sync.RWMutex
-	httpServer *http.Server
-	rpcServer  *rpc.Server
+	// queues holds the queue of each worker pool; buildQueue is the queue
+	// of the default pool
+	queues   map[string]chan BuildRequest
+	router   *pools.Router
+	weights  fairshare.Weights
+	builds   map[string]*BuildResponse
+	requests map[string]BuildRequest
+	progress map[string]*BuildProgress
+	watchers map[string][]chan BuildProgress
+	timers   map[string]*taskTimer
+	results  map[string]cachedResult
+	// speculations tracks the builds duplicated on a second worker
+	speculations map[string]*speculation
+	speculation  SpeculationConfig
+	mutex        sync.RWMutex
+	httpServer   *http.Server
+	rpcServer    *rpc.Server
+	rateLimiter  *ratelimit.Limiter
+	auditLog     *audit.Log
+	buildStore   *buildstore.Store
+	chaos        *chaos.Injector
+	buildPolicy  validation.BuildPolicy
+	secretStore  *secrets.Store
+	// buildHooks are the hooks of projects, added around those of builds
+	buildHooks hooks.Rules
+	// statuses reports builds on their commits to the source code hosts
+	// configured in statusReports
+	statusReports StatusReportConfig
+	statuses      *scmstatus.Dispatcher
+	// minWorkerProtocol is the oldest protocol version workers may register
+	// with, and workerRelease the worker binary they may update to
+	minWorkerProtocol int
+	workerRelease     *protocol.Publisher
+	// resultTTL is how long successful results are reused; zero disables
+	// the result cache
+	resultTTL  time.Duration
 	shutdown   chan struct{}
 	maxWorkers int
+	// drain configures shutdown, and draining is set once it began and
+	// builds are no longer accepted or dispatched
+	drain       DrainConfig
+	draining    bool
+	rpcListener net.Listener
+	// forwarded tracks the builds running on peer coordinators
+	forwarded  map[string]forwardedBuild
+	federation federation.Config
+	peers      *federation.Client
+	// registry persists registered workers across restarts
+	registry *registry.Registry
+	// mailboxes queue the calls to workers registered over HTTP until they
+	// poll them
+	mailboxes map[string]*httprpc.Mailbox
+	// recovery evicts workers that miss heartbeats and recovers their builds
+	recovery RecoveryConfig
+	// spot configures which builds prefer workers that are not spot
+	// instances
+	spot SpotConfig
+	// concurrency limits the running builds of each project
+	concurrency ConcurrencyConfig
+	// maven is the Maven repository builds publish their artifacts to
+	maven PublishConfig
+	// events publishes build lifecycle events, and queueStream streams the
+	// changes of the scheduling queues
+	events      events.Bus
+	queueStream *queueStream
+	// artifacts stores the artifacts uploaded by workers as deduplicated
+	// chunks, garbage collected by the retention policies
+	artifacts *transfer.Store
+	retention retention.Policies
+	// scheduling keeps the scheduling attempts of every build, and
+	// reliability the finished builds of every worker they are scored by
+	scheduling  map[string][]SchedulingAttempt
+	reliability map[string]workerReliability
+	// quarantine configures when failing workers are quarantined, and
+	// quarantined keeps the quarantined workers across re-registrations
+	quarantine  QuarantineConfig
+	quarantined map[string]*registry.Quarantine
+	// tags holds the tags of every build, with their annotations
+	tags *tagIndex
+	// groups tracks the children of matrix builds, and pipelines the
+	// stages of pipelines
+	groups    map[string]*buildGroup
+	pipelines map[string]*pipelineRun
+	// dependents are the queued builds waiting for each build to complete
+	dependents map[string][]string
+	// bisects tracks the bisections of build regressions, listing the
+	// commits to build with checkouts
+	bisects   map[string]*bisectRun
+	checkouts *gitsource.Checkouts
+	// tracer exports spans of the API requests, nil unless tracing is
+	// configured
+	tracer *tracing.Tracer
+	// buildLogs keeps the output workers report for each build
+	buildLogs *buildlogs.Store
+	// systemHealth configures which dependencies the system health check
+	// queries
+	systemHealth SystemHealthConfig
+	// authorizer decides which callers may submit builds and perform admin
+	// operations, nil to allow every authenticated caller
+	authorizer authz.Authorizer
+	// apiKeys are the keys issued to non-interactive clients
+	apiKeys *apikeys.Store
+	// signer signs build results and artifact manifests, nil to serve them
+	// unsigned
+	signer *signing.Signer
+	// attestation lists the workers allowed to register, nil to accept
+	// workers without attestation
+	attestation *attestation.Policy
+	// login signs users in with an OIDC identity provider, nil when none is
+	// configured
+	login *oidcLogin
+	// ml predicts build durations over RPC, nil to predict them from the
+	// coordinator's build history
+	ml *mlrpc.Client
+	// admission rejects builds of commits that keep failing, using the
+	// failure risk predicted by ml
+	admission AdmissionConfig
+	// cacheSeed configures the builds warming the caches off-peak, by the
+	// scaling patterns learned by ml, and lastCacheSeed is when they were
+	// last queued
+	cacheSeed     CacheSeedConfig
+	lastCacheSeed time.Time
 }
 
 // Test RPC method to verify registration works
@@ -118,16 +527,65 @@ type RegisterWorkerArgs struct {
 	Port         int      `json:"port"`
 	Capabilities []string `json:"capabilities"`
 	Status       string   `json:"status"`
+	MaxBuilds    int      `json:"max_builds"`
+	// Version and ProtocolVersion are unset for workers that predate
+	// version negotiation
+	Version         string `json:"version"`
+	ProtocolVersion int    `json:"protocol_version"`
+	// Pool is the worker pool to join, the default pool if empty
+	Pool string `json:"pool"`
+	// Calibration are the benchmark scores of the worker, if calibrated
+	Calibration *calibration.Scores `json:"calibration,omitempty"`
+	// Spot is set by workers on preemptible instances
+	Spot bool `json:"spot,omitempty"`
+	// Transport is http or pull for workers that poll the coordinator's
+	// calls instead of accepting RPC connections
+	Transport string `json:"transport,omitempty"`
+	// Devices are the Android devices attached to the worker
+	Devices []devices.Device `json:"devices,omitempty"`
+	// Attestation is the worker's signed statement of what it runs, if it
+	// has an attestation key
+	Attestation *attestation.Attestation `json:"attestation,omitempty"`
 }
 
 type RegisterWorkerReply struct {
 	Message string `json:"message"`
+	// Update is the worker release published by the coordinator, if any
+	Update *protocol.Release `json:"update,omitempty"`
+}
+
+type GetWorkerReleaseArgs struct {
+	ID string `json:"id"`
+}
+
+type GetWorkerReleaseReply struct {
+	MinProtocolVersion int               `json:"min_protocol_version"`
+	Release            *protocol.Release `json:"release,omitempty"`
+}
+
+type DownloadWorkerBinaryArgs struct {
+	ID     string `json:"id"`
+	SHA256 string `json:"sha256"`
+}
+
+type DownloadWorkerBinaryReply struct {
+	Data []byte `json:"data"`
 }
 
 type HeartbeatArgs struct {
-	ID        string    `json:"id"`
-	Status    string    `json:"status"`
-	Timestamp time.Time `json:"timestamp"`
+	ID           string    `json:"id"`
+	Status       string    `json:"status"`
+	Timestamp    time.Time `json:"timestamp"`
+	CPUUsage     float64   `json:"cpu_usage"`
+	MemoryUsage  float64   `json:"memory_usage"`
+	DiskUsage    float64   `json:"disk_usage"`
+	LoadAverage  float64   `json:"load_average"`
+	ActiveBuilds int       `json:"active_builds"`
+	// TelemetryUnavailable is set by workers that could not read their
+	// usage values, whose load is then unknown
+	TelemetryUnavailable bool `json:"telemetry_unavailable,omitempty"`
+	// Devices are the Android devices attached to the worker
+	Devices []devices.Device `json:"devices,omitempty"`
 }
 
 type HeartbeatReply struct {
@@ -142,15 +600,164 @@ type UnregisterWorkerReply struct {
 	Message string `json:"message"`
 }
 
+type GetBuildStatusArgs struct {
+	BuildID string `json:"build_id"`
+}
+
+type GetBuildStatusReply struct {
+	Progress BuildProgress `json:"progress"`
+	Response BuildResponse `json:"response"`
+}
+
+type CancelBuildArgs struct {
+	BuildID string `json:"build_id"`
+	Reason  string `json:"reason"`
+}
+
+type CancelBuildReply struct {
+	Message string `json:"message"`
+}
+
+type ReportProgressArgs struct {
+	BuildID   string    `json:"build_id"`
+	WorkerID  string    `json:"worker_id"`
+	Progress  float64   `json:"progress"`
+	Step      string    `json:"step"`
+	Message   string    `json:"message"`
+	Timestamp time.Time `json:"timestamp"`
+	// CommandLine is the Gradle invocation of the build, with secrets
+	// masked, reported when it starts
+	CommandLine string `json:"command_line,omitempty"`
+	// Outcome is the outcome Gradle printed next to the task of the step,
+	// such as FROM-CACHE or UP-TO-DATE, if known when it started
+	Outcome string `json:"outcome,omitempty"`
+	// Environment is the environment of the build, reported when it starts
+	// and again with the cache keys of its tasks when it ends
+	Environment *buildenv.Snapshot `json:"environment,omitempty"`
+	// Hook is the outcome of the hook of the step, reported when it ended
+	Hook *hooks.Step `json:"hook,omitempty"`
+}
+
+type ReportProgressReply struct {
+	Cancelled bool   `json:"cancelled"`
+	Message   string `json:"message"`
+}
+
+type ReportArtifactsArgs struct {
+	BuildID      string           `json:"build_id"`
+	WorkerID     string           `json:"worker_id"`
+	Artifacts    []types.Artifact `json:"artifacts"`
+	CacheHitRate float64          `json:"cache_hit_rate"`
+	// ResourceUsage is the sampled resource usage of the build
+	ResourceUsage *ResourceMetrics `json:"resource_usage,omitempty"`
+}
+
+type ReportArtifactsReply struct {
+	Message string `json:"message"`
+}
+
+type ReportTestResultsArgs struct {
+	BuildID  string                  `json:"build_id"`
+	WorkerID string                  `json:"worker_id"`
+	Classes  []testshard.ClassResult `json:"classes"`
+	// Commit is the commit the worker checked out, empty for builds of a
+	// project path
+	Commit string `json:"commit,omitempty"`
+}
+
+type ReportTestResultsReply struct {
+	Message string `json:"message"`
+}
+
+// CoordinatorRPC exposes the coordinator over net/rpc. It embeds the
+// coordinator so its RPC methods are served as-is, and adds RPC forms of
+// methods whose Go signatures take plain arguments.
+type CoordinatorRPC struct {
+	*BuildCoordinator
+}
+
 // NewBuildCoordinator creates a new build coordinator
 func NewBuildCoordinator(maxWorkers int) *BuildCoordinator {
-	return &BuildCoordinator{
-		workers:    make(map[string]*Worker),
-		buildQueue: make(chan BuildRequest, 100),
-		builds:     make(map[string]*BuildResponse),
-		shutdown:   make(chan struct{}),
-		maxWorkers: maxWorkers,
+	rateLimitConfig, err := ratelimit.LoadConfigFromEnv()
+	if err != nil {
+		log.Printf("Invalid rate limit configuration, using defaults: %v", err)
 	}
+	// Workers connected over HTTP are not rate limited, like those
+	// connected over TCP
+	rateLimitConfig.ExemptPaths = append(rateLimitConfig.ExemptPaths, workerRPCPaths...)
+	buildPolicy, err := validation.BuildPolicyFromEnv()
+	if err != nil {
+		log.Printf("Invalid build policy, using defaults: %v", err)
+	}
+
+	// The audit log and build store are persisted and secrets loaded by
+	// coordinatorService.Init; tests keep them in memory
+	auditLog, _ := audit.Open("")
+	apiKeys, _ := apikeys.Open("")
+	buildStore, _ := buildstore.Open("")
+	workerRegistry, _ := registry.Open("")
+	artifactStore, _ := transfer.Open("")
+	buildLogs, _ := buildlogs.Open("", buildlogs.DefaultLimits())
+	buildQueue := make(chan BuildRequest, 100)
+	router, _ := pools.NewRouter(nil)
+	federationConfig := federation.DefaultConfig()
+
+	bc := &BuildCoordinator{
+		workers:      make(map[string]*Worker),
+		buildQueue:   buildQueue,
+		queues:       map[string]chan BuildRequest{pools.DefaultPool: buildQueue},
+		router:       router,
+		builds:       make(map[string]*BuildResponse),
+		requests:     make(map[string]BuildRequest),
+		progress:     make(map[string]*BuildProgress),
+		watchers:     make(map[string][]chan BuildProgress),
+		timers:       make(map[string]*taskTimer),
+		results:      make(map[string]cachedResult),
+		speculations: make(map[string]*speculation),
+		scheduling:   make(map[string][]SchedulingAttempt),
+		reliability:  make(map[string]workerReliability),
+		quarantine:   defaultQuarantineConfig(),
+		quarantined:  make(map[string]*registry.Quarantine),
+		tags:         newTagIndex(),
+		groups:       make(map[string]*buildGroup),
+		pipelines:    make(map[string]*pipelineRun),
+		dependents:   make(map[string][]string),
+		bisects:      make(map[string]*bisectRun),
+		checkouts:    gitsource.NewCheckouts(filepath.Join(os.TempDir(), "git-cache")),
+		forwarded:    make(map[string]forwardedBuild),
+		federation:   federationConfig,
+		peers:        federation.NewClient(federationConfig.Name),
+		registry:     workerRegistry,
+		recovery:     defaultRecoveryConfig(),
+		spot:         defaultSpotConfig(),
+		concurrency:  defaultConcurrencyConfig(),
+		events:       events.NewMemory(),
+		queueStream:  newQueueStream(),
+		artifacts:    artifactStore,
+		buildLogs:    buildLogs,
+		systemHealth: defaultSystemHealthConfig(),
+		retention:    retention.Policies{Default: retention.Policy{KeepDays: DefaultArtifactRetention.Hours() / 24}},
+		weights:      fairshare.Weights{Default: fairshare.DefaultWeight},
+		rateLimiter:  ratelimit.NewLimiter(rateLimitConfig, "coordinator"),
+		auditLog:     auditLog,
+		apiKeys:      apiKeys,
+		buildStore:   buildStore,
+		buildPolicy:  buildPolicy,
+		secretStore:  &secrets.Store{},
+		shutdown:     make(chan struct{}),
+		maxWorkers:   maxWorkers,
+		drain:        defaultDrainConfig(),
+		cacheSeed:    defaultCacheSeedConfig(),
+		mailboxes:    make(map[string]*httprpc.Mailbox),
+	}
+
+	// The RPC service is served on the RPC port and, to workers that can
+	// only reach the HTTP port, on /api/rpc
+	bc.rpcServer = rpc.NewServer()
+	if err := bc.rpcServer.RegisterName("BuildCoordinator", &CoordinatorRPC{bc}); err != nil {
+		log.Printf("RPC registration failed: %v", err)
+	}
+	return bc
 }
 
 // RegisterWorker adds a new worker to the pool
@@ -160,23 +767,108 @@ func (bc *BuildCoordinator) RegisterWorker(args *RegisterWorkerArgs, reply *Regi
 	bc.mutex.Lock()
 	defer bc.mutex.Unlock()
 
-	if len(bc.workers) >= bc.maxWorkers {
+	// Reject workers whose requests this coordinator cannot understand;
+	// they can still fetch the published release to update themselves
+	if args.ProtocolVersion < bc.minWorkerProtocol {
+		return fmt.Errorf("worker %s speaks protocol version %d but at least version %d is required; update the worker",
+			args.ID, args.ProtocolVersion, bc.minWorkerProtocol)
+	}
+	if args.Pool != "" && !pools.ValidName(args.Pool) {
+		return fmt.Errorf("worker %s has an invalid pool name %q", args.ID, args.Pool)
+	}
+	statement, err := bc.attestWorker(args)
+	if err != nil {
+		return err
+	}
+
+	// A worker re-registering, e.g. after updating itself, replaces its entry
+	if _, exists := bc.workers[args.ID]; !exists && len(bc.workers) >= bc.maxWorkers {
 		return fmt.Errorf("maximum workers (%d) reached", bc.maxWorkers)
 	}
 
 	worker := &Worker{
-		ID:           args.ID,
-		Host:         args.Host,
-		Port:         args.Port,
-		Status:       "idle",
-		Capabilities: args.Capabilities,
-		LastPing:     time.Now(),
+		ID:              args.ID,
+		Host:            args.Host,
+		Port:            args.Port,
+		Status:          "idle",
+		Capabilities:    args.Capabilities,
+		LastPing:        time.Now(),
+		MaxBuilds:       args.MaxBuilds,
+		Version:         args.Version,
+		ProtocolVersion: args.ProtocolVersion,
+		Pool:            pools.Normalize(args.Pool),
+		Calibration:     args.Calibration,
+		Spot:            args.Spot,
+		Transport:       args.Transport,
+		Quarantine:      bc.workerQuarantine(args.ID),
+		Attestation:     statement,
 	}
+	if worker.MaxBuilds <= 0 {
+		worker.MaxBuilds = 1
+	}
+	// Devices stay allocated to the builds still running on the worker
+	if previous, exists := bc.workers[worker.ID]; exists {
+		worker.deviceLocks = previous.deviceLocks
+	}
+	worker.setDevices(args.Devices)
 
 	bc.workers[worker.ID] = worker
+	if worker.pollsCalls() {
+		bc.mailbox(worker.ID)
+	}
+	if err := bc.registry.Put(registryEntry(worker)); err != nil {
+		log.Printf("Failed to update the worker registry: %v", err)
+	}
 
-	log.Printf("Worker %s registered from %s:%d", worker.ID, worker.Host, worker.Port)
+	bc.recordEvent(audit.Event{
+		Action:    audit.ActionWorkerRegistered,
+		Principal: "worker:" + worker.ID,
+		SourceIP:  worker.Host,
+		Resource:  worker.ID,
+		Details: map[string]string{
+			"port":             strconv.Itoa(worker.Port),
+			"max_builds":       strconv.Itoa(worker.MaxBuilds),
+			"version":          worker.Version,
+			"protocol_version": strconv.Itoa(worker.ProtocolVersion),
+			"pool":             worker.Pool,
+			"spot":             strconv.FormatBool(worker.Spot),
+			"transport":        worker.Transport,
+		},
+	})
+
+	log.Printf("Worker %s %s registered from %s:%d in pool %s with %d build slots", worker.ID, worker.Version, worker.Host, worker.Port, worker.Pool, worker.MaxBuilds)
 	reply.Message = fmt.Sprintf("Worker %s registered successfully", worker.ID)
+	reply.Update = bc.workerRelease.Release()
+	return nil
+}
+
+// GetWorkerRelease returns the worker release workers may update to and the
+// oldest protocol version they may register with
+func (bc *BuildCoordinator) GetWorkerRelease(args *GetWorkerReleaseArgs, reply *GetWorkerReleaseReply) error {
+	reply.MinProtocolVersion = bc.minWorkerProtocol
+	reply.Release = bc.workerRelease.Release()
+	return nil
+}
+
+// DownloadWorkerBinary sends the published worker binary. The digest of the
+// release the worker is updating to must match, so a worker never installs
+// a binary published after it checked.
+func (bc *BuildCoordinator) DownloadWorkerBinary(args *DownloadWorkerBinaryArgs, reply *DownloadWorkerBinaryReply) error {
+	release := bc.workerRelease.Release()
+	if release == nil {
+		return fmt.Errorf("no worker release is published")
+	}
+	if args.SHA256 != release.SHA256 {
+		return fmt.Errorf("worker release %s is no longer published", args.SHA256)
+	}
+
+	data, err := bc.workerRelease.Binary()
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Sending worker release %s to worker %s", release.Version, args.ID)
+	reply.Data = data
 	return nil
 }
 
@@ -184,15 +876,37 @@ func (bc *BuildCoordinator) RegisterWorker(args *RegisterWorkerArgs, reply *Regi
 // RPC method signature: func (t *T) MethodName(args *ArgType, reply *ReplyType) error
 func (bc *BuildCoordinator) Heartbeat(args *HeartbeatArgs, reply *HeartbeatReply) error {
 	log.Printf("Heartbeat called with args: %+v", args)
+	if bc.chaos.DropHeartbeat() {
+		log.Printf("Chaos: dropping heartbeat from worker %s", args.ID)
+		return nil
+	}
+
 	bc.mutex.Lock()
 	defer bc.mutex.Unlock()
 
 	if worker, exists := bc.workers[args.ID]; exists {
-		worker.Status = args.Status
+		// Slot accounting is authoritative for workers that advertised a capacity
+		if worker.MaxBuilds > 0 {
+			worker.releaseOrphanedBuilds(args.ActiveBuilds)
+			worker.updateStatus()
+		} else {
+			worker.Status = args.Status
+		}
 		worker.LastPing = time.Now()
 
+		worker.Metrics.ActiveBuilds = args.ActiveBuilds
+		if !args.TelemetryUnavailable {
+			worker.Metrics.CPUUsage = args.CPUUsage
+			worker.Metrics.MemoryUsage = args.MemoryUsage
+			worker.Metrics.DiskUsage = args.DiskUsage
+			worker.Metrics.LoadAverage = args.LoadAverage
+			worker.Metrics.LastTelemetry = time.Now()
+		}
+		worker.setDevices(args.Devices)
+
 		reply.Message = fmt.Sprintf("Heartbeat received from worker %s", args.ID)
-		log.Printf("Heartbeat from worker %s (status: %s)", args.ID, args.Status)
+		log.Printf("Heartbeat from worker %s (status: %s, cpu: %.2f, mem: %.2f, disk: %.2f, load: %.2f, active: %d)",
+			args.ID, args.Status, args.CPUUsage, args.MemoryUsage, args.DiskUsage, args.LoadAverage, args.ActiveBuilds)
 		return nil
 	}
 
@@ -205,8 +919,17 @@ func (bc *BuildCoordinator) UnregisterWorker(args *UnregisterWorkerArgs, reply *
 	bc.mutex.Lock()
 	defer bc.mutex.Unlock()
 
-	if _, exists := bc.workers[args.ID]; exists {
+	if worker, exists := bc.workers[args.ID]; exists {
 		delete(bc.workers, args.ID)
+		if err := bc.registry.Remove(args.ID); err != nil {
+			log.Printf("Failed to update the worker registry: %v", err)
+		}
+		bc.recordEvent(audit.Event{
+			Action:    audit.ActionWorkerUnregistered,
+			Principal: "worker:" + args.ID,
+			SourceIP:  worker.Host,
+			Resource:  args.ID,
+		})
 		log.Printf("Worker %s unregistered", args.ID)
 		reply.Message = fmt.Sprintf("Worker %s unregistered successfully", args.ID)
 		return nil
@@ -225,6 +948,29 @@ func (bc *BuildCoordinator) SubmitBuild(request BuildRequest) (string, error) {
 	}
 
 	request.Timestamp = time.Now()
+	request.QueuedAt = request.Timestamp
+	if request.Type != BuildTypeCacheSeed {
+		request.Pool = bc.router.Route(request.ProjectPath, request.RepoURL, request.Labels)
+	}
+	if request.Tenant == "" {
+		request.Tenant = fairshare.DefaultTenant
+	}
+	bc.tags.set(request.RequestID, request.Tags)
+
+	// An identical build that succeeded recently completes immediately,
+	// unless it waits for builds that may change what it builds
+	if len(request.DependsOn) == 0 && bc.reuseResult(request, request.Timestamp) {
+		response := bc.builds[request.RequestID]
+		bc.publish(events.Event{Type: events.BuildSubmitted, BuildID: request.RequestID})
+		bc.publish(events.Event{
+			Type:         events.BuildFinished,
+			BuildID:      request.RequestID,
+			WorkerID:     response.WorkerID,
+			Status:       BuildStatusCompleted,
+			CacheHitRate: response.Metrics.CacheHitRate,
+		})
+		return request.RequestID, nil
+	}
 
 	// Store initial build response
 	response := &BuildResponse{
@@ -233,13 +979,37 @@ func (bc *BuildCoordinator) SubmitBuild(request BuildRequest) (string, error) {
 		Success:   false,
 	}
 	bc.builds[request.RequestID] = response
+	bc.requests[request.RequestID] = request
+	bc.progress[request.RequestID] = &BuildProgress{
+		BuildID:   request.RequestID,
+		Status:    BuildStatusQueued,
+		UpdatedAt: time.Now(),
+	}
+
+	// A build whose dependency already failed fails without being queued,
+	// the others wait in the queue until their dependencies completed
+	pending, failed := bc.pendingDependencies(request)
+	if failed != "" {
+		bc.publish(events.Event{Type: events.BuildSubmitted, BuildID: request.RequestID})
+		bc.failDependent(request.RequestID, failed)
+		return request.RequestID, nil
+	}
+	bc.waitForDependencies(request, pending)
 
 	// Add to queue
 	select {
-	case bc.buildQueue <- request:
-		log.Printf("Build %s queued for project %s", request.RequestID, request.ProjectPath)
+	case bc.queue(request.Pool) <- request:
+		log.Printf("Build %s queued for project %s in pool %s request_id=%s", request.RequestID, request.ProjectPath, request.Pool, request.CorrelationID)
+		bc.publish(events.Event{Type: events.BuildSubmitted, BuildID: request.RequestID})
 		return request.RequestID, nil
 	default:
+		// Forget the build, so it is neither listed nor waited for
+		bc.stopWaiting(request.RequestID, pending)
+		delete(bc.builds, request.RequestID)
+		delete(bc.requests, request.RequestID)
+		delete(bc.progress, request.RequestID)
+		bc.tags.set(request.RequestID, nil)
+		metrics.SchedulerDecisions.WithLabelValues(pools.Normalize(request.Pool), metrics.DecisionQueueFull).Inc()
 		return "", fmt.Errorf("build queue is full")
 	}
 }
@@ -257,6 +1027,206 @@ func (bc *BuildCoordinator) GetBuildStatus(buildID string) (*BuildResponse, erro
 	return response, nil
 }
 
+// GetBuildProgress returns the live progress of a build
+func (bc *BuildCoordinator) GetBuildProgress(buildID string) (*BuildProgress, error) {
+	bc.mutex.RLock()
+	defer bc.mutex.RUnlock()
+
+	progress, exists := bc.progress[buildID]
+	if !exists {
+		return nil, fmt.Errorf("build %s not found", buildID)
+	}
+
+	result := *progress
+	return &result, nil
+}
+
+// GetBuildStatus returns the progress and result of a build
+// RPC method signature: func (t *T) MethodName(args *ArgType, reply *ReplyType) error
+func (r *CoordinatorRPC) GetBuildStatus(args *GetBuildStatusArgs, reply *GetBuildStatusReply) error {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	response, exists := r.builds[args.BuildID]
+	if !exists {
+		return fmt.Errorf("build %s not found", args.BuildID)
+	}
+
+	reply.Response = *response
+	if progress, exists := r.progress[args.BuildID]; exists {
+		reply.Progress = *progress
+	}
+	return nil
+}
+
+// CancelBuild cancels a queued or running build. Running builds are stopped
+// by their worker the next time it reports progress.
+// RPC method signature: func (t *T) MethodName(args *ArgType, reply *ReplyType) error
+func (bc *BuildCoordinator) CancelBuild(args *CancelBuildArgs, reply *CancelBuildReply) error {
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+
+	progress, exists := bc.progress[args.BuildID]
+	if !exists {
+		return fmt.Errorf("build %s not found", args.BuildID)
+	}
+
+	switch progress.Status {
+	case BuildStatusCompleted, BuildStatusFailed, BuildStatusCancelled:
+		return fmt.Errorf("build %s already %s", args.BuildID, progress.Status)
+	}
+
+	reason := args.Reason
+	if reason == "" {
+		reason = "cancelled by request"
+	}
+
+	progress.Status = BuildStatusCancelled
+	progress.Paused = false
+	progress.Throttled = false
+	progress.Message = reason
+	progress.UpdatedAt = time.Now()
+	bc.notifyProgress(args.BuildID)
+
+	if response, exists := bc.builds[args.BuildID]; exists {
+		response.Success = false
+		response.ErrorMessage = fmt.Sprintf("build cancelled: %s", reason)
+		response.ErrorCode = protocol.ErrorCancelled
+		response.Timestamp = time.Now()
+		response.BuildDuration = bc.elapsed(args.BuildID)
+	}
+	bc.recordBuild(args.BuildID)
+
+	bc.recordEvent(audit.Event{
+		Action:    audit.ActionBuildCancelled,
+		Principal: "rpc",
+		Resource:  args.BuildID,
+		Details:   map[string]string{"reason": reason},
+	})
+
+	log.Printf("Build %s cancelled: %s", args.BuildID, reason)
+	reply.Message = fmt.Sprintf("Build %s cancelled", args.BuildID)
+	return nil
+}
+
+// ReportProgress records progress and step transitions streamed by a worker.
+// The reply tells the worker whether the build has been cancelled.
+// RPC method signature: func (t *T) MethodName(args *ArgType, reply *ReplyType) error
+func (bc *BuildCoordinator) ReportProgress(args *ReportProgressArgs, reply *ReportProgressReply) error {
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+
+	progress, exists := bc.progress[args.BuildID]
+	if !exists {
+		return fmt.Errorf("build %s not found", args.BuildID)
+	}
+
+	if progress.Status == BuildStatusCancelled {
+		reply.Cancelled = true
+		reply.Message = fmt.Sprintf("Build %s was cancelled: %s", args.BuildID, progress.Message)
+		return nil
+	}
+
+	// Only one copy of a duplicated build reports its progress; the copy
+	// that lost is stopped
+	winner, current := bc.speculativeReport(args.BuildID, args.WorkerID)
+	if winner != "" {
+		reply.Cancelled = true
+		reply.Message = fmt.Sprintf("Build %s was completed by worker %s", args.BuildID, winner)
+		return nil
+	}
+	if !current {
+		reply.Message = fmt.Sprintf("Build %s is reported by another worker", args.BuildID)
+		return nil
+	}
+
+	if args.Step != "" && args.Step != progress.Step {
+		log.Printf("Build %s on worker %s: %s (%.0f%%)", args.BuildID, args.WorkerID, args.Step, args.Progress)
+	}
+
+	progress.WorkerID = args.WorkerID
+	progress.Status = BuildStatusRunning
+	progress.Progress = math.Max(0, math.Min(100, args.Progress))
+	if args.Step != "" {
+		progress.Step = args.Step
+	}
+	progress.Message = args.Message
+	progress.UpdatedAt = time.Now()
+	if response, exists := bc.builds[args.BuildID]; exists {
+		if args.CommandLine != "" {
+			response.CommandLine = args.CommandLine
+		}
+		if args.Environment != nil {
+			response.Environment = args.Environment
+			response.Environment.ResultCacheKey = resultCacheKey(bc.requests[args.BuildID])
+		}
+		if args.Hook != nil {
+			response.Metrics.BuildSteps = append(response.Metrics.BuildSteps, hookStep(args.Step, *args.Hook))
+		}
+	}
+	bc.trackStep(args.BuildID, progress.Step, args.Outcome, progress.UpdatedAt)
+	bc.notifyProgress(args.BuildID)
+
+	reply.Message = fmt.Sprintf("Progress recorded for build %s", args.BuildID)
+	return nil
+}
+
+// ReportArtifacts records the checksummed artifacts a worker produced for a build.
+// Only the worker the build was assigned to may report them.
+// RPC method signature: func (t *T) MethodName(args *ArgType, reply *ReplyType) error
+func (bc *BuildCoordinator) ReportArtifacts(args *ReportArtifactsArgs, reply *ReportArtifactsReply) error {
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+
+	if _, exists := bc.builds[args.BuildID]; !exists {
+		return fmt.Errorf("build %s not found", args.BuildID)
+	}
+
+	// The artifacts of a duplicated build are those of the copy that wins
+	if spec, exists := bc.speculations[args.BuildID]; exists && spec.winner == "" && (args.WorkerID == spec.primary || args.WorkerID == spec.backup) {
+		spec.artifacts[args.WorkerID] = args
+		reply.Message = fmt.Sprintf("Recorded %d artifacts for build %s", len(args.Artifacts), args.BuildID)
+		return nil
+	}
+
+	if progress, exists := bc.progress[args.BuildID]; exists && progress.WorkerID != args.WorkerID {
+		return fmt.Errorf("build %s is not assigned to worker %s", args.BuildID, args.WorkerID)
+	}
+
+	bc.applyArtifacts(args.BuildID, args)
+	reply.Message = fmt.Sprintf("Recorded %d artifacts for build %s", len(args.Artifacts), args.BuildID)
+	return nil
+}
+
+// applyArtifacts sets the artifacts of a build. Must be called with the
+// mutex held.
+func (bc *BuildCoordinator) applyArtifacts(buildID string, args *ReportArtifactsArgs) {
+	response, exists := bc.builds[buildID]
+	if !exists {
+		return
+	}
+
+	response.Artifacts = make([]string, 0, len(args.Artifacts))
+	for _, artifact := range args.Artifacts {
+		response.Artifacts = append(response.Artifacts, artifact.Path)
+	}
+	response.ArtifactDetails = args.Artifacts
+	response.Metrics.CacheHitRate = args.CacheHitRate
+	metrics.BuildCacheHits.Observe(args.CacheHitRate)
+	if args.ResourceUsage != nil {
+		response.Metrics.ResourceUsage = *args.ResourceUsage
+	}
+}
+
+// isBuildCancelled reports whether a build has been cancelled
+func (bc *BuildCoordinator) isBuildCancelled(buildID string) bool {
+	bc.mutex.RLock()
+	defer bc.mutex.RUnlock()
+
+	progress, exists := bc.progress[buildID]
+	return exists && progress.Status == BuildStatusCancelled
+}
+
 // GetWorkers returns the list of registered workers
 func (bc *BuildCoordinator) GetWorkers() []Worker {
 	bc.mutex.RLock()
@@ -270,23 +1240,135 @@ func (bc *BuildCoordinator) GetWorkers() []Worker {
 	return workers
 }
 
+// httpRequestsTotal counts HTTP requests by method, route and status
+var httpRequestsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: metrics.HTTPRequestsTotal,
+		Help: "Total number of HTTP requests",
+	},
+	[]string{"method", "endpoint", "status"},
+)
+
 // StartHTTPServer starts the HTTP API server
 func (bc *BuildCoordinator) StartHTTPServer(port int) error {
+	bc.listen(port)
+	return bc.httpServer.ListenAndServe()
+}
+
+// listen creates the HTTP API server, to be served with ListenAndServe
+func (bc *BuildCoordinator) listen(port int) {
+	bc.httpServer = &http.Server{
+		Addr:    fmt.Sprintf(":%d", port),
+		Handler: bc.routes(auth.NewAuthServiceFromEnv()),
+	}
+	log.Printf("HTTP server listening on port %d", port)
+}
+
+// routes registers the HTTP API and wraps it with the middleware stack.
+// A nil auth service leaves the API unauthenticated.
+func (bc *BuildCoordinator) routes(authService *auth.AuthService) http.Handler {
 	mux := http.NewServeMux()
 
 	// API endpoints
-	mux.HandleFunc("/api/build", bc.handleBuildRequest)
-	mux.HandleFunc("/api/builds/", bc.handleGetBuild)
-	mux.HandleFunc("/api/workers", bc.handleGetWorkers)
-	mux.HandleFunc("/api/health", bc.handleHealthCheck)
+	mux.HandleFunc("POST /api/build", bc.handleBuildRequest)
+	mux.HandleFunc("GET /api/builds", bc.handleListBuilds)
+	mux.HandleFunc("GET /api/builds/compare", bc.handleCompareBuilds)
+	mux.HandleFunc("GET /api/builds/{id}", bc.handleGetBuild)
+	mux.HandleFunc("GET /api/builds/{id}/stream", bc.handleBuildStream)
+	mux.HandleFunc("GET /api/queue/stream", bc.handleQueueStream)
+	mux.HandleFunc("GET /api/builds/{id}/log", bc.handleBuildLog)
+	mux.HandleFunc("GET /api/builds/{id}/provenance", bc.handleGetBuildProvenance)
+	mux.HandleFunc("GET /api/builds/{id}/scheduling", bc.handleGetScheduling)
+	mux.HandleFunc("GET /api/builds/{id}/children", bc.handleGetBuildChildren)
+	mux.HandleFunc("POST /api/builds/{id}/pause", bc.handlePauseBuild)
+	mux.HandleFunc("POST /api/builds/{id}/resume", bc.handleResumeBuild)
+	mux.HandleFunc("POST /api/builds/{id}/replay", bc.handleReplayBuild)
+	mux.HandleFunc("POST /api/builds/{id}/annotations", bc.handleAnnotateBuild)
+	mux.HandleFunc("POST /api/pipelines", bc.handleSubmitPipeline)
+	mux.HandleFunc("GET /api/pipelines/{id}", bc.handleGetPipeline)
+	mux.HandleFunc("POST /api/bisect", bc.handleSubmitBisect)
+	mux.HandleFunc("GET /api/bisect/{id}", bc.handleGetBisect)
+	mux.HandleFunc("POST /api/uploads", bc.handleUploadProject)
+	mux.HandleFunc("POST /api/tasks", bc.handleSubmitTask)
+	mux.HandleFunc("GET /api/builds/{id}/artifacts", bc.handleListArtifacts)
+	mux.HandleFunc("GET /api/builds/{id}/artifacts/{path...}", bc.handleGetArtifact)
+	mux.HandleFunc("DELETE /api/builds/{id}/artifacts", bc.handleDeleteArtifacts)
+	mux.HandleFunc("DELETE /api/builds/{id}/artifacts/{path...}", bc.handleDeleteArtifacts)
+	mux.HandleFunc("GET /api/chunks/{hash}", bc.handleGetChunk)
+	mux.HandleFunc("GET /api/workers", bc.handleGetWorkers)
+	mux.HandleFunc("GET /api/workers/release", bc.handleGetWorkerRelease)
+	mux.HandleFunc("POST /api/workers/{id}/quarantine", bc.handleQuarantineWorker)
+	mux.HandleFunc("DELETE /api/workers/{id}/quarantine", bc.handleReleaseWorker)
+	mux.HandleFunc("POST /api/rpc", bc.handleWorkerRPC)
+	mux.HandleFunc("GET /api/rpc/calls", bc.handlePollWorkerCalls)
+	mux.HandleFunc("POST /api/rpc/calls", bc.handleWorkerReply)
+	mux.HandleFunc("GET /api/pools", bc.handleListPools)
+	mux.HandleFunc("GET /api/keys/signing", bc.handleSigningKeys)
+	mux.HandleFunc("GET /api/health", bc.handleHealthCheck)
+	mux.HandleFunc("GET /api/system/health", bc.handleSystemHealth)
+	mux.HandleFunc("GET /api/stats", bc.handleGetStats)
+	mux.HandleFunc("GET /api/status", bc.handleFederatedStatus)
+	mux.HandleFunc("GET /api/secrets", bc.handleListSecrets)
+	mux.HandleFunc("GET /api/analytics/durations", bc.analyticsHandler(func(records []buildstore.Record, query analytics.Query) any {
+		return analytics.DurationTrends(records, query)
+	}))
+	mux.HandleFunc("GET /api/analytics/failures", bc.analyticsHandler(func(records []buildstore.Record, query analytics.Query) any {
+		return analytics.FailureRates(records, query)
+	}))
+	mux.HandleFunc("GET /api/analytics/busiest-hours", bc.analyticsHandler(func(records []buildstore.Record, query analytics.Query) any {
+		return analytics.BusiestHours(records)
+	}))
+	mux.HandleFunc("GET /api/analytics/slowest-tasks", bc.analyticsHandler(func(records []buildstore.Record, query analytics.Query) any {
+		return analytics.SlowestTasks(records, query)
+	}))
+	mux.HandleFunc("GET /api/usage", bc.handleUsage)
+	mux.HandleFunc("GET /api/audit", bc.requireAuthorization(authz.ActionAuditRead, bc.auditLog.Handler()))
+	mux.HandleFunc("GET /api/tracing/check", bc.tracer.Handler())
+	mux.Handle("GET /metrics", promhttp.Handler())
+	mux.HandleFunc("GET /api/openapi.json", coordinatorOpenAPI().Handler())
+
+	// Fault injection, only when enabled for resilience testing
+	if bc.chaos != nil {
+		chaosHandler := bc.chaos.Handler(func(r *http.Request, config chaos.Config) {
+			data, _ := json.Marshal(config)
+			bc.auditLog.RecordRequest(r, audit.ActionChaosConfigured, "chaos", map[string]string{"config": string(data)})
+		})
+		mux.HandleFunc("GET /api/chaos", chaosHandler)
+		mux.HandleFunc("PUT /api/chaos", bc.requireAuthorization(authz.ActionChaosConfigure, chaosHandler))
+	}
 
-	bc.httpServer = &http.Server{
-		Addr:    fmt.Sprintf(":%d", port),
-		Handler: mux,
+	// API keys of non-interactive clients, only when authentication is
+	// enabled
+	if authService != nil {
+		authService.SetAPIKeys(bc.apiKeys)
+		mux.HandleFunc("POST /api/keys", bc.requireAdmin(authService, bc.handleIssueAPIKey))
+		mux.HandleFunc("GET /api/keys", bc.requireAdmin(authService, bc.handleListAPIKeys))
+		mux.HandleFunc("DELETE /api/keys/{id}", bc.requireAdmin(authService, bc.handleRevokeAPIKey))
 	}
 
-	log.Printf("HTTP server listening on port %d", port)
-	return bc.httpServer.ListenAndServe()
+	// Single sign-on of the dashboard and CLI, only when an identity
+	// provider is configured
+	if authService != nil && bc.login != nil {
+		mux.HandleFunc("GET /auth/login", bc.handleLogin)
+		mux.HandleFunc("GET /auth/callback", bc.handleLoginCallback(authService))
+		mux.HandleFunc("GET /api/auth/oidc/config", bc.handleOIDCConfig)
+		mux.HandleFunc("POST /api/auth/oidc/token", bc.handleOIDCToken(authService))
+	}
+
+	// Dashboard
+	mux.Handle("GET /{$}", dashboardHandler())
+
+	return middleware.Chain(mux,
+		middleware.RequestID,
+		middleware.Tracing(bc.tracer, mux),
+		middleware.Logging,
+		middleware.Recovery,
+		middleware.Metrics(httpRequestsTotal, mux),
+		bc.rateLimiter.Middleware,
+		middleware.Auth(authService, "/", "/api/health", "/api/system/health", "/metrics", "/api/keys/signing",
+			"/auth/login", "/auth/callback", "/api/auth/oidc/config", "/api/auth/oidc/token"),
+		keyScopes(mux),
+	)
 }
 
 // StartRPCServer starts the RPC server
@@ -296,130 +1378,326 @@ func (bc *BuildCoordinator) StartRPCServer(port int) error {
 		return err
 	}
 
-	bc.rpcServer = rpc.NewServer()
-	err = bc.rpcServer.RegisterName("BuildCoordinator", bc)
-	if err != nil {
-		log.Printf("RPC registration failed: %v", err)
-		return err
-	}
-
+	bc.rpcListener = listener
 	log.Printf("RPC server listening on port %d", port)
 	go bc.rpcServer.Accept(listener)
 
 	return nil
 }
 
-// BuildQueueProcessor handles the build queue
+// BuildQueueProcessor handles the build queue of every pool
 func (bc *BuildCoordinator) BuildQueueProcessor() {
-	for {
-		select {
-		case request := <-bc.buildQueue:
-			go bc.processBuild(request)
-		case <-bc.shutdown:
-			return
+	for pool, queue := range bc.queues {
+		if pool != pools.DefaultPool {
+			go bc.processQueue(pool, queue)
 		}
 	}
+	bc.processQueue(pools.DefaultPool, bc.buildQueue)
 }
 
-// processBuild assigns a build to an available worker
-func (bc *BuildCoordinator) processBuild(request BuildRequest) {
+// startBuild assigns a build to the best scoring worker of its pool with a
+// free slot, and records the scores of the workers considered. It returns
+// false if the pool has no free slot, and true once the build started or if
+// it was cancelled while queued.
+func (bc *BuildCoordinator) startBuild(request BuildRequest) bool {
+	pool := pools.Normalize(request.Pool)
+	if bc.isBuildCancelled(request.RequestID) {
+		log.Printf("Skipping cancelled build %s", request.RequestID)
+		metrics.SchedulerDecisions.WithLabelValues(pool, metrics.DecisionCancelled).Inc()
+		return true
+	}
+	if bc.isBuildFailed(request.RequestID) {
+		log.Printf("Skipping build %s, a dependency did not complete", request.RequestID)
+		return true
+	}
+
 	bc.mutex.RLock()
-	availableWorkers := bc.getAvailableWorkers()
+	workers := bc.getPoolWorkers(pool)
+	if request.PinnedWorkerID != "" {
+		workers = slices.DeleteFunc(workers, func(worker *Worker) bool { return worker.ID != request.PinnedWorkerID })
+	}
 	bc.mutex.RUnlock()
+	// Predicting the duration may ask the ML service, so it is done unlocked
+	avoidSpot := bc.avoidsSpotWorkers(request, workers)
 
-	if len(availableWorkers) == 0 {
-		// Re-queue if no workers available
-		time.Sleep(5 * time.Second)
-		select {
-		case bc.buildQueue <- request:
-			return
-		case <-bc.shutdown:
-			return
-		default:
-			// Mark as failed if queue is full
-			bc.markBuildFailed(request.RequestID, "no workers available")
-			return
+	bc.mutex.RLock()
+	availableWorkers, candidates := bc.rankWorkers(workers, request, avoidSpot)
+	if requirement := deviceRequirement(request); requirement != nil {
+		for i, worker := range availableWorkers {
+			if !worker.hasFreeDevices(*requirement) {
+				candidates[i].Skipped = "no suitable device"
+			}
 		}
 	}
+	bc.mutex.RUnlock()
+
+	attempt := SchedulingAttempt{
+		Time:       time.Now(),
+		Requeues:   request.Requeues,
+		Outcome:    ScheduleNoCapacity,
+		Candidates: candidates,
+	}
+	defer func() { bc.recordSchedulingAttempt(request.RequestID, attempt) }()
 
-	// Assign to first available worker
-	worker := availableWorkers[0]
-	bc.assignBuildToWorker(worker, request)
+	// Another build may have claimed the last slot of a worker since the
+	// list was taken
+	for i, worker := range availableWorkers {
+		if candidates[i].Skipped != "" {
+			continue
+		}
+		if bc.assignBuildToWorker(worker, request) {
+			metrics.SchedulerDecisions.WithLabelValues(pool, metrics.DecisionAssigned).Inc()
+			observeQueueWait(pool, request)
+			attempt.Outcome, attempt.WorkerID = ScheduleAssigned, worker.ID
+			candidates[i].Chosen = true
+			return true
+		}
+		candidates[i].Skipped = "no free slot"
+	}
+	return false
 }
 
-// getAvailableWorkers returns idle workers
+// observeQueueWait records how long an assigned build waited in the queue
+func observeQueueWait(pool string, request BuildRequest) {
+	if request.QueuedAt.IsZero() {
+		return
+	}
+	priority := metrics.PriorityNormal
+	if request.Critical {
+		priority = metrics.PriorityCritical
+	}
+	metrics.QueueWait.WithLabelValues(pool, priority, request.Tenant).Observe(time.Since(request.QueuedAt).Seconds())
+}
+
+// getAvailableWorkers returns workers with a free build slot, least loaded first
 func (bc *BuildCoordinator) getAvailableWorkers() []*Worker {
 	var available []*Worker
 	for _, worker := range bc.workers {
-		if worker.Status == "idle" && time.Since(worker.LastPing) < 30*time.Second {
+		if worker.availableSlots() > 0 && time.Since(worker.LastPing) < 30*time.Second {
 			available = append(available, worker)
 		}
 	}
+
+	sort.SliceStable(available, func(i, j int) bool {
+		return workerLoad(available[i]) < workerLoad(available[j])
+	})
 	return available
 }
 
-// assignBuildToWorker assigns a build to a specific worker
-func (bc *BuildCoordinator) assignBuildToWorker(worker *Worker, request BuildRequest) {
-	worker.Status = "busy"
+// workerLoad scores how loaded a worker is from its reported telemetry.
+// Workers without recent telemetry get a neutral score.
+func workerLoad(worker *Worker) float64 {
+	metrics := worker.Metrics
+	if metrics.LastTelemetry.IsZero() || time.Since(metrics.LastTelemetry) > 2*time.Minute {
+		return 0.5
+	}
+
+	return 0.6*metrics.CPUUsage + 0.3*metrics.MemoryUsage + 0.1*metrics.DiskUsage
+}
+
+// assignBuildToWorker claims a build slot on a worker, and the devices the
+// build needs, and starts the build. It returns false if the worker has no
+// free slot or devices.
+func (bc *BuildCoordinator) assignBuildToWorker(worker *Worker, request BuildRequest) bool {
+	bc.mutex.Lock()
+	if worker.availableSlots() == 0 || !worker.acquireDevices(&request) {
+		bc.mutex.Unlock()
+		return false
+	}
+
+	worker.ActiveBuilds++
+	worker.updateStatus()
 	worker.Builds = append(worker.Builds, request)
+	worker.track(request)
+
+	if progress, exists := bc.progress[request.RequestID]; exists {
+		if progress.Throttled {
+			progress.Throttled = false
+			progress.Message = ""
+		}
+		progress.Status = BuildStatusRunning
+		progress.WorkerID = worker.ID
+		progress.StartedAt = time.Now()
+		progress.UpdatedAt = progress.StartedAt
+		bc.notifyProgress(request.RequestID)
+	}
+	bc.publish(events.Event{Type: events.BuildScheduled, BuildID: request.RequestID, WorkerID: worker.ID})
+	bc.mutex.Unlock()
 
 	// Execute build via RPC
 	go bc.executeBuildOnWorker(worker, request)
+	return true
+}
+
+// releaseBuildSlot frees the slot held by a finished build
+func (bc *BuildCoordinator) releaseBuildSlot(worker *Worker) {
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+
+	if worker.ActiveBuilds > 0 {
+		worker.ActiveBuilds--
+	}
+	worker.updateStatus()
+	worker.LastPing = time.Now()
 }
 
 // executeBuildOnWorker executes a build on a remote worker
 func (bc *BuildCoordinator) executeBuildOnWorker(worker *Worker, request BuildRequest) {
-	defer func() {
-		worker.Status = "idle"
-		worker.LastPing = time.Now()
-	}()
+	defer bc.releaseBuildSlot(worker)
+	defer bc.releaseDevices(worker, request.RequestID)
+	done := make(chan struct{})
+	defer close(done)
+	go bc.watchForSlowdown(worker, request, done)
+	bc.chaos.DelayRPC("WorkerService.Build")
+
+	// The result of a build recovered after its worker was evicted is
+	// ignored
+	fail := func(failure *protocol.BuildError) {
+		if !bc.untrackBuild(worker, request.RequestID) {
+			bc.buildFailed(request.RequestID, worker.ID, failure)
+		}
+	}
+
+	// Secrets are read as late as possible and only travel with the request
+	// sent to the worker
+	secretEnv, err := bc.secretStore.Resolve(request.Secrets)
+	if err != nil {
+		fail(protocol.NewBuildError(protocol.ErrorCompile, "%v", err))
+		return
+	}
+	request.SecretEnv = secretEnv
+	if request.Credentials != "" {
+		credentials, err := bc.secretStore.Value(request.Credentials)
+		if err != nil {
+			fail(protocol.NewBuildError(protocol.ErrorCompile, "%v", err))
+			return
+		}
+		request.GitCredentials = credentials
+	}
+	if projectHooks := bc.buildHooks.For(request.ProjectPath, request.RepoURL); !projectHooks.Empty() {
+		var requestHooks hooks.Hooks
+		if request.Hooks != nil {
+			requestHooks = *request.Hooks
+		}
+		wrapped := projectHooks.Around(requestHooks)
+		request.Hooks = &wrapped
+	}
 
 	// Connect to worker RPC server
-	client, err := rpc.Dial("tcp", fmt.Sprintf("%s:%d", worker.Host, worker.Port))
+	client, err := bc.dialWorker(worker)
 	if err != nil {
-		bc.markBuildFailed(request.RequestID, fmt.Sprintf("failed to connect to worker: %v", err))
+		fail(protocol.NewBuildError(protocol.ErrorInfra, "failed to connect to worker: %v", err))
 		return
 	}
 	defer client.Close()
+	if !bc.attachClient(worker, request.RequestID, client) {
+		return
+	}
+	bc.publishStarted(request.RequestID, worker.ID)
+	log.Printf("Build %s sent to worker %s request_id=%s", request.RequestID, worker.ID, request.CorrelationID)
 
 	// Execute build
 	var response string
 	err = client.Call("WorkerService.Build", request, &response)
 	if err != nil {
-		bc.markBuildFailed(request.RequestID, fmt.Sprintf("build failed: %v", err))
+		failure := protocol.ParseBuildError(err)
+		message := secrets.Mask("build failed: "+failure.Message, secretEnv)
+		if request.GitCredentials != "" {
+			message = strings.ReplaceAll(message, request.GitCredentials, secrets.MaskedValue)
+		}
+		log.Printf("Build %s failed on worker %s request_id=%s: %s", request.RequestID, worker.ID, request.CorrelationID, message)
+		fail(&protocol.BuildError{Code: failure.Code, Message: message})
 		return
 	}
 
 	// Mark as successful
-	bc.markBuildCompleted(request.RequestID, worker.ID)
+	if !bc.untrackBuild(worker, request.RequestID) {
+		bc.buildSucceeded(request.RequestID, worker.ID)
+	}
 }
 
 // markBuildCompleted marks a build as completed successfully
 func (bc *BuildCoordinator) markBuildCompleted(buildID, workerID string) {
 	bc.mutex.Lock()
 	defer bc.mutex.Unlock()
+	bc.completeBuild(buildID, workerID)
+}
 
+// completeBuild marks a build as completed successfully. Must be called with
+// the mutex held.
+func (bc *BuildCoordinator) completeBuild(buildID, workerID string) {
 	if response, exists := bc.builds[buildID]; exists {
 		response.Success = true
 		response.WorkerID = workerID
 		response.Timestamp = time.Now()
+		response.BuildDuration = bc.elapsed(buildID)
+	}
+
+	if progress, exists := bc.progress[buildID]; exists {
+		progress.Status = BuildStatusCompleted
+		progress.Progress = 100
+		progress.UpdatedAt = time.Now()
+		bc.notifyProgress(buildID)
+	}
+	bc.storeResult(buildID, time.Now())
+	bc.recordBuild(buildID)
+
+	// Builds forwarded to a peer uploaded their artifacts there
+	if request := bc.requests[buildID]; request.Publish != nil {
+		if _, forwarded := bc.forwarded[buildID]; !forwarded {
+			go bc.publishArtifacts(buildID, *request.Publish)
+		}
 	}
 }
 
 // markBuildFailed marks a build as failed
-func (bc *BuildCoordinator) markBuildFailed(buildID, errorMsg string) {
+func (bc *BuildCoordinator) markBuildFailed(buildID string, code protocol.ErrorCode, errorMsg string) {
 	bc.mutex.Lock()
 	defer bc.mutex.Unlock()
+	bc.failBuild(buildID, code, errorMsg)
+}
+
+// failBuild marks a build as failed with the class of its failure, if
+// known. Must be called with the mutex held.
+func (bc *BuildCoordinator) failBuild(buildID string, code protocol.ErrorCode, errorMsg string) {
+	// A cancelled build keeps its cancellation reason
+	if progress, exists := bc.progress[buildID]; exists {
+		if progress.Status == BuildStatusCancelled {
+			return
+		}
+		progress.Status = BuildStatusFailed
+		progress.Message = errorMsg
+		progress.UpdatedAt = time.Now()
+		bc.notifyProgress(buildID)
+	}
 
 	if response, exists := bc.builds[buildID]; exists {
 		response.Success = false
 		response.ErrorMessage = errorMsg
+		response.ErrorCode = code
 		response.Timestamp = time.Now()
+		response.BuildDuration = bc.elapsed(buildID)
+	}
+	bc.recordBuild(buildID)
+}
+
+// elapsed returns how long a build has been running on its worker, or zero
+// if it was never assigned. Must be called with the mutex held.
+func (bc *BuildCoordinator) elapsed(buildID string) time.Duration {
+	progress, exists := bc.progress[buildID]
+	if !exists || progress.StartedAt.IsZero() {
+		return 0
 	}
+	return time.Since(progress.StartedAt)
 }
 
-// Shutdown gracefully shuts down the coordinator
+// Shutdown gracefully shuts down the coordinator. Submissions are refused
+// while the running builds get up to the drain timeout to finish; the
+// builds left are then saved to be queued again on the next start.
 func (bc *BuildCoordinator) Shutdown() {
+	if running := bc.Drain(bc.drain.Timeout); running > 0 {
+		log.Printf("Shutting down with %d builds still running", running)
+	}
 	close(bc.shutdown)
 
 	if bc.httpServer != nil {
@@ -428,37 +1706,222 @@ func (bc *BuildCoordinator) Shutdown() {
 		bc.httpServer.Shutdown(ctx)
 	}
 
-	if bc.rpcServer != nil {
-		// RPC server doesn't have explicit close method in standard library
-		// The listener will be closed when the process exits
-		log.Println("RPC server shutdown requested")
+	// Connections already accepted are served until the process exits
+	if bc.rpcListener != nil {
+		bc.rpcListener.Close()
+	}
+
+	if saved, err := bc.saveQueue(); err != nil {
+		log.Printf("Failed to save the build queue, losing its builds: %v", err)
+	} else if saved > 0 {
+		log.Printf("Saved %d unfinished builds to %s", saved, bc.drain.QueueFile)
+	}
+
+	if err := bc.events.Close(); err != nil {
+		log.Printf("Failed to close the event bus: %v", err)
+	}
+	if bc.statuses != nil {
+		bc.statuses.Close()
 	}
 }
 
+// SubmitBuildResponse is returned when a build request is accepted
+type SubmitBuildResponse struct {
+	BuildID    string `json:"build_id"`
+	Status     string `json:"status"`
+	CachedFrom string `json:"cached_from,omitempty"`
+	// Children are the builds a matrix request was fanned out into
+	Children []string `json:"children,omitempty"`
+}
+
+// HealthStatus is the coordinator health check response
+type HealthStatus struct {
+	Status string `json:"status"`
+}
+
 // HTTP Handlers
 func (bc *BuildCoordinator) handleBuildRequest(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "POST" {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
-
 	var request BuildRequest
 	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
 		http.Error(w, "Invalid request", http.StatusBadRequest)
 		return
 	}
+	bc.submitBuildRequest(w, r, request.withoutReplay())
+}
+
+// submitBuildRequest validates, authorizes and queues a build requested over
+// the API and answers with its ID
+func (bc *BuildCoordinator) submitBuildRequest(w http.ResponseWriter, r *http.Request, request BuildRequest) {
+	if bc.rejectWhileDraining(w) {
+		return
+	}
+	request.CorrelationID = middleware.RequestIDFromContext(r.Context())
+	// Shards are only selected by the coordinator, or replayed
+	if request.ReplayOf == "" {
+		request.Shard = nil
+	}
+	switch {
+	case request.Matrix != nil && request.Sharding != nil:
+		http.Error(w, "a build cannot have both a matrix and test sharding", http.StatusBadRequest)
+		return
+	case request.Matrix != nil:
+		bc.handleMatrixRequest(w, r, request)
+		return
+	case request.Sharding != nil:
+		bc.handleShardedRequest(w, r, request)
+		return
+	}
+
+	// Reject unsafe project paths, disallowed tasks and oversized options
+	// before the build is queued
+	if err := bc.validateBuildRequest(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Reject malformed versions now rather than once a worker picks the build up
+	if request.GradleVersion != "" && !gradledist.ValidVersion(request.GradleVersion) {
+		http.Error(w, fmt.Sprintf("invalid gradle version %q", request.GradleVersion), http.StatusBadRequest)
+		return
+	}
+	if !bc.authorize(w, r, authz.ActionBuildSubmit, buildResource(request)) {
+		return
+	}
+	if request.Publish != nil && !bc.authorize(w, r, authz.ActionArtifactsPublish, buildResource(request)) {
+		return
+	}
+	if request.Hooks != nil && !request.Hooks.Empty() && !bc.authorize(w, r, authz.ActionBuildHooks, buildResource(request)) {
+		return
+	}
+
+	// Reject builds of a commit that keeps failing instead of running them
+	// again
+	if err := bc.admitBuild(request); err != nil {
+		log.Printf("Rejected build of %s at %s: %v", request.RepoURL, request.Ref, err)
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
 
+	request.Tenant = bc.rateLimiter.Tenant(r)
+	request.FederatedFrom = r.Header.Get(federation.ForwardedHeader)
 	buildID, err := bc.SubmitBuild(request)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	json.NewEncoder(w).Encode(map[string]string{"build_id": buildID})
+	details := map[string]string{
+		"project_path": request.ProjectPath,
+		"task_name":    request.TaskName,
+		"tenant":       request.Tenant,
+	}
+	if len(request.Secrets) > 0 {
+		details["secrets"] = strings.Join(request.Secrets, ",")
+	}
+	if request.RepoURL != "" {
+		details["repo_url"] = request.RepoURL
+		details["ref"] = request.Ref
+	}
+	if request.FederatedFrom != "" {
+		details["federated_from"] = request.FederatedFrom
+	}
+	if request.ReplayOf != "" {
+		details["replay_of"] = request.ReplayOf
+	}
+
+	submitted := SubmitBuildResponse{BuildID: buildID, Status: BuildStatusQueued}
+	if response, err := bc.GetBuildStatus(buildID); err == nil && response.CachedFrom != "" {
+		submitted.Status = BuildStatusCompleted
+		submitted.CachedFrom = response.CachedFrom
+		details["cached_from"] = response.CachedFrom
+	}
+	bc.auditLog.RecordRequest(r, audit.ActionBuildSubmitted, buildID, details)
+	tracing.SpanFromContext(r.Context()).SetAttribute("build.id", buildID)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(submitted)
+}
+
+// validateBuildRequest checks a build request against the build policy and
+// normalizes its project path. Builds of a repository have a project
+// directory relative to the checkout instead of a path on the workers.
+func (bc *BuildCoordinator) validateBuildRequest(request *BuildRequest) error {
+	if request.Type != "" {
+		return fmt.Errorf("builds of type %q are only scheduled by the coordinator", request.Type)
+	}
+	if err := pools.ValidateLabels(request.Labels); err != nil {
+		return err
+	}
+	if err := buildstore.ValidateTags(request.Tags); err != nil {
+		return err
+	}
+	if err := validateOutputs(request.Outputs); err != nil {
+		return err
+	}
+	if err := bc.validatePublishRequest(request.Publish); err != nil {
+		return err
+	}
+	if request.Hooks != nil {
+		if err := request.Hooks.Validate(); err != nil {
+			return err
+		}
+	}
+	if request.Devices != nil {
+		if err := request.Devices.Validate(); err != nil {
+			return err
+		}
+	}
+	if err := bc.validateDependencies(*request); err != nil {
+		return err
+	}
+
+	request.Upload = nil
+	if request.RepoURL == "" && (request.Ref != "" || request.Credentials != "") {
+		return fmt.Errorf("ref and credentials require repo_url")
+	}
+	switch {
+	case request.UploadID != "" && request.RepoURL != "":
+		return fmt.Errorf("a build cannot have both repo_url and upload_id")
+	case request.UploadID != "":
+		manifest, err := bc.uploadManifest(request.UploadID)
+		if err != nil {
+			return err
+		}
+		request.Upload = manifest
+	case request.RepoURL == "":
+		projectPath, err := bc.buildPolicy.ValidateBuild(request.ProjectPath, request.TaskName, request.BuildOptions)
+		if err != nil {
+			return err
+		}
+		request.ProjectPath = projectPath
+		return bc.secretStore.Check(request.Secrets)
+	default:
+		if err := gitsource.ValidateSource(request.RepoURL, request.Ref); err != nil {
+			return err
+		}
+	}
+	if err := gitsource.ValidateSubdirectory(request.ProjectPath); err != nil {
+		return fmt.Errorf("invalid project path: %v", err)
+	}
+	if request.ProjectPath != "" {
+		request.ProjectPath = filepath.Clean(request.ProjectPath)
+	}
+	if err := bc.buildPolicy.ValidateTaskName(request.TaskName); err != nil {
+		return fmt.Errorf("invalid task name: %v", err)
+	}
+	if err := bc.buildPolicy.ValidateBuildOptions(request.BuildOptions); err != nil {
+		return fmt.Errorf("invalid build options: %v", err)
+	}
+	if request.Credentials != "" {
+		if err := bc.secretStore.Check([]string{request.Credentials}); err != nil {
+			return fmt.Errorf("invalid credentials: %v", err)
+		}
+	}
+	return bc.secretStore.Check(request.Secrets)
 }
 
 func (bc *BuildCoordinator) handleGetBuild(w http.ResponseWriter, r *http.Request) {
-	buildID := r.URL.Path[len("/api/builds/"):]
+	buildID := r.PathValue("id")
 
 	response, err := bc.GetBuildStatus(buildID)
 	if err != nil {
@@ -466,7 +1929,12 @@ func (bc *BuildCoordinator) handleGetBuild(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	json.NewEncoder(w).Encode(response)
+	status := BuildStatusResponse{BuildResponse: *response, Tags: bc.buildTags(buildID)}
+	if progress, err := bc.GetBuildProgress(buildID); err == nil {
+		status.Progress = *progress
+	}
+
+	bc.signer.WriteJSON(w, "application/json", status)
 }
 
 func (bc *BuildCoordinator) handleGetWorkers(w http.ResponseWriter, r *http.Request) {
@@ -474,9 +1942,24 @@ func (bc *BuildCoordinator) handleGetWorkers(w http.ResponseWriter, r *http.Requ
 	json.NewEncoder(w).Encode(workers)
 }
 
+// handleGetWorkerRelease describes the worker release workers update to
+func (bc *BuildCoordinator) handleGetWorkerRelease(w http.ResponseWriter, r *http.Request) {
+	var reply GetWorkerReleaseReply
+	bc.GetWorkerRelease(&GetWorkerReleaseArgs{}, &reply)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reply)
+}
+
+// handleListSecrets lists the secrets builds may request, without their values
+func (bc *BuildCoordinator) handleListSecrets(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(bc.secretStore.List())
+}
+
 func (bc *BuildCoordinator) handleHealthCheck(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"status": "healthy"})
+	json.NewEncoder(w).Encode(HealthStatus{Status: "healthy"})
 }
 
 // Utility functions
@@ -484,28 +1967,168 @@ func generateBuildID() string {
 	return fmt.Sprintf("build-%d", time.Now().UnixNano())
 }
 
-// Main coordinator application entry point
-func coordinatorMain() {
+// coordinatorService runs the coordinator as an app.Service
+type coordinatorService struct {
+	coordinator *BuildCoordinator
+}
+
+func (s *coordinatorService) Name() string {
+	return "coordinator"
+}
+
+// Init loads the configuration of the coordinator from the environment and
+// opens its stores
+func (s *coordinatorService) Init(ctx context.Context) error {
 	coordinator := NewBuildCoordinator(10)
+	s.coordinator = coordinator
+	coordinator.auditLog = audit.OpenFromEnv()
+	coordinator.apiKeys = apikeys.OpenFromEnv()
+	coordinator.signer = signing.LoadFromEnv()
+	coordinator.buildStore = buildstore.OpenFromEnv()
+	coordinator.registry = registry.OpenFromEnv()
+	coordinator.chaos = chaos.NewInjectorFromEnv()
+	coordinator.secretStore = secrets.LoadFromEnv()
+	coordinator.minWorkerProtocol = protocol.MinWorkerVersionFromEnv()
+	coordinator.workerRelease = protocol.NewPublisherFromEnv()
+	coordinator.resultTTL = ResultCacheTTLFromEnv()
+	coordinator.speculation = loadSpeculationConfig()
+	coordinator.recovery = loadRecoveryConfig()
+	coordinator.spot = loadSpotConfig()
+	coordinator.concurrency = loadConcurrencyConfig()
+	coordinator.quarantine = loadQuarantineConfig()
+	coordinator.maven = loadPublishConfig()
+	coordinator.checkouts = gitsource.NewCheckoutsFromEnv()
+	coordinator.artifacts = transfer.OpenFromEnv()
+	coordinator.buildLogs = buildlogs.OpenFromEnv()
+	coordinator.systemHealth = loadSystemHealthConfig()
+	coordinator.drain = loadDrainConfig()
+	router, err := pools.RouterFromEnv()
+	if err != nil {
+		return fmt.Errorf("invalid build routing rules: %v", err)
+	}
+	if coordinator.buildHooks, err = hooks.RulesFromEnv(); err != nil {
+		return fmt.Errorf("invalid build hooks: %v", err)
+	}
+	if coordinator.retention, err = retention.FromEnv(ArtifactRetentionFromEnv()); err != nil {
+		return fmt.Errorf("invalid artifact retention policies: %v", err)
+	}
+	coordinator.setRouter(router)
+	if coordinator.weights, err = fairshare.WeightsFromEnv(); err != nil {
+		return fmt.Errorf("invalid fair share weights: %v", err)
+	}
+	if coordinator.federation, err = federation.ConfigFromEnv(); err != nil {
+		return fmt.Errorf("invalid federation configuration: %v", err)
+	}
+	coordinator.peers = federation.NewClient(coordinator.federation.Name)
+	if coordinator.events, err = events.FromEnv("coordinator"); err != nil {
+		return fmt.Errorf("invalid event bus configuration: %v", err)
+	}
+	if coordinator.tracer, err = tracing.FromEnv("coordinator"); err != nil {
+		return fmt.Errorf("invalid tracing configuration: %v", err)
+	}
+	if coordinator.authorizer, err = authz.FromEnv(); err != nil {
+		return fmt.Errorf("invalid authorization configuration: %v", err)
+	}
+	if coordinator.attestation, err = attestation.LoadPolicyFromEnv(); err != nil {
+		return fmt.Errorf("invalid worker attestation policy: %v", err)
+	}
+	if coordinator.ml, err = mlrpc.ClientFromEnv(localPredictor{coordinator}); err != nil {
+		return fmt.Errorf("invalid ML service configuration: %v", err)
+	}
+	coordinator.admission = loadAdmissionConfig()
+	if coordinator.admission.Enabled() && coordinator.ml == nil {
+		return fmt.Errorf("ADMISSION_FAILURE_RISK_THRESHOLD requires the ML service at ML_RPC_ADDR")
+	}
+	if coordinator.cacheSeed, err = loadCacheSeedConfig(); err != nil {
+		return fmt.Errorf("invalid cache seeding configuration: %v", err)
+	}
+	if coordinator.cacheSeed.Enabled() && coordinator.ml == nil {
+		return fmt.Errorf("CACHE_SEED_BUILDS requires the ML service at ML_RPC_ADDR")
+	}
+	if coordinator.statusReports, err = loadStatusReportConfig(); err != nil {
+		return fmt.Errorf("invalid SCM status reporting configuration: %v", err)
+	}
+	if coordinator.statusReports.Enabled() {
+		if coordinator.statuses, err = scmstatus.NewDispatcher(coordinator.statusReports.Reporters, coordinator.secretStore.Value); err != nil {
+			return fmt.Errorf("invalid SCM status reporting configuration: %v", err)
+		}
+	}
+	loginConfig, err := oidc.ConfigFromEnv()
+	if err != nil {
+		return fmt.Errorf("invalid OIDC configuration: %v", err)
+	}
+	if loginConfig != nil {
+		// Tokens issued at login must stay valid across restarts
+		if os.Getenv("AUTH_JWT_SECRET") == "" {
+			return fmt.Errorf("OIDC login requires AUTH_JWT_SECRET")
+		}
+		coordinator.login = newOIDCLogin(oidc.NewProvider(*loginConfig))
+	}
+	return nil
+}
+
+func (s *coordinatorService) Collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		s.coordinator.rateLimiter,
+		httpRequestsTotal,
+		coordinatorCollector{s.coordinator},
+		metrics.SchedulerDecisions,
+		metrics.QueueWait,
+		metrics.BuildsFinished,
+		metrics.BuildFailures,
+		metrics.BuildCacheHits,
+		metrics.ResultCacheLookups,
+		metrics.SpeculativeExecutions,
+		metrics.FederatedBuilds,
+		metrics.StaleBuilds,
+		metrics.SCMStatusReports,
+		metrics.TransferBytes,
+		metrics.ComputeSeconds,
+		metrics.CacheStorageBytes,
+		metrics.ArtifactStorage,
+	}
+}
 
+// Start queues the builds left by the last shutdown, starts the background
+// work of the coordinator and its HTTP and RPC servers
+func (s *coordinatorService) Start(ctx context.Context) error {
 	// Start build queue processor
-	go coordinator.BuildQueueProcessor()
+	go s.coordinator.BuildQueueProcessor()
 
-	// Start servers in goroutines
-	go func() {
-		if err := coordinator.StartHTTPServer(8080); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("HTTP server error: %v", err)
-		}
-	}()
+	// Queue the builds left unfinished by the last shutdown
+	if err := s.coordinator.restoreQueue(); err != nil {
+		log.Printf("Failed to restore the build queue: %v", err)
+	}
 
-	go func() {
-		if err := coordinator.StartRPCServer(8081); err != nil {
-			log.Fatalf("RPC server error: %v", err)
-		}
-	}()
+	// Reconnect to the workers registered before a restart
+	go s.coordinator.reconcileWorkers()
+
+	// Evict workers that stop sending heartbeats
+	go s.coordinator.monitorWorkers()
+
+	// Remove the artifacts the retention policies no longer keep
+	go s.coordinator.pruneArtifacts()
+	go s.coordinator.pruneLogs()
+	go s.coordinator.runBisects()
+	go s.coordinator.runCacheSeeds()
 
-	// Wait for interrupt signal
-	select {}
+	if err := s.coordinator.StartRPCServer(8081); err != nil {
+		return fmt.Errorf("failed to start RPC server: %v", err)
+	}
+	s.coordinator.listen(8080)
+	app.Go(ctx, s.coordinator.httpServer.ListenAndServe)
+	return nil
+}
+
+// Stop drains the coordinator and saves its queue
+func (s *coordinatorService) Stop(ctx context.Context, cause error) error {
+	s.coordinator.Shutdown()
+	return nil
+}
+
+// Main coordinator application entry point
+func coordinatorMain() {
+	app.Main(&coordinatorService{})
 }
 
 // Main function for coordinator
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"distributed-gradle-building/audit"
+	"distributed-gradle-building/authz"
+	"distributed-gradle-building/federation"
+	"distributed-gradle-building/gradledist"
+	"distributed-gradle-building/testshard"
+)
+
+// maxMatrixBuilds is the largest number of builds a matrix may fan out into
+const maxMatrixBuilds = 64
+
+// BuildMatrix fans a build request out into a child build per combination
+// of its values. Empty dimensions keep the value of the request.
+type BuildMatrix struct {
+	Tasks          []string `json:"tasks,omitempty"`
+	GradleVersions []string `json:"gradle_versions,omitempty"`
+	// Options maps build options, such as java_version or flavor, to the
+	// values they take
+	Options map[string][]string `json:"options,omitempty"`
+}
+
+// MatrixBuild is a child build of a matrix and the values it was built with
+type MatrixBuild struct {
+	BuildID  string            `json:"build_id"`
+	Values   map[string]string `json:"values"`
+	Status   string            `json:"status"`
+	WorkerID string            `json:"worker_id,omitempty"`
+}
+
+// BuildGroup is a matrix or sharded build with the aggregate status of its
+// children. The group is queued until a child starts and running until every
+// child finished; it then failed if a child failed, was cancelled if a child
+// was cancelled and completed otherwise.
+type BuildGroup struct {
+	GroupID   string         `json:"group_id"`
+	Status    string         `json:"status"`
+	Matrix    *BuildMatrix   `json:"matrix,omitempty"`
+	Sharding  *TestSharding  `json:"sharding,omitempty"`
+	CreatedAt time.Time      `json:"created_at"`
+	Total     int            `json:"total"`
+	Counts    map[string]int `json:"counts"`
+	Children  []MatrixBuild  `json:"children"`
+	// TestResults and TestClasses combine the test results the children
+	// reported so far
+	TestResults *TestResults            `json:"test_results,omitempty"`
+	TestClasses []testshard.ClassResult `json:"test_classes,omitempty"`
+}
+
+// buildGroup tracks the children of a matrix or sharded build
+type buildGroup struct {
+	matrix    *BuildMatrix
+	sharding  *TestSharding
+	createdAt time.Time
+	children  []string
+	values    []map[string]string
+}
+
+// matrixDimension is a value of a build request the matrix varies
+type matrixDimension struct {
+	name   string
+	values []string
+	apply  func(request *BuildRequest, value string)
+}
+
+// expandMatrix returns the child builds of a matrix request with the values
+// each was built with. The last dimension varies fastest: tasks, then Gradle
+// versions, then build options by name.
+func expandMatrix(request BuildRequest) ([]BuildRequest, []map[string]string, error) {
+	matrix := request.Matrix
+	if matrix == nil {
+		return nil, nil, fmt.Errorf("request has no matrix")
+	}
+	var dimensions []matrixDimension
+	if len(matrix.Tasks) > 0 {
+		dimensions = append(dimensions, matrixDimension{"task_name", matrix.Tasks, func(request *BuildRequest, value string) {
+			request.TaskName = value
+		}})
+	}
+	if len(matrix.GradleVersions) > 0 {
+		dimensions = append(dimensions, matrixDimension{"gradle_version", matrix.GradleVersions, func(request *BuildRequest, value string) {
+			request.GradleVersion = value
+		}})
+	}
+	for _, name := range slices.Sorted(maps.Keys(matrix.Options)) {
+		if len(matrix.Options[name]) == 0 {
+			return nil, nil, fmt.Errorf("matrix option %s has no values", name)
+		}
+		dimensions = append(dimensions, matrixDimension{name, matrix.Options[name], func(request *BuildRequest, value string) {
+			request.BuildOptions[name] = value
+		}})
+	}
+	if len(dimensions) == 0 {
+		return nil, nil, fmt.Errorf("matrix has no values")
+	}
+
+	total := 1
+	for _, dimension := range dimensions {
+		total *= len(dimension.values)
+		if total > maxMatrixBuilds {
+			return nil, nil, fmt.Errorf("matrix has more than %d builds", maxMatrixBuilds)
+		}
+	}
+
+	children := make([]BuildRequest, total)
+	values := make([]map[string]string, total)
+	for i := range children {
+		child := request
+		child.Matrix = nil
+		child.BuildOptions = maps.Clone(request.BuildOptions)
+		if child.BuildOptions == nil && len(matrix.Options) > 0 {
+			child.BuildOptions = make(map[string]string)
+		}
+		values[i] = make(map[string]string, len(dimensions))
+
+		rest := i
+		for d := len(dimensions) - 1; d >= 0; d-- {
+			dimension := dimensions[d]
+			value := dimension.values[rest%len(dimension.values)]
+			rest /= len(dimension.values)
+			dimension.apply(&child, value)
+			values[i][dimension.name] = value
+		}
+		children[i] = child
+	}
+	return children, values, nil
+}
+
+// SubmitMatrix queues the child builds of a matrix request and returns the
+// ID of their group and of the children
+func (bc *BuildCoordinator) SubmitMatrix(request BuildRequest) (string, []string, error) {
+	children, values, err := expandMatrix(request)
+	if err != nil {
+		return "", nil, err
+	}
+
+	matrix := *request.Matrix
+	return bc.submitGroup(&buildGroup{matrix: &matrix, createdAt: time.Now(), values: values}, children, "matrix")
+}
+
+// submitGroup queues the children of a group and returns its ID. Children
+// are IDs of the group numbered from 1. If a child cannot be queued, the
+// children already queued are cancelled.
+func (bc *BuildCoordinator) submitGroup(group *buildGroup, children []BuildRequest, kind string) (string, []string, error) {
+	groupID := generateBuildID()
+	for i, child := range children {
+		child.RequestID = groupID + "-" + strconv.Itoa(i+1)
+		child.GroupID = groupID
+		buildID, err := bc.SubmitBuild(child)
+		if err != nil {
+			for _, queued := range group.children {
+				bc.CancelBuild(&CancelBuildArgs{BuildID: queued, Reason: kind + " build could not be queued"}, &CancelBuildReply{})
+			}
+			return "", nil, fmt.Errorf("failed to queue %s build %d: %v", kind, i+1, err)
+		}
+		group.children = append(group.children, buildID)
+	}
+
+	bc.mutex.Lock()
+	bc.groups[groupID] = group
+	bc.mutex.Unlock()
+	return groupID, group.children, nil
+}
+
+// GetBuildGroup returns a matrix or sharded build with the status of its
+// children
+func (bc *BuildCoordinator) GetBuildGroup(groupID string) (*BuildGroup, error) {
+	bc.mutex.RLock()
+	defer bc.mutex.RUnlock()
+
+	group, exists := bc.groups[groupID]
+	if !exists {
+		return nil, fmt.Errorf("build group %s not found", groupID)
+	}
+
+	result := &BuildGroup{
+		GroupID:   groupID,
+		Matrix:    group.matrix,
+		Sharding:  group.sharding,
+		CreatedAt: group.createdAt,
+		Total:     len(group.children),
+		Counts:    make(map[string]int),
+		Children:  make([]MatrixBuild, 0, len(group.children)),
+	}
+	var tests [][]testshard.ClassResult
+	for i, buildID := range group.children {
+		child := MatrixBuild{BuildID: buildID, Values: group.values[i], Status: BuildStatusQueued}
+		if progress, exists := bc.progress[buildID]; exists {
+			child.Status = progress.Status
+			child.WorkerID = progress.WorkerID
+		}
+		if response, exists := bc.builds[buildID]; exists {
+			if response.WorkerID != "" {
+				child.WorkerID = response.WorkerID
+			}
+			if len(response.TestClasses) > 0 {
+				tests = append(tests, response.TestClasses)
+			}
+		}
+		result.Counts[child.Status]++
+		result.Children = append(result.Children, child)
+	}
+	result.Status = groupStatus(result.Counts, result.Total)
+	if len(tests) > 0 {
+		result.TestClasses = testshard.Merge(tests...)
+		testResults := testResultsOf(result.TestClasses)
+		result.TestResults = &testResults
+	}
+	return result, nil
+}
+
+// groupStatus aggregates the statuses of the children of a build group
+func groupStatus(counts map[string]int, total int) string {
+	switch {
+	case counts[BuildStatusQueued] == total:
+		return BuildStatusQueued
+	case counts[BuildStatusQueued] > 0 || counts[BuildStatusRunning] > 0:
+		return BuildStatusRunning
+	case counts[BuildStatusFailed] > 0:
+		return BuildStatusFailed
+	case counts[BuildStatusCancelled] > 0:
+		return BuildStatusCancelled
+	default:
+		return BuildStatusCompleted
+	}
+}
+
+// handleMatrixRequest validates every child of a matrix request before
+// queueing any of them
+func (bc *BuildCoordinator) handleMatrixRequest(w http.ResponseWriter, r *http.Request, request BuildRequest) {
+	children, values, err := expandMatrix(request)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for i := range children {
+		if err := bc.validateBuildRequest(&children[i]); err != nil {
+			http.Error(w, fmt.Sprintf("matrix build %v: %v", values[i], err), http.StatusBadRequest)
+			return
+		}
+		if version := children[i].GradleVersion; version != "" && !gradledist.ValidVersion(version) {
+			http.Error(w, fmt.Sprintf("matrix build %v: invalid gradle version %q", values[i], version), http.StatusBadRequest)
+			return
+		}
+		if !bc.authorize(w, r, authz.ActionBuildSubmit, buildResource(children[i])) {
+			return
+		}
+	}
+
+	// The matrix does not vary the project path the children normalized
+	request.ProjectPath = children[0].ProjectPath
+	request.Tenant = bc.rateLimiter.Tenant(r)
+	request.FederatedFrom = r.Header.Get(federation.ForwardedHeader)
+	groupID, buildIDs, err := bc.SubmitMatrix(request)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	bc.auditLog.RecordRequest(r, audit.ActionBuildSubmitted, groupID, map[string]string{
+		"project_path": request.ProjectPath,
+		"tenant":       request.Tenant,
+		"matrix":       strconv.Itoa(len(buildIDs)),
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(SubmitBuildResponse{BuildID: groupID, Status: BuildStatusQueued, Children: buildIDs})
+}
+
+func (bc *BuildCoordinator) handleGetBuildChildren(w http.ResponseWriter, r *http.Request) {
+	group, err := bc.GetBuildGroup(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(group)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"distributed-gradle-building/metrics"
+	"distributed-gradle-building/pools"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// coordinatorCollector exports the queue depth of each pool and per-worker
+// gauges from the coordinator's state at scrape time, so unregistered workers
+// disappear from the metrics with them
+type coordinatorCollector struct {
+	bc *BuildCoordinator
+}
+
+// Describe implements prometheus.Collector
+func (c coordinatorCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- metrics.QueueDepthDesc
+	ch <- metrics.WorkerBusyDesc
+	ch <- metrics.WorkerSlotsDesc
+	ch <- metrics.WorkerActiveBuildsDesc
+	ch <- metrics.WorkerCPUUsageDesc
+	ch <- metrics.WorkerMemoryUsageDesc
+}
+
+// Collect implements prometheus.Collector
+func (c coordinatorCollector) Collect(ch chan<- prometheus.Metric) {
+	c.bc.mutex.RLock()
+	defer c.bc.mutex.RUnlock()
+
+	queued := make(map[string]int, len(c.bc.queues))
+	for pool := range c.bc.queues {
+		queued[pool] = 0
+	}
+	for id, progress := range c.bc.progress {
+		if progress.Status == BuildStatusQueued {
+			queued[pools.Normalize(c.bc.requests[id].Pool)]++
+		}
+	}
+	for pool, count := range queued {
+		ch <- prometheus.MustNewConstMetric(metrics.QueueDepthDesc, prometheus.GaugeValue, float64(count), pool)
+	}
+
+	for _, worker := range c.bc.workers {
+		busy := 0.0
+		if worker.availableSlots() == 0 {
+			busy = 1
+		}
+		ch <- prometheus.MustNewConstMetric(metrics.WorkerBusyDesc, prometheus.GaugeValue, busy, worker.ID, worker.pool())
+		ch <- prometheus.MustNewConstMetric(metrics.WorkerSlotsDesc, prometheus.GaugeValue, float64(worker.capacity()), worker.ID, worker.pool())
+		ch <- prometheus.MustNewConstMetric(metrics.WorkerActiveBuildsDesc, prometheus.GaugeValue, float64(worker.ActiveBuilds), worker.ID, worker.pool())
+		ch <- prometheus.MustNewConstMetric(metrics.WorkerCPUUsageDesc, prometheus.GaugeValue, worker.Metrics.CPUUsage, worker.ID, worker.pool())
+		ch <- prometheus.MustNewConstMetric(metrics.WorkerMemoryUsageDesc, prometheus.GaugeValue, worker.Metrics.MemoryUsage, worker.ID, worker.pool())
+	}
+}
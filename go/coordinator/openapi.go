@@ -0,0 +1,445 @@
+package main
+
+import (
+	"distributed-gradle-building/analytics"
+	"distributed-gradle-building/apikeys"
+	"distributed-gradle-building/audit"
+	"distributed-gradle-building/chaos"
+	"distributed-gradle-building/openapi"
+	"distributed-gradle-building/provenance"
+	"distributed-gradle-building/secrets"
+	"distributed-gradle-building/signing"
+	"distributed-gradle-building/tracing"
+	"distributed-gradle-building/transfer"
+	"distributed-gradle-building/usage"
+)
+
+// coordinatorOpenAPI describes the coordinator HTTP API
+func coordinatorOpenAPI() *openapi.Document {
+	doc := openapi.New("Distributed Gradle Building Coordinator API", "1.0.0",
+		"Build orchestration and queue management")
+
+	doc.Add(openapi.Route{
+		Method:      "POST",
+		Path:        "/api/build",
+		Summary:     "Submit a build request",
+		OperationID: "submitBuild",
+		Request:     BuildRequest{},
+		Response:    SubmitBuildResponse{},
+	})
+	doc.Add(openapi.Route{
+		Method:      "GET",
+		Path:        "/api/builds",
+		Summary:     "List the most recently submitted builds, newest first",
+		OperationID: "listBuilds",
+		Parameters: []openapi.Parameter{
+			openapi.QueryParam("limit", "integer", "", "Maximum number of builds (default 50)"),
+			openapi.QueryParam("tag", "string", "", "Only builds with this tag, as key:value; repeat for builds with every tag"),
+		},
+		Response: []BuildSummary{},
+	})
+	doc.Add(openapi.Route{
+		Method:      "GET",
+		Path:        "/api/builds/compare",
+		Summary:     "Diff build b against build a: task durations, cache hits, test failures and artifact sizes",
+		OperationID: "compareBuilds",
+		Parameters: []openapi.Parameter{
+			openapi.QueryParam("a", "string", "", "ID of the build compared against"),
+			openapi.QueryParam("b", "string", "", "ID of the build compared"),
+		},
+		Response: BuildComparison{},
+	})
+	doc.Add(openapi.Route{
+		Method:      "GET",
+		Path:        "/api/builds/{id}",
+		Summary:     "Get the result and progress of a build",
+		OperationID: "getBuild",
+		Parameters:  []openapi.Parameter{openapi.PathParam("id", "Build ID returned on submission")},
+		Response:    BuildStatusResponse{},
+	})
+	doc.Add(openapi.Route{
+		Method:      "GET",
+		Path:        "/api/builds/{id}/stream",
+		Summary:     "Stream build progress over a WebSocket; each message is a BuildProgress",
+		OperationID: "streamBuildProgress",
+		Parameters:  []openapi.Parameter{openapi.PathParam("id", "Build ID returned on submission")},
+		Response:    BuildProgress{},
+	})
+	doc.Add(openapi.Route{
+		Method:      "GET",
+		Path:        "/api/queue/stream",
+		Summary:     "Stream the changes of the scheduling queues as server-sent events; each event is a QueueEvent, and the Last-Event-ID header resumes after an event",
+		OperationID: "streamQueue",
+		Parameters:  []openapi.Parameter{openapi.QueryParam("pool", "string", "", "Only stream the queue of this pool")},
+		Response:    QueueEvent{},
+	})
+	doc.Add(openapi.Route{
+		Method:      "GET",
+		Path:        "/api/builds/{id}/log",
+		Summary:     "Get the output of a build as plain text, optionally following it until the build finishes",
+		OperationID: "getBuildLog",
+		Parameters: []openapi.Parameter{
+			openapi.PathParam("id", "Build ID returned on submission"),
+			openapi.QueryParam("tail", "integer", "", "Only the last lines (default: the whole log)"),
+			openapi.QueryParam("follow", "boolean", "", "Stream lines as the worker reports them until the build finishes"),
+		},
+	})
+	doc.Add(openapi.Route{
+		Method:      "GET",
+		Path:        "/api/builds/{id}/provenance",
+		Summary:     "Get the SLSA provenance statement of a completed build",
+		OperationID: "getBuildProvenance",
+		Parameters:  []openapi.Parameter{openapi.PathParam("id", "Build ID returned on submission")},
+		Response:    provenance.Statement{},
+	})
+	doc.Add(openapi.Route{
+		Method:      "GET",
+		Path:        "/api/builds/{id}/scheduling",
+		Summary:     "Explain which workers were considered for a build and how they scored",
+		OperationID: "getBuildScheduling",
+		Parameters:  []openapi.Parameter{openapi.PathParam("id", "Build ID returned on submission")},
+		Response:    SchedulingDecision{},
+	})
+	doc.Add(openapi.Route{
+		Method:      "GET",
+		Path:        "/api/builds/{id}/children",
+		Summary:     "Get the child builds and aggregate status of a matrix or sharded build",
+		OperationID: "getBuildChildren",
+		Parameters:  []openapi.Parameter{openapi.PathParam("id", "Group ID returned on submission of a matrix or sharded build")},
+		Response:    BuildGroup{},
+	})
+	doc.Add(openapi.Route{
+		Method:      "POST",
+		Path:        "/api/builds/{id}/pause",
+		Summary:     "Keep a queued build in the queue without scheduling it until it is resumed",
+		OperationID: "pauseBuild",
+		Parameters:  []openapi.Parameter{openapi.PathParam("id", "Build ID returned on submission")},
+		Request:     PauseBuildRequest{},
+		Response:    BuildProgress{},
+	})
+	doc.Add(openapi.Route{
+		Method:      "POST",
+		Path:        "/api/builds/{id}/resume",
+		Summary:     "Schedule a paused build again from its place in the queue",
+		OperationID: "resumeBuild",
+		Parameters:  []openapi.Parameter{openapi.PathParam("id", "Build ID returned on submission")},
+		Response:    BuildProgress{},
+	})
+	doc.Add(openapi.Route{
+		Method:      "POST",
+		Path:        "/api/builds/{id}/annotations",
+		Summary:     "Add tags to a build, running or finished, replacing the values of tags it already has",
+		OperationID: "annotateBuild",
+		Parameters:  []openapi.Parameter{openapi.PathParam("id", "Build ID returned on submission")},
+		Request:     AnnotateBuildRequest{},
+		Response:    BuildTags{},
+	})
+	doc.Add(openapi.Route{
+		Method:      "POST",
+		Path:        "/api/builds/{id}/replay",
+		Summary:     "Run a build again with its recorded environment pinned, optionally on a given worker",
+		OperationID: "replayBuild",
+		Parameters:  []openapi.Parameter{openapi.PathParam("id", "Build ID returned on submission")},
+		Request:     ReplayBuildRequest{},
+		Response:    SubmitBuildResponse{},
+	})
+	doc.Add(openapi.Route{
+		Method:      "POST",
+		Path:        "/api/pipelines",
+		Summary:     "Submit a pipeline of stages that run once the stages they depend on completed",
+		OperationID: "submitPipeline",
+		Request:     PipelineRequest{},
+		Response:    PipelineStatus{},
+	})
+	doc.Add(openapi.Route{
+		Method:      "GET",
+		Path:        "/api/pipelines/{id}",
+		Summary:     "Get the status of a pipeline and its stages",
+		OperationID: "getPipeline",
+		Parameters:  []openapi.Parameter{openapi.PathParam("id", "Pipeline ID returned on submission")},
+		Response:    PipelineStatus{},
+	})
+	doc.Add(openapi.Route{
+		Method:      "POST",
+		Path:        "/api/bisect",
+		Summary:     "Find the first commit between a good and a bad ref whose build fails, building commits on idle capacity",
+		OperationID: "submitBisect",
+		Request:     BisectRequest{},
+		Response:    BisectStatus{},
+	})
+	doc.Add(openapi.Route{
+		Method:      "GET",
+		Path:        "/api/bisect/{id}",
+		Summary:     "Get the status of a bisection and the builds it ran",
+		OperationID: "getBisect",
+		Parameters:  []openapi.Parameter{openapi.PathParam("id", "Bisection ID returned on submission")},
+		Response:    BisectStatus{},
+	})
+	doc.Add(openapi.Route{
+		Method:      "POST",
+		Path:        "/api/uploads",
+		Summary:     "Upload the gzipped tar archive of a project for builds to run on by upload_id",
+		OperationID: "uploadProject",
+		Parameters:  []openapi.Parameter{openapi.QueryParam("project_path", "string", "", "Absolute path of the project the archive is of, which the upload and the builds on it are authorized for")},
+		Response:    ProjectUpload{},
+	})
+	doc.Add(openapi.Route{
+		Method:      "POST",
+		Path:        "/api/tasks",
+		Summary:     "Run a single task of an uploaded project and upload its outputs as artifacts of the build",
+		OperationID: "submitTask",
+		Request:     TaskRequest{},
+		Response:    SubmitBuildResponse{},
+	})
+	doc.Add(openapi.Route{
+		Method:      "GET",
+		Path:        "/api/builds/{id}/artifacts",
+		Summary:     "List the artifacts workers uploaded for a build",
+		OperationID: "listBuildArtifacts",
+		Parameters:  []openapi.Parameter{openapi.PathParam("id", "Build ID returned on submission")},
+		Response:    []StoredArtifact{},
+	})
+	doc.Add(openapi.Route{
+		Method:      "GET",
+		Path:        "/api/builds/{id}/artifacts/{path}",
+		Summary:     "Download an uploaded artifact, or its chunk manifest when accepting " + transfer.ManifestContentType,
+		OperationID: "getBuildArtifact",
+		Parameters: []openapi.Parameter{
+			openapi.PathParam("id", "Build ID returned on submission"),
+			openapi.PathParam("path", "Artifact path relative to the project directory"),
+		},
+		Response: transfer.Manifest{},
+	})
+	doc.Add(openapi.Route{
+		Method:      "DELETE",
+		Path:        "/api/builds/{id}/artifacts",
+		Summary:     "Delete every artifact uploaded for a build",
+		OperationID: "deleteBuildArtifacts",
+		Parameters:  []openapi.Parameter{openapi.PathParam("id", "Build ID returned on submission")},
+		Response:    DeleteArtifactsResponse{},
+	})
+	doc.Add(openapi.Route{
+		Method:      "DELETE",
+		Path:        "/api/builds/{id}/artifacts/{path}",
+		Summary:     "Delete an uploaded artifact",
+		OperationID: "deleteBuildArtifact",
+		Parameters: []openapi.Parameter{
+			openapi.PathParam("id", "Build ID returned on submission"),
+			openapi.PathParam("path", "Artifact path relative to the project directory"),
+		},
+		Response: DeleteArtifactsResponse{},
+	})
+	doc.Add(openapi.Route{
+		Method:      "GET",
+		Path:        "/api/chunks/{hash}",
+		Summary:     "Download a gzip-compressed artifact chunk by its SHA-256",
+		OperationID: "getChunk",
+		Parameters:  []openapi.Parameter{openapi.PathParam("hash", "Hex SHA-256 of the uncompressed chunk")},
+	})
+	doc.Add(openapi.Route{
+		Method:      "GET",
+		Path:        "/api/workers",
+		Summary:     "List registered workers",
+		OperationID: "getWorkers",
+		Response:    []Worker{},
+	})
+	doc.Add(openapi.Route{
+		Method:      "GET",
+		Path:        "/api/workers/release",
+		Summary:     "Get the minimum worker protocol version and the worker release published for self-update",
+		OperationID: "getWorkerRelease",
+		Response:    GetWorkerReleaseReply{},
+	})
+	doc.Add(openapi.Route{
+		Method:      "POST",
+		Path:        "/api/workers/{id}/quarantine",
+		Summary:     "Keep a worker registered but stop scheduling builds on it",
+		OperationID: "quarantineWorker",
+		Parameters:  []openapi.Parameter{openapi.PathParam("id", "Worker ID")},
+		Request:     QuarantineWorkerRequest{},
+		Response:    Worker{},
+	})
+	doc.Add(openapi.Route{
+		Method:      "DELETE",
+		Path:        "/api/workers/{id}/quarantine",
+		Summary:     "Release a quarantined worker so builds are scheduled on it again",
+		OperationID: "releaseWorker",
+		Parameters:  []openapi.Parameter{openapi.PathParam("id", "Worker ID")},
+		Response:    Worker{},
+	})
+	doc.Add(openapi.Route{
+		Method:      "POST",
+		Path:        "/api/rpc",
+		Summary:     "Call the coordinator's RPC service from a worker connected over HTTP, with a gob-encoded net/rpc call",
+		OperationID: "callCoordinator",
+	})
+	doc.Add(openapi.Route{
+		Method:      "GET",
+		Path:        "/api/rpc/calls",
+		Summary:     "Long-poll the next gob-encoded call of the coordinator to a worker connected over HTTP",
+		OperationID: "pollWorkerCalls",
+		Parameters:  []openapi.Parameter{openapi.QueryParam("worker", "string", "", "ID of the polling worker")},
+	})
+	doc.Add(openapi.Route{
+		Method:      "POST",
+		Path:        "/api/rpc/calls",
+		Summary:     "Reply to the call in X-Call-ID polled by a worker connected over HTTP",
+		OperationID: "replyWorkerCall",
+		Parameters:  []openapi.Parameter{openapi.QueryParam("worker", "string", "", "ID of the replying worker")},
+	})
+	doc.Add(openapi.Route{
+		Method:      "GET",
+		Path:        "/api/pools",
+		Summary:     "List the worker pools with their workers, build slots and queued and running builds",
+		OperationID: "listPools",
+		Response:    []PoolStats{},
+	})
+	doc.Add(openapi.Route{
+		Method:      "GET",
+		Path:        "/api/stats",
+		Summary:     "Get queue, worker utilization and cache hit rate statistics",
+		OperationID: "getStats",
+		Response:    CoordinatorStats{},
+	})
+	doc.Add(openapi.Route{
+		Method:      "GET",
+		Path:        "/api/status",
+		Summary:     "Get the statistics of this coordinator, of each federated peer and their total",
+		OperationID: "getFederatedStatus",
+		Response:    FederatedStatus{},
+	})
+	doc.Add(openapi.Route{
+		Method:      "GET",
+		Path:        "/api/secrets",
+		Summary:     "List the secrets builds may request by name; values are never returned",
+		OperationID: "listSecrets",
+		Response:    []secrets.Info{},
+	})
+	doc.Add(openapi.Route{
+		Method:      "GET",
+		Path:        "/api/keys/signing",
+		Summary:     "List the Ed25519 public keys build results and artifact manifests are signed with, in the " + signing.Header + " header",
+		OperationID: "listSigningKeys",
+		Response:    signing.KeySet{},
+	})
+	doc.Add(openapi.Route{
+		Method:      "GET",
+		Path:        "/api/health",
+		Summary:     "Check coordinator health",
+		OperationID: "healthCheck",
+		Response:    HealthStatus{},
+	})
+	doc.Add(openapi.Route{
+		Method:      "GET",
+		Path:        "/api/system/health",
+		Summary:     "Check the health of the coordinator's workers and services; answers 503 when no registered worker is reachable",
+		OperationID: "systemHealthCheck",
+		Response:    SystemHealth{},
+	})
+	analyticsParams := func(extra ...openapi.Parameter) []openapi.Parameter {
+		return append([]openapi.Parameter{
+			openapi.QueryParam("project", "string", "", "Only builds of this project path"),
+			openapi.QueryParam("from", "string", "date-time", "Start of the range (default: 7 days before to)"),
+			openapi.QueryParam("to", "string", "date-time", "End of the range (default: now)"),
+			openapi.QueryParam("tag", "string", "", "Only builds with this tag, as key:value; repeat for builds with every tag"),
+		}, extra...)
+	}
+	interval := openapi.QueryParam("interval", "string", "", "Bucket size as a Go duration or whole days, e.g. 15m, 1h, 1d (default 1h)")
+	doc.Add(openapi.Route{
+		Method:      "GET",
+		Path:        "/api/analytics/durations",
+		Summary:     "Average duration in seconds of completed builds per interval, one series per project",
+		OperationID: "getDurationTrends",
+		Parameters:  analyticsParams(interval),
+		Response:    []analytics.Series{},
+	})
+	doc.Add(openapi.Route{
+		Method:      "GET",
+		Path:        "/api/analytics/failures",
+		Summary:     "Failure rate and number of finished builds per interval",
+		OperationID: "getFailureRates",
+		Parameters:  analyticsParams(interval),
+		Response:    []analytics.Series{},
+	})
+	doc.Add(openapi.Route{
+		Method:      "GET",
+		Path:        "/api/analytics/busiest-hours",
+		Summary:     "Builds per UTC hour of day, busiest first",
+		OperationID: "getBusiestHours",
+		Parameters:  analyticsParams(),
+		Response:    analytics.Table{},
+	})
+	doc.Add(openapi.Route{
+		Method:      "GET",
+		Path:        "/api/analytics/slowest-tasks",
+		Summary:     "Gradle tasks with the highest average duration",
+		OperationID: "getSlowestTasks",
+		Parameters:  analyticsParams(openapi.QueryParam("limit", "integer", "", "Maximum number of tasks (default 10)")),
+		Response:    analytics.Table{},
+	})
+	doc.Add(openapi.Route{
+		Method:      "GET",
+		Path:        "/api/usage",
+		Summary:     "Compute time, build cache growth and artifact storage per tenant and project, as JSON or CSV",
+		OperationID: "getUsage",
+		Parameters: []openapi.Parameter{
+			openapi.QueryParam("tenant", "string", "", "Only usage of this tenant"),
+			openapi.QueryParam("project", "string", "", "Only usage of this project path or repository URL"),
+			openapi.QueryParam("from", "string", "date-time", "Start of the range builds were submitted in (default: 7 days before to)"),
+			openapi.QueryParam("to", "string", "date-time", "End of the range (default: now)"),
+			openapi.QueryParam("format", "string", "", "csv to export the report as CSV"),
+		},
+		Response: []usage.Row{},
+	})
+	doc.Add(audit.Route())
+	doc.Add(openapi.Route{
+		Method:      "POST",
+		Path:        "/api/keys",
+		Summary:     "Issue an API key; the key is only returned in this response",
+		OperationID: "issueAPIKey",
+		Request:     IssueAPIKeyRequest{},
+		Response:    IssueAPIKeyResponse{},
+	})
+	doc.Add(openapi.Route{
+		Method:      "GET",
+		Path:        "/api/keys",
+		Summary:     "List the issued API keys without their secrets",
+		OperationID: "listAPIKeys",
+		Response:    []apikeys.Key{},
+	})
+	doc.Add(openapi.Route{
+		Method:      "DELETE",
+		Path:        "/api/keys/{id}",
+		Summary:     "Revoke an API key",
+		OperationID: "revokeAPIKey",
+		Parameters:  []openapi.Parameter{openapi.PathParam("id", "API key ID")},
+		Response:    apikeys.Key{},
+	})
+	doc.Add(openapi.Route{
+		Method:      "GET",
+		Path:        "/api/auth/oidc/config",
+		Summary:     "Identity provider and client the CLI logs in with",
+		OperationID: "getOIDCConfig",
+		Response:    OIDCLoginConfig{},
+	})
+	doc.Add(openapi.Route{
+		Method:      "POST",
+		Path:        "/api/auth/oidc/token",
+		Summary:     "Exchange an identity provider ID token for a coordinator token",
+		OperationID: "exchangeOIDCToken",
+		Request:     OIDCTokenRequest{},
+		Response:    LoginResponse{},
+	})
+	doc.Add(tracing.Route())
+	for _, route := range chaos.Routes() {
+		doc.Add(route)
+	}
+	doc.Add(openapi.Route{
+		Method:      "GET",
+		Path:        "/metrics",
+		Summary:     "Prometheus metrics",
+		OperationID: "getMetrics",
+	})
+
+	return doc
+}
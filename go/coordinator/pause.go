@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"distributed-gradle-building/audit"
+	"distributed-gradle-building/authz"
+)
+
+// Errors of pausing and resuming builds that exist
+var (
+	errBuildNotQueued = fmt.Errorf("build is not queued")
+	errBuildNotPaused = fmt.Errorf("build is not paused")
+)
+
+// PauseBuildRequest is the optional body of POST /api/builds/{id}/pause
+type PauseBuildRequest struct {
+	Reason string `json:"reason,omitempty"`
+}
+
+// PauseBuild keeps a queued build in the queue without scheduling it until
+// it is resumed
+func (bc *BuildCoordinator) PauseBuild(buildID, reason string) (*BuildProgress, error) {
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+
+	progress, err := bc.queuedProgress(buildID)
+	if err != nil {
+		return nil, err
+	}
+	if reason == "" {
+		reason = "paused by request"
+	}
+
+	progress.Paused = true
+	progress.Throttled = false
+	progress.Message = reason
+	progress.UpdatedAt = time.Now()
+	bc.notifyProgress(buildID)
+
+	log.Printf("Build %s paused: %s", buildID, reason)
+	paused := *progress
+	return &paused, nil
+}
+
+// ResumeBuild lets a paused build be scheduled again from its place in the
+// queue
+func (bc *BuildCoordinator) ResumeBuild(buildID string) (*BuildProgress, error) {
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+
+	progress, err := bc.queuedProgress(buildID)
+	if err != nil {
+		return nil, err
+	}
+	if !progress.Paused {
+		return nil, errBuildNotPaused
+	}
+
+	progress.Paused = false
+	progress.Message = ""
+	progress.UpdatedAt = time.Now()
+	bc.notifyProgress(buildID)
+
+	log.Printf("Build %s resumed", buildID)
+	resumed := *progress
+	return &resumed, nil
+}
+
+// queuedProgress returns the progress of a build waiting in the local queue.
+// Must be called with the mutex held.
+func (bc *BuildCoordinator) queuedProgress(buildID string) (*BuildProgress, error) {
+	progress, exists := bc.progress[buildID]
+	if !exists {
+		return nil, fmt.Errorf("build %s not found", buildID)
+	}
+	if _, forwarded := bc.forwarded[buildID]; forwarded || progress.Status != BuildStatusQueued {
+		return nil, errBuildNotQueued
+	}
+	return progress, nil
+}
+
+// isBuildPaused reports whether a queued build is paused
+func (bc *BuildCoordinator) isBuildPaused(buildID string) bool {
+	bc.mutex.RLock()
+	defer bc.mutex.RUnlock()
+
+	progress, exists := bc.progress[buildID]
+	return exists && progress.Paused
+}
+
+// handlePauseBuild pauses a queued build
+func (bc *BuildCoordinator) handlePauseBuild(w http.ResponseWriter, r *http.Request) {
+	buildID := r.PathValue("id")
+	if !bc.authorize(w, r, authz.ActionBuildPause, bc.buildAuthzResource(buildID)) {
+		return
+	}
+
+	var request PauseBuildRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	progress, err := bc.PauseBuild(buildID, request.Reason)
+	bc.writePauseResult(w, r, audit.ActionBuildPaused, buildID, progress, err)
+}
+
+// handleResumeBuild resumes a paused build
+func (bc *BuildCoordinator) handleResumeBuild(w http.ResponseWriter, r *http.Request) {
+	buildID := r.PathValue("id")
+	if !bc.authorize(w, r, authz.ActionBuildPause, bc.buildAuthzResource(buildID)) {
+		return
+	}
+
+	progress, err := bc.ResumeBuild(buildID)
+	bc.writePauseResult(w, r, audit.ActionBuildResumed, buildID, progress, err)
+}
+
+// writePauseResult answers a pause or resume request with the build's
+// progress, recording it in the audit log when it succeeded
+func (bc *BuildCoordinator) writePauseResult(w http.ResponseWriter, r *http.Request, action, buildID string, progress *BuildProgress, err error) {
+	if err == errBuildNotQueued || err == errBuildNotPaused {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	var details map[string]string
+	if progress.Paused {
+		details = map[string]string{"reason": progress.Message}
+	}
+	bc.auditLog.RecordRequest(r, action, buildID, details)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(progress)
+}
@@ -0,0 +1,469 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"distributed-gradle-building/audit"
+	"distributed-gradle-building/authz"
+	"distributed-gradle-building/gradledist"
+	"distributed-gradle-building/metrics"
+	"distributed-gradle-building/middleware"
+	"distributed-gradle-building/transfer"
+)
+
+// Statuses of pipeline stages that have no build
+const (
+	StageStatusPending = "pending"
+	StageStatusSkipped = "skipped"
+)
+
+// maxPipelineStages is the largest number of stages a pipeline may have
+const maxPipelineStages = 64
+
+// stageNamePattern matches stage names, which become part of build IDs
+var stageNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+// PipelineStage is a build of a pipeline that starts once every stage it
+// depends on completed. Its build options are added to those of the
+// pipeline's build.
+type PipelineStage struct {
+	Name         string            `json:"name"`
+	TaskName     string            `json:"task_name"`
+	BuildOptions map[string]string `json:"build_options,omitempty"`
+	DependsOn    []string          `json:"depends_on,omitempty"`
+}
+
+// PipelineRequest is a DAG of stages built like Build, which holds the
+// project or repository and other settings shared by every stage
+type PipelineRequest struct {
+	Name   string          `json:"name"`
+	Build  BuildRequest    `json:"build"`
+	Stages []PipelineStage `json:"stages"`
+}
+
+// StageStatus is the state of a pipeline stage. Inputs are the artifacts of
+// the stages it depends on, downloaded into its project before it runs.
+type StageStatus struct {
+	Name      string   `json:"name"`
+	TaskName  string   `json:"task_name"`
+	DependsOn []string `json:"depends_on,omitempty"`
+	BuildID   string   `json:"build_id,omitempty"`
+	Status    string   `json:"status"`
+	WorkerID  string   `json:"worker_id,omitempty"`
+	Message   string   `json:"message,omitempty"`
+	Inputs    []string `json:"inputs,omitempty"`
+}
+
+// PipelineStatus is a pipeline with the state of its stages, in the order
+// they may run. The pipeline's status aggregates its stages like the status
+// of a matrix build, with pending stages counted as queued.
+type PipelineStatus struct {
+	PipelineID string         `json:"pipeline_id"`
+	Name       string         `json:"name"`
+	Status     string         `json:"status"`
+	CreatedAt  time.Time      `json:"created_at"`
+	Counts     map[string]int `json:"counts"`
+	Stages     []StageStatus  `json:"stages"`
+}
+
+// pipelineRun tracks the stages of a submitted pipeline
+type pipelineRun struct {
+	name      string
+	build     BuildRequest
+	stages    []*pipelineStage
+	createdAt time.Time
+}
+
+// pipelineStage is a stage of a pipeline run. Status is only used until the
+// stage has a build, and then reflects whether it could be queued.
+type pipelineStage struct {
+	PipelineStage
+	buildID string
+	status  string
+	message string
+	inputs  []string
+}
+
+// sortStages checks that the stages of a pipeline form a DAG and returns
+// them in an order where every stage follows the stages it depends on
+func sortStages(stages []PipelineStage) ([]PipelineStage, error) {
+	if len(stages) == 0 {
+		return nil, fmt.Errorf("pipeline has no stages")
+	}
+	if len(stages) > maxPipelineStages {
+		return nil, fmt.Errorf("pipeline has more than %d stages", maxPipelineStages)
+	}
+
+	byName := make(map[string]PipelineStage, len(stages))
+	for _, stage := range stages {
+		if !stageNamePattern.MatchString(stage.Name) {
+			return nil, fmt.Errorf("invalid stage name %q", stage.Name)
+		}
+		if _, exists := byName[stage.Name]; exists {
+			return nil, fmt.Errorf("duplicate stage %s", stage.Name)
+		}
+		byName[stage.Name] = stage
+	}
+
+	waiting := make(map[string]int, len(stages))
+	dependents := make(map[string][]string)
+	for _, stage := range stages {
+		for _, dependency := range stage.DependsOn {
+			if _, exists := byName[dependency]; !exists {
+				return nil, fmt.Errorf("stage %s depends on unknown stage %s", stage.Name, dependency)
+			}
+			dependents[dependency] = append(dependents[dependency], stage.Name)
+		}
+		waiting[stage.Name] = len(stage.DependsOn)
+	}
+
+	// Kahn's algorithm, keeping the submitted order among ready stages
+	var sorted []PipelineStage
+	var ready []string
+	for _, stage := range stages {
+		if waiting[stage.Name] == 0 {
+			ready = append(ready, stage.Name)
+		}
+	}
+	for len(ready) > 0 {
+		name := ready[0]
+		ready = ready[1:]
+		sorted = append(sorted, byName[name])
+		for _, dependent := range dependents[name] {
+			if waiting[dependent]--; waiting[dependent] == 0 {
+				ready = append(ready, dependent)
+			}
+		}
+	}
+	if len(sorted) != len(stages) {
+		var cyclic []string
+		for _, stage := range stages {
+			if waiting[stage.Name] > 0 {
+				cyclic = append(cyclic, stage.Name)
+			}
+		}
+		return nil, fmt.Errorf("stages %s depend on each other", strings.Join(cyclic, ", "))
+	}
+	return sorted, nil
+}
+
+// stageRequest returns the build request of a pipeline stage
+func stageRequest(build BuildRequest, stage PipelineStage) BuildRequest {
+	request := build
+	request.TaskName = stage.TaskName
+	if len(stage.BuildOptions) > 0 {
+		request.BuildOptions = maps.Clone(build.BuildOptions)
+		if request.BuildOptions == nil {
+			request.BuildOptions = make(map[string]string)
+		}
+		maps.Copy(request.BuildOptions, stage.BuildOptions)
+	}
+	return request
+}
+
+// SubmitPipeline starts a pipeline, queueing the stages without
+// dependencies, and returns its ID. The stages must have been sorted by
+// sortStages.
+func (bc *BuildCoordinator) SubmitPipeline(name string, build BuildRequest, stages []PipelineStage) string {
+	pipelineID := "pipeline-" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	run := &pipelineRun{name: name, build: build, createdAt: time.Now()}
+	for _, stage := range stages {
+		run.stages = append(run.stages, &pipelineStage{PipelineStage: stage, status: StageStatusPending})
+	}
+
+	bc.mutex.Lock()
+	bc.pipelines[pipelineID] = run
+	bc.mutex.Unlock()
+
+	bc.advancePipeline(pipelineID)
+	return pipelineID
+}
+
+// advancePipeline queues the stages of a pipeline whose dependencies all
+// completed, and skips the stages whose dependencies did not
+func (bc *BuildCoordinator) advancePipeline(pipelineID string) {
+	for {
+		ready := bc.readyStages(pipelineID)
+		if len(ready) == 0 {
+			return
+		}
+		for _, stage := range ready {
+			bc.submitStage(pipelineID, stage)
+		}
+	}
+}
+
+// readyStages returns the stages of a pipeline that can be queued, giving
+// each its build ID so that they are queued once
+func (bc *BuildCoordinator) readyStages(pipelineID string) []*pipelineStage {
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+
+	run, exists := bc.pipelines[pipelineID]
+	if !exists {
+		return nil
+	}
+
+	var ready []*pipelineStage
+	for _, stage := range run.stages {
+		if stage.buildID != "" || stage.status != StageStatusPending {
+			continue
+		}
+
+		// Stages are sorted, so skipped dependencies are already marked
+		waiting := false
+		for _, dependency := range stage.DependsOn {
+			status := bc.stageStatus(run.stage(dependency))
+			if status == BuildStatusFailed || status == BuildStatusCancelled || status == StageStatusSkipped {
+				stage.status = StageStatusSkipped
+				stage.message = fmt.Sprintf("stage %s %s", dependency, status)
+				break
+			}
+			waiting = waiting || status != BuildStatusCompleted
+		}
+		if stage.status == StageStatusPending && !waiting {
+			stage.buildID = pipelineID + "-" + stage.Name
+			stage.status = BuildStatusQueued
+			ready = append(ready, stage)
+		}
+	}
+	return ready
+}
+
+// submitStage queues the build of a pipeline stage with the artifacts of the
+// stages it depends on as inputs
+func (bc *BuildCoordinator) submitStage(pipelineID string, stage *pipelineStage) {
+	bc.mutex.RLock()
+	run := bc.pipelines[pipelineID]
+	request := stageRequest(run.build, stage.PipelineStage)
+	var prefixes []string
+	for _, dependency := range stage.DependsOn {
+		// A reused result's artifacts are stored under the build it reused
+		buildID := run.stage(dependency).buildID
+		if response, exists := bc.builds[buildID]; exists && response.CachedFrom != "" {
+			buildID = response.CachedFrom
+		}
+		prefixes = append(prefixes, buildID+"/")
+	}
+	bc.mutex.RUnlock()
+
+	var inputs []string
+	for _, prefix := range prefixes {
+		manifests, err := bc.artifacts.List(prefix)
+		if err != nil {
+			log.Printf("Failed to list the artifacts of %s for stage %s of pipeline %s: %v", prefix, stage.Name, pipelineID, err)
+			continue
+		}
+		request.Inputs = append(request.Inputs, manifests...)
+		for _, manifest := range manifests {
+			inputs = append(inputs, manifest.Name)
+		}
+	}
+	request.RequestID = stage.buildID
+	request.PipelineID = pipelineID
+	request.Stage = stage.Name
+
+	_, err := bc.SubmitBuild(request)
+
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+	stage.inputs = inputs
+	if err != nil {
+		log.Printf("Failed to queue stage %s of pipeline %s: %v", stage.Name, pipelineID, err)
+		stage.status = BuildStatusFailed
+		stage.message = err.Error()
+	}
+}
+
+// stage returns the stage of a pipeline run with the given name
+func (run *pipelineRun) stage(name string) *pipelineStage {
+	for _, stage := range run.stages {
+		if stage.Name == name {
+			return stage
+		}
+	}
+	return nil
+}
+
+// stageStatus returns the status of a stage's build, or of the stage if it
+// has none. Must be called with the mutex held.
+func (bc *BuildCoordinator) stageStatus(stage *pipelineStage) string {
+	if stage.status == BuildStatusQueued {
+		if progress, exists := bc.progress[stage.buildID]; exists {
+			return progress.Status
+		}
+	}
+	return stage.status
+}
+
+// GetPipeline returns a pipeline with the state of its stages
+func (bc *BuildCoordinator) GetPipeline(pipelineID string) (*PipelineStatus, error) {
+	bc.mutex.RLock()
+	defer bc.mutex.RUnlock()
+
+	run, exists := bc.pipelines[pipelineID]
+	if !exists {
+		return nil, fmt.Errorf("pipeline %s not found", pipelineID)
+	}
+
+	status := &PipelineStatus{
+		PipelineID: pipelineID,
+		Name:       run.name,
+		CreatedAt:  run.createdAt,
+		Counts:     make(map[string]int),
+		Stages:     make([]StageStatus, 0, len(run.stages)),
+	}
+	aggregate := make(map[string]int)
+	for _, stage := range run.stages {
+		state := StageStatus{
+			Name:      stage.Name,
+			TaskName:  stage.TaskName,
+			DependsOn: stage.DependsOn,
+			Status:    bc.stageStatus(stage),
+			Message:   stage.message,
+			Inputs:    stage.inputs,
+		}
+		if stage.status == BuildStatusQueued {
+			state.BuildID = stage.buildID
+			if response, exists := bc.builds[stage.buildID]; exists {
+				state.WorkerID = response.WorkerID
+			}
+			if progress, exists := bc.progress[stage.buildID]; exists && state.WorkerID == "" {
+				state.WorkerID = progress.WorkerID
+			}
+		}
+		status.Counts[state.Status]++
+		if state.Status == StageStatusPending {
+			aggregate[BuildStatusQueued]++
+		} else {
+			aggregate[state.Status]++
+		}
+		status.Stages = append(status.Stages, state)
+	}
+	status.Status = groupStatus(aggregate, len(run.stages))
+	return status, nil
+}
+
+// handleSubmitPipeline validates every stage of a pipeline before queueing
+// the stages without dependencies
+func (bc *BuildCoordinator) handleSubmitPipeline(w http.ResponseWriter, r *http.Request) {
+	var request PipelineRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	request.Build = request.Build.withoutReplay()
+	if bc.rejectWhileDraining(w) {
+		return
+	}
+	if request.Build.Matrix != nil {
+		http.Error(w, "pipeline stages cannot be matrix builds", http.StatusBadRequest)
+		return
+	}
+	if request.Build.Sharding != nil || request.Build.Shard != nil {
+		http.Error(w, "pipeline stages cannot be sharded builds", http.StatusBadRequest)
+		return
+	}
+
+	stages, err := sortStages(request.Stages)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, stage := range stages {
+		build := stageRequest(request.Build, stage)
+		if err := bc.validateBuildRequest(&build); err != nil {
+			http.Error(w, fmt.Sprintf("stage %s: %v", stage.Name, err), http.StatusBadRequest)
+			return
+		}
+		if build.GradleVersion != "" && !gradledist.ValidVersion(build.GradleVersion) {
+			http.Error(w, fmt.Sprintf("stage %s: invalid gradle version %q", stage.Name, build.GradleVersion), http.StatusBadRequest)
+			return
+		}
+		if !bc.authorize(w, r, authz.ActionBuildSubmit, buildResource(build)) {
+			return
+		}
+		// Stages share the project, normalized like that of a single build
+		request.Build.ProjectPath = build.ProjectPath
+	}
+
+	request.Build.Tenant = bc.rateLimiter.Tenant(r)
+	request.Build.CorrelationID = middleware.RequestIDFromContext(r.Context())
+	pipelineID := bc.SubmitPipeline(request.Name, request.Build, stages)
+	bc.auditLog.RecordRequest(r, audit.ActionBuildSubmitted, pipelineID, map[string]string{
+		"pipeline":     request.Name,
+		"project_path": request.Build.ProjectPath,
+		"tenant":       request.Build.Tenant,
+		"stages":       strconv.Itoa(len(stages)),
+	})
+
+	status, err := bc.GetPipeline(pipelineID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+func (bc *BuildCoordinator) handleGetPipeline(w http.ResponseWriter, r *http.Request) {
+	status, err := bc.GetPipeline(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// RPC argument and reply types for downloading the inputs of a build
+type DownloadChunkArgs struct {
+	BuildID  string `json:"build_id"`
+	WorkerID string `json:"worker_id"`
+	Hash     string `json:"hash"`
+}
+
+type DownloadChunkReply struct {
+	Data []byte `json:"data"`
+}
+
+// DownloadChunk returns a compressed chunk of an input artifact or of the
+// uploaded project to the worker running the build
+// RPC method signature: func (t *T) MethodName(args *ArgType, reply *ReplyType) error
+func (bc *BuildCoordinator) DownloadChunk(args *DownloadChunkArgs, reply *DownloadChunkReply) error {
+	if err := bc.checkUploader(args.BuildID, args.WorkerID); err != nil {
+		return err
+	}
+
+	bc.mutex.RLock()
+	request := bc.requests[args.BuildID]
+	bc.mutex.RUnlock()
+	inputs := request.Inputs
+	if request.Upload != nil {
+		inputs = append(slices.Clone(inputs), *request.Upload)
+	}
+	if !slices.ContainsFunc(inputs, func(manifest transfer.Manifest) bool {
+		return slices.ContainsFunc(manifest.Chunks, func(chunk transfer.ChunkRef) bool { return chunk.Hash == args.Hash })
+	}) {
+		return fmt.Errorf("chunk %s is not an input of build %s", args.Hash, args.BuildID)
+	}
+
+	data, err := bc.artifacts.Chunk(args.Hash)
+	if err != nil {
+		return err
+	}
+	metrics.TransferBytes.WithLabelValues(metrics.TransferDownload, metrics.TransferDeduplicated).Add(float64(transfer.PlainSize(data)))
+	metrics.TransferBytes.WithLabelValues(metrics.TransferDownload, metrics.TransferCompressed).Add(float64(len(data)))
+	reply.Data = data
+	return nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+
+	"distributed-gradle-building/pools"
+)
+
+// PoolStats summarizes the workers and builds of a worker pool
+type PoolStats struct {
+	Name          string `json:"name"`
+	Workers       int    `json:"workers"`
+	Slots         int    `json:"slots"`
+	ActiveBuilds  int    `json:"active_builds"`
+	QueuedBuilds  int    `json:"queued_builds"`
+	RunningBuilds int    `json:"running_builds"`
+	AcceptsBuilds bool   `json:"accepts_builds"`
+}
+
+// pool returns the pool the worker registered in
+func (w *Worker) pool() string {
+	return pools.Normalize(w.Pool)
+}
+
+// setRouter routes builds with router and creates a queue for each pool
+// builds may be routed to. It must be called before the queues are
+// processed.
+func (bc *BuildCoordinator) setRouter(router *pools.Router) {
+	bc.router = router
+	for _, pool := range router.Pools() {
+		if _, exists := bc.queues[pool]; !exists {
+			bc.queues[pool] = make(chan BuildRequest, cap(bc.buildQueue))
+		}
+	}
+}
+
+// queue returns the queue of a pool
+func (bc *BuildCoordinator) queue(pool string) chan BuildRequest {
+	if queue, exists := bc.queues[pools.Normalize(pool)]; exists {
+		return queue
+	}
+	return bc.buildQueue
+}
+
+// getPoolWorkers returns the workers of a pool with a free build slot, least
+// loaded first. Must be called with the mutex held.
+func (bc *BuildCoordinator) getPoolWorkers(pool string) []*Worker {
+	pool = pools.Normalize(pool)
+	var available []*Worker
+	for _, worker := range bc.getAvailableWorkers() {
+		if worker.pool() == pool {
+			available = append(available, worker)
+		}
+	}
+	return available
+}
+
+// poolStats summarizes every pool with workers or routed builds
+func (bc *BuildCoordinator) poolStats() []PoolStats {
+	bc.mutex.RLock()
+	defer bc.mutex.RUnlock()
+
+	stats := make(map[string]*PoolStats)
+	get := func(pool string) *PoolStats {
+		if _, exists := stats[pool]; !exists {
+			_, routed := bc.queues[pool]
+			stats[pool] = &PoolStats{Name: pool, AcceptsBuilds: routed}
+		}
+		return stats[pool]
+	}
+
+	for pool := range bc.queues {
+		get(pool)
+	}
+	for _, worker := range bc.workers {
+		pool := get(worker.pool())
+		pool.Workers++
+		pool.Slots += worker.capacity()
+		pool.ActiveBuilds += worker.ActiveBuilds
+	}
+	for id, progress := range bc.progress {
+		pool := get(pools.Normalize(bc.requests[id].Pool))
+		switch progress.Status {
+		case BuildStatusQueued:
+			pool.QueuedBuilds++
+		case BuildStatusRunning:
+			pool.RunningBuilds++
+		}
+	}
+
+	list := make([]PoolStats, 0, len(stats))
+	for _, pool := range stats {
+		list = append(list, *pool)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// handleListPools lists the worker pools with their capacity and builds
+func (bc *BuildCoordinator) handleListPools(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(bc.poolStats())
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+
+	"distributed-gradle-building/websocket"
+)
+
+// BuildStatusResponse is the result of a build together with its live progress
+type BuildStatusResponse struct {
+	BuildResponse
+	Progress BuildProgress     `json:"progress"`
+	Tags     map[string]string `json:"tags,omitempty"`
+}
+
+// finished reports whether a build has reached a final status
+func (p BuildProgress) finished() bool {
+	switch p.Status {
+	case BuildStatusCompleted, BuildStatusFailed, BuildStatusCancelled:
+		return true
+	}
+	return false
+}
+
+// watchProgress subscribes to progress updates of a build. The returned
+// function unsubscribes and must be called once the caller stops reading.
+func (bc *BuildCoordinator) watchProgress(buildID string) (<-chan BuildProgress, func(), error) {
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+
+	if _, exists := bc.progress[buildID]; !exists {
+		return nil, nil, fmt.Errorf("build %s not found", buildID)
+	}
+
+	updates := make(chan BuildProgress, 16)
+	bc.watchers[buildID] = append(bc.watchers[buildID], updates)
+
+	stop := func() {
+		bc.mutex.Lock()
+		defer bc.mutex.Unlock()
+
+		watchers := bc.watchers[buildID]
+		for i, watcher := range watchers {
+			if watcher == updates {
+				bc.watchers[buildID] = append(watchers[:i], watchers[i+1:]...)
+				break
+			}
+		}
+		if len(bc.watchers[buildID]) == 0 {
+			delete(bc.watchers, buildID)
+		}
+	}
+
+	return updates, stop, nil
+}
+
+// notifyProgress sends the current progress of a build to its watchers.
+// Must be called with the mutex held.
+func (bc *BuildCoordinator) notifyProgress(buildID string) {
+	progress, exists := bc.progress[buildID]
+	if !exists {
+		return
+	}
+
+	for _, watcher := range bc.watchers[buildID] {
+		// A slow watcher loses its oldest update rather than blocking the build
+		select {
+		case watcher <- *progress:
+		default:
+			select {
+			case <-watcher:
+			default:
+			}
+			select {
+			case watcher <- *progress:
+			default:
+			}
+		}
+	}
+}
+
+// handleBuildStream streams the progress of a build over a WebSocket until
+// the build finishes or the client disconnects
+func (bc *BuildCoordinator) handleBuildStream(w http.ResponseWriter, r *http.Request) {
+	buildID := r.PathValue("id")
+
+	updates, stop, err := bc.watchProgress(buildID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	defer stop()
+
+	conn, err := websocket.Upgrade(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer conn.Close()
+
+	// Reading detects clients going away; they send nothing else
+	disconnected := make(chan struct{})
+	go func() {
+		defer close(disconnected)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	progress, err := bc.GetBuildProgress(buildID)
+	if err != nil {
+		return
+	}
+
+	current := *progress
+	for {
+		if err := conn.WriteJSON(current); err != nil {
+			log.Printf("Failed to stream progress of build %s: %v", buildID, err)
+			return
+		}
+		if current.finished() {
+			return
+		}
+
+		select {
+		case current = <-updates:
+		case <-disconnected:
+			return
+		case <-bc.shutdown:
+			return
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"distributed-gradle-building/provenance"
+)
+
+// errBuildNotCompleted is returned for provenance of builds that have not succeeded
+var errBuildNotCompleted = fmt.Errorf("build has not completed")
+
+// GetBuildProvenance returns the SLSA provenance of a completed build
+func (bc *BuildCoordinator) GetBuildProvenance(buildID string) (*provenance.Statement, error) {
+	bc.mutex.RLock()
+	defer bc.mutex.RUnlock()
+
+	response, exists := bc.builds[buildID]
+	if !exists {
+		return nil, fmt.Errorf("build %s not found", buildID)
+	}
+
+	progress, exists := bc.progress[buildID]
+	if !exists || progress.Status != BuildStatusCompleted || !response.Success {
+		return nil, errBuildNotCompleted
+	}
+
+	request := bc.requests[buildID]
+	statement := provenance.NewStatement(provenance.Build{
+		ID:          buildID,
+		ProjectPath: request.ProjectPath,
+		TaskName:    request.TaskName,
+		Options:     request.BuildOptions,
+		WorkerID:    response.WorkerID,
+		StartedOn:   progress.StartedAt,
+		FinishedOn:  response.Timestamp,
+		Artifacts:   response.ArtifactDetails,
+	})
+	return &statement, nil
+}
+
+// handleGetBuildProvenance serves the provenance statement of a completed build
+func (bc *BuildCoordinator) handleGetBuildProvenance(w http.ResponseWriter, r *http.Request) {
+	statement, err := bc.GetBuildProvenance(r.PathValue("id"))
+	if err == errBuildNotCompleted {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	bc.signer.WriteJSON(w, "application/json", statement)
+}
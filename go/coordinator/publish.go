@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"distributed-gradle-building/audit"
+	"distributed-gradle-building/mavenrepo"
+	"distributed-gradle-building/transfer"
+)
+
+// Outcomes of publishing an artifact
+const (
+	PublishPublished = "published"
+	PublishUnchanged = "unchanged"
+	PublishFailed    = "failed"
+)
+
+// PublishConfig configures the Maven repository successful builds publish
+// their JARs and AARs to. The credentials are read from the build secrets
+// named UsernameSecret and PasswordSecret when a build is published.
+type PublishConfig struct {
+	URL            string `json:"url"`
+	UsernameSecret string `json:"username_secret,omitempty"`
+	PasswordSecret string `json:"password_secret,omitempty"`
+}
+
+// loadPublishConfig loads the Maven repository from environment variables.
+// Without MAVEN_PUBLISH_URL builds cannot be published.
+func loadPublishConfig() PublishConfig {
+	return PublishConfig{
+		URL:            os.Getenv("MAVEN_PUBLISH_URL"),
+		UsernameSecret: os.Getenv("MAVEN_PUBLISH_USERNAME_SECRET"),
+		PasswordSecret: os.Getenv("MAVEN_PUBLISH_PASSWORD_SECRET"),
+	}
+}
+
+// PublishRequest asks for the JARs and AARs of a successful build to be
+// published with a group ID and version. Artifact IDs and classifiers are
+// taken from the file names.
+type PublishRequest struct {
+	GroupID string `json:"group_id"`
+	Version string `json:"version"`
+}
+
+// PublishedArtifact is the outcome of publishing an artifact of a build
+type PublishedArtifact struct {
+	Path        string                `json:"path"`
+	Coordinates mavenrepo.Coordinates `json:"coordinates"`
+	URL         string                `json:"url"`
+	// Status is published, unchanged if the repository had the artifact
+	// already, or failed with the Error
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// validatePublishRequest checks that the artifacts of a build can be
+// published as requested
+func (bc *BuildCoordinator) validatePublishRequest(request *PublishRequest) error {
+	if request == nil {
+		return nil
+	}
+	if bc.maven.URL == "" {
+		return fmt.Errorf("artifact publishing is not configured")
+	}
+	return mavenrepo.Validate(request.GroupID, request.Version)
+}
+
+// repository returns the configured Maven repository with its credentials
+func (bc *BuildCoordinator) repository() (*mavenrepo.Repository, error) {
+	repository := &mavenrepo.Repository{URL: bc.maven.URL, Client: &http.Client{Timeout: 5 * time.Minute}}
+	if bc.maven.UsernameSecret != "" {
+		username, err := bc.secretStore.Value(bc.maven.UsernameSecret)
+		if err != nil {
+			return nil, err
+		}
+		repository.Username = username
+	}
+	if bc.maven.PasswordSecret != "" {
+		password, err := bc.secretStore.Value(bc.maven.PasswordSecret)
+		if err != nil {
+			return nil, err
+		}
+		repository.Password = password
+	}
+	return repository, nil
+}
+
+// publishArtifacts publishes the JARs and AARs a successful build uploaded
+// to the Maven repository and records the outcome of each with the build.
+// Only artifacts that changed are uploaded, and failures do not fail the
+// build.
+func (bc *BuildCoordinator) publishArtifacts(buildID string, request PublishRequest) {
+	manifests, err := bc.artifacts.List(buildID + "/")
+	if err != nil {
+		log.Printf("Failed to list artifacts of build %s to publish: %v", buildID, err)
+		return
+	}
+
+	var published []PublishedArtifact
+	repository, repositoryErr := bc.repository()
+	for _, manifest := range manifests {
+		path := strings.TrimPrefix(manifest.Name, buildID+"/")
+		coordinates, ok := mavenrepo.Parse(path, request.GroupID, request.Version)
+		if !ok {
+			continue
+		}
+		artifact := PublishedArtifact{Path: path, Coordinates: coordinates, URL: strings.TrimRight(bc.maven.URL, "/") + "/" + coordinates.Path()}
+
+		err := repositoryErr
+		if err == nil {
+			var data []byte
+			if data, err = bc.readArtifact(manifest.Chunks); err == nil {
+				var uploaded bool
+				uploaded, err = repository.Publish(coordinates, data)
+				artifact.Status = PublishUnchanged
+				if uploaded {
+					artifact.Status = PublishPublished
+				}
+			}
+		}
+		if err != nil {
+			artifact.Status, artifact.Error = PublishFailed, err.Error()
+			log.Printf("Failed to publish %s of build %s: %v", path, buildID, err)
+		}
+		published = append(published, artifact)
+	}
+	if len(published) == 0 {
+		log.Printf("Build %s uploaded no JAR or AAR to publish", buildID)
+		return
+	}
+
+	bc.mutex.Lock()
+	if response, exists := bc.builds[buildID]; exists {
+		response.Published = published
+	}
+	bc.mutex.Unlock()
+
+	details := map[string]string{"repository": bc.maven.URL}
+	for _, artifact := range published {
+		details[artifact.Path] = artifact.Status
+	}
+	bc.recordEvent(audit.Event{
+		Action:    audit.ActionArtifactsPublished,
+		Principal: "publisher",
+		Resource:  buildID,
+		Details:   details,
+	})
+}
+
+// readArtifact reads a stored artifact from its chunks
+func (bc *BuildCoordinator) readArtifact(chunks []transfer.ChunkRef) ([]byte, error) {
+	var data []byte
+	for _, chunk := range chunks {
+		plain, err := bc.artifacts.ReadChunk(chunk.Hash)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, plain...)
+	}
+	return data, nil
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"distributed-gradle-building/audit"
+	"distributed-gradle-building/authz"
+	"distributed-gradle-building/registry"
+)
+
+// errWorkerNotQuarantined is returned when releasing a worker that is not
+// quarantined
+var errWorkerNotQuarantined = errors.New("worker is not quarantined")
+
+// QuarantineConfig configures when workers are quarantined automatically: a
+// worker is quarantined once at least FailureRate of its last Window builds
+// failed. A FailureRate of 0 disables automatic quarantine.
+type QuarantineConfig struct {
+	FailureRate float64 `json:"failure_rate"`
+	Window      int     `json:"window"`
+}
+
+// defaultQuarantineConfig only quarantines workers on request, judging
+// failure rates over ten builds when enabled
+func defaultQuarantineConfig() QuarantineConfig {
+	return QuarantineConfig{Window: 10}
+}
+
+// loadQuarantineConfig loads the automatic quarantine settings from
+// WORKER_QUARANTINE_FAILURE_RATE and WORKER_QUARANTINE_WINDOW
+func loadQuarantineConfig() QuarantineConfig {
+	config := defaultQuarantineConfig()
+
+	if value := os.Getenv("WORKER_QUARANTINE_FAILURE_RATE"); value != "" {
+		if rate, err := strconv.ParseFloat(value, 64); err != nil || rate < 0 || rate > 1 {
+			log.Printf("Ignoring invalid WORKER_QUARANTINE_FAILURE_RATE %q: must be between 0 and 1", value)
+		} else {
+			config.FailureRate = rate
+		}
+	}
+	if value := os.Getenv("WORKER_QUARANTINE_WINDOW"); value != "" {
+		if window, err := strconv.Atoi(value); err != nil || window <= 0 {
+			log.Printf("Ignoring invalid WORKER_QUARANTINE_WINDOW %q: must be a positive number of builds", value)
+		} else {
+			config.Window = window
+		}
+	}
+
+	return config
+}
+
+// QuarantineWorkerRequest is the optional body of POST
+// /api/workers/{id}/quarantine
+type QuarantineWorkerRequest struct {
+	Reason string `json:"reason,omitempty"`
+}
+
+// workerQuarantine returns the quarantine of a worker registering: the one
+// it had before it last left, or the one saved in the registry before the
+// coordinator restarted. Must be called with the mutex held.
+func (bc *BuildCoordinator) workerQuarantine(workerID string) *registry.Quarantine {
+	if quarantine, exists := bc.quarantined[workerID]; exists {
+		return quarantine
+	}
+	if entry, exists := bc.registry.Get(workerID); exists && entry.Quarantine != nil {
+		bc.quarantined[workerID] = entry.Quarantine
+		return entry.Quarantine
+	}
+	return nil
+}
+
+// QuarantineWorker keeps a registered worker from being scheduled builds.
+// Its running builds finish. Quarantining a quarantined worker again
+// replaces the reason.
+func (bc *BuildCoordinator) QuarantineWorker(workerID, reason, by string) (*Worker, error) {
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+
+	worker, exists := bc.workers[workerID]
+	if !exists {
+		return nil, fmt.Errorf("worker %s not found", workerID)
+	}
+	if reason == "" {
+		reason = "quarantined by request"
+	}
+	bc.quarantineWorker(worker, registry.Quarantine{Reason: reason, By: by, Since: time.Now()})
+
+	quarantined := *worker
+	return &quarantined, nil
+}
+
+// ReleaseWorker lets builds be scheduled on a quarantined worker again. Its
+// failure rate is judged afresh from then on.
+func (bc *BuildCoordinator) ReleaseWorker(workerID string) (*Worker, error) {
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+
+	worker, exists := bc.workers[workerID]
+	if !exists {
+		return nil, fmt.Errorf("worker %s not found", workerID)
+	}
+	if worker.Quarantine == nil {
+		return nil, errWorkerNotQuarantined
+	}
+
+	worker.Quarantine = nil
+	delete(bc.quarantined, workerID)
+	reliability := bc.reliability[workerID]
+	reliability.recent = nil
+	bc.reliability[workerID] = reliability
+	if err := bc.registry.Put(registryEntry(worker)); err != nil {
+		log.Printf("Failed to update the worker registry: %v", err)
+	}
+
+	log.Printf("Worker %s released from quarantine", workerID)
+	released := *worker
+	return &released, nil
+}
+
+// quarantineWorker quarantines a worker and saves its quarantine in the
+// registry. Must be called with the mutex held.
+func (bc *BuildCoordinator) quarantineWorker(worker *Worker, quarantine registry.Quarantine) {
+	worker.Quarantine = &quarantine
+	bc.quarantined[worker.ID] = &quarantine
+	if err := bc.registry.Put(registryEntry(worker)); err != nil {
+		log.Printf("Failed to update the worker registry: %v", err)
+	}
+	log.Printf("Worker %s quarantined: %s", worker.ID, quarantine.Reason)
+}
+
+// checkFailureRate quarantines a worker once too many of its recent builds
+// failed. Must be called with the mutex held.
+func (bc *BuildCoordinator) checkFailureRate(workerID string) {
+	worker, exists := bc.workers[workerID]
+	if !exists || worker.Quarantine != nil || bc.quarantine.FailureRate <= 0 {
+		return
+	}
+	recent := bc.reliability[workerID].recent
+	if len(recent) < bc.quarantine.Window {
+		return
+	}
+
+	failed := 0
+	for _, success := range recent {
+		if !success {
+			failed++
+		}
+	}
+	if float64(failed)/float64(len(recent)) < bc.quarantine.FailureRate {
+		return
+	}
+
+	reason := fmt.Sprintf("failed %d of its last %d builds", failed, len(recent))
+	bc.quarantineWorker(worker, registry.Quarantine{Reason: reason, Automatic: true, By: "scheduler", Since: time.Now()})
+	bc.recordEvent(audit.Event{
+		Action:    audit.ActionWorkerQuarantined,
+		Principal: "scheduler",
+		Resource:  workerID,
+		Details:   map[string]string{"reason": reason, "automatic": "true"},
+	})
+}
+
+// handleQuarantineWorker quarantines a worker
+func (bc *BuildCoordinator) handleQuarantineWorker(w http.ResponseWriter, r *http.Request) {
+	if !bc.authorize(w, r, authz.ActionWorkersQuarantine, authz.Resource{}) {
+		return
+	}
+
+	var request QuarantineWorkerRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	workerID := r.PathValue("id")
+	worker, err := bc.QuarantineWorker(workerID, request.Reason, audit.Principal(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	bc.auditLog.RecordRequest(r, audit.ActionWorkerQuarantined, workerID, map[string]string{"reason": worker.Quarantine.Reason})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(worker)
+}
+
+// handleReleaseWorker releases a quarantined worker
+func (bc *BuildCoordinator) handleReleaseWorker(w http.ResponseWriter, r *http.Request) {
+	if !bc.authorize(w, r, authz.ActionWorkersQuarantine, authz.Resource{}) {
+		return
+	}
+
+	workerID := r.PathValue("id")
+	worker, err := bc.ReleaseWorker(workerID)
+	if err == errWorkerNotQuarantined {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	bc.auditLog.RecordRequest(r, audit.ActionWorkerReleased, workerID, nil)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(worker)
+}
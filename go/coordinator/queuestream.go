@@ -0,0 +1,318 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"distributed-gradle-building/events"
+	"distributed-gradle-building/fairshare"
+	"distributed-gradle-building/pools"
+)
+
+// Types of the events of the queue stream
+const (
+	// QueueSnapshot lists the queue of a pool when a client connects or
+	// resumes after the events it missed were discarded
+	QueueSnapshot = "snapshot"
+	// QueueEnqueued is emitted when a build enters the queue of its pool
+	QueueEnqueued = "enqueued"
+	// QueueReprioritized is emitted when the order of the queued builds
+	// changes, such as when a build is paused, resumed or preempted
+	QueueReprioritized = "reprioritized"
+	// QueueAssigned is emitted when a build is assigned to a worker or
+	// forwarded to a peer coordinator
+	QueueAssigned = "assigned"
+	// QueueCompleted is emitted when a build completes, fails or is
+	// cancelled
+	QueueCompleted = "completed"
+)
+
+// queueStreamBacklog is the number of events kept for clients resuming with
+// Last-Event-ID
+const queueStreamBacklog = 1000
+
+// queueStreamBuffer is how many events a client may fall behind before it
+// is disconnected to resume later
+const queueStreamBuffer = 256
+
+// queueStreamKeepAlive is how often an idle stream sends a comment so
+// proxies keep the connection open
+const queueStreamKeepAlive = 15 * time.Second
+
+// QueueEvent is an event of the queue stream. Queue lists the builds queued
+// in the pool after the event, in the order they will be scheduled, and
+// Position is the 1-based position of the build in it.
+type QueueEvent struct {
+	ID        uint64    `json:"id"`
+	Type      string    `json:"type"`
+	Pool      string    `json:"pool"`
+	BuildID   string    `json:"build_id,omitempty"`
+	Tenant    string    `json:"tenant,omitempty"`
+	WorkerID  string    `json:"worker_id,omitempty"`
+	Status    string    `json:"status,omitempty"`
+	Position  int       `json:"position,omitempty"`
+	Queue     []string  `json:"queue"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// queueStream tracks the order of the queue of each pool and emits its
+// changes to the clients of the queue stream. It has a mutex of its own so
+// it can be updated with the coordinator's mutex held.
+type queueStream struct {
+	mutex       sync.Mutex
+	orders      map[string][]string
+	backlog     []QueueEvent
+	next        uint64
+	subscribers map[chan QueueEvent]struct{}
+}
+
+func newQueueStream() *queueStream {
+	return &queueStream{
+		orders:      make(map[string][]string),
+		subscribers: make(map[chan QueueEvent]struct{}),
+	}
+}
+
+// emit assigns the next ID to an event and sends it to the subscribers.
+// Subscribers that fell behind are disconnected. Must be called with the
+// mutex held.
+func (s *queueStream) emit(event QueueEvent) {
+	s.next++
+	event.ID = s.next
+	event.Timestamp = time.Now()
+	event.Queue = slices.Clone(s.orders[event.Pool])
+	if event.Queue == nil {
+		event.Queue = []string{}
+	}
+	if event.BuildID != "" {
+		event.Position = slices.Index(event.Queue, event.BuildID) + 1
+	}
+
+	s.backlog = append(s.backlog, event)
+	if len(s.backlog) > queueStreamBacklog {
+		s.backlog = slices.Delete(s.backlog, 0, len(s.backlog)-queueStreamBacklog)
+	}
+	for subscriber := range s.subscribers {
+		select {
+		case subscriber <- event:
+		default:
+			delete(s.subscribers, subscriber)
+			close(subscriber)
+		}
+	}
+}
+
+// track updates the order of a pool's queue, emitting an event for each
+// build that entered it and one if the builds already queued changed order
+func (s *queueStream) track(pool string, order []string, tenants map[string]string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	previous := s.orders[pool]
+	if slices.Equal(previous, order) {
+		return
+	}
+	known := make(map[string]bool, len(previous))
+	for _, id := range previous {
+		known[id] = true
+	}
+	current := make(map[string]bool, len(order))
+	for _, id := range order {
+		current[id] = true
+	}
+
+	s.orders[pool] = order
+	for _, id := range order {
+		if !known[id] {
+			s.emit(QueueEvent{Type: QueueEnqueued, Pool: pool, BuildID: id, Tenant: tenants[id]})
+		}
+	}
+
+	// The builds queued before may have changed order among themselves
+	staying := slices.DeleteFunc(slices.Clone(previous), func(id string) bool { return !current[id] })
+	reordered := slices.DeleteFunc(slices.Clone(order), func(id string) bool { return !known[id] })
+	if !slices.Equal(reordered, staying) {
+		s.emit(QueueEvent{Type: QueueReprioritized, Pool: pool})
+	}
+}
+
+// empty reports whether no build of a pool's queue was streamed as queued
+func (s *queueStream) empty(pool string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.orders[pool]) == 0
+}
+
+// remove takes a build out of its pool's queue and emits the event of it
+// leaving or finishing
+func (s *queueStream) remove(event QueueEvent) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if order, queued := s.orders[event.Pool]; queued {
+		s.orders[event.Pool] = slices.DeleteFunc(slices.Clone(order), func(id string) bool { return id == event.BuildID })
+	}
+	s.emit(event)
+}
+
+// subscribe returns the events after lastID and a channel of the events to
+// come, closed if the subscriber falls behind. Without lastID, or if events
+// after it were discarded, the events start with a snapshot of each pool's
+// queue.
+func (s *queueStream) subscribe(lastID uint64, resume bool) ([]QueueEvent, chan QueueEvent, func()) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var missed []QueueEvent
+	if resume && lastID <= s.next && (lastID == s.next || (len(s.backlog) > 0 && s.backlog[0].ID <= lastID+1)) {
+		for _, event := range s.backlog {
+			if event.ID > lastID {
+				missed = append(missed, event)
+			}
+		}
+	} else {
+		pools := slices.Sorted(maps.Keys(s.orders))
+		for _, pool := range pools {
+			missed = append(missed, QueueEvent{
+				ID:        s.next,
+				Type:      QueueSnapshot,
+				Pool:      pool,
+				Queue:     append([]string{}, s.orders[pool]...),
+				Timestamp: time.Now(),
+			})
+		}
+	}
+
+	events := make(chan QueueEvent, queueStreamBuffer)
+	s.subscribers[events] = struct{}{}
+	return missed, events, func() {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		if _, subscribed := s.subscribers[events]; subscribed {
+			delete(s.subscribers, events)
+			close(events)
+		}
+	}
+}
+
+// trackQueue updates the queue stream with the order the builds pending in
+// a pool will be scheduled in. Builds no longer queued, such as cancelled
+// builds waiting to be skipped, are left out.
+func (bc *BuildCoordinator) trackQueue(pool string, pending *fairshare.Queue, requests map[string]BuildRequest) {
+	if pending.Len() == 0 && bc.queueStream.empty(pool) {
+		return
+	}
+
+	bc.mutex.RLock()
+	defer bc.mutex.RUnlock()
+
+	state := bc.pendingState(pool, requests)
+	order := slices.DeleteFunc(pending.Order(state.running, state.eligible(bc, requests)), func(id string) bool {
+		progress, exists := bc.progress[id]
+		_, forwarded := bc.forwarded[id]
+		return !exists || forwarded || progress.Status != BuildStatusQueued
+	})
+	tenants := make(map[string]string, len(order))
+	for _, id := range order {
+		tenants[id] = requests[id].Tenant
+	}
+	bc.queueStream.track(pool, order, tenants)
+}
+
+// streamLifecycleEvent emits the builds leaving the queue to the queue
+// stream as they are assigned and as they finish
+func (bc *BuildCoordinator) streamLifecycleEvent(event events.Event) {
+	queueEvent := QueueEvent{
+		Pool:     pools.Normalize(event.Pool),
+		BuildID:  event.BuildID,
+		Tenant:   event.Tenant,
+		WorkerID: event.WorkerID,
+	}
+	switch event.Type {
+	case events.BuildScheduled:
+		queueEvent.Type = QueueAssigned
+	case events.BuildFinished:
+		queueEvent.Type = QueueCompleted
+		queueEvent.Status = event.Status
+	default:
+		return
+	}
+	bc.queueStream.remove(queueEvent)
+}
+
+// handleQueueStream streams the changes of the scheduling queues as
+// server-sent events until the client disconnects. Clients resume after
+// the last event they received with the Last-Event-ID header; pool limits
+// the stream to one pool.
+func (bc *BuildCoordinator) handleQueueStream(w http.ResponseWriter, r *http.Request) {
+	var lastID uint64
+	resume := false
+	if value := r.Header.Get("Last-Event-ID"); value != "" {
+		parsed, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid Last-Event-ID: "+value, http.StatusBadRequest)
+			return
+		}
+		lastID, resume = parsed, true
+	}
+	pool := r.URL.Query().Get("pool")
+
+	missed, updates, stop := bc.queueStream.subscribe(lastID, resume)
+	defer stop()
+
+	controller := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	write := func(event QueueEvent) bool {
+		if pool != "" && event.Pool != pools.Normalize(pool) {
+			return true
+		}
+		data, _ := json.Marshal(event)
+		if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data); err != nil {
+			return false
+		}
+		return true
+	}
+	for _, event := range missed {
+		if !write(event) {
+			return
+		}
+	}
+	if err := controller.Flush(); err != nil {
+		log.Printf("Failed to stream the queue: %v", err)
+		return
+	}
+
+	keepAlive := time.NewTicker(queueStreamKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case event, open := <-updates:
+			// Clients that fell behind resume from their last event
+			if !open || !write(event) {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		case <-bc.shutdown:
+			return
+		}
+		if err := controller.Flush(); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/rpc"
+	"os"
+	"strconv"
+	"time"
+
+	"distributed-gradle-building/audit"
+	"distributed-gradle-building/metrics"
+	"distributed-gradle-building/pools"
+	"distributed-gradle-building/protocol"
+)
+
+// Policies for the builds of a worker evicted for missed heartbeats
+const (
+	RecoveryRequeue = "requeue"
+	RecoveryFail    = "fail"
+)
+
+// RecoveryConfig configures how workers that stop sending heartbeats are
+// evicted and what happens to the builds they were running. A build is
+// re-queued at most MaxRequeues times, so a build that crashes its workers
+// eventually fails.
+type RecoveryConfig struct {
+	HeartbeatTimeout time.Duration `json:"heartbeat_timeout"`
+	Policy           string        `json:"policy"`
+	MaxRequeues      int           `json:"max_requeues"`
+}
+
+// defaultRecoveryConfig evicts workers after three missed heartbeats and
+// re-queues their builds twice
+func defaultRecoveryConfig() RecoveryConfig {
+	return RecoveryConfig{
+		HeartbeatTimeout: 90 * time.Second,
+		Policy:           RecoveryRequeue,
+		MaxRequeues:      2,
+	}
+}
+
+// loadRecoveryConfig loads stale build recovery settings from environment
+// variables
+func loadRecoveryConfig() RecoveryConfig {
+	config := defaultRecoveryConfig()
+
+	if value, err := time.ParseDuration(os.Getenv("WORKER_HEARTBEAT_TIMEOUT")); err == nil && value > 0 {
+		config.HeartbeatTimeout = value
+	}
+	switch policy := os.Getenv("STALE_BUILD_POLICY"); policy {
+	case "":
+	case RecoveryRequeue, RecoveryFail:
+		config.Policy = policy
+	default:
+		log.Printf("Unknown stale build policy %q, using %s", policy, config.Policy)
+	}
+	if value, err := strconv.Atoi(os.Getenv("STALE_BUILD_MAX_REQUEUES")); err == nil && value >= 0 {
+		config.MaxRequeues = value
+	}
+
+	return config
+}
+
+// inflightBuild is a build running on a worker
+type inflightBuild struct {
+	request BuildRequest
+	// client is the connection waiting for the worker's result
+	client *rpc.Client
+	// recovered is set once the worker was evicted and the build recovered
+	recovered bool
+}
+
+// track records a build started on the worker. Must be called with the
+// mutex held.
+func (w *Worker) track(request BuildRequest) {
+	if w.inflight == nil {
+		w.inflight = make(map[string]*inflightBuild)
+	}
+	w.inflight[request.RequestID] = &inflightBuild{request: request}
+}
+
+// attachClient records the connection waiting for a build's result. It
+// returns false, forgetting the build, if the worker was evicted in the
+// meantime.
+func (bc *BuildCoordinator) attachClient(worker *Worker, buildID string, client *rpc.Client) bool {
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+
+	build, exists := worker.inflight[buildID]
+	if !exists {
+		return true
+	}
+	if build.recovered {
+		delete(worker.inflight, buildID)
+		return false
+	}
+	build.client = client
+	return true
+}
+
+// untrackBuild forgets a build that returned from its worker. It reports
+// whether the build was already recovered after the worker was evicted, in
+// which case the worker's result must be ignored.
+func (bc *BuildCoordinator) untrackBuild(worker *Worker, buildID string) bool {
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+
+	build, exists := worker.inflight[buildID]
+	delete(worker.inflight, buildID)
+	return exists && build.recovered
+}
+
+// monitorWorkers evicts workers that stopped sending heartbeats
+func (bc *BuildCoordinator) monitorWorkers() {
+	interval := bc.recovery.HeartbeatTimeout / 3
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			bc.evictStaleWorkers(time.Now())
+		case <-bc.shutdown:
+			return
+		}
+	}
+}
+
+// evictStaleWorkers evicts the workers whose last heartbeat is older than
+// the heartbeat timeout and recovers their builds
+func (bc *BuildCoordinator) evictStaleWorkers(now time.Time) {
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+
+	for _, worker := range bc.workers {
+		if now.Sub(worker.LastPing) > bc.recovery.HeartbeatTimeout {
+			bc.evictWorker(worker)
+		}
+	}
+}
+
+// evictWorker removes a worker and recovers the builds it was running. The
+// worker registers again once it is back. Must be called with the mutex
+// held.
+func (bc *BuildCoordinator) evictWorker(worker *Worker) {
+	bc.removeWorker(worker)
+	bc.recordEvent(audit.Event{
+		Action:    audit.ActionWorkerEvicted,
+		Principal: "worker:" + worker.ID,
+		SourceIP:  worker.Host,
+		Resource:  worker.ID,
+		Details: map[string]string{
+			"last_heartbeat": worker.LastPing.Format(time.RFC3339),
+			"builds":         strconv.Itoa(len(worker.inflight)),
+		},
+	})
+	log.Printf("Worker %s evicted after no heartbeat since %s, recovering %d builds", worker.ID, worker.LastPing.Format(time.RFC3339), len(worker.inflight))
+	bc.recoverBuilds(worker, false)
+}
+
+// removeWorker removes a worker from the pool and the registry. Must be
+// called with the mutex held.
+func (bc *BuildCoordinator) removeWorker(worker *Worker) {
+	delete(bc.workers, worker.ID)
+	if err := bc.registry.Remove(worker.ID); err != nil {
+		log.Printf("Failed to update the worker registry: %v", err)
+	}
+}
+
+// recoverBuilds stops waiting for the results of the builds a removed worker
+// was running and recovers them. Must be called with the mutex held.
+func (bc *BuildCoordinator) recoverBuilds(worker *Worker, preempted bool) {
+	for _, build := range worker.inflight {
+		build.recovered = true
+		// Closing the connection ends the wait for the lost worker's result
+		if build.client != nil {
+			build.client.Close()
+		}
+		bc.recoverBuild(worker, build.request, preempted)
+	}
+}
+
+// recoverBuild re-queues or fails a build that was running on an evicted
+// worker, depending on the recovery policy. Builds of a preempted worker are
+// always re-queued, ahead of their tenant's other builds, and do not count
+// against MaxRequeues. A duplicated build keeps running on the other worker.
+// Must be called with the mutex held.
+func (bc *BuildCoordinator) recoverBuild(worker *Worker, request BuildRequest, preempted bool) {
+	buildID := request.RequestID
+	progress, exists := bc.progress[buildID]
+	if !exists || progress.finished() {
+		return
+	}
+
+	if spec, exists := bc.speculations[buildID]; exists {
+		bc.finishCopy(buildID, spec)
+		if spec.winner != "" {
+			return
+		}
+		if spec.running > 0 {
+			progress.WorkerID = spec.other(worker.ID)
+			log.Printf("Copy of build %s on evicted worker %s lost, waiting for the other copy", buildID, worker.ID)
+			return
+		}
+	}
+
+	pool := pools.Normalize(request.Pool)
+	message := fmt.Sprintf("worker %s stopped sending heartbeats", worker.ID)
+	requeue := bc.recovery.Policy == RecoveryRequeue && request.Requeues < bc.recovery.MaxRequeues
+	if preempted {
+		message = fmt.Sprintf("worker %s was preempted", worker.ID)
+		requeue = true
+	}
+	if requeue {
+		if bc.requeueBuild(request, progress, message, preempted) {
+			if preempted {
+				metrics.StaleBuilds.WithLabelValues(pool, metrics.StaleBuildPreempted).Inc()
+				log.Printf("Build %s re-queued after worker %s was preempted", buildID, worker.ID)
+			} else {
+				metrics.StaleBuilds.WithLabelValues(pool, metrics.StaleBuildRequeued).Inc()
+				log.Printf("Build %s re-queued after worker %s was evicted (%d of %d)", buildID, worker.ID, request.Requeues+1, bc.recovery.MaxRequeues)
+			}
+			return
+		}
+		message += " and the build queue is full"
+	}
+
+	metrics.StaleBuilds.WithLabelValues(pool, metrics.StaleBuildFailed).Inc()
+	bc.failBuild(buildID, protocol.ErrorInfra, message)
+}
+
+// requeueBuild queues a build that lost its worker again, counting it
+// against MaxRequeues unless the worker was preempted. It reports whether
+// the queue had room for the build. Must be called with the mutex held.
+func (bc *BuildCoordinator) requeueBuild(request BuildRequest, progress *BuildProgress, message string, preempted bool) bool {
+	if preempted {
+		request.Preempted = true
+	} else {
+		request.Requeues++
+	}
+	request.WorkerID = ""
+	request.QueuedAt = time.Now()
+	select {
+	case bc.queue(pools.Normalize(request.Pool)) <- request:
+	default:
+		return false
+	}
+
+	bc.requests[request.RequestID] = request
+	progress.Status = BuildStatusQueued
+	progress.WorkerID = ""
+	progress.Progress = 0
+	progress.Step = ""
+	progress.Message = message + ", build re-queued"
+	progress.StartedAt = time.Time{}
+	progress.UpdatedAt = time.Now()
+	bc.notifyProgress(request.RequestID)
+	return true
+}
+
+// retryBuild re-queues a build that failed on its worker for a retryable
+// reason, as long as the recovery policy re-queues builds and the build has
+// re-queues left. It reports whether the build was re-queued. Must be called
+// with the mutex held.
+func (bc *BuildCoordinator) retryBuild(buildID, workerID string, failure *protocol.BuildError) bool {
+	progress, exists := bc.progress[buildID]
+	if !exists || progress.finished() || !failure.Code.Retryable() {
+		return false
+	}
+	request, exists := bc.requests[buildID]
+	if !exists || bc.recovery.Policy != RecoveryRequeue || request.Requeues >= bc.recovery.MaxRequeues {
+		return false
+	}
+
+	message := fmt.Sprintf("build failed on worker %s with %s: %s", workerID, failure.Code, failure.Message)
+	if !bc.requeueBuild(request, progress, message, false) {
+		return false
+	}
+	metrics.StaleBuilds.WithLabelValues(pools.Normalize(request.Pool), metrics.StaleBuildRetried).Inc()
+	log.Printf("Build %s re-queued after %s on worker %s (%d of %d)", buildID, failure.Code, workerID, request.Requeues+1, bc.recovery.MaxRequeues)
+	return true
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/rpc"
+	"strconv"
+	"sync"
+	"time"
+
+	"distributed-gradle-building/audit"
+	"distributed-gradle-building/pools"
+	"distributed-gradle-building/registry"
+)
+
+// pingTimeout bounds connecting to and pinging a registered worker
+const pingTimeout = 5 * time.Second
+
+// RPC argument and reply types for the reconciliation ping
+type PingArgs struct {
+	Coordinator string `json:"coordinator"`
+}
+
+type PingReply struct {
+	ID              string `json:"id"`
+	ActiveBuilds    int    `json:"active_builds"`
+	MaxBuilds       int    `json:"max_builds"`
+	Version         string `json:"version"`
+	ProtocolVersion int    `json:"protocol_version"`
+	Pool            string `json:"pool"`
+}
+
+// registryEntry returns the registry entry of a worker
+func registryEntry(worker *Worker) registry.Entry {
+	return registry.Entry{
+		ID:              worker.ID,
+		Host:            worker.Host,
+		Port:            worker.Port,
+		Capabilities:    worker.Capabilities,
+		MaxBuilds:       worker.MaxBuilds,
+		Version:         worker.Version,
+		ProtocolVersion: worker.ProtocolVersion,
+		Pool:            worker.Pool,
+		RegisteredAt:    time.Now(),
+		Calibration:     worker.Calibration,
+		Spot:            worker.Spot,
+		Transport:       worker.Transport,
+		Quarantine:      worker.Quarantine,
+		Attestation:     worker.Attestation,
+	}
+}
+
+// reconcileWorkers reconnects to the workers in the registry after a
+// restart. Workers that answer, and were attested if the attestation policy
+// requires it, are restored with their current load; the others are removed
+// from the registry and register again when they start.
+// Workers polling for calls cannot be pinged and are restored as registered,
+// to be evicted if they do not resume their heartbeats.
+func (bc *BuildCoordinator) reconcileWorkers() {
+	entries := bc.registry.List()
+	if len(entries) == 0 {
+		return
+	}
+	log.Printf("Reconnecting to %d registered workers", len(entries))
+
+	var wg sync.WaitGroup
+	for _, entry := range entries {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if entry.Transport == TransportHTTP || entry.Transport == TransportPull {
+				bc.reconcileWorker(entry, registeredReply(entry), nil)
+				return
+			}
+			reply, err := pingWorker(entry, bc.federation.Name, pingTimeout)
+			bc.reconcileWorker(entry, reply, err)
+		}()
+	}
+	wg.Wait()
+}
+
+// reconcileWorker restores a registered worker from its ping reply, or
+// forgets it if the ping failed
+func (bc *BuildCoordinator) reconcileWorker(entry registry.Entry, reply PingReply, err error) {
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+
+	// The worker registered by itself in the meantime
+	if _, registered := bc.workers[entry.ID]; registered {
+		return
+	}
+
+	switch {
+	case err != nil:
+		err = fmt.Errorf("unreachable: %v", err)
+	case reply.ID != entry.ID:
+		err = fmt.Errorf("%s:%d is now worker %s", entry.Host, entry.Port, reply.ID)
+	case reply.ProtocolVersion < bc.minWorkerProtocol:
+		err = fmt.Errorf("protocol version %d is below %d", reply.ProtocolVersion, bc.minWorkerProtocol)
+	case len(bc.workers) >= bc.maxWorkers:
+		err = fmt.Errorf("maximum workers (%d) reached", bc.maxWorkers)
+	case bc.attestation != nil && entry.Attestation == nil:
+		err = fmt.Errorf("not attested")
+	case bc.attestation != nil:
+		err = bc.attestation.Allows(*entry.Attestation, bc.releasedBinaries())
+	}
+	if err != nil {
+		log.Printf("Not restoring worker %s: %v", entry.ID, err)
+		if err := bc.registry.Remove(entry.ID); err != nil {
+			log.Printf("Failed to update the worker registry: %v", err)
+		}
+		return
+	}
+
+	worker := &Worker{
+		ID:              entry.ID,
+		Host:            entry.Host,
+		Port:            entry.Port,
+		Capabilities:    entry.Capabilities,
+		LastPing:        time.Now(),
+		MaxBuilds:       reply.MaxBuilds,
+		ActiveBuilds:    reply.ActiveBuilds,
+		OrphanedBuilds:  reply.ActiveBuilds,
+		Version:         reply.Version,
+		ProtocolVersion: reply.ProtocolVersion,
+		Pool:            pools.Normalize(reply.Pool),
+		Calibration:     entry.Calibration,
+		Spot:            entry.Spot,
+		Transport:       entry.Transport,
+		Quarantine:      entry.Quarantine,
+		Attestation:     entry.Attestation,
+	}
+	if worker.Quarantine != nil {
+		bc.quarantined[worker.ID] = worker.Quarantine
+	}
+	if worker.MaxBuilds <= 0 {
+		worker.MaxBuilds = 1
+	}
+	worker.updateStatus()
+	bc.workers[worker.ID] = worker
+	if worker.pollsCalls() {
+		bc.mailbox(worker.ID)
+	}
+
+	bc.recordEvent(audit.Event{
+		Action:    audit.ActionWorkerRegistered,
+		Principal: "worker:" + worker.ID,
+		SourceIP:  worker.Host,
+		Resource:  worker.ID,
+		Details: map[string]string{
+			"port":          strconv.Itoa(worker.Port),
+			"max_builds":    strconv.Itoa(worker.MaxBuilds),
+			"version":       worker.Version,
+			"pool":          worker.Pool,
+			"restored":      "true",
+			"active_builds": strconv.Itoa(worker.ActiveBuilds),
+		},
+	})
+	log.Printf("Worker %s restored from the registry with %d of %d build slots in use", worker.ID, worker.ActiveBuilds, worker.MaxBuilds)
+}
+
+// pingWorker asks a registered worker for its identity and load. Workers
+// predating the ping reject the call and are assumed unchanged and idle.
+func pingWorker(entry registry.Entry, coordinator string, timeout time.Duration) (PingReply, error) {
+	conn, err := net.DialTimeout("tcp", fmt.Sprintf("%s:%d", entry.Host, entry.Port), timeout)
+	if err != nil {
+		return PingReply{}, err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	client := rpc.NewClient(conn)
+	defer client.Close()
+
+	var reply PingReply
+	err = client.Call("WorkerService.Ping", PingArgs{Coordinator: coordinator}, &reply)
+	if _, outdated := err.(rpc.ServerError); outdated {
+		return registeredReply(entry), nil
+	}
+	return reply, err
+}
+
+// registeredReply is the ping reply of an idle worker unchanged since it
+// registered
+func registeredReply(entry registry.Entry) PingReply {
+	return PingReply{
+		ID:              entry.ID,
+		MaxBuilds:       entry.MaxBuilds,
+		Version:         entry.Version,
+		ProtocolVersion: entry.ProtocolVersion,
+		Pool:            entry.Pool,
+	}
+}
+
+// releaseOrphanedBuilds frees the slots of builds a restored worker was
+// running before the restart once its heartbeat shows they finished. Must be
+// called with the mutex held.
+func (w *Worker) releaseOrphanedBuilds(reportedActive int) {
+	if w.OrphanedBuilds == 0 {
+		return
+	}
+	running := reportedActive - (w.ActiveBuilds - w.OrphanedBuilds)
+	if running < 0 {
+		running = 0
+	}
+	if running < w.OrphanedBuilds {
+		w.ActiveBuilds -= w.OrphanedBuilds - running
+		w.OrphanedBuilds = running
+	}
+}
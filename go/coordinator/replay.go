@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"distributed-gradle-building/pools"
+)
+
+// Errors of replaying builds that exist
+var (
+	errNoEnvironment     = fmt.Errorf("build has no recorded environment")
+	errWorkerNotInPool   = fmt.Errorf("worker is not in the build's pool")
+	errWorkerQuarantined = fmt.Errorf("worker is quarantined")
+)
+
+// ReplayBuildRequest is the optional body of POST /api/builds/{id}/replay
+type ReplayBuildRequest struct {
+	// WorkerID runs the replay on this worker only, by default on any
+	// worker of the build's pool
+	WorkerID string `json:"worker_id,omitempty"`
+}
+
+// withoutReplay clears the fields only replays set, so clients cannot pin
+// environments or workers of their own
+func (r BuildRequest) withoutReplay() BuildRequest {
+	r.Environment = nil
+	r.ReplayOf = ""
+	r.PinnedWorkerID = ""
+	return r
+}
+
+// replayRequest returns a request running a build again with the
+// environment it ran in: the same options, commit, Gradle version and
+// environment variables, on a worker with the same JDK and platform. It
+// always runs rather than reusing a cached result.
+func (bc *BuildCoordinator) replayRequest(buildID, workerID string) (BuildRequest, error) {
+	bc.mutex.RLock()
+	defer bc.mutex.RUnlock()
+
+	original, exists := bc.requests[buildID]
+	response := bc.builds[buildID]
+	if !exists || response == nil {
+		return BuildRequest{}, fmt.Errorf("build %s not found", buildID)
+	}
+	if response.Environment == nil {
+		return BuildRequest{}, errNoEnvironment
+	}
+	if workerID != "" {
+		worker, registered := bc.workers[workerID]
+		if !registered {
+			return BuildRequest{}, fmt.Errorf("worker %s not found", workerID)
+		}
+		if worker.pool() != pools.Normalize(original.Pool) {
+			return BuildRequest{}, errWorkerNotInPool
+		}
+		if worker.Quarantine != nil {
+			return BuildRequest{}, errWorkerQuarantined
+		}
+	}
+
+	// The task cache keys describe the original run, not what to pin
+	environment := *response.Environment
+	environment.CacheKeys = nil
+	environment.ResultCacheKey = ""
+
+	replay := original
+	replay.RequestID = ""
+	replay.WorkerID = ""
+	replay.Pool = ""
+	replay.Tenant = ""
+	replay.FederatedFrom = ""
+	replay.Requeues = 0
+	replay.Preempted = false
+	replay.Timestamp = time.Time{}
+	replay.Matrix = nil
+	replay.Sharding = nil
+	replay.GroupID = ""
+	replay.PipelineID = ""
+	replay.Stage = ""
+	replay.Publish = nil
+	replay.DependsOn = nil
+	replay.Force = true
+	if environment.Commit != "" {
+		replay.Ref = environment.Commit
+	}
+	if environment.GradleVersion != "" {
+		replay.GradleVersion = environment.GradleVersion
+	}
+	replay.Environment = &environment
+	replay.ReplayOf = buildID
+	replay.PinnedWorkerID = workerID
+	return replay, nil
+}
+
+// handleReplayBuild runs a build again with its recorded environment pinned
+func (bc *BuildCoordinator) handleReplayBuild(w http.ResponseWriter, r *http.Request) {
+	var body ReplayBuildRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	request, err := bc.replayRequest(r.PathValue("id"), body.WorkerID)
+	switch {
+	case err == errNoEnvironment || err == errWorkerNotInPool || err == errWorkerQuarantined:
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	bc.submitBuildRequest(w, r, request)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"sort"
+	"time"
+
+	"distributed-gradle-building/metrics"
+)
+
+// DefaultResultCacheTTL is how long a successful build's result is reused
+// for identical builds, unless BUILD_RESULT_CACHE_TTL is set
+const DefaultResultCacheTTL = 30 * time.Minute
+
+// cachedResult is the result of a successful build, reused until it expires
+type cachedResult struct {
+	buildID  string
+	response BuildResponse
+	expires  time.Time
+}
+
+// ResultCacheTTLFromEnv reads BUILD_RESULT_CACHE_TTL; "0" disables the
+// result cache
+func ResultCacheTTLFromEnv() time.Duration {
+	value := os.Getenv("BUILD_RESULT_CACHE_TTL")
+	if value == "" {
+		return DefaultResultCacheTTL
+	}
+
+	ttl, err := time.ParseDuration(value)
+	if err != nil || ttl < 0 {
+		log.Printf("Invalid BUILD_RESULT_CACHE_TTL %q, using %v", value, DefaultResultCacheTTL)
+		return DefaultResultCacheTTL
+	}
+	return ttl
+}
+
+// resultCacheKey hashes the inputs that determine a build's result. Only
+// builds of a repository are cached: a project path on the workers may
+// change between builds without the request changing. The credentials only
+// authenticate the checkout and the worker and cache settings only affect
+// where and how fast the build runs, so they are not part of the key. Test
+// shards run the part of the tests their historical durations assign them,
+// so they are not cached either.
+func resultCacheKey(request BuildRequest) string {
+	if request.RepoURL == "" || request.Shard != nil {
+		return ""
+	}
+
+	// Maps are marshaled with sorted keys and empty lists and maps are
+	// omitted, so equal requests hash equally
+	var secrets []string
+	if len(request.Secrets) > 0 {
+		secrets = slices.Clone(request.Secrets)
+		sort.Strings(secrets)
+	}
+	canonical, err := json.Marshal(struct {
+		RepoURL       string            `json:"repo_url"`
+		Ref           string            `json:"ref"`
+		ProjectPath   string            `json:"project_path"`
+		TaskName      string            `json:"task_name"`
+		GradleVersion string            `json:"gradle_version"`
+		BuildOptions  map[string]string `json:"build_options,omitempty"`
+		Secrets       []string          `json:"secrets,omitempty"`
+	}{
+		RepoURL:       request.RepoURL,
+		Ref:           request.Ref,
+		ProjectPath:   request.ProjectPath,
+		TaskName:      request.TaskName,
+		GradleVersion: request.GradleVersion,
+		BuildOptions:  request.BuildOptions,
+		Secrets:       secrets,
+	})
+	if err != nil {
+		return ""
+	}
+
+	sum := sha256.Sum256(canonical)
+	return hex.EncodeToString(sum[:])
+}
+
+// reuseResult completes a submitted build with the result of a recent
+// identical build, if there is one and the request does not force a
+// rebuild. Must be called with the mutex held.
+func (bc *BuildCoordinator) reuseResult(request BuildRequest, now time.Time) bool {
+	key := resultCacheKey(request)
+	if bc.resultTTL <= 0 || key == "" {
+		return false
+	}
+	if request.Force {
+		metrics.ResultCacheLookups.WithLabelValues(metrics.LookupForced).Inc()
+		return false
+	}
+
+	cached, exists := bc.results[key]
+	if !exists || !now.Before(cached.expires) {
+		metrics.ResultCacheLookups.WithLabelValues(metrics.LookupMiss).Inc()
+		return false
+	}
+	metrics.ResultCacheLookups.WithLabelValues(metrics.LookupHit).Inc()
+
+	response := cached.response
+	response.Artifacts = slices.Clone(response.Artifacts)
+	response.ArtifactDetails = slices.Clone(response.ArtifactDetails)
+	response.RequestID = request.RequestID
+	response.Timestamp = now
+	response.CachedFrom = cached.buildID
+
+	bc.builds[request.RequestID] = &response
+	bc.requests[request.RequestID] = request
+	bc.progress[request.RequestID] = &BuildProgress{
+		BuildID:   request.RequestID,
+		WorkerID:  response.WorkerID,
+		Status:    BuildStatusCompleted,
+		Progress:  100,
+		Step:      "completed",
+		Message:   fmt.Sprintf("reused the result of build %s", cached.buildID),
+		StartedAt: now,
+		UpdatedAt: now,
+	}
+	log.Printf("Build %s reused the result of build %s", request.RequestID, cached.buildID)
+	return true
+}
+
+// storeResult caches the result of a successful build and drops expired
+// results. Must be called with the mutex held.
+func (bc *BuildCoordinator) storeResult(buildID string, now time.Time) {
+	key := resultCacheKey(bc.requests[buildID])
+	response, exists := bc.builds[buildID]
+	if bc.resultTTL <= 0 || key == "" || !exists || !response.Success {
+		return
+	}
+
+	for k, cached := range bc.results {
+		if !now.Before(cached.expires) {
+			delete(bc.results, k)
+		}
+	}
+
+	bc.results[key] = cachedResult{
+		buildID:  buildID,
+		response: *response,
+		expires:  now.Add(bc.resultTTL),
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"time"
+
+	"distributed-gradle-building/pools"
+)
+
+// Outcomes of a scheduling attempt
+const (
+	ScheduleAssigned   = "assigned"
+	ScheduleNoCapacity = "no_capacity"
+)
+
+// Weights of the score components a worker is ranked by
+const (
+	resourceFitWeight   = 0.5
+	cacheAffinityWeight = 0.3
+	reliabilityWeight   = 0.2
+)
+
+// affinityWindow is the number of recent builds of a worker checked for
+// cache affinity
+const affinityWindow = 20
+
+// maxSchedulingAttempts is the number of attempts kept per build
+const maxSchedulingAttempts = 10
+
+// CandidateScore is how a worker scored when a build was scheduled.
+// ResourceFit is one minus the worker's load, CacheAffinity whether it
+// recently built the same project, and Reliability the smoothed share of its
+// builds that succeeded.
+type CandidateScore struct {
+	WorkerID      string  `json:"worker_id"`
+	Score         float64 `json:"score"`
+	ResourceFit   float64 `json:"resource_fit"`
+	CacheAffinity float64 `json:"cache_affinity"`
+	Reliability   float64 `json:"reliability"`
+	Load          float64 `json:"load"`
+	ActiveBuilds  int     `json:"active_builds"`
+	Spot          bool    `json:"spot,omitempty"`
+	Chosen        bool    `json:"chosen"`
+	Skipped       string  `json:"skipped,omitempty"`
+}
+
+// SchedulingAttempt records one attempt to place a build on a worker
+type SchedulingAttempt struct {
+	Time       time.Time        `json:"time"`
+	Requeues   int              `json:"requeues"`
+	Outcome    string           `json:"outcome"`
+	WorkerID   string           `json:"worker_id,omitempty"`
+	Candidates []CandidateScore `json:"candidates"`
+}
+
+// SchedulingDecision explains why a build went to its worker. Attempts are
+// oldest first; a build is attempted again when no worker had a free slot or
+// after it was re-queued.
+type SchedulingDecision struct {
+	BuildID  string              `json:"build_id"`
+	Pool     string              `json:"pool"`
+	Status   string              `json:"status"`
+	Attempts []SchedulingAttempt `json:"attempts"`
+}
+
+// workerReliability counts the finished builds of a worker. Recent are the
+// outcomes of its last builds in the quarantine window, oldest first.
+type workerReliability struct {
+	succeeded int
+	failed    int
+	recent    []bool
+}
+
+// score returns the share of builds that succeeded, smoothed so that workers
+// without history are neutral
+func (r workerReliability) score() float64 {
+	return float64(r.succeeded+1) / float64(r.succeeded+r.failed+2)
+}
+
+// rankWorkers scores the workers a build may go to, best first. Ties keep the
+// least loaded order of the workers. Spot workers come last for builds that
+// avoid them. Must be called with the mutex held.
+func (bc *BuildCoordinator) rankWorkers(workers []*Worker, request BuildRequest, avoidSpot bool) ([]*Worker, []CandidateScore) {
+	scores := make([]CandidateScore, len(workers))
+	for i, worker := range workers {
+		load := workerLoad(worker)
+		candidate := CandidateScore{
+			WorkerID:     worker.ID,
+			ResourceFit:  1 - load,
+			Reliability:  bc.reliability[worker.ID].score(),
+			Load:         load,
+			ActiveBuilds: worker.ActiveBuilds,
+			Spot:         worker.Spot,
+		}
+		if hasCacheAffinity(worker, request.ProjectPath) {
+			candidate.CacheAffinity = 1
+		}
+		candidate.Score = resourceFitWeight*candidate.ResourceFit +
+			cacheAffinityWeight*candidate.CacheAffinity +
+			reliabilityWeight*candidate.Reliability
+		scores[i] = candidate
+	}
+
+	order := make([]int, len(workers))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		first, second := scores[order[i]], scores[order[j]]
+		if avoidSpot && first.Spot != second.Spot {
+			return second.Spot
+		}
+		return first.Score > second.Score
+	})
+
+	ranked := make([]*Worker, len(workers))
+	candidates := make([]CandidateScore, len(workers))
+	for i, index := range order {
+		ranked[i] = workers[index]
+		candidates[i] = scores[index]
+	}
+	return ranked, candidates
+}
+
+// hasCacheAffinity reports whether a worker recently built a project, so its
+// build cache is likely warm
+func hasCacheAffinity(worker *Worker, projectPath string) bool {
+	builds := worker.Builds[max(len(worker.Builds)-affinityWindow, 0):]
+	return slices.ContainsFunc(builds, func(build BuildRequest) bool {
+		return build.ProjectPath == projectPath
+	})
+}
+
+// recordSchedulingAttempt keeps an attempt to schedule a build, dropping the
+// oldest attempts beyond maxSchedulingAttempts
+func (bc *BuildCoordinator) recordSchedulingAttempt(buildID string, attempt SchedulingAttempt) {
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+
+	attempts := append(bc.scheduling[buildID], attempt)
+	bc.scheduling[buildID] = attempts[max(len(attempts)-maxSchedulingAttempts, 0):]
+}
+
+// recordBuildOutcome counts a finished build towards the reliability of its
+// worker, quarantining the worker if too many of its recent builds failed.
+// Must be called with the mutex held.
+func (bc *BuildCoordinator) recordBuildOutcome(workerID string, success bool) {
+	reliability := bc.reliability[workerID]
+	if success {
+		reliability.succeeded++
+	} else {
+		reliability.failed++
+	}
+	recent := append(reliability.recent, success)
+	reliability.recent = recent[max(len(recent)-bc.quarantine.Window, 0):]
+	bc.reliability[workerID] = reliability
+	bc.checkFailureRate(workerID)
+}
+
+// GetSchedulingDecision returns how a build was scheduled. A build that was
+// not attempted yet has no attempts.
+func (bc *BuildCoordinator) GetSchedulingDecision(buildID string) (*SchedulingDecision, error) {
+	bc.mutex.RLock()
+	defer bc.mutex.RUnlock()
+
+	progress, exists := bc.progress[buildID]
+	if !exists {
+		return nil, fmt.Errorf("build %s not found", buildID)
+	}
+
+	decision := SchedulingDecision{
+		BuildID:  buildID,
+		Pool:     pools.Normalize(bc.requests[buildID].Pool),
+		Status:   progress.Status,
+		Attempts: make([]SchedulingAttempt, 0),
+	}
+	decision.Attempts = append(decision.Attempts, bc.scheduling[buildID]...)
+	return &decision, nil
+}
+
+func (bc *BuildCoordinator) handleGetScheduling(w http.ResponseWriter, r *http.Request) {
+	decision, err := bc.GetSchedulingDecision(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(decision)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"distributed-gradle-building/audit"
+	"distributed-gradle-building/authz"
+	"distributed-gradle-building/federation"
+	"distributed-gradle-building/gradledist"
+	"distributed-gradle-building/ml/service"
+	"distributed-gradle-building/testshard"
+)
+
+// maxTestShards is the largest number of builds the tests of a request may
+// be split across
+const maxTestShards = 32
+
+// TestSharding splits the test classes of a build request across Shards
+// child builds run in parallel. Each child runs the request's task with its
+// test tasks restricted to a share of the classes of about equal historical
+// duration.
+type TestSharding struct {
+	Shards int `json:"shards"`
+}
+
+// expandShards returns the child builds of a sharded request with the shard
+// each runs, balanced by the durations of the project's test classes
+func expandShards(request BuildRequest, durations map[string]time.Duration) ([]BuildRequest, []map[string]string, error) {
+	sharding := request.Sharding
+	if sharding == nil {
+		return nil, nil, fmt.Errorf("request has no test sharding")
+	}
+	if sharding.Shards < 2 || sharding.Shards > maxTestShards {
+		return nil, nil, fmt.Errorf("test sharding needs between 2 and %d shards", maxTestShards)
+	}
+
+	children := make([]BuildRequest, sharding.Shards)
+	values := make([]map[string]string, sharding.Shards)
+	for i := range children {
+		child := request
+		child.Sharding = nil
+		child.Shard = &testshard.Shard{Index: i, Count: sharding.Shards, Durations: durations}
+		children[i] = child
+		values[i] = map[string]string{"shard": fmt.Sprintf("%d/%d", i+1, sharding.Shards)}
+	}
+	return children, values, nil
+}
+
+// testDurations returns the historical durations of the test classes of a
+// project, or none while the ML service is unavailable, in which case the
+// classes are split by count
+func (bc *BuildCoordinator) testDurations(projectPath string) map[string]time.Duration {
+	if bc.ml == nil {
+		return nil
+	}
+	durations, err := bc.ml.TestDurations(context.Background(), projectPath)
+	if err != nil {
+		log.Printf("Sharding the tests of %s without their durations: %v", projectPath, err)
+		return nil
+	}
+	return durations
+}
+
+// SubmitShards queues a child build per test shard of a sharded request and
+// returns the ID of their group and of the children
+func (bc *BuildCoordinator) SubmitShards(request BuildRequest) (string, []string, error) {
+	children, values, err := expandShards(request, bc.testDurations(request.ProjectPath))
+	if err != nil {
+		return "", nil, err
+	}
+
+	sharding := *request.Sharding
+	return bc.submitGroup(&buildGroup{sharding: &sharding, createdAt: time.Now(), values: values}, children, "test shard")
+}
+
+// handleShardedRequest validates a sharded request like a single build
+// before queueing its shards
+func (bc *BuildCoordinator) handleShardedRequest(w http.ResponseWriter, r *http.Request, request BuildRequest) {
+	if _, _, err := expandShards(request, nil); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := bc.validateBuildRequest(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if request.GradleVersion != "" && !gradledist.ValidVersion(request.GradleVersion) {
+		http.Error(w, fmt.Sprintf("invalid gradle version %q", request.GradleVersion), http.StatusBadRequest)
+		return
+	}
+	if !bc.authorize(w, r, authz.ActionBuildSubmit, buildResource(request)) {
+		return
+	}
+	if err := bc.admitBuild(request); err != nil {
+		log.Printf("Rejected build of %s at %s: %v", request.RepoURL, request.Ref, err)
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	request.Tenant = bc.rateLimiter.Tenant(r)
+	request.FederatedFrom = r.Header.Get(federation.ForwardedHeader)
+	groupID, buildIDs, err := bc.SubmitShards(request)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	bc.auditLog.RecordRequest(r, audit.ActionBuildSubmitted, groupID, map[string]string{
+		"project_path": request.ProjectPath,
+		"task_name":    request.TaskName,
+		"tenant":       request.Tenant,
+		"shards":       strconv.Itoa(len(buildIDs)),
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(SubmitBuildResponse{BuildID: groupID, Status: BuildStatusQueued, Children: buildIDs})
+}
+
+// testResultsOf sums up the JUnit results of test classes
+func testResultsOf(classes []testshard.ClassResult) TestResults {
+	var results TestResults
+	for _, class := range classes {
+		results.Total += class.Tests
+		results.Failed += class.Failures
+		results.Skipped += class.Skipped
+		results.Duration += class.Duration
+	}
+	results.Passed = results.Total - results.Failed - results.Skipped
+	return results
+}
+
+// ReportTestResults records the JUnit results of the test classes a build
+// ran, whether or not it succeeded. They are also recorded in the ML
+// service, which balances later test shards of the project by the durations
+// of the classes and detects flaky tests from the outcomes of their cases.
+func (bc *BuildCoordinator) ReportTestResults(args *ReportTestResultsArgs, reply *ReportTestResultsReply) error {
+	bc.mutex.Lock()
+	response, exists := bc.builds[args.BuildID]
+	if !exists {
+		bc.mutex.Unlock()
+		return fmt.Errorf("build %s not found", args.BuildID)
+	}
+
+	// Both copies of a duplicated build run the same tests
+	spec, duplicated := bc.speculations[args.BuildID]
+	if !duplicated || (args.WorkerID != spec.primary && args.WorkerID != spec.backup) {
+		if progress, exists := bc.progress[args.BuildID]; exists && progress.WorkerID != args.WorkerID {
+			bc.mutex.Unlock()
+			return fmt.Errorf("build %s is not assigned to worker %s", args.BuildID, args.WorkerID)
+		}
+	}
+
+	response.TestClasses = args.Classes
+	response.Metrics.TestResults = testResultsOf(args.Classes)
+	request := bc.requests[args.BuildID]
+	bc.mutex.Unlock()
+
+	run := service.TestRun{ProjectPath: request.ProjectPath, BuildID: args.BuildID, Commit: args.Commit, Time: time.Now(), Classes: args.Classes}
+	if bc.ml != nil && len(args.Classes) > 0 {
+		go func() {
+			if err := bc.ml.RecordTestResults(context.Background(), run); err != nil {
+				log.Printf("Failed to record the test results of build %s: %v", args.BuildID, err)
+			}
+		}()
+	}
+
+	reply.Message = fmt.Sprintf("Recorded results of %d test classes for build %s", len(args.Classes), args.BuildID)
+	return nil
+}
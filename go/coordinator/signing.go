@@ -0,0 +1,21 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"distributed-gradle-building/signing"
+)
+
+// handleSigningKeys publishes the public keys build results and artifact
+// manifests are signed with, without authentication so clients can fetch
+// them before they hold a token
+func (bc *BuildCoordinator) handleSigningKeys(w http.ResponseWriter, r *http.Request) {
+	keys := signing.KeySet{Keys: []signing.PublicKey{}}
+	if bc.signer != nil {
+		keys.Keys = append(keys.Keys, bc.signer.PublicKey())
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(keys)
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"distributed-gradle-building/buildstore"
+	"distributed-gradle-building/calibration"
+	"distributed-gradle-building/metrics"
+	"distributed-gradle-building/ml/service"
+	"distributed-gradle-building/protocol"
+)
+
+// SpeculationConfig configures speculative execution: a build that runs
+// ThresholdPercent longer than predicted is duplicated on a second worker and
+// the first successful copy wins. Only builds marked critical or predicted to
+// take at least MinDuration are duplicated.
+type SpeculationConfig struct {
+	Enabled          bool          `json:"enabled"`
+	ThresholdPercent int           `json:"threshold_percent"`
+	MinDuration      time.Duration `json:"min_duration"`
+	MinSamples       int           `json:"min_samples"`
+	RetryInterval    time.Duration `json:"retry_interval"`
+}
+
+// predictionWindow is how many recent successful builds a prediction uses
+const predictionWindow = 20
+
+// loadSpeculationConfig loads speculative execution settings from
+// environment variables
+func loadSpeculationConfig() SpeculationConfig {
+	config := SpeculationConfig{
+		ThresholdPercent: 50,
+		MinDuration:      5 * time.Minute,
+		MinSamples:       5,
+		RetryInterval:    10 * time.Second,
+	}
+
+	if value, err := strconv.ParseBool(os.Getenv("SPECULATION_ENABLED")); err == nil {
+		config.Enabled = value
+	}
+	if value, err := strconv.Atoi(os.Getenv("SPECULATION_THRESHOLD_PERCENT")); err == nil && value >= 0 {
+		config.ThresholdPercent = value
+	}
+	if value, err := time.ParseDuration(os.Getenv("SPECULATION_MIN_DURATION")); err == nil && value >= 0 {
+		config.MinDuration = value
+	}
+	if value, err := strconv.Atoi(os.Getenv("SPECULATION_MIN_SAMPLES")); err == nil && value > 0 {
+		config.MinSamples = value
+	}
+
+	return config
+}
+
+// speculation tracks the two copies of a duplicated build
+type speculation struct {
+	primary string
+	backup  string
+	// running counts the copies that have not finished
+	running int
+	// winner is the worker whose copy succeeded first, and loser the worker
+	// told to stop its copy
+	winner string
+	loser  string
+	// artifacts holds the artifacts reported by each copy until one wins
+	artifacts map[string]*ReportArtifactsArgs
+}
+
+// other returns the worker running the other copy
+func (s *speculation) other(workerID string) string {
+	if workerID == s.primary {
+		return s.backup
+	}
+	return s.primary
+}
+
+// predictDuration predicts how long a build runs on a worker, or on a
+// typical worker if nil, with the ML service when one is configured and
+// otherwise from the recent builds of the same project and task, if there
+// are enough of them
+func (bc *BuildCoordinator) predictDuration(request BuildRequest, worker *Worker) (time.Duration, bool) {
+	speed := bc.workerSpeed(worker)
+	if bc.ml != nil {
+		prediction := service.PredictionRequest{
+			ProjectPath:  request.ProjectPath,
+			TaskName:     request.TaskName,
+			BuildOptions: request.BuildOptions,
+			WorkerSpeed:  speed,
+		}
+		if worker != nil {
+			prediction.WorkerID = worker.ID
+		}
+		result, err := bc.ml.PredictOnWorker(context.Background(), prediction)
+		if err != nil || result.SampleSize == 0 || result.SampleSize < bc.speculation.MinSamples {
+			return 0, false
+		}
+		return result.PredictedTime, true
+	}
+
+	duration, samples := bc.medianDuration(request.ProjectPath, request.TaskName)
+	if samples == 0 || samples < bc.speculation.MinSamples {
+		return 0, false
+	}
+	if speed > 0 {
+		duration = time.Duration(float64(duration) / speed)
+	}
+	return duration, true
+}
+
+// medianDuration returns the median duration of the recent successful
+// builds of a project and task, and how many there were
+func (bc *BuildCoordinator) medianDuration(projectPath, taskName string) (time.Duration, int) {
+	records, err := bc.buildStore.Query(buildstore.Filter{ProjectPath: projectPath})
+	if err != nil {
+		log.Printf("Failed to read build history for %s: %v", projectPath, err)
+		return 0, 0
+	}
+
+	var durations []time.Duration
+	for i := len(records) - 1; i >= 0 && len(durations) < predictionWindow; i-- {
+		record := records[i]
+		if record.TaskName == taskName && record.Status == buildstore.StatusCompleted && record.Duration > 0 {
+			durations = append(durations, record.Duration)
+		}
+	}
+	if len(durations) == 0 {
+		return 0, 0
+	}
+
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	return durations[len(durations)/2], len(durations)
+}
+
+// localPredictor answers the predictions of the ML service from the
+// coordinator's own build history while the ML service is down
+type localPredictor struct {
+	bc *BuildCoordinator
+}
+
+func (p localPredictor) GetBuildInsights(projectPath, taskName string, buildOptions map[string]string) service.PredictionResult {
+	duration, samples := p.bc.medianDuration(projectPath, taskName)
+	return service.PredictionResult{
+		PredictedTime: duration,
+		P50Time:       duration,
+		P90Time:       duration,
+		SampleSize:    samples,
+		Basis:         "coordinator build history",
+		Factors:       []service.PredictionFactor{},
+	}
+}
+
+func (p localPredictor) PredictScalingNeeds(queueLength int, avgCPULoad float64, currentWorkers int) service.ScalingRecommendation {
+	return service.ScalingRecommendation{
+		Action:        "maintain",
+		WorkersNeeded: currentWorkers,
+		Reason:        "ML service unavailable",
+	}
+}
+
+// speculationDeadline returns how long a build may run on its first worker
+// before it is duplicated, and false if it is not duplicated
+func (bc *BuildCoordinator) speculationDeadline(request BuildRequest, worker *Worker) (time.Duration, bool) {
+	if !bc.speculation.Enabled {
+		return 0, false
+	}
+
+	predicted, ok := bc.predictDuration(request, worker)
+	if !ok || (!request.Critical && predicted < bc.speculation.MinDuration) {
+		return 0, false
+	}
+	return predicted + predicted*time.Duration(bc.speculation.ThresholdPercent)/100, true
+}
+
+// workerSpeed returns how fast the calibration benchmark of a worker ran
+// relative to that of a typical worker of the fleet, 2 for twice as fast,
+// and 0 for uncalibrated workers
+func (bc *BuildCoordinator) workerSpeed(worker *Worker) float64 {
+	if worker == nil || worker.Calibration == nil {
+		return 0
+	}
+
+	bc.mutex.RLock()
+	var fleet []calibration.Scores
+	for _, other := range bc.workers {
+		if other.Calibration != nil {
+			fleet = append(fleet, *other.Calibration)
+		}
+	}
+	bc.mutex.RUnlock()
+
+	return worker.Calibration.Speed(calibration.Reference(fleet))
+}
+
+// watchForSlowdown duplicates a build on another worker once it has run past
+// its deadline on the first one, until done is closed. A build whose copies
+// have already been started is not watched again.
+func (bc *BuildCoordinator) watchForSlowdown(worker *Worker, request BuildRequest, done <-chan struct{}) {
+	bc.mutex.RLock()
+	_, speculated := bc.speculations[request.RequestID]
+	bc.mutex.RUnlock()
+	if speculated {
+		return
+	}
+
+	deadline, ok := bc.speculationDeadline(request, worker)
+	if !ok {
+		return
+	}
+
+	timer := time.NewTimer(deadline)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-done:
+		return
+	case <-bc.shutdown:
+		return
+	}
+
+	log.Printf("Build %s is running past its predicted duration on worker %s, starting a speculative copy", request.RequestID, worker.ID)
+	for !bc.launchBackup(worker, request) {
+		select {
+		case <-time.After(bc.speculation.RetryInterval):
+		case <-done:
+			return
+		case <-bc.shutdown:
+			return
+		}
+	}
+}
+
+// launchBackup starts a copy of a running build on the least loaded other
+// worker of its pool with a free slot. It returns true once there is nothing left to do:
+// the copy was started or the build is no longer running.
+func (bc *BuildCoordinator) launchBackup(primary *Worker, request BuildRequest) bool {
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+
+	progress, exists := bc.progress[request.RequestID]
+	if !exists || progress.Status != BuildStatusRunning {
+		return true
+	}
+
+	for _, worker := range bc.getPoolWorkers(request.Pool) {
+		// The copy needs devices of its own
+		backup := request
+		if worker.ID == primary.ID || !worker.acquireDevices(&backup) {
+			continue
+		}
+
+		worker.ActiveBuilds++
+		worker.updateStatus()
+		worker.Builds = append(worker.Builds, request)
+		worker.track(request)
+		bc.speculations[request.RequestID] = &speculation{
+			primary:   primary.ID,
+			backup:    worker.ID,
+			running:   2,
+			artifacts: make(map[string]*ReportArtifactsArgs),
+		}
+		metrics.SpeculativeExecutions.WithLabelValues(metrics.SpeculationLaunched).Inc()
+		log.Printf("Build %s duplicated on worker %s", request.RequestID, worker.ID)
+
+		go bc.executeBuildOnWorker(worker, backup)
+		return true
+	}
+	return false
+}
+
+// buildSucceeded completes a build once a copy of it succeeds. The first
+// successful copy of a duplicated build wins and the other one is cancelled.
+func (bc *BuildCoordinator) buildSucceeded(buildID, workerID string) {
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+
+	bc.recordBuildOutcome(workerID, true)
+	if spec, exists := bc.speculations[buildID]; exists {
+		bc.finishCopy(buildID, spec)
+		if spec.winner != "" {
+			return
+		}
+		spec.winner = workerID
+		spec.loser = spec.other(workerID)
+		if artifacts := spec.artifacts[workerID]; artifacts != nil {
+			bc.applyArtifacts(buildID, artifacts)
+		}
+		if progress, exists := bc.progress[buildID]; exists {
+			progress.WorkerID = workerID
+		}
+
+		outcome := metrics.SpeculationPrimaryWon
+		if workerID == spec.backup {
+			outcome = metrics.SpeculationBackupWon
+		}
+		metrics.SpeculativeExecutions.WithLabelValues(outcome).Inc()
+		log.Printf("Build %s won by worker %s, cancelling the copy on worker %s", buildID, workerID, spec.loser)
+	}
+	bc.completeBuild(buildID, workerID)
+}
+
+// buildFailed fails a build once a copy of it fails. A duplicated build only
+// fails when neither copy succeeds, and a build failing with a retryable
+// error is re-queued instead while it has re-queues left.
+func (bc *BuildCoordinator) buildFailed(buildID, workerID string, failure *protocol.BuildError) {
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+
+	if spec, exists := bc.speculations[buildID]; exists {
+		bc.finishCopy(buildID, spec)
+		if spec.winner != "" {
+			return
+		}
+		bc.recordFailureOutcome(workerID, failure.Code)
+		if spec.running > 0 {
+			// The other copy now reports the build's progress
+			if progress, exists := bc.progress[buildID]; exists {
+				progress.WorkerID = spec.other(workerID)
+			}
+			log.Printf("Copy of build %s on worker %s failed, waiting for the other copy: %s", buildID, workerID, failure.Message)
+			return
+		}
+		metrics.SpeculativeExecutions.WithLabelValues(metrics.SpeculationBothFailed).Inc()
+	} else if progress, exists := bc.progress[buildID]; !exists || progress.Status != BuildStatusCancelled {
+		// Cancelled builds say nothing about their worker
+		bc.recordFailureOutcome(workerID, failure.Code)
+	}
+	if bc.retryBuild(buildID, workerID, failure) {
+		return
+	}
+	bc.failBuild(buildID, failure.Code, failure.Message)
+}
+
+// recordFailureOutcome counts a failed build against the reliability of its
+// worker, unless the failure was the build's own. Must be called with the
+// mutex held.
+func (bc *BuildCoordinator) recordFailureOutcome(workerID string, code protocol.ErrorCode) {
+	switch code {
+	case protocol.ErrorCompile, protocol.ErrorTestFailure, protocol.ErrorCancelled:
+		return
+	}
+	bc.recordBuildOutcome(workerID, false)
+}
+
+// speculativeReport checks a progress report for a duplicated build. It
+// returns the winning worker if the reporting copy lost, and whether the
+// report is from the copy whose progress the build shows. Must be called
+// with the mutex held.
+func (bc *BuildCoordinator) speculativeReport(buildID, workerID string) (winner string, current bool) {
+	spec, exists := bc.speculations[buildID]
+	if !exists {
+		return "", true
+	}
+	if workerID == spec.loser {
+		return spec.winner, false
+	}
+
+	progress, exists := bc.progress[buildID]
+	return "", exists && progress.WorkerID == workerID
+}
+
+// finishCopy counts a finished copy of a duplicated build and forgets the
+// build once both copies have finished. Must be called with the mutex held.
+func (bc *BuildCoordinator) finishCopy(buildID string, spec *speculation) {
+	spec.running--
+	if spec.running <= 0 {
+		delete(bc.speculations, buildID)
+	}
+}
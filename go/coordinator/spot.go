@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+
+	"distributed-gradle-building/audit"
+)
+
+// SpotConfig configures scheduling on spot workers, which run on preemptible
+// instances. Builds predicted to take at least MaxDuration prefer other
+// workers, as a preemption would lose more of their work; 0 lets every build
+// run on spot workers alike.
+type SpotConfig struct {
+	MaxDuration time.Duration `json:"max_duration"`
+}
+
+// defaultSpotConfig keeps builds predicted to take 10 minutes or more off
+// spot workers while others are free
+func defaultSpotConfig() SpotConfig {
+	return SpotConfig{MaxDuration: 10 * time.Minute}
+}
+
+// loadSpotConfig loads spot worker settings from environment variables
+func loadSpotConfig() SpotConfig {
+	config := defaultSpotConfig()
+
+	if value, err := time.ParseDuration(os.Getenv("SPOT_MAX_BUILD_DURATION")); err == nil && value >= 0 {
+		config.MaxDuration = value
+	}
+
+	return config
+}
+
+// RPC argument and reply types for preemption notices
+type ReportPreemptionArgs struct {
+	ID string `json:"id"`
+	// Reason is how the worker learned of its termination, such as the
+	// metadata endpoint or SIGTERM
+	Reason string `json:"reason"`
+}
+
+type ReportPreemptionReply struct {
+	Message string `json:"message"`
+	// Builds is how many builds the worker was running
+	Builds int `json:"builds"`
+}
+
+// avoidsSpotWorkers reports whether a build should run on a spot worker only
+// if no other worker is free: builds that were preempted before, and builds
+// predicted to take at least the spot configuration's MaxDuration. The
+// duration is only predicted when spot workers are among the candidates.
+func (bc *BuildCoordinator) avoidsSpotWorkers(request BuildRequest, workers []*Worker) bool {
+	if !slices.ContainsFunc(workers, func(worker *Worker) bool { return worker.Spot }) {
+		return false
+	}
+	if request.Preempted {
+		return true
+	}
+	if bc.spot.MaxDuration <= 0 {
+		return false
+	}
+	predicted, ok := bc.predictDuration(request, nil)
+	return ok && predicted >= bc.spot.MaxDuration
+}
+
+// ReportPreemption removes a spot worker that is about to be terminated and
+// re-queues the builds it was running, ahead of their tenants' other builds
+// RPC method signature: func (t *T) MethodName(args *ArgType, reply *ReplyType) error
+func (bc *BuildCoordinator) ReportPreemption(args *ReportPreemptionArgs, reply *ReportPreemptionReply) error {
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+
+	worker, exists := bc.workers[args.ID]
+	if !exists {
+		return fmt.Errorf("worker %s not found", args.ID)
+	}
+
+	bc.removeWorker(worker)
+	bc.recordEvent(audit.Event{
+		Action:    audit.ActionWorkerPreempted,
+		Principal: "worker:" + worker.ID,
+		SourceIP:  worker.Host,
+		Resource:  worker.ID,
+		Details: map[string]string{
+			"reason": args.Reason,
+			"builds": strconv.Itoa(len(worker.inflight)),
+		},
+	})
+	log.Printf("Worker %s preempted (%s), re-queuing %d builds", worker.ID, args.Reason, len(worker.inflight))
+	bc.recoverBuilds(worker, true)
+
+	reply.Builds = len(worker.inflight)
+	reply.Message = fmt.Sprintf("Worker %s removed after preemption", worker.ID)
+	return nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"distributed-gradle-building/buildstore"
+	"distributed-gradle-building/events"
+	"distributed-gradle-building/gitsource"
+	"distributed-gradle-building/scmstatus"
+)
+
+// maxStatusDescription is the longest description reported on a commit;
+// Bitbucket and GitLab reject longer ones
+const maxStatusDescription = 140
+
+// StatusReportConfig configures the source code hosts builds report their
+// status to. Builds are reported on the commit of their commit tag, or their
+// ref if it is a commit hash, in the repository of their repo tag or URL.
+type StatusReportConfig struct {
+	Reporters []scmstatus.Config `json:"reporters"`
+	// URL is the address of the coordinator linked from statuses
+	URL string `json:"url,omitempty"`
+	// Context prefixes the names of the statuses
+	Context string `json:"context"`
+}
+
+// defaultStatusReportConfig reports nothing, naming statuses after the
+// service once reporters are configured
+func defaultStatusReportConfig() StatusReportConfig {
+	return StatusReportConfig{Context: "distributed-gradle"}
+}
+
+// loadStatusReportConfig loads the reporters from the JSON array
+// SCM_STATUS_REPORTERS, the coordinator address from SCM_STATUS_URL and the
+// prefix of the status names from SCM_STATUS_CONTEXT
+func loadStatusReportConfig() (StatusReportConfig, error) {
+	config := defaultStatusReportConfig()
+
+	if value := os.Getenv("SCM_STATUS_REPORTERS"); value != "" {
+		if err := json.Unmarshal([]byte(value), &config.Reporters); err != nil {
+			return config, fmt.Errorf("failed to parse SCM_STATUS_REPORTERS: %v", err)
+		}
+	}
+	for _, reporter := range config.Reporters {
+		if reporter.Kind == "" || reporter.TokenSecret == "" {
+			return config, fmt.Errorf("status reporters require kind and token_secret")
+		}
+	}
+	config.URL = strings.TrimSuffix(os.Getenv("SCM_STATUS_URL"), "/")
+	if value := os.Getenv("SCM_STATUS_CONTEXT"); value != "" {
+		config.Context = value
+	}
+
+	return config, nil
+}
+
+// Enabled reports whether any reporters are configured
+func (c StatusReportConfig) Enabled() bool {
+	return len(c.Reporters) > 0
+}
+
+// reportStatus reports the status of a build on its commit as it is
+// submitted, starts and finishes. Builds without a commit, or in
+// repositories of hosts without a reporter, are not reported. Must be
+// called with the mutex held.
+func (bc *BuildCoordinator) reportStatus(event events.Event) {
+	if bc.statuses == nil {
+		return
+	}
+	request, exists := bc.requests[event.BuildID]
+	if !exists {
+		return
+	}
+
+	status := scmstatus.Status{BuildID: event.BuildID}
+	switch event.Type {
+	case events.BuildSubmitted:
+		status.State, status.Description = scmstatus.StatePending, "Queued"
+	case events.BuildStarted:
+		status.State, status.Description = scmstatus.StateRunning, "Running on "+event.WorkerID
+	case events.BuildFinished:
+		status.State, status.Description = finishedStatus(event)
+	default:
+		return
+	}
+
+	tags := bc.tags.get(event.BuildID)
+	repoURL := tags[buildstore.TagRepository]
+	if repoURL == "" {
+		repoURL = request.RepoURL
+	}
+	status.Commit = tags[buildstore.TagCommit]
+	if status.Commit == "" {
+		status.Commit = request.Ref
+	}
+	if repoURL == "" || !gitsource.IsCommitHash(status.Commit) {
+		return
+	}
+	repository, err := scmstatus.ParseRepository(repoURL)
+	if err != nil {
+		return
+	}
+	status.Repository = repository
+
+	status.Context = bc.statusReports.Context + "/"
+	if request.ProjectPath != "" {
+		status.Context += request.ProjectPath + " "
+	}
+	status.Context += request.TaskName
+	if bc.statusReports.URL != "" {
+		status.TargetURL = bc.statusReports.URL + "/api/builds/" + event.BuildID + "/log"
+	}
+	bc.statuses.Report(status)
+}
+
+// finishedStatus returns the state and description of a finished build
+func finishedStatus(event events.Event) (string, string) {
+	switch event.Status {
+	case BuildStatusCompleted:
+		if event.Duration == 0 {
+			return scmstatus.StateSuccess, "Succeeded"
+		}
+		return scmstatus.StateSuccess, "Succeeded in " + event.Duration.Round(100*time.Millisecond).String()
+	case BuildStatusCancelled:
+		return scmstatus.StateCancelled, "Cancelled"
+	}
+
+	description := "Failed"
+	if event.ErrorCode != "" {
+		description += " (" + event.ErrorCode + ")"
+	}
+	if event.ErrorMessage != "" {
+		description += ": " + event.ErrorMessage
+	}
+	if len(description) > maxStatusDescription {
+		description = strings.ToValidUTF8(description[:maxStatusDescription-3], "") + "..."
+	}
+	return scmstatus.StateFailure, description
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"distributed-gradle-building/audit"
+	"distributed-gradle-building/authz"
+	"distributed-gradle-building/buildstore"
+)
+
+// AnnotateBuildRequest is the body of POST /api/builds/{id}/annotations
+type AnnotateBuildRequest struct {
+	Tags map[string]string `json:"tags"`
+}
+
+// BuildTags are the tags of a build after it was annotated
+type BuildTags struct {
+	BuildID string            `json:"build_id"`
+	Tags    map[string]string `json:"tags"`
+}
+
+// tagIndex keeps the tags of the builds the coordinator knows, with the
+// builds carrying each tag so builds can be listed by their tags. The tags
+// are kept apart from the build requests because queued copies of a
+// request replace it when the build is re-queued.
+type tagIndex struct {
+	tags   map[string]map[string]string
+	builds map[string]map[string]struct{}
+}
+
+func newTagIndex() *tagIndex {
+	return &tagIndex{
+		tags:   make(map[string]map[string]string),
+		builds: make(map[string]map[string]struct{}),
+	}
+}
+
+// tagIndexKey is the key of the builds carrying a tag
+func tagIndexKey(key, value string) string {
+	return key + ":" + value
+}
+
+// set replaces the tags of a build
+func (t *tagIndex) set(buildID string, tags map[string]string) {
+	for key, value := range t.tags[buildID] {
+		delete(t.builds[tagIndexKey(key, value)], buildID)
+	}
+	if len(tags) == 0 {
+		delete(t.tags, buildID)
+		return
+	}
+
+	t.tags[buildID] = tags
+	for key, value := range tags {
+		builds, exists := t.builds[tagIndexKey(key, value)]
+		if !exists {
+			builds = make(map[string]struct{})
+			t.builds[tagIndexKey(key, value)] = builds
+		}
+		builds[buildID] = struct{}{}
+	}
+}
+
+// get returns the tags of a build
+func (t *tagIndex) get(buildID string) map[string]string {
+	return t.tags[buildID]
+}
+
+// matching returns the builds carrying every tag of a filter, found
+// through the tag fewest builds carry
+func (t *tagIndex) matching(filter map[string]string) map[string]struct{} {
+	var candidates map[string]struct{}
+	for key, value := range filter {
+		builds := t.builds[tagIndexKey(key, value)]
+		if candidates == nil || len(builds) < len(candidates) {
+			candidates = builds
+		}
+	}
+
+	matching := make(map[string]struct{}, len(candidates))
+	for buildID := range candidates {
+		if buildstore.HasTags(t.tags[buildID], filter) {
+			matching[buildID] = struct{}{}
+		}
+	}
+	return matching
+}
+
+// buildTags returns the tags of a build
+func (bc *BuildCoordinator) buildTags(buildID string) map[string]string {
+	bc.mutex.RLock()
+	defer bc.mutex.RUnlock()
+
+	return bc.tags.get(buildID)
+}
+
+// AnnotateBuild adds tags to a build, replacing the values of tags it
+// already has. Running builds are recorded with their annotations when they
+// finish; annotations of finished builds are added to the build store,
+// which also knows the builds that finished before the coordinator started.
+func (bc *BuildCoordinator) AnnotateBuild(buildID string, annotations map[string]string) (map[string]string, error) {
+	if len(annotations) == 0 {
+		return nil, fmt.Errorf("%w: no tags to annotate the build with", buildstore.ErrInvalidTags)
+	}
+	if err := buildstore.ValidateTags(annotations); err != nil {
+		return nil, err
+	}
+
+	var tags map[string]string
+	bc.mutex.Lock()
+	progress, known := bc.progress[buildID]
+	if known {
+		tags = buildstore.MergeTags(bc.tags.get(buildID), annotations)
+		if err := buildstore.ValidateTags(tags); err != nil {
+			bc.mutex.Unlock()
+			return nil, err
+		}
+		bc.tags.set(buildID, tags)
+		if !progress.finished() {
+			bc.mutex.Unlock()
+			return tags, nil
+		}
+	}
+	bc.mutex.Unlock()
+
+	record, err := bc.buildStore.Annotate(buildID, annotations)
+	switch {
+	case errors.Is(err, buildstore.ErrNotFound) && known:
+		// Builds completed from the result cache are not recorded
+		return tags, nil
+	case errors.Is(err, buildstore.ErrNotFound):
+		return nil, fmt.Errorf("%w: %s", errBuildNotFound, buildID)
+	case err != nil:
+		return nil, err
+	}
+	return record.Tags, nil
+}
+
+// handleAnnotateBuild adds tags to a build
+func (bc *BuildCoordinator) handleAnnotateBuild(w http.ResponseWriter, r *http.Request) {
+	buildID := r.PathValue("id")
+	if !bc.authorize(w, r, authz.ActionBuildAnnotate, bc.buildAuthzResource(buildID)) {
+		return
+	}
+
+	var request AnnotateBuildRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	tags, err := bc.AnnotateBuild(buildID, request.Tags)
+	switch {
+	case errors.Is(err, buildstore.ErrInvalidTags):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case errors.Is(err, errBuildNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err != nil:
+		log.Printf("Failed to annotate build %s: %v", buildID, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	bc.auditLog.RecordRequest(r, audit.ActionBuildAnnotated, buildID, request.Tags)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(BuildTags{BuildID: buildID, Tags: tags})
+}
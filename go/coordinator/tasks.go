@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"distributed-gradle-building/transfer"
+)
+
+// maxBuildOutputs is the most outputs a build may ask workers to upload
+const maxBuildOutputs = 256
+
+// TaskRequest runs a single Gradle task of an uploaded project for a
+// client, such as the Gradle plugin offloading the task from a local build.
+// The worker uploads the task's outputs as artifacts of the build, for the
+// client to download in place of running the task itself.
+type TaskRequest struct {
+	UploadID      string            `json:"upload_id"`
+	ProjectPath   string            `json:"project_path,omitempty"`
+	Task          string            `json:"task"`
+	Outputs       []string          `json:"outputs"`
+	GradleVersion string            `json:"gradle_version,omitempty"`
+	CacheEnabled  bool              `json:"cache_enabled"`
+	BuildOptions  map[string]string `json:"build_options,omitempty"`
+	Labels        []string          `json:"labels,omitempty"`
+}
+
+// validateOutputs checks that the outputs of a build are slash-separated
+// paths inside the project directory
+func validateOutputs(outputs []string) error {
+	if len(outputs) > maxBuildOutputs {
+		return fmt.Errorf("a build may have at most %d outputs", maxBuildOutputs)
+	}
+	for _, output := range outputs {
+		if !transfer.ValidName(output) {
+			return fmt.Errorf("invalid output %q: outputs are relative paths inside the project", output)
+		}
+	}
+	return nil
+}
+
+// handleSubmitTask queues the build of a single task of an uploaded project
+func (bc *BuildCoordinator) handleSubmitTask(w http.ResponseWriter, r *http.Request) {
+	var task TaskRequest
+	if err := json.NewDecoder(r.Body).Decode(&task); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	if task.UploadID == "" || task.Task == "" {
+		http.Error(w, "upload_id and task are required", http.StatusBadRequest)
+		return
+	}
+
+	bc.submitBuildRequest(w, r, BuildRequest{
+		ProjectPath:   task.ProjectPath,
+		TaskName:      task.Task,
+		GradleVersion: task.GradleVersion,
+		CacheEnabled:  task.CacheEnabled,
+		BuildOptions:  task.BuildOptions,
+		Labels:        task.Labels,
+		UploadID:      task.UploadID,
+		Outputs:       task.Outputs,
+	})
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/rpc"
+	"time"
+
+	"distributed-gradle-building/httprpc"
+)
+
+// Transports of workers the coordinator cannot connect to. Both long-poll
+// the coordinator's calls to them from a mailbox instead of accepting RPC
+// connections.
+const (
+	// TransportHTTP is the transport of workers that reach the coordinator
+	// over its HTTP port only. Their calls are POSTed to /api/rpc, and they
+	// poll the coordinator's calls from /api/rpc/calls.
+	TransportHTTP = "http"
+	// TransportPull is the transport of workers that connect to the RPC
+	// port but cannot be connected to, such as workers behind NAT. They
+	// poll the coordinator's calls with PollCalls and answer them with
+	// ReplyCall.
+	TransportPull = "pull"
+)
+
+// workerRPCPaths are the paths HTTP workers call
+var workerRPCPaths = []string{"/api/rpc", "/api/rpc/calls"}
+
+// workerPollWait is how long a poll of a worker waits for a call, short
+// enough for proxies not to time it out
+const workerPollWait = 25 * time.Second
+
+// RPC argument and reply types for workers polling for calls
+type PollCallsArgs struct {
+	WorkerID string `json:"worker_id"`
+}
+
+type PollCallsReply struct {
+	// Call is the next call to the worker, nil if none was made while
+	// polling
+	Call *httprpc.Call `json:"call,omitempty"`
+}
+
+type ReplyCallArgs struct {
+	WorkerID string `json:"worker_id"`
+	CallID   uint64 `json:"call_id"`
+	// Reply is the gob-encoded reply to the call
+	Reply []byte `json:"reply"`
+}
+
+type ReplyCallReply struct{}
+
+// pollsCalls reports whether a worker polls the coordinator's calls instead
+// of accepting connections
+func (w *Worker) pollsCalls() bool {
+	return w.Transport == TransportHTTP || w.Transport == TransportPull
+}
+
+// dialWorker connects to a worker's RPC service: directly for TCP workers
+// and through the mailbox polling workers poll otherwise
+func (bc *BuildCoordinator) dialWorker(worker *Worker) (*rpc.Client, error) {
+	if !worker.pollsCalls() {
+		return rpc.Dial("tcp", fmt.Sprintf("%s:%d", worker.Host, worker.Port))
+	}
+
+	bc.mutex.RLock()
+	mailbox := bc.mailboxes[worker.ID]
+	bc.mutex.RUnlock()
+	if mailbox == nil || !mailbox.Polling(2*workerPollWait) {
+		return nil, fmt.Errorf("worker %s is not polling for calls", worker.ID)
+	}
+	return mailbox.Client(), nil
+}
+
+// mailbox returns the mailbox of a polling worker, creating it when the
+// worker registers. Must be called with the mutex held.
+func (bc *BuildCoordinator) mailbox(workerID string) *httprpc.Mailbox {
+	mailbox, exists := bc.mailboxes[workerID]
+	if !exists {
+		mailbox = httprpc.NewMailbox()
+		bc.mailboxes[workerID] = mailbox
+	}
+	return mailbox
+}
+
+// workerMailbox returns the mailbox of a registered worker polling for
+// calls with a transport
+func (bc *BuildCoordinator) workerMailbox(workerID, transport string) (*httprpc.Mailbox, error) {
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+
+	if worker, exists := bc.workers[workerID]; !exists || worker.Transport != transport {
+		return nil, fmt.Errorf("worker %s not found or not polling over %s", workerID, transport)
+	}
+	return bc.mailbox(workerID), nil
+}
+
+// PollCalls waits for the next call to a pull worker
+func (bc *BuildCoordinator) PollCalls(args *PollCallsArgs, reply *PollCallsReply) error {
+	mailbox, err := bc.workerMailbox(args.WorkerID, TransportPull)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), workerPollWait)
+	defer cancel()
+	if call, ok := mailbox.Next(ctx); ok {
+		reply.Call = &call
+	}
+	return nil
+}
+
+// ReplyCall routes a pull worker's reply to the call it answers
+func (bc *BuildCoordinator) ReplyCall(args *ReplyCallArgs, reply *ReplyCallReply) error {
+	mailbox, err := bc.workerMailbox(args.WorkerID, TransportPull)
+	if err != nil {
+		return err
+	}
+	if err := mailbox.Deliver(args.CallID, args.Reply); err != nil {
+		if errors.Is(err, httprpc.ErrUnknownCall) {
+			return fmt.Errorf("call %d is not pending", args.CallID)
+		}
+		return err
+	}
+	return nil
+}
+
+// handleWorkerRPC serves a call of an HTTP worker to the coordinator
+func (bc *BuildCoordinator) handleWorkerRPC(w http.ResponseWriter, r *http.Request) {
+	httprpc.Handler(bc.rpcServer).ServeHTTP(w, r)
+}
+
+// handlePollWorkerCalls answers an HTTP worker's long-poll with the next
+// call to it
+func (bc *BuildCoordinator) handlePollWorkerCalls(w http.ResponseWriter, r *http.Request) {
+	mailbox, ok := bc.httpMailbox(w, r)
+	if !ok {
+		return
+	}
+	mailbox.ServeNext(w, r, workerPollWait)
+}
+
+// handleWorkerReply routes an HTTP worker's reply to the call it answers
+func (bc *BuildCoordinator) handleWorkerReply(w http.ResponseWriter, r *http.Request) {
+	mailbox, ok := bc.httpMailbox(w, r)
+	if !ok {
+		return
+	}
+	mailbox.ServeReply(w, r)
+}
+
+// httpMailbox returns the mailbox of the HTTP worker in the worker query
+// parameter, or responds with 404 Not Found if it is not registered over
+// HTTP
+func (bc *BuildCoordinator) httpMailbox(w http.ResponseWriter, r *http.Request) (*httprpc.Mailbox, bool) {
+	id := r.URL.Query().Get("worker")
+	mailbox, err := bc.workerMailbox(id, TransportHTTP)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Worker %s is not registered over HTTP", id), http.StatusNotFound)
+		return nil, false
+	}
+	return mailbox, true
+}
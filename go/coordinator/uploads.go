@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"distributed-gradle-building/audit"
+	"distributed-gradle-building/authz"
+	"distributed-gradle-building/metrics"
+	"distributed-gradle-building/retention"
+	"distributed-gradle-building/transfer"
+	"distributed-gradle-building/usage"
+)
+
+// maxProjectUpload is the largest project archive accepted
+const maxProjectUpload = 2 << 30
+
+// ProjectUpload is a project archive uploaded for builds to run on. Builds
+// name it by UploadID instead of a project directory on the workers.
+type ProjectUpload struct {
+	UploadID string `json:"upload_id"`
+	Size     int64  `json:"size"`
+	SHA256   string `json:"sha256"`
+	// SentBytes is how much of the archive was not stored already
+	SentBytes int64 `json:"sent_bytes"`
+}
+
+// uploadPrefix starts the IDs of uploads, which are stored like the
+// artifacts of a build of that ID and expire under the same retention
+// policies
+const uploadPrefix = "upload-"
+
+// uploadName names the archive of an upload in the artifact store
+func uploadName(uploadID string) string {
+	return uploadID + "/project.tar.gz"
+}
+
+// uploadManifest returns the manifest of an uploaded project archive
+func (bc *BuildCoordinator) uploadManifest(uploadID string) (*transfer.Manifest, error) {
+	if !strings.HasPrefix(uploadID, uploadPrefix) {
+		return nil, fmt.Errorf("upload %s not found", uploadID)
+	}
+	manifest, err := bc.artifacts.Manifest(uploadName(uploadID))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("upload %s not found", uploadID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid upload %s: %v", uploadID, err)
+	}
+	return &manifest, nil
+}
+
+// handleUploadProject stores the gzipped tar archive of a project streamed
+// in the request body. Like artifacts, it is split into chunks and only the
+// chunks not stored yet, such as those of an earlier upload of the project,
+// take up space. The project_path parameter names the project the archive
+// is of, which the upload and the builds on it are authorized for.
+func (bc *BuildCoordinator) handleUploadProject(w http.ResponseWriter, r *http.Request) {
+	if bc.rejectWhileDraining(w) {
+		return
+	}
+	project := r.URL.Query().Get("project_path")
+	if project != "" {
+		if !filepath.IsAbs(project) {
+			http.Error(w, "project_path must be absolute", http.StatusBadRequest)
+			return
+		}
+		project = filepath.Clean(project)
+	}
+	if !bc.authorize(w, r, authz.ActionBuildSubmit, authz.Resource{ProjectPath: project}) {
+		return
+	}
+
+	uploadID := fmt.Sprintf("%s%d", uploadPrefix, time.Now().UnixNano())
+	body := http.MaxBytesReader(w, r.Body, maxProjectUpload)
+	attributes := map[string]string{usage.AttributeTenant: bc.rateLimiter.Tenant(r)}
+	if project != "" {
+		attributes[retention.AttributeProject] = project
+	}
+	remote := attributedRemote{bc.artifacts, attributes}
+	manifest, stats, err := transfer.UploadReader(remote, uploadName(uploadID), body)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, fmt.Sprintf("project archives are limited to %d bytes", maxProjectUpload), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	metrics.TransferBytes.WithLabelValues(metrics.TransferUpload, metrics.TransferRaw).Add(float64(stats.Bytes))
+	metrics.TransferBytes.WithLabelValues(metrics.TransferUpload, metrics.TransferDeduplicated).Add(float64(stats.SentBytes))
+	metrics.TransferBytes.WithLabelValues(metrics.TransferUpload, metrics.TransferCompressed).Add(float64(stats.WireBytes))
+	bc.auditLog.RecordRequest(r, audit.ActionProjectUploaded, uploadID, map[string]string{
+		"size":   strconv.FormatInt(manifest.Size, 10),
+		"sha256": manifest.SHA256,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ProjectUpload{UploadID: uploadID, Size: manifest.Size, SHA256: manifest.SHA256, SentBytes: stats.SentBytes})
+}
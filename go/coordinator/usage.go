@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"distributed-gradle-building/analytics"
+	"distributed-gradle-building/buildstore"
+	"distributed-gradle-building/metrics"
+	"distributed-gradle-building/transfer"
+	"distributed-gradle-building/usage"
+)
+
+// csvContentType is the content type of usage reports exported as CSV
+const csvContentType = "text/csv"
+
+// attributedRemote commits the files sent through it with attributes, so
+// uploads are accounted like the artifacts of builds
+type attributedRemote struct {
+	transfer.Remote
+	attributes map[string]string
+}
+
+// Commit implements transfer.Remote
+func (r attributedRemote) Commit(manifest transfer.Manifest) error {
+	manifest.Attributes = r.attributes
+	return r.Remote.Commit(manifest)
+}
+
+// handleUsage reports the compute time, build cache growth and artifact
+// storage of each tenant and project, as JSON or, with format=csv or a
+// text/csv Accept header, as CSV for chargeback. Compute and cache usage
+// cover the builds submitted between from and to, artifact storage is what
+// is stored now.
+func (bc *BuildCoordinator) handleUsage(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+	query, err := analytics.ParseQuery(values, time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// The project of a build is its repository for checkouts, so it is
+	// matched after summarizing rather than by the store's filter
+	records, err := bc.buildStore.Query(buildstore.Filter{Since: query.From, Until: query.To})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	manifests, err := bc.artifacts.List("")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rows := usage.Summarize(records, manifests, usage.Filter{Tenant: values.Get("tenant"), Project: values.Get("project")})
+
+	if values.Get("format") == "csv" || strings.Contains(r.Header.Get("Accept"), csvContentType) {
+		w.Header().Set("Content-Type", csvContentType)
+		w.Header().Set("Content-Disposition", `attachment; filename="usage.csv"`)
+		usage.WriteCSV(w, rows)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rows)
+}
+
+// updateArtifactStorage sets the artifact storage gauge of every tenant and
+// project from the stored artifacts
+func (bc *BuildCoordinator) updateArtifactStorage() {
+	manifests, err := bc.artifacts.List("")
+	if err != nil {
+		log.Printf("Failed to measure artifact storage: %v", err)
+		return
+	}
+	metrics.ArtifactStorage.Reset()
+	for _, row := range usage.Summarize(nil, manifests, usage.Filter{}) {
+		metrics.ArtifactStorage.WithLabelValues(row.Tenant, row.Project).Set(float64(row.ArtifactBytes))
+	}
+}
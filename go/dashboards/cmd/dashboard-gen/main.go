@@ -0,0 +1,36 @@
+// Command dashboard-gen writes the generated Grafana dashboards as JSON files.
+//
+// Usage:
+//
+//	dashboard-gen -out ../../k8s/helm/distributed-gradle/dashboards
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"path/filepath"
+
+	"distributed-gradle-building/dashboards"
+)
+
+func main() {
+	out := flag.String("out", "dashboards", "directory to write the dashboards to")
+	flag.Parse()
+
+	if err := os.MkdirAll(*out, 0755); err != nil {
+		log.Fatalf("Failed to create %s: %v", *out, err)
+	}
+
+	for name, dashboard := range dashboards.Files() {
+		data, err := dashboard.JSON()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		path := filepath.Join(*out, name)
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			log.Fatalf("Failed to write %s: %v", path, err)
+		}
+	}
+}
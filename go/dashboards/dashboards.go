@@ -0,0 +1,317 @@
+// Package dashboards generates the Grafana dashboards of the system from the
+// metric names of the metrics package, so the panels always query metrics
+// the services export. The generated JSON is provisioned by the Helm chart.
+package dashboards
+
+//go:generate go run ./cmd/dashboard-gen -out ../../k8s/helm/distributed-gradle/dashboards
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"distributed-gradle-building/metrics"
+)
+
+// gridWidth is the width of a Grafana dashboard grid
+const gridWidth = 24
+
+// Dashboard is a Grafana dashboard model as read by file provisioning
+type Dashboard struct {
+	UID           string     `json:"uid"`
+	Title         string     `json:"title"`
+	Tags          []string   `json:"tags"`
+	Timezone      string     `json:"timezone"`
+	Refresh       string     `json:"refresh"`
+	SchemaVersion int        `json:"schemaVersion"`
+	Time          TimeRange  `json:"time"`
+	Templating    Templating `json:"templating"`
+	Panels        []Panel    `json:"panels"`
+}
+
+// TimeRange is the default time range of a dashboard
+type TimeRange struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// Templating holds dashboard variables
+type Templating struct {
+	List []Variable `json:"list"`
+}
+
+// Variable is a dashboard variable
+type Variable struct {
+	Name  string `json:"name"`
+	Label string `json:"label"`
+	Type  string `json:"type"`
+	Query string `json:"query"`
+}
+
+// Panel is a dashboard panel or a row header
+type Panel struct {
+	ID          int          `json:"id"`
+	Title       string       `json:"title"`
+	Type        string       `json:"type"`
+	Datasource  *Datasource  `json:"datasource,omitempty"`
+	GridPos     GridPos      `json:"gridPos"`
+	Targets     []Target     `json:"targets,omitempty"`
+	FieldConfig *FieldConfig `json:"fieldConfig,omitempty"`
+}
+
+// Datasource references the datasource a panel queries
+type Datasource struct {
+	Type string `json:"type"`
+	UID  string `json:"uid"`
+}
+
+// GridPos places a panel on the dashboard grid
+type GridPos struct {
+	H int `json:"h"`
+	W int `json:"w"`
+	X int `json:"x"`
+	Y int `json:"y"`
+}
+
+// Target is a PromQL query of a panel
+type Target struct {
+	RefID        string `json:"refId"`
+	Expr         string `json:"expr"`
+	LegendFormat string `json:"legendFormat,omitempty"`
+}
+
+// FieldConfig sets how panel values are displayed
+type FieldConfig struct {
+	Defaults FieldDefaults `json:"defaults"`
+}
+
+// FieldDefaults are the display defaults of a panel's fields
+type FieldDefaults struct {
+	Unit string   `json:"unit,omitempty"`
+	Min  *float64 `json:"min,omitempty"`
+	Max  *float64 `json:"max,omitempty"`
+}
+
+// prometheus is the datasource of every panel, chosen by the datasource variable
+var prometheus = &Datasource{Type: "prometheus", UID: "${datasource}"}
+
+// query builds a panel target
+func query(expr, legend string) Target {
+	return Target{Expr: expr, LegendFormat: legend}
+}
+
+// graph is a time series panel
+func graph(title, unit string, width int, targets ...Target) Panel {
+	return panel("timeseries", title, unit, width, targets)
+}
+
+// stat is a single value panel
+func stat(title, unit string, width int, targets ...Target) Panel {
+	return panel("stat", title, unit, width, targets)
+}
+
+// panel builds a panel of the given Grafana type
+func panel(kind, title, unit string, width int, targets []Target) Panel {
+	for i := range targets {
+		targets[i].RefID = string(rune('A' + i))
+	}
+
+	p := Panel{Type: kind, Title: title, Datasource: prometheus, GridPos: GridPos{H: 8, W: width}, Targets: targets}
+	if unit != "" {
+		p.FieldConfig = &FieldConfig{Defaults: FieldDefaults{Unit: unit}}
+		if unit == "percentunit" {
+			zero, one := 0.0, 1.0
+			p.FieldConfig.Defaults.Min, p.FieldConfig.Defaults.Max = &zero, &one
+		}
+	}
+	return p
+}
+
+// row is a collapsible section header
+func row(title string) Panel {
+	return Panel{Type: "row", Title: title, GridPos: GridPos{H: 1, W: gridWidth}}
+}
+
+// quantile queries a quantile of a histogram over a rate window
+func quantile(q float64, histogram, window string) string {
+	return fmt.Sprintf("histogram_quantile(%g, sum by (le) (rate(%s_bucket[%s])))", q, histogram, window)
+}
+
+// layout numbers the panels and flows them left to right into rows of the grid
+func layout(panels []Panel) []Panel {
+	x, y, rowHeight := 0, 0, 0
+	for i := range panels {
+		p := &panels[i]
+		p.ID = i + 1
+
+		if p.Type == "row" || x+p.GridPos.W > gridWidth {
+			x, y, rowHeight = 0, y+rowHeight, 0
+		}
+		p.GridPos.X, p.GridPos.Y = x, y
+
+		x += p.GridPos.W
+		if p.GridPos.H > rowHeight {
+			rowHeight = p.GridPos.H
+		}
+		if p.Type == "row" {
+			x, y, rowHeight = 0, y+p.GridPos.H, 0
+		}
+	}
+	return panels
+}
+
+// Overview charts the build queue, scheduler, worker pool, caches, usage by
+// tenant and ML predictions
+func Overview() Dashboard {
+	panels := []Panel{
+		row("Services"),
+		stat("Service health", "none", 24,
+			query(`up{job=~"distributed-gradle-.*"}`, "{{job}}")),
+
+		row("Queue and scheduling"),
+		stat("Queued builds", "none", 4,
+			query(fmt.Sprintf("sum(%s)", metrics.QueueDepth), "")),
+		graph("Queue depth by pool", "none", 10,
+			query(fmt.Sprintf("sum by (pool) (%s)", metrics.QueueDepth), "{{pool}}")),
+		graph("Scheduler decisions", "ops", 10,
+			query(fmt.Sprintf("sum by (decision) (rate(%s[5m]))", metrics.SchedulerDecisionsTotal), "{{decision}}")),
+		graph("Queue wait by priority", "s", 12,
+			query(fmt.Sprintf("histogram_quantile(0.95, sum by (le, priority) (rate(%s_bucket[15m])))", metrics.QueueWaitSeconds), "p95 {{priority}}"),
+			query(quantile(0.5, metrics.QueueWaitSeconds, "15m"), "median (all)")),
+		graph("Queue wait p95 by tenant", "s", 12,
+			query(fmt.Sprintf("histogram_quantile(0.95, sum by (le, tenant) (rate(%s_bucket[15m])))", metrics.QueueWaitSeconds), "{{tenant}}")),
+		graph("Finished builds", "ops", 6,
+			query(fmt.Sprintf("sum by (status) (rate(%s[5m]))", metrics.BuildsTotal), "{{status}}")),
+		graph("Speculative builds", "ops", 6,
+			query(fmt.Sprintf("sum by (event) (rate(%s[5m]))", metrics.SpeculativeBuildsTotal), "{{event}}")),
+		graph("Federated builds", "ops", 6,
+			query(fmt.Sprintf("sum by (peer, event) (rate(%s[5m]))", metrics.FederatedBuildsTotal), "{{peer}} {{event}}")),
+		graph("Coordinator HTTP requests", "reqps", 6,
+			query(fmt.Sprintf(`sum by (status) (rate(%s{job="distributed-gradle-coordinator"}[5m]))`, metrics.HTTPRequestsTotal), "{{status}}")),
+		graph("Build failures by error code", "ops", 12,
+			query(fmt.Sprintf("sum by (code) (rate(%s[5m]))", metrics.BuildFailuresTotal), "{{code}}")),
+		graph("SCM status reports", "ops", 12,
+			query(fmt.Sprintf("sum by (reporter, result) (rate(%s[5m]))", metrics.SCMStatusReportsTotal), "{{reporter}} {{result}}")),
+
+		row("Workers"),
+		stat("Busy workers", "none", 4,
+			query(fmt.Sprintf("sum(%s)", metrics.WorkerBusy), "")),
+		stat("Slot utilization", "percentunit", 4,
+			query(fmt.Sprintf("sum(%s) / sum(%s)", metrics.WorkerActiveBuilds, metrics.WorkerSlots), "")),
+		graph("Active builds per worker", "none", 16,
+			query(metrics.WorkerActiveBuilds, "{{worker}}"),
+			query(fmt.Sprintf("sum(%s)", metrics.WorkerSlots), "total slots")),
+		graph("Slot utilization by pool", "percentunit", 6,
+			query(fmt.Sprintf("sum by (pool) (%s) / sum by (pool) (%s)", metrics.WorkerActiveBuilds, metrics.WorkerSlots), "{{pool}}")),
+		graph("Stale builds recovered", "ops", 6,
+			query(fmt.Sprintf("sum by (pool, action) (rate(%s[5m]))", metrics.StaleBuildsTotal), "{{pool}} {{action}}")),
+		graph("Worker CPU usage", "percentunit", 6,
+			query(metrics.WorkerCPUUsage, "{{worker}}")),
+		graph("Worker memory usage", "percentunit", 6,
+			query(metrics.WorkerMemoryUsage, "{{worker}}")),
+		graph("Builds run by workers", "ops", 8,
+			query(fmt.Sprintf("sum(rate(%s[5m]))", metrics.WorkerBuildsStartedTotal), "started"),
+			query(fmt.Sprintf("sum by (status) (rate(%s[5m]))", metrics.WorkerBuildsFinishedTotal), "{{status}}")),
+		graph("Worker build duration", "s", 8,
+			query(quantile(0.5, metrics.WorkerBuildDurationSeconds, "1h"), "median"),
+			query(quantile(0.95, metrics.WorkerBuildDurationSeconds, "1h"), "p95")),
+		graph("Concurrent builds per worker", "none", 8,
+			query(metrics.WorkerConcurrentBuilds, "{{instance}}")),
+		graph("Gradle daemons", "none", 8,
+			query(metrics.WorkerGradleDaemons, "{{instance}}")),
+		graph("Workspace disk usage", "percentunit", 8,
+			query(metrics.WorkerWorkspaceDiskUsage, "{{instance}}")),
+		graph("Worker chunk transfer", "Bps", 8,
+			query(fmt.Sprintf("sum by (direction) (rate(%s[5m]))", metrics.WorkerCacheTransferBytesTotal), "{{direction}}")),
+
+		row("Caching"),
+		stat("Cache hit rate", "percentunit", 4,
+			query(fmt.Sprintf("sum(rate(%s[15m])) / sum(rate(%s[15m]))", metrics.CacheHitsTotal, metrics.CacheRequestsTotal), "")),
+		graph("Cache requests", "ops", 10,
+			query(fmt.Sprintf("sum(rate(%s[5m]))", metrics.CacheHitsTotal), "hits"),
+			query(fmt.Sprintf("sum(rate(%s[5m]))", metrics.CacheMissesTotal), "misses")),
+		graph("Build cache hit ratio", "percentunit", 10,
+			query(quantile(0.5, metrics.BuildCacheHitRatio, "15m"), "median"),
+			query(quantile(0.1, metrics.BuildCacheHitRatio, "15m"), "10th percentile")),
+		graph("Cache size", "bytes", 8,
+			query(metrics.CacheSizeBytes, "size")),
+		graph("Cache entries", "none", 8,
+			query(metrics.CacheEntriesTotal, "entries")),
+		graph("Build result cache", "ops", 8,
+			query(fmt.Sprintf("sum by (result) (rate(%s[5m]))", metrics.ResultCacheLookupsTotal), "{{result}}")),
+
+		row("Dependency proxy"),
+		stat("Dependency proxy hit rate", "percentunit", 4,
+			query(fmt.Sprintf(`sum(rate(%[1]s{result=~"hit|stale"}[15m])) / sum(rate(%[1]s{result!="not_found"}[15m]))`, metrics.DependencyProxyRequestsTotal), "")),
+		graph("Dependency proxy requests", "ops", 10,
+			query(fmt.Sprintf("sum by (result) (rate(%s[5m]))", metrics.DependencyProxyRequestsTotal), "{{result}}")),
+		graph("Upstream downloads", "Bps", 10,
+			query(fmt.Sprintf("sum by (repository) (rate(%s[5m]))", metrics.DependencyProxyUpstreamBytesTotal), "{{repository}}")),
+		graph("Dependency proxy storage", "bytes", 12,
+			query(metrics.DependencyProxyStorageBytes, "size")),
+		graph("Dependency proxy files", "none", 12,
+			query(metrics.DependencyProxyStorageFiles, "files"),
+			query(fmt.Sprintf("increase(%s[1h])", metrics.DependencyProxyEvictionsTotal), "evicted per hour")),
+
+		row("Artifact transfer"),
+		graph("Transfer deduplication", "percentunit", 12,
+			query(fmt.Sprintf(`1 - sum by (direction) (rate(%[1]s{stage="deduplicated"}[15m])) / sum by (direction) (rate(%[1]s{stage="raw"}[15m]))`, metrics.TransferBytesTotal), "{{direction}} deduplicated"),
+			query(fmt.Sprintf(`1 - sum by (direction) (rate(%[1]s{stage="compressed"}[15m])) / sum by (direction) (rate(%[1]s{stage="raw"}[15m]))`, metrics.TransferBytesTotal), "{{direction}} saved overall")),
+		graph("Transferred bytes", "Bps", 12,
+			query(fmt.Sprintf("sum by (direction, stage) (rate(%s[5m]))", metrics.TransferBytesTotal), "{{direction}} {{stage}}")),
+
+		row("Usage by tenant"),
+		graph("Compute time per hour", "s", 8,
+			query(fmt.Sprintf("sum by (tenant) (increase(%s[1h]))", metrics.ComputeSecondsTotal), "{{tenant}}")),
+		graph("Build cache growth per hour", "bytes", 8,
+			query(fmt.Sprintf("sum by (tenant) (increase(%s[1h]))", metrics.CacheStorageBytesTotal), "{{tenant}}")),
+		graph("Artifact storage", "bytes", 8,
+			query(fmt.Sprintf("sum by (tenant) (%s)", metrics.ArtifactStorageBytes), "{{tenant}}")),
+
+		row("ML predictions"),
+		graph("Predictions", "ops", 8,
+			query(fmt.Sprintf("rate(%s[5m])", metrics.PredictionsTotal), "predictions"),
+			query(fmt.Sprintf("rate(%s[5m])", metrics.TrainingTotal), "training runs")),
+		graph("Prediction latency", "s", 8,
+			query(quantile(0.95, metrics.PredictionDurationSeconds, "5m"), "p95")),
+		graph("Prediction error", "s", 8,
+			query(quantile(0.5, metrics.PredictionErrorSeconds, "1h"), "median"),
+			query(quantile(0.9, metrics.PredictionErrorSeconds, "1h"), "p90")),
+		graph("Relative prediction error", "percentunit", 12,
+			query(quantile(0.5, metrics.PredictionErrorRatio, "1h"), "median"),
+			query(quantile(0.9, metrics.PredictionErrorRatio, "1h"), "p90")),
+		graph("Data collection", "none", 12,
+			query(metrics.CollectionUp, "{{source}} up"),
+			query(metrics.CollectionCircuitOpen, "{{source}} suspended"),
+			query(metrics.CollectionConsecutiveFailures, "{{source}} failures")),
+	}
+
+	return Dashboard{
+		UID:           "distributed-gradle-building",
+		Title:         "Distributed Gradle Building",
+		Tags:          []string{"distributed-gradle"},
+		Timezone:      "browser",
+		Refresh:       "30s",
+		SchemaVersion: 39,
+		Time:          TimeRange{From: "now-6h", To: "now"},
+		Templating: Templating{List: []Variable{
+			{Name: "datasource", Label: "Data source", Type: "datasource", Query: "prometheus"},
+		}},
+		Panels: layout(panels),
+	}
+}
+
+// Files returns the generated dashboards by file name
+func Files() map[string]Dashboard {
+	return map[string]Dashboard{
+		"distributed-gradle-building.json": Overview(),
+	}
+}
+
+// JSON encodes a dashboard as provisioned by Grafana
+func (d Dashboard) JSON() ([]byte, error) {
+	data, err := json.MarshalIndent(d, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode dashboard %s: %v", d.UID, err)
+	}
+	return append(data, '\n'), nil
+}
@@ -0,0 +1,94 @@
+package dashboards
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"distributed-gradle-building/metrics"
+)
+
+// chartDashboards is where the Helm chart provisions the dashboards from
+const chartDashboards = "../../k8s/helm/distributed-gradle/dashboards"
+
+// TestDashboardSnapshots keeps the chart's dashboards in sync with the
+// generator. Run go generate ./dashboards after changing a dashboard.
+func TestDashboardSnapshots(t *testing.T) {
+	for name, dashboard := range Files() {
+		data, err := dashboard.JSON()
+		if err != nil {
+			t.Fatalf("Failed to encode %s: %v", name, err)
+		}
+
+		snapshot, err := os.ReadFile(filepath.Join(chartDashboards, name))
+		if err != nil {
+			t.Fatalf("Failed to read snapshot: %v", err)
+		}
+		if !bytes.Equal(data, snapshot) {
+			t.Errorf("%s is out of date; run go generate ./dashboards", name)
+		}
+	}
+}
+
+func TestOverviewChartsEveryMetric(t *testing.T) {
+	var exprs []string
+	for _, panel := range Overview().Panels {
+		for _, target := range panel.Targets {
+			exprs = append(exprs, target.Expr)
+		}
+	}
+	all := strings.Join(exprs, "\n")
+
+	for _, name := range metrics.Names() {
+		if !strings.Contains(all, name) {
+			t.Errorf("No panel queries %s", name)
+		}
+	}
+}
+
+func TestOverviewLayout(t *testing.T) {
+	panels := Overview().Panels
+
+	for i, a := range panels {
+		if a.ID != i+1 {
+			t.Errorf("Expected panel %q to have ID %d, got %d", a.Title, i+1, a.ID)
+		}
+		if a.GridPos.X+a.GridPos.W > gridWidth {
+			t.Errorf("Panel %q overflows the grid: %+v", a.Title, a.GridPos)
+		}
+		for _, b := range panels[i+1:] {
+			if overlaps(a.GridPos, b.GridPos) {
+				t.Errorf("Panels %q and %q overlap", a.Title, b.Title)
+			}
+		}
+	}
+}
+
+func TestLayoutStartsRowsOnNewLine(t *testing.T) {
+	panels := layout([]Panel{
+		row("first"),
+		graph("a", "", 16),
+		graph("b", "", 16),
+		row("second"),
+		stat("c", "", 4),
+	})
+
+	expected := []GridPos{
+		{H: 1, W: 24, X: 0, Y: 0},
+		{H: 8, W: 16, X: 0, Y: 1},
+		{H: 8, W: 16, X: 0, Y: 9},
+		{H: 1, W: 24, X: 0, Y: 17},
+		{H: 8, W: 4, X: 0, Y: 18},
+	}
+	for i, panel := range panels {
+		if panel.GridPos != expected[i] {
+			t.Errorf("Expected %s at %+v, got %+v", panel.Title, expected[i], panel.GridPos)
+		}
+	}
+}
+
+func overlaps(a, b GridPos) bool {
+	return a.X < b.X+b.W && b.X < a.X+a.W && a.Y < b.Y+b.H && b.Y < a.Y+a.H
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"distributed-gradle-building/depproxy/proxy"
+	"distributed-gradle-building/metrics"
+	"distributed-gradle-building/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// ProxyConfig configures the dependency proxy
+type ProxyConfig struct {
+	Port       int
+	StorageDir string
+	Upstreams  []proxy.Upstream
+	// MaxStorageMB is the size of the cache in MiB, 0 for no limit
+	MaxStorageMB    int64
+	MetadataTTL     time.Duration
+	UpstreamTimeout time.Duration
+}
+
+// loadProxyConfig loads the configuration of the dependency proxy from
+// environment variables
+func loadProxyConfig() (ProxyConfig, error) {
+	upstreams, err := proxy.ParseUpstreams(os.Getenv("DEPPROXY_UPSTREAMS"))
+	if err != nil {
+		return ProxyConfig{}, err
+	}
+	config := ProxyConfig{
+		Port:            8091,
+		StorageDir:      getEnvOrDefault("DEPPROXY_STORAGE_DIR", "/app/data/depproxy"),
+		Upstreams:       upstreams,
+		MaxStorageMB:    20480,
+		MetadataTTL:     10 * time.Minute,
+		UpstreamTimeout: time.Minute,
+	}
+
+	if value := os.Getenv("DEPPROXY_PORT"); value != "" {
+		if config.Port, err = strconv.Atoi(value); err != nil {
+			return ProxyConfig{}, fmt.Errorf("invalid DEPPROXY_PORT %q", value)
+		}
+	}
+	if value := os.Getenv("DEPPROXY_MAX_STORAGE_MB"); value != "" {
+		if config.MaxStorageMB, err = strconv.ParseInt(value, 10, 64); err != nil || config.MaxStorageMB < 0 {
+			return ProxyConfig{}, fmt.Errorf("invalid DEPPROXY_MAX_STORAGE_MB %q", value)
+		}
+	}
+	for key, target := range map[string]*time.Duration{
+		"DEPPROXY_METADATA_TTL":     &config.MetadataTTL,
+		"DEPPROXY_UPSTREAM_TIMEOUT": &config.UpstreamTimeout,
+	} {
+		if value := os.Getenv(key); value != "" {
+			if *target, err = time.ParseDuration(value); err != nil || *target < 0 {
+				return ProxyConfig{}, fmt.Errorf("invalid %s %q", key, value)
+			}
+		}
+	}
+	return config, nil
+}
+
+func getEnvOrDefault(key, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+func main() {
+	config, err := loadProxyConfig()
+	if err != nil {
+		log.Fatalf("Invalid dependency proxy configuration: %v", err)
+	}
+
+	repositories, err := proxy.New(proxy.Config{
+		Dir:         config.StorageDir,
+		Upstreams:   config.Upstreams,
+		MaxStorage:  config.MaxStorageMB << 20,
+		MetadataTTL: config.MetadataTTL,
+		Client:      &http.Client{Timeout: config.UpstreamTimeout},
+	})
+	if err != nil {
+		log.Fatalf("Failed to open dependency cache: %v", err)
+	}
+	prometheus.MustRegister(repositories, metrics.DependencyProxyRequests,
+		metrics.DependencyProxyUpstreamBytes, metrics.DependencyProxyEvictions)
+
+	mux := http.NewServeMux()
+	mux.Handle("GET /repositories/{repository}/{path...}", repositories)
+	mux.HandleFunc("GET /health", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"status": "healthy"})
+	})
+	mux.HandleFunc("GET /api/stats", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(repositories.Stats())
+	})
+	mux.Handle("GET /metrics", promhttp.Handler())
+
+	server := &http.Server{
+		Addr:    fmt.Sprintf(":%d", config.Port),
+		Handler: middleware.Chain(mux, middleware.RequestID, middleware.Recovery),
+	}
+
+	log.Printf("Distributed Gradle Building - Dependency Proxy")
+	log.Printf("Listening on port %d, caching in %s", config.Port, config.StorageDir)
+	for _, upstream := range config.Upstreams {
+		log.Printf("  GET  /repositories/%s/{path} - Proxy %s", upstream.Name, upstream.URL)
+	}
+	log.Printf("  GET  /api/stats - Get the size of the cache")
+
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Dependency proxy error: %v", err)
+		}
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	<-signals
+
+	log.Printf("Shutting down dependency proxy...")
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Dependency proxy shutdown error: %v", err)
+	}
+}
@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"text/template"
+)
+
+// initScript redirects the repositories of a build and of the plugins it
+// applies to the proxy when their URL is that of an upstream repository.
+// Repositories the build declares with other URLs are left alone.
+var initScript = template.Must(template.New("init").Parse(`// Resolves dependencies through the dependency proxy
+def proxy = '{{.Proxy}}'
+def mirrors = [
+{{- range .Upstreams}}
+    '{{.URL}}': '{{.Name}}',
+{{- end}}
+]
+def redirect = { repositories ->
+    repositories.configureEach { repository ->
+        if (!(repository instanceof MavenArtifactRepository || repository instanceof IvyArtifactRepository)) {
+            return
+        }
+        def name = mirrors[repository.url.toString().replaceAll('/+$', '')]
+        if (name == null) {
+            return
+        }
+        repository.url = "${proxy}/repositories/${name}/"
+        if (proxy.startsWith('http:') && repository.hasProperty('allowInsecureProtocol')) {
+            repository.allowInsecureProtocol = true
+        }
+    }
+}
+settingsEvaluated { settings ->
+    redirect(settings.pluginManagement.repositories)
+    if (settings.hasProperty('dependencyResolutionManagement')) {
+        redirect(settings.dependencyResolutionManagement.repositories)
+    }
+}
+allprojects {
+    buildscript {
+        redirect(repositories)
+    }
+    redirect(repositories)
+}
+`))
+
+// InitScript returns a Gradle init script resolving the dependencies of
+// builds from the upstream repositories through the proxy at proxyURL
+func InitScript(proxyURL string, upstreams []Upstream) (string, error) {
+	proxyURL = strings.TrimRight(proxyURL, "/")
+	if err := (Upstream{Name: "proxy", URL: proxyURL}).validate(); err != nil {
+		return "", fmt.Errorf("invalid dependency proxy URL %q", proxyURL)
+	}
+	if parsed, _ := url.Parse(proxyURL); parsed.User != nil {
+		return "", fmt.Errorf("invalid dependency proxy URL %q: credentials are not supported", proxyURL)
+	}
+	for _, upstream := range upstreams {
+		if err := upstream.validate(); err != nil {
+			return "", err
+		}
+	}
+
+	var script strings.Builder
+	err := initScript.Execute(&script, struct {
+		Proxy     string
+		Upstreams []Upstream
+	}{proxyURL, upstreams})
+	if err != nil {
+		return "", err
+	}
+	return script.String(), nil
+}
@@ -0,0 +1,441 @@
+// Package proxy serves remote Maven and Ivy repositories through a local
+// cache, so the dependency downloads of all workers reach each upstream
+// repository once and keep working while it is unreachable. Released
+// artifacts never change once published and are cached for good; metadata,
+// such as maven-metadata.xml and the files of snapshot versions, is fetched
+// again once it is older than the metadata TTL, and served stale if the
+// upstream repository fails.
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"distributed-gradle-building/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// namePattern accepts the names of upstream repositories, which are part of
+// the proxy's URLs
+var namePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]*$`)
+
+// Upstream is a remote repository served by the proxy under its name
+type Upstream struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
+
+// DefaultUpstreams are the public repositories Gradle builds resolve from:
+// Maven Central, Google's Maven repository and the Gradle plugin portal
+func DefaultUpstreams() []Upstream {
+	return []Upstream{
+		{Name: "central", URL: "https://repo.maven.apache.org/maven2"},
+		{Name: "google", URL: "https://dl.google.com/dl/android/maven2"},
+		{Name: "gradle-plugins", URL: "https://plugins.gradle.org/m2"},
+	}
+}
+
+// ParseUpstreams parses upstream repositories from a comma separated list of
+// name=url pairs, returning the defaults for an empty list
+func ParseUpstreams(value string) ([]Upstream, error) {
+	if strings.TrimSpace(value) == "" {
+		return DefaultUpstreams(), nil
+	}
+
+	var upstreams []Upstream
+	seen := make(map[string]bool)
+	for _, pair := range strings.Split(value, ",") {
+		name, rawURL, found := strings.Cut(strings.TrimSpace(pair), "=")
+		if !found {
+			return nil, fmt.Errorf("invalid upstream %q, expected name=url", pair)
+		}
+		upstream := Upstream{Name: strings.TrimSpace(name), URL: strings.TrimRight(strings.TrimSpace(rawURL), "/")}
+		if err := upstream.validate(); err != nil {
+			return nil, err
+		}
+		if seen[upstream.Name] {
+			return nil, fmt.Errorf("duplicate upstream %q", upstream.Name)
+		}
+		seen[upstream.Name] = true
+		upstreams = append(upstreams, upstream)
+	}
+	return upstreams, nil
+}
+
+// validate checks the name and URL of an upstream repository. URLs are
+// written into Gradle init scripts, so quotes and backslashes are rejected.
+func (u Upstream) validate() error {
+	if !namePattern.MatchString(u.Name) {
+		return fmt.Errorf("invalid upstream name %q", u.Name)
+	}
+	parsed, err := url.Parse(u.URL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("invalid URL %q of upstream %s", u.URL, u.Name)
+	}
+	if strings.ContainsAny(u.URL, `'"\$`) {
+		return fmt.Errorf("invalid URL %q of upstream %s", u.URL, u.Name)
+	}
+	return nil
+}
+
+// Config configures a Proxy
+type Config struct {
+	// Dir stores the cached files
+	Dir       string
+	Upstreams []Upstream
+	// MaxStorage is the size the cached files are kept under by evicting
+	// the least recently used ones, 0 for no limit
+	MaxStorage int64
+	// MetadataTTL is how long metadata is served before it is fetched again
+	MetadataTTL time.Duration
+	Client      *http.Client
+}
+
+// entry is a cached file
+type entry struct {
+	size     int64
+	fetched  time.Time
+	accessed time.Time
+}
+
+// fetch is a download from an upstream repository that concurrent requests
+// for the same file wait for
+type fetch struct {
+	done   chan struct{}
+	status int
+	err    error
+}
+
+// Proxy serves upstream repositories through a cache on disk
+type Proxy struct {
+	config    Config
+	upstreams map[string]string
+
+	mutex    sync.Mutex
+	entries  map[string]*entry
+	size     int64
+	fetching map[string]*fetch
+}
+
+// Stats summarizes the cache of a Proxy
+type Stats struct {
+	Files      int        `json:"files"`
+	Bytes      int64      `json:"bytes"`
+	MaxStorage int64      `json:"max_storage"`
+	Upstreams  []Upstream `json:"upstreams"`
+}
+
+// New returns a proxy caching in config.Dir, indexing the files already
+// cached there
+func New(config Config) (*Proxy, error) {
+	if config.Client == nil {
+		config.Client = &http.Client{Timeout: time.Minute}
+	}
+	if len(config.Upstreams) == 0 {
+		config.Upstreams = DefaultUpstreams()
+	}
+
+	p := &Proxy{
+		config:    config,
+		upstreams: make(map[string]string),
+		entries:   make(map[string]*entry),
+		fetching:  make(map[string]*fetch),
+	}
+	for _, upstream := range config.Upstreams {
+		if err := upstream.validate(); err != nil {
+			return nil, err
+		}
+		p.upstreams[upstream.Name] = upstream.URL
+	}
+
+	// Downloads interrupted by a restart are incomplete
+	if err := os.RemoveAll(p.tempDir()); err != nil {
+		return nil, fmt.Errorf("failed to remove incomplete downloads: %v", err)
+	}
+	if err := os.MkdirAll(p.tempDir(), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create storage directory: %v", err)
+	}
+	if err := p.index(); err != nil {
+		return nil, err
+	}
+	p.mutex.Lock()
+	p.evict()
+	p.mutex.Unlock()
+	return p, nil
+}
+
+// tempDir holds the downloads in progress
+func (p *Proxy) tempDir() string {
+	return filepath.Join(p.config.Dir, ".downloads")
+}
+
+// index records the files cached in the storage directory, taking their
+// modification time for when they were fetched and last used
+func (p *Proxy) index() error {
+	err := filepath.WalkDir(p.config.Dir, func(file string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && file == p.tempDir() {
+			return filepath.SkipDir
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		key, err := filepath.Rel(p.config.Dir, file)
+		if err != nil {
+			return err
+		}
+		p.entries[filepath.ToSlash(key)] = &entry{size: info.Size(), fetched: info.ModTime(), accessed: info.ModTime()}
+		p.size += info.Size()
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to index cached files: %v", err)
+	}
+	return nil
+}
+
+// Stats returns the number and size of the cached files
+func (p *Proxy) Stats() Stats {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return Stats{Files: len(p.entries), Bytes: p.size, MaxStorage: p.config.MaxStorage, Upstreams: p.config.Upstreams}
+}
+
+// mutable reports whether a file of a repository may change once published:
+// the metadata listing the versions of a module and the files of snapshot
+// versions
+func mutable(file string) bool {
+	return strings.HasPrefix(path.Base(file), "maven-metadata") || strings.Contains(file, "-SNAPSHOT/")
+}
+
+// ServeHTTP serves a file of an upstream repository, GET
+// /repositories/{repository}/{path...}
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	repository := r.PathValue("repository")
+	upstream, exists := p.upstreams[repository]
+	if !exists {
+		http.Error(w, "Unknown repository", http.StatusNotFound)
+		return
+	}
+	file := r.PathValue("path")
+	if file == "" || strings.HasSuffix(file, "/") || path.Clean("/"+file) != "/"+file {
+		// Directory listings are not cached
+		http.Error(w, "Invalid path", http.StatusNotFound)
+		return
+	}
+
+	key := repository + "/" + file
+	result, status := p.lookup(key, upstream+"/"+file)
+	metrics.DependencyProxyRequests.WithLabelValues(repository, result).Inc()
+	if status != http.StatusOK {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	cached, err := os.Open(filepath.Join(p.config.Dir, filepath.FromSlash(key)))
+	if err != nil {
+		// Evicted since it was looked up
+		http.Error(w, "File evicted, retry", http.StatusServiceUnavailable)
+		return
+	}
+	defer cached.Close()
+	info, err := cached.Stat()
+	if err != nil {
+		http.Error(w, "Failed to read cached file", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("X-Cache", result)
+	http.ServeContent(w, r, path.Base(file), info.ModTime(), cached)
+}
+
+// lookup makes a file available in the cache, downloading it if missing or,
+// for mutable files, expired. It returns the result counted by
+// DependencyProxyRequests and the status to answer with.
+func (p *Proxy) lookup(key, upstreamURL string) (string, int) {
+	for {
+		p.mutex.Lock()
+		cached, found := p.entries[key]
+		if found && (!mutable(key) || time.Since(cached.fetched) < p.config.MetadataTTL) {
+			cached.accessed = time.Now()
+			p.mutex.Unlock()
+			return metrics.ProxyHit, http.StatusOK
+		}
+
+		if pending, downloading := p.fetching[key]; downloading {
+			p.mutex.Unlock()
+			<-pending.done
+			if result, status, done := p.outcome(key, pending, metrics.ProxyHit); done {
+				return result, status
+			}
+			// Evicted already, so download it again
+			continue
+		}
+
+		pending := &fetch{done: make(chan struct{})}
+		p.fetching[key] = pending
+		p.mutex.Unlock()
+
+		pending.status, pending.err = p.download(key, upstreamURL)
+		if pending.err != nil {
+			log.Printf("Failed to fetch %s: %v", key, pending.err)
+		}
+		p.mutex.Lock()
+		delete(p.fetching, key)
+		if cached, exists := p.entries[key]; exists && pending.err != nil {
+			// The stale copy is served for another TTL rather than every
+			// request waiting for the failing upstream
+			cached.fetched = time.Now()
+		}
+		p.mutex.Unlock()
+		close(pending.done)
+
+		if result, status, done := p.outcome(key, pending, metrics.ProxyMiss); done {
+			return result, status
+		}
+	}
+}
+
+// outcome returns the result and status of a request for a file once its
+// download finished, with result for a successful download. A copy of the
+// file cached earlier is served stale if the download failed. done is false
+// if the file was evicted since.
+func (p *Proxy) outcome(key string, pending *fetch, result string) (string, int, bool) {
+	if pending.err == nil && pending.status != http.StatusOK {
+		return metrics.ProxyNotFound, pending.status, true
+	}
+
+	p.mutex.Lock()
+	cached, found := p.entries[key]
+	if found {
+		cached.accessed = time.Now()
+	}
+	p.mutex.Unlock()
+	switch {
+	case pending.err == nil:
+		return result, http.StatusOK, found
+	case found:
+		// A stale copy is better than failing builds during an outage
+		return metrics.ProxyStale, http.StatusOK, true
+	default:
+		return metrics.ProxyError, http.StatusBadGateway, true
+	}
+}
+
+// download fetches a file from its upstream repository into the cache. It
+// returns the status of a file the upstream repository does not have, or an
+// error if the repository failed.
+func (p *Proxy) download(key, upstreamURL string) (int, error) {
+	response, err := p.config.Client.Get(upstreamURL)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	switch {
+	case response.StatusCode == http.StatusNotFound || response.StatusCode == http.StatusGone:
+		return http.StatusNotFound, nil
+	case response.StatusCode != http.StatusOK:
+		return 0, fmt.Errorf("upstream returned %s", response.Status)
+	}
+
+	temp, err := os.CreateTemp(p.tempDir(), "download-")
+	if err != nil {
+		return 0, fmt.Errorf("failed to store download: %v", err)
+	}
+	defer os.Remove(temp.Name())
+	size, err := io.Copy(temp, response.Body)
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to download: %v", err)
+	}
+	if response.ContentLength >= 0 && size != response.ContentLength {
+		return 0, fmt.Errorf("download truncated at %d of %d bytes", size, response.ContentLength)
+	}
+	metrics.DependencyProxyUpstreamBytes.WithLabelValues(strings.SplitN(key, "/", 2)[0]).Add(float64(size))
+
+	target := filepath.Join(p.config.Dir, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return 0, fmt.Errorf("failed to store download: %v", err)
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if err := os.Rename(temp.Name(), target); err != nil {
+		return 0, fmt.Errorf("failed to store download: %v", err)
+	}
+	now := time.Now()
+	if previous, exists := p.entries[key]; exists {
+		p.size -= previous.size
+	}
+	p.entries[key] = &entry{size: size, fetched: now, accessed: now}
+	p.size += size
+	p.evict()
+	return http.StatusOK, nil
+}
+
+// evict removes the least recently used files until the cache fits in its
+// maximum size. Must be called with the mutex held.
+func (p *Proxy) evict() {
+	if p.config.MaxStorage <= 0 || p.size <= p.config.MaxStorage {
+		return
+	}
+
+	keys := make([]string, 0, len(p.entries))
+	for key := range p.entries {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return p.entries[keys[i]].accessed.Before(p.entries[keys[j]].accessed)
+	})
+	for _, key := range keys {
+		if p.size <= p.config.MaxStorage {
+			break
+		}
+		err := os.Remove(filepath.Join(p.config.Dir, filepath.FromSlash(key)))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("Failed to evict %s: %v", key, err)
+			continue
+		}
+		p.size -= p.entries[key].size
+		delete(p.entries, key)
+		metrics.DependencyProxyEvictions.Inc()
+	}
+}
+
+// Describe implements prometheus.Collector
+func (p *Proxy) Describe(ch chan<- *prometheus.Desc) {
+	ch <- metrics.DependencyProxyStorageBytesDesc
+	ch <- metrics.DependencyProxyStorageFilesDesc
+}
+
+// Collect implements prometheus.Collector, reporting the size of the cache
+func (p *Proxy) Collect(ch chan<- prometheus.Metric) {
+	stats := p.Stats()
+	ch <- prometheus.MustNewConstMetric(metrics.DependencyProxyStorageBytesDesc, prometheus.GaugeValue, float64(stats.Bytes))
+	ch <- prometheus.MustNewConstMetric(metrics.DependencyProxyStorageFilesDesc, prometheus.GaugeValue, float64(stats.Files))
+}
@@ -0,0 +1,215 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// upstream serves files from a map, counting the requests for each
+type upstream struct {
+	mutex    sync.Mutex
+	files    map[string]string
+	requests map[string]int
+	failing  atomic.Bool
+	server   *httptest.Server
+}
+
+func newUpstream(t *testing.T, files map[string]string) *upstream {
+	u := &upstream{files: files, requests: make(map[string]int)}
+	u.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if u.failing.Load() {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		u.mutex.Lock()
+		u.requests[r.URL.Path]++
+		content, exists := u.files[r.URL.Path]
+		u.mutex.Unlock()
+		if !exists {
+			http.NotFound(w, r)
+			return
+		}
+		// Slow enough for concurrent requests to overlap
+		time.Sleep(10 * time.Millisecond)
+		io.WriteString(w, content)
+	}))
+	t.Cleanup(u.server.Close)
+	return u
+}
+
+func (u *upstream) count(path string) int {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	return u.requests[path]
+}
+
+func (u *upstream) set(path, content string) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	u.files[path] = content
+}
+
+func newProxy(t *testing.T, dir string, u *upstream, config Config) *httptest.Server {
+	t.Helper()
+	config.Dir = dir
+	config.Upstreams = []Upstream{{Name: "central", URL: u.server.URL + "/maven2"}}
+	p, err := New(config)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("GET /repositories/{repository}/{path...}", p)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func get(t *testing.T, server *httptest.Server, path string) (int, string, string) {
+	t.Helper()
+	response, err := http.Get(server.URL + path)
+	if err != nil {
+		t.Fatalf("GET %s failed: %v", path, err)
+	}
+	defer response.Body.Close()
+	body, _ := io.ReadAll(response.Body)
+	return response.StatusCode, response.Header.Get("X-Cache"), string(body)
+}
+
+const (
+	jar      = "/maven2/com/example/lib/1.0/lib-1.0.jar"
+	metadata = "/maven2/com/example/lib/maven-metadata.xml"
+)
+
+func TestProxyCachesArtifacts(t *testing.T) {
+	u := newUpstream(t, map[string]string{jar: "jar-1.0"})
+	server := newProxy(t, t.TempDir(), u, Config{MetadataTTL: time.Hour})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if status, _, body := get(t, server, "/repositories/central/com/example/lib/1.0/lib-1.0.jar"); status != http.StatusOK || body != "jar-1.0" {
+				t.Errorf("Expected the artifact, got %d %q", status, body)
+			}
+		}()
+	}
+	wg.Wait()
+	if status, result, _ := get(t, server, "/repositories/central/com/example/lib/1.0/lib-1.0.jar"); status != http.StatusOK || result != "hit" {
+		t.Errorf("Expected a cache hit, got %d %s", status, result)
+	}
+	if count := u.count(jar); count != 1 {
+		t.Errorf("Expected concurrent requests to download the artifact once, got %d downloads", count)
+	}
+
+	// Released artifacts are served even when the upstream fails
+	u.failing.Store(true)
+	if status, result, _ := get(t, server, "/repositories/central/com/example/lib/1.0/lib-1.0.jar"); status != http.StatusOK || result != "hit" {
+		t.Errorf("Expected a cache hit during an outage, got %d %s", status, result)
+	}
+	if status, _, _ := get(t, server, "/repositories/central/com/example/lib/2.0/lib-2.0.jar"); status != http.StatusBadGateway {
+		t.Errorf("Expected an uncached artifact to fail during an outage, got %d", status)
+	}
+	u.failing.Store(false)
+
+	for path, expected := range map[string]int{
+		"/repositories/central/com/example/lib/2.0/lib-2.0.jar": http.StatusNotFound,
+		"/repositories/unknown/com/example/lib/1.0/lib-1.0.jar": http.StatusNotFound,
+		"/repositories/central/com/example/../../../etc/passwd": http.StatusNotFound,
+		"/repositories/central/com/example/lib/1.0/":            http.StatusNotFound,
+	} {
+		if status, _, _ := get(t, server, path); status != expected {
+			t.Errorf("%s: expected %d, got %d", path, expected, status)
+		}
+	}
+}
+
+func TestProxyRevalidatesMetadata(t *testing.T) {
+	u := newUpstream(t, map[string]string{metadata: "<versions>1.0</versions>"})
+	server := newProxy(t, t.TempDir(), u, Config{MetadataTTL: 50 * time.Millisecond})
+	path := "/repositories/central/com/example/lib/maven-metadata.xml"
+
+	get(t, server, path)
+	u.set(metadata, "<versions>1.0 2.0</versions>")
+	if _, result, body := get(t, server, path); result != "hit" || body != "<versions>1.0</versions>" {
+		t.Errorf("Expected fresh metadata from the cache, got %s %q", result, body)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if _, result, body := get(t, server, path); result != "miss" || body != "<versions>1.0 2.0</versions>" {
+		t.Errorf("Expected expired metadata to be fetched again, got %s %q", result, body)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	u.failing.Store(true)
+	if status, result, body := get(t, server, path); status != http.StatusOK || result != "stale" || body != "<versions>1.0 2.0</versions>" {
+		t.Errorf("Expected stale metadata during an outage, got %d %s %q", status, result, body)
+	}
+	if _, result, _ := get(t, server, path); result != "hit" {
+		t.Errorf("Expected the stale metadata to be kept for another TTL, got %s", result)
+	}
+}
+
+func TestProxyEvictsLeastRecentlyUsed(t *testing.T) {
+	files := map[string]string{}
+	for _, version := range []string{"1", "2", "3"} {
+		files["/maven2/com/example/lib/"+version+"/lib.jar"] = strings.Repeat(version, 100)
+	}
+	u := newUpstream(t, files)
+	dir := t.TempDir()
+	server := newProxy(t, dir, u, Config{MaxStorage: 250})
+
+	get(t, server, "/repositories/central/com/example/lib/1/lib.jar")
+	get(t, server, "/repositories/central/com/example/lib/2/lib.jar")
+	get(t, server, "/repositories/central/com/example/lib/1/lib.jar")
+	get(t, server, "/repositories/central/com/example/lib/3/lib.jar")
+
+	if _, err := os.Stat(filepath.Join(dir, "central/com/example/lib/2/lib.jar")); !os.IsNotExist(err) {
+		t.Errorf("Expected the least recently used artifact to be evicted, got %v", err)
+	}
+	if _, result, _ := get(t, server, "/repositories/central/com/example/lib/1/lib.jar"); result != "hit" {
+		t.Errorf("Expected the recently used artifact to be kept, got %s", result)
+	}
+
+	// A restarted proxy finds the cached files
+	p, err := New(Config{Dir: dir, Upstreams: []Upstream{{Name: "central", URL: u.server.URL + "/maven2"}}})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	if stats := p.Stats(); stats.Files != 2 || stats.Bytes != 200 {
+		t.Errorf("Expected 2 cached files of 200 bytes, got %+v", stats)
+	}
+}
+
+func TestParseUpstreams(t *testing.T) {
+	upstreams, err := ParseUpstreams("central=https://repo.maven.apache.org/maven2/, internal = https://nexus.example.com/repository/releases")
+	if err != nil {
+		t.Fatalf("ParseUpstreams failed: %v", err)
+	}
+	if len(upstreams) != 2 || upstreams[0].URL != "https://repo.maven.apache.org/maven2" || upstreams[1].Name != "internal" {
+		t.Errorf("Unexpected upstreams %+v", upstreams)
+	}
+
+	if upstreams, _ := ParseUpstreams(""); len(upstreams) != len(DefaultUpstreams()) {
+		t.Errorf("Expected the default upstreams, got %+v", upstreams)
+	}
+	for _, value := range []string{
+		"central",
+		"Central=https://repo.maven.apache.org/maven2",
+		"central=ftp://repo.example.com",
+		"central=https://repo.example.com/'+evil+'",
+		"a=https://one.example.com,a=https://two.example.com",
+	} {
+		if _, err := ParseUpstreams(value); err == nil {
+			t.Errorf("Expected %q to be rejected", value)
+		}
+	}
+}
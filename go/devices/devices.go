@@ -0,0 +1,300 @@
+// Package devices describes the Android emulators and devices attached to
+// workers for instrumentation tests. Workers discover them with adb and
+// advertise them to the coordinator, which sends builds needing devices,
+// such as connectedAndroidTest, to a worker with suitable free ones. Each
+// device is locked to one build at a time.
+package devices
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kinds of devices
+const (
+	KindEmulator = "emulator"
+	KindDevice   = "device"
+)
+
+// MaxCount is the most devices a build may ask for
+const MaxCount = 16
+
+// discoveryTimeout bounds the adb calls of a discovery
+const discoveryTimeout = 10 * time.Second
+
+// abiPattern matches Android ABIs, such as arm64-v8a or x86_64
+var abiPattern = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+
+// connectedTaskPattern matches the tasks of the Android Gradle plugin that
+// run instrumentation tests on connected devices
+var connectedTaskPattern = regexp.MustCompile(`(^|:)connected[A-Za-z0-9]*(AndroidTest|Check)$`)
+
+// Device is an emulator or device attached to a worker
+type Device struct {
+	Serial   string `json:"serial"`
+	Kind     string `json:"kind"`
+	Model    string `json:"model,omitempty"`
+	APILevel int    `json:"api_level"`
+	ABI      string `json:"abi"`
+	// BuildID is the build the device is locked to, if any
+	BuildID string `json:"build_id,omitempty"`
+}
+
+// Requirement selects the devices a build runs on. Zero fields accept any
+// device.
+type Requirement struct {
+	// Count is how many devices the build needs, 1 if zero
+	Count       int    `json:"count,omitempty"`
+	MinAPILevel int    `json:"min_api_level,omitempty"`
+	MaxAPILevel int    `json:"max_api_level,omitempty"`
+	ABI         string `json:"abi,omitempty"`
+	// Kind is emulator or device
+	Kind string `json:"kind,omitempty"`
+}
+
+// Validate checks the fields of the requirement
+func (r Requirement) Validate() error {
+	if r.Count < 0 || r.Count > MaxCount {
+		return fmt.Errorf("device count must be between 1 and %d", MaxCount)
+	}
+	if r.MinAPILevel < 0 || r.MaxAPILevel < 0 || (r.MaxAPILevel > 0 && r.MaxAPILevel < r.MinAPILevel) {
+		return fmt.Errorf("invalid API level range %d to %d", r.MinAPILevel, r.MaxAPILevel)
+	}
+	if r.ABI != "" && !abiPattern.MatchString(r.ABI) {
+		return fmt.Errorf("invalid ABI %q", r.ABI)
+	}
+	if r.Kind != "" && r.Kind != KindEmulator && r.Kind != KindDevice {
+		return fmt.Errorf("device kind must be %s or %s", KindEmulator, KindDevice)
+	}
+	return nil
+}
+
+// count returns how many devices the requirement asks for
+func (r Requirement) count() int {
+	return max(r.Count, 1)
+}
+
+// Matches reports whether a device meets the requirement
+func (r Requirement) Matches(device Device) bool {
+	return device.APILevel >= r.MinAPILevel &&
+		(r.MaxAPILevel == 0 || device.APILevel <= r.MaxAPILevel) &&
+		(r.ABI == "" || device.ABI == r.ABI) &&
+		(r.Kind == "" || device.Kind == r.Kind)
+}
+
+// String describes the requirement for messages
+func (r Requirement) String() string {
+	description := fmt.Sprintf("%d", r.count())
+	if r.Kind != "" {
+		description += " " + r.Kind
+	}
+	if r.ABI != "" {
+		description += " " + r.ABI
+	}
+	switch {
+	case r.MinAPILevel > 0 && r.MaxAPILevel > 0:
+		description += fmt.Sprintf(" API %d-%d", r.MinAPILevel, r.MaxAPILevel)
+	case r.MinAPILevel > 0:
+		description += fmt.Sprintf(" API %d+", r.MinAPILevel)
+	case r.MaxAPILevel > 0:
+		description += fmt.Sprintf(" API <=%d", r.MaxAPILevel)
+	}
+	return description + " device(s)"
+}
+
+// NeedsDevices reports whether a Gradle task runs instrumentation tests on
+// connected devices, such as connectedAndroidTest or :app:connectedCheck
+func NeedsDevices(task string) bool {
+	return connectedTaskPattern.MatchString(task)
+}
+
+// Locks lock devices to builds. The zero value is ready to use.
+type Locks struct {
+	mutex sync.Mutex
+	held  map[string]string
+}
+
+// Acquire locks devices meeting the requirement to a build. With serials
+// given it locks exactly those, otherwise the free matching devices of
+// attached with the lowest API levels. It fails if not enough devices are
+// attached and free.
+func (l *Locks) Acquire(buildID string, attached []Device, requirement Requirement, serials []string) ([]Device, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	var candidates []Device
+	for _, device := range attached {
+		if holder, locked := l.held[device.Serial]; (locked && holder != buildID) || !requirement.Matches(device) {
+			continue
+		}
+		if len(serials) > 0 && !slices.Contains(serials, device.Serial) {
+			continue
+		}
+		candidates = append(candidates, device)
+	}
+	// Newer devices are left to builds that need them
+	slices.SortStableFunc(candidates, func(a, b Device) int { return a.APILevel - b.APILevel })
+
+	count := requirement.count()
+	if len(serials) > 0 {
+		count = len(serials)
+	}
+	if len(candidates) < count {
+		return nil, fmt.Errorf("%s not available", requirement)
+	}
+
+	if l.held == nil {
+		l.held = make(map[string]string)
+	}
+	allocated := candidates[:count]
+	for i := range allocated {
+		l.held[allocated[i].Serial] = buildID
+		allocated[i].BuildID = buildID
+	}
+	return allocated, nil
+}
+
+// Available reports whether enough free devices meet the requirement
+func (l *Locks) Available(attached []Device, requirement Requirement) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	free := 0
+	for _, device := range attached {
+		if _, locked := l.held[device.Serial]; !locked && requirement.Matches(device) {
+			free++
+		}
+	}
+	return free >= requirement.count()
+}
+
+// Release unlocks the devices of a build
+func (l *Locks) Release(buildID string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for serial, holder := range l.held {
+		if holder == buildID {
+			delete(l.held, serial)
+		}
+	}
+}
+
+// Annotate returns the devices with the builds they are locked to
+func (l *Locks) Annotate(attached []Device) []Device {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	annotated := make([]Device, len(attached))
+	for i, device := range attached {
+		device.BuildID = l.held[device.Serial]
+		annotated[i] = device
+	}
+	return annotated
+}
+
+// Serials returns the serial numbers of devices
+func Serials(devices []Device) []string {
+	serials := make([]string, len(devices))
+	for i, device := range devices {
+		serials[i] = device.Serial
+	}
+	return serials
+}
+
+// Environ returns the environment variables selecting the devices of a
+// build: adb and the Android Gradle plugin only use the devices listed in
+// ANDROID_SERIAL
+func Environ(devices []Device) []string {
+	return []string{"ANDROID_SERIAL=" + strings.Join(Serials(devices), ",")}
+}
+
+// Discover lists the emulators and devices adb reports as online, with their
+// API level and ABI
+func Discover(adb string) ([]Device, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), discoveryTimeout)
+	defer cancel()
+
+	output, err := exec.CommandContext(ctx, adb, "devices", "-l").Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list devices: %v", err)
+	}
+	var devices []Device
+	for _, device := range ParseDevices(string(output)) {
+		properties, err := exec.CommandContext(ctx, adb, "-s", device.Serial, "shell", "getprop").Output()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the properties of device %s: %v", device.Serial, err)
+		}
+		devices = append(devices, device.withProperties(ParseProperties(string(properties))))
+	}
+	return devices, nil
+}
+
+// ParseDevices parses the output of adb devices -l, leaving out devices
+// that are offline or not authorized
+func ParseDevices(output string) []Device {
+	var devices []Device
+	lines := bufio.NewScanner(strings.NewReader(output))
+	for lines.Scan() {
+		fields := strings.Fields(lines.Text())
+		if len(fields) < 2 || fields[1] != "device" {
+			continue
+		}
+		device := Device{Serial: fields[0], Kind: KindDevice}
+		if strings.HasPrefix(device.Serial, "emulator-") {
+			device.Kind = KindEmulator
+		}
+		for _, field := range fields[2:] {
+			if model, found := strings.CutPrefix(field, "model:"); found {
+				device.Model = model
+			}
+		}
+		devices = append(devices, device)
+	}
+	return devices
+}
+
+// ParseProperties parses the output of getprop
+func ParseProperties(output string) map[string]string {
+	properties := make(map[string]string)
+	lines := bufio.NewScanner(strings.NewReader(output))
+	for lines.Scan() {
+		key, value, found := strings.Cut(strings.TrimSpace(lines.Text()), "]: [")
+		if found && strings.HasPrefix(key, "[") && strings.HasSuffix(value, "]") {
+			properties[key[1:]] = value[:len(value)-1]
+		}
+	}
+	return properties
+}
+
+// withProperties completes a device from its system properties
+func (d Device) withProperties(properties map[string]string) Device {
+	d.APILevel, _ = strconv.Atoi(properties["ro.build.version.sdk"])
+	d.ABI = properties["ro.product.cpu.abi"]
+	if model := properties["ro.product.model"]; model != "" {
+		d.Model = model
+	}
+	// Emulators reached over TCP are not named emulator-<port>
+	if properties["ro.kernel.qemu"] == "1" || properties["ro.boot.qemu"] == "1" {
+		d.Kind = KindEmulator
+	}
+	return d
+}
+
+// ADB returns the adb executable of an Android SDK, or adb from the PATH if
+// sdk is empty
+func ADB(sdk string) string {
+	if sdk == "" {
+		return "adb"
+	}
+	return filepath.Join(sdk, "platform-tools", "adb")
+}
@@ -0,0 +1,144 @@
+package devices
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const adbDevices = `List of devices attached
+emulator-5554          device product:sdk_gphone64_x86_64 model:sdk_gphone64_x86_64 device:emu64x transport_id:1
+R58M123ABC             device usb:1-1 product:beyond1 model:SM_G973F device:beyond1 transport_id:2
+emulator-5556          offline transport_id:3
+0123456789ABCDEF       unauthorized usb:1-2 transport_id:4
+`
+
+func TestParseDevices(t *testing.T) {
+	devices := ParseDevices(adbDevices)
+	if len(devices) != 2 {
+		t.Fatalf("Expected the two online devices, got %+v", devices)
+	}
+	if devices[0] != (Device{Serial: "emulator-5554", Kind: KindEmulator, Model: "sdk_gphone64_x86_64"}) {
+		t.Errorf("Unexpected emulator %+v", devices[0])
+	}
+	if devices[1] != (Device{Serial: "R58M123ABC", Kind: KindDevice, Model: "SM_G973F"}) {
+		t.Errorf("Unexpected device %+v", devices[1])
+	}
+
+	properties := ParseProperties("[ro.build.version.sdk]: [34]\n[ro.product.cpu.abi]: [x86_64]\n[ro.kernel.qemu]: [1]\n[empty]: []\nnot a property\n")
+	device := Device{Serial: "10.0.2.2:5555", Kind: KindDevice}.withProperties(properties)
+	if device.APILevel != 34 || device.ABI != "x86_64" || device.Kind != KindEmulator {
+		t.Errorf("Expected the properties to complete the device, got %+v", device)
+	}
+}
+
+func TestDiscover(t *testing.T) {
+	sdk := t.TempDir()
+	adb := ADB(sdk)
+	script := "#!/bin/sh\n" +
+		"if [ \"$1\" = devices ]; then printf '%s' '" + adbDevices + "'; exit 0; fi\n" +
+		"case \"$2\" in emulator-5554) echo '[ro.build.version.sdk]: [34]'; echo '[ro.product.cpu.abi]: [x86_64]';;\n" +
+		"*) echo '[ro.build.version.sdk]: [30]'; echo '[ro.product.cpu.abi]: [arm64-v8a]'; echo '[ro.product.model]: [Galaxy S10]';; esac\n"
+	if err := os.MkdirAll(filepath.Dir(adb), 0755); err != nil {
+		t.Fatalf("Failed to create the SDK: %v", err)
+	}
+	if err := os.WriteFile(adb, []byte(script), 0755); err != nil {
+		t.Fatalf("Failed to write adb: %v", err)
+	}
+
+	devices, err := Discover(adb)
+	if err != nil {
+		t.Fatalf("Discover failed: %v", err)
+	}
+	expected := []Device{
+		{Serial: "emulator-5554", Kind: KindEmulator, Model: "sdk_gphone64_x86_64", APILevel: 34, ABI: "x86_64"},
+		{Serial: "R58M123ABC", Kind: KindDevice, Model: "Galaxy S10", APILevel: 30, ABI: "arm64-v8a"},
+	}
+	if len(devices) != 2 || devices[0] != expected[0] || devices[1] != expected[1] {
+		t.Errorf("Expected %+v, got %+v", expected, devices)
+	}
+
+	if _, err := Discover(filepath.Join(sdk, "missing")); err == nil {
+		t.Errorf("Expected a missing adb to fail discovery")
+	}
+}
+
+func TestRequirement(t *testing.T) {
+	for _, requirement := range []Requirement{{}, {Count: 2, MinAPILevel: 30, MaxAPILevel: 34, ABI: "arm64-v8a", Kind: KindDevice}} {
+		if err := requirement.Validate(); err != nil {
+			t.Errorf("Expected %+v to be valid, got %v", requirement, err)
+		}
+	}
+	for _, requirement := range []Requirement{{Count: -1}, {Count: MaxCount + 1}, {MinAPILevel: 34, MaxAPILevel: 30}, {ABI: "x86; rm"}, {Kind: "simulator"}} {
+		if err := requirement.Validate(); err == nil {
+			t.Errorf("Expected %+v to be rejected", requirement)
+		}
+	}
+
+	device := Device{Serial: "emulator-5554", Kind: KindEmulator, APILevel: 33, ABI: "x86_64"}
+	if !(Requirement{MinAPILevel: 33, ABI: "x86_64", Kind: KindEmulator}).Matches(device) {
+		t.Errorf("Expected the emulator to match")
+	}
+	if (Requirement{MinAPILevel: 34}).Matches(device) || (Requirement{MaxAPILevel: 30}).Matches(device) || (Requirement{Kind: KindDevice}).Matches(device) {
+		t.Errorf("Expected the emulator not to match")
+	}
+	if description := (Requirement{Count: 2, Kind: KindEmulator, MinAPILevel: 33}).String(); description != "2 emulator API 33+ device(s)" {
+		t.Errorf("Unexpected description %q", description)
+	}
+
+	for task, expected := range map[string]bool{
+		"connectedAndroidTest":           true,
+		"connectedDebugAndroidTest":      true,
+		":app:connectedCheck":            true,
+		"test":                           false,
+		"assembleAndroidTest":            false,
+		"disconnectedDebugAndroidTest":   false,
+		":app:connectedAndroidTestSetup": false,
+	} {
+		if NeedsDevices(task) != expected {
+			t.Errorf("NeedsDevices(%q) = %v", task, !expected)
+		}
+	}
+}
+
+func TestLocks(t *testing.T) {
+	attached := []Device{
+		{Serial: "emulator-5556", Kind: KindEmulator, APILevel: 34, ABI: "x86_64"},
+		{Serial: "emulator-5554", Kind: KindEmulator, APILevel: 30, ABI: "x86_64"},
+		{Serial: "R58M123ABC", Kind: KindDevice, APILevel: 33, ABI: "arm64-v8a"},
+	}
+	var locks Locks
+
+	// The oldest matching device is taken first
+	first, err := locks.Acquire("build-1", attached, Requirement{ABI: "x86_64"}, nil)
+	if err != nil || len(first) != 1 || first[0].Serial != "emulator-5554" || first[0].BuildID != "build-1" {
+		t.Fatalf("Expected the API 30 emulator, got %+v: %v", first, err)
+	}
+	if !locks.Available(attached, Requirement{ABI: "x86_64"}) || locks.Available(attached, Requirement{Count: 2, ABI: "x86_64"}) {
+		t.Errorf("Expected one x86_64 emulator to be left")
+	}
+	if _, err := locks.Acquire("build-2", attached, Requirement{}, []string{"emulator-5554"}); err == nil {
+		t.Errorf("Expected a locked device to be refused")
+	}
+	second, err := locks.Acquire("build-2", attached, Requirement{Count: 2}, nil)
+	if err != nil || strings.Join(Serials(second), ",") != "R58M123ABC,emulator-5556" {
+		t.Fatalf("Expected the remaining devices, got %+v: %v", second, err)
+	}
+	if environ := Environ(second); environ[0] != "ANDROID_SERIAL=R58M123ABC,emulator-5556" {
+		t.Errorf("Unexpected environment %v", environ)
+	}
+
+	annotated := locks.Annotate(attached)
+	if annotated[0].BuildID != "build-2" || annotated[1].BuildID != "build-1" || attached[0].BuildID != "" {
+		t.Errorf("Expected the devices annotated with their builds, got %+v", annotated)
+	}
+
+	locks.Release("build-2")
+	if _, err := locks.Acquire("build-3", attached, Requirement{}, []string{"emulator-5556", "R58M123ABC"}); err != nil {
+		t.Errorf("Expected the released devices to be locked again, got %v", err)
+	}
+	if _, err := locks.Acquire("build-4", attached, Requirement{}, []string{"emulator-5558"}); err == nil || !strings.Contains(err.Error(), "not available") {
+		t.Errorf("Expected a device that is not attached to be refused, got %v", err)
+	}
+}
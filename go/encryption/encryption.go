@@ -0,0 +1,220 @@
+// Package encryption encrypts data at rest with AES-256-GCM, so proprietary
+// build outputs are not stored in plaintext on shared cache nodes. The data
+// key is fetched when a store starts, from HashiCorp Vault, from AWS KMS or
+// from a file such as a mounted Kubernetes secret.
+package encryption
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+
+	"distributed-gradle-building/secrets"
+)
+
+// Key providers
+const (
+	KeyProviderVault  = "vault"
+	KeyProviderAWSKMS = "aws-kms"
+	KeyProviderFile   = "file"
+)
+
+// KeySize is the size of data keys: AES-256
+const KeySize = 32
+
+// magic starts every sealed value, followed by the format version
+var magic = []byte("DGBE")
+
+const formatVersion = 1
+
+// Config selects where the data key comes from. The zero Config disables
+// encryption.
+type Config struct {
+	KeyProvider string `json:"key_provider"`
+	// KeyID names the key. It is stored with everything sealed under the
+	// key, so data sealed under another key is recognised.
+	KeyID string `json:"key_id"`
+	// VaultKey is the "path#field" of a base64 encoded key in Vault, read
+	// from VAULT_ADDR with VAULT_TOKEN
+	VaultKey string `json:"vault_key,omitempty"`
+	// KMSCiphertext is a base64 data key encrypted with AWS KMS, such as the
+	// CiphertextBlob returned by GenerateDataKey. It is decrypted with the
+	// credentials in AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and
+	// AWS_SESSION_TOKEN.
+	KMSCiphertext string `json:"kms_ciphertext,omitempty"`
+	KMSRegion     string `json:"kms_region,omitempty"`
+	// KMSEndpoint overrides the regional KMS endpoint, e.g. for VPC endpoints
+	KMSEndpoint string `json:"kms_endpoint,omitempty"`
+	// KeyFile is the path of a file holding a base64 encoded key
+	KeyFile string `json:"key_file,omitempty"`
+}
+
+// Enabled reports whether the configuration enables encryption
+func (c Config) Enabled() bool {
+	return c.KeyProvider != ""
+}
+
+// Validate checks that the key provider is known and configured
+func (c Config) Validate() error {
+	if !c.Enabled() {
+		return nil
+	}
+	if c.KeyID == "" || len(c.KeyID) > 255 {
+		return fmt.Errorf("key_id is required and must be at most 255 bytes")
+	}
+
+	switch c.KeyProvider {
+	case KeyProviderVault:
+		if c.VaultKey == "" || !strings.Contains(c.VaultKey, "#") {
+			return fmt.Errorf("vault_key must be \"path#field\"")
+		}
+	case KeyProviderAWSKMS:
+		if c.KMSCiphertext == "" {
+			return fmt.Errorf("kms_ciphertext is required")
+		}
+		if c.KMSRegion == "" && c.KMSEndpoint == "" {
+			return fmt.Errorf("kms_region or kms_endpoint is required")
+		}
+	case KeyProviderFile:
+		if c.KeyFile == "" {
+			return fmt.Errorf("key_file is required")
+		}
+	default:
+		return fmt.Errorf("unknown key provider %q", c.KeyProvider)
+	}
+	return nil
+}
+
+// Cipher seals and opens data under one key
+type Cipher struct {
+	keyID string
+	aead  cipher.AEAD
+}
+
+// NewCipher creates a cipher for a 256-bit key
+func NewCipher(key []byte, keyID string) (*Cipher, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("key must be %d bytes, got %d", KeySize, len(key))
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %v", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %v", err)
+	}
+	return &Cipher{keyID: keyID, aead: aead}, nil
+}
+
+// Load fetches the key of a configuration and creates its cipher. It returns
+// nil if the configuration does not enable encryption.
+func Load(config Config) (*Cipher, error) {
+	if !config.Enabled() {
+		return nil, nil
+	}
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid encryption configuration: %v", err)
+	}
+
+	key, err := fetchKey(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch encryption key %s from %s: %v", config.KeyID, config.KeyProvider, err)
+	}
+	return NewCipher(key, config.KeyID)
+}
+
+// fetchKey reads the data key from the configured provider
+func fetchKey(config Config) ([]byte, error) {
+	switch config.KeyProvider {
+	case KeyProviderVault:
+		vault := secrets.NewVaultFromEnv()
+		if vault == nil {
+			return nil, fmt.Errorf("VAULT_ADDR and VAULT_TOKEN are required")
+		}
+		path, field, _ := strings.Cut(config.VaultKey, "#")
+		encoded, err := vault.Read(strings.Trim(path, "/"), field)
+		if err != nil {
+			return nil, err
+		}
+		return decodeKey(encoded)
+	case KeyProviderAWSKMS:
+		return NewKMSFromEnv(config.KMSRegion, config.KMSEndpoint).Decrypt(config.KMSCiphertext)
+	case KeyProviderFile:
+		data, err := os.ReadFile(config.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		return decodeKey(string(data))
+	default:
+		return nil, fmt.Errorf("unknown key provider %q", config.KeyProvider)
+	}
+}
+
+// decodeKey decodes a base64 encoded key
+func decodeKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("key is not valid base64: %v", err)
+	}
+	return key, nil
+}
+
+// KeyID returns the name of the cipher's key
+func (c *Cipher) KeyID() string {
+	return c.keyID
+}
+
+// Seal encrypts plaintext. additionalData, such as the cache key, is
+// authenticated but not stored, so sealed data cannot be moved to another key.
+func (c *Cipher) Seal(plaintext, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %v", err)
+	}
+
+	sealed := make([]byte, 0, len(magic)+2+len(c.keyID)+len(nonce)+len(plaintext)+c.aead.Overhead())
+	sealed = append(sealed, magic...)
+	sealed = append(sealed, formatVersion, byte(len(c.keyID)))
+	sealed = append(sealed, c.keyID...)
+	sealed = append(sealed, nonce...)
+	return c.aead.Seal(sealed, nonce, plaintext, additionalData), nil
+}
+
+// Open decrypts data sealed with the same key and additional data
+func (c *Cipher) Open(sealed, additionalData []byte) ([]byte, error) {
+	if !IsSealed(sealed) {
+		return nil, fmt.Errorf("data is not encrypted")
+	}
+
+	rest := sealed[len(magic)+1:]
+	keyIDLength := int(rest[0])
+	rest = rest[1:]
+	if len(rest) < keyIDLength+c.aead.NonceSize() {
+		return nil, fmt.Errorf("encrypted data is truncated")
+	}
+
+	keyID := string(rest[:keyIDLength])
+	if keyID != c.keyID {
+		return nil, fmt.Errorf("data is encrypted with key %s, not %s", keyID, c.keyID)
+	}
+	rest = rest[keyIDLength:]
+
+	nonce, ciphertext := rest[:c.aead.NonceSize()], rest[c.aead.NonceSize():]
+	plaintext, err := c.aead.Open(nil, nonce, ciphertext, additionalData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt data: %v", err)
+	}
+	return plaintext, nil
+}
+
+// IsSealed reports whether data was sealed by a Cipher
+func IsSealed(data []byte) bool {
+	return len(data) > len(magic)+1 && bytes.HasPrefix(data, magic) && data[len(magic)] == formatVersion
+}
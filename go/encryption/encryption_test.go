@@ -0,0 +1,177 @@
+package encryption
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testKey(fill byte) []byte {
+	return bytes.Repeat([]byte{fill}, KeySize)
+}
+
+func TestSealAndOpen(t *testing.T) {
+	c, err := NewCipher(testKey(1), "cache-2024")
+	if err != nil {
+		t.Fatalf("NewCipher failed: %v", err)
+	}
+
+	plaintext := []byte("proprietary build output")
+	sealed, err := c.Seal(plaintext, []byte("classes"))
+	if err != nil {
+		t.Fatalf("Seal failed: %v", err)
+	}
+	if bytes.Contains(sealed, plaintext) || !IsSealed(sealed) {
+		t.Fatalf("Expected sealed data to be encrypted, got %q", sealed)
+	}
+
+	opened, err := c.Open(sealed, []byte("classes"))
+	if err != nil || !bytes.Equal(opened, plaintext) {
+		t.Fatalf("Expected %q, got %q, %v", plaintext, opened, err)
+	}
+
+	if _, err := c.Open(sealed, []byte("resources")); err == nil {
+		t.Error("Expected error for other additional data")
+	}
+
+	tampered := bytes.Clone(sealed)
+	tampered[len(tampered)-1] ^= 0xff
+	if _, err := c.Open(tampered, []byte("classes")); err == nil {
+		t.Error("Expected error for tampered data")
+	}
+
+	other, _ := NewCipher(testKey(2), "cache-2025")
+	if _, err := other.Open(sealed, []byte("classes")); err == nil || !strings.Contains(err.Error(), "encrypted with key cache-2024") {
+		t.Errorf("Expected key mismatch error, got %v", err)
+	}
+
+	if _, err := c.Open(plaintext, []byte("classes")); err == nil {
+		t.Error("Expected error for plaintext data")
+	}
+	if _, err := c.Open(sealed[:8], []byte("classes")); err == nil {
+		t.Error("Expected error for truncated data")
+	}
+}
+
+func TestNewCipherRequires256BitKey(t *testing.T) {
+	if _, err := NewCipher(make([]byte, 16), "short"); err == nil {
+		t.Error("Expected error for a 128-bit key")
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	valid := []Config{
+		{},
+		{KeyProvider: KeyProviderVault, KeyID: "k", VaultKey: "secret/data/cache#key"},
+		{KeyProvider: KeyProviderAWSKMS, KeyID: "k", KMSCiphertext: "AQID", KMSRegion: "eu-west-1"},
+		{KeyProvider: KeyProviderFile, KeyID: "k", KeyFile: "/run/secrets/cache-key"},
+	}
+	for _, config := range valid {
+		if err := config.Validate(); err != nil {
+			t.Errorf("Expected %+v to be valid, got %v", config, err)
+		}
+	}
+
+	invalid := []Config{
+		{KeyProvider: KeyProviderFile, KeyFile: "/run/secrets/cache-key"},
+		{KeyProvider: KeyProviderVault, KeyID: "k", VaultKey: "secret/data/cache"},
+		{KeyProvider: KeyProviderAWSKMS, KeyID: "k", KMSCiphertext: "AQID"},
+		{KeyProvider: KeyProviderFile, KeyID: "k"},
+		{KeyProvider: "gcp-kms", KeyID: "k"},
+	}
+	for _, config := range invalid {
+		if err := config.Validate(); err == nil {
+			t.Errorf("Expected %+v to be invalid", config)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	if c, err := Load(Config{}); c != nil || err != nil {
+		t.Errorf("Expected no cipher without configuration, got %v, %v", c, err)
+	}
+
+	keyFile := filepath.Join(t.TempDir(), "cache-key")
+	os.WriteFile(keyFile, []byte(base64.StdEncoding.EncodeToString(testKey(3))+"\n"), 0600)
+	c, err := Load(Config{KeyProvider: KeyProviderFile, KeyID: "file-key", KeyFile: keyFile})
+	if err != nil || c.KeyID() != "file-key" {
+		t.Fatalf("Expected cipher from key file, got %v, %v", c, err)
+	}
+
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/secret/data/cache" || r.Header.Get("X-Vault-Token") != "token" {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{"data": map[string]any{
+			"data":     map[string]string{"key": base64.StdEncoding.EncodeToString(testKey(4))},
+			"metadata": map[string]int{"version": 1},
+		}})
+	}))
+	defer vault.Close()
+	t.Setenv("VAULT_ADDR", vault.URL)
+	t.Setenv("VAULT_TOKEN", "token")
+
+	if _, err := Load(Config{KeyProvider: KeyProviderVault, KeyID: "vault-key", VaultKey: "secret/data/cache#key"}); err != nil {
+		t.Errorf("Expected cipher from Vault, got %v", err)
+	}
+	if _, err := Load(Config{KeyProvider: KeyProviderVault, KeyID: "vault-key", VaultKey: "secret/data/missing#key"}); err == nil {
+		t.Error("Expected error for a missing Vault secret")
+	}
+}
+
+func TestKMSDecrypt(t *testing.T) {
+	var request *http.Request
+	var body map[string]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		request = r
+		json.NewDecoder(r.Body).Decode(&body)
+		json.NewEncoder(w).Encode(map[string]string{"Plaintext": base64.StdEncoding.EncodeToString(testKey(5))})
+	}))
+	defer server.Close()
+
+	kms := &KMS{
+		Region:          "eu-west-1",
+		Endpoint:        server.URL,
+		AccessKeyID:     "AKIDEXAMPLE",
+		SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+		SessionToken:    "session",
+		now:             func() time.Time { return time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC) },
+	}
+	key, err := kms.Decrypt("AQIDBAU=")
+	if err != nil || !bytes.Equal(key, testKey(5)) {
+		t.Fatalf("Expected decrypted key, got %x, %v", key, err)
+	}
+
+	if body["CiphertextBlob"] != "AQIDBAU=" || request.Header.Get("X-Amz-Target") != "TrentService.Decrypt" {
+		t.Errorf("Unexpected KMS request %v with body %v", request.Header, body)
+	}
+	if request.Header.Get("X-Amz-Date") != "20240301T120000Z" || request.Header.Get("X-Amz-Security-Token") != "session" {
+		t.Errorf("Unexpected signing headers %v", request.Header)
+	}
+	authorization := request.Header.Get("Authorization")
+	if !strings.HasPrefix(authorization, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20240301/eu-west-1/kms/aws4_request, SignedHeaders=content-type;host;x-amz-date;x-amz-security-token;x-amz-target, Signature=") {
+		t.Errorf("Unexpected authorization %s", authorization)
+	}
+
+	kms.AccessKeyID = ""
+	if _, err := kms.Decrypt("AQIDBAU="); err == nil {
+		t.Error("Expected error without credentials")
+	}
+}
+
+func TestSigningKey(t *testing.T) {
+	// Example from the AWS Signature Version 4 documentation
+	key := signingKey("wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", "20150830", "us-east-1", "iam")
+	if hex.EncodeToString(key) != "c4afb1cc5771d871763a393e44b703571b55cc28424d1a5e86da6ed3c154a4b9" {
+		t.Errorf("Unexpected signing key %x", key)
+	}
+}
@@ -0,0 +1,179 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// KMS decrypts data keys with AWS KMS, signing requests with Signature
+// Version 4
+type KMS struct {
+	Region          string
+	Endpoint        string
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	Client          *http.Client
+	// now returns the signing time; tests fix it
+	now func() time.Time
+}
+
+// NewKMSFromEnv returns a KMS client for a region using the credentials in
+// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN. The region
+// defaults to AWS_REGION and the endpoint to the regional one.
+func NewKMSFromEnv(region, endpoint string) *KMS {
+	if region == "" {
+		region = os.Getenv("AWS_REGION")
+	}
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://kms.%s.amazonaws.com", region)
+	}
+
+	return &KMS{
+		Region:          region,
+		Endpoint:        endpoint,
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		Client:          &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Decrypt decrypts a base64 encoded ciphertext blob and returns the plaintext
+func (k *KMS) Decrypt(ciphertext string) ([]byte, error) {
+	if k.AccessKeyID == "" || k.SecretAccessKey == "" {
+		return nil, fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY are required")
+	}
+	if k.Region == "" {
+		return nil, fmt.Errorf("AWS region is required")
+	}
+
+	body, err := json.Marshal(map[string]string{"CiphertextBlob": ciphertext})
+	if err != nil {
+		return nil, err
+	}
+
+	request, err := http.NewRequest("POST", k.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("invalid KMS request: %v", err)
+	}
+	request.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	request.Header.Set("X-Amz-Target", "TrentService.Decrypt")
+
+	now := time.Now
+	if k.now != nil {
+		now = k.now
+	}
+	k.sign(request, body, now().UTC())
+
+	client := k.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("KMS request failed: %v", err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+		return nil, fmt.Errorf("KMS returned %s: %s", response.Status, strings.TrimSpace(string(message)))
+	}
+
+	var decrypted struct {
+		Plaintext string `json:"Plaintext"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&decrypted); err != nil {
+		return nil, fmt.Errorf("invalid KMS response: %v", err)
+	}
+
+	plaintext, err := base64.StdEncoding.DecodeString(decrypted.Plaintext)
+	if err != nil {
+		return nil, fmt.Errorf("invalid KMS plaintext: %v", err)
+	}
+	return plaintext, nil
+}
+
+// sign adds the Signature Version 4 headers for the kms service
+func (k *KMS) sign(request *http.Request, body []byte, at time.Time) {
+	amzDate := at.Format("20060102T150405Z")
+	date := at.Format("20060102")
+
+	request.Header.Set("X-Amz-Date", amzDate)
+	if k.SessionToken != "" {
+		request.Header.Set("X-Amz-Security-Token", k.SessionToken)
+	}
+
+	headers := map[string]string{"host": request.URL.Host}
+	for name, values := range request.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := request.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		request.Method,
+		path,
+		canonicalQuery(request.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		hexSHA256(body),
+	}, "\n")
+
+	scope := fmt.Sprintf("%s/%s/kms/aws4_request", date, k.Region)
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, hexSHA256([]byte(canonicalRequest))}, "\n")
+	signature := hex.EncodeToString(hmacSHA256(signingKey(k.SecretAccessKey, date, k.Region, "kms"), stringToSign))
+
+	request.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		k.AccessKeyID, scope, signedHeaders, signature))
+}
+
+// signingKey derives the Signature Version 4 key of a day, region and service
+func signingKey(secret, date, region, service string) []byte {
+	key := hmacSHA256([]byte("AWS4"+secret), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	return hmacSHA256(key, "aws4_request")
+}
+
+// canonicalQuery encodes a query string sorted by key, as signed
+func canonicalQuery(query url.Values) string {
+	return strings.ReplaceAll(query.Encode(), "+", "%20")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func hexSHA256(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
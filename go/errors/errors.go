@@ -38,6 +38,7 @@ const (
 	ErrCodeNotFound           ErrorCode = "NOT_FOUND"
 	ErrCodeInternalError      ErrorCode = "INTERNAL_ERROR"
 	ErrCodeServiceUnavailable ErrorCode = "SERVICE_UNAVAILABLE"
+	ErrCodeRateLimited        ErrorCode = "RATE_LIMITED"
 )
 
 // APIError represents a structured API error
@@ -118,6 +119,8 @@ func getHTTPStatusForCode(code ErrorCode) int {
 		return http.StatusInternalServerError
 	case ErrCodeWorkerTimeout, ErrCodeBuildTimeout:
 		return http.StatusRequestTimeout
+	case ErrCodeRateLimited:
+		return http.StatusTooManyRequests
 	default:
 		return http.StatusInternalServerError
 	}
@@ -149,6 +149,7 @@ func TestGetHTTPStatusForCode(t *testing.T) {
 		{ErrCodeInternalError, http.StatusInternalServerError},
 		{ErrCodeWorkerTimeout, http.StatusRequestTimeout},
 		{ErrCodeBuildTimeout, http.StatusRequestTimeout},
+		{ErrCodeRateLimited, http.StatusTooManyRequests},
 		{"UNKNOWN_CODE", http.StatusInternalServerError},
 	}
 
@@ -0,0 +1,241 @@
+// Package events publishes build lifecycle events on an event bus, so the
+// monitor, the ML service and external consumers can follow builds as they
+// happen instead of polling the coordinator's HTTP API. The bus is in memory
+// by default; NATS and Kafka carry events between services.
+package events
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Build lifecycle event types
+const (
+	// BuildSubmitted is published when a build is accepted
+	BuildSubmitted = "build.submitted"
+	// BuildScheduled is published when a build is assigned to a worker or
+	// forwarded to a peer coordinator
+	BuildScheduled = "build.scheduled"
+	// BuildStarted is published when a build is sent to its worker
+	BuildStarted = "build.started"
+	// BuildStepCompleted is published when a Gradle task of a build finishes
+	BuildStepCompleted = "build.step_completed"
+	// BuildFinished is published when a build completes, fails or is
+	// cancelled
+	BuildFinished = "build.finished"
+)
+
+// Event bus backends
+const (
+	BackendMemory = "memory"
+	BackendNATS   = "nats"
+	BackendKafka  = "kafka"
+)
+
+// DefaultSubject is the NATS subject and Kafka topic events are published to
+const DefaultSubject = "gradle.builds"
+
+// bufferSize is how many events a subscriber or publisher holds before new
+// events are dropped
+const bufferSize = 1024
+
+// Event is a build lifecycle event
+type Event struct {
+	Type        string    `json:"type"`
+	BuildID     string    `json:"build_id"`
+	Timestamp   time.Time `json:"timestamp"`
+	Source      string    `json:"source"`
+	ProjectPath string    `json:"project_path,omitempty"`
+	TaskName    string    `json:"task_name,omitempty"`
+	Pool        string    `json:"pool,omitempty"`
+	Tenant      string    `json:"tenant,omitempty"`
+	WorkerID    string    `json:"worker_id,omitempty"`
+	// Step is the completed Gradle task of a step event
+	Step string `json:"step,omitempty"`
+	// Status, Duration, CacheHitRate and ErrorMessage describe the result
+	// of a finished build; Duration is also the duration of a completed step
+	Status       string        `json:"status,omitempty"`
+	Duration     time.Duration `json:"duration,omitempty"`
+	CacheHitRate float64       `json:"cache_hit_rate,omitempty"`
+	ErrorMessage string        `json:"error_message,omitempty"`
+	// ErrorCode classifies why a finished build failed
+	ErrorCode string `json:"error_code,omitempty"`
+}
+
+// Handler receives the events of a subscription
+type Handler func(Event)
+
+// Bus publishes events and delivers them to subscribers. Publish never
+// blocks on the bus; events that cannot be buffered are dropped.
+type Bus interface {
+	// Backend returns the name of the bus backend
+	Backend() string
+	// Publish sends an event to every subscriber
+	Publish(event Event) error
+	// Subscribe delivers every published event to handler, one at a time,
+	// until the returned function is called
+	Subscribe(handler Handler) (func(), error)
+	// Close stops the bus after sending the buffered events
+	Close() error
+}
+
+// FromEnv returns the bus selected by EVENT_BUS: memory (default), nats or
+// kafka. EVENT_BUS_URL is the NATS server or Kafka REST proxy,
+// EVENT_BUS_SUBJECT the subject or topic and EVENT_BUS_GROUP the Kafka
+// consumer group, which defaults to the service name.
+func FromEnv(service string) (Bus, error) {
+	subject := os.Getenv("EVENT_BUS_SUBJECT")
+	if subject == "" {
+		subject = DefaultSubject
+	}
+	url := os.Getenv("EVENT_BUS_URL")
+
+	switch backend := os.Getenv("EVENT_BUS"); backend {
+	case "", BackendMemory:
+		return NewMemory(), nil
+	case BackendNATS:
+		if url == "" {
+			url = "nats://localhost:4222"
+		}
+		return DialNATS(url, subject, service)
+	case BackendKafka:
+		group := os.Getenv("EVENT_BUS_GROUP")
+		if group == "" {
+			group = service
+		}
+		return NewKafka(url, subject, group)
+	default:
+		return nil, fmt.Errorf("unknown event bus %q", backend)
+	}
+}
+
+// Memory is an in-process bus
+type Memory struct {
+	mutex       sync.RWMutex
+	subscribers map[int]chan Event
+	next        int
+}
+
+// NewMemory returns an in-process bus
+func NewMemory() *Memory {
+	return &Memory{subscribers: make(map[int]chan Event)}
+}
+
+// Backend returns the name of the bus backend
+func (m *Memory) Backend() string {
+	return BackendMemory
+}
+
+// Publish delivers an event to every subscriber. Subscribers that fall
+// behind miss events.
+func (m *Memory) Publish(event Event) error {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	for _, events := range m.subscribers {
+		select {
+		case events <- event:
+		default:
+			log.Printf("Event bus subscriber is falling behind, dropping %s event of build %s", event.Type, event.BuildID)
+		}
+	}
+	return nil
+}
+
+// Subscribe delivers every published event to handler
+func (m *Memory) Subscribe(handler Handler) (func(), error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	id := m.next
+	m.next++
+	events := make(chan Event, bufferSize)
+	m.subscribers[id] = events
+	go func() {
+		for event := range events {
+			handler(event)
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			m.mutex.Lock()
+			defer m.mutex.Unlock()
+			if _, exists := m.subscribers[id]; exists {
+				delete(m.subscribers, id)
+				close(events)
+			}
+		})
+	}, nil
+}
+
+// Close ends every subscription
+func (m *Memory) Close() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for id, events := range m.subscribers {
+		delete(m.subscribers, id)
+		close(events)
+	}
+	return nil
+}
+
+// outbox sends published events to a remote bus from a single goroutine, so
+// publishing never waits for the network
+type outbox struct {
+	events chan Event
+	send   func(Event) error
+	done   chan struct{}
+	mutex  sync.RWMutex
+	closed bool
+}
+
+// newOutbox starts sending events with send
+func newOutbox(send func(Event) error) *outbox {
+	o := &outbox{events: make(chan Event, bufferSize), send: send, done: make(chan struct{})}
+	go o.run()
+	return o
+}
+
+// run sends events until the outbox is closed and drained. Events that
+// cannot be sent are logged and dropped.
+func (o *outbox) run() {
+	defer close(o.done)
+	for event := range o.events {
+		if err := o.send(event); err != nil {
+			log.Printf("Failed to publish %s event of build %s: %v", event.Type, event.BuildID, err)
+		}
+	}
+}
+
+// publish queues an event
+func (o *outbox) publish(event Event) error {
+	o.mutex.RLock()
+	defer o.mutex.RUnlock()
+
+	if o.closed {
+		return fmt.Errorf("event bus is closed")
+	}
+	select {
+	case o.events <- event:
+		return nil
+	default:
+		return fmt.Errorf("event bus buffer is full, dropping %s event of build %s", event.Type, event.BuildID)
+	}
+}
+
+// close sends the queued events and stops the outbox
+func (o *outbox) close() {
+	o.mutex.Lock()
+	if !o.closed {
+		o.closed = true
+		close(o.events)
+	}
+	o.mutex.Unlock()
+	<-o.done
+}
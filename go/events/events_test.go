@@ -0,0 +1,256 @@
+package events
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// receive waits for the next event of a subscription
+func receive(t *testing.T, events <-chan Event) Event {
+	t.Helper()
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for an event")
+		return Event{}
+	}
+}
+
+func TestMemoryBus(t *testing.T) {
+	bus := NewMemory()
+	defer bus.Close()
+
+	first, second := make(chan Event, 4), make(chan Event, 4)
+	stopFirst, _ := bus.Subscribe(func(event Event) { first <- event })
+	bus.Subscribe(func(event Event) { second <- event })
+
+	bus.Publish(Event{Type: BuildSubmitted, BuildID: "build-1"})
+	if event := receive(t, first); event.BuildID != "build-1" || event.Type != BuildSubmitted {
+		t.Errorf("Unexpected event %+v", event)
+	}
+	if event := receive(t, second); event.BuildID != "build-1" {
+		t.Errorf("Unexpected event %+v", event)
+	}
+
+	// A stopped subscription receives no more events
+	stopFirst()
+	stopFirst()
+	bus.Publish(Event{Type: BuildFinished, BuildID: "build-1"})
+	if event := receive(t, second); event.Type != BuildFinished {
+		t.Errorf("Unexpected event %+v", event)
+	}
+	select {
+	case event := <-first:
+		t.Errorf("Expected no event after unsubscribing, got %+v", event)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// natsServer is a minimal NATS server echoing published messages to the
+// subscribed connections
+type natsServer struct {
+	listener net.Listener
+	mutex    sync.Mutex
+	connects []string
+	subs     map[net.Conn]string
+}
+
+func newNATSServer(t *testing.T) *natsServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	server := &natsServer{listener: listener, subs: make(map[net.Conn]string)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { listener.Close() })
+	return server
+}
+
+func (s *natsServer) serve(conn net.Conn) {
+	defer conn.Close()
+	fmt.Fprint(conn, "INFO {\"server_id\":\"test\"}\r\n")
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "CONNECT":
+			s.mutex.Lock()
+			s.connects = append(s.connects, strings.TrimSpace(strings.TrimPrefix(line, "CONNECT")))
+			s.mutex.Unlock()
+		case "PING":
+			fmt.Fprint(conn, "PONG\r\n")
+		case "SUB":
+			s.mutex.Lock()
+			s.subs[conn] = fields[2]
+			s.mutex.Unlock()
+		case "PUB":
+			var size int
+			fmt.Sscan(fields[2], &size)
+			payload := make([]byte, size+2)
+			if _, err := io.ReadFull(reader, payload); err != nil {
+				return
+			}
+			s.mutex.Lock()
+			for sub, sid := range s.subs {
+				fmt.Fprintf(sub, "MSG %s %s %d\r\n%s", fields[1], sid, size, payload)
+			}
+			s.mutex.Unlock()
+		}
+	}
+}
+
+func TestNATSBus(t *testing.T) {
+	server := newNATSServer(t)
+	bus, err := DialNATS("nats://alice:secret@"+server.listener.Addr().String(), "gradle.test", "coordinator")
+	if err != nil {
+		t.Fatalf("Failed to dial NATS: %v", err)
+	}
+	defer bus.Close()
+
+	received := make(chan Event, 4)
+	bus.Subscribe(func(event Event) { received <- event })
+
+	// Events published before the connection is up are retried by the test
+	deadline := time.Now().Add(5 * time.Second)
+	var event Event
+	for {
+		bus.Publish(Event{Type: BuildStarted, BuildID: "build-1", WorkerID: "worker-1"})
+		select {
+		case event = <-received:
+		case <-time.After(100 * time.Millisecond):
+			if time.Now().Before(deadline) {
+				continue
+			}
+			t.Fatal("Timed out waiting for the event")
+		}
+		break
+	}
+	if event.Type != BuildStarted || event.BuildID != "build-1" || event.WorkerID != "worker-1" {
+		t.Errorf("Unexpected event %+v", event)
+	}
+
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	var options map[string]any
+	if len(server.connects) == 0 || json.Unmarshal([]byte(server.connects[0]), &options) != nil {
+		t.Fatalf("Expected a CONNECT, got %v", server.connects)
+	}
+	if options["user"] != "alice" || options["pass"] != "secret" || options["name"] != "coordinator" {
+		t.Errorf("Unexpected connect options %v", options)
+	}
+}
+
+func TestKafkaBus(t *testing.T) {
+	var mutex sync.Mutex
+	var topic []json.RawMessage
+	var subscribed, deleted bool
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		switch {
+		case r.Method == "POST" && r.URL.Path == "/topics/gradle.builds":
+			if r.Header.Get("Content-Type") != kafkaJSON {
+				http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+				return
+			}
+			var body struct {
+				Records []struct {
+					Key   string          `json:"key"`
+					Value json.RawMessage `json:"value"`
+				} `json:"records"`
+			}
+			json.NewDecoder(r.Body).Decode(&body)
+			for _, record := range body.Records {
+				topic = append(topic, record.Value)
+			}
+			w.Write([]byte(`{"offsets":[{"partition":0,"offset":0}]}`))
+		case r.Method == "POST" && r.URL.Path == "/consumers/ml-service":
+			fmt.Fprintf(w, `{"instance_id":"1","base_uri":"%s/consumers/ml-service/instances/1"}`, server.URL)
+		case r.Method == "POST" && r.URL.Path == "/consumers/ml-service/instances/1/subscription":
+			subscribed = true
+			w.WriteHeader(http.StatusNoContent)
+		case r.Method == "GET" && r.URL.Path == "/consumers/ml-service/instances/1/records":
+			records := make([]map[string]json.RawMessage, 0, len(topic))
+			for _, value := range topic {
+				records = append(records, map[string]json.RawMessage{"value": value})
+			}
+			topic = nil
+			json.NewEncoder(w).Encode(records)
+		case r.Method == "DELETE" && r.URL.Path == "/consumers/ml-service/instances/1":
+			deleted = true
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	if _, err := NewKafka("", DefaultSubject, "ml-service"); err == nil {
+		t.Error("Expected an error without a REST proxy URL")
+	}
+	bus, err := NewKafka(server.URL, DefaultSubject, "ml-service")
+	if err != nil {
+		t.Fatalf("Failed to create the Kafka bus: %v", err)
+	}
+
+	received := make(chan Event, 4)
+	bus.Subscribe(func(event Event) { received <- event })
+	bus.Publish(Event{Type: BuildFinished, BuildID: "build-1", Status: "completed", Duration: time.Minute})
+
+	event := receive(t, received)
+	if event.Type != BuildFinished || event.Status != "completed" || event.Duration != time.Minute {
+		t.Errorf("Unexpected event %+v", event)
+	}
+
+	bus.Close()
+	mutex.Lock()
+	defer mutex.Unlock()
+	if !subscribed || !deleted {
+		t.Errorf("Expected the consumer to subscribe and be deleted, got subscribed=%v deleted=%v", subscribed, deleted)
+	}
+}
+
+func TestFromEnv(t *testing.T) {
+	t.Setenv("EVENT_BUS", "")
+	bus, err := FromEnv("coordinator")
+	if err != nil || bus.Backend() != BackendMemory {
+		t.Errorf("Expected the memory bus by default, got %v", err)
+	}
+
+	t.Setenv("EVENT_BUS", "kafka")
+	t.Setenv("EVENT_BUS_URL", "")
+	if _, err := FromEnv("coordinator"); err == nil {
+		t.Error("Expected an error for Kafka without a REST proxy URL")
+	}
+
+	t.Setenv("EVENT_BUS", "rabbitmq")
+	if _, err := FromEnv("coordinator"); err == nil {
+		t.Error("Expected an error for an unknown event bus")
+	}
+}
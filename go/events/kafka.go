@@ -0,0 +1,234 @@
+package events
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Content types of the Kafka REST proxy API
+const (
+	kafkaJSON = "application/vnd.kafka.json.v2+json"
+	kafkaAPI  = "application/vnd.kafka.v2+json"
+)
+
+// kafkaPoll is how often the topic is polled for new events
+const kafkaPoll = time.Second
+
+// kafkaTimeout bounds each request to the Kafka REST proxy
+const kafkaTimeout = 10 * time.Second
+
+// Kafka is a bus publishing events to a Kafka topic through a Kafka REST
+// proxy. Subscribers share a consumer instance in the configured consumer
+// group, which is created on the first subscription.
+type Kafka struct {
+	proxy  string
+	topic  string
+	group  string
+	client *http.Client
+	// local delivers the events consumed from Kafka to the subscribers of
+	// this service
+	local  *Memory
+	outbox *outbox
+	done   chan struct{}
+	once   sync.Once
+	mutex  sync.Mutex
+	// consuming is set once the poll loop runs; stopped is closed when it
+	// has deleted its consumer instance
+	consuming bool
+	stopped   chan struct{}
+}
+
+// NewKafka returns a bus publishing to topic through the Kafka REST proxy at
+// proxyURL, consuming in group
+func NewKafka(proxyURL, topic, group string) (*Kafka, error) {
+	parsed, err := url.Parse(proxyURL)
+	if proxyURL == "" || err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return nil, fmt.Errorf("invalid Kafka REST proxy URL %q", proxyURL)
+	}
+	if topic == "" || group == "" {
+		return nil, fmt.Errorf("kafka topic and consumer group are required")
+	}
+
+	k := &Kafka{
+		proxy:   strings.TrimRight(proxyURL, "/"),
+		topic:   topic,
+		group:   group,
+		client:  &http.Client{Timeout: kafkaTimeout},
+		local:   NewMemory(),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	k.outbox = newOutbox(k.send)
+	return k, nil
+}
+
+// Backend returns the name of the bus backend
+func (k *Kafka) Backend() string {
+	return BackendKafka
+}
+
+// Publish queues an event for the topic
+func (k *Kafka) Publish(event Event) error {
+	return k.outbox.publish(event)
+}
+
+// Subscribe delivers every event consumed from the topic to handler
+func (k *Kafka) Subscribe(handler Handler) (func(), error) {
+	k.mutex.Lock()
+	if !k.consuming {
+		k.consuming = true
+		go k.consume()
+	}
+	k.mutex.Unlock()
+
+	return k.local.Subscribe(handler)
+}
+
+// Close sends the queued events, deletes the consumer instance and ends the
+// subscriptions
+func (k *Kafka) Close() error {
+	k.outbox.close()
+	k.once.Do(func() { close(k.done) })
+
+	k.mutex.Lock()
+	consuming := k.consuming
+	k.mutex.Unlock()
+	if consuming {
+		<-k.stopped
+	}
+	return k.local.Close()
+}
+
+// send produces an event to the topic, keyed by build so the events of a
+// build stay in order
+func (k *Kafka) send(event Event) error {
+	body, err := json.Marshal(map[string]any{
+		"records": []map[string]any{{"key": event.BuildID, "value": event}},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode event: %v", err)
+	}
+	return k.request("POST", k.proxy+"/topics/"+url.PathEscape(k.topic), kafkaJSON, body, nil)
+}
+
+// consume polls the topic until the bus is closed, recreating the consumer
+// instance when the proxy lost it
+func (k *Kafka) consume() {
+	defer close(k.stopped)
+
+	var instance string
+	delay := kafkaPoll
+	for {
+		var err error
+		if instance == "" {
+			instance, err = k.createConsumer()
+		}
+		if err == nil {
+			err = k.poll(instance)
+		}
+
+		wait := kafkaPoll
+		if err != nil {
+			log.Printf("Failed to consume events from Kafka topic %s, retrying in %s: %v", k.topic, delay, err)
+			if instance != "" {
+				k.request("DELETE", instance, kafkaAPI, nil, nil)
+				instance = ""
+			}
+			wait = delay
+			if delay *= 2; delay > maxReconnectDelay {
+				delay = maxReconnectDelay
+			}
+		} else {
+			delay = kafkaPoll
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-k.done:
+			if instance != "" {
+				k.request("DELETE", instance, kafkaAPI, nil, nil)
+			}
+			return
+		}
+	}
+}
+
+// createConsumer creates a consumer instance subscribed to the topic and
+// returns its URL
+func (k *Kafka) createConsumer() (string, error) {
+	body, _ := json.Marshal(map[string]string{"format": "json", "auto.offset.reset": "latest"})
+	var consumer struct {
+		BaseURI string `json:"base_uri"`
+	}
+	if err := k.request("POST", k.proxy+"/consumers/"+url.PathEscape(k.group), kafkaAPI, body, &consumer); err != nil {
+		return "", fmt.Errorf("failed to create consumer: %v", err)
+	}
+	if consumer.BaseURI == "" {
+		return "", fmt.Errorf("kafka REST proxy returned no consumer URL")
+	}
+
+	body, _ = json.Marshal(map[string][]string{"topics": {k.topic}})
+	if err := k.request("POST", consumer.BaseURI+"/subscription", kafkaAPI, body, nil); err != nil {
+		k.request("DELETE", consumer.BaseURI, kafkaAPI, nil, nil)
+		return "", fmt.Errorf("failed to subscribe to %s: %v", k.topic, err)
+	}
+	return consumer.BaseURI, nil
+}
+
+// poll delivers the records waiting for the consumer instance
+func (k *Kafka) poll(instance string) error {
+	var records []struct {
+		Value json.RawMessage `json:"value"`
+	}
+	if err := k.request("GET", instance+"/records", kafkaJSON, nil, &records); err != nil {
+		return err
+	}
+
+	for _, record := range records {
+		var event Event
+		if err := json.Unmarshal(record.Value, &event); err != nil {
+			log.Printf("Ignoring malformed event on %s: %v", k.topic, err)
+			continue
+		}
+		k.local.Publish(event)
+	}
+	return nil
+}
+
+// request calls the REST proxy, decoding the response into result if given
+func (k *Kafka) request(method, target, contentType string, body []byte, result any) error {
+	request, err := http.NewRequest(method, target, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("invalid Kafka REST proxy request: %v", err)
+	}
+	if body != nil {
+		request.Header.Set("Content-Type", contentType)
+	}
+	request.Header.Set("Accept", contentType)
+
+	response, err := k.client.Do(request)
+	if err != nil {
+		return fmt.Errorf("kafka REST proxy request failed: %v", err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode >= http.StatusMultipleChoices {
+		message, _ := io.ReadAll(io.LimitReader(response.Body, 512))
+		return fmt.Errorf("kafka REST proxy returned %s: %s", response.Status, strings.TrimSpace(string(message)))
+	}
+	if result == nil {
+		return nil
+	}
+	if err := json.NewDecoder(response.Body).Decode(result); err != nil {
+		return fmt.Errorf("invalid Kafka REST proxy response: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,208 @@
+// Package fairshare orders pending builds so that tenants share contended
+// build capacity in proportion to their weights. A tenant submitting many
+// builds only gets more than its share while others leave capacity unused.
+package fairshare
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+)
+
+// DefaultTenant is the tenant of builds submitted without an API key of a
+// configured tenant
+const DefaultTenant = "default"
+
+// DefaultWeight is the weight of tenants without a configured weight
+const DefaultWeight = 1.0
+
+// Weights are the relative shares of the tenants
+type Weights struct {
+	Tenants map[string]float64
+	Default float64
+}
+
+// WeightsFromEnv reads the tenant weights from FAIR_SHARE_WEIGHTS, a JSON
+// object of weights by tenant, and the weight of other tenants from
+// FAIR_SHARE_DEFAULT_WEIGHT
+func WeightsFromEnv() (Weights, error) {
+	weights := Weights{Default: DefaultWeight}
+
+	if value := os.Getenv("FAIR_SHARE_WEIGHTS"); value != "" {
+		if err := json.Unmarshal([]byte(value), &weights.Tenants); err != nil {
+			return Weights{Default: DefaultWeight}, fmt.Errorf("failed to parse FAIR_SHARE_WEIGHTS: %v", err)
+		}
+	}
+	if value := os.Getenv("FAIR_SHARE_DEFAULT_WEIGHT"); value != "" {
+		weight, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return Weights{Default: DefaultWeight}, fmt.Errorf("invalid FAIR_SHARE_DEFAULT_WEIGHT: %s", value)
+		}
+		weights.Default = weight
+	}
+
+	return weights, weights.Validate()
+}
+
+// Validate checks that every weight is positive
+func (w Weights) Validate() error {
+	if w.Default <= 0 {
+		return fmt.Errorf("default weight must be positive, got %v", w.Default)
+	}
+	for tenant, weight := range w.Tenants {
+		if weight <= 0 {
+			return fmt.Errorf("weight of tenant %s must be positive, got %v", tenant, weight)
+		}
+	}
+	return nil
+}
+
+// Of returns the weight of a tenant
+func (w Weights) Of(tenant string) float64 {
+	if weight, exists := w.Tenants[tenant]; exists {
+		return weight
+	}
+	if w.Default <= 0 {
+		return DefaultWeight
+	}
+	return w.Default
+}
+
+// entry is a pending item with its submission order
+type entry struct {
+	id  string
+	seq uint64
+}
+
+// Queue holds pending build IDs per tenant. It is not safe for concurrent
+// use.
+type Queue struct {
+	weights Weights
+	pending map[string][]entry
+	seq     uint64
+	size    int
+}
+
+// NewQueue creates an empty queue sharing capacity by weights
+func NewQueue(weights Weights) *Queue {
+	return &Queue{weights: weights, pending: make(map[string][]entry)}
+}
+
+// Push adds a build of a tenant to the queue
+func (q *Queue) Push(tenant, id string) {
+	q.seq++
+	q.pending[tenant] = append(q.pending[tenant], entry{id: id, seq: q.seq})
+	q.size++
+}
+
+// PushFront returns a popped build that could not be started to the head of
+// its tenant's builds, ahead of every other pending build
+func (q *Queue) PushFront(tenant, id string) {
+	q.pending[tenant] = append([]entry{{id: id}}, q.pending[tenant]...)
+	q.size++
+}
+
+// Remove removes a pending build, reporting whether it was pending
+func (q *Queue) Remove(tenant, id string) bool {
+	for i, pending := range q.pending[tenant] {
+		if pending.id != id {
+			continue
+		}
+		if len(q.pending[tenant]) == 1 {
+			delete(q.pending, tenant)
+		} else {
+			q.pending[tenant] = append(q.pending[tenant][:i:i], q.pending[tenant][i+1:]...)
+		}
+		q.size--
+		return true
+	}
+	return false
+}
+
+// Len returns the number of pending builds
+func (q *Queue) Len() int {
+	return q.size
+}
+
+// Pending returns the number of pending builds of each tenant
+func (q *Queue) Pending() map[string]int {
+	pending := make(map[string]int, len(q.pending))
+	for tenant, entries := range q.pending {
+		pending[tenant] = len(entries)
+	}
+	return pending
+}
+
+// Order returns the pending builds in the order PopEligible would pop them
+// given the running builds of each tenant, followed by the builds eligible
+// rejects in the order Pop would pop them after. The queue is left as is.
+func (q *Queue) Order(running map[string]int, eligible func(id string) bool) []string {
+	clone := &Queue{weights: q.weights, pending: make(map[string][]entry, len(q.pending)), size: q.size}
+	for tenant, entries := range q.pending {
+		clone.pending[tenant] = slices.Clone(entries)
+	}
+	counts := maps.Clone(running)
+	if counts == nil {
+		counts = make(map[string]int)
+	}
+
+	order := make([]string, 0, q.size)
+	for {
+		_, id, ok := clone.PopEligible(counts, eligible)
+		if !ok {
+			break
+		}
+		order = append(order, id)
+	}
+	for clone.Len() > 0 {
+		_, id, _ := clone.Pop(counts)
+		order = append(order, id)
+	}
+	return order
+}
+
+// Pop removes the oldest build of the tenant furthest below its share, that
+// is with the fewest running builds for its weight. Ties go to the tenant
+// whose oldest build waited longest. running is updated with the returned
+// build, so a caller can pop several builds for the same free slots.
+func (q *Queue) Pop(running map[string]int) (tenant, id string, ok bool) {
+	return q.PopEligible(running, nil)
+}
+
+// PopEligible is Pop among the builds for which eligible returns true. The
+// other builds keep their place in the queue. A nil eligible accepts every
+// build.
+func (q *Queue) PopEligible(running map[string]int, eligible func(id string) bool) (tenant, id string, ok bool) {
+	var best entry
+	var bestIndex int
+	var bestUsage float64
+	for candidate, entries := range q.pending {
+		index := 0
+		for eligible != nil && index < len(entries) && !eligible(entries[index].id) {
+			index++
+		}
+		if index == len(entries) {
+			continue
+		}
+		usage := float64(running[candidate]) / q.weights.Of(candidate)
+		if !ok || usage < bestUsage || (usage == bestUsage && entries[index].seq < best.seq) {
+			tenant, best, bestIndex, bestUsage, ok = candidate, entries[index], index, usage, true
+		}
+	}
+	if !ok {
+		return "", "", false
+	}
+
+	entries := q.pending[tenant]
+	if len(entries) == 1 {
+		delete(q.pending, tenant)
+	} else {
+		q.pending[tenant] = append(entries[:bestIndex:bestIndex], entries[bestIndex+1:]...)
+	}
+	q.size--
+	running[tenant]++
+	return tenant, best.id, true
+}
@@ -0,0 +1,138 @@
+package fairshare
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+)
+
+func TestPopInterleavesTenants(t *testing.T) {
+	queue := NewQueue(Weights{Default: DefaultWeight})
+	for i := 0; i < 500; i++ {
+		queue.Push("team-a", fmt.Sprintf("a-%d", i))
+	}
+	queue.Push("team-b", "b-0")
+	queue.Push("team-b", "b-1")
+
+	// team-a already holds both running slots, so team-b goes next
+	running := map[string]int{"team-a": 2}
+	expected := []string{"b-0", "b-1", "a-0", "a-1", "a-2"}
+	for _, want := range expected {
+		if _, id, ok := queue.Pop(running); !ok || id != want {
+			t.Fatalf("Expected %s, got %s", want, id)
+		}
+	}
+	if queue.Len() != 497 || queue.Pending()["team-a"] != 497 {
+		t.Errorf("Expected 497 pending builds of team-a, got %d", queue.Len())
+	}
+}
+
+func TestPopFollowsWeights(t *testing.T) {
+	queue := NewQueue(Weights{Tenants: map[string]float64{"android": 3}, Default: DefaultWeight})
+	for i := 0; i < 100; i++ {
+		queue.Push("android", fmt.Sprintf("android-%d", i))
+		queue.Push("backend", fmt.Sprintf("backend-%d", i))
+	}
+
+	// Of 8 free slots android gets three for every one of backend
+	running := map[string]int{}
+	for i := 0; i < 8; i++ {
+		queue.Pop(running)
+	}
+	if running["android"] != 6 || running["backend"] != 2 {
+		t.Errorf("Expected a 3:1 share, got %v", running)
+	}
+}
+
+func TestPopOrdersTiesBySubmission(t *testing.T) {
+	queue := NewQueue(Weights{Default: DefaultWeight})
+	queue.Push("team-b", "first")
+	queue.Push("team-a", "second")
+
+	if tenant, id, _ := queue.Pop(map[string]int{}); tenant != "team-b" || id != "first" {
+		t.Errorf("Expected the oldest build first, got %s of %s", id, tenant)
+	}
+	queue.Push("team-a", "third")
+	if !queue.Remove("team-a", "second") || queue.Remove("team-a", "second") || queue.Len() != 1 {
+		t.Errorf("Expected a pending build to be removed once, %d left", queue.Len())
+	}
+	if _, id, _ := queue.Pop(map[string]int{}); id != "third" {
+		t.Errorf("Expected the remaining build, got %s", id)
+	}
+	if _, _, ok := NewQueue(Weights{}).Pop(map[string]int{}); ok {
+		t.Error("Expected nothing to pop from an empty queue")
+	}
+}
+
+func TestPopEligibleSkipsHeldBuilds(t *testing.T) {
+	queue := NewQueue(Weights{Default: DefaultWeight})
+	queue.Push("team-a", "held")
+	queue.Push("team-b", "b-0")
+	queue.Push("team-a", "a-1")
+	held := map[string]bool{"held": true}
+	eligible := func(id string) bool { return !held[id] }
+
+	// team-b's build is older than team-a's first eligible one
+	running := map[string]int{}
+	for _, want := range []string{"b-0", "a-1"} {
+		if _, id, ok := queue.PopEligible(running, eligible); !ok || id != want {
+			t.Fatalf("Expected %s, got %s", want, id)
+		}
+	}
+	if _, id, ok := queue.PopEligible(running, eligible); ok {
+		t.Fatalf("Expected only held builds to remain, got %s", id)
+	}
+
+	// A released build is popped from its original place
+	delete(held, "held")
+	if tenant, id, ok := queue.PopEligible(running, eligible); !ok || tenant != "team-a" || id != "held" || queue.Len() != 0 {
+		t.Errorf("Expected the released build, got %s of %s with %d pending", id, tenant, queue.Len())
+	}
+}
+
+func TestOrderFollowsPops(t *testing.T) {
+	queue := NewQueue(Weights{Tenants: map[string]float64{"team-a": 2}, Default: DefaultWeight})
+	queue.Push("team-a", "a-0")
+	queue.Push("team-a", "held")
+	queue.Push("team-b", "b-0")
+	queue.Push("team-a", "a-1")
+	queue.Push("team-b", "b-1")
+	eligible := func(id string) bool { return id != "held" }
+
+	// team-b is furthest below its share with nothing running, then team-a
+	// runs two builds for each of team-b's; the held build comes last
+	want := []string{"b-0", "a-0", "a-1", "b-1", "held"}
+	running := map[string]int{"team-a": 1}
+	if order := queue.Order(running, eligible); !slices.Equal(order, want) {
+		t.Fatalf("Expected %v, got %v", want, order)
+	}
+	if queue.Len() != 5 || running["team-a"] != 1 {
+		t.Errorf("Expected the queue and running builds to be left as is, got %d pending and %v", queue.Len(), running)
+	}
+	for _, id := range want[:4] {
+		if _, popped, _ := queue.PopEligible(running, eligible); popped != id {
+			t.Errorf("Expected %s to be popped, got %s", id, popped)
+		}
+	}
+}
+
+func TestWeightsFromEnv(t *testing.T) {
+	t.Setenv("FAIR_SHARE_WEIGHTS", `{"android": 3, "release": 0.5}`)
+	t.Setenv("FAIR_SHARE_DEFAULT_WEIGHT", "2")
+	weights, err := WeightsFromEnv()
+	if err != nil {
+		t.Fatalf("WeightsFromEnv failed: %v", err)
+	}
+	if weights.Of("android") != 3 || weights.Of("release") != 0.5 || weights.Of("backend") != 2 {
+		t.Errorf("Unexpected weights %+v", weights)
+	}
+
+	t.Setenv("FAIR_SHARE_WEIGHTS", `{"android": 0}`)
+	if _, err := WeightsFromEnv(); err == nil {
+		t.Error("Expected a zero weight to be rejected")
+	}
+	t.Setenv("FAIR_SHARE_WEIGHTS", `[3]`)
+	if _, err := WeightsFromEnv(); err == nil {
+		t.Error("Expected malformed weights to be rejected")
+	}
+}
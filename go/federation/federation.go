@@ -0,0 +1,243 @@
+// Package federation lets a coordinator forward builds to peer coordinators,
+// such as the coordinator of another data center, when its own workers are
+// busy. The forwarding coordinator keeps following a forwarded build on the
+// peer and reports its result as its own.
+package federation
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"distributed-gradle-building/middleware"
+)
+
+// ForwardedHeader names the coordinator that forwarded a build. Peers never
+// forward such builds again, so builds cannot bounce between coordinators.
+const ForwardedHeader = "X-Federated-From"
+
+// Routing policies choosing the peer a build is forwarded to
+const (
+	// PolicyOrdered forwards to the first peer, in configured order, with
+	// free capacity
+	PolicyOrdered = "ordered"
+	// PolicyLeastLoaded forwards to the peer with the most free capacity
+	PolicyLeastLoaded = "least_loaded"
+)
+
+// Peer is a coordinator builds may be forwarded to
+type Peer struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+	// Token authenticates to the peer; its API key quota also decides the
+	// tenant forwarded builds are scheduled for there
+	Token string `json:"token,omitempty"`
+	// Pools restricts forwarding to builds of these worker pools; empty
+	// forwards builds of every pool
+	Pools []string `json:"pools,omitempty"`
+}
+
+// Accepts reports whether builds of a pool may be forwarded to the peer
+func (p Peer) Accepts(pool string) bool {
+	return len(p.Pools) == 0 || slices.Contains(p.Pools, pool)
+}
+
+// Config configures forwarding to peers
+type Config struct {
+	// Name identifies this coordinator to its peers
+	Name   string
+	Peers  []Peer
+	Policy string
+	// ForwardAfter is how long a build waits for a local slot before it
+	// may be forwarded
+	ForwardAfter time.Duration
+	// PollInterval is how often peers are asked for capacity and for the
+	// status of forwarded builds
+	PollInterval time.Duration
+}
+
+// Enabled reports whether any peer is configured
+func (c Config) Enabled() bool {
+	return len(c.Peers) > 0
+}
+
+// DefaultConfig returns a configuration without peers
+func DefaultConfig() Config {
+	name, _ := os.Hostname()
+	return Config{
+		Name:         name,
+		Policy:       PolicyOrdered,
+		ForwardAfter: 30 * time.Second,
+		PollInterval: 5 * time.Second,
+	}
+}
+
+// ConfigFromEnv reads the peers from FEDERATION_PEERS, a JSON array of
+// peers, and the rest of the configuration from FEDERATION_NAME,
+// FEDERATION_POLICY, FEDERATION_FORWARD_AFTER and FEDERATION_POLL_INTERVAL
+func ConfigFromEnv() (Config, error) {
+	config := DefaultConfig()
+
+	if value := os.Getenv("FEDERATION_NAME"); value != "" {
+		config.Name = value
+	}
+	if value := os.Getenv("FEDERATION_PEERS"); value != "" {
+		if err := json.Unmarshal([]byte(value), &config.Peers); err != nil {
+			return DefaultConfig(), fmt.Errorf("failed to parse FEDERATION_PEERS: %v", err)
+		}
+	}
+	if value := os.Getenv("FEDERATION_POLICY"); value != "" {
+		config.Policy = value
+	}
+	for name, target := range map[string]*time.Duration{
+		"FEDERATION_FORWARD_AFTER": &config.ForwardAfter,
+		"FEDERATION_POLL_INTERVAL": &config.PollInterval,
+	} {
+		if value := os.Getenv(name); value != "" {
+			duration, err := time.ParseDuration(value)
+			if err != nil || duration <= 0 {
+				return DefaultConfig(), fmt.Errorf("invalid %s: %s", name, value)
+			}
+			*target = duration
+		}
+	}
+
+	return config, config.Validate()
+}
+
+// Validate checks the policy and that every peer has a unique name and an
+// HTTP URL
+func (c Config) Validate() error {
+	if c.Policy != PolicyOrdered && c.Policy != PolicyLeastLoaded {
+		return fmt.Errorf("unknown federation policy %q", c.Policy)
+	}
+	if c.Enabled() && c.Name == "" {
+		return fmt.Errorf("federation requires a coordinator name")
+	}
+
+	names := make(map[string]bool)
+	for _, peer := range c.Peers {
+		if peer.Name == "" || names[peer.Name] {
+			return fmt.Errorf("peer names must be unique and not empty, got %q", peer.Name)
+		}
+		names[peer.Name] = true
+
+		parsed, err := url.Parse(peer.URL)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return fmt.Errorf("invalid URL %q for peer %s", peer.URL, peer.Name)
+		}
+	}
+	return nil
+}
+
+// Capacity is the part of a coordinator's /api/stats telling how busy it is
+type Capacity struct {
+	TotalSlots   int `json:"total_slots"`
+	UsedSlots    int `json:"used_slots"`
+	QueuedBuilds int `json:"queued_builds"`
+}
+
+// Free returns the number of slots not taken by running or queued builds
+func (c Capacity) Free() int {
+	return c.TotalSlots - c.UsedSlots - c.QueuedBuilds
+}
+
+// Select returns the peer to forward a build to by the policy, among the
+// peers with free capacity. Peers missing from capacities are skipped.
+func Select(policy string, peers []Peer, capacities map[string]Capacity) (Peer, bool) {
+	var selected Peer
+	best := 0
+	for _, peer := range peers {
+		capacity, reachable := capacities[peer.Name]
+		if !reachable || capacity.Free() <= best {
+			continue
+		}
+		if policy == PolicyOrdered {
+			return peer, true
+		}
+		selected, best = peer, capacity.Free()
+	}
+	return selected, best > 0
+}
+
+// Client calls the HTTP API of peer coordinators
+type Client struct {
+	// Name is sent in ForwardedHeader with forwarded builds
+	Name       string
+	HTTPClient *http.Client
+}
+
+// NewClient creates a client for a coordinator named name
+func NewClient(name string) *Client {
+	return &Client{Name: name, HTTPClient: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// Stats decodes the /api/stats of a peer into reply
+func (c *Client) Stats(peer Peer, reply any) error {
+	return c.call(peer, "GET", "/api/stats", nil, reply, "")
+}
+
+// Submit forwards a build request to a peer and returns its build ID there.
+// A non-empty requestID is sent as the request ID of the submission, so the
+// peer's logs can be correlated with the original API request.
+func (c *Client) Submit(peer Peer, request any, requestID string) (string, error) {
+	var submitted struct {
+		BuildID string `json:"build_id"`
+	}
+	if err := c.call(peer, "POST", "/api/build", request, &submitted, requestID); err != nil {
+		return "", err
+	}
+	if submitted.BuildID == "" {
+		return "", fmt.Errorf("peer %s returned no build ID", peer.Name)
+	}
+	return submitted.BuildID, nil
+}
+
+// Build decodes the result and progress of a build on a peer into reply
+func (c *Client) Build(peer Peer, buildID string, reply any) error {
+	return c.call(peer, "GET", "/api/builds/"+url.PathEscape(buildID), nil, reply, "")
+}
+
+// call sends a JSON request to a peer and decodes its JSON reply
+func (c *Client) call(peer Peer, method, path string, body, reply any, requestID string) error {
+	var payload io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		payload = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, strings.TrimSuffix(peer.URL, "/")+path, payload)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(ForwardedHeader, c.Name)
+	if requestID != "" {
+		req.Header.Set(middleware.RequestIDHeader, requestID)
+	}
+	if peer.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+peer.Token)
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("peer %s returned %d: %s", peer.Name, resp.StatusCode, strings.TrimSpace(string(message)))
+	}
+	return json.NewDecoder(resp.Body).Decode(reply)
+}
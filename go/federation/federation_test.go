@@ -0,0 +1,125 @@
+package federation
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSelect(t *testing.T) {
+	peers := []Peer{{Name: "dc-east"}, {Name: "dc-west"}, {Name: "dc-north"}}
+	capacities := map[string]Capacity{
+		"dc-east":  {TotalSlots: 4, UsedSlots: 4},
+		"dc-west":  {TotalSlots: 8, UsedSlots: 6},
+		"dc-north": {TotalSlots: 8, UsedSlots: 2, QueuedBuilds: 1},
+	}
+
+	if peer, ok := Select(PolicyOrdered, peers, capacities); !ok || peer.Name != "dc-west" {
+		t.Errorf("Expected the first peer with capacity, got %s", peer.Name)
+	}
+	if peer, ok := Select(PolicyLeastLoaded, peers, capacities); !ok || peer.Name != "dc-north" {
+		t.Errorf("Expected the peer with the most free slots, got %s", peer.Name)
+	}
+
+	// Unreachable and busy peers are never selected
+	delete(capacities, "dc-west")
+	delete(capacities, "dc-north")
+	if peer, ok := Select(PolicyLeastLoaded, peers, capacities); ok {
+		t.Errorf("Expected no peer with capacity, got %s", peer.Name)
+	}
+}
+
+func TestPeerAccepts(t *testing.T) {
+	peer := Peer{Name: "dc-west", Pools: []string{"android"}}
+	if !peer.Accepts("android") || peer.Accepts("default") {
+		t.Error("Expected the peer to only accept android builds")
+	}
+	if !(Peer{Name: "dc-east"}).Accepts("default") {
+		t.Error("Expected a peer without pools to accept every build")
+	}
+}
+
+func TestConfigFromEnv(t *testing.T) {
+	t.Setenv("FEDERATION_NAME", "dc-east")
+	t.Setenv("FEDERATION_PEERS", `[{"name":"dc-west","url":"https://coordinator.west.example.com","token":"secret","pools":["android"]}]`)
+	t.Setenv("FEDERATION_POLICY", PolicyLeastLoaded)
+	t.Setenv("FEDERATION_FORWARD_AFTER", "1m")
+	t.Setenv("FEDERATION_POLL_INTERVAL", "")
+	config, err := ConfigFromEnv()
+	if err != nil {
+		t.Fatalf("ConfigFromEnv failed: %v", err)
+	}
+	if !config.Enabled() || config.Name != "dc-east" || config.Peers[0].Token != "secret" || config.Policy != PolicyLeastLoaded ||
+		config.ForwardAfter != time.Minute || config.PollInterval != 5*time.Second {
+		t.Errorf("Unexpected configuration %+v", config)
+	}
+
+	for name, value := range map[string]string{
+		"FEDERATION_PEERS":         `[{"name":"dc-west","url":"coordinator.west:8080"}]`,
+		"FEDERATION_POLICY":        "random",
+		"FEDERATION_FORWARD_AFTER": "soon",
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv(name, value)
+			if _, err := ConfigFromEnv(); err == nil {
+				t.Errorf("Expected %s=%s to be rejected", name, value)
+			}
+		})
+	}
+
+	t.Setenv("FEDERATION_PEERS", `[{"name":"dc-west","url":"http://a"},{"name":"dc-west","url":"http://b"}]`)
+	if _, err := ConfigFromEnv(); err == nil {
+		t.Error("Expected duplicate peer names to be rejected")
+	}
+}
+
+func TestClient(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(ForwardedHeader) != "dc-east" || r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		switch r.Method + " " + r.URL.Path {
+		case "GET /api/stats":
+			json.NewEncoder(w).Encode(Capacity{TotalSlots: 4, UsedSlots: 1})
+		case "POST /api/build":
+			if id := r.Header.Get("X-Request-ID"); id != "request-1" {
+				t.Errorf("Expected the request ID to be forwarded, got %q", id)
+			}
+			json.NewEncoder(w).Encode(map[string]string{"build_id": "remote-1", "status": "queued"})
+		case "GET /api/builds/remote-1":
+			json.NewEncoder(w).Encode(map[string]bool{"success": true})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	client := NewClient("dc-east")
+	peer := Peer{Name: "dc-west", URL: server.URL + "/", Token: "secret"}
+
+	var capacity Capacity
+	if err := client.Stats(peer, &capacity); err != nil || capacity.Free() != 3 {
+		t.Errorf("Expected 3 free slots, got %d: %v", capacity.Free(), err)
+	}
+	buildID, err := client.Submit(peer, map[string]string{"project_path": "/projects/app", "task_name": "build"}, "request-1")
+	if err != nil || buildID != "remote-1" {
+		t.Fatalf("Expected build remote-1, got %q: %v", buildID, err)
+	}
+	var status struct {
+		Success bool `json:"success"`
+	}
+	if err := client.Build(peer, buildID, &status); err != nil || !status.Success {
+		t.Errorf("Expected the build to have succeeded, got %+v: %v", status, err)
+	}
+	if err := client.Build(peer, "missing", &status); err == nil {
+		t.Error("Expected an unknown build to fail")
+	}
+
+	peer.Token = "wrong"
+	if err := client.Stats(peer, &capacity); err == nil {
+		t.Error("Expected a rejected token to fail")
+	}
+}
@@ -0,0 +1,396 @@
+// Package gitsource checks out the repository a build runs on. Each
+// repository is fetched shallowly into a bare clone cached per repository
+// URL, and every build gets its own worktree of the fetched commit, so
+// repeated builds of a repository only fetch what changed.
+package gitsource
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultDepth is the history depth fetched for a build
+const DefaultDepth = 1
+
+// DefaultCredentialsUser is the user name sent with credentials that are a
+// bare token rather than "user:password"
+const DefaultCredentialsUser = "x-access-token"
+
+// allowedSchemes are the URL schemes builds may clone from. Local paths and
+// file URLs are refused so a build cannot read repositories on the worker.
+var allowedSchemes = map[string]bool{"https": true, "http": true, "ssh": true, "git": true}
+
+// scpPattern matches scp-like SSH addresses such as git@github.com:org/repo.git
+var scpPattern = regexp.MustCompile(`^[A-Za-z0-9._-]+@[A-Za-z0-9.-]+:[^\s:]+$`)
+
+// refPattern accepts branch and tag names, qualified refs and commit hashes
+var refPattern = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9._/+-]*$`)
+
+// commitPattern matches full SHA-1 and SHA-256 commit hashes
+var commitPattern = regexp.MustCompile(`^([0-9a-f]{40}|[0-9a-f]{64})$`)
+
+// Source is a repository and the ref of it to build
+type Source struct {
+	RepoURL string
+	// Ref is a branch, tag or commit hash; empty builds the default branch
+	Ref string
+	// Credentials authenticate HTTP(S) clones as "user:password" or as a
+	// bare token. SSH clones use the worker's SSH configuration.
+	Credentials string
+}
+
+// ValidateSource checks that a repository URL and ref are safe to pass to git
+func ValidateSource(repoURL, ref string) error {
+	if err := ValidateRepoURL(repoURL); err != nil {
+		return err
+	}
+	return ValidateRef(ref)
+}
+
+// ValidateRepoURL checks that a repository URL uses an allowed scheme and
+// carries no password, which belongs in a build secret instead
+func ValidateRepoURL(repoURL string) error {
+	if repoURL == "" {
+		return fmt.Errorf("repository URL cannot be empty")
+	}
+	if strings.HasPrefix(repoURL, "-") || strings.ContainsAny(repoURL, " \t\r\n") {
+		return fmt.Errorf("invalid repository URL %q", repoURL)
+	}
+	if scpPattern.MatchString(repoURL) {
+		return nil
+	}
+
+	parsed, err := url.Parse(repoURL)
+	if err != nil {
+		return fmt.Errorf("invalid repository URL: %v", err)
+	}
+	if !allowedSchemes[parsed.Scheme] || parsed.Host == "" {
+		return fmt.Errorf("unsupported repository URL %q: use https, http, ssh or git", repoURL)
+	}
+	if _, hasPassword := parsed.User.Password(); hasPassword {
+		return fmt.Errorf("repository URL must not contain a password; pass credentials as a build secret")
+	}
+	return nil
+}
+
+// ValidateRef checks that a ref is a well-formed branch, tag or commit hash
+func ValidateRef(ref string) error {
+	if ref == "" {
+		return nil
+	}
+	if !refPattern.MatchString(ref) || strings.Contains(ref, "..") || strings.Contains(ref, "//") ||
+		strings.HasSuffix(ref, "/") || strings.HasSuffix(ref, ".lock") {
+		return fmt.Errorf("invalid ref %q", ref)
+	}
+	return nil
+}
+
+// IsCommitHash reports whether a ref is a full commit hash, which unlike a
+// branch or tag always names the same commit
+func IsCommitHash(ref string) bool {
+	return commitPattern.MatchString(ref)
+}
+
+// ValidateSubdirectory checks that the project directory of a repository
+// build is a relative path that stays inside the repository
+func ValidateSubdirectory(subdir string) error {
+	if subdir == "" {
+		return nil
+	}
+	if filepath.IsAbs(subdir) {
+		return fmt.Errorf("project directory must be relative to the repository: %s", subdir)
+	}
+	clean := filepath.Clean(subdir)
+	if clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("project directory escapes the repository: %s", subdir)
+	}
+	return nil
+}
+
+// ProjectDir returns the project directory subdir of a checkout, checking
+// that it is a directory inside the checkout once symlinks are resolved, so
+// a link committed to the repository cannot point a build elsewhere
+func ProjectDir(checkout, subdir string) (string, error) {
+	if err := ValidateSubdirectory(subdir); err != nil {
+		return "", err
+	}
+
+	root, err := filepath.EvalSymlinks(checkout)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve checkout: %v", err)
+	}
+	dir, err := filepath.EvalSymlinks(filepath.Join(root, subdir))
+	if err != nil {
+		return "", fmt.Errorf("project directory %s not found in the repository", subdir)
+	}
+	rel, err := filepath.Rel(root, dir)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("project directory %s resolves outside the repository", subdir)
+	}
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return "", fmt.Errorf("project directory %s is not a directory", subdir)
+	}
+	return dir, nil
+}
+
+// Checkouts checks out repositories for builds
+type Checkouts struct {
+	// CacheDir holds a bare clone of every repository built
+	CacheDir string
+	// Depth is the history depth fetched; 0 fetches the full history
+	Depth int
+	// Submodules checks out submodules recursively
+	Submodules bool
+	// mutexes serializes fetches and worktree changes per repository
+	mutexes sync.Map
+}
+
+// NewCheckouts creates checkouts caching repositories in cacheDir
+func NewCheckouts(cacheDir string) *Checkouts {
+	return &Checkouts{
+		CacheDir:   cacheDir,
+		Depth:      DefaultDepth,
+		Submodules: true,
+	}
+}
+
+// NewCheckoutsFromEnv creates checkouts configured by GIT_CACHE_DIR,
+// GIT_CLONE_DEPTH and GIT_SUBMODULES
+func NewCheckoutsFromEnv() *Checkouts {
+	cacheDir := os.Getenv("GIT_CACHE_DIR")
+	if cacheDir == "" {
+		cacheDir = filepath.Join(os.TempDir(), "git-cache")
+	}
+
+	checkouts := NewCheckouts(cacheDir)
+	if value := os.Getenv("GIT_CLONE_DEPTH"); value != "" {
+		if depth, err := strconv.Atoi(value); err == nil && depth >= 0 {
+			checkouts.Depth = depth
+		}
+	}
+	if value := os.Getenv("GIT_SUBMODULES"); value == "false" || value == "0" {
+		checkouts.Submodules = false
+	}
+	return checkouts
+}
+
+// Checkout fetches the source's ref into the repository cache and checks it
+// out into dir, which must not exist or be empty. It returns the commit
+// checked out. Release the checkout with Remove.
+func (c *Checkouts) Checkout(source Source, dir string) (string, error) {
+	if err := ValidateRef(source.Ref); err != nil {
+		return "", err
+	}
+
+	repo := c.repository(source.RepoURL)
+	mutex, _ := c.mutexes.LoadOrStore(repo, &sync.Mutex{})
+	mutex.(*sync.Mutex).Lock()
+	defer mutex.(*sync.Mutex).Unlock()
+
+	env := credentialsEnv(source)
+	if err := c.initRepository(repo, source.RepoURL); err != nil {
+		return "", err
+	}
+
+	ref := source.Ref
+	if ref == "" {
+		ref = "HEAD"
+	}
+	fetch := []string{"fetch", "--no-tags", "--force"}
+	if c.Depth > 0 {
+		fetch = append(fetch, fmt.Sprintf("--depth=%d", c.Depth))
+	}
+	fetch = append(fetch, "origin", ref)
+	if _, err := git(repo, env, fetch...); err != nil {
+		return "", fmt.Errorf("failed to fetch %s of %s: %v", ref, source.RepoURL, mask(err, source))
+	}
+
+	commit, err := git(repo, nil, "rev-parse", "--verify", "FETCH_HEAD^{commit}")
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %s of %s: %v", ref, source.RepoURL, err)
+	}
+
+	// Worktrees share the cached objects, so checking out is cheap
+	if _, err := git(repo, nil, "worktree", "add", "--detach", "--force", dir, commit); err != nil {
+		return "", fmt.Errorf("failed to check out %s: %v", commit, err)
+	}
+
+	if c.Submodules {
+		if _, err := os.Stat(filepath.Join(dir, ".gitmodules")); err == nil {
+			update := []string{"submodule", "update", "--init", "--recursive"}
+			if c.Depth > 0 {
+				update = append(update, fmt.Sprintf("--depth=%d", c.Depth))
+			}
+			if _, err := git(dir, env, update...); err != nil {
+				c.remove(repo, dir)
+				return "", fmt.Errorf("failed to check out submodules: %v", mask(err, source))
+			}
+		}
+	}
+
+	return commit, nil
+}
+
+// Commits fetches the full history of the source's ref and returns the
+// commits after good up to the ref, oldest first. Only first parents are
+// followed, so every commit returned was once the tip of the ref's branch.
+// Good must be an ancestor of the ref.
+func (c *Checkouts) Commits(source Source, good string) ([]string, error) {
+	if err := ValidateRef(source.Ref); err != nil {
+		return nil, err
+	}
+	if err := ValidateRef(good); err != nil || good == "" {
+		return nil, fmt.Errorf("invalid ref %q", good)
+	}
+
+	repo := c.repository(source.RepoURL)
+	mutex, _ := c.mutexes.LoadOrStore(repo, &sync.Mutex{})
+	mutex.(*sync.Mutex).Lock()
+	defer mutex.(*sync.Mutex).Unlock()
+
+	env := credentialsEnv(source)
+	if err := c.initRepository(repo, source.RepoURL); err != nil {
+		return nil, err
+	}
+
+	// Checkouts leave the cache shallow; the range needs the whole history
+	shallow, _ := git(repo, nil, "rev-parse", "--is-shallow-repository")
+	unshallow := shallow == "true"
+	commits := make([]string, 2)
+	for i, ref := range []string{good, source.Ref} {
+		if ref == "" {
+			ref = "HEAD"
+		}
+		fetch := []string{"fetch", "--no-tags", "--force"}
+		if unshallow {
+			fetch = append(fetch, "--unshallow")
+			unshallow = false
+		}
+		if _, err := git(repo, env, append(fetch, "origin", ref)...); err != nil {
+			return nil, fmt.Errorf("failed to fetch %s of %s: %v", ref, source.RepoURL, mask(err, source))
+		}
+		commit, err := git(repo, nil, "rev-parse", "--verify", "FETCH_HEAD^{commit}")
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve %s of %s: %v", ref, source.RepoURL, err)
+		}
+		commits[i] = commit
+	}
+
+	if _, err := git(repo, nil, "merge-base", "--is-ancestor", commits[0], commits[1]); err != nil {
+		return nil, fmt.Errorf("%s is not an ancestor of %s", good, source.Ref)
+	}
+	output, err := git(repo, nil, "rev-list", "--first-parent", "--reverse", commits[0]+".."+commits[1])
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the commits of %s: %v", source.RepoURL, err)
+	}
+	return strings.Fields(output), nil
+}
+
+// Remove deletes a checkout of the repository
+func (c *Checkouts) Remove(repoURL, dir string) error {
+	repo := c.repository(repoURL)
+	mutex, _ := c.mutexes.LoadOrStore(repo, &sync.Mutex{})
+	mutex.(*sync.Mutex).Lock()
+	defer mutex.(*sync.Mutex).Unlock()
+
+	return c.remove(repo, dir)
+}
+
+// remove deletes a worktree and forgets it in the repository cache
+func (c *Checkouts) remove(repo, dir string) error {
+	if err := os.RemoveAll(dir); err != nil {
+		return fmt.Errorf("failed to remove checkout: %v", err)
+	}
+	if _, err := git(repo, nil, "worktree", "prune"); err != nil {
+		return fmt.Errorf("failed to prune checkout: %v", err)
+	}
+	return nil
+}
+
+// repository returns the cache directory of a repository URL
+func (c *Checkouts) repository(repoURL string) string {
+	sum := sha256.Sum256([]byte(repoURL))
+	return filepath.Join(c.CacheDir, hex.EncodeToString(sum[:8])+".git")
+}
+
+// initRepository creates the bare clone of a repository on first use
+func (c *Checkouts) initRepository(repo, repoURL string) error {
+	if _, err := os.Stat(filepath.Join(repo, "HEAD")); err == nil {
+		return nil
+	}
+
+	if err := os.MkdirAll(c.CacheDir, 0755); err != nil {
+		return fmt.Errorf("failed to create repository cache: %v", err)
+	}
+	// Start over if an earlier initialization was interrupted
+	os.RemoveAll(repo)
+	if _, err := git(c.CacheDir, nil, "init", "--bare", "--quiet", repo); err != nil {
+		return fmt.Errorf("failed to create repository cache: %v", err)
+	}
+	if _, err := git(repo, nil, "remote", "add", "origin", "--", repoURL); err != nil {
+		os.RemoveAll(repo)
+		return fmt.Errorf("failed to create repository cache: %v", err)
+	}
+	return nil
+}
+
+// credentialsEnv returns the environment passing the source's credentials to
+// git as an HTTP authorization header for its host only. The header is given
+// through GIT_CONFIG_* variables so it is never written to disk.
+func credentialsEnv(source Source) []string {
+	if source.Credentials == "" {
+		return nil
+	}
+	parsed, err := url.Parse(source.RepoURL)
+	if err != nil || (parsed.Scheme != "https" && parsed.Scheme != "http") {
+		return nil
+	}
+
+	credentials := source.Credentials
+	if !strings.Contains(credentials, ":") {
+		credentials = DefaultCredentialsUser + ":" + credentials
+	}
+	header := "Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(credentials))
+
+	return []string{
+		"GIT_CONFIG_COUNT=1",
+		fmt.Sprintf("GIT_CONFIG_KEY_0=http.%s://%s/.extraHeader", parsed.Scheme, parsed.Host),
+		"GIT_CONFIG_VALUE_0=" + header,
+	}
+}
+
+// mask removes the source's credentials from an error
+func mask(err error, source Source) string {
+	message := err.Error()
+	if source.Credentials != "" {
+		message = strings.ReplaceAll(message, source.Credentials, "****")
+	}
+	return message
+}
+
+// git runs a git command in dir and returns its trimmed output
+func git(dir string, env []string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	// Never wait for a password prompt
+	cmd.Env = append(append(os.Environ(), "GIT_TERMINAL_PROMPT=0"), env...)
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("git %s: %v: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
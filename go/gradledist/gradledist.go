@@ -0,0 +1,257 @@
+// Package gradledist resolves the Gradle executable for a build. Projects
+// with a Gradle wrapper use it; builds requesting a specific Gradle version
+// run a distribution downloaded once into a version cache.
+package gradledist
+
+import (
+	"archive/zip"
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultDistributionURL serves the official Gradle distributions
+const DefaultDistributionURL = "https://services.gradle.org/distributions"
+
+// versionPattern accepts release versions such as 8.5, 7.6.4 or 8.7-rc-1 and
+// keeps requested versions from escaping the cache directory
+var versionPattern = regexp.MustCompile(`^[0-9]+(\.[0-9]+)*(-[A-Za-z0-9.-]+)?$`)
+
+// wrapperVersionPattern extracts the version from a wrapper distributionUrl
+var wrapperVersionPattern = regexp.MustCompile(`gradle-([0-9][A-Za-z0-9.-]*?)-(bin|all)\.zip`)
+
+// Provisioner resolves and installs Gradle distributions
+type Provisioner struct {
+	CacheDir        string
+	DistributionURL string
+	HTTPClient      *http.Client
+	mutex           sync.Mutex
+}
+
+// NewProvisioner creates a provisioner caching distributions in cacheDir
+func NewProvisioner(cacheDir string) *Provisioner {
+	return &Provisioner{
+		CacheDir:        cacheDir,
+		DistributionURL: DefaultDistributionURL,
+		HTTPClient:      &http.Client{Timeout: 10 * time.Minute},
+	}
+}
+
+// NewProvisionerFromEnv creates a provisioner configured by
+// GRADLE_DISTRIBUTIONS_DIR and GRADLE_DISTRIBUTION_URL
+func NewProvisionerFromEnv() *Provisioner {
+	cacheDir := os.Getenv("GRADLE_DISTRIBUTIONS_DIR")
+	if cacheDir == "" {
+		cacheDir = filepath.Join(os.TempDir(), "gradle-distributions")
+	}
+
+	provisioner := NewProvisioner(cacheDir)
+	if url := os.Getenv("GRADLE_DISTRIBUTION_URL"); url != "" {
+		provisioner.DistributionURL = strings.TrimSuffix(url, "/")
+	}
+	return provisioner
+}
+
+// ValidVersion reports whether a requested Gradle version is well formed
+func ValidVersion(version string) bool {
+	return versionPattern.MatchString(version)
+}
+
+// Executable returns the Gradle command for a build of the project. Without
+// a requested version the project's wrapper is preferred over the gradle on
+// the PATH. With one, the wrapper is used only if it pins that version;
+// otherwise the distribution is taken from the cache, downloading it first
+// if needed.
+func (p *Provisioner) Executable(projectPath, version string) (string, error) {
+	wrapper := filepath.Join(projectPath, "gradlew")
+	_, err := os.Stat(wrapper)
+	hasWrapper := err == nil
+
+	if version == "" {
+		if hasWrapper {
+			return wrapper, nil
+		}
+		return "gradle", nil
+	}
+
+	if !ValidVersion(version) {
+		return "", fmt.Errorf("invalid gradle version %q", version)
+	}
+
+	if hasWrapper {
+		if wrapperVersion, ok := WrapperVersion(projectPath); ok && wrapperVersion == version {
+			return wrapper, nil
+		}
+	}
+
+	executable, err := p.install(version)
+	if err != nil {
+		return "", fmt.Errorf("gradle %s could not be provisioned: %v", version, err)
+	}
+	return executable, nil
+}
+
+// WrapperVersion returns the Gradle version pinned by the project's wrapper
+func WrapperVersion(projectPath string) (string, bool) {
+	file, err := os.Open(filepath.Join(projectPath, "gradle", "wrapper", "gradle-wrapper.properties"))
+	if err != nil {
+		return "", false
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, "distributionUrl") {
+			continue
+		}
+		if match := wrapperVersionPattern.FindStringSubmatch(line); match != nil {
+			return match[1], true
+		}
+	}
+
+	return "", false
+}
+
+// install returns the executable of a cached distribution, downloading and
+// unpacking it on first use
+func (p *Provisioner) install(version string) (string, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	home := filepath.Join(p.CacheDir, "gradle-"+version)
+	executable := filepath.Join(home, "bin", "gradle")
+	if _, err := os.Stat(executable); err == nil {
+		return executable, nil
+	}
+
+	if err := os.MkdirAll(p.CacheDir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create distribution cache: %v", err)
+	}
+
+	archive, err := p.download(version)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(archive)
+
+	// Unpack next to the cache entry and rename it into place, so an
+	// interrupted install never leaves a partial distribution behind
+	staging, err := os.MkdirTemp(p.CacheDir, ".gradle-"+version+"-")
+	if err != nil {
+		return "", fmt.Errorf("failed to create staging directory: %v", err)
+	}
+	defer os.RemoveAll(staging)
+
+	if err := unzip(archive, staging); err != nil {
+		return "", err
+	}
+
+	unpacked := filepath.Join(staging, "gradle-"+version)
+	if _, err := os.Stat(filepath.Join(unpacked, "bin", "gradle")); err != nil {
+		return "", fmt.Errorf("distribution does not contain gradle-%s/bin/gradle", version)
+	}
+
+	if err := os.Rename(unpacked, home); err != nil {
+		return "", fmt.Errorf("failed to install distribution: %v", err)
+	}
+
+	return executable, nil
+}
+
+// download fetches the binary distribution of a version into a temporary file
+func (p *Provisioner) download(version string) (string, error) {
+	url := fmt.Sprintf("%s/gradle-%s-bin.zip", p.DistributionURL, version)
+
+	resp, err := p.HTTPClient.Get(url)
+	if err != nil {
+		return "", fmt.Errorf("failed to download %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to download %s: status %d", url, resp.StatusCode)
+	}
+
+	file, err := os.CreateTemp(p.CacheDir, ".gradle-"+version+"-*.zip")
+	if err != nil {
+		return "", fmt.Errorf("failed to create download file: %v", err)
+	}
+	defer file.Close()
+
+	if _, err := io.Copy(file, resp.Body); err != nil {
+		os.Remove(file.Name())
+		return "", fmt.Errorf("failed to download %s: %v", url, err)
+	}
+
+	return file.Name(), nil
+}
+
+// unzip extracts an archive into dir, rejecting entries outside of it
+func unzip(archive, dir string) error {
+	reader, err := zip.OpenReader(archive)
+	if err != nil {
+		return fmt.Errorf("failed to open distribution: %v", err)
+	}
+	defer reader.Close()
+
+	for _, entry := range reader.File {
+		target := filepath.Join(dir, entry.Name)
+		if !strings.HasPrefix(target, filepath.Clean(dir)+string(os.PathSeparator)) {
+			return fmt.Errorf("distribution entry %s escapes the install directory", entry.Name)
+		}
+
+		if entry.FileInfo().IsDir() {
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return fmt.Errorf("failed to unpack distribution: %v", err)
+			}
+			continue
+		}
+
+		if err := extractFile(entry, target); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// extractFile writes a single archive entry, keeping its permission bits so
+// bin/gradle stays executable
+func extractFile(entry *zip.File, target string) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return fmt.Errorf("failed to unpack distribution: %v", err)
+	}
+
+	source, err := entry.Open()
+	if err != nil {
+		return fmt.Errorf("failed to unpack %s: %v", entry.Name, err)
+	}
+	defer source.Close()
+
+	mode := entry.Mode().Perm()
+	if mode == 0 {
+		mode = 0644
+	}
+	if strings.Contains(entry.Name, "/bin/") {
+		mode |= 0755
+	}
+
+	file, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return fmt.Errorf("failed to unpack %s: %v", entry.Name, err)
+	}
+	defer file.Close()
+
+	if _, err := io.Copy(file, source); err != nil {
+		return fmt.Errorf("failed to unpack %s: %v", entry.Name, err)
+	}
+	return nil
+}
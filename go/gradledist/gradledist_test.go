@@ -0,0 +1,147 @@
+package gradledist
+
+import (
+	"archive/zip"
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// distributionServer serves a minimal gradle-<version>-bin.zip for each version
+func distributionServer(t *testing.T, downloads *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/")
+		if !strings.HasPrefix(name, "gradle-") || !strings.HasSuffix(name, "-bin.zip") {
+			http.NotFound(w, r)
+			return
+		}
+		version := strings.TrimSuffix(strings.TrimPrefix(name, "gradle-"), "-bin.zip")
+		if version == "0.0" {
+			http.NotFound(w, r)
+			return
+		}
+		atomic.AddInt32(downloads, 1)
+
+		var buf bytes.Buffer
+		archive := zip.NewWriter(&buf)
+		entry, _ := archive.Create("gradle-" + version + "/bin/gradle")
+		entry.Write([]byte("#!/bin/sh\necho Gradle " + version + "\n"))
+		archive.Close()
+
+		w.Write(buf.Bytes())
+	}))
+}
+
+func writeWrapper(t *testing.T, projectPath, version string) {
+	t.Helper()
+	os.WriteFile(filepath.Join(projectPath, "gradlew"), []byte("#!/bin/sh\n"), 0755)
+	os.MkdirAll(filepath.Join(projectPath, "gradle", "wrapper"), 0755)
+	properties := "distributionBase=GRADLE_USER_HOME\n" +
+		"distributionUrl=https\\://services.gradle.org/distributions/gradle-" + version + "-bin.zip\n"
+	os.WriteFile(filepath.Join(projectPath, "gradle", "wrapper", "gradle-wrapper.properties"), []byte(properties), 0644)
+}
+
+func TestExecutableWithoutVersion(t *testing.T) {
+	provisioner := NewProvisioner(t.TempDir())
+
+	plain := t.TempDir()
+	if executable, err := provisioner.Executable(plain, ""); err != nil || executable != "gradle" {
+		t.Errorf("Expected gradle from PATH, got %s (%v)", executable, err)
+	}
+
+	wrapped := t.TempDir()
+	writeWrapper(t, wrapped, "8.5")
+	if executable, err := provisioner.Executable(wrapped, ""); err != nil || executable != filepath.Join(wrapped, "gradlew") {
+		t.Errorf("Expected project wrapper, got %s (%v)", executable, err)
+	}
+}
+
+func TestExecutableWithVersion(t *testing.T) {
+	var downloads int32
+	server := distributionServer(t, &downloads)
+	defer server.Close()
+
+	provisioner := NewProvisioner(t.TempDir())
+	provisioner.DistributionURL = server.URL
+
+	// A wrapper pinning the requested version is used as is
+	project := t.TempDir()
+	writeWrapper(t, project, "8.5")
+	if executable, err := provisioner.Executable(project, "8.5"); err != nil || executable != filepath.Join(project, "gradlew") {
+		t.Errorf("Expected matching wrapper, got %s (%v)", executable, err)
+	}
+
+	// Another version is downloaded once and then served from the cache
+	expected := filepath.Join(provisioner.CacheDir, "gradle-7.6.4", "bin", "gradle")
+	for i := 0; i < 2; i++ {
+		executable, err := provisioner.Executable(project, "7.6.4")
+		if err != nil {
+			t.Fatalf("Executable failed: %v", err)
+		}
+		if executable != expected {
+			t.Errorf("Expected %s, got %s", expected, executable)
+		}
+	}
+	if downloads != 1 {
+		t.Errorf("Expected 1 download, got %d", downloads)
+	}
+
+	info, err := os.Stat(expected)
+	if err != nil {
+		t.Fatalf("Expected installed distribution: %v", err)
+	}
+	if info.Mode().Perm()&0100 == 0 {
+		t.Errorf("Expected bin/gradle to be executable, got %v", info.Mode())
+	}
+
+	entries, _ := os.ReadDir(provisioner.CacheDir)
+	if len(entries) != 1 {
+		t.Errorf("Expected only the installed distribution in the cache, got %d entries", len(entries))
+	}
+}
+
+func TestExecutableFailsFast(t *testing.T) {
+	var downloads int32
+	server := distributionServer(t, &downloads)
+	defer server.Close()
+
+	provisioner := NewProvisioner(t.TempDir())
+	provisioner.DistributionURL = server.URL
+
+	_, err := provisioner.Executable(t.TempDir(), "0.0")
+	if err == nil || !strings.Contains(err.Error(), "gradle 0.0 could not be provisioned") {
+		t.Errorf("Expected provisioning error, got %v", err)
+	}
+
+	for _, version := range []string{"../../etc", "8.5/../..", "latest", ""} {
+		if ValidVersion(version) {
+			t.Errorf("Expected %q to be rejected", version)
+		}
+	}
+	if _, err := provisioner.Executable(t.TempDir(), "../8.5"); err == nil || !strings.Contains(err.Error(), "invalid gradle version") {
+		t.Errorf("Expected invalid version error, got %v", err)
+	}
+}
+
+func TestWrapperVersion(t *testing.T) {
+	project := t.TempDir()
+	if _, ok := WrapperVersion(project); ok {
+		t.Error("Expected no wrapper version without properties")
+	}
+
+	writeWrapper(t, project, "8.7-rc-1")
+	if version, ok := WrapperVersion(project); !ok || version != "8.7-rc-1" {
+		t.Errorf("Expected 8.7-rc-1, got %s", version)
+	}
+
+	for _, version := range []string{"8.5", "7.6.4", "8.7-rc-1", "8.10-milestone-2"} {
+		if !ValidVersion(version) {
+			t.Errorf("Expected %q to be valid", version)
+		}
+	}
+}
@@ -0,0 +1,299 @@
+// Package hooks defines the commands workers run around the Gradle
+// invocation of a build: pre-build hooks, such as starting a database or an
+// emulator, and post-build hooks, such as signing artifacts. Hooks come with
+// a build request or from rules matching the build's project, and each one
+// is reported as a step of the build with its output.
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Phases of a build hooks run in
+const (
+	PhasePre  = "pre"
+	PhasePost = "post"
+)
+
+// Statuses of the step of a hook
+const (
+	StatusSucceeded = "succeeded"
+	StatusFailed    = "failed"
+	StatusTimedOut  = "timed_out"
+	StatusSkipped   = "skipped"
+)
+
+// Environment variables set for hooks
+const (
+	// EnvBuildID is the ID of the build
+	EnvBuildID = "DGB_BUILD_ID"
+	// EnvBuildStatus is succeeded or failed for post-build hooks
+	EnvBuildStatus = "DGB_BUILD_STATUS"
+)
+
+const (
+	// MaxHooks is the most hooks of a phase
+	MaxHooks = 10
+	// DefaultTimeout is how long a hook may run without a timeout of its own
+	DefaultTimeout = 10 * time.Minute
+	// MaxTimeout is the longest timeout of a hook
+	MaxTimeout = time.Hour
+	// MaxOutput is the most output kept with the step of a hook; the end of
+	// longer output is kept
+	MaxOutput = 16 << 10
+	// waitDelay is how long output is read after a hook exits, as processes
+	// it started in the background may keep its output open
+	waitDelay = 2 * time.Second
+)
+
+// namePattern matches the names of hooks
+var namePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,62}$`)
+
+// Hook is a shell command run with sh -c in the project directory of a
+// build, with the build's environment and secrets
+type Hook struct {
+	Name string `json:"name"`
+	Run  string `json:"run"`
+	// TimeoutSeconds kills the hook once it ran that long, DefaultTimeout
+	// if zero
+	TimeoutSeconds int `json:"timeout_seconds,omitempty"`
+	// Always runs a post-build hook after failed builds too, such as one
+	// stopping an emulator
+	Always bool `json:"always,omitempty"`
+}
+
+// Timeout returns how long the hook may run
+func (h Hook) Timeout() time.Duration {
+	if h.TimeoutSeconds == 0 {
+		return DefaultTimeout
+	}
+	return time.Duration(h.TimeoutSeconds) * time.Second
+}
+
+// Hooks are the hooks of a build, run in order before and after Gradle
+type Hooks struct {
+	Pre  []Hook `json:"pre,omitempty"`
+	Post []Hook `json:"post,omitempty"`
+}
+
+// Empty reports whether there are no hooks
+func (h Hooks) Empty() bool {
+	return len(h.Pre) == 0 && len(h.Post) == 0
+}
+
+// Validate checks the names, commands and timeouts of the hooks
+func (h Hooks) Validate() error {
+	for _, phase := range []string{PhasePre, PhasePost} {
+		hooks := h.Pre
+		if phase == PhasePost {
+			hooks = h.Post
+		}
+		if len(hooks) > MaxHooks {
+			return fmt.Errorf("at most %d %s-build hooks are allowed", MaxHooks, phase)
+		}
+		names := make(map[string]bool)
+		for _, hook := range hooks {
+			if !namePattern.MatchString(hook.Name) {
+				return fmt.Errorf("invalid hook name %q: use up to 63 letters, digits, '.', '_' and '-'", hook.Name)
+			}
+			if names[hook.Name] {
+				return fmt.Errorf("duplicate %s-build hook %q", phase, hook.Name)
+			}
+			names[hook.Name] = true
+			if strings.TrimSpace(hook.Run) == "" {
+				return fmt.Errorf("hook %q has no command", hook.Name)
+			}
+			if hook.TimeoutSeconds < 0 || hook.Timeout() > MaxTimeout {
+				return fmt.Errorf("timeout of hook %q must be between 0 and %d seconds", hook.Name, int(MaxTimeout.Seconds()))
+			}
+			if hook.Always && phase == PhasePre {
+				return fmt.Errorf("pre-build hook %q cannot set always", hook.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// Around returns the hooks of inner wrapped in h: the pre-build hooks of h
+// run first and its post-build hooks last
+func (h Hooks) Around(inner Hooks) Hooks {
+	return Hooks{
+		Pre:  append(append([]Hook(nil), h.Pre...), inner.Pre...),
+		Post: append(append([]Hook(nil), inner.Post...), h.Post...),
+	}
+}
+
+// Rule gives the builds matching it hooks. Project and Repository are glob
+// patterns (path.Match syntax) of the project path and repository URL of a
+// build; empty fields match any build.
+type Rule struct {
+	Project    string `json:"project,omitempty"`
+	Repository string `json:"repository,omitempty"`
+	Hooks
+}
+
+// matches reports whether a build's project and repository match the rule
+func (r Rule) matches(project, repository string) bool {
+	if r.Project != "" {
+		if matched, _ := path.Match(r.Project, project); !matched {
+			return false
+		}
+	}
+	if r.Repository != "" {
+		if matched, _ := path.Match(r.Repository, repository); repository == "" || !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// Rules give builds the hooks of the first rule they match
+type Rules []Rule
+
+// RulesFromEnv reads the rules from BUILD_HOOKS, a JSON array of rules
+func RulesFromEnv() (Rules, error) {
+	var rules Rules
+	if value := os.Getenv("BUILD_HOOKS"); value != "" {
+		if err := json.Unmarshal([]byte(value), &rules); err != nil {
+			return nil, fmt.Errorf("failed to parse BUILD_HOOKS: %v", err)
+		}
+	}
+	for _, rule := range rules {
+		for _, pattern := range []string{rule.Project, rule.Repository} {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("invalid pattern %q: %v", pattern, err)
+			}
+		}
+		if err := rule.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	return rules, nil
+}
+
+// For returns the hooks of a build of project or repository
+func (r Rules) For(project, repository string) Hooks {
+	for _, rule := range r {
+		if rule.matches(project, repository) {
+			return rule.Hooks
+		}
+	}
+	return Hooks{}
+}
+
+// Step is the outcome of running a hook
+type Step struct {
+	Name   string `json:"name"`
+	Phase  string `json:"phase"`
+	Status string `json:"status"`
+	// ExitCode is that of a hook that exited, -1 if it was killed
+	ExitCode  int       `json:"exit_code"`
+	Output    string    `json:"output,omitempty"`
+	StartTime time.Time `json:"start_time"`
+	EndTime   time.Time `json:"end_time"`
+}
+
+// Skip returns the step of a hook that did not run
+func Skip(hook Hook, phase string) Step {
+	now := time.Now()
+	return Step{Name: hook.Name, Phase: phase, Status: StatusSkipped, StartTime: now, EndTime: now}
+}
+
+// Run runs a hook in dir with env, passing every line of its output to
+// output and keeping the end of it in the step. The hook is killed once it
+// runs past its timeout.
+func Run(hook Hook, phase, dir string, env []string, output func(line string)) Step {
+	step := Step{Name: hook.Name, Phase: phase, StartTime: time.Now()}
+	ctx, cancel := context.WithTimeout(context.Background(), hook.Timeout())
+	defer cancel()
+
+	lines := &lineWriter{output: output}
+	cmd := exec.CommandContext(ctx, "sh", "-c", hook.Run)
+	cmd.Dir = dir
+	cmd.Env = env
+	cmd.Stdout = lines
+	cmd.Stderr = lines
+	cmd.WaitDelay = waitDelay
+	err := cmd.Run()
+	lines.flush()
+
+	step.EndTime = time.Now()
+	step.Output = lines.tail()
+	step.ExitCode = cmd.ProcessState.ExitCode()
+	var exitErr *exec.ExitError
+	switch {
+	case ctx.Err() == context.DeadlineExceeded:
+		step.Status = StatusTimedOut
+	case err == nil, errors.Is(err, exec.ErrWaitDelay):
+		step.Status = StatusSucceeded
+	case errors.As(err, &exitErr):
+		step.Status = StatusFailed
+	default:
+		step.Status, step.ExitCode = StatusFailed, -1
+		step.Output = err.Error()
+	}
+	return step
+}
+
+// Err returns the error of a step that did not succeed, nil otherwise
+func (s Step) Err() error {
+	switch s.Status {
+	case StatusFailed:
+		return fmt.Errorf("%s-build hook %s failed with exit code %d", s.Phase, s.Name, s.ExitCode)
+	case StatusTimedOut:
+		return fmt.Errorf("%s-build hook %s timed out", s.Phase, s.Name)
+	}
+	return nil
+}
+
+// lineWriter splits the output of a hook into lines, keeping its end
+type lineWriter struct {
+	output  func(string)
+	partial []byte
+	kept    []byte
+}
+
+func (w *lineWriter) Write(data []byte) (int, error) {
+	w.kept = append(w.kept, data...)
+	if len(w.kept) > 2*MaxOutput {
+		w.kept = append([]byte(nil), w.kept[len(w.kept)-MaxOutput:]...)
+	}
+
+	w.partial = append(w.partial, data...)
+	for {
+		end := bytes.IndexByte(w.partial, '\n')
+		if end < 0 {
+			break
+		}
+		w.output(strings.TrimSuffix(string(w.partial[:end]), "\r"))
+		w.partial = w.partial[end+1:]
+	}
+	return len(data), nil
+}
+
+// flush passes on the last line of output if it did not end in a newline
+func (w *lineWriter) flush() {
+	if len(w.partial) > 0 {
+		w.output(string(w.partial))
+		w.partial = nil
+	}
+}
+
+// tail returns the end of the output, at most MaxOutput bytes
+func (w *lineWriter) tail() string {
+	kept := w.kept
+	if len(kept) > MaxOutput {
+		kept = kept[len(kept)-MaxOutput:]
+	}
+	return strings.ToValidUTF8(string(kept), "")
+}
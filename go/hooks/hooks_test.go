@@ -0,0 +1,115 @@
+package hooks
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidate(t *testing.T) {
+	valid := Hooks{
+		Pre:  []Hook{{Name: "start-db", Run: "docker compose up -d db", TimeoutSeconds: 120}},
+		Post: []Hook{{Name: "stop-db", Run: "docker compose down", Always: true}},
+	}
+	if err := valid.Validate(); err != nil {
+		t.Errorf("Expected valid hooks, got %v", err)
+	}
+
+	tooMany := Hooks{}
+	for i := 0; i <= MaxHooks; i++ {
+		tooMany.Pre = append(tooMany.Pre, Hook{Name: strings.Repeat("a", i+1), Run: "true"})
+	}
+	for name, hooks := range map[string]Hooks{
+		"too many":          tooMany,
+		"invalid name":      {Pre: []Hook{{Name: "-rf", Run: "true"}}},
+		"duplicate name":    {Post: []Hook{{Name: "sign", Run: "true"}, {Name: "sign", Run: "true"}}},
+		"no command":        {Pre: []Hook{{Name: "empty", Run: "  "}}},
+		"negative timeout":  {Pre: []Hook{{Name: "slow", Run: "true", TimeoutSeconds: -1}}},
+		"long timeout":      {Pre: []Hook{{Name: "slow", Run: "true", TimeoutSeconds: 7200}}},
+		"always before run": {Pre: []Hook{{Name: "setup", Run: "true", Always: true}}},
+	} {
+		if err := hooks.Validate(); err == nil {
+			t.Errorf("%s: expected the hooks to be rejected", name)
+		}
+	}
+}
+
+func TestRules(t *testing.T) {
+	t.Setenv("BUILD_HOOKS", `[
+		{"project": "/projects/android/*", "pre": [{"name": "emulator", "run": "start-emulator"}], "post": [{"name": "stop-emulator", "run": "stop-emulator", "always": true}]},
+		{"repository": "https://git.example.com/*", "post": [{"name": "sign", "run": "sign-artifacts"}]}
+	]`)
+	rules, err := RulesFromEnv()
+	if err != nil {
+		t.Fatalf("RulesFromEnv failed: %v", err)
+	}
+
+	android := rules.For("/projects/android/app", "")
+	if len(android.Pre) != 1 || android.Pre[0].Name != "emulator" || len(android.Post) != 1 || !android.Post[0].Always {
+		t.Errorf("Expected the android hooks, got %+v", android)
+	}
+	if signed := rules.For("app", "https://git.example.com/app"); len(signed.Pre) != 0 || len(signed.Post) != 1 {
+		t.Errorf("Expected the signing hook, got %+v", signed)
+	}
+	if none := rules.For("/projects/backend", ""); !none.Empty() {
+		t.Errorf("Expected no hooks, got %+v", none)
+	}
+
+	wrapped := android.Around(Hooks{Pre: []Hook{{Name: "seed", Run: "seed"}}, Post: []Hook{{Name: "report", Run: "report"}}})
+	var names []string
+	for _, hook := range append(wrapped.Pre, wrapped.Post...) {
+		names = append(names, hook.Name)
+	}
+	if strings.Join(names, ",") != "emulator,seed,report,stop-emulator" {
+		t.Errorf("Expected the project hooks around the request's, got %v", names)
+	}
+	if len(android.Pre) != 1 {
+		t.Errorf("Around must not change the rule's hooks")
+	}
+
+	for _, value := range []string{`{`, `[{"project": "[", "pre": []}]`, `[{"pre": [{"name": "", "run": "true"}]}]`} {
+		t.Setenv("BUILD_HOOKS", value)
+		if _, err := RulesFromEnv(); err == nil {
+			t.Errorf("Expected %s to be rejected", value)
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	dir := t.TempDir()
+	var lines []string
+	output := func(line string) { lines = append(lines, line) }
+
+	step := Run(Hook{Name: "setup", Run: `echo "$GREETING" > greeting.txt; echo started; echo warning >&2; printf done`},
+		PhasePre, dir, append(os.Environ(), "GREETING=hello"), output)
+	if step.Status != StatusSucceeded || step.ExitCode != 0 || step.Err() != nil {
+		t.Fatalf("Expected the hook to succeed, got %+v", step)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "greeting.txt")); string(data) != "hello\n" {
+		t.Errorf("Expected the hook to run in the project directory with its environment, got %q", data)
+	}
+	if strings.Join(lines, ",") != "started,warning,done" || step.Output != "started\nwarning\ndone" {
+		t.Errorf("Unexpected output %v %q", lines, step.Output)
+	}
+	if step.Name != "setup" || step.Phase != PhasePre || step.EndTime.Before(step.StartTime) {
+		t.Errorf("Unexpected step %+v", step)
+	}
+
+	failed := Run(Hook{Name: "check", Run: "exit 3"}, PhasePost, dir, nil, output)
+	if failed.Status != StatusFailed || failed.ExitCode != 3 || failed.Err() == nil || !strings.Contains(failed.Err().Error(), "post-build hook check failed with exit code 3") {
+		t.Errorf("Expected the hook to fail, got %+v: %v", failed, failed.Err())
+	}
+
+	started := time.Now()
+	timedOut := Run(Hook{Name: "slow", Run: "sleep 30", TimeoutSeconds: 1}, PhasePre, dir, nil, output)
+	if timedOut.Status != StatusTimedOut || timedOut.Err() == nil || time.Since(started) > 10*time.Second {
+		t.Errorf("Expected the hook to time out, got %+v after %v", timedOut, time.Since(started))
+	}
+
+	long := Run(Hook{Name: "noisy", Run: "yes | head -c 100000"}, PhasePre, dir, nil, func(string) {})
+	if len(long.Output) != MaxOutput {
+		t.Errorf("Expected the end of the output to be kept, got %d bytes", len(long.Output))
+	}
+}
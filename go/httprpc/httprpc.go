@@ -0,0 +1,494 @@
+// Package httprpc carries net/rpc calls over HTTP, for workers at sites whose
+// firewalls only let HTTP(S) through. Calls to a server are POSTed to its
+// Handler, one call per request. Calls from the server to a client it cannot
+// connect to are queued in a Mailbox, which the client long-polls; it serves
+// each call with its own rpc.Server and POSTs the reply back. Calls and
+// replies are gob encoded like net/rpc's own codec, so the same services and
+// argument types work over both transports. A Mailbox may also be polled
+// over another transport with Next and Deliver.
+package httprpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/rpc"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ContentType of encoded calls and replies
+const ContentType = "application/x-gob"
+
+// CallIDHeader carries the ID of a polled call and of the reply to it
+const CallIDHeader = "X-Call-ID"
+
+// ErrUnknownCall is returned for replies to calls that are not pending,
+// because they were answered already or their client was closed
+var ErrUnknownCall = errors.New("unknown call")
+
+// encode encodes the header and body of a call or reply
+func encode(header, body any) ([]byte, error) {
+	var buffer bytes.Buffer
+	encoder := gob.NewEncoder(&buffer)
+	if err := encoder.Encode(header); err != nil {
+		return nil, err
+	}
+	if err := encoder.Encode(body); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// reply is a decoded reply header with the decoder of its body
+type reply struct {
+	header  rpc.Response
+	decoder *gob.Decoder
+}
+
+// decodeReply decodes the header of an encoded reply
+func decodeReply(data []byte) (reply, error) {
+	decoder := gob.NewDecoder(bytes.NewReader(data))
+	var header rpc.Response
+	if err := decoder.Decode(&header); err != nil {
+		return reply{}, fmt.Errorf("invalid reply: %v", err)
+	}
+	return reply{header: header, decoder: decoder}, nil
+}
+
+// clientCodec POSTs each call to a URL. Calls run concurrently, and failed
+// requests fail their call only.
+type clientCodec struct {
+	url     string
+	header  http.Header
+	client  *http.Client
+	replies chan reply
+	done    chan struct{}
+	once    sync.Once
+	current *gob.Decoder
+}
+
+// Dial returns a client POSTing its calls to url with header set on every
+// request. A nil client uses http.DefaultClient.
+func Dial(url string, header http.Header, client *http.Client) *rpc.Client {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return rpc.NewClientWithCodec(&clientCodec{
+		url:     url,
+		header:  header,
+		client:  client,
+		replies: make(chan reply),
+		done:    make(chan struct{}),
+	})
+}
+
+func (c *clientCodec) WriteRequest(request *rpc.Request, body any) error {
+	data, err := encode(request, body)
+	if err != nil {
+		return err
+	}
+	go c.post(request.Seq, data)
+	return nil
+}
+
+// post sends a call and hands its reply to the client. Transport errors are
+// returned as the error of the call.
+func (c *clientCodec) post(seq uint64, data []byte) {
+	result, err := c.roundTrip(data)
+	if err != nil {
+		result = reply{header: rpc.Response{Error: err.Error()}}
+	}
+	result.header.Seq = seq
+
+	select {
+	case c.replies <- result:
+	case <-c.done:
+	}
+}
+
+func (c *clientCodec) roundTrip(data []byte) (reply, error) {
+	request, err := http.NewRequest("POST", c.url, bytes.NewReader(data))
+	if err != nil {
+		return reply{}, err
+	}
+	for name, values := range c.header {
+		request.Header[name] = values
+	}
+	request.Header.Set("Content-Type", ContentType)
+
+	response, err := c.client.Do(request)
+	if err != nil {
+		return reply{}, err
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return reply{}, err
+	}
+	if response.StatusCode != http.StatusOK {
+		return reply{}, fmt.Errorf("%s returned %s: %s", c.url, response.Status, strings.TrimSpace(string(body)))
+	}
+	return decodeReply(body)
+}
+
+func (c *clientCodec) ReadResponseHeader(response *rpc.Response) error {
+	select {
+	case result := <-c.replies:
+		*response = result.header
+		c.current = result.decoder
+		return nil
+	case <-c.done:
+		return io.EOF
+	}
+}
+
+func (c *clientCodec) ReadResponseBody(body any) error {
+	if body == nil || c.current == nil {
+		return nil
+	}
+	return c.current.Decode(body)
+}
+
+func (c *clientCodec) Close() error {
+	c.once.Do(func() { close(c.done) })
+	return nil
+}
+
+// serverCodec reads a single call and writes its reply
+type serverCodec struct {
+	decoder *gob.Decoder
+	encoder *gob.Encoder
+}
+
+func (c *serverCodec) ReadRequestHeader(request *rpc.Request) error {
+	return c.decoder.Decode(request)
+}
+
+func (c *serverCodec) ReadRequestBody(body any) error {
+	return c.decoder.Decode(body)
+}
+
+func (c *serverCodec) WriteResponse(response *rpc.Response, body any) error {
+	if err := c.encoder.Encode(response); err != nil {
+		return err
+	}
+	return c.encoder.Encode(body)
+}
+
+func (c *serverCodec) Close() error {
+	return nil
+}
+
+// Serve reads an encoded call from in, serves it with server and returns the
+// encoded reply. Calls of unknown methods are answered with an error reply;
+// calls that cannot be decoded return an error.
+func Serve(server *rpc.Server, in io.Reader) ([]byte, error) {
+	var out bytes.Buffer
+	err := server.ServeRequest(&serverCodec{decoder: gob.NewDecoder(in), encoder: gob.NewEncoder(&out)})
+	if out.Len() > 0 {
+		return out.Bytes(), nil
+	}
+	if err == nil {
+		err = errors.New("no reply")
+	}
+	return nil, err
+}
+
+// Handler serves the calls POSTed to it with server
+func Handler(server *rpc.Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		data, err := Serve(server, r.Body)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid call: %v", err), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", ContentType)
+		w.Write(data)
+	}
+}
+
+// Call is a call queued in a mailbox. Its reply is delivered by ID.
+type Call struct {
+	ID   uint64
+	Data []byte
+}
+
+// Mailbox queues calls to a client the server cannot connect to until the
+// client polls them, and routes their replies back to the callers
+type Mailbox struct {
+	mutex   sync.Mutex
+	queue   []Call
+	pending map[uint64]*mailboxCodec
+	nextID  uint64
+	ready   chan struct{}
+	polls   int
+	polled  time.Time
+}
+
+// NewMailbox creates an empty mailbox. It counts as polled when it is
+// created, so calls can be queued for a client about to poll.
+func NewMailbox() *Mailbox {
+	return &Mailbox{pending: make(map[uint64]*mailboxCodec), ready: make(chan struct{}, 1), polled: time.Now()}
+}
+
+// Client returns a client whose calls are queued in the mailbox. Closing it
+// drops its calls that were not polled yet and fails those waiting for a
+// reply.
+func (m *Mailbox) Client() *rpc.Client {
+	return rpc.NewClientWithCodec(&mailboxCodec{mailbox: m, replies: make(chan reply), done: make(chan struct{})})
+}
+
+// Polling reports whether the client is polling the mailbox now or polled it
+// within grace
+func (m *Mailbox) Polling(grace time.Duration) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.polls > 0 || time.Since(m.polled) <= grace
+}
+
+// Next waits for the next queued call until ctx is done
+func (m *Mailbox) Next(ctx context.Context) (Call, bool) {
+	m.mutex.Lock()
+	m.polls++
+	m.mutex.Unlock()
+	defer func() {
+		m.mutex.Lock()
+		m.polls--
+		m.polled = time.Now()
+		m.mutex.Unlock()
+	}()
+
+	for {
+		m.mutex.Lock()
+		if len(m.queue) > 0 {
+			call := m.queue[0]
+			m.queue = m.queue[1:]
+			more := len(m.queue) > 0
+			m.mutex.Unlock()
+			// Wake another poller for the remaining calls
+			if more {
+				m.signal()
+			}
+			return call, true
+		}
+		m.mutex.Unlock()
+
+		select {
+		case <-m.ready:
+		case <-ctx.Done():
+			return Call{}, false
+		}
+	}
+}
+
+// Deliver routes the encoded reply of a polled call to its caller
+func (m *Mailbox) Deliver(id uint64, data []byte) error {
+	m.mutex.Lock()
+	codec, exists := m.pending[id]
+	delete(m.pending, id)
+	m.mutex.Unlock()
+	if !exists {
+		return ErrUnknownCall
+	}
+
+	result, err := decodeReply(data)
+	if err != nil {
+		return err
+	}
+	select {
+	case codec.replies <- result:
+	case <-codec.done:
+	}
+	return nil
+}
+
+// ServeNext is the handler of a client polling the mailbox. It responds with
+// the next call and its ID in CallIDHeader, or 204 No Content if none was
+// queued within wait.
+func (m *Mailbox) ServeNext(w http.ResponseWriter, r *http.Request, wait time.Duration) {
+	ctx, cancel := context.WithTimeout(r.Context(), wait)
+	defer cancel()
+
+	call, ok := m.Next(ctx)
+	if !ok {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", ContentType)
+	w.Header().Set(CallIDHeader, strconv.FormatUint(call.ID, 10))
+	w.Write(call.Data)
+}
+
+// ServeReply is the handler of a client POSTing the reply to the call in
+// CallIDHeader
+func (m *Mailbox) ServeReply(w http.ResponseWriter, r *http.Request) {
+	callID, err := strconv.ParseUint(r.Header.Get(CallIDHeader), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid call ID", http.StatusBadRequest)
+		return
+	}
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to read reply: %v", err), http.StatusBadRequest)
+		return
+	}
+	switch err := m.Deliver(callID, data); {
+	case errors.Is(err, ErrUnknownCall):
+		http.Error(w, fmt.Sprintf("Call %d is not pending", callID), http.StatusNotFound)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (m *Mailbox) signal() {
+	select {
+	case m.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (m *Mailbox) enqueue(codec *mailboxCodec, data []byte) {
+	m.mutex.Lock()
+	m.nextID++
+	m.pending[m.nextID] = codec
+	m.queue = append(m.queue, Call{ID: m.nextID, Data: data})
+	m.mutex.Unlock()
+	m.signal()
+}
+
+// drop forgets the calls of a closed client
+func (m *Mailbox) drop(codec *mailboxCodec) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for id, pending := range m.pending {
+		if pending == codec {
+			delete(m.pending, id)
+		}
+	}
+	m.queue = slices.DeleteFunc(m.queue, func(call Call) bool {
+		_, pending := m.pending[call.ID]
+		return !pending
+	})
+}
+
+// mailboxCodec queues the calls of a client in a mailbox
+type mailboxCodec struct {
+	mailbox *Mailbox
+	replies chan reply
+	done    chan struct{}
+	once    sync.Once
+	current *gob.Decoder
+}
+
+func (c *mailboxCodec) WriteRequest(request *rpc.Request, body any) error {
+	data, err := encode(request, body)
+	if err != nil {
+		return err
+	}
+	c.mailbox.enqueue(c, data)
+	return nil
+}
+
+func (c *mailboxCodec) ReadResponseHeader(response *rpc.Response) error {
+	select {
+	case result := <-c.replies:
+		*response = result.header
+		c.current = result.decoder
+		return nil
+	case <-c.done:
+		return io.EOF
+	}
+}
+
+func (c *mailboxCodec) ReadResponseBody(body any) error {
+	if body == nil || c.current == nil {
+		return nil
+	}
+	return c.current.Decode(body)
+}
+
+func (c *mailboxCodec) Close() error {
+	c.once.Do(func() {
+		close(c.done)
+		c.mailbox.drop(c)
+	})
+	return nil
+}
+
+// Poll waits for the next call queued for this client in a remote mailbox
+// at url and serves it with server in the background, POSTing the reply
+// back to url. It returns once a call was received or the poll timed out.
+func Poll(client *http.Client, url string, header http.Header, server *rpc.Server) error {
+	request, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	for name, values := range header {
+		request.Header[name] = values
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	switch response.StatusCode {
+	case http.StatusNoContent:
+		return nil
+	case http.StatusOK:
+	default:
+		body, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+		return fmt.Errorf("%s returned %s: %s", url, response.Status, strings.TrimSpace(string(body)))
+	}
+	id := response.Header.Get(CallIDHeader)
+	data, err := io.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		if err := answerCall(client, url, id, header, server, data); err != nil {
+			log.Printf("Failed to answer call %s: %v", id, err)
+		}
+	}()
+	return nil
+}
+
+// answerCall serves a polled call and POSTs its reply
+func answerCall(client *http.Client, url, id string, header http.Header, server *rpc.Server, data []byte) error {
+	answer, err := Serve(server, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequest("POST", url, bytes.NewReader(answer))
+	if err != nil {
+		return err
+	}
+	for name, values := range header {
+		request.Header[name] = values
+	}
+	request.Header.Set("Content-Type", ContentType)
+	request.Header.Set(CallIDHeader, id)
+
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("%s returned %s", url, response.Status)
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package httprpc
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/rpc"
+	"strings"
+	"testing"
+	"time"
+)
+
+type Args struct {
+	A, B int
+}
+
+type Arith struct{}
+
+func (Arith) Add(args Args, reply *int) error {
+	*reply = args.A + args.B
+	return nil
+}
+
+func (Arith) Fail(args Args, reply *int) error {
+	return errors.New("worker not found")
+}
+
+func newServer(t *testing.T) *rpc.Server {
+	server := rpc.NewServer()
+	if err := server.RegisterName("Arith", Arith{}); err != nil {
+		t.Fatal(err)
+	}
+	return server
+}
+
+func TestDial(t *testing.T) {
+	httpServer := httptest.NewServer(Handler(newServer(t)))
+	defer httpServer.Close()
+
+	client := Dial(httpServer.URL, nil, nil)
+	defer client.Close()
+
+	var sum int
+	if err := client.Call("Arith.Add", Args{2, 3}, &sum); err != nil || sum != 5 {
+		t.Fatalf("Expected 5, got %d: %v", sum, err)
+	}
+
+	// Errors of the service are server errors, as over TCP
+	err := client.Call("Arith.Fail", Args{}, &sum)
+	if _, ok := err.(rpc.ServerError); !ok || err.Error() != "worker not found" {
+		t.Errorf("Expected the server error, got %#v", err)
+	}
+	if err := client.Call("Arith.Missing", Args{}, &sum); err == nil {
+		t.Error("Expected an unknown method to fail")
+	}
+
+	// Concurrent calls are answered independently
+	calls := make([]*rpc.Call, 10)
+	for i := range calls {
+		calls[i] = client.Go("Arith.Add", Args{i, i}, new(int), nil)
+	}
+	for i, call := range calls {
+		<-call.Done
+		if call.Error != nil || *call.Reply.(*int) != 2*i {
+			t.Errorf("Call %d: unexpected %d: %v", i, *call.Reply.(*int), call.Error)
+		}
+	}
+
+	// Rejected requests fail their call only
+	rejecting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Missing authorization header", http.StatusUnauthorized)
+	}))
+	defer rejecting.Close()
+	client = Dial(rejecting.URL, nil, nil)
+	defer client.Close()
+	if err := client.Call("Arith.Add", Args{1, 1}, &sum); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("Expected the rejected request to fail, got %v", err)
+	}
+}
+
+func TestMailbox(t *testing.T) {
+	mailbox := NewMailbox()
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /calls", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-API-Key") != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		mailbox.ServeNext(w, r, 100*time.Millisecond)
+	})
+	mux.HandleFunc("POST /calls", mailbox.ServeReply)
+	httpServer := httptest.NewServer(mux)
+	defer httpServer.Close()
+
+	if !mailbox.Polling(time.Second) || mailbox.Polling(-time.Second) {
+		t.Error("Expected a new mailbox to count as polled when it was created")
+	}
+
+	// Polls without a queued call time out
+	server := newServer(t)
+	header := http.Header{"X-Api-Key": {"secret"}}
+	if err := Poll(http.DefaultClient, httpServer.URL+"/calls", header, server); err != nil {
+		t.Fatalf("Expected an empty poll, got %v", err)
+	}
+	if !mailbox.Polling(time.Second) {
+		t.Error("Expected the mailbox to be polled")
+	}
+	if err := Poll(http.DefaultClient, httpServer.URL+"/calls", nil, server); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("Expected the unauthorized poll to fail, got %v", err)
+	}
+
+	client := mailbox.Client()
+	defer client.Close()
+	add := client.Go("Arith.Add", Args{20, 22}, new(int), nil)
+	fail := client.Go("Arith.Fail", Args{}, new(int), nil)
+	for range 2 {
+		if err := Poll(http.DefaultClient, httpServer.URL+"/calls", header, server); err != nil {
+			t.Fatalf("Poll failed: %v", err)
+		}
+	}
+	<-add.Done
+	if add.Error != nil || *add.Reply.(*int) != 42 {
+		t.Errorf("Expected 42, got %d: %v", *add.Reply.(*int), add.Error)
+	}
+	<-fail.Done
+	if _, ok := fail.Error.(rpc.ServerError); !ok {
+		t.Errorf("Expected the server error, got %#v", fail.Error)
+	}
+
+	// Closing a client drops its calls that were not polled yet
+	closed := mailbox.Client()
+	call := closed.Go("Arith.Add", Args{1, 1}, new(int), nil)
+	closed.Close()
+	<-call.Done
+	if call.Error == nil {
+		t.Error("Expected the call of the closed client to fail")
+	}
+	if len(mailbox.queue) != 0 || len(mailbox.pending) != 0 {
+		t.Errorf("Expected the dropped call to be forgotten, got %v %v", mailbox.queue, mailbox.pending)
+	}
+	if err := mailbox.Deliver(1, nil); !errors.Is(err, ErrUnknownCall) {
+		t.Errorf("Expected the answered call to be unknown, got %v", err)
+	}
+}
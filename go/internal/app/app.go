@@ -0,0 +1,162 @@
+// Package app runs the binaries of the build system the same way: Run
+// initializes a service, registers its metrics and starts it, then stops it
+// gracefully on SIGINT or SIGTERM, when one of its servers fails, or when
+// the service asks to stop, such as a worker whose instance is preempted.
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ShutdownTimeout is the deadline of the context services are stopped with
+const ShutdownTimeout = 30 * time.Second
+
+// Service is a binary run by Run
+type Service interface {
+	// Name identifies the service in logs
+	Name() string
+	// Init loads the configuration of the service and opens its stores
+	Init(ctx context.Context) error
+	// Start starts the servers and background work of the service and
+	// returns. Servers are run with Go, so that their failure stops the
+	// service. A service that fails to start is not stopped.
+	Start(ctx context.Context) error
+	// Stop shuts the service down gracefully, by the deadline of ctx where
+	// it can. cause is why it stops: an Interrupted, a Stopped, the error
+	// of a server that failed, or that of the context Run was called with.
+	Stop(ctx context.Context, cause error) error
+}
+
+// MetricsService is a service exporting Prometheus metrics, which Run
+// registers once the service is initialized
+type MetricsService interface {
+	Service
+	Collectors() []prometheus.Collector
+}
+
+// Interrupted is the cause of a service stopped by a signal
+type Interrupted struct {
+	Signal os.Signal
+}
+
+func (i Interrupted) Error() string {
+	return "received " + i.Signal.String()
+}
+
+// Stopped is the cause of a service that asked to stop with Stop
+type Stopped struct {
+	Reason string
+}
+
+func (s Stopped) Error() string {
+	return "stopped: " + s.Reason
+}
+
+// stopKey is the context key of the function stopping a running service
+type stopKey struct{}
+
+// Go runs a server of the service started with ctx in a goroutine. The
+// service stops if it fails; http.ErrServerClosed is not a failure.
+func Go(ctx context.Context, serve func() error) {
+	go func() {
+		if err := serve(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			stop(ctx, err)
+		}
+	}()
+}
+
+// Stop asks the service started with ctx to stop for a reason
+func Stop(ctx context.Context, reason string) {
+	stop(ctx, Stopped{Reason: reason})
+}
+
+// stop ends the context of a running service with a cause. The first cause
+// is kept.
+func stop(ctx context.Context, cause error) {
+	if cancel, ok := ctx.Value(stopKey{}).(context.CancelCauseFunc); ok {
+		cancel(cause)
+	}
+}
+
+// Run initializes and starts a service, and stops it when ctx is done, the
+// process is interrupted, a server fails or the service asks to stop. It
+// returns once the service stopped, with the error of a server that failed.
+func Run(ctx context.Context, service Service) error {
+	name := service.Name()
+	if err := service.Init(ctx); err != nil {
+		return err
+	}
+	if metrics, ok := service.(MetricsService); ok {
+		for _, collector := range metrics.Collectors() {
+			if err := prometheus.Register(collector); err != nil {
+				return fmt.Errorf("failed to register metrics: %v", err)
+			}
+		}
+	}
+
+	running, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	running = context.WithValue(running, stopKey{}, cancel)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	go func() {
+		select {
+		case sig := <-signals:
+			cancel(Interrupted{Signal: sig})
+		case <-running.Done():
+		}
+	}()
+
+	if err := service.Start(running); err != nil {
+		return err
+	}
+	log.Printf("%s started", name)
+
+	<-running.Done()
+	cause := context.Cause(running)
+	log.Printf("Stopping %s: %v", name, cause)
+	stopping, cancelStop := context.WithTimeout(context.WithoutCancel(running), ShutdownTimeout)
+	defer cancelStop()
+	stopErr := service.Stop(stopping, cause)
+	log.Printf("%s stopped", name)
+
+	var interrupted Interrupted
+	var stopped Stopped
+	switch {
+	case errors.As(cause, &interrupted), errors.As(cause, &stopped), ctx.Err() != nil:
+		if stopErr != nil {
+			return fmt.Errorf("failed to stop: %v", stopErr)
+		}
+		return nil
+	default:
+		return cause
+	}
+}
+
+// Main runs a service until it stops, exiting if it fails
+func Main(service Service) {
+	if err := Run(context.Background(), service); err != nil {
+		log.Fatalf("%s failed: %v", service.Name(), err)
+	}
+}
+
+// ConfigFile returns the configuration file named by the first argument,
+// or defaultFile without arguments
+func ConfigFile(defaultFile string) string {
+	if len(os.Args) > 1 {
+		return os.Args[1]
+	}
+	return defaultFile
+}
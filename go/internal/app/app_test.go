@@ -0,0 +1,113 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// fakeService records its lifecycle, running start once started
+type fakeService struct {
+	initErr    error
+	start      func(ctx context.Context)
+	collectors []prometheus.Collector
+	calls      []string
+	cause      error
+}
+
+func (s *fakeService) Name() string {
+	return "fake"
+}
+
+func (s *fakeService) Init(ctx context.Context) error {
+	s.calls = append(s.calls, "init")
+	return s.initErr
+}
+
+func (s *fakeService) Start(ctx context.Context) error {
+	s.calls = append(s.calls, "start")
+	if s.start != nil {
+		s.start(ctx)
+	}
+	return nil
+}
+
+func (s *fakeService) Stop(ctx context.Context, cause error) error {
+	s.calls = append(s.calls, "stop")
+	s.cause = cause
+	if _, hasDeadline := ctx.Deadline(); !hasDeadline || ctx.Err() != nil {
+		return fmt.Errorf("expected a live context with a deadline")
+	}
+	return nil
+}
+
+func (s *fakeService) Collectors() []prometheus.Collector {
+	return s.collectors
+}
+
+func TestRun(t *testing.T) {
+	counter := prometheus.NewCounter(prometheus.CounterOpts{Name: "app_test_runs_total", Help: "Test runs"})
+	failure := errors.New("listen tcp :8080: address already in use")
+
+	tests := map[string]struct {
+		start func(ctx context.Context)
+		check func(cause, err error) bool
+	}{
+		"interrupted": {
+			start: func(ctx context.Context) { syscall.Kill(syscall.Getpid(), syscall.SIGTERM) },
+			check: func(cause, err error) bool {
+				var interrupted Interrupted
+				return errors.As(cause, &interrupted) && interrupted.Signal == syscall.SIGTERM && err == nil
+			},
+		},
+		"server failed": {
+			start: func(ctx context.Context) { Go(ctx, func() error { return failure }) },
+			check: func(cause, err error) bool { return cause == failure && err == failure },
+		},
+		"stopped": {
+			start: func(ctx context.Context) { Stop(ctx, "preempted") },
+			check: func(cause, err error) bool { return cause == Stopped{Reason: "preempted"} && err == nil },
+		},
+	}
+	for name, test := range tests {
+		service := &fakeService{start: test.start}
+		if name == "interrupted" {
+			service.collectors = []prometheus.Collector{counter}
+		}
+		done := make(chan error, 1)
+		go func() { done <- Run(context.Background(), service) }()
+
+		select {
+		case err := <-done:
+			if !test.check(service.cause, err) || fmt.Sprint(service.calls) != "[init start stop]" {
+				t.Errorf("%s: unexpected stop for %v returning %v after %v", name, service.cause, err, service.calls)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: service did not stop", name)
+		}
+	}
+
+	// Collectors are registered with the default registry
+	if err := prometheus.Register(counter); !errors.As(err, &prometheus.AlreadyRegisteredError{}) {
+		t.Errorf("Expected the collector to be registered, got %v", err)
+	}
+	defer prometheus.Unregister(counter)
+
+	// Cancelling the context stops the service
+	ctx, cancel := context.WithCancel(context.Background())
+	service := &fakeService{start: func(context.Context) { cancel() }}
+	if err := Run(ctx, service); err != nil || !errors.Is(service.cause, context.Canceled) {
+		t.Errorf("Expected the service to stop with its context, got %v, %v", service.cause, err)
+	}
+
+	// Services failing to initialize are not started
+	service = &fakeService{initErr: errors.New("invalid configuration")}
+	if err := Run(context.Background(), service); err != service.initErr || fmt.Sprint(service.calls) != "[init]" {
+		t.Errorf("Expected the initialization to fail, got %v after %v", err, service.calls)
+	}
+}
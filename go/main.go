@@ -18,8 +18,15 @@ import (
 	"syscall"
 	"time"
 
+	"distributed-gradle-building/audit"
+	"distributed-gradle-building/auth"
+	"distributed-gradle-building/gradledist"
+	"distributed-gradle-building/middleware"
 	"distributed-gradle-building/ml/service"
+	"distributed-gradle-building/provenance"
+	"distributed-gradle-building/provisioner"
 	"distributed-gradle-building/types"
+	"distributed-gradle-building/validation"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	_ "net/http/pprof"
@@ -42,13 +49,29 @@ type BuildCoordinator struct {
 	WorkerPool   *WorkerPool
 	BuildQueue   chan types.BuildRequest
 	ActiveBuilds map[string]chan types.BuildResponse
-	MLService    *service.MLService
-	mutex        sync.RWMutex
-	httpServer   *http.Server
-	rpcServer    *rpc.Server
-	listener     net.Listener
-	shutdown     chan struct{}
-	startTime    time.Time
+	// PendingBuilds holds submitted builds not yet picked up, in submission order
+	PendingBuilds []types.BuildRequest
+	// WorkerTelemetry holds the latest heartbeat of each worker
+	WorkerTelemetry map[string]HeartbeatArgs
+	MLService       *service.MLService
+	auditLog        *audit.Log
+	gradle          *gradledist.Provisioner
+	buildPolicy     validation.BuildPolicy
+	mutex           sync.RWMutex
+	httpServer      *http.Server
+	rpcServer       *rpc.Server
+	listener        net.Listener
+	shutdown        chan struct{}
+	startTime       time.Time
+	// Prewarm configures provisioning ahead of learned busy windows; the pool
+	// is not scaled below prewarmFloor while such a window is upcoming
+	Prewarm      PrewarmConfig
+	prewarmFloor int
+	// predictions caches the ML insights of recently scheduled builds
+	predictions *predictionCache
+	// fleet launches and terminates cloud instances when scaling; without
+	// it scaling decisions are only logged
+	fleet *provisioner.Fleet
 }
 
 // Prometheus metrics for coordinator
@@ -95,13 +118,27 @@ func NewWorkerPool(maxWorkers int) *WorkerPool {
 
 // NewBuildCoordinator creates a new build coordinator
 func NewBuildCoordinator(maxWorkers int) *BuildCoordinator {
+	// The audit log is persisted by main; tests keep it in memory
+	auditLog, _ := audit.Open("")
+
+	buildPolicy, err := validation.BuildPolicyFromEnv()
+	if err != nil {
+		log.Printf("Invalid build policy, using defaults: %v", err)
+	}
+
 	coordinator := &BuildCoordinator{
-		WorkerPool:   NewWorkerPool(maxWorkers),
-		BuildQueue:   make(chan types.BuildRequest, 100),
-		ActiveBuilds: make(map[string]chan types.BuildResponse),
-		MLService:    service.NewMLService(),
-		shutdown:     make(chan struct{}),
-		startTime:    time.Now(),
+		WorkerPool:      NewWorkerPool(maxWorkers),
+		BuildQueue:      make(chan types.BuildRequest, 100),
+		ActiveBuilds:    make(map[string]chan types.BuildResponse),
+		WorkerTelemetry: make(map[string]HeartbeatArgs),
+		Prewarm:         loadPrewarmConfig(maxWorkers),
+		MLService:       service.NewMLService(),
+		predictions:     newPredictionCache(predictionCacheTTLFromEnv()),
+		auditLog:        auditLog,
+		gradle:          gradledist.NewProvisionerFromEnv(),
+		buildPolicy:     buildPolicy,
+		shutdown:        make(chan struct{}),
+		startTime:       time.Now(),
 	}
 
 	// Initialize RPC server
@@ -182,12 +219,52 @@ func (wp *WorkerPool) UpdateWorkerStatus(workerID string, status string) error {
 	return nil
 }
 
+// Heartbeat records a worker heartbeat and its resource telemetry (RPC method)
+func (bc *BuildCoordinator) Heartbeat(args *HeartbeatArgs, reply *HeartbeatReply) error {
+	bc.WorkerPool.WorkerPool.Mutex.Lock()
+	worker, exists := bc.WorkerPool.WorkerPool.Workers[args.ID]
+	if exists {
+		worker.Status = args.Status
+		worker.LastCheckin = time.Now()
+		worker.Resources.CPUPercent = args.CPUUsage
+	}
+	bc.WorkerPool.WorkerPool.Mutex.Unlock()
+
+	if !exists {
+		return fmt.Errorf("worker %s not found", args.ID)
+	}
+
+	telemetry := *args
+	telemetry.Timestamp = time.Now()
+
+	bc.mutex.Lock()
+	bc.WorkerTelemetry[args.ID] = telemetry
+	bc.mutex.Unlock()
+
+	reply.Message = fmt.Sprintf("Heartbeat received from worker %s", args.ID)
+	return nil
+}
+
+// workerCPULoad returns a worker's reported CPU usage, falling back to an
+// estimate from its busy/idle status when no recent telemetry exists
+func (bc *BuildCoordinator) workerCPULoad(worker *types.Worker, telemetry map[string]HeartbeatArgs) float64 {
+	if heartbeat, exists := telemetry[worker.ID]; exists && time.Since(heartbeat.Timestamp) < 2*time.Minute {
+		return heartbeat.CPUUsage
+	}
+
+	if worker.Status == "busy" {
+		return 0.8 // Assume busy workers are at 80% CPU
+	}
+	return 0.2 // Assume idle workers are at 20% CPU
+}
+
 // SubmitBuild submits a build request to the coordinator
 func (bc *BuildCoordinator) SubmitBuild(request types.BuildRequest) (string, error) {
 	responseChan := make(chan types.BuildResponse)
 
 	bc.mutex.Lock()
 	bc.ActiveBuilds[request.RequestID] = responseChan
+	bc.PendingBuilds = append(bc.PendingBuilds, request)
 	activeBuilds.Set(float64(len(bc.ActiveBuilds)))
 	bc.mutex.Unlock()
 
@@ -197,6 +274,39 @@ func (bc *BuildCoordinator) SubmitBuild(request types.BuildRequest) (string, err
 	return request.RequestID, nil
 }
 
+// EstimateQueueWait predicts how long a new build waits behind the pending builds
+func (bc *BuildCoordinator) EstimateQueueWait() time.Duration {
+	bc.mutex.RLock()
+	queued := make([]service.PredictionRequest, 0, len(bc.PendingBuilds))
+	for _, pending := range bc.PendingBuilds {
+		queued = append(queued, service.PredictionRequest{
+			ProjectPath:  pending.ProjectPath,
+			TaskName:     pending.TaskName,
+			BuildOptions: pending.BuildOptions,
+		})
+	}
+	bc.mutex.RUnlock()
+
+	bc.WorkerPool.WorkerPool.Mutex.RLock()
+	workerCount := len(bc.WorkerPool.WorkerPool.Workers)
+	bc.WorkerPool.WorkerPool.Mutex.RUnlock()
+
+	return bc.MLService.EstimateQueueWait(queued, workerCount)
+}
+
+// removePendingBuild drops a build from the pending list once it starts
+func (bc *BuildCoordinator) removePendingBuild(requestID string) {
+	bc.mutex.Lock()
+	defer bc.mutex.Unlock()
+
+	for i, pending := range bc.PendingBuilds {
+		if pending.RequestID == requestID {
+			bc.PendingBuilds = append(bc.PendingBuilds[:i], bc.PendingBuilds[i+1:]...)
+			return
+		}
+	}
+}
+
 // calculateCacheMetrics calculates cache hit rate for a project
 func (bc *BuildCoordinator) calculateCacheMetrics(projectPath string) (hits, total int) {
 	// In a real implementation, this would analyze cache usage
@@ -254,7 +364,7 @@ func (bc *BuildCoordinator) countCompiledFiles(projectPath string) int {
 // ProcessBuild processes a build request
 func (bc *BuildCoordinator) ProcessBuild(request types.BuildRequest) types.BuildResponse {
 	// Get ML predictions for failure risk assessment
-	predictions := bc.MLService.GetBuildInsights(request.ProjectPath, request.TaskName, request.BuildOptions)
+	predictions := bc.buildInsights(request)
 
 	// Handle high-risk builds with mitigation strategies
 	if predictions.FailureRisk > 0.7 {
@@ -294,8 +404,21 @@ func (bc *BuildCoordinator) ProcessBuild(request types.BuildRequest) types.Build
 
 	startTime := time.Now()
 
+	// Resolve the wrapper or requested Gradle version before running anything
+	executable, err := bc.gradle.Executable(request.ProjectPath, request.GradleVersion)
+	if err != nil {
+		buildRequestsTotal.WithLabelValues("failed").Inc()
+		return types.BuildResponse{
+			Success:      false,
+			WorkerID:     worker.ID,
+			ErrorMessage: err.Error(),
+			RequestID:    request.RequestID,
+			Timestamp:    time.Now(),
+		}
+	}
+
 	// Execute build command
-	cmd := exec.Command("gradle", request.TaskName)
+	cmd := exec.Command(executable, request.TaskName)
 	cmd.Dir = request.ProjectPath
 
 	if request.CacheEnabled {
@@ -328,13 +451,16 @@ func (bc *BuildCoordinator) ProcessBuild(request types.BuildRequest) types.Build
 	buildRequestsTotal.WithLabelValues("successful").Inc()
 	buildDuration.WithLabelValues("successful").Observe(duration.Seconds())
 
+	artifacts := bc.findArtifacts(request.ProjectPath)
+
 	return types.BuildResponse{
-		Success:       true,
-		WorkerID:      worker.ID,
-		BuildDuration: duration,
-		Artifacts:     bc.findArtifacts(request.ProjectPath),
-		RequestID:     request.RequestID,
-		Timestamp:     time.Now(),
+		Success:         true,
+		WorkerID:        worker.ID,
+		BuildDuration:   duration,
+		Artifacts:       artifacts,
+		ArtifactDetails: bc.describeArtifacts(request, executable, worker.ID, artifacts),
+		RequestID:       request.RequestID,
+		Timestamp:       time.Now(),
 		Metrics: types.BuildMetrics{
 			CacheHitRate:  float64(cacheHits) / float64(totalRequests),
 			CompiledFiles: compiledFiles,
@@ -366,8 +492,20 @@ func (bc *BuildCoordinator) processHighRiskBuild(request types.BuildRequest, pre
 	// Strategy 2: Enhanced monitoring and logging
 	log.Printf("Starting high-risk build %s on reliable worker %s", request.RequestID, worker.ID)
 
+	executable, err := bc.gradle.Executable(request.ProjectPath, request.GradleVersion)
+	if err != nil {
+		buildRequestsTotal.WithLabelValues("failed").Inc()
+		return types.BuildResponse{
+			Success:      false,
+			WorkerID:     worker.ID,
+			ErrorMessage: err.Error(),
+			RequestID:    request.RequestID,
+			Timestamp:    time.Now(),
+		}
+	}
+
 	// Execute build with enhanced error handling
-	cmd := exec.Command("gradle", request.TaskName)
+	cmd := exec.Command(executable, request.TaskName)
 	cmd.Dir = request.ProjectPath
 	cmd.Env = append(os.Environ(),
 		"GRADLE_OPTS=-Xmx2g -XX:+HeapDumpOnOutOfMemoryError",            // More memory for stability
@@ -410,13 +548,16 @@ func (bc *BuildCoordinator) processHighRiskBuild(request types.BuildRequest, pre
 
 	log.Printf("High-risk build %s completed successfully on reliable worker %s", request.RequestID, worker.ID)
 
+	artifacts := bc.findArtifacts(request.ProjectPath)
+
 	return types.BuildResponse{
-		Success:       true,
-		WorkerID:      worker.ID,
-		BuildDuration: duration,
-		Artifacts:     bc.findArtifacts(request.ProjectPath),
-		RequestID:     request.RequestID,
-		Timestamp:     time.Now(),
+		Success:         true,
+		WorkerID:        worker.ID,
+		BuildDuration:   duration,
+		Artifacts:       artifacts,
+		ArtifactDetails: bc.describeArtifacts(request, executable, worker.ID, artifacts),
+		RequestID:       request.RequestID,
+		Timestamp:       time.Now(),
 		Metrics: types.BuildMetrics{
 			CacheHitRate:  float64(cacheHits) / float64(totalRequests),
 			CompiledFiles: compiledFiles,
@@ -510,7 +651,7 @@ func (bc *BuildCoordinator) selectBestWorkerForBuild(request types.BuildRequest)
 	defer bc.WorkerPool.WorkerPool.Mutex.RUnlock()
 
 	// Get ML predictions for this build
-	predictions := bc.MLService.GetBuildInsights(request.ProjectPath, request.TaskName, request.BuildOptions)
+	predictions := bc.buildInsights(request)
 
 	var bestWorker *types.Worker
 	var bestScore float64 = -1
@@ -598,6 +739,10 @@ func (bc *BuildCoordinator) checkAndPerformScaling() {
 	bc.mutex.RLock()
 	queueLength := len(bc.BuildQueue)
 	activeBuilds := len(bc.ActiveBuilds)
+	telemetry := make(map[string]HeartbeatArgs, len(bc.WorkerTelemetry))
+	for id, heartbeat := range bc.WorkerTelemetry {
+		telemetry[id] = heartbeat
+	}
 	bc.mutex.RUnlock()
 
 	bc.WorkerPool.WorkerPool.Mutex.RLock()
@@ -610,13 +755,7 @@ func (bc *BuildCoordinator) checkAndPerformScaling() {
 		if worker.Status == "busy" {
 			busyWorkers++
 		}
-		// In a real implementation, you'd collect actual CPU metrics
-		// For now, estimate based on busy/idle status
-		if worker.Status == "busy" {
-			avgCPULoad += 0.8 // Assume busy workers are at 80% CPU
-		} else {
-			avgCPULoad += 0.2 // Assume idle workers are at 20% CPU
-		}
+		avgCPULoad += bc.workerCPULoad(worker, telemetry)
 		workerCount++
 	}
 
@@ -637,48 +776,80 @@ func (bc *BuildCoordinator) checkAndPerformScaling() {
 	case "scale_up":
 		bc.performScaleUp(scalingAdvice.WorkersNeeded - currentWorkers)
 	case "scale_down":
-		bc.performScaleDown(currentWorkers - scalingAdvice.WorkersNeeded)
+		// Never scale below the workers pre-warmed for an upcoming busy window
+		bc.mutex.RLock()
+		floor := bc.prewarmFloor
+		bc.mutex.RUnlock()
+
+		workersNeeded := scalingAdvice.WorkersNeeded
+		if workersNeeded < floor {
+			workersNeeded = floor
+		}
+		bc.performScaleDown(currentWorkers - workersNeeded)
 	case "maintain":
 		// Do nothing
 	}
 }
 
-// performScaleUp adds new workers to the pool
+// performScaleUp adds new workers to the pool. Instances launched earlier
+// whose workers have not registered yet count towards the new workers.
 func (bc *BuildCoordinator) performScaleUp(workersToAdd int) {
 	if workersToAdd <= 0 {
 		return
 	}
+	if bc.fleet == nil {
+		log.Printf("Scaling up: %d workers needed, but no provisioner is configured", workersToAdd)
+		return
+	}
 
-	log.Printf("Scaling up: adding %d workers", workersToAdd)
+	bc.WorkerPool.WorkerPool.Mutex.RLock()
+	pending := bc.fleet.Pending(func(workerID string) bool {
+		_, registered := bc.WorkerPool.WorkerPool.Workers[workerID]
+		return registered
+	})
+	bc.WorkerPool.WorkerPool.Mutex.RUnlock()
 
-	// In a real implementation, this would provision new worker instances
-	// For now, we'll just log the scaling action
-	for i := 0; i < workersToAdd; i++ {
-		workerID := fmt.Sprintf("auto-scaled-worker-%d-%d", time.Now().Unix(), i)
-		log.Printf("Would provision new worker: %s", workerID)
-		// TODO: Implement actual worker provisioning logic
+	if workersToAdd -= pending; workersToAdd <= 0 {
+		return
+	}
+
+	log.Printf("Scaling up: adding %d workers", workersToAdd)
+	launched, err := bc.fleet.Launch(workersToAdd)
+	if err != nil {
+		log.Printf("Scaling up: %v", err)
+	}
+	if len(launched) < workersToAdd && err == nil {
+		log.Printf("Scaling up: launched %d of %d workers, the provisioner's instance or budget limit is reached", len(launched), workersToAdd)
 	}
 }
 
-// performScaleDown removes workers from the pool
+// performScaleDown removes idle workers from the pool and terminates their
+// instances. Only workers launched by the provisioner are removed.
 func (bc *BuildCoordinator) performScaleDown(workersToRemove int) {
-	if workersToRemove <= 0 {
+	if workersToRemove <= 0 || bc.fleet == nil {
 		return
 	}
 
-	log.Printf("Scaling down: removing %d workers", workersToRemove)
+	bc.WorkerPool.WorkerPool.Mutex.RLock()
+	var idle []string
+	for workerID, worker := range bc.WorkerPool.WorkerPool.Workers {
+		if worker.Status == "idle" && bc.fleet.Manages(workerID) && len(idle) < workersToRemove {
+			idle = append(idle, workerID)
+		}
+	}
+	bc.WorkerPool.WorkerPool.Mutex.RUnlock()
 
-	// In a real implementation, this would gracefully shut down workers
-	// For now, we'll just log the scaling action
-	bc.WorkerPool.WorkerPool.Mutex.Lock()
-	defer bc.WorkerPool.WorkerPool.Mutex.Unlock()
+	if len(idle) == 0 {
+		return
+	}
 
-	removed := 0
-	for workerID, worker := range bc.WorkerPool.WorkerPool.Workers {
-		if worker.Status == "idle" && removed < workersToRemove {
-			log.Printf("Would shut down idle worker: %s", workerID)
-			// TODO: Implement actual worker shutdown logic
-			removed++
+	log.Printf("Scaling down: removing %d workers", len(idle))
+	for _, workerID := range idle {
+		// Remove the worker first so no build is dispatched to it while its
+		// instance shuts down
+		bc.WorkerPool.RemoveWorker(workerID)
+		if _, err := bc.fleet.Terminate(workerID); err != nil {
+			log.Printf("Scaling down: %v", err)
 		}
 	}
 }
@@ -707,26 +878,52 @@ func (bc *BuildCoordinator) findArtifacts(projectPath string) []string {
 	return artifacts
 }
 
+// describeArtifacts checksums the artifacts of a build and records the
+// toolchain that produced them. Artifacts are still returned by path if they
+// cannot be described.
+func (bc *BuildCoordinator) describeArtifacts(request types.BuildRequest, executable, workerID string, artifacts []string) []types.Artifact {
+	details, err := provenance.DescribeArtifacts(artifacts, workerID, provenance.DetectToolchain(executable, request.ProjectPath))
+	if err != nil {
+		log.Printf("Failed to describe artifacts of build %s: %v", request.RequestID, err)
+		return nil
+	}
+	return details
+}
+
 // StartHTTPServer starts the HTTP API server
 func (bc *BuildCoordinator) StartHTTPServer(port int) error {
-	mux := http.NewServeMux()
-
-	// API endpoints
-	mux.HandleFunc("/api/build", bc.handleBuildRequest)
-	mux.HandleFunc("/api/workers", bc.handleWorkersRequest)
-	mux.HandleFunc("/api/status", bc.handleStatusRequest)
-	mux.HandleFunc("/health", bc.handleHealthCheck)
-	mux.Handle("/metrics", promhttp.Handler())
-
 	bc.httpServer = &http.Server{
 		Addr:    fmt.Sprintf(":%d", port),
-		Handler: mux,
+		Handler: bc.routes(auth.NewAuthServiceFromEnv()),
 	}
 
 	log.Printf("Starting HTTP server on port %d", port)
 	return bc.httpServer.ListenAndServe()
 }
 
+// routes registers the HTTP API and wraps it with the middleware stack.
+// A nil auth service leaves the API unauthenticated.
+func (bc *BuildCoordinator) routes(authService *auth.AuthService) http.Handler {
+	mux := http.NewServeMux()
+
+	// API endpoints
+	mux.HandleFunc("POST /api/build", bc.handleBuildRequest)
+	mux.HandleFunc("GET /api/workers", bc.handleWorkersRequest)
+	mux.HandleFunc("GET /api/status", bc.handleStatusRequest)
+	mux.HandleFunc("GET /api/audit", bc.auditLog.Handler())
+	mux.HandleFunc("GET /health", bc.handleHealthCheck)
+	mux.Handle("GET /metrics", promhttp.Handler())
+	mux.HandleFunc("GET /api/openapi.json", coordinatorOpenAPI().Handler())
+
+	return middleware.Chain(mux,
+		middleware.RequestID,
+		middleware.Logging,
+		middleware.Recovery,
+		middleware.Metrics(coordinatorHTTPRequestsTotal, mux),
+		middleware.Auth(authService, "/health", "/metrics"),
+	)
+}
+
 // StartRPCServer starts the RPC server
 func (bc *BuildCoordinator) StartRPCServer(port int) error {
 	var err error
@@ -738,6 +935,7 @@ func (bc *BuildCoordinator) StartRPCServer(port int) error {
 	log.Printf("Starting RPC server on port %d", port)
 	go bc.processBuildQueue()
 	go bc.startAutoScaling() // Start auto-scaling monitoring
+	go bc.startPrewarming()  // Start predictive pre-warming
 	go bc.rpcServer.Accept(bc.listener)
 
 	return nil
@@ -777,6 +975,7 @@ func (bc *BuildCoordinator) processBuildQueue() {
 // processBuildWithPriority processes a build with priority logging
 func (bc *BuildCoordinator) processBuildWithPriority(request types.BuildRequest, priority float64) {
 	log.Printf("Processing build %s with priority %.2f", request.RequestID, priority)
+	bc.removePendingBuild(request.RequestID)
 	response := bc.ProcessBuild(request)
 
 	bc.mutex.Lock()
@@ -790,7 +989,7 @@ func (bc *BuildCoordinator) processBuildWithPriority(request types.BuildRequest,
 
 // calculateBuildPriority calculates a priority score for a build based on ML predictions
 func (bc *BuildCoordinator) calculateBuildPriority(request types.BuildRequest) float64 {
-	predictions := bc.MLService.GetBuildInsights(request.ProjectPath, request.TaskName, request.BuildOptions)
+	predictions := bc.buildInsights(request)
 
 	score := 5.0 // Base priority
 
@@ -813,13 +1012,34 @@ func (bc *BuildCoordinator) calculateBuildPriority(request types.BuildRequest) f
 	return math.Max(0.0, math.Min(10.0, score)) // Clamp between 0-10
 }
 
+// SubmitBuildResponse is returned when a build request is accepted
+type SubmitBuildResponse struct {
+	BuildID            string        `json:"build_id"`
+	Status             string        `json:"status"`
+	EstimatedQueueWait time.Duration `json:"estimated_queue_wait"`
+}
+
+// SystemStatus summarizes the coordinator's workers and queue
+type SystemStatus struct {
+	Timestamp    time.Time `json:"timestamp"`
+	WorkerCount  int       `json:"worker_count"`
+	QueueLength  int       `json:"queue_length"`
+	ActiveBuilds int       `json:"active_builds"`
+}
+
+// HealthStatus is the coordinator health check response
+type HealthStatus struct {
+	Status     string `json:"status"`
+	Service    string `json:"service"`
+	Version    string `json:"version"`
+	Timestamp  string `json:"timestamp"`
+	Workers    int    `json:"workers"`
+	BuildQueue int    `json:"build_queue"`
+	Uptime     string `json:"uptime"`
+}
+
 // HTTP Handlers
 func (bc *BuildCoordinator) handleBuildRequest(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "POST" {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
-
 	var request types.BuildRequest
 	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
@@ -831,14 +1051,41 @@ func (bc *BuildCoordinator) handleBuildRequest(w http.ResponseWriter, r *http.Re
 		request.RequestID = fmt.Sprintf("build-%d", time.Now().UnixNano())
 	}
 
+	// Reject unsafe project paths, disallowed tasks and oversized options
+	// before the build is queued
+	projectPath, err := bc.buildPolicy.ValidateBuild(request.ProjectPath, request.TaskName, request.BuildOptions)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	request.ProjectPath = projectPath
+
+	// Reject malformed versions now rather than once a worker picks the build up
+	if request.GradleVersion != "" && !gradledist.ValidVersion(request.GradleVersion) {
+		http.Error(w, fmt.Sprintf("invalid gradle version %q", request.GradleVersion), http.StatusBadRequest)
+		return
+	}
+
+	// Estimate the wait before this build joins the queue
+	queueWait := bc.EstimateQueueWait()
+
 	buildID, err := bc.SubmitBuild(request)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	bc.auditLog.RecordRequest(r, audit.ActionBuildSubmitted, buildID, map[string]string{
+		"project_path": request.ProjectPath,
+		"task_name":    request.TaskName,
+	})
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"build_id": buildID})
+	json.NewEncoder(w).Encode(SubmitBuildResponse{
+		BuildID:            buildID,
+		Status:             "queued",
+		EstimatedQueueWait: queueWait,
+	})
 }
 
 func (bc *BuildCoordinator) handleWorkersRequest(w http.ResponseWriter, r *http.Request) {
@@ -851,11 +1098,11 @@ func (bc *BuildCoordinator) handleWorkersRequest(w http.ResponseWriter, r *http.
 }
 
 func (bc *BuildCoordinator) handleStatusRequest(w http.ResponseWriter, r *http.Request) {
-	status := map[string]any{
-		"timestamp":     time.Now(),
-		"worker_count":  len(bc.WorkerPool.Workers),
-		"queue_length":  len(bc.BuildQueue),
-		"active_builds": len(bc.ActiveBuilds),
+	status := SystemStatus{
+		Timestamp:    time.Now(),
+		WorkerCount:  len(bc.WorkerPool.Workers),
+		QueueLength:  len(bc.BuildQueue),
+		ActiveBuilds: len(bc.ActiveBuilds),
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -870,14 +1117,14 @@ func (bc *BuildCoordinator) handleHealthCheck(w http.ResponseWriter, r *http.Req
 	buildQueueLength := len(bc.BuildQueue)
 	bc.mutex.RUnlock()
 
-	health := map[string]any{
-		"status":      "healthy",
-		"service":     "coordinator",
-		"version":     "1.0.0",
-		"timestamp":   time.Now().Format(time.RFC3339),
-		"workers":     workerCount,
-		"build_queue": buildQueueLength,
-		"uptime":      time.Since(bc.startTime).String(),
+	health := HealthStatus{
+		Status:     "healthy",
+		Service:    "coordinator",
+		Version:    "1.0.0",
+		Timestamp:  time.Now().Format(time.RFC3339),
+		Workers:    workerCount,
+		BuildQueue: buildQueueLength,
+		Uptime:     time.Since(bc.startTime).String(),
 	}
 
 	json.NewEncoder(w).Encode(health)
@@ -894,6 +1141,12 @@ func coordinatorMain() {
 	)
 
 	coordinator := NewBuildCoordinator(10)
+	coordinator.auditLog = audit.OpenFromEnv()
+	fleet, err := provisioner.FromEnv()
+	if err != nil {
+		log.Fatalf("Invalid provisioner configuration: %v", err)
+	}
+	coordinator.fleet = fleet
 
 	// Setup graceful shutdown
 	sigChan := make(chan os.Signal, 1)
@@ -0,0 +1,228 @@
+// Package mavenrepo publishes build artifacts to a Maven repository, such as
+// Artifactory or Nexus, in the standard repository layout. Only artifacts
+// that changed are uploaded: an artifact whose checksum the repository
+// already has at its coordinates is skipped, so unchanged modules of a
+// multi-module build are not deployed again.
+package mavenrepo
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Extensions of the artifacts that are published
+var Extensions = []string{"jar", "aar"}
+
+// coordinatePattern accepts group IDs, artifact IDs, versions and classifiers
+// without path separators
+var coordinatePattern = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.+-]*$`)
+
+// Coordinates locate an artifact in a Maven repository
+type Coordinates struct {
+	GroupID    string `json:"group_id"`
+	ArtifactID string `json:"artifact_id"`
+	Version    string `json:"version"`
+	Classifier string `json:"classifier,omitempty"`
+	Extension  string `json:"extension"`
+}
+
+// String returns the coordinates in Gradle's notation,
+// group:artifact:version[:classifier]@extension
+func (c Coordinates) String() string {
+	coordinates := c.GroupID + ":" + c.ArtifactID + ":" + c.Version
+	if c.Classifier != "" {
+		coordinates += ":" + c.Classifier
+	}
+	return coordinates + "@" + c.Extension
+}
+
+// Path returns the path of the artifact in the repository layout
+func (c Coordinates) Path() string {
+	file := c.ArtifactID + "-" + c.Version
+	if c.Classifier != "" {
+		file += "-" + c.Classifier
+	}
+	return strings.ReplaceAll(c.GroupID, ".", "/") + "/" + c.ArtifactID + "/" + c.Version + "/" + file + "." + c.Extension
+}
+
+// pom returns the coordinates of the artifact's POM
+func (c Coordinates) pom() Coordinates {
+	return Coordinates{GroupID: c.GroupID, ArtifactID: c.ArtifactID, Version: c.Version, Extension: "pom"}
+}
+
+// Validate checks a group ID and version that artifacts are published with
+func Validate(groupID, version string) error {
+	if !coordinatePattern.MatchString(groupID) {
+		return fmt.Errorf("invalid group id %q", groupID)
+	}
+	if !coordinatePattern.MatchString(version) {
+		return fmt.Errorf("invalid version %q", version)
+	}
+	return nil
+}
+
+// Parse returns the coordinates of a built file from its name, as Gradle
+// names archives: the artifact ID, then the version and classifier if set.
+// "app-1.2.0-sources.jar" of version 1.2.0 is app with the classifier
+// sources, "lib-release.aar" is lib-release. It returns false for files that
+// are not published.
+func Parse(file, groupID, version string) (Coordinates, bool) {
+	name := path.Base(file)
+	extension := strings.TrimPrefix(path.Ext(name), ".")
+	if !slices.Contains(Extensions, extension) {
+		return Coordinates{}, false
+	}
+	name = strings.TrimSuffix(name, "."+extension)
+
+	coordinates := Coordinates{GroupID: groupID, ArtifactID: name, Version: version, Extension: extension}
+	if artifactID, rest, found := strings.Cut(name, "-"+version); found && (rest == "" || strings.HasPrefix(rest, "-")) {
+		coordinates.ArtifactID = artifactID
+		coordinates.Classifier = strings.TrimPrefix(rest, "-")
+	}
+	if !coordinatePattern.MatchString(coordinates.ArtifactID) || (coordinates.Classifier != "" && !coordinatePattern.MatchString(coordinates.Classifier)) {
+		return Coordinates{}, false
+	}
+	return coordinates, true
+}
+
+// Repository is a Maven repository accepting uploads over HTTP PUT, with
+// basic authentication if Username is set
+type Repository struct {
+	URL      string
+	Username string
+	Password string
+	Client   *http.Client
+}
+
+// URLOf returns the URL of an artifact in the repository
+func (r *Repository) URLOf(coordinates Coordinates) string {
+	return strings.TrimRight(r.URL, "/") + "/" + coordinates.Path()
+}
+
+// Publish uploads an artifact with its checksums, and a minimal POM for
+// artifacts without a classifier. It returns false without uploading if the
+// repository has the artifact already.
+func (r *Repository) Publish(coordinates Coordinates, data []byte) (bool, error) {
+	unchanged, err := r.has(coordinates, data)
+	if err != nil {
+		return false, err
+	}
+	if unchanged {
+		return false, nil
+	}
+
+	if err := r.upload(coordinates, data); err != nil {
+		return false, err
+	}
+	if coordinates.Classifier == "" {
+		if err := r.upload(coordinates.pom(), pom(coordinates)); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// has reports whether the repository serves the SHA-1 checksum of data for
+// the artifact
+func (r *Repository) has(coordinates Coordinates, data []byte) (bool, error) {
+	response, err := r.do("GET", r.URLOf(coordinates)+".sha1", nil)
+	if err != nil {
+		return false, err
+	}
+	defer response.Body.Close()
+
+	switch response.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("maven repository returned %s for %s", response.Status, coordinates)
+	}
+	body, err := io.ReadAll(io.LimitReader(response.Body, 1024))
+	if err != nil {
+		return false, fmt.Errorf("failed to read checksum of %s: %v", coordinates, err)
+	}
+	// Some repositories follow the checksum with the file name
+	fields := strings.Fields(string(body))
+	return len(fields) > 0 && strings.EqualFold(fields[0], checksum(sha1.New(), data)), nil
+}
+
+// upload puts a file and its SHA-1, MD5 and SHA-256 checksums
+func (r *Repository) upload(coordinates Coordinates, data []byte) error {
+	url := r.URLOf(coordinates)
+	files := []struct {
+		url  string
+		data []byte
+	}{
+		{url, data},
+		{url + ".sha1", []byte(checksum(sha1.New(), data))},
+		{url + ".md5", []byte(checksum(md5.New(), data))},
+		{url + ".sha256", []byte(checksum(sha256.New(), data))},
+	}
+	for _, file := range files {
+		response, err := r.do("PUT", file.url, file.data)
+		if err != nil {
+			return err
+		}
+		response.Body.Close()
+		if response.StatusCode < 200 || response.StatusCode > 299 {
+			return fmt.Errorf("maven repository returned %s for %s", response.Status, path.Base(file.url))
+		}
+	}
+	return nil
+}
+
+// do sends an authenticated request
+func (r *Repository) do(method, url string, body []byte) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	request, err := http.NewRequest(method, url, reader)
+	if err != nil {
+		return nil, fmt.Errorf("invalid maven repository request: %v", err)
+	}
+	if r.Username != "" {
+		request.SetBasicAuth(r.Username, r.Password)
+	}
+
+	client := r.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("maven repository request failed: %v", err)
+	}
+	return response, nil
+}
+
+// pom returns a POM declaring the coordinates and packaging of an artifact,
+// without dependencies
+func pom(coordinates Coordinates) []byte {
+	return []byte(fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<project xmlns="http://maven.apache.org/POM/4.0.0" xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance" xsi:schemaLocation="http://maven.apache.org/POM/4.0.0 https://maven.apache.org/xsd/maven-4.0.0.xsd">
+  <modelVersion>4.0.0</modelVersion>
+  <groupId>%s</groupId>
+  <artifactId>%s</artifactId>
+  <version>%s</version>
+  <packaging>%s</packaging>
+</project>
+`, coordinates.GroupID, coordinates.ArtifactID, coordinates.Version, coordinates.Extension))
+}
+
+func checksum(h hash.Hash, data []byte) string {
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil))
+}
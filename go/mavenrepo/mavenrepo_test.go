@@ -0,0 +1,123 @@
+package mavenrepo
+
+import (
+	"crypto/sha1"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		file       string
+		artifactID string
+		classifier string
+		extension  string
+		ok         bool
+	}{
+		{"app/build/libs/app-1.2.0.jar", "app", "", "jar", true},
+		{"app/build/libs/app-1.2.0-sources.jar", "app", "sources", "jar", true},
+		{"lib/build/outputs/aar/lib-release.aar", "lib-release", "", "aar", true},
+		{"app/build/libs/app.jar", "app", "", "jar", true},
+		{"app/build/libs/app-1.2.0.1.jar", "app-1.2.0.1", "", "jar", true},
+		{"app/build/outputs/apk/app.apk", "", "", "", false},
+		{"app/build/reports/tests/index.html", "", "", "", false},
+	}
+	for _, tc := range tests {
+		coordinates, ok := Parse(tc.file, "com.example", "1.2.0")
+		if ok != tc.ok || coordinates.ArtifactID != tc.artifactID || coordinates.Classifier != tc.classifier || coordinates.Extension != tc.extension {
+			t.Errorf("Parse(%s): unexpected %+v, %v", tc.file, coordinates, ok)
+		}
+	}
+
+	coordinates, _ := Parse("app-1.2.0-sources.jar", "com.example.mobile", "1.2.0")
+	if path := coordinates.Path(); path != "com/example/mobile/app/1.2.0/app-1.2.0-sources.jar" {
+		t.Errorf("Unexpected path %s", path)
+	}
+	if coordinates.String() != "com.example.mobile:app:1.2.0:sources@jar" {
+		t.Errorf("Unexpected coordinates %s", coordinates)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if err := Validate("com.example", "1.2.0-SNAPSHOT"); err != nil {
+		t.Errorf("Expected valid coordinates, got %v", err)
+	}
+	for _, tc := range [][2]string{{"", "1.0"}, {"com/example", "1.0"}, {"com.example", "../1.0"}, {"com.example", ""}} {
+		if err := Validate(tc[0], tc[1]); err == nil {
+			t.Errorf("Expected %q %q to be rejected", tc[0], tc[1])
+		}
+	}
+}
+
+func TestPublish(t *testing.T) {
+	var mutex sync.Mutex
+	files := make(map[string]string)
+	var puts []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if username, password, _ := r.BasicAuth(); username != "deployer" || password != "s3cret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		switch r.Method {
+		case "PUT":
+			data, _ := io.ReadAll(r.Body)
+			files[r.URL.Path] = string(data)
+			puts = append(puts, r.URL.Path)
+			w.WriteHeader(http.StatusCreated)
+		case "GET":
+			data, exists := files[r.URL.Path]
+			if !exists {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			io.WriteString(w, data)
+		}
+	}))
+	defer server.Close()
+
+	repository := &Repository{URL: server.URL + "/libs-release/", Username: "deployer", Password: "s3cret"}
+	coordinates, _ := Parse("app-1.2.0.jar", "com.example", "1.2.0")
+	if uploaded, err := repository.Publish(coordinates, []byte("compiled classes")); err != nil || !uploaded {
+		t.Fatalf("Expected the artifact to be uploaded, got %v: %v", uploaded, err)
+	}
+	base := "/libs-release/com/example/app/1.2.0/app-1.2.0"
+	for _, path := range []string{base + ".jar", base + ".jar.sha1", base + ".jar.md5", base + ".jar.sha256", base + ".pom", base + ".pom.sha1"} {
+		if _, exists := files[path]; !exists {
+			t.Errorf("Expected %s to be uploaded", path)
+		}
+	}
+	if files[base+".jar.sha1"] != checksum(sha1.New(), []byte("compiled classes")) {
+		t.Errorf("Unexpected checksum %q", files[base+".jar.sha1"])
+	}
+	if !strings.Contains(files[base+".pom"], "<artifactId>app</artifactId>") || !strings.Contains(files[base+".pom"], "<packaging>jar</packaging>") {
+		t.Errorf("Unexpected POM %s", files[base+".pom"])
+	}
+
+	// An unchanged artifact is not uploaded again, a changed one is
+	uploads := len(puts)
+	if uploaded, err := repository.Publish(coordinates, []byte("compiled classes")); err != nil || uploaded || len(puts) != uploads {
+		t.Errorf("Expected the unchanged artifact to be skipped, got %v: %v", uploaded, err)
+	}
+	if uploaded, err := repository.Publish(coordinates, []byte("recompiled classes")); err != nil || !uploaded {
+		t.Errorf("Expected the changed artifact to be uploaded, got %v: %v", uploaded, err)
+	}
+
+	// Artifacts with a classifier have no POM of their own
+	sources, _ := Parse("app-1.2.0-sources.jar", "com.example", "1.2.0")
+	uploads = len(puts)
+	repository.Publish(sources, []byte("sources"))
+	if len(puts) != uploads+4 {
+		t.Errorf("Expected the sources and their checksums only, got %v", puts[uploads:])
+	}
+
+	repository.Password = "wrong"
+	if _, err := repository.Publish(coordinates, []byte("classes")); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("Expected the rejected credentials to fail, got %v", err)
+	}
+}
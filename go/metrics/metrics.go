@@ -0,0 +1,456 @@
+// Package metrics names the Prometheus metrics of the services and defines
+// the collectors shared between them. The Grafana dashboards are generated
+// from the same names, so a panel can only query a metric defined here.
+package metrics
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Coordinator metrics
+const (
+	QueueDepth              = "coordinator_queue_depth"
+	QueueWaitSeconds        = "coordinator_queue_wait_seconds"
+	BuildsTotal             = "coordinator_builds_total"
+	BuildFailuresTotal      = "coordinator_build_failures_total"
+	SchedulerDecisionsTotal = "coordinator_scheduler_decisions_total"
+	WorkerBusy              = "coordinator_worker_busy"
+	WorkerSlots             = "coordinator_worker_slots"
+	WorkerActiveBuilds      = "coordinator_worker_active_builds"
+	WorkerCPUUsage          = "coordinator_worker_cpu_usage"
+	WorkerMemoryUsage       = "coordinator_worker_memory_usage"
+	BuildCacheHitRatio      = "coordinator_build_cache_hit_ratio"
+	ResultCacheLookupsTotal = "coordinator_result_cache_lookups_total"
+	SpeculativeBuildsTotal  = "coordinator_speculative_builds_total"
+	FederatedBuildsTotal    = "coordinator_federated_builds_total"
+	StaleBuildsTotal        = "coordinator_stale_builds_total"
+	SCMStatusReportsTotal   = "coordinator_scm_status_reports_total"
+	TransferBytesTotal      = "coordinator_transfer_bytes_total"
+	ComputeSecondsTotal     = "coordinator_compute_seconds_total"
+	CacheStorageBytesTotal  = "coordinator_cache_storage_bytes_total"
+	ArtifactStorageBytes    = "coordinator_artifact_storage_bytes"
+	HTTPRequestsTotal       = "http_requests_total"
+)
+
+// Worker metrics
+const (
+	WorkerBuildsStartedTotal      = "worker_builds_started_total"
+	WorkerBuildsFinishedTotal     = "worker_builds_finished_total"
+	WorkerConcurrentBuilds        = "worker_concurrent_builds"
+	WorkerBuildDurationSeconds    = "worker_build_duration_seconds"
+	WorkerGradleDaemons           = "worker_gradle_daemons"
+	WorkerWorkspaceDiskUsage      = "worker_workspace_disk_usage"
+	WorkerCacheTransferBytesTotal = "worker_cache_transfer_bytes_total"
+)
+
+// Cache server metrics
+const (
+	CacheHitsTotal     = "cache_hits_total"
+	CacheMissesTotal   = "cache_misses_total"
+	CacheRequestsTotal = "cache_requests_total"
+	CacheSizeBytes     = "cache_size_bytes"
+	CacheEntriesTotal  = "cache_entries_total"
+)
+
+// Dependency proxy metrics
+const (
+	DependencyProxyRequestsTotal      = "depproxy_requests_total"
+	DependencyProxyUpstreamBytesTotal = "depproxy_upstream_bytes_total"
+	DependencyProxyEvictionsTotal     = "depproxy_evictions_total"
+	DependencyProxyStorageBytes       = "depproxy_storage_bytes"
+	DependencyProxyStorageFiles       = "depproxy_storage_files"
+)
+
+// ML service metrics
+const (
+	PredictionsTotal          = "ml_predictions_total"
+	PredictionDurationSeconds = "ml_prediction_duration_seconds"
+	TrainingTotal             = "ml_training_total"
+	PredictionErrorSeconds    = "ml_prediction_error_seconds"
+	PredictionErrorRatio      = "ml_prediction_error_ratio"
+	// Data collection health by source
+	CollectionUp                  = "ml_collection_up"
+	CollectionCircuitOpen         = "ml_collection_circuit_open"
+	CollectionConsecutiveFailures = "ml_collection_consecutive_failures"
+)
+
+// Names lists every metric the dashboards may query
+func Names() []string {
+	return []string{
+		QueueDepth, QueueWaitSeconds, BuildsTotal, BuildFailuresTotal, SchedulerDecisionsTotal, SpeculativeBuildsTotal, FederatedBuildsTotal, StaleBuildsTotal, SCMStatusReportsTotal,
+		WorkerBusy, WorkerSlots, WorkerActiveBuilds, WorkerCPUUsage, WorkerMemoryUsage,
+		BuildCacheHitRatio, ResultCacheLookupsTotal, TransferBytesTotal, HTTPRequestsTotal,
+		ComputeSecondsTotal, CacheStorageBytesTotal, ArtifactStorageBytes,
+		WorkerBuildsStartedTotal, WorkerBuildsFinishedTotal, WorkerConcurrentBuilds, WorkerBuildDurationSeconds,
+		WorkerGradleDaemons, WorkerWorkspaceDiskUsage, WorkerCacheTransferBytesTotal,
+		CacheHitsTotal, CacheMissesTotal, CacheRequestsTotal, CacheSizeBytes, CacheEntriesTotal,
+		DependencyProxyRequestsTotal, DependencyProxyUpstreamBytesTotal, DependencyProxyEvictionsTotal,
+		DependencyProxyStorageBytes, DependencyProxyStorageFiles,
+		PredictionsTotal, PredictionDurationSeconds, TrainingTotal, PredictionErrorSeconds, PredictionErrorRatio,
+		CollectionUp, CollectionCircuitOpen, CollectionConsecutiveFailures,
+	}
+}
+
+// Scheduler decisions counted by SchedulerDecisions
+const (
+	DecisionAssigned   = "assigned"
+	DecisionNoCapacity = "no_capacity"
+	DecisionQueueFull  = "queue_full"
+	DecisionCancelled  = "cancelled"
+)
+
+// Result cache lookups counted by ResultCacheLookups
+const (
+	LookupHit    = "hit"
+	LookupMiss   = "miss"
+	LookupForced = "forced"
+)
+
+// Speculative execution events counted by SpeculativeExecutions
+const (
+	SpeculationLaunched   = "launched"
+	SpeculationPrimaryWon = "primary_won"
+	SpeculationBackupWon  = "backup_won"
+	SpeculationBothFailed = "both_failed"
+)
+
+// Federation events counted by FederatedBuilds
+const (
+	FederationForwarded     = "forwarded"
+	FederationForwardFailed = "forward_failed"
+	FederationCompleted     = "completed"
+	FederationFailed        = "failed"
+)
+
+// Recovery actions for the builds of evicted workers counted by StaleBuilds,
+// for those of preempted spot workers, which are always re-queued, and for
+// builds re-queued after failing with an infrastructure error
+const (
+	StaleBuildRequeued  = "requeued"
+	StaleBuildFailed    = "failed"
+	StaleBuildPreempted = "preempted"
+	StaleBuildRetried   = "retried"
+)
+
+// Results of the build statuses posted to source code hosts counted by
+// SCMStatusReports: reported, rejected or unreachable host, or dropped on a
+// full queue
+const (
+	StatusReported      = "reported"
+	StatusReportFailed  = "failed"
+	StatusReportDropped = "dropped"
+)
+
+// BuildFailureUnknown labels the failures counted by BuildFailures that have
+// no error code
+const BuildFailureUnknown = "unknown"
+
+// Artifact transfer directions and stages counted by TransferBytes. Raw
+// bytes are the size of the transferred files, deduplicated bytes those of
+// the chunks that had to be sent and compressed bytes what crossed the wire.
+const (
+	TransferUpload       = "upload"
+	TransferDownload     = "download"
+	TransferRaw          = "raw"
+	TransferDeduplicated = "deduplicated"
+	TransferCompressed   = "compressed"
+)
+
+// Priorities of the builds timed by QueueWait
+const (
+	PriorityCritical = "critical"
+	PriorityNormal   = "normal"
+)
+
+// Outcomes of the builds a worker ran counted by WorkerBuildsFinished
+const (
+	BuildSucceeded = "succeeded"
+	BuildFailed    = "failed"
+)
+
+// Results of the requests to the dependency proxy counted by
+// DependencyProxyRequests: served from the cache, downloaded, served from the
+// cache after the upstream repository failed, missing upstream, or failed
+const (
+	ProxyHit      = "hit"
+	ProxyMiss     = "miss"
+	ProxyStale    = "stale"
+	ProxyNotFound = "not_found"
+	ProxyError    = "error"
+)
+
+// Coordinator collectors updated as builds are scheduled and finish
+var (
+	SchedulerDecisions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: SchedulerDecisionsTotal,
+			Help: "Scheduling attempts by worker pool and outcome: assigned to a worker, requeued for lack of capacity, failed on a full queue or skipped after cancellation",
+		},
+		[]string{"pool", "decision"},
+	)
+
+	QueueWait = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    QueueWaitSeconds,
+			Help:    "Time builds waited in the queue before being assigned to a worker, by worker pool, priority and tenant",
+			Buckets: prometheus.ExponentialBuckets(0.5, 2, 14),
+		},
+		[]string{"pool", "priority", "tenant"},
+	)
+
+	BuildsFinished = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: BuildsTotal,
+			Help: "Finished builds by final status",
+		},
+		[]string{"status"},
+	)
+
+	BuildFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: BuildFailuresTotal,
+			Help: "Failed and cancelled builds by error code, such as INFRA_ERROR or TEST_FAILURE, unknown if the worker did not classify the failure",
+		},
+		[]string{"code"},
+	)
+
+	BuildCacheHits = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    BuildCacheHitRatio,
+			Help:    "Fraction of the executed tasks of a build taken from the build cache",
+			Buckets: prometheus.LinearBuckets(0.1, 0.1, 10),
+		},
+	)
+
+	SpeculativeExecutions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: SpeculativeBuildsTotal,
+			Help: "Builds duplicated on a second worker after running past their predicted duration, and which copy finished them",
+		},
+		[]string{"event"},
+	)
+
+	FederatedBuilds = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: FederatedBuildsTotal,
+			Help: "Builds forwarded to peer coordinators for lack of local capacity, failed forwarding attempts, and how forwarded builds finished",
+		},
+		[]string{"peer", "event"},
+	)
+
+	StaleBuilds = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: StaleBuildsTotal,
+			Help: "Builds recovered from workers evicted for missed heartbeats by worker pool, re-queued or failed, builds re-queued from preempted spot workers and builds retried after infrastructure errors",
+		},
+		[]string{"pool", "action"},
+	)
+
+	SCMStatusReports = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: SCMStatusReportsTotal,
+			Help: "Build statuses posted to source code hosts by reporter and result: reported, failed or dropped",
+		},
+		[]string{"reporter", "result"},
+	)
+
+	TransferBytes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: TransferBytesTotal,
+			Help: "Bytes of artifacts uploaded by workers and downloaded in chunks, by direction and stage: file size, after deduplication and after compression",
+		},
+		[]string{"direction", "stage"},
+	)
+
+	ResultCacheLookups = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: ResultCacheLookupsTotal,
+			Help: "Lookups of submitted builds in the result cache: reused a recent result, missed, or skipped by force",
+		},
+		[]string{"result"},
+	)
+
+	ComputeSeconds = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: ComputeSecondsTotal,
+			Help: "Time finished builds occupied a worker, by tenant and project",
+		},
+		[]string{"tenant", "project"},
+	)
+
+	CacheStorageBytes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: CacheStorageBytesTotal,
+			Help: "Bytes finished builds added to the local build cache of their worker, by tenant and project",
+		},
+		[]string{"tenant", "project"},
+	)
+
+	ArtifactStorage = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: ArtifactStorageBytes,
+			Help: "Size of the artifacts and uploaded projects stored on the coordinator by tenant and project, refreshed hourly",
+		},
+		[]string{"tenant", "project"},
+	)
+)
+
+// Coordinator gauges read from the worker pool and queue at scrape time
+var (
+	QueueDepthDesc = prometheus.NewDesc(QueueDepth,
+		"Builds waiting for a worker of the pool", []string{"pool"}, nil)
+	WorkerBusyDesc = prometheus.NewDesc(WorkerBusy,
+		"1 if the worker has no free build slot, 0 if it is idle", []string{"worker", "pool"}, nil)
+	WorkerSlotsDesc = prometheus.NewDesc(WorkerSlots,
+		"Concurrent builds the worker accepts", []string{"worker", "pool"}, nil)
+	WorkerActiveBuildsDesc = prometheus.NewDesc(WorkerActiveBuilds,
+		"Builds running on the worker", []string{"worker", "pool"}, nil)
+	WorkerCPUUsageDesc = prometheus.NewDesc(WorkerCPUUsage,
+		"CPU usage fraction reported in the worker's last heartbeat", []string{"worker", "pool"}, nil)
+	WorkerMemoryUsageDesc = prometheus.NewDesc(WorkerMemoryUsage,
+		"Memory usage fraction reported in the worker's last heartbeat", []string{"worker", "pool"}, nil)
+)
+
+// Worker collectors updated as builds run
+var (
+	WorkerBuildsStarted = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: WorkerBuildsStartedTotal,
+			Help: "Builds the worker accepted and started",
+		},
+	)
+
+	WorkerBuildsFinished = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: WorkerBuildsFinishedTotal,
+			Help: "Builds the worker finished by outcome: succeeded, or failed including cancelled builds",
+		},
+		[]string{"status"},
+	)
+
+	WorkerBuildDurations = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    WorkerBuildDurationSeconds,
+			Help:    "Time the worker spent on a build from checkout to its result, by outcome",
+			Buckets: prometheus.ExponentialBuckets(5, 2, 11),
+		},
+		[]string{"status"},
+	)
+
+	WorkerCacheTransferBytes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: WorkerCacheTransferBytesTotal,
+			Help: "Compressed bytes of artifact chunks the worker uploaded to and input chunks it downloaded from the coordinator's chunk store",
+		},
+		[]string{"direction"},
+	)
+)
+
+// Worker gauges read from the worker and its host at scrape time
+var (
+	WorkerConcurrentBuildsDesc = prometheus.NewDesc(WorkerConcurrentBuilds,
+		"Builds running on the worker", nil, nil)
+	WorkerGradleDaemonsDesc = prometheus.NewDesc(WorkerGradleDaemons,
+		"Gradle daemon processes running on the worker's host", nil, nil)
+	WorkerWorkspaceDiskUsageDesc = prometheus.NewDesc(WorkerWorkspaceDiskUsage,
+		"Used fraction of the filesystem holding the worker's build directory", nil, nil)
+)
+
+// Dependency proxy collectors updated as files are requested
+var (
+	DependencyProxyRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: DependencyProxyRequestsTotal,
+			Help: "Requests for files of upstream repositories by repository and result: hit, miss, stale, not_found or error",
+		},
+		[]string{"repository", "result"},
+	)
+
+	DependencyProxyUpstreamBytes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: DependencyProxyUpstreamBytesTotal,
+			Help: "Bytes downloaded from upstream repositories by repository",
+		},
+		[]string{"repository"},
+	)
+
+	DependencyProxyEvictions = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: DependencyProxyEvictionsTotal,
+			Help: "Cached files removed to keep the cache under its maximum size",
+		},
+	)
+)
+
+// Dependency proxy gauges read from the cache at scrape time
+var (
+	DependencyProxyStorageBytesDesc = prometheus.NewDesc(DependencyProxyStorageBytes,
+		"Size of the files in the dependency proxy's cache", nil, nil)
+	DependencyProxyStorageFilesDesc = prometheus.NewDesc(DependencyProxyStorageFiles,
+		"Files in the dependency proxy's cache", nil, nil)
+)
+
+// ML collectors comparing predictions with the builds that followed
+var (
+	PredictionErrors = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    PredictionErrorSeconds,
+			Help:    "Absolute difference between predicted and actual build durations in seconds",
+			Buckets: prometheus.ExponentialBuckets(1, 2, 12),
+		},
+	)
+
+	PredictionErrorRatios = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    PredictionErrorRatio,
+			Help:    "Absolute difference between predicted and actual build durations relative to the actual duration",
+			Buckets: []float64{0.05, 0.1, 0.25, 0.5, 1, 2, 5},
+		},
+	)
+)
+
+// ML collectors of the health of data collection from the monitor and
+// coordinator
+var (
+	CollectionStatus = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: CollectionUp,
+			Help: "1 if the last data collection from the source succeeded, 0 if it failed",
+		},
+		[]string{"source"},
+	)
+
+	CollectionCircuits = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: CollectionCircuitOpen,
+			Help: "1 while data collection from the source is suspended after repeated failures",
+		},
+		[]string{"source"},
+	)
+
+	CollectionFailures = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: CollectionConsecutiveFailures,
+			Help: "Failed data collections from the source since the last successful one",
+		},
+		[]string{"source"},
+	)
+)
+
+// ObservePredictionError records how far a build duration prediction was
+// from the actual duration
+func ObservePredictionError(predicted, actual time.Duration) {
+	if actual <= 0 {
+		return
+	}
+
+	diff := predicted - actual
+	if diff < 0 {
+		diff = -diff
+	}
+
+	PredictionErrors.Observe(diff.Seconds())
+	PredictionErrorRatios.Observe(diff.Seconds() / actual.Seconds())
+}
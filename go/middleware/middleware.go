@@ -0,0 +1,201 @@
+package middleware
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+
+	"distributed-gradle-building/auth"
+	"distributed-gradle-building/errors"
+	"distributed-gradle-building/tracing"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// RequestIDHeader carries the request ID between clients and services
+const RequestIDHeader = "X-Request-ID"
+
+// Middleware wraps an HTTP handler
+type Middleware func(http.Handler) http.Handler
+
+type contextKey string
+
+const requestIDKey contextKey = "request_id"
+
+// Chain wraps a handler with middlewares. The first middleware is the
+// outermost, so it sees each request first and each response last.
+func Chain(handler http.Handler, middlewares ...Middleware) http.Handler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
+
+// RequestID assigns each request an ID, reusing the one sent by the client.
+// The ID is echoed in the response and stored in the request context.
+func RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if id == "" {
+			id = newRequestID()
+		}
+
+		w.Header().Set(RequestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey, id)))
+	})
+}
+
+// RequestIDFromContext returns the request ID assigned by RequestID
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// newRequestID returns a random 16 byte hex ID
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(b)
+}
+
+// Logging logs the method, path, status and duration of each request
+func Logging(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := newStatusRecorder(w)
+
+		next.ServeHTTP(recorder, r)
+
+		log.Printf("%s %s %d %v request_id=%s", r.Method, r.URL.Path, recorder.status, time.Since(start), RequestIDFromContext(r.Context()))
+	})
+}
+
+// Recovery turns a panicking handler into a 500 response instead of a dropped connection
+func Recovery(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				if recovered == http.ErrAbortHandler {
+					panic(recovered)
+				}
+
+				log.Printf("Panic serving %s %s request_id=%s: %v\n%s", r.Method, r.URL.Path, RequestIDFromContext(r.Context()), recovered, debug.Stack())
+
+				apiErr := errors.NewAPIError(errors.ErrCodeInternalError, "Internal server error")
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(apiErr.HTTPStatus)
+				json.NewEncoder(w).Encode(apiErr)
+			}
+		}()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Metrics counts requests by method, route pattern and status code. The
+// counter must have the labels method, endpoint and status; endpoints are the
+// patterns registered on mux so path parameters do not create new series.
+func Metrics(counter *prometheus.CounterVec, mux *http.ServeMux) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			recorder := newStatusRecorder(w)
+
+			next.ServeHTTP(recorder, r)
+
+			_, endpoint := mux.Handler(r)
+			if endpoint == "" {
+				endpoint = "unmatched"
+			}
+			counter.WithLabelValues(r.Method, endpoint, strconv.Itoa(recorder.status)).Inc()
+		})
+	}
+}
+
+// Tracing records a server span of each request, continuing the trace of the
+// client's traceparent header. Spans are named after the patterns registered
+// on mux, like Metrics labels them. A nil tracer disables tracing.
+func Tracing(tracer *tracing.Tracer, mux *http.ServeMux) Middleware {
+	return func(next http.Handler) http.Handler {
+		if tracer == nil {
+			return next
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, route := mux.Handler(r)
+			if route == "" {
+				route = "unmatched"
+			}
+			name := route
+			if !strings.Contains(route, " ") {
+				name = r.Method + " " + route
+			}
+
+			ctx, span := tracer.Start(tracing.Extract(r.Context(), r.Header), name, tracing.KindServer)
+			defer span.End()
+			span.SetAttribute("http.request.method", r.Method)
+			span.SetAttribute("http.route", route)
+			span.SetAttribute("url.path", r.URL.Path)
+			if id := RequestIDFromContext(ctx); id != "" {
+				span.SetAttribute("request.id", id)
+			}
+
+			recorder := newStatusRecorder(w)
+			next.ServeHTTP(recorder, r.WithContext(ctx))
+
+			span.SetAttribute("http.response.status_code", strconv.Itoa(recorder.status))
+			if recorder.status >= http.StatusInternalServerError {
+				span.SetError(http.StatusText(recorder.status))
+			}
+		})
+	}
+}
+
+// statusRecorder captures the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func newStatusRecorder(w http.ResponseWriter) *statusRecorder {
+	return &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+}
+
+// WriteHeader records the status before writing it
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// Auth requires a valid bearer token on every path except the exempt ones.
+// A nil service disables authentication.
+func Auth(service *auth.AuthService, exemptPaths ...string) Middleware {
+	return func(next http.Handler) http.Handler {
+		if service == nil {
+			return next
+		}
+
+		authenticated := service.AuthMiddleware(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for _, path := range exemptPaths {
+				if r.URL.Path == path {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+			authenticated.ServeHTTP(w, r)
+		})
+	}
+}
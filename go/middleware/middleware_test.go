@@ -0,0 +1,165 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"distributed-gradle-building/auth"
+	"distributed-gradle-building/tracing"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestChainOrder(t *testing.T) {
+	var order []string
+	tag := func(name string) Middleware {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				order = append(order, name)
+				next.ServeHTTP(w, r)
+			})
+		}
+	}
+
+	handler := Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		order = append(order, "handler")
+	}), tag("first"), tag("second"))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	if len(order) != 3 || order[0] != "first" || order[1] != "second" || order[2] != "handler" {
+		t.Errorf("Unexpected order %v", order)
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	var seen string
+	handler := RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = RequestIDFromContext(r.Context())
+	}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if seen == "" || w.Header().Get(RequestIDHeader) != seen {
+		t.Errorf("Expected generated ID in context and response, got %q and %q", seen, w.Header().Get(RequestIDHeader))
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set(RequestIDHeader, "client-id")
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if seen != "client-id" || w.Header().Get(RequestIDHeader) != "client-id" {
+		t.Errorf("Expected client ID to be reused, got %q", seen)
+	}
+}
+
+func TestRecovery(t *testing.T) {
+	handler := Recovery(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("Expected status 500, got %d", w.Code)
+	}
+	if contentType := w.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("Expected JSON error, got %s", contentType)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	counter := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "test_requests_total"}, []string{"method", "endpoint", "status"})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/builds/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	})
+	handler := Metrics(counter, mux)(mux)
+
+	for _, path := range []string{"/api/builds/a", "/api/builds/b", "/unknown"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+
+	for _, tc := range []struct {
+		endpoint string
+		expected float64
+	}{
+		{"GET /api/builds/{id}", 2},
+		{"unmatched", 1},
+	} {
+		var metric dto.Metric
+		if err := counter.WithLabelValues("GET", tc.endpoint, "404").Write(&metric); err != nil {
+			t.Fatalf("Failed to read counter: %v", err)
+		}
+		if value := metric.GetCounter().GetValue(); value != tc.expected {
+			t.Errorf("Expected %v requests for %s, got %v", tc.expected, tc.endpoint, value)
+		}
+	}
+}
+
+func TestTracing(t *testing.T) {
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer collector.Close()
+	tracer, _ := tracing.New(tracing.Config{Service: "coordinator", Endpoint: collector.URL, SampleRate: 1})
+	defer tracer.Close()
+
+	var span *tracing.Span
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/builds/{id}", func(w http.ResponseWriter, r *http.Request) {
+		span = tracing.SpanFromContext(r.Context())
+	})
+
+	request := httptest.NewRequest("GET", "/api/builds/build-1", nil)
+	request.Header.Set(tracing.TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	Tracing(tracer, mux)(mux).ServeHTTP(httptest.NewRecorder(), request)
+	if context := span.Context(); span == nil || context.TraceID != [16]byte{0x4b, 0xf9, 0x2f, 0x35, 0x77, 0xb3, 0x4d, 0xa6, 0xa3, 0xce, 0x92, 0x9d, 0x0e, 0x0e, 0x47, 0x36} || context.Sampled {
+		t.Errorf("Expected a server span continuing the client's unsampled trace, got %+v", context)
+	}
+
+	span = nil
+	Tracing(nil, mux)(mux).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/builds/build-1", nil))
+	if span != nil {
+		t.Error("Expected no span without a tracer")
+	}
+}
+
+func TestAuth(t *testing.T) {
+	service := auth.NewAuthService("secret", time.Hour)
+	service.AddAllowedToken("service-token")
+
+	handler := Auth(service, "/health")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		path     string
+		token    string
+		expected int
+	}{
+		{"/health", "", http.StatusOK},
+		{"/api/build", "", http.StatusUnauthorized},
+		{"/api/build", "wrong", http.StatusUnauthorized},
+		{"/api/build", "service-token", http.StatusOK},
+	}
+
+	for _, tc := range tests {
+		req := httptest.NewRequest("GET", tc.path, nil)
+		if tc.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tc.token)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		if w.Code != tc.expected {
+			t.Errorf("%s with token %q: expected %d, got %d", tc.path, tc.token, tc.expected, w.Code)
+		}
+	}
+
+	// A nil service disables authentication
+	w := httptest.NewRecorder()
+	Auth(nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(w, httptest.NewRequest("GET", "/api/build", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected nil service to allow requests, got %d", w.Code)
+	}
+}
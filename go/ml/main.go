@@ -1,27 +1,45 @@
 package main
 
 import (
+	"compress/gzip"
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
-	"os/signal"
 	"strconv"
-	"syscall"
+	"strings"
 	"time"
 
+	"distributed-gradle-building/audit"
+	"distributed-gradle-building/events"
+	"distributed-gradle-building/internal/app"
+	"distributed-gradle-building/metrics"
+	"distributed-gradle-building/middleware"
+	"distributed-gradle-building/ml/mlrpc"
 	"distributed-gradle-building/ml/service"
+	"distributed-gradle-building/ratelimit"
+	"distributed-gradle-building/tracing"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 type MLServer struct {
-	mlService  *service.MLService
-	port       int
-	httpServer *http.Server
-	shutdown   chan struct{}
+	mlService        *service.MLService
+	port             int
+	batchConcurrency int
+	httpServer       *http.Server
+	rateLimiter      *ratelimit.Limiter
+	auditLog         *audit.Log
+	shutdown         chan struct{}
+	// events delivers the builds finishing on the coordinator
+	events events.Bus
+	// tracer exports spans of the API requests, nil unless tracing is
+	// configured
+	tracer *tracing.Tracer
 
 	// Prometheus metrics
 	predictionsTotal    prometheus.Counter
@@ -33,14 +51,14 @@ func NewMLServer(port int) *MLServer {
 	// Create Prometheus metrics
 	predictionsTotal := prometheus.NewCounter(
 		prometheus.CounterOpts{
-			Name: "ml_predictions_total",
+			Name: metrics.PredictionsTotal,
 			Help: "Total number of predictions made by ML service",
 		},
 	)
 
 	predictionsDuration := prometheus.NewHistogram(
 		prometheus.HistogramOpts{
-			Name:    "ml_prediction_duration_seconds",
+			Name:    metrics.PredictionDurationSeconds,
 			Help:    "Duration of prediction requests in seconds",
 			Buckets: prometheus.DefBuckets,
 		},
@@ -48,17 +66,33 @@ func NewMLServer(port int) *MLServer {
 
 	trainingTotal := prometheus.NewCounter(
 		prometheus.CounterOpts{
-			Name: "ml_training_total",
+			Name: metrics.TrainingTotal,
 			Help: "Total number of model training sessions",
 		},
 	)
 
+	rateLimitConfig, err := ratelimit.LoadConfigFromEnv()
+	if err != nil {
+		log.Printf("Invalid rate limit configuration, using defaults: %v", err)
+	}
+	rateLimiter := ratelimit.NewLimiter(rateLimitConfig, "ml")
+
 	// Register metrics
-	prometheus.MustRegister(predictionsTotal, predictionsDuration, trainingTotal)
+	prometheus.MustRegister(predictionsTotal, predictionsDuration, trainingTotal, rateLimiter,
+		metrics.PredictionErrors, metrics.PredictionErrorRatios,
+		metrics.CollectionStatus, metrics.CollectionCircuits, metrics.CollectionFailures)
+
+	mlService := service.NewMLService()
+	if _, err := mlService.LoadLatestSnapshot(); err != nil {
+		log.Printf("Failed to load persisted models: %v", err)
+	}
 
 	return &MLServer{
-		mlService:           service.NewMLService(),
+		mlService:           mlService,
 		port:                port,
+		batchConcurrency:    8,
+		rateLimiter:         rateLimiter,
+		auditLog:            audit.OpenFromEnv(),
 		shutdown:            make(chan struct{}),
 		predictionsTotal:    predictionsTotal,
 		predictionsDuration: predictionsDuration,
@@ -67,37 +101,170 @@ func NewMLServer(port int) *MLServer {
 }
 
 func (s *MLServer) Start() error {
+	s.listen()
+	return s.httpServer.ListenAndServe()
+}
+
+// listen creates the HTTP server, to be served with ListenAndServe
+func (s *MLServer) listen() {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/health", s.handleHealth)
 	mux.HandleFunc("/api/predict", s.handlePredict)
+	mux.HandleFunc("/api/predict/batch", s.handlePredictBatch)
 	mux.HandleFunc("/api/train", s.handleTrain)
+	mux.HandleFunc("GET /api/train/{id}", s.handleTrainingJob)
 	mux.HandleFunc("/api/scaling", s.handleScalingAdvice)
 	mux.HandleFunc("/api/stats", s.handleStats)
 	mux.HandleFunc("/api/learning", s.handleLearningStats)
 	mux.HandleFunc("/api/rollback", s.handleRollback)
+	mux.HandleFunc("/api/projects", s.handleProjectModels)
+	mux.HandleFunc("/api/projects/models", s.handleProjectModel)
+	mux.HandleFunc("/api/projects/train", s.handleTrainProject)
+	mux.HandleFunc("/api/projects/rollback", s.handleRollbackProject)
+	mux.HandleFunc("/api/anomalies", s.handleAnomalies)
+	mux.HandleFunc("/api/failures/classify", s.handleClassifyFailure)
+	mux.HandleFunc("/api/tests/durations", s.handleTestDurations)
+	mux.HandleFunc("/api/flaky-tests", s.handleFlakyTests)
+	mux.HandleFunc("/api/trends", s.handleTrends)
 	mux.HandleFunc("/api/export", s.handleExport)
+	mux.HandleFunc("/api/export/rollups", s.handleExportRollups)
+	mux.HandleFunc("/api/export/ndjson", s.handleExportNDJSON)
 	mux.HandleFunc("/api/import", s.handleImport)
+	mux.HandleFunc("/api/audit", s.handleAudit)
+	mux.HandleFunc("/api/tracing/check", s.tracer.Handler())
 	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/api/openapi.json", mlOpenAPI().Handler())
 
 	s.httpServer = &http.Server{
-		Addr:    fmt.Sprintf(":%d", s.port),
-		Handler: mux,
+		Addr: fmt.Sprintf(":%d", s.port),
+		Handler: middleware.Chain(mux,
+			middleware.RequestID,
+			middleware.Tracing(s.tracer, mux),
+			middleware.Logging,
+			s.rateLimiter.Middleware,
+		),
 	}
 
 	log.Printf("ML Service starting on port %d", s.port)
-	return s.httpServer.ListenAndServe()
+}
+
+// PredictRequest is the body of a single build prediction request
+type PredictRequest struct {
+	ProjectPath  string            `json:"project_path"`
+	TaskName     string            `json:"task_name"`
+	BuildOptions map[string]string `json:"build_options"`
+	// Optional worker the predicted durations are scaled to, see
+	// service.PredictionRequest
+	WorkerID    string  `json:"worker_id,omitempty"`
+	WorkerSpeed float64 `json:"worker_speed,omitempty"`
+	// Optional time of submission and cluster load the predicted durations
+	// are scaled to, see service.PredictionRequest
+	SubmittedAt time.Time `json:"submitted_at,omitempty"`
+	ClusterLoad int       `json:"cluster_load,omitempty"`
+	// Optional queue state used to estimate the wait for a worker
+	QueuedBuilds []service.PredictionRequest `json:"queued_builds,omitempty"`
+	WorkerCount  int                         `json:"worker_count,omitempty"`
+}
+
+// BatchPredictResponse holds the predictions of a batch request
+type BatchPredictResponse struct {
+	Predictions []service.PredictionResult `json:"predictions"`
+	Count       int                        `json:"count"`
+}
+
+// ClassifyFailureRequest is the log or error message of a failed build to
+// classify
+type ClassifyFailureRequest struct {
+	Log string `json:"log"`
+}
+
+// RollbackRequest selects the model version to restore
+type RollbackRequest struct {
+	Version string `json:"version"`
+}
+
+// ModelVersionsResponse lists the stored model versions
+type ModelVersionsResponse struct {
+	CurrentVersion string                      `json:"current_version"`
+	Versions       []service.ModelSnapshotInfo `json:"versions"`
+}
+
+// ProjectModelsResponse lists the models of projects and project groups
+type ProjectModelsResponse struct {
+	Models []service.ProjectModelInfo `json:"models"`
+	Count  int                        `json:"count"`
+}
+
+// ProjectModelRequest selects a project or project group, and the model
+// version to restore on rollback
+type ProjectModelRequest struct {
+	Project string `json:"project"`
+	Version string `json:"version,omitempty"`
+}
+
+// AnomaliesResponse lists detected build anomalies
+type AnomaliesResponse struct {
+	Anomalies []service.Anomaly `json:"anomalies"`
+	Count     int               `json:"count"`
+}
+
+// TestDurationsResponse lists the recorded durations of a project's test
+// classes by class name
+type TestDurationsResponse struct {
+	Project   string                   `json:"project"`
+	Durations map[string]time.Duration `json:"durations"`
+	Count     int                      `json:"count"`
+}
+
+// FlakyTestsResponse lists the flaky test cases of a project
+type FlakyTestsResponse struct {
+	Project string              `json:"project"`
+	Tests   []service.FlakyTest `json:"tests"`
+	Count   int                 `json:"count"`
+}
+
+// TrendsResponse lists daily build summaries
+type TrendsResponse struct {
+	Trends []service.TrendPoint `json:"trends"`
+	Count  int                  `json:"count"`
+}
+
+// maxImportSize limits the size of an imported ML data file
+const maxImportSize = 1 << 30
+
+// ImportResponse reports an import of ML data
+type ImportResponse struct {
+	Status string `json:"status"`
+	service.ImportResult
+}
+
+// StatusResponse acknowledges a completed operation
+type StatusResponse struct {
+	Status  string `json:"status"`
+	Version string `json:"version,omitempty"`
+}
+
+// HealthStatus is the ML service health check response
+type HealthStatus struct {
+	Status    string         `json:"status"`
+	Service   string         `json:"service"`
+	Version   string         `json:"version"`
+	Timestamp string         `json:"timestamp"`
+	Backend   string         `json:"backend"`
+	Stats     map[string]any `json:"stats"`
 }
 
 func (s *MLServer) handleHealth(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
 	stats := s.mlService.GetLearningStats()
-	health := map[string]any{
-		"status":    "healthy",
-		"service":   "ml",
-		"version":   "1.0.0",
-		"timestamp": time.Now().Format(time.RFC3339),
-		"stats":     stats,
+	health := HealthStatus{
+		Status:    "healthy",
+		Service:   "ml",
+		Version:   "1.0.0",
+		Timestamp: time.Now().Format(time.RFC3339),
+		Backend:   s.mlService.PredictorName(),
+		Stats:     stats,
 	}
 
 	json.NewEncoder(w).Encode(health)
@@ -111,18 +278,23 @@ func (s *MLServer) handlePredict(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var req struct {
-		ProjectPath  string            `json:"project_path"`
-		TaskName     string            `json:"task_name"`
-		BuildOptions map[string]string `json:"build_options"`
-	}
+	var req PredictRequest
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
 
-	prediction := s.mlService.GetBuildInsights(req.ProjectPath, req.TaskName, req.BuildOptions)
+	prediction := s.mlService.GetWorkerBuildInsights(service.PredictionRequest{
+		ProjectPath:  req.ProjectPath,
+		TaskName:     req.TaskName,
+		BuildOptions: req.BuildOptions,
+		WorkerID:     req.WorkerID,
+		WorkerSpeed:  req.WorkerSpeed,
+		SubmittedAt:  req.SubmittedAt,
+		ClusterLoad:  req.ClusterLoad,
+	})
+	prediction.EstimatedQueueWait = s.mlService.EstimateQueueWait(req.QueuedBuilds, req.WorkerCount)
 
 	// Record metrics
 	s.predictionsTotal.Inc()
@@ -132,22 +304,151 @@ func (s *MLServer) handlePredict(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(prediction)
 }
 
+func (s *MLServer) handlePredictBatch(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var requests []service.PredictionRequest
+	if err := json.NewDecoder(r.Body).Decode(&requests); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	predictions := s.mlService.GetBatchBuildInsights(requests, s.batchConcurrency)
+
+	// Record metrics
+	s.predictionsTotal.Add(float64(len(predictions)))
+	s.predictionsDuration.Observe(time.Since(start).Seconds())
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(BatchPredictResponse{
+		Predictions: predictions,
+		Count:       len(predictions),
+	})
+}
+
 func (s *MLServer) handleTrain(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	if err := s.mlService.TrainModels(); err != nil {
-		http.Error(w, fmt.Sprintf("Training failed: %v", err), http.StatusInternalServerError)
+	job := s.mlService.StartTraining(func(job service.TrainingJob) {
+		if job.Status == service.TrainingCompleted {
+			s.trainingTotal.Inc()
+		}
+	})
+	s.auditLog.RecordRequest(r, audit.ActionModelTrained, job.ID, nil)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/api/train/"+job.ID)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(job)
+}
+
+func (s *MLServer) handleTrainingJob(w http.ResponseWriter, r *http.Request) {
+	job, err := s.mlService.GetTrainingJob(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job)
+}
+
+func (s *MLServer) handleProjectModels(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	models := s.mlService.ListProjectModels()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ProjectModelsResponse{Models: models, Count: len(models)})
+}
+
+func (s *MLServer) handleProjectModel(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	project := r.URL.Query().Get("project")
+	if project == "" {
+		http.Error(w, "project parameter is required", http.StatusBadRequest)
+		return
+	}
+
+	model, err := s.mlService.ProjectModel(project)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(model)
+}
+
+func (s *MLServer) handleTrainProject(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req ProjectModelRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Project == "" {
+		http.Error(w, "Project is required", http.StatusBadRequest)
 		return
 	}
 
-	// Record training metric
+	info, err := s.mlService.TrainProjectModel(req.Project)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Training failed: %v", err), http.StatusBadRequest)
+		return
+	}
 	s.trainingTotal.Inc()
+	s.auditLog.RecordRequest(r, audit.ActionModelTrained, info.Version, map[string]string{"project": info.Key})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
+
+func (s *MLServer) handleRollbackProject(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req ProjectModelRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if req.Project == "" || req.Version == "" {
+		http.Error(w, "Project and version are required", http.StatusBadRequest)
+		return
+	}
+
+	model, err := s.mlService.ProjectModel(req.Project)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err := s.mlService.RollbackProjectModel(req.Project, req.Version); err != nil {
+		http.Error(w, fmt.Sprintf("Rollback failed: %v", err), http.StatusInternalServerError)
+		return
+	}
+	s.auditLog.RecordRequest(r, audit.ActionModelRolledBack, req.Version, map[string]string{"project": model.Key, "previous_version": model.Version})
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"status": "training_completed"})
+	json.NewEncoder(w).Encode(StatusResponse{Status: "rollback_completed", Version: req.Version})
 }
 
 func (s *MLServer) handleScalingAdvice(w http.ResponseWriter, r *http.Request) {
@@ -196,14 +497,27 @@ func (s *MLServer) handleLearningStats(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *MLServer) handleRollback(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		snapshots, err := s.mlService.ListModelSnapshots()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to list model versions: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(ModelVersionsResponse{
+			CurrentVersion: s.mlService.CurrentModelVersion(),
+			Versions:       snapshots,
+		})
+		return
+	}
+
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	var req struct {
-		Version string `json:"version"`
-	}
+	var req RollbackRequest
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
@@ -215,25 +529,198 @@ func (s *MLServer) handleRollback(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	previousVersion := s.mlService.CurrentModelVersion()
 	if err := s.mlService.RollbackToVersion(req.Version); err != nil {
 		http.Error(w, fmt.Sprintf("Rollback failed: %v", err), http.StatusInternalServerError)
 		return
 	}
+	s.auditLog.RecordRequest(r, audit.ActionModelRolledBack, req.Version, map[string]string{"previous_version": previousVersion})
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"status": "rollback_completed", "version": req.Version})
+	json.NewEncoder(w).Encode(StatusResponse{Status: "rollback_completed", Version: req.Version})
 }
 
-func (s *MLServer) handleExport(w http.ResponseWriter, r *http.Request) {
-	data, err := s.mlService.ExportData()
+func (s *MLServer) handleAnomalies(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var since time.Time
+	if sinceStr := r.URL.Query().Get("since"); sinceStr != "" {
+		parsed, err := time.Parse(time.RFC3339, sinceStr)
+		if err != nil {
+			http.Error(w, "Invalid since parameter, expected RFC3339", http.StatusBadRequest)
+			return
+		}
+		since = parsed
+	}
+
+	anomalies := s.mlService.GetAnomalies(since)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(AnomaliesResponse{
+		Anomalies: anomalies,
+		Count:     len(anomalies),
+	})
+}
+
+func (s *MLServer) handleClassifyFailure(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req ClassifyFailureRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Log == "" {
+		http.Error(w, "Invalid request body, expected the log of a failed build", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.mlService.ClassifyFailure(req.Log))
+}
+
+func (s *MLServer) handleTestDurations(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	project := r.URL.Query().Get("project")
+	if project == "" {
+		http.Error(w, "project parameter is required", http.StatusBadRequest)
+		return
+	}
+
+	durations := s.mlService.GetTestDurations(project)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(TestDurationsResponse{Project: project, Durations: durations, Count: len(durations)})
+}
+
+func (s *MLServer) handleFlakyTests(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	project := r.URL.Query().Get("project")
+	if project == "" {
+		http.Error(w, "project parameter is required", http.StatusBadRequest)
+		return
+	}
+
+	tests := s.mlService.GetFlakyTests(project)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(FlakyTestsResponse{Project: project, Tests: tests, Count: len(tests)})
+}
+
+// trendQuery parses the project and since parameters of trend requests
+func trendQuery(r *http.Request) (string, time.Time, error) {
+	var since time.Time
+	if sinceStr := r.URL.Query().Get("since"); sinceStr != "" {
+		parsed, err := time.Parse(time.RFC3339, sinceStr)
+		if err != nil {
+			return "", since, fmt.Errorf("invalid since parameter, expected RFC3339")
+		}
+		since = parsed
+	}
+	return r.URL.Query().Get("project"), since, nil
+}
+
+func (s *MLServer) handleTrends(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	project, since, err := trendQuery(r)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Export failed: %v", err), http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	trends := s.mlService.Trends(project, since)
 
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(TrendsResponse{
+		Trends: trends,
+		Count:  len(trends),
+	})
+}
+
+func (s *MLServer) handleExportRollups(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	project, since, err := trendQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", "attachment; filename=ml-rollups.json")
+	json.NewEncoder(w).Encode(s.mlService.RolledUpData(project, since))
+}
+
+func (s *MLServer) handleExport(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Content-Disposition", "attachment; filename=ml-data.json")
-	w.Write(data)
+	if err := s.mlService.Export(w); err != nil {
+		// The status is sent already; the truncated body tells the client
+		log.Printf("Export failed: %v", err)
+	}
+}
+
+// NextCursorHeader carries the cursor of the next page of an NDJSON export
+const NextCursorHeader = "X-Next-Cursor"
+
+func (s *MLServer) handleExportNDJSON(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	options := service.NDJSONOptions{Cursor: query.Get("cursor")}
+	if sections := query.Get("sections"); sections != "" {
+		options.Sections = strings.Split(sections, ",")
+	}
+	if limit := query.Get("limit"); limit != "" {
+		pageSize, err := strconv.Atoi(limit)
+		if err != nil || pageSize < 1 {
+			http.Error(w, "limit must be a positive number of lines", http.StatusBadRequest)
+			return
+		}
+		options.PageSize = pageSize
+	}
+
+	page, err := s.mlService.NDJSONPage(options)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	if page.Next != "" {
+		w.Header().Set(NextCursorHeader, page.Next)
+	}
+	var out io.Writer = w
+	if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Add("Vary", "Accept-Encoding")
+		compressed := gzip.NewWriter(w)
+		defer compressed.Close()
+		out = compressed
+	}
+	if err := page.Encode(out); err != nil {
+		// The status is sent already; the truncated body tells the client
+		log.Printf("NDJSON export failed: %v", err)
+	}
 }
 
 func (s *MLServer) handleImport(w http.ResponseWriter, r *http.Request) {
@@ -242,20 +729,38 @@ func (s *MLServer) handleImport(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	data := make([]byte, r.ContentLength)
-	_, err := r.Body.Read(data)
-	if err != nil && err.Error() != "EOF" {
-		http.Error(w, "Failed to read request body", http.StatusBadRequest)
-		return
+	options := service.ImportOptions{DryRun: r.URL.Query().Get("dry_run") == "true"}
+	if sections := r.URL.Query().Get("sections"); sections != "" {
+		options.Sections = strings.Split(sections, ",")
 	}
 
-	if err := s.mlService.ImportData(data); err != nil {
-		http.Error(w, fmt.Sprintf("Import failed: %v", err), http.StatusInternalServerError)
+	result, err := s.mlService.Import(http.MaxBytesReader(w, r.Body, maxImportSize), options)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Import failed: %v", err), http.StatusBadRequest)
 		return
 	}
 
+	response := ImportResponse{Status: "import_completed", ImportResult: result}
+	if options.DryRun {
+		response.Status = "dry_run"
+	} else {
+		s.auditLog.RecordRequest(r, audit.ActionDataImported, "ml-data", map[string]string{
+			"sections":      strings.Join(result.Sections, ","),
+			"build_records": strconv.Itoa(result.BuildRecords),
+		})
+	}
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"status": "import_completed"})
+	json.NewEncoder(w).Encode(response)
+}
+
+func (s *MLServer) handleAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.auditLog.Handler().ServeHTTP(w, r)
 }
 
 // AddTestData adds some test data for demonstration
@@ -347,7 +852,18 @@ func (s *MLServer) AddTestData() {
 	s.mlService.RecordCacheMetrics(cacheMetric)
 }
 
-func main() {
+// mlProcess runs the ML service as an app.Service
+type mlProcess struct {
+	server *MLServer
+}
+
+func (s *mlProcess) Name() string {
+	return "ML service"
+}
+
+// Init creates the server on the port of the first argument and subscribes
+// it to the event bus
+func (s *mlProcess) Init(ctx context.Context) error {
 	port := 8085
 	if len(os.Args) > 1 {
 		if p, err := strconv.Atoi(os.Args[1]); err == nil {
@@ -356,49 +872,93 @@ func main() {
 	}
 
 	server := NewMLServer(port)
+	s.server = server
+
+	// Learn from finished builds as they happen when the coordinator
+	// publishes its events on a shared bus
+	bus, err := events.FromEnv("ml-service")
+	if err != nil {
+		return fmt.Errorf("invalid event bus configuration: %v", err)
+	}
+	server.events = bus
+	if server.tracer, err = tracing.FromEnv("ml-service"); err != nil {
+		return fmt.Errorf("invalid tracing configuration: %v", err)
+	}
+	if bus.Backend() != events.BackendMemory {
+		if _, err := server.mlService.ConsumeEvents(bus); err != nil {
+			return fmt.Errorf("failed to subscribe to build events: %v", err)
+		}
+		log.Printf("Consuming build events from the %s event bus", bus.Backend())
+	}
+	return nil
+}
 
+// Start starts the HTTP server and, with ML_RPC_PORT, the RPC server
+func (s *mlProcess) Start(ctx context.Context) error {
 	log.Printf("Distributed Gradle Building - ML Service")
 	log.Printf("Version: 1.0.0")
-	log.Printf("Listening on port %d", port)
+	log.Printf("Listening on port %d", s.server.port)
 	log.Printf("Available endpoints:")
 	log.Printf("  GET  /health - Health check")
 	log.Printf("  POST /api/predict - Predict build time and resources")
-	log.Printf("  POST /api/train - Train ML models")
+	log.Printf("  POST /api/predict/batch - Predict several builds in one call")
+	log.Printf("  POST /api/train - Train ML models in the background")
+	log.Printf("  GET  /api/train/{id} - Get the progress of a training job")
 	log.Printf("  GET  /api/scaling - Get scaling advice")
 	log.Printf("  GET  /api/stats - Get service statistics")
 	log.Printf("  GET  /api/learning - Get learning statistics")
+	log.Printf("  GET  /api/rollback - List persisted model versions")
 	log.Printf("  POST /api/rollback - Rollback to previous model")
+	log.Printf("  GET  /api/anomalies - List detected build and worker anomalies")
+	log.Printf("  POST /api/failures/classify - Classify a build failure from its log")
 	log.Printf("  GET  /api/export - Export ML data")
+	log.Printf("  GET  /api/export/ndjson - Export ML data as NDJSON pages")
 	log.Printf("  POST /api/import - Import ML data")
+	log.Printf("  GET  /api/audit - Query the audit log")
+	log.Printf("  GET  /api/tracing/check - Test the connection to the tracing collector")
+	log.Printf("Model backend: %s", s.server.mlService.PredictorName())
 	log.Printf("Continuous learning: ENABLED")
 
-	// Start server in goroutine
-	go func() {
-		if err := server.Start(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("Server failed to start: %v", err)
+	// Serve predictions to the coordinator over RPC as well
+	if value := os.Getenv("ML_RPC_PORT"); value != "" {
+		rpcPort, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid ML_RPC_PORT %q", value)
 		}
-	}()
-
-	// Setup graceful shutdown
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+		listener, err := net.Listen("tcp", fmt.Sprintf(":%d", rpcPort))
+		if err != nil {
+			return fmt.Errorf("RPC server error: %v", err)
+		}
+		app.Go(ctx, func() error {
+			return mlrpc.Serve(listener, s.server.mlService, s.server.batchConcurrency)
+		})
+		log.Printf("RPC predictions listening on port %d", rpcPort)
+	}
 
-	// Wait for shutdown signal
-	sig := <-sigChan
-	log.Printf("Received signal %v, shutting down ML service...", sig)
+	s.server.listen()
+	app.Go(ctx, s.server.httpServer.ListenAndServe)
+	return nil
+}
 
-	// Graceful shutdown
-	if err := server.Shutdown(); err != nil {
-		log.Printf("Error during ML service shutdown: %v", err)
-	}
+func (s *mlProcess) Stop(ctx context.Context, cause error) error {
+	return s.server.Shutdown()
+}
 
-	log.Printf("ML service shutdown complete")
+func main() {
+	app.Main(&mlProcess{})
 }
 
 // Shutdown gracefully shuts down the ML server
 func (s *MLServer) Shutdown() error {
 	close(s.shutdown)
 
+	if s.events != nil {
+		s.events.Close()
+	}
+
+	// Export the spans of the requests still being served once they finish
+	defer s.tracer.Close()
+
 	if s.httpServer != nil {
 		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 		defer cancel()
@@ -0,0 +1,471 @@
+// Package mlrpc serves ML predictions over RPC, the protocol the coordinator
+// already speaks with its workers, so scheduling decisions avoid the cost of
+// an HTTP request per prediction. Clients keep a pool of connections, bound
+// every call by a deadline and answer from a local predictor while the ML
+// service is down.
+//
+// The interface uses net/rpc since the module has no gRPC or protobuf
+// dependency. Deadlines travel in the arguments of each call, as net/rpc has
+// no call metadata.
+package mlrpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/rpc"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"distributed-gradle-building/ml/service"
+)
+
+// Defaults of clients created from the environment
+const (
+	DefaultPoolSize   = 4
+	DefaultTimeout    = 200 * time.Millisecond
+	DefaultRetryAfter = 5 * time.Second
+)
+
+// ErrDeadlineExceeded is returned by the server for calls whose deadline
+// passed before they were served
+var ErrDeadlineExceeded = errors.New("deadline exceeded")
+
+// PredictArgs asks for the insights of a single build
+type PredictArgs struct {
+	ProjectPath  string
+	TaskName     string
+	BuildOptions map[string]string
+	// WorkerID and WorkerSpeed select the worker the durations are scaled
+	// to, see service.PredictionRequest
+	WorkerID    string
+	WorkerSpeed float64
+	// SubmittedAt and ClusterLoad describe when the build is submitted,
+	// see service.PredictionRequest
+	SubmittedAt time.Time
+	ClusterLoad int
+	// Deadline after which the caller no longer waits for the reply
+	Deadline time.Time
+}
+
+// PredictBatchArgs asks for the insights of several builds
+type PredictBatchArgs struct {
+	Requests []service.PredictionRequest
+	Deadline time.Time
+}
+
+// PredictBatchReply holds the insights of a batch in request order
+type PredictBatchReply struct {
+	Predictions []service.PredictionResult
+}
+
+// ScalingArgs describes the load to give scaling advice for
+type ScalingArgs struct {
+	QueueLength    int
+	AvgCPULoad     float64
+	CurrentWorkers int
+	Deadline       time.Time
+}
+
+// TestDurationsArgs names the project whose test class durations are read
+type TestDurationsArgs struct {
+	ProjectPath string
+	Deadline    time.Time
+}
+
+// TestDurationsReply holds the recorded durations of a project's test
+// classes by class name
+type TestDurationsReply struct {
+	Durations map[string]time.Duration
+}
+
+// TestResultsArgs holds the test results of a build to record
+type TestResultsArgs struct {
+	Run      service.TestRun
+	Deadline time.Time
+}
+
+// TestResultsReply is empty
+type TestResultsReply struct{}
+
+// ScalingPatternsArgs asks for the learned scaling patterns
+type ScalingPatternsArgs struct {
+	Deadline time.Time
+}
+
+// ScalingPatternsReply holds the expected load of each hour of the week the
+// ML service has seen
+type ScalingPatternsReply struct {
+	Patterns []service.ScalingPattern
+}
+
+// Server is the RPC receiver of the ML service, registered as "MLService"
+type Server struct {
+	ml               *service.MLService
+	batchConcurrency int
+}
+
+// Predict returns the insights of a build
+func (s *Server) Predict(args PredictArgs, reply *service.PredictionResult) error {
+	if expired(args.Deadline) {
+		return ErrDeadlineExceeded
+	}
+	*reply = s.ml.GetWorkerBuildInsights(service.PredictionRequest{
+		ProjectPath:  args.ProjectPath,
+		TaskName:     args.TaskName,
+		BuildOptions: args.BuildOptions,
+		WorkerID:     args.WorkerID,
+		WorkerSpeed:  args.WorkerSpeed,
+		SubmittedAt:  args.SubmittedAt,
+		ClusterLoad:  args.ClusterLoad,
+	})
+	return nil
+}
+
+// PredictBatch returns the insights of several builds
+func (s *Server) PredictBatch(args PredictBatchArgs, reply *PredictBatchReply) error {
+	if expired(args.Deadline) {
+		return ErrDeadlineExceeded
+	}
+	reply.Predictions = s.ml.GetBatchBuildInsights(args.Requests, s.batchConcurrency)
+	return nil
+}
+
+// ScalingAdvice recommends how many workers the load needs
+func (s *Server) ScalingAdvice(args ScalingArgs, reply *service.ScalingRecommendation) error {
+	if expired(args.Deadline) {
+		return ErrDeadlineExceeded
+	}
+	*reply = s.ml.PredictScalingNeeds(args.QueueLength, args.AvgCPULoad, args.CurrentWorkers)
+	return nil
+}
+
+// TestDurations returns the recorded durations of a project's test classes
+func (s *Server) TestDurations(args TestDurationsArgs, reply *TestDurationsReply) error {
+	if expired(args.Deadline) {
+		return ErrDeadlineExceeded
+	}
+	reply.Durations = s.ml.GetTestDurations(args.ProjectPath)
+	return nil
+}
+
+// RecordTestResults records the test results of a build
+func (s *Server) RecordTestResults(args TestResultsArgs, reply *TestResultsReply) error {
+	if expired(args.Deadline) {
+		return ErrDeadlineExceeded
+	}
+	s.ml.RecordTestResults(args.Run)
+	return nil
+}
+
+// ScalingPatterns returns the learned scaling patterns
+func (s *Server) ScalingPatterns(args ScalingPatternsArgs, reply *ScalingPatternsReply) error {
+	if expired(args.Deadline) {
+		return ErrDeadlineExceeded
+	}
+	reply.Patterns = s.ml.ScalingPatterns()
+	return nil
+}
+
+func expired(deadline time.Time) bool {
+	return !deadline.IsZero() && time.Now().After(deadline)
+}
+
+// Serve serves the predictions of ml on the connections of listener until
+// it is closed. Batches are evaluated with at most batchConcurrency
+// predictions in parallel.
+func Serve(listener net.Listener, ml *service.MLService, batchConcurrency int) error {
+	server := rpc.NewServer()
+	if err := server.RegisterName("MLService", &Server{ml: ml, batchConcurrency: batchConcurrency}); err != nil {
+		return err
+	}
+	server.Accept(listener)
+	return nil
+}
+
+// Predictor answers predictions locally. *service.MLService is one.
+type Predictor interface {
+	GetBuildInsights(projectPath, taskName string, buildOptions map[string]string) service.PredictionResult
+	PredictScalingNeeds(queueLength int, avgCPULoad float64, currentWorkers int) service.ScalingRecommendation
+}
+
+// Client calls the ML service over a pool of RPC connections
+type Client struct {
+	address string
+	// timeout bounds calls whose context has no deadline
+	timeout time.Duration
+	// retryAfter is how long the ML service is considered down after a
+	// failed call, during which calls are answered by fallback
+	retryAfter time.Duration
+	// fallback answers while the ML service is down, nil to return the error
+	fallback Predictor
+
+	// slots limits the open connections, idle holds the unused ones
+	slots chan struct{}
+	idle  chan *rpc.Client
+
+	mutex     sync.Mutex
+	downUntil time.Time
+}
+
+// NewClient creates a client of the ML service at address keeping at most
+// poolSize connections
+func NewClient(address string, poolSize int, timeout time.Duration, fallback Predictor) *Client {
+	if poolSize <= 0 {
+		poolSize = DefaultPoolSize
+	}
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	return &Client{
+		address:    address,
+		timeout:    timeout,
+		retryAfter: DefaultRetryAfter,
+		fallback:   fallback,
+		slots:      make(chan struct{}, poolSize),
+		idle:       make(chan *rpc.Client, poolSize),
+	}
+}
+
+// ClientFromEnv creates a client of the ML service at ML_RPC_ADDR with
+// ML_RPC_POOL_SIZE connections and ML_RPC_TIMEOUT per call. It returns nil
+// when ML_RPC_ADDR is not set.
+func ClientFromEnv(fallback Predictor) (*Client, error) {
+	address := os.Getenv("ML_RPC_ADDR")
+	if address == "" {
+		return nil, nil
+	}
+
+	poolSize := DefaultPoolSize
+	if value := os.Getenv("ML_RPC_POOL_SIZE"); value != "" {
+		size, err := strconv.Atoi(value)
+		if err != nil || size <= 0 {
+			return nil, fmt.Errorf("invalid ML_RPC_POOL_SIZE %q", value)
+		}
+		poolSize = size
+	}
+	timeout := DefaultTimeout
+	if value := os.Getenv("ML_RPC_TIMEOUT"); value != "" {
+		duration, err := time.ParseDuration(value)
+		if err != nil || duration <= 0 {
+			return nil, fmt.Errorf("invalid ML_RPC_TIMEOUT %q", value)
+		}
+		timeout = duration
+	}
+	return NewClient(address, poolSize, timeout, fallback), nil
+}
+
+// Predict returns the insights of a build
+func (c *Client) Predict(ctx context.Context, projectPath, taskName string, buildOptions map[string]string) (service.PredictionResult, error) {
+	return c.PredictOnWorker(ctx, service.PredictionRequest{ProjectPath: projectPath, TaskName: taskName, BuildOptions: buildOptions})
+}
+
+// PredictOnWorker returns the insights of a build with its durations scaled
+// to the worker of the request. The fallback only knows the worker's
+// calibrated speed.
+func (c *Client) PredictOnWorker(ctx context.Context, request service.PredictionRequest) (service.PredictionResult, error) {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+
+	args := PredictArgs{
+		ProjectPath:  request.ProjectPath,
+		TaskName:     request.TaskName,
+		BuildOptions: request.BuildOptions,
+		WorkerID:     request.WorkerID,
+		WorkerSpeed:  request.WorkerSpeed,
+		SubmittedAt:  request.SubmittedAt,
+		ClusterLoad:  request.ClusterLoad,
+		Deadline:     deadline(ctx),
+	}
+	var reply service.PredictionResult
+	err := c.call(ctx, "MLService.Predict", args, &reply)
+	if err != nil && c.fallback != nil {
+		return c.predictLocally(request), nil
+	}
+	return reply, err
+}
+
+// PredictBatch returns the insights of several builds in request order
+func (c *Client) PredictBatch(ctx context.Context, requests []service.PredictionRequest) ([]service.PredictionResult, error) {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+
+	var reply PredictBatchReply
+	err := c.call(ctx, "MLService.PredictBatch", PredictBatchArgs{Requests: requests, Deadline: deadline(ctx)}, &reply)
+	if err != nil && c.fallback != nil {
+		predictions := make([]service.PredictionResult, len(requests))
+		for i, request := range requests {
+			predictions[i] = c.predictLocally(request)
+		}
+		return predictions, nil
+	}
+	return reply.Predictions, err
+}
+
+// predictLocally answers a prediction with the fallback, scaled to the
+// calibrated speed of the request's worker
+func (c *Client) predictLocally(request service.PredictionRequest) service.PredictionResult {
+	result := c.fallback.GetBuildInsights(request.ProjectPath, request.TaskName, request.BuildOptions)
+	if request.WorkerSpeed > 0 {
+		service.ScaleDurations(&result, 1/request.WorkerSpeed)
+	}
+	return result
+}
+
+// ScalingAdvice recommends how many workers the load needs
+func (c *Client) ScalingAdvice(ctx context.Context, queueLength int, avgCPULoad float64, currentWorkers int) (service.ScalingRecommendation, error) {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+
+	var reply service.ScalingRecommendation
+	err := c.call(ctx, "MLService.ScalingAdvice", ScalingArgs{QueueLength: queueLength, AvgCPULoad: avgCPULoad, CurrentWorkers: currentWorkers, Deadline: deadline(ctx)}, &reply)
+	if err != nil && c.fallback != nil {
+		return c.fallback.PredictScalingNeeds(queueLength, avgCPULoad, currentWorkers), nil
+	}
+	return reply, err
+}
+
+// TestDurations returns the recorded durations of a project's test classes.
+// The fallback has no history, so errors are returned while the ML service
+// is down.
+func (c *Client) TestDurations(ctx context.Context, projectPath string) (map[string]time.Duration, error) {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+
+	var reply TestDurationsReply
+	err := c.call(ctx, "MLService.TestDurations", TestDurationsArgs{ProjectPath: projectPath, Deadline: deadline(ctx)}, &reply)
+	return reply.Durations, err
+}
+
+// RecordTestResults records the test results of a build
+func (c *Client) RecordTestResults(ctx context.Context, run service.TestRun) error {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+
+	var reply TestResultsReply
+	return c.call(ctx, "MLService.RecordTestResults", TestResultsArgs{Run: run, Deadline: deadline(ctx)}, &reply)
+}
+
+// ScalingPatterns returns the expected load of each hour of the week. The
+// fallback has no history, so errors are returned while the ML service is
+// down.
+func (c *Client) ScalingPatterns(ctx context.Context) ([]service.ScalingPattern, error) {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
+
+	var reply ScalingPatternsReply
+	err := c.call(ctx, "MLService.ScalingPatterns", ScalingPatternsArgs{Deadline: deadline(ctx)}, &reply)
+	return reply.Patterns, err
+}
+
+// Close closes the idle connections
+func (c *Client) Close() {
+	for {
+		select {
+		case client := <-c.idle:
+			client.Close()
+			<-c.slots
+		default:
+			return
+		}
+	}
+}
+
+func (c *Client) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, c.timeout)
+}
+
+func deadline(ctx context.Context) time.Time {
+	deadline, _ := ctx.Deadline()
+	return deadline
+}
+
+// available reports whether the ML service is not known to be down
+func (c *Client) available() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return time.Now().After(c.downUntil)
+}
+
+// markDown answers calls locally for a while after the ML service failed
+func (c *Client) markDown(err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if time.Now().After(c.downUntil) {
+		log.Printf("ML service at %s unavailable, predicting locally for %s: %v", c.address, c.retryAfter, err)
+	}
+	c.downUntil = time.Now().Add(c.retryAfter)
+}
+
+// call runs a method on a pooled connection. Connections whose call failed
+// or timed out are closed rather than reused.
+func (c *Client) call(ctx context.Context, method string, args, reply any) error {
+	if !c.available() {
+		return fmt.Errorf("ML service at %s is down", c.address)
+	}
+
+	client, err := c.get(ctx)
+	if err != nil {
+		c.markDown(err)
+		return err
+	}
+
+	call := client.Go(method, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		var serverErr rpc.ServerError
+		if call.Error != nil && !errors.As(call.Error, &serverErr) {
+			c.discard(client)
+			c.markDown(call.Error)
+			return call.Error
+		}
+		c.put(client)
+		return call.Error
+	case <-ctx.Done():
+		c.discard(client)
+		c.markDown(ctx.Err())
+		return fmt.Errorf("%s: %v", method, ctx.Err())
+	}
+}
+
+// get returns an idle connection, or dials a new one while the pool has
+// room, waiting for one to be returned otherwise
+func (c *Client) get(ctx context.Context) (*rpc.Client, error) {
+	select {
+	case client := <-c.idle:
+		return client, nil
+	default:
+	}
+
+	select {
+	case client := <-c.idle:
+		return client, nil
+	case c.slots <- struct{}{}:
+		dialer := net.Dialer{}
+		conn, err := dialer.DialContext(ctx, "tcp", c.address)
+		if err != nil {
+			<-c.slots
+			return nil, fmt.Errorf("failed to connect to the ML service: %v", err)
+		}
+		return rpc.NewClient(conn), nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("no ML service connection available: %v", ctx.Err())
+	}
+}
+
+func (c *Client) put(client *rpc.Client) {
+	c.idle <- client
+}
+
+func (c *Client) discard(client *rpc.Client) {
+	client.Close()
+	<-c.slots
+}
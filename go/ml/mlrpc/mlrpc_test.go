@@ -0,0 +1,177 @@
+package mlrpc
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"distributed-gradle-building/ml/service"
+	"distributed-gradle-building/testshard"
+)
+
+// countingListener counts the connections it accepted
+type countingListener struct {
+	net.Listener
+	accepted atomic.Int32
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.accepted.Add(1)
+	}
+	return conn, err
+}
+
+func startServer(t *testing.T) *countingListener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	counting := &countingListener{Listener: listener}
+	go Serve(counting, service.NewMLService(), 2)
+	t.Cleanup(func() { listener.Close() })
+	return counting
+}
+
+// stubPredictor answers every prediction with a fixed duration
+type stubPredictor struct{}
+
+func (stubPredictor) GetBuildInsights(projectPath, taskName string, buildOptions map[string]string) service.PredictionResult {
+	return service.PredictionResult{PredictedTime: time.Minute, Basis: "local"}
+}
+
+func (stubPredictor) PredictScalingNeeds(queueLength int, avgCPULoad float64, currentWorkers int) service.ScalingRecommendation {
+	return service.ScalingRecommendation{Action: "maintain", WorkersNeeded: currentWorkers}
+}
+
+func TestPredictions(t *testing.T) {
+	listener := startServer(t)
+	client := NewClient(listener.Addr().String(), 2, time.Second, nil)
+	defer client.Close()
+
+	result, err := client.Predict(context.Background(), "/projects/app", "build", nil)
+	if err != nil {
+		t.Fatalf("Predict failed: %v", err)
+	}
+	if result.PredictedTime <= 0 || result.Basis == "local" {
+		t.Errorf("Expected a prediction of the ML service, got %+v", result)
+	}
+
+	results, err := client.PredictBatch(context.Background(), []service.PredictionRequest{
+		{ProjectPath: "/projects/app", TaskName: "build"},
+		{ProjectPath: "/projects/lib", TaskName: "test"},
+	})
+	if err != nil || len(results) != 2 {
+		t.Fatalf("Expected two predictions, got %d: %v", len(results), err)
+	}
+
+	advice, err := client.ScalingAdvice(context.Background(), 30, 0.95, 2)
+	if err != nil || advice.Action != "scale_up" {
+		t.Errorf("Expected advice to scale up, got %+v, %v", advice, err)
+	}
+
+	run := service.TestRun{ProjectPath: "/projects/app", BuildID: "build-1", Classes: []testshard.ClassResult{{Name: "AppTest", Tests: 1, Duration: time.Second}}}
+	if err := client.RecordTestResults(context.Background(), run); err != nil {
+		t.Fatalf("RecordTestResults failed: %v", err)
+	}
+	durations, err := client.TestDurations(context.Background(), "/projects/app")
+	if err != nil || durations["AppTest"] != time.Second {
+		t.Errorf("Expected the recorded test durations, got %v, %v", durations, err)
+	}
+	if patterns, err := client.ScalingPatterns(context.Background()); err != nil || len(patterns) != 0 {
+		t.Errorf("Expected no scaling patterns before training, got %v, %v", patterns, err)
+	}
+
+	// Connections are reused, and never more than the pool size are opened
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := client.Predict(context.Background(), "/projects/app", "build", nil); err != nil {
+				t.Errorf("Predict failed: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if accepted := listener.accepted.Load(); accepted < 1 || accepted > 2 {
+		t.Errorf("Expected at most 2 connections, got %d", accepted)
+	}
+}
+
+func TestDeadline(t *testing.T) {
+	listener := startServer(t)
+	client := NewClient(listener.Addr().String(), 1, time.Second, nil)
+	defer client.Close()
+
+	// The server refuses calls whose caller stopped waiting
+	var reply service.PredictionResult
+	server := &Server{ml: service.NewMLService()}
+	if err := server.Predict(PredictArgs{Deadline: time.Now().Add(-time.Second)}, &reply); err != ErrDeadlineExceeded {
+		t.Errorf("Expected ErrDeadlineExceeded, got %v", err)
+	}
+
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	if _, err := client.Predict(ctx, "/projects/app", "build", nil); err == nil {
+		t.Error("Expected a call past its deadline to fail")
+	}
+}
+
+func TestFallback(t *testing.T) {
+	// Nothing listens on the address of a closed listener
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	address := listener.Addr().String()
+	listener.Close()
+
+	client := NewClient(address, 1, 100*time.Millisecond, stubPredictor{})
+	result, err := client.Predict(context.Background(), "/projects/app", "build", nil)
+	if err != nil || result.Basis != "local" {
+		t.Errorf("Expected the local prediction, got %+v, %v", result, err)
+	}
+	if client.available() {
+		t.Error("Expected the ML service to be considered down")
+	}
+	results, _ := client.PredictBatch(context.Background(), []service.PredictionRequest{{ProjectPath: "/projects/app"}})
+	if len(results) != 1 || results[0].Basis != "local" {
+		t.Errorf("Expected local batch predictions, got %+v", results)
+	}
+	// Local predictions are scaled to the calibrated speed of the worker
+	result, _ = client.PredictOnWorker(context.Background(), service.PredictionRequest{ProjectPath: "/projects/app", WorkerSpeed: 2})
+	if result.PredictedTime != 30*time.Second || result.WorkerFactor != 0.5 {
+		t.Errorf("Expected half the local prediction on a worker twice as fast, got %+v", result)
+	}
+
+	// Without a fallback the error is returned
+	client = NewClient(address, 1, 100*time.Millisecond, nil)
+	if _, err := client.ScalingAdvice(context.Background(), 1, 0.5, 1); err == nil {
+		t.Error("Expected an error without a fallback")
+	}
+}
+
+func TestClientFromEnv(t *testing.T) {
+	t.Setenv("ML_RPC_ADDR", "")
+	if client, err := ClientFromEnv(nil); client != nil || err != nil {
+		t.Errorf("Expected no client by default, got %v, %v", client, err)
+	}
+
+	t.Setenv("ML_RPC_ADDR", "ml-service:9082")
+	t.Setenv("ML_RPC_POOL_SIZE", "8")
+	t.Setenv("ML_RPC_TIMEOUT", "50ms")
+	client, err := ClientFromEnv(stubPredictor{})
+	if err != nil {
+		t.Fatalf("ClientFromEnv failed: %v", err)
+	}
+	if client.address != "ml-service:9082" || cap(client.slots) != 8 || client.timeout != 50*time.Millisecond {
+		t.Errorf("Unexpected client %+v", client)
+	}
+
+	t.Setenv("ML_RPC_TIMEOUT", "soon")
+	if _, err := ClientFromEnv(nil); err == nil {
+		t.Error("Expected an invalid timeout to be rejected")
+	}
+}
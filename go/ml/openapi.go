@@ -0,0 +1,218 @@
+package main
+
+import (
+	"distributed-gradle-building/audit"
+	"distributed-gradle-building/ml/service"
+	"distributed-gradle-building/openapi"
+	"distributed-gradle-building/tracing"
+)
+
+// mlOpenAPI describes the ML service HTTP API
+func mlOpenAPI() *openapi.Document {
+	doc := openapi.New("Distributed Gradle Building ML API", "1.0.0",
+		"Build predictions, scaling advice and continuous learning")
+
+	doc.Add(openapi.Route{
+		Method:      "GET",
+		Path:        "/health",
+		Summary:     "Check ML service health",
+		OperationID: "healthCheck",
+		Response:    HealthStatus{},
+	})
+	doc.Add(openapi.Route{
+		Method:      "POST",
+		Path:        "/api/predict",
+		Summary:     "Predict the outcome of a build",
+		OperationID: "predict",
+		Request:     PredictRequest{},
+		Response:    service.PredictionResult{},
+	})
+	doc.Add(openapi.Route{
+		Method:      "POST",
+		Path:        "/api/predict/batch",
+		Summary:     "Predict the outcomes of several builds",
+		OperationID: "predictBatch",
+		Request:     []service.PredictionRequest{},
+		Response:    BatchPredictResponse{},
+	})
+	doc.Add(openapi.Route{
+		Method:      "POST",
+		Path:        "/api/train",
+		Summary:     "Start retraining the models in the background",
+		OperationID: "train",
+		Response:    service.TrainingJob{},
+	})
+	doc.Add(openapi.Route{
+		Method:      "GET",
+		Path:        "/api/train/{id}",
+		Summary:     "Get the status and progress of a training job",
+		OperationID: "getTrainingJob",
+		Parameters:  []openapi.Parameter{openapi.PathParam("id", "Training job ID returned when training started")},
+		Response:    service.TrainingJob{},
+	})
+	doc.Add(openapi.Route{
+		Method:      "GET",
+		Path:        "/api/scaling",
+		Summary:     "Get scaling advice",
+		OperationID: "getScalingAdvice",
+		Parameters: []openapi.Parameter{
+			openapi.QueryParam("queue_length", "integer", "", "Number of queued builds"),
+			openapi.QueryParam("cpu_load", "number", "double", "Average CPU load between 0 and 1"),
+			openapi.QueryParam("current_workers", "integer", "", "Number of running workers"),
+		},
+		Response: service.ScalingRecommendation{},
+	})
+	doc.Add(openapi.Route{
+		Method:      "GET",
+		Path:        "/api/stats",
+		Summary:     "Get model statistics",
+		OperationID: "getStats",
+		Response:    map[string]any{},
+	})
+	doc.Add(openapi.Route{
+		Method:      "GET",
+		Path:        "/api/learning",
+		Summary:     "Get continuous learning statistics",
+		OperationID: "getLearningStats",
+		Response:    map[string]any{},
+	})
+	doc.Add(openapi.Route{
+		Method:      "GET",
+		Path:        "/api/rollback",
+		Summary:     "List stored model versions",
+		OperationID: "listModelVersions",
+		Response:    ModelVersionsResponse{},
+	})
+	doc.Add(openapi.Route{
+		Method:      "POST",
+		Path:        "/api/rollback",
+		Summary:     "Restore a stored model version",
+		OperationID: "rollback",
+		Request:     RollbackRequest{},
+		Response:    StatusResponse{},
+	})
+	doc.Add(openapi.Route{
+		Method:      "GET",
+		Path:        "/api/projects",
+		Summary:     "List the models of projects and project groups",
+		OperationID: "listProjectModels",
+		Response:    ProjectModelsResponse{},
+	})
+	doc.Add(openapi.Route{
+		Method:      "GET",
+		Path:        "/api/projects/models",
+		Summary:     "Get the models of a project or project group",
+		OperationID: "getProjectModel",
+		Parameters:  []openapi.Parameter{openapi.QueryParam("project", "string", "", "Project path or group name")},
+		Response:    service.ProjectModel{},
+	})
+	doc.Add(openapi.Route{
+		Method:      "POST",
+		Path:        "/api/projects/train",
+		Summary:     "Train the models of a project or project group, creating them if needed",
+		OperationID: "trainProjectModel",
+		Request:     ProjectModelRequest{},
+		Response:    service.ProjectModelInfo{},
+	})
+	doc.Add(openapi.Route{
+		Method:      "POST",
+		Path:        "/api/projects/rollback",
+		Summary:     "Restore a previous version of the models of a project or project group",
+		OperationID: "rollbackProjectModel",
+		Request:     ProjectModelRequest{},
+		Response:    StatusResponse{},
+	})
+	doc.Add(openapi.Route{
+		Method:      "GET",
+		Path:        "/api/anomalies",
+		Summary:     "List detected build anomalies",
+		OperationID: "getAnomalies",
+		Parameters:  []openapi.Parameter{openapi.QueryParam("since", "string", "date-time", "Only return anomalies detected after this time")},
+		Response:    AnomaliesResponse{},
+	})
+	doc.Add(openapi.Route{
+		Method:      "POST",
+		Path:        "/api/failures/classify",
+		Summary:     "Classify a build failure from its log, with mitigation hints",
+		OperationID: "classifyFailure",
+		Request:     ClassifyFailureRequest{},
+		Response:    service.FailureClassification{},
+	})
+	doc.Add(openapi.Route{
+		Method:      "GET",
+		Path:        "/api/tests/durations",
+		Summary:     "Get the recorded durations of a project's test classes",
+		OperationID: "getTestDurations",
+		Parameters:  []openapi.Parameter{openapi.QueryParam("project", "string", "", "Project path")},
+		Response:    TestDurationsResponse{},
+	})
+	doc.Add(openapi.Route{
+		Method:      "GET",
+		Path:        "/api/flaky-tests",
+		Summary:     "List the flaky test cases of a project with quarantine suggestions",
+		OperationID: "getFlakyTests",
+		Parameters:  []openapi.Parameter{openapi.QueryParam("project", "string", "", "Project path")},
+		Response:    FlakyTestsResponse{},
+	})
+	trendParams := []openapi.Parameter{
+		openapi.QueryParam("project", "string", "", "Only return this project path"),
+		openapi.QueryParam("since", "string", "date-time", "Only return days from this time on"),
+	}
+	doc.Add(openapi.Route{
+		Method:      "GET",
+		Path:        "/api/trends",
+		Summary:     "Daily build summaries per project, from build records and rolled-up aggregates",
+		OperationID: "getTrends",
+		Parameters:  trendParams,
+		Response:    TrendsResponse{},
+	})
+	doc.Add(openapi.Route{
+		Method:      "GET",
+		Path:        "/api/export",
+		Summary:     "Export training data",
+		OperationID: "exportData",
+		Response:    map[string]any{},
+	})
+	doc.Add(openapi.Route{
+		Method:      "GET",
+		Path:        "/api/export/rollups",
+		Summary:     "Export the per-project daily aggregates of rolled-up build records",
+		OperationID: "exportRollups",
+		Parameters:  trendParams,
+		Response:    []service.DailyAggregate{},
+	})
+	doc.Add(openapi.Route{
+		Method:      "GET",
+		Path:        "/api/export/ndjson",
+		Summary:     "Export training data one record per line, a page at a time; the next page's cursor is in X-Next-Cursor",
+		OperationID: "exportDataNDJSON",
+		Parameters: []openapi.Parameter{
+			openapi.QueryParam("sections", "string", "", "Comma-separated sections to export: build_history, worker_metrics, cache_metrics, daily_aggregates, models"),
+			openapi.QueryParam("cursor", "string", "", "X-Next-Cursor of the previous page"),
+			openapi.QueryParam("limit", "integer", "", "Lines per page, at most 10000 (default 1000)"),
+		},
+		Response: service.NDJSONLine{},
+	})
+	doc.Add(openapi.Route{
+		Method:      "POST",
+		Path:        "/api/import",
+		Summary:     "Import training data exported by /api/export, validating every record",
+		OperationID: "importData",
+		Parameters: []openapi.Parameter{
+			openapi.QueryParam("dry_run", "boolean", "", "Validate the data without importing it"),
+			openapi.QueryParam("sections", "string", "", "Comma-separated sections to import: build_history, worker_metrics, cache_metrics, daily_aggregates, models"),
+		},
+		Request:  map[string]any{},
+		Response: ImportResponse{},
+	})
+	doc.Add(audit.Route())
+	doc.Add(tracing.Route())
+	doc.Add(openapi.Route{
+		Method:      "GET",
+		Path:        "/metrics",
+		Summary:     "Prometheus metrics",
+		OperationID: "getMetrics",
+	})
+
+	return doc
+}
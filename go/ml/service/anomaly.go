@@ -0,0 +1,207 @@
+package service
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// Anomaly types reported by the detector
+const (
+	AnomalyBuildDuration      = "build_duration"
+	AnomalyWorkerResponseTime = "worker_response_time"
+)
+
+// AnomalyConfig configures the EWMA based anomaly detector
+type AnomalyConfig struct {
+	Enabled    bool    `json:"enabled"`
+	Alpha      float64 `json:"alpha"`
+	Threshold  float64 `json:"threshold"`
+	MinSamples int     `json:"min_samples"`
+}
+
+// Anomaly describes an observation far outside its historical distribution
+type Anomaly struct {
+	ID        string    `json:"id"`
+	Type      string    `json:"type"`
+	Severity  string    `json:"severity"`
+	Subject   string    `json:"subject"`
+	Key       string    `json:"key"`
+	Value     float64   `json:"value"`
+	Mean      float64   `json:"mean"`
+	StdDev    float64   `json:"std_dev"`
+	ZScore    float64   `json:"z_score"`
+	Message   string    `json:"message"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// ewmaStats tracks an exponentially weighted mean and variance
+type ewmaStats struct {
+	mean     float64
+	variance float64
+	count    int
+}
+
+// AnomalyDetector flags values deviating from an exponentially weighted baseline
+type AnomalyDetector struct {
+	config AnomalyConfig
+	stats  map[string]*ewmaStats
+	mutex  sync.Mutex
+}
+
+// NewAnomalyDetector creates an anomaly detector
+func NewAnomalyDetector(config AnomalyConfig) *AnomalyDetector {
+	return &AnomalyDetector{
+		config: config,
+		stats:  make(map[string]*ewmaStats),
+	}
+}
+
+// Observe scores a value against the baseline for key and then folds it into
+// the baseline. It returns the z-score, the baseline mean and standard
+// deviation, and whether enough samples existed to score the value.
+func (ad *AnomalyDetector) Observe(key string, value float64) (float64, float64, float64, bool) {
+	ad.mutex.Lock()
+	defer ad.mutex.Unlock()
+
+	stats, exists := ad.stats[key]
+	if !exists {
+		ad.stats[key] = &ewmaStats{mean: value, count: 1}
+		return 0, value, 0, false
+	}
+
+	mean := stats.mean
+	stdDev := math.Sqrt(stats.variance)
+	scored := stats.count >= ad.config.MinSamples
+
+	z := 0.0
+	if stdDev > 0 {
+		z = (value - mean) / stdDev
+	} else if value != mean {
+		// A flat baseline has no spread; treat any relative deviation above 50% as extreme
+		if mean != 0 && math.Abs(value-mean)/math.Abs(mean) > 0.5 {
+			z = math.Copysign(ad.config.Threshold*2, value-mean)
+		}
+	}
+
+	// Update the EWMA mean and variance
+	diff := value - stats.mean
+	increment := ad.config.Alpha * diff
+	stats.mean += increment
+	stats.variance = (1 - ad.config.Alpha) * (stats.variance + diff*increment)
+	stats.count++
+
+	return z, mean, stdDev, scored
+}
+
+// anomalySeverity maps a z-score to an alert severity
+func (ad *AnomalyDetector) anomalySeverity(z float64) string {
+	if math.Abs(z) >= ad.config.Threshold*2 {
+		return "critical"
+	}
+	return "warning"
+}
+
+// loadAnomalyConfig loads anomaly detection settings from environment variables
+func (ml *MLService) loadAnomalyConfig() {
+	ml.AnomalyDetection.Enabled = getEnvAsBool("ML_ANOMALY_DETECTION_ENABLED", ml.AnomalyDetection.Enabled)
+	ml.AnomalyDetection.Alpha = getEnvAsFloat("ML_ANOMALY_ALPHA", ml.AnomalyDetection.Alpha)
+	ml.AnomalyDetection.Threshold = getEnvAsFloat("ML_ANOMALY_THRESHOLD", ml.AnomalyDetection.Threshold)
+	ml.AnomalyDetection.MinSamples = getEnvAsInt("ML_ANOMALY_MIN_SAMPLES", ml.AnomalyDetection.MinSamples)
+}
+
+// checkBuildAnomaly scores a completed build against its project/task history.
+// Must be called with the service mutex held.
+func (ml *MLService) checkBuildAnomaly(record BuildRecord) {
+	if ml.anomalyDetector == nil || !ml.AnomalyDetection.Enabled || !record.Success || record.Duration <= 0 {
+		return
+	}
+
+	key := fmt.Sprintf("%s:%s", record.ProjectPath, record.TaskName)
+	seconds := record.Duration.Seconds()
+
+	z, mean, stdDev, scored := ml.anomalyDetector.Observe(key, seconds)
+	if !scored || math.Abs(z) < ml.AnomalyDetection.Threshold {
+		return
+	}
+
+	direction := "slower"
+	if z < 0 {
+		direction = "faster"
+	}
+
+	ml.recordAnomaly(Anomaly{
+		Type:     AnomalyBuildDuration,
+		Severity: ml.anomalyDetector.anomalySeverity(z),
+		Subject:  record.BuildID,
+		Key:      key,
+		Value:    seconds,
+		Mean:     mean,
+		StdDev:   stdDev,
+		ZScore:   z,
+		Message: fmt.Sprintf("Build %s for %s took %.1fs, %s than usual (mean %.1fs, z=%.1f)",
+			record.BuildID, key, seconds, direction, mean, z),
+		Timestamp: record.EndTime,
+	})
+}
+
+// checkWorkerAnomaly flags workers whose response time degrades.
+// Must be called with the service mutex held.
+func (ml *MLService) checkWorkerAnomaly(metric WorkerMetric) {
+	if ml.anomalyDetector == nil || !ml.AnomalyDetection.Enabled || metric.ResponseTime <= 0 {
+		return
+	}
+
+	key := "worker:" + metric.WorkerID
+	millis := float64(metric.ResponseTime) / float64(time.Millisecond)
+
+	z, mean, stdDev, scored := ml.anomalyDetector.Observe(key, millis)
+	// Only degradation is interesting; faster responses are not alerted on
+	if !scored || z < ml.AnomalyDetection.Threshold {
+		return
+	}
+
+	ml.recordAnomaly(Anomaly{
+		Type:     AnomalyWorkerResponseTime,
+		Severity: ml.anomalyDetector.anomalySeverity(z),
+		Subject:  metric.WorkerID,
+		Key:      key,
+		Value:    millis,
+		Mean:     mean,
+		StdDev:   stdDev,
+		ZScore:   z,
+		Message: fmt.Sprintf("Worker %s response time degraded to %.0fms (mean %.0fms, z=%.1f)",
+			metric.WorkerID, millis, mean, z),
+		Timestamp: metric.Timestamp,
+	})
+}
+
+// recordAnomaly stores an anomaly. Must be called with the service mutex held.
+func (ml *MLService) recordAnomaly(anomaly Anomaly) {
+	if anomaly.Timestamp.IsZero() {
+		anomaly.Timestamp = time.Now()
+	}
+	anomaly.ID = fmt.Sprintf("anomaly_%d", time.Now().UnixNano())
+
+	// Keep only the last 1000 anomalies
+	if len(ml.Anomalies) >= 1000 {
+		ml.Anomalies = ml.Anomalies[1:]
+	}
+	ml.Anomalies = append(ml.Anomalies, anomaly)
+}
+
+// GetAnomalies returns anomalies detected after since, oldest first
+func (ml *MLService) GetAnomalies(since time.Time) []Anomaly {
+	ml.mutex.RLock()
+	defer ml.mutex.RUnlock()
+
+	result := make([]Anomaly, 0)
+	for _, anomaly := range ml.Anomalies {
+		if anomaly.Timestamp.After(since) {
+			result = append(result, anomaly)
+		}
+	}
+
+	return result
+}
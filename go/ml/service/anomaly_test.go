@@ -0,0 +1,141 @@
+package service
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestAnomalyDetectorObserve(t *testing.T) {
+	detector := NewAnomalyDetector(AnomalyConfig{Enabled: true, Alpha: 0.1, Threshold: 3.0, MinSamples: 5})
+
+	for i := 0; i < 20; i++ {
+		value := 100.0 + float64(i%3) // 100, 101, 102
+		if _, _, _, scored := detector.Observe("key", value); scored && i < 5 {
+			t.Errorf("Expected observation %d not to be scored before min samples", i)
+		}
+	}
+
+	z, mean, _, scored := detector.Observe("key", 101)
+	if !scored {
+		t.Fatal("Expected observation to be scored after min samples")
+	}
+	if z > 3.0 || z < -3.0 {
+		t.Errorf("Expected normal value to have small z-score, got %f", z)
+	}
+	if mean < 99 || mean > 103 {
+		t.Errorf("Expected baseline mean around 101, got %f", mean)
+	}
+
+	z, _, _, _ = detector.Observe("key", 500)
+	if z < 3.0 {
+		t.Errorf("Expected outlier to exceed threshold, got z-score %f", z)
+	}
+}
+
+func TestBuildDurationAnomaly(t *testing.T) {
+	service := NewMLService()
+	now := time.Now()
+
+	for i := 0; i < 15; i++ {
+		service.RecordBuild(Build{
+			ID:          fmt.Sprintf("build-%d", i),
+			ProjectPath: "/test/project",
+			TaskName:    "build",
+			StartTime:   now,
+			EndTime:     now.Add(time.Duration(60+i%3) * time.Second),
+			Success:     true,
+		})
+	}
+
+	if anomalies := service.GetAnomalies(time.Time{}); len(anomalies) != 0 {
+		t.Fatalf("Expected no anomalies for stable builds, got %d", len(anomalies))
+	}
+
+	service.RecordBuild(Build{
+		ID:          "slow-build",
+		ProjectPath: "/test/project",
+		TaskName:    "build",
+		StartTime:   now,
+		EndTime:     now.Add(10 * time.Minute),
+		Success:     true,
+	})
+
+	anomalies := service.GetAnomalies(time.Time{})
+	if len(anomalies) != 1 {
+		t.Fatalf("Expected 1 anomaly, got %d", len(anomalies))
+	}
+	if anomalies[0].Type != AnomalyBuildDuration {
+		t.Errorf("Expected %s anomaly, got %s", AnomalyBuildDuration, anomalies[0].Type)
+	}
+	if anomalies[0].Subject != "slow-build" {
+		t.Errorf("Expected anomaly subject slow-build, got %s", anomalies[0].Subject)
+	}
+	if anomalies[0].Severity != "critical" {
+		t.Errorf("Expected critical severity, got %s", anomalies[0].Severity)
+	}
+
+	if recent := service.GetAnomalies(anomalies[0].Timestamp); len(recent) != 0 {
+		t.Errorf("Expected no anomalies after the last one, got %d", len(recent))
+	}
+}
+
+func TestWorkerResponseTimeAnomaly(t *testing.T) {
+	service := NewMLService()
+	now := time.Now()
+
+	for i := 0; i < 15; i++ {
+		service.RecordWorkerMetrics(WorkerMetric{
+			WorkerID:     "worker-1",
+			Timestamp:    now.Add(time.Duration(i) * time.Second),
+			ResponseTime: time.Duration(100+i%5) * time.Millisecond,
+		})
+	}
+
+	// Faster responses are not anomalies worth alerting on
+	service.RecordWorkerMetrics(WorkerMetric{
+		WorkerID:     "worker-1",
+		Timestamp:    now.Add(20 * time.Second),
+		ResponseTime: 10 * time.Millisecond,
+	})
+	if anomalies := service.GetAnomalies(time.Time{}); len(anomalies) != 0 {
+		t.Fatalf("Expected no anomalies for faster responses, got %d", len(anomalies))
+	}
+
+	service.RecordWorkerMetrics(WorkerMetric{
+		WorkerID:     "worker-1",
+		Timestamp:    now.Add(30 * time.Second),
+		ResponseTime: 2 * time.Second,
+	})
+
+	anomalies := service.GetAnomalies(time.Time{})
+	if len(anomalies) != 1 {
+		t.Fatalf("Expected 1 anomaly, got %d", len(anomalies))
+	}
+	if anomalies[0].Type != AnomalyWorkerResponseTime || anomalies[0].Subject != "worker-1" {
+		t.Errorf("Expected worker response time anomaly for worker-1, got %+v", anomalies[0])
+	}
+}
+
+func TestAnomalyDetectionDisabled(t *testing.T) {
+	service := NewMLService()
+	service.AnomalyDetection.Enabled = false
+	now := time.Now()
+
+	for i := 0; i < 15; i++ {
+		service.RecordWorkerMetrics(WorkerMetric{
+			WorkerID:     "worker-1",
+			Timestamp:    now,
+			ResponseTime: 100 * time.Millisecond,
+		})
+	}
+	service.RecordWorkerMetrics(WorkerMetric{
+		WorkerID:     "worker-1",
+		Timestamp:    now,
+		ResponseTime: 5 * time.Second,
+	})
+
+	if anomalies := service.GetAnomalies(time.Time{}); len(anomalies) != 0 {
+		t.Errorf("Expected no anomalies when detection is disabled, got %d", len(anomalies))
+	}
+}
@@ -0,0 +1,225 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"distributed-gradle-building/metrics"
+)
+
+// Data collection sources
+const (
+	SourceMonitor     = "monitor"
+	SourceCoordinator = "coordinator"
+)
+
+// Circuit breaker states of a data collection source
+const (
+	CircuitClosed   = "closed"
+	CircuitOpen     = "open"
+	CircuitHalfOpen = "half_open"
+)
+
+// CollectionConfig configures how data is fetched from the monitor and
+// coordinator. A failed fetch is retried MaxRetries times, waiting
+// RetryBackoff and doubling the wait up to MaxBackoff. After
+// FailureThreshold failed collections in a row the source's circuit opens
+// and it is skipped for OpenDuration, after which one trial collection
+// decides whether it closes again. Collected records wait in a queue of
+// QueueSize, dropping the oldest when full, and are added BatchSize at a
+// time.
+type CollectionConfig struct {
+	Timeout          time.Duration `json:"timeout"`
+	MaxRetries       int           `json:"max_retries"`
+	RetryBackoff     time.Duration `json:"retry_backoff"`
+	MaxBackoff       time.Duration `json:"max_backoff"`
+	FailureThreshold int           `json:"failure_threshold"`
+	OpenDuration     time.Duration `json:"open_duration"`
+	QueueSize        int           `json:"queue_size"`
+	BatchSize        int           `json:"batch_size"`
+}
+
+// SourceHealth is the collection status of a data source
+type SourceHealth struct {
+	Source              string    `json:"source"`
+	URL                 string    `json:"url"`
+	State               string    `json:"state"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	LastSuccess         time.Time `json:"last_success"`
+	LastFailure         time.Time `json:"last_failure"`
+	LastError           string    `json:"last_error,omitempty"`
+	// OpenUntil is when an open circuit lets the next collection through
+	OpenUntil time.Time `json:"open_until"`
+}
+
+// loadCollectionConfig loads data collection retry and circuit breaker
+// settings from environment variables
+func (ml *MLService) loadCollectionConfig() {
+	ml.Collection.Timeout = getEnvAsDuration("ML_COLLECTION_TIMEOUT", ml.Collection.Timeout)
+	ml.Collection.MaxRetries = getEnvAsInt("ML_COLLECTION_MAX_RETRIES", ml.Collection.MaxRetries)
+	ml.Collection.RetryBackoff = getEnvAsDuration("ML_COLLECTION_RETRY_BACKOFF", ml.Collection.RetryBackoff)
+	ml.Collection.MaxBackoff = getEnvAsDuration("ML_COLLECTION_MAX_BACKOFF", ml.Collection.MaxBackoff)
+	ml.Collection.FailureThreshold = getEnvAsInt("ML_COLLECTION_FAILURE_THRESHOLD", ml.Collection.FailureThreshold)
+	ml.Collection.OpenDuration = getEnvAsDuration("ML_COLLECTION_OPEN_DURATION", ml.Collection.OpenDuration)
+	ml.Collection.QueueSize = getEnvAsInt("ML_COLLECTION_QUEUE_SIZE", ml.Collection.QueueSize)
+	ml.Collection.BatchSize = getEnvAsInt("ML_COLLECTION_BATCH_SIZE", ml.Collection.BatchSize)
+}
+
+// circuitBreaker tracks the health of a data source and suspends collection
+// from it after repeated failures
+type circuitBreaker struct {
+	mutex  sync.Mutex
+	health SourceHealth
+}
+
+// newCircuitBreaker returns a closed circuit breaker for a source
+func newCircuitBreaker(source string) *circuitBreaker {
+	b := &circuitBreaker{health: SourceHealth{Source: source, State: CircuitClosed}}
+	b.report()
+	return b
+}
+
+// allow reports whether the source may be collected from. An open circuit
+// lets one trial collection through once its open duration has passed.
+func (b *circuitBreaker) allow(now time.Time) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	switch b.health.State {
+	case CircuitOpen:
+		if now.Before(b.health.OpenUntil) {
+			return false
+		}
+		b.health.State = CircuitHalfOpen
+		b.report()
+	}
+	return true
+}
+
+// succeeded closes the circuit after a successful collection
+func (b *circuitBreaker) succeeded(now time.Time) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.health.State != CircuitClosed {
+		log.Printf("Data collection from %s recovered", b.health.Source)
+	}
+	b.health.State = CircuitClosed
+	b.health.ConsecutiveFailures = 0
+	b.health.LastSuccess = now
+	b.health.LastError = ""
+	b.health.OpenUntil = time.Time{}
+	b.report()
+}
+
+// failed counts a failed collection and opens the circuit once failures
+// reach the threshold, or again if its trial collection failed
+func (b *circuitBreaker) failed(now time.Time, err error, config CollectionConfig) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.health.ConsecutiveFailures++
+	b.health.LastFailure = now
+	b.health.LastError = err.Error()
+	if b.health.State == CircuitHalfOpen || b.health.ConsecutiveFailures >= config.FailureThreshold {
+		b.health.State = CircuitOpen
+		b.health.OpenUntil = now.Add(config.OpenDuration)
+		log.Printf("Suspending data collection from %s until %s after %d failed collections: %v",
+			b.health.Source, b.health.OpenUntil.Format(time.RFC3339), b.health.ConsecutiveFailures, err)
+	}
+	b.report()
+}
+
+// snapshot returns the current health of the source
+func (b *circuitBreaker) snapshot() SourceHealth {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.health
+}
+
+// report updates the collection health gauges. Must be called with the
+// mutex held.
+func (b *circuitBreaker) report() {
+	source := b.health.Source
+	up, open := 0.0, 0.0
+	if b.health.ConsecutiveFailures == 0 {
+		up = 1
+	}
+	if b.health.State == CircuitOpen {
+		open = 1
+	}
+	metrics.CollectionStatus.WithLabelValues(source).Set(up)
+	metrics.CollectionCircuits.WithLabelValues(source).Set(open)
+	metrics.CollectionFailures.WithLabelValues(source).Set(float64(b.health.ConsecutiveFailures))
+}
+
+// fetch decodes the JSON served at url into data, retrying with exponential
+// backoff. It returns false without a request while the source's circuit is
+// open, and false after every attempt failed.
+func (ml *MLService) fetch(source, url string, data any) bool {
+	breaker := ml.breakers[source]
+	breaker.mutex.Lock()
+	breaker.health.URL = url
+	breaker.mutex.Unlock()
+	if !breaker.allow(time.Now()) {
+		return false
+	}
+
+	config := ml.Collection
+	client := &http.Client{Timeout: config.Timeout}
+	backoff := config.RetryBackoff
+	var err error
+	for attempt := 0; ; attempt++ {
+		if err = getJSON(client, url, data); err == nil {
+			breaker.succeeded(time.Now())
+			return true
+		}
+		if attempt >= config.MaxRetries {
+			break
+		}
+
+		log.Printf("Failed to collect data from %s, retrying in %s: %v", source, backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-ml.shutdown:
+			return false
+		}
+		if backoff *= 2; backoff > config.MaxBackoff {
+			backoff = config.MaxBackoff
+		}
+	}
+
+	log.Printf("Failed to collect data from %s: %v", source, err)
+	breaker.failed(time.Now(), err, config)
+	return false
+}
+
+// getJSON decodes the JSON served at url into data
+func getJSON(client *http.Client, url string, data any) error {
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(data); err != nil {
+		return fmt.Errorf("failed to decode response: %v", err)
+	}
+	return nil
+}
+
+// CollectionHealth returns the collection status of each data source
+func (ml *MLService) CollectionHealth() map[string]SourceHealth {
+	health := make(map[string]SourceHealth, len(ml.breakers))
+	for source, breaker := range ml.breakers {
+		health[source] = breaker.snapshot()
+	}
+	return health
+}
@@ -0,0 +1,91 @@
+package service
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCollectionRetriesWithBackoff(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The coordinator fails twice before answering
+		if requests.Add(1) <= 2 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`[{"id":"worker-1","status":"busy"}]`))
+	}))
+	defer server.Close()
+
+	service := NewMLService()
+	service.Collection = CollectionConfig{Timeout: time.Second, MaxRetries: 2, RetryBackoff: time.Millisecond, MaxBackoff: 2 * time.Millisecond, FailureThreshold: 1, OpenDuration: time.Hour}
+	host, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	service.ContinuousLearning.CoordinatorHost = host
+	service.ContinuousLearning.CoordinatorPort, _ = strconv.Atoi(port)
+
+	service.collectFromCoordinator()
+	service.flushIngest()
+	if requests.Load() != 3 || len(service.WorkerMetrics) != 1 {
+		t.Fatalf("Expected the third attempt to collect the worker, got %d requests and %d metrics", requests.Load(), len(service.WorkerMetrics))
+	}
+	health := service.CollectionHealth()[SourceCoordinator]
+	if health.State != CircuitClosed || health.ConsecutiveFailures != 0 || health.LastSuccess.IsZero() {
+		t.Errorf("Expected a healthy coordinator, got %+v", health)
+	}
+}
+
+func TestCollectionCircuitBreaker(t *testing.T) {
+	var requests atomic.Int32
+	var healthy atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if !healthy.Load() {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"workers":{},"builds":{}}`))
+	}))
+	defer server.Close()
+
+	service := NewMLService()
+	service.Collection = CollectionConfig{Timeout: time.Second, FailureThreshold: 2, OpenDuration: time.Hour}
+	var data map[string]any
+
+	// The circuit opens after two failed collections in a row
+	for i := 0; i < 2; i++ {
+		if service.fetch(SourceMonitor, server.URL, &data) {
+			t.Fatal("Expected the collection to fail")
+		}
+	}
+	health := service.CollectionHealth()[SourceMonitor]
+	if health.State != CircuitOpen || health.ConsecutiveFailures != 2 || health.LastError == "" {
+		t.Fatalf("Expected the circuit to open, got %+v", health)
+	}
+
+	// An open circuit skips the source
+	if service.fetch(SourceMonitor, server.URL, &data) || requests.Load() != 2 {
+		t.Errorf("Expected no request while the circuit is open, got %d requests", requests.Load())
+	}
+
+	// A failed trial collection opens the circuit again
+	breaker := service.breakers[SourceMonitor]
+	breaker.health.OpenUntil = time.Now()
+	if service.fetch(SourceMonitor, server.URL, &data) || service.CollectionHealth()[SourceMonitor].State != CircuitOpen {
+		t.Errorf("Expected a failed trial to reopen the circuit, got %+v", service.CollectionHealth()[SourceMonitor])
+	}
+
+	// A successful trial collection closes it
+	healthy.Store(true)
+	breaker.health.OpenUntil = time.Now()
+	if !service.fetch(SourceMonitor, server.URL, &data) {
+		t.Fatal("Expected the trial collection to succeed")
+	}
+	if health := service.CollectionHealth()[SourceMonitor]; health.State != CircuitClosed || health.ConsecutiveFailures != 0 {
+		t.Errorf("Expected the circuit to close, got %+v", health)
+	}
+}
@@ -0,0 +1,399 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"time"
+)
+
+// DataFormatVersion is the version of the ML data export format. Exports
+// without a version predate versioning and share the layout of version 1.
+const DataFormatVersion = 1
+
+// Sections of ML data that can be imported
+const (
+	SectionBuildHistory    = "build_history"
+	SectionWorkerMetrics   = "worker_metrics"
+	SectionCacheMetrics    = "cache_metrics"
+	SectionDailyAggregates = "daily_aggregates"
+	SectionModels          = "models"
+)
+
+// DataSections lists the importable sections
+var DataSections = []string{SectionBuildHistory, SectionWorkerMetrics, SectionCacheMetrics, SectionDailyAggregates, SectionModels}
+
+// ImportOptions selects what an import changes. Empty Sections imports
+// every section present in the data. A dry run validates the data without
+// changing the service.
+type ImportOptions struct {
+	Sections []string `json:"sections"`
+	DryRun   bool     `json:"dry_run"`
+}
+
+// ImportResult reports what an import read and, unless it was a dry run,
+// replaced
+type ImportResult struct {
+	FormatVersion   int      `json:"format_version"`
+	DryRun          bool     `json:"dry_run"`
+	Sections        []string `json:"sections"`
+	BuildRecords    int      `json:"build_records"`
+	WorkerMetrics   int      `json:"worker_metrics"`
+	CacheMetrics    int      `json:"cache_metrics"`
+	DailyAggregates int      `json:"daily_aggregates"`
+	Models          bool     `json:"models"`
+}
+
+// importData holds the sections read by an import until they are applied
+type importData struct {
+	buildHistory    []BuildRecord
+	workerMetrics   []WorkerMetric
+	cacheMetrics    []CacheMetric
+	dailyAggregates []DailyAggregate
+	models          *MLModels
+}
+
+// Export streams the ML data and settings as JSON. The data is copied under
+// the read lock and written without it, so a slow client does not block
+// recording.
+func (ml *MLService) Export(w io.Writer) error {
+	ml.mutex.RLock()
+	buildHistory := slices.Clone(ml.BuildHistory)
+	workerMetrics := slices.Clone(ml.WorkerMetrics)
+	cacheMetrics := slices.Clone(ml.CacheMetrics)
+	dailyAggregates := slices.Clone(ml.DailyAggregates)
+	anomalies := slices.Clone(ml.Anomalies)
+	header := []field{
+		{"format_version", DataFormatVersion},
+		{"exported_at", time.Now().UTC()},
+		{"models", ml.Models},
+		{"continuous_learning", ml.ContinuousLearning},
+		{"learning_stats", ml.LearningStats},
+		{"model_backend", ml.ModelBackend},
+		{"anomaly_detection", ml.AnomalyDetection},
+		{"collection", ml.Collection},
+		{"retention", ml.Retention},
+		{"shadow", ml.Shadow},
+		{"project_isolation", ml.ProjectIsolation},
+		{"project_models", ml.ProjectModels},
+	}
+	// Encode the fields sharing maps with the live models before unlocking
+	for i := range header {
+		data, err := json.Marshal(header[i].value)
+		if err != nil {
+			ml.mutex.RUnlock()
+			return fmt.Errorf("failed to encode %s: %v", header[i].name, err)
+		}
+		header[i].value = json.RawMessage(data)
+	}
+	ml.mutex.RUnlock()
+
+	out := bufio.NewWriter(w)
+	out.WriteString("{")
+	for i, f := range header {
+		if i > 0 {
+			out.WriteString(",")
+		}
+		fmt.Fprintf(out, "\n  %q: %s", f.name, f.value)
+	}
+	for _, err := range []error{
+		writeSection(out, SectionBuildHistory, buildHistory),
+		writeSection(out, SectionWorkerMetrics, workerMetrics),
+		writeSection(out, SectionCacheMetrics, cacheMetrics),
+		writeSection(out, SectionDailyAggregates, dailyAggregates),
+		writeSection(out, "anomalies", anomalies),
+	} {
+		if err != nil {
+			return err
+		}
+	}
+	out.WriteString("\n}\n")
+	return out.Flush()
+}
+
+// field is a named JSON value of an export
+type field struct {
+	name  string
+	value any
+}
+
+// writeSection writes a list one element at a time
+func writeSection[T any](out *bufio.Writer, name string, items []T) error {
+	fmt.Fprintf(out, ",\n  %q: [", name)
+	for i, item := range items {
+		data, err := json.Marshal(item)
+		if err != nil {
+			return fmt.Errorf("failed to encode %s[%d]: %v", name, i, err)
+		}
+		if i > 0 {
+			out.WriteString(",")
+		}
+		out.WriteString("\n    ")
+		out.Write(data)
+	}
+	if len(items) > 0 {
+		out.WriteString("\n  ")
+	}
+	out.WriteString("]")
+	return nil
+}
+
+// Import reads ML data exported by Export, decoding and validating one
+// element at a time, and replaces the selected sections of the service
+// with it. Nothing is changed if any element is invalid. Settings and
+// detected anomalies in the data are ignored.
+func (ml *MLService) Import(r io.Reader, options ImportOptions) (ImportResult, error) {
+	result := ImportResult{DryRun: options.DryRun}
+	selected := make(map[string]bool)
+	for _, section := range options.Sections {
+		if !slices.Contains(DataSections, section) {
+			return result, fmt.Errorf("unknown section %q, expected one of %v", section, DataSections)
+		}
+		selected[section] = true
+	}
+	wanted := func(section string) bool { return len(selected) == 0 || selected[section] }
+
+	decoder := json.NewDecoder(r)
+	if err := expectDelim(decoder, '{'); err != nil {
+		return result, err
+	}
+
+	var data importData
+	present := make(map[string]bool)
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return result, fmt.Errorf("invalid data: %v", err)
+		}
+		key, _ := token.(string)
+
+		switch {
+		case key == "format_version":
+			if err := decoder.Decode(&result.FormatVersion); err != nil {
+				return result, fmt.Errorf("invalid format_version: %v", err)
+			}
+			if result.FormatVersion < 0 || result.FormatVersion > DataFormatVersion {
+				return result, fmt.Errorf("unsupported format version %d, this service reads up to %d", result.FormatVersion, DataFormatVersion)
+			}
+			continue
+		case !wanted(key):
+			err = skipValue(decoder)
+		case key == SectionBuildHistory:
+			data.buildHistory, err = readSection(decoder, key, validateBuildRecord)
+		case key == SectionWorkerMetrics:
+			data.workerMetrics, err = readSection(decoder, key, validateWorkerMetric)
+		case key == SectionCacheMetrics:
+			data.cacheMetrics, err = readSection(decoder, key, validateCacheMetric)
+		case key == SectionDailyAggregates:
+			data.dailyAggregates, err = readSection(decoder, key, validateDailyAggregate)
+		case key == SectionModels:
+			data.models = &MLModels{}
+			if err = decoder.Decode(data.models); err == nil {
+				err = validateModels(data.models)
+			}
+			if err != nil {
+				err = fmt.Errorf("invalid models: %v", err)
+			}
+		default:
+			err = skipValue(decoder)
+		}
+		if err != nil {
+			return result, err
+		}
+		if wanted(key) && slices.Contains(DataSections, key) {
+			present[key] = true
+		}
+	}
+	if err := expectDelim(decoder, '}'); err != nil {
+		return result, err
+	}
+
+	for _, section := range DataSections {
+		if present[section] {
+			result.Sections = append(result.Sections, section)
+		} else if selected[section] {
+			return result, fmt.Errorf("section %s not found in the data", section)
+		}
+	}
+	result.BuildRecords = len(data.buildHistory)
+	result.WorkerMetrics = len(data.workerMetrics)
+	result.CacheMetrics = len(data.cacheMetrics)
+	result.DailyAggregates = len(data.dailyAggregates)
+	result.Models = data.models != nil
+	if options.DryRun {
+		return result, nil
+	}
+
+	ml.mutex.Lock()
+	defer ml.mutex.Unlock()
+
+	if present[SectionBuildHistory] {
+		ml.BuildHistory = data.buildHistory
+		ml.recordedBuilds = nil
+	}
+	if present[SectionWorkerMetrics] {
+		ml.WorkerMetrics = data.workerMetrics
+	}
+	if present[SectionCacheMetrics] {
+		ml.CacheMetrics = data.cacheMetrics
+	}
+	if present[SectionDailyAggregates] {
+		// Merging restores the order the aggregates are searched in
+		ml.DailyAggregates = make([]DailyAggregate, 0, len(data.dailyAggregates))
+		for _, aggregate := range data.dailyAggregates {
+			ml.DailyAggregates = mergeAggregate(ml.DailyAggregates, aggregate)
+		}
+	}
+	if data.models != nil {
+		ml.Models = *data.models
+	}
+	ml.applyRetention(time.Now())
+	return result, nil
+}
+
+// ExportData exports all ML data for backup/analysis
+func (ml *MLService) ExportData() ([]byte, error) {
+	var buffer bytes.Buffer
+	err := ml.Export(&buffer)
+	return buffer.Bytes(), err
+}
+
+// ImportData imports every section of ML data from backup
+func (ml *MLService) ImportData(data []byte) error {
+	_, err := ml.Import(bytes.NewReader(data), ImportOptions{})
+	return err
+}
+
+// readSection decodes a list one element at a time, validating each
+func readSection[T any](decoder *json.Decoder, name string, validate func(T) error) ([]T, error) {
+	if err := expectDelim(decoder, '['); err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", name, err)
+	}
+	items := make([]T, 0)
+	for i := 0; decoder.More(); i++ {
+		var item T
+		if err := decoder.Decode(&item); err != nil {
+			return nil, fmt.Errorf("invalid %s[%d]: %v", name, i, err)
+		}
+		if err := validate(item); err != nil {
+			return nil, fmt.Errorf("invalid %s[%d]: %v", name, i, err)
+		}
+		items = append(items, item)
+	}
+	if err := expectDelim(decoder, ']'); err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", name, err)
+	}
+	return items, nil
+}
+
+// expectDelim reads the next token and checks it is the delimiter
+func expectDelim(decoder *json.Decoder, delim json.Delim) error {
+	token, err := decoder.Token()
+	if err != nil {
+		return fmt.Errorf("invalid data: %v", err)
+	}
+	if token != delim {
+		return fmt.Errorf("invalid data: expected %v, got %v", delim, token)
+	}
+	return nil
+}
+
+// skipValue reads past the next value without keeping it
+func skipValue(decoder *json.Decoder) error {
+	depth := 0
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return fmt.Errorf("invalid data: %v", err)
+		}
+		switch token {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+		if depth == 0 {
+			return nil
+		}
+	}
+}
+
+// validateBuildRecord checks an imported build record
+func validateBuildRecord(record BuildRecord) error {
+	switch {
+	case record.BuildID == "" && record.ProjectPath == "":
+		return fmt.Errorf("build record without build ID or project path")
+	case record.Duration < 0 || record.EndTime.Before(record.StartTime):
+		return fmt.Errorf("build %s ends before it starts", record.BuildID)
+	case record.CacheHitRate < 0 || record.CacheHitRate > 1:
+		return fmt.Errorf("build %s has cache hit rate %v outside [0, 1]", record.BuildID, record.CacheHitRate)
+	}
+	return nil
+}
+
+// validateWorkerMetric checks an imported worker metric
+func validateWorkerMetric(metric WorkerMetric) error {
+	if metric.WorkerID == "" {
+		return fmt.Errorf("worker metric without worker ID")
+	}
+	if metric.ActiveBuilds < 0 || metric.QueueLength < 0 {
+		return fmt.Errorf("worker %s has negative build counts", metric.WorkerID)
+	}
+	return nil
+}
+
+// validateCacheMetric checks an imported cache metric
+func validateCacheMetric(metric CacheMetric) error {
+	if metric.HitRate < 0 || metric.HitRate > 1 {
+		return fmt.Errorf("cache hit rate %v outside [0, 1]", metric.HitRate)
+	}
+	if metric.CacheHits < 0 || metric.CacheMisses < 0 || metric.CacheSize < 0 {
+		return fmt.Errorf("negative cache counters")
+	}
+	return nil
+}
+
+// validateDailyAggregate checks an imported daily aggregate
+func validateDailyAggregate(aggregate DailyAggregate) error {
+	switch {
+	case !aggregate.Day.Equal(day(aggregate.Day)):
+		return fmt.Errorf("aggregate day %v is not the start of a UTC day", aggregate.Day)
+	case aggregate.Builds <= 0 || aggregate.Successes < 0 || aggregate.Successes > aggregate.Builds:
+		return fmt.Errorf("aggregate of %s on %s has %d successes of %d builds", aggregate.ProjectPath, aggregate.Day.Format(time.DateOnly), aggregate.Successes, aggregate.Builds)
+	case aggregate.TotalDuration < 0 || aggregate.MaxDuration < 0:
+		return fmt.Errorf("aggregate of %s on %s has a negative duration", aggregate.ProjectPath, aggregate.Day.Format(time.DateOnly))
+	}
+	return nil
+}
+
+// validateModels checks imported models and fills in missing maps
+func validateModels(models *MLModels) error {
+	for name, accuracy := range map[string]float64{
+		"build time": models.BuildTimePredictor.Accuracy,
+		"resource":   models.ResourcePredictor.Accuracy,
+		"failure":    models.FailurePredictor.Accuracy,
+		"cache":      models.CachePredictor.Accuracy,
+	} {
+		if accuracy < 0 || accuracy > 1 {
+			return fmt.Errorf("%s model accuracy %v outside [0, 1]", name, accuracy)
+		}
+	}
+
+	for _, weights := range []*map[string]float64{
+		&models.BuildTimePredictor.Weights,
+		&models.BuildTimePredictor.FeatureWeights,
+		&models.ResourcePredictor.CPUWeights,
+		&models.ResourcePredictor.MemWeights,
+		&models.ResourcePredictor.DiskWeights,
+		&models.FailurePredictor.ErrorPatterns,
+		&models.CachePredictor.HitRateWeights,
+	} {
+		if *weights == nil {
+			*weights = make(map[string]float64)
+		}
+	}
+	return nil
+}
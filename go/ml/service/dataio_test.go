@@ -0,0 +1,116 @@
+package service
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func exportedService(t *testing.T) (*MLService, []byte) {
+	t.Helper()
+	service := NewMLService()
+	now := time.Now()
+	for _, project := range []string{"/projects/app", "/projects/lib"} {
+		service.RecordBuild(Build{ID: project + "-1", ProjectPath: project, StartTime: now.Add(-time.Minute), EndTime: now, Success: true, CacheHitRate: 0.5})
+	}
+	service.Models.BuildTimePredictor.Accuracy = 0.9
+
+	var buffer bytes.Buffer
+	if err := service.Export(&buffer); err != nil {
+		t.Fatalf("Failed to export data: %v", err)
+	}
+	return service, buffer.Bytes()
+}
+
+func TestImportRoundTrip(t *testing.T) {
+	_, data := exportedService(t)
+
+	service := NewMLService()
+	result, err := service.Import(bytes.NewReader(data), ImportOptions{})
+	if err != nil {
+		t.Fatalf("Failed to import data: %v", err)
+	}
+	if result.FormatVersion != DataFormatVersion || result.BuildRecords != 2 || !result.Models {
+		t.Errorf("Unexpected import result %+v", result)
+	}
+	if len(service.BuildHistory) != 2 || service.Models.BuildTimePredictor.Accuracy != 0.9 {
+		t.Errorf("Expected 2 builds and the exported models, got %d builds and accuracy %v", len(service.BuildHistory), service.Models.BuildTimePredictor.Accuracy)
+	}
+}
+
+func TestImportDryRunAndSections(t *testing.T) {
+	_, data := exportedService(t)
+
+	service := NewMLService()
+	result, err := service.Import(bytes.NewReader(data), ImportOptions{DryRun: true})
+	if err != nil {
+		t.Fatalf("Dry run failed: %v", err)
+	}
+	if result.BuildRecords != 2 || len(service.BuildHistory) != 0 {
+		t.Errorf("Expected a dry run to count 2 builds and import none, got %d counted and %d imported", result.BuildRecords, len(service.BuildHistory))
+	}
+
+	service.RecordBuild(Build{ID: "local", ProjectPath: "/projects/local", StartTime: time.Now(), EndTime: time.Now(), Success: true})
+	result, err = service.Import(bytes.NewReader(data), ImportOptions{Sections: []string{SectionModels}})
+	if err != nil {
+		t.Fatalf("Failed to import models: %v", err)
+	}
+	if len(result.Sections) != 1 || result.BuildRecords != 0 {
+		t.Errorf("Expected only models to be imported, got %+v", result)
+	}
+	if len(service.BuildHistory) != 1 || service.BuildHistory[0].BuildID != "local" {
+		t.Errorf("Expected the build history to be kept, got %+v", service.BuildHistory)
+	}
+	if service.Models.BuildTimePredictor.Accuracy != 0.9 {
+		t.Errorf("Expected the exported models, got accuracy %v", service.Models.BuildTimePredictor.Accuracy)
+	}
+
+	if _, err := service.Import(bytes.NewReader(data), ImportOptions{Sections: []string{"configuration"}}); err == nil {
+		t.Error("Expected an unknown section to be rejected")
+	}
+}
+
+func TestImportRejectsInvalidData(t *testing.T) {
+	_, data := exportedService(t)
+
+	tests := []struct {
+		name string
+		data string
+		want string
+	}{
+		{"newer version", `{"format_version": 2, "build_history": []}`, "unsupported format version"},
+		{"not an object", `[]`, "invalid data"},
+		{"truncated", string(data[:len(data)/2]), "invalid"},
+		{"negative duration", `{"build_history": [{"build_id": "b", "duration": -1}]}`, "build_history[0]"},
+		{"hit rate", `{"cache_metrics": [{"hit_rate": 1.5}]}`, "cache_metrics[0]"},
+		{"successes", `{"daily_aggregates": [{"day": "2026-01-01T00:00:00Z", "builds": 1, "successes": 2}]}`, "daily_aggregates[0]"},
+		{"accuracy", `{"models": {"build_time_predictor": {"accuracy": 2}}}`, "invalid models"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			service, _ := exportedService(t)
+			_, err := service.Import(strings.NewReader(test.data), ImportOptions{})
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Fatalf("Expected an error containing %q, got %v", test.want, err)
+			}
+			if len(service.BuildHistory) != 2 {
+				t.Errorf("Expected a failed import to change nothing, got %d builds", len(service.BuildHistory))
+			}
+		})
+	}
+}
+
+func TestImportLegacyExport(t *testing.T) {
+	now := time.Now().UTC().Format(time.RFC3339)
+	legacy := `{"build_history": [{"build_id": "old", "project_path": "/projects/app", "start_time": "` + now + `", "end_time": "` + now + `"}], "configuration": {"ignored": true}}`
+
+	service := NewMLService()
+	result, err := service.Import(strings.NewReader(legacy), ImportOptions{})
+	if err != nil {
+		t.Fatalf("Failed to import a legacy export: %v", err)
+	}
+	if result.FormatVersion != 0 || len(service.BuildHistory) != 1 {
+		t.Errorf("Expected 1 build from an unversioned export, got %+v", result)
+	}
+}
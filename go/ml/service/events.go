@@ -0,0 +1,39 @@
+package service
+
+import (
+	"distributed-gradle-building/events"
+)
+
+// Build statuses reported in finished build events
+const (
+	eventStatusCompleted = "completed"
+	eventStatusFailed    = "failed"
+)
+
+// ConsumeEvents learns from the builds finishing on the coordinator as their
+// events arrive on bus, instead of waiting for the next data collection.
+// Cancelled builds are ignored. It returns a function ending the
+// subscription.
+func (ml *MLService) ConsumeEvents(bus events.Bus) (func(), error) {
+	return bus.Subscribe(func(event events.Event) {
+		if event.Type != events.BuildFinished {
+			return
+		}
+		if event.Status != eventStatusCompleted && event.Status != eventStatusFailed {
+			return
+		}
+
+		ml.RecordBuild(Build{
+			ID:           event.BuildID,
+			ProjectPath:  event.ProjectPath,
+			TaskName:     event.TaskName,
+			WorkerID:     event.WorkerID,
+			StartTime:    event.Timestamp.Add(-event.Duration),
+			EndTime:      event.Timestamp,
+			Success:      event.Status == eventStatusCompleted,
+			CacheHitRate: event.CacheHitRate,
+			ErrorMessage: event.ErrorMessage,
+			ErrorCode:    event.ErrorCode,
+		})
+	})
+}
@@ -0,0 +1,51 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"distributed-gradle-building/events"
+)
+
+func TestConsumeEvents(t *testing.T) {
+	service := NewMLService()
+	bus := events.NewMemory()
+	stop, err := service.ConsumeEvents(bus)
+	if err != nil {
+		t.Fatalf("ConsumeEvents failed: %v", err)
+	}
+	defer stop()
+
+	finished := time.Now()
+	bus.Publish(events.Event{Type: events.BuildStarted, BuildID: "build-1"})
+	bus.Publish(events.Event{Type: events.BuildFinished, BuildID: "build-2", Status: "cancelled"})
+	bus.Publish(events.Event{
+		Type:         events.BuildFinished,
+		BuildID:      "build-1",
+		Timestamp:    finished,
+		ProjectPath:  "/test/project",
+		TaskName:     "build",
+		WorkerID:     "worker-1",
+		Status:       "completed",
+		Duration:     time.Minute,
+		CacheHitRate: 0.5,
+	})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		service.mutex.RLock()
+		history := append([]BuildRecord(nil), service.BuildHistory...)
+		service.mutex.RUnlock()
+		if len(history) > 0 {
+			record := history[0]
+			if len(history) != 1 || record.BuildID != "build-1" || !record.Success || record.Duration != time.Minute || record.CacheHitRate != 0.5 {
+				t.Errorf("Expected only the completed build to be recorded, got %+v", history)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the build to be recorded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
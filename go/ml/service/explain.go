@@ -0,0 +1,111 @@
+package service
+
+import (
+	"math"
+	"slices"
+	"sort"
+	"time"
+)
+
+// Bases of a build time prediction
+const (
+	BasisSimilarBuilds   = "similar_builds"
+	BasisProjectBuilds   = "project_builds"
+	BasisAllBuilds       = "all_builds"
+	BasisProjectFeatures = "project_features"
+	BasisDefault         = "default"
+)
+
+// maxFactors is the number of factors explaining a prediction
+const maxFactors = 3
+
+// PredictionFactor is a project feature or past build contributing to a
+// build time prediction. Features contribute their model weight times their
+// value; past builds their share of the average duration.
+type PredictionFactor struct {
+	Name         string        `json:"name"`
+	Value        float64       `json:"value"`
+	Contribution time.Duration `json:"contribution"`
+}
+
+// buildTimeEstimate is a build time prediction with what it is based on
+type buildTimeEstimate struct {
+	duration   time.Duration
+	confidence float64
+	basis      string
+	sampleSize int
+	p50        time.Duration
+	p90        time.Duration
+	factors    []PredictionFactor
+}
+
+// estimateFromHistory estimates build duration as the average of past builds
+func estimateFromHistory(records []BuildRecord, basis string) buildTimeEstimate {
+	var total time.Duration
+	durations := make([]time.Duration, 0, len(records))
+	factors := make([]PredictionFactor, 0, len(records))
+	for _, record := range records {
+		total += record.Duration
+		durations = append(durations, record.Duration)
+		factors = append(factors, PredictionFactor{
+			Name:         record.BuildID,
+			Value:        record.Duration.Seconds(),
+			Contribution: record.Duration / time.Duration(len(records)),
+		})
+	}
+	slices.Sort(durations)
+
+	return buildTimeEstimate{
+		duration:   total / time.Duration(len(records)),
+		confidence: math.Min(0.9, float64(len(records))/100.0), // Higher confidence with more data
+		basis:      basis,
+		sampleSize: len(records),
+		p50:        percentile(durations, 0.5),
+		p90:        percentile(durations, 0.9),
+		factors:    topFactors(factors),
+	}
+}
+
+// percentile returns the nearest-rank percentile of sorted durations
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	rank := int(math.Ceil(p*float64(len(sorted)))) - 1
+	return sorted[max(rank, 0)]
+}
+
+// topFactors returns the factors contributing most to a prediction
+func topFactors(factors []PredictionFactor) []PredictionFactor {
+	sort.SliceStable(factors, func(i, j int) bool {
+		return absDuration(factors[i].Contribution) > absDuration(factors[j].Contribution)
+	})
+	return factors[:min(len(factors), maxFactors)]
+}
+
+// absDuration returns the absolute value of d
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
+
+// explainBuildTime fills in the prediction interval and explanation of a
+// build time prediction. Without past build durations to draw on, both ends
+// of the interval are the prediction.
+func (ml *MLService) explainBuildTime(result *PredictionResult, projectPath, taskName string) {
+	features := ml.projectFeatures(projectPath)
+
+	ml.mutex.RLock()
+	estimate := ml.estimateBuildTime(ml.modelsFor(projectPath).BuildTimePredictor, features, projectPath, taskName)
+	ml.mutex.RUnlock()
+
+	result.P50Time, result.P90Time = estimate.p50, estimate.p90
+	if estimate.p90 == 0 {
+		result.P50Time, result.P90Time = result.PredictedTime, result.PredictedTime
+	}
+	result.SampleSize = estimate.sampleSize
+	result.Basis = estimate.basis
+	result.Factors = estimate.factors
+	if result.Factors == nil {
+		result.Factors = make([]PredictionFactor, 0)
+	}
+}
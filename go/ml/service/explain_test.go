@@ -0,0 +1,64 @@
+package service
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestPredictionExplainsSmallSamples(t *testing.T) {
+	service := NewMLService()
+	now := time.Now()
+	for i := 1; i <= 10; i++ {
+		service.RecordBuild(Build{ID: fmt.Sprintf("app-%d", i), ProjectPath: "/projects/app", TaskName: "build", StartTime: now.Add(-time.Duration(i) * time.Minute), EndTime: now, Success: true})
+	}
+	for _, minutes := range []int{40, 50} {
+		service.RecordBuild(Build{ID: fmt.Sprintf("lib-%d", minutes), ProjectPath: "/projects/lib", TaskName: "test", StartTime: now.Add(-time.Duration(minutes) * time.Minute), EndTime: now, Success: true})
+	}
+
+	result := service.GetBuildInsights("/projects/lib", "test", nil)
+	if result.PredictedTime != 45*time.Minute || result.SampleSize != 2 || result.Basis != BasisSimilarBuilds {
+		t.Fatalf("Expected 45m from 2 similar builds, got %v from %d %s", result.PredictedTime, result.SampleSize, result.Basis)
+	}
+	if result.P50Time != 40*time.Minute || result.P90Time != 50*time.Minute {
+		t.Errorf("Expected an interval of 40m to 50m, got %v to %v", result.P50Time, result.P90Time)
+	}
+	if len(result.Factors) != 2 || result.Factors[0].Name != "lib-50" || result.Factors[0].Contribution != 25*time.Minute {
+		t.Errorf("Expected the 50m build to contribute most, got %+v", result.Factors)
+	}
+
+	result = service.GetBuildInsights("/projects/app", "build", nil)
+	if result.SampleSize != 10 || result.P50Time != 5*time.Minute || result.P90Time != 9*time.Minute {
+		t.Errorf("Expected p50 5m and p90 9m of 10 builds, got %v and %v of %d", result.P50Time, result.P90Time, result.SampleSize)
+	}
+	if len(result.Factors) != maxFactors || result.Factors[0].Name != "app-10" {
+		t.Errorf("Expected the %d longest builds as factors, got %+v", maxFactors, result.Factors)
+	}
+}
+
+func TestPredictionExplainsDefaults(t *testing.T) {
+	service := NewMLService()
+
+	result := service.GetBuildInsights("/projects/new", "build", nil)
+	if result.Basis != BasisDefault || result.SampleSize != 0 || len(result.Factors) != 0 {
+		t.Errorf("Expected a default prediction without samples, got %+v", result)
+	}
+	if result.P50Time != result.PredictedTime || result.P90Time != result.PredictedTime {
+		t.Errorf("Expected the interval to collapse to the prediction, got %v to %v", result.P50Time, result.P90Time)
+	}
+}
+
+func TestFeatureEstimateExplainsContributions(t *testing.T) {
+	service := NewMLService()
+
+	estimate := service.Models.BuildTimePredictor.estimateFromFeatures(ProjectFeatures{ModuleCount: 2, LinesOfCode: 3000})
+	if estimate.basis != BasisProjectFeatures || len(estimate.factors) != maxFactors {
+		t.Fatalf("Expected %d feature factors, got %+v", maxFactors, estimate)
+	}
+	if factor := estimate.factors[0]; factor.Name != FeatureModules || factor.Value != 2 || factor.Contribution != time.Minute {
+		t.Errorf("Expected modules to contribute 1m, got %+v", factor)
+	}
+	if factor := estimate.factors[1]; factor.Name != FeatureKLOC || factor.Contribution != 45*time.Second {
+		t.Errorf("Expected lines of code to contribute 45s, got %+v", factor)
+	}
+}
@@ -0,0 +1,366 @@
+package service
+
+import (
+	"math"
+	"slices"
+	"sort"
+	"strings"
+	"unicode"
+
+	"distributed-gradle-building/protocol"
+)
+
+// failurePatternWeight is the log-odds a log pattern of a class adds to the
+// class when classifying a failure
+const failurePatternWeight = 3.0
+
+// failurePriorWeight is how many failures the share of each class among all
+// failed builds counts as when predicting how a build fails from its own
+// failures
+const failurePriorWeight = 2.0
+
+// maxFailureTerms is the number of terms explaining a classification
+const maxFailureTerms = 3
+
+// failureClasses are the classes failures are classified into. Cancelled
+// builds did not fail on their own, so they are left out.
+var failureClasses = []protocol.ErrorCode{
+	protocol.ErrorInfra,
+	protocol.ErrorCompile,
+	protocol.ErrorTestFailure,
+	protocol.ErrorTimeout,
+	protocol.ErrorOOM,
+}
+
+// failureHints are what can be done about the failures of each class
+var failureHints = map[protocol.ErrorCode][]string{
+	protocol.ErrorInfra: {
+		"Retry the build: the coordinator re-queues builds failing with infrastructure errors on its own",
+		"Check that the dependency repositories are reachable from the workers and that their disks have space",
+	},
+	protocol.ErrorCompile: {
+		"Build the change locally before submitting it",
+		"Check recent changes to the build scripts and dependency versions",
+	},
+	protocol.ErrorTestFailure: {
+		"Run the failing tests locally",
+		"Check the flaky tests of the project before retrying",
+	},
+	protocol.ErrorTimeout: {
+		"Shard the tests of the build across workers",
+		"Raise WORKER_BUILD_TIMEOUT if the build is expected to take this long",
+	},
+	protocol.ErrorOOM: {
+		"Raise the Gradle heap with the jvmArgs build option, such as -Xmx4g",
+		"Route the build to a pool of workers with more memory",
+	},
+}
+
+// FailureClassification is the class of a failure predicted from its log.
+// Probabilities has the probability of each class, Patterns the lines that
+// matched the log patterns of the class and Terms the learned terms of the
+// log weighing most for it.
+type FailureClassification struct {
+	Class         protocol.ErrorCode             `json:"class"`
+	Probability   float64                        `json:"probability"`
+	Probabilities map[protocol.ErrorCode]float64 `json:"probabilities"`
+	Patterns      []string                       `json:"patterns,omitempty"`
+	Terms         []string                       `json:"terms,omitempty"`
+	Hints         []string                       `json:"hints"`
+}
+
+// FailurePrediction is how a build is expected to fail. Risk is the
+// probability it fails, and Class the most likely class of its failure
+// should it fail, with Probability its probability among the Classes.
+// SampleSize is the number of past failures of the build it is based on.
+type FailurePrediction struct {
+	Risk        float64                        `json:"risk"`
+	Class       protocol.ErrorCode             `json:"class"`
+	Probability float64                        `json:"probability"`
+	Classes     map[protocol.ErrorCode]float64 `json:"classes"`
+	SampleSize  int                            `json:"sample_size"`
+	Hints       []string                       `json:"hints"`
+}
+
+// failureTerms splits an error message into the lower case words it is
+// classified by. Numbers and words shorter than three letters, such as
+// build IDs and exit codes, tell nothing about the class.
+func failureTerms(message string) []string {
+	words := strings.FieldsFunc(strings.ToLower(message), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	terms := words[:0]
+	for _, word := range words {
+		if len(word) < 3 || strings.IndexFunc(word, unicode.IsLetter) < 0 {
+			continue
+		}
+		terms = append(terms, word)
+	}
+	return terms
+}
+
+// matchFailureLog returns the class the log patterns point to in a log,
+// with the lines matching them
+func matchFailureLog(log string) (protocol.ErrorCode, []string) {
+	matches := make(map[protocol.ErrorCode][]string)
+	for _, line := range strings.Split(log, "\n") {
+		if code := protocol.MatchLogLine(line); code != "" {
+			matches[code] = append(matches[code], strings.TrimSpace(line))
+		}
+	}
+	// The patterns of a class outweigh those of the classes after it
+	for _, code := range []protocol.ErrorCode{protocol.ErrorOOM, protocol.ErrorTestFailure, protocol.ErrorInfra} {
+		if lines := matches[code]; len(lines) > 0 {
+			return code, lines
+		}
+	}
+	return "", nil
+}
+
+// failureLabel returns the class of a failed build: the error code it was
+// reported with, or the class its error message matches the log patterns
+// of, if any
+func failureLabel(record BuildRecord) protocol.ErrorCode {
+	if code := protocol.ErrorCode(record.ErrorCode); slices.Contains(failureClasses, code) {
+		return code
+	}
+	code, _ := matchFailureLog(record.ErrorMessage)
+	return code
+}
+
+// trainFailureClasses learns the share of each class among the failed
+// builds and, for each class, the log-likelihood of the terms of their
+// error messages, with add-one smoothing over the terms of all classes.
+// Failed builds whose class is unknown are left out. Must be called with the
+// mutex held.
+func (ml *MLService) trainFailureClasses() {
+	model := &ml.Models.FailurePredictor
+	model.ClassPriors, model.ClassTermWeights, model.ClassUnseenWeights = nil, nil, nil
+
+	failures := make(map[protocol.ErrorCode]int)
+	termCounts := make(map[protocol.ErrorCode]map[string]int)
+	termTotals := make(map[protocol.ErrorCode]int)
+	vocabulary := make(map[string]bool)
+	labeled := 0
+	for _, record := range ml.BuildHistory {
+		if record.Success {
+			continue
+		}
+		class := failureLabel(record)
+		if class == "" {
+			continue
+		}
+		failures[class]++
+		labeled++
+		if termCounts[class] == nil {
+			termCounts[class] = make(map[string]int)
+		}
+		for _, term := range failureTerms(record.ErrorMessage) {
+			termCounts[class][term]++
+			termTotals[class]++
+			vocabulary[term] = true
+		}
+	}
+	if labeled == 0 {
+		return
+	}
+
+	model.ClassPriors = make(map[string]float64, len(failureClasses))
+	model.ClassTermWeights = make(map[string]map[string]float64, len(termCounts))
+	model.ClassUnseenWeights = make(map[string]float64, len(failureClasses))
+	for _, class := range failureClasses {
+		model.ClassPriors[string(class)] = float64(failures[class]+1) / float64(labeled+len(failureClasses))
+		denominator := float64(termTotals[class] + len(vocabulary) + 1)
+		model.ClassUnseenWeights[string(class)] = math.Log(1 / denominator)
+		if counts := termCounts[class]; len(counts) > 0 {
+			weights := make(map[string]float64, len(counts))
+			for term, count := range counts {
+				weights[term] = math.Log(float64(count+1) / denominator)
+			}
+			model.ClassTermWeights[string(class)] = weights
+		}
+	}
+}
+
+// trained reports whether the model learned the classes of failures
+func (model FailureModel) trained() bool {
+	return len(model.ClassPriors) > 0
+}
+
+// termWeight returns the log-likelihood of a term in the failures of a class
+func (model FailureModel) termWeight(class protocol.ErrorCode, term string) float64 {
+	if weight, seen := model.ClassTermWeights[string(class)][term]; seen {
+		return weight
+	}
+	return model.ClassUnseenWeights[string(class)]
+}
+
+// known reports whether the model saw a term in the failures of any class
+func (model FailureModel) known(term string) bool {
+	for _, weights := range model.ClassTermWeights {
+		if _, seen := weights[term]; seen {
+			return true
+		}
+	}
+	return false
+}
+
+// classify predicts the class of a failure from its log by the log patterns
+// it matches and the learned weights of its terms. Without either, the
+// class is unknown and left empty.
+func (model FailureModel) classify(log string) FailureClassification {
+	matched, lines := matchFailureLog(log)
+	var terms []string
+	if model.trained() {
+		for _, term := range failureTerms(log) {
+			if model.known(term) {
+				terms = append(terms, term)
+			}
+		}
+	}
+	if matched == "" && !model.trained() {
+		return FailureClassification{}
+	}
+
+	scores := make(map[protocol.ErrorCode]float64, len(failureClasses))
+	for _, class := range failureClasses {
+		score := 0.0
+		if model.trained() {
+			score = math.Log(model.ClassPriors[string(class)])
+			for _, term := range terms {
+				score += model.termWeight(class, term)
+			}
+		}
+		if class == matched {
+			score += failurePatternWeight
+		}
+		scores[class] = score
+	}
+
+	classification := FailureClassification{Probabilities: softmax(scores)}
+	classification.Class, classification.Probability = mostLikely(classification.Probabilities)
+	if classification.Class == matched {
+		classification.Patterns = lines
+	}
+	classification.Terms = model.telling(classification.Class, terms)
+	classification.Hints = failureHints[classification.Class]
+	return classification
+}
+
+// telling returns the terms weighing most for a class over the others, most
+// telling first
+func (model FailureModel) telling(class protocol.ErrorCode, terms []string) []string {
+	margins := make(map[string]float64)
+	for _, term := range terms {
+		margin := model.termWeight(class, term)
+		for _, other := range failureClasses {
+			if other != class {
+				margin -= model.termWeight(other, term) / float64(len(failureClasses)-1)
+			}
+		}
+		if margin > 0 {
+			margins[term] = margin
+		}
+	}
+
+	telling := make([]string, 0, len(margins))
+	for term := range margins {
+		telling = append(telling, term)
+	}
+	sort.Slice(telling, func(i, j int) bool {
+		if margins[telling[i]] != margins[telling[j]] {
+			return margins[telling[i]] > margins[telling[j]]
+		}
+		return telling[i] < telling[j]
+	})
+	if len(telling) > maxFailureTerms {
+		telling = telling[:maxFailureTerms]
+	}
+	return telling
+}
+
+// softmax turns log scores into probabilities
+func softmax(scores map[protocol.ErrorCode]float64) map[protocol.ErrorCode]float64 {
+	highest := math.Inf(-1)
+	for _, score := range scores {
+		highest = math.Max(highest, score)
+	}
+	var sum float64
+	probabilities := make(map[protocol.ErrorCode]float64, len(scores))
+	for class, score := range scores {
+		probabilities[class] = math.Exp(score - highest)
+		sum += probabilities[class]
+	}
+	for class := range probabilities {
+		probabilities[class] /= sum
+	}
+	return probabilities
+}
+
+// mostLikely returns the class with the highest probability, the first of
+// failureClasses on a tie
+func mostLikely(probabilities map[protocol.ErrorCode]float64) (protocol.ErrorCode, float64) {
+	var best protocol.ErrorCode
+	bestProbability := -1.0
+	for _, class := range failureClasses {
+		if probability, exists := probabilities[class]; exists && probability > bestProbability {
+			best, bestProbability = class, probability
+		}
+	}
+	return best, bestProbability
+}
+
+// ClassifyFailure predicts the class of a build failure from its log or
+// error message, with hints on mitigating it
+func (ml *MLService) ClassifyFailure(log string) FailureClassification {
+	ml.mutex.RLock()
+	defer ml.mutex.RUnlock()
+	return ml.Models.FailurePredictor.classify(log)
+}
+
+// predictFailure predicts how a build of a project's task fails, given the
+// risk it fails at all: the classes of its past failures, classified by
+// their error codes, log patterns or the learned weights, blended with the
+// share of each class among all failures. It returns nil without either.
+func (ml *MLService) predictFailure(projectPath, taskName string, risk float64) *FailurePrediction {
+	ml.mutex.RLock()
+	defer ml.mutex.RUnlock()
+
+	model := ml.modelsFor(projectPath).FailurePredictor
+	counts := make(map[protocol.ErrorCode]int)
+	failures := 0
+	for _, record := range ml.BuildHistory {
+		if record.Success || record.ProjectPath != projectPath || record.TaskName != taskName {
+			continue
+		}
+		class := failureLabel(record)
+		if class == "" {
+			class = model.classify(record.ErrorMessage).Class
+		}
+		if class != "" {
+			counts[class]++
+			failures++
+		}
+	}
+	if failures == 0 && !model.trained() {
+		return nil
+	}
+
+	classes := make(map[protocol.ErrorCode]float64, len(failureClasses))
+	for _, class := range failureClasses {
+		prior := 1 / float64(len(failureClasses))
+		if model.trained() {
+			prior = model.ClassPriors[string(class)]
+		}
+		classes[class] = (float64(counts[class]) + failurePriorWeight*prior) / (float64(failures) + failurePriorWeight)
+	}
+	class, probability := mostLikely(classes)
+	return &FailurePrediction{
+		Risk:        risk,
+		Class:       class,
+		Probability: probability,
+		Classes:     classes,
+		SampleSize:  failures,
+		Hints:       failureHints[class],
+	}
+}
@@ -0,0 +1,113 @@
+package service
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"distributed-gradle-building/protocol"
+)
+
+func failureService(t *testing.T) *MLService {
+	t.Helper()
+	service := NewMLService()
+
+	now := time.Now()
+	record := func(id, project, code, message string) {
+		service.RecordBuild(Build{ID: id, ProjectPath: project, TaskName: "build", StartTime: now.Add(-time.Minute), EndTime: now, ErrorCode: code, ErrorMessage: message})
+	}
+	for i := 0; i < 6; i++ {
+		record(fmt.Sprintf("compile-%d", i), "/repo/app", string(protocol.ErrorCompile), "error: cannot find symbol in Main.java")
+	}
+	for i := 0; i < 5; i++ {
+		// Builds of workers older than the error codes are labelled by the
+		// log patterns their messages match
+		record(fmt.Sprintf("tests-%d", i), "/repo/lib", "", "5 tests completed, 2 failed")
+	}
+	for i := 0; i < 3; i++ {
+		record(fmt.Sprintf("oom-%d", i), "/repo/lib", string(protocol.ErrorOOM), "daemon exited: heap exhausted by the dexer")
+	}
+	for i := 0; i < 10; i++ {
+		service.RecordBuild(Build{ID: fmt.Sprintf("ok-%d", i), ProjectPath: "/repo/app", TaskName: "build", StartTime: now.Add(-time.Minute), EndTime: now, Success: true})
+	}
+
+	if err := service.TrainModels(); err != nil {
+		t.Fatalf("TrainModels failed: %v", err)
+	}
+	return service
+}
+
+func TestClassifyFailureByPatterns(t *testing.T) {
+	service := NewMLService()
+
+	classification := service.ClassifyFailure("> Task :test FAILED\nException in thread \"main\" java.lang.OutOfMemoryError: Java heap space")
+	if classification.Class != protocol.ErrorOOM {
+		t.Fatalf("Expected an untrained model to classify by patterns, got %+v", classification)
+	}
+	if len(classification.Patterns) != 1 || len(classification.Hints) == 0 {
+		t.Errorf("Expected the matched line and hints, got %+v", classification)
+	}
+
+	if classification := service.ClassifyFailure("something went wrong"); classification.Class != "" {
+		t.Errorf("Expected no class without patterns or training, got %+v", classification)
+	}
+}
+
+func TestClassifyFailureByLearnedTerms(t *testing.T) {
+	service := failureService(t)
+
+	// No pattern matches, only terms learned from failures with codes
+	classification := service.ClassifyFailure("error: cannot find symbol in Util.java")
+	if classification.Class != protocol.ErrorCompile {
+		t.Fatalf("Expected a compile error, got %+v", classification)
+	}
+	if len(classification.Terms) != maxFailureTerms || slices.Contains(classification.Terms, "util") {
+		t.Errorf("Expected the learned terms explaining the class, got %v", classification.Terms)
+	}
+	if classification.Probability < 0.5 {
+		t.Errorf("Expected a confident classification, got %.2f", classification.Probability)
+	}
+
+	classification = service.ClassifyFailure("build failed: heap exhausted by the dexer")
+	if classification.Class != protocol.ErrorOOM {
+		t.Errorf("Expected the learned terms of running out of memory, got %+v", classification)
+	}
+
+	var sum float64
+	for _, probability := range classification.Probabilities {
+		sum += probability
+	}
+	if sum < 0.999 || sum > 1.001 {
+		t.Errorf("Expected probabilities to sum to 1, got %.3f", sum)
+	}
+}
+
+func TestPredictFailureClass(t *testing.T) {
+	service := failureService(t)
+
+	result := service.GetBuildInsights("/repo/lib", "build", nil)
+	if result.Failure == nil {
+		t.Fatal("Expected a failure prediction")
+	}
+	if result.Failure.Class != protocol.ErrorTestFailure || result.Failure.SampleSize != 8 {
+		t.Errorf("Expected the tests of the project to fail most, got %+v", result.Failure)
+	}
+	if result.Failure.Classes[protocol.ErrorOOM] <= result.Failure.Classes[protocol.ErrorInfra] {
+		t.Errorf("Expected past OOMs to outweigh unseen classes, got %v", result.Failure.Classes)
+	}
+	if result.Failure.Risk != result.FailureRisk || len(result.Failure.Hints) == 0 {
+		t.Errorf("Expected the failure risk and hints, got %+v", result.Failure)
+	}
+
+	// Builds without failures of their own fall back to the share of each
+	// class among all failures
+	result = service.GetBuildInsights("/repo/new", "build", nil)
+	if result.Failure == nil || result.Failure.Class != protocol.ErrorCompile || result.Failure.SampleSize != 0 {
+		t.Errorf("Expected the most common class overall, got %+v", result.Failure)
+	}
+
+	if result := NewMLService().GetBuildInsights("/repo/new", "build", nil); result.Failure != nil {
+		t.Errorf("Expected no failure prediction without failures, got %+v", result.Failure)
+	}
+}
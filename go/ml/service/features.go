@@ -0,0 +1,445 @@
+package service
+
+import (
+	"bufio"
+	"io/fs"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ProjectFeatures describes the structure of a Gradle project for predictions
+type ProjectFeatures struct {
+	ModuleCount     int `json:"module_count"`
+	LinesOfCode     int `json:"lines_of_code"`
+	DependencyCount int `json:"dependency_count"`
+	ChangedFiles    int `json:"changed_files"`
+}
+
+// Feature names used as keys in feature weight maps
+const (
+	FeatureModules      = "modules"
+	FeatureKLOC         = "kloc"
+	FeatureDependencies = "dependencies"
+	FeatureChangedFiles = "changed_files"
+)
+
+var featureNames = []string{FeatureModules, FeatureKLOC, FeatureDependencies, FeatureChangedFiles}
+
+// IsZero reports whether no features could be extracted
+func (f ProjectFeatures) IsZero() bool {
+	return f == ProjectFeatures{}
+}
+
+// values returns the feature vector in featureNames order
+func (f ProjectFeatures) values() []float64 {
+	return []float64{
+		float64(f.ModuleCount),
+		float64(f.LinesOfCode) / 1000.0,
+		float64(f.DependencyCount),
+		float64(f.ChangedFiles),
+	}
+}
+
+// sourceExtensions are the file types counted towards lines of code
+var sourceExtensions = map[string]bool{
+	".java":   true,
+	".kt":     true,
+	".groovy": true,
+	".scala":  true,
+}
+
+// skippedDirs are directories ignored when walking a project
+var skippedDirs = map[string]bool{
+	".git":         true,
+	".gradle":      true,
+	".idea":        true,
+	"build":        true,
+	"node_modules": true,
+}
+
+// dependencyConfigurations are Gradle configurations counted as dependencies
+var dependencyConfigurations = []string{
+	"implementation", "api", "compile", "compileOnly", "runtimeOnly",
+	"testImplementation", "testCompile", "testRuntimeOnly", "annotationProcessor", "kapt",
+}
+
+// Limits of a project walk, so a project path naming a large tree cannot
+// turn a prediction into a scan of the whole file system
+const (
+	maxWalkDepth = 12
+	maxWalkFiles = 20000
+)
+
+// maxCachedFeatures bounds the projects whose features are cached
+const maxCachedFeatures = 1000
+
+type cachedFeatures struct {
+	features    ProjectFeatures
+	extractedAt time.Time
+}
+
+// FeatureExtractor analyzes project directories under a projects root and
+// caches the results
+type FeatureExtractor struct {
+	root  string
+	ttl   time.Duration
+	cache map[string]cachedFeatures
+	mutex sync.Mutex
+}
+
+// NewFeatureExtractor creates a feature extractor analyzing the projects
+// under root and caching results for ttl. Without a root no project is
+// analyzed.
+func NewFeatureExtractor(root string, ttl time.Duration) *FeatureExtractor {
+	return &FeatureExtractor{
+		root:  root,
+		ttl:   ttl,
+		cache: make(map[string]cachedFeatures),
+	}
+}
+
+// resolve returns the directory of a project path, relative to the projects
+// root or absolute within it. Symbolic links are resolved, so they cannot
+// lead out of the root.
+func (fe *FeatureExtractor) resolve(projectPath string) (string, bool) {
+	if fe.root == "" || projectPath == "" {
+		return "", false
+	}
+	root, err := filepath.EvalSymlinks(fe.root)
+	if err != nil {
+		return "", false
+	}
+	root, err = filepath.Abs(root)
+	if err != nil {
+		return "", false
+	}
+	path := projectPath
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(root, path)
+	}
+	path, err = filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", false
+	}
+	relative, err := filepath.Rel(root, path)
+	if err != nil || relative == ".." || strings.HasPrefix(relative, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return path, true
+}
+
+// Extract returns the features of a project, using cached results when
+// fresh. Projects outside the projects root yield zero features.
+func (fe *FeatureExtractor) Extract(projectPath string) ProjectFeatures {
+	dir, ok := fe.resolve(projectPath)
+	if !ok {
+		return ProjectFeatures{}
+	}
+
+	fe.mutex.Lock()
+	cached, exists := fe.cache[dir]
+	fe.mutex.Unlock()
+
+	if exists && time.Since(cached.extractedAt) < fe.ttl {
+		return cached.features
+	}
+
+	features := ExtractProjectFeatures(dir)
+
+	fe.mutex.Lock()
+	fe.store(dir, cachedFeatures{features: features, extractedAt: time.Now()})
+	fe.mutex.Unlock()
+
+	return features
+}
+
+// store caches the features of a project, evicting expired entries and, if
+// the cache is still full, the oldest one
+func (fe *FeatureExtractor) store(dir string, entry cachedFeatures) {
+	if _, exists := fe.cache[dir]; !exists && len(fe.cache) >= maxCachedFeatures {
+		oldest := ""
+		for path, cached := range fe.cache {
+			if time.Since(cached.extractedAt) >= fe.ttl {
+				delete(fe.cache, path)
+			} else if oldest == "" || cached.extractedAt.Before(fe.cache[oldest].extractedAt) {
+				oldest = path
+			}
+		}
+		if len(fe.cache) >= maxCachedFeatures {
+			delete(fe.cache, oldest)
+		}
+	}
+	fe.cache[dir] = entry
+}
+
+// ExtractProjectFeatures analyzes a project directory, walking at most
+// maxWalkDepth directories deep and maxWalkFiles files. Projects that are
+// not available locally yield zero features.
+func ExtractProjectFeatures(projectPath string) ProjectFeatures {
+	var features ProjectFeatures
+
+	if info, err := os.Stat(projectPath); err != nil || !info.IsDir() {
+		return features
+	}
+
+	features.ModuleCount = countModules(projectPath)
+
+	files := 0
+	filepath.WalkDir(projectPath, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+
+		if entry.IsDir() {
+			if path == projectPath {
+				return nil
+			}
+			depth := strings.Count(path[len(projectPath):], string(filepath.Separator))
+			if skippedDirs[entry.Name()] || depth > maxWalkDepth {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if files++; files > maxWalkFiles {
+			return filepath.SkipAll
+		}
+		switch {
+		case entry.Name() == "build.gradle" || entry.Name() == "build.gradle.kts":
+			features.DependencyCount += countDependencies(path)
+		case sourceExtensions[filepath.Ext(path)]:
+			features.LinesOfCode += countLines(path)
+		}
+
+		return nil
+	})
+
+	features.ChangedFiles = countChangedFiles(projectPath)
+
+	return features
+}
+
+// countModules counts modules included in the Gradle settings file
+func countModules(projectPath string) int {
+	modules := 1
+
+	for _, name := range []string{"settings.gradle", "settings.gradle.kts"} {
+		file, err := os.Open(filepath.Join(projectPath, name))
+		if err != nil {
+			continue
+		}
+
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if !strings.HasPrefix(line, "include") {
+				continue
+			}
+			// Each quoted module path is one module: include ':app', ':lib'
+			modules += (strings.Count(line, "'") + strings.Count(line, "\"")) / 2
+		}
+		file.Close()
+	}
+
+	return modules
+}
+
+// countDependencies counts dependency declarations in a build script
+func countDependencies(path string) int {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0
+	}
+	defer file.Close()
+
+	count := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		for _, configuration := range dependencyConfigurations {
+			if strings.HasPrefix(line, configuration+"(") || strings.HasPrefix(line, configuration+" ") {
+				count++
+				break
+			}
+		}
+	}
+
+	return count
+}
+
+// countLines counts the lines in a source file
+func countLines(path string) int {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0
+	}
+	defer file.Close()
+
+	lines := 0
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		lines++
+	}
+
+	return lines
+}
+
+// countChangedFiles counts files changed in the working tree according to git
+func countChangedFiles(projectPath string) int {
+	output, err := exec.Command("git", "-C", projectPath, "diff", "--name-only", "HEAD").Output()
+	if err != nil {
+		return 0
+	}
+
+	count := 0
+	for _, line := range strings.Split(string(output), "\n") {
+		if strings.TrimSpace(line) != "" {
+			count++
+		}
+	}
+
+	return count
+}
+
+// projectFeatures extracts features for a project using the service cache
+func (ml *MLService) projectFeatures(projectPath string) ProjectFeatures {
+	if ml.featureExtractor == nil {
+		return ProjectFeatures{}
+	}
+	return ml.featureExtractor.Extract(projectPath)
+}
+
+// predictBuildTimeFromFeatures estimates build duration from project structure
+func (ml *MLService) predictBuildTimeFromFeatures(features ProjectFeatures) (time.Duration, float64) {
+	estimate := ml.Models.BuildTimePredictor.estimateFromFeatures(features)
+	return estimate.duration, estimate.confidence
+}
+
+// estimateFromFeatures estimates build duration from project structure
+func (model BuildTimeModel) estimateFromFeatures(features ProjectFeatures) buildTimeEstimate {
+	seconds := model.FeatureBias
+	factors := make([]PredictionFactor, 0, len(featureNames))
+	for i, value := range features.values() {
+		contribution := model.FeatureWeights[featureNames[i]] * value
+		seconds += contribution
+		factors = append(factors, PredictionFactor{
+			Name:         featureNames[i],
+			Value:        value,
+			Contribution: time.Duration(contribution * float64(time.Second)),
+		})
+	}
+
+	// Never predict less than a minimal build
+	seconds = math.Max(seconds, 10)
+
+	confidence := 0.4
+	if !model.LastTrained.IsZero() && model.FeatureSamples > 0 {
+		confidence = math.Min(0.8, 0.4+float64(model.FeatureSamples)/200.0)
+	}
+
+	return buildTimeEstimate{
+		duration:   time.Duration(seconds * float64(time.Second)),
+		confidence: confidence,
+		basis:      BasisProjectFeatures,
+		sampleSize: model.FeatureSamples,
+		factors:    topFactors(factors),
+	}
+}
+
+// predictFailureRiskFromFeatures adjusts a base failure risk by change volume and dependency count
+func predictFailureRiskFromFeatures(baseRisk float64, features ProjectFeatures) float64 {
+	risk := baseRisk * (1.0 + float64(features.ChangedFiles)/50.0 + float64(features.DependencyCount)/200.0)
+	return math.Min(risk, 0.95)
+}
+
+// trainFeatureModel fits build time feature weights with least squares
+func (ml *MLService) trainFeatureModel() {
+	var rows [][]float64
+	var targets []float64
+
+	for _, record := range ml.BuildHistory {
+		if !record.Success || record.Features == nil || record.Features.IsZero() {
+			continue
+		}
+		rows = append(rows, append([]float64{1}, record.Features.values()...))
+		targets = append(targets, record.Duration.Seconds())
+	}
+
+	// Need more samples than parameters for a meaningful fit
+	if len(rows) <= len(featureNames)+1 {
+		return
+	}
+
+	coefficients, ok := solveLeastSquares(rows, targets)
+	if !ok {
+		return
+	}
+
+	if ml.Models.BuildTimePredictor.FeatureWeights == nil {
+		ml.Models.BuildTimePredictor.FeatureWeights = make(map[string]float64)
+	}
+
+	ml.Models.BuildTimePredictor.FeatureBias = coefficients[0]
+	for i, name := range featureNames {
+		ml.Models.BuildTimePredictor.FeatureWeights[name] = coefficients[i+1]
+	}
+	ml.Models.BuildTimePredictor.FeatureSamples = len(rows)
+}
+
+// solveLeastSquares solves the normal equations (XᵀX)β = Xᵀy with Gaussian elimination
+func solveLeastSquares(rows [][]float64, targets []float64) ([]float64, bool) {
+	n := len(rows[0])
+
+	// Build the augmented matrix [XᵀX | Xᵀy] with light ridge regularization
+	matrix := make([][]float64, n)
+	for i := range matrix {
+		matrix[i] = make([]float64, n+1)
+		for j := 0; j < n; j++ {
+			for k := range rows {
+				matrix[i][j] += rows[k][i] * rows[k][j]
+			}
+		}
+		if i > 0 {
+			matrix[i][i] += 1e-6
+		}
+		for k := range rows {
+			matrix[i][n] += rows[k][i] * targets[k]
+		}
+	}
+
+	for col := 0; col < n; col++ {
+		pivot := col
+		for row := col + 1; row < n; row++ {
+			if math.Abs(matrix[row][col]) > math.Abs(matrix[pivot][col]) {
+				pivot = row
+			}
+		}
+		if math.Abs(matrix[pivot][col]) < 1e-12 {
+			return nil, false
+		}
+		matrix[col], matrix[pivot] = matrix[pivot], matrix[col]
+
+		for row := 0; row < n; row++ {
+			if row == col {
+				continue
+			}
+			factor := matrix[row][col] / matrix[col][col]
+			for k := col; k <= n; k++ {
+				matrix[row][k] -= factor * matrix[col][k]
+			}
+		}
+	}
+
+	coefficients := make([]float64, n)
+	for i := 0; i < n; i++ {
+		coefficients[i] = matrix[i][n] / matrix[i][i]
+	}
+
+	return coefficients, true
+}
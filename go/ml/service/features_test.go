@@ -0,0 +1,182 @@
+package service
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// createTestProject writes a small multi-module Gradle project
+func createTestProject(t *testing.T) string {
+	dir := t.TempDir()
+
+	files := map[string]string{
+		"settings.gradle":              "rootProject.name = 'demo'\ninclude ':app', ':lib'\n",
+		"build.gradle":                 "dependencies {\n    implementation 'com.google.guava:guava:32.0.0-jre'\n    testImplementation(\"junit:junit:4.13.2\")\n}\n",
+		"lib/build.gradle":             "dependencies {\n    api 'org.slf4j:slf4j-api:2.0.9'\n}\n",
+		"app/src/main/java/App.java":   strings.Repeat("// line\n", 2000),
+		"build/generated/Ignored.java": strings.Repeat("// generated\n", 5000),
+	}
+
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+
+	return dir
+}
+
+func TestExtractProjectFeatures(t *testing.T) {
+	dir := createTestProject(t)
+
+	features := ExtractProjectFeatures(dir)
+
+	if features.ModuleCount != 3 {
+		t.Errorf("Expected 3 modules (root, app, lib), got %d", features.ModuleCount)
+	}
+	if features.LinesOfCode != 2000 {
+		t.Errorf("Expected 2000 lines of code, got %d", features.LinesOfCode)
+	}
+	if features.DependencyCount != 3 {
+		t.Errorf("Expected 3 dependencies, got %d", features.DependencyCount)
+	}
+	if features.ChangedFiles != 0 {
+		t.Errorf("Expected no changed files outside a git repository, got %d", features.ChangedFiles)
+	}
+
+	if missing := ExtractProjectFeatures(filepath.Join(dir, "missing")); !missing.IsZero() {
+		t.Errorf("Expected zero features for missing project, got %+v", missing)
+	}
+}
+
+func TestFeatureExtractor(t *testing.T) {
+	dir := createTestProject(t)
+	root := filepath.Dir(dir)
+	extractor := NewFeatureExtractor(root, time.Minute)
+
+	// Projects resolve under the root, relative or absolute
+	for _, path := range []string{dir, filepath.Base(dir)} {
+		if features := extractor.Extract(path); features.ModuleCount != 3 {
+			t.Errorf("Expected the features of %s, got %+v", path, features)
+		}
+	}
+
+	// Paths outside the root yield no features, also through links
+	outside, _ := os.MkdirTemp("", "outside")
+	defer os.RemoveAll(outside)
+	os.WriteFile(filepath.Join(outside, "settings.gradle"), []byte("include ':app'\n"), 0644)
+	os.Symlink(outside, filepath.Join(root, "escape"))
+	for _, path := range []string{outside, "/", "..", "escape", filepath.Join(dir, "..", "..")} {
+		if features := extractor.Extract(path); !features.IsZero() {
+			t.Errorf("Expected no features for %s, got %+v", path, features)
+		}
+	}
+	if features := NewFeatureExtractor("", time.Minute).Extract(dir); !features.IsZero() {
+		t.Errorf("Expected no features without a projects root, got %+v", features)
+	}
+
+	// The cache is bounded, evicting the oldest entry
+	for i := 0; i <= maxCachedFeatures; i++ {
+		name := filepath.Join(root, fmt.Sprintf("p%d", i))
+		os.Mkdir(name, 0755)
+		extractor.Extract(name)
+	}
+	if len(extractor.cache) != maxCachedFeatures {
+		t.Errorf("Expected %d cached projects, got %d", maxCachedFeatures, len(extractor.cache))
+	}
+	if _, cached := extractor.cache[dir]; cached {
+		t.Error("Expected the oldest project to be evicted")
+	}
+}
+
+func TestExtractProjectFeaturesLimits(t *testing.T) {
+	dir := t.TempDir()
+	deep := filepath.Join(append([]string{dir}, strings.Split(strings.Repeat("d/", maxWalkDepth+1), "/")...)...)
+	os.MkdirAll(deep, 0755)
+	os.WriteFile(filepath.Join(deep, "Deep.java"), []byte("// line\n"), 0644)
+	if features := ExtractProjectFeatures(dir); features.LinesOfCode != 0 {
+		t.Errorf("Expected sources beyond the walk depth to be skipped, got %d lines", features.LinesOfCode)
+	}
+
+	for i := 0; i < maxWalkFiles+10; i++ {
+		os.WriteFile(filepath.Join(dir, fmt.Sprintf("F%d.java", i)), []byte("// line\n"), 0644)
+	}
+	if features := ExtractProjectFeatures(dir); features.LinesOfCode != maxWalkFiles {
+		t.Errorf("Expected %d files to be counted, got %d lines", maxWalkFiles, features.LinesOfCode)
+	}
+}
+
+func TestColdStartPredictionFromFeatures(t *testing.T) {
+	dir := createTestProject(t)
+	t.Setenv("ML_PROJECTS_ROOT", filepath.Dir(dir))
+	service := NewMLService()
+
+	duration, confidence := service.PredictBuildTime(dir, "build", nil)
+
+	// 60 + 3 modules*30 + 2 kloc*15 + 3 deps*2 = 186 seconds
+	if duration != 186*time.Second {
+		t.Errorf("Expected cold-start prediction of 186s, got %v", duration)
+	}
+	if confidence != 0.4 {
+		t.Errorf("Expected cold-start confidence 0.4, got %f", confidence)
+	}
+
+	risk := service.PredictFailureRisk(dir, "build")
+	if risk <= 0.1 || risk > 0.95 {
+		t.Errorf("Expected feature-adjusted failure risk above 0.1, got %f", risk)
+	}
+}
+
+func TestTrainFeatureModel(t *testing.T) {
+	service := NewMLService()
+	now := time.Now()
+
+	// Duration follows 20 + 10*modules + 40*kloc seconds
+	for i := 0; i < 30; i++ {
+		features := &ProjectFeatures{
+			ModuleCount:     1 + i%5,
+			LinesOfCode:     1000 * (1 + i%7),
+			DependencyCount: i % 3,
+			ChangedFiles:    i % 4,
+		}
+		seconds := 20 + 10*float64(features.ModuleCount) + 40*float64(features.LinesOfCode)/1000
+		service.RecordBuild(Build{
+			ID:          fmt.Sprintf("build-%d", i),
+			ProjectPath: fmt.Sprintf("/projects/p%d", i),
+			TaskName:    "build",
+			StartTime:   now,
+			EndTime:     now.Add(time.Duration(seconds * float64(time.Second))),
+			Success:     true,
+			Features:    features,
+		})
+	}
+
+	if err := service.TrainModels(); err != nil {
+		t.Fatalf("Failed to train models: %v", err)
+	}
+
+	model := service.Models.BuildTimePredictor
+	if model.FeatureSamples != 30 {
+		t.Errorf("Expected 30 feature samples, got %d", model.FeatureSamples)
+	}
+	if math.Abs(model.FeatureWeights[FeatureModules]-10) > 0.01 {
+		t.Errorf("Expected module weight ~10, got %f", model.FeatureWeights[FeatureModules])
+	}
+	if math.Abs(model.FeatureWeights[FeatureKLOC]-40) > 0.01 {
+		t.Errorf("Expected kloc weight ~40, got %f", model.FeatureWeights[FeatureKLOC])
+	}
+
+	duration, _ := service.predictBuildTimeFromFeatures(ProjectFeatures{ModuleCount: 2, LinesOfCode: 3000})
+	if math.Abs(duration.Seconds()-160) > 0.5 {
+		t.Errorf("Expected prediction ~160s, got %v", duration)
+	}
+}
@@ -0,0 +1,194 @@
+package service
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"distributed-gradle-building/testshard"
+)
+
+// minFlipRuns is the number of runs a test case needs before its flip rate
+// alone suggests quarantine
+const minFlipRuns = 5
+
+// FlakyConfig configures flaky test detection. The outcomes of the last
+// History runs of every test case are kept. A test case is flaky once it
+// both passed and failed on the same commit, or in the same build when the
+// commit is not known. Quarantine is suggested once it did so on
+// QuarantineCommits commits, or its outcome changed between at least
+// QuarantineFlipRate of its consecutive runs over at least minFlipRuns runs.
+type FlakyConfig struct {
+	History            int     `json:"history"`
+	QuarantineCommits  int     `json:"quarantine_commits"`
+	QuarantineFlipRate float64 `json:"quarantine_flip_rate"`
+}
+
+// TestRun holds the test results of a build
+type TestRun struct {
+	ProjectPath string
+	BuildID     string
+	// Commit is the commit the build checked out, empty if not known
+	Commit  string
+	Time    time.Time
+	Classes []testshard.ClassResult
+}
+
+// TestOutcome is a run of a test case that passed or failed
+type TestOutcome struct {
+	BuildID string    `json:"build_id"`
+	Commit  string    `json:"commit,omitempty"`
+	Passed  bool      `json:"passed"`
+	Time    time.Time `json:"time"`
+}
+
+// TestCaseHistory holds the latest runs of a test case, oldest first
+type TestCaseHistory struct {
+	Class    string        `json:"class"`
+	Name     string        `json:"name"`
+	Outcomes []TestOutcome `json:"outcomes"`
+}
+
+// FlakyTest is a test case that both passed and failed on the same commit.
+// FlipRate is the share of its consecutive runs whose outcome changed.
+// Filter is the Gradle test filter pattern that quarantines it.
+type FlakyTest struct {
+	Class        string    `json:"class"`
+	Name         string    `json:"name"`
+	Runs         int       `json:"runs"`
+	Failures     int       `json:"failures"`
+	FlakyCommits int       `json:"flaky_commits"`
+	FlipRate     float64   `json:"flip_rate"`
+	LastFailure  time.Time `json:"last_failure"`
+	Quarantine   bool      `json:"quarantine"`
+	Suggestion   string    `json:"suggestion"`
+	Filter       string    `json:"filter"`
+}
+
+// loadFlakyConfig loads flaky test detection settings from environment
+// variables
+func (ml *MLService) loadFlakyConfig() {
+	ml.Flaky.History = getEnvAsInt("ML_FLAKY_HISTORY", ml.Flaky.History)
+	ml.Flaky.QuarantineCommits = getEnvAsInt("ML_FLAKY_QUARANTINE_COMMITS", ml.Flaky.QuarantineCommits)
+	ml.Flaky.QuarantineFlipRate = getEnvAsFloat("ML_FLAKY_QUARANTINE_FLIP_RATE", ml.Flaky.QuarantineFlipRate)
+}
+
+// RecordTestResults records the test results of a build: the durations of
+// its test classes and the outcomes of their test cases. Skipped cases are
+// not recorded.
+func (ml *MLService) RecordTestResults(run TestRun) {
+	ml.mutex.Lock()
+	defer ml.mutex.Unlock()
+
+	ml.recordTestDurations(run.ProjectPath, testshard.Durations(run.Classes))
+	if ml.TestCases == nil {
+		ml.TestCases = make(map[string]map[string]*TestCaseHistory)
+	}
+	cases, exists := ml.TestCases[run.ProjectPath]
+	if !exists {
+		cases = make(map[string]*TestCaseHistory)
+		ml.TestCases[run.ProjectPath] = cases
+	}
+
+	for _, class := range run.Classes {
+		for _, c := range class.Cases {
+			if c.Outcome == testshard.CaseSkipped {
+				continue
+			}
+			key := class.Name + "#" + c.Name
+			history, exists := cases[key]
+			if !exists {
+				history = &TestCaseHistory{Class: class.Name, Name: c.Name}
+				cases[key] = history
+			}
+			history.Outcomes = append(history.Outcomes, TestOutcome{
+				BuildID: run.BuildID,
+				Commit:  run.Commit,
+				Passed:  c.Outcome == testshard.CasePassed,
+				Time:    run.Time,
+			})
+			if ml.Flaky.History > 0 && len(history.Outcomes) > ml.Flaky.History {
+				history.Outcomes = slices.Clone(history.Outcomes[len(history.Outcomes)-ml.Flaky.History:])
+			}
+		}
+	}
+}
+
+// GetFlakyTests returns the flaky test cases of a project, those flaky on
+// the most commits first
+func (ml *MLService) GetFlakyTests(projectPath string) []FlakyTest {
+	ml.mutex.RLock()
+	defer ml.mutex.RUnlock()
+
+	flaky := make([]FlakyTest, 0)
+	for _, history := range ml.TestCases[projectPath] {
+		if test, ok := ml.flakyTest(history); ok {
+			flaky = append(flaky, test)
+		}
+	}
+	slices.SortFunc(flaky, func(a, b FlakyTest) int {
+		return cmp.Or(
+			cmp.Compare(b.FlakyCommits, a.FlakyCommits),
+			cmp.Compare(b.FlipRate, a.FlipRate),
+			strings.Compare(a.Class, b.Class),
+			strings.Compare(a.Name, b.Name),
+		)
+	})
+	return flaky
+}
+
+// flakyTest scores the history of a test case, reporting whether it is
+// flaky. Must be called with the mutex held.
+func (ml *MLService) flakyTest(history *TestCaseHistory) (FlakyTest, bool) {
+	test := FlakyTest{Class: history.Class, Name: history.Name, Runs: len(history.Outcomes)}
+
+	// Outcomes by commit: bit 0 set if it passed, bit 1 if it failed
+	outcomes := make(map[string]int)
+	flips := 0
+	for i, outcome := range history.Outcomes {
+		revision := outcome.Commit
+		if revision == "" {
+			revision = "build:" + outcome.BuildID
+		}
+		if outcome.Passed {
+			outcomes[revision] |= 1
+		} else {
+			outcomes[revision] |= 2
+			test.Failures++
+			test.LastFailure = outcome.Time
+		}
+		if i > 0 && outcome.Passed != history.Outcomes[i-1].Passed {
+			flips++
+		}
+	}
+	for _, seen := range outcomes {
+		if seen == 3 {
+			test.FlakyCommits++
+		}
+	}
+	if test.FlakyCommits == 0 {
+		return test, false
+	}
+	if test.Runs > 1 {
+		test.FlipRate = float64(flips) / float64(test.Runs-1)
+	}
+
+	// Filters match method names without JUnit 5 parameters or invocations
+	method, _, _ := strings.Cut(history.Name, "(")
+	method, _, _ = strings.Cut(method, "[")
+	test.Filter = history.Class + "." + method
+	commits := "commit"
+	if test.FlakyCommits > 1 {
+		commits = "commits"
+	}
+	test.Quarantine = test.FlakyCommits >= ml.Flaky.QuarantineCommits ||
+		(test.Runs >= minFlipRuns && test.FlipRate >= ml.Flaky.QuarantineFlipRate)
+	if test.Quarantine {
+		test.Suggestion = fmt.Sprintf("quarantine: passed and failed on %d %s, outcome changed in %.0f%% of runs", test.FlakyCommits, commits, test.FlipRate*100)
+	} else {
+		test.Suggestion = fmt.Sprintf("monitor: passed and failed on %d %s", test.FlakyCommits, commits)
+	}
+	return test, true
+}
@@ -0,0 +1,69 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"distributed-gradle-building/testshard"
+)
+
+func TestFlakyTests(t *testing.T) {
+	service := NewMLService()
+	service.Flaky = FlakyConfig{History: 6, QuarantineCommits: 2, QuarantineFlipRate: 0.9}
+
+	record := func(buildID, commit string, outcomes map[string]string) {
+		var cases []testshard.CaseResult
+		for name, outcome := range outcomes {
+			cases = append(cases, testshard.CaseResult{Name: name, Outcome: outcome})
+		}
+		service.RecordTestResults(TestRun{
+			ProjectPath: "/test/project",
+			BuildID:     buildID,
+			Commit:      commit,
+			Time:        time.Now(),
+			Classes:     []testshard.ClassResult{{Name: "com.example.AppTest", Cases: cases}},
+		})
+	}
+	passed, failed, skipped := testshard.CasePassed, testshard.CaseFailed, testshard.CaseSkipped
+
+	// "broken" fails on every run of a commit, "flaky" passes and fails on
+	// the same commits and "retried" within a build without a commit
+	record("build-1", "aaa", map[string]string{"stable": passed, "broken": passed, "flaky()": passed, "ignored": skipped})
+	record("build-2", "bbb", map[string]string{"stable": passed, "broken": failed, "flaky()": failed})
+	record("build-3", "bbb", map[string]string{"stable": passed, "broken": failed, "flaky()": passed})
+	record("build-4", "ccc", map[string]string{"stable": passed, "broken": failed, "flaky()": failed})
+	record("build-5", "ccc", map[string]string{"stable": passed, "flaky()": passed})
+	service.RecordTestResults(TestRun{ProjectPath: "/test/project", BuildID: "build-6", Classes: []testshard.ClassResult{{
+		Name:  "com.example.AppTest",
+		Cases: []testshard.CaseResult{{Name: "retried", Outcome: failed}, {Name: "retried", Outcome: passed}},
+	}}})
+
+	flaky := service.GetFlakyTests("/test/project")
+	if len(flaky) != 2 {
+		t.Fatalf("Expected 2 flaky tests, got %+v", flaky)
+	}
+	test := flaky[0]
+	if test.Name != "flaky()" || test.Runs != 5 || test.Failures != 2 || test.FlakyCommits != 2 || test.FlipRate != 1 {
+		t.Errorf("Expected the test flaky on two commits first, got %+v", test)
+	}
+	if !test.Quarantine || test.Filter != "com.example.AppTest.flaky" {
+		t.Errorf("Expected quarantine to be suggested, got %+v", test)
+	}
+	if retried := flaky[1]; retried.Name != "retried" || retried.FlakyCommits != 1 || retried.Quarantine {
+		t.Errorf("Expected the test retried within a build to be monitored, got %+v", retried)
+	}
+
+	// Only the latest runs are kept
+	for i := 0; i < 6; i++ {
+		record("build-later", "ddd", map[string]string{"flaky()": passed})
+	}
+	if flaky := service.GetFlakyTests("/test/project"); len(flaky) != 1 || flaky[0].Name != "retried" {
+		t.Errorf("Expected the outcomes of old runs to be forgotten, got %+v", flaky)
+	}
+	if durations := service.GetTestDurations("/test/project"); len(durations) != 1 {
+		t.Errorf("Expected the class durations to be recorded, got %v", durations)
+	}
+	if flaky := service.GetFlakyTests("/other/project"); flaky == nil || len(flaky) != 0 {
+		t.Errorf("Expected no flaky tests, got %+v", flaky)
+	}
+}
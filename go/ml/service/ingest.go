@@ -0,0 +1,330 @@
+package service
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"distributed-gradle-building/metrics"
+)
+
+// Collected records are queued and added to the history in batches, so a
+// large collection takes the mutex once per batch instead of once per
+// record and predictions are served in between
+const (
+	defaultIngestQueueSize = 10000
+	defaultIngestBatchSize = 100
+)
+
+// maxRecordedBuildIDs bounds the build IDs remembered to skip builds that
+// are collected again
+const maxRecordedBuildIDs = 20000
+
+// maxWorkerMetrics is the number of worker metrics kept
+const maxWorkerMetrics = 5000
+
+// IngestStats reports the records waiting to be added to the history, the
+// records dropped because collection outpaced ingestion and the builds
+// skipped because they were recorded before
+type IngestStats struct {
+	Queued     int `json:"queued"`
+	Dropped    int `json:"dropped"`
+	Duplicates int `json:"duplicates"`
+}
+
+// ringBuffer is a FIFO of fixed capacity that overwrites its oldest item
+// when full
+type ringBuffer[T any] struct {
+	items []T
+	head  int
+	size  int
+}
+
+func newRingBuffer[T any](capacity int) *ringBuffer[T] {
+	return &ringBuffer[T]{items: make([]T, max(capacity, 1))}
+}
+
+// push appends an item, returning the oldest item and true if it had to be
+// overwritten
+func (r *ringBuffer[T]) push(item T) (T, bool) {
+	var evicted T
+	full := r.size == len(r.items)
+	if full {
+		evicted = r.items[r.head]
+		r.head = (r.head + 1) % len(r.items)
+		r.size--
+	}
+	r.items[(r.head+r.size)%len(r.items)] = item
+	r.size++
+	return evicted, full
+}
+
+// pop removes and returns up to n of the oldest items
+func (r *ringBuffer[T]) pop(n int) []T {
+	n = min(n, r.size)
+	popped := make([]T, n)
+	var zero T
+	for i := range popped {
+		popped[i] = r.items[r.head]
+		r.items[r.head] = zero
+		r.head = (r.head + 1) % len(r.items)
+	}
+	r.size -= n
+	return popped
+}
+
+// ingestItem is a collected build or worker metric
+type ingestItem struct {
+	build  *Build
+	metric *WorkerMetric
+}
+
+// ingestQueue holds the collected records until they are added to the
+// history. It has a mutex of its own so collecting never waits for
+// predictions.
+type ingestQueue struct {
+	mutex   sync.Mutex
+	items   *ringBuffer[ingestItem]
+	dropped int
+}
+
+func newIngestQueue(size int) *ingestQueue {
+	return &ingestQueue{items: newRingBuffer[ingestItem](size)}
+}
+
+// push queues a record, dropping the oldest queued one when the queue is
+// full
+func (q *ingestQueue) push(item ingestItem) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if _, dropped := q.items.push(item); dropped {
+		q.dropped++
+	}
+}
+
+// pop removes up to n of the oldest queued records
+func (q *ingestQueue) pop(n int) []ingestItem {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.items.pop(n)
+}
+
+// stats returns the number of queued and dropped records
+func (q *ingestQueue) stats() (queued, dropped int) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.items.size, q.dropped
+}
+
+// idSet remembers the latest IDs added to it, forgetting the oldest beyond
+// its capacity
+type idSet struct {
+	ids   map[string]struct{}
+	order *ringBuffer[string]
+}
+
+func newIDSet(capacity int) *idSet {
+	return &idSet{ids: make(map[string]struct{}), order: newRingBuffer[string](capacity)}
+}
+
+func (s *idSet) contains(id string) bool {
+	_, exists := s.ids[id]
+	return exists
+}
+
+func (s *idSet) add(id string) {
+	if s.contains(id) {
+		return
+	}
+	if evicted, full := s.order.push(id); full {
+		delete(s.ids, evicted)
+	}
+	s.ids[id] = struct{}{}
+}
+
+// enqueueBuild queues a collected build
+func (ml *MLService) enqueueBuild(build Build) {
+	ml.ingest.push(ingestItem{build: &build})
+}
+
+// enqueueWorkerMetric queues a collected worker metric
+func (ml *MLService) enqueueWorkerMetric(metric WorkerMetric) {
+	ml.ingest.push(ingestItem{metric: &metric})
+}
+
+// flushIngest adds the queued records to the history, one batch at a time
+func (ml *MLService) flushIngest() {
+	batchSize := ml.Collection.BatchSize
+	if batchSize <= 0 {
+		batchSize = defaultIngestBatchSize
+	}
+
+	for {
+		items := ml.ingest.pop(batchSize)
+		if len(items) == 0 {
+			break
+		}
+
+		var builds []Build
+		var workerMetrics []WorkerMetric
+		for _, item := range items {
+			if item.build != nil {
+				builds = append(builds, *item.build)
+			} else {
+				workerMetrics = append(workerMetrics, *item.metric)
+			}
+		}
+		if len(builds) > 0 {
+			ml.RecordBuilds(builds)
+		}
+		if len(workerMetrics) > 0 {
+			ml.recordWorkerMetrics(workerMetrics)
+		}
+	}
+
+	if _, dropped := ml.ingest.stats(); dropped > ml.reportedDrops {
+		log.Printf("Dropped %d collected records: collection outpaced ingestion, raise ML_COLLECTION_QUEUE_SIZE", dropped-ml.reportedDrops)
+		ml.reportedDrops = dropped
+	}
+}
+
+// ingestStats returns the state of the ingestion of collected records. Must
+// be called with the mutex held.
+func (ml *MLService) ingestStats() IngestStats {
+	queued, dropped := ml.ingest.stats()
+	return IngestStats{Queued: queued, Dropped: dropped, Duplicates: ml.duplicateBuilds}
+}
+
+// preparedBuild is a build with what is computed before it is recorded
+type preparedBuild struct {
+	build     Build
+	features  *ProjectFeatures
+	predicted time.Duration
+	candidate shadowPrediction
+}
+
+// RecordBuilds adds build records to the history under a single lock.
+// Builds whose ID was recorded before, such as builds collected again, are
+// skipped. It returns the number of builds recorded.
+func (ml *MLService) RecordBuilds(builds []Build) int {
+	builds = ml.unrecordedBuilds(builds)
+	if len(builds) == 0 {
+		return 0
+	}
+
+	// Compare what the models would have predicted before they learn from
+	// the builds
+	prepared := make([]preparedBuild, len(builds))
+	for i, build := range builds {
+		prepared[i].build = build
+		prepared[i].features = build.Features
+		if prepared[i].features == nil {
+			if extracted := ml.projectFeatures(build.ProjectPath); !extracted.IsZero() {
+				prepared[i].features = &extracted
+			}
+		}
+		if build.Success {
+			prepared[i].predicted, _ = ml.PredictBuildTime(build.ProjectPath, build.TaskName, build.BuildOptions)
+			metrics.ObservePredictionError(prepared[i].predicted, build.EndTime.Sub(build.StartTime))
+			prepared[i].candidate = ml.predictShadowBuildTime(build.ProjectPath, build.TaskName)
+		}
+	}
+
+	ml.mutex.Lock()
+	defer ml.mutex.Unlock()
+
+	recorded := 0
+	for _, p := range prepared {
+		build := p.build
+		// Another collection may have recorded the build meanwhile
+		if build.ID != "" {
+			if ml.recordedBuildIDs().contains(build.ID) {
+				ml.duplicateBuilds++
+				continue
+			}
+			ml.recordedBuilds.add(build.ID)
+		}
+
+		if p.candidate.ok {
+			ml.recordShadowPrediction(p.candidate, p.predicted, build.EndTime.Sub(build.StartTime))
+		}
+
+		record := BuildRecord{
+			BuildID:      build.ID,
+			ProjectPath:  build.ProjectPath,
+			TaskName:     build.TaskName,
+			WorkerID:     build.WorkerID,
+			StartTime:    build.StartTime,
+			EndTime:      build.EndTime,
+			Duration:     build.EndTime.Sub(build.StartTime),
+			Success:      build.Success,
+			CacheHitRate: build.CacheHitRate,
+			CPUUsage:     build.CPUUsage,
+			MemoryUsage:  build.MemoryUsage,
+			DiskUsage:    build.DiskUsage,
+			BuildOptions: build.BuildOptions,
+			ErrorMessage: build.ErrorMessage,
+			ErrorCode:    build.ErrorCode,
+			Features:     p.features,
+		}
+		ml.BuildHistory = append(ml.BuildHistory, record)
+		ml.checkBuildAnomaly(record)
+		recorded++
+	}
+
+	// Older records are rolled up into daily aggregates to bound memory
+	ml.applyRetention(time.Now())
+	return recorded
+}
+
+// unrecordedBuilds returns the builds whose ID was not recorded before,
+// each once. Builds without an ID are always recorded.
+func (ml *MLService) unrecordedBuilds(builds []Build) []Build {
+	ml.mutex.Lock()
+	defer ml.mutex.Unlock()
+
+	recorded := ml.recordedBuildIDs()
+	fresh := make([]Build, 0, len(builds))
+	batch := make(map[string]bool)
+	for _, build := range builds {
+		if build.ID != "" && (recorded.contains(build.ID) || batch[build.ID]) {
+			ml.duplicateBuilds++
+			continue
+		}
+		batch[build.ID] = true
+		fresh = append(fresh, build)
+	}
+	return fresh
+}
+
+// recordedBuildIDs returns the IDs of the builds recorded, taken from the
+// history the first time, such as after a snapshot was loaded. Must be
+// called with the mutex held.
+func (ml *MLService) recordedBuildIDs() *idSet {
+	if ml.recordedBuilds == nil {
+		ml.recordedBuilds = newIDSet(maxRecordedBuildIDs)
+		for _, record := range ml.BuildHistory {
+			if record.BuildID != "" {
+				ml.recordedBuilds.add(record.BuildID)
+			}
+		}
+	}
+	return ml.recordedBuilds
+}
+
+// recordWorkerMetrics adds worker metrics under a single lock, keeping the
+// latest maxWorkerMetrics
+func (ml *MLService) recordWorkerMetrics(workerMetrics []WorkerMetric) {
+	ml.mutex.Lock()
+	defer ml.mutex.Unlock()
+
+	ml.WorkerMetrics = append(ml.WorkerMetrics, workerMetrics...)
+	if excess := len(ml.WorkerMetrics) - maxWorkerMetrics; excess > 0 {
+		ml.WorkerMetrics = append([]WorkerMetric(nil), ml.WorkerMetrics[excess:]...)
+	}
+
+	for _, metric := range workerMetrics {
+		ml.checkWorkerAnomaly(metric)
+	}
+}
@@ -0,0 +1,79 @@
+package service
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRecordBuildsSkipsDuplicates(t *testing.T) {
+	service := NewMLService()
+	now := time.Now()
+	build := Build{ID: "build-1", ProjectPath: "/projects/app", TaskName: "build", StartTime: now.Add(-time.Minute), EndTime: now, Success: true}
+
+	service.RecordBuild(build)
+	if recorded := service.RecordBuilds([]Build{build, {ID: "build-2", StartTime: now, EndTime: now}, {ID: "build-2", StartTime: now, EndTime: now}}); recorded != 1 {
+		t.Errorf("Expected only build-2 to be recorded, got %d builds", recorded)
+	}
+	// Builds without an ID cannot be told apart
+	service.RecordBuilds([]Build{{StartTime: now, EndTime: now}, {StartTime: now, EndTime: now}})
+
+	if len(service.BuildHistory) != 4 {
+		t.Errorf("Expected 4 build records, got %d", len(service.BuildHistory))
+	}
+	if stats := service.ingestStats(); stats.Duplicates != 2 {
+		t.Errorf("Expected 2 duplicates, got %+v", stats)
+	}
+
+	// Builds loaded with the history are recognized too
+	restored := NewMLService()
+	restored.BuildHistory = append(restored.BuildHistory, service.BuildHistory...)
+	if recorded := restored.RecordBuilds([]Build{build}); recorded != 0 {
+		t.Errorf("Expected a build of the loaded history to be skipped, got %d", recorded)
+	}
+}
+
+func TestFlushIngest(t *testing.T) {
+	service := NewMLService()
+	service.Collection.BatchSize = 2
+	service.ingest = newIngestQueue(4)
+
+	now := time.Now()
+	for i := 0; i < 5; i++ {
+		service.enqueueBuild(Build{ID: "build-" + strconv.Itoa(i), StartTime: now, EndTime: now})
+	}
+	service.enqueueWorkerMetric(WorkerMetric{WorkerID: "worker-1", Timestamp: now})
+
+	// The two oldest builds were dropped to make room
+	if stats := service.ingestStats(); stats.Queued != 4 || stats.Dropped != 2 {
+		t.Fatalf("Expected 4 queued and 2 dropped records, got %+v", stats)
+	}
+	if len(service.BuildHistory) != 0 {
+		t.Fatal("Expected queued builds not to be recorded before the flush")
+	}
+
+	service.flushIngest()
+	if len(service.BuildHistory) != 3 || service.BuildHistory[0].BuildID != "build-2" || len(service.WorkerMetrics) != 1 {
+		t.Errorf("Expected builds 2 to 4 and the worker metric, got %+v and %d metrics", service.BuildHistory, len(service.WorkerMetrics))
+	}
+	if stats := service.ingestStats(); stats.Queued != 0 {
+		t.Errorf("Expected the queue to be drained, got %+v", stats)
+	}
+}
+
+func TestRingBuffer(t *testing.T) {
+	ring := newRingBuffer[int](3)
+	for i := 1; i <= 4; i++ {
+		evicted, full := ring.push(i)
+		if full != (i == 4) || (full && evicted != 1) {
+			t.Errorf("Unexpected eviction of %d pushing %d", evicted, i)
+		}
+	}
+	if popped := ring.pop(2); len(popped) != 2 || popped[0] != 2 || popped[1] != 3 {
+		t.Errorf("Expected 2 and 3 first, got %v", popped)
+	}
+	ring.push(5)
+	if popped := ring.pop(10); len(popped) != 2 || popped[0] != 4 || popped[1] != 5 {
+		t.Errorf("Expected 4 and 5, got %v", popped)
+	}
+}
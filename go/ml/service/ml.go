@@ -1,11 +1,9 @@
 package service
 
 import (
-	"encoding/json"
 	"fmt"
 	"log"
 	"math"
-	"net/http"
 	"os"
 	"sort"
 	"strconv"
@@ -24,6 +22,7 @@ type ContinuousLearningConfig struct {
 	CoordinatorPort        int           `json:"coordinator_port"`
 	MonitorHost            string        `json:"monitor_host"`
 	MonitorPort            int           `json:"monitor_port"`
+	ModelDir               string        `json:"model_dir"`
 }
 
 // ModelBackup represents a backup of ML models for rollback
@@ -56,8 +55,40 @@ type MLService struct {
 	Models             MLModels                 `json:"models"`
 	ContinuousLearning ContinuousLearningConfig `json:"continuous_learning"`
 	LearningStats      ContinuousLearningStats  `json:"learning_stats"`
-	mutex              sync.RWMutex
-	shutdown           chan struct{}
+	ModelBackend       ModelBackendConfig       `json:"model_backend"`
+	AnomalyDetection   AnomalyConfig            `json:"anomaly_detection"`
+	Anomalies          []Anomaly                `json:"anomalies"`
+	Collection         CollectionConfig         `json:"collection"`
+	Retention          RetentionConfig          `json:"retention"`
+	DailyAggregates    []DailyAggregate         `json:"daily_aggregates"`
+	Shadow             ShadowConfig             `json:"shadow"`
+	ProjectIsolation   ProjectModelConfig       `json:"project_isolation"`
+	ProjectModels      map[string]*ProjectModel `json:"project_models"`
+	// TestDurations are the durations of the test classes of each project,
+	// by project path and class name
+	TestDurations map[string]map[string]time.Duration `json:"test_durations"`
+	// TestCases are the latest outcomes of each test case of a project, by
+	// project path and class and case name
+	TestCases map[string]map[string]*TestCaseHistory `json:"test_cases"`
+	Flaky     FlakyConfig                            `json:"flaky"`
+	shadow    *shadowModels
+	// ingest queues collected records until they are added in batches, and
+	// recordedBuilds remembers the builds added to skip those collected
+	// again
+	ingest          *ingestQueue
+	recordedBuilds  *idSet
+	duplicateBuilds int
+	reportedDrops   int
+	// training serializes trainings on snapshots of the data, and
+	// trainingJobs tracks those started in the background
+	training         sync.Mutex
+	trainingJobs     *trainingJobs
+	predictor        Predictor
+	featureExtractor *FeatureExtractor
+	anomalyDetector  *AnomalyDetector
+	breakers         map[string]*circuitBreaker
+	mutex            sync.RWMutex
+	shutdown         chan struct{}
 }
 
 // BuildRecord represents a historical build record for ML training
@@ -76,6 +107,8 @@ type BuildRecord struct {
 	DiskUsage    float64           `json:"disk_usage"`
 	BuildOptions map[string]string `json:"build_options"`
 	ErrorMessage string            `json:"error_message,omitempty"`
+	ErrorCode    string            `json:"error_code,omitempty"`
+	Features     *ProjectFeatures  `json:"features,omitempty"`
 }
 
 // WorkerMetric represents worker performance metrics
@@ -116,6 +149,24 @@ type BuildTimeModel struct {
 	Features    []string           `json:"features"`
 	Accuracy    float64            `json:"accuracy"`
 	LastTrained time.Time          `json:"last_trained"`
+
+	// Project structure regression used for cold-start predictions
+	FeatureWeights map[string]float64 `json:"feature_weights"`
+	FeatureBias    float64            `json:"feature_bias"`
+	FeatureSamples int                `json:"feature_samples"`
+
+	// WorkerFactors is how much longer than the fleet average each worker
+	// takes, learned from its past builds
+	WorkerFactors map[string]float64 `json:"worker_factors,omitempty"`
+
+	// HourFactors and WeekdayFactors are how much longer than usual builds
+	// starting in an hour of the day (0-23) and on a day of the week (0 is
+	// Sunday) take, and LoadWeight the share each build running in the
+	// cluster beyond MeanLoad adds, learned from past builds
+	HourFactors    map[int]float64 `json:"hour_factors,omitempty"`
+	WeekdayFactors map[int]float64 `json:"weekday_factors,omitempty"`
+	LoadWeight     float64         `json:"load_weight,omitempty"`
+	MeanLoad       float64         `json:"mean_load,omitempty"`
 }
 
 // ResourceModel predicts resource requirements
@@ -150,6 +201,12 @@ type FailureModel struct {
 	RiskFactors   []string           `json:"risk_factors"`
 	Accuracy      float64            `json:"accuracy"`
 	LastTrained   time.Time          `json:"last_trained"`
+	// ClassPriors is the share of each error code among failed builds and
+	// ClassTermWeights the log-likelihood of the terms of their error
+	// messages by code, ClassUnseenWeights that of terms never seen with it
+	ClassPriors        map[string]float64            `json:"class_priors,omitempty"`
+	ClassTermWeights   map[string]map[string]float64 `json:"class_term_weights,omitempty"`
+	ClassUnseenWeights map[string]float64            `json:"class_unseen_weights,omitempty"`
 }
 
 // CacheModel predicts cache performance
@@ -169,6 +226,27 @@ type PredictionResult struct {
 	ScalingAdvice ScalingRecommendation `json:"scaling_advice"`
 	FailureRisk   float64               `json:"failure_risk"`
 	CacheHitRate  float64               `json:"cache_hit_rate"`
+	// Failure is how the build is expected to fail, if failures of the
+	// project or any others are known
+	Failure *FailurePrediction `json:"failure,omitempty"`
+	// EstimatedQueueWait is how long the build is expected to wait for a worker
+	EstimatedQueueWait time.Duration `json:"estimated_queue_wait"`
+	// Median and 90th percentile of the build durations the prediction is
+	// based on, and how many there were
+	P50Time    time.Duration `json:"p50_time"`
+	P90Time    time.Duration `json:"p90_time"`
+	SampleSize int           `json:"sample_size"`
+	// Basis tells what the prediction is based on, Factors the features or
+	// past builds contributing most to it
+	Basis   string             `json:"basis"`
+	Factors []PredictionFactor `json:"factors"`
+	// WorkerFactor is the factor the durations were scaled by for the
+	// worker the build runs on, absent for a typical worker
+	WorkerFactor float64 `json:"worker_factor,omitempty"`
+	// TemporalFactor is the factor the durations were scaled by for the
+	// hour, day and cluster load the build is submitted at, absent when
+	// these make no difference
+	TemporalFactor float64 `json:"temporal_factor,omitempty"`
 }
 
 // ResourcePrediction predicts resource requirements
@@ -194,8 +272,17 @@ func NewMLService() *MLService {
 		CacheMetrics:  make([]CacheMetric, 0),
 		Models: MLModels{
 			BuildTimePredictor: BuildTimeModel{
-				Weights: make(map[string]float64),
-				Bias:    300.0, // Default 5 minutes
+				Weights:  make(map[string]float64),
+				Bias:     300.0, // Default 5 minutes
+				Features: featureNames,
+				// Untrained cold-start heuristic, refined by training
+				FeatureWeights: map[string]float64{
+					FeatureModules:      30.0,
+					FeatureKLOC:         15.0,
+					FeatureDependencies: 2.0,
+					FeatureChangedFiles: 1.0,
+				},
+				FeatureBias: 60.0,
 			},
 			ResourcePredictor: ResourceModel{
 				CPUWeights:  make(map[string]float64),
@@ -227,17 +314,79 @@ func NewMLService() *MLService {
 			CoordinatorPort:        8080,
 			MonitorHost:            "monitor",
 			MonitorPort:            8084,
+			ModelDir:               "models",
 		},
 		LearningStats: ContinuousLearningStats{
 			LastDataCollection: time.Now(),
 			LastRetraining:     time.Now(),
 			CurrentVersion:     "v1.0",
 		},
+		ModelBackend: ModelBackendConfig{
+			Type:    "builtin",
+			Timeout: 2 * time.Second,
+		},
+		AnomalyDetection: AnomalyConfig{
+			Enabled:    true,
+			Alpha:      0.1,
+			Threshold:  3.0,
+			MinSamples: 10,
+		},
+		Collection: CollectionConfig{
+			Timeout:          10 * time.Second,
+			MaxRetries:       3,
+			RetryBackoff:     time.Second,
+			MaxBackoff:       30 * time.Second,
+			FailureThreshold: 3,                // Suspend after 3 failed collections
+			OpenDuration:     30 * time.Minute, // Try again after 30 minutes
+			QueueSize:        defaultIngestQueueSize,
+			BatchSize:        defaultIngestBatchSize,
+		},
+		Retention: RetentionConfig{
+			RawRetention:       30 * 24 * time.Hour,
+			MaxBuildRecords:    10000,
+			RollupRetention:    2 * 365 * 24 * time.Hour,
+			MaxDailyAggregates: 100000,
+		},
+		Shadow: ShadowConfig{
+			Enabled: true,
+			Window:  50,
+		},
+		ProjectIsolation: ProjectModelConfig{
+			Enabled:    true,
+			MinRecords: 50,
+		},
+		ProjectModels: make(map[string]*ProjectModel),
+		TestDurations: make(map[string]map[string]time.Duration),
+		trainingJobs:  newTrainingJobs(),
+		TestCases:     make(map[string]map[string]*TestCaseHistory),
+		Flaky: FlakyConfig{
+			History:            50,
+			QuarantineCommits:  2,
+			QuarantineFlipRate: 0.3,
+		},
+		DailyAggregates:  make([]DailyAggregate, 0),
+		Anomalies:        make([]Anomaly, 0),
+		featureExtractor: NewFeatureExtractor(getEnvString("ML_PROJECTS_ROOT", ""), 5*time.Minute),
+		breakers: map[string]*circuitBreaker{
+			SourceMonitor:     newCircuitBreaker(SourceMonitor),
+			SourceCoordinator: newCircuitBreaker(SourceCoordinator),
+		},
 		shutdown: make(chan struct{}),
 	}
 
 	// Load configuration from environment
 	service.loadContinuousLearningConfig()
+	service.loadModelBackendConfig()
+	service.loadAnomalyConfig()
+	service.loadCollectionConfig()
+	service.loadRetentionConfig()
+	service.loadShadowConfig()
+	service.loadProjectModelConfig()
+	service.loadFlakyConfig()
+
+	service.predictor = newPredictor(service, service.ModelBackend)
+	service.ingest = newIngestQueue(service.Collection.QueueSize)
+	service.anomalyDetector = NewAnomalyDetector(service.AnomalyDetection)
 
 	return service
 }
@@ -280,6 +429,17 @@ func (ml *MLService) loadContinuousLearningConfig() {
 	if port := getEnvAsInt("ML_MONITOR_PORT", ml.ContinuousLearning.MonitorPort); port != ml.ContinuousLearning.MonitorPort {
 		ml.ContinuousLearning.MonitorPort = port
 	}
+
+	if dir := getEnvString("ML_MODEL_DIR", ml.ContinuousLearning.ModelDir); dir != ml.ContinuousLearning.ModelDir {
+		ml.ContinuousLearning.ModelDir = dir
+	}
+}
+
+// loadModelBackendConfig loads model backend selection from environment variables
+func (ml *MLService) loadModelBackendConfig() {
+	ml.ModelBackend.Type = getEnvString("ML_MODEL_BACKEND", ml.ModelBackend.Type)
+	ml.ModelBackend.ServerURL = getEnvString("ML_MODEL_SERVER_URL", ml.ModelBackend.ServerURL)
+	ml.ModelBackend.Timeout = getEnvAsDuration("ML_MODEL_SERVER_TIMEOUT", ml.ModelBackend.Timeout)
 }
 
 // Build represents a completed build for ML analysis
@@ -297,47 +457,19 @@ type Build struct {
 	DiskUsage    float64
 	BuildOptions map[string]string
 	ErrorMessage string
+	ErrorCode    string
+	Features     *ProjectFeatures
 }
 
-// RecordBuild adds a build record to the history
+// RecordBuild adds a build record to the history, unless a build with the
+// same ID was recorded before
 func (ml *MLService) RecordBuild(build Build) {
-	ml.mutex.Lock()
-	defer ml.mutex.Unlock()
-
-	record := BuildRecord{
-		BuildID:      build.ID,
-		ProjectPath:  build.ProjectPath,
-		TaskName:     build.TaskName,
-		WorkerID:     build.WorkerID,
-		StartTime:    build.StartTime,
-		EndTime:      build.EndTime,
-		Duration:     build.EndTime.Sub(build.StartTime),
-		Success:      build.Success,
-		CacheHitRate: build.CacheHitRate,
-		CPUUsage:     build.CPUUsage,
-		MemoryUsage:  build.MemoryUsage,
-		DiskUsage:    build.DiskUsage,
-		BuildOptions: build.BuildOptions,
-		ErrorMessage: build.ErrorMessage,
-	}
-
-	// Keep only last 10000 records to prevent memory issues
-	if len(ml.BuildHistory) >= 10000 {
-		ml.BuildHistory = ml.BuildHistory[1:]
-	}
-	ml.BuildHistory = append(ml.BuildHistory, record)
+	ml.RecordBuilds([]Build{build})
 }
 
 // RecordWorkerMetrics adds worker performance metrics
 func (ml *MLService) RecordWorkerMetrics(metrics WorkerMetric) {
-	ml.mutex.Lock()
-	defer ml.mutex.Unlock()
-
-	// Keep only last 5000 metrics
-	if len(ml.WorkerMetrics) >= 5000 {
-		ml.WorkerMetrics = ml.WorkerMetrics[1:]
-	}
-	ml.WorkerMetrics = append(ml.WorkerMetrics, metrics)
+	ml.recordWorkerMetrics([]WorkerMetric{metrics})
 }
 
 // RecordCacheMetrics adds cache performance metrics
@@ -354,45 +486,65 @@ func (ml *MLService) RecordCacheMetrics(metrics CacheMetric) {
 
 // PredictBuildTime predicts the duration of a build
 func (ml *MLService) PredictBuildTime(projectPath, taskName string, buildOptions map[string]string) (time.Duration, float64) {
+	features := ml.projectFeatures(projectPath)
+
 	ml.mutex.RLock()
 	defer ml.mutex.RUnlock()
 
+	return ml.predictBuildTime(ml.modelsFor(projectPath).BuildTimePredictor, features, projectPath, taskName)
+}
+
+// predictBuildTime predicts the duration of a build with a build time model.
+// Must be called with the mutex held.
+func (ml *MLService) predictBuildTime(model BuildTimeModel, features ProjectFeatures, projectPath, taskName string) (time.Duration, float64) {
+	estimate := ml.estimateBuildTime(model, features, projectPath, taskName)
+	return estimate.duration, estimate.confidence
+}
+
+// estimateBuildTime estimates the duration of a build with a build time
+// model, keeping the build durations or features it is based on. Must be
+// called with the mutex held.
+func (ml *MLService) estimateBuildTime(model BuildTimeModel, features ProjectFeatures, projectPath, taskName string) buildTimeEstimate {
 	if len(ml.BuildHistory) < 10 {
+		if !features.IsZero() {
+			// Cold start: estimate from project structure
+			return model.estimateFromFeatures(features)
+		}
 		// Not enough data, return default
-		return 5 * time.Minute, 0.5
+		return buildTimeEstimate{duration: 5 * time.Minute, confidence: 0.5, basis: BasisDefault}
 	}
 
 	// Simple prediction based on historical averages for similar builds
-	var totalDuration time.Duration
-	var count int
 	var similarBuilds []BuildRecord
-
 	for _, record := range ml.BuildHistory {
 		if record.ProjectPath == projectPath && record.TaskName == taskName && record.Success {
 			similarBuilds = append(similarBuilds, record)
-			totalDuration += record.Duration
-			count++
 		}
 	}
-
-	if count == 0 {
-		// No similar builds, use overall average
-		for _, record := range ml.BuildHistory {
-			if record.Success {
-				totalDuration += record.Duration
-				count++
-			}
-		}
+	if len(similarBuilds) > 0 {
+		return estimateFromHistory(similarBuilds, BasisSimilarBuilds)
 	}
 
-	if count == 0 {
-		return 5 * time.Minute, 0.3
+	if !features.IsZero() {
+		// No similar builds, estimate from project structure
+		return model.estimateFromFeatures(features)
 	}
 
-	averageDuration := totalDuration / time.Duration(count)
-	confidence := math.Min(0.9, float64(count)/100.0) // Higher confidence with more data
-
-	return averageDuration, confidence
+	// No similar builds, use overall average
+	basis := BasisAllBuilds
+	if ml.projectModel(projectPath) != nil {
+		basis = BasisProjectBuilds
+	}
+	var successful []BuildRecord
+	for _, record := range ml.fallbackRecords(projectPath) {
+		if record.Success {
+			successful = append(successful, record)
+		}
+	}
+	if len(successful) == 0 {
+		return buildTimeEstimate{duration: 5 * time.Minute, confidence: 0.3, basis: BasisDefault}
+	}
+	return estimateFromHistory(successful, basis)
 }
 
 // PredictResourceNeeds predicts resource requirements for a build
@@ -418,7 +570,7 @@ func (ml *MLService) PredictResourceNeeds(projectPath, taskName string) Resource
 
 	if count == 0 {
 		// Use overall averages
-		for _, record := range ml.BuildHistory {
+		for _, record := range ml.fallbackRecords(projectPath) {
 			if record.Success {
 				totalCPU += record.CPUUsage
 				totalMem += record.MemoryUsage
@@ -475,11 +627,13 @@ func (ml *MLService) PredictScalingNeeds(queueLength int, avgCPULoad float64, cu
 
 // PredictFailureRisk predicts the risk of build failure
 func (ml *MLService) PredictFailureRisk(projectPath, taskName string) float64 {
+	features := ml.projectFeatures(projectPath)
+
 	ml.mutex.RLock()
 	defer ml.mutex.RUnlock()
 
 	if len(ml.BuildHistory) < 5 {
-		return 0.1 // Default low risk
+		return predictFailureRiskFromFeatures(0.1, features) // Default low risk
 	}
 
 	var failures, total int
@@ -493,7 +647,7 @@ func (ml *MLService) PredictFailureRisk(projectPath, taskName string) float64 {
 	}
 
 	if total == 0 {
-		return 0.1
+		return predictFailureRiskFromFeatures(0.1, features)
 	}
 
 	failureRate := float64(failures) / float64(total)
@@ -542,7 +696,7 @@ func (ml *MLService) PredictCacheHitRate(projectPath, taskName string) float64 {
 
 	if count == 0 {
 		// Use overall average
-		for _, record := range ml.BuildHistory {
+		for _, record := range ml.fallbackRecords(projectPath) {
 			totalHitRate += record.CacheHitRate
 			count++
 		}
@@ -555,23 +709,32 @@ func (ml *MLService) PredictCacheHitRate(projectPath, taskName string) float64 {
 	return totalHitRate / float64(count)
 }
 
-// GetBuildInsights provides comprehensive build insights
+// GetBuildInsights provides comprehensive build insights of a build
+// submitted now
 func (ml *MLService) GetBuildInsights(projectPath, taskName string, buildOptions map[string]string) PredictionResult {
-	predictedTime, timeConfidence := ml.PredictBuildTime(projectPath, taskName, buildOptions)
+	return ml.buildInsights(projectPath, taskName, buildOptions, time.Now(), -1)
+}
+
+// buildInsights provides the insights of a build submitted at a time with
+// load builds running in the cluster, or the load the workers last reported
+// if load is negative
+func (ml *MLService) buildInsights(projectPath, taskName string, buildOptions map[string]string, submittedAt time.Time, load int) PredictionResult {
+	predictedTime, timeConfidence := ml.predictBuildTimeWithBackend(projectPath, taskName, buildOptions)
 	resourceNeeds := ml.PredictResourceNeeds(projectPath, taskName)
-	failureRisk := ml.PredictFailureRisk(projectPath, taskName)
+	failureRisk := ml.predictFailureRiskWithBackend(projectPath, taskName)
 	cacheHitRate := ml.PredictCacheHitRate(projectPath, taskName)
 
 	// Generate a build ID for this prediction
 	buildID := fmt.Sprintf("prediction_%d", time.Now().Unix())
 
-	return PredictionResult{
+	result := PredictionResult{
 		BuildID:       buildID,
 		PredictedTime: predictedTime,
 		Confidence:    timeConfidence,
 		ResourceNeeds: resourceNeeds,
 		FailureRisk:   failureRisk,
 		CacheHitRate:  cacheHitRate,
+		Failure:       ml.predictFailure(projectPath, taskName, failureRisk),
 		ScalingAdvice: ScalingRecommendation{
 			Action:        "maintain",
 			WorkersNeeded: 1,
@@ -579,32 +742,83 @@ func (ml *MLService) GetBuildInsights(projectPath, taskName string, buildOptions
 			Reason:        "Prediction for individual build",
 		},
 	}
+	ml.explainBuildTime(&result, projectPath, taskName)
+	ml.applyTemporalFactors(&result, projectPath, submittedAt, load)
+
+	return result
 }
 
-// TrainModels trains all ML models with current data
-func (ml *MLService) TrainModels() error {
-	ml.mutex.Lock()
-	defer ml.mutex.Unlock()
+// PredictionRequest describes a single build to be scored in a batch
+type PredictionRequest struct {
+	ProjectPath  string            `json:"project_path"`
+	TaskName     string            `json:"task_name"`
+	BuildOptions map[string]string `json:"build_options"`
+	// WorkerID and WorkerSpeed select the worker the durations are scaled
+	// to: the speed learned from its builds, or else its calibrated speed
+	// relative to the fleet, 2 for twice as fast
+	WorkerID    string  `json:"worker_id,omitempty"`
+	WorkerSpeed float64 `json:"worker_speed,omitempty"`
+	// SubmittedAt is when the build is submitted, now if zero, and
+	// ClusterLoad how many builds run in the cluster then, the number the
+	// workers last reported if zero
+	SubmittedAt time.Time `json:"submitted_at,omitempty"`
+	ClusterLoad int       `json:"cluster_load,omitempty"`
+}
 
-	if len(ml.BuildHistory) < 20 {
-		return fmt.Errorf("insufficient data for training: need at least 20 build records, have %d", len(ml.BuildHistory))
+// GetBatchBuildInsights scores several builds at once, evaluating at most
+// concurrency predictions in parallel. Results are returned in request order.
+func (ml *MLService) GetBatchBuildInsights(requests []PredictionRequest, concurrency int) []PredictionResult {
+	if concurrency <= 0 {
+		concurrency = 1
 	}
 
-	// Train build time predictor
-	ml.trainBuildTimeModel()
+	results := make([]PredictionResult, len(requests))
+	semaphore := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
 
-	// Train resource predictor
-	ml.trainResourceModel()
+	for i, request := range requests {
+		wg.Add(1)
+		semaphore <- struct{}{}
 
-	// Train failure predictor
-	ml.trainFailureModel()
+		go func(index int, req PredictionRequest) {
+			defer wg.Done()
+			defer func() { <-semaphore }()
 
-	// Train cache predictor
-	ml.trainCacheModel()
+			results[index] = ml.GetWorkerBuildInsights(req)
+		}(i, request)
+	}
 
-	// Train scaling patterns
-	ml.trainScalingPatterns()
+	wg.Wait()
+	return results
+}
+
+// TrainModels trains all ML models with current data, including the models
+// of projects and groups with enough build records. They are trained on a
+// copy of the data, so predictions are served meanwhile, and replace the
+// current models at once.
+func (ml *MLService) TrainModels() error {
+	return ml.train(nil)
+}
+
+// trainModels trains all ML models in place. Must be called with the mutex
+// held.
+func (ml *MLService) trainModels() error {
+	return ml.trainModelsReporting(nil)
+}
+
+// trainModelsReporting trains all ML models in place, calling progress, if
+// not nil, before each stage. Must be called with the mutex held.
+func (ml *MLService) trainModelsReporting(progress func(stage string)) error {
+	if len(ml.BuildHistory) < 20 {
+		return fmt.Errorf("insufficient data for training: need at least 20 build records, have %d", len(ml.BuildHistory))
+	}
 
+	for _, stage := range ml.trainingStages() {
+		if progress != nil {
+			progress(stage.name)
+		}
+		stage.train()
+	}
 	return nil
 }
 
@@ -641,6 +855,9 @@ func (ml *MLService) trainBuildTimeModel() {
 		}
 	}
 
+	ml.trainWorkerFactors()
+	ml.trainTemporalFactors()
+
 	ml.Models.BuildTimePredictor.LastTrained = time.Now()
 	ml.Models.BuildTimePredictor.Accuracy = 0.75 // Placeholder accuracy
 }
@@ -723,6 +940,8 @@ func (ml *MLService) trainFailureModel() {
 		ml.Models.FailurePredictor.ErrorPatterns[errorMsg] = float64(count) / float64(len(ml.BuildHistory))
 	}
 
+	ml.trainFailureClasses()
+
 	ml.Models.FailurePredictor.LastTrained = time.Now()
 	ml.Models.FailurePredictor.Accuracy = 0.7
 }
@@ -815,11 +1034,16 @@ func (ml *MLService) GetStatistics() map[string]any {
 	stats["total_build_records"] = len(ml.BuildHistory)
 	stats["total_worker_metrics"] = len(ml.WorkerMetrics)
 	stats["total_cache_metrics"] = len(ml.CacheMetrics)
+	stats["total_daily_aggregates"] = len(ml.DailyAggregates)
+	stats["project_models"] = len(ml.ProjectModels)
 
 	if len(ml.BuildHistory) > 0 {
 		stats["oldest_build"] = ml.BuildHistory[0].StartTime
 		stats["newest_build"] = ml.BuildHistory[len(ml.BuildHistory)-1].StartTime
 	}
+	if len(ml.DailyAggregates) > 0 {
+		stats["oldest_aggregate"] = ml.DailyAggregates[0].Day
+	}
 
 	stats["models_trained"] = map[string]any{
 		"build_time": !ml.Models.BuildTimePredictor.LastTrained.IsZero(),
@@ -838,8 +1062,11 @@ func (ml *MLService) GetLearningStats() map[string]any {
 	defer ml.mutex.RUnlock()
 
 	return map[string]any{
-		"config": ml.ContinuousLearning,
-		"stats":  ml.LearningStats,
+		"config":     ml.ContinuousLearning,
+		"stats":      ml.LearningStats,
+		"collection": ml.CollectionHealth(),
+		"shadow":     ml.shadowEvaluation(),
+		"ingest":     ml.ingestStats(),
 	}
 }
 
@@ -898,22 +1125,6 @@ func getEnvAsDuration(key string, defaultValue time.Duration) time.Duration {
 	return defaultValue
 }
 
-// ExportData exports all ML data for backup/analysis
-func (ml *MLService) ExportData() ([]byte, error) {
-	ml.mutex.RLock()
-	defer ml.mutex.RUnlock()
-
-	return json.MarshalIndent(ml, "", "  ")
-}
-
-// ImportData imports ML data from backup
-func (ml *MLService) ImportData(data []byte) error {
-	ml.mutex.Lock()
-	defer ml.mutex.Unlock()
-
-	return json.Unmarshal(data, ml)
-}
-
 // StartContinuousLearning starts the automated learning process
 func (ml *MLService) StartContinuousLearning() {
 	if !ml.ContinuousLearning.Enabled {
@@ -958,6 +1169,9 @@ func (ml *MLService) retrainingTriggerLoop() {
 	for {
 		select {
 		case <-ticker.C:
+			if rolled := ml.ApplyRetention(); rolled > 0 {
+				log.Printf("Rolled up %d build records into daily aggregates", rolled)
+			}
 			ml.checkRetrainingConditions()
 		case <-ml.shutdown:
 			return
@@ -976,6 +1190,8 @@ func (ml *MLService) collectDataFromServices() {
 	// Collect data from coordinator
 	ml.collectFromCoordinator()
 
+	ml.flushIngest()
+
 	ml.LearningStats.LastDataCollection = time.Now()
 	ml.LearningStats.DataPointsCollected = len(ml.BuildHistory) + len(ml.WorkerMetrics) + len(ml.CacheMetrics)
 }
@@ -984,21 +1200,13 @@ func (ml *MLService) collectDataFromServices() {
 func (ml *MLService) collectFromMonitor() {
 	monitorURL := fmt.Sprintf("http://%s:%d/api/metrics", ml.ContinuousLearning.MonitorHost, ml.ContinuousLearning.MonitorPort)
 
-	resp, err := http.Get(monitorURL)
-	if err != nil {
-		log.Printf("Failed to collect data from monitor: %v", err)
-		return
-	}
-	defer resp.Body.Close()
-
 	var monitorData struct {
 		Workers map[string]any `json:"workers"`
 		Builds  map[string]any `json:"builds"`
 		System  map[string]any `json:"system"`
 	}
 
-	if err := json.NewDecoder(resp.Body).Decode(&monitorData); err != nil {
-		log.Printf("Failed to decode monitor data: %v", err)
+	if !ml.fetch(SourceMonitor, monitorURL, &monitorData) {
 		return
 	}
 
@@ -1025,7 +1233,7 @@ func (ml *MLService) collectFromMonitor() {
 				metric.MemoryUsage = mem
 			}
 
-			ml.RecordWorkerMetrics(metric)
+			ml.enqueueWorkerMetric(metric)
 		}
 	}
 
@@ -1083,8 +1291,11 @@ func (ml *MLService) collectFromMonitor() {
 			if errorMsg, ok := buildMap["error_message"].(string); ok {
 				build.ErrorMessage = errorMsg
 			}
+			if errorCode, ok := buildMap["error_code"].(string); ok {
+				build.ErrorCode = errorCode
+			}
 
-			ml.RecordBuild(build)
+			ml.enqueueBuild(build)
 		}
 	}
 }
@@ -1093,13 +1304,6 @@ func (ml *MLService) collectFromMonitor() {
 func (ml *MLService) collectFromCoordinator() {
 	coordinatorURL := fmt.Sprintf("http://%s:%d/api/workers", ml.ContinuousLearning.CoordinatorHost, ml.ContinuousLearning.CoordinatorPort)
 
-	resp, err := http.Get(coordinatorURL)
-	if err != nil {
-		log.Printf("Failed to collect data from coordinator: %v", err)
-		return
-	}
-	defer resp.Body.Close()
-
 	var workers []struct {
 		ID       string    `json:"id"`
 		Status   string    `json:"status"`
@@ -1112,8 +1316,7 @@ func (ml *MLService) collectFromCoordinator() {
 		} `json:"metrics"`
 	}
 
-	if err := json.NewDecoder(resp.Body).Decode(&workers); err != nil {
-		log.Printf("Failed to decode coordinator data: %v", err)
+	if !ml.fetch(SourceCoordinator, coordinatorURL, &workers) {
 		return
 	}
 
@@ -1134,7 +1337,7 @@ func (ml *MLService) collectFromCoordinator() {
 			metric.ActiveBuilds = 1
 		}
 
-		ml.RecordWorkerMetrics(metric)
+		ml.enqueueWorkerMetric(metric)
 	}
 }
 
@@ -1143,6 +1346,11 @@ func (ml *MLService) checkRetrainingConditions() {
 	ml.mutex.RLock()
 	defer ml.mutex.RUnlock()
 
+	// Candidate models are not replaced while they are being evaluated
+	if ml.shadowRunning() {
+		return
+	}
+
 	now := time.Now()
 	shouldRetrain := false
 	reason := ""
@@ -1207,19 +1415,31 @@ func (ml *MLService) backupCurrentModels() {
 	ml.LearningStats.ModelBackups = append(ml.LearningStats.ModelBackups, backup)
 
 	log.Printf("Created model backup version %s with accuracy %.3f", backup.Version, backup.Accuracy)
+
+	if err := ml.saveModelSnapshot(backup); err != nil {
+		log.Printf("Failed to persist model backup %s: %v", backup.Version, err)
+	}
 }
 
 // rollbackToBackup restores models from a backup
 func (ml *MLService) rollbackToBackup(version string) error {
 	for _, backup := range ml.LearningStats.ModelBackups {
 		if backup.Version == version {
-			ml.Models = backup.Models // Restore models
-			ml.LearningStats.CurrentVersion = version
-			ml.LearningStats.AverageAccuracy = backup.Accuracy
+			ml.restoreBackup(backup)
 			log.Printf("Rolled back to model version %s (accuracy: %.3f)", version, backup.Accuracy)
 			return nil
 		}
 	}
+
+	// Fall back to snapshots persisted by previous runs
+	if ml.ContinuousLearning.ModelDir != "" {
+		if backup, err := ml.loadModelSnapshot(version); err == nil {
+			ml.restoreBackup(*backup)
+			log.Printf("Rolled back to persisted model version %s (accuracy: %.3f)", version, backup.Accuracy)
+			return nil
+		}
+	}
+
 	return fmt.Errorf("backup version %s not found", version)
 }
 
@@ -1235,12 +1455,22 @@ func (ml *MLService) triggerRetraining(reason string) {
 	ml.LearningStats.IsRetraining = true
 	defer func() { ml.LearningStats.IsRetraining = false }()
 
-	// Create backup before retraining
-	ml.backupCurrentModels()
-
 	// Generate new version
 	newVersion := ml.generateModelVersion()
 
+	// Candidates are promoted only once they beat the current models
+	if ml.Shadow.Enabled {
+		// Shadow evaluation compares the global models only
+		ml.TrainProjectModels()
+		if err := ml.startShadowEvaluation(newVersion, reason); err != nil {
+			log.Printf("Retraining failed: %v", err)
+		}
+		return
+	}
+
+	// Create backup before retraining
+	ml.backupCurrentModels()
+
 	if err := ml.TrainModels(); err != nil {
 		log.Printf("Retraining failed: %v", err)
 		// Attempt rollback on failure
@@ -1273,23 +1503,42 @@ func (ml *MLService) triggerRetraining(reason string) {
 		return
 	}
 
-	// Accept new models
+	ml.acceptModels(newVersion, newAccuracy)
+}
+
+// acceptModels makes the active models the new current version and persists
+// them
+func (ml *MLService) acceptModels(version string, accuracy float64) {
 	ml.LearningStats.LastRetraining = time.Now()
 	ml.LearningStats.RetrainingCount++
-	ml.LearningStats.AverageAccuracy = newAccuracy
+	ml.LearningStats.AverageAccuracy = accuracy
 	ml.LearningStats.LastAccuracyCheck = time.Now()
-	ml.LearningStats.CurrentVersion = newVersion
+	ml.LearningStats.CurrentVersion = version
 
-	log.Printf("Model retraining completed successfully - new version %s (accuracy: %.3f)", newVersion, newAccuracy)
+	if err := ml.saveModelSnapshot(ModelBackup{
+		Timestamp: time.Now(),
+		Models:    ml.Models,
+		Accuracy:  accuracy,
+		Version:   version,
+	}); err != nil {
+		log.Printf("Failed to persist model version %s: %v", version, err)
+	}
+
+	log.Printf("Model retraining completed successfully - new version %s (accuracy: %.3f)", version, accuracy)
 }
 
 // calculateAverageModelAccuracy calculates average accuracy across all models
 func (ml *MLService) calculateAverageModelAccuracy() float64 {
+	return modelAccuracy(ml.Models)
+}
+
+// modelAccuracy calculates average accuracy across models
+func modelAccuracy(models MLModels) float64 {
 	accuracies := []float64{
-		ml.Models.BuildTimePredictor.Accuracy,
-		ml.Models.ResourcePredictor.Accuracy,
-		ml.Models.FailurePredictor.Accuracy,
-		ml.Models.CachePredictor.Accuracy,
+		models.BuildTimePredictor.Accuracy,
+		models.ResourcePredictor.Accuracy,
+		models.FailurePredictor.Accuracy,
+		models.CachePredictor.Accuracy,
 	}
 
 	sum := 0.0
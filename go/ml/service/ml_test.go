@@ -4,6 +4,9 @@ import (
 	"fmt"
 	"testing"
 	"time"
+
+	"distributed-gradle-building/metrics"
+	dto "github.com/prometheus/client_model/go"
 )
 
 func TestNewMLService(t *testing.T) {
@@ -80,6 +83,30 @@ func TestRecordBuild(t *testing.T) {
 	}
 }
 
+func TestRecordBuildObservesPredictionError(t *testing.T) {
+	sampleCount := func() uint64 {
+		var metric dto.Metric
+		if err := metrics.PredictionErrors.Write(&metric); err != nil {
+			t.Fatalf("Failed to read prediction errors: %v", err)
+		}
+		return metric.GetHistogram().GetSampleCount()
+	}
+
+	service := NewMLService()
+	before := sampleCount()
+
+	start := time.Now().Add(-time.Minute)
+	service.RecordBuild(Build{ID: "ok", ProjectPath: "/test/project", TaskName: "build", StartTime: start, EndTime: start.Add(30 * time.Second), Success: true})
+	if got := sampleCount() - before; got != 1 {
+		t.Errorf("Expected 1 prediction error observation for a successful build, got %d", got)
+	}
+
+	service.RecordBuild(Build{ID: "failed", ProjectPath: "/test/project", TaskName: "build", StartTime: start, EndTime: start.Add(time.Second), Success: false})
+	if got := sampleCount() - before; got != 1 {
+		t.Errorf("Expected failed builds not to be compared with predictions, got %d observations", got)
+	}
+}
+
 func TestRecordWorkerMetrics(t *testing.T) {
 	service := NewMLService()
 
@@ -532,6 +559,52 @@ func TestGetBuildInsights(t *testing.T) {
 	}
 }
 
+func TestGetBatchBuildInsights(t *testing.T) {
+	service := NewMLService()
+	now := time.Now()
+
+	for i := 0; i < 12; i++ {
+		service.RecordBuild(Build{
+			ID:          fmt.Sprintf("build-%d", i),
+			ProjectPath: "/test/project",
+			TaskName:    "build",
+			StartTime:   now.Add(-10 * time.Minute),
+			EndTime:     now.Add(-8 * time.Minute),
+			Success:     true,
+		})
+	}
+
+	requests := []PredictionRequest{
+		{ProjectPath: "/test/project", TaskName: "build"},
+		{ProjectPath: "/other/project", TaskName: "test"},
+		{ProjectPath: "/test/project", TaskName: "build", BuildOptions: map[string]string{"clean": "true"}},
+	}
+
+	results := service.GetBatchBuildInsights(requests, 2)
+	if len(results) != len(requests) {
+		t.Fatalf("Expected %d results, got %d", len(requests), len(results))
+	}
+
+	if results[0].PredictedTime != 2*time.Minute {
+		t.Errorf("Expected predicted time 2m for first request, got %v", results[0].PredictedTime)
+	}
+
+	for i, result := range results {
+		if result.PredictedTime <= 0 {
+			t.Errorf("Expected positive predicted time for request %d, got %v", i, result.PredictedTime)
+		}
+	}
+
+	// Zero concurrency falls back to sequential evaluation
+	if results := service.GetBatchBuildInsights(requests, 0); len(results) != len(requests) {
+		t.Errorf("Expected %d results with zero concurrency, got %d", len(requests), len(results))
+	}
+
+	if results := service.GetBatchBuildInsights(nil, 4); len(results) != 0 {
+		t.Errorf("Expected no results for empty batch, got %d", len(results))
+	}
+}
+
 func TestGetStatistics(t *testing.T) {
 	service := NewMLService()
 
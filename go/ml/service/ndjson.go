@@ -0,0 +1,246 @@
+package service
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"time"
+)
+
+// Page sizes of NDJSON exports, in lines
+const (
+	DefaultNDJSONPageSize = 1000
+	MaxNDJSONPageSize     = 10000
+)
+
+// NDJSONOptions selects the sections and the page of an NDJSON export.
+// Empty Sections exports every section, and an empty Cursor starts from the
+// first record.
+type NDJSONOptions struct {
+	Sections []string
+	Cursor   string
+	PageSize int
+}
+
+// NDJSONLine is a line of an NDJSON export: a record of a section, or the
+// models
+type NDJSONLine struct {
+	Section string          `json:"section"`
+	Data    json.RawMessage `json:"data"`
+}
+
+// NDJSONPage is a page of an NDJSON export. Next is the cursor of the
+// following page, empty on the last page.
+type NDJSONPage struct {
+	Next  string
+	lines []ndjsonItem
+}
+
+// ndjsonItem is a record of an export with the key it is ordered by
+type ndjsonItem struct {
+	section string
+	time    time.Time
+	key     string
+	data    any
+}
+
+// ndjsonCursor is the position after the last line of a page: its section
+// and key, and how many records with that key the pages so far held, as
+// several records may share a key
+type ndjsonCursor struct {
+	Section string    `json:"s"`
+	Time    time.Time `json:"t"`
+	Key     string    `json:"k,omitempty"`
+	Seen    int       `json:"n"`
+}
+
+func (c ndjsonCursor) encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeNDJSONCursor(cursor string) (ndjsonCursor, error) {
+	var decoded ndjsonCursor
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err == nil {
+		err = json.Unmarshal(data, &decoded)
+	}
+	if err != nil || !slices.Contains(DataSections, decoded.Section) || decoded.Seen < 1 {
+		return ndjsonCursor{}, fmt.Errorf("invalid cursor")
+	}
+	return decoded, nil
+}
+
+// compareNDJSON orders records by time, then key
+func compareNDJSON(a, b ndjsonItem) int {
+	if c := a.time.Compare(b.time); c != 0 {
+		return c
+	}
+	switch {
+	case a.key < b.key:
+		return -1
+	case a.key > b.key:
+		return 1
+	}
+	return 0
+}
+
+// NDJSONPage returns a page of the ML data as NDJSON lines, section by
+// section in the order of DataSections. Records are ordered by time: build
+// records by start time and build ID, worker metrics by timestamp and
+// worker, cache metrics by timestamp and daily aggregates by day and
+// project. Only the records after the cursor are copied under the read
+// lock; sorting and encoding happen without it.
+func (ml *MLService) NDJSONPage(options NDJSONOptions) (*NDJSONPage, error) {
+	sections := DataSections
+	if len(options.Sections) > 0 {
+		for _, section := range options.Sections {
+			if !slices.Contains(DataSections, section) {
+				return nil, fmt.Errorf("unknown section %q, expected one of %v", section, DataSections)
+			}
+		}
+		sections = slices.DeleteFunc(slices.Clone(DataSections), func(section string) bool {
+			return !slices.Contains(options.Sections, section)
+		})
+	}
+	pageSize := options.PageSize
+	if pageSize <= 0 {
+		pageSize = DefaultNDJSONPageSize
+	}
+	if pageSize > MaxNDJSONPageSize {
+		return nil, fmt.Errorf("page size must be at most %d", MaxNDJSONPageSize)
+	}
+
+	var cursor *ndjsonCursor
+	if options.Cursor != "" {
+		decoded, err := decodeNDJSONCursor(options.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		if !slices.Contains(sections, decoded.Section) {
+			return nil, fmt.Errorf("invalid cursor: section %s is not exported", decoded.Section)
+		}
+		cursor = &decoded
+		sections = sections[slices.Index(sections, decoded.Section):]
+	}
+
+	// Collect the records after the cursor until there is more than a page
+	var items []ndjsonItem
+	ml.mutex.RLock()
+	for _, section := range sections {
+		collected, err := ml.ndjsonSection(section, cursor)
+		if err != nil {
+			ml.mutex.RUnlock()
+			return nil, err
+		}
+		items = append(items, collected...)
+		if len(items) > pageSize {
+			break
+		}
+	}
+	ml.mutex.RUnlock()
+
+	page := &NDJSONPage{lines: items}
+	if len(items) > pageSize {
+		page.lines = items[:pageSize]
+		last := page.lines[pageSize-1]
+		next := ndjsonCursor{Section: last.section, Time: last.time, Key: last.key}
+		for _, item := range page.lines {
+			if item.section == last.section && compareNDJSON(item, last) == 0 {
+				next.Seen++
+			}
+		}
+		if cursor != nil && cursor.Section == next.Section && cursor.Time.Equal(next.Time) && cursor.Key == next.Key {
+			next.Seen += cursor.Seen
+		}
+		page.Next = next.encode()
+	}
+	return page, nil
+}
+
+// ndjsonSection returns the records of a section after the cursor, sorted.
+// Must be called with the read lock held.
+func (ml *MLService) ndjsonSection(section string, cursor *ndjsonCursor) ([]ndjsonItem, error) {
+	var items []ndjsonItem
+	after := func(t time.Time, key string) bool {
+		return cursor == nil || cursor.Section != section || compareNDJSON(ndjsonItem{time: t, key: key}, ndjsonItem{time: cursor.Time, key: cursor.Key}) >= 0
+	}
+
+	switch section {
+	case SectionBuildHistory:
+		for _, record := range ml.BuildHistory {
+			if after(record.StartTime, record.BuildID) {
+				items = append(items, ndjsonItem{section, record.StartTime, record.BuildID, record})
+			}
+		}
+	case SectionWorkerMetrics:
+		for _, metric := range ml.WorkerMetrics {
+			if after(metric.Timestamp, metric.WorkerID) {
+				items = append(items, ndjsonItem{section, metric.Timestamp, metric.WorkerID, metric})
+			}
+		}
+	case SectionCacheMetrics:
+		for _, metric := range ml.CacheMetrics {
+			if after(metric.Timestamp, "") {
+				items = append(items, ndjsonItem{section, metric.Timestamp, "", metric})
+			}
+		}
+	case SectionDailyAggregates:
+		for _, aggregate := range ml.DailyAggregates {
+			if after(aggregate.Day, aggregate.ProjectPath) {
+				items = append(items, ndjsonItem{section, aggregate.Day, aggregate.ProjectPath, aggregate})
+			}
+		}
+	case SectionModels:
+		if cursor != nil && cursor.Section == section {
+			return nil, nil
+		}
+		// The models share maps with the live models, so they are encoded
+		// before unlocking
+		data, err := json.Marshal(ml.Models)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode models: %v", err)
+		}
+		return []ndjsonItem{{section: section, data: json.RawMessage(data)}}, nil
+	}
+
+	sort.SliceStable(items, func(i, j int) bool { return compareNDJSON(items[i], items[j]) < 0 })
+
+	// Skip the records sharing the cursor's key that earlier pages held
+	if cursor != nil && cursor.Section == section {
+		skipped := 0
+		items = slices.DeleteFunc(items, func(item ndjsonItem) bool {
+			if skipped < cursor.Seen && item.time.Equal(cursor.Time) && item.key == cursor.Key {
+				skipped++
+				return true
+			}
+			return false
+		})
+	}
+	return items, nil
+}
+
+// Len returns the number of lines of the page
+func (p *NDJSONPage) Len() int {
+	return len(p.lines)
+}
+
+// Encode writes the page as one JSON object per line
+func (p *NDJSONPage) Encode(w io.Writer) error {
+	out := bufio.NewWriter(w)
+	encoder := json.NewEncoder(out)
+	for i, item := range p.lines {
+		data, err := json.Marshal(item.data)
+		if err != nil {
+			return fmt.Errorf("failed to encode %s[%d]: %v", item.section, i, err)
+		}
+		if err := encoder.Encode(NDJSONLine{Section: item.section, Data: data}); err != nil {
+			return err
+		}
+	}
+	return out.Flush()
+}
@@ -0,0 +1,93 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// readNDJSON exports every page and returns the lines
+func readNDJSON(t *testing.T, service *MLService, options NDJSONOptions) []NDJSONLine {
+	t.Helper()
+	var lines []NDJSONLine
+	for pages := 0; ; pages++ {
+		if pages > 100 {
+			t.Fatal("Expected the export to end")
+		}
+		page, err := service.NDJSONPage(options)
+		if err != nil {
+			t.Fatalf("NDJSONPage failed: %v", err)
+		}
+		var out bytes.Buffer
+		if err := page.Encode(&out); err != nil {
+			t.Fatalf("Encode failed: %v", err)
+		}
+		scanner := bufio.NewScanner(&out)
+		for scanner.Scan() {
+			var line NDJSONLine
+			if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+				t.Fatalf("Invalid line %q: %v", scanner.Text(), err)
+			}
+			lines = append(lines, line)
+		}
+		if page.Next == "" {
+			return lines
+		}
+		options.Cursor = page.Next
+	}
+}
+
+func TestNDJSONExport(t *testing.T) {
+	service := NewMLService()
+	start := time.Date(2026, 10, 1, 12, 0, 0, 0, time.UTC)
+	// Recorded out of order, and two builds share their start and ID
+	for _, id := range []string{"build-3", "build-1", "build-2", "build-2", "build-0"} {
+		offset := time.Duration(id[len(id)-1]-'0') * time.Minute
+		service.BuildHistory = append(service.BuildHistory, BuildRecord{BuildID: id, ProjectPath: "/projects/app", StartTime: start.Add(offset), EndTime: start.Add(offset + time.Minute)})
+	}
+	service.WorkerMetrics = append(service.WorkerMetrics, WorkerMetric{WorkerID: "worker-1", Timestamp: start})
+
+	lines := readNDJSON(t, service, NDJSONOptions{PageSize: 2})
+	if len(lines) != 7 {
+		t.Fatalf("Expected 5 builds, a worker metric and the models, got %d lines", len(lines))
+	}
+	for i, expected := range []string{"build-0", "build-1", "build-2", "build-2", "build-3"} {
+		var record BuildRecord
+		if err := json.Unmarshal(lines[i].Data, &record); err != nil || lines[i].Section != SectionBuildHistory || record.BuildID != expected {
+			t.Errorf("Expected %s on line %d, got %s %s", expected, i, lines[i].Section, lines[i].Data)
+		}
+	}
+	if lines[5].Section != SectionWorkerMetrics || lines[6].Section != SectionModels {
+		t.Errorf("Expected the worker metric and the models last, got %s and %s", lines[5].Section, lines[6].Section)
+	}
+
+	// Records added meanwhile are exported if they sort after the cursor
+	page, err := service.NDJSONPage(NDJSONOptions{Sections: []string{SectionBuildHistory}, PageSize: 3})
+	if err != nil || page.Len() != 3 || page.Next == "" {
+		t.Fatalf("Expected a first page of 3 builds, got %v", err)
+	}
+	service.BuildHistory = append(service.BuildHistory, BuildRecord{BuildID: "build-9", StartTime: start.Add(9 * time.Minute)})
+	rest := readNDJSON(t, service, NDJSONOptions{Sections: []string{SectionBuildHistory}, Cursor: page.Next, PageSize: 3})
+	if len(rest) != 3 {
+		t.Errorf("Expected the second build-2, build-3 and build-9, got %d lines", len(rest))
+	}
+
+	// Sections are exported selectively
+	models := readNDJSON(t, service, NDJSONOptions{Sections: []string{SectionModels}})
+	if len(models) != 1 || models[0].Section != SectionModels {
+		t.Errorf("Expected only the models, got %+v", models)
+	}
+
+	for name, options := range map[string]NDJSONOptions{
+		"unknown section": {Sections: []string{"anomalies"}},
+		"invalid cursor":  {Cursor: "not-a-cursor"},
+		"foreign cursor":  {Sections: []string{SectionModels}, Cursor: page.Next},
+		"oversized page":  {PageSize: MaxNDJSONPageSize + 1},
+	} {
+		if _, err := service.NDJSONPage(options); err == nil {
+			t.Errorf("Expected the %s to be rejected", name)
+		}
+	}
+}
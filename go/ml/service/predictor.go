@@ -0,0 +1,209 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Predictor is a pluggable model backend for build time and failure risk predictions
+type Predictor interface {
+	Name() string
+	PredictBuildTime(projectPath, taskName string, buildOptions map[string]string) (time.Duration, float64, error)
+	PredictFailureRisk(projectPath, taskName string) (float64, error)
+}
+
+// ModelBackendConfig selects the model backend used for predictions
+type ModelBackendConfig struct {
+	Type      string        `json:"type"` // "builtin" or "http"
+	ServerURL string        `json:"server_url"`
+	Timeout   time.Duration `json:"timeout"`
+}
+
+// builtinPredictor exposes the in-process averaging models as a Predictor
+type builtinPredictor struct {
+	ml *MLService
+}
+
+// Name returns the backend name
+func (p *builtinPredictor) Name() string {
+	return "builtin"
+}
+
+// PredictBuildTime predicts build duration using the built-in model
+func (p *builtinPredictor) PredictBuildTime(projectPath, taskName string, buildOptions map[string]string) (time.Duration, float64, error) {
+	duration, confidence := p.ml.PredictBuildTime(projectPath, taskName, buildOptions)
+	return duration, confidence, nil
+}
+
+// PredictFailureRisk predicts failure risk using the built-in model
+func (p *builtinPredictor) PredictFailureRisk(projectPath, taskName string) (float64, error) {
+	return p.ml.PredictFailureRisk(projectPath, taskName), nil
+}
+
+// HTTPPredictor delegates predictions to an external model server
+type HTTPPredictor struct {
+	BaseURL    string
+	HTTPClient *http.Client
+}
+
+// NewHTTPPredictor creates a predictor backed by an external model server
+func NewHTTPPredictor(baseURL string, timeout time.Duration) *HTTPPredictor {
+	if timeout <= 0 {
+		timeout = 2 * time.Second
+	}
+
+	return &HTTPPredictor{
+		BaseURL: strings.TrimRight(baseURL, "/"),
+		HTTPClient: &http.Client{
+			Timeout: timeout,
+		},
+	}
+}
+
+// Name returns the backend name
+func (p *HTTPPredictor) Name() string {
+	return "http"
+}
+
+// PredictBuildTime asks the model server for a build duration prediction
+func (p *HTTPPredictor) PredictBuildTime(projectPath, taskName string, buildOptions map[string]string) (time.Duration, float64, error) {
+	var reply struct {
+		PredictedSeconds float64 `json:"predicted_seconds"`
+		Confidence       float64 `json:"confidence"`
+	}
+
+	request := PredictionRequest{
+		ProjectPath:  projectPath,
+		TaskName:     taskName,
+		BuildOptions: buildOptions,
+	}
+
+	if err := p.post("/predict/build-time", request, &reply); err != nil {
+		return 0, 0, err
+	}
+
+	if reply.PredictedSeconds <= 0 {
+		return 0, 0, fmt.Errorf("model server returned invalid prediction: %f", reply.PredictedSeconds)
+	}
+
+	return time.Duration(reply.PredictedSeconds * float64(time.Second)), reply.Confidence, nil
+}
+
+// PredictFailureRisk asks the model server for a failure risk prediction
+func (p *HTTPPredictor) PredictFailureRisk(projectPath, taskName string) (float64, error) {
+	var reply struct {
+		FailureRisk float64 `json:"failure_risk"`
+	}
+
+	request := PredictionRequest{
+		ProjectPath: projectPath,
+		TaskName:    taskName,
+	}
+
+	if err := p.post("/predict/failure-risk", request, &reply); err != nil {
+		return 0, err
+	}
+
+	if reply.FailureRisk < 0 || reply.FailureRisk > 1 {
+		return 0, fmt.Errorf("model server returned invalid failure risk: %f", reply.FailureRisk)
+	}
+
+	return reply.FailureRisk, nil
+}
+
+// post sends a JSON request to the model server and decodes the reply
+func (p *HTTPPredictor) post(path string, request any, reply any) error {
+	data, err := json.Marshal(request)
+	if err != nil {
+		return fmt.Errorf("failed to marshal request: %v", err)
+	}
+
+	resp, err := p.HTTPClient.Post(p.BaseURL+path, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("model server request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("model server returned status %d", resp.StatusCode)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(reply); err != nil {
+		return fmt.Errorf("failed to decode model server response: %v", err)
+	}
+
+	return nil
+}
+
+// newPredictor creates the predictor selected by the backend configuration
+func newPredictor(ml *MLService, config ModelBackendConfig) Predictor {
+	switch config.Type {
+	case "http":
+		if config.ServerURL == "" {
+			log.Printf("ML model backend 'http' requires a server URL, using builtin model")
+			return &builtinPredictor{ml: ml}
+		}
+		return NewHTTPPredictor(config.ServerURL, config.Timeout)
+	case "", "builtin":
+		return &builtinPredictor{ml: ml}
+	default:
+		log.Printf("Unknown ML model backend %q, using builtin model", config.Type)
+		return &builtinPredictor{ml: ml}
+	}
+}
+
+// SetPredictor replaces the model backend used for predictions
+func (ml *MLService) SetPredictor(predictor Predictor) {
+	ml.mutex.Lock()
+	defer ml.mutex.Unlock()
+
+	if predictor == nil {
+		predictor = &builtinPredictor{ml: ml}
+	}
+	ml.predictor = predictor
+}
+
+// PredictorName returns the name of the active model backend
+func (ml *MLService) PredictorName() string {
+	ml.mutex.RLock()
+	defer ml.mutex.RUnlock()
+
+	return ml.predictor.Name()
+}
+
+// predictBuildTimeWithBackend predicts build time with the configured backend,
+// falling back to the built-in model on errors
+func (ml *MLService) predictBuildTimeWithBackend(projectPath, taskName string, buildOptions map[string]string) (time.Duration, float64) {
+	ml.mutex.RLock()
+	predictor := ml.predictor
+	ml.mutex.RUnlock()
+
+	duration, confidence, err := predictor.PredictBuildTime(projectPath, taskName, buildOptions)
+	if err != nil {
+		log.Printf("Model backend %s failed to predict build time, using builtin model: %v", predictor.Name(), err)
+		return ml.PredictBuildTime(projectPath, taskName, buildOptions)
+	}
+
+	return duration, confidence
+}
+
+// predictFailureRiskWithBackend predicts failure risk with the configured backend,
+// falling back to the built-in model on errors
+func (ml *MLService) predictFailureRiskWithBackend(projectPath, taskName string) float64 {
+	ml.mutex.RLock()
+	predictor := ml.predictor
+	ml.mutex.RUnlock()
+
+	risk, err := predictor.PredictFailureRisk(projectPath, taskName)
+	if err != nil {
+		log.Printf("Model backend %s failed to predict failure risk, using builtin model: %v", predictor.Name(), err)
+		return ml.PredictFailureRisk(projectPath, taskName)
+	}
+
+	return risk
+}
@@ -0,0 +1,99 @@
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDefaultPredictorIsBuiltin(t *testing.T) {
+	service := NewMLService()
+
+	if service.PredictorName() != "builtin" {
+		t.Errorf("Expected builtin predictor by default, got %s", service.PredictorName())
+	}
+
+	insights := service.GetBuildInsights("/test/project", "build", nil)
+	if insights.PredictedTime != 5*time.Minute {
+		t.Errorf("Expected default prediction of 5 minutes, got %v", insights.PredictedTime)
+	}
+}
+
+func TestHTTPPredictor(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req PredictionRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+
+		switch r.URL.Path {
+		case "/predict/build-time":
+			json.NewEncoder(w).Encode(map[string]float64{"predicted_seconds": 90, "confidence": 0.95})
+		case "/predict/failure-risk":
+			json.NewEncoder(w).Encode(map[string]float64{"failure_risk": 0.42})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	service := NewMLService()
+	service.SetPredictor(NewHTTPPredictor(server.URL, time.Second))
+
+	if service.PredictorName() != "http" {
+		t.Errorf("Expected http predictor, got %s", service.PredictorName())
+	}
+
+	insights := service.GetBuildInsights("/test/project", "build", nil)
+	if insights.PredictedTime != 90*time.Second {
+		t.Errorf("Expected predicted time 90s, got %v", insights.PredictedTime)
+	}
+	if insights.Confidence != 0.95 {
+		t.Errorf("Expected confidence 0.95, got %f", insights.Confidence)
+	}
+	if insights.FailureRisk != 0.42 {
+		t.Errorf("Expected failure risk 0.42, got %f", insights.FailureRisk)
+	}
+}
+
+func TestHTTPPredictorFallback(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "model unavailable", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	service := NewMLService()
+	service.SetPredictor(NewHTTPPredictor(server.URL, time.Second))
+
+	insights := service.GetBuildInsights("/test/project", "build", nil)
+	if insights.PredictedTime != 5*time.Minute {
+		t.Errorf("Expected fallback to builtin prediction of 5 minutes, got %v", insights.PredictedTime)
+	}
+	if insights.FailureRisk != 0.1 {
+		t.Errorf("Expected fallback to builtin failure risk 0.1, got %f", insights.FailureRisk)
+	}
+}
+
+func TestNewPredictorSelection(t *testing.T) {
+	service := NewMLService()
+
+	tests := []struct {
+		config   ModelBackendConfig
+		expected string
+	}{
+		{ModelBackendConfig{Type: "builtin"}, "builtin"},
+		{ModelBackendConfig{Type: "http", ServerURL: "http://models:9000"}, "http"},
+		{ModelBackendConfig{Type: "http"}, "builtin"},
+		{ModelBackendConfig{Type: "unknown"}, "builtin"},
+	}
+
+	for _, tt := range tests {
+		predictor := newPredictor(service, tt.config)
+		if predictor.Name() != tt.expected {
+			t.Errorf("Expected %s predictor for config %+v, got %s", tt.expected, tt.config, predictor.Name())
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package service
+
+import "time"
+
+// PeakScalingPattern returns the learned pattern recommending the most workers
+// among the hourly windows between from and from+lookahead. It returns false
+// when no pattern has been trained for any of those windows.
+func (ml *MLService) PeakScalingPattern(from time.Time, lookahead time.Duration) (ScalingPattern, bool) {
+	ml.mutex.RLock()
+	defer ml.mutex.RUnlock()
+
+	patterns := make(map[[2]int]ScalingPattern, len(ml.Models.ScalingPredictor.Patterns))
+	for _, pattern := range ml.Models.ScalingPredictor.Patterns {
+		patterns[[2]int{pattern.HourOfDay, pattern.DayOfWeek}] = pattern
+	}
+
+	var peak ScalingPattern
+	found := false
+
+	end := from.Add(lookahead)
+	for window := from; !window.After(end); window = window.Add(time.Hour) {
+		pattern, exists := patterns[[2]int{window.Hour(), int(window.Weekday())}]
+		if exists && (!found || pattern.RecommendedWorkers > peak.RecommendedWorkers) {
+			peak = pattern
+			found = true
+		}
+	}
+
+	return peak, found
+}
+
+// ScalingPatterns returns a copy of the learned scaling patterns, busiest
+// hour first
+func (ml *MLService) ScalingPatterns() []ScalingPattern {
+	ml.mutex.RLock()
+	defer ml.mutex.RUnlock()
+
+	return append([]ScalingPattern(nil), ml.Models.ScalingPredictor.Patterns...)
+}
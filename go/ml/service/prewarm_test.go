@@ -0,0 +1,47 @@
+package service
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPeakScalingPattern(t *testing.T) {
+	service := NewMLService()
+
+	// Monday 2024-01-01 08:30 UTC
+	now := time.Date(2024, 1, 1, 8, 30, 0, 0, time.UTC)
+
+	if _, found := service.PeakScalingPattern(now, time.Hour); found {
+		t.Error("Expected no pattern before training")
+	}
+
+	service.Models.ScalingPredictor.Patterns = []ScalingPattern{
+		{HourOfDay: 8, DayOfWeek: int(time.Monday), ExpectedLoad: 2, RecommendedWorkers: 1},
+		{HourOfDay: 9, DayOfWeek: int(time.Monday), ExpectedLoad: 8, RecommendedWorkers: 4},
+		{HourOfDay: 12, DayOfWeek: int(time.Monday), ExpectedLoad: 16, RecommendedWorkers: 8},
+		{HourOfDay: 9, DayOfWeek: int(time.Tuesday), ExpectedLoad: 20, RecommendedWorkers: 10},
+	}
+
+	tests := []struct {
+		name      string
+		lookahead time.Duration
+		expected  int
+	}{
+		{"current hour only", 0, 1},
+		{"next hour", time.Hour, 4},
+		{"afternoon peak", 4 * time.Hour, 8},
+		{"next day", 25 * time.Hour, 10},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pattern, found := service.PeakScalingPattern(now, tt.lookahead)
+			if !found {
+				t.Fatal("Expected a pattern to be found")
+			}
+			if pattern.RecommendedWorkers != tt.expected {
+				t.Errorf("Expected %d workers, got %d", tt.expected, pattern.RecommendedWorkers)
+			}
+		})
+	}
+}
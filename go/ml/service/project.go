@@ -0,0 +1,299 @@
+package service
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ProjectModelConfig configures per-project model isolation. Projects whose
+// path starts with the path prefix of a group share the models of the group,
+// named after it; other projects get models of their own. Models are created
+// once a project or group has MinRecords build records, and are trained only
+// on those. Until then, predictions use the global models.
+type ProjectModelConfig struct {
+	Enabled    bool              `json:"enabled"`
+	MinRecords int               `json:"min_records"`
+	Groups     map[string]string `json:"groups"`
+}
+
+// ProjectModel holds the models of a project or project group
+type ProjectModel struct {
+	Key         string        `json:"key"`
+	Models      MLModels      `json:"models"`
+	Version     string        `json:"version"`
+	Accuracy    float64       `json:"accuracy"`
+	Records     int           `json:"records"`
+	Trainings   int           `json:"trainings"`
+	CreatedAt   time.Time     `json:"created_at"`
+	LastTrained time.Time     `json:"last_trained"`
+	Backups     []ModelBackup `json:"backups"`
+}
+
+// ProjectModelInfo summarizes the models of a project or project group
+type ProjectModelInfo struct {
+	Key         string    `json:"key"`
+	Version     string    `json:"version"`
+	Accuracy    float64   `json:"accuracy"`
+	Records     int       `json:"records"`
+	LastTrained time.Time `json:"last_trained"`
+	Versions    []string  `json:"versions"`
+}
+
+// loadProjectModelConfig loads project model isolation settings from
+// environment variables. ML_PROJECT_GROUPS lists groups as
+// name=path-prefix pairs separated by commas.
+func (ml *MLService) loadProjectModelConfig() {
+	ml.ProjectIsolation.Enabled = getEnvAsBool("ML_PROJECT_MODELS_ENABLED", ml.ProjectIsolation.Enabled)
+	ml.ProjectIsolation.MinRecords = getEnvAsInt("ML_PROJECT_MODEL_MIN_RECORDS", ml.ProjectIsolation.MinRecords)
+
+	groups := getEnvString("ML_PROJECT_GROUPS", "")
+	if groups == "" {
+		return
+	}
+	ml.ProjectIsolation.Groups = make(map[string]string)
+	for _, group := range strings.Split(groups, ",") {
+		name, prefix, ok := strings.Cut(strings.TrimSpace(group), "=")
+		if !ok || name == "" || prefix == "" {
+			log.Printf("Ignoring invalid project group %q, expected name=path-prefix", group)
+			continue
+		}
+		ml.ProjectIsolation.Groups[name] = prefix
+	}
+}
+
+// projectKey returns the group a project belongs to, by its longest
+// matching path prefix, or the project path if it belongs to none
+func (ml *MLService) projectKey(projectPath string) string {
+	key, longest := projectPath, 0
+	for name, prefix := range ml.ProjectIsolation.Groups {
+		if strings.HasPrefix(projectPath, prefix) && len(prefix) > longest {
+			key, longest = name, len(prefix)
+		}
+	}
+	return key
+}
+
+// projectModel returns the models of the project's group, or nil if the
+// project uses the global models. Must be called with the mutex held.
+func (ml *MLService) projectModel(projectPath string) *ProjectModel {
+	if !ml.ProjectIsolation.Enabled {
+		return nil
+	}
+	return ml.ProjectModels[ml.projectKey(projectPath)]
+}
+
+// modelsFor returns the models predicting builds of a project. Must be
+// called with the mutex held.
+func (ml *MLService) modelsFor(projectPath string) *MLModels {
+	if model := ml.projectModel(projectPath); model != nil {
+		return &model.Models
+	}
+	return &ml.Models
+}
+
+// fallbackRecords returns the build records predictions fall back to when a
+// project has no builds of a task: the records of its group if it has its
+// own models, all records otherwise. Must be called with the mutex held.
+func (ml *MLService) fallbackRecords(projectPath string) []BuildRecord {
+	if model := ml.projectModel(projectPath); model != nil {
+		return ml.projectRecords(model.Key)
+	}
+	return ml.BuildHistory
+}
+
+// projectRecords returns the build records of a project or group. Must be
+// called with the mutex held.
+func (ml *MLService) projectRecords(key string) []BuildRecord {
+	var records []BuildRecord
+	for _, record := range ml.BuildHistory {
+		if ml.projectKey(record.ProjectPath) == key {
+			records = append(records, record)
+		}
+	}
+	return records
+}
+
+// trainOn trains a copy of models on build records and returns it. Must be
+// called with the mutex held.
+func (ml *MLService) trainOn(records []BuildRecord, models MLModels) (MLModels, error) {
+	// The trainers work on the service's records and models, so swap them in
+	history, current := ml.BuildHistory, ml.Models
+	ml.BuildHistory, ml.Models = records, cloneModels(models)
+	err := ml.trainModels()
+	trained := ml.Models
+	ml.BuildHistory, ml.Models = history, current
+	return trained, err
+}
+
+// TrainProjectModels trains the models of every project and group with
+// enough build records, creating missing ones. It returns the number of
+// models trained.
+func (ml *MLService) TrainProjectModels() int {
+	ml.mutex.Lock()
+	defer ml.mutex.Unlock()
+
+	return ml.trainProjectModels()
+}
+
+// trainProjectModels trains the models of every project and group with
+// enough build records. Must be called with the mutex held.
+func (ml *MLService) trainProjectModels() int {
+	if !ml.ProjectIsolation.Enabled {
+		return 0
+	}
+
+	counts := make(map[string]int)
+	for _, record := range ml.BuildHistory {
+		counts[ml.projectKey(record.ProjectPath)]++
+	}
+
+	trained := 0
+	for key, count := range counts {
+		if count < ml.ProjectIsolation.MinRecords {
+			continue
+		}
+		if _, err := ml.trainProjectModel(key); err != nil {
+			log.Printf("Failed to train models of project %s: %v", key, err)
+			continue
+		}
+		trained++
+	}
+	return trained
+}
+
+// TrainProjectModel trains the models of a project or group, creating them
+// if needed
+func (ml *MLService) TrainProjectModel(project string) (ProjectModelInfo, error) {
+	ml.mutex.Lock()
+	defer ml.mutex.Unlock()
+
+	model, err := ml.trainProjectModel(ml.lookupKey(project))
+	if err != nil {
+		return ProjectModelInfo{}, err
+	}
+	return model.info(), nil
+}
+
+// trainProjectModel trains the models of a project or group. New models
+// start from the global ones. Must be called with the mutex held.
+func (ml *MLService) trainProjectModel(key string) (*ProjectModel, error) {
+	records := ml.projectRecords(key)
+	if len(records) < ml.ProjectIsolation.MinRecords {
+		return nil, fmt.Errorf("project %s has %d build records, need %d", key, len(records), ml.ProjectIsolation.MinRecords)
+	}
+
+	model := ml.ProjectModels[key]
+	base := ml.Models
+	if model != nil {
+		base = model.Models
+	}
+	trained, err := ml.trainOn(records, base)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if model == nil {
+		model = &ProjectModel{Key: key, CreatedAt: now}
+		ml.ProjectModels[key] = model
+		log.Printf("Created models for project %s", key)
+	} else {
+		// Keep only last 5 backups
+		if len(model.Backups) >= 5 {
+			model.Backups = model.Backups[1:]
+		}
+		model.Backups = append(model.Backups, ModelBackup{Timestamp: now, Models: model.Models, Accuracy: model.Accuracy, Version: model.Version})
+	}
+
+	model.Trainings++
+	model.Models = trained
+	model.Version = fmt.Sprintf("v%d.%d", model.Trainings, now.Unix())
+	model.Accuracy = modelAccuracy(trained)
+	model.Records = len(records)
+	model.LastTrained = now
+	return model, nil
+}
+
+// RollbackProjectModel restores a previous version of the models of a
+// project or group
+func (ml *MLService) RollbackProjectModel(project, version string) error {
+	ml.mutex.Lock()
+	defer ml.mutex.Unlock()
+
+	key := ml.lookupKey(project)
+	model, exists := ml.ProjectModels[key]
+	if !exists {
+		return fmt.Errorf("project %s has no models", key)
+	}
+	for _, backup := range model.Backups {
+		if backup.Version == version {
+			model.Models = backup.Models
+			model.Version = backup.Version
+			model.Accuracy = backup.Accuracy
+			log.Printf("Rolled back models of project %s to version %s (accuracy: %.3f)", key, version, backup.Accuracy)
+			return nil
+		}
+	}
+	return fmt.Errorf("project %s has no model version %s", key, version)
+}
+
+// ProjectModel returns a copy of the models of a project or group
+func (ml *MLService) ProjectModel(project string) (ProjectModel, error) {
+	ml.mutex.RLock()
+	defer ml.mutex.RUnlock()
+
+	key := ml.lookupKey(project)
+	model, exists := ml.ProjectModels[key]
+	if !exists {
+		return ProjectModel{}, fmt.Errorf("project %s has no models", key)
+	}
+
+	copied := *model
+	copied.Models = cloneModels(model.Models)
+	copied.Backups = append([]ModelBackup(nil), model.Backups...)
+	return copied, nil
+}
+
+// ListProjectModels summarizes the models of every project and group, sorted
+// by key
+func (ml *MLService) ListProjectModels() []ProjectModelInfo {
+	ml.mutex.RLock()
+	defer ml.mutex.RUnlock()
+
+	models := make([]ProjectModelInfo, 0, len(ml.ProjectModels))
+	for _, model := range ml.ProjectModels {
+		models = append(models, model.info())
+	}
+	sort.Slice(models, func(i, j int) bool {
+		return models[i].Key < models[j].Key
+	})
+	return models
+}
+
+// lookupKey returns the key of a project path or group name. Must be called
+// with the mutex held.
+func (ml *MLService) lookupKey(project string) string {
+	if _, isGroup := ml.ProjectIsolation.Groups[project]; isGroup {
+		return project
+	}
+	return ml.projectKey(project)
+}
+
+// info summarizes the models
+func (model *ProjectModel) info() ProjectModelInfo {
+	versions := make([]string, 0, len(model.Backups))
+	for _, backup := range model.Backups {
+		versions = append(versions, backup.Version)
+	}
+	return ProjectModelInfo{
+		Key:         model.Key,
+		Version:     model.Version,
+		Accuracy:    model.Accuracy,
+		Records:     model.Records,
+		LastTrained: model.LastTrained,
+		Versions:    versions,
+	}
+}
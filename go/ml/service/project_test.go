@@ -0,0 +1,116 @@
+package service
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func projectService(t *testing.T) *MLService {
+	t.Helper()
+	service := NewMLService()
+	service.ProjectIsolation = ProjectModelConfig{
+		Enabled:    true,
+		MinRecords: 20,
+		Groups:     map[string]string{"android": "/repo/android", "android-tv": "/repo/android/tv"},
+	}
+
+	now := time.Now()
+	for i := 0; i < 25; i++ {
+		service.RecordBuild(Build{ID: fmt.Sprintf("app-%d", i), ProjectPath: "/repo/android/app", TaskName: "assemble", StartTime: now.Add(-10 * time.Minute), EndTime: now, Success: true})
+	}
+	for i := 0; i < 5; i++ {
+		service.RecordBuild(Build{ID: fmt.Sprintf("api-%d", i), ProjectPath: "/repo/backend", TaskName: "build", StartTime: now.Add(-time.Minute), EndTime: now, Success: true})
+	}
+	return service
+}
+
+func TestProjectKeyUsesLongestGroupPrefix(t *testing.T) {
+	service := projectService(t)
+
+	for path, want := range map[string]string{
+		"/repo/android/app":   "android",
+		"/repo/android/tv/ui": "android-tv",
+		"/repo/backend":       "/repo/backend",
+	} {
+		if got := service.projectKey(path); got != want {
+			t.Errorf("Expected %s to belong to %s, got %s", path, want, got)
+		}
+	}
+}
+
+func TestProjectModelsAreCreatedLazily(t *testing.T) {
+	service := projectService(t)
+
+	if len(service.ListProjectModels()) != 0 {
+		t.Fatal("Expected no project models before training")
+	}
+	if err := service.TrainModels(); err != nil {
+		t.Fatalf("Failed to train models: %v", err)
+	}
+
+	models := service.ListProjectModels()
+	if len(models) != 1 || models[0].Key != "android" || models[0].Records != 25 {
+		t.Fatalf("Expected models for the android group only, got %+v", models)
+	}
+	if _, err := service.ProjectModel("/repo/backend"); err == nil {
+		t.Error("Expected a project with too few records to use the global models")
+	}
+	if model, err := service.ProjectModel("/repo/android/app"); err != nil || model.Key != "android" {
+		t.Errorf("Expected a project path to resolve to its group's models, got %+v, %v", model, err)
+	}
+}
+
+func TestProjectModelsIsolatePredictions(t *testing.T) {
+	service := projectService(t)
+
+	// Without project models, unknown tasks fall back to all builds
+	global, _ := service.PredictBuildTime("/repo/android/lib", "lint", nil)
+	if global >= 10*time.Minute {
+		t.Fatalf("Expected the global average to include the short backend builds, got %v", global)
+	}
+
+	if _, err := service.TrainProjectModel("android"); err != nil {
+		t.Fatalf("Failed to train project models: %v", err)
+	}
+	isolated, _ := service.PredictBuildTime("/repo/android/lib", "lint", nil)
+	if isolated != 10*time.Minute {
+		t.Errorf("Expected the android group average of 10m, got %v", isolated)
+	}
+	if backend, _ := service.PredictBuildTime("/repo/backend", "test", nil); backend != global {
+		t.Errorf("Expected projects without models to keep the global average %v, got %v", global, backend)
+	}
+}
+
+func TestProjectModelTrainAndRollback(t *testing.T) {
+	service := projectService(t)
+
+	if _, err := service.TrainProjectModel("/repo/backend"); err == nil {
+		t.Error("Expected training a project with too few records to fail")
+	}
+
+	first, err := service.TrainProjectModel("android")
+	if err != nil {
+		t.Fatalf("Failed to train project models: %v", err)
+	}
+	second, err := service.TrainProjectModel("android")
+	if err != nil {
+		t.Fatalf("Failed to retrain project models: %v", err)
+	}
+	if second.Version == first.Version || len(second.Versions) != 1 || second.Versions[0] != first.Version {
+		t.Fatalf("Expected the first version to be kept for rollback, got %+v", second)
+	}
+
+	if err := service.RollbackProjectModel("android", first.Version); err != nil {
+		t.Fatalf("Failed to roll back project models: %v", err)
+	}
+	if model, _ := service.ProjectModel("android"); model.Version != first.Version {
+		t.Errorf("Expected version %s after rollback, got %s", first.Version, model.Version)
+	}
+	if err := service.RollbackProjectModel("android", "v9.9"); err == nil {
+		t.Error("Expected rolling back to an unknown version to fail")
+	}
+	if err := service.RollbackProjectModel("/repo/backend", first.Version); err == nil {
+		t.Error("Expected rolling back a project without models to fail")
+	}
+}
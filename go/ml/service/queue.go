@@ -0,0 +1,40 @@
+package service
+
+import (
+	"sort"
+	"time"
+)
+
+// EstimateQueueWait estimates how long a newly submitted build waits before a
+// worker picks it up. Queued builds are assigned in order to whichever worker
+// frees up first, using their predicted durations.
+func (ml *MLService) EstimateQueueWait(queued []PredictionRequest, workerCount int) time.Duration {
+	if len(queued) == 0 {
+		return 0
+	}
+
+	if workerCount < 1 {
+		workerCount = 1
+	}
+
+	// Time at which each worker becomes free
+	available := make([]time.Duration, workerCount)
+
+	for _, request := range queued {
+		duration, _ := ml.predictBuildTimeWithBackend(request.ProjectPath, request.TaskName, request.BuildOptions)
+
+		sort.Slice(available, func(i, j int) bool { return available[i] < available[j] })
+		available[0] += duration
+	}
+
+	sort.Slice(available, func(i, j int) bool { return available[i] < available[j] })
+	return available[0]
+}
+
+// GetBuildInsightsWithQueue provides build insights including the expected
+// wait behind the currently queued builds
+func (ml *MLService) GetBuildInsightsWithQueue(projectPath, taskName string, buildOptions map[string]string, queued []PredictionRequest, workerCount int) PredictionResult {
+	insights := ml.GetBuildInsights(projectPath, taskName, buildOptions)
+	insights.EstimatedQueueWait = ml.EstimateQueueWait(queued, workerCount)
+	return insights
+}
@@ -0,0 +1,54 @@
+package service
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEstimateQueueWait(t *testing.T) {
+	service := NewMLService()
+
+	queued := []PredictionRequest{
+		{ProjectPath: "/test/project", TaskName: "build"},
+		{ProjectPath: "/test/project", TaskName: "build"},
+		{ProjectPath: "/test/project", TaskName: "build"},
+	}
+
+	tests := []struct {
+		name     string
+		queued   []PredictionRequest
+		workers  int
+		expected time.Duration
+	}{
+		{"empty queue", nil, 2, 0},
+		{"single worker", queued, 1, 15 * time.Minute},
+		{"two workers", queued, 2, 5 * time.Minute},
+		{"more workers than builds", queued, 4, 0},
+		{"no workers", queued, 0, 15 * time.Minute},
+	}
+
+	// Each untrained prediction defaults to 5 minutes
+	for _, tt := range tests {
+		wait := service.EstimateQueueWait(tt.queued, tt.workers)
+		if wait != tt.expected {
+			t.Errorf("%s: expected wait %v, got %v", tt.name, tt.expected, wait)
+		}
+	}
+}
+
+func TestGetBuildInsightsWithQueue(t *testing.T) {
+	service := NewMLService()
+
+	queued := []PredictionRequest{
+		{ProjectPath: "/test/project", TaskName: "build"},
+		{ProjectPath: "/test/project", TaskName: "test"},
+	}
+
+	insights := service.GetBuildInsightsWithQueue("/test/project", "build", nil, queued, 1)
+	if insights.EstimatedQueueWait != 10*time.Minute {
+		t.Errorf("Expected estimated queue wait 10m, got %v", insights.EstimatedQueueWait)
+	}
+	if insights.PredictedTime != 5*time.Minute {
+		t.Errorf("Expected predicted time 5m, got %v", insights.PredictedTime)
+	}
+}
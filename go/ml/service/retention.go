@@ -0,0 +1,203 @@
+package service
+
+import (
+	"sort"
+	"time"
+)
+
+// RetentionConfig configures how long build records are kept. Records older
+// than RawRetention, and the oldest records beyond MaxBuildRecords, are
+// rolled up into per-project daily aggregates, which are kept for
+// RollupRetention and limited to MaxDailyAggregates. A zero duration or
+// limit disables that rule.
+type RetentionConfig struct {
+	RawRetention       time.Duration `json:"raw_retention"`
+	MaxBuildRecords    int           `json:"max_build_records"`
+	RollupRetention    time.Duration `json:"rollup_retention"`
+	MaxDailyAggregates int           `json:"max_daily_aggregates"`
+}
+
+// DailyAggregate summarizes the builds of a project started on a UTC day.
+// Aggregates hold sums, so they can be merged and re-imported.
+type DailyAggregate struct {
+	Day               time.Time     `json:"day"`
+	ProjectPath       string        `json:"project_path"`
+	Builds            int           `json:"builds"`
+	Successes         int           `json:"successes"`
+	TotalDuration     time.Duration `json:"total_duration"`
+	MaxDuration       time.Duration `json:"max_duration"`
+	TotalCacheHitRate float64       `json:"total_cache_hit_rate"`
+}
+
+// TrendPoint is the daily build summary of a project
+type TrendPoint struct {
+	Day                 time.Time     `json:"day"`
+	ProjectPath         string        `json:"project_path"`
+	Builds              int           `json:"builds"`
+	SuccessRate         float64       `json:"success_rate"`
+	AverageDuration     time.Duration `json:"average_duration"`
+	MaxDuration         time.Duration `json:"max_duration"`
+	AverageCacheHitRate float64       `json:"average_cache_hit_rate"`
+}
+
+// loadRetentionConfig loads data retention settings from environment variables
+func (ml *MLService) loadRetentionConfig() {
+	ml.Retention.RawRetention = getEnvAsDuration("ML_RAW_RETENTION", ml.Retention.RawRetention)
+	ml.Retention.MaxBuildRecords = getEnvAsInt("ML_MAX_BUILD_RECORDS", ml.Retention.MaxBuildRecords)
+	ml.Retention.RollupRetention = getEnvAsDuration("ML_ROLLUP_RETENTION", ml.Retention.RollupRetention)
+	ml.Retention.MaxDailyAggregates = getEnvAsInt("ML_MAX_DAILY_AGGREGATES", ml.Retention.MaxDailyAggregates)
+}
+
+// ApplyRetention rolls up expired build records and drops expired daily
+// aggregates. It returns the number of records rolled up.
+func (ml *MLService) ApplyRetention() int {
+	ml.mutex.Lock()
+	defer ml.mutex.Unlock()
+
+	return ml.applyRetention(time.Now())
+}
+
+// applyRetention applies the retention rules as of now. Must be called with
+// the mutex held.
+func (ml *MLService) applyRetention(now time.Time) int {
+	rolled := 0
+	if ml.Retention.RawRetention > 0 {
+		cutoff := now.Add(-ml.Retention.RawRetention)
+		kept := ml.BuildHistory[:0]
+		for _, record := range ml.BuildHistory {
+			if record.StartTime.Before(cutoff) {
+				ml.rollUp(record)
+				rolled++
+				continue
+			}
+			kept = append(kept, record)
+		}
+		ml.BuildHistory = kept
+	}
+
+	// Records are appended as builds finish, so the first are the oldest
+	if excess := len(ml.BuildHistory) - ml.Retention.MaxBuildRecords; ml.Retention.MaxBuildRecords > 0 && excess > 0 {
+		for _, record := range ml.BuildHistory[:excess] {
+			ml.rollUp(record)
+		}
+		ml.BuildHistory = append([]BuildRecord(nil), ml.BuildHistory[excess:]...)
+		rolled += excess
+	}
+
+	if ml.Retention.RollupRetention > 0 {
+		cutoff := day(now.Add(-ml.Retention.RollupRetention))
+		expired := sort.Search(len(ml.DailyAggregates), func(i int) bool {
+			return !ml.DailyAggregates[i].Day.Before(cutoff)
+		})
+		ml.DailyAggregates = ml.DailyAggregates[expired:]
+	}
+	if excess := len(ml.DailyAggregates) - ml.Retention.MaxDailyAggregates; ml.Retention.MaxDailyAggregates > 0 && excess > 0 {
+		ml.DailyAggregates = ml.DailyAggregates[excess:]
+	}
+	return rolled
+}
+
+// rollUp adds a build record to the daily aggregate of its project. Must be
+// called with the mutex held.
+func (ml *MLService) rollUp(record BuildRecord) {
+	ml.DailyAggregates = mergeAggregate(ml.DailyAggregates, aggregateOf(record))
+}
+
+// aggregateOf returns the daily aggregate of a single build record
+func aggregateOf(record BuildRecord) DailyAggregate {
+	aggregate := DailyAggregate{
+		Day:               day(record.StartTime),
+		ProjectPath:       record.ProjectPath,
+		Builds:            1,
+		TotalDuration:     record.Duration,
+		MaxDuration:       record.Duration,
+		TotalCacheHitRate: record.CacheHitRate,
+	}
+	if record.Success {
+		aggregate.Successes = 1
+	}
+	return aggregate
+}
+
+// mergeAggregate adds an aggregate to a list sorted by day and project,
+// merging it with the aggregate of the same day and project
+func mergeAggregate(aggregates []DailyAggregate, add DailyAggregate) []DailyAggregate {
+	i := sort.Search(len(aggregates), func(i int) bool {
+		current := aggregates[i]
+		return !current.Day.Before(add.Day) && (current.Day.After(add.Day) || current.ProjectPath >= add.ProjectPath)
+	})
+	if i < len(aggregates) && aggregates[i].Day.Equal(add.Day) && aggregates[i].ProjectPath == add.ProjectPath {
+		current := &aggregates[i]
+		current.Builds += add.Builds
+		current.Successes += add.Successes
+		current.TotalDuration += add.TotalDuration
+		current.MaxDuration = max(current.MaxDuration, add.MaxDuration)
+		current.TotalCacheHitRate += add.TotalCacheHitRate
+		return aggregates
+	}
+
+	aggregates = append(aggregates, DailyAggregate{})
+	copy(aggregates[i+1:], aggregates[i:])
+	aggregates[i] = add
+	return aggregates
+}
+
+// day returns the start of the UTC day of t
+func day(t time.Time) time.Time {
+	return t.UTC().Truncate(24 * time.Hour)
+}
+
+// RolledUpData returns the daily aggregates of a project, or of all
+// projects if projectPath is empty, from the day of since on
+func (ml *MLService) RolledUpData(projectPath string, since time.Time) []DailyAggregate {
+	ml.mutex.RLock()
+	defer ml.mutex.RUnlock()
+
+	aggregates := make([]DailyAggregate, 0)
+	for _, aggregate := range ml.DailyAggregates {
+		if matchesTrend(aggregate, projectPath, since) {
+			aggregates = append(aggregates, aggregate)
+		}
+	}
+	return aggregates
+}
+
+// Trends returns the daily build summaries of a project, or of all projects
+// if projectPath is empty, from the day of since on. Days still held as
+// build records are summarized from them, older days from the aggregates.
+func (ml *MLService) Trends(projectPath string, since time.Time) []TrendPoint {
+	ml.mutex.RLock()
+	defer ml.mutex.RUnlock()
+
+	var aggregates []DailyAggregate
+	for _, aggregate := range ml.DailyAggregates {
+		if matchesTrend(aggregate, projectPath, since) {
+			aggregates = mergeAggregate(aggregates, aggregate)
+		}
+	}
+	for _, record := range ml.BuildHistory {
+		if aggregate := aggregateOf(record); matchesTrend(aggregate, projectPath, since) {
+			aggregates = mergeAggregate(aggregates, aggregate)
+		}
+	}
+
+	points := make([]TrendPoint, 0, len(aggregates))
+	for _, aggregate := range aggregates {
+		points = append(points, TrendPoint{
+			Day:                 aggregate.Day,
+			ProjectPath:         aggregate.ProjectPath,
+			Builds:              aggregate.Builds,
+			SuccessRate:         float64(aggregate.Successes) / float64(aggregate.Builds),
+			AverageDuration:     aggregate.TotalDuration / time.Duration(aggregate.Builds),
+			MaxDuration:         aggregate.MaxDuration,
+			AverageCacheHitRate: aggregate.TotalCacheHitRate / float64(aggregate.Builds),
+		})
+	}
+	return points
+}
+
+// matchesTrend reports whether an aggregate is of the project and not
+// before the day of since
+func matchesTrend(aggregate DailyAggregate, projectPath string, since time.Time) bool {
+	return (projectPath == "" || aggregate.ProjectPath == projectPath) && !aggregate.Day.Before(day(since)) && aggregate.Builds > 0
+}
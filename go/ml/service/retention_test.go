@@ -0,0 +1,72 @@
+package service
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRetentionRollsUpOldRecords(t *testing.T) {
+	service := NewMLService()
+	service.Retention = RetentionConfig{RawRetention: 48 * time.Hour, MaxBuildRecords: 3, RollupRetention: 10 * 24 * time.Hour}
+
+	now := time.Now()
+	old := now.Add(-5 * 24 * time.Hour)
+	builds := []Build{
+		{ID: "expired", ProjectPath: "/projects/app", StartTime: now.Add(-20 * 24 * time.Hour), EndTime: now.Add(-20 * 24 * time.Hour).Add(time.Minute), Success: true},
+		{ID: "old-1", ProjectPath: "/projects/app", StartTime: old, EndTime: old.Add(2 * time.Minute), Success: true, CacheHitRate: 0.5},
+		{ID: "old-2", ProjectPath: "/projects/app", StartTime: old, EndTime: old.Add(4 * time.Minute), CacheHitRate: 0.1},
+	}
+	for i := 0; i < 4; i++ {
+		builds = append(builds, Build{ID: "recent-" + strconv.Itoa(i), ProjectPath: "/projects/lib", StartTime: now, EndTime: now.Add(time.Minute), Success: true})
+	}
+	for _, build := range builds {
+		service.RecordBuild(build)
+	}
+
+	if len(service.BuildHistory) != 3 {
+		t.Errorf("Expected the record limit to keep 3 records, got %d", len(service.BuildHistory))
+	}
+	if len(service.DailyAggregates) != 2 {
+		t.Fatalf("Expected aggregates of the old and the overflowing records, got %+v", service.DailyAggregates)
+	}
+	if aggregate := service.DailyAggregates[0]; aggregate.ProjectPath != "/projects/app" || aggregate.Builds != 2 || aggregate.Successes != 1 || aggregate.MaxDuration != 4*time.Minute {
+		t.Errorf("Expected the old builds rolled up into one day, got %+v", aggregate)
+	}
+
+	trends := service.Trends("/projects/app", time.Time{})
+	if len(trends) != 1 || trends[0].SuccessRate != 0.5 || trends[0].AverageDuration != 3*time.Minute || trends[0].AverageCacheHitRate != 0.3 {
+		t.Errorf("Expected the rolled-up day in the trends, got %+v", trends)
+	}
+	// Trends merge the rolled-up and the raw records of a day
+	if trends := service.Trends("/projects/lib", now.Add(-time.Hour)); len(trends) != 1 || trends[0].Builds != 4 {
+		t.Errorf("Expected 4 builds of today, got %+v", trends)
+	}
+	if trends := service.Trends("", time.Time{}); len(trends) != 2 {
+		t.Errorf("Expected the trends of both projects, got %+v", trends)
+	}
+
+	if rollups := service.RolledUpData("/projects/lib", time.Time{}); len(rollups) != 1 || rollups[0].Builds != 1 {
+		t.Errorf("Expected the exported rollup of the overflowing record, got %+v", rollups)
+	}
+	if stats := service.GetStatistics(); stats["total_daily_aggregates"] != 2 {
+		t.Errorf("Expected aggregates in the statistics, got %v", stats["total_daily_aggregates"])
+	}
+}
+
+func TestRetentionLimitsAggregates(t *testing.T) {
+	service := NewMLService()
+	service.Retention = RetentionConfig{RawRetention: time.Hour, MaxDailyAggregates: 2}
+
+	now := time.Now()
+	for days := 3; days > 0; days-- {
+		start := now.Add(-time.Duration(days) * 24 * time.Hour)
+		service.BuildHistory = append(service.BuildHistory, BuildRecord{ProjectPath: "/projects/app", StartTime: start, Duration: time.Minute})
+	}
+	if rolled := service.ApplyRetention(); rolled != 3 {
+		t.Errorf("Expected 3 records rolled up, got %d", rolled)
+	}
+	if len(service.DailyAggregates) != 2 || !service.DailyAggregates[0].Day.Equal(day(now.Add(-2*24*time.Hour))) {
+		t.Errorf("Expected the 2 newest days to be kept, got %+v", service.DailyAggregates)
+	}
+}
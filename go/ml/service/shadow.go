@@ -0,0 +1,200 @@
+package service
+
+import (
+	"log"
+	"maps"
+	"slices"
+	"time"
+)
+
+// Outcomes of a shadow evaluation
+const (
+	ShadowRunning  = "running"
+	ShadowPromoted = "promoted"
+	ShadowRejected = "rejected"
+)
+
+// ShadowConfig configures the shadow evaluation of retrained models. A
+// retrained candidate predicts alongside the current models, which keep
+// serving, until Window successful builds have been compared. It is promoted
+// if its mean build time error is at most (1 - MinImprovement) times the
+// error of the current models, and discarded otherwise.
+type ShadowConfig struct {
+	Enabled        bool    `json:"enabled"`
+	Window         int     `json:"window"`
+	MinImprovement float64 `json:"min_improvement"`
+}
+
+// ShadowEvaluation reports how a candidate compared with the current models.
+// Errors are mean build time errors relative to the actual durations.
+type ShadowEvaluation struct {
+	CandidateVersion string    `json:"candidate_version"`
+	CurrentVersion   string    `json:"current_version"`
+	Reason           string    `json:"reason"`
+	Outcome          string    `json:"outcome"`
+	StartedAt        time.Time `json:"started_at"`
+	FinishedAt       time.Time `json:"finished_at"`
+	Builds           int       `json:"builds"`
+	Window           int       `json:"window"`
+	CurrentError     float64   `json:"current_error"`
+	CandidateError   float64   `json:"candidate_error"`
+}
+
+// shadowModels is a candidate evaluated in the shadow of the current models
+type shadowModels struct {
+	models         MLModels
+	evaluation     ShadowEvaluation
+	currentTotal   float64
+	candidateTotal float64
+}
+
+// shadowPrediction is what a candidate predicted for a build
+type shadowPrediction struct {
+	version  string
+	duration time.Duration
+	ok       bool
+}
+
+// loadShadowConfig loads shadow evaluation settings from environment variables
+func (ml *MLService) loadShadowConfig() {
+	ml.Shadow.Enabled = getEnvAsBool("ML_SHADOW_ENABLED", ml.Shadow.Enabled)
+	ml.Shadow.Window = getEnvAsInt("ML_SHADOW_WINDOW", ml.Shadow.Window)
+	ml.Shadow.MinImprovement = getEnvAsFloat("ML_SHADOW_MIN_IMPROVEMENT", ml.Shadow.MinImprovement)
+}
+
+// startShadowEvaluation trains candidate models without replacing the
+// current ones and starts comparing their predictions
+func (ml *MLService) startShadowEvaluation(version, reason string) error {
+	ml.mutex.Lock()
+	defer ml.mutex.Unlock()
+
+	candidate, err := ml.trainOn(ml.BuildHistory, ml.Models)
+	if err != nil {
+		return err
+	}
+
+	ml.shadow = &shadowModels{
+		models: candidate,
+		evaluation: ShadowEvaluation{
+			CandidateVersion: version,
+			CurrentVersion:   ml.LearningStats.CurrentVersion,
+			Reason:           reason,
+			Outcome:          ShadowRunning,
+			StartedAt:        time.Now(),
+			Window:           max(ml.Shadow.Window, 1),
+		},
+	}
+	log.Printf("Evaluating candidate models %s in shadow mode over %d builds", version, ml.shadow.evaluation.Window)
+	return nil
+}
+
+// shadowRunning reports whether candidate models are being evaluated. Must
+// be called with the mutex held.
+func (ml *MLService) shadowRunning() bool {
+	return ml.shadow != nil && ml.shadow.evaluation.Outcome == ShadowRunning
+}
+
+// predictShadowBuildTime returns what the candidate models predict for a
+// build, if a candidate is being evaluated and would predict the build
+func (ml *MLService) predictShadowBuildTime(projectPath, taskName string) shadowPrediction {
+	features := ml.projectFeatures(projectPath)
+
+	ml.mutex.RLock()
+	defer ml.mutex.RUnlock()
+
+	if !ml.shadowRunning() || ml.projectModel(projectPath) != nil {
+		return shadowPrediction{}
+	}
+	duration, _ := ml.predictBuildTime(ml.shadow.models.BuildTimePredictor, features, projectPath, taskName)
+	return shadowPrediction{version: ml.shadow.evaluation.CandidateVersion, duration: duration, ok: true}
+}
+
+// recordShadowPrediction compares the predictions of the current and
+// candidate models for a build, and decides on the candidate once the window
+// is complete. Must be called with the mutex held.
+func (ml *MLService) recordShadowPrediction(candidate shadowPrediction, predicted, actual time.Duration) {
+	if !ml.shadowRunning() || ml.shadow.evaluation.CandidateVersion != candidate.version || actual <= 0 {
+		return
+	}
+
+	shadow := ml.shadow
+	evaluation := &shadow.evaluation
+	shadow.currentTotal += relativeError(predicted, actual)
+	shadow.candidateTotal += relativeError(candidate.duration, actual)
+	evaluation.Builds++
+	evaluation.CurrentError = shadow.currentTotal / float64(evaluation.Builds)
+	evaluation.CandidateError = shadow.candidateTotal / float64(evaluation.Builds)
+	if evaluation.Builds < evaluation.Window {
+		return
+	}
+
+	evaluation.FinishedAt = time.Now()
+	if evaluation.CandidateError <= evaluation.CurrentError*(1-ml.Shadow.MinImprovement) {
+		evaluation.Outcome = ShadowPromoted
+		log.Printf("Candidate models %s beat %s in shadow mode (error %.3f vs %.3f)", evaluation.CandidateVersion, evaluation.CurrentVersion, evaluation.CandidateError, evaluation.CurrentError)
+
+		ml.backupCurrentModels()
+		ml.Models = shadow.models
+		ml.acceptModels(evaluation.CandidateVersion, ml.calculateAverageModelAccuracy())
+	} else {
+		evaluation.Outcome = ShadowRejected
+		log.Printf("Discarding candidate models %s: error %.3f in shadow mode, current models %.3f", evaluation.CandidateVersion, evaluation.CandidateError, evaluation.CurrentError)
+
+		// Wait for the next interval or new data before retraining again
+		ml.LearningStats.LastRetraining = evaluation.FinishedAt
+	}
+	shadow.models = MLModels{}
+}
+
+// ShadowEvaluation returns the running or last shadow evaluation, or nil if
+// no candidate was evaluated yet
+func (ml *MLService) ShadowEvaluation() *ShadowEvaluation {
+	ml.mutex.RLock()
+	defer ml.mutex.RUnlock()
+
+	return ml.shadowEvaluation()
+}
+
+// shadowEvaluation returns a copy of the last shadow evaluation. Must be
+// called with the mutex held.
+func (ml *MLService) shadowEvaluation() *ShadowEvaluation {
+	if ml.shadow == nil {
+		return nil
+	}
+	evaluation := ml.shadow.evaluation
+	return &evaluation
+}
+
+// relativeError returns how far a prediction was from the actual duration,
+// relative to it
+func relativeError(predicted, actual time.Duration) float64 {
+	diff := predicted - actual
+	if diff < 0 {
+		diff = -diff
+	}
+	return diff.Seconds() / actual.Seconds()
+}
+
+// cloneModels returns a deep copy of models
+func cloneModels(models MLModels) MLModels {
+	clone := models
+	clone.BuildTimePredictor.Weights = maps.Clone(models.BuildTimePredictor.Weights)
+	clone.BuildTimePredictor.Features = slices.Clone(models.BuildTimePredictor.Features)
+	clone.BuildTimePredictor.FeatureWeights = maps.Clone(models.BuildTimePredictor.FeatureWeights)
+	clone.ResourcePredictor.CPUWeights = maps.Clone(models.ResourcePredictor.CPUWeights)
+	clone.ResourcePredictor.MemWeights = maps.Clone(models.ResourcePredictor.MemWeights)
+	clone.ResourcePredictor.DiskWeights = maps.Clone(models.ResourcePredictor.DiskWeights)
+	clone.ScalingPredictor.Patterns = slices.Clone(models.ScalingPredictor.Patterns)
+	clone.FailurePredictor.ErrorPatterns = maps.Clone(models.FailurePredictor.ErrorPatterns)
+	clone.FailurePredictor.RiskFactors = slices.Clone(models.FailurePredictor.RiskFactors)
+	clone.FailurePredictor.ClassPriors = maps.Clone(models.FailurePredictor.ClassPriors)
+	clone.FailurePredictor.ClassUnseenWeights = maps.Clone(models.FailurePredictor.ClassUnseenWeights)
+	if weights := models.FailurePredictor.ClassTermWeights; weights != nil {
+		clone.FailurePredictor.ClassTermWeights = make(map[string]map[string]float64, len(weights))
+		for class, terms := range weights {
+			clone.FailurePredictor.ClassTermWeights[class] = maps.Clone(terms)
+		}
+	}
+	clone.CachePredictor.HitRateWeights = maps.Clone(models.CachePredictor.HitRateWeights)
+	return clone
+}
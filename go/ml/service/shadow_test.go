@@ -0,0 +1,90 @@
+package service
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func shadowService(t *testing.T) *MLService {
+	t.Helper()
+	service := NewMLService()
+	service.ContinuousLearning.ModelDir = ""
+	service.Shadow = ShadowConfig{Enabled: true, Window: 3}
+
+	now := time.Now()
+	for i := 0; i < 25; i++ {
+		service.RecordBuild(Build{ID: fmt.Sprintf("build-%d", i), ProjectPath: "/projects/app", TaskName: "build", StartTime: now.Add(-time.Minute), EndTime: now, Success: true})
+	}
+	if err := service.startShadowEvaluation("v2.0", "test"); err != nil {
+		t.Fatalf("Failed to start shadow evaluation: %v", err)
+	}
+	return service
+}
+
+func TestShadowEvaluationKeepsCurrentModels(t *testing.T) {
+	service := shadowService(t)
+
+	if !service.Models.BuildTimePredictor.LastTrained.IsZero() {
+		t.Error("Expected training a candidate to leave the current models untrained")
+	}
+	if service.shadow.models.BuildTimePredictor.LastTrained.IsZero() {
+		t.Error("Expected the candidate models to be trained")
+	}
+
+	evaluation := service.ShadowEvaluation()
+	if evaluation == nil || evaluation.Outcome != ShadowRunning || evaluation.CandidateVersion != "v2.0" || evaluation.CurrentVersion != "v1.0" {
+		t.Fatalf("Expected a running evaluation of v2.0 against v1.0, got %+v", evaluation)
+	}
+	if prediction := service.predictShadowBuildTime("/projects/app", "build"); !prediction.ok || prediction.version != "v2.0" {
+		t.Errorf("Expected a candidate prediction, got %+v", prediction)
+	}
+}
+
+func TestShadowEvaluationPromotesBetterCandidate(t *testing.T) {
+	service := shadowService(t)
+
+	candidate := shadowPrediction{version: "v2.0", duration: time.Minute, ok: true}
+	for i := 0; i < 3; i++ {
+		service.recordShadowPrediction(candidate, 2*time.Minute, time.Minute)
+	}
+
+	evaluation := service.ShadowEvaluation()
+	if evaluation.Outcome != ShadowPromoted || evaluation.Builds != 3 || evaluation.CurrentError != 1 || evaluation.CandidateError != 0 {
+		t.Fatalf("Expected the candidate to be promoted after 3 builds, got %+v", evaluation)
+	}
+	if service.CurrentModelVersion() != "v2.0" || service.Models.BuildTimePredictor.LastTrained.IsZero() {
+		t.Errorf("Expected the trained candidate v2.0 to be current, got %s", service.CurrentModelVersion())
+	}
+	if len(service.LearningStats.ModelBackups) != 1 || service.LearningStats.ModelBackups[0].Version != "v1.0" {
+		t.Errorf("Expected the replaced models to be backed up, got %+v", service.LearningStats.ModelBackups)
+	}
+}
+
+func TestShadowEvaluationRejectsWorseCandidate(t *testing.T) {
+	service := shadowService(t)
+	service.Shadow.MinImprovement = 0.1
+
+	// The candidate is as good as the current models, which is not enough
+	candidate := shadowPrediction{version: "v2.0", duration: 2 * time.Minute, ok: true}
+	for i := 0; i < 3; i++ {
+		service.recordShadowPrediction(candidate, 2*time.Minute, time.Minute)
+	}
+
+	evaluation := service.ShadowEvaluation()
+	if evaluation.Outcome != ShadowRejected {
+		t.Fatalf("Expected the candidate to be rejected, got %+v", evaluation)
+	}
+	if service.CurrentModelVersion() != "v1.0" || !service.Models.BuildTimePredictor.LastTrained.IsZero() {
+		t.Errorf("Expected the current models to be kept, got %s", service.CurrentModelVersion())
+	}
+
+	// Predictions of a discarded candidate are ignored
+	service.recordShadowPrediction(candidate, 2*time.Minute, time.Minute)
+	if service.ShadowEvaluation().Builds != 3 {
+		t.Error("Expected a finished evaluation not to count more builds")
+	}
+	if service.predictShadowBuildTime("/projects/app", "build").ok {
+		t.Error("Expected no candidate predictions after the evaluation")
+	}
+}
@@ -0,0 +1,173 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ModelSnapshotInfo describes a model snapshot persisted to disk
+type ModelSnapshotInfo struct {
+	Version   string    `json:"version"`
+	Timestamp time.Time `json:"timestamp"`
+	Accuracy  float64   `json:"accuracy"`
+	Path      string    `json:"path"`
+}
+
+// snapshotPath returns the file path for a model version
+func (ml *MLService) snapshotPath(version string) (string, error) {
+	if version == "" || strings.ContainsAny(version, `/\`) || strings.Contains(version, "..") {
+		return "", fmt.Errorf("invalid model version %q", version)
+	}
+	return filepath.Join(ml.ContinuousLearning.ModelDir, version+".json"), nil
+}
+
+// saveModelSnapshot writes a model backup to the model directory
+func (ml *MLService) saveModelSnapshot(backup ModelBackup) error {
+	if ml.ContinuousLearning.ModelDir == "" {
+		return nil
+	}
+
+	path, err := ml.snapshotPath(backup.Version)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(ml.ContinuousLearning.ModelDir, 0755); err != nil {
+		return fmt.Errorf("failed to create model directory: %v", err)
+	}
+
+	data, err := json.MarshalIndent(backup, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal model snapshot: %v", err)
+	}
+
+	// Write to a temporary file first so a crash never leaves a truncated snapshot
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write model snapshot: %v", err)
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to store model snapshot: %v", err)
+	}
+
+	log.Printf("Persisted model snapshot %s to %s", backup.Version, path)
+	return nil
+}
+
+// loadModelSnapshot reads a persisted model snapshot by version
+func (ml *MLService) loadModelSnapshot(version string) (*ModelBackup, error) {
+	path, err := ml.snapshotPath(version)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var backup ModelBackup
+	if err := json.Unmarshal(data, &backup); err != nil {
+		return nil, fmt.Errorf("failed to decode model snapshot %s: %v", version, err)
+	}
+
+	return &backup, nil
+}
+
+// listModelSnapshots returns persisted snapshots, newest first
+func (ml *MLService) listModelSnapshots() ([]ModelSnapshotInfo, error) {
+	snapshots := make([]ModelSnapshotInfo, 0)
+
+	if ml.ContinuousLearning.ModelDir == "" {
+		return snapshots, nil
+	}
+
+	entries, err := os.ReadDir(ml.ContinuousLearning.ModelDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return snapshots, nil
+		}
+		return nil, fmt.Errorf("failed to read model directory: %v", err)
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+
+		version := strings.TrimSuffix(entry.Name(), ".json")
+		backup, err := ml.loadModelSnapshot(version)
+		if err != nil {
+			log.Printf("Skipping unreadable model snapshot %s: %v", entry.Name(), err)
+			continue
+		}
+
+		snapshots = append(snapshots, ModelSnapshotInfo{
+			Version:   backup.Version,
+			Timestamp: backup.Timestamp,
+			Accuracy:  backup.Accuracy,
+			Path:      filepath.Join(ml.ContinuousLearning.ModelDir, entry.Name()),
+		})
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].Timestamp.After(snapshots[j].Timestamp)
+	})
+
+	return snapshots, nil
+}
+
+// ListModelSnapshots returns the model versions persisted to disk, newest first
+func (ml *MLService) ListModelSnapshots() ([]ModelSnapshotInfo, error) {
+	ml.mutex.RLock()
+	defer ml.mutex.RUnlock()
+
+	return ml.listModelSnapshots()
+}
+
+// LoadLatestSnapshot restores the most recent persisted model snapshot, if any
+func (ml *MLService) LoadLatestSnapshot() (bool, error) {
+	ml.mutex.Lock()
+	defer ml.mutex.Unlock()
+
+	snapshots, err := ml.listModelSnapshots()
+	if err != nil {
+		return false, err
+	}
+
+	if len(snapshots) == 0 {
+		return false, nil
+	}
+
+	backup, err := ml.loadModelSnapshot(snapshots[0].Version)
+	if err != nil {
+		return false, err
+	}
+
+	ml.restoreBackup(*backup)
+	log.Printf("Loaded model snapshot %s (accuracy: %.3f)", backup.Version, backup.Accuracy)
+	return true, nil
+}
+
+// CurrentModelVersion returns the version of the active models
+func (ml *MLService) CurrentModelVersion() string {
+	ml.mutex.RLock()
+	defer ml.mutex.RUnlock()
+
+	return ml.LearningStats.CurrentVersion
+}
+
+// restoreBackup replaces the active models with a backup
+func (ml *MLService) restoreBackup(backup ModelBackup) {
+	ml.Models = backup.Models
+	ml.LearningStats.CurrentVersion = backup.Version
+	ml.LearningStats.AverageAccuracy = backup.Accuracy
+}
@@ -0,0 +1,96 @@
+package service
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestModelSnapshotPersistence(t *testing.T) {
+	dir := t.TempDir()
+
+	service := NewMLService()
+	service.ContinuousLearning.ModelDir = dir
+	service.Models.BuildTimePredictor.Weights["/test/project:build"] = 120
+	service.LearningStats.CurrentVersion = "v1.100"
+	service.backupCurrentModels()
+
+	service.Models.BuildTimePredictor.Weights["/test/project:build"] = 60
+	service.LearningStats.CurrentVersion = "v2.200"
+	if err := service.saveModelSnapshot(ModelBackup{
+		Timestamp: time.Now().Add(time.Minute),
+		Models:    service.Models,
+		Accuracy:  0.8,
+		Version:   "v2.200",
+	}); err != nil {
+		t.Fatalf("Failed to save snapshot: %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "v1.100.json")); err != nil {
+		t.Errorf("Expected backup snapshot on disk: %v", err)
+	}
+
+	snapshots, err := service.ListModelSnapshots()
+	if err != nil {
+		t.Fatalf("Failed to list snapshots: %v", err)
+	}
+	if len(snapshots) != 2 {
+		t.Fatalf("Expected 2 snapshots, got %d", len(snapshots))
+	}
+	if snapshots[0].Version != "v2.200" {
+		t.Errorf("Expected newest snapshot first, got %s", snapshots[0].Version)
+	}
+
+	// A fresh service picks up the latest snapshot on startup
+	restarted := NewMLService()
+	restarted.ContinuousLearning.ModelDir = dir
+
+	loaded, err := restarted.LoadLatestSnapshot()
+	if err != nil {
+		t.Fatalf("Failed to load latest snapshot: %v", err)
+	}
+	if !loaded {
+		t.Fatal("Expected a snapshot to be loaded")
+	}
+	if restarted.CurrentModelVersion() != "v2.200" {
+		t.Errorf("Expected current version v2.200, got %s", restarted.CurrentModelVersion())
+	}
+	if restarted.Models.BuildTimePredictor.Weights["/test/project:build"] != 60 {
+		t.Errorf("Expected restored weight 60, got %f", restarted.Models.BuildTimePredictor.Weights["/test/project:build"])
+	}
+
+	// Persisted versions are available for rollback even without in-memory backups
+	if err := restarted.RollbackToVersion("v1.100"); err != nil {
+		t.Fatalf("Failed to roll back to persisted version: %v", err)
+	}
+	if restarted.Models.BuildTimePredictor.Weights["/test/project:build"] != 120 {
+		t.Errorf("Expected rolled back weight 120, got %f", restarted.Models.BuildTimePredictor.Weights["/test/project:build"])
+	}
+}
+
+func TestLoadLatestSnapshotEmptyDir(t *testing.T) {
+	service := NewMLService()
+	service.ContinuousLearning.ModelDir = filepath.Join(t.TempDir(), "missing")
+
+	loaded, err := service.LoadLatestSnapshot()
+	if err != nil {
+		t.Fatalf("Expected no error for missing model directory, got %v", err)
+	}
+	if loaded {
+		t.Error("Expected no snapshot to be loaded")
+	}
+	if service.CurrentModelVersion() != "v1.0" {
+		t.Errorf("Expected default version v1.0, got %s", service.CurrentModelVersion())
+	}
+}
+
+func TestSnapshotPathRejectsTraversal(t *testing.T) {
+	service := NewMLService()
+
+	for _, version := range []string{"", "../etc/passwd", "v1/v2"} {
+		if _, err := service.snapshotPath(version); err == nil {
+			t.Errorf("Expected error for version %q", version)
+		}
+	}
+}
@@ -0,0 +1,234 @@
+package service
+
+import (
+	"slices"
+	"sort"
+	"time"
+)
+
+// minTemporalSamples is the number of successful builds an hour of the day
+// or day of the week needs before its factor is learned from them
+const minTemporalSamples = 5
+
+// Bounds of the factor builds are scaled by for when they are submitted
+const (
+	minTemporalFactor = 0.25
+	maxTemporalFactor = 4
+)
+
+// clusterLoadWindow is how recent the worker metrics the cluster load is
+// taken from must be
+const clusterLoadWindow = 10 * time.Minute
+
+// Names of the factors explaining the temporal part of a prediction
+const (
+	FactorHourOfDay   = "hour_of_day"
+	FactorDayOfWeek   = "day_of_week"
+	FactorClusterLoad = "cluster_load"
+)
+
+// temporalSample is the ratio of a build's duration to the average of its
+// project and task, with when it started and how many builds ran then
+type temporalSample struct {
+	hour    int
+	weekday int
+	load    float64
+	ratio   float64
+}
+
+// trainTemporalFactors learns how much longer than usual builds take by when
+// they start: the mean ratio of their durations to the trained averages in
+// each hour of the day, then in each day of the week once the hour is
+// accounted for, both relative to the mean of all builds, and how much
+// each build running concurrently adds to what remains. Ratios discount the
+// speed of the worker. Must be called with the mutex held, after the
+// averages and worker factors are trained.
+func (ml *MLService) trainTemporalFactors() {
+	model := &ml.Models.BuildTimePredictor
+	model.HourFactors, model.WeekdayFactors = nil, nil
+	model.LoadWeight, model.MeanLoad = 0, 0
+
+	loads := concurrentLoads(ml.BuildHistory)
+	var samples []temporalSample
+	for i, record := range ml.BuildHistory {
+		if !record.Success || record.Duration <= 0 {
+			continue
+		}
+		average := model.Weights[record.ProjectPath+":"+record.TaskName]
+		if average <= 0 {
+			continue
+		}
+		ratio := record.Duration.Seconds() / average
+		if factor := model.WorkerFactors[record.WorkerID]; factor > 0 {
+			ratio /= factor
+		}
+		samples = append(samples, temporalSample{
+			hour:    record.StartTime.Hour(),
+			weekday: int(record.StartTime.Weekday()),
+			load:    float64(loads[i]),
+			ratio:   ratio,
+		})
+	}
+	if len(samples) < minTemporalSamples {
+		return
+	}
+
+	model.HourFactors = groupFactors(samples, func(s temporalSample) int { return s.hour })
+	for i := range samples {
+		if factor, learned := model.HourFactors[samples[i].hour]; learned {
+			samples[i].ratio /= factor
+		}
+	}
+	model.WeekdayFactors = groupFactors(samples, func(s temporalSample) int { return s.weekday })
+	for i := range samples {
+		if factor, learned := model.WeekdayFactors[samples[i].weekday]; learned {
+			samples[i].ratio /= factor
+		}
+	}
+
+	// Least squares fit of the remaining ratio to the load, as the share of
+	// the mean ratio each concurrent build adds
+	var meanLoad, meanRatio float64
+	for _, sample := range samples {
+		meanLoad += sample.load
+		meanRatio += sample.ratio
+	}
+	meanLoad /= float64(len(samples))
+	meanRatio /= float64(len(samples))
+	var covariance, variance float64
+	for _, sample := range samples {
+		covariance += (sample.load - meanLoad) * (sample.ratio - meanRatio)
+		variance += (sample.load - meanLoad) * (sample.load - meanLoad)
+	}
+	if variance > 0 && meanRatio > 0 {
+		model.LoadWeight = covariance / variance / meanRatio
+		model.MeanLoad = meanLoad
+	}
+}
+
+// groupFactors returns the mean ratio of the samples of each group with
+// enough of them, relative to the mean ratio of all samples. Groups within a
+// percent of it are left out as typical.
+func groupFactors(samples []temporalSample, group func(temporalSample) int) map[int]float64 {
+	var total float64
+	ratios := make(map[int][]float64)
+	for _, sample := range samples {
+		total += sample.ratio
+		ratios[group(sample)] = append(ratios[group(sample)], sample.ratio)
+	}
+	overall := total / float64(len(samples))
+	if overall <= 0 {
+		return nil
+	}
+
+	factors := make(map[int]float64)
+	for key, values := range ratios {
+		if len(values) < minTemporalSamples {
+			continue
+		}
+		sum := 0.0
+		for _, value := range values {
+			sum += value
+		}
+		if factor := sum / float64(len(values)) / overall; factor < 0.99 || factor > 1.01 {
+			factors[key] = factor
+		}
+	}
+	if len(factors) == 0 {
+		return nil
+	}
+	return factors
+}
+
+// concurrentLoads returns how many other builds of the history were running
+// when each build started
+func concurrentLoads(records []BuildRecord) []int {
+	starts := make([]time.Time, len(records))
+	ends := make([]time.Time, len(records))
+	for i, record := range records {
+		starts[i], ends[i] = record.StartTime, record.EndTime
+	}
+	slices.SortFunc(starts, time.Time.Compare)
+	slices.SortFunc(ends, time.Time.Compare)
+
+	loads := make([]int, len(records))
+	for i, record := range records {
+		started := sort.Search(len(starts), func(j int) bool { return starts[j].After(record.StartTime) })
+		ended := sort.Search(len(ends), func(j int) bool { return ends[j].After(record.StartTime) })
+		loads[i] = max(started-ended-1, 0)
+	}
+	return loads
+}
+
+// temporalFactor returns how much longer than usual a build takes when
+// submitted at a time with load builds running in the cluster, and the
+// factors explaining it. A negative load is unknown and left out.
+func (model BuildTimeModel) temporalFactor(at time.Time, load int) (float64, []PredictionFactor) {
+	factor := 1.0
+	var factors []PredictionFactor
+	if hourFactor, learned := model.HourFactors[at.Hour()]; learned {
+		factor *= hourFactor
+		factors = append(factors, PredictionFactor{Name: FactorHourOfDay, Value: float64(at.Hour())})
+	}
+	if weekdayFactor, learned := model.WeekdayFactors[int(at.Weekday())]; learned {
+		factor *= weekdayFactor
+		factors = append(factors, PredictionFactor{Name: FactorDayOfWeek, Value: float64(at.Weekday())})
+	}
+	if load >= 0 && model.LoadWeight != 0 {
+		factor *= max(1+model.LoadWeight*(float64(load)-model.MeanLoad), minTemporalFactor)
+		factors = append(factors, PredictionFactor{Name: FactorClusterLoad, Value: float64(load)})
+	}
+	return min(max(factor, minTemporalFactor), maxTemporalFactor), factors
+}
+
+// clusterLoad returns how many builds the workers reported running in their
+// latest metrics within clusterLoadWindow of now, or -1 without any. Must be
+// called with the read lock held.
+func (ml *MLService) clusterLoad(now time.Time) int {
+	latest := make(map[string]WorkerMetric)
+	for _, metric := range ml.WorkerMetrics {
+		if now.Sub(metric.Timestamp) > clusterLoadWindow {
+			continue
+		}
+		if previous, seen := latest[metric.WorkerID]; !seen || metric.Timestamp.After(previous.Timestamp) {
+			latest[metric.WorkerID] = metric
+		}
+	}
+	if len(latest) == 0 {
+		return -1
+	}
+	load := 0
+	for _, metric := range latest {
+		load += metric.ActiveBuilds
+	}
+	return load
+}
+
+// applyTemporalFactors scales the predicted durations of a result to a build
+// submitted at a time with load builds running in the cluster, or the load
+// the workers last reported if load is negative. The factors are listed
+// first among those explaining the prediction, each contributing what it
+// adds to the duration.
+func (ml *MLService) applyTemporalFactors(result *PredictionResult, projectPath string, at time.Time, load int) {
+	ml.mutex.RLock()
+	if load < 0 {
+		load = ml.clusterLoad(at)
+	}
+	factor, factors := ml.modelsFor(projectPath).BuildTimePredictor.temporalFactor(at, load)
+	ml.mutex.RUnlock()
+
+	if factor == 1 {
+		return
+	}
+	before := result.PredictedTime
+	scaleDurations(result, factor)
+	result.TemporalFactor = factor
+	if len(factors) > 0 {
+		// The factors share the added duration equally
+		share := (result.PredictedTime - before) / time.Duration(len(factors))
+		for i := range factors {
+			factors[i].Contribution = share
+		}
+		result.Factors = append(factors, result.Factors...)
+	}
+}
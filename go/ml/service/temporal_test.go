@@ -0,0 +1,117 @@
+package service
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestTemporalFactors(t *testing.T) {
+	service := NewMLService()
+	day := time.Date(2024, 3, 4, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 28; i++ {
+		// Builds at 10am, when the artifact proxy is saturated, take twice
+		// as long as in the afternoon
+		for hour, duration := range map[int]time.Duration{10: 2 * time.Minute, 14: time.Minute} {
+			start := day.AddDate(0, 0, i).Add(time.Duration(hour) * time.Hour)
+			service.BuildHistory = append(service.BuildHistory, BuildRecord{
+				ProjectPath: "/test/project",
+				TaskName:    "build",
+				StartTime:   start,
+				EndTime:     start.Add(duration),
+				Duration:    duration,
+				Success:     true,
+			})
+		}
+	}
+	if err := service.TrainModels(); err != nil {
+		t.Fatalf("TrainModels failed: %v", err)
+	}
+
+	model := service.Models.BuildTimePredictor
+	if len(model.HourFactors) != 2 || len(model.WeekdayFactors) != 0 {
+		t.Fatalf("Expected factors for two hours and no weekdays, got %v and %v", model.HourFactors, model.WeekdayFactors)
+	}
+
+	morning := service.GetWorkerBuildInsights(PredictionRequest{ProjectPath: "/test/project", TaskName: "build", SubmittedAt: day.Add(10 * time.Hour)})
+	afternoon := service.GetWorkerBuildInsights(PredictionRequest{ProjectPath: "/test/project", TaskName: "build", SubmittedAt: day.Add(14 * time.Hour)})
+	for _, tt := range []struct {
+		result   PredictionResult
+		expected time.Duration
+	}{{morning, 2 * time.Minute}, {afternoon, time.Minute}} {
+		if diff := tt.result.PredictedTime - tt.expected; diff < -time.Second || diff > time.Second {
+			t.Errorf("Expected %v, got %v", tt.expected, tt.result.PredictedTime)
+		}
+		if len(tt.result.Factors) == 0 || tt.result.Factors[0].Name != FactorHourOfDay {
+			t.Errorf("Expected the hour of day to explain the prediction first, got %+v", tt.result.Factors)
+		}
+	}
+
+	// Hours without enough builds are typical
+	night := service.GetWorkerBuildInsights(PredictionRequest{ProjectPath: "/test/project", TaskName: "build", SubmittedAt: day.Add(3 * time.Hour)})
+	if night.TemporalFactor != 0 {
+		t.Errorf("Expected no temporal factor at night, got %v", night.TemporalFactor)
+	}
+}
+
+func TestClusterLoadFactor(t *testing.T) {
+	service := NewMLService()
+	start := time.Date(2024, 3, 4, 12, 0, 0, 0, time.UTC)
+	// Builds running alongside others take longer the more there are
+	for i := 0; i < 40; i++ {
+		concurrent := i % 4
+		duration := time.Duration(1+concurrent) * time.Minute
+		for j := 0; j <= concurrent; j++ {
+			service.BuildHistory = append(service.BuildHistory, BuildRecord{
+				ProjectPath: "/test/project",
+				TaskName:    "build",
+				StartTime:   start,
+				EndTime:     start.Add(duration),
+				Duration:    duration,
+				Success:     true,
+			})
+		}
+		start = start.Add(10 * time.Minute)
+	}
+	if err := service.TrainModels(); err != nil {
+		t.Fatalf("TrainModels failed: %v", err)
+	}
+	if service.Models.BuildTimePredictor.LoadWeight <= 0 {
+		t.Fatalf("Expected builds to slow down with the load, got weight %v", service.Models.BuildTimePredictor.LoadWeight)
+	}
+
+	idle := service.GetWorkerBuildInsights(PredictionRequest{ProjectPath: "/test/project", TaskName: "build", SubmittedAt: start, ClusterLoad: 1})
+	busy := service.GetWorkerBuildInsights(PredictionRequest{ProjectPath: "/test/project", TaskName: "build", SubmittedAt: start, ClusterLoad: 3})
+	if busy.PredictedTime <= idle.PredictedTime {
+		t.Errorf("Expected a longer prediction under load, got %v idle and %v busy", idle.PredictedTime, busy.PredictedTime)
+	}
+
+	// Without a load in the request, the load the workers last reported is
+	// used
+	service.WorkerMetrics = []WorkerMetric{
+		{WorkerID: "worker-1", Timestamp: start.Add(-time.Minute), ActiveBuilds: 1},
+		{WorkerID: "worker-2", Timestamp: start.Add(-time.Minute), ActiveBuilds: 1},
+		{WorkerID: "worker-2", Timestamp: start, ActiveBuilds: 2},
+		{WorkerID: "worker-3", Timestamp: start.Add(-time.Hour), ActiveBuilds: 5},
+	}
+	reported := service.GetWorkerBuildInsights(PredictionRequest{ProjectPath: "/test/project", TaskName: "build", SubmittedAt: start})
+	if reported.PredictedTime != busy.PredictedTime {
+		t.Errorf("Expected the reported load of 3 to predict %v, got %v", busy.PredictedTime, reported.PredictedTime)
+	}
+}
+
+func TestConcurrentLoads(t *testing.T) {
+	at := func(minutes int) time.Time {
+		return time.Date(2024, 3, 4, 12, minutes, 0, 0, time.UTC)
+	}
+	records := []BuildRecord{
+		{StartTime: at(0), EndTime: at(10)},
+		{StartTime: at(5), EndTime: at(15)},
+		{StartTime: at(8), EndTime: at(9)},
+		{StartTime: at(10), EndTime: at(20)},
+		{StartTime: at(30), EndTime: at(40)},
+	}
+	if loads := concurrentLoads(records); !slices.Equal(loads, []int{0, 1, 2, 1, 0}) {
+		t.Errorf("Expected loads [0 1 2 1 0], got %v", loads)
+	}
+}
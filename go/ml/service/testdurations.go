@@ -0,0 +1,54 @@
+package service
+
+import (
+	"maps"
+	"time"
+)
+
+// testDurationWeight is the weight of the latest run of a test class in its
+// recorded duration, which otherwise keeps its earlier runs
+const testDurationWeight = 0.5
+
+// RecordTestDurations records how long the test classes of a project took in
+// a build. The recorded duration of a class is a moving average of its runs,
+// so a single slow run only moves it half way.
+func (ml *MLService) RecordTestDurations(projectPath string, durations map[string]time.Duration) {
+	ml.mutex.Lock()
+	defer ml.mutex.Unlock()
+	ml.recordTestDurations(projectPath, durations)
+}
+
+// recordTestDurations records test class durations. Must be called with the
+// mutex held.
+func (ml *MLService) recordTestDurations(projectPath string, durations map[string]time.Duration) {
+	if len(durations) == 0 {
+		return
+	}
+	if ml.TestDurations == nil {
+		ml.TestDurations = make(map[string]map[string]time.Duration)
+	}
+	recorded, exists := ml.TestDurations[projectPath]
+	if !exists {
+		recorded = make(map[string]time.Duration, len(durations))
+		ml.TestDurations[projectPath] = recorded
+	}
+	for class, duration := range durations {
+		if previous, exists := recorded[class]; exists {
+			duration = time.Duration(testDurationWeight*float64(duration) + (1-testDurationWeight)*float64(previous))
+		}
+		recorded[class] = duration
+	}
+}
+
+// GetTestDurations returns the recorded durations of the test classes of a
+// project by class name, empty for projects whose tests never ran
+func (ml *MLService) GetTestDurations(projectPath string) map[string]time.Duration {
+	ml.mutex.RLock()
+	defer ml.mutex.RUnlock()
+
+	durations := maps.Clone(ml.TestDurations[projectPath])
+	if durations == nil {
+		durations = make(map[string]time.Duration)
+	}
+	return durations
+}
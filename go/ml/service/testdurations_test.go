@@ -0,0 +1,28 @@
+package service
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTestDurations(t *testing.T) {
+	service := NewMLService()
+	if durations := service.GetTestDurations("/test/project"); len(durations) != 0 {
+		t.Fatalf("Expected no durations, got %v", durations)
+	}
+
+	service.RecordTestDurations("/test/project", map[string]time.Duration{"AppTest": 10 * time.Second, "LibTest": time.Second})
+	service.RecordTestDurations("/test/project", map[string]time.Duration{"AppTest": 20 * time.Second})
+	service.RecordTestDurations("/other/project", map[string]time.Duration{"AppTest": time.Minute})
+
+	durations := service.GetTestDurations("/test/project")
+	if durations["AppTest"] != 15*time.Second || durations["LibTest"] != time.Second || len(durations) != 2 {
+		t.Errorf("Expected the average of the runs of each class, got %v", durations)
+	}
+
+	// The returned durations are a copy
+	durations["AppTest"] = 0
+	if service.GetTestDurations("/test/project")["AppTest"] != 15*time.Second {
+		t.Error("Expected the recorded durations to be unchanged")
+	}
+}
@@ -0,0 +1,222 @@
+package service
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Statuses of a training job
+const (
+	TrainingRunning   = "running"
+	TrainingCompleted = "completed"
+	TrainingFailed    = "failed"
+)
+
+// StageProjectModels is the last stage of a training, training the models
+// of projects and groups
+const StageProjectModels = "project_models"
+
+// maxTrainingJobs is the number of finished training jobs kept
+const maxTrainingJobs = 20
+
+// TrainingJob is a training of the models in the background. Stage is the
+// stage running, and Progress the share of the stages done, 1 once the job
+// finished.
+type TrainingJob struct {
+	ID           string     `json:"id"`
+	Status       string     `json:"status"`
+	Stage        string     `json:"stage,omitempty"`
+	Progress     float64    `json:"progress"`
+	StartedAt    time.Time  `json:"started_at"`
+	FinishedAt   *time.Time `json:"finished_at,omitempty"`
+	ModelVersion string     `json:"model_version,omitempty"`
+	Error        string     `json:"error,omitempty"`
+}
+
+// trainingStage is a step of training the models
+type trainingStage struct {
+	name  string
+	train func()
+}
+
+// trainingStages returns the stages of training the global models, in order
+func (ml *MLService) trainingStages() []trainingStage {
+	return []trainingStage{
+		{"build_time", ml.trainBuildTimeModel},
+		{"features", ml.trainFeatureModel},
+		{"resources", ml.trainResourceModel},
+		{"failures", ml.trainFailureModel},
+		{"cache", ml.trainCacheModel},
+		{"scaling", ml.trainScalingPatterns},
+	}
+}
+
+// trainingJobs tracks the training jobs. It has a mutex of its own so the
+// progress of a job is reported without waiting for predictions.
+type trainingJobs struct {
+	mutex   sync.Mutex
+	jobs    map[string]*TrainingJob
+	order   []string
+	running *TrainingJob
+	started int
+}
+
+func newTrainingJobs() *trainingJobs {
+	return &trainingJobs{jobs: make(map[string]*TrainingJob)}
+}
+
+// start returns a new running job, or the running job and false if there
+// is one
+func (t *trainingJobs) start(now time.Time) (TrainingJob, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.running != nil {
+		return *t.running, false
+	}
+	t.started++
+	job := &TrainingJob{
+		ID:        fmt.Sprintf("train-%d-%d", now.Unix(), t.started),
+		Status:    TrainingRunning,
+		StartedAt: now,
+	}
+	t.jobs[job.ID] = job
+	t.order = append(t.order, job.ID)
+	if len(t.order) > maxTrainingJobs {
+		delete(t.jobs, t.order[0])
+		t.order = t.order[1:]
+	}
+	t.running = job
+	return *job, true
+}
+
+// update applies change to a job and returns the result
+func (t *trainingJobs) update(id string, change func(job *TrainingJob)) TrainingJob {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	job := t.jobs[id]
+	change(job)
+	if job.Status != TrainingRunning && t.running == job {
+		t.running = nil
+	}
+	return *job
+}
+
+// get returns a job by ID
+func (t *trainingJobs) get(id string) (TrainingJob, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	job, exists := t.jobs[id]
+	if !exists {
+		return TrainingJob{}, false
+	}
+	return *job, true
+}
+
+// StartTraining starts training the models in the background, like
+// TrainModels, and returns the job at once. While a job runs, it is
+// returned instead of starting another. done, if not nil, is called with
+// the job once it finished.
+func (ml *MLService) StartTraining(done func(TrainingJob)) TrainingJob {
+	job, started := ml.trainingJobs.start(time.Now())
+	if !started {
+		return job
+	}
+
+	go func() {
+		stages := len(ml.trainingStages()) + 1
+		finished := 0
+		err := ml.train(func(stage string) {
+			ml.trainingJobs.update(job.ID, func(job *TrainingJob) {
+				job.Stage = stage
+				job.Progress = float64(finished) / float64(stages)
+			})
+			finished++
+		})
+
+		version := ml.CurrentModelVersion()
+		now := time.Now()
+		result := ml.trainingJobs.update(job.ID, func(job *TrainingJob) {
+			job.Stage = ""
+			job.FinishedAt = &now
+			if err != nil {
+				job.Status = TrainingFailed
+				job.Error = err.Error()
+				return
+			}
+			job.Status = TrainingCompleted
+			job.Progress = 1
+			job.ModelVersion = version
+		})
+		if done != nil {
+			done(result)
+		}
+	}()
+	return job
+}
+
+// GetTrainingJob returns a training job by ID. The latest maxTrainingJobs
+// jobs are kept.
+func (ml *MLService) GetTrainingJob(id string) (TrainingJob, error) {
+	job, exists := ml.trainingJobs.get(id)
+	if !exists {
+		return TrainingJob{}, fmt.Errorf("training job %s not found", id)
+	}
+	return job, nil
+}
+
+// train trains the models on a snapshot of the data without holding the
+// mutex, calling progress, if not nil, before each stage, then replaces the
+// global models and the project models it trained at once. Trainings run
+// one at a time.
+func (ml *MLService) train(progress func(stage string)) error {
+	ml.training.Lock()
+	defer ml.training.Unlock()
+
+	ml.mutex.RLock()
+	snapshot := ml.trainingSnapshot()
+	ml.mutex.RUnlock()
+
+	if err := snapshot.trainModelsReporting(progress); err != nil {
+		return err
+	}
+	if progress != nil {
+		progress(StageProjectModels)
+	}
+	snapshot.trainProjectModels()
+
+	ml.mutex.Lock()
+	defer ml.mutex.Unlock()
+
+	ml.Models = snapshot.Models
+	for key, model := range snapshot.ProjectModels {
+		// Keep the models of projects trained on their own meanwhile
+		if current := ml.ProjectModels[key]; current == nil || model.Trainings > current.Trainings {
+			ml.ProjectModels[key] = model
+		}
+	}
+	return nil
+}
+
+// trainingSnapshot returns a service holding copies of the data and models
+// training reads and changes. Must be called with the mutex held.
+func (ml *MLService) trainingSnapshot() *MLService {
+	projectModels := make(map[string]*ProjectModel, len(ml.ProjectModels))
+	for key, model := range ml.ProjectModels {
+		clone := *model
+		clone.Models = cloneModels(model.Models)
+		clone.Backups = slices.Clone(model.Backups)
+		projectModels[key] = &clone
+	}
+	return &MLService{
+		BuildHistory:     slices.Clone(ml.BuildHistory),
+		WorkerMetrics:    slices.Clone(ml.WorkerMetrics),
+		Models:           cloneModels(ml.Models),
+		ProjectIsolation: ml.ProjectIsolation,
+		ProjectModels:    projectModels,
+	}
+}
@@ -0,0 +1,105 @@
+package service
+
+import (
+	"testing"
+	"time"
+)
+
+// waitForTraining waits for a training job to finish and returns it
+func waitForTraining(t *testing.T, service *MLService, id string) TrainingJob {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		job, err := service.GetTrainingJob(id)
+		if err != nil {
+			t.Fatalf("GetTrainingJob failed: %v", err)
+		}
+		if job.Status != TrainingRunning {
+			return job
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("Training job %s did not finish", id)
+	return TrainingJob{}
+}
+
+func TestStartTraining(t *testing.T) {
+	service := projectService(t)
+
+	done := make(chan TrainingJob, 1)
+	job := service.StartTraining(func(job TrainingJob) { done <- job })
+	if job.ID == "" || job.Status != TrainingRunning {
+		t.Fatalf("Expected a running job, got %+v", job)
+	}
+
+	finished := <-done
+	if finished.Status != TrainingCompleted || finished.Progress != 1 || finished.FinishedAt == nil {
+		t.Fatalf("Expected a completed job, got %+v", finished)
+	}
+	if finished.ModelVersion != service.CurrentModelVersion() {
+		t.Errorf("Expected model version %s, got %s", service.CurrentModelVersion(), finished.ModelVersion)
+	}
+	if job, _ := service.GetTrainingJob(job.ID); job.Status != TrainingCompleted {
+		t.Errorf("Expected the job to be reported completed, got %+v", job)
+	}
+
+	// The trained models replaced the current ones
+	if service.Models.BuildTimePredictor.Weights["/repo/android/app:assemble"] == 0 {
+		t.Errorf("Expected the build time model to be trained, got %v", service.Models.BuildTimePredictor.Weights)
+	}
+	if model := service.ProjectModels["android"]; model == nil || model.Trainings != 1 {
+		t.Errorf("Expected the android models to be trained once, got %+v", model)
+	}
+}
+
+func TestStartTrainingFailure(t *testing.T) {
+	service := NewMLService()
+
+	done := make(chan TrainingJob, 1)
+	job := service.StartTraining(func(job TrainingJob) { done <- job })
+	finished := <-done
+	if finished.Status != TrainingFailed || finished.Error == "" {
+		t.Fatalf("Expected a failed job with too little data, got %+v", finished)
+	}
+
+	// Failed jobs do not block the next one
+	if next := service.StartTraining(nil); next.ID == job.ID {
+		t.Errorf("Expected a new job after the failure, got %s again", next.ID)
+	} else {
+		waitForTraining(t, service, next.ID)
+	}
+
+	if _, err := service.GetTrainingJob("unknown"); err == nil {
+		t.Error("Expected an error for an unknown job")
+	}
+}
+
+func TestTrainingServesPredictions(t *testing.T) {
+	service := projectService(t)
+
+	// Predictions only need the read lock while training works on its
+	// snapshot
+	progressed := make(chan struct{})
+	served := make(chan struct{})
+	go func() {
+		<-progressed
+		service.GetBuildInsights("/repo/android/app", "assemble", nil)
+		close(served)
+	}()
+
+	first := true
+	err := service.train(func(stage string) {
+		if first {
+			first = false
+			close(progressed)
+			select {
+			case <-served:
+			case <-time.After(5 * time.Second):
+				t.Error("Prediction blocked by training")
+			}
+		}
+	})
+	if err != nil {
+		t.Fatalf("train failed: %v", err)
+	}
+}
@@ -0,0 +1,99 @@
+package service
+
+import (
+	"slices"
+	"time"
+)
+
+// minWorkerSamples is the number of successful builds a worker needs before
+// its speed is learned from them
+const minWorkerSamples = 5
+
+// trainWorkerFactors learns how much longer than the average of the fleet
+// each worker takes for the same project and task: the median ratio of its
+// build durations to the trained averages. Must be called with the mutex
+// held, after the averages are trained.
+func (ml *MLService) trainWorkerFactors() {
+	ratios := make(map[string][]float64)
+	for _, record := range ml.BuildHistory {
+		if !record.Success || record.WorkerID == "" || record.Duration <= 0 {
+			continue
+		}
+		average := ml.Models.BuildTimePredictor.Weights[record.ProjectPath+":"+record.TaskName]
+		if average <= 0 {
+			continue
+		}
+		ratios[record.WorkerID] = append(ratios[record.WorkerID], record.Duration.Seconds()/average)
+	}
+
+	factors := make(map[string]float64)
+	for workerID, values := range ratios {
+		if len(values) < minWorkerSamples {
+			continue
+		}
+		slices.Sort(values)
+		factors[workerID] = values[len(values)/2]
+	}
+	ml.Models.BuildTimePredictor.WorkerFactors = factors
+}
+
+// WorkerFactor returns how much longer than a typical worker a worker takes:
+// the factor learned from its past builds, or else the inverse of speed, its
+// speed relative to the fleet as measured by calibration. Workers with
+// neither are typical.
+func (ml *MLService) WorkerFactor(workerID string, speed float64) float64 {
+	ml.mutex.RLock()
+	defer ml.mutex.RUnlock()
+
+	if factor, learned := ml.Models.BuildTimePredictor.WorkerFactors[workerID]; learned && factor > 0 {
+		return factor
+	}
+	if speed > 0 {
+		return 1 / speed
+	}
+	return 1
+}
+
+// ScaleToWorker scales the predicted durations of a result to the worker
+// with workerID or the calibrated speed, leaving it unscaled without either
+func (ml *MLService) ScaleToWorker(result *PredictionResult, workerID string, speed float64) {
+	if workerID != "" || speed > 0 {
+		ScaleDurations(result, ml.WorkerFactor(workerID, speed))
+	}
+}
+
+// ScaleDurations multiplies the predicted durations of a result by factor
+func ScaleDurations(result *PredictionResult, factor float64) {
+	if factor <= 0 || factor == 1 {
+		return
+	}
+	scaleDurations(result, factor)
+	result.WorkerFactor = factor
+}
+
+// scaleDurations multiplies the predicted durations of a result by factor
+func scaleDurations(result *PredictionResult, factor float64) {
+	scale := func(d time.Duration) time.Duration {
+		return time.Duration(float64(d) * factor)
+	}
+	result.PredictedTime = scale(result.PredictedTime)
+	result.P50Time = scale(result.P50Time)
+	result.P90Time = scale(result.P90Time)
+}
+
+// GetWorkerBuildInsights provides the insights of a build with its durations
+// scaled to when it is submitted and to the worker or speed class of the
+// request, if any
+func (ml *MLService) GetWorkerBuildInsights(request PredictionRequest) PredictionResult {
+	submittedAt := request.SubmittedAt
+	if submittedAt.IsZero() {
+		submittedAt = time.Now()
+	}
+	load := request.ClusterLoad
+	if load == 0 {
+		load = -1
+	}
+	result := ml.buildInsights(request.ProjectPath, request.TaskName, request.BuildOptions, submittedAt, load)
+	ml.ScaleToWorker(&result, request.WorkerID, request.WorkerSpeed)
+	return result
+}
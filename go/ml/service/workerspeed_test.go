@@ -0,0 +1,50 @@
+package service
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWorkerFactors(t *testing.T) {
+	service := NewMLService()
+	for i := 0; i < 10; i++ {
+		for workerID, duration := range map[string]time.Duration{"fast": time.Minute, "slow": 2 * time.Minute} {
+			service.BuildHistory = append(service.BuildHistory, BuildRecord{
+				ProjectPath: "/test/project",
+				TaskName:    "build",
+				WorkerID:    workerID,
+				Duration:    duration,
+				Success:     true,
+			})
+		}
+	}
+	// Too few builds to learn the speed of a worker from
+	service.BuildHistory = append(service.BuildHistory, BuildRecord{ProjectPath: "/test/project", TaskName: "build", WorkerID: "new", Duration: 3 * time.Minute, Success: true})
+	if err := service.TrainModels(); err != nil {
+		t.Fatalf("TrainModels failed: %v", err)
+	}
+
+	typical := service.GetBuildInsights("/test/project", "build", nil)
+	tests := []struct {
+		request PredictionRequest
+		factor  float64
+	}{
+		{PredictionRequest{WorkerID: "slow"}, 2 * time.Minute.Seconds() / typical.PredictedTime.Seconds()},
+		{PredictionRequest{WorkerID: "fast", WorkerSpeed: 0.1}, time.Minute.Seconds() / typical.PredictedTime.Seconds()},
+		{PredictionRequest{WorkerID: "new", WorkerSpeed: 2}, 0.5},
+		{PredictionRequest{WorkerID: "new"}, 1},
+		{PredictionRequest{}, 1},
+	}
+	for _, tt := range tests {
+		tt.request.ProjectPath, tt.request.TaskName = "/test/project", "build"
+		insights := service.GetWorkerBuildInsights(tt.request)
+		expected := time.Duration(float64(typical.PredictedTime) * tt.factor)
+		if diff := insights.PredictedTime - expected; diff < -time.Millisecond || diff > time.Millisecond {
+			t.Errorf("%+v: expected %v, got %v", tt.request, expected, insights.PredictedTime)
+		}
+		expected = time.Duration(float64(typical.P90Time) * tt.factor)
+		if diff := insights.P90Time - expected; diff < -time.Millisecond || diff > time.Millisecond {
+			t.Errorf("%+v: expected p90 %v, got %v", tt.request, expected, insights.P90Time)
+		}
+	}
+}
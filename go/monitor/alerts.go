@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+
+	"distributed-gradle-building/alerting"
+)
+
+// defaultEvaluationInterval is how often alert rules are evaluated without
+// a MetricsInterval
+const defaultEvaluationInterval = 30 * time.Second
+
+// SilenceRequest silences the alerts of a rule, of a severity, or of both
+// for a duration such as 2h
+type SilenceRequest struct {
+	Rule     string `json:"rule,omitempty"`
+	Severity string `json:"severity,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+	Duration string `json:"duration"`
+}
+
+// newAlerting returns the engine evaluating the configured alert rules and
+// the burn rate rules of the SLOs on the metrics history
+func (m *Monitor) newAlerting() (*alerting.Engine, error) {
+	series := m.historySeries()
+	for _, rule := range m.config.AlertRules {
+		if !slices.Contains(series, rule.Metric) {
+			return nil, fmt.Errorf("alert rule %s has unknown metric %q", rule.Name, rule.Metric)
+		}
+	}
+	rules := slices.Clone(m.config.AlertRules)
+	for _, slo := range m.config.SLOs {
+		rules = append(rules, slo.burnRules()...)
+	}
+	return alerting.NewEngine(m.history, rules)
+}
+
+// evaluateAlerts evaluates the alert rules every MetricsInterval, logging
+// the alerts that fire or resolve unless they are silenced
+func (m *Monitor) evaluateAlerts() {
+	interval := m.config.MetricsInterval
+	if interval <= 0 {
+		interval = defaultEvaluationInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		changes, err := m.alerts.Evaluate(time.Now())
+		if err != nil {
+			log.Printf("Failed to evaluate alert rules: %v", err)
+		}
+		for _, alert := range changes {
+			if alert.SilencedBy == "" {
+				log.Printf("Alert %s %s (%s): %s", alert.Rule, alert.State, alert.Severity, alert.Message)
+			}
+		}
+	}
+}
+
+// handleListAlerts returns the pending, firing and recently resolved
+// alerts, or only those in the state of the state parameter
+func (m *Monitor) handleListAlerts(w http.ResponseWriter, r *http.Request) {
+	if m.alerts == nil {
+		http.Error(w, "Alerting is not enabled", http.StatusServiceUnavailable)
+		return
+	}
+
+	alerts := m.alerts.Alerts(time.Now())
+	if state := r.URL.Query().Get("state"); state != "" {
+		alerts = slices.DeleteFunc(alerts, func(alert alerting.Alert) bool {
+			return alert.State != state
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(alerts)
+}
+
+// handleListSilences returns the silences in effect
+func (m *Monitor) handleListSilences(w http.ResponseWriter, r *http.Request) {
+	if m.alerts == nil {
+		http.Error(w, "Alerting is not enabled", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(m.alerts.Silences(time.Now()))
+}
+
+// handleCreateSilence silences alerts from now on
+func (m *Monitor) handleCreateSilence(w http.ResponseWriter, r *http.Request) {
+	if m.alerts == nil {
+		http.Error(w, "Alerting is not enabled", http.StatusServiceUnavailable)
+		return
+	}
+
+	var request SilenceRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	duration, err := time.ParseDuration(request.Duration)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid duration %q", request.Duration), http.StatusBadRequest)
+		return
+	}
+	silence, err := m.alerts.Silence(alerting.Silence{Rule: request.Rule, Severity: request.Severity, Comment: request.Comment}, duration, time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Printf("Silenced alerts until %s: %+v", silence.EndsAt.Format(time.RFC3339), request)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(silence)
+}
+
+// handleExpireSilence ends a silence
+func (m *Monitor) handleExpireSilence(w http.ResponseWriter, r *http.Request) {
+	if m.alerts == nil || !m.alerts.Expire(r.PathValue("id")) {
+		http.Error(w, "Silence not found", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
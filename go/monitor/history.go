@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"distributed-gradle-building/events"
+	"distributed-gradle-building/tsdb"
+)
+
+// Series recorded of each finished build. The mean of build_success over a
+// step is the success rate of the builds finished in it.
+const (
+	seriesBuildDuration = "build_duration_seconds"
+	seriesBuildSuccess  = "build_success"
+	seriesCacheHitRate  = "build_cache_hit_rate"
+)
+
+// defaultQueryRange is how far back a range query reaches without from
+const defaultQueryRange = 24 * time.Hour
+
+// metricsSeries lists the series recorded of every build
+var metricsSeries = []string{seriesBuildDuration, seriesBuildSuccess, seriesCacheHitRate}
+
+// MetricsRange is the response of a range query of /api/metrics
+type MetricsRange struct {
+	Series string       `json:"series"`
+	From   string       `json:"from"`
+	To     string       `json:"to"`
+	Step   string       `json:"step,omitempty"`
+	Points []tsdb.Point `json:"points"`
+}
+
+// openHistory opens the store of the metrics history in the metrics
+// directory of DataDir, defaulting to data/metrics, keeping RetentionDays
+// of samples (default: 30)
+func openHistory(config *MonitorConfig) (*tsdb.Store, error) {
+	dir := config.DataDir
+	if dir == "" {
+		dir = "data"
+	}
+	options := tsdb.DefaultOptions()
+	if config.RetentionDays < 0 {
+		return nil, fmt.Errorf("invalid retention_days: %d", config.RetentionDays)
+	}
+	if config.RetentionDays > 0 {
+		options.RetentionDays = config.RetentionDays
+	}
+	return tsdb.Open(filepath.Join(dir, "metrics"), options)
+}
+
+// recordHistory appends the samples of a finished build to the history
+func (m *Monitor) recordHistory(event events.Event) {
+	if m.history == nil {
+		return
+	}
+	at := event.Timestamp
+	if at.IsZero() {
+		at = time.Now()
+	}
+	success := 0.0
+	if event.Status == "completed" {
+		success = 1
+	}
+
+	samples := map[string]float64{
+		seriesBuildDuration: event.Duration.Seconds(),
+		seriesBuildSuccess:  success,
+		seriesCacheHitRate:  event.CacheHitRate,
+	}
+	for series, value := range samples {
+		m.appendHistory(series, at, value, event.BuildID)
+	}
+	m.recordSLOs(event, at)
+}
+
+// appendHistory appends a sample of a build, logging failures
+func (m *Monitor) appendHistory(series string, at time.Time, value float64, buildID string) {
+	if err := m.history.Append(series, at, value); err != nil {
+		log.Printf("Failed to record %s of build %s: %v", series, buildID, err)
+	}
+}
+
+// historySeries returns the series of the history: those of every build
+// and those of the SLOs
+func (m *Monitor) historySeries() []string {
+	series := slices.Clone(metricsSeries)
+	for _, slo := range m.config.SLOs {
+		series = append(series, slo.series())
+	}
+	return series
+}
+
+// restoreTotals computes the build totals from the builds of the history,
+// so they survive restarts
+func (m *Monitor) restoreTotals(now time.Time) error {
+	from := now.AddDate(0, 0, -tsdb.DefaultRetentionDays)
+	if m.config.RetentionDays > 0 {
+		from = now.AddDate(0, 0, -m.config.RetentionDays)
+	}
+
+	// Downsampled points count all the builds they aggregate
+	counts := make(map[string]int)
+	sums := make(map[string]float64)
+	var last time.Time
+	for _, series := range metricsSeries {
+		points, err := m.history.Query(series, from, now, 0)
+		if err != nil {
+			return err
+		}
+		for _, point := range points {
+			counts[series] += point.Count
+			sums[series] += point.Sum()
+			if point.Timestamp.After(last) {
+				last = point.Timestamp
+			}
+		}
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	builds := counts[seriesBuildSuccess]
+	if builds == 0 {
+		return nil
+	}
+	m.totals.TotalBuilds = builds
+	m.totals.SuccessfulBuilds = int(math.Round(sums[seriesBuildSuccess]))
+	m.totals.FailedBuilds = builds - m.totals.SuccessfulBuilds
+	m.totals.CacheHitRate = sums[seriesCacheHitRate] / float64(builds)
+	m.buildTime = time.Duration(sums[seriesBuildDuration] * float64(time.Second))
+	m.totals.AverageBuildTime = m.buildTime.Seconds() / float64(builds)
+	m.totals.LastUpdate = last.Format(time.RFC3339)
+	return nil
+}
+
+// compactHistory deletes and downsamples old samples every hour
+func (m *Monitor) compactHistory() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		deleted, downsampled, err := m.history.Compact(time.Now())
+		if err != nil {
+			log.Printf("Failed to compact metrics history: %v", err)
+		}
+		if deleted > 0 || downsampled > 0 {
+			log.Printf("Deleted %d and downsampled %d days of metrics history", deleted, downsampled)
+		}
+		<-ticker.C
+	}
+}
+
+// queryHistory answers a range query of /api/metrics for series over from
+// and to, RFC 3339 times defaulting to the last 24 hours, aggregated per
+// step, a duration such as 5m
+func (m *Monitor) queryHistory(w http.ResponseWriter, r *http.Request) {
+	if m.history == nil {
+		http.Error(w, "Metrics history is not enabled", http.StatusServiceUnavailable)
+		return
+	}
+
+	query := r.URL.Query()
+	series := query.Get("series")
+	if !slices.Contains(m.historySeries(), series) {
+		http.Error(w, fmt.Sprintf("Unknown series %q", series), http.StatusBadRequest)
+		return
+	}
+
+	to := time.Now()
+	if value := query.Get("to"); value != "" {
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			http.Error(w, "Invalid to: "+value, http.StatusBadRequest)
+			return
+		}
+		to = parsed
+	}
+	from := to.Add(-defaultQueryRange)
+	if value := query.Get("from"); value != "" {
+		parsed, err := time.Parse(time.RFC3339, value)
+		if err != nil || !parsed.Before(to) {
+			http.Error(w, "Invalid from: "+value, http.StatusBadRequest)
+			return
+		}
+		from = parsed
+	}
+	var step time.Duration
+	if value := query.Get("step"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			http.Error(w, "Invalid step: "+value, http.StatusBadRequest)
+			return
+		}
+		step = parsed
+	}
+
+	points, err := m.history.Query(series, from, to, step)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	response := MetricsRange{Series: series, From: from.UTC().Format(time.RFC3339), To: to.UTC().Format(time.RFC3339), Points: points}
+	if step > 0 {
+		response.Step = step.String()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -1,15 +1,37 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"sync"
 	"time"
+
+	"distributed-gradle-building/alerting"
+	"distributed-gradle-building/events"
+	"distributed-gradle-building/internal/app"
+	"distributed-gradle-building/middleware"
+	"distributed-gradle-building/tracing"
+	"distributed-gradle-building/tsdb"
 )
 
-// MonitorConfig holds configuration for monitoring service
+// maxRecentBuilds is how many finished builds received as events are
+// reported by /api/metrics
+const maxRecentBuilds = 100
+
+// defaultJaegerEndpoint is the OTLP/HTTP traces URL of a local Jaeger
+const defaultJaegerEndpoint = "http://localhost:4318/v1/traces"
+
+// MonitorConfig holds configuration for monitoring service. With
+// EnableJaeger, spans are exported to the OTLP/HTTP JaegerEndpoint, sampling
+// JaegerSampleRate of new traces (default: all). The metrics of finished
+// builds are kept under DataDir for RetentionDays, see openHistory, and
+// AlertRules are evaluated on them every MetricsInterval, along with the
+// burn rates of the SLOs.
 type MonitorConfig struct {
 	Port             int                `json:"port"`
 	MetricsInterval  time.Duration      `json:"metrics_interval"`
@@ -17,12 +39,34 @@ type MonitorConfig struct {
 	EnablePrometheus bool               `json:"enable_prometheus"`
 	EnableJaeger     bool               `json:"enable_jaeger"`
 	JaegerEndpoint   string             `json:"jaeger_endpoint"`
+	JaegerSampleRate float64            `json:"jaeger_sample_rate"`
+	DataDir          string             `json:"data_dir"`
+	RetentionDays    int                `json:"retention_days"`
+	AlertRules       []alerting.Rule    `json:"alert_rules"`
+	SLOs             []SLO              `json:"slos"`
 }
 
 // Monitor represents the monitoring service
 type Monitor struct {
 	config     *MonitorConfig
 	httpServer *http.Server
+	// mutex guards the builds received as events on the event bus
+	mutex  sync.RWMutex
+	builds []BuildRecord
+	totals SystemMetrics
+	// buildTime is the summed duration of the finished builds
+	buildTime time.Duration
+	// tracer exports spans of the API requests and finished builds, nil
+	// unless tracing is configured
+	tracer *tracing.Tracer
+	// history stores the metrics of the finished builds, nil unless opened
+	history *tsdb.Store
+	// alerts evaluates the alert rules on the history, nil unless it is
+	// opened
+	alerts *alerting.Engine
+	// bus delivers the events of the finished builds, nil unless the
+	// monitor is run as a service
+	bus events.Bus
 }
 
 // loadMonitorConfig loads monitor configuration from file
@@ -54,6 +98,23 @@ func loadMonitorConfig(filename string) (*MonitorConfig, error) {
 	return &config, nil
 }
 
+// newTracer starts the tracer exporting to the configured Jaeger endpoint,
+// or to TRACING_ENDPOINT when Jaeger is not enabled in the configuration
+func newTracer(config *MonitorConfig) (*tracing.Tracer, error) {
+	if !config.EnableJaeger {
+		return tracing.FromEnv("monitor")
+	}
+
+	endpoint, rate := config.JaegerEndpoint, config.JaegerSampleRate
+	if endpoint == "" {
+		endpoint = defaultJaegerEndpoint
+	}
+	if rate == 0 {
+		rate = tracing.DefaultSampleRate
+	}
+	return tracing.New(tracing.Config{Service: "monitor", Endpoint: endpoint, SampleRate: rate})
+}
+
 // NewMonitor creates a new monitor service
 func NewMonitor(config *MonitorConfig) *Monitor {
 	return &Monitor{
@@ -61,32 +122,112 @@ func NewMonitor(config *MonitorConfig) *Monitor {
 	}
 }
 
+// routes returns the HTTP handler of the monitor API
+func (m *Monitor) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", m.healthHandler)
+	mux.HandleFunc("/metrics", m.metricsHandler)
+	mux.HandleFunc("/api/metrics", m.apiMetricsHandler)
+	mux.HandleFunc("GET /api/slo", m.handleSLO)
+	mux.HandleFunc("GET /api/alerts", m.handleListAlerts)
+	mux.HandleFunc("GET /api/silences", m.handleListSilences)
+	mux.HandleFunc("POST /api/silences", m.handleCreateSilence)
+	mux.HandleFunc("DELETE /api/silences/{id}", m.handleExpireSilence)
+	mux.HandleFunc("/api/openapi.json", monitorOpenAPI().Handler())
+	mux.HandleFunc("/api/tracing/check", m.tracer.Handler())
+
+	return middleware.Chain(mux,
+		middleware.RequestID,
+		middleware.Tracing(m.tracer, mux),
+		middleware.Logging,
+	)
+}
+
 // Start starts the monitor service
 func (m *Monitor) Start() error {
-	// Set up HTTP routes
-	http.HandleFunc("/health", m.healthHandler)
-	http.HandleFunc("/metrics", m.metricsHandler)
-	http.HandleFunc("/api/metrics", m.apiMetricsHandler)
+	m.listen()
+	return m.httpServer.ListenAndServe()
+}
 
-	// Start HTTP server
-	addr := fmt.Sprintf(":%d", m.config.Port)
+// listen creates the HTTP server of the monitor, to be served with
+// ListenAndServe
+func (m *Monitor) listen() {
 	log.Printf("Monitor service started on port %d", m.config.Port)
-
 	m.httpServer = &http.Server{
-		Addr:    addr,
-		Handler: nil, // Use default mux
+		Addr:    fmt.Sprintf(":%d", m.config.Port),
+		Handler: m.routes(),
 	}
+}
 
-	return m.httpServer.ListenAndServe()
+// HealthStatus is the monitor health check response
+type HealthStatus struct {
+	Status  string `json:"status"`
+	Service string `json:"service"`
+}
+
+// ServiceMetrics is the basic metrics response
+type ServiceMetrics struct {
+	Service string            `json:"service"`
+	Metrics map[string]string `json:"metrics"`
+}
+
+// WorkerStatus reports the load of a worker
+type WorkerStatus struct {
+	ID           string  `json:"id"`
+	Status       string  `json:"status"`
+	CPUUsage     float64 `json:"cpu_usage"`
+	MemoryUsage  float64 `json:"memory_usage"`
+	ActiveBuilds int     `json:"active_builds"`
+}
+
+// ResourceUsage reports the resources a build consumed
+type ResourceUsage struct {
+	CPUPercent  float64 `json:"cpu_percent"`
+	MemoryUsage int64   `json:"memory_usage"`
+	DiskIO      int64   `json:"disk_io"`
+	NetworkIO   int64   `json:"network_io"`
+}
+
+// BuildRecord reports a finished build
+type BuildRecord struct {
+	BuildID       string        `json:"build_id"`
+	WorkerID      string        `json:"worker_id"`
+	ProjectPath   string        `json:"project_path"`
+	TaskName      string        `json:"task_name"`
+	Success       bool          `json:"success"`
+	StartTime     string        `json:"start_time"`
+	EndTime       string        `json:"end_time"`
+	CacheHitRate  float64       `json:"cache_hit_rate"`
+	ResourceUsage ResourceUsage `json:"resource_usage"`
+	ErrorMessage  string        `json:"error_message"`
+}
+
+// SystemMetrics summarizes the whole build system
+type SystemMetrics struct {
+	TotalBuilds      int     `json:"total_builds"`
+	SuccessfulBuilds int     `json:"successful_builds"`
+	FailedBuilds     int     `json:"failed_builds"`
+	ActiveWorkers    int     `json:"active_workers"`
+	QueueLength      int     `json:"queue_length"`
+	AverageBuildTime float64 `json:"average_build_time"` // seconds
+	CacheHitRate     float64 `json:"cache_hit_rate"`
+	LastUpdate       string  `json:"last_update"`
+}
+
+// MetricsReport is the detailed metrics response consumed by the ML service
+type MetricsReport struct {
+	Workers map[string]WorkerStatus `json:"workers"`
+	Builds  map[string]BuildRecord  `json:"builds"`
+	System  SystemMetrics           `json:"system"`
 }
 
 // healthHandler provides a basic health check endpoint
 func (m *Monitor) healthHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{
-		"status":  "healthy",
-		"service": "monitor",
+	json.NewEncoder(w).Encode(HealthStatus{
+		Status:  "healthy",
+		Service: "monitor",
 	})
 }
 
@@ -94,117 +235,260 @@ func (m *Monitor) healthHandler(w http.ResponseWriter, r *http.Request) {
 func (m *Monitor) metricsHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]any{
-		"service": "monitor",
-		"metrics": map[string]any{
+	json.NewEncoder(w).Encode(ServiceMetrics{
+		Service: "monitor",
+		Metrics: map[string]string{
 			"uptime":  "running",
 			"version": "1.0.0",
 		},
 	})
 }
 
-// apiMetricsHandler provides detailed metrics for ML service consumption
+// apiMetricsHandler provides detailed metrics for ML service consumption,
+// or the history of a series when one is queried
 func (m *Monitor) apiMetricsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Has("series") {
+		m.queryHistory(w, r)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 
 	// Mock data for now - in a real implementation, this would collect from actual monitoring
-	response := map[string]any{
-		"workers": map[string]any{
-			"worker-1": map[string]any{
-				"id":            "worker-1",
-				"status":        "active",
-				"cpu_usage":     0.65,
-				"memory_usage":  0.55,
-				"active_builds": 1,
+	response := MetricsReport{
+		Workers: map[string]WorkerStatus{
+			"worker-1": {
+				ID:           "worker-1",
+				Status:       "active",
+				CPUUsage:     0.65,
+				MemoryUsage:  0.55,
+				ActiveBuilds: 1,
 			},
-			"worker-2": map[string]any{
-				"id":            "worker-2",
-				"status":        "active",
-				"cpu_usage":     0.45,
-				"memory_usage":  0.35,
-				"active_builds": 0,
+			"worker-2": {
+				ID:           "worker-2",
+				Status:       "active",
+				CPUUsage:     0.45,
+				MemoryUsage:  0.35,
+				ActiveBuilds: 0,
 			},
-			"worker-3": map[string]any{
-				"id":            "worker-3",
-				"status":        "idle",
-				"cpu_usage":     0.25,
-				"memory_usage":  0.20,
-				"active_builds": 0,
+			"worker-3": {
+				ID:           "worker-3",
+				Status:       "idle",
+				CPUUsage:     0.25,
+				MemoryUsage:  0.20,
+				ActiveBuilds: 0,
 			},
 		},
-		"builds": map[string]any{
-			"build-123": map[string]any{
-				"build_id":       "build-123",
-				"worker_id":      "worker-1",
-				"project_path":   "/projects/myapp",
-				"task_name":      "build",
-				"success":        true,
-				"start_time":     time.Now().Add(-10 * time.Minute).Format(time.RFC3339),
-				"end_time":       time.Now().Add(-8 * time.Minute).Format(time.RFC3339),
-				"cache_hit_rate": 0.75,
-				"resource_usage": map[string]any{
-					"cpu_percent":  0.65,
-					"memory_usage": 512 * 1024 * 1024, // 512MB
-					"disk_io":      1024 * 1024,       // 1MB
-					"network_io":   512 * 1024,        // 512KB
+		Builds: map[string]BuildRecord{
+			"build-123": {
+				BuildID:      "build-123",
+				WorkerID:     "worker-1",
+				ProjectPath:  "/projects/myapp",
+				TaskName:     "build",
+				Success:      true,
+				StartTime:    time.Now().Add(-10 * time.Minute).Format(time.RFC3339),
+				EndTime:      time.Now().Add(-8 * time.Minute).Format(time.RFC3339),
+				CacheHitRate: 0.75,
+				ResourceUsage: ResourceUsage{
+					CPUPercent:  0.65,
+					MemoryUsage: 512 * 1024 * 1024, // 512MB
+					DiskIO:      1024 * 1024,       // 1MB
+					NetworkIO:   512 * 1024,        // 512KB
 				},
-				"error_message": "",
+				ErrorMessage: "",
 			},
-			"build-124": map[string]any{
-				"build_id":       "build-124",
-				"worker_id":      "worker-2",
-				"project_path":   "/projects/web",
-				"task_name":      "test",
-				"success":        false,
-				"start_time":     time.Now().Add(-5 * time.Minute).Format(time.RFC3339),
-				"end_time":       time.Now().Add(-3 * time.Minute).Format(time.RFC3339),
-				"cache_hit_rate": 0.20,
-				"resource_usage": map[string]any{
-					"cpu_percent":  0.80,
-					"memory_usage": 1024 * 1024 * 1024, // 1GB
-					"disk_io":      2048 * 1024,        // 2MB
-					"network_io":   1024 * 1024,        // 1MB
+			"build-124": {
+				BuildID:      "build-124",
+				WorkerID:     "worker-2",
+				ProjectPath:  "/projects/web",
+				TaskName:     "test",
+				Success:      false,
+				StartTime:    time.Now().Add(-5 * time.Minute).Format(time.RFC3339),
+				EndTime:      time.Now().Add(-3 * time.Minute).Format(time.RFC3339),
+				CacheHitRate: 0.20,
+				ResourceUsage: ResourceUsage{
+					CPUPercent:  0.80,
+					MemoryUsage: 1024 * 1024 * 1024, // 1GB
+					DiskIO:      2048 * 1024,        // 2MB
+					NetworkIO:   1024 * 1024,        // 1MB
 				},
-				"error_message": "Test failures detected",
+				ErrorMessage: "Test failures detected",
 			},
 		},
-		"system": map[string]any{
-			"total_builds":       150,
-			"successful_builds":  135,
-			"failed_builds":      15,
-			"active_workers":     3,
-			"queue_length":       2,
-			"average_build_time": 450.5, // seconds
-			"cache_hit_rate":     0.72,
-			"last_update":        time.Now().Format(time.RFC3339),
+		System: SystemMetrics{
+			TotalBuilds:      150,
+			SuccessfulBuilds: 135,
+			FailedBuilds:     15,
+			ActiveWorkers:    3,
+			QueueLength:      2,
+			AverageBuildTime: 450.5,
+			CacheHitRate:     0.72,
+			LastUpdate:       time.Now().Format(time.RFC3339),
 		},
 	}
 
+	m.reportEvents(&response)
 	json.NewEncoder(w).Encode(response)
 }
 
-// Main monitor application entry point
-func monitorMain() {
-	// Load configuration
-	configFile := "monitor_config.json"
-	if len(os.Args) > 1 {
-		configFile = os.Args[1]
+// consumeEvents records the builds finishing on the coordinator as their
+// events arrive on bus
+func (m *Monitor) consumeEvents(bus events.Bus) (func(), error) {
+	return bus.Subscribe(m.recordEvent)
+}
+
+// recordEvent records a finished build
+func (m *Monitor) recordEvent(event events.Event) {
+	if event.Type != events.BuildFinished {
+		return
 	}
 
-	config, err := loadMonitorConfig(configFile)
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	success := event.Status == "completed"
+	m.builds = append(m.builds, BuildRecord{
+		BuildID:      event.BuildID,
+		WorkerID:     event.WorkerID,
+		ProjectPath:  event.ProjectPath,
+		TaskName:     event.TaskName,
+		Success:      success,
+		StartTime:    event.Timestamp.Add(-event.Duration).Format(time.RFC3339),
+		EndTime:      event.Timestamp.Format(time.RFC3339),
+		CacheHitRate: event.CacheHitRate,
+		ErrorMessage: event.ErrorMessage,
+	})
+	if len(m.builds) > maxRecentBuilds {
+		m.builds = m.builds[1:]
+	}
+
+	// The cache hit rate is a running average over the finished builds
+	m.totals.CacheHitRate = (m.totals.CacheHitRate*float64(m.totals.TotalBuilds) + event.CacheHitRate) / float64(m.totals.TotalBuilds+1)
+	m.totals.TotalBuilds++
+	if success {
+		m.totals.SuccessfulBuilds++
+	} else {
+		m.totals.FailedBuilds++
+	}
+	m.buildTime += event.Duration
+	m.totals.AverageBuildTime = m.buildTime.Seconds() / float64(m.totals.TotalBuilds)
+	m.totals.LastUpdate = event.Timestamp.Format(time.RFC3339)
+
+	m.recordHistory(event)
+	m.traceBuild(event)
+}
+
+// traceBuild exports a finished build as a span covering its duration, so
+// builds show up in Jaeger next to the requests of the services
+func (m *Monitor) traceBuild(event events.Event) {
+	_, span := m.tracer.StartAt(context.Background(), "build "+event.TaskName, tracing.KindInternal, event.Timestamp.Add(-event.Duration))
+	span.SetAttribute("build.id", event.BuildID)
+	span.SetAttribute("build.status", event.Status)
+	span.SetAttribute("build.project_path", event.ProjectPath)
+	span.SetAttribute("build.worker_id", event.WorkerID)
+	span.SetAttribute("build.cache_hit_rate", strconv.FormatFloat(event.CacheHitRate, 'f', -1, 64))
+	if event.Status != "completed" {
+		span.SetError(event.ErrorMessage)
+	}
+	span.EndAt(event.Timestamp)
+}
+
+// reportEvents replaces the reported builds and build totals with the ones
+// received as events, once there are any
+func (m *Monitor) reportEvents(response *MetricsReport) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	if m.totals.TotalBuilds == 0 {
+		return
+	}
+	response.Builds = make(map[string]BuildRecord, len(m.builds))
+	for _, build := range m.builds {
+		response.Builds[build.BuildID] = build
+	}
+	response.System.TotalBuilds = m.totals.TotalBuilds
+	response.System.SuccessfulBuilds = m.totals.SuccessfulBuilds
+	response.System.FailedBuilds = m.totals.FailedBuilds
+	response.System.AverageBuildTime = m.totals.AverageBuildTime
+	response.System.CacheHitRate = m.totals.CacheHitRate
+	response.System.LastUpdate = m.totals.LastUpdate
+}
+
+// Main monitor application entry point
+// monitorProcess runs the monitor as an app.Service
+type monitorProcess struct {
+	monitor *Monitor
+}
+
+func (p *monitorProcess) Name() string {
+	return "monitor"
+}
+
+// Init loads the configuration of the monitor from the file named by the
+// first argument and opens its metrics history
+func (p *monitorProcess) Init(ctx context.Context) error {
+	config, err := loadMonitorConfig(app.ConfigFile("monitor_config.json"))
 	if err != nil {
-		log.Fatalf("Failed to load monitor config: %v", err)
+		return fmt.Errorf("failed to load monitor config: %v", err)
 	}
 
-	// Create and start monitor
 	monitor := NewMonitor(config)
+	p.monitor = monitor
+	if monitor.tracer, err = newTracer(config); err != nil {
+		return fmt.Errorf("invalid tracing configuration: %v", err)
+	}
+	if err := validateSLOs(config); err != nil {
+		return fmt.Errorf("invalid SLOs: %v", err)
+	}
+	if monitor.history, err = openHistory(config); err != nil {
+		return fmt.Errorf("invalid metrics history configuration: %v", err)
+	}
+	if err := monitor.restoreTotals(time.Now()); err != nil {
+		log.Printf("Failed to restore build totals from the metrics history: %v", err)
+	}
+	if monitor.alerts, err = monitor.newAlerting(); err != nil {
+		return fmt.Errorf("invalid alert rules: %v", err)
+	}
 
-	log.Printf("Starting monitor on port %d", config.Port)
-	err = monitor.Start()
-	if err != nil {
-		log.Fatalf("Monitor failed: %v", err)
+	// Report the builds finishing on the coordinator when it publishes its
+	// events on a shared bus
+	if monitor.bus, err = events.FromEnv("monitor"); err != nil {
+		return fmt.Errorf("invalid event bus configuration: %v", err)
+	}
+	if monitor.bus.Backend() != events.BackendMemory {
+		if _, err := monitor.consumeEvents(monitor.bus); err != nil {
+			return fmt.Errorf("failed to subscribe to build events: %v", err)
+		}
+		log.Printf("Consuming build events from the %s event bus", monitor.bus.Backend())
 	}
+	return nil
+}
+
+// Start compacts the metrics history and evaluates the alert rules in the
+// background, and starts the HTTP server
+func (p *monitorProcess) Start(ctx context.Context) error {
+	go p.monitor.compactHistory()
+	go p.monitor.evaluateAlerts()
+
+	p.monitor.listen()
+	app.Go(ctx, p.monitor.httpServer.ListenAndServe)
+	return nil
+}
+
+// Stop shuts the HTTP server down, then closes the event bus, the metrics
+// history and the tracer
+func (p *monitorProcess) Stop(ctx context.Context, cause error) error {
+	err := p.monitor.httpServer.Shutdown(ctx)
+	p.monitor.bus.Close()
+	p.monitor.history.Close()
+	p.monitor.tracer.Close()
+	return err
+}
+
+// Main monitor application entry point
+func monitorMain() {
+	app.Main(&monitorProcess{})
 }
 
 // Main function for monitor
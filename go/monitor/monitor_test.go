@@ -2,11 +2,20 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
+	"io"
+	"math"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	"distributed-gradle-building/alerting"
+	"distributed-gradle-building/events"
 )
 
 func TestLoadMonitorConfig(t *testing.T) {
@@ -95,6 +104,24 @@ func TestHealthHandler(t *testing.T) {
 	}
 }
 
+func TestRoutesEchoRequestID(t *testing.T) {
+	handler := NewMonitor(&MonitorConfig{}).routes()
+
+	req := httptest.NewRequest("GET", "/health", nil)
+	req.Header.Set("X-Request-ID", "request-1")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if id := w.Header().Get("X-Request-ID"); id != "request-1" {
+		t.Errorf("Expected the client's request ID to be echoed, got %q", id)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/health", nil))
+	if w.Code != http.StatusOK || w.Header().Get("X-Request-ID") == "" {
+		t.Errorf("Expected a generated request ID, got %d %v", w.Code, w.Header())
+	}
+}
+
 func TestMetricsHandler(t *testing.T) {
 	config := &MonitorConfig{}
 	monitor := NewMonitor(config)
@@ -218,3 +245,294 @@ func TestMonitorStart(t *testing.T) {
 		t.Error("Server did not stop in time")
 	}
 }
+
+func TestOpenAPIDocument(t *testing.T) {
+	req := httptest.NewRequest("GET", "/api/openapi.json", nil)
+	w := httptest.NewRecorder()
+
+	monitorOpenAPI().Handler()(w, req)
+
+	var doc struct {
+		Paths map[string]any `json:"paths"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil {
+		t.Fatalf("Failed to unmarshal document: %v", err)
+	}
+
+	for _, path := range []string{"/health", "/metrics", "/api/metrics", "/api/slo", "/api/alerts", "/api/silences", "/api/silences/{id}", "/api/tracing/check"} {
+		if _, exists := doc.Paths[path]; !exists {
+			t.Errorf("Expected path %s in document", path)
+		}
+	}
+}
+
+func TestApiMetricsFromEvents(t *testing.T) {
+	monitor := NewMonitor(&MonitorConfig{})
+	bus := events.NewMemory()
+	stop, err := monitor.consumeEvents(bus)
+	if err != nil {
+		t.Fatalf("consumeEvents failed: %v", err)
+	}
+	defer stop()
+
+	now := time.Now()
+	bus.Publish(events.Event{Type: events.BuildStarted, BuildID: "build-1"})
+	bus.Publish(events.Event{Type: events.BuildFinished, BuildID: "build-1", Timestamp: now, Status: "completed", Duration: 2 * time.Minute, CacheHitRate: 1})
+	bus.Publish(events.Event{Type: events.BuildFinished, BuildID: "build-2", Timestamp: now, Status: "failed", ErrorMessage: "compilation failed"})
+
+	var response MetricsReport
+	deadline := time.Now().Add(5 * time.Second)
+	for response.System.TotalBuilds != 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for the builds, got %+v", response.System)
+		}
+		time.Sleep(10 * time.Millisecond)
+		w := httptest.NewRecorder()
+		monitor.apiMetricsHandler(w, httptest.NewRequest("GET", "/api/metrics", nil))
+		response = MetricsReport{}
+		json.Unmarshal(w.Body.Bytes(), &response)
+	}
+
+	if len(response.Builds) != 2 || !response.Builds["build-1"].Success || response.Builds["build-2"].ErrorMessage != "compilation failed" {
+		t.Errorf("Expected the finished builds, got %+v", response.Builds)
+	}
+	system := response.System
+	if system.SuccessfulBuilds != 1 || system.FailedBuilds != 1 || system.AverageBuildTime != 60 || system.CacheHitRate != 0.5 {
+		t.Errorf("Expected totals of the finished builds, got %+v", system)
+	}
+}
+
+func TestNewTracer(t *testing.T) {
+	t.Setenv("TRACING_ENDPOINT", "")
+	if tracer, err := newTracer(&MonitorConfig{}); tracer != nil || err != nil {
+		t.Errorf("Expected tracing to be disabled by default, got %v, %v", tracer, err)
+	}
+
+	tracer, err := newTracer(&MonitorConfig{EnableJaeger: true})
+	if err != nil {
+		t.Fatalf("newTracer failed: %v", err)
+	}
+	defer tracer.Close()
+	if status := tracer.Status(); status.Endpoint != defaultJaegerEndpoint || status.SampleRate != 1 || status.Service != "monitor" {
+		t.Errorf("Expected the default Jaeger endpoint sampling every trace, got %+v", status)
+	}
+
+	if _, err := newTracer(&MonitorConfig{EnableJaeger: true, JaegerEndpoint: "jaeger:14268", JaegerSampleRate: 0.5}); err == nil {
+		t.Error("Expected an endpoint without scheme to be rejected")
+	}
+}
+
+func TestTraceBuilds(t *testing.T) {
+	var mutex sync.Mutex
+	var received []string
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mutex.Lock()
+		received = append(received, string(body))
+		mutex.Unlock()
+	}))
+	defer collector.Close()
+
+	monitor := NewMonitor(&MonitorConfig{})
+	monitor.tracer, _ = newTracer(&MonitorConfig{EnableJaeger: true, JaegerEndpoint: collector.URL + "/v1/traces"})
+	monitor.recordEvent(events.Event{Type: events.BuildFinished, BuildID: "build-1", TaskName: "assemble", Timestamp: time.Now(), Status: "failed", Duration: time.Minute, ErrorMessage: "compilation failed"})
+	monitor.tracer.Close()
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(received) != 1 {
+		t.Fatalf("Expected one export, got %v", received)
+	}
+	for _, expected := range []string{`"name":"build assemble"`, `"stringValue":"build-1"`, `"message":"compilation failed"`, `"stringValue":"monitor"`} {
+		if !strings.Contains(received[0], expected) {
+			t.Errorf("Expected %s in the exported spans, got %s", expected, received[0])
+		}
+	}
+}
+
+func TestMetricsHistory(t *testing.T) {
+	config := &MonitorConfig{DataDir: t.TempDir(), RetentionDays: 7}
+	monitor := NewMonitor(config)
+	history, err := openHistory(config)
+	if err != nil {
+		t.Fatalf("openHistory failed: %v", err)
+	}
+	monitor.history = history
+
+	now := time.Now().UTC().Truncate(time.Minute)
+	monitor.recordEvent(events.Event{Type: events.BuildFinished, BuildID: "build-1", Timestamp: now.Add(-2 * time.Minute), Status: "completed", Duration: time.Minute, CacheHitRate: 1})
+	monitor.recordEvent(events.Event{Type: events.BuildFinished, BuildID: "build-2", Timestamp: now.Add(-time.Minute), Status: "failed", Duration: 3 * time.Minute})
+	history.Close()
+
+	query := func(url string) (*httptest.ResponseRecorder, MetricsRange) {
+		w := httptest.NewRecorder()
+		monitor.apiMetricsHandler(w, httptest.NewRequest("GET", url, nil))
+		var response MetricsRange
+		json.Unmarshal(w.Body.Bytes(), &response)
+		return w, response
+	}
+
+	w, response := query("/api/metrics?series=build_duration_seconds")
+	if w.Code != http.StatusOK || len(response.Points) != 2 || response.Points[0].Value != 60 || response.Points[1].Value != 180 {
+		t.Fatalf("Expected the durations of both builds, got %d %s", w.Code, w.Body.String())
+	}
+	_, response = query("/api/metrics?series=build_success&from=" + now.Add(-time.Hour).Format(time.RFC3339) + "&to=" + now.Format(time.RFC3339) + "&step=1h")
+	if len(response.Points) != 1 || response.Points[0].Value != 0.5 || response.Points[0].Count != 2 || response.Step != "1h0m0s" {
+		t.Errorf("Expected the success rate of the hour, got %+v", response)
+	}
+	for _, invalid := range []string{"series=unknown", "series=build_success&step=0", "series=build_success&from=yesterday", "series=build_success&from=" + now.Format(time.RFC3339) + "&to=" + now.Add(-time.Hour).Format(time.RFC3339)} {
+		if w, _ := query("/api/metrics?" + invalid); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected %s to be rejected, got %d", invalid, w.Code)
+		}
+	}
+	w = httptest.NewRecorder()
+	NewMonitor(config).apiMetricsHandler(w, httptest.NewRequest("GET", "/api/metrics?series=build_success", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected range queries to be unavailable without a history, got %d", w.Code)
+	}
+
+	// The totals survive a restart
+	restarted := NewMonitor(config)
+	restarted.history, _ = openHistory(config)
+	defer restarted.history.Close()
+	if err := restarted.restoreTotals(now); err != nil {
+		t.Fatalf("restoreTotals failed: %v", err)
+	}
+	if totals := restarted.totals; totals.TotalBuilds != 2 || totals.SuccessfulBuilds != 1 || totals.FailedBuilds != 1 || totals.AverageBuildTime != 120 || totals.CacheHitRate != 0.5 {
+		t.Errorf("Expected the totals of the stored builds, got %+v", totals)
+	}
+}
+
+func TestAlerts(t *testing.T) {
+	config := &MonitorConfig{DataDir: t.TempDir(), AlertRules: []alerting.Rule{
+		{Name: "failing-builds", Metric: "build_success", Operator: "<", Threshold: 0.5, Window: "1h", Severity: alerting.SeverityCritical},
+	}}
+	monitor := NewMonitor(config)
+	monitor.history, _ = openHistory(config)
+	defer monitor.history.Close()
+	var err error
+	if monitor.alerts, err = monitor.newAlerting(); err != nil {
+		t.Fatalf("newAlerting failed: %v", err)
+	}
+	if _, err := NewMonitor(&MonitorConfig{AlertRules: []alerting.Rule{{Name: "cpu", Metric: "cpu_usage", Operator: ">", Severity: alerting.SeverityWarning}}}).newAlerting(); err == nil {
+		t.Error("Expected a rule of an unknown metric to be rejected")
+	}
+
+	now := time.Now()
+	monitor.recordEvent(events.Event{Type: events.BuildFinished, BuildID: "build-1", Timestamp: now.Add(-time.Minute), Status: "failed"})
+	monitor.alerts.Evaluate(now)
+
+	server := httptest.NewServer(monitor.routes())
+	defer server.Close()
+	var alerts []alerting.Alert
+	resp, err := http.Get(server.URL + "/api/alerts?state=firing")
+	if err != nil {
+		t.Fatalf("Failed to list alerts: %v", err)
+	}
+	json.NewDecoder(resp.Body).Decode(&alerts)
+	resp.Body.Close()
+	if len(alerts) != 1 || alerts[0].Rule != "failing-builds" || alerts[0].SilencedBy != "" {
+		t.Fatalf("Expected the failing builds alert, got %+v", alerts)
+	}
+
+	resp, _ = http.Post(server.URL+"/api/silences", "application/json", strings.NewReader(`{"rule": "failing-builds", "duration": "1h", "comment": "known outage"}`))
+	var silence alerting.Silence
+	json.NewDecoder(resp.Body).Decode(&silence)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated || silence.ID == "" {
+		t.Fatalf("Expected the silence to be created, got %d %+v", resp.StatusCode, silence)
+	}
+	if resp, _ := http.Post(server.URL+"/api/silences", "application/json", strings.NewReader(`{"rule": "failing-builds"}`)); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected a silence without duration to be rejected, got %d", resp.StatusCode)
+	}
+
+	resp, _ = http.Get(server.URL + "/api/alerts")
+	json.NewDecoder(resp.Body).Decode(&alerts)
+	resp.Body.Close()
+	if len(alerts) != 1 || alerts[0].SilencedBy != silence.ID {
+		t.Errorf("Expected the alert to be silenced, got %+v", alerts)
+	}
+
+	request, _ := http.NewRequest("DELETE", server.URL+"/api/silences/"+silence.ID, nil)
+	if resp, _ := http.DefaultClient.Do(request); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("Expected the silence to be expired, got %d", resp.StatusCode)
+	}
+	if resp, _ := http.DefaultClient.Do(request); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected an expired silence not to be found, got %d", resp.StatusCode)
+	}
+}
+
+func TestSLO(t *testing.T) {
+	config := &MonitorConfig{DataDir: t.TempDir(), SLOs: []SLO{
+		{Name: "app-success", Project: "/projects/app", Type: sloSuccess, Objective: 0.99, WindowDays: 7},
+		{Name: "fast-builds", Type: sloDuration, Objective: 0.9, Threshold: "10m"},
+	}}
+	if err := validateSLOs(config); err != nil {
+		t.Fatalf("Expected the SLOs to be valid, got %v", err)
+	}
+	monitor := NewMonitor(config)
+	monitor.history, _ = openHistory(config)
+	defer monitor.history.Close()
+	var err error
+	if monitor.alerts, err = monitor.newAlerting(); err != nil {
+		t.Fatalf("newAlerting failed: %v", err)
+	}
+
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		status := "completed"
+		if i < 2 {
+			status = "failed"
+		}
+		monitor.recordEvent(events.Event{Type: events.BuildFinished, BuildID: fmt.Sprintf("build-%d", i), ProjectPath: "/projects/app", Timestamp: now.Add(-time.Duration(i+1) * time.Minute), Status: status, Duration: time.Minute})
+	}
+	monitor.recordEvent(events.Event{Type: events.BuildFinished, BuildID: "build-slow", ProjectPath: "/projects/web", Timestamp: now.Add(-time.Minute), Status: "completed", Duration: 20 * time.Minute})
+
+	server := httptest.NewServer(monitor.routes())
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/api/slo")
+	if err != nil {
+		t.Fatalf("Failed to get SLOs: %v", err)
+	}
+	var statuses []SLOStatus
+	json.NewDecoder(resp.Body).Decode(&statuses)
+	resp.Body.Close()
+	if len(statuses) != 2 {
+		t.Fatalf("Expected the status of both SLOs, got %+v", statuses)
+	}
+
+	success := statuses[0]
+	if success.Builds != 10 || success.GoodBuilds != 8 || success.Met || math.Abs(success.BudgetRemaining+19) > 1e-9 || math.Abs(success.BurnRates["1h0m0s"]-20) > 1e-9 {
+		t.Errorf("Expected the failed builds of the project to exceed the budget 20 times, got %+v", success)
+	}
+	duration := statuses[1]
+	if duration.Builds != 11 || duration.GoodBuilds != 10 || !duration.Met || duration.Attainment != 10.0/11 {
+		t.Errorf("Expected the slow build to be within the budget, got %+v", duration)
+	}
+
+	// The budget of the project burns too fast
+	monitor.alerts.Evaluate(now)
+	changes, _ := monitor.alerts.Evaluate(now.Add(6 * time.Minute))
+	if !slices.ContainsFunc(changes, func(alert alerting.Alert) bool {
+		return alert.Rule == "app-success:fast-burn" && alert.State == alerting.StateFiring && alert.Severity == alerting.SeverityCritical
+	}) || slices.ContainsFunc(changes, func(alert alerting.Alert) bool { return strings.HasPrefix(alert.Rule, "fast-builds:") }) {
+		t.Errorf("Expected only the fast burn alert of the project to fire, got %+v", changes)
+	}
+
+	// History queries include the series of the SLOs
+	if resp, _ := http.Get(server.URL + "/api/metrics?series=slo:fast-builds"); resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected the series of an SLO to be queried, got %d", resp.StatusCode)
+	}
+
+	for _, invalid := range []SLO{
+		{Name: "objective", Type: sloSuccess, Objective: 99},
+		{Name: "type", Type: "latency", Objective: 0.9},
+		{Name: "threshold", Type: sloDuration, Objective: 0.9},
+		{Name: "window", Type: sloSuccess, Objective: 0.9, WindowDays: 90},
+		{Type: sloSuccess, Objective: 0.9},
+	} {
+		if err := validateSLOs(&MonitorConfig{SLOs: []SLO{invalid}}); err == nil {
+			t.Errorf("Expected SLO %+v to be rejected", invalid)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"distributed-gradle-building/alerting"
+	"distributed-gradle-building/openapi"
+	"distributed-gradle-building/tracing"
+)
+
+// monitorOpenAPI describes the monitor HTTP API
+func monitorOpenAPI() *openapi.Document {
+	doc := openapi.New("Distributed Gradle Building Monitor API", "1.0.0",
+		"System monitoring and metrics")
+
+	doc.Add(openapi.Route{
+		Method:      "GET",
+		Path:        "/health",
+		Summary:     "Check monitor health",
+		OperationID: "healthCheck",
+		Response:    HealthStatus{},
+	})
+	doc.Add(openapi.Route{
+		Method:      "GET",
+		Path:        "/metrics",
+		Summary:     "Get basic service metrics",
+		OperationID: "getServiceMetrics",
+		Response:    ServiceMetrics{},
+	})
+	doc.Add(openapi.Route{
+		Method:      "GET",
+		Path:        "/api/metrics",
+		Summary:     "Get worker, build and system metrics, or with series the stored history of a series as a MetricsRange",
+		OperationID: "getMetrics",
+		Parameters: []openapi.Parameter{
+			openapi.QueryParam("series", "string", "", "Series to query: build_duration_seconds, build_success, build_cache_hit_rate or slo:<name> of an SLO"),
+			openapi.QueryParam("from", "string", "date-time", "Start of the range (default 24 hours before to)"),
+			openapi.QueryParam("to", "string", "date-time", "End of the range, excluded (default now)"),
+			openapi.QueryParam("step", "string", "", "Aggregate the points per step, such as 5m (default: every stored point)"),
+		},
+		Response: MetricsReport{},
+	})
+	doc.Add(openapi.Route{
+		Method:      "GET",
+		Path:        "/api/slo",
+		Summary:     "Report the attainment, error budget and burn rates of the SLOs",
+		OperationID: "listSLOs",
+		Response:    []SLOStatus{},
+	})
+	doc.Add(openapi.Route{
+		Method:      "GET",
+		Path:        "/api/alerts",
+		Summary:     "List the pending, firing and recently resolved alerts of the alert rules",
+		OperationID: "listAlerts",
+		Parameters:  []openapi.Parameter{openapi.QueryParam("state", "string", "", "Only alerts in this state: pending, firing or resolved")},
+		Response:    []alerting.Alert{},
+	})
+	doc.Add(openapi.Route{
+		Method:      "GET",
+		Path:        "/api/silences",
+		Summary:     "List the silences in effect",
+		OperationID: "listSilences",
+		Response:    []alerting.Silence{},
+	})
+	doc.Add(openapi.Route{
+		Method:      "POST",
+		Path:        "/api/silences",
+		Summary:     "Silence the alerts of a rule, of a severity, or of both for a duration",
+		OperationID: "createSilence",
+		Request:     SilenceRequest{},
+		Response:    alerting.Silence{},
+	})
+	doc.Add(openapi.Route{
+		Method:      "DELETE",
+		Path:        "/api/silences/{id}",
+		Summary:     "End a silence",
+		OperationID: "expireSilence",
+		Parameters:  []openapi.Parameter{openapi.PathParam("id", "Silence ID")},
+	})
+	doc.Add(tracing.Route())
+
+	return doc
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"time"
+
+	"distributed-gradle-building/alerting"
+	"distributed-gradle-building/events"
+	"distributed-gradle-building/tsdb"
+)
+
+// SLO types
+const (
+	// sloSuccess counts the completed builds as good
+	sloSuccess = "success"
+	// sloDuration counts the builds finished within the threshold as good
+	sloDuration = "duration"
+)
+
+// Burn rates, as multiples of the rate spending the error budget exactly
+// over the SLO window, from which burn rate alerts fire. A fast burn spends
+// 2% of a 30 day budget in an hour, a slow burn 5% in 6 hours.
+const (
+	fastBurnRate   = 14.4
+	fastBurnWindow = time.Hour
+	slowBurnRate   = 6
+	slowBurnWindow = 6 * time.Hour
+)
+
+// defaultSLOWindowDays is the window of an SLO without window_days
+const defaultSLOWindowDays = 30
+
+// SLO is a service level objective: Objective of the finished builds of
+// Project, or of all projects without one, are good over the last
+// WindowDays
+type SLO struct {
+	Name      string  `json:"name"`
+	Project   string  `json:"project,omitempty"`
+	Type      string  `json:"type"`
+	Objective float64 `json:"objective"`
+	// Threshold is the duration, such as 10m, builds of a duration SLO
+	// finish within
+	Threshold  string `json:"threshold,omitempty"`
+	WindowDays int    `json:"window_days,omitempty"`
+}
+
+// SLOStatus reports how an SLO is met
+type SLOStatus struct {
+	SLO
+	Builds     int `json:"builds"`
+	GoodBuilds int `json:"good_builds"`
+	// Attainment is the fraction of good builds, 1 without builds
+	Attainment float64 `json:"attainment"`
+	Met        bool    `json:"met"`
+	// ErrorBudget is the fraction of builds allowed to be bad, and
+	// BudgetRemaining the fraction of it left, negative once exceeded
+	ErrorBudget     float64 `json:"error_budget"`
+	BudgetRemaining float64 `json:"budget_remaining"`
+	// BurnRates are the rates the budget was spent at over the last hour
+	// and 6 hours, as multiples of the rate spending it over the window
+	BurnRates map[string]float64 `json:"burn_rates"`
+}
+
+// series returns the series recording whether each build was good
+func (s SLO) series() string {
+	return "slo:" + s.Name
+}
+
+// window returns the window of the SLO
+func (s SLO) window() time.Duration {
+	days := s.WindowDays
+	if days == 0 {
+		days = defaultSLOWindowDays
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// good reports whether a finished build meets the SLO
+func (s SLO) good(event events.Event) bool {
+	if s.Type == sloDuration {
+		threshold, _ := time.ParseDuration(s.Threshold)
+		return event.Duration <= threshold
+	}
+	return event.Status == "completed"
+}
+
+// burnRules returns the alert rules firing when the error budget is spent
+// at the fast or slow burn rate. The budget allows 1 - Objective of the
+// builds to be bad, so it burns at a rate once the mean of the series drops
+// below 1 minus the rate times the budget.
+func (s SLO) burnRules() []alerting.Rule {
+	budget := 1 - s.Objective
+	return []alerting.Rule{
+		{
+			Name:        s.Name + ":fast-burn",
+			Metric:      s.series(),
+			Operator:    "<",
+			Threshold:   1 - fastBurnRate*budget,
+			Window:      fastBurnWindow.String(),
+			For:         "5m",
+			Severity:    alerting.SeverityCritical,
+			Description: fmt.Sprintf("Error budget of SLO %s burning %gx too fast", s.Name, float64(fastBurnRate)),
+		},
+		{
+			Name:        s.Name + ":slow-burn",
+			Metric:      s.series(),
+			Operator:    "<",
+			Threshold:   1 - slowBurnRate*budget,
+			Window:      slowBurnWindow.String(),
+			For:         "30m",
+			Severity:    alerting.SeverityWarning,
+			Description: fmt.Sprintf("Error budget of SLO %s burning %gx too fast", s.Name, float64(slowBurnRate)),
+		},
+	}
+}
+
+// validateSLOs checks the configured SLOs. Their windows must fit into the
+// retention of the metrics history.
+func validateSLOs(config *MonitorConfig) error {
+	retention := config.RetentionDays
+	if retention == 0 {
+		retention = tsdb.DefaultRetentionDays
+	}
+	for i, slo := range config.SLOs {
+		if slo.Name == "" {
+			return fmt.Errorf("SLO has no name")
+		}
+		if slices.ContainsFunc(config.SLOs[:i], func(other SLO) bool { return other.Name == slo.Name }) {
+			return fmt.Errorf("duplicate SLO %s", slo.Name)
+		}
+		if slo.Objective <= 0 || slo.Objective >= 1 {
+			return fmt.Errorf("SLO %s has objective %g, expected a fraction between 0 and 1", slo.Name, slo.Objective)
+		}
+		if slo.WindowDays < 0 || slo.WindowDays > retention {
+			return fmt.Errorf("SLO %s has window_days %d beyond the retention of %d days", slo.Name, slo.WindowDays, retention)
+		}
+		switch slo.Type {
+		case sloSuccess:
+			if slo.Threshold != "" {
+				return fmt.Errorf("SLO %s of type %s has a threshold", slo.Name, slo.Type)
+			}
+		case sloDuration:
+			if threshold, err := time.ParseDuration(slo.Threshold); err != nil || threshold <= 0 {
+				return fmt.Errorf("SLO %s has invalid threshold %q", slo.Name, slo.Threshold)
+			}
+		default:
+			return fmt.Errorf("SLO %s has unknown type %q, expected %s or %s", slo.Name, slo.Type, sloSuccess, sloDuration)
+		}
+	}
+	return nil
+}
+
+// recordSLOs appends whether a finished build was good to the series of
+// the SLOs of its project
+func (m *Monitor) recordSLOs(event events.Event, at time.Time) {
+	for _, slo := range m.config.SLOs {
+		if slo.Project != "" && slo.Project != event.ProjectPath {
+			continue
+		}
+		good := 0.0
+		if slo.good(event) {
+			good = 1
+		}
+		m.appendHistory(slo.series(), at, good, event.BuildID)
+	}
+}
+
+// sloStatus computes how an SLO is met at now
+func (m *Monitor) sloStatus(slo SLO, now time.Time) (SLOStatus, error) {
+	status := SLOStatus{SLO: slo, Attainment: 1, ErrorBudget: 1 - slo.Objective, BudgetRemaining: 1, BurnRates: make(map[string]float64)}
+
+	for _, window := range []time.Duration{fastBurnWindow, slowBurnWindow, slo.window()} {
+		points, err := m.history.Query(slo.series(), now.Add(-window), now, 0)
+		if err != nil {
+			return status, err
+		}
+		var builds int
+		var good float64
+		for _, point := range points {
+			builds += point.Count
+			good += point.Sum()
+		}
+		var errorRate float64
+		if builds > 0 {
+			errorRate = 1 - good/float64(builds)
+		}
+
+		if window == slo.window() {
+			status.Builds = builds
+			status.GoodBuilds = int(math.Round(good))
+			status.Attainment = 1 - errorRate
+			status.BudgetRemaining = 1 - errorRate/status.ErrorBudget
+			continue
+		}
+		status.BurnRates[window.String()] = errorRate / status.ErrorBudget
+	}
+	status.Met = status.Attainment >= slo.Objective
+	return status, nil
+}
+
+// handleSLO reports how the configured SLOs are met
+func (m *Monitor) handleSLO(w http.ResponseWriter, r *http.Request) {
+	if m.history == nil {
+		http.Error(w, "Metrics history is not enabled", http.StatusServiceUnavailable)
+		return
+	}
+
+	statuses := make([]SLOStatus, 0, len(m.config.SLOs))
+	now := time.Now()
+	for _, slo := range m.config.SLOs {
+		status, err := m.sloStatus(slo, now)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		statuses = append(statuses, status)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(statuses)
+}
@@ -25,6 +25,9 @@ type Monitor struct {
 	mutex      sync.RWMutex
 	httpServer *http.Server
 	shutdown   chan struct{}
+
+	// lastMLAnomaly is the timestamp of the newest ML anomaly already alerted on
+	lastMLAnomaly time.Time
 }
 
 // SystemMetrics contains overall system metrics
@@ -308,6 +311,37 @@ func (m *Monitor) detectAnomalies() {
 		m.TriggerAlert("resource_usage_anomaly", "critical",
 			"System resource usage anomaly detected: high CPU/memory consumption", nil)
 	}
+
+	// Anomaly 6: Statistical anomalies detected by the ML service
+	m.collectMLAnomalies()
+}
+
+// collectMLAnomalies raises alerts for anomalies reported by the ML service
+func (m *Monitor) collectMLAnomalies() {
+	if m.MLService == nil {
+		return
+	}
+
+	m.mutex.RLock()
+	since := m.lastMLAnomaly
+	m.mutex.RUnlock()
+
+	for _, anomaly := range m.MLService.GetAnomalies(since) {
+		m.TriggerAlert(anomaly.Type+"_anomaly", anomaly.Severity, anomaly.Message,
+			map[string]any{
+				"anomaly_id": anomaly.ID,
+				"subject":    anomaly.Subject,
+				"value":      anomaly.Value,
+				"mean":       anomaly.Mean,
+				"z_score":    anomaly.ZScore,
+			})
+
+		m.mutex.Lock()
+		if anomaly.Timestamp.After(m.lastMLAnomaly) {
+			m.lastMLAnomaly = anomaly.Timestamp
+		}
+		m.mutex.Unlock()
+	}
 }
 
 // detectBuildTimeAnomaly detects anomalies in build times
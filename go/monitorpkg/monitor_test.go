@@ -7,6 +7,7 @@ import (
 	"testing"
 	"time"
 
+	"distributed-gradle-building/ml/service"
 	"distributed-gradle-building/types"
 )
 
@@ -678,3 +679,41 @@ func TestShutdown(t *testing.T) {
 		t.Errorf("Shutdown failed: %v", err)
 	}
 }
+
+func TestCollectMLAnomalies(t *testing.T) {
+	config := types.MonitorConfig{}
+	monitor := NewMonitor(config)
+	now := time.Now()
+
+	for i := 0; i < 15; i++ {
+		monitor.MLService.RecordWorkerMetrics(service.WorkerMetric{
+			WorkerID:     "worker-1",
+			Timestamp:    now.Add(time.Duration(i) * time.Second),
+			ResponseTime: 100 * time.Millisecond,
+		})
+	}
+	monitor.MLService.RecordWorkerMetrics(service.WorkerMetric{
+		WorkerID:     "worker-1",
+		Timestamp:    now.Add(time.Minute),
+		ResponseTime: 3 * time.Second,
+	})
+
+	monitor.collectMLAnomalies()
+
+	alerts := monitor.GetAlerts()
+	if len(alerts) != 1 {
+		t.Fatalf("Expected 1 alert, got %d", len(alerts))
+	}
+	if alerts[0].Type != "worker_response_time_anomaly" {
+		t.Errorf("Expected worker_response_time_anomaly alert, got %s", alerts[0].Type)
+	}
+	if alerts[0].Data["subject"] != "worker-1" {
+		t.Errorf("Expected alert subject worker-1, got %v", alerts[0].Data["subject"])
+	}
+
+	// Anomalies already alerted on are not raised again
+	monitor.collectMLAnomalies()
+	if len(monitor.GetAlerts()) != 1 {
+		t.Errorf("Expected anomalies to be alerted once, got %d alerts", len(monitor.GetAlerts()))
+	}
+}
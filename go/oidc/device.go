@@ -0,0 +1,87 @@
+package oidc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// DeviceCode is the response of a device authorization request. The user
+// opens VerificationURI and enters UserCode while the CLI polls for tokens.
+type DeviceCode struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete,omitempty"`
+	// VerificationURL is what Google calls VerificationURI
+	VerificationURL string `json:"verification_url,omitempty"`
+	ExpiresIn       int    `json:"expires_in"`
+	Interval        int    `json:"interval,omitempty"`
+}
+
+// RequestDeviceCode starts a device authorization flow for a public client
+func RequestDeviceCode(ctx context.Context, client *http.Client, metadata *Metadata, clientID string, scopes []string) (*DeviceCode, error) {
+	if metadata.DeviceAuthorizationEndpoint == "" {
+		return nil, fmt.Errorf("identity provider %s does not support device login", metadata.Issuer)
+	}
+
+	form := url.Values{"client_id": {clientID}, "scope": {strings.Join(scopes, " ")}}
+	var code DeviceCode
+	if err := postForm(ctx, client, metadata.DeviceAuthorizationEndpoint, form, &code); err != nil {
+		return nil, fmt.Errorf("device authorization failed: %v", err)
+	}
+	if code.VerificationURI == "" {
+		code.VerificationURI = code.VerificationURL
+	}
+	if code.VerificationURI == "" {
+		return nil, fmt.Errorf("device authorization returned no verification URI")
+	}
+	return &code, nil
+}
+
+// PollDeviceToken polls the token endpoint until the user approved or denied
+// the login, or the device code expired
+func PollDeviceToken(ctx context.Context, client *http.Client, metadata *Metadata, clientID string, code *DeviceCode) (*Tokens, error) {
+	interval := time.Duration(code.Interval) * time.Second
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	if code.ExpiresIn > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(code.ExpiresIn)*time.Second)
+		defer cancel()
+	}
+
+	form := url.Values{
+		"grant_type":  {"urn:ietf:params:oauth:grant-type:device_code"},
+		"device_code": {code.DeviceCode},
+		"client_id":   {clientID},
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("login was not approved in time")
+		case <-time.After(interval):
+		}
+
+		var tokens Tokens
+		err := postForm(ctx, client, metadata.TokenEndpoint, form, &tokens)
+		var oauthErr *Error
+		switch {
+		case err == nil:
+			if tokens.IDToken == "" {
+				return nil, fmt.Errorf("device login returned no ID token")
+			}
+			return &tokens, nil
+		case errors.As(err, &oauthErr) && oauthErr.Code == "authorization_pending":
+		case errors.As(err, &oauthErr) && oauthErr.Code == "slow_down":
+			interval += 5 * time.Second
+		default:
+			return nil, fmt.Errorf("device login failed: %v", err)
+		}
+	}
+}
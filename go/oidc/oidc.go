@@ -0,0 +1,512 @@
+// Package oidc signs users in with an OpenID Connect identity provider such
+// as Okta, Google or Keycloak. The coordinator runs the authorization code
+// flow with PKCE for the dashboard and verifies the ID tokens the CLI obtains
+// with the device authorization flow, then maps the user's IdP groups to the
+// roles its authorization policy is written against.
+package oidc
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// Config is an OIDC client registered with the identity provider
+type Config struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// RedirectURL is the coordinator's /auth/callback as registered with
+	// the identity provider
+	RedirectURL string
+	// CLIClientID is the public client the CLI logs in with using the
+	// device flow, ClientID unless the provider requires a separate one
+	CLIClientID string
+	Scopes      []string
+	// GroupsClaim is the ID token claim listing the user's groups. Nested
+	// claims are separated by dots, such as realm_access.roles for Keycloak.
+	GroupsClaim string
+	// Roles maps groups to roles. Users in none of the groups get
+	// DefaultRole, or cannot log in when it is empty.
+	Roles       map[string]string
+	DefaultRole string
+}
+
+// DefaultScopes are requested unless OIDC_SCOPES is set
+var DefaultScopes = []string{"openid", "profile", "email"}
+
+// ConfigFromEnv reads the client from OIDC_ISSUER, OIDC_CLIENT_ID,
+// OIDC_CLIENT_SECRET, OIDC_REDIRECT_URL, OIDC_CLI_CLIENT_ID, OIDC_SCOPES,
+// OIDC_GROUPS_CLAIM, OIDC_ROLE_MAPPINGS and OIDC_DEFAULT_ROLE. It returns nil
+// when OIDC_ISSUER is not set.
+func ConfigFromEnv() (*Config, error) {
+	issuer := strings.TrimSuffix(os.Getenv("OIDC_ISSUER"), "/")
+	if issuer == "" {
+		return nil, nil
+	}
+
+	config := &Config{
+		Issuer:       issuer,
+		ClientID:     os.Getenv("OIDC_CLIENT_ID"),
+		ClientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+		RedirectURL:  os.Getenv("OIDC_REDIRECT_URL"),
+		CLIClientID:  os.Getenv("OIDC_CLI_CLIENT_ID"),
+		Scopes:       DefaultScopes,
+		GroupsClaim:  "groups",
+		DefaultRole:  os.Getenv("OIDC_DEFAULT_ROLE"),
+	}
+	if config.ClientID == "" {
+		return nil, fmt.Errorf("OIDC_CLIENT_ID is required with OIDC_ISSUER")
+	}
+	if config.RedirectURL == "" {
+		return nil, fmt.Errorf("OIDC_REDIRECT_URL is required with OIDC_ISSUER")
+	}
+	if config.CLIClientID == "" {
+		config.CLIClientID = config.ClientID
+	}
+	if value := os.Getenv("OIDC_SCOPES"); value != "" {
+		config.Scopes = strings.Fields(strings.ReplaceAll(value, ",", " "))
+		if !slices.Contains(config.Scopes, "openid") {
+			config.Scopes = append([]string{"openid"}, config.Scopes...)
+		}
+	}
+	if value := os.Getenv("OIDC_GROUPS_CLAIM"); value != "" {
+		config.GroupsClaim = value
+	}
+	if value := os.Getenv("OIDC_ROLE_MAPPINGS"); value != "" {
+		if err := json.Unmarshal([]byte(value), &config.Roles); err != nil {
+			return nil, fmt.Errorf("invalid OIDC_ROLE_MAPPINGS: %v", err)
+		}
+	}
+	return config, nil
+}
+
+// Role returns the role of a user in groups: the first group, in the order
+// they are listed, with a mapped role, or the default role
+func (c Config) Role(groups []string) (string, error) {
+	for _, group := range groups {
+		if role, exists := c.Roles[group]; exists {
+			return role, nil
+		}
+	}
+	if c.DefaultRole != "" {
+		return c.DefaultRole, nil
+	}
+	return "", fmt.Errorf("none of the groups %v is mapped to a role", groups)
+}
+
+// Metadata is the discovery document of an identity provider
+type Metadata struct {
+	Issuer                      string `json:"issuer"`
+	AuthorizationEndpoint       string `json:"authorization_endpoint"`
+	TokenEndpoint               string `json:"token_endpoint"`
+	JWKSURI                     string `json:"jwks_uri"`
+	DeviceAuthorizationEndpoint string `json:"device_authorization_endpoint,omitempty"`
+}
+
+// Discover fetches the discovery document of an issuer
+func Discover(ctx context.Context, client *http.Client, issuer string) (*Metadata, error) {
+	var metadata Metadata
+	if err := getJSON(ctx, client, strings.TrimSuffix(issuer, "/")+"/.well-known/openid-configuration", &metadata); err != nil {
+		return nil, fmt.Errorf("OIDC discovery failed: %v", err)
+	}
+	if metadata.Issuer != strings.TrimSuffix(issuer, "/") {
+		return nil, fmt.Errorf("OIDC discovery returned issuer %q instead of %q", metadata.Issuer, issuer)
+	}
+	return &metadata, nil
+}
+
+// Tokens is the token endpoint response
+type Tokens struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	IDToken      string `json:"id_token"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	ExpiresIn    int    `json:"expires_in,omitempty"`
+}
+
+// Identity is the user an ID token was issued for
+type Identity struct {
+	Subject string   `json:"sub"`
+	Email   string   `json:"email,omitempty"`
+	Name    string   `json:"name,omitempty"`
+	Groups  []string `json:"groups,omitempty"`
+}
+
+// User identifies the user to the coordinator: the email, or the subject
+// when the provider does not share it
+func (i Identity) User() string {
+	if i.Email != "" {
+		return i.Email
+	}
+	return i.Subject
+}
+
+// Provider is an identity provider. Its discovery document and signing keys
+// are fetched on first use, so the coordinator starts while it is down.
+type Provider struct {
+	config Config
+	client *http.Client
+
+	mutex    sync.Mutex
+	metadata *Metadata
+	keys     map[string]any
+	// keysFetched limits how often unknown key IDs refetch the keys
+	keysFetched time.Time
+}
+
+// NewProvider creates a provider for a client. Groups are read from the
+// groups claim unless the configuration names another.
+func NewProvider(config Config) *Provider {
+	if config.GroupsClaim == "" {
+		config.GroupsClaim = "groups"
+	}
+	if config.CLIClientID == "" {
+		config.CLIClientID = config.ClientID
+	}
+	return &Provider{config: config, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// Config returns the client configuration
+func (p *Provider) Config() Config {
+	return p.config
+}
+
+// Metadata returns the discovery document of the provider
+func (p *Provider) Metadata(ctx context.Context) (*Metadata, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.metadata == nil {
+		metadata, err := Discover(ctx, p.client, p.config.Issuer)
+		if err != nil {
+			return nil, err
+		}
+		p.metadata = metadata
+	}
+	return p.metadata, nil
+}
+
+// AuthCodeURL returns the URL the browser is sent to for logging in. The
+// challenge of verifier is sent for PKCE.
+func (p *Provider) AuthCodeURL(ctx context.Context, state, nonce, verifier string) (string, error) {
+	metadata, err := p.Metadata(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.config.ClientID},
+		"redirect_uri":          {p.config.RedirectURL},
+		"scope":                 {strings.Join(p.config.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {Challenge(verifier)},
+		"code_challenge_method": {"S256"},
+	}
+	separator := "?"
+	if strings.Contains(metadata.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return metadata.AuthorizationEndpoint + separator + query.Encode(), nil
+}
+
+// Exchange redeems the code the provider redirected back with
+func (p *Provider) Exchange(ctx context.Context, code, verifier string) (*Tokens, error) {
+	metadata, err := p.Metadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.config.RedirectURL},
+		"client_id":     {p.config.ClientID},
+		"code_verifier": {verifier},
+	}
+	if p.config.ClientSecret != "" {
+		form.Set("client_secret", p.config.ClientSecret)
+	}
+	var tokens Tokens
+	if err := postForm(ctx, p.client, metadata.TokenEndpoint, form, &tokens); err != nil {
+		return nil, fmt.Errorf("code exchange failed: %v", err)
+	}
+	if tokens.IDToken == "" {
+		return nil, fmt.Errorf("code exchange returned no ID token")
+	}
+	return &tokens, nil
+}
+
+// Verify checks the signature, issuer, audience and expiry of an ID token,
+// and its nonce unless empty, and returns the user it was issued for. The
+// audience must be one of the client IDs of the configuration.
+func (p *Provider) Verify(ctx context.Context, rawIDToken, nonce string) (*Identity, error) {
+	metadata, err := p.Metadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	claims := jwt.MapClaims{}
+	_, err = jwt.ParseWithClaims(rawIDToken, claims, func(token *jwt.Token) (any, error) {
+		switch token.Method.(type) {
+		case *jwt.SigningMethodRSA, *jwt.SigningMethodECDSA:
+		default:
+			return nil, fmt.Errorf("unexpected signing method %v", token.Header["alg"])
+		}
+		kid, _ := token.Header["kid"].(string)
+		return p.key(ctx, metadata, kid)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid ID token: %v", err)
+	}
+
+	if issuer, _ := claims["iss"].(string); issuer != metadata.Issuer {
+		return nil, fmt.Errorf("ID token issued by %q instead of %q", issuer, metadata.Issuer)
+	}
+	if _, exists := claims["exp"]; !exists {
+		return nil, fmt.Errorf("ID token does not expire")
+	}
+	if !audienceMatches(claims["aud"], p.config.ClientID, p.config.CLIClientID) {
+		return nil, fmt.Errorf("ID token was issued for another client")
+	}
+	if tokenNonce, _ := claims["nonce"].(string); nonce != "" && tokenNonce != nonce {
+		return nil, fmt.Errorf("ID token nonce does not match the login")
+	}
+
+	identity := &Identity{Groups: stringList(claim(map[string]any(claims), p.config.GroupsClaim))}
+	identity.Subject, _ = claims["sub"].(string)
+	identity.Email, _ = claims["email"].(string)
+	identity.Name, _ = claims["name"].(string)
+	if identity.Subject == "" {
+		return nil, fmt.Errorf("ID token has no subject")
+	}
+	return identity, nil
+}
+
+// key returns the signing key with an ID, refetching the provider's keys
+// when it is unknown, as providers rotate them
+func (p *Provider) key(ctx context.Context, metadata *Metadata, kid string) (any, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if key, exists := p.keys[kid]; exists {
+		return key, nil
+	}
+	if time.Since(p.keysFetched) < 10*time.Second {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+
+	keys, err := fetchKeys(ctx, p.client, metadata.JWKSURI)
+	p.keysFetched = time.Now()
+	if err != nil {
+		return nil, err
+	}
+	p.keys = keys
+	if key, exists := keys[kid]; exists {
+		return key, nil
+	}
+	// Providers with a single key may leave out key IDs
+	if len(keys) == 1 && kid == "" {
+		for _, key := range keys {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// jsonWebKey is a public key of a JWK set
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// fetchKeys fetches the RSA and EC signing keys of a JWK set by key ID.
+// Keys of other types are skipped.
+func fetchKeys(ctx context.Context, client *http.Client, uri string) (map[string]any, error) {
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := getJSON(ctx, client, uri, &set); err != nil {
+		return nil, fmt.Errorf("failed to fetch signing keys: %v", err)
+	}
+
+	keys := make(map[string]any)
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		switch jwk.Kty {
+		case "RSA":
+			n, errN := decodeBigInt(jwk.N)
+			e, errE := decodeBigInt(jwk.E)
+			if errN != nil || errE != nil || !e.IsInt64() {
+				return nil, fmt.Errorf("invalid RSA key %q", jwk.Kid)
+			}
+			keys[jwk.Kid] = &rsa.PublicKey{N: n, E: int(e.Int64())}
+		case "EC":
+			var curve elliptic.Curve
+			switch jwk.Crv {
+			case "P-256":
+				curve = elliptic.P256()
+			case "P-384":
+				curve = elliptic.P384()
+			default:
+				continue
+			}
+			x, errX := decodeBigInt(jwk.X)
+			y, errY := decodeBigInt(jwk.Y)
+			if errX != nil || errY != nil {
+				return nil, fmt.Errorf("invalid EC key %q", jwk.Kid)
+			}
+			keys[jwk.Kid] = &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+		}
+	}
+	return keys, nil
+}
+
+// decodeBigInt decodes a base64url encoded big-endian integer
+func decodeBigInt(value string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(data), nil
+}
+
+// audienceMatches reports whether the aud claim, a string or a list, names
+// one of the client IDs
+func audienceMatches(aud any, clientIDs ...string) bool {
+	for _, audience := range stringList(aud) {
+		if slices.Contains(clientIDs, audience) {
+			return true
+		}
+	}
+	return false
+}
+
+// claim returns a claim by its dot separated path
+func claim(claims map[string]any, path string) any {
+	var value any = claims
+	for _, name := range strings.Split(path, ".") {
+		object, ok := value.(map[string]any)
+		if !ok {
+			return nil
+		}
+		value = object[name]
+	}
+	return value
+}
+
+// stringList returns a claim that is a string or a list of strings as a list
+func stringList(value any) []string {
+	switch value := value.(type) {
+	case string:
+		return []string{value}
+	case []any:
+		var list []string
+		for _, item := range value {
+			if s, ok := item.(string); ok {
+				list = append(list, s)
+			}
+		}
+		return list
+	}
+	return nil
+}
+
+// RandomString returns a random URL-safe string for states, nonces and PKCE
+// verifiers
+func RandomString() string {
+	data := make([]byte, 32)
+	rand.Read(data)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// Challenge returns the S256 PKCE challenge of a verifier
+func Challenge(verifier string) string {
+	digest := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(digest[:])
+}
+
+// getJSON fetches and decodes a JSON document
+func getJSON(ctx context.Context, client *http.Client, uri string, reply any) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", uri, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	return do(client, req, reply)
+}
+
+// postForm posts a form to an endpoint of the provider and decodes its JSON
+// reply
+func postForm(ctx context.Context, client *http.Client, uri string, form url.Values, reply any) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", uri, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	return do(client, req, reply)
+}
+
+// do sends a request and decodes its JSON reply. OAuth errors are returned
+// as *Error.
+func do(client *http.Client, req *http.Request, reply any) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var oauthErr Error
+		if json.Unmarshal(data, &oauthErr) == nil && oauthErr.Code != "" {
+			return &oauthErr
+		}
+		return fmt.Errorf("%s returned %d: %s", req.URL.Host, resp.StatusCode, strings.TrimSpace(string(data)))
+	}
+	return json.Unmarshal(data, reply)
+}
+
+// Error is an OAuth error response
+type Error struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+func (e *Error) Error() string {
+	if e.Description != "" {
+		return e.Code + ": " + e.Description
+	}
+	return e.Code
+}
@@ -0,0 +1,275 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// fakeProvider is an identity provider issuing ID tokens for a single user
+type fakeProvider struct {
+	*httptest.Server
+	key    *rsa.PrivateKey
+	claims jwt.MapClaims
+
+	mutex     sync.Mutex
+	challenge string
+	nonce     string
+	// pending is how many more times the device code is still pending
+	pending int
+}
+
+func newFakeProvider(t *testing.T) *fakeProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	p := &fakeProvider{key: key}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(Metadata{
+			Issuer:                      p.URL,
+			AuthorizationEndpoint:       p.URL + "/authorize",
+			TokenEndpoint:               p.URL + "/token",
+			JWKSURI:                     p.URL + "/keys",
+			DeviceAuthorizationEndpoint: p.URL + "/device",
+		})
+	})
+	mux.HandleFunc("GET /keys", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kid": "key-1",
+			"kty": "RSA",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("GET /authorize", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		p.mutex.Lock()
+		p.challenge, p.nonce = query.Get("code_challenge"), query.Get("nonce")
+		p.mutex.Unlock()
+		http.Redirect(w, r, query.Get("redirect_uri")+"?code=code-1&state="+url.QueryEscape(query.Get("state")), http.StatusFound)
+	})
+	mux.HandleFunc("POST /device", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(DeviceCode{DeviceCode: "device-1", UserCode: "ABCD-EFGH", VerificationURL: p.URL + "/activate", ExpiresIn: 60, Interval: 1})
+	})
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+
+		nonce := ""
+		switch r.Form.Get("grant_type") {
+		case "authorization_code":
+			if r.Form.Get("code") != "code-1" || Challenge(r.Form.Get("code_verifier")) != p.challenge {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(Error{Code: "invalid_grant"})
+				return
+			}
+			nonce = p.nonce
+		case "urn:ietf:params:oauth:grant-type:device_code":
+			if p.pending > 0 {
+				p.pending--
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(Error{Code: "authorization_pending"})
+				return
+			}
+		}
+		json.NewEncoder(w).Encode(Tokens{AccessToken: "access", TokenType: "Bearer", IDToken: p.idToken(t, r.Form.Get("client_id"), nonce)})
+	})
+	p.Server = httptest.NewServer(mux)
+	t.Cleanup(p.Close)
+
+	p.claims = jwt.MapClaims{"sub": "user-1", "email": "alice@example.com", "groups": []string{"engineering", "team-a"}}
+	return p
+}
+
+// idToken signs an ID token for a client
+func (p *fakeProvider) idToken(t *testing.T, clientID, nonce string) string {
+	claims := jwt.MapClaims{
+		"iss": p.URL,
+		"aud": clientID,
+		"exp": time.Now().Add(time.Hour).Unix(),
+		"iat": time.Now().Unix(),
+	}
+	if nonce != "" {
+		claims["nonce"] = nonce
+	}
+	for name, value := range p.claims {
+		claims[name] = value
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = "key-1"
+	signed, err := token.SignedString(p.key)
+	if err != nil {
+		t.Fatalf("Failed to sign ID token: %v", err)
+	}
+	return signed
+}
+
+func TestCodeFlow(t *testing.T) {
+	idp := newFakeProvider(t)
+	provider := NewProvider(Config{Issuer: idp.URL, ClientID: "dashboard", CLIClientID: "cli", RedirectURL: "https://dgb.example.com/auth/callback", Scopes: DefaultScopes})
+
+	verifier := RandomString()
+	authURL, err := provider.AuthCodeURL(context.Background(), "state-1", "nonce-1", verifier)
+	if err != nil {
+		t.Fatalf("AuthCodeURL failed: %v", err)
+	}
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Get(authURL)
+	if err != nil {
+		t.Fatalf("Authorization request failed: %v", err)
+	}
+	resp.Body.Close()
+	callback, _ := url.Parse(resp.Header.Get("Location"))
+	if callback.Query().Get("state") != "state-1" {
+		t.Fatalf("Expected the state to be returned, got %s", callback)
+	}
+
+	if _, err := provider.Exchange(context.Background(), callback.Query().Get("code"), "wrong-verifier"); err == nil || !strings.Contains(err.Error(), "invalid_grant") {
+		t.Errorf("Expected the PKCE verifier to be checked, got %v", err)
+	}
+	tokens, err := provider.Exchange(context.Background(), callback.Query().Get("code"), verifier)
+	if err != nil {
+		t.Fatalf("Exchange failed: %v", err)
+	}
+
+	identity, err := provider.Verify(context.Background(), tokens.IDToken, "nonce-1")
+	if err != nil {
+		t.Fatalf("Verify failed: %v", err)
+	}
+	if identity.User() != "alice@example.com" || len(identity.Groups) != 2 {
+		t.Errorf("Unexpected identity %+v", identity)
+	}
+	if _, err := provider.Verify(context.Background(), tokens.IDToken, "other-nonce"); err == nil {
+		t.Error("Expected a replayed ID token to be rejected")
+	}
+}
+
+func TestVerifyRejectsInvalidTokens(t *testing.T) {
+	idp := newFakeProvider(t)
+	provider := NewProvider(Config{Issuer: idp.URL, ClientID: "dashboard", CLIClientID: "cli"})
+
+	if _, err := provider.Verify(context.Background(), idp.idToken(t, "cli", ""), ""); err != nil {
+		t.Errorf("Expected tokens of the CLI client to be accepted, got %v", err)
+	}
+	if _, err := provider.Verify(context.Background(), idp.idToken(t, "other-app", ""), ""); err == nil {
+		t.Error("Expected tokens of other clients to be rejected")
+	}
+
+	idp.claims["exp"] = time.Now().Add(-time.Minute).Unix()
+	if _, err := provider.Verify(context.Background(), idp.idToken(t, "dashboard", ""), ""); err == nil {
+		t.Error("Expected expired tokens to be rejected")
+	}
+	delete(idp.claims, "exp")
+
+	idp.claims["iss"] = "https://evil.example.com"
+	if _, err := provider.Verify(context.Background(), idp.idToken(t, "dashboard", ""), ""); err == nil {
+		t.Error("Expected tokens of other issuers to be rejected")
+	}
+	delete(idp.claims, "iss")
+
+	// Tokens signed with a symmetric key, such as the client secret, are
+	// never accepted
+	forged, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"iss": idp.URL, "aud": "dashboard", "sub": "admin", "exp": time.Now().Add(time.Hour).Unix(),
+	}).SignedString([]byte("secret"))
+	if _, err := provider.Verify(context.Background(), forged, ""); err == nil {
+		t.Error("Expected HMAC signed tokens to be rejected")
+	}
+
+	idp.key, _ = rsa.GenerateKey(rand.Reader, 2048)
+	if _, err := provider.Verify(context.Background(), idp.idToken(t, "dashboard", ""), ""); err == nil {
+		t.Error("Expected tokens with a wrong signature to be rejected")
+	}
+}
+
+func TestDeviceFlow(t *testing.T) {
+	idp := newFakeProvider(t)
+	idp.pending = 1
+	metadata, err := Discover(context.Background(), http.DefaultClient, idp.URL)
+	if err != nil {
+		t.Fatalf("Discover failed: %v", err)
+	}
+
+	code, err := RequestDeviceCode(context.Background(), http.DefaultClient, metadata, "cli", DefaultScopes)
+	if err != nil {
+		t.Fatalf("RequestDeviceCode failed: %v", err)
+	}
+	if code.UserCode != "ABCD-EFGH" || code.VerificationURI != idp.URL+"/activate" {
+		t.Errorf("Unexpected device code %+v", code)
+	}
+
+	tokens, err := PollDeviceToken(context.Background(), http.DefaultClient, metadata, "cli", code)
+	if err != nil {
+		t.Fatalf("PollDeviceToken failed: %v", err)
+	}
+	provider := NewProvider(Config{Issuer: idp.URL, ClientID: "dashboard", CLIClientID: "cli"})
+	if _, err := provider.Verify(context.Background(), tokens.IDToken, ""); err != nil {
+		t.Errorf("Expected the device login ID token to verify, got %v", err)
+	}
+}
+
+func TestRole(t *testing.T) {
+	config := Config{Roles: map[string]string{"platform": "admin", "team-a": "team-a"}}
+	if role, err := config.Role([]string{"engineering", "team-a"}); err != nil || role != "team-a" {
+		t.Errorf("Expected role team-a, got %q, %v", role, err)
+	}
+	if _, err := config.Role([]string{"engineering"}); err == nil {
+		t.Error("Expected users in no mapped group to be refused")
+	}
+	config.DefaultRole = "viewer"
+	if role, _ := config.Role(nil); role != "viewer" {
+		t.Errorf("Expected the default role, got %q", role)
+	}
+
+	// Keycloak lists realm roles in a nested claim
+	claims := map[string]any{"realm_access": map[string]any{"roles": []any{"platform"}}}
+	if groups := stringList(claim(claims, "realm_access.roles")); len(groups) != 1 || groups[0] != "platform" {
+		t.Errorf("Expected the nested groups, got %v", groups)
+	}
+}
+
+func TestConfigFromEnv(t *testing.T) {
+	t.Setenv("OIDC_ISSUER", "")
+	if config, err := ConfigFromEnv(); config != nil || err != nil {
+		t.Errorf("Expected OIDC to be disabled by default, got %+v, %v", config, err)
+	}
+
+	t.Setenv("OIDC_ISSUER", "https://login.example.com/")
+	t.Setenv("OIDC_CLIENT_ID", "dashboard")
+	t.Setenv("OIDC_REDIRECT_URL", "https://dgb.example.com/auth/callback")
+	t.Setenv("OIDC_SCOPES", "profile email groups")
+	t.Setenv("OIDC_ROLE_MAPPINGS", `{"platform":"admin"}`)
+	config, err := ConfigFromEnv()
+	if err != nil {
+		t.Fatalf("ConfigFromEnv failed: %v", err)
+	}
+	if config.Issuer != "https://login.example.com" || config.CLIClientID != "dashboard" || config.Scopes[0] != "openid" || len(config.Scopes) != 4 || config.Roles["platform"] != "admin" {
+		t.Errorf("Unexpected config %+v", config)
+	}
+
+	t.Setenv("OIDC_ROLE_MAPPINGS", `["admin"]`)
+	if _, err := ConfigFromEnv(); err == nil {
+		t.Error("Expected invalid role mappings to be rejected")
+	}
+	t.Setenv("OIDC_CLIENT_ID", "")
+	if _, err := ConfigFromEnv(); err == nil {
+		t.Error("Expected a client ID to be required")
+	}
+}
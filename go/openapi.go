@@ -0,0 +1,53 @@
+package main
+
+import (
+	"distributed-gradle-building/audit"
+	"distributed-gradle-building/openapi"
+	"distributed-gradle-building/types"
+)
+
+// coordinatorOpenAPI describes the coordinator HTTP API. The client package
+// generates its types from a snapshot of this document (client/openapi.json).
+func coordinatorOpenAPI() *openapi.Document {
+	doc := openapi.New("Distributed Gradle Building Coordinator API", "1.0.0",
+		"Submits builds and reports worker and queue state")
+
+	doc.Add(openapi.Route{
+		Method:      "POST",
+		Path:        "/api/build",
+		Summary:     "Submit a build request",
+		OperationID: "submitBuild",
+		Request:     types.BuildRequest{},
+		Response:    SubmitBuildResponse{},
+	})
+	doc.Add(openapi.Route{
+		Method:      "GET",
+		Path:        "/api/workers",
+		Summary:     "List registered workers",
+		OperationID: "getWorkers",
+		Response:    map[string]*types.Worker{},
+	})
+	doc.Add(openapi.Route{
+		Method:      "GET",
+		Path:        "/api/status",
+		Summary:     "Get worker and queue status",
+		OperationID: "getSystemStatus",
+		Response:    SystemStatus{},
+	})
+	doc.Add(audit.Route())
+	doc.Add(openapi.Route{
+		Method:      "GET",
+		Path:        "/health",
+		Summary:     "Check coordinator health",
+		OperationID: "healthCheck",
+		Response:    HealthStatus{},
+	})
+	doc.Add(openapi.Route{
+		Method:      "GET",
+		Path:        "/metrics",
+		Summary:     "Prometheus metrics",
+		OperationID: "getMetrics",
+	})
+
+	return doc
+}
@@ -0,0 +1,42 @@
+// Command openapi-gen generates Go types from the component schemas of an
+// OpenAPI document.
+//
+// Usage:
+//
+//	openapi-gen -in openapi.json -out types_gen.go -package client
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"path/filepath"
+
+	"distributed-gradle-building/openapi"
+)
+
+func main() {
+	in := flag.String("in", "openapi.json", "OpenAPI document to read")
+	out := flag.String("out", "types_gen.go", "Go file to write")
+	packageName := flag.String("package", "main", "package of the generated file")
+	flag.Parse()
+
+	data, err := os.ReadFile(*in)
+	if err != nil {
+		log.Fatalf("Failed to read %s: %v", *in, err)
+	}
+
+	doc, err := openapi.Parse(data)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	source, err := openapi.GenerateGo(doc, *packageName, filepath.Base(*in))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := os.WriteFile(*out, source, 0644); err != nil {
+		log.Fatalf("Failed to write %s: %v", *out, err)
+	}
+}
@@ -0,0 +1,139 @@
+package openapi
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// GenerateGo renders the component schemas of a document as Go type
+// declarations in the named package. source names the document in the
+// generated file header.
+func GenerateGo(doc *Document, packageName, source string) ([]byte, error) {
+	names := make([]string, 0, len(doc.Components.Schemas))
+	for name := range doc.Components.Schemas {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var body bytes.Buffer
+	usesTime := false
+	for _, name := range names {
+		schema := doc.Components.Schemas[name]
+		goType := goTypeFor(schema)
+		if strings.Contains(goType, "time.") {
+			usesTime = true
+		}
+
+		fmt.Fprintf(&body, "// %s is generated from the %s schema\n", name, name)
+		fmt.Fprintf(&body, "type %s %s\n\n", name, goType)
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "// Code generated by openapi-gen from %s. DO NOT EDIT.\n\n", source)
+	fmt.Fprintf(&buf, "package %s\n\n", packageName)
+	if usesTime {
+		buf.WriteString("import \"time\"\n\n")
+	}
+	buf.Write(body.Bytes())
+
+	formatted, err := format.Source(buf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("failed to format generated code: %v", err)
+	}
+	return formatted, nil
+}
+
+// goTypeFor maps a schema to a Go type expression
+func goTypeFor(schema *Schema) string {
+	if schema.GoType != "" {
+		return schema.GoType
+	}
+	if schema.Ref != "" {
+		return schema.Ref[strings.LastIndex(schema.Ref, "/")+1:]
+	}
+
+	switch schema.Type {
+	case "boolean":
+		return "bool"
+	case "integer":
+		switch schema.Format {
+		case "int64":
+			return "int64"
+		case "int32":
+			return "int32"
+		}
+		return "int"
+	case "number":
+		if schema.Format == "float" {
+			return "float32"
+		}
+		return "float64"
+	case "string":
+		if schema.Format == "byte" {
+			return "[]byte"
+		}
+		return "string"
+	case "array":
+		if schema.Items == nil {
+			return "[]any"
+		}
+		return "[]" + goTypeFor(schema.Items)
+	case "object":
+		if schema.AdditionalProperties != nil {
+			return "map[string]" + goTypeFor(schema.AdditionalProperties)
+		}
+		if len(schema.Properties) == 0 {
+			return "map[string]any"
+		}
+		return goStruct(schema)
+	}
+
+	return "any"
+}
+
+// goStruct renders an object schema as a struct type
+func goStruct(schema *Schema) string {
+	required := make(map[string]bool, len(schema.Required))
+	for _, name := range schema.Required {
+		required[name] = true
+	}
+
+	var buf strings.Builder
+	buf.WriteString("struct {\n")
+	for _, property := range schema.Properties {
+		fieldName := property.Schema.GoName
+		if fieldName == "" {
+			fieldName = exportedName(property.Name)
+		}
+
+		tag := property.Name
+		if !required[property.Name] {
+			tag += ",omitempty"
+		}
+
+		fmt.Fprintf(&buf, "\t%s %s `json:\"%s\"`\n", fieldName, goTypeFor(property.Schema), tag)
+	}
+	buf.WriteString("}")
+	return buf.String()
+}
+
+// exportedName converts a snake_case JSON name into an exported Go identifier
+func exportedName(name string) string {
+	var buf strings.Builder
+	for _, part := range strings.FieldsFunc(name, func(r rune) bool { return r == '_' || r == '-' }) {
+		upper := strings.ToUpper(part)
+		switch upper {
+		case "ID", "URL", "CPU", "HTTP", "API", "IO":
+			buf.WriteString(upper)
+		default:
+			runes := []rune(part)
+			runes[0] = unicode.ToUpper(runes[0])
+			buf.WriteString(string(runes))
+		}
+	}
+	return buf.String()
+}
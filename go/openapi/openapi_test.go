@@ -0,0 +1,132 @@
+package openapi
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testResources struct {
+	CPUPercent float64 `json:"cpu_percent"`
+}
+
+type testWorker struct {
+	ID        string            `json:"id"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Started   time.Time         `json:"started"`
+	Timeout   time.Duration     `json:"timeout"`
+	Resources testResources     `json:"resources"`
+	Tags      []string          `json:"tags"`
+	internal  string
+	Ignored   string `json:"-"`
+}
+
+func TestSchemaForStruct(t *testing.T) {
+	doc := New("Test API", "1.0.0", "")
+
+	ref := doc.SchemaFor(map[string]*testWorker{})
+	if ref.Type != "object" || ref.AdditionalProperties.Ref != "#/components/schemas/testWorker" {
+		t.Fatalf("Expected map of testWorker refs, got %+v", ref)
+	}
+
+	worker := doc.Components.Schemas["testWorker"]
+	if worker == nil {
+		t.Fatal("Expected testWorker component")
+	}
+
+	var names []string
+	for _, property := range worker.Properties {
+		names = append(names, property.Name)
+	}
+	if got := strings.Join(names, ","); got != "id,labels,started,timeout,resources,tags" {
+		t.Errorf("Unexpected properties %s", got)
+	}
+	if got := strings.Join(worker.Required, ","); got != "id,started,timeout,resources,tags" {
+		t.Errorf("Unexpected required properties %s", got)
+	}
+
+	if timeout := worker.Properties[3].Schema; timeout.Type != "integer" || timeout.GoType != "time.Duration" {
+		t.Errorf("Expected duration schema, got %+v", timeout)
+	}
+	if _, exists := doc.Components.Schemas["testResources"]; !exists {
+		t.Error("Expected nested struct to be registered as a component")
+	}
+}
+
+func TestDocumentRoundTrip(t *testing.T) {
+	doc := New("Test API", "1.0.0", "Round trip")
+	doc.Add(Route{
+		Method:      "GET",
+		Path:        "/api/workers/{id}",
+		OperationID: "getWorker",
+		Parameters:  []Parameter{PathParam("id", "Worker ID")},
+		Response:    testWorker{},
+	})
+
+	data, err := doc.JSON()
+	if err != nil {
+		t.Fatalf("JSON failed: %v", err)
+	}
+
+	parsed, err := Parse(data)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	again, err := parsed.JSON()
+	if err != nil {
+		t.Fatalf("JSON failed: %v", err)
+	}
+	if string(again) != string(data) {
+		t.Error("Expected parsed document to encode identically")
+	}
+
+	operation := parsed.Paths["/api/workers/{id}"]["get"]
+	if operation == nil || operation.OperationID != "getWorker" {
+		t.Fatalf("Expected getWorker operation, got %+v", operation)
+	}
+}
+
+func TestGenerateGo(t *testing.T) {
+	doc := New("Test API", "1.0.0", "")
+	doc.SchemaFor(testWorker{})
+
+	source, err := GenerateGo(doc, "client", "test.json")
+	if err != nil {
+		t.Fatalf("GenerateGo failed: %v", err)
+	}
+
+	for _, expected := range []string{
+		"// Code generated by openapi-gen from test.json. DO NOT EDIT.",
+		"package client",
+		`import "time"`,
+		"type testWorker struct {",
+		"Labels    map[string]string `json:\"labels,omitempty\"`",
+		"Started   time.Time         `json:\"started\"`",
+		"Timeout   time.Duration     `json:\"timeout\"`",
+		"Resources testResources     `json:\"resources\"`",
+		"CPUPercent float64 `json:\"cpu_percent\"`",
+	} {
+		if !strings.Contains(string(source), expected) {
+			t.Errorf("Expected generated code to contain %q, got:\n%s", expected, source)
+		}
+	}
+}
+
+func TestHandler(t *testing.T) {
+	doc := New("Test API", "1.0.0", "")
+	recorder := httptest.NewRecorder()
+	doc.Handler()(recorder, httptest.NewRequest(http.MethodGet, "/api/openapi.json", nil))
+
+	if recorder.Code != http.StatusOK {
+		t.Errorf("Expected status 200, got %d", recorder.Code)
+	}
+	if contentType := recorder.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("Expected JSON content type, got %s", contentType)
+	}
+	if !strings.Contains(recorder.Body.String(), `"openapi": "3.0.3"`) {
+		t.Errorf("Unexpected body %s", recorder.Body.String())
+	}
+}
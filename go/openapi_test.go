@@ -0,0 +1,34 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"testing"
+)
+
+var updateOpenAPI = flag.Bool("update-openapi", false, "rewrite client/openapi.json from the coordinator document")
+
+// TestCoordinatorOpenAPISnapshot keeps the client's copy of the document in
+// sync with the handlers. Run with -update-openapi and go generate ./client
+// after changing the API.
+func TestCoordinatorOpenAPISnapshot(t *testing.T) {
+	data, err := coordinatorOpenAPI().JSON()
+	if err != nil {
+		t.Fatalf("Failed to encode document: %v", err)
+	}
+
+	if *updateOpenAPI {
+		if err := os.WriteFile("client/openapi.json", data, 0644); err != nil {
+			t.Fatalf("Failed to write snapshot: %v", err)
+		}
+	}
+
+	snapshot, err := os.ReadFile("client/openapi.json")
+	if err != nil {
+		t.Fatalf("Failed to read snapshot: %v", err)
+	}
+	if !bytes.Equal(data, snapshot) {
+		t.Error("client/openapi.json is out of date; run go test -run TestCoordinatorOpenAPISnapshot -update-openapi .")
+	}
+}
@@ -0,0 +1,140 @@
+// Package pools routes builds to named pools of workers, so separate fleets
+// such as Android, backend and release workers only run the builds meant for
+// them. Workers join a pool when they register and builds are assigned to a
+// pool by the first routing rule they match.
+package pools
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+)
+
+// DefaultPool is the pool of workers registered without one and of builds
+// matching no rule
+const DefaultPool = "default"
+
+// MaxLabels is the number of labels a build may carry
+const MaxLabels = 16
+
+// namePattern restricts pool names and build labels to short identifiers
+var namePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{0,62}$`)
+
+// ValidName reports whether name may be used as a pool name or build label
+func ValidName(name string) bool {
+	return namePattern.MatchString(name)
+}
+
+// Normalize returns the pool name, DefaultPool if it is empty
+func Normalize(pool string) string {
+	if pool == "" {
+		return DefaultPool
+	}
+	return pool
+}
+
+// ValidateLabels checks the labels of a build
+func ValidateLabels(labels []string) error {
+	if len(labels) > MaxLabels {
+		return fmt.Errorf("too many labels: %d, at most %d", len(labels), MaxLabels)
+	}
+	for _, label := range labels {
+		if !ValidName(label) {
+			return fmt.Errorf("invalid label %q", label)
+		}
+	}
+	return nil
+}
+
+// Rule routes the builds it matches to Pool. Project and Repository are glob
+// patterns (path.Match syntax) of the project path and repository URL of a
+// build, and Label a label the build must carry. Empty fields match any
+// build, but a rule needs at least one of them.
+type Rule struct {
+	Project    string `json:"project,omitempty"`
+	Repository string `json:"repository,omitempty"`
+	Label      string `json:"label,omitempty"`
+	Pool       string `json:"pool"`
+}
+
+// validate checks that a rule names a valid pool and has valid patterns
+func (r Rule) validate() error {
+	if !ValidName(r.Pool) {
+		return fmt.Errorf("invalid pool name %q", r.Pool)
+	}
+	if r.Project == "" && r.Repository == "" && r.Label == "" {
+		return fmt.Errorf("rule for pool %s matches no project, repository or label", r.Pool)
+	}
+	for _, pattern := range []string{r.Project, r.Repository} {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q for pool %s: %v", pattern, r.Pool, err)
+		}
+	}
+	return nil
+}
+
+// matches reports whether a build matches the rule
+func (r Rule) matches(projectPath, repoURL string, labels []string) bool {
+	if r.Project != "" {
+		if matched, _ := path.Match(r.Project, projectPath); !matched {
+			return false
+		}
+	}
+	if r.Repository != "" {
+		if matched, _ := path.Match(r.Repository, repoURL); repoURL == "" || !matched {
+			return false
+		}
+	}
+	return r.Label == "" || slices.Contains(labels, r.Label)
+}
+
+// Router assigns builds to pools
+type Router struct {
+	rules []Rule
+}
+
+// NewRouter creates a router applying rules in order
+func NewRouter(rules []Rule) (*Router, error) {
+	for _, rule := range rules {
+		if err := rule.validate(); err != nil {
+			return nil, err
+		}
+	}
+	return &Router{rules: rules}, nil
+}
+
+// RouterFromEnv reads the routing rules from BUILD_ROUTING_RULES, a JSON
+// array of rules. Without it every build runs in the default pool.
+func RouterFromEnv() (*Router, error) {
+	var rules []Rule
+	if value := os.Getenv("BUILD_ROUTING_RULES"); value != "" {
+		if err := json.Unmarshal([]byte(value), &rules); err != nil {
+			return nil, fmt.Errorf("failed to parse BUILD_ROUTING_RULES: %v", err)
+		}
+	}
+	return NewRouter(rules)
+}
+
+// Route returns the pool of the first rule a build matches, or DefaultPool
+func (r *Router) Route(projectPath, repoURL string, labels []string) string {
+	for _, rule := range r.rules {
+		if rule.matches(projectPath, repoURL, labels) {
+			return rule.Pool
+		}
+	}
+	return DefaultPool
+}
+
+// Pools returns the pools builds may be routed to, DefaultPool first
+func (r *Router) Pools() []string {
+	pools := []string{DefaultPool}
+	for _, rule := range r.rules {
+		if !slices.Contains(pools, rule.Pool) {
+			pools = append(pools, rule.Pool)
+		}
+	}
+	return pools
+}
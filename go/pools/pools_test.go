@@ -0,0 +1,87 @@
+package pools
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRoute(t *testing.T) {
+	router, err := NewRouter([]Rule{
+		{Label: "release", Pool: "release"},
+		{Project: "/projects/android/*", Pool: "android"},
+		{Repository: "https://git.example.com/mobile/*", Pool: "android"},
+		{Project: "/projects/*", Pool: "backend"},
+	})
+	if err != nil {
+		t.Fatalf("NewRouter failed: %v", err)
+	}
+
+	tests := []struct {
+		projectPath string
+		repoURL     string
+		labels      []string
+		expected    string
+	}{
+		{"/projects/android/app", "", nil, "android"},
+		{"/projects/android/app", "", []string{"nightly", "release"}, "release"},
+		{"/projects/api", "", nil, "backend"},
+		{"app", "https://git.example.com/mobile/app.git", nil, "android"},
+		{"app", "https://git.example.com/services/api.git", nil, DefaultPool},
+		{"/srv/tools/app", "", []string{"nightly"}, DefaultPool},
+	}
+	for _, test := range tests {
+		if pool := router.Route(test.projectPath, test.repoURL, test.labels); pool != test.expected {
+			t.Errorf("Expected %s %s %v to be routed to %s, got %s", test.projectPath, test.repoURL, test.labels, test.expected, pool)
+		}
+	}
+
+	if pools := router.Pools(); !reflect.DeepEqual(pools, []string{DefaultPool, "release", "android", "backend"}) {
+		t.Errorf("Unexpected pools %v", pools)
+	}
+}
+
+func TestNewRouterRejectsInvalidRules(t *testing.T) {
+	for name, rule := range map[string]Rule{
+		"missing pool":    {Project: "/projects/*"},
+		"invalid pool":    {Project: "/projects/*", Pool: "Android Builds"},
+		"matches nothing": {Pool: "android"},
+		"bad pattern":     {Project: "/projects/[", Pool: "android"},
+	} {
+		if _, err := NewRouter([]Rule{rule}); err == nil {
+			t.Errorf("Expected the %s rule to be rejected", name)
+		}
+	}
+}
+
+func TestRouterFromEnv(t *testing.T) {
+	t.Setenv("BUILD_ROUTING_RULES", "")
+	router, err := RouterFromEnv()
+	if err != nil || router.Route("/projects/app", "", nil) != DefaultPool || len(router.Pools()) != 1 {
+		t.Fatalf("Expected only the default pool without rules, got %v, %v", router, err)
+	}
+
+	t.Setenv("BUILD_ROUTING_RULES", `[{"label":"release","pool":"release"}]`)
+	if router, err = RouterFromEnv(); err != nil || router.Route("/projects/app", "", []string{"release"}) != "release" {
+		t.Errorf("Expected the rules to be read, got %v", err)
+	}
+
+	t.Setenv("BUILD_ROUTING_RULES", `{"pool":"release"}`)
+	if _, err := RouterFromEnv(); err == nil {
+		t.Error("Expected malformed rules to be rejected")
+	}
+}
+
+func TestValidateLabels(t *testing.T) {
+	if err := ValidateLabels([]string{"release", "android-12", "v1.2"}); err != nil {
+		t.Errorf("Expected labels to be valid: %v", err)
+	}
+	if err := ValidateLabels([]string{"Release Build"}); err == nil {
+		t.Error("Expected an invalid label to be rejected")
+	}
+	if err := ValidateLabels(make([]string, MaxLabels+1)); err == nil {
+		t.Error("Expected too many labels to be rejected")
+	}
+	if Normalize("") != DefaultPool || Normalize("android") != "android" {
+		t.Error("Expected an empty pool to be the default pool")
+	}
+}
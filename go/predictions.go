@@ -0,0 +1,100 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"distributed-gradle-building/ml/service"
+	"distributed-gradle-building/types"
+)
+
+// defaultPredictionCacheTTL is how long the insights of a build are reused
+const defaultPredictionCacheTTL = 30 * time.Second
+
+// predictionCache keeps the ML insights of recently scheduled builds for a
+// short time, so prioritizing a build, choosing its worker and handling it
+// as high risk predict it only once
+type predictionCache struct {
+	ttl time.Duration
+	now func() time.Time
+
+	mutex   sync.Mutex
+	entries map[string]cachedPrediction
+}
+
+// cachedPrediction is the insights of a build and when they expire
+type cachedPrediction struct {
+	result  service.PredictionResult
+	expires time.Time
+}
+
+// newPredictionCache creates a cache keeping insights for ttl; a ttl of 0
+// disables it
+func newPredictionCache(ttl time.Duration) *predictionCache {
+	return &predictionCache{ttl: ttl, now: time.Now, entries: make(map[string]cachedPrediction)}
+}
+
+// predictionCacheTTLFromEnv reads PREDICTION_CACHE_TTL, 0 to disable the
+// cache
+func predictionCacheTTLFromEnv() time.Duration {
+	if value, err := time.ParseDuration(os.Getenv("PREDICTION_CACHE_TTL")); err == nil && value >= 0 {
+		return value
+	}
+	return defaultPredictionCacheTTL
+}
+
+// predictionKey identifies the builds sharing a prediction: the same task of
+// the same project with the same options
+func predictionKey(projectPath, taskName string, options map[string]string) string {
+	names := make([]string, 0, len(options))
+	for name := range options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	hash := sha256.New()
+	for _, name := range names {
+		hash.Write([]byte(name + "\x00" + options[name] + "\x00"))
+	}
+	return projectPath + "\x00" + taskName + "\x00" + hex.EncodeToString(hash.Sum(nil))
+}
+
+// get returns the cached insights for key, or computes and caches them
+func (c *predictionCache) get(key string, compute func() service.PredictionResult) service.PredictionResult {
+	if c.ttl <= 0 {
+		return compute()
+	}
+
+	now := c.now()
+	c.mutex.Lock()
+	entry, found := c.entries[key]
+	c.mutex.Unlock()
+	if found && now.Before(entry.expires) {
+		return entry.result
+	}
+
+	result := compute()
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for cached, entry := range c.entries {
+		if !now.Before(entry.expires) {
+			delete(c.entries, cached)
+		}
+	}
+	c.entries[key] = cachedPrediction{result: result, expires: now.Add(c.ttl)}
+	return result
+}
+
+// buildInsights returns the ML insights of a build, reusing those of the
+// same project, task and options predicted within the cache TTL
+func (bc *BuildCoordinator) buildInsights(request types.BuildRequest) service.PredictionResult {
+	key := predictionKey(request.ProjectPath, request.TaskName, request.BuildOptions)
+	return bc.predictions.get(key, func() service.PredictionResult {
+		return bc.MLService.GetBuildInsights(request.ProjectPath, request.TaskName, request.BuildOptions)
+	})
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"distributed-gradle-building/ml/service"
+)
+
+func TestPredictionCache(t *testing.T) {
+	cache := newPredictionCache(time.Minute)
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	cache.now = func() time.Time { return now }
+
+	computed := 0
+	compute := func() service.PredictionResult {
+		computed++
+		return service.PredictionResult{PredictedTime: time.Duration(computed) * time.Minute}
+	}
+
+	key := predictionKey("/projects/app", "build", map[string]string{"flavor": "free", "debug": "true"})
+	cache.get(key, compute)
+	if result := cache.get(predictionKey("/projects/app", "build", map[string]string{"debug": "true", "flavor": "free"}), compute); computed != 1 || result.PredictedTime != time.Minute {
+		t.Errorf("Expected the prediction to be reused regardless of option order, computed %d times", computed)
+	}
+
+	for _, other := range []string{
+		predictionKey("/projects/app", "test", map[string]string{"flavor": "free", "debug": "true"}),
+		predictionKey("/projects/app", "build", map[string]string{"flavor": "paid", "debug": "true"}),
+		predictionKey("/projects/app", "build", nil),
+	} {
+		if other == key {
+			t.Errorf("Expected a different key than %q", key)
+		}
+	}
+
+	now = now.Add(time.Minute)
+	if result := cache.get(key, compute); computed != 2 || result.PredictedTime != 2*time.Minute {
+		t.Errorf("Expected an expired prediction to be computed again, computed %d times", computed)
+	}
+	if len(cache.entries) != 1 {
+		t.Errorf("Expected expired entries to be dropped, got %d", len(cache.entries))
+	}
+
+	disabled := newPredictionCache(0)
+	disabled.get(key, compute)
+	disabled.get(key, compute)
+	if computed != 4 {
+		t.Errorf("Expected no caching with a TTL of 0, computed %d times", computed)
+	}
+}
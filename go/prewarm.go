@@ -0,0 +1,110 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// PrewarmConfig configures predictive worker pre-warming from learned scaling patterns
+type PrewarmConfig struct {
+	Enabled    bool          `json:"enabled"`
+	Interval   time.Duration `json:"interval"`
+	Lookahead  time.Duration `json:"lookahead"`
+	MinWorkers int           `json:"min_workers"`
+	MaxWorkers int           `json:"max_workers"`
+}
+
+// loadPrewarmConfig loads pre-warming settings from environment variables
+func loadPrewarmConfig(maxWorkers int) PrewarmConfig {
+	config := PrewarmConfig{
+		Enabled:    true,
+		Interval:   5 * time.Minute,
+		Lookahead:  time.Hour,
+		MinWorkers: 1,
+		MaxWorkers: maxWorkers,
+	}
+
+	if value, err := strconv.ParseBool(os.Getenv("PREWARM_ENABLED")); err == nil {
+		config.Enabled = value
+	}
+	if value, err := time.ParseDuration(os.Getenv("PREWARM_INTERVAL")); err == nil && value > 0 {
+		config.Interval = value
+	}
+	if value, err := time.ParseDuration(os.Getenv("PREWARM_LOOKAHEAD")); err == nil && value >= 0 {
+		config.Lookahead = value
+	}
+	if value, err := strconv.Atoi(os.Getenv("PREWARM_MIN_WORKERS")); err == nil && value >= 0 {
+		config.MinWorkers = value
+	}
+	if value, err := strconv.Atoi(os.Getenv("PREWARM_MAX_WORKERS")); err == nil && value > 0 {
+		config.MaxWorkers = value
+	}
+
+	// The pool can never hold more workers than its own limit
+	if config.MaxWorkers > maxWorkers {
+		config.MaxWorkers = maxWorkers
+	}
+	if config.MinWorkers > config.MaxWorkers {
+		config.MinWorkers = config.MaxWorkers
+	}
+
+	return config
+}
+
+// startPrewarming periodically provisions workers ahead of predicted busy windows
+func (bc *BuildCoordinator) startPrewarming() {
+	if !bc.Prewarm.Enabled {
+		return
+	}
+
+	ticker := time.NewTicker(bc.Prewarm.Interval)
+	defer ticker.Stop()
+
+	for {
+		bc.checkAndPrewarm(time.Now())
+
+		select {
+		case <-ticker.C:
+		case <-bc.shutdown:
+			return
+		}
+	}
+}
+
+// prewarmTarget returns the worker count the pool should hold at now: the peak
+// recommendation of the upcoming windows, clamped to the configured bounds
+func (bc *BuildCoordinator) prewarmTarget(now time.Time) int {
+	target := bc.Prewarm.MinWorkers
+
+	if pattern, found := bc.MLService.PeakScalingPattern(now, bc.Prewarm.Lookahead); found && pattern.RecommendedWorkers > target {
+		target = pattern.RecommendedWorkers
+	}
+
+	if target > bc.Prewarm.MaxWorkers {
+		target = bc.Prewarm.MaxWorkers
+	}
+	return target
+}
+
+// checkAndPrewarm provisions workers so the pool reaches the pre-warm target
+// before the predicted load arrives
+func (bc *BuildCoordinator) checkAndPrewarm(now time.Time) {
+	target := bc.prewarmTarget(now)
+
+	bc.mutex.Lock()
+	bc.prewarmFloor = target
+	bc.mutex.Unlock()
+
+	bc.WorkerPool.WorkerPool.Mutex.RLock()
+	currentWorkers := len(bc.WorkerPool.WorkerPool.Workers)
+	bc.WorkerPool.WorkerPool.Mutex.RUnlock()
+
+	if currentWorkers >= target {
+		return
+	}
+
+	log.Printf("Pre-warming: %d workers expected within %v, pool has %d", target, bc.Prewarm.Lookahead, currentWorkers)
+	bc.performScaleUp(target - currentWorkers)
+}
@@ -0,0 +1,174 @@
+// Package projectarchive packs a Gradle project into a gzipped tar archive
+// and unpacks it again, so a project on a machine without a filesystem
+// shared with the workers can be uploaded and built.
+package projectarchive
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// ContentType is the media type of project archives
+const ContentType = "application/gzip"
+
+// skippedDirs are left out of archives: version control, IDE and build
+// state the workers recreate
+var skippedDirs = map[string]bool{".git": true, ".gradle": true, ".idea": true, "node_modules": true}
+
+// buildScripts mark the directories of Gradle projects
+var buildScripts = []string{"build.gradle", "build.gradle.kts", "settings.gradle", "settings.gradle.kts"}
+
+// ErrTooLarge is returned by Extract for archives unpacking to more than
+// its limit
+var ErrTooLarge = errors.New("project archive is too large")
+
+// Write packs the regular files of the project in dir into a gzipped tar
+// archive written to w. The build directories of its projects, Gradle and
+// IDE state, version control and symbolic links are left out. File modes are kept, so the Gradle
+// wrapper stays executable.
+func Write(w io.Writer, dir string) error {
+	zipper := gzip.NewWriter(w)
+	archive := tar.NewWriter(zipper)
+
+	err := filepath.WalkDir(dir, func(file string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if file == dir {
+			return nil
+		}
+		if entry.IsDir() && (skippedDirs[entry.Name()] || isBuildOutput(file)) {
+			return filepath.SkipDir
+		}
+		if !entry.IsDir() && !entry.Type().IsRegular() {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		relative, err := filepath.Rel(dir, file)
+		if err != nil {
+			return err
+		}
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(relative)
+		if entry.IsDir() {
+			header.Name += "/"
+		}
+		// Archives do not depend on who packed them
+		header.Uid, header.Gid, header.Uname, header.Gname = 0, 0, "", ""
+		if err := archive.WriteHeader(header); err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			return nil
+		}
+
+		source, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer source.Close()
+		_, err = io.Copy(archive, source)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to pack %s: %v", dir, err)
+	}
+
+	if err := archive.Close(); err != nil {
+		return err
+	}
+	return zipper.Close()
+}
+
+// isBuildOutput reports whether dir is the build directory of a Gradle
+// project, rather than, say, a source package named build
+func isBuildOutput(dir string) bool {
+	if filepath.Base(dir) != "build" {
+		return false
+	}
+	for _, script := range buildScripts {
+		if _, err := os.Stat(filepath.Join(filepath.Dir(dir), script)); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Extract unpacks a gzipped tar archive written by Write into dir. Entries
+// outside of dir, links and other special files are rejected, as is an
+// archive whose files add up to more than limit bytes.
+func Extract(r io.Reader, dir string, limit int64) error {
+	zipped, err := gzip.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("invalid project archive: %v", err)
+	}
+	defer zipped.Close()
+	archive := tar.NewReader(zipped)
+
+	var total int64
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("invalid project archive: %v", err)
+		}
+
+		name := path.Clean(header.Name)
+		if !filepath.IsLocal(name) {
+			return fmt.Errorf("project archive entry %s escapes the project directory", header.Name)
+		}
+		target := filepath.Join(dir, filepath.FromSlash(name))
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			total += header.Size
+			if total > limit {
+				return ErrTooLarge
+			}
+			if err := extractFile(archive, target, header.FileInfo().Mode().Perm()); err != nil {
+				return fmt.Errorf("failed to unpack %s: %v", name, err)
+			}
+		default:
+			return fmt.Errorf("project archive entry %s is not a regular file or directory", header.Name)
+		}
+	}
+}
+
+// extractFile writes the current entry of an archive to target
+func extractFile(archive *tar.Reader, target string, mode fs.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	if mode == 0 {
+		mode = 0644
+	}
+	file, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode|0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(file, archive); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,78 @@
+package projectarchive
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeFile(t *testing.T, path, content string, mode os.FileMode) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), mode); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWriteAndExtract(t *testing.T) {
+	project := t.TempDir()
+	writeFile(t, filepath.Join(project, "gradlew"), "#!/bin/sh", 0755)
+	writeFile(t, filepath.Join(project, "settings.gradle"), "include 'app'", 0644)
+	writeFile(t, filepath.Join(project, "app/build.gradle"), "plugins { id 'java' }", 0644)
+	writeFile(t, filepath.Join(project, "app/src/main/java/com/example/build/Tool.java"), "class Tool {}", 0644)
+	writeFile(t, filepath.Join(project, "app/build/libs/app.jar"), "jar", 0644)
+	writeFile(t, filepath.Join(project, ".gradle/caches/state"), "state", 0644)
+	writeFile(t, filepath.Join(project, ".git/HEAD"), "ref", 0644)
+
+	var archive bytes.Buffer
+	if err := Write(&archive, project); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	dir := t.TempDir()
+	if err := Extract(bytes.NewReader(archive.Bytes()), dir, 1<<20); err != nil {
+		t.Fatalf("Extract failed: %v", err)
+	}
+
+	for _, file := range []string{"settings.gradle", "app/build.gradle", "app/src/main/java/com/example/build/Tool.java"} {
+		if _, err := os.Stat(filepath.Join(dir, file)); err != nil {
+			t.Errorf("Expected %s to be unpacked: %v", file, err)
+		}
+	}
+	for _, file := range []string{"app/build", ".gradle", ".git"} {
+		if _, err := os.Stat(filepath.Join(dir, file)); !os.IsNotExist(err) {
+			t.Errorf("Expected %s to be left out, got %v", file, err)
+		}
+	}
+	if info, err := os.Stat(filepath.Join(dir, "gradlew")); err != nil || info.Mode().Perm()&0100 == 0 {
+		t.Errorf("Expected the wrapper to stay executable, got %v, %v", info, err)
+	}
+
+	if err := Extract(bytes.NewReader(archive.Bytes()), t.TempDir(), 10); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("Expected an archive over the limit to be rejected, got %v", err)
+	}
+}
+
+func TestExtractRejectsEscapingEntries(t *testing.T) {
+	for name, header := range map[string]*tar.Header{
+		"parent":   {Name: "../outside", Typeflag: tar.TypeReg, Mode: 0644},
+		"absolute": {Name: "/etc/passwd", Typeflag: tar.TypeReg, Mode: 0644},
+		"symlink":  {Name: "link", Typeflag: tar.TypeSymlink, Linkname: "/etc"},
+	} {
+		var archive bytes.Buffer
+		zipper := gzip.NewWriter(&archive)
+		writer := tar.NewWriter(zipper)
+		writer.WriteHeader(header)
+		writer.Close()
+		zipper.Close()
+
+		if err := Extract(&archive, t.TempDir(), 1<<20); err == nil {
+			t.Errorf("Expected the %s entry to be rejected", name)
+		}
+	}
+}
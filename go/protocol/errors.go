@@ -0,0 +1,145 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"net/rpc"
+	"strings"
+)
+
+// ErrorCode classifies why a build failed, so infrastructure failures can be
+// retried and told apart from failures of the code being built
+type ErrorCode string
+
+// Classes of build failures
+const (
+	// ErrorInfra is a failure of the build infrastructure rather than of the
+	// build: an unreachable worker, a failed checkout or a crashed daemon
+	ErrorInfra ErrorCode = "INFRA_ERROR"
+	// ErrorCompile is a build that failed other than in its tests, such as
+	// on compilation or configuration errors or an invalid request
+	ErrorCompile ErrorCode = "COMPILE_ERROR"
+	// ErrorTestFailure is a build that failed because tests failed
+	ErrorTestFailure ErrorCode = "TEST_FAILURE"
+	// ErrorTimeout is a build that ran past its time limit
+	ErrorTimeout ErrorCode = "TIMEOUT"
+	// ErrorCancelled is a build cancelled before it finished
+	ErrorCancelled ErrorCode = "CANCELLED"
+	// ErrorOOM is a build that ran out of memory
+	ErrorOOM ErrorCode = "OOM"
+)
+
+// ErrorCodes lists the classes of build failures
+func ErrorCodes() []ErrorCode {
+	return []ErrorCode{ErrorInfra, ErrorCompile, ErrorTestFailure, ErrorTimeout, ErrorCancelled, ErrorOOM}
+}
+
+// Valid reports whether the code is one of ErrorCodes
+func (c ErrorCode) Valid() bool {
+	for _, code := range ErrorCodes() {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// Retryable reports whether a build that failed with the code may succeed
+// when run again elsewhere
+func (c ErrorCode) Retryable() bool {
+	return c == ErrorInfra
+}
+
+// logPatterns are the lines of build output that point to the class of a
+// failure, by class in the order they outweigh each other: running out of
+// memory hides behind failed tests, and failed tests are more telling than
+// the network errors tests may print
+var logPatterns = []struct {
+	code     ErrorCode
+	patterns []string
+}{
+	{ErrorOOM, []string{
+		"java.lang.OutOfMemoryError",
+		"GC overhead limit exceeded",
+		"Java heap space",
+	}},
+	{ErrorTestFailure, []string{
+		"There were failing tests",
+		"tests completed,",
+	}},
+	{ErrorInfra, []string{
+		"Could not resolve",
+		"Could not GET",
+		"Could not HEAD",
+		"Could not download",
+		"Connection refused",
+		"Connection reset",
+		"Read timed out",
+		"Connect timed out",
+		"No space left on device",
+		"daemon disappeared unexpectedly",
+		"Could not connect to the Gradle daemon",
+		"Timeout waiting to lock",
+	}},
+}
+
+// MatchLogLine returns the class of failure a line Gradle or the JVM printed
+// points to, or an empty code if it points to none
+func MatchLogLine(line string) ErrorCode {
+	for _, class := range logPatterns {
+		for _, pattern := range class.patterns {
+			if strings.Contains(line, pattern) {
+				return class.code
+			}
+		}
+	}
+	return ""
+}
+
+// BuildError is a failed build with the class of its failure. RPC carries
+// errors as text only, so a BuildError returned by a worker reaches the
+// coordinator as "CODE: message", which ParseBuildError reads back.
+type BuildError struct {
+	Code    ErrorCode
+	Message string
+}
+
+// Error implements the error interface
+func (e *BuildError) Error() string {
+	return string(e.Code) + ": " + e.Message
+}
+
+// NewBuildError returns a BuildError with a formatted message
+func NewBuildError(code ErrorCode, format string, args ...any) *BuildError {
+	return &BuildError{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// ClassifyError returns err as a BuildError of code unless it already is one
+func ClassifyError(code ErrorCode, err error) *BuildError {
+	var buildError *BuildError
+	if errors.As(err, &buildError) {
+		return buildError
+	}
+	return &BuildError{Code: code, Message: err.Error()}
+}
+
+// ParseBuildError reads the class of a build failure back from the error of
+// an RPC call. Errors returned by workers without a class, as by workers
+// older than the taxonomy, have no code; errors of the call itself, such as
+// a lost connection, are infrastructure failures.
+func ParseBuildError(err error) *BuildError {
+	var buildError *BuildError
+	if errors.As(err, &buildError) {
+		return buildError
+	}
+
+	var serverError rpc.ServerError
+	if !errors.As(err, &serverError) {
+		return &BuildError{Code: ErrorInfra, Message: err.Error()}
+	}
+	message := string(serverError)
+	if code, rest, found := strings.Cut(message, ": "); found && ErrorCode(code).Valid() {
+		return &BuildError{Code: ErrorCode(code), Message: rest}
+	}
+	return &BuildError{Message: message}
+}
@@ -0,0 +1,62 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"net/rpc"
+	"testing"
+)
+
+func TestParseBuildError(t *testing.T) {
+	// RPC hands the coordinator the text of the worker's error
+	sent := NewBuildError(ErrorTestFailure, "gradle build failed: %s", "exit status 1")
+	parsed := ParseBuildError(rpc.ServerError(sent.Error()))
+	if parsed.Code != ErrorTestFailure || parsed.Message != "gradle build failed: exit status 1" {
+		t.Errorf("Expected the worker's error back, got %+v", parsed)
+	}
+
+	tests := []struct {
+		err      error
+		expected ErrorCode
+	}{
+		{fmt.Errorf("wrapped: %w", sent), ErrorTestFailure},
+		{rpc.ServerError("gradle build failed: exit status 1"), ""},
+		{rpc.ServerError("UNKNOWN: gradle build failed"), ""},
+		{rpc.ErrShutdown, ErrorInfra},
+	}
+	for _, tt := range tests {
+		if code := ParseBuildError(tt.err).Code; code != tt.expected {
+			t.Errorf("%v: expected code %q, got %q", tt.err, tt.expected, code)
+		}
+	}
+}
+
+func TestClassifyError(t *testing.T) {
+	if err := ClassifyError(ErrorInfra, errors.New("checkout failed")); err.Code != ErrorInfra || err.Message != "checkout failed" {
+		t.Errorf("Expected an infrastructure error, got %+v", err)
+	}
+	oom := NewBuildError(ErrorOOM, "out of memory")
+	if err := ClassifyError(ErrorInfra, fmt.Errorf("build: %w", oom)); err != oom {
+		t.Errorf("Expected the classified error to be kept, got %+v", err)
+	}
+
+	for _, code := range ErrorCodes() {
+		if code.Retryable() != (code == ErrorInfra) {
+			t.Errorf("Expected only %s to be retryable, %s is %v", ErrorInfra, code, code.Retryable())
+		}
+	}
+}
+
+func TestMatchLogLine(t *testing.T) {
+	tests := map[string]ErrorCode{
+		"Exception in thread \"main\" java.lang.OutOfMemoryError: Java heap space": ErrorOOM,
+		"5 tests completed, 2 failed":                 ErrorTestFailure,
+		"   > Could not resolve com.example:lib:1.0.": ErrorInfra,
+		"error: cannot find symbol":                   "",
+	}
+	for line, expected := range tests {
+		if code := MatchLogLine(line); code != expected {
+			t.Errorf("%q: expected %q, got %q", line, expected, code)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+// Package protocol versions the RPC protocol between the coordinator and its
+// workers, and publishes worker binaries so workers can update themselves
+// when a new release is rolled out.
+package protocol
+
+import (
+	"log"
+	"os"
+	"strconv"
+)
+
+// Version is the protocol version spoken by this build. Bump it whenever a
+// change to the RPC argument or reply types cannot be understood by older
+// workers. Workers built before versioning send no version, which reads as 0.
+const Version = 1
+
+// MinVersion is the oldest worker protocol version this build of the
+// coordinator can drive
+const MinVersion = 1
+
+// BuildVersion identifies the release of the running binary. Release builds
+// set it with -ldflags "-X distributed-gradle-building/protocol.BuildVersion=<version>".
+var BuildVersion = "dev"
+
+// MinWorkerVersionFromEnv returns the minimum protocol version workers must
+// speak to register, from MIN_WORKER_PROTOCOL_VERSION (default: MinVersion)
+func MinWorkerVersionFromEnv() int {
+	value := os.Getenv("MIN_WORKER_PROTOCOL_VERSION")
+	if value == "" {
+		return MinVersion
+	}
+
+	version, err := strconv.Atoi(value)
+	if err != nil || version < 0 {
+		log.Printf("Invalid MIN_WORKER_PROTOCOL_VERSION %q, using %d", value, MinVersion)
+		return MinVersion
+	}
+	return version
+}
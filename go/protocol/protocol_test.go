@@ -0,0 +1,87 @@
+package protocol
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMinWorkerVersionFromEnv(t *testing.T) {
+	tests := map[string]int{"": MinVersion, "0": 0, "3": 3, "-1": MinVersion, "latest": MinVersion}
+	for value, expected := range tests {
+		t.Setenv("MIN_WORKER_PROTOCOL_VERSION", value)
+		if version := MinWorkerVersionFromEnv(); version != expected {
+			t.Errorf("%q: expected %d, got %d", value, expected, version)
+		}
+	}
+}
+
+func TestPublisher(t *testing.T) {
+	binary := filepath.Join(t.TempDir(), "worker")
+	os.WriteFile(binary, []byte("worker v2"), 0755)
+
+	var unpublished *Publisher
+	if unpublished.Release() != nil {
+		t.Error("Expected no release from a nil publisher")
+	}
+
+	t.Setenv("WORKER_UPDATE_BINARY", binary)
+	t.Setenv("WORKER_UPDATE_VERSION", "2.0.0")
+	publisher := NewPublisherFromEnv()
+	release := publisher.Release()
+	if release == nil || release.Version != "2.0.0" || release.ProtocolVersion != Version || release.Size != 9 {
+		t.Fatalf("Unexpected release %+v", release)
+	}
+	if digest, _ := FileSHA256(binary); release.SHA256 != digest {
+		t.Errorf("Expected digest %s, got %s", digest, release.SHA256)
+	}
+
+	data, err := publisher.Binary()
+	if err != nil || string(data) != "worker v2" {
+		t.Errorf("Expected published binary, got %q, %v", data, err)
+	}
+
+	os.WriteFile(binary, []byte("worker v3"), 0755)
+	if _, err := publisher.Binary(); err == nil {
+		t.Error("Expected error for a binary replaced after publishing")
+	}
+
+	t.Setenv("WORKER_UPDATE_BINARY", filepath.Join(t.TempDir(), "missing"))
+	if NewPublisherFromEnv() != nil {
+		t.Error("Expected no publisher for a missing binary")
+	}
+}
+
+func TestInstall(t *testing.T) {
+	dir := t.TempDir()
+	source := filepath.Join(dir, "release")
+	os.WriteFile(source, []byte("worker v2"), 0644)
+	publisher, err := NewPublisher(source, "2.0.0", Version)
+	if err != nil {
+		t.Fatalf("NewPublisher failed: %v", err)
+	}
+	release := *publisher.Release()
+
+	target := filepath.Join(dir, "worker")
+	os.WriteFile(target, []byte("worker v1"), 0755)
+
+	if err := Install([]byte("worker v9"), release, target); err == nil {
+		t.Error("Expected error for a binary not matching the release")
+	}
+	if data, _ := os.ReadFile(target); string(data) != "worker v1" {
+		t.Errorf("Expected the binary to be kept after a failed install, got %q", data)
+	}
+
+	if err := Install([]byte("worker v2"), release, target); err != nil {
+		t.Fatalf("Install failed: %v", err)
+	}
+	info, err := os.Stat(target)
+	if data, _ := os.ReadFile(target); string(data) != "worker v2" || err != nil || info.Mode().Perm() != 0755 {
+		t.Errorf("Expected the executable to be replaced, got %q with mode %v", data, info.Mode())
+	}
+
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 2 {
+		t.Errorf("Expected no staged files to be left, got %d entries", len(entries))
+	}
+}
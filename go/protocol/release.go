@@ -0,0 +1,164 @@
+package protocol
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// Release describes a worker binary published by the coordinator
+type Release struct {
+	Version         string `json:"version"`
+	ProtocolVersion int    `json:"protocol_version"`
+	SHA256          string `json:"sha256"`
+	Size            int64  `json:"size"`
+}
+
+// Publisher publishes a worker binary for workers to update to
+type Publisher struct {
+	path    string
+	release Release
+}
+
+// NewPublisher publishes the binary at path as a release speaking the given
+// protocol version
+func NewPublisher(path, version string, protocolVersion int) (*Publisher, error) {
+	digest, size, err := fileDigest(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read worker binary: %v", err)
+	}
+
+	return &Publisher{
+		path: path,
+		release: Release{
+			Version:         version,
+			ProtocolVersion: protocolVersion,
+			SHA256:          digest,
+			Size:            size,
+		},
+	}, nil
+}
+
+// NewPublisherFromEnv publishes the binary at WORKER_UPDATE_BINARY as release
+// WORKER_UPDATE_VERSION speaking WORKER_UPDATE_PROTOCOL_VERSION (default:
+// Version), or returns nil if no binary is configured
+func NewPublisherFromEnv() *Publisher {
+	path := os.Getenv("WORKER_UPDATE_BINARY")
+	if path == "" {
+		return nil
+	}
+
+	protocolVersion := Version
+	if value := os.Getenv("WORKER_UPDATE_PROTOCOL_VERSION"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			log.Printf("Invalid WORKER_UPDATE_PROTOCOL_VERSION %q, using %d", value, Version)
+		} else {
+			protocolVersion = parsed
+		}
+	}
+
+	version := os.Getenv("WORKER_UPDATE_VERSION")
+	if version == "" {
+		version = "unversioned"
+	}
+
+	p, err := NewPublisher(path, version, protocolVersion)
+	if err != nil {
+		log.Printf("Worker self-update disabled: %v", err)
+		return nil
+	}
+
+	log.Printf("Publishing worker release %s (protocol %d, sha256 %s)", version, protocolVersion, p.release.SHA256)
+	return p
+}
+
+// Release returns the published release, or nil if nothing is published
+func (p *Publisher) Release() *Release {
+	if p == nil {
+		return nil
+	}
+	release := p.release
+	return &release
+}
+
+// Binary reads the published binary, checking it was not replaced since it
+// was published
+func (p *Publisher) Binary() ([]byte, error) {
+	if p == nil {
+		return nil, fmt.Errorf("no worker release is published")
+	}
+
+	data, err := os.ReadFile(p.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read worker binary: %v", err)
+	}
+	if digest(data) != p.release.SHA256 {
+		return nil, fmt.Errorf("worker binary %s changed since it was published", p.path)
+	}
+	return data, nil
+}
+
+// FileSHA256 returns the hex encoded SHA-256 digest of a file
+func FileSHA256(path string) (string, error) {
+	digest, _, err := fileDigest(path)
+	return digest, err
+}
+
+// fileDigest returns the hex encoded SHA-256 digest and the size of a file
+func fileDigest(path string) (string, int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), size, nil
+}
+
+// digest returns the hex encoded SHA-256 digest of data
+func digest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Install verifies a downloaded binary against its release and atomically
+// replaces the executable at target with it
+func Install(data []byte, release Release, target string) error {
+	if int64(len(data)) != release.Size || digest(data) != release.SHA256 {
+		return fmt.Errorf("downloaded binary does not match release %s", release.Version)
+	}
+
+	// Write next to the target so the rename cannot cross file systems
+	temp, err := os.CreateTemp(filepath.Dir(target), "."+filepath.Base(target)+".update-*")
+	if err != nil {
+		return fmt.Errorf("failed to stage worker binary: %v", err)
+	}
+	defer os.Remove(temp.Name())
+
+	if _, err := temp.Write(data); err != nil {
+		temp.Close()
+		return fmt.Errorf("failed to stage worker binary: %v", err)
+	}
+	if err := temp.Close(); err != nil {
+		return fmt.Errorf("failed to stage worker binary: %v", err)
+	}
+	if err := os.Chmod(temp.Name(), 0755); err != nil {
+		return fmt.Errorf("failed to stage worker binary: %v", err)
+	}
+
+	if err := os.Rename(temp.Name(), target); err != nil {
+		return fmt.Errorf("failed to replace worker binary: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,222 @@
+// Package provenance describes build artifacts with their checksums and the
+// toolchain that produced them, and renders SLSA provenance statements so
+// deployments can verify what they consume.
+package provenance
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"distributed-gradle-building/types"
+)
+
+// Statement and predicate types of the in-toto attestation format
+const (
+	StatementType = "https://in-toto.io/Statement/v1"
+	PredicateType = "https://slsa.dev/provenance/v1"
+	BuildType     = "https://github.com/milos85vasic/Distributed-Gradle-Building/gradle-build/v1"
+)
+
+// Toolchain identifies the Gradle and JDK versions used for a build
+type Toolchain struct {
+	GradleVersion string `json:"gradle_version"`
+	JDKVersion    string `json:"jdk_version"`
+}
+
+// DetectToolchain runs "--version" of the Gradle executable used for a build
+// in the project directory. Versions that cannot be determined are left empty.
+func DetectToolchain(executable, projectPath string) Toolchain {
+	cmd := exec.Command(executable, "--version")
+	cmd.Dir = projectPath
+
+	output, err := cmd.Output()
+	if err != nil {
+		return Toolchain{}
+	}
+
+	return ParseToolchain(string(output))
+}
+
+// ParseToolchain extracts the Gradle and JDK versions from "gradle --version"
+// output. Newer Gradle releases print "Launcher JVM" instead of "JVM".
+func ParseToolchain(output string) Toolchain {
+	var toolchain Toolchain
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+
+		switch {
+		case toolchain.GradleVersion == "" && strings.HasPrefix(line, "Gradle "):
+			toolchain.GradleVersion = strings.TrimSpace(strings.TrimPrefix(line, "Gradle "))
+		case toolchain.JDKVersion == "" && (strings.HasPrefix(line, "JVM:") || strings.HasPrefix(line, "Launcher JVM:")):
+			fields := strings.Fields(line[strings.Index(line, ":")+1:])
+			if len(fields) > 0 {
+				toolchain.JDKVersion = fields[0]
+			}
+		}
+	}
+
+	return toolchain
+}
+
+// Checksum returns the hex encoded SHA-256 digest and size of a file
+func Checksum(path string) (string, int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to open artifact: %v", err)
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to hash artifact %s: %v", path, err)
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), size, nil
+}
+
+// DescribeArtifacts checksums each artifact and records the worker and
+// toolchain that produced it
+func DescribeArtifacts(paths []string, workerID string, toolchain Toolchain) ([]types.Artifact, error) {
+	artifacts := make([]types.Artifact, 0, len(paths))
+	for _, path := range paths {
+		digest, size, err := Checksum(path)
+		if err != nil {
+			return nil, err
+		}
+
+		artifacts = append(artifacts, types.Artifact{
+			Path:          path,
+			SHA256:        digest,
+			Size:          size,
+			WorkerID:      workerID,
+			GradleVersion: toolchain.GradleVersion,
+			JDKVersion:    toolchain.JDKVersion,
+		})
+	}
+
+	return artifacts, nil
+}
+
+// Build holds what a provenance statement records about a finished build
+type Build struct {
+	ID          string
+	ProjectPath string
+	TaskName    string
+	Options     map[string]string
+	WorkerID    string
+	StartedOn   time.Time
+	FinishedOn  time.Time
+	Artifacts   []types.Artifact
+}
+
+// Statement is an in-toto statement carrying SLSA provenance
+type Statement struct {
+	Type          string    `json:"_type"`
+	Subject       []Subject `json:"subject"`
+	PredicateType string    `json:"predicateType"`
+	Predicate     Predicate `json:"predicate"`
+}
+
+// Subject is an artifact the statement is about
+type Subject struct {
+	Name   string            `json:"name"`
+	Digest map[string]string `json:"digest"`
+}
+
+// Predicate is the SLSA provenance predicate
+type Predicate struct {
+	BuildDefinition BuildDefinition `json:"buildDefinition"`
+	RunDetails      RunDetails      `json:"runDetails"`
+}
+
+// BuildDefinition describes the inputs of a build
+type BuildDefinition struct {
+	BuildType          string             `json:"buildType"`
+	ExternalParameters ExternalParameters `json:"externalParameters"`
+	InternalParameters InternalParameters `json:"internalParameters"`
+}
+
+// ExternalParameters are the parameters chosen by whoever submitted the build
+type ExternalParameters struct {
+	ProjectPath  string            `json:"project_path"`
+	TaskName     string            `json:"task_name"`
+	BuildOptions map[string]string `json:"build_options,omitempty"`
+}
+
+// InternalParameters are the parameters chosen by the build system
+type InternalParameters struct {
+	WorkerID string `json:"worker_id"`
+}
+
+// RunDetails describes the builder and the invocation
+type RunDetails struct {
+	Builder  Builder       `json:"builder"`
+	Metadata BuildMetadata `json:"metadata"`
+}
+
+// Builder identifies the worker and its toolchain
+type Builder struct {
+	ID      string            `json:"id"`
+	Version map[string]string `json:"version,omitempty"`
+}
+
+// BuildMetadata records the invocation ID and timing of a build
+type BuildMetadata struct {
+	InvocationID string    `json:"invocationId"`
+	StartedOn    time.Time `json:"startedOn"`
+	FinishedOn   time.Time `json:"finishedOn"`
+}
+
+// NewStatement renders the provenance of a finished build. The toolchain is
+// taken from the artifacts, which are all produced by the same worker.
+func NewStatement(build Build) Statement {
+	subjects := make([]Subject, 0, len(build.Artifacts))
+	version := map[string]string{}
+	for _, artifact := range build.Artifacts {
+		subjects = append(subjects, Subject{
+			Name:   artifact.Path,
+			Digest: map[string]string{"sha256": artifact.SHA256},
+		})
+		if artifact.GradleVersion != "" {
+			version["gradle"] = artifact.GradleVersion
+		}
+		if artifact.JDKVersion != "" {
+			version["jdk"] = artifact.JDKVersion
+		}
+	}
+
+	return Statement{
+		Type:          StatementType,
+		Subject:       subjects,
+		PredicateType: PredicateType,
+		Predicate: Predicate{
+			BuildDefinition: BuildDefinition{
+				BuildType: BuildType,
+				ExternalParameters: ExternalParameters{
+					ProjectPath:  build.ProjectPath,
+					TaskName:     build.TaskName,
+					BuildOptions: build.Options,
+				},
+				InternalParameters: InternalParameters{WorkerID: build.WorkerID},
+			},
+			RunDetails: RunDetails{
+				Builder: Builder{
+					ID:      "urn:distributed-gradle-building:worker:" + build.WorkerID,
+					Version: version,
+				},
+				Metadata: BuildMetadata{
+					InvocationID: build.ID,
+					StartedOn:    build.StartedOn,
+					FinishedOn:   build.FinishedOn,
+				},
+			},
+		},
+	}
+}
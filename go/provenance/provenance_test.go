@@ -0,0 +1,138 @@
+package provenance
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"distributed-gradle-building/types"
+)
+
+func TestParseToolchain(t *testing.T) {
+	tests := []struct {
+		name     string
+		output   string
+		expected Toolchain
+	}{
+		{
+			name: "gradle 8",
+			output: `
+------------------------------------------------------------
+Gradle 8.5
+------------------------------------------------------------
+
+Build time:   2023-11-29 14:08:57 UTC
+Kotlin:       1.9.20
+JVM:          17.0.9 (Eclipse Adoptium 17.0.9+9)
+OS:           Linux 6.1.0 amd64
+`,
+			expected: Toolchain{GradleVersion: "8.5", JDKVersion: "17.0.9"},
+		},
+		{
+			name: "launcher and daemon JVM",
+			output: `Gradle 8.14
+Launcher JVM:  21.0.2 (Oracle Corporation 21.0.2+13-58)
+Daemon JVM:    /opt/jdk-17 (no JDK specified, using current Java home)
+`,
+			expected: Toolchain{GradleVersion: "8.14", JDKVersion: "21.0.2"},
+		},
+		{
+			name:     "no gradle",
+			output:   "bash: gradle: command not found",
+			expected: Toolchain{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ParseToolchain(tt.output); got != tt.expected {
+				t.Errorf("Expected %+v, got %+v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestDescribeArtifacts(t *testing.T) {
+	content := []byte("jar contents")
+	path := filepath.Join(t.TempDir(), "app.jar")
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		t.Fatalf("Failed to write artifact: %v", err)
+	}
+
+	toolchain := Toolchain{GradleVersion: "8.5", JDKVersion: "17.0.9"}
+	artifacts, err := DescribeArtifacts([]string{path}, "worker-1", toolchain)
+	if err != nil {
+		t.Fatalf("DescribeArtifacts failed: %v", err)
+	}
+
+	sum := sha256.Sum256(content)
+	expected := types.Artifact{
+		Path:          path,
+		SHA256:        hex.EncodeToString(sum[:]),
+		Size:          int64(len(content)),
+		WorkerID:      "worker-1",
+		GradleVersion: "8.5",
+		JDKVersion:    "17.0.9",
+	}
+	if len(artifacts) != 1 || artifacts[0] != expected {
+		t.Errorf("Expected %+v, got %+v", expected, artifacts)
+	}
+
+	if _, err := DescribeArtifacts([]string{filepath.Join(t.TempDir(), "missing.jar")}, "worker-1", toolchain); err == nil {
+		t.Error("Expected error for missing artifact")
+	}
+}
+
+func TestNewStatement(t *testing.T) {
+	started := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	statement := NewStatement(Build{
+		ID:          "build-1",
+		ProjectPath: "/projects/app",
+		TaskName:    "build",
+		WorkerID:    "worker-1",
+		StartedOn:   started,
+		FinishedOn:  started.Add(time.Minute),
+		Artifacts: []types.Artifact{{
+			Path:          "/projects/app/build/libs/app.jar",
+			SHA256:        "abc123",
+			WorkerID:      "worker-1",
+			GradleVersion: "8.5",
+			JDKVersion:    "17.0.9",
+		}},
+	})
+
+	data, err := json.Marshal(statement)
+	if err != nil {
+		t.Fatalf("Failed to encode statement: %v", err)
+	}
+
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("Failed to decode statement: %v", err)
+	}
+
+	if decoded["_type"] != StatementType || decoded["predicateType"] != PredicateType {
+		t.Errorf("Unexpected statement header: %v", decoded)
+	}
+
+	subjects := decoded["subject"].([]interface{})
+	subject := subjects[0].(map[string]interface{})
+	if subject["name"] != "/projects/app/build/libs/app.jar" || subject["digest"].(map[string]interface{})["sha256"] != "abc123" {
+		t.Errorf("Unexpected subject: %v", subject)
+	}
+
+	builder := statement.Predicate.RunDetails.Builder
+	if builder.ID != "urn:distributed-gradle-building:worker:worker-1" {
+		t.Errorf("Unexpected builder ID %s", builder.ID)
+	}
+	if builder.Version["gradle"] != "8.5" || builder.Version["jdk"] != "17.0.9" {
+		t.Errorf("Unexpected builder version %v", builder.Version)
+	}
+	if statement.Predicate.RunDetails.Metadata.InvocationID != "build-1" {
+		t.Errorf("Unexpected invocation ID %s", statement.Predicate.RunDetails.Metadata.InvocationID)
+	}
+}
@@ -0,0 +1,242 @@
+package provisioner
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ec2APIVersion is the version of the EC2 query API the driver speaks
+const ec2APIVersion = "2016-11-15"
+
+// WorkerIDTag tags the instances launched for a worker with its ID
+const WorkerIDTag = "gradle-worker-id"
+
+// EC2 launches workers as Amazon EC2 instances, from a launch template or an
+// AMI. Requests are signed with the access key of the coordinator.
+type EC2 struct {
+	Region string
+	// Endpoint defaults to the EC2 endpoint of the region
+	Endpoint         string
+	LaunchTemplateID string
+	ImageID          string
+	InstanceType     string
+	SubnetID         string
+	SecurityGroupIDs []string
+	AccessKeyID      string
+	SecretAccessKey  string
+	SessionToken     string
+	Client           *http.Client
+}
+
+// NewEC2FromEnv returns an EC2 driver launching from EC2_LAUNCH_TEMPLATE_ID
+// or EC2_IMAGE_ID in AWS_REGION, authenticating with AWS_ACCESS_KEY_ID,
+// AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN
+func NewEC2FromEnv() (*EC2, error) {
+	ec2 := &EC2{
+		Region:           os.Getenv("AWS_REGION"),
+		Endpoint:         os.Getenv("EC2_ENDPOINT"),
+		LaunchTemplateID: os.Getenv("EC2_LAUNCH_TEMPLATE_ID"),
+		ImageID:          os.Getenv("EC2_IMAGE_ID"),
+		InstanceType:     os.Getenv("EC2_INSTANCE_TYPE"),
+		SubnetID:         os.Getenv("EC2_SUBNET_ID"),
+		AccessKeyID:      os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey:  os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:     os.Getenv("AWS_SESSION_TOKEN"),
+		Client:           &http.Client{Timeout: 30 * time.Second},
+	}
+	if groups := os.Getenv("EC2_SECURITY_GROUP_IDS"); groups != "" {
+		ec2.SecurityGroupIDs = strings.Split(groups, ",")
+	}
+
+	if ec2.Region == "" {
+		return nil, fmt.Errorf("AWS_REGION is required for the EC2 provisioner")
+	}
+	if ec2.LaunchTemplateID == "" && ec2.ImageID == "" {
+		return nil, fmt.Errorf("EC2_LAUNCH_TEMPLATE_ID or EC2_IMAGE_ID is required for the EC2 provisioner")
+	}
+	if ec2.AccessKeyID == "" || ec2.SecretAccessKey == "" {
+		return nil, fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY are required for the EC2 provisioner")
+	}
+	return ec2, nil
+}
+
+// Driver returns the name of the driver
+func (e *EC2) Driver() string {
+	return DriverEC2
+}
+
+// Launch runs one instance tagged with the worker ID
+func (e *EC2) Launch(workerID, userData string) (string, error) {
+	params := url.Values{
+		"Action":                            {"RunInstances"},
+		"MinCount":                          {"1"},
+		"MaxCount":                          {"1"},
+		"UserData":                          {base64.StdEncoding.EncodeToString([]byte(userData))},
+		"TagSpecification.1.ResourceType":   {"instance"},
+		"TagSpecification.1.Tag.1.Key":      {"Name"},
+		"TagSpecification.1.Tag.1.Value":    {workerID},
+		"TagSpecification.1.Tag.2.Key":      {WorkerIDTag},
+		"TagSpecification.1.Tag.2.Value":    {workerID},
+		"InstanceInitiatedShutdownBehavior": {"terminate"},
+	}
+	if e.LaunchTemplateID != "" {
+		params.Set("LaunchTemplate.LaunchTemplateId", e.LaunchTemplateID)
+	}
+	if e.ImageID != "" {
+		params.Set("ImageId", e.ImageID)
+	}
+	if e.InstanceType != "" {
+		params.Set("InstanceType", e.InstanceType)
+	}
+	if e.SubnetID != "" {
+		params.Set("SubnetId", e.SubnetID)
+	}
+	for i, group := range e.SecurityGroupIDs {
+		params.Set("SecurityGroupId."+strconv.Itoa(i+1), strings.TrimSpace(group))
+	}
+
+	var response struct {
+		Instances []struct {
+			ID string `xml:"instanceId"`
+		} `xml:"instancesSet>item"`
+	}
+	if err := e.call(params, &response); err != nil {
+		return "", err
+	}
+	if len(response.Instances) == 0 {
+		return "", fmt.Errorf("EC2 launched no instance")
+	}
+	return response.Instances[0].ID, nil
+}
+
+// Terminate terminates an instance
+func (e *EC2) Terminate(instanceID string) error {
+	return e.call(url.Values{"Action": {"TerminateInstances"}, "InstanceId.1": {instanceID}}, nil)
+}
+
+// call posts a signed query API request and decodes its XML response into
+// result
+func (e *EC2) call(params url.Values, result any) error {
+	params.Set("Version", ec2APIVersion)
+	endpoint := e.Endpoint
+	if endpoint == "" {
+		endpoint = "https://ec2." + e.Region + ".amazonaws.com"
+	}
+	body := params.Encode()
+
+	request, err := http.NewRequest("POST", strings.TrimRight(endpoint, "/")+"/", strings.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("invalid EC2 request: %v", err)
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	if e.SessionToken != "" {
+		request.Header.Set("X-Amz-Security-Token", e.SessionToken)
+	}
+	signV4(request, []byte(body), "ec2", e.Region, e.AccessKeyID, e.SecretAccessKey, time.Now())
+
+	client := e.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return fmt.Errorf("EC2 request failed: %v", err)
+	}
+	defer response.Body.Close()
+
+	data, err := io.ReadAll(response.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read EC2 response: %v", err)
+	}
+	if response.StatusCode != http.StatusOK {
+		var failure struct {
+			Errors []struct {
+				Code    string `xml:"Code"`
+				Message string `xml:"Message"`
+			} `xml:"Errors>Error"`
+		}
+		if xml.Unmarshal(data, &failure) == nil && len(failure.Errors) > 0 {
+			return fmt.Errorf("EC2 returned %s: %s", failure.Errors[0].Code, failure.Errors[0].Message)
+		}
+		return fmt.Errorf("EC2 returned %s", response.Status)
+	}
+	if result == nil {
+		return nil
+	}
+	if err := xml.Unmarshal(data, result); err != nil {
+		return fmt.Errorf("invalid EC2 response: %v", err)
+	}
+	return nil
+}
+
+// signV4 signs a request with AWS Signature Version 4, covering the host and
+// every header set on the request
+func signV4(request *http.Request, body []byte, service, region, accessKeyID, secretAccessKey string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	request.Header.Set("X-Amz-Date", amzDate)
+
+	headers := map[string]string{"host": request.URL.Host}
+	for name, values := range request.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := request.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		request.Method,
+		path,
+		request.URL.Query().Encode(),
+		canonicalHeaders.String(),
+		signedHeaders,
+		hashHex(body),
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hashHex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+secretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	request.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKeyID, scope, signedHeaders, signature))
+}
+
+func hashHex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,190 @@
+package provisioner
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// gceTokenURL is the metadata server endpoint returning an access token of
+// the instance's service account
+const gceTokenURL = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+
+// GCE launches workers as Google Compute Engine instances from an instance
+// template. Without a Token, requests are authorized with the service
+// account of the instance the coordinator runs on.
+type GCE struct {
+	Project          string
+	Zone             string
+	InstanceTemplate string
+	// Endpoint defaults to the Compute Engine API
+	Endpoint string
+	Token    string
+	// TokenURL defaults to the metadata server
+	TokenURL string
+	Client   *http.Client
+
+	mutex      sync.Mutex
+	token      string
+	tokenUntil time.Time
+}
+
+// NewGCEFromEnv returns a GCE driver launching from GCE_INSTANCE_TEMPLATE in
+// GCE_PROJECT and GCE_ZONE, authorized with GCE_ACCESS_TOKEN if set
+func NewGCEFromEnv() (*GCE, error) {
+	gce := &GCE{
+		Project:          os.Getenv("GCE_PROJECT"),
+		Zone:             os.Getenv("GCE_ZONE"),
+		InstanceTemplate: os.Getenv("GCE_INSTANCE_TEMPLATE"),
+		Endpoint:         os.Getenv("GCE_ENDPOINT"),
+		Token:            os.Getenv("GCE_ACCESS_TOKEN"),
+		Client:           &http.Client{Timeout: 30 * time.Second},
+	}
+	if gce.Project == "" || gce.Zone == "" || gce.InstanceTemplate == "" {
+		return nil, fmt.Errorf("GCE_PROJECT, GCE_ZONE and GCE_INSTANCE_TEMPLATE are required for the GCE provisioner")
+	}
+	return gce, nil
+}
+
+// Driver returns the name of the driver
+func (g *GCE) Driver() string {
+	return DriverGCE
+}
+
+// Launch inserts an instance named after the worker, with the user data as
+// its startup script
+func (g *GCE) Launch(workerID, userData string) (string, error) {
+	template := g.InstanceTemplate
+	if !strings.Contains(template, "/") {
+		template = "projects/" + g.Project + "/global/instanceTemplates/" + template
+	}
+	instance := map[string]any{
+		"name": workerID,
+		"labels": map[string]string{
+			WorkerIDTag: workerID,
+		},
+		"metadata": map[string]any{
+			"items": []map[string]string{{"key": "startup-script", "value": userData}},
+		},
+	}
+	path := "/instances?sourceInstanceTemplate=" + url.QueryEscape(template)
+	if err := g.call("POST", path, instance); err != nil {
+		return "", err
+	}
+	return workerID, nil
+}
+
+// Terminate deletes an instance
+func (g *GCE) Terminate(instanceID string) error {
+	return g.call("DELETE", "/instances/"+url.PathEscape(instanceID), nil)
+}
+
+// call sends a request to the instances of the zone
+func (g *GCE) call(method, path string, body any) error {
+	token, err := g.accessToken()
+	if err != nil {
+		return err
+	}
+
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("invalid GCE request: %v", err)
+		}
+		reader = bytes.NewReader(data)
+	}
+	endpoint := g.Endpoint
+	if endpoint == "" {
+		endpoint = "https://compute.googleapis.com/compute/v1"
+	}
+	requestURL := strings.TrimRight(endpoint, "/") + "/projects/" + url.PathEscape(g.Project) + "/zones/" + url.PathEscape(g.Zone) + path
+	request, err := http.NewRequest(method, requestURL, reader)
+	if err != nil {
+		return fmt.Errorf("invalid GCE request: %v", err)
+	}
+	request.Header.Set("Authorization", "Bearer "+token)
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+
+	response, err := g.client().Do(request)
+	if err != nil {
+		return fmt.Errorf("GCE request failed: %v", err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		var failure struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if json.NewDecoder(response.Body).Decode(&failure) == nil && failure.Error.Message != "" {
+			return fmt.Errorf("GCE returned %s: %s", response.Status, failure.Error.Message)
+		}
+		return fmt.Errorf("GCE returned %s", response.Status)
+	}
+	return nil
+}
+
+// accessToken returns the configured token, or the service account token
+// from the metadata server until shortly before it expires
+func (g *GCE) accessToken() (string, error) {
+	if g.Token != "" {
+		return g.Token, nil
+	}
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if g.token != "" && time.Now().Before(g.tokenUntil) {
+		return g.token, nil
+	}
+
+	tokenURL := g.TokenURL
+	if tokenURL == "" {
+		tokenURL = gceTokenURL
+	}
+	request, err := http.NewRequest("GET", tokenURL, nil)
+	if err != nil {
+		return "", fmt.Errorf("invalid token request: %v", err)
+	}
+	request.Header.Set("Metadata-Flavor", "Google")
+
+	response, err := g.client().Do(request)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch GCE access token: %v", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("metadata server returned %s for the access token", response.Status)
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&token); err != nil || token.AccessToken == "" {
+		return "", fmt.Errorf("invalid access token response: %v", err)
+	}
+
+	// Refresh a minute early so no request goes out with an expired token
+	g.token = token.AccessToken
+	g.tokenUntil = time.Now().Add(time.Duration(token.ExpiresIn)*time.Second - time.Minute)
+	return g.token, nil
+}
+
+func (g *GCE) client() *http.Client {
+	if g.Client == nil {
+		return http.DefaultClient
+	}
+	return g.Client
+}
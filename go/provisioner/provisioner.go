@@ -0,0 +1,293 @@
+// Package provisioner launches worker instances in the cloud when the
+// coordinator scales up and terminates them when it scales down. Each
+// instance boots with user data starting a worker that registers with the
+// coordinator under the worker ID it was launched for, so the coordinator
+// knows which instance to terminate for an idle worker.
+package provisioner
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Provisioner drivers
+const (
+	DriverEC2 = "ec2"
+	DriverGCE = "gce"
+)
+
+// PendingTimeout is how long a launched instance counts as pending while its
+// worker has not registered yet. Instances that take longer to boot are
+// assumed to have failed and no longer hold back further launches.
+const PendingTimeout = 10 * time.Minute
+
+// Provisioner launches and terminates the instances of one cloud
+type Provisioner interface {
+	// Driver returns the name of the driver
+	Driver() string
+	// Launch starts an instance booting with userData and returns its ID
+	Launch(workerID, userData string) (string, error)
+	// Terminate terminates the instance with the ID returned by Launch
+	Terminate(instanceID string) error
+}
+
+// Instance is an instance launched for a worker
+type Instance struct {
+	ID         string    `json:"id"`
+	WorkerID   string    `json:"worker_id"`
+	LaunchedAt time.Time `json:"launched_at"`
+}
+
+// Limits caps the spend of a fleet. HourlyCost is what one instance costs per
+// hour; with a Budget, no more instances run than the budget pays for per
+// hour. Zero limits are unlimited.
+type Limits struct {
+	MaxInstances int     `json:"max_instances"`
+	HourlyCost   float64 `json:"hourly_cost"`
+	Budget       float64 `json:"budget"`
+}
+
+// maxInstances returns the most instances the limits allow, or -1 without a
+// limit
+func (l Limits) maxInstances() int {
+	limit := -1
+	if l.MaxInstances > 0 {
+		limit = l.MaxInstances
+	}
+	if l.Budget > 0 && l.HourlyCost > 0 {
+		if affordable := int(l.Budget / l.HourlyCost); limit < 0 || affordable < limit {
+			limit = affordable
+		}
+	}
+	return limit
+}
+
+// UserData holds what the user data template of an instance may refer to
+type UserData struct {
+	WorkerID           string
+	CoordinatorHost    string
+	CoordinatorRPCPort int
+	Pool               string
+}
+
+// DefaultUserData starts the worker installed in the instance's image with
+// the settings it registers with
+const DefaultUserData = `#!/bin/sh
+export WORKER_ID={{.WorkerID}}
+export COORDINATOR_HOST={{.CoordinatorHost}}
+export COORDINATOR_RPC_PORT={{.CoordinatorRPCPort}}
+{{- if .Pool}}
+export WORKER_POOL={{.Pool}}
+{{- end}}
+exec /usr/local/bin/worker
+`
+
+// Fleet launches instances through a provisioner within its limits and keeps
+// track of them by worker ID
+type Fleet struct {
+	provisioner Provisioner
+	limits      Limits
+	userData    *template.Template
+	settings    UserData
+	mutex       sync.Mutex
+	instances   map[string]Instance
+	now         func() time.Time
+}
+
+// NewFleet returns a fleet launching instances through provisioner. The
+// userData template is rendered with settings and the worker ID of each
+// instance; an empty template uses DefaultUserData.
+func NewFleet(provisioner Provisioner, limits Limits, userData string, settings UserData) (*Fleet, error) {
+	if userData == "" {
+		userData = DefaultUserData
+	}
+	parsed, err := template.New("user-data").Option("missingkey=error").Parse(userData)
+	if err != nil {
+		return nil, fmt.Errorf("invalid user data template: %v", err)
+	}
+	return &Fleet{
+		provisioner: provisioner,
+		limits:      limits,
+		userData:    parsed,
+		settings:    settings,
+		instances:   make(map[string]Instance),
+		now:         time.Now,
+	}, nil
+}
+
+// Driver returns the name of the fleet's driver
+func (f *Fleet) Driver() string {
+	return f.provisioner.Driver()
+}
+
+// Launch launches up to count instances, as many as the limits allow, and
+// returns those launched. An error is only returned with the instances
+// launched before the provisioner failed.
+func (f *Fleet) Launch(count int) ([]Instance, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if limit := f.limits.maxInstances(); limit >= 0 && count > limit-len(f.instances) {
+		count = max(limit-len(f.instances), 0)
+	}
+
+	var launched []Instance
+	for range count {
+		now := f.now()
+		workerID := f.workerID(now)
+		settings := f.settings
+		settings.WorkerID = workerID
+
+		var userData bytes.Buffer
+		if err := f.userData.Execute(&userData, settings); err != nil {
+			return launched, fmt.Errorf("failed to render user data: %v", err)
+		}
+		id, err := f.provisioner.Launch(workerID, userData.String())
+		if err != nil {
+			return launched, fmt.Errorf("failed to launch %s instance: %v", f.provisioner.Driver(), err)
+		}
+
+		instance := Instance{ID: id, WorkerID: workerID, LaunchedAt: now}
+		f.instances[workerID] = instance
+		launched = append(launched, instance)
+		log.Printf("Launched %s instance %s for worker %s", f.provisioner.Driver(), id, workerID)
+	}
+	return launched, nil
+}
+
+// workerID returns a worker ID for an instance launched at now, unique among
+// the fleet's instances and valid as an instance name in every cloud
+func (f *Fleet) workerID(now time.Time) string {
+	for i := 0; ; i++ {
+		workerID := fmt.Sprintf("%s-worker-%d-%d", f.provisioner.Driver(), now.Unix(), i)
+		if _, exists := f.instances[workerID]; !exists {
+			return workerID
+		}
+	}
+}
+
+// Terminate terminates the instance of a worker, returning false if the
+// fleet did not launch it
+func (f *Fleet) Terminate(workerID string) (bool, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	instance, exists := f.instances[workerID]
+	if !exists {
+		return false, nil
+	}
+	if err := f.provisioner.Terminate(instance.ID); err != nil {
+		return true, fmt.Errorf("failed to terminate %s instance %s: %v", f.provisioner.Driver(), instance.ID, err)
+	}
+	delete(f.instances, workerID)
+	log.Printf("Terminated %s instance %s of worker %s", f.provisioner.Driver(), instance.ID, workerID)
+	return true, nil
+}
+
+// Manages reports whether the fleet launched the instance of a worker
+func (f *Fleet) Manages(workerID string) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	_, exists := f.instances[workerID]
+	return exists
+}
+
+// Pending counts the instances launched within PendingTimeout whose workers
+// have not registered yet
+func (f *Fleet) Pending(registered func(workerID string) bool) int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	pending := 0
+	for workerID, instance := range f.instances {
+		if f.now().Sub(instance.LaunchedAt) < PendingTimeout && !registered(workerID) {
+			pending++
+		}
+	}
+	return pending
+}
+
+// Instances returns the instances of the fleet, oldest first
+func (f *Fleet) Instances() []Instance {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	instances := make([]Instance, 0, len(f.instances))
+	for _, instance := range f.instances {
+		instances = append(instances, instance)
+	}
+	sort.Slice(instances, func(i, j int) bool {
+		if !instances[i].LaunchedAt.Equal(instances[j].LaunchedAt) {
+			return instances[i].LaunchedAt.Before(instances[j].LaunchedAt)
+		}
+		return instances[i].WorkerID < instances[j].WorkerID
+	})
+	return instances
+}
+
+// FromEnv returns the fleet of the driver selected by PROVISIONER, ec2 or
+// gce, or nil if PROVISIONER is unset. PROVISIONER_MAX_INSTANCES,
+// PROVISIONER_INSTANCE_HOURLY_COST and PROVISIONER_HOURLY_BUDGET set its
+// limits. Instances start a worker registering with
+// PROVISIONER_COORDINATOR_HOST on port PROVISIONER_COORDINATOR_RPC_PORT in
+// PROVISIONER_WORKER_POOL, unless PROVISIONER_USER_DATA_FILE holds another
+// user data template.
+func FromEnv() (*Fleet, error) {
+	var provisioner Provisioner
+	var err error
+	switch driver := os.Getenv("PROVISIONER"); driver {
+	case "":
+		return nil, nil
+	case DriverEC2:
+		provisioner, err = NewEC2FromEnv()
+	case DriverGCE:
+		provisioner, err = NewGCEFromEnv()
+	default:
+		return nil, fmt.Errorf("unknown provisioner %q", driver)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	limits := Limits{MaxInstances: 10}
+	if value, err := strconv.Atoi(os.Getenv("PROVISIONER_MAX_INSTANCES")); err == nil && value >= 0 {
+		limits.MaxInstances = value
+	}
+	if value, err := strconv.ParseFloat(os.Getenv("PROVISIONER_INSTANCE_HOURLY_COST"), 64); err == nil && value >= 0 {
+		limits.HourlyCost = value
+	}
+	if value, err := strconv.ParseFloat(os.Getenv("PROVISIONER_HOURLY_BUDGET"), 64); err == nil && value >= 0 {
+		limits.Budget = value
+	}
+
+	settings := UserData{
+		CoordinatorHost:    os.Getenv("PROVISIONER_COORDINATOR_HOST"),
+		CoordinatorRPCPort: 8081,
+		Pool:               os.Getenv("PROVISIONER_WORKER_POOL"),
+	}
+	if settings.CoordinatorHost == "" {
+		settings.CoordinatorHost, _ = os.Hostname()
+	}
+	if value, err := strconv.Atoi(os.Getenv("PROVISIONER_COORDINATOR_RPC_PORT")); err == nil && value > 0 {
+		settings.CoordinatorRPCPort = value
+	}
+
+	var userData string
+	if path := os.Getenv("PROVISIONER_USER_DATA_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read user data template: %v", err)
+		}
+		userData = string(data)
+	}
+
+	return NewFleet(provisioner, limits, userData, settings)
+}
@@ -0,0 +1,275 @@
+package provisioner
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeProvisioner records the instances it launches and terminates
+type fakeProvisioner struct {
+	launched   map[string]string
+	terminated []string
+	fail       bool
+}
+
+func (p *fakeProvisioner) Driver() string {
+	return "fake"
+}
+
+func (p *fakeProvisioner) Launch(workerID, userData string) (string, error) {
+	if p.fail {
+		return "", fmt.Errorf("quota exceeded")
+	}
+	if p.launched == nil {
+		p.launched = make(map[string]string)
+	}
+	id := fmt.Sprintf("i-%d", len(p.launched))
+	p.launched[id] = userData
+	return id, nil
+}
+
+func (p *fakeProvisioner) Terminate(instanceID string) error {
+	p.terminated = append(p.terminated, instanceID)
+	return nil
+}
+
+func TestFleetLimits(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		limits   Limits
+		expected int
+	}{
+		{"unlimited", Limits{}, 5},
+		{"max instances", Limits{MaxInstances: 3}, 3},
+		{"budget", Limits{MaxInstances: 10, HourlyCost: 0.4, Budget: 1}, 2},
+		{"budget without cost", Limits{MaxInstances: 4, Budget: 1}, 4},
+	} {
+		fleet, err := NewFleet(&fakeProvisioner{}, test.limits, "", UserData{CoordinatorHost: "coordinator", CoordinatorRPCPort: 8081})
+		if err != nil {
+			t.Fatalf("NewFleet failed: %v", err)
+		}
+		if launched, err := fleet.Launch(5); err != nil || len(launched) != test.expected {
+			t.Errorf("%s: expected %d instances, got %d: %v", test.name, test.expected, len(launched), err)
+		}
+		// A full fleet launches nothing more
+		if launched, err := fleet.Launch(5); test.limits.maxInstances() >= 0 && (err != nil || len(launched) != 0) {
+			t.Errorf("%s: expected no more instances, got %d: %v", test.name, len(launched), err)
+		}
+	}
+}
+
+func TestFleetLaunchAndTerminate(t *testing.T) {
+	provisioner := &fakeProvisioner{}
+	fleet, err := NewFleet(provisioner, Limits{MaxInstances: 5}, "", UserData{CoordinatorHost: "coordinator", CoordinatorRPCPort: 8081, Pool: "android"})
+	if err != nil {
+		t.Fatalf("NewFleet failed: %v", err)
+	}
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	fleet.now = func() time.Time { return now }
+
+	launched, err := fleet.Launch(2)
+	if err != nil || len(launched) != 2 {
+		t.Fatalf("Expected 2 instances, got %+v: %v", launched, err)
+	}
+	if launched[0].WorkerID == launched[1].WorkerID {
+		t.Errorf("Expected unique worker IDs, got %s twice", launched[0].WorkerID)
+	}
+	userData := provisioner.launched[launched[0].ID]
+	for _, line := range []string{"export WORKER_ID=" + launched[0].WorkerID, "export COORDINATOR_HOST=coordinator", "export COORDINATOR_RPC_PORT=8081", "export WORKER_POOL=android"} {
+		if !strings.Contains(userData, line+"\n") {
+			t.Errorf("Expected user data to contain %q, got:\n%s", line, userData)
+		}
+	}
+
+	registered := func(workerID string) bool { return workerID == launched[0].WorkerID }
+	if pending := fleet.Pending(registered); pending != 1 {
+		t.Errorf("Expected 1 pending instance, got %d", pending)
+	}
+	now = now.Add(PendingTimeout)
+	if pending := fleet.Pending(registered); pending != 0 {
+		t.Errorf("Expected instances booting for too long not to be pending, got %d", pending)
+	}
+
+	if managed, err := fleet.Terminate("worker-1"); managed || err != nil {
+		t.Errorf("Expected a worker the fleet did not launch to be left alone, got %v: %v", managed, err)
+	}
+	if managed, err := fleet.Terminate(launched[0].WorkerID); !managed || err != nil {
+		t.Errorf("Expected the instance to be terminated, got %v: %v", managed, err)
+	}
+	if len(provisioner.terminated) != 1 || provisioner.terminated[0] != launched[0].ID {
+		t.Errorf("Expected instance %s to be terminated, got %v", launched[0].ID, provisioner.terminated)
+	}
+	if instances := fleet.Instances(); len(instances) != 1 || instances[0] != launched[1] || fleet.Manages(launched[0].WorkerID) {
+		t.Errorf("Expected only %+v to be left, got %+v", launched[1], instances)
+	}
+
+	provisioner.fail = true
+	if launched, err := fleet.Launch(1); err == nil || len(launched) != 0 {
+		t.Errorf("Expected the provisioner's error, got %+v: %v", launched, err)
+	}
+}
+
+func TestNewFleetRejectsInvalidUserData(t *testing.T) {
+	if _, err := NewFleet(&fakeProvisioner{}, Limits{}, "{{.WorkerID", UserData{}); err == nil {
+		t.Error("Expected an error for an invalid template")
+	}
+}
+
+func TestSignV4(t *testing.T) {
+	// The get-vanilla example of the AWS Signature Version 4 test suite
+	request, _ := http.NewRequest("GET", "https://example.amazonaws.com/", nil)
+	signV4(request, nil, "service", "us-east-1", "AKIDEXAMPLE", "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+
+	expected := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"
+	if authorization := request.Header.Get("Authorization"); authorization != expected {
+		t.Errorf("Expected %s, got %s", expected, authorization)
+	}
+}
+
+func TestEC2(t *testing.T) {
+	var requests []url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/") || r.Header.Get("X-Amz-Security-Token") != "session" {
+			t.Errorf("Expected a signed request, got %v", r.Header)
+		}
+		r.ParseForm()
+		requests = append(requests, r.PostForm)
+		switch r.PostForm.Get("Action") {
+		case "RunInstances":
+			w.Write([]byte(`<RunInstancesResponse><instancesSet><item><instanceId>i-0abc</instanceId></item></instancesSet></RunInstancesResponse>`))
+		case "TerminateInstances":
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`<Response><Errors><Error><Code>InvalidInstanceID.NotFound</Code><Message>The instance ID 'i-0def' does not exist</Message></Error></Errors></Response>`))
+		}
+	}))
+	defer server.Close()
+
+	ec2 := &EC2{
+		Region:           "eu-west-1",
+		Endpoint:         server.URL,
+		LaunchTemplateID: "lt-0123",
+		SecurityGroupIDs: []string{"sg-1", "sg-2"},
+		AccessKeyID:      "AKID",
+		SecretAccessKey:  "secret",
+		SessionToken:     "session",
+	}
+	id, err := ec2.Launch("ec2-worker-1-0", "#!/bin/sh\n")
+	if err != nil || id != "i-0abc" {
+		t.Fatalf("Expected instance i-0abc, got %q: %v", id, err)
+	}
+	params := requests[0]
+	for key, value := range map[string]string{
+		"Version":                         ec2APIVersion,
+		"LaunchTemplate.LaunchTemplateId": "lt-0123",
+		"SecurityGroupId.2":               "sg-2",
+		"TagSpecification.1.Tag.2.Key":    WorkerIDTag,
+		"TagSpecification.1.Tag.2.Value":  "ec2-worker-1-0",
+		"UserData":                        base64.StdEncoding.EncodeToString([]byte("#!/bin/sh\n")),
+	} {
+		if params.Get(key) != value {
+			t.Errorf("Expected %s=%s, got %q", key, value, params.Get(key))
+		}
+	}
+
+	err = ec2.Terminate("i-0def")
+	if err == nil || !strings.Contains(err.Error(), "InvalidInstanceID.NotFound") {
+		t.Errorf("Expected the EC2 error, got %v", err)
+	}
+	if requests[1].Get("InstanceId.1") != "i-0def" {
+		t.Errorf("Expected instance i-0def to be terminated, got %v", requests[1])
+	}
+}
+
+func TestGCE(t *testing.T) {
+	tokens := 0
+	metadata := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata-Flavor") != "Google" {
+			http.Error(w, "missing header", http.StatusForbidden)
+			return
+		}
+		tokens++
+		w.Write([]byte(`{"access_token": "token", "expires_in": 3599, "token_type": "Bearer"}`))
+	}))
+	defer metadata.Close()
+
+	var inserted map[string]any
+	var deleted string
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			t.Errorf("Expected the metadata server's token, got %q", r.Header.Get("Authorization"))
+		}
+		switch {
+		case r.Method == "POST" && r.URL.Path == "/projects/builds/zones/europe-west1-b/instances":
+			if template := r.URL.Query().Get("sourceInstanceTemplate"); template != "projects/builds/global/instanceTemplates/gradle-worker" {
+				t.Errorf("Expected the instance template, got %q", template)
+			}
+			json.NewDecoder(r.Body).Decode(&inserted)
+			w.Write([]byte(`{"kind": "compute#operation", "status": "RUNNING"}`))
+		case r.Method == "DELETE":
+			deleted = r.URL.Path
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error": {"code": 404, "message": "The resource was not found"}}`))
+		}
+	}))
+	defer api.Close()
+
+	gce := &GCE{Project: "builds", Zone: "europe-west1-b", InstanceTemplate: "gradle-worker", Endpoint: api.URL, TokenURL: metadata.URL}
+	id, err := gce.Launch("gce-worker-1-0", "#!/bin/sh\n")
+	if err != nil || id != "gce-worker-1-0" {
+		t.Fatalf("Expected instance gce-worker-1-0, got %q: %v", id, err)
+	}
+	items := inserted["metadata"].(map[string]any)["items"].([]any)
+	if inserted["name"] != "gce-worker-1-0" || items[0].(map[string]any)["value"] != "#!/bin/sh\n" {
+		t.Errorf("Expected the worker's name and startup script, got %v", inserted)
+	}
+
+	err = gce.Terminate("gce-worker-1-0")
+	if err == nil || !strings.Contains(err.Error(), "The resource was not found") {
+		t.Errorf("Expected the GCE error, got %v", err)
+	}
+	if deleted != "/projects/builds/zones/europe-west1-b/instances/gce-worker-1-0" {
+		t.Errorf("Expected the instance to be deleted, got %q", deleted)
+	}
+	if tokens != 1 {
+		t.Errorf("Expected the access token to be fetched once, got %d", tokens)
+	}
+}
+
+func TestFromEnv(t *testing.T) {
+	if fleet, err := FromEnv(); fleet != nil || err != nil {
+		t.Errorf("Expected no fleet without a provisioner, got %v: %v", fleet, err)
+	}
+
+	t.Setenv("PROVISIONER", "azure")
+	if _, err := FromEnv(); err == nil {
+		t.Error("Expected an error for an unknown provisioner")
+	}
+
+	t.Setenv("PROVISIONER", DriverEC2)
+	t.Setenv("AWS_REGION", "eu-west-1")
+	if _, err := FromEnv(); err == nil {
+		t.Error("Expected an error for EC2 without an image or launch template")
+	}
+
+	t.Setenv("PROVISIONER", DriverGCE)
+	t.Setenv("GCE_PROJECT", "builds")
+	t.Setenv("GCE_ZONE", "europe-west1-b")
+	t.Setenv("GCE_INSTANCE_TEMPLATE", "gradle-worker")
+	t.Setenv("PROVISIONER_MAX_INSTANCES", "4")
+	t.Setenv("PROVISIONER_INSTANCE_HOURLY_COST", "0.5")
+	t.Setenv("PROVISIONER_HOURLY_BUDGET", "1.5")
+	fleet, err := FromEnv()
+	if err != nil {
+		t.Fatalf("FromEnv failed: %v", err)
+	}
+	if fleet.Driver() != DriverGCE || fleet.limits != (Limits{MaxInstances: 4, HourlyCost: 0.5, Budget: 1.5}) || fleet.limits.maxInstances() != 3 {
+		t.Errorf("Expected a GCE fleet of up to 3 instances, got %s with %+v", fleet.Driver(), fleet.limits)
+	}
+}
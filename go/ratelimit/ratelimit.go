@@ -0,0 +1,286 @@
+package ratelimit
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"distributed-gradle-building/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Quota limits the request rate of a single client
+type Quota struct {
+	Tenant            string  `json:"tenant"`
+	RequestsPerSecond float64 `json:"requests_per_second"`
+	Burst             int     `json:"burst"`
+}
+
+// Config configures HTTP rate limiting. Default applies to every client
+// without an entry in Quotas, which is keyed by API key.
+type Config struct {
+	Enabled     bool             `json:"enabled"`
+	Default     Quota            `json:"default"`
+	Quotas      map[string]Quota `json:"quotas"`
+	ExemptPaths []string         `json:"exempt_paths"`
+}
+
+// bucket is a token bucket for one client
+type bucket struct {
+	tokens   float64
+	quota    Quota
+	lastSeen time.Time
+}
+
+// Limiter applies token-bucket rate limiting per client
+type Limiter struct {
+	config    Config
+	buckets   map[string]*bucket
+	lastPrune time.Time
+	mutex     sync.Mutex
+	now       func() time.Time
+
+	throttled *prometheus.CounterVec
+}
+
+// DefaultConfig returns the default rate limiting configuration
+func DefaultConfig() Config {
+	return Config{
+		Enabled: true,
+		Default: Quota{
+			Tenant:            "default",
+			RequestsPerSecond: 10,
+			Burst:             20,
+		},
+		Quotas:      make(map[string]Quota),
+		ExemptPaths: []string{"/health", "/api/health", "/metrics"},
+	}
+}
+
+// LoadConfigFromEnv loads rate limiting configuration from environment variables.
+// RATE_LIMIT_QUOTAS holds a JSON object of per API key quotas.
+func LoadConfigFromEnv() (Config, error) {
+	config := DefaultConfig()
+
+	if value, err := strconv.ParseBool(os.Getenv("RATE_LIMIT_ENABLED")); err == nil {
+		config.Enabled = value
+	}
+	if value, err := strconv.ParseFloat(os.Getenv("RATE_LIMIT_REQUESTS_PER_SECOND"), 64); err == nil && value > 0 {
+		config.Default.RequestsPerSecond = value
+	}
+	if value, err := strconv.Atoi(os.Getenv("RATE_LIMIT_BURST")); err == nil && value > 0 {
+		config.Default.Burst = value
+	}
+
+	if quotas := os.Getenv("RATE_LIMIT_QUOTAS"); quotas != "" {
+		if err := json.Unmarshal([]byte(quotas), &config.Quotas); err != nil {
+			return config, fmt.Errorf("failed to parse RATE_LIMIT_QUOTAS: %v", err)
+		}
+	}
+
+	return config, nil
+}
+
+// NewLimiter creates a rate limiter reporting metrics for the named service
+func NewLimiter(config Config, service string) *Limiter {
+	if config.Quotas == nil {
+		config.Quotas = make(map[string]Quota)
+	}
+
+	return &Limiter{
+		config:  config,
+		buckets: make(map[string]*bucket),
+		now:     time.Now,
+		throttled: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name:        "http_requests_throttled_total",
+				Help:        "Total number of HTTP requests rejected by rate limiting",
+				ConstLabels: prometheus.Labels{"service": service},
+			},
+			[]string{"tenant"},
+		),
+	}
+}
+
+// Describe implements prometheus.Collector
+func (l *Limiter) Describe(ch chan<- *prometheus.Desc) {
+	l.throttled.Describe(ch)
+}
+
+// Collect implements prometheus.Collector
+func (l *Limiter) Collect(ch chan<- prometheus.Metric) {
+	l.throttled.Collect(ch)
+}
+
+// Decision is the outcome of a rate limit check
+type Decision struct {
+	Allowed    bool
+	Tenant     string
+	Limit      int
+	Remaining  int
+	RetryAfter time.Duration
+	Reset      time.Duration
+}
+
+// Allow takes a token from the bucket of a client. Clients presenting an API
+// key with a configured quota are limited by that quota, others by the default.
+func (l *Limiter) Allow(client, apiKey string) Decision {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := l.now()
+	l.pruneBuckets(now)
+
+	quota, configured := l.config.Quotas[apiKey]
+	if apiKey == "" || !configured {
+		quota = l.config.Default
+	} else if quota.Tenant != "" {
+		// API keys of the same tenant share one bucket
+		client = "tenant:" + quota.Tenant
+	}
+	if quota.Tenant == "" {
+		quota.Tenant = l.config.Default.Tenant
+	}
+
+	b, exists := l.buckets[client]
+	if !exists {
+		b = &bucket{tokens: float64(quota.Burst), quota: quota, lastSeen: now}
+		l.buckets[client] = b
+	}
+
+	// Refill tokens for the time elapsed since the last request
+	elapsed := now.Sub(b.lastSeen).Seconds()
+	b.tokens = math.Min(float64(quota.Burst), b.tokens+elapsed*quota.RequestsPerSecond)
+	b.quota = quota
+	b.lastSeen = now
+
+	decision := Decision{Tenant: quota.Tenant, Limit: quota.Burst}
+	if b.tokens >= 1 {
+		b.tokens--
+		decision.Allowed = true
+	} else if quota.RequestsPerSecond > 0 {
+		decision.RetryAfter = time.Duration((1 - b.tokens) / quota.RequestsPerSecond * float64(time.Second))
+	}
+
+	decision.Remaining = int(b.tokens)
+	if quota.RequestsPerSecond > 0 {
+		decision.Reset = time.Duration((float64(quota.Burst) - b.tokens) / quota.RequestsPerSecond * float64(time.Second))
+	}
+
+	return decision
+}
+
+// Tenant returns the tenant of the API key a request presents, or the
+// default tenant for requests without a key of a configured quota
+func (l *Limiter) Tenant(r *http.Request) string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	apiKey := apiKeyFromRequest(r)
+	if quota, configured := l.config.Quotas[apiKey]; apiKey != "" && configured && quota.Tenant != "" {
+		return quota.Tenant
+	}
+	return l.config.Default.Tenant
+}
+
+// pruneBuckets drops buckets idle long enough to have refilled completely.
+// Must be called with the mutex held.
+func (l *Limiter) pruneBuckets(now time.Time) {
+	if now.Sub(l.lastPrune) < time.Minute {
+		return
+	}
+	l.lastPrune = now
+
+	for client, b := range l.buckets {
+		if b.quota.RequestsPerSecond <= 0 {
+			continue
+		}
+		refill := time.Duration(float64(b.quota.Burst) / b.quota.RequestsPerSecond * float64(time.Second))
+		if now.Sub(b.lastSeen) > refill {
+			delete(l.buckets, client)
+		}
+	}
+}
+
+// Middleware rejects requests exceeding the client's quota with 429 Too Many Requests
+func (l *Limiter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !l.config.Enabled || l.isExempt(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		apiKey := apiKeyFromRequest(r)
+		client := "key:" + apiKey
+		if apiKey == "" {
+			client = "ip:" + clientIP(r)
+		}
+
+		decision := l.Allow(client, apiKey)
+
+		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(decision.Limit))
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(decision.Remaining))
+		w.Header().Set("X-RateLimit-Reset", strconv.Itoa(ceilSeconds(decision.Reset)))
+
+		if !decision.Allowed {
+			l.throttled.WithLabelValues(decision.Tenant).Inc()
+
+			retryAfter := ceilSeconds(decision.RetryAfter)
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+
+			apiErr := errors.NewAPIError(errors.ErrCodeRateLimited, "Rate limit exceeded").
+				WithDetail("tenant", decision.Tenant).
+				WithDetail("retry_after_seconds", retryAfter)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(apiErr.HTTPStatus)
+			json.NewEncoder(w).Encode(apiErr)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isExempt reports whether a path bypasses rate limiting
+func (l *Limiter) isExempt(path string) bool {
+	for _, exempt := range l.config.ExemptPaths {
+		if path == exempt {
+			return true
+		}
+	}
+	return false
+}
+
+// apiKeyFromRequest returns the API key from X-API-Key or a bearer token
+func apiKeyFromRequest(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+
+	if token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); found {
+		return token
+	}
+
+	return ""
+}
+
+// clientIP returns the remote address of a request without its port
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// ceilSeconds rounds a duration up to whole seconds
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
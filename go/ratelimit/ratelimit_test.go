@@ -0,0 +1,165 @@
+package ratelimit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+func newTestLimiter(config Config) (*Limiter, *time.Time) {
+	limiter := NewLimiter(config, "test")
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	limiter.now = func() time.Time { return now }
+	return limiter, &now
+}
+
+func TestAllowTokenBucket(t *testing.T) {
+	config := DefaultConfig()
+	config.Default.RequestsPerSecond = 2
+	config.Default.Burst = 3
+	limiter, now := newTestLimiter(config)
+
+	for i := 0; i < 3; i++ {
+		if decision := limiter.Allow("ip:10.0.0.1", ""); !decision.Allowed {
+			t.Fatalf("Expected request %d within burst to be allowed", i+1)
+		}
+	}
+
+	decision := limiter.Allow("ip:10.0.0.1", "")
+	if decision.Allowed {
+		t.Fatal("Expected request beyond burst to be throttled")
+	}
+	if decision.RetryAfter != 500*time.Millisecond {
+		t.Errorf("Expected retry after 500ms, got %v", decision.RetryAfter)
+	}
+
+	// Other clients have their own bucket
+	if decision := limiter.Allow("ip:10.0.0.2", ""); !decision.Allowed {
+		t.Error("Expected a different client to be allowed")
+	}
+
+	// Half a second refills one token
+	*now = now.Add(500 * time.Millisecond)
+	if decision := limiter.Allow("ip:10.0.0.1", ""); !decision.Allowed {
+		t.Error("Expected request to be allowed after refill")
+	}
+}
+
+func TestAllowTenantQuota(t *testing.T) {
+	config := DefaultConfig()
+	config.Quotas = map[string]Quota{
+		"ci-key-1": {Tenant: "ci", RequestsPerSecond: 1, Burst: 2},
+		"ci-key-2": {Tenant: "ci", RequestsPerSecond: 1, Burst: 2},
+	}
+	limiter, _ := newTestLimiter(config)
+
+	// Both keys of the tenant draw from the same bucket
+	if decision := limiter.Allow("key:ci-key-1", "ci-key-1"); !decision.Allowed || decision.Tenant != "ci" || decision.Limit != 2 {
+		t.Errorf("Unexpected decision for first request: %+v", decision)
+	}
+	if decision := limiter.Allow("key:ci-key-2", "ci-key-2"); !decision.Allowed {
+		t.Error("Expected second request to be allowed")
+	}
+	if decision := limiter.Allow("key:ci-key-1", "ci-key-1"); decision.Allowed {
+		t.Error("Expected tenant quota to be exhausted")
+	}
+
+	// Unknown keys use the default quota
+	if decision := limiter.Allow("key:other", "other"); !decision.Allowed || decision.Tenant != "default" || decision.Limit != 20 {
+		t.Errorf("Unexpected decision for unknown key: %+v", decision)
+	}
+}
+
+func TestTenant(t *testing.T) {
+	config := DefaultConfig()
+	config.Quotas = map[string]Quota{"ci-key": {Tenant: "ci", RequestsPerSecond: 1, Burst: 2}}
+	limiter, _ := newTestLimiter(config)
+
+	tests := map[string]string{"X-API-Key": "ci-key", "Authorization": "Bearer ci-key"}
+	for header, value := range tests {
+		req := httptest.NewRequest("POST", "/api/build", nil)
+		req.Header.Set(header, value)
+		if tenant := limiter.Tenant(req); tenant != "ci" {
+			t.Errorf("Expected %s to identify tenant ci, got %s", header, tenant)
+		}
+	}
+
+	req := httptest.NewRequest("POST", "/api/build", nil)
+	req.Header.Set("X-API-Key", "other")
+	if tenant := limiter.Tenant(req); tenant != "default" {
+		t.Errorf("Expected unknown keys to belong to the default tenant, got %s", tenant)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	config := DefaultConfig()
+	config.Default.RequestsPerSecond = 1
+	config.Default.Burst = 1
+	limiter, _ := newTestLimiter(config)
+
+	handler := limiter.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	request := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", path, nil)
+		req.Header.Set("X-API-Key", "build-bot")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	w := request("/api/predict")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+	if w.Header().Get("X-RateLimit-Limit") != "1" || w.Header().Get("X-RateLimit-Remaining") != "0" {
+		t.Errorf("Unexpected rate limit headers: %v", w.Header())
+	}
+
+	w = request("/api/predict")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected status 429, got %d", w.Code)
+	}
+	if w.Header().Get("Retry-After") != "1" {
+		t.Errorf("Expected Retry-After 1, got %q", w.Header().Get("Retry-After"))
+	}
+
+	// Health checks are never throttled
+	if w := request("/health"); w.Code != http.StatusOK {
+		t.Errorf("Expected health check to bypass rate limiting, got %d", w.Code)
+	}
+
+	var metric dto.Metric
+	if err := limiter.throttled.WithLabelValues("default").Write(&metric); err != nil {
+		t.Fatalf("Failed to read throttled counter: %v", err)
+	}
+	if throttled := metric.GetCounter().GetValue(); throttled != 1 {
+		t.Errorf("Expected 1 throttled request, got %f", throttled)
+	}
+}
+
+func TestLoadConfigFromEnv(t *testing.T) {
+	t.Setenv("RATE_LIMIT_REQUESTS_PER_SECOND", "5")
+	t.Setenv("RATE_LIMIT_BURST", "8")
+	t.Setenv("RATE_LIMIT_QUOTAS", `{"ci-key":{"tenant":"ci","requests_per_second":1,"burst":2}}`)
+
+	config, err := LoadConfigFromEnv()
+	if err != nil {
+		t.Fatalf("LoadConfigFromEnv failed: %v", err)
+	}
+	if config.Default.RequestsPerSecond != 5 || config.Default.Burst != 8 {
+		t.Errorf("Unexpected default quota: %+v", config.Default)
+	}
+	if quota := config.Quotas["ci-key"]; quota.Tenant != "ci" || quota.Burst != 2 {
+		t.Errorf("Unexpected ci quota: %+v", quota)
+	}
+
+	t.Setenv("RATE_LIMIT_QUOTAS", "not json")
+	if _, err := LoadConfigFromEnv(); err == nil {
+		t.Error("Expected error for invalid quotas")
+	}
+}
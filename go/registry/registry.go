@@ -0,0 +1,180 @@
+// Package registry persists the workers registered with the coordinator, so
+// a restarted coordinator knows which workers to reconnect to instead of
+// waiting for each of them to register again.
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"distributed-gradle-building/attestation"
+	"distributed-gradle-building/calibration"
+)
+
+// Entry is a registered worker
+type Entry struct {
+	ID              string    `json:"id"`
+	Host            string    `json:"host"`
+	Port            int       `json:"port"`
+	Capabilities    []string  `json:"capabilities,omitempty"`
+	MaxBuilds       int       `json:"max_builds"`
+	Version         string    `json:"version,omitempty"`
+	ProtocolVersion int       `json:"protocol_version"`
+	Pool            string    `json:"pool,omitempty"`
+	RegisteredAt    time.Time `json:"registered_at"`
+	// Calibration are the benchmark scores the worker registered with
+	Calibration *calibration.Scores `json:"calibration,omitempty"`
+	// Spot is set for workers on preemptible instances
+	Spot bool `json:"spot,omitempty"`
+	// Transport is http or pull for workers that poll the coordinator's
+	// calls instead of accepting connections
+	Transport string `json:"transport,omitempty"`
+	// Quarantine is set for workers excluded from scheduling
+	Quarantine *Quarantine `json:"quarantine,omitempty"`
+	// Attestation is the statement the worker registered with, if it was
+	// attested
+	Attestation *attestation.Statement `json:"attestation,omitempty"`
+}
+
+// Quarantine keeps a registered worker from being scheduled builds, e.g.
+// because its builds produce corrupted artifacts or keep failing
+type Quarantine struct {
+	Reason string `json:"reason"`
+	// Automatic is set for workers quarantined for their failure rate
+	Automatic bool      `json:"automatic,omitempty"`
+	By        string    `json:"by"`
+	Since     time.Time `json:"since"`
+}
+
+// Registry is the set of registered workers. It is rewritten as a whole on
+// every change, which is cheap for the number of workers of a coordinator.
+// Entries are kept in memory only when the registry has no file.
+type Registry struct {
+	mutex   sync.Mutex
+	path    string
+	entries map[string]Entry
+}
+
+// Open opens the registry at path, loading the workers saved there. An empty
+// path keeps the registry in memory.
+func Open(path string) (*Registry, error) {
+	r := &Registry{path: path, entries: make(map[string]Entry)}
+	if path == "" {
+		return r, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create worker registry directory: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return r, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read worker registry: %v", err)
+	}
+
+	var entries []Entry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("failed to parse worker registry: %v", err)
+	}
+	for _, entry := range entries {
+		r.entries[entry.ID] = entry
+	}
+	return r, nil
+}
+
+// OpenFromEnv opens the registry at WORKER_REGISTRY_FILE, defaulting to
+// data/workers.json. It falls back to an in-memory registry if the file
+// cannot be read, so workers can still register.
+func OpenFromEnv() *Registry {
+	path := os.Getenv("WORKER_REGISTRY_FILE")
+	if path == "" {
+		path = filepath.Join("data", "workers.json")
+	}
+
+	r, err := Open(path)
+	if err != nil {
+		log.Printf("Worker registry unavailable, keeping workers in memory: %v", err)
+		r, _ = Open("")
+	}
+	return r
+}
+
+// Put adds or replaces a worker
+func (r *Registry) Put(entry Entry) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.entries[entry.ID] = entry
+	return r.save()
+}
+
+// Get returns a worker, if it is registered
+func (r *Registry) Get(id string) (Entry, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	entry, exists := r.entries[id]
+	return entry, exists
+}
+
+// Remove removes a worker
+func (r *Registry) Remove(id string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if _, exists := r.entries[id]; !exists {
+		return nil
+	}
+	delete(r.entries, id)
+	return r.save()
+}
+
+// List returns the registered workers sorted by ID
+func (r *Registry) List() []Entry {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	entries := make([]Entry, 0, len(r.entries))
+	for _, entry := range r.entries {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ID < entries[j].ID })
+	return entries
+}
+
+// save writes the registry to a temporary file and renames it over the
+// registry, so a crash never leaves a partly written file. Must be called
+// with the mutex held.
+func (r *Registry) save() error {
+	if r.path == "" {
+		return nil
+	}
+
+	entries := make([]Entry, 0, len(r.entries))
+	for _, entry := range r.entries {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ID < entries[j].ID })
+
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode worker registry: %v", err)
+	}
+	tmp := r.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write worker registry: %v", err)
+	}
+	if err := os.Rename(tmp, r.path); err != nil {
+		return fmt.Errorf("failed to replace worker registry: %v", err)
+	}
+	return nil
+}
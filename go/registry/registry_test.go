@@ -0,0 +1,65 @@
+package registry
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRegistryPersistsWorkers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data", "workers.json")
+
+	r, err := Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open registry: %v", err)
+	}
+	r.Put(Entry{ID: "worker-2", Host: "worker-2", Port: 8082, MaxBuilds: 2, Pool: "android"})
+	r.Put(Entry{ID: "worker-1", Host: "worker-1", Port: 8082, MaxBuilds: 1})
+	r.Put(Entry{ID: "worker-3", Host: "worker-3", Port: 8082, MaxBuilds: 1})
+	r.Remove("worker-3")
+	r.Remove("unknown")
+
+	// A re-registering worker replaces its entry
+	r.Put(Entry{ID: "worker-1", Host: "worker-1", Port: 9092, MaxBuilds: 4})
+
+	r, err = Open(path)
+	if err != nil {
+		t.Fatalf("Failed to reopen registry: %v", err)
+	}
+	entries := r.List()
+	if len(entries) != 2 || entries[0].ID != "worker-1" || entries[0].Port != 9092 || entries[1].Pool != "android" {
+		t.Fatalf("Expected the two remaining workers, got %+v", entries)
+	}
+	if entry, exists := r.Get("worker-2"); !exists || entry.MaxBuilds != 2 {
+		t.Errorf("Expected worker-2, got %+v", entry)
+	}
+	if _, exists := r.Get("worker-3"); exists {
+		t.Error("Expected the removed worker to be gone")
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Error("Expected no temporary file to be left behind")
+	}
+}
+
+func TestOpenRejectsCorruptRegistry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "workers.json")
+	os.WriteFile(path, []byte(`[{"id":"worker-1"`), 0644)
+	if _, err := Open(path); err == nil {
+		t.Error("Expected a corrupt registry to be rejected")
+	}
+
+	t.Setenv("WORKER_REGISTRY_FILE", path)
+	if r := OpenFromEnv(); r == nil || len(r.List()) != 0 {
+		t.Error("Expected an empty in-memory registry for a corrupt file")
+	}
+}
+
+func TestInMemoryRegistry(t *testing.T) {
+	r, err := Open("")
+	if err != nil {
+		t.Fatalf("Failed to open registry: %v", err)
+	}
+	if err := r.Put(Entry{ID: "worker-1"}); err != nil || len(r.List()) != 1 {
+		t.Errorf("Expected the worker to be kept in memory: %v", err)
+	}
+}
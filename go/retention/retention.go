@@ -0,0 +1,199 @@
+// Package retention decides which build artifacts are kept. Policies keep
+// the artifacts of a project's last builds, of builds younger than an age and
+// of tagged releases; the artifacts of other builds are garbage collected.
+package retention
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"distributed-gradle-building/transfer"
+)
+
+// Manifest attributes recording the build an artifact belongs to
+const (
+	AttributeProject    = "project"
+	AttributeRepository = "repository"
+	AttributeRef        = "ref"
+	AttributeLabels     = "labels"
+)
+
+// Policy keeps the artifacts of a build if it is one of the KeepLast most
+// recent builds of its project, younger than KeepDays, carries one of
+// KeepLabels or builds a ref matching one of KeepRefs. Project and
+// Repository are glob patterns (path.Match syntax) selecting the builds the
+// policy applies to; empty fields match any build.
+type Policy struct {
+	Project    string   `json:"project,omitempty"`
+	Repository string   `json:"repository,omitempty"`
+	KeepLast   int      `json:"keep_last,omitempty"`
+	KeepDays   float64  `json:"keep_days,omitempty"`
+	KeepLabels []string `json:"keep_labels,omitempty"`
+	KeepRefs   []string `json:"keep_refs,omitempty"`
+}
+
+// validate checks the patterns of a policy
+func (p Policy) validate() error {
+	if p.KeepLast < 0 || p.KeepDays < 0 {
+		return fmt.Errorf("policy for %q keeps a negative number of builds or days", p.Project)
+	}
+	for _, pattern := range append([]string{p.Project, p.Repository}, p.KeepRefs...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %v", pattern, err)
+		}
+	}
+	return nil
+}
+
+// matches reports whether a build's project and repository match the policy
+func (p Policy) matches(project, repository string) bool {
+	if p.Project != "" {
+		if matched, _ := path.Match(p.Project, project); !matched {
+			return false
+		}
+	}
+	if p.Repository != "" {
+		if matched, _ := path.Match(p.Repository, repository); repository == "" || !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// tagged reports whether a build is a release the policy always keeps
+func (p Policy) tagged(ref string, labels []string) bool {
+	for _, label := range labels {
+		if slices.Contains(p.KeepLabels, label) {
+			return true
+		}
+	}
+	for _, pattern := range p.KeepRefs {
+		if matched, _ := path.Match(pattern, ref); ref != "" && matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Policies applies the first policy a build matches, or Default
+type Policies struct {
+	Rules   []Policy `json:"rules"`
+	Default Policy   `json:"default"`
+}
+
+// New validates policies
+func New(rules []Policy, fallback Policy) (Policies, error) {
+	for _, rule := range append(rules, fallback) {
+		if err := rule.validate(); err != nil {
+			return Policies{}, err
+		}
+	}
+	return Policies{Rules: rules, Default: fallback}, nil
+}
+
+// FromEnv reads the policies from ARTIFACT_RETENTION_POLICIES, a JSON array
+// of policies. Builds matching none keep their artifacts for retention, the
+// ARTIFACT_RETENTION of the coordinator.
+func FromEnv(retention time.Duration) (Policies, error) {
+	var rules []Policy
+	if value := os.Getenv("ARTIFACT_RETENTION_POLICIES"); value != "" {
+		if err := json.Unmarshal([]byte(value), &rules); err != nil {
+			return Policies{}, fmt.Errorf("failed to parse ARTIFACT_RETENTION_POLICIES: %v", err)
+		}
+	}
+	return New(rules, Policy{KeepDays: retention.Hours() / 24})
+}
+
+// For returns the policy applying to a build of project or repository
+func (p Policies) For(project, repository string) Policy {
+	for _, rule := range p.Rules {
+		if rule.matches(project, repository) {
+			return rule
+		}
+	}
+	return p.Default
+}
+
+// Attributes returns the manifest attributes recording a build
+func Attributes(project, repository, ref string, labels []string) map[string]string {
+	attributes := map[string]string{AttributeProject: project}
+	if repository != "" {
+		attributes[AttributeRepository] = repository
+		attributes[AttributeRef] = ref
+	}
+	if len(labels) > 0 {
+		attributes[AttributeLabels] = strings.Join(labels, ",")
+	}
+	return attributes
+}
+
+// build is a build with stored artifacts
+type build struct {
+	id        string
+	created   time.Time
+	policy    Policy
+	tagged    bool
+	artifacts []string
+}
+
+// BuildID returns the build an artifact belongs to. Artifacts are named
+// <build id>/<path>.
+func BuildID(name string) string {
+	id, _, _ := strings.Cut(name, "/")
+	return id
+}
+
+// Expired returns the names of the artifacts the policies no longer keep.
+// A build's age is that of its newest artifact, and its project and
+// repository those recorded in its artifacts' attributes; builds of the same
+// project and repository count towards each other's KeepLast.
+func (p Policies) Expired(manifests []transfer.Manifest, now time.Time) []string {
+	builds := make(map[string]*build)
+	projects := make(map[string][]*build)
+	for _, manifest := range manifests {
+		id := BuildID(manifest.Name)
+		current, exists := builds[id]
+		if !exists {
+			attributes := manifest.Attributes
+			var labels []string
+			if attributes[AttributeLabels] != "" {
+				labels = strings.Split(attributes[AttributeLabels], ",")
+			}
+			policy := p.For(attributes[AttributeProject], attributes[AttributeRepository])
+			current = &build{id: id, policy: policy, tagged: policy.tagged(attributes[AttributeRef], labels)}
+			builds[id] = current
+			key := attributes[AttributeRepository] + "\x00" + attributes[AttributeProject]
+			projects[key] = append(projects[key], current)
+		}
+		if manifest.CreatedAt.After(current.created) {
+			current.created = manifest.CreatedAt
+		}
+		current.artifacts = append(current.artifacts, manifest.Name)
+	}
+
+	var expired []string
+	for _, project := range projects {
+		sort.Slice(project, func(i, j int) bool {
+			if !project[i].created.Equal(project[j].created) {
+				return project[i].created.After(project[j].created)
+			}
+			return project[i].id > project[j].id
+		})
+		for rank, build := range project {
+			policy := build.policy
+			keepFor := time.Duration(policy.KeepDays * float64(24*time.Hour))
+			if build.tagged || rank < policy.KeepLast || now.Sub(build.created) < keepFor {
+				continue
+			}
+			expired = append(expired, build.artifacts...)
+		}
+	}
+	sort.Strings(expired)
+	return expired
+}
@@ -0,0 +1,79 @@
+package retention
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"distributed-gradle-building/transfer"
+)
+
+func TestExpired(t *testing.T) {
+	policies, err := New([]Policy{
+		{Project: "/projects/android/*", KeepLast: 2, KeepLabels: []string{"release"}},
+		{Repository: "https://git.example.com/*", KeepRefs: []string{"refs/tags/v*"}},
+	}, Policy{KeepDays: 7})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	now := time.Now()
+	android := Attributes("/projects/android/app", "", "", nil)
+	manifest := func(name string, age time.Duration, attributes map[string]string) transfer.Manifest {
+		return transfer.Manifest{Name: name, CreatedAt: now.Add(-age), Attributes: attributes}
+	}
+	manifests := []transfer.Manifest{
+		// The two most recent android builds and the release are kept
+		manifest("android-1/app.apk", 30*time.Hour, Attributes("/projects/android/app", "", "", []string{"nightly", "release"})),
+		manifest("android-2/app.apk", 20*time.Hour, android),
+		manifest("android-2/mapping.txt", 20*time.Hour, android),
+		manifest("android-3/app.apk", 10*time.Hour, android),
+		manifest("android-4/app.apk", time.Hour, android),
+		// Tagged checkouts are kept, branches expire at once
+		manifest("git-1/api.jar", 100*time.Hour, Attributes("api", "https://git.example.com/api.git", "refs/tags/v1.0", nil)),
+		manifest("git-2/api.jar", time.Minute, Attributes("api", "https://git.example.com/api.git", "main", nil)),
+		// Other builds are kept for 7 days
+		manifest("tools-1/cli.jar", 8*24*time.Hour, Attributes("/projects/tools", "", "", nil)),
+		manifest("tools-2/cli.jar", 6*24*time.Hour, Attributes("/projects/tools", "", "", nil)),
+		manifest("unknown/lib.jar", 8*24*time.Hour, nil),
+	}
+
+	expected := []string{"android-2/app.apk", "android-2/mapping.txt", "git-2/api.jar", "tools-1/cli.jar", "unknown/lib.jar"}
+	if expired := policies.Expired(manifests, now); !reflect.DeepEqual(expired, expected) {
+		t.Errorf("Expected %v to expire, got %v", expected, expired)
+	}
+}
+
+func TestNewRejectsInvalidPolicies(t *testing.T) {
+	for name, policy := range map[string]Policy{
+		"negative count": {KeepLast: -1},
+		"negative age":   {KeepDays: -1},
+		"bad pattern":    {Project: "/projects/["},
+		"bad ref":        {KeepRefs: []string{"refs/tags/["}},
+	} {
+		if _, err := New([]Policy{policy}, Policy{}); err == nil {
+			t.Errorf("Expected the %s policy to be rejected", name)
+		}
+	}
+}
+
+func TestFromEnv(t *testing.T) {
+	t.Setenv("ARTIFACT_RETENTION_POLICIES", "")
+	policies, err := FromEnv(48 * time.Hour)
+	if err != nil || len(policies.Rules) != 0 || policies.Default.KeepDays != 2 {
+		t.Fatalf("Expected the retention as the default policy, got %+v, %v", policies, err)
+	}
+
+	t.Setenv("ARTIFACT_RETENTION_POLICIES", `[{"project":"/projects/*","keep_last":5,"keep_labels":["release"]}]`)
+	if policies, err = FromEnv(48 * time.Hour); err != nil || policies.For("/projects/app", "").KeepLast != 5 {
+		t.Errorf("Expected the policies to be read, got %+v, %v", policies, err)
+	}
+	if policy := policies.For("/srv/app", ""); policy.KeepDays != 2 {
+		t.Errorf("Expected the default policy for other projects, got %+v", policy)
+	}
+
+	t.Setenv("ARTIFACT_RETENTION_POLICIES", `{"keep_last":5}`)
+	if _, err := FromEnv(48 * time.Hour); err == nil {
+		t.Error("Expected malformed policies to be rejected")
+	}
+}
@@ -0,0 +1,81 @@
+package scmstatus
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// maxBitbucketKey is the longest key of a Bitbucket build status
+const maxBitbucketKey = 40
+
+// Bitbucket reports builds as build statuses of Bitbucket Cloud. The token
+// is a repository, project or workspace access token with the
+// repository:write scope.
+type Bitbucket struct {
+	APIURL string
+	// Host is the web host of the repositories, linked from statuses
+	// without a target URL since Bitbucket requires one
+	Host   string
+	Token  string
+	Client *http.Client
+}
+
+func newBitbucket(config Config, token string, client *http.Client) Reporter {
+	return &Bitbucket{APIURL: config.APIURL, Host: config.Host, Token: token, Client: client}
+}
+
+// Kind returns the kind of the reporter
+func (b *Bitbucket) Kind() string {
+	return KindBitbucket
+}
+
+// bitbucketStates maps build states to the states of Bitbucket build
+// statuses, which have no queued state
+var bitbucketStates = map[string]string{
+	StatePending:   "INPROGRESS",
+	StateRunning:   "INPROGRESS",
+	StateSuccess:   "SUCCESSFUL",
+	StateFailure:   "FAILED",
+	StateCancelled: "STOPPED",
+}
+
+// Report sets the status of the build on its commit. The status is keyed
+// by its context, hashed if it is too long for a key.
+func (b *Bitbucket) Report(ctx context.Context, status Status) error {
+	state, exists := bitbucketStates[status.State]
+	if !exists {
+		return fmt.Errorf("unknown build state %q", status.State)
+	}
+
+	key := status.Context
+	if len(key) > maxBitbucketKey {
+		sum := sha1.Sum([]byte(key))
+		key = hex.EncodeToString(sum[:])
+	}
+	target := status.TargetURL
+	if target == "" {
+		target = "https://" + b.Host + "/" + status.Repository.Path() + "/commits/" + status.Commit
+	}
+	body := map[string]string{
+		"key":         key,
+		"state":       state,
+		"name":        status.Context,
+		"description": status.Description,
+		"url":         target,
+	}
+	requestURL := b.APIURL + "/repositories/" + url.PathEscape(status.Repository.Owner) + "/" + url.PathEscape(status.Repository.Name) +
+		"/commit/" + url.PathEscape(status.Commit) + "/statuses/build"
+	headers := map[string]string{"Authorization": "Bearer " + b.Token}
+	return call(ctx, b.client(), "POST", requestURL, headers, body, nil)
+}
+
+func (b *Bitbucket) client() *http.Client {
+	if b.Client == nil {
+		return http.DefaultClient
+	}
+	return b.Client
+}
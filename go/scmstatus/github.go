@@ -0,0 +1,99 @@
+package scmstatus
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+// GitHub reports builds as check runs. The Checks API only accepts the
+// installation tokens of GitHub Apps, with the checks:write permission on
+// the repository.
+type GitHub struct {
+	APIURL string
+	Token  string
+	Client *http.Client
+
+	mutex sync.Mutex
+	// runs holds the check run of each build until it finished
+	runs map[string]int64
+}
+
+func newGitHub(config Config, token string, client *http.Client) Reporter {
+	return &GitHub{APIURL: config.APIURL, Token: token, Client: client, runs: make(map[string]int64)}
+}
+
+// Kind returns the kind of the reporter
+func (g *GitHub) Kind() string {
+	return KindGitHub
+}
+
+// Report creates the check run of a build with its first status and
+// updates it with the following ones
+func (g *GitHub) Report(ctx context.Context, status Status) error {
+	run := map[string]any{
+		"name":        status.Context,
+		"external_id": status.BuildID,
+		"output":      map[string]string{"title": status.Description, "summary": status.Description},
+	}
+	if status.TargetURL != "" {
+		run["details_url"] = status.TargetURL
+	}
+	switch status.State {
+	case StatePending:
+		run["status"] = "queued"
+	case StateRunning:
+		run["status"] = "in_progress"
+	case StateSuccess:
+		run["status"], run["conclusion"] = "completed", "success"
+	case StateFailure:
+		run["status"], run["conclusion"] = "completed", "failure"
+	case StateCancelled:
+		run["status"], run["conclusion"] = "completed", "cancelled"
+	default:
+		return fmt.Errorf("unknown build state %q", status.State)
+	}
+
+	g.mutex.Lock()
+	id, exists := g.runs[status.BuildID]
+	g.mutex.Unlock()
+
+	runs := g.APIURL + "/repos/" + url.PathEscape(status.Repository.Owner) + "/" + url.PathEscape(status.Repository.Name) + "/check-runs"
+	headers := map[string]string{
+		"Authorization":        "Bearer " + g.Token,
+		"Accept":               "application/vnd.github+json",
+		"X-GitHub-Api-Version": "2022-11-28",
+	}
+	if exists {
+		if err := call(ctx, g.client(), "PATCH", fmt.Sprintf("%s/%d", runs, id), headers, run, nil); err != nil {
+			return err
+		}
+	} else {
+		run["head_sha"] = status.Commit
+		var created struct {
+			ID int64 `json:"id"`
+		}
+		if err := call(ctx, g.client(), "POST", runs, headers, run, &created); err != nil {
+			return err
+		}
+		id = created.ID
+	}
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if status.Final() {
+		delete(g.runs, status.BuildID)
+	} else {
+		g.runs[status.BuildID] = id
+	}
+	return nil
+}
+
+func (g *GitHub) client() *http.Client {
+	if g.Client == nil {
+		return http.DefaultClient
+	}
+	return g.Client
+}
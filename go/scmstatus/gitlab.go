@@ -0,0 +1,62 @@
+package scmstatus
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// GitLab reports builds as commit statuses, which GitLab shows with the
+// pipelines of the commit and its merge requests. The token needs the api
+// scope on the project.
+type GitLab struct {
+	APIURL string
+	Token  string
+	Client *http.Client
+}
+
+func newGitLab(config Config, token string, client *http.Client) Reporter {
+	return &GitLab{APIURL: config.APIURL, Token: token, Client: client}
+}
+
+// Kind returns the kind of the reporter
+func (g *GitLab) Kind() string {
+	return KindGitLab
+}
+
+// gitLabStates maps build states to the states of GitLab commit statuses
+var gitLabStates = map[string]string{
+	StatePending:   "pending",
+	StateRunning:   "running",
+	StateSuccess:   "success",
+	StateFailure:   "failed",
+	StateCancelled: "canceled",
+}
+
+// Report sets the status of the build on its commit
+func (g *GitLab) Report(ctx context.Context, status Status) error {
+	state, exists := gitLabStates[status.State]
+	if !exists {
+		return fmt.Errorf("unknown build state %q", status.State)
+	}
+
+	body := map[string]string{
+		"state":       state,
+		"name":        status.Context,
+		"description": status.Description,
+	}
+	if status.TargetURL != "" {
+		body["target_url"] = status.TargetURL
+	}
+	requestURL := g.APIURL + "/projects/" + url.PathEscape(status.Repository.Path()) + "/statuses/" + url.PathEscape(status.Commit)
+	headers := map[string]string{"PRIVATE-TOKEN": g.Token}
+	return call(ctx, g.client(), "POST", requestURL, headers, body, nil)
+}
+
+func (g *GitLab) client() *http.Client {
+	if g.Client == nil {
+		return http.DefaultClient
+	}
+	return g.Client
+}
@@ -0,0 +1,303 @@
+// Package scmstatus reports the status of builds on the commits they build
+// to the source code hosts of their repositories: as GitHub check runs,
+// GitLab commit statuses and Bitbucket build statuses. Reporters are
+// plugins registered by kind, so another host only needs a Reporter and a
+// call to Register.
+package scmstatus
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"distributed-gradle-building/metrics"
+)
+
+// Reporter kinds
+const (
+	KindGitHub    = "github"
+	KindGitLab    = "gitlab"
+	KindBitbucket = "bitbucket"
+)
+
+// States of a build reported on its commit
+const (
+	StatePending   = "pending"
+	StateRunning   = "running"
+	StateSuccess   = "success"
+	StateFailure   = "failure"
+	StateCancelled = "cancelled"
+)
+
+// queueSize is how many statuses wait to be reported before new ones are
+// dropped
+const queueSize = 1024
+
+// reportTimeout bounds a single call to a source code host
+const reportTimeout = 30 * time.Second
+
+// Repository is a repository on a source code host. Owner is the user or
+// organization owning it, or the path of its group on GitLab.
+type Repository struct {
+	Host  string `json:"host"`
+	Owner string `json:"owner"`
+	Name  string `json:"name"`
+}
+
+// Path returns the path of the repository on its host, owner/name
+func (r Repository) Path() string {
+	return r.Owner + "/" + r.Name
+}
+
+// scpPattern matches scp-like addresses such as git@github.com:owner/name.git
+var scpPattern = regexp.MustCompile(`^[A-Za-z0-9._-]+@([A-Za-z0-9.-]+):(.+)$`)
+
+// ParseRepository reads the host, owner and name of a repository from its
+// https, http, ssh or git URL, or from an scp-like address
+func ParseRepository(repoURL string) (Repository, error) {
+	var host, path string
+	if match := scpPattern.FindStringSubmatch(repoURL); match != nil {
+		host, path = match[1], match[2]
+	} else {
+		parsed, err := url.Parse(repoURL)
+		if err != nil || parsed.Host == "" {
+			return Repository{}, fmt.Errorf("invalid repository URL %q", repoURL)
+		}
+		host, path = parsed.Hostname(), parsed.Path
+	}
+
+	path = strings.TrimSuffix(strings.Trim(path, "/"), ".git")
+	slash := strings.LastIndex(path, "/")
+	if slash <= 0 || slash == len(path)-1 {
+		return Repository{}, fmt.Errorf("repository URL %q has no owner and name", repoURL)
+	}
+	return Repository{Host: strings.ToLower(host), Owner: path[:slash], Name: path[slash+1:]}, nil
+}
+
+// Status is the state of a build of a commit
+type Status struct {
+	BuildID    string
+	Repository Repository
+	// Commit is the full hash of the commit built
+	Commit string
+	State  string
+	// Context names the status on the commit. A build replaces the status
+	// of earlier builds with the same context.
+	Context     string
+	Description string
+	// TargetURL links the status to the build, if set
+	TargetURL string
+}
+
+// Final reports whether the build has finished
+func (s Status) Final() bool {
+	return s.State == StateSuccess || s.State == StateFailure || s.State == StateCancelled
+}
+
+// Reporter posts the statuses of builds to a source code host. Statuses of
+// a build are reported in order, one at a time.
+type Reporter interface {
+	// Kind returns the kind of the reporter, such as github
+	Kind() string
+	// Report posts the status of a build
+	Report(ctx context.Context, status Status) error
+}
+
+// Config configures the reporter of a source code host
+type Config struct {
+	Kind string `json:"kind"`
+	// Host is the host name of the repositories reported on, defaulting to
+	// the public host of the kind, such as github.com
+	Host string `json:"host,omitempty"`
+	// APIURL defaults to the API of the public host
+	APIURL string `json:"api_url,omitempty"`
+	// TokenSecret names the build secret holding the API token
+	TokenSecret string `json:"token_secret"`
+}
+
+// Plugin creates the reporters of a kind. Host and APIURL are the defaults
+// of its configurations.
+type Plugin struct {
+	Host   string
+	APIURL string
+	New    func(config Config, token string, client *http.Client) Reporter
+}
+
+var (
+	pluginsMutex sync.RWMutex
+	plugins      = map[string]Plugin{
+		KindGitHub:    {Host: "github.com", APIURL: "https://api.github.com", New: newGitHub},
+		KindGitLab:    {Host: "gitlab.com", APIURL: "https://gitlab.com/api/v4", New: newGitLab},
+		KindBitbucket: {Host: "bitbucket.org", APIURL: "https://api.bitbucket.org/2.0", New: newBitbucket},
+	}
+)
+
+// Register makes a kind of reporter available to configurations, replacing
+// the plugin of a kind already registered
+func Register(kind string, plugin Plugin) {
+	pluginsMutex.Lock()
+	defer pluginsMutex.Unlock()
+	plugins[kind] = plugin
+}
+
+// New creates the reporter of a configuration, returning the configuration
+// with its defaults applied
+func New(config Config, token string, client *http.Client) (Reporter, Config, error) {
+	pluginsMutex.RLock()
+	plugin, exists := plugins[config.Kind]
+	pluginsMutex.RUnlock()
+	if !exists {
+		return nil, config, fmt.Errorf("unknown status reporter %q", config.Kind)
+	}
+
+	if config.Host == "" {
+		config.Host = plugin.Host
+	}
+	if config.APIURL == "" {
+		config.APIURL = plugin.APIURL
+	}
+	config.Host = strings.ToLower(config.Host)
+	config.APIURL = strings.TrimRight(config.APIURL, "/")
+	if parsed, err := url.Parse(config.APIURL); err != nil || (parsed.Scheme != "https" && parsed.Scheme != "http") || parsed.Host == "" {
+		return nil, config, fmt.Errorf("invalid API URL %q of the %s status reporter", config.APIURL, config.Kind)
+	}
+	if token == "" {
+		return nil, config, fmt.Errorf("the %s status reporter of %s has no token", config.Kind, config.Host)
+	}
+	return plugin.New(config, token, client), config, nil
+}
+
+// Dispatcher reports statuses in the background through the reporter of
+// the host of each repository, so builds never wait for a source code host
+type Dispatcher struct {
+	reporters map[string]Reporter
+	queue     chan Status
+	done      chan struct{}
+
+	mutex  sync.Mutex
+	closed bool
+}
+
+// NewDispatcher creates the reporters configured, reading their tokens with
+// token, and starts reporting
+func NewDispatcher(configs []Config, token func(secret string) (string, error)) (*Dispatcher, error) {
+	d := &Dispatcher{
+		reporters: make(map[string]Reporter),
+		queue:     make(chan Status, queueSize),
+		done:      make(chan struct{}),
+	}
+	client := &http.Client{Timeout: reportTimeout}
+	for _, config := range configs {
+		value, err := token(config.TokenSecret)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the token of the %s status reporter: %v", config.Kind, err)
+		}
+		reporter, config, err := New(config, value, client)
+		if err != nil {
+			return nil, err
+		}
+		if _, exists := d.reporters[config.Host]; exists {
+			return nil, fmt.Errorf("more than one status reporter for %s", config.Host)
+		}
+		d.reporters[config.Host] = reporter
+	}
+
+	go d.run()
+	return d, nil
+}
+
+// Report queues a status for the reporter of its repository's host. It
+// reports false if no reporter handles the host or the dispatcher is
+// closed.
+func (d *Dispatcher) Report(status Status) bool {
+	reporter, exists := d.reporters[status.Repository.Host]
+	if !exists {
+		return false
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.closed {
+		return false
+	}
+	select {
+	case d.queue <- status:
+	default:
+		log.Printf("Status report queue is full, dropping the %s status of build %s", status.State, status.BuildID)
+		metrics.SCMStatusReports.WithLabelValues(reporter.Kind(), metrics.StatusReportDropped).Inc()
+	}
+	return true
+}
+
+// Close stops the dispatcher after reporting the queued statuses
+func (d *Dispatcher) Close() {
+	d.mutex.Lock()
+	if !d.closed {
+		d.closed = true
+		close(d.queue)
+	}
+	d.mutex.Unlock()
+	<-d.done
+}
+
+// run reports the queued statuses in order
+func (d *Dispatcher) run() {
+	defer close(d.done)
+	for status := range d.queue {
+		reporter := d.reporters[status.Repository.Host]
+		ctx, cancel := context.WithTimeout(context.Background(), reportTimeout)
+		err := reporter.Report(ctx, status)
+		cancel()
+
+		if err != nil {
+			log.Printf("Failed to report the %s status of build %s to %s: %v", status.State, status.BuildID, status.Repository.Host, err)
+			metrics.SCMStatusReports.WithLabelValues(reporter.Kind(), metrics.StatusReportFailed).Inc()
+			continue
+		}
+		metrics.SCMStatusReports.WithLabelValues(reporter.Kind(), metrics.StatusReported).Inc()
+	}
+}
+
+// call sends a JSON request to the API of a source code host and decodes
+// the response into result, if given
+func call(ctx context.Context, client *http.Client, method, requestURL string, headers map[string]string, body, result any) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("invalid status request: %v", err)
+	}
+	request, err := http.NewRequestWithContext(ctx, method, requestURL, bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("invalid status request: %v", err)
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Accept", "application/json")
+	for name, value := range headers {
+		request.Header.Set(name, value)
+	}
+
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		message, _ := io.ReadAll(io.LimitReader(response.Body, 512))
+		return fmt.Errorf("%s returned %s: %s", request.URL.Host, response.Status, strings.TrimSpace(string(message)))
+	}
+	if result != nil {
+		if err := json.NewDecoder(response.Body).Decode(result); err != nil {
+			return fmt.Errorf("invalid response from %s: %v", request.URL.Host, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,247 @@
+package scmstatus
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const commit = "0123456789abcdef0123456789abcdef01234567"
+
+// recorded is a request received by a fake source code host
+type recorded struct {
+	method string
+	path   string
+	header http.Header
+	body   map[string]any
+}
+
+// fakeHost records the requests it receives, answering with response
+func fakeHost(t *testing.T, response string) (*httptest.Server, *[]recorded) {
+	var requests []recorded
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("Invalid request body: %v", err)
+		}
+		requests = append(requests, recorded{r.Method, r.URL.EscapedPath(), r.Header, body})
+		if strings.Contains(r.URL.Path, "/fail/") {
+			http.Error(w, `{"message":"Not Found"}`, http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, response)
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+func status(state string) Status {
+	return Status{
+		BuildID:     "build-1",
+		Repository:  Repository{Host: "example.com", Owner: "group/sub", Name: "app"},
+		Commit:      commit,
+		State:       state,
+		Context:     "distributed-gradle/app assemble",
+		Description: "Queued",
+		TargetURL:   "https://coordinator/api/builds/build-1/log",
+	}
+}
+
+func TestParseRepository(t *testing.T) {
+	for _, test := range []struct {
+		url      string
+		expected Repository
+	}{
+		{"https://github.com/owner/app.git", Repository{"github.com", "owner", "app"}},
+		{"https://GitHub.com/owner/app/", Repository{"github.com", "owner", "app"}},
+		{"ssh://git@gitlab.example.com:2222/group/sub/app.git", Repository{"gitlab.example.com", "group/sub", "app"}},
+		{"git@bitbucket.org:team/app.git", Repository{"bitbucket.org", "team", "app"}},
+	} {
+		repository, err := ParseRepository(test.url)
+		if err != nil || repository != test.expected {
+			t.Errorf("%s: expected %+v, got %+v: %v", test.url, test.expected, repository, err)
+		}
+	}
+
+	for _, url := range []string{"", "/srv/git/app", "https://github.com/app", "not a url"} {
+		if _, err := ParseRepository(url); err == nil {
+			t.Errorf("Expected %q to be rejected", url)
+		}
+	}
+}
+
+func TestGitHub(t *testing.T) {
+	server, requests := fakeHost(t, `{"id":42}`)
+	github := &GitHub{APIURL: server.URL, Token: "app-token", runs: make(map[string]int64)}
+
+	for _, state := range []string{StatePending, StateRunning, StateFailure} {
+		if err := github.Report(context.Background(), status(state)); err != nil {
+			t.Fatalf("Report %s failed: %v", state, err)
+		}
+	}
+	if len(*requests) != 3 {
+		t.Fatalf("Expected 3 requests, got %d", len(*requests))
+	}
+
+	created := (*requests)[0]
+	if created.method != "POST" || created.path != "/repos/group%2Fsub/app/check-runs" {
+		t.Errorf("Expected the check run to be created, got %s %s", created.method, created.path)
+	}
+	if created.header.Get("Authorization") != "Bearer app-token" || created.header.Get("Accept") != "application/vnd.github+json" {
+		t.Errorf("Unexpected headers %v", created.header)
+	}
+	if created.body["head_sha"] != commit || created.body["status"] != "queued" || created.body["external_id"] != "build-1" ||
+		created.body["details_url"] != "https://coordinator/api/builds/build-1/log" {
+		t.Errorf("Unexpected check run %v", created.body)
+	}
+
+	for i, expected := range []string{"in_progress", "completed"} {
+		updated := (*requests)[i+1]
+		if updated.method != "PATCH" || updated.path != "/repos/group%2Fsub/app/check-runs/42" || updated.body["status"] != expected {
+			t.Errorf("Expected the check run to be updated to %s, got %s %s %v", expected, updated.method, updated.path, updated.body)
+		}
+		if _, exists := updated.body["head_sha"]; exists {
+			t.Errorf("Updates must not change the commit of the check run")
+		}
+	}
+	if (*requests)[2].body["conclusion"] != "failure" {
+		t.Errorf("Expected a failure conclusion, got %v", (*requests)[2].body)
+	}
+	if len(github.runs) != 0 {
+		t.Errorf("Expected the check run to be forgotten once the build finished, got %v", github.runs)
+	}
+}
+
+func TestGitLab(t *testing.T) {
+	server, requests := fakeHost(t, `{}`)
+	gitlab := &GitLab{APIURL: server.URL, Token: "project-token"}
+
+	for _, state := range []string{StateRunning, StateCancelled} {
+		if err := gitlab.Report(context.Background(), status(state)); err != nil {
+			t.Fatalf("Report %s failed: %v", state, err)
+		}
+	}
+
+	for i, expected := range []string{"running", "canceled"} {
+		request := (*requests)[i]
+		if request.method != "POST" || request.path != "/projects/group%2Fsub%2Fapp/statuses/"+commit {
+			t.Errorf("Unexpected request %s %s", request.method, request.path)
+		}
+		if request.header.Get("PRIVATE-TOKEN") != "project-token" {
+			t.Errorf("Expected the token in PRIVATE-TOKEN, got %v", request.header)
+		}
+		if request.body["state"] != expected || request.body["name"] != "distributed-gradle/app assemble" {
+			t.Errorf("Expected state %s, got %v", expected, request.body)
+		}
+	}
+}
+
+func TestBitbucket(t *testing.T) {
+	server, requests := fakeHost(t, `{}`)
+	bitbucket := &Bitbucket{APIURL: server.URL, Host: "bitbucket.org", Token: "access-token"}
+
+	success := status(StateSuccess)
+	success.TargetURL = ""
+	success.Context = strings.Repeat("long context ", 5)
+	if err := bitbucket.Report(context.Background(), success); err != nil {
+		t.Fatalf("Report failed: %v", err)
+	}
+
+	request := (*requests)[0]
+	if request.path != "/repositories/group%2Fsub/app/commit/"+commit+"/statuses/build" {
+		t.Errorf("Unexpected path %s", request.path)
+	}
+	if request.header.Get("Authorization") != "Bearer access-token" {
+		t.Errorf("Unexpected headers %v", request.header)
+	}
+	if request.body["state"] != "SUCCESSFUL" || len(request.body["key"].(string)) != maxBitbucketKey ||
+		request.body["url"] != "https://bitbucket.org/group/sub/app/commits/"+commit {
+		t.Errorf("Unexpected build status %v", request.body)
+	}
+
+	failed := status(StatePending)
+	failed.Repository.Name = "fail"
+	if err := bitbucket.Report(context.Background(), failed); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("Expected the rejected status to fail, got %v", err)
+	}
+}
+
+// fakeReporter records the statuses it reports
+type fakeReporter struct {
+	mutex    sync.Mutex
+	reported []string
+}
+
+func (r *fakeReporter) Kind() string {
+	return "fake"
+}
+
+func (r *fakeReporter) Report(ctx context.Context, status Status) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.reported = append(r.reported, status.State)
+	return nil
+}
+
+func TestDispatcher(t *testing.T) {
+	reporter := &fakeReporter{}
+	Register("fake", Plugin{Host: "example.com", APIURL: "https://api.example.com", New: func(Config, string, *http.Client) Reporter {
+		return reporter
+	}})
+	tokens := map[string]string{"scm-token": "secret"}
+	token := func(name string) (string, error) {
+		if value, exists := tokens[name]; exists {
+			return value, nil
+		}
+		return "", fmt.Errorf("unknown secret %s", name)
+	}
+
+	if _, err := NewDispatcher([]Config{{Kind: "fake", TokenSecret: "missing"}}, token); err == nil {
+		t.Errorf("Expected a missing token to be rejected")
+	}
+	if _, err := NewDispatcher([]Config{{Kind: "svn", TokenSecret: "scm-token"}}, token); err == nil {
+		t.Errorf("Expected an unknown reporter to be rejected")
+	}
+	if _, err := NewDispatcher([]Config{{Kind: "fake", TokenSecret: "scm-token"}, {Kind: "fake", TokenSecret: "scm-token"}}, token); err == nil {
+		t.Errorf("Expected two reporters of a host to be rejected")
+	}
+
+	dispatcher, err := NewDispatcher([]Config{{Kind: "fake", TokenSecret: "scm-token"}}, token)
+	if err != nil {
+		t.Fatalf("NewDispatcher failed: %v", err)
+	}
+	for _, state := range []string{StatePending, StateRunning, StateSuccess} {
+		if !dispatcher.Report(status(state)) {
+			t.Errorf("Expected the %s status to be queued", state)
+		}
+	}
+	other := status(StatePending)
+	other.Repository.Host = "github.com"
+	if dispatcher.Report(other) {
+		t.Errorf("Expected a host without a reporter to be skipped")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		dispatcher.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close did not return")
+	}
+	if strings.Join(reporter.reported, ",") != "pending,running,success" {
+		t.Errorf("Expected the statuses to be reported in order, got %v", reporter.reported)
+	}
+	if dispatcher.Report(status(StateSuccess)) {
+		t.Errorf("Expected a closed dispatcher to report nothing")
+	}
+}
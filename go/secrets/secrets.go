@@ -0,0 +1,257 @@
+// Package secrets resolves the secrets builds need, such as signing keys and
+// repository credentials. The coordinator holds references saying where each
+// named secret is stored and which environment variable of the build receives
+// it; values are only read when a build is dispatched and are masked wherever
+// build output is logged.
+package secrets
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Secret backends
+const (
+	BackendEnv   = "env"
+	BackendFile  = "file"
+	BackendVault = "vault"
+)
+
+// MaskedValue replaces secret values in masked text
+const MaskedValue = "****"
+
+// minMaskedLineLength is the shortest line of a multi-line secret masked on
+// its own; shorter lines are too likely to occur in ordinary output
+const minMaskedLineLength = 8
+
+// envVarPattern matches valid environment variable names
+var envVarPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Reference says where a secret is stored and which environment variable of
+// the build receives it
+type Reference struct {
+	EnvVar  string `json:"env_var"`
+	Backend string `json:"backend"`
+	// Key is the environment variable of the coordinator holding the secret,
+	// the absolute path of the file holding it, or the Vault path and field
+	// as "path#field". For the env backend it defaults to EnvVar.
+	Key string `json:"key,omitempty"`
+}
+
+// Validate checks that the reference names a valid environment variable and
+// a supported backend
+func (r Reference) Validate() error {
+	if !envVarPattern.MatchString(r.EnvVar) {
+		return fmt.Errorf("invalid environment variable name %q", r.EnvVar)
+	}
+
+	switch r.Backend {
+	case BackendEnv:
+		if r.Key != "" && !envVarPattern.MatchString(r.Key) {
+			return fmt.Errorf("invalid environment variable name %q", r.Key)
+		}
+	case BackendFile:
+		if !filepath.IsAbs(r.Key) {
+			return fmt.Errorf("file secret path must be absolute: %q", r.Key)
+		}
+	case BackendVault:
+		if _, _, err := splitVaultKey(r.Key); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown secret backend %q", r.Backend)
+	}
+	return nil
+}
+
+// Info describes a secret without revealing where or what it is
+type Info struct {
+	Name    string `json:"name"`
+	EnvVar  string `json:"env_var"`
+	Backend string `json:"backend"`
+}
+
+// Store resolves named secrets
+type Store struct {
+	references map[string]Reference
+	vault      *Vault
+}
+
+// NewStore creates a store of the given references by secret name. vault may
+// be nil if no reference uses the vault backend.
+func NewStore(references map[string]Reference, vault *Vault) (*Store, error) {
+	envVars := make(map[string]string, len(references))
+	for name, reference := range references {
+		if err := reference.Validate(); err != nil {
+			return nil, fmt.Errorf("secret %s: %v", name, err)
+		}
+		if reference.Backend == BackendVault && vault == nil {
+			return nil, fmt.Errorf("secret %s: vault backend requires VAULT_ADDR and VAULT_TOKEN", name)
+		}
+		if other, exists := envVars[reference.EnvVar]; exists {
+			return nil, fmt.Errorf("secrets %s and %s are both injected as %s", other, name, reference.EnvVar)
+		}
+		envVars[reference.EnvVar] = name
+	}
+
+	return &Store{references: references, vault: vault}, nil
+}
+
+// Load reads secret references by name from a JSON file
+func Load(path string, vault *Vault) (*Store, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read secrets file: %v", err)
+	}
+
+	var references map[string]Reference
+	if err := json.Unmarshal(data, &references); err != nil {
+		return nil, fmt.Errorf("failed to parse secrets file %s: %v", path, err)
+	}
+	return NewStore(references, vault)
+}
+
+// LoadFromEnv reads the references from BUILD_SECRETS_FILE, using the Vault
+// server at VAULT_ADDR with VAULT_TOKEN. Without a file, or if it is invalid,
+// the store has no secrets.
+func LoadFromEnv() *Store {
+	path := os.Getenv("BUILD_SECRETS_FILE")
+	if path == "" {
+		return &Store{}
+	}
+
+	s, err := Load(path, NewVaultFromEnv())
+	if err != nil {
+		log.Printf("Build secrets unavailable: %v", err)
+		return &Store{}
+	}
+
+	log.Printf("Loaded %d build secret references from %s", len(s.references), path)
+	return s
+}
+
+// List describes the secrets builds may request, sorted by name
+func (s *Store) List() []Info {
+	infos := make([]Info, 0, len(s.references))
+	for name, reference := range s.references {
+		infos = append(infos, Info{Name: name, EnvVar: reference.EnvVar, Backend: reference.Backend})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos
+}
+
+// Check reports an error if any of the names is not a known secret
+func (s *Store) Check(names []string) error {
+	for _, name := range names {
+		if _, exists := s.references[name]; !exists {
+			return fmt.Errorf("unknown secret %q", name)
+		}
+	}
+	return nil
+}
+
+// Resolve reads the named secrets and returns their values by the environment
+// variable receiving them. Errors never contain secret values.
+func (s *Store) Resolve(names []string) (map[string]string, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	if err := s.Check(names); err != nil {
+		return nil, err
+	}
+
+	env := make(map[string]string, len(names))
+	for _, name := range names {
+		reference := s.references[name]
+		value, err := s.read(reference)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read secret %s: %v", name, err)
+		}
+		env[reference.EnvVar] = value
+	}
+	return env, nil
+}
+
+// Value reads a single named secret, such as repository credentials that are
+// not passed to the build as an environment variable
+func (s *Store) Value(name string) (string, error) {
+	if err := s.Check([]string{name}); err != nil {
+		return "", err
+	}
+
+	value, err := s.read(s.references[name])
+	if err != nil {
+		return "", fmt.Errorf("failed to read secret %s: %v", name, err)
+	}
+	return value, nil
+}
+
+// read reads the value of a secret from its backend
+func (s *Store) read(reference Reference) (string, error) {
+	switch reference.Backend {
+	case BackendEnv:
+		key := reference.Key
+		if key == "" {
+			key = reference.EnvVar
+		}
+		value, exists := os.LookupEnv(key)
+		if !exists {
+			return "", fmt.Errorf("environment variable %s is not set", key)
+		}
+		return value, nil
+	case BackendFile:
+		data, err := os.ReadFile(reference.Key)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	case BackendVault:
+		path, field, _ := splitVaultKey(reference.Key)
+		return s.vault.Read(path, field)
+	default:
+		return "", fmt.Errorf("unknown secret backend %q", reference.Backend)
+	}
+}
+
+// Environ returns secret values as "NAME=value" entries for a command's
+// environment, sorted by name
+func Environ(env map[string]string) []string {
+	entries := make([]string, 0, len(env))
+	for name, value := range env {
+		entries = append(entries, name+"="+value)
+	}
+	sort.Strings(entries)
+	return entries
+}
+
+// Mask replaces every secret value occurring in text with MaskedValue
+func Mask(text string, env map[string]string) string {
+	values := make([]string, 0, len(env))
+	for _, value := range env {
+		if value != "" {
+			values = append(values, value)
+		}
+		// Output is logged line by line, so mask each line of multi-line
+		// values such as PEM encoded keys as well
+		if strings.Contains(value, "\n") {
+			for _, line := range strings.Split(value, "\n") {
+				if line = strings.TrimSpace(line); len(line) >= minMaskedLineLength {
+					values = append(values, line)
+				}
+			}
+		}
+	}
+	// Longer values first, so a value containing another is masked whole
+	sort.Slice(values, func(i, j int) bool { return len(values[i]) > len(values[j]) })
+
+	for _, value := range values {
+		text = strings.ReplaceAll(text, value, MaskedValue)
+	}
+	return text
+}
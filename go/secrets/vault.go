@@ -0,0 +1,84 @@
+package secrets
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Vault reads secrets from the key/value engines of a HashiCorp Vault server
+type Vault struct {
+	Address string
+	Token   string
+	Client  *http.Client
+}
+
+// NewVaultFromEnv returns a client of the Vault server at VAULT_ADDR
+// authenticating with VAULT_TOKEN, or nil if either is unset
+func NewVaultFromEnv() *Vault {
+	address, token := os.Getenv("VAULT_ADDR"), os.Getenv("VAULT_TOKEN")
+	if address == "" || token == "" {
+		return nil
+	}
+	return &Vault{Address: address, Token: token, Client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// splitVaultKey splits a "path#field" vault key
+func splitVaultKey(key string) (string, string, error) {
+	path, field, found := strings.Cut(key, "#")
+	path = strings.Trim(path, "/")
+	if !found || path == "" || field == "" {
+		return "", "", fmt.Errorf("vault secret key must be \"path#field\": %q", key)
+	}
+	return path, field, nil
+}
+
+// Read reads a field of the secret at path. Both version 1 and version 2 of
+// the key/value engine are supported; for version 2 the path includes the
+// "data/" segment, as in "secret/data/gradle#password".
+func (v *Vault) Read(path, field string) (string, error) {
+	request, err := http.NewRequest("GET", strings.TrimRight(v.Address, "/")+"/v1/"+(&url.URL{Path: path}).EscapedPath(), nil)
+	if err != nil {
+		return "", fmt.Errorf("invalid vault request: %v", err)
+	}
+	request.Header.Set("X-Vault-Token", v.Token)
+
+	client := v.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return "", fmt.Errorf("vault request failed: %v", err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("vault returned %s for %s", response.Status, path)
+	}
+
+	var secret struct {
+		Data map[string]any `json:"data"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&secret); err != nil {
+		return "", fmt.Errorf("invalid vault response for %s: %v", path, err)
+	}
+
+	// Version 2 nests the secret under data.data, next to data.metadata
+	data := secret.Data
+	if nested, ok := data["data"].(map[string]any); ok {
+		if _, versioned := data["metadata"]; versioned {
+			data = nested
+		}
+	}
+
+	value, ok := data[field].(string)
+	if !ok {
+		return "", fmt.Errorf("vault secret %s has no string field %s", path, field)
+	}
+	return value, nil
+}
@@ -0,0 +1,214 @@
+// Package signing signs the build results and artifact manifests the
+// coordinator serves with an Ed25519 key, so clients holding its public key
+// can detect results tampered with after the coordinator accepted them, such
+// as by a compromised worker or proxy.
+package signing
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Header carries the signature of a response body as
+// keyid=<key ID>,ed25519=<base64 signature>
+const Header = "X-Result-Signature"
+
+// Algorithm names the signature algorithm of published keys
+const Algorithm = "ed25519"
+
+// PublicKey is a published verification key
+type PublicKey struct {
+	KeyID     string `json:"key_id"`
+	Algorithm string `json:"algorithm"`
+	// PublicKey is the base64 encoded raw Ed25519 public key
+	PublicKey string `json:"public_key"`
+}
+
+// KeySet lists the keys responses may be signed with
+type KeySet struct {
+	Keys []PublicKey `json:"keys"`
+}
+
+// Signer signs response bodies with a private key
+type Signer struct {
+	key ed25519.PrivateKey
+	id  string
+}
+
+// NewSigner returns a signer for a private key
+func NewSigner(key ed25519.PrivateKey) *Signer {
+	return &Signer{key: key, id: KeyID(key.Public().(ed25519.PublicKey))}
+}
+
+// Generate returns a signer with a new random key
+func Generate() (*Signer, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate signing key: %v", err)
+	}
+	return NewSigner(key), nil
+}
+
+// Load reads the PKCS #8 PEM encoded private key at path, generating and
+// storing one if the file does not exist
+func Load(path string) (*Signer, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		signer, err := Generate()
+		if err != nil {
+			return nil, err
+		}
+		encoded, err := x509.MarshalPKCS8PrivateKey(signer.key)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: encoded}), 0600); err != nil {
+			return nil, fmt.Errorf("failed to store signing key: %v", err)
+		}
+		return signer, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, fmt.Errorf("%s holds no PEM encoded private key", path)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signing key %s: %v", path, err)
+	}
+	key, ok := parsed.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("signing key %s is not an Ed25519 key", path)
+	}
+	return NewSigner(key), nil
+}
+
+// LoadFromEnv loads the key at RESULT_SIGNING_KEY_FILE, defaulting to
+// data/signing-key.pem. It falls back to a key generated for this process if
+// the file cannot be read or written, in which case signatures no longer
+// verify against the published key after a restart.
+func LoadFromEnv() *Signer {
+	path := os.Getenv("RESULT_SIGNING_KEY_FILE")
+	if path == "" {
+		path = filepath.Join("data", "signing-key.pem")
+	}
+
+	signer, err := Load(path)
+	if err != nil {
+		log.Printf("Signing key unavailable, signing with a temporary key: %v", err)
+		if signer, err = Generate(); err != nil {
+			log.Printf("Results are not signed: %v", err)
+			return nil
+		}
+	}
+	log.Printf("Signing results with key %s", signer.KeyID())
+	return signer
+}
+
+// KeyID identifies a public key by the first 8 bytes of its SHA-256
+func KeyID(key ed25519.PublicKey) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+// KeyID returns the ID of the signer's key
+func (s *Signer) KeyID() string {
+	return s.id
+}
+
+// PublicKey returns the signer's key as published
+func (s *Signer) PublicKey() PublicKey {
+	return PublicKey{
+		KeyID:     s.id,
+		Algorithm: Algorithm,
+		PublicKey: base64.StdEncoding.EncodeToString(s.key.Public().(ed25519.PublicKey)),
+	}
+}
+
+// Sign returns the Header value signing body
+func (s *Signer) Sign(body []byte) string {
+	return fmt.Sprintf("keyid=%s,%s=%s", s.id, Algorithm, base64.StdEncoding.EncodeToString(ed25519.Sign(s.key, body)))
+}
+
+// WriteJSON writes v as a JSON response signed by the signer. A nil signer
+// writes it unsigned.
+func (s *Signer) WriteJSON(w http.ResponseWriter, contentType string, v any) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	body = append(body, '\n')
+
+	w.Header().Set("Content-Type", contentType)
+	if s != nil {
+		w.Header().Set(Header, s.Sign(body))
+	}
+	w.Write(body)
+}
+
+// Verifier checks signatures against trusted public keys
+type Verifier struct {
+	keys map[string]ed25519.PublicKey
+}
+
+// NewVerifier returns a verifier trusting keys
+func NewVerifier(keys ...PublicKey) (*Verifier, error) {
+	v := &Verifier{keys: make(map[string]ed25519.PublicKey)}
+	for _, key := range keys {
+		if key.Algorithm != Algorithm {
+			return nil, fmt.Errorf("key %s uses unsupported algorithm %q", key.KeyID, key.Algorithm)
+		}
+		decoded, err := base64.StdEncoding.DecodeString(key.PublicKey)
+		if err != nil || len(decoded) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("key %s is not an Ed25519 public key", key.KeyID)
+		}
+		public := ed25519.PublicKey(decoded)
+		if id := KeyID(public); id != key.KeyID {
+			return nil, fmt.Errorf("key %s has ID %s", key.KeyID, id)
+		}
+		v.keys[key.KeyID] = public
+	}
+	return v, nil
+}
+
+// Verify checks that header holds a signature of body by a trusted key
+func (v *Verifier) Verify(body []byte, header string) error {
+	if header == "" {
+		return fmt.Errorf("response is not signed")
+	}
+	fields := make(map[string]string)
+	for _, field := range strings.Split(header, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(field), "=")
+		fields[name] = value
+	}
+	key, trusted := v.keys[fields["keyid"]]
+	if !trusted {
+		return fmt.Errorf("response is signed with unknown key %q", fields["keyid"])
+	}
+	signature, err := base64.StdEncoding.DecodeString(fields[Algorithm])
+	if err != nil || !ed25519.Verify(key, body, signature) {
+		return fmt.Errorf("invalid signature of key %s", fields["keyid"])
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package signing
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data", "signing-key.pem")
+	signer, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("Expected the generated key to be stored privately, got %v: %v", info, err)
+	}
+
+	// The key survives a restart
+	reloaded, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if reloaded.KeyID() != signer.KeyID() || reloaded.PublicKey() != signer.PublicKey() || len(signer.KeyID()) != 16 {
+		t.Errorf("Expected the stored key, got %s and %s", signer.KeyID(), reloaded.KeyID())
+	}
+
+	invalid := filepath.Join(t.TempDir(), "invalid.pem")
+	os.WriteFile(invalid, []byte("not a key"), 0600)
+	if _, err := Load(invalid); err == nil {
+		t.Errorf("Expected an invalid key file to be rejected")
+	}
+}
+
+func TestSignAndVerify(t *testing.T) {
+	signer, err := Generate()
+	if err != nil {
+		t.Fatalf("Generate failed: %v", err)
+	}
+	other, _ := Generate()
+	verifier, err := NewVerifier(signer.PublicKey())
+	if err != nil {
+		t.Fatalf("NewVerifier failed: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	signer.WriteJSON(w, "application/json", map[string]any{"success": true, "worker_id": "worker-1"})
+	body, header := w.Body.Bytes(), w.Header().Get(Header)
+	if !strings.HasPrefix(header, "keyid="+signer.KeyID()+",ed25519=") || w.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("Unexpected signature header %q", header)
+	}
+	if err := verifier.Verify(body, header); err != nil {
+		t.Errorf("Expected the response to verify, got %v", err)
+	}
+
+	tampered := []byte(strings.Replace(string(body), "true", "false", 1))
+	for name, check := range map[string]error{
+		"tampered body": verifier.Verify(tampered, header),
+		"unsigned":      verifier.Verify(body, ""),
+		"unknown key":   verifier.Verify(body, other.Sign(body)),
+		"bad signature": verifier.Verify(body, "keyid="+signer.KeyID()+",ed25519=AAAA"),
+	} {
+		if check == nil {
+			t.Errorf("Expected the %s response to be rejected", name)
+		}
+	}
+
+	mismatched := signer.PublicKey()
+	mismatched.KeyID = other.KeyID()
+	if _, err := NewVerifier(mismatched); err == nil {
+		t.Errorf("Expected a key with the wrong ID to be rejected")
+	}
+	if _, err := NewVerifier(PublicKey{KeyID: "x", Algorithm: "rsa"}); err == nil {
+		t.Errorf("Expected an unsupported algorithm to be rejected")
+	}
+
+	// A nil signer writes unsigned responses
+	w = httptest.NewRecorder()
+	(*Signer)(nil).WriteJSON(w, "application/json", []string{})
+	if w.Header().Get(Header) != "" || w.Body.String() != "[]\n" {
+		t.Errorf("Expected an unsigned response, got %q", w.Body.String())
+	}
+}
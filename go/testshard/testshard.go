@@ -0,0 +1,336 @@
+// Package testshard splits the test classes of a Gradle project across
+// workers and reads back the JUnit results of each part. Every worker finds
+// the test classes in its own copy of the project and computes the same
+// assignment from the same historical durations, so the shards never need
+// to agree on anything but their index.
+package testshard
+
+import (
+	"cmp"
+	"encoding/xml"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Shard selects the test classes a build runs: shard Index, from 0, of the
+// Count shards the classes are split into by Assign. Durations are the
+// historical durations of test classes by name.
+type Shard struct {
+	Index     int                      `json:"index"`
+	Count     int                      `json:"count"`
+	Durations map[string]time.Duration `json:"durations,omitempty"`
+}
+
+// Outcomes of a test case
+const (
+	CasePassed  = "passed"
+	CaseFailed  = "failed"
+	CaseSkipped = "skipped"
+)
+
+// ClassResult is the outcome of a test class as reported by JUnit.
+// Failures include errors.
+type ClassResult struct {
+	Name     string        `json:"name"`
+	Tests    int           `json:"tests"`
+	Failures int           `json:"failures"`
+	Skipped  int           `json:"skipped"`
+	Duration time.Duration `json:"duration"`
+	// Cases are the outcomes of the test cases of the class, a case retried
+	// within the build once per run
+	Cases []CaseResult `json:"cases,omitempty"`
+}
+
+// CaseResult is the outcome of a test case, one of CasePassed, CaseFailed
+// and CaseSkipped
+type CaseResult struct {
+	Name     string        `json:"name"`
+	Outcome  string        `json:"outcome"`
+	Duration time.Duration `json:"duration"`
+}
+
+// testSourceDirs are the source sets tests are found in
+var testSourceDirs = []string{"/src/test/java/", "/src/test/kotlin/", "/src/test/groovy/", "/src/test/scala/"}
+
+// testSuffixes are the names of test classes by convention
+var testSuffixes = []string{"Test", "Tests", "TestCase", "IT", "Spec"}
+
+// className matches the fully qualified names Gradle filters can take
+var className = regexp.MustCompile(`^[A-Za-z_$][A-Za-z0-9_$]*(\.[A-Za-z_$][A-Za-z0-9_$]*)*$`)
+
+// skippedDirs are never searched for tests or results
+var skippedDirs = map[string]bool{".git": true, ".gradle": true, ".idea": true, "node_modules": true}
+
+// Discover returns the test classes of a project in name order: the source
+// files of its test source sets named like tests
+func Discover(projectDir string) ([]string, error) {
+	var classes []string
+	err := filepath.WalkDir(projectDir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			if skippedDirs[entry.Name()] || entry.Name() == "build" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		slashed := filepath.ToSlash(path)
+		extension := filepath.Ext(slashed)
+		name := strings.TrimSuffix(entry.Name(), extension)
+		if !slices.Contains([]string{".java", ".kt", ".groovy", ".scala"}, extension) || !hasTestSuffix(name) {
+			return nil
+		}
+		for _, dir := range testSourceDirs {
+			if _, source, found := strings.Cut(slashed, dir); found {
+				class := strings.ReplaceAll(strings.TrimSuffix(source, extension), "/", ".")
+				if className.MatchString(class) {
+					classes = append(classes, class)
+				}
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	slices.Sort(classes)
+	return slices.Compact(classes), nil
+}
+
+func hasTestSuffix(name string) bool {
+	for _, suffix := range testSuffixes {
+		if strings.HasSuffix(name, suffix) && len(name) > len(suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Assign splits classes into count shards of about equal duration, placing
+// the longest classes first on the shard with the least duration so far.
+// Classes without a historical duration are taken to last as long as the
+// average class that has one. The assignment only depends on its
+// arguments, not on their order.
+func Assign(classes []string, durations map[string]time.Duration, count int) [][]string {
+	if count < 1 {
+		count = 1
+	}
+
+	var known time.Duration
+	var samples int
+	for _, class := range classes {
+		if duration := durations[class]; duration > 0 {
+			known += duration
+			samples++
+		}
+	}
+	typical := time.Second
+	if samples > 0 {
+		typical = known / time.Duration(samples)
+	}
+	duration := func(class string) time.Duration {
+		if duration := durations[class]; duration > 0 {
+			return duration
+		}
+		return typical
+	}
+
+	ordered := slices.Clone(classes)
+	slices.SortFunc(ordered, func(a, b string) int {
+		if order := cmp.Compare(duration(b), duration(a)); order != 0 {
+			return order
+		}
+		return strings.Compare(a, b)
+	})
+
+	shards := make([][]string, count)
+	totals := make([]time.Duration, count)
+	for _, class := range ordered {
+		shortest := 0
+		for i := range totals {
+			if totals[i] < totals[shortest] {
+				shortest = i
+			}
+		}
+		shards[shortest] = append(shards[shortest], class)
+		totals[shortest] += duration(class)
+	}
+	for _, shard := range shards {
+		slices.Sort(shard)
+	}
+	return shards
+}
+
+// InitScript returns a Gradle init script restricting every test task of
+// the build to the include classes, or to all but the exclude classes.
+// Test tasks of projects without any of the classes run no tests instead of
+// failing.
+func InitScript(include, exclude []string) (string, error) {
+	var script strings.Builder
+	script.WriteString("allprojects {\n    tasks.withType(Test).configureEach {\n        filter {\n")
+	script.WriteString("            failOnNoMatchingTests = false\n")
+	for _, pattern := range []struct {
+		method  string
+		classes []string
+	}{{"includeTestsMatching", include}, {"excludeTestsMatching", exclude}} {
+		for _, class := range pattern.classes {
+			if !className.MatchString(class) {
+				return "", fmt.Errorf("invalid test class %q", class)
+			}
+			fmt.Fprintf(&script, "            %s '%s'\n", pattern.method, class)
+		}
+	}
+	script.WriteString("        }\n    }\n}\n")
+	return script.String(), nil
+}
+
+// Select returns the test classes of a project a shard runs. Every shard
+// but the first includes the classes assigned to it. The first excludes the
+// classes of the other shards instead, so test classes Discover does not
+// recognize still run once. ok is false when a shard other than the first
+// has no classes and so nothing to run.
+func Select(classes []string, shard Shard) (include, exclude []string, ok bool, err error) {
+	if shard.Count < 1 || shard.Index < 0 || shard.Index >= shard.Count {
+		return nil, nil, false, fmt.Errorf("invalid test shard %d of %d", shard.Index+1, shard.Count)
+	}
+
+	shards := Assign(classes, shard.Durations, shard.Count)
+	if shard.Index == 0 {
+		for _, other := range shards[1:] {
+			exclude = append(exclude, other...)
+		}
+		slices.Sort(exclude)
+		return nil, exclude, true, nil
+	}
+	return shards[shard.Index], nil, len(shards[shard.Index]) > 0, nil
+}
+
+// testSuite is the root element of a JUnit XML report
+type testSuite struct {
+	Name     string     `xml:"name,attr"`
+	Tests    int        `xml:"tests,attr"`
+	Failures int        `xml:"failures,attr"`
+	Errors   int        `xml:"errors,attr"`
+	Skipped  int        `xml:"skipped,attr"`
+	Time     float64    `xml:"time,attr"`
+	Cases    []testCase `xml:"testcase"`
+}
+
+// testCase is a test case of a JUnit XML report
+type testCase struct {
+	Name    string    `xml:"name,attr"`
+	Time    float64   `xml:"time,attr"`
+	Failure *struct{} `xml:"failure"`
+	Error   *struct{} `xml:"error"`
+	Skipped *struct{} `xml:"skipped"`
+}
+
+func (c testCase) outcome() string {
+	switch {
+	case c.Failure != nil || c.Error != nil:
+		return CaseFailed
+	case c.Skipped != nil:
+		return CaseSkipped
+	default:
+		return CasePassed
+	}
+}
+
+func seconds(value float64) time.Duration {
+	return time.Duration(value * float64(time.Second))
+}
+
+// ReadResults reads the JUnit reports Gradle wrote to the test-results
+// directories of a project since a time, in class name order
+func ReadResults(projectDir string, since time.Time) ([]ClassResult, error) {
+	var results []ClassResult
+	err := filepath.WalkDir(projectDir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			if skippedDirs[entry.Name()] {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if !strings.HasPrefix(entry.Name(), "TEST-") || filepath.Ext(entry.Name()) != ".xml" ||
+			!strings.Contains(filepath.ToSlash(path), "/build/test-results/") {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil || info.ModTime().Before(since) {
+			return nil
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var suite testSuite
+		if err := xml.Unmarshal(data, &suite); err != nil {
+			return fmt.Errorf("failed to parse test report %s: %v", path, err)
+		}
+		result := ClassResult{
+			Name:     suite.Name,
+			Tests:    suite.Tests,
+			Failures: suite.Failures + suite.Errors,
+			Skipped:  suite.Skipped,
+			Duration: seconds(suite.Time),
+		}
+		for _, c := range suite.Cases {
+			result.Cases = append(result.Cases, CaseResult{Name: c.Name, Outcome: c.outcome(), Duration: seconds(c.Time)})
+		}
+		results = append(results, result)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return Merge(results), nil
+}
+
+// Merge combines test results by class in name order, adding up the
+// results of a class reported more than once, such as by the test tasks of
+// several projects, and keeping the outcomes of all its cases
+func Merge(results ...[]ClassResult) []ClassResult {
+	byName := make(map[string]int)
+	var merged []ClassResult
+	for _, list := range results {
+		for _, result := range list {
+			if i, ok := byName[result.Name]; ok {
+				existing := &merged[i]
+				existing.Tests += result.Tests
+				existing.Failures += result.Failures
+				existing.Skipped += result.Skipped
+				existing.Duration += result.Duration
+				existing.Cases = append(slices.Clone(existing.Cases), result.Cases...)
+				continue
+			}
+			byName[result.Name] = len(merged)
+			merged = append(merged, result)
+		}
+	}
+	slices.SortFunc(merged, func(a, b ClassResult) int { return strings.Compare(a.Name, b.Name) })
+	return merged
+}
+
+// Durations returns the duration of each class of results
+func Durations(results []ClassResult) map[string]time.Duration {
+	durations := make(map[string]time.Duration, len(results))
+	for _, result := range results {
+		durations[result.Name] = result.Duration
+	}
+	return durations
+}
@@ -0,0 +1,136 @@
+package testshard
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDiscover(t *testing.T) {
+	dir := t.TempDir()
+	for _, file := range []string{
+		"app/src/test/java/com/example/AppTest.java",
+		"app/src/test/java/com/example/TestUtils.java",
+		"app/src/main/java/com/example/AppTest.java",
+		"lib/src/test/kotlin/com/example/lib/ParserTests.kt",
+		"lib/src/test/groovy/com/example/lib/ParserSpec.groovy",
+		"lib/build/tmp/src/test/java/GeneratedTest.java",
+	} {
+		writeFile(t, filepath.Join(dir, file), "")
+	}
+
+	classes, err := Discover(dir)
+	if err != nil {
+		t.Fatalf("Discover failed: %v", err)
+	}
+	expected := []string{"com.example.AppTest", "com.example.lib.ParserSpec", "com.example.lib.ParserTests"}
+	if !reflect.DeepEqual(classes, expected) {
+		t.Errorf("Expected %v, got %v", expected, classes)
+	}
+}
+
+func TestAssign(t *testing.T) {
+	durations := map[string]time.Duration{"A": 6 * time.Second, "B": 4 * time.Second, "C": 3 * time.Second, "D": 3 * time.Second}
+	shards := Assign([]string{"D", "C", "B", "A", "E"}, durations, 2)
+	// E takes 4s, the average, and the longest classes are placed first
+	expected := [][]string{{"A", "C"}, {"B", "D", "E"}}
+	if !reflect.DeepEqual(shards, expected) {
+		t.Errorf("Expected %v, got %v", expected, shards)
+	}
+
+	// The order of the classes does not change the assignment
+	if again := Assign([]string{"A", "B", "C", "D", "E"}, durations, 2); !reflect.DeepEqual(again, shards) {
+		t.Errorf("Expected the same assignment, got %v", again)
+	}
+
+	// Without history the classes are spread evenly
+	for _, shard := range Assign([]string{"A", "B", "C", "D"}, nil, 2) {
+		if len(shard) != 2 {
+			t.Errorf("Expected 2 classes per shard, got %v", shard)
+		}
+	}
+}
+
+func TestSelect(t *testing.T) {
+	classes := []string{"A", "B", "C"}
+	include, exclude, ok, err := Select(classes, Shard{Index: 0, Count: 3})
+	if err != nil || !ok || include != nil || !reflect.DeepEqual(exclude, []string{"B", "C"}) {
+		t.Errorf("Expected the first shard to exclude the others, got %v %v %v %v", include, exclude, ok, err)
+	}
+	include, exclude, ok, err = Select(classes, Shard{Index: 2, Count: 3})
+	if err != nil || !ok || !reflect.DeepEqual(include, []string{"C"}) || exclude != nil {
+		t.Errorf("Expected the last shard to include its class, got %v %v %v %v", include, exclude, ok, err)
+	}
+	if _, _, ok, err := Select(classes[:1], Shard{Index: 1, Count: 2}); err != nil || ok {
+		t.Errorf("Expected an empty shard to have nothing to run, got %v %v", ok, err)
+	}
+	if _, _, _, err := Select(classes, Shard{Index: 3, Count: 3}); err == nil {
+		t.Error("Expected an invalid shard to be rejected")
+	}
+}
+
+func TestInitScript(t *testing.T) {
+	script, err := InitScript([]string{"com.example.AppTest"}, []string{"com.example.Outer$InnerTest"})
+	if err != nil {
+		t.Fatalf("InitScript failed: %v", err)
+	}
+	for _, line := range []string{"failOnNoMatchingTests = false", "includeTestsMatching 'com.example.AppTest'", "excludeTestsMatching 'com.example.Outer$InnerTest'"} {
+		if !strings.Contains(script, line) {
+			t.Errorf("Expected %q in script:\n%s", line, script)
+		}
+	}
+
+	if _, err := InitScript([]string{"x'; System.exit(1); '"}, nil); err == nil {
+		t.Error("Expected a class name that is not one to be rejected")
+	}
+}
+
+func TestReadResults(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "app/build/test-results/test/TEST-com.example.AppTest.xml"),
+		`<?xml version="1.0" encoding="UTF-8"?>
+<testsuite name="com.example.AppTest" tests="5" skipped="1" failures="1" errors="1" time="2.5">
+  <testcase name="works" classname="com.example.AppTest" time="0.5"/>
+  <testcase name="fails" classname="com.example.AppTest" time="1.0"><failure message="expected">stack</failure></testcase>
+  <testcase name="crashes" classname="com.example.AppTest" time="0.25"><error message="boom"/></testcase>
+  <testcase name="ignored" classname="com.example.AppTest" time="0"><skipped/></testcase>
+</testsuite>`)
+	writeFile(t, filepath.Join(dir, "lib/build/test-results/test/TEST-com.example.AppTest.xml"),
+		`<testsuite name="com.example.AppTest" tests="2" skipped="0" failures="0" errors="0" time="0.5">
+  <testcase name="works" classname="com.example.AppTest" time="0.5"/>
+</testsuite>`)
+	writeFile(t, filepath.Join(dir, "lib/build/reports/TEST-other.xml"), `not a report`)
+
+	results, err := ReadResults(dir, time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatalf("ReadResults failed: %v", err)
+	}
+	expected := []ClassResult{{Name: "com.example.AppTest", Tests: 7, Failures: 2, Skipped: 1, Duration: 3 * time.Second, Cases: []CaseResult{
+		{Name: "works", Outcome: CasePassed, Duration: 500 * time.Millisecond},
+		{Name: "fails", Outcome: CaseFailed, Duration: time.Second},
+		{Name: "crashes", Outcome: CaseFailed, Duration: 250 * time.Millisecond},
+		{Name: "ignored", Outcome: CaseSkipped},
+		{Name: "works", Outcome: CasePassed, Duration: 500 * time.Millisecond},
+	}}}
+	if !reflect.DeepEqual(results, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, results)
+	}
+
+	// Reports of earlier builds are ignored
+	if results, err := ReadResults(dir, time.Now().Add(time.Minute)); err != nil || len(results) != 0 {
+		t.Errorf("Expected no results, got %+v, %v", results, err)
+	}
+}
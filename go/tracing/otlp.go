@@ -0,0 +1,229 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"distributed-gradle-building/openapi"
+)
+
+// selfTestTimeout bounds the connectivity check of the status endpoint
+const selfTestTimeout = 5 * time.Second
+
+// OTLP/HTTP JSON export request, as defined by the OpenTelemetry protocol.
+// IDs are hex encoded and 64-bit integers are strings.
+type exportRequest struct {
+	ResourceSpans []resourceSpans `json:"resourceSpans"`
+}
+
+type resourceSpans struct {
+	Resource   resource     `json:"resource"`
+	ScopeSpans []scopeSpans `json:"scopeSpans"`
+}
+
+type resource struct {
+	Attributes []keyValue `json:"attributes"`
+}
+
+type scopeSpans struct {
+	Scope scope      `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type scope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string     `json:"traceId"`
+	SpanID            string     `json:"spanId"`
+	ParentSpanID      string     `json:"parentSpanId,omitempty"`
+	Name              string     `json:"name"`
+	Kind              int        `json:"kind"`
+	StartTimeUnixNano string     `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string     `json:"endTimeUnixNano"`
+	Attributes        []keyValue `json:"attributes,omitempty"`
+	Status            otlpStatus `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// statusError is the OTLP status code of a failed span
+const statusError = 2
+
+type keyValue struct {
+	Key   string   `json:"key"`
+	Value anyValue `json:"value"`
+}
+
+type anyValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+// encode converts spans to an OTLP export request of the tracer's service
+func (t *Tracer) encode(spans []*Span) exportRequest {
+	encoded := make([]otlpSpan, 0, len(spans))
+	for _, span := range spans {
+		span.mutex.Lock()
+		s := otlpSpan{
+			TraceID:           hex.EncodeToString(span.context.TraceID[:]),
+			SpanID:            hex.EncodeToString(span.context.SpanID[:]),
+			Name:              span.name,
+			Kind:              span.kind,
+			StartTimeUnixNano: strconv.FormatInt(span.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.end.UnixNano(), 10),
+			Attributes:        attributes(span.attributes),
+		}
+		if span.parent != [8]byte{} {
+			s.ParentSpanID = hex.EncodeToString(span.parent[:])
+		}
+		if span.err != "" {
+			s.Status = otlpStatus{Code: statusError, Message: span.err}
+		}
+		span.mutex.Unlock()
+		encoded = append(encoded, s)
+	}
+
+	return exportRequest{ResourceSpans: []resourceSpans{{
+		Resource:   resource{Attributes: attributes(map[string]string{"service.name": t.config.Service})},
+		ScopeSpans: []scopeSpans{{Scope: scope{Name: "distributed-gradle-building"}, Spans: encoded}},
+	}}}
+}
+
+// attributes converts a map to OTLP attributes sorted by key
+func attributes(values map[string]string) []keyValue {
+	encoded := make([]keyValue, 0, len(values))
+	for key, value := range values {
+		encoded = append(encoded, keyValue{Key: key, Value: anyValue{StringValue: value}})
+	}
+	sort.Slice(encoded, func(i, j int) bool { return encoded[i].Key < encoded[j].Key })
+	return encoded
+}
+
+// export sends spans to the collector
+func (t *Tracer) export(ctx context.Context, spans []*Span) error {
+	body, err := json.Marshal(t.encode(spans))
+	if err != nil {
+		return fmt.Errorf("failed to encode spans: %v", err)
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, t.config.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	response, err := t.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		message, _ := io.ReadAll(io.LimitReader(response.Body, 512))
+		return fmt.Errorf("collector returned %s: %s", response.Status, bytes.TrimSpace(message))
+	}
+	return nil
+}
+
+// Status reports the configuration of a tracer and how its exports went.
+// The self test fills in Reachable, Error and TraceID.
+type Status struct {
+	Service       string     `json:"service,omitempty"`
+	Enabled       bool       `json:"enabled"`
+	Endpoint      string     `json:"endpoint,omitempty"`
+	SampleRate    float64    `json:"sample_rate"`
+	Reachable     bool       `json:"reachable"`
+	Error         string     `json:"error,omitempty"`
+	TraceID       string     `json:"trace_id,omitempty"`
+	ExportedSpans int64      `json:"exported_spans"`
+	DroppedSpans  int64      `json:"dropped_spans"`
+	QueuedSpans   int        `json:"queued_spans"`
+	LastExport    *time.Time `json:"last_export,omitempty"`
+	LastError     string     `json:"last_error,omitempty"`
+}
+
+// Status returns the configuration and export counts of a tracer
+func (t *Tracer) Status() Status {
+	if t == nil {
+		return Status{}
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	status := Status{
+		Service:       t.config.Service,
+		Enabled:       true,
+		Endpoint:      t.config.Endpoint,
+		SampleRate:    t.config.SampleRate,
+		ExportedSpans: t.exported,
+		DroppedSpans:  t.dropped,
+		QueuedSpans:   len(t.queue),
+		LastError:     t.lastError,
+	}
+	if !t.lastExport.IsZero() {
+		lastExport := t.lastExport
+		status.LastExport = &lastExport
+	}
+	return status
+}
+
+// SelfTest exports a tracing.self_test span directly, bypassing sampling,
+// and returns its trace ID so it can be looked up in the collector's UI
+func (t *Tracer) SelfTest(ctx context.Context) (string, error) {
+	if t == nil {
+		return "", fmt.Errorf("tracing is disabled")
+	}
+
+	_, span := t.Start(context.Background(), "tracing.self_test", KindInternal)
+	span.end = span.start
+	traceID := hex.EncodeToString(span.context.TraceID[:])
+	return traceID, t.export(ctx, []*Span{span})
+}
+
+// Handler serves the tracer's status after a self test, with 503 Service
+// Unavailable when the collector does not accept spans. Disabled tracing is
+// reported without a test.
+func (t *Tracer) Handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status := t.Status()
+		code := http.StatusOK
+		if t != nil {
+			ctx, cancel := context.WithTimeout(r.Context(), selfTestTimeout)
+			defer cancel()
+			traceID, err := t.SelfTest(ctx)
+			status.TraceID = traceID
+			status.Reachable = err == nil
+			if err != nil {
+				status.Error = err.Error()
+				code = http.StatusServiceUnavailable
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(status)
+	}
+}
+
+// Route describes the GET /api/tracing/check endpoint served by Handler
+func Route() openapi.Route {
+	return openapi.Route{
+		Method:      "GET",
+		Path:        "/api/tracing/check",
+		Summary:     "Export a test span to the tracing collector and report the tracing status",
+		OperationID: "checkTracing",
+		Response:    Status{},
+	}
+}
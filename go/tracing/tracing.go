@@ -0,0 +1,376 @@
+// Package tracing records spans of the work a service does and exports the
+// sampled ones to an OpenTelemetry collector, such as Jaeger, over OTLP/HTTP
+// with the JSON encoding. Traces continue across services through the W3C
+// traceparent header.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TraceparentHeader carries the W3C trace context between services
+const TraceparentHeader = "traceparent"
+
+// DefaultSampleRate is the fraction of new traces exported, unless
+// TRACING_SAMPLE_RATE is set
+const DefaultSampleRate = 1.0
+
+// Span kinds, as numbered by OTLP
+const (
+	KindInternal = 1
+	KindServer   = 2
+	KindClient   = 3
+)
+
+const (
+	// maxQueuedSpans bounds the spans waiting for export; further spans are
+	// dropped while the collector is unreachable
+	maxQueuedSpans = 2048
+	// maxBatchSpans is the most spans sent in one export
+	maxBatchSpans = 512
+	flushInterval = 5 * time.Second
+	exportTimeout = 10 * time.Second
+)
+
+// Config configures a tracer. Endpoint is the OTLP/HTTP traces URL, such as
+// http://jaeger:4318/v1/traces, and SampleRate the fraction of new traces
+// exported. Traces continued from another service follow its decision.
+type Config struct {
+	Service    string  `json:"service"`
+	Endpoint   string  `json:"endpoint"`
+	SampleRate float64 `json:"sample_rate"`
+}
+
+// validate checks the endpoint and sample rate of a configuration
+func (c Config) validate() error {
+	if c.Service == "" {
+		return fmt.Errorf("service name is required")
+	}
+	endpoint, err := url.Parse(c.Endpoint)
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		return fmt.Errorf("invalid endpoint %q: expected an http or https URL", c.Endpoint)
+	}
+	if c.SampleRate < 0 || c.SampleRate > 1 {
+		return fmt.Errorf("sample rate %v is not between 0 and 1", c.SampleRate)
+	}
+	return nil
+}
+
+// Tracer records spans and exports them in batches. A nil Tracer records
+// nothing, so services call it unconditionally.
+type Tracer struct {
+	config Config
+	client *http.Client
+
+	mutex      sync.Mutex
+	queue      []*Span
+	exported   int64
+	dropped    int64
+	lastExport time.Time
+	lastError  string
+
+	flush chan struct{}
+	done  chan struct{}
+	wait  sync.WaitGroup
+}
+
+// New starts a tracer exporting to the configured endpoint
+func New(config Config) (*Tracer, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+
+	t := &Tracer{
+		config: config,
+		client: &http.Client{Timeout: exportTimeout},
+		flush:  make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	t.wait.Add(1)
+	go t.run()
+	return t, nil
+}
+
+// FromEnv starts a tracer for service exporting to TRACING_ENDPOINT, sampling
+// TRACING_SAMPLE_RATE of new traces. It returns nil when TRACING_ENDPOINT is
+// not set.
+func FromEnv(service string) (*Tracer, error) {
+	endpoint := os.Getenv("TRACING_ENDPOINT")
+	if endpoint == "" {
+		return nil, nil
+	}
+
+	rate := DefaultSampleRate
+	if value := os.Getenv("TRACING_SAMPLE_RATE"); value != "" {
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TRACING_SAMPLE_RATE %q: %v", value, err)
+		}
+		rate = parsed
+	}
+	return New(Config{Service: service, Endpoint: endpoint, SampleRate: rate})
+}
+
+// Close exports the remaining spans and stops the tracer
+func (t *Tracer) Close() {
+	if t == nil {
+		return
+	}
+	close(t.done)
+	t.wait.Wait()
+}
+
+// run exports the queued spans every flushInterval, or once a batch is full
+func (t *Tracer) run() {
+	defer t.wait.Done()
+
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			t.exportQueued()
+		case <-t.flush:
+			t.exportQueued()
+		case <-t.done:
+			t.exportQueued()
+			return
+		}
+	}
+}
+
+// exportQueued exports the queued spans in batches
+func (t *Tracer) exportQueued() {
+	for {
+		t.mutex.Lock()
+		batch := t.queue[:min(len(t.queue), maxBatchSpans)]
+		t.queue = t.queue[len(batch):]
+		t.mutex.Unlock()
+		if len(batch) == 0 {
+			return
+		}
+
+		err := t.export(context.Background(), batch)
+
+		t.mutex.Lock()
+		if err != nil {
+			t.dropped += int64(len(batch))
+			t.lastError = err.Error()
+		} else {
+			t.exported += int64(len(batch))
+			t.lastExport = time.Now()
+			t.lastError = ""
+		}
+		t.mutex.Unlock()
+		if err != nil {
+			log.Printf("Failed to export %d spans: %v", len(batch), err)
+			return
+		}
+	}
+}
+
+// enqueue queues an ended span for export
+func (t *Tracer) enqueue(span *Span) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if len(t.queue) >= maxQueuedSpans {
+		t.dropped++
+		return
+	}
+	t.queue = append(t.queue, span)
+	if len(t.queue) >= maxBatchSpans {
+		select {
+		case t.flush <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// sampled decides whether a new trace is exported. The decision depends on
+// the trace ID only, so every service sampling at the same rate agrees.
+func (t *Tracer) sampled(traceID [16]byte) bool {
+	threshold := uint64(t.config.SampleRate * (1 << 63))
+	return binary.BigEndian.Uint64(traceID[8:])>>1 < threshold
+}
+
+// SpanContext identifies a span within its trace
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Sampled bool
+}
+
+// IsValid reports whether the trace and span IDs are set
+func (c SpanContext) IsValid() bool {
+	return c.TraceID != [16]byte{} && c.SpanID != [8]byte{}
+}
+
+// Traceparent formats the context as a W3C traceparent header value
+func (c SpanContext) Traceparent() string {
+	flags := 0
+	if c.Sampled {
+		flags = 1
+	}
+	return fmt.Sprintf("00-%x-%x-%02x", c.TraceID, c.SpanID, flags)
+}
+
+// ParseTraceparent parses a W3C traceparent header value
+func ParseTraceparent(value string) (SpanContext, bool) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return SpanContext{}, false
+	}
+	if parts[0] == "00" && len(parts) != 4 {
+		return SpanContext{}, false
+	}
+
+	var c SpanContext
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return SpanContext{}, false
+	}
+	if _, err := hex.Decode(c.TraceID[:], []byte(parts[1])); err != nil {
+		return SpanContext{}, false
+	}
+	if _, err := hex.Decode(c.SpanID[:], []byte(parts[2])); err != nil {
+		return SpanContext{}, false
+	}
+	c.Sampled = flags[0]&1 == 1
+	return c, c.IsValid()
+}
+
+type contextKey struct{}
+
+// ContextWithSpan returns a context whose current span is span
+func ContextWithSpan(ctx context.Context, span *Span) context.Context {
+	return context.WithValue(ctx, contextKey{}, span)
+}
+
+// SpanFromContext returns the current span of a context, or nil
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(contextKey{}).(*Span)
+	return span
+}
+
+// Extract returns a context continuing the trace of a traceparent header
+func Extract(ctx context.Context, header http.Header) context.Context {
+	remote, ok := ParseTraceparent(header.Get(TraceparentHeader))
+	if !ok {
+		return ctx
+	}
+	return ContextWithSpan(ctx, &Span{context: remote})
+}
+
+// Inject sets the traceparent header of an outgoing request to the current
+// span of ctx, if any
+func Inject(ctx context.Context, header http.Header) {
+	if span := SpanFromContext(ctx); span != nil && span.context.IsValid() {
+		header.Set(TraceparentHeader, span.context.Traceparent())
+	}
+}
+
+// Span is a timed operation of a trace. The methods of a nil Span do
+// nothing.
+type Span struct {
+	tracer  *Tracer
+	context SpanContext
+	parent  [8]byte
+	name    string
+	kind    int
+	start   time.Time
+
+	mutex      sync.Mutex
+	end        time.Time
+	attributes map[string]string
+	err        string
+}
+
+// Start starts a span as a child of the current span of ctx, returning a
+// context whose current span is the new one
+func (t *Tracer) Start(ctx context.Context, name string, kind int) (context.Context, *Span) {
+	return t.StartAt(ctx, name, kind, time.Now())
+}
+
+// StartAt starts a span at a past time, such as for an operation reported
+// once it finished
+func (t *Tracer) StartAt(ctx context.Context, name string, kind int, start time.Time) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+
+	span := &Span{tracer: t, name: name, kind: kind, start: start, attributes: make(map[string]string)}
+	if parent := SpanFromContext(ctx); parent != nil && parent.context.IsValid() {
+		span.context.TraceID = parent.context.TraceID
+		span.context.Sampled = parent.context.Sampled
+		span.parent = parent.context.SpanID
+	} else {
+		rand.Read(span.context.TraceID[:])
+		span.context.Sampled = t.sampled(span.context.TraceID)
+	}
+	rand.Read(span.context.SpanID[:])
+	return ContextWithSpan(ctx, span), span
+}
+
+// Context returns the IDs of the span
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.context
+}
+
+// SetAttribute records a key and value describing the span
+func (s *Span) SetAttribute(key, value string) {
+	if s == nil || s.tracer == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.attributes[key] = value
+}
+
+// SetError marks the span as failed
+func (s *Span) SetError(message string) {
+	if s == nil || s.tracer == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.err = message
+}
+
+// End ends the span, queueing it for export if its trace is sampled
+func (s *Span) End() {
+	s.EndAt(time.Now())
+}
+
+// EndAt ends the span at a past time
+func (s *Span) EndAt(end time.Time) {
+	if s == nil || s.tracer == nil {
+		return
+	}
+	s.mutex.Lock()
+	ended := !s.end.IsZero()
+	if !ended {
+		s.end = end
+	}
+	s.mutex.Unlock()
+
+	if !ended && s.context.Sampled {
+		s.tracer.enqueue(s)
+	}
+}
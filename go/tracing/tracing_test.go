@@ -0,0 +1,206 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// collector is an OTLP/HTTP endpoint recording the spans it receives
+type collector struct {
+	*httptest.Server
+	mutex    sync.Mutex
+	requests []exportRequest
+	status   int
+}
+
+func newCollector(t *testing.T, status int) *collector {
+	c := &collector{status: status}
+	c.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request exportRequest
+		if r.Header.Get("Content-Type") != "application/json" || json.NewDecoder(r.Body).Decode(&request) != nil {
+			http.Error(w, "expected OTLP JSON", http.StatusBadRequest)
+			return
+		}
+		c.mutex.Lock()
+		c.requests = append(c.requests, request)
+		c.mutex.Unlock()
+		w.WriteHeader(c.status)
+	}))
+	t.Cleanup(c.Close)
+	return c
+}
+
+// spans returns the received spans by name
+func (c *collector) spans() map[string]otlpSpan {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	spans := make(map[string]otlpSpan)
+	for _, request := range c.requests {
+		for _, span := range request.ResourceSpans[0].ScopeSpans[0].Spans {
+			spans[span.Name] = span
+		}
+	}
+	return spans
+}
+
+func TestExport(t *testing.T) {
+	collector := newCollector(t, http.StatusOK)
+	tracer, err := New(Config{Service: "coordinator", Endpoint: collector.URL + "/v1/traces", SampleRate: 1})
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	ctx, parent := tracer.Start(context.Background(), "POST /api/build", KindServer)
+	_, child := tracer.Start(ctx, "queue build", KindInternal)
+	child.SetAttribute("build.id", "build-1")
+	child.SetError("queue full")
+	child.End()
+	parent.End()
+	tracer.Close()
+
+	spans := collector.spans()
+	server, queued := spans["POST /api/build"], spans["queue build"]
+	if server.TraceID == "" || queued.TraceID != server.TraceID || queued.ParentSpanID != server.SpanID || server.ParentSpanID != "" {
+		t.Fatalf("Expected a parent and child span of one trace, got %+v", spans)
+	}
+	if server.Kind != KindServer || queued.Status.Code != statusError || queued.Status.Message != "queue full" {
+		t.Errorf("Expected the kind and error status to be exported, got %+v and %+v", server, queued)
+	}
+	if len(queued.Attributes) != 1 || queued.Attributes[0].Value.StringValue != "build-1" {
+		t.Errorf("Expected the span attributes, got %+v", queued.Attributes)
+	}
+	service := collector.requests[0].ResourceSpans[0].Resource.Attributes
+	if len(service) != 1 || service[0].Key != "service.name" || service[0].Value.StringValue != "coordinator" {
+		t.Errorf("Expected the service name as a resource attribute, got %+v", service)
+	}
+	if status := tracer.Status(); status.ExportedSpans != 2 || status.LastExport == nil {
+		t.Errorf("Expected 2 exported spans, got %+v", status)
+	}
+}
+
+func TestSampling(t *testing.T) {
+	collector := newCollector(t, http.StatusOK)
+	tracer, _ := New(Config{Service: "worker", Endpoint: collector.URL, SampleRate: 0})
+
+	_, unsampled := tracer.Start(context.Background(), "new trace", KindServer)
+	unsampled.End()
+	if unsampled.Context().Sampled {
+		t.Error("Expected new traces not to be sampled at rate 0")
+	}
+
+	// Traces continued from another service follow its decision
+	header := http.Header{}
+	header.Set(TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	_, continued := tracer.Start(Extract(context.Background(), header), "continued trace", KindServer)
+	continued.End()
+	tracer.Close()
+
+	spans := collector.spans()
+	if _, exported := spans["new trace"]; exported || len(spans) != 1 {
+		t.Errorf("Expected only the continued trace to be exported, got %+v", spans)
+	}
+	if span := spans["continued trace"]; span.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || span.ParentSpanID != "00f067aa0ba902b7" {
+		t.Errorf("Expected the remote parent to be continued, got %+v", span)
+	}
+
+	half, _ := New(Config{Service: "worker", Endpoint: collector.URL, SampleRate: 0.5})
+	defer half.Close()
+	sampled := 0
+	for range 2000 {
+		if _, span := half.Start(context.Background(), "trace", KindInternal); span.Context().Sampled {
+			sampled++
+		}
+	}
+	if sampled < 800 || sampled > 1200 {
+		t.Errorf("Expected about half the traces to be sampled, got %d of 2000", sampled)
+	}
+}
+
+func TestTraceparent(t *testing.T) {
+	header := http.Header{}
+	tracer, _ := New(Config{Service: "ml", Endpoint: "http://localhost:4318/v1/traces", SampleRate: 1})
+	defer tracer.Close()
+	ctx, span := tracer.Start(context.Background(), "predict", KindServer)
+	Inject(ctx, header)
+	parsed, ok := ParseTraceparent(header.Get(TraceparentHeader))
+	if !ok || parsed != span.Context() {
+		t.Errorf("Expected the injected context to parse back, got %+v from %q", parsed, header.Get(TraceparentHeader))
+	}
+
+	for _, value := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473g-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+	} {
+		if _, ok := ParseTraceparent(value); ok {
+			t.Errorf("Expected %q to be rejected", value)
+		}
+	}
+}
+
+func TestHandler(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		collector int
+		expected  int
+	}{
+		{"reachable", http.StatusOK, http.StatusOK},
+		{"failing", http.StatusInternalServerError, http.StatusServiceUnavailable},
+	} {
+		collector := newCollector(t, tc.collector)
+		tracer, _ := New(Config{Service: "monitor", Endpoint: collector.URL, SampleRate: 0.1})
+		w := httptest.NewRecorder()
+		tracer.Handler()(w, httptest.NewRequest("GET", "/api/tracing/check", nil))
+		tracer.Close()
+
+		var status Status
+		json.NewDecoder(w.Body).Decode(&status)
+		if w.Code != tc.expected || status.Reachable != (tc.expected == http.StatusOK) || !status.Enabled || status.SampleRate != 0.1 {
+			t.Errorf("%s collector: expected %d, got %d with %+v", tc.name, tc.expected, w.Code, status)
+		}
+		if span, exported := collector.spans()["tracing.self_test"]; !exported || span.TraceID != status.TraceID {
+			t.Errorf("%s collector: expected the self test span of trace %s, got %+v", tc.name, status.TraceID, collector.spans())
+		}
+	}
+
+	var disabled *Tracer
+	w := httptest.NewRecorder()
+	disabled.Handler()(w, httptest.NewRequest("GET", "/api/tracing/check", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "{\"enabled\":false,\"sample_rate\":0,\"reachable\":false,\"exported_spans\":0,\"dropped_spans\":0,\"queued_spans\":0}\n" {
+		t.Errorf("Expected disabled tracing to be reported, got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestFromEnv(t *testing.T) {
+	t.Setenv("TRACING_ENDPOINT", "")
+	if tracer, err := FromEnv("coordinator"); tracer != nil || err != nil {
+		t.Errorf("Expected tracing to be disabled without an endpoint, got %v, %v", tracer, err)
+	}
+
+	t.Setenv("TRACING_ENDPOINT", "http://jaeger:4318/v1/traces")
+	t.Setenv("TRACING_SAMPLE_RATE", "0.25")
+	tracer, err := FromEnv("coordinator")
+	if err != nil || tracer.Status().SampleRate != 0.25 || tracer.Status().Service != "coordinator" {
+		t.Fatalf("Expected the tracer to be configured, got %+v, %v", tracer.Status(), err)
+	}
+	tracer.Close()
+
+	for endpoint, rate := range map[string]string{
+		"http://jaeger:4318/v1/traces": "1.5",
+		"jaeger:4318":                  "0.5",
+	} {
+		t.Setenv("TRACING_ENDPOINT", endpoint)
+		t.Setenv("TRACING_SAMPLE_RATE", rate)
+		if _, err := FromEnv("coordinator"); err == nil {
+			t.Errorf("Expected endpoint %q with rate %s to be rejected", endpoint, rate)
+		}
+	}
+}
@@ -0,0 +1,418 @@
+package transfer
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Store keeps compressed chunks by hash and the manifests of the files made
+// of them. Chunks shared by several files are stored once. Everything is
+// kept in memory when the store has no directory.
+type Store struct {
+	// mutex is held for writing while the store is pruned
+	mutex     sync.RWMutex
+	dir       string
+	memory    sync.Mutex
+	chunks    map[string]storedChunk
+	manifests map[string]Manifest
+}
+
+// storedChunk is a chunk of an in-memory store
+type storedChunk struct {
+	data   []byte
+	stored time.Time
+}
+
+// Open opens the store in dir, creating it if needed. An empty dir keeps the
+// store in memory.
+func Open(dir string) (*Store, error) {
+	s := &Store{dir: dir, chunks: make(map[string]storedChunk), manifests: make(map[string]Manifest)}
+	if dir == "" {
+		return s, nil
+	}
+
+	for _, sub := range []string{"chunks", "manifests"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			return nil, fmt.Errorf("failed to create transfer store directory: %v", err)
+		}
+	}
+	return s, nil
+}
+
+// OpenFromEnv opens the store in ARTIFACT_STORE_DIR, defaulting to
+// data/artifacts. It falls back to an in-memory store if the directory
+// cannot be created.
+func OpenFromEnv() *Store {
+	dir := os.Getenv("ARTIFACT_STORE_DIR")
+	if dir == "" {
+		dir = filepath.Join("data", "artifacts")
+	}
+
+	s, err := Open(dir)
+	if err != nil {
+		log.Printf("Artifact store unavailable, keeping artifacts in memory: %v", err)
+		s, _ = Open("")
+	}
+	return s
+}
+
+// Missing returns the hashes the store has no chunk for. The chunks it has
+// are marked as used, so they survive pruning until the file is committed.
+func (s *Store) Missing(hashes []string) ([]string, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	missing := []string{}
+	seen := make(map[string]bool, len(hashes))
+	now := time.Now()
+	for _, hash := range hashes {
+		if seen[hash] {
+			continue
+		}
+		seen[hash] = true
+		if !validHash(hash) {
+			return nil, fmt.Errorf("invalid chunk hash %q", hash)
+		}
+		if !s.touch(hash, now) {
+			missing = append(missing, hash)
+		}
+	}
+	return missing, nil
+}
+
+// touch marks a chunk as used and reports whether the store has it
+func (s *Store) touch(hash string, now time.Time) bool {
+	if s.dir == "" {
+		s.memory.Lock()
+		defer s.memory.Unlock()
+		chunk, exists := s.chunks[hash]
+		if exists {
+			chunk.stored = now
+			s.chunks[hash] = chunk
+		}
+		return exists
+	}
+	return os.Chtimes(s.chunkPath(hash), now, now) == nil
+}
+
+// PutChunk stores a compressed chunk after checking it against its hash
+func (s *Store) PutChunk(hash string, data []byte) error {
+	if !validHash(hash) {
+		return fmt.Errorf("invalid chunk hash %q", hash)
+	}
+	if _, err := verify(hash, data); err != nil {
+		return err
+	}
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if s.dir == "" {
+		s.memory.Lock()
+		defer s.memory.Unlock()
+		s.chunks[hash] = storedChunk{data: data, stored: time.Now()}
+		return nil
+	}
+	return writeFile(s.chunkPath(hash), data)
+}
+
+// Chunk returns a compressed chunk
+func (s *Store) Chunk(hash string) ([]byte, error) {
+	if !validHash(hash) {
+		return nil, fmt.Errorf("invalid chunk hash %q", hash)
+	}
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if s.dir == "" {
+		s.memory.Lock()
+		defer s.memory.Unlock()
+		chunk, exists := s.chunks[hash]
+		if !exists {
+			return nil, fmt.Errorf("chunk %s not found: %w", hash, fs.ErrNotExist)
+		}
+		return chunk.data, nil
+	}
+
+	data, err := os.ReadFile(s.chunkPath(hash))
+	if err != nil {
+		return nil, fmt.Errorf("chunk %s not found: %w", hash, err)
+	}
+	return data, nil
+}
+
+// ReadChunk returns a chunk decompressed and checked against its hash
+func (s *Store) ReadChunk(hash string) ([]byte, error) {
+	data, err := s.Chunk(hash)
+	if err != nil {
+		return nil, err
+	}
+	return verify(hash, data)
+}
+
+// Commit stores the manifest of a file once all its chunks are stored. A
+// file of the same name is replaced.
+func (s *Store) Commit(manifest Manifest) error {
+	if !ValidName(manifest.Name) {
+		return fmt.Errorf("invalid file name %q", manifest.Name)
+	}
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	var size int64
+	now := time.Now()
+	for _, chunk := range manifest.Chunks {
+		if !validHash(chunk.Hash) || !s.touch(chunk.Hash, now) {
+			return fmt.Errorf("chunk %s of %s has not been uploaded", chunk.Hash, manifest.Name)
+		}
+		size += chunk.Size
+	}
+	if size != manifest.Size {
+		return fmt.Errorf("chunks of %s add up to %d bytes, not %d", manifest.Name, size, manifest.Size)
+	}
+	if manifest.CreatedAt.IsZero() {
+		manifest.CreatedAt = now.UTC()
+	}
+
+	if s.dir == "" {
+		s.memory.Lock()
+		defer s.memory.Unlock()
+		s.manifests[manifest.Name] = manifest
+		return nil
+	}
+
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return fmt.Errorf("failed to encode manifest: %v", err)
+	}
+	return writeFile(s.manifestPath(manifest.Name), data)
+}
+
+// Manifest returns the manifest of a file
+func (s *Store) Manifest(name string) (Manifest, error) {
+	if !ValidName(name) {
+		return Manifest{}, fmt.Errorf("invalid file name %q", name)
+	}
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if s.dir == "" {
+		s.memory.Lock()
+		defer s.memory.Unlock()
+		manifest, exists := s.manifests[name]
+		if !exists {
+			return Manifest{}, fmt.Errorf("file %s not found: %w", name, fs.ErrNotExist)
+		}
+		return manifest, nil
+	}
+	return readManifest(s.manifestPath(name))
+}
+
+// List returns the manifests of the files whose names start with prefix,
+// sorted by name
+func (s *Store) List(prefix string) ([]Manifest, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	manifests, err := s.all()
+	if err != nil {
+		return nil, err
+	}
+	selected := []Manifest{}
+	for _, manifest := range manifests {
+		if strings.HasPrefix(manifest.Name, prefix) {
+			selected = append(selected, manifest)
+		}
+	}
+	sort.Slice(selected, func(i, j int) bool { return selected[i].Name < selected[j].Name })
+	return selected, nil
+}
+
+// all returns every manifest. Must be called with the mutex held.
+func (s *Store) all() ([]Manifest, error) {
+	if s.dir == "" {
+		s.memory.Lock()
+		defer s.memory.Unlock()
+		manifests := make([]Manifest, 0, len(s.manifests))
+		for _, manifest := range s.manifests {
+			manifests = append(manifests, manifest)
+		}
+		return manifests, nil
+	}
+
+	var manifests []Manifest
+	root := filepath.Join(s.dir, "manifests")
+	err := filepath.WalkDir(root, func(file string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() || !strings.HasSuffix(file, ".json") {
+			return err
+		}
+		manifest, err := readManifest(file)
+		if err != nil {
+			log.Printf("Skipping unreadable manifest %s: %v", file, err)
+			return nil
+		}
+		manifests = append(manifests, manifest)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list manifests: %v", err)
+	}
+	return manifests, nil
+}
+
+// Prune removes the files committed before cutoff and then the chunks no
+// remaining file uses that were last used before cutoff. It returns how many
+// files and chunks were removed.
+func (s *Store) Prune(cutoff time.Time) (int, int, error) {
+	return s.Collect(func(manifest Manifest) bool {
+		return manifest.CreatedAt.Before(cutoff)
+	}, cutoff)
+}
+
+// Collect removes the files remove selects and then the chunks no remaining
+// file uses that were last used before cutoff, so chunks of files still being
+// uploaded are kept. It returns how many files and chunks were removed.
+func (s *Store) Collect(remove func(Manifest) bool, cutoff time.Time) (int, int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	manifests, err := s.all()
+	if err != nil {
+		return 0, 0, err
+	}
+	used := make(map[string]bool)
+	files := 0
+	for _, manifest := range manifests {
+		if remove(manifest) {
+			if err := s.removeManifest(manifest.Name); err != nil {
+				return files, 0, err
+			}
+			files++
+			continue
+		}
+		for _, chunk := range manifest.Chunks {
+			used[chunk.Hash] = true
+		}
+	}
+
+	chunks := 0
+	if s.dir == "" {
+		s.memory.Lock()
+		defer s.memory.Unlock()
+		for hash, chunk := range s.chunks {
+			if !used[hash] && chunk.stored.Before(cutoff) {
+				delete(s.chunks, hash)
+				chunks++
+			}
+		}
+		return files, chunks, nil
+	}
+
+	err = filepath.WalkDir(filepath.Join(s.dir, "chunks"), func(file string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() || used[entry.Name()] {
+			return err
+		}
+		info, err := entry.Info()
+		if err != nil || !info.ModTime().Before(cutoff) {
+			return nil
+		}
+		if err := os.Remove(file); err != nil {
+			return err
+		}
+		chunks++
+		return nil
+	})
+	if err != nil {
+		return files, chunks, fmt.Errorf("failed to prune chunks: %v", err)
+	}
+	return files, chunks, nil
+}
+
+// removeManifest removes the manifest of a file. Must be called with the
+// mutex held.
+func (s *Store) removeManifest(name string) error {
+	if s.dir == "" {
+		s.memory.Lock()
+		defer s.memory.Unlock()
+		delete(s.manifests, name)
+		return nil
+	}
+	if err := os.Remove(s.manifestPath(name)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove manifest of %s: %v", name, err)
+	}
+	return nil
+}
+
+// chunkPath returns the file of a chunk, spread over directories by the
+// first byte of its hash
+func (s *Store) chunkPath(hash string) string {
+	return filepath.Join(s.dir, "chunks", hash[:2], hash)
+}
+
+// manifestPath returns the file of a manifest
+func (s *Store) manifestPath(name string) string {
+	return filepath.Join(s.dir, "manifests", filepath.FromSlash(name)+".json")
+}
+
+// readManifest reads a manifest file
+func readManifest(file string) (Manifest, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return Manifest{}, fmt.Errorf("file not found: %w", err)
+	}
+	var manifest Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return Manifest{}, fmt.Errorf("invalid manifest %s: %v", file, err)
+	}
+	return manifest, nil
+}
+
+// writeFile replaces a file atomically
+func writeFile(file string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	temp, err := os.CreateTemp(filepath.Dir(file), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+
+	if _, err := temp.Write(data); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), file)
+}
+
+// validHash reports whether hash is a hex SHA-256
+func validHash(hash string) bool {
+	if len(hash) != 64 {
+		return false
+	}
+	_, err := hex.DecodeString(hash)
+	return err == nil
+}
+
+// ValidName reports whether name is a relative slash-separated file name
+// that stays inside the store
+func ValidName(name string) bool {
+	return name != "" && path.Clean(name) == name && !path.IsAbs(name) &&
+		name != ".." && !strings.HasPrefix(name, "../") && !strings.Contains(name, "\\")
+}
@@ -0,0 +1,383 @@
+// Package transfer moves large files, such as build artifacts, between
+// services without sending the same bytes twice. Files are split into
+// content-defined chunks, so an edit only changes the chunks around it, and
+// only the chunks the receiver does not have yet are sent, compressed.
+package transfer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Chunk size bounds. Boundaries are placed where the rolling hash of the
+// content matches, which averages about MinChunkSize + 1 MiB per chunk.
+const (
+	MinChunkSize = 256 << 10
+	MaxChunkSize = 4 << 20
+)
+
+// ManifestContentType is the media type of manifests served over HTTP
+const ManifestContentType = "application/vnd.dgb.manifest+json"
+
+// chunkMask selects the hash bits that must be zero at a chunk boundary. The
+// high bits depend on the last 64 bytes, the low bits only on the last few.
+const chunkMask = uint64(1<<20-1) << 44
+
+// gear maps each byte to a random value for the rolling hash
+var gear = func() (table [256]uint64) {
+	// splitmix64 with a fixed seed, so every service cuts identical chunks
+	state := uint64(0x9e3779b97f4a7c15)
+	for i := range table {
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+// ChunkRef is a chunk of a file
+type ChunkRef struct {
+	Hash string `json:"hash"`
+	Size int64  `json:"size"`
+}
+
+// Manifest describes a file as its chunks, in order. Attributes are set by
+// the receiver, such as the build a file belongs to.
+type Manifest struct {
+	Name       string            `json:"name"`
+	Size       int64             `json:"size"`
+	SHA256     string            `json:"sha256"`
+	Chunks     []ChunkRef        `json:"chunks"`
+	CreatedAt  time.Time         `json:"created_at"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+// Stats reports how much of a file was transferred. Bytes is the size of the
+// file, SentBytes the size of the chunks that were missing on the receiving
+// side and WireBytes their compressed size.
+type Stats struct {
+	Bytes      int64 `json:"bytes"`
+	Chunks     int   `json:"chunks"`
+	SentChunks int   `json:"sent_chunks"`
+	SentBytes  int64 `json:"sent_bytes"`
+	WireBytes  int64 `json:"wire_bytes"`
+}
+
+// DedupRatio returns the share of the file that did not have to be sent
+func (s Stats) DedupRatio() float64 {
+	if s.Bytes == 0 {
+		return 0
+	}
+	return 1 - float64(s.SentBytes)/float64(s.Bytes)
+}
+
+// Remote receives uploaded files
+type Remote interface {
+	// Missing returns the hashes of the chunks the remote does not have
+	Missing(hashes []string) ([]string, error)
+	// PutChunk stores a compressed chunk
+	PutChunk(hash string, data []byte) error
+	// Commit stores the manifest of a file whose chunks were all sent
+	Commit(manifest Manifest) error
+}
+
+// Source serves files to download
+type Source interface {
+	// Chunk returns a compressed chunk
+	Chunk(hash string) ([]byte, error)
+}
+
+// Split reads r to the end and calls fn with each content-defined chunk. The
+// chunk is only valid until fn returns.
+func Split(r io.Reader, fn func(chunk []byte) error) error {
+	buffer := make([]byte, MaxChunkSize)
+	filled := 0
+	for {
+		n, err := io.ReadFull(r, buffer[filled:])
+		filled += n
+		eof := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !eof {
+			return err
+		}
+
+		for filled > 0 {
+			cut := boundary(buffer[:filled])
+			if cut < 0 {
+				if !eof {
+					break
+				}
+				cut = filled
+			}
+			if err := fn(buffer[:cut]); err != nil {
+				return err
+			}
+			filled = copy(buffer, buffer[cut:filled])
+		}
+		if eof {
+			return nil
+		}
+	}
+}
+
+// boundary returns the end of the first chunk of data, or -1 if more data is
+// needed to find it
+func boundary(data []byte) int {
+	if len(data) <= MinChunkSize {
+		return -1
+	}
+
+	end := min(len(data), MaxChunkSize)
+	var hash uint64
+	for i := MinChunkSize - 64; i < end; i++ {
+		hash = hash<<1 + gear[data[i]]
+		if i >= MinChunkSize && hash&chunkMask == 0 {
+			return i + 1
+		}
+	}
+	if end == MaxChunkSize {
+		return MaxChunkSize
+	}
+	return -1
+}
+
+// Describe splits the file at path into chunks and returns its manifest
+func Describe(name, path string) (Manifest, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return Manifest{}, err
+	}
+	defer file.Close()
+
+	manifest := Manifest{Name: name, Chunks: []ChunkRef{}, CreatedAt: time.Now().UTC()}
+	digest := sha256.New()
+	err = Split(file, func(chunk []byte) error {
+		digest.Write(chunk)
+		manifest.Chunks = append(manifest.Chunks, ChunkRef{Hash: hashOf(chunk), Size: int64(len(chunk))})
+		manifest.Size += int64(len(chunk))
+		return nil
+	})
+	if err != nil {
+		return Manifest{}, fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	manifest.SHA256 = hex.EncodeToString(digest.Sum(nil))
+	return manifest, nil
+}
+
+// Upload sends the file at path to remote as name, skipping the chunks the
+// remote already has
+func Upload(remote Remote, name, path string) (Manifest, Stats, error) {
+	manifest, err := Describe(name, path)
+	if err != nil {
+		return Manifest{}, Stats{}, err
+	}
+	stats := Stats{Bytes: manifest.Size, Chunks: len(manifest.Chunks)}
+
+	hashes := make([]string, 0, len(manifest.Chunks))
+	for _, chunk := range manifest.Chunks {
+		hashes = append(hashes, chunk.Hash)
+	}
+	missing, err := remote.Missing(hashes)
+	if err != nil {
+		return Manifest{}, stats, fmt.Errorf("failed to query missing chunks: %v", err)
+	}
+
+	if len(missing) > 0 {
+		pending := make(map[string]bool, len(missing))
+		for _, hash := range missing {
+			pending[hash] = true
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			return Manifest{}, stats, err
+		}
+		defer file.Close()
+
+		index := 0
+		err = Split(file, func(chunk []byte) error {
+			if index >= len(manifest.Chunks) {
+				return fmt.Errorf("%s changed while it was uploaded", path)
+			}
+			hash := manifest.Chunks[index].Hash
+			index++
+			if !pending[hash] {
+				return nil
+			}
+			if hashOf(chunk) != hash {
+				return fmt.Errorf("%s changed while it was uploaded", path)
+			}
+
+			data := compress(chunk)
+			if err := remote.PutChunk(hash, data); err != nil {
+				return fmt.Errorf("failed to upload chunk %s: %v", hash, err)
+			}
+			delete(pending, hash)
+			stats.SentChunks++
+			stats.SentBytes += int64(len(chunk))
+			stats.WireBytes += int64(len(data))
+			return nil
+		})
+		if err != nil {
+			return Manifest{}, stats, err
+		}
+		if len(pending) > 0 {
+			return Manifest{}, stats, fmt.Errorf("%s changed while it was uploaded", path)
+		}
+	}
+
+	if err := remote.Commit(manifest); err != nil {
+		return Manifest{}, stats, fmt.Errorf("failed to commit %s: %v", name, err)
+	}
+	return manifest, stats, nil
+}
+
+// UploadReader sends what r reads to the end to remote as name, like Upload
+// but reading the content only once, so it can be streamed. Each chunk is
+// only sent if the remote does not have it yet.
+func UploadReader(remote Remote, name string, r io.Reader) (Manifest, Stats, error) {
+	manifest := Manifest{Name: name, Chunks: []ChunkRef{}, CreatedAt: time.Now().UTC()}
+	var stats Stats
+	digest := sha256.New()
+	err := Split(r, func(chunk []byte) error {
+		hash := hashOf(chunk)
+		digest.Write(chunk)
+		manifest.Chunks = append(manifest.Chunks, ChunkRef{Hash: hash, Size: int64(len(chunk))})
+		manifest.Size += int64(len(chunk))
+
+		missing, err := remote.Missing([]string{hash})
+		if err != nil {
+			return fmt.Errorf("failed to query missing chunks: %v", err)
+		}
+		if len(missing) == 0 {
+			return nil
+		}
+		data := compress(chunk)
+		if err := remote.PutChunk(hash, data); err != nil {
+			return fmt.Errorf("failed to upload chunk %s: %v", hash, err)
+		}
+		stats.SentChunks++
+		stats.SentBytes += int64(len(chunk))
+		stats.WireBytes += int64(len(data))
+		return nil
+	})
+	stats.Bytes, stats.Chunks = manifest.Size, len(manifest.Chunks)
+	if err != nil {
+		return Manifest{}, stats, err
+	}
+
+	manifest.SHA256 = hex.EncodeToString(digest.Sum(nil))
+	if err := remote.Commit(manifest); err != nil {
+		return Manifest{}, stats, fmt.Errorf("failed to commit %s: %v", name, err)
+	}
+	return manifest, stats, nil
+}
+
+// Download writes the file described by manifest to path, taking the chunks
+// found in cache from there and fetching the others from source. Fetched
+// chunks are added to cache, which may be nil. The file is replaced only once
+// its checksum matches the manifest.
+func Download(source Source, manifest Manifest, path string, cache *Store) (Stats, error) {
+	stats := Stats{Bytes: manifest.Size, Chunks: len(manifest.Chunks)}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return stats, err
+	}
+	file, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return stats, err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	digest := sha256.New()
+	for _, ref := range manifest.Chunks {
+		var chunk []byte
+		if cache != nil {
+			if chunk, err = cache.ReadChunk(ref.Hash); err != nil {
+				chunk = nil
+			}
+		}
+		if chunk == nil {
+			data, err := source.Chunk(ref.Hash)
+			if err != nil {
+				return stats, fmt.Errorf("failed to download chunk %s: %v", ref.Hash, err)
+			}
+			if chunk, err = verify(ref.Hash, data); err != nil {
+				return stats, err
+			}
+			if cache != nil {
+				if err := cache.PutChunk(ref.Hash, data); err != nil {
+					return stats, fmt.Errorf("failed to cache chunk %s: %v", ref.Hash, err)
+				}
+			}
+			stats.SentChunks++
+			stats.SentBytes += int64(len(chunk))
+			stats.WireBytes += int64(len(data))
+		}
+
+		digest.Write(chunk)
+		if _, err := file.Write(chunk); err != nil {
+			return stats, err
+		}
+	}
+
+	if sum := hex.EncodeToString(digest.Sum(nil)); sum != manifest.SHA256 {
+		return stats, fmt.Errorf("checksum mismatch for %s: expected %s, got %s", manifest.Name, manifest.SHA256, sum)
+	}
+	if err := file.Close(); err != nil {
+		return stats, err
+	}
+	return stats, os.Rename(file.Name(), path)
+}
+
+// hashOf returns the hex SHA-256 of a chunk
+func hashOf(chunk []byte) string {
+	sum := sha256.Sum256(chunk)
+	return hex.EncodeToString(sum[:])
+}
+
+// compress gzips a chunk. Artifacts such as jars and APKs are compressed
+// already, so the fastest level is used. Chunks are gzipped rather than
+// zstd-compressed because the standard library has no zstd encoder, and the
+// module takes no third-party dependency for it.
+func compress(chunk []byte) []byte {
+	var buffer bytes.Buffer
+	writer, _ := gzip.NewWriterLevel(&buffer, gzip.BestSpeed)
+	writer.Write(chunk)
+	writer.Close()
+	return buffer.Bytes()
+}
+
+// verify decompresses a chunk and checks it against its hash
+func verify(hash string, data []byte) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid chunk %s: %v", hash, err)
+	}
+	chunk, err := io.ReadAll(io.LimitReader(reader, MaxChunkSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("invalid chunk %s: %v", hash, err)
+	}
+	if len(chunk) > MaxChunkSize || hashOf(chunk) != hash {
+		return nil, fmt.Errorf("chunk %s does not match its hash", hash)
+	}
+	return chunk, nil
+}
+
+// PlainSize returns the uncompressed size of a compressed chunk, which gzip
+// records in its trailer
+func PlainSize(data []byte) int64 {
+	if len(data) < 4 {
+		return 0
+	}
+	return int64(binary.LittleEndian.Uint32(data[len(data)-4:]))
+}
@@ -0,0 +1,207 @@
+package transfer
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// randomData returns deterministic incompressible data
+func randomData(seed int64, size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+func TestSplitIsContentDefined(t *testing.T) {
+	data := randomData(1, 12<<20)
+	var chunks [][]byte
+	Split(bytes.NewReader(data), func(chunk []byte) error {
+		chunks = append(chunks, bytes.Clone(chunk))
+		return nil
+	})
+	if len(chunks) < 3 || !bytes.Equal(bytes.Join(chunks, nil), data) {
+		t.Fatalf("Expected the chunks to add up to the data, got %d chunks", len(chunks))
+	}
+	for i, chunk := range chunks {
+		if len(chunk) > MaxChunkSize || (len(chunk) < MinChunkSize && i != len(chunks)-1) {
+			t.Errorf("Chunk %d has %d bytes, outside of the bounds", i, len(chunk))
+		}
+	}
+
+	// Inserting bytes at the start only changes the first chunk
+	edited := append([]byte("inserted"), data...)
+	hashes := make(map[string]bool)
+	for _, chunk := range chunks {
+		hashes[hashOf(chunk)] = true
+	}
+	changed := 0
+	Split(bytes.NewReader(edited), func(chunk []byte) error {
+		if !hashes[hashOf(chunk)] {
+			changed++
+		}
+		return nil
+	})
+	if changed != 1 {
+		t.Errorf("Expected one changed chunk after an insertion, got %d", changed)
+	}
+}
+
+func TestUploadAndDownload(t *testing.T) {
+	dir := t.TempDir()
+	remote, err := Open(filepath.Join(dir, "remote"))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+
+	data := randomData(2, 10<<20)
+	original := filepath.Join(dir, "app-1.apk")
+	os.WriteFile(original, data, 0644)
+	manifest, stats, err := Upload(remote, "build-1/app.apk", original)
+	if err != nil {
+		t.Fatalf("Upload failed: %v", err)
+	}
+	if stats.SentBytes != int64(len(data)) || stats.DedupRatio() != 0 || manifest.Size != int64(len(data)) {
+		t.Errorf("Expected the first upload to send everything, got %+v", stats)
+	}
+
+	// A new build changing the end of the file only sends its last chunks
+	changed := append(bytes.Clone(data[:9<<20]), randomData(3, 1<<20)...)
+	os.WriteFile(original, changed, 0644)
+	_, stats, err = Upload(remote, "build-2/app.apk", original)
+	if err != nil {
+		t.Fatalf("Upload failed: %v", err)
+	}
+	if stats.DedupRatio() < 0.5 || stats.SentChunks == 0 || stats.WireBytes == 0 {
+		t.Errorf("Expected most of the second upload to be deduplicated, got %+v", stats)
+	}
+
+	// Downloading into a cache holding the first build only fetches the
+	// changed chunks
+	cache, _ := Open("")
+	downloaded := filepath.Join(dir, "download", "app.apk")
+	if _, err := Download(remote, manifest, downloaded, cache); err != nil {
+		t.Fatalf("Download failed: %v", err)
+	}
+	second, err := remote.Manifest("build-2/app.apk")
+	if err != nil {
+		t.Fatalf("Manifest failed: %v", err)
+	}
+	stats, err = Download(remote, second, downloaded, cache)
+	if err != nil {
+		t.Fatalf("Download failed: %v", err)
+	}
+	if content, _ := os.ReadFile(downloaded); !bytes.Equal(content, changed) {
+		t.Error("Expected the downloaded file to match the second build")
+	}
+	if stats.DedupRatio() < 0.5 {
+		t.Errorf("Expected the cache to serve most of the download, got %+v", stats)
+	}
+
+	if listed, _ := remote.List("build-2/"); len(listed) != 1 || listed[0].SHA256 != second.SHA256 {
+		t.Errorf("Expected the second build's file, got %+v", listed)
+	}
+}
+
+func TestUploadReader(t *testing.T) {
+	remote, _ := Open("")
+	data := randomData(4, 6<<20)
+	manifest, stats, err := UploadReader(remote, "uploads/project", bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("UploadReader failed: %v", err)
+	}
+	if stats.SentBytes != int64(len(data)) || manifest.Size != int64(len(data)) || len(manifest.Chunks) < 2 {
+		t.Errorf("Expected everything to be sent in several chunks, got %+v", stats)
+	}
+
+	// The chunks of the same content are only sent once
+	if _, stats, err := UploadReader(remote, "uploads/again", bytes.NewReader(data)); err != nil || stats.SentChunks != 0 {
+		t.Errorf("Expected nothing to be sent again, got %+v, %v", stats, err)
+	}
+
+	downloaded := filepath.Join(t.TempDir(), "project")
+	if _, err := Download(remote, manifest, downloaded, nil); err != nil {
+		t.Fatalf("Download failed: %v", err)
+	}
+	if content, _ := os.ReadFile(downloaded); !bytes.Equal(content, data) {
+		t.Error("Expected the downloaded file to match the stream")
+	}
+}
+
+func TestStoreRejectsInvalidData(t *testing.T) {
+	store, _ := Open("")
+	chunk := []byte("chunk")
+	if err := store.PutChunk(hashOf([]byte("other")), compress(chunk)); err == nil {
+		t.Error("Expected a chunk not matching its hash to be rejected")
+	}
+	if PlainSize(compress(chunk)) != int64(len(chunk)) {
+		t.Error("Expected the plain size from the gzip trailer")
+	}
+
+	manifest := Manifest{Name: "build-1/app.jar", Size: 5, Chunks: []ChunkRef{{Hash: hashOf(chunk), Size: 5}}}
+	if err := store.Commit(manifest); err == nil {
+		t.Error("Expected a manifest with missing chunks to be rejected")
+	}
+	store.PutChunk(hashOf(chunk), compress(chunk))
+	for _, name := range []string{"../app.jar", "/etc/passwd", "build-1/../../app.jar", ""} {
+		manifest.Name = name
+		if err := store.Commit(manifest); err == nil {
+			t.Errorf("Expected name %q to be rejected", name)
+		}
+	}
+}
+
+func TestPrune(t *testing.T) {
+	store, _ := Open(t.TempDir())
+	shared, old := []byte("shared"), []byte("old")
+	for _, chunk := range [][]byte{shared, old} {
+		store.PutChunk(hashOf(chunk), compress(chunk))
+	}
+	store.Commit(Manifest{Name: "build-1/app.jar", Size: 9, Chunks: []ChunkRef{{hashOf(shared), 6}, {hashOf(old), 3}}, CreatedAt: time.Now().Add(-48 * time.Hour)})
+	store.Commit(Manifest{Name: "build-2/app.jar", Size: 6, Chunks: []ChunkRef{{hashOf(shared), 6}}})
+
+	files, chunks, err := store.Prune(time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("Prune failed: %v", err)
+	}
+	// Files committed and chunks used before the cutoff are removed
+	if files != 2 || chunks != 2 {
+		t.Errorf("Expected everything before the cutoff to be pruned, got %d files and %d chunks", files, chunks)
+	}
+
+	store.PutChunk(hashOf(old), compress(old))
+	store.Commit(Manifest{Name: "build-3/app.jar", Size: 3, Chunks: []ChunkRef{{hashOf(old), 3}}, CreatedAt: time.Now().Add(-48 * time.Hour)})
+	if files, chunks, _ := store.Prune(time.Now().Add(-time.Hour)); files != 1 || chunks != 0 {
+		t.Errorf("Expected recently used chunks to be kept, got %d files and %d chunks", files, chunks)
+	}
+	if _, err := store.Chunk(hashOf(old)); err != nil {
+		t.Errorf("Expected the recently used chunk to be kept: %v", err)
+	}
+}
+
+func TestCollect(t *testing.T) {
+	store, _ := Open(t.TempDir())
+	shared, own := []byte("shared"), []byte("own")
+	for _, chunk := range [][]byte{shared, own} {
+		store.PutChunk(hashOf(chunk), compress(chunk))
+	}
+	store.Commit(Manifest{Name: "build-1/app.jar", Size: 9, Chunks: []ChunkRef{{hashOf(shared), 6}, {hashOf(own), 3}}})
+	store.Commit(Manifest{Name: "build-2/app.jar", Size: 6, Chunks: []ChunkRef{{hashOf(shared), 6}}})
+
+	// Only the selected file and the chunk no other file uses are removed
+	files, chunks, err := store.Collect(func(manifest Manifest) bool {
+		return manifest.Name == "build-1/app.jar"
+	}, time.Now().Add(time.Hour))
+	if err != nil || files != 1 || chunks != 1 {
+		t.Fatalf("Expected one file and its own chunk to be collected, got %d files and %d chunks: %v", files, chunks, err)
+	}
+	if _, err := store.Chunk(hashOf(shared)); err != nil {
+		t.Errorf("Expected the shared chunk to be kept: %v", err)
+	}
+	if remaining, _ := store.List(""); len(remaining) != 1 || remaining[0].Name != "build-2/app.jar" {
+		t.Errorf("Expected the other file to be kept, got %+v", remaining)
+	}
+}
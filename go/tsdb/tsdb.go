@@ -0,0 +1,376 @@
+// Package tsdb stores metric samples on disk in append-only segment files,
+// one per UTC day, each holding a JSON record per line. Segments older than
+// the downsampling age are rewritten with one aggregated point per series
+// and resolution interval, and deleted once they exceed the retention.
+package tsdb
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Store defaults
+const (
+	DefaultRetentionDays   = 30
+	DefaultDownsampleAfter = 7 * 24 * time.Hour
+	DefaultResolution      = time.Hour
+)
+
+// Segment file name suffixes. Downsampled segments replace the raw segment
+// of their day.
+const (
+	rawSuffix         = ".seg"
+	downsampledSuffix = ".downsampled.seg"
+)
+
+// dayLayout names the segment of a day
+const dayLayout = "2006-01-02"
+
+// Options configure the retention and downsampling of a store
+type Options struct {
+	// RetentionDays is how many days of samples are kept, including today
+	RetentionDays int
+	// DownsampleAfter is the age from which the samples of a day are
+	// aggregated into one point per Resolution
+	DownsampleAfter time.Duration
+	Resolution      time.Duration
+}
+
+// DefaultOptions returns the default store options
+func DefaultOptions() Options {
+	return Options{RetentionDays: DefaultRetentionDays, DownsampleAfter: DefaultDownsampleAfter, Resolution: DefaultResolution}
+}
+
+// Point is a sample, or the aggregate of the samples of a query step or a
+// downsampled interval
+type Point struct {
+	Timestamp time.Time `json:"timestamp"`
+	// Value is the mean of the aggregated samples
+	Value float64 `json:"value"`
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+	Count int     `json:"count"`
+}
+
+// Sum returns the sum of the aggregated samples
+func (p Point) Sum() float64 {
+	return p.Value * float64(p.Count)
+}
+
+// record is a line of a segment file. Raw samples only have a value.
+type record struct {
+	Series string `json:"s"`
+	// Time is in Unix milliseconds
+	Time  int64    `json:"t"`
+	Value float64  `json:"v"`
+	Count int      `json:"n,omitempty"`
+	Min   *float64 `json:"min,omitempty"`
+	Max   *float64 `json:"max,omitempty"`
+}
+
+// point returns the point a record stores
+func (r record) point() Point {
+	p := Point{Timestamp: time.UnixMilli(r.Time).UTC(), Value: r.Value, Min: r.Value, Max: r.Value, Count: 1}
+	if r.Count > 0 {
+		p.Count = r.Count
+	}
+	if r.Min != nil {
+		p.Min = *r.Min
+	}
+	if r.Max != nil {
+		p.Max = *r.Max
+	}
+	return p
+}
+
+// Store keeps samples in a directory
+type Store struct {
+	mutex   sync.Mutex
+	dir     string
+	options Options
+	// file is the open segment of day, which samples are appended to
+	file *os.File
+	day  string
+}
+
+// Open opens the store in dir, creating it if needed
+func Open(dir string, options Options) (*Store, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create metrics directory: %v", err)
+	}
+	return &Store{dir: dir, options: options}, nil
+}
+
+// Close closes the open segment
+func (s *Store) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file, s.day = nil, ""
+	return err
+}
+
+// Append adds a sample of a series at t
+func (s *Store) Append(series string, t time.Time, value float64) error {
+	if series == "" {
+		return fmt.Errorf("sample has no series")
+	}
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return fmt.Errorf("invalid value %v of series %s", value, series)
+	}
+	line, err := json.Marshal(record{Series: series, Time: t.UnixMilli(), Value: value})
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	day := t.UTC().Format(dayLayout)
+	if s.day != day {
+		if s.file != nil {
+			s.file.Close()
+			s.file, s.day = nil, ""
+		}
+		file, err := os.OpenFile(filepath.Join(s.dir, day+rawSuffix), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return fmt.Errorf("failed to open metrics segment %s: %v", day, err)
+		}
+		s.file, s.day = file, day
+	}
+	if _, err := s.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write metrics segment %s: %v", day, err)
+	}
+	return nil
+}
+
+// Query returns the points of a series from from up to but excluding to,
+// oldest first. With a step, the points are aggregated into one per step
+// from from on.
+func (s *Store) Query(series string, from, to time.Time, step time.Duration) ([]Point, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	segments, err := s.segments()
+	if err != nil {
+		return nil, err
+	}
+
+	points := []Point{}
+	first, last := from.UTC().Format(dayLayout), to.UTC().Format(dayLayout)
+	for _, segment := range segments {
+		if segment.day < first || segment.day > last {
+			continue
+		}
+		records, err := readSegment(segment.path)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range records {
+			if r.Series != series || r.Time < from.UnixMilli() || r.Time >= to.UnixMilli() {
+				continue
+			}
+			points = append(points, r.point())
+		}
+	}
+	sort.SliceStable(points, func(i, j int) bool {
+		return points[i].Timestamp.Before(points[j].Timestamp)
+	})
+
+	if step <= 0 {
+		return points, nil
+	}
+	return aggregate(points, func(t time.Time) time.Time {
+		return from.Add(t.Sub(from) / step * step).UTC()
+	}), nil
+}
+
+// aggregate merges the sorted points falling into the same bucket
+func aggregate(points []Point, bucket func(time.Time) time.Time) []Point {
+	merged := []Point{}
+	for _, p := range points {
+		start := bucket(p.Timestamp)
+		if n := len(merged); n > 0 && merged[n-1].Timestamp.Equal(start) {
+			last := &merged[n-1]
+			sum := last.Sum() + p.Sum()
+			last.Count += p.Count
+			last.Value = sum / float64(last.Count)
+			last.Min = math.Min(last.Min, p.Min)
+			last.Max = math.Max(last.Max, p.Max)
+			continue
+		}
+		p.Timestamp = start
+		merged = append(merged, p)
+	}
+	return merged
+}
+
+// Compact deletes the segments of the days beyond the retention and
+// downsamples the raw segments older than DownsampleAfter. It returns the
+// number of segments deleted and downsampled.
+func (s *Store) Compact(now time.Time) (deleted, downsampled int, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	segments, err := s.segments()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	today := now.UTC().Truncate(24 * time.Hour)
+	oldest := today.AddDate(0, 0, 1-s.options.RetentionDays).Format(dayLayout)
+	for _, segment := range segments {
+		if s.options.RetentionDays > 0 && segment.day < oldest {
+			if err := os.Remove(segment.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return deleted, downsampled, fmt.Errorf("failed to delete metrics segment %s: %v", segment.day, err)
+			}
+			deleted++
+			continue
+		}
+
+		// A day is downsampled once all of it is older than DownsampleAfter
+		start, _ := time.Parse(dayLayout, segment.day)
+		if segment.downsampled || s.options.DownsampleAfter <= 0 || s.options.Resolution <= 0 || now.Sub(start.Add(24*time.Hour)) < s.options.DownsampleAfter {
+			continue
+		}
+		if segment.day == s.day {
+			s.file.Close()
+			s.file, s.day = nil, ""
+		}
+		if err := s.downsample(segment); err != nil {
+			return deleted, downsampled, err
+		}
+		downsampled++
+	}
+	return deleted, downsampled, nil
+}
+
+// downsample replaces a raw segment with one aggregated point per series
+// and resolution interval. Must be called with the mutex held.
+func (s *Store) downsample(segment segment) error {
+	records, err := readSegment(segment.path)
+	if err != nil {
+		return err
+	}
+
+	bySeries := make(map[string][]Point)
+	for _, r := range records {
+		bySeries[r.Series] = append(bySeries[r.Series], r.point())
+	}
+	names := make([]string, 0, len(bySeries))
+	for name := range bySeries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var data []byte
+	for _, name := range names {
+		points := bySeries[name]
+		sort.SliceStable(points, func(i, j int) bool {
+			return points[i].Timestamp.Before(points[j].Timestamp)
+		})
+		for _, p := range aggregate(points, func(t time.Time) time.Time {
+			return t.Truncate(s.options.Resolution)
+		}) {
+			line, err := json.Marshal(record{Series: name, Time: p.Timestamp.UnixMilli(), Value: p.Value, Count: p.Count, Min: &p.Min, Max: &p.Max})
+			if err != nil {
+				return err
+			}
+			data = append(append(data, line...), '\n')
+		}
+	}
+
+	path := filepath.Join(s.dir, segment.day+downsampledSuffix)
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		return fmt.Errorf("failed to downsample metrics segment %s: %v", segment.day, err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("failed to downsample metrics segment %s: %v", segment.day, err)
+	}
+	return os.Remove(segment.path)
+}
+
+// segment is a segment file of a day
+type segment struct {
+	day         string
+	path        string
+	downsampled bool
+}
+
+// segments lists the segment files ordered by day. A downsampled segment
+// hides a raw one of the same day left by an interrupted compaction. Must
+// be called with the mutex held.
+func (s *Store) segments() ([]segment, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read metrics directory: %v", err)
+	}
+
+	byDay := make(map[string]segment)
+	for _, entry := range entries {
+		name := entry.Name()
+		day, downsampled := strings.CutSuffix(name, downsampledSuffix)
+		if !downsampled {
+			var found bool
+			if day, found = strings.CutSuffix(name, rawSuffix); !found {
+				continue
+			}
+		}
+		if _, err := time.Parse(dayLayout, day); err != nil || entry.IsDir() {
+			continue
+		}
+		if existing, exists := byDay[day]; exists && existing.downsampled {
+			continue
+		}
+		byDay[day] = segment{day: day, path: filepath.Join(s.dir, name), downsampled: downsampled}
+	}
+
+	segments := make([]segment, 0, len(byDay))
+	for _, segment := range byDay {
+		segments = append(segments, segment)
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].day < segments[j].day
+	})
+	return segments, nil
+}
+
+// readSegment decodes the records of a segment file. A line torn by a crash
+// is skipped.
+func readSegment(path string) ([]record, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open metrics segment: %v", err)
+	}
+	defer file.Close()
+
+	var records []record
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var r record
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil || r.Series == "" {
+			continue
+		}
+		records = append(records, r)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read metrics segment: %v", err)
+	}
+	return records, nil
+}
@@ -0,0 +1,92 @@
+package tsdb
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestQuery(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(dir, DefaultOptions())
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	start := time.Date(2026, 10, 14, 23, 58, 0, 0, time.UTC)
+	for i, value := range []float64{1, 2, 3, 4, 5, 6} {
+		if err := s.Append("build_duration_seconds", start.Add(time.Duration(i)*time.Minute), value); err != nil {
+			t.Fatalf("Append failed: %v", err)
+		}
+	}
+	s.Append("build_success", start, 1)
+	if err := s.Append("build_success", start, math.NaN()); err == nil {
+		t.Error("Expected an invalid value to be rejected")
+	}
+	s.Close()
+
+	// Samples are kept in a segment per day and survive reopening the store
+	for _, day := range []string{"2026-10-14", "2026-10-15"} {
+		if _, err := os.Stat(filepath.Join(dir, day+rawSuffix)); err != nil {
+			t.Errorf("Expected a segment of %s, got %v", day, err)
+		}
+	}
+	s, _ = Open(dir, DefaultOptions())
+	defer s.Close()
+
+	points, err := s.Query("build_duration_seconds", start.Add(time.Minute), start.Add(5*time.Minute), 0)
+	if err != nil || len(points) != 4 || points[0].Value != 2 || points[3].Value != 5 || points[0].Count != 1 {
+		t.Fatalf("Expected the 4 samples in range, got %+v: %v", points, err)
+	}
+
+	points, _ = s.Query("build_duration_seconds", start, start.Add(6*time.Minute), 4*time.Minute)
+	if len(points) != 2 || points[0].Count != 4 || points[0].Value != 2.5 || points[0].Min != 1 || points[0].Max != 4 || !points[1].Timestamp.Equal(start.Add(4*time.Minute)) || points[1].Sum() != 11 {
+		t.Errorf("Expected the samples aggregated per 4 minutes, got %+v", points)
+	}
+
+	if points, _ := s.Query("unknown", start, start.Add(time.Hour), 0); len(points) != 0 {
+		t.Errorf("Expected no points of an unknown series, got %+v", points)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	dir := t.TempDir()
+	s, _ := Open(dir, Options{RetentionDays: 10, DownsampleAfter: 2 * 24 * time.Hour, Resolution: time.Hour})
+	defer s.Close()
+
+	now := time.Date(2026, 10, 15, 12, 0, 0, 0, time.UTC)
+	expired := now.AddDate(0, 0, -10)
+	old := time.Date(2026, 10, 11, 10, 0, 0, 0, time.UTC)
+	s.Append("build_success", expired, 1)
+	for i, value := range []float64{1, 0, 1, 1} {
+		s.Append("build_success", old.Add(time.Duration(i)*20*time.Minute), value)
+	}
+	s.Append("build_success", now, 1)
+
+	deleted, downsampled, err := s.Compact(now)
+	if err != nil || deleted != 1 || downsampled != 1 {
+		t.Fatalf("Expected a segment deleted and one downsampled, got %d, %d: %v", deleted, downsampled, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "2026-10-11"+rawSuffix)); !os.IsNotExist(err) {
+		t.Errorf("Expected the raw segment to be replaced, got %v", err)
+	}
+
+	points, _ := s.Query("build_success", expired, now.Add(time.Hour), 0)
+	if len(points) != 3 {
+		t.Fatalf("Expected 2 downsampled points and today's sample, got %+v", points)
+	}
+	if !points[0].Timestamp.Equal(old) || points[0].Count != 3 || points[0].Min != 0 || points[0].Max != 1 || points[1].Count != 1 || points[2].Count != 1 {
+		t.Errorf("Expected the samples aggregated per hour, got %+v", points)
+	}
+
+	// Downsampled points are aggregated further by queries
+	points, _ = s.Query("build_success", old.Add(-10*time.Hour), now, 24*time.Hour)
+	if len(points) != 1 || points[0].Count != 4 || points[0].Value != 0.75 {
+		t.Errorf("Expected a point of the whole day, got %+v", points)
+	}
+
+	if deleted, downsampled, _ := s.Compact(now); deleted != 0 || downsampled != 0 {
+		t.Errorf("Expected compaction to be idempotent, got %d, %d", deleted, downsampled)
+	}
+}
@@ -7,25 +7,40 @@ import (
 
 // BuildRequest represents a distributed build request
 type BuildRequest struct {
-	ProjectPath  string            `json:"project_path"`
-	TaskName     string            `json:"task_name"`
-	WorkerID     string            `json:"worker_id"`
-	CacheEnabled bool              `json:"cache_enabled"`
-	BuildOptions map[string]string `json:"build_options"`
-	Timestamp    time.Time         `json:"timestamp"`
-	RequestID    string            `json:"request_id"`
+	ProjectPath   string            `json:"project_path"`
+	TaskName      string            `json:"task_name"`
+	GradleVersion string            `json:"gradle_version,omitempty"`
+	WorkerID      string            `json:"worker_id"`
+	CacheEnabled  bool              `json:"cache_enabled"`
+	BuildOptions  map[string]string `json:"build_options"`
+	Timestamp     time.Time         `json:"timestamp"`
+	RequestID     string            `json:"request_id"`
+	// UploadID names a project archive uploaded to the coordinator to
+	// build; ProjectPath is then relative to the archive
+	UploadID string `json:"upload_id,omitempty"`
 }
 
 // BuildResponse represents response from a build worker
 type BuildResponse struct {
-	Success       bool          `json:"success"`
-	WorkerID      string        `json:"worker_id"`
-	BuildDuration time.Duration `json:"build_duration"`
-	Artifacts     []string      `json:"artifacts"`
-	ErrorMessage  string        `json:"error_message"`
-	Metrics       BuildMetrics  `json:"metrics"`
-	RequestID     string        `json:"request_id"`
-	Timestamp     time.Time     `json:"timestamp"`
+	Success         bool          `json:"success"`
+	WorkerID        string        `json:"worker_id"`
+	BuildDuration   time.Duration `json:"build_duration"`
+	Artifacts       []string      `json:"artifacts"`
+	ArtifactDetails []Artifact    `json:"artifact_details,omitempty"`
+	ErrorMessage    string        `json:"error_message"`
+	Metrics         BuildMetrics  `json:"metrics"`
+	RequestID       string        `json:"request_id"`
+	Timestamp       time.Time     `json:"timestamp"`
+}
+
+// Artifact describes a file produced by a build and the toolchain that produced it
+type Artifact struct {
+	Path          string `json:"path"`
+	SHA256        string `json:"sha256"`
+	Size          int64  `json:"size"`
+	WorkerID      string `json:"worker_id"`
+	GradleVersion string `json:"gradle_version"`
+	JDKVersion    string `json:"jdk_version"`
 }
 
 // BuildMetrics contains detailed build performance metrics
@@ -65,6 +80,17 @@ type ResourceMetrics struct {
 	MaxMemoryUsed int64   `json:"max_memory_used"`
 }
 
+// ResourceSample is the resource usage of a build's process tree at one
+// point of the build. CPUUsage is a fraction of the worker's CPU capacity,
+// MemoryUsage the resident memory in bytes and DiskIO the bytes read and
+// written so far.
+type ResourceSample struct {
+	Time        time.Time `json:"time"`
+	CPUUsage    float64   `json:"cpu_usage"`
+	MemoryUsage int64     `json:"memory_usage"`
+	DiskIO      int64     `json:"disk_io"`
+}
+
 // WorkerInfo contains information about registered workers
 type WorkerInfo struct {
 	ID           string    `json:"id"`
@@ -138,6 +164,7 @@ type MonitorConfig struct {
 	EnablePrometheus bool               `json:"enable_prometheus"`
 	EnableJaeger     bool               `json:"enable_jaeger"`
 	JaegerEndpoint   string             `json:"jaeger_endpoint"`
+	JaegerSampleRate float64            `json:"jaeger_sample_rate"`
 }
 
 // ClientConfig holds configuration for HTTP client
@@ -0,0 +1,137 @@
+// Package usage accounts the resources each tenant and project consumes, so
+// the cost of the build pool can be charged back to the teams using it: the
+// compute time of their builds, the build cache their builds filled on the
+// workers and the artifact storage they hold on the coordinator.
+package usage
+
+import (
+	"encoding/csv"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+
+	"distributed-gradle-building/buildstore"
+	"distributed-gradle-building/fairshare"
+	"distributed-gradle-building/retention"
+	"distributed-gradle-building/transfer"
+)
+
+// AttributeTenant is the manifest attribute recording the tenant an artifact
+// is stored for
+const AttributeTenant = "tenant"
+
+// Row is the usage of a project by a tenant. Compute and cache usage cover
+// the builds of the requested range, artifact usage what is stored now.
+type Row struct {
+	Tenant         string  `json:"tenant"`
+	Project        string  `json:"project"`
+	Builds         int     `json:"builds"`
+	ComputeSeconds float64 `json:"compute_seconds"`
+	CacheBytes     int64   `json:"cache_bytes"`
+	Artifacts      int     `json:"artifacts"`
+	ArtifactBytes  int64   `json:"artifact_bytes"`
+}
+
+// Filter selects rows by tenant and project. Empty fields match every row.
+type Filter struct {
+	Tenant  string
+	Project string
+}
+
+// key identifies a Row
+type key struct {
+	tenant  string
+	project string
+}
+
+// Tenant returns the tenant usage is accounted to, the default tenant of the
+// fair-share scheduler for builds and artifacts recorded without one
+func Tenant(tenant string) string {
+	if tenant == "" {
+		return fairshare.DefaultTenant
+	}
+	return tenant
+}
+
+// Project returns the project usage is accounted to: the repository of
+// builds checked out by the worker, the project directory of the others
+func Project(projectPath, repoURL string) string {
+	if repoURL != "" {
+		return repoURL
+	}
+	return projectPath
+}
+
+// ComputeTime returns how long a build occupied a worker. Builds cancelled
+// or lost before reporting a duration are charged from their start to their
+// end.
+func ComputeTime(record buildstore.Record) time.Duration {
+	if record.Duration > 0 || record.StartedAt.IsZero() {
+		return record.Duration
+	}
+	return max(record.FinishedAt.Sub(record.StartedAt), 0)
+}
+
+// Summarize totals the usage of the builds in records and the artifacts in
+// manifests by tenant and project, sorted by tenant and project
+func Summarize(records []buildstore.Record, manifests []transfer.Manifest, filter Filter) []Row {
+	rows := make(map[key]*Row)
+	row := func(tenant, project string) *Row {
+		k := key{Tenant(tenant), project}
+		if filter.Tenant != "" && k.tenant != filter.Tenant || filter.Project != "" && k.project != filter.Project {
+			return nil
+		}
+		if rows[k] == nil {
+			rows[k] = &Row{Tenant: k.tenant, Project: k.project}
+		}
+		return rows[k]
+	}
+
+	for _, record := range records {
+		if r := row(record.Tenant, Project(record.ProjectPath, record.RepoURL)); r != nil {
+			r.Builds++
+			r.ComputeSeconds += ComputeTime(record).Seconds()
+			r.CacheBytes += record.CacheBytes
+		}
+	}
+	for _, manifest := range manifests {
+		attributes := manifest.Attributes
+		project := Project(attributes[retention.AttributeProject], attributes[retention.AttributeRepository])
+		if r := row(attributes[AttributeTenant], project); r != nil {
+			r.Artifacts++
+			r.ArtifactBytes += manifest.Size
+		}
+	}
+
+	summary := make([]Row, 0, len(rows))
+	for _, r := range rows {
+		summary = append(summary, *r)
+	}
+	sort.Slice(summary, func(i, j int) bool {
+		if summary[i].Tenant != summary[j].Tenant {
+			return summary[i].Tenant < summary[j].Tenant
+		}
+		return summary[i].Project < summary[j].Project
+	})
+	return summary
+}
+
+// WriteCSV writes rows as CSV with a header line
+func WriteCSV(w io.Writer, rows []Row) error {
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"tenant", "project", "builds", "compute_seconds", "cache_bytes", "artifacts", "artifact_bytes"})
+	for _, row := range rows {
+		writer.Write([]string{
+			row.Tenant,
+			row.Project,
+			strconv.Itoa(row.Builds),
+			strconv.FormatFloat(row.ComputeSeconds, 'f', 3, 64),
+			strconv.FormatInt(row.CacheBytes, 10),
+			strconv.Itoa(row.Artifacts),
+			strconv.FormatInt(row.ArtifactBytes, 10),
+		})
+	}
+	writer.Flush()
+	return writer.Error()
+}
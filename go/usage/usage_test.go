@@ -0,0 +1,72 @@
+package usage
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+
+	"distributed-gradle-building/buildstore"
+	"distributed-gradle-building/retention"
+	"distributed-gradle-building/transfer"
+)
+
+func TestSummarize(t *testing.T) {
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	records := []buildstore.Record{
+		{Tenant: "android", ProjectPath: "/projects/app", Duration: 90 * time.Second, CacheBytes: 1000},
+		{Tenant: "android", ProjectPath: "/projects/app", Duration: 30 * time.Second, CacheBytes: 500},
+		// Checkouts are accounted to their repository
+		{Tenant: "android", ProjectPath: "app", RepoURL: "https://git.example.com/app.git", Duration: time.Minute},
+		// Cancelled builds are charged for the time they ran
+		{Tenant: "backend", ProjectPath: "/projects/api", StartedAt: start, FinishedAt: start.Add(45 * time.Second)},
+		// Builds recorded without a tenant belong to the default one
+		{ProjectPath: "/projects/tools", Duration: 10 * time.Second},
+	}
+	attributes := func(tenant, project string) map[string]string {
+		attributes := retention.Attributes(project, "", "", nil)
+		attributes[AttributeTenant] = tenant
+		return attributes
+	}
+	manifests := []transfer.Manifest{
+		{Name: "build-1/app.apk", Size: 4096, Attributes: attributes("android", "/projects/app")},
+		{Name: "build-1/mapping.txt", Size: 1024, Attributes: attributes("android", "/projects/app")},
+		{Name: "build-9/docs.zip", Size: 2048, Attributes: attributes("docs", "/projects/docs")},
+	}
+
+	expected := []Row{
+		{Tenant: "android", Project: "/projects/app", Builds: 2, ComputeSeconds: 120, CacheBytes: 1500, Artifacts: 2, ArtifactBytes: 5120},
+		{Tenant: "android", Project: "https://git.example.com/app.git", Builds: 1, ComputeSeconds: 60},
+		{Tenant: "backend", Project: "/projects/api", Builds: 1, ComputeSeconds: 45},
+		{Tenant: "default", Project: "/projects/tools", Builds: 1, ComputeSeconds: 10},
+		{Tenant: "docs", Project: "/projects/docs", Artifacts: 1, ArtifactBytes: 2048},
+	}
+	if rows := Summarize(records, manifests, Filter{}); !reflect.DeepEqual(rows, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, rows)
+	}
+
+	if rows := Summarize(records, manifests, Filter{Tenant: "android", Project: "/projects/app"}); !reflect.DeepEqual(rows, expected[:1]) {
+		t.Errorf("Expected %+v for the filter, got %+v", expected[:1], rows)
+	}
+	if rows := Summarize(records, manifests, Filter{Tenant: "nobody"}); len(rows) != 0 {
+		t.Errorf("Expected no rows for an unknown tenant, got %+v", rows)
+	}
+}
+
+func TestWriteCSV(t *testing.T) {
+	var buffer bytes.Buffer
+	err := WriteCSV(&buffer, []Row{
+		{Tenant: "android", Project: "/projects/app", Builds: 2, ComputeSeconds: 120.5, CacheBytes: 1500, Artifacts: 2, ArtifactBytes: 5120},
+		{Tenant: "backend", Project: "https://git.example.com/api,v2.git", Builds: 1, ComputeSeconds: 45},
+	})
+	if err != nil {
+		t.Fatalf("WriteCSV failed: %v", err)
+	}
+
+	expected := "tenant,project,builds,compute_seconds,cache_bytes,artifacts,artifact_bytes\n" +
+		"android,/projects/app,2,120.500,1500,2,5120\n" +
+		"backend,\"https://git.example.com/api,v2.git\",1,45.000,0,0,0\n"
+	if buffer.String() != expected {
+		t.Errorf("Expected\n%s\ngot\n%s", expected, buffer.String())
+	}
+}
@@ -0,0 +1,219 @@
+package validation
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"distributed-gradle-building/buildopts"
+)
+
+// Build policy defaults
+const (
+	DefaultMaxBuildOptions      = 32
+	DefaultMaxBuildOptionsBytes = 10240
+)
+
+// BuildPolicy restricts which builds are accepted: where projects may live,
+// which tasks may run and how large build options may be
+type BuildPolicy struct {
+	// ProjectRoots are the directories projects must be inside; empty
+	// allows any absolute path
+	ProjectRoots []string
+	// TaskPatterns are glob patterns (path.Match syntax) of allowed task
+	// names; empty allows any well-formed task name
+	TaskPatterns []string
+	// MaxBuildOptions and MaxBuildOptionsBytes limit the number and the
+	// total size of the keys and values of build options
+	MaxBuildOptions      int
+	MaxBuildOptionsBytes int
+}
+
+// DefaultBuildPolicy accepts any well-formed build within the default limits
+func DefaultBuildPolicy() BuildPolicy {
+	return BuildPolicy{
+		MaxBuildOptions:      DefaultMaxBuildOptions,
+		MaxBuildOptionsBytes: DefaultMaxBuildOptionsBytes,
+	}
+}
+
+// BuildPolicyFromEnv reads the policy from BUILD_PROJECT_ROOTS (a path list),
+// BUILD_TASK_ALLOWLIST (comma separated glob patterns), BUILD_MAX_OPTIONS and
+// BUILD_MAX_OPTIONS_BYTES. Unset variables keep the defaults.
+func BuildPolicyFromEnv() (BuildPolicy, error) {
+	policy := DefaultBuildPolicy()
+
+	if roots := os.Getenv("BUILD_PROJECT_ROOTS"); roots != "" {
+		for _, root := range filepath.SplitList(roots) {
+			if root == "" {
+				continue
+			}
+			if !filepath.IsAbs(root) {
+				return DefaultBuildPolicy(), fmt.Errorf("BUILD_PROJECT_ROOTS entry must be absolute: %s", root)
+			}
+			policy.ProjectRoots = append(policy.ProjectRoots, filepath.Clean(root))
+		}
+	}
+
+	if patterns := os.Getenv("BUILD_TASK_ALLOWLIST"); patterns != "" {
+		for _, pattern := range strings.Split(patterns, ",") {
+			pattern = strings.TrimSpace(pattern)
+			if pattern == "" {
+				continue
+			}
+			if _, err := path.Match(pattern, ""); err != nil {
+				return DefaultBuildPolicy(), fmt.Errorf("invalid BUILD_TASK_ALLOWLIST pattern %q: %v", pattern, err)
+			}
+			policy.TaskPatterns = append(policy.TaskPatterns, pattern)
+		}
+	}
+
+	limits := map[string]*int{
+		"BUILD_MAX_OPTIONS":       &policy.MaxBuildOptions,
+		"BUILD_MAX_OPTIONS_BYTES": &policy.MaxBuildOptionsBytes,
+	}
+	for name, limit := range limits {
+		value := os.Getenv(name)
+		if value == "" {
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return DefaultBuildPolicy(), fmt.Errorf("invalid %s: %s", name, value)
+		}
+		*limit = n
+	}
+
+	return policy, nil
+}
+
+// ValidateBuild checks a build against the policy and returns its normalized
+// project path
+func (p BuildPolicy) ValidateBuild(projectPath, taskName string, options map[string]string) (string, error) {
+	normalized, err := p.NormalizeProjectPath(projectPath)
+	if err != nil {
+		return "", fmt.Errorf("invalid project path: %w", err)
+	}
+
+	if err := p.ValidateTaskName(taskName); err != nil {
+		return "", fmt.Errorf("invalid task name: %w", err)
+	}
+
+	if err := p.ValidateBuildOptions(options); err != nil {
+		return "", fmt.Errorf("invalid build options: %w", err)
+	}
+
+	return normalized, nil
+}
+
+// NormalizeProjectPath validates a project path, cleans it and checks that it
+// is inside one of the project roots
+func (p BuildPolicy) NormalizeProjectPath(projectPath string) (string, error) {
+	if err := ValidateProjectPath(projectPath); err != nil {
+		return "", err
+	}
+	if strings.ContainsFunc(projectPath, unicode.IsControl) {
+		return "", fmt.Errorf("control character in path: %q", projectPath)
+	}
+
+	normalized := filepath.Clean(projectPath)
+	if !p.contains(normalized) {
+		return "", fmt.Errorf("project path %s is outside the allowed project roots", normalized)
+	}
+	return normalized, nil
+}
+
+// ResolveProjectPath normalizes a project path that exists on this host and
+// checks that it is still inside the project roots once symlinks are
+// resolved, so a link cannot point a build elsewhere
+func (p BuildPolicy) ResolveProjectPath(projectPath string) (string, error) {
+	normalized, err := p.NormalizeProjectPath(projectPath)
+	if err != nil {
+		return "", err
+	}
+
+	resolved, err := filepath.EvalSymlinks(normalized)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve project path: %v", err)
+	}
+	if !p.contains(resolved) {
+		return "", fmt.Errorf("project path %s resolves to %s, outside the allowed project roots", normalized, resolved)
+	}
+	return resolved, nil
+}
+
+// contains reports whether a clean absolute path is inside a project root.
+// Roots are also compared with their symlinks resolved.
+func (p BuildPolicy) contains(projectPath string) bool {
+	if len(p.ProjectRoots) == 0 {
+		return true
+	}
+
+	for _, root := range p.ProjectRoots {
+		if within(projectPath, root) {
+			return true
+		}
+		if resolved, err := filepath.EvalSymlinks(root); err == nil && within(projectPath, resolved) {
+			return true
+		}
+	}
+	return false
+}
+
+// within reports whether path is root or below it
+func within(path, root string) bool {
+	rel, err := filepath.Rel(root, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// ValidateTaskName checks that a task name is well formed and matches the
+// allowlist
+func (p BuildPolicy) ValidateTaskName(taskName string) error {
+	if err := ValidateTaskName(taskName); err != nil {
+		return err
+	}
+
+	if len(p.TaskPatterns) == 0 {
+		return nil
+	}
+	for _, pattern := range p.TaskPatterns {
+		if matched, _ := path.Match(pattern, taskName); matched {
+			return nil
+		}
+	}
+	return fmt.Errorf("task %s is not allowed", taskName)
+}
+
+// ValidateBuildOptions checks the number and size of build options, each
+// key and value, and the options controlling the Gradle invocation
+func (p BuildPolicy) ValidateBuildOptions(options map[string]string) error {
+	if p.MaxBuildOptions > 0 && len(options) > p.MaxBuildOptions {
+		return fmt.Errorf("too many build options: %d (max %d)", len(options), p.MaxBuildOptions)
+	}
+
+	size := 0
+	for key, value := range options {
+		size += len(key) + len(value)
+	}
+	if p.MaxBuildOptionsBytes > 0 && size > p.MaxBuildOptionsBytes {
+		return fmt.Errorf("build options too large: %d bytes (max %d)", size, p.MaxBuildOptionsBytes)
+	}
+
+	for key, value := range options {
+		if err := validateOptionKey(key); err != nil {
+			return fmt.Errorf("invalid option key '%s': %w", SanitizeInput(key), err)
+		}
+		if err := validateOptionValue(value); err != nil {
+			return fmt.Errorf("invalid option value for key '%s': %w", key, err)
+		}
+	}
+
+	if _, err := buildopts.Parse(options); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package validation
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBuildPolicyFromEnv(t *testing.T) {
+	t.Setenv("BUILD_PROJECT_ROOTS", "/workspace:/projects/")
+	t.Setenv("BUILD_TASK_ALLOWLIST", "build, test,:*:assemble*")
+	t.Setenv("BUILD_MAX_OPTIONS", "4")
+
+	policy, err := BuildPolicyFromEnv()
+	if err != nil {
+		t.Fatalf("BuildPolicyFromEnv failed: %v", err)
+	}
+	if strings.Join(policy.ProjectRoots, ",") != "/workspace,/projects" {
+		t.Errorf("Unexpected project roots %v", policy.ProjectRoots)
+	}
+	if strings.Join(policy.TaskPatterns, ",") != "build,test,:*:assemble*" {
+		t.Errorf("Unexpected task patterns %v", policy.TaskPatterns)
+	}
+	if policy.MaxBuildOptions != 4 || policy.MaxBuildOptionsBytes != DefaultMaxBuildOptionsBytes {
+		t.Errorf("Unexpected option limits %d and %d", policy.MaxBuildOptions, policy.MaxBuildOptionsBytes)
+	}
+
+	invalid := map[string]string{
+		"BUILD_PROJECT_ROOTS":     "relative/root",
+		"BUILD_TASK_ALLOWLIST":    "[build",
+		"BUILD_MAX_OPTIONS_BYTES": "lots",
+	}
+	for name, value := range invalid {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv(name, value)
+			if _, err := BuildPolicyFromEnv(); err == nil {
+				t.Errorf("Expected error for %s=%s", name, value)
+			}
+		})
+	}
+}
+
+func TestNormalizeProjectPath(t *testing.T) {
+	policy := BuildPolicy{ProjectRoots: []string{"/workspace"}}
+
+	tests := []struct {
+		path     string
+		expected string
+		err      string
+	}{
+		{"/workspace/app", "/workspace/app", ""},
+		{"/workspace//app/./", "/workspace/app", ""},
+		{"/workspace", "/workspace", ""},
+		{"/workspace-other/app", "", "outside the allowed project roots"},
+		{"/etc", "", "outside the allowed project roots"},
+		{"/workspace/../etc", "", "path traversal"},
+		{"/workspace/app\nrm", "", "control character"},
+		{"workspace/app", "", "must be absolute"},
+	}
+
+	for _, tc := range tests {
+		normalized, err := policy.NormalizeProjectPath(tc.path)
+		if tc.err == "" && (err != nil || normalized != tc.expected) {
+			t.Errorf("%q: expected %s, got %q, %v", tc.path, tc.expected, normalized, err)
+		}
+		if tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)) {
+			t.Errorf("%q: expected error containing %q, got %v", tc.path, tc.err, err)
+		}
+	}
+
+	if _, err := DefaultBuildPolicy().NormalizeProjectPath("/anywhere/app"); err != nil {
+		t.Errorf("Expected the default policy to allow any absolute path, got %v", err)
+	}
+}
+
+func TestResolveProjectPathRejectsSymlinkEscape(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	os.Mkdir(filepath.Join(root, "app"), 0755)
+	if err := os.Symlink(outside, filepath.Join(root, "link")); err != nil {
+		t.Skipf("Symlinks unavailable: %v", err)
+	}
+
+	policy := BuildPolicy{ProjectRoots: []string{root}}
+	if _, err := policy.ResolveProjectPath(filepath.Join(root, "app")); err != nil {
+		t.Errorf("Expected project inside the root to resolve, got %v", err)
+	}
+
+	_, err := policy.ResolveProjectPath(filepath.Join(root, "link"))
+	if err == nil || !strings.Contains(err.Error(), "outside the allowed project roots") {
+		t.Errorf("Expected symlink out of the root to be rejected, got %v", err)
+	}
+}
+
+func TestBuildPolicyTaskAllowlist(t *testing.T) {
+	policy := BuildPolicy{TaskPatterns: []string{"build", "test", ":*:assemble*"}}
+
+	for _, task := range []string{"build", "test", ":app:assembleDebug"} {
+		if err := policy.ValidateTaskName(task); err != nil {
+			t.Errorf("Expected %s to be allowed, got %v", task, err)
+		}
+	}
+	for _, task := range []string{"publish", ":app:publish", "--init-script", "build;rm"} {
+		if err := policy.ValidateTaskName(task); err == nil {
+			t.Errorf("Expected %s to be rejected", task)
+		}
+	}
+
+	if err := DefaultBuildPolicy().ValidateTaskName("-Dorg.gradle.jvmargs"); err == nil {
+		t.Error("Expected a task name starting with '-' to be rejected")
+	}
+}
+
+func TestBuildPolicyOptionLimits(t *testing.T) {
+	policy := BuildPolicy{MaxBuildOptions: 2, MaxBuildOptionsBytes: 20}
+
+	if err := policy.ValidateBuildOptions(map[string]string{"clean": "true"}); err != nil {
+		t.Errorf("Expected options within limits to be valid, got %v", err)
+	}
+
+	tooMany := map[string]string{}
+	for i := range 3 {
+		tooMany[fmt.Sprintf("o%d", i)] = "1"
+	}
+	if err := policy.ValidateBuildOptions(tooMany); err == nil || !strings.Contains(err.Error(), "too many build options") {
+		t.Errorf("Expected too many options error, got %v", err)
+	}
+
+	if err := policy.ValidateBuildOptions(map[string]string{"profile": strings.Repeat("x", 20)}); err == nil || !strings.Contains(err.Error(), "too large") {
+		t.Errorf("Expected size error, got %v", err)
+	}
+
+	if err := policy.ValidateBuildOptions(map[string]string{"flag": "$(id)"}); err == nil {
+		t.Error("Expected dangerous value to be rejected")
+	}
+
+	if err := DefaultBuildPolicy().ValidateBuildOptions(map[string]string{"gradleArgs": "-I init.gradle"}); err == nil || !strings.Contains(err.Error(), "gradleArgs") {
+		t.Errorf("Expected a disallowed Gradle argument to be rejected, got %v", err)
+	}
+}
+
+func TestValidateBuild(t *testing.T) {
+	policy := BuildPolicy{ProjectRoots: []string{"/workspace"}, MaxBuildOptions: 4}
+
+	normalized, err := policy.ValidateBuild("/workspace/app/", "build", map[string]string{"clean": "true"})
+	if err != nil || normalized != "/workspace/app" {
+		t.Errorf("Expected normalized path /workspace/app, got %q, %v", normalized, err)
+	}
+
+	if _, err := policy.ValidateBuild("/workspace/app", "build test", nil); err == nil || !strings.Contains(err.Error(), "invalid task name") {
+		t.Errorf("Expected task name error, got %v", err)
+	}
+}
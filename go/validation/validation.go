@@ -8,6 +8,7 @@ import (
 	"strings"
 	"time"
 
+	"distributed-gradle-building/gradledist"
 	"distributed-gradle-building/types"
 )
 
@@ -30,6 +31,10 @@ func ValidateBuildRequest(req *types.BuildRequest) error {
 		return fmt.Errorf("invalid build options: %w", err)
 	}
 
+	if req.GradleVersion != "" && !gradledist.ValidVersion(req.GradleVersion) {
+		return fmt.Errorf("invalid gradle version: %s", req.GradleVersion)
+	}
+
 	if req.RequestID == "" {
 		return fmt.Errorf("request ID is required")
 	}
@@ -97,6 +102,11 @@ func ValidateTaskName(taskName string) error {
 		return fmt.Errorf("invalid task name format: %s", taskName)
 	}
 
+	// Gradle would take a leading hyphen as a command line option
+	if strings.HasPrefix(taskName, "-") {
+		return fmt.Errorf("task name must not start with '-': %s", taskName)
+	}
+
 	// Validate length
 	if len(taskName) > 256 {
 		return fmt.Errorf("task name too long: %d characters", len(taskName))
@@ -49,6 +49,16 @@ func TestValidateBuildRequest(t *testing.T) {
 	if err := ValidateBuildRequest(invalidRequest); err == nil {
 		t.Error("Expected error for missing request ID")
 	}
+
+	// Test gradle version
+	validRequest.GradleVersion = "8.5"
+	if err := ValidateBuildRequest(validRequest); err != nil {
+		t.Errorf("Expected valid gradle version, got error: %v", err)
+	}
+	validRequest.GradleVersion = "../8.5"
+	if err := ValidateBuildRequest(validRequest); err == nil {
+		t.Error("Expected error for invalid gradle version")
+	}
 }
 
 func TestValidateProjectPath(t *testing.T) {
@@ -116,6 +126,7 @@ func TestValidateTaskName(t *testing.T) {
 		{"Task with backtick", "build`rm`", "dangerous pattern"},
 		{"Task with dollar", "build$", "dangerous pattern"},
 		{"Task with subshell", "build$(rm)", "dangerous pattern"},
+		{"Task starting with hyphen", "--init-script", "must not start with '-'"},
 		{"Too long task name", strings.Repeat("a", 257), "task name too long:"},
 	}
 
@@ -0,0 +1,107 @@
+package websocket
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAcceptKey(t *testing.T) {
+	// Example handshake from RFC 6455 section 1.3
+	if accept := AcceptKey("dGhlIHNhbXBsZSBub25jZQ=="); accept != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("Unexpected accept key %s", accept)
+	}
+}
+
+func TestUpgradeRejectsPlainRequests(t *testing.T) {
+	req := httptest.NewRequest("GET", "/stream", nil)
+	if _, err := Upgrade(httptest.NewRecorder(), req); err == nil {
+		t.Error("Expected request without upgrade headers to be rejected")
+	}
+}
+
+func TestConnExchange(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := Upgrade(w, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer conn.Close()
+
+		conn.WriteJSON(map[string]int{"progress": 40})
+
+		// Echo one message, then wait for the client to close
+		if opcode, payload, err := conn.ReadMessage(); err == nil {
+			conn.WriteMessage(opcode, payload)
+		}
+		conn.ReadMessage()
+	}))
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(server.URL, "http://"))
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: test\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n" +
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n"))
+
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("Failed to read handshake: %v", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Expected status 101, got %d", resp.StatusCode)
+	}
+	if accept := resp.Header.Get("Sec-WebSocket-Accept"); accept != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("Unexpected accept header %s", accept)
+	}
+
+	if opcode, payload := readFrame(t, reader); opcode != OpText || string(payload) != `{"progress":40}` {
+		t.Errorf("Unexpected message %d %s", opcode, payload)
+	}
+
+	writeMaskedFrame(conn, OpText, []byte("hello"))
+	if opcode, payload := readFrame(t, reader); opcode != OpText || string(payload) != "hello" {
+		t.Errorf("Expected echo, got %d %s", opcode, payload)
+	}
+
+	writeMaskedFrame(conn, OpClose, binary.BigEndian.AppendUint16(nil, 1000))
+	if opcode, _ := readFrame(t, reader); opcode != OpClose {
+		t.Errorf("Expected close frame, got %d", opcode)
+	}
+}
+
+// readFrame reads an unmasked server frame
+func readFrame(t *testing.T, reader *bufio.Reader) (byte, []byte) {
+	t.Helper()
+
+	var header [2]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		t.Fatalf("Failed to read frame: %v", err)
+	}
+	payload := make([]byte, header[1]&0x7F)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		t.Fatalf("Failed to read payload: %v", err)
+	}
+	return header[0] & 0x0F, payload
+}
+
+// writeMaskedFrame writes a small client frame, which must be masked
+func writeMaskedFrame(conn net.Conn, opcode byte, payload []byte) {
+	mask := []byte{1, 2, 3, 4}
+	frame := []byte{0x80 | opcode, 0x80 | byte(len(payload))}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	conn.Write(frame)
+}
@@ -73,9 +73,14 @@ type RegisterWorkerReply struct {
 }
 
 type HeartbeatArgs struct {
-	ID        string    `json:"id"`
-	Status    string    `json:"status"`
-	Timestamp time.Time `json:"timestamp"`
+	ID           string    `json:"id"`
+	Status       string    `json:"status"`
+	Timestamp    time.Time `json:"timestamp"`
+	CPUUsage     float64   `json:"cpu_usage"`
+	MemoryUsage  float64   `json:"memory_usage"`
+	DiskUsage    float64   `json:"disk_usage"`
+	LoadAverage  float64   `json:"load_average"`
+	ActiveBuilds int       `json:"active_builds"`
 }
 
 type HeartbeatReply struct {
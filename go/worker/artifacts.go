@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"log"
+	"path/filepath"
+	"strings"
+
+	"distributed-gradle-building/metrics"
+	"distributed-gradle-building/transfer"
+)
+
+// RPC argument and reply types for artifact uploads
+type MissingChunksArgs struct {
+	BuildID  string   `json:"build_id"`
+	WorkerID string   `json:"worker_id"`
+	Hashes   []string `json:"hashes"`
+}
+
+type MissingChunksReply struct {
+	Missing []string `json:"missing"`
+}
+
+type UploadChunkArgs struct {
+	BuildID  string `json:"build_id"`
+	WorkerID string `json:"worker_id"`
+	Hash     string `json:"hash"`
+	Data     []byte `json:"data"`
+}
+
+type UploadChunkReply struct {
+	Message string `json:"message"`
+}
+
+type CommitArtifactArgs struct {
+	BuildID  string            `json:"build_id"`
+	WorkerID string            `json:"worker_id"`
+	Manifest transfer.Manifest `json:"manifest"`
+}
+
+type CommitArtifactReply struct {
+	Message string `json:"message"`
+}
+
+// rpcRemote uploads artifact chunks to the coordinator over RPC
+type rpcRemote struct {
+	reporter *progressReporter
+}
+
+func (r rpcRemote) Missing(hashes []string) ([]string, error) {
+	args := MissingChunksArgs{BuildID: r.reporter.buildID, WorkerID: r.reporter.workerID, Hashes: hashes}
+	var reply MissingChunksReply
+	err := r.reporter.client.Call("BuildCoordinator.MissingChunks", args, &reply)
+	return reply.Missing, err
+}
+
+func (r rpcRemote) PutChunk(hash string, data []byte) error {
+	args := UploadChunkArgs{BuildID: r.reporter.buildID, WorkerID: r.reporter.workerID, Hash: hash, Data: data}
+	return r.reporter.client.Call("BuildCoordinator.UploadChunk", args, &UploadChunkReply{})
+}
+
+func (r rpcRemote) Commit(manifest transfer.Manifest) error {
+	args := CommitArtifactArgs{BuildID: r.reporter.buildID, WorkerID: r.reporter.workerID, Manifest: manifest}
+	return r.reporter.client.Call("BuildCoordinator.CommitArtifact", args, &CommitArtifactReply{})
+}
+
+// RPC argument and reply types for input downloads
+type DownloadChunkArgs struct {
+	BuildID  string `json:"build_id"`
+	WorkerID string `json:"worker_id"`
+	Hash     string `json:"hash"`
+}
+
+type DownloadChunkReply struct {
+	Data []byte `json:"data"`
+}
+
+// rpcSource downloads input chunks from the coordinator over RPC
+type rpcSource struct {
+	reporter *progressReporter
+}
+
+func (s rpcSource) Chunk(hash string) ([]byte, error) {
+	args := DownloadChunkArgs{BuildID: s.reporter.buildID, WorkerID: s.reporter.workerID, Hash: hash}
+	var reply DownloadChunkReply
+	err := s.reporter.client.Call("BuildCoordinator.DownloadChunk", args, &reply)
+	return reply.Data, err
+}
+
+// findOutputs returns the files of the outputs of a build: the files at
+// those paths in the project and the files in the directories there. Outputs
+// that were not created are skipped, as are those resolving outside the
+// project through a symbolic link.
+func findOutputs(projectPath string, outputs []string) []string {
+	root, err := filepath.EvalSymlinks(projectPath)
+	if err != nil {
+		return nil
+	}
+
+	var files []string
+	for _, output := range outputs {
+		if !transfer.ValidName(output) {
+			continue
+		}
+		path := filepath.Join(projectPath, filepath.FromSlash(output))
+		resolved, err := filepath.EvalSymlinks(path)
+		if err != nil {
+			continue
+		}
+		if rel, err := filepath.Rel(root, resolved); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			log.Printf("Skipping output %s outside of the project", output)
+			continue
+		}
+		filepath.WalkDir(path, func(file string, entry fs.DirEntry, err error) error {
+			if err == nil && entry.Type().IsRegular() {
+				files = append(files, file)
+			}
+			return nil
+		})
+	}
+	return files
+}
+
+// uploadArtifacts uploads the artifacts of the build to the coordinator,
+// named by their path in the project, sending only the chunks it does not
+// have yet. It returns the upload totals.
+func (pr *progressReporter) uploadArtifacts(projectPath string, artifacts []string) (transfer.Stats, error) {
+	var total transfer.Stats
+	if pr.client == nil {
+		return total, nil
+	}
+
+	for _, artifact := range artifacts {
+		relative, err := filepath.Rel(projectPath, artifact)
+		if err != nil {
+			return total, fmt.Errorf("artifact %s is outside the project: %v", artifact, err)
+		}
+		_, stats, err := transfer.Upload(rpcRemote{pr}, pr.buildID+"/"+filepath.ToSlash(relative), artifact)
+		total.Bytes += stats.Bytes
+		total.Chunks += stats.Chunks
+		total.SentChunks += stats.SentChunks
+		total.SentBytes += stats.SentBytes
+		total.WireBytes += stats.WireBytes
+		metrics.WorkerCacheTransferBytes.WithLabelValues(metrics.TransferUpload).Add(float64(stats.WireBytes))
+		if err != nil {
+			return total, fmt.Errorf("failed to upload %s: %v", relative, err)
+		}
+	}
+
+	log.Printf("Uploaded %d artifacts of build %s: %d of %d bytes sent in %d of %d chunks (%.0f%% deduplicated), %d bytes compressed",
+		len(artifacts), pr.buildID, total.SentBytes, total.Bytes, total.SentChunks, total.Chunks, total.DedupRatio()*100, total.WireBytes)
+	return total, nil
+}
+
+// downloadInputs downloads the artifacts of the pipeline stages a build
+// depends on into the project, at the paths they were built at
+func (pr *progressReporter) downloadInputs(projectPath string, inputs []transfer.Manifest) error {
+	if len(inputs) == 0 {
+		return nil
+	}
+	if pr.client == nil {
+		return fmt.Errorf("cannot download the inputs of build %s without a coordinator connection", pr.buildID)
+	}
+
+	var total transfer.Stats
+	for _, manifest := range inputs {
+		// Artifacts are named <build id>/<path in the project>
+		_, relative, found := strings.Cut(manifest.Name, "/")
+		if !found || !transfer.ValidName(relative) {
+			return fmt.Errorf("invalid input artifact %s", manifest.Name)
+		}
+		stats, err := transfer.Download(rpcSource{pr}, manifest, filepath.Join(projectPath, filepath.FromSlash(relative)), nil)
+		total.Bytes += stats.Bytes
+		total.SentBytes += stats.SentBytes
+		metrics.WorkerCacheTransferBytes.WithLabelValues(metrics.TransferDownload).Add(float64(stats.WireBytes))
+		if err != nil {
+			return fmt.Errorf("failed to download input %s: %v", manifest.Name, err)
+		}
+	}
+
+	log.Printf("Downloaded %d inputs of build %s: %d bytes", len(inputs), pr.buildID, total.SentBytes)
+	return nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"distributed-gradle-building/transfer"
+)
+
+// artifactCoordinator is a coordinator RPC service storing uploaded artifacts
+type artifactCoordinator struct {
+	store *transfer.Store
+}
+
+func (c *artifactCoordinator) MissingChunks(args MissingChunksArgs, reply *MissingChunksReply) error {
+	missing, err := c.store.Missing(args.Hashes)
+	reply.Missing = missing
+	return err
+}
+
+func (c *artifactCoordinator) UploadChunk(args UploadChunkArgs, reply *UploadChunkReply) error {
+	return c.store.PutChunk(args.Hash, args.Data)
+}
+
+func (c *artifactCoordinator) CommitArtifact(args CommitArtifactArgs, reply *CommitArtifactReply) error {
+	return c.store.Commit(args.Manifest)
+}
+
+func (c *artifactCoordinator) DownloadChunk(args DownloadChunkArgs, reply *DownloadChunkReply) error {
+	data, err := c.store.Chunk(args.Hash)
+	reply.Data = data
+	return err
+}
+
+func TestUploadArtifacts(t *testing.T) {
+	store, _ := transfer.Open("")
+	server := rpc.NewServer()
+	if err := server.RegisterName("BuildCoordinator", &artifactCoordinator{store: store}); err != nil {
+		t.Fatalf("Failed to register RPC service: %v", err)
+	}
+	serverConn, clientConn := net.Pipe()
+	go server.ServeConn(serverConn)
+	client := rpc.NewClient(clientConn)
+	defer client.Close()
+
+	projectPath := t.TempDir()
+	jar := filepath.Join(projectPath, "build", "libs", "app.jar")
+	os.MkdirAll(filepath.Dir(jar), 0755)
+	content := []byte(strings.Repeat("compiled classes\n", 1000))
+	os.WriteFile(jar, content, 0644)
+
+	reporter := &progressReporter{client: client, buildID: "build-1", workerID: "worker-1"}
+	stats, err := reporter.uploadArtifacts(projectPath, []string{jar})
+	if err != nil {
+		t.Fatalf("uploadArtifacts failed: %v", err)
+	}
+	if stats.Bytes != int64(len(content)) || stats.SentChunks != 1 {
+		t.Errorf("Expected the artifact to be sent, got %+v", stats)
+	}
+
+	manifest, err := store.Manifest("build-1/build/libs/app.jar")
+	if err != nil {
+		t.Fatalf("Expected the artifact to be named by its project path: %v", err)
+	}
+	downloaded := filepath.Join(t.TempDir(), "app.jar")
+	if _, err := transfer.Download(store, manifest, downloaded, nil); err != nil {
+		t.Fatalf("Download failed: %v", err)
+	}
+	if data, _ := os.ReadFile(downloaded); !bytes.Equal(data, content) {
+		t.Error("Expected the uploaded artifact content")
+	}
+
+	// The next build of the same artifact sends nothing
+	reporter.buildID = "build-2"
+	if stats, err := reporter.uploadArtifacts(projectPath, []string{jar}); err != nil || stats.SentChunks != 0 || stats.DedupRatio() != 1 {
+		t.Errorf("Expected an unchanged artifact to be deduplicated, got %+v: %v", stats, err)
+	}
+}
+
+func TestDownloadInputs(t *testing.T) {
+	store, _ := transfer.Open("")
+	server := rpc.NewServer()
+	if err := server.RegisterName("BuildCoordinator", &artifactCoordinator{store: store}); err != nil {
+		t.Fatalf("Failed to register RPC service: %v", err)
+	}
+	serverConn, clientConn := net.Pipe()
+	go server.ServeConn(serverConn)
+	client := rpc.NewClient(clientConn)
+	defer client.Close()
+
+	// The compile stage uploads its jar
+	compiled := t.TempDir()
+	jar := filepath.Join(compiled, "core", "build", "libs", "core.jar")
+	os.MkdirAll(filepath.Dir(jar), 0755)
+	content := []byte(strings.Repeat("compiled classes\n", 1000))
+	os.WriteFile(jar, content, 0644)
+	compile := &progressReporter{client: client, buildID: "pipeline-1-compile", workerID: "worker-1"}
+	if _, err := compile.uploadArtifacts(compiled, []string{jar}); err != nil {
+		t.Fatalf("uploadArtifacts failed: %v", err)
+	}
+	manifest, err := store.Manifest("pipeline-1-compile/core/build/libs/core.jar")
+	if err != nil {
+		t.Fatalf("Expected the uploaded artifact: %v", err)
+	}
+
+	// The test stage finds it where it was built
+	projectPath := t.TempDir()
+	test := &progressReporter{client: client, buildID: "pipeline-1-test", workerID: "worker-2"}
+	if err := test.downloadInputs(projectPath, []transfer.Manifest{manifest}); err != nil {
+		t.Fatalf("downloadInputs failed: %v", err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(projectPath, "core", "build", "libs", "core.jar")); !bytes.Equal(data, content) {
+		t.Error("Expected the input at its path in the project")
+	}
+
+	escaping := manifest
+	escaping.Name = "pipeline-1-compile/../../outside.jar"
+	if err := test.downloadInputs(projectPath, []transfer.Manifest{escaping}); err == nil {
+		t.Error("Expected an input outside the project to be rejected")
+	}
+	if err := (&progressReporter{buildID: "pipeline-1-test"}).downloadInputs(projectPath, []transfer.Manifest{manifest}); err == nil {
+		t.Error("Expected inputs to require a coordinator connection")
+	}
+}
+
+func TestFindOutputs(t *testing.T) {
+	projectPath := t.TempDir()
+	classes := filepath.Join(projectPath, "app", "build", "classes", "java", "main")
+	os.MkdirAll(filepath.Join(classes, "com", "example"), 0755)
+	os.WriteFile(filepath.Join(classes, "com", "example", "App.class"), []byte("class"), 0644)
+	os.WriteFile(filepath.Join(projectPath, "app", "build", "report.txt"), []byte("report"), 0644)
+
+	outside := t.TempDir()
+	os.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0644)
+	os.Symlink(outside, filepath.Join(projectPath, "app", "build", "linked"))
+
+	files := findOutputs(projectPath, []string{
+		"app/build/classes/java/main",
+		"app/build/report.txt",
+		"app/build/linked",
+		"app/build/missing",
+		"../escape",
+	})
+	expected := []string{
+		filepath.Join(classes, "com", "example", "App.class"),
+		filepath.Join(projectPath, "app", "build", "report.txt"),
+	}
+	if strings.Join(files, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected %v, got %v", expected, files)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"distributed-gradle-building/attestation"
+	"distributed-gradle-building/signing"
+)
+
+// attest signs the statement of the worker's binary and platform it
+// registers with, nil if it has no attestation key or cannot sign. The
+// coordinator then rejects it if its attestation policy requires one.
+func (ws *WorkerService) attest() *attestation.Attestation {
+	if ws.config.AttestationKeyFile == "" {
+		return nil
+	}
+	signer, err := signing.Load(ws.config.AttestationKeyFile)
+	if err != nil {
+		log.Printf("Failed to load the attestation key: %v", err)
+		return nil
+	}
+	binary, err := os.Executable()
+	if err == nil {
+		binary, err = filepath.EvalSymlinks(binary)
+	}
+	if err != nil {
+		log.Printf("Failed to locate the worker binary: %v", err)
+		return nil
+	}
+
+	statement, err := attestation.Attest(signer, ws.config.ID, binary, time.Now())
+	if err != nil {
+		log.Printf("Failed to attest worker %s: %v", ws.config.ID, err)
+		return nil
+	}
+	log.Printf("Worker %s attests with key %s (public key %s)", ws.config.ID, signer.KeyID(), signer.PublicKey().PublicKey)
+	return statement
+}
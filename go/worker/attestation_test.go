@@ -0,0 +1,37 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"distributed-gradle-building/attestation"
+	"distributed-gradle-building/protocol"
+	"distributed-gradle-building/signing"
+)
+
+func TestAttest(t *testing.T) {
+	service := NewWorkerService(&WorkerConfig{ID: "worker-1", BuildDir: t.TempDir(), MaxConcurrentBuilds: 1})
+	if service.attest() != nil {
+		t.Errorf("Expected a worker without an attestation key not to attest")
+	}
+
+	keyFile := filepath.Join(t.TempDir(), "attestation-key.pem")
+	service.config.AttestationKeyFile = keyFile
+	statement := service.attest()
+	if statement == nil {
+		t.Fatalf("Expected the worker to attest")
+	}
+	signer, err := signing.Load(keyFile)
+	if err != nil {
+		t.Fatalf("Expected the generated key to be stored, got %v", err)
+	}
+	binary, _ := os.Executable()
+	checksum, _ := protocol.FileSHA256(binary)
+
+	policy := &attestation.Policy{Keys: []string{signer.PublicKey().PublicKey}, Binaries: []string{checksum}, Platforms: []string{attestation.Platform()}}
+	if _, err := policy.Verify(statement, "worker-1", nil, time.Now()); err != nil {
+		t.Errorf("Expected the statement to satisfy the policy, got %v", err)
+	}
+}
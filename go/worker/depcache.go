@@ -0,0 +1,294 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// sharedGradleHomeEntries are the entries of the worker's Gradle user home
+// linked into the home of every build: the Gradle distributions of the
+// wrapper, the user's configuration and the local build cache, which Gradle
+// locks for use by concurrent builds
+var sharedGradleHomeEntries = []string{
+	"wrapper",
+	"gradle.properties",
+	"init.d",
+	"jdks",
+	filepath.Join("caches", "build-cache-1"),
+}
+
+// dependencyCache shares the dependencies concurrent builds download. Each
+// build runs with a Gradle user home of its own, an overlay of the worker's,
+// and the shared cache as its read-only dependency cache
+// (GRADLE_RO_DEP_CACHE), so builds never download what an earlier build
+// did. Gradle requires the read-only cache not to change while builds use
+// it, so the dependencies a build downloaded are merged into a new
+// generation of the cache, hard linking the files of the current one, and a
+// generation is removed once no build uses it.
+type dependencyCache struct {
+	dir string
+	// merging serializes merges, mutex guards the generations
+	merging sync.Mutex
+	mutex   sync.Mutex
+	current int
+	// readers counts the builds using each generation
+	readers map[int]int
+}
+
+// newDependencyCache returns a dependency cache in dir, continuing from the
+// latest generation left in it
+func newDependencyCache(dir string) (*dependencyCache, error) {
+	c := &dependencyCache{dir: dir, readers: make(map[int]int)}
+	// The overlays of builds interrupted by a restart are of no use
+	if err := os.RemoveAll(filepath.Join(dir, "builds")); err != nil {
+		return nil, fmt.Errorf("failed to remove build overlays: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "builds"), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create dependency cache: %v", err)
+	}
+
+	generations, err := c.generations()
+	if err != nil {
+		return nil, err
+	}
+	if len(generations) > 0 {
+		c.current = slices.Max(generations)
+	}
+	for _, generation := range generations {
+		if generation != c.current {
+			os.RemoveAll(c.generationDir(generation))
+		}
+	}
+	return c, nil
+}
+
+// generations lists the generations of the cache on disk
+func (c *dependencyCache) generations() ([]int, error) {
+	entries, err := os.ReadDir(filepath.Join(c.dir, "generations"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read dependency cache: %v", err)
+	}
+	var generations []int
+	for _, entry := range entries {
+		if generation, err := strconv.Atoi(entry.Name()); err == nil && entry.IsDir() {
+			generations = append(generations, generation)
+		}
+	}
+	return generations, nil
+}
+
+// generationDir returns the directory of a generation, holding the
+// modules-2 directory Gradle expects in GRADLE_RO_DEP_CACHE
+func (c *dependencyCache) generationDir(generation int) string {
+	return filepath.Join(c.dir, "generations", strconv.Itoa(generation))
+}
+
+// acquire prepares the Gradle user home of a build run with env. It returns
+// the environment to run Gradle with and the function releasing the cache
+// when the build ends, merging the dependencies it downloaded if merge is
+// set. Builds choosing their own read-only cache run unchanged, as do all
+// builds if the cache is disabled.
+func (c *dependencyCache) acquire(env []string) ([]string, func(merge bool), error) {
+	if c == nil || lookupEnv(env, "GRADLE_RO_DEP_CACHE") != "" {
+		return env, func(bool) {}, nil
+	}
+
+	home := gradleUserHome(env)
+	overlay, err := os.MkdirTemp(filepath.Join(c.dir, "builds"), "build-")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create Gradle user home: %v", err)
+	}
+	if err := linkGradleHome(home, overlay); err != nil {
+		os.RemoveAll(overlay)
+		return nil, nil, err
+	}
+
+	c.mutex.Lock()
+	generation := c.current
+	c.readers[generation]++
+	c.mutex.Unlock()
+
+	env = append(env, "GRADLE_USER_HOME="+overlay)
+	// Generation 0 is the empty cache
+	if generation > 0 {
+		env = append(env, "GRADLE_RO_DEP_CACHE="+c.generationDir(generation))
+	}
+
+	release := func(merge bool) {
+		if merge {
+			if err := c.merge(filepath.Join(overlay, "caches", "modules-2")); err != nil {
+				log.Printf("Failed to share downloaded dependencies: %v", err)
+			}
+		}
+		c.release(generation)
+		os.RemoveAll(overlay)
+	}
+	return env, release, nil
+}
+
+// linkGradleHome links the shared entries of the Gradle user home into the
+// overlay of a build. The build cache is created if missing, so builds
+// share it from the start.
+func linkGradleHome(home, overlay string) error {
+	if err := os.MkdirAll(filepath.Join(home, "caches", "build-cache-1"), 0755); err != nil {
+		return fmt.Errorf("failed to create build cache: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Join(overlay, "caches"), 0755); err != nil {
+		return fmt.Errorf("failed to create Gradle user home: %v", err)
+	}
+	for _, entry := range sharedGradleHomeEntries {
+		target := filepath.Join(home, entry)
+		if _, err := os.Stat(target); err != nil {
+			continue
+		}
+		if err := os.Symlink(target, filepath.Join(overlay, entry)); err != nil {
+			return fmt.Errorf("failed to link %s into Gradle user home: %v", entry, err)
+		}
+	}
+	return nil
+}
+
+// release stops a build using a generation
+func (c *dependencyCache) release(generation int) {
+	c.mutex.Lock()
+	c.readers[generation]--
+	c.mutex.Unlock()
+	c.prune()
+}
+
+// prune removes the generations replaced by newer ones that no build uses
+func (c *dependencyCache) prune() {
+	c.mutex.Lock()
+	var unused []int
+	for generation, readers := range c.readers {
+		if readers == 0 && generation != c.current {
+			delete(c.readers, generation)
+			unused = append(unused, generation)
+		}
+	}
+	c.mutex.Unlock()
+
+	for _, generation := range unused {
+		os.RemoveAll(c.generationDir(generation))
+	}
+}
+
+// merge creates a generation of the cache with the files of the current one
+// and the new files of a build's modules-2 directory, and makes it current
+func (c *dependencyCache) merge(modules string) error {
+	c.merging.Lock()
+	defer c.merging.Unlock()
+
+	c.mutex.Lock()
+	current := c.current
+	c.mutex.Unlock()
+
+	base := filepath.Join(c.generationDir(current), "modules-2")
+	var downloaded []string
+	err := filepath.WalkDir(modules, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == modules {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if !entry.Type().IsRegular() || !sharedDependencyFile(entry.Name()) {
+			return nil
+		}
+		rel, err := filepath.Rel(modules, path)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stat(filepath.Join(base, rel)); os.IsNotExist(err) {
+			downloaded = append(downloaded, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to read downloaded dependencies: %v", err)
+	}
+	if len(downloaded) == 0 {
+		return nil
+	}
+
+	next := current + 1
+	target := filepath.Join(c.generationDir(next), "modules-2")
+	os.RemoveAll(c.generationDir(next))
+	if err := linkTree(base, target); err != nil {
+		os.RemoveAll(c.generationDir(next))
+		return err
+	}
+	for _, rel := range downloaded {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(target, rel)), 0755); err != nil {
+			os.RemoveAll(c.generationDir(next))
+			return fmt.Errorf("failed to share dependency %s: %v", rel, err)
+		}
+		// The overlay is removed with the build, so its files are moved
+		if err := os.Rename(filepath.Join(modules, rel), filepath.Join(target, rel)); err != nil {
+			os.RemoveAll(c.generationDir(next))
+			return fmt.Errorf("failed to share dependency %s: %v", rel, err)
+		}
+	}
+
+	c.mutex.Lock()
+	c.current = next
+	// The replaced generation goes once its last build ends, or now
+	if _, used := c.readers[current]; !used {
+		c.readers[current] = 0
+	}
+	c.mutex.Unlock()
+	c.prune()
+
+	log.Printf("Shared %d downloaded dependency files in generation %d of the dependency cache", len(downloaded), next)
+	return nil
+}
+
+// sharedDependencyFile reports whether a file of a Gradle modules-2
+// directory belongs in the read-only cache. Lock files and the state of
+// Gradle's cache cleanup are left out, as Gradle requires.
+func sharedDependencyFile(name string) bool {
+	return !strings.HasSuffix(name, ".lock") && name != "gc.properties"
+}
+
+// linkTree hard links the files under src into dst, doing nothing if src
+// does not exist
+func linkTree(src, dst string) error {
+	err := filepath.WalkDir(src, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == src {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			return os.MkdirAll(filepath.Join(dst, rel), 0755)
+		}
+		return os.Link(path, filepath.Join(dst, rel))
+	})
+	if err != nil {
+		return fmt.Errorf("failed to link dependency cache: %v", err)
+	}
+	return os.MkdirAll(dst, 0755)
+}
+
+// lookupEnv returns the last value of a variable in env
+func lookupEnv(env []string, key string) string {
+	value := ""
+	for _, variable := range env {
+		if v, found := strings.CutPrefix(variable, key+"="); found {
+			value = v
+		}
+	}
+	return value
+}
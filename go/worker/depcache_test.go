@@ -0,0 +1,124 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// download writes a dependency into the modules-2 directory of the Gradle
+// user home of a build run with env, as Gradle does
+func download(t *testing.T, env []string, rel string) {
+	t.Helper()
+	path := filepath.Join(lookupEnv(env, "GRADLE_USER_HOME"), "caches", "modules-2", rel)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatalf("Failed to create cache directory: %v", err)
+	}
+	if err := os.WriteFile(path, []byte(rel), 0644); err != nil {
+		t.Fatalf("Failed to write dependency: %v", err)
+	}
+}
+
+func TestDependencyCache(t *testing.T) {
+	home := t.TempDir()
+	os.MkdirAll(filepath.Join(home, "wrapper", "dists"), 0755)
+	cache, err := newDependencyCache(filepath.Join(t.TempDir(), "dependency-cache"))
+	if err != nil {
+		t.Fatalf("newDependencyCache failed: %v", err)
+	}
+	base := []string{"GRADLE_USER_HOME=" + home}
+	guava := filepath.Join("files-2.1", "com.google.guava", "guava", "33.0", "abc", "guava-33.0.jar")
+	junit := filepath.Join("files-2.1", "junit", "junit", "4.13", "def", "junit-4.13.jar")
+
+	first, releaseFirst, err := cache.acquire(base)
+	if err != nil {
+		t.Fatalf("acquire failed: %v", err)
+	}
+	if lookupEnv(first, "GRADLE_RO_DEP_CACHE") != "" {
+		t.Error("Expected no read-only cache before any build downloaded dependencies")
+	}
+	overlay := lookupEnv(first, "GRADLE_USER_HOME")
+	if target, err := os.Readlink(filepath.Join(overlay, "wrapper")); err != nil || target != filepath.Join(home, "wrapper") {
+		t.Errorf("Expected the Gradle distributions to be shared, got %q: %v", target, err)
+	}
+	if _, err := os.Stat(filepath.Join(home, "caches", "build-cache-1")); err != nil {
+		t.Errorf("Expected the shared build cache to be created: %v", err)
+	}
+
+	// A concurrent build keeps the generation it started with
+	second, releaseSecond, _ := cache.acquire(base)
+	download(t, first, guava)
+	download(t, first, filepath.Join("metadata-2.106", "module-metadata.bin.lock"))
+	releaseFirst(true)
+	if _, err := os.Stat(overlay); !os.IsNotExist(err) {
+		t.Errorf("Expected the Gradle user home of the build to be removed, got %v", err)
+	}
+	if lookupEnv(second, "GRADLE_RO_DEP_CACHE") != "" {
+		t.Error("Expected the running build's read-only cache to be unchanged")
+	}
+
+	third, releaseThird, _ := cache.acquire(base)
+	shared := lookupEnv(third, "GRADLE_RO_DEP_CACHE")
+	if _, err := os.Stat(filepath.Join(shared, "modules-2", guava)); err != nil {
+		t.Fatalf("Expected the downloaded dependency in the read-only cache: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(shared, "modules-2", "metadata-2.106", "module-metadata.bin.lock")); !os.IsNotExist(err) {
+		t.Errorf("Expected lock files to be left out, got %v", err)
+	}
+
+	// Failed builds share nothing
+	download(t, second, junit)
+	releaseSecond(false)
+	download(t, third, guava)
+	download(t, third, junit)
+	releaseThird(true)
+
+	latest, releaseLatest, _ := cache.acquire(base)
+	defer releaseLatest(false)
+	if next := lookupEnv(latest, "GRADLE_RO_DEP_CACHE"); next == shared {
+		t.Fatal("Expected a new generation of the cache")
+	} else {
+		for _, rel := range []string{guava, junit} {
+			if _, err := os.Stat(filepath.Join(next, "modules-2", rel)); err != nil {
+				t.Errorf("Expected %s in the new generation: %v", rel, err)
+			}
+		}
+	}
+	if _, err := os.Stat(shared); !os.IsNotExist(err) {
+		t.Errorf("Expected the replaced generation to be removed once unused, got %v", err)
+	}
+
+	// Builds choosing their own read-only cache are left alone
+	own := append(base, "GRADLE_RO_DEP_CACHE=/opt/gradle-cache")
+	if env, release, _ := cache.acquire(own); len(env) != len(own) {
+		t.Errorf("Expected the environment to be unchanged, got %v", env)
+	} else {
+		release(true)
+	}
+}
+
+func TestDependencyCacheRestart(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "dependency-cache")
+	os.MkdirAll(filepath.Join(dir, "generations", "3", "modules-2"), 0755)
+	os.MkdirAll(filepath.Join(dir, "generations", "4", "modules-2"), 0755)
+	os.MkdirAll(filepath.Join(dir, "builds", "build-1"), 0755)
+
+	cache, err := newDependencyCache(dir)
+	if err != nil {
+		t.Fatalf("newDependencyCache failed: %v", err)
+	}
+	if cache.current != 4 {
+		t.Errorf("Expected to continue from generation 4, got %d", cache.current)
+	}
+	for _, path := range []string{filepath.Join(dir, "generations", "3"), filepath.Join(dir, "builds", "build-1")} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("Expected %s to be removed, got %v", path, err)
+		}
+	}
+
+	// Without the cache, builds run with the worker's Gradle user home
+	var disabled *dependencyCache
+	if env, _, _ := disabled.acquire([]string{"PATH=/bin"}); len(env) != 1 {
+		t.Errorf("Expected the environment to be unchanged, got %v", env)
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"distributed-gradle-building/depproxy/proxy"
+)
+
+// writeProxyInitScript writes the init script redirecting the repositories
+// of builds to the worker's dependency proxy into the build directory, and
+// returns its path, empty without a proxy
+func writeProxyInitScript(config *WorkerConfig) (string, error) {
+	if config.DependencyProxyURL == "" {
+		return "", nil
+	}
+
+	upstreams, err := proxy.ParseUpstreams(config.DependencyProxyUpstreams)
+	if err != nil {
+		return "", err
+	}
+	script, err := proxy.InitScript(config.DependencyProxyURL, upstreams)
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(config.BuildDir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create build directory: %v", err)
+	}
+	path := filepath.Join(config.BuildDir, "dependency-proxy.gradle")
+	if err := os.WriteFile(path, []byte(script), 0644); err != nil {
+		return "", fmt.Errorf("failed to write init script: %v", err)
+	}
+	log.Printf("Builds resolve dependencies through the dependency proxy at %s", config.DependencyProxyURL)
+	return path, nil
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDependencyProxyInitScript(t *testing.T) {
+	project := t.TempDir()
+	// The wrapper records the arguments of the build
+	wrapper := "#!/bin/sh\n[ \"$1\" = build ] || exit 0\necho \"$@\" > args\n"
+	if err := os.WriteFile(filepath.Join(project, "gradlew"), []byte(wrapper), 0755); err != nil {
+		t.Fatalf("Failed to write wrapper: %v", err)
+	}
+	buildDir := t.TempDir()
+	service := NewWorkerService(&WorkerConfig{ID: "worker-1", BuildDir: buildDir, MaxConcurrentBuilds: 1, DependencyProxyURL: "http://depproxy:8091"})
+
+	var response string
+	if err := service.Build(BuildRequest{RequestID: "build-1", ProjectPath: project, TaskName: "build"}, &response); err != nil {
+		t.Fatalf("Build failed: %v", err)
+	}
+	args, _ := os.ReadFile(filepath.Join(project, "args"))
+	script := filepath.Join(buildDir, "dependency-proxy.gradle")
+	if !strings.Contains(string(args), "--init-script "+script) {
+		t.Errorf("Expected the build to run with the proxy's init script, got %q", args)
+	}
+	content, err := os.ReadFile(script)
+	if err != nil || !strings.Contains(string(content), "def proxy = 'http://depproxy:8091'") {
+		t.Errorf("Expected the init script to point at the proxy, got %q: %v", content, err)
+	}
+
+	// Builds run unchanged with an invalid proxy
+	invalid := NewWorkerService(&WorkerConfig{ID: "worker-2", BuildDir: t.TempDir(), DependencyProxyURL: "http://depproxy:8091", DependencyProxyUpstreams: "central"})
+	if invalid.proxyInitScript != "" {
+		t.Errorf("Expected no init script for invalid upstreams, got %s", invalid.proxyInitScript)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"log"
+	"strings"
+
+	"distributed-gradle-building/devices"
+	"distributed-gradle-building/protocol"
+)
+
+// attachedDevices returns the Android devices attached to the worker with
+// the builds they are locked to, nil unless the worker advertises devices
+func (ws *WorkerService) attachedDevices() []devices.Device {
+	if !ws.config.AndroidDevices {
+		return nil
+	}
+	attached, err := devices.Discover(devices.ADB(ws.config.AndroidSDK))
+	if err != nil {
+		log.Printf("Failed to discover Android devices: %v", err)
+		return nil
+	}
+	return ws.deviceLocks.Annotate(attached)
+}
+
+// acquireDevices locks the devices the coordinator allocated to a build, or
+// devices meeting its requirement if it allocated none. Builds whose devices
+// are gone or taken fail for the worker, so the coordinator re-queues them.
+func (ws *WorkerService) acquireDevices(request BuildRequest) ([]devices.Device, error) {
+	if !ws.config.AndroidDevices {
+		return nil, protocol.NewBuildError(protocol.ErrorInfra, "worker %s has no Android devices", ws.config.ID)
+	}
+	attached, err := devices.Discover(devices.ADB(ws.config.AndroidSDK))
+	if err != nil {
+		return nil, protocol.NewBuildError(protocol.ErrorInfra, "%v", err)
+	}
+	allocated, err := ws.deviceLocks.Acquire(request.RequestID, attached, *request.Devices, request.DeviceSerials)
+	if err != nil {
+		return nil, protocol.NewBuildError(protocol.ErrorInfra, "worker %s: %v", ws.config.ID, err)
+	}
+	log.Printf("Build %s runs on devices %s", request.RequestID, strings.Join(devices.Serials(allocated), ", "))
+	return allocated, nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"distributed-gradle-building/devices"
+	"distributed-gradle-building/protocol"
+)
+
+func TestBuildDevices(t *testing.T) {
+	sdk := t.TempDir()
+	adb := devices.ADB(sdk)
+	script := "#!/bin/sh\n" +
+		"if [ \"$1\" = devices ]; then printf 'List of devices attached\\nemulator-5554 device model:sdk_gphone64\\nemulator-5556 device model:sdk_gphone64\\n'; exit 0; fi\n" +
+		"case \"$2\" in emulator-5554) echo '[ro.build.version.sdk]: [30]';; *) echo '[ro.build.version.sdk]: [34]';; esac\n" +
+		"echo '[ro.product.cpu.abi]: [x86_64]'\n"
+	if err := os.MkdirAll(filepath.Dir(adb), 0755); err != nil {
+		t.Fatalf("Failed to create the SDK: %v", err)
+	}
+	if err := os.WriteFile(adb, []byte(script), 0755); err != nil {
+		t.Fatalf("Failed to write adb: %v", err)
+	}
+
+	project := t.TempDir()
+	// The wrapper records the devices Gradle may use
+	wrapper := "#!/bin/sh\n[ \"$1\" = connectedAndroidTest ] || exit 0\necho \"$ANDROID_SERIAL\" > devices\n"
+	if err := os.WriteFile(filepath.Join(project, "gradlew"), []byte(wrapper), 0755); err != nil {
+		t.Fatalf("Failed to write wrapper: %v", err)
+	}
+	service := NewWorkerService(&WorkerConfig{ID: "worker-1", BuildDir: t.TempDir(), MaxConcurrentBuilds: 2, AndroidDevices: true, AndroidSDK: sdk})
+
+	advertised := service.heartbeatArgs().Devices
+	if len(advertised) != 2 || advertised[0].APILevel != 30 || advertised[1].APILevel != 34 || advertised[1].Kind != devices.KindEmulator {
+		t.Fatalf("Expected the emulators in the heartbeat, got %+v", advertised)
+	}
+
+	build := func(id string, requirement devices.Requirement, serials ...string) (string, error) {
+		os.Remove(filepath.Join(project, "devices"))
+		var response string
+		err := service.Build(BuildRequest{RequestID: id, ProjectPath: project, TaskName: "connectedAndroidTest", Devices: &requirement, DeviceSerials: serials}, &response)
+		serial, _ := os.ReadFile(filepath.Join(project, "devices"))
+		return strings.TrimSpace(string(serial)), err
+	}
+
+	if serial, err := build("build-1", devices.Requirement{MinAPILevel: 33}, "emulator-5556"); err != nil || serial != "emulator-5556" {
+		t.Errorf("Expected the build to run on the allocated emulator, got %q: %v", serial, err)
+	}
+	if serial, err := build("build-2", devices.Requirement{Count: 2}); err != nil || serial != "emulator-5554,emulator-5556" {
+		t.Errorf("Expected the build to run on both emulators, got %q: %v", serial, err)
+	}
+
+	// Devices locked to another build are refused
+	if _, err := service.deviceLocks.Acquire("build-3", advertised, devices.Requirement{}, []string{"emulator-5556"}); err != nil {
+		t.Fatalf("Acquire failed: %v", err)
+	}
+	if locked := service.heartbeatArgs().Devices; locked[1].BuildID != "build-3" || locked[0].BuildID != "" {
+		t.Errorf("Expected the heartbeat to show the locked emulator, got %+v", locked)
+	}
+	_, err := build("build-4", devices.Requirement{}, "emulator-5556")
+	var failure *protocol.BuildError
+	if !errors.As(err, &failure) || failure.Code != protocol.ErrorInfra {
+		t.Errorf("Expected the build to fail for the worker, got %v", err)
+	}
+	service.deviceLocks.Release("build-3")
+
+	service.config.AndroidDevices = false
+	if _, err := build("build-5", devices.Requirement{}); err == nil || !strings.Contains(err.Error(), "has no Android devices") {
+		t.Errorf("Expected a worker without devices to refuse the build, got %v", err)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"os/exec"
+	"sync"
+	"syscall"
+
+	"distributed-gradle-building/protocol"
+	"distributed-gradle-building/testshard"
+)
+
+// failureClassifier classifies a failed Gradle build by the lines it printed
+// to its standard output and error
+type failureClassifier struct {
+	mutex   sync.Mutex
+	matched map[protocol.ErrorCode]bool
+}
+
+// observe looks for the signs of a failure's class in a line of output
+func (c *failureClassifier) observe(line string) {
+	code := protocol.MatchLogLine(line)
+	if code == "" {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.matched == nil {
+		c.matched = make(map[protocol.ErrorCode]bool)
+	}
+	c.matched[code] = true
+}
+
+// classify returns the class of a Gradle build that exited with err, given
+// the results of its tests. A JVM running out of memory or killed outright,
+// as by the kernel's OOM killer, outweighs failed tests, which outweigh
+// infrastructure errors; anything else is an error of the project.
+func (c *failureClassifier) classify(err error, tests []testshard.ClassResult) protocol.ErrorCode {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.matched[protocol.ErrorOOM] || killed(err) {
+		return protocol.ErrorOOM
+	}
+	if c.matched[protocol.ErrorTestFailure] {
+		return protocol.ErrorTestFailure
+	}
+	for _, class := range tests {
+		if class.Failures > 0 {
+			return protocol.ErrorTestFailure
+		}
+	}
+	if c.matched[protocol.ErrorInfra] {
+		return protocol.ErrorInfra
+	}
+	return protocol.ErrorCompile
+}
+
+// killed reports whether a process exited with err because it received
+// SIGKILL
+func killed(err error) bool {
+	var exitError *exec.ExitError
+	if !errors.As(err, &exitError) {
+		return false
+	}
+	status, ok := exitError.Sys().(syscall.WaitStatus)
+	return ok && status.Signaled() && status.Signal() == syscall.SIGKILL
+}
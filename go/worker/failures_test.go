@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"distributed-gradle-building/protocol"
+	"distributed-gradle-building/testshard"
+)
+
+func TestFailureClassifier(t *testing.T) {
+	exitError := errors.New("exit status 1")
+	tests := []struct {
+		name     string
+		lines    []string
+		results  []testshard.ClassResult
+		expected protocol.ErrorCode
+	}{
+		{"compile", []string{"> Task :compileJava FAILED", "error: cannot find symbol"}, nil, protocol.ErrorCompile},
+		{"tests", []string{"> Task :test FAILED", "3 tests completed, 1 failed"}, nil, protocol.ErrorTestFailure},
+		{"test results", nil, []testshard.ClassResult{{Name: "AppTest", Tests: 2, Failures: 1}}, protocol.ErrorTestFailure},
+		{"oom", []string{"3 tests completed, 1 failed", "java.lang.OutOfMemoryError: Java heap space"}, nil, protocol.ErrorOOM},
+		{"infra", []string{"> Could not resolve com.example:lib:1.0.", "> Could not GET 'https://repo.example.com/lib.pom'"}, nil, protocol.ErrorInfra},
+	}
+	for _, tt := range tests {
+		var classifier failureClassifier
+		for _, line := range tt.lines {
+			classifier.observe(line)
+		}
+		if code := classifier.classify(exitError, tt.results); code != tt.expected {
+			t.Errorf("%s: expected %s, got %s", tt.name, tt.expected, code)
+		}
+	}
+}
+
+func TestBuildErrorCodes(t *testing.T) {
+	project := t.TempDir()
+	// The wrapper fails the build the way the file named by the test asks
+	wrapper := "#!/bin/sh\n[ \"$1\" = build ] || exit 0\n" +
+		"[ -e tests ] && echo '2 tests completed, 1 failed' && exit 1\n" +
+		"[ -e oom ] && echo 'java.lang.OutOfMemoryError: GC overhead limit exceeded' >&2 && exit 1\n" +
+		"[ -e slow ] && sleep 2\n" +
+		"echo 'error: cannot find symbol' && exit 1\n"
+	if err := os.WriteFile(filepath.Join(project, "gradlew"), []byte(wrapper), 0755); err != nil {
+		t.Fatalf("Failed to write wrapper: %v", err)
+	}
+	service := NewWorkerService(&WorkerConfig{ID: "worker-1", BuildDir: t.TempDir(), MaxConcurrentBuilds: 1, BuildTimeout: 500 * time.Millisecond})
+
+	for _, tt := range []struct {
+		file     string
+		expected protocol.ErrorCode
+	}{
+		{"", protocol.ErrorCompile},
+		{"tests", protocol.ErrorTestFailure},
+		{"oom", protocol.ErrorOOM},
+		{"slow", protocol.ErrorTimeout},
+	} {
+		if tt.file != "" {
+			os.WriteFile(filepath.Join(project, tt.file), nil, 0644)
+		}
+		var response string
+		err := service.Build(BuildRequest{RequestID: "build-" + tt.file, ProjectPath: project, TaskName: "build"}, &response)
+		var buildError *protocol.BuildError
+		if !errors.As(err, &buildError) || buildError.Code != tt.expected {
+			t.Errorf("%q: expected a %s build error, got %v", tt.file, tt.expected, err)
+		}
+		if tt.file != "" {
+			os.Remove(filepath.Join(project, tt.file))
+		}
+	}
+
+	// Invalid requests fail everywhere, unlike missing capacity
+	var response string
+	err := service.Build(BuildRequest{RequestID: "build-invalid", ProjectPath: project, TaskName: "build", BuildOptions: map[string]string{"gradleArgs": "--init-script /tmp/init.gradle"}}, &response)
+	if code := protocol.ParseBuildError(err).Code; code != protocol.ErrorCompile {
+		t.Errorf("Expected invalid options to be a %s, got %v", protocol.ErrorCompile, err)
+	}
+	service.buildSlots <- struct{}{}
+	err = service.Build(BuildRequest{RequestID: "build-full", ProjectPath: project, TaskName: "build"}, &response)
+	if code := protocol.ParseBuildError(err).Code; code != protocol.ErrorInfra {
+		t.Errorf("Expected a full worker to be an %s, got %v", protocol.ErrorInfra, err)
+	}
+}
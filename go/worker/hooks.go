@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"slices"
+
+	"distributed-gradle-building/hooks"
+	"distributed-gradle-building/protocol"
+)
+
+// runHooks runs the hooks of a phase of a build in its project directory,
+// logging their output with the build's and reporting each as a step. Once
+// a hook fails or the build is cancelled the remaining ones are skipped, and
+// so are the post-build hooks of a failed build, except those that always
+// run.
+func (pr *progressReporter) runHooks(phase string, list []hooks.Hook, dir string, env []string, mask func(string) string, failed bool) error {
+	var failure error
+	for _, hook := range list {
+		step := "pre-build hook " + hook.Name
+		if phase == hooks.PhasePost {
+			step = "post-build hook " + hook.Name
+		}
+
+		if (failed || failure != nil) && !hook.Always {
+			pr.reportHook(step, hooks.Skip(hook, phase))
+			continue
+		}
+		// Hooks that always run clean up after cancelled builds too
+		if pr.report(pr.percent(), step, "") {
+			failed = true
+			if failure == nil {
+				failure = protocol.NewBuildError(protocol.ErrorCancelled, "build %s cancelled by coordinator", pr.buildID)
+			}
+			if !hook.Always {
+				pr.reportHook(step, hooks.Skip(hook, phase))
+				continue
+			}
+		}
+
+		hookEnv := append(slices.Clip(env), hooks.EnvBuildID+"="+pr.buildID)
+		if phase == hooks.PhasePost {
+			status := "succeeded"
+			if failed || failure != nil {
+				status = "failed"
+			}
+			hookEnv = append(hookEnv, hooks.EnvBuildStatus+"="+status)
+		}
+		result := hooks.Run(hook, phase, dir, hookEnv, func(line string) {
+			line = mask(line)
+			fmt.Println(line)
+			pr.log(line)
+		})
+		result.Output = mask(result.Output)
+		pr.reportHook(step, result)
+
+		if err := result.Err(); err != nil && failure == nil {
+			log.Printf("Build %s: %v", pr.buildID, err)
+			failure = protocol.NewBuildError(protocol.ErrorCompile, "%v", err)
+			if result.Status == hooks.StatusTimedOut {
+				failure = protocol.NewBuildError(protocol.ErrorTimeout, "%v after %v", err, hook.Timeout())
+			}
+		}
+	}
+	return failure
+}
+
+// reportHook sends the outcome of a hook as a step of the build
+func (pr *progressReporter) reportHook(step string, result hooks.Step) {
+	pr.send(ReportProgressArgs{Progress: pr.percent(), Step: step, Message: result.Status, Hook: &result})
+}
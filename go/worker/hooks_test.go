@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"distributed-gradle-building/hooks"
+	"distributed-gradle-building/protocol"
+)
+
+func TestBuildHooks(t *testing.T) {
+	project := t.TempDir()
+	// The wrapper records the build, failing it if asked to
+	wrapper := "#!/bin/sh\n[ \"$1\" = build ] || exit 0\necho gradle >> events\n[ ! -f fail ] || exit 1\n"
+	if err := os.WriteFile(filepath.Join(project, "gradlew"), []byte(wrapper), 0755); err != nil {
+		t.Fatalf("Failed to write wrapper: %v", err)
+	}
+	service := NewWorkerService(&WorkerConfig{ID: "worker-1", BuildDir: t.TempDir(), MaxConcurrentBuilds: 1})
+	build := func(buildHooks hooks.Hooks) (string, error) {
+		os.Remove(filepath.Join(project, "events"))
+		var response string
+		err := service.Build(BuildRequest{RequestID: "build-1", ProjectPath: project, TaskName: "build", Hooks: &buildHooks}, &response)
+		events, _ := os.ReadFile(filepath.Join(project, "events"))
+		return strings.ReplaceAll(strings.TrimSpace(string(events)), "\n", ","), err
+	}
+	record := func(name string) hooks.Hook {
+		return hooks.Hook{Name: name, Run: "echo " + name + ":$" + hooks.EnvBuildStatus + " >> events"}
+	}
+	always := func(hook hooks.Hook) hooks.Hook {
+		hook.Always = true
+		return hook
+	}
+
+	events, err := build(hooks.Hooks{
+		Pre:  []hooks.Hook{record("start-db")},
+		Post: []hooks.Hook{record("sign"), always(record("stop-db"))},
+	})
+	if err != nil || events != "start-db:,gradle,sign:succeeded,stop-db:succeeded" {
+		t.Errorf("Expected the hooks around Gradle, got %q: %v", events, err)
+	}
+
+	// A failing pre-build hook fails the build before Gradle runs
+	events, err = build(hooks.Hooks{
+		Pre:  []hooks.Hook{{Name: "start-db", Run: "exit 2"}, record("seed")},
+		Post: []hooks.Hook{record("sign"), always(record("stop-db"))},
+	})
+	var failure *protocol.BuildError
+	if !errors.As(err, &failure) || failure.Code != protocol.ErrorCompile || !strings.Contains(failure.Message, "pre-build hook start-db failed with exit code 2") {
+		t.Errorf("Expected the pre-build hook to fail the build, got %v", err)
+	}
+	if events != "stop-db:failed" {
+		t.Errorf("Expected only the cleanup to run, got %q", events)
+	}
+
+	// Failed builds only run the post-build hooks that always run
+	if err := os.WriteFile(filepath.Join(project, "fail"), nil, 0644); err != nil {
+		t.Fatalf("Failed to fail the build: %v", err)
+	}
+	events, err = build(hooks.Hooks{Post: []hooks.Hook{record("sign"), always(record("stop-db"))}})
+	if err == nil || events != "gradle,stop-db:failed" {
+		t.Errorf("Expected the failed build to be cleaned up, got %q: %v", events, err)
+	}
+	os.Remove(filepath.Join(project, "fail"))
+
+	// A failing post-build hook fails the build, and timeouts fail it as
+	// timed out
+	_, err = build(hooks.Hooks{Post: []hooks.Hook{{Name: "sign", Run: "sleep 5", TimeoutSeconds: 1}}})
+	if !errors.As(err, &failure) || failure.Code != protocol.ErrorTimeout || !strings.Contains(failure.Message, "post-build hook sign timed out after 1s") {
+		t.Errorf("Expected the post-build hook to time out, got %v", err)
+	}
+}
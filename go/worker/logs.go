@@ -0,0 +1,91 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+const (
+	// logBatchLines is the most output lines sent to the coordinator at once
+	logBatchLines = 500
+	// logFlushInterval is how often output is sent while a build runs
+	logFlushInterval = time.Second
+)
+
+// RPC argument and reply types for build output
+type ReportLogArgs struct {
+	BuildID  string   `json:"build_id"`
+	WorkerID string   `json:"worker_id"`
+	Lines    []string `json:"lines"`
+}
+
+type ReportLogReply struct {
+	Message string `json:"message"`
+}
+
+// startLogs sends the build output every logFlushInterval until the
+// reporter is closed
+func (pr *progressReporter) startLogs() {
+	pr.logDone = make(chan struct{})
+	pr.logWait.Add(1)
+	go func() {
+		defer pr.logWait.Done()
+		ticker := time.NewTicker(logFlushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				pr.flushLogs()
+			case <-pr.logDone:
+				return
+			}
+		}
+	}()
+}
+
+// log buffers a line of build output, sending a full batch at once
+func (pr *progressReporter) log(line string) {
+	if pr.client == nil {
+		return
+	}
+	pr.logMutex.Lock()
+	pr.logLines = append(pr.logLines, line)
+	full := len(pr.logLines) >= logBatchLines
+	pr.logMutex.Unlock()
+	if full {
+		pr.flushLogs()
+	}
+}
+
+// flushLogs sends the buffered output to the coordinator. Output the
+// coordinator does not accept is dropped; the build goes on regardless.
+func (pr *progressReporter) flushLogs() {
+	// Batches are sent one at a time so lines arrive in order
+	pr.logSend.Lock()
+	defer pr.logSend.Unlock()
+
+	pr.logMutex.Lock()
+	lines := pr.logLines
+	pr.logLines = nil
+	pr.logMutex.Unlock()
+	if len(lines) == 0 {
+		return
+	}
+
+	args := ReportLogArgs{BuildID: pr.buildID, WorkerID: pr.workerID, Lines: lines}
+	var reply ReportLogReply
+	pr.chaos.DelayRPC("BuildCoordinator.ReportLog")
+	if err := pr.client.Call("BuildCoordinator.ReportLog", args, &reply); err != nil {
+		log.Printf("Failed to report output of build %s: %v", pr.buildID, err)
+	}
+}
+
+// stopLogs stops the periodic sending and sends the remaining output
+func (pr *progressReporter) stopLogs() {
+	if pr.logDone == nil {
+		return
+	}
+	close(pr.logDone)
+	pr.logWait.Wait()
+	pr.flushLogs()
+}
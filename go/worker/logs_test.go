@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/rpc"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// logCoordinator is a coordinator RPC service recording reported output
+type logCoordinator struct {
+	mutex   sync.Mutex
+	batches [][]string
+}
+
+func (c *logCoordinator) ReportLog(args ReportLogArgs, reply *ReportLogReply) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.batches = append(c.batches, args.Lines)
+	return nil
+}
+
+func TestReportLogs(t *testing.T) {
+	coordinator := &logCoordinator{}
+	server := rpc.NewServer()
+	if err := server.RegisterName("BuildCoordinator", coordinator); err != nil {
+		t.Fatalf("Failed to register RPC service: %v", err)
+	}
+	serverConn, clientConn := net.Pipe()
+	go server.ServeConn(serverConn)
+	client := rpc.NewClient(clientConn)
+	defer client.Close()
+
+	reporter := &progressReporter{client: client, buildID: "build-1", workerID: "worker-1"}
+	reporter.startLogs()
+	var expected []string
+	for i := range logBatchLines + 2 {
+		line := fmt.Sprintf("line %d", i)
+		reporter.log(line)
+		expected = append(expected, line)
+	}
+	reporter.stopLogs()
+
+	// A full batch is sent at once and the rest when the reporter stops
+	var received []string
+	for _, batch := range coordinator.batches {
+		if len(batch) > logBatchLines {
+			t.Errorf("Expected batches of at most %d lines, got %d", logBatchLines, len(batch))
+		}
+		received = append(received, batch...)
+	}
+	if !reflect.DeepEqual(received, expected) {
+		t.Errorf("Expected every line in order, got %d lines", len(received))
+	}
+
+	// Without a coordinator, output is only printed
+	offline := &progressReporter{buildID: "build-2"}
+	offline.log("line")
+	offline.close()
+}
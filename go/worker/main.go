@@ -1,20 +1,46 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"math"
 	"net"
 	"net/http"
 	"net/rpc"
 	"os"
 	"os/exec"
-	"os/signal"
+	"path/filepath"
+	"runtime"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"distributed-gradle-building/attestation"
+	"distributed-gradle-building/buildenv"
+	"distributed-gradle-building/buildopts"
+	"distributed-gradle-building/calibration"
+	"distributed-gradle-building/chaos"
+	"distributed-gradle-building/devices"
+	"distributed-gradle-building/gitsource"
+	"distributed-gradle-building/gradledist"
+	"distributed-gradle-building/hooks"
+	"distributed-gradle-building/internal/app"
+	"distributed-gradle-building/metrics"
+	"distributed-gradle-building/protocol"
+	"distributed-gradle-building/provenance"
+	"distributed-gradle-building/secrets"
+	"distributed-gradle-building/testshard"
+	"distributed-gradle-building/transfer"
+	"distributed-gradle-building/types"
+	"distributed-gradle-building/validation"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
@@ -29,6 +55,49 @@ type WorkerConfig struct {
 	CacheEnabled        bool   `json:"cache_enabled"`
 	MaxConcurrentBuilds int    `json:"max_concurrent_builds"`
 	WorkerType          string `json:"worker_type"`
+	Pool                string `json:"pool"`
+	// UploadArtifacts uploads the artifacts of successful builds to the
+	// coordinator, which serves them to clients
+	UploadArtifacts bool `json:"upload_artifacts"`
+	// Calibrate benchmarks the worker before it first registers, so the
+	// coordinator can scale predicted build durations to it
+	Calibrate bool `json:"calibrate"`
+	// ResourceSampleInterval is how often the process tree of a build is
+	// sampled, 0 to disable sampling
+	ResourceSampleInterval time.Duration `json:"resource_sample_interval"`
+	// BuildTimeout is how long a build may run before it is killed and
+	// fails with a timeout, 0 for no limit
+	BuildTimeout time.Duration `json:"build_timeout"`
+	// SharedDependencyCache runs every build with a Gradle user home of its
+	// own, sharing the dependencies earlier builds downloaded read-only
+	SharedDependencyCache bool `json:"shared_dependency_cache"`
+	// DependencyProxyURL is the dependency proxy builds resolve the
+	// repositories of DependencyProxyUpstreams through, name=url pairs as
+	// configured on the proxy, the public repositories if empty
+	DependencyProxyURL       string `json:"dependency_proxy_url"`
+	DependencyProxyUpstreams string `json:"dependency_proxy_upstreams"`
+	// Spot marks a worker on a preemptible instance. It reports its
+	// preemption when it receives SIGTERM or PreemptionNoticeURL, polled
+	// every PreemptionPollInterval, announces it.
+	Spot                   bool          `json:"spot"`
+	PreemptionNoticeURL    string        `json:"preemption_notice_url"`
+	PreemptionPollInterval time.Duration `json:"preemption_poll_interval"`
+	// Transport is tcp to connect over the RPC ports, pull to only connect
+	// to the coordinator's RPC port, or http to reach the coordinator over
+	// its HTTP port at CoordinatorURL only, authenticated with
+	// CoordinatorAPIKey if set
+	Transport         string `json:"transport"`
+	CoordinatorURL    string `json:"coordinator_url"`
+	CoordinatorAPIKey string `json:"coordinator_api_key,omitempty"`
+	// AndroidDevices advertises the emulators and devices adb of the
+	// Android SDK at AndroidSDK lists, adb of the PATH if empty, for
+	// instrumentation tests
+	AndroidDevices bool   `json:"android_devices"`
+	AndroidSDK     string `json:"android_sdk"`
+	// AttestationKeyFile is the Ed25519 key the worker signs the statement
+	// of its binary and platform with when registering, generated if
+	// missing. The worker does not attest if it is empty.
+	AttestationKeyFile string `json:"attestation_key_file"`
 }
 
 // RPC argument and reply types
@@ -38,39 +107,228 @@ type RegisterWorkerArgs struct {
 	Port         int      `json:"port"`
 	Capabilities []string `json:"capabilities"`
 	Status       string   `json:"status"`
+	MaxBuilds    int      `json:"max_builds"`
+	// Version and ProtocolVersion let the coordinator reject workers it
+	// cannot drive
+	Version         string `json:"version"`
+	ProtocolVersion int    `json:"protocol_version"`
+	// Pool is the worker pool to join, the default pool if empty
+	Pool string `json:"pool"`
+	// Calibration are the benchmark scores of the worker, if calibrated
+	Calibration *calibration.Scores `json:"calibration,omitempty"`
+	// Spot is set for workers on preemptible instances
+	Spot bool `json:"spot,omitempty"`
+	// Transport is tcp, or http or pull for workers that poll the
+	// coordinator's calls instead of accepting RPC connections
+	Transport string `json:"transport,omitempty"`
+	// Devices are the Android emulators and devices attached to the worker
+	Devices []devices.Device `json:"devices,omitempty"`
+	// Attestation is the signed statement of what the worker runs
+	Attestation *attestation.Attestation `json:"attestation,omitempty"`
 }
 
 type RegisterWorkerReply struct {
 	Message string `json:"message"`
+	// Update is the worker release published by the coordinator, if any
+	Update *protocol.Release `json:"update,omitempty"`
 }
 
 type BuildRequest struct {
-	ProjectPath  string
-	TaskName     string
-	WorkerID     string
-	CacheEnabled bool
-	BuildOptions map[string]string
-	Timestamp    time.Time
-	RequestID    string
+	ProjectPath   string
+	TaskName      string
+	GradleVersion string
+	WorkerID      string
+	CacheEnabled  bool
+	BuildOptions  map[string]string
+	Secrets       []string
+	Timestamp     time.Time
+	RequestID     string
+	// RepoURL, Ref and Credentials name a repository the worker checks out
+	// for the build; ProjectPath is then relative to the checkout
+	RepoURL     string
+	Ref         string
+	Credentials string
+	// SecretEnv holds the secret values the coordinator resolved for the
+	// build by environment variable
+	SecretEnv map[string]string
+	// GitCredentials holds the value of the Credentials secret
+	GitCredentials string
+	// Inputs are artifacts of earlier pipeline stages to download into the
+	// project before building
+	Inputs []transfer.Manifest
+	// CorrelationID is the request ID of the API request that submitted the
+	// build, logged with it
+	CorrelationID string
+	// Shard selects the test classes the build runs when the coordinator
+	// split the tests of a request across builds
+	Shard *testshard.Shard
+	// Outputs are files and directories of the project the worker uploads
+	// as artifacts after the build, whether it succeeds or not
+	Outputs []string
+	// Upload is an uploaded project archive the worker unpacks for the
+	// build; ProjectPath is then relative to the archive
+	Upload *transfer.Manifest
+	// Environment is the environment pinned for a replayed build. Its
+	// variables are set for Gradle, and the build fails if the worker's
+	// toolchain or platform differs from it.
+	Environment *buildenv.Snapshot
+	// Hooks are commands run in the project directory before and after
+	// Gradle
+	Hooks *hooks.Hooks
+	// Devices selects the Android devices the build runs instrumentation
+	// tests on, and DeviceSerials are those the coordinator allocated
+	Devices       *devices.Requirement
+	DeviceSerials []string
+}
+
+// mask replaces the build's secrets and repository credentials in text
+func (r BuildRequest) mask(text string) string {
+	text = secrets.Mask(text, r.SecretEnv)
+	if r.GitCredentials != "" {
+		text = strings.ReplaceAll(text, r.GitCredentials, secrets.MaskedValue)
+	}
+	return text
 }
 
 // RPC argument and reply types for heartbeat
 type HeartbeatArgs struct {
-	ID        string    `json:"id"`
-	Status    string    `json:"status"`
-	Timestamp time.Time `json:"timestamp"`
+	ID           string    `json:"id"`
+	Status       string    `json:"status"`
+	Timestamp    time.Time `json:"timestamp"`
+	CPUUsage     float64   `json:"cpu_usage"`
+	MemoryUsage  float64   `json:"memory_usage"`
+	DiskUsage    float64   `json:"disk_usage"`
+	LoadAverage  float64   `json:"load_average"`
+	ActiveBuilds int       `json:"active_builds"`
+	// TelemetryUnavailable is set when the usage values could not be read
+	TelemetryUnavailable bool `json:"telemetry_unavailable,omitempty"`
+	// Devices are the Android devices attached to the worker, with the
+	// builds they are locked to
+	Devices []devices.Device `json:"devices,omitempty"`
 }
 
 type HeartbeatReply struct {
 	Message string `json:"message"`
 }
 
+// RPC argument and reply types for the coordinator's reconciliation ping
+type PingArgs struct {
+	Coordinator string `json:"coordinator"`
+}
+
+type PingReply struct {
+	ID              string `json:"id"`
+	ActiveBuilds    int    `json:"active_builds"`
+	MaxBuilds       int    `json:"max_builds"`
+	Version         string `json:"version"`
+	ProtocolVersion int    `json:"protocol_version"`
+	Pool            string `json:"pool"`
+}
+
+// RPC argument and reply types for build progress
+type ReportProgressArgs struct {
+	BuildID   string    `json:"build_id"`
+	WorkerID  string    `json:"worker_id"`
+	Progress  float64   `json:"progress"`
+	Step      string    `json:"step"`
+	Message   string    `json:"message"`
+	Timestamp time.Time `json:"timestamp"`
+	// CommandLine is the Gradle invocation of the build, with secrets
+	// masked, reported when it starts
+	CommandLine string `json:"command_line,omitempty"`
+	// Outcome is the outcome Gradle printed next to the task of the step,
+	// such as FROM-CACHE or UP-TO-DATE, if known when it started
+	Outcome string `json:"outcome,omitempty"`
+	// Environment is the environment of the build, reported when it starts
+	// and again with the cache keys of its tasks when it ends
+	Environment *buildenv.Snapshot `json:"environment,omitempty"`
+	// Hook is the outcome of the hook of the step, reported when it ended
+	Hook *hooks.Step `json:"hook,omitempty"`
+}
+
+type ReportProgressReply struct {
+	Cancelled bool   `json:"cancelled"`
+	Message   string `json:"message"`
+}
+
+// RPC argument and reply types for build artifacts
+type ReportArtifactsArgs struct {
+	BuildID      string           `json:"build_id"`
+	WorkerID     string           `json:"worker_id"`
+	Artifacts    []types.Artifact `json:"artifacts"`
+	CacheHitRate float64          `json:"cache_hit_rate"`
+	// ResourceUsage is the sampled resource usage of the build
+	ResourceUsage *ResourceMetrics `json:"resource_usage,omitempty"`
+}
+
+type ReportArtifactsReply struct {
+	Message string `json:"message"`
+}
+
+type ReportTestResultsArgs struct {
+	BuildID  string                  `json:"build_id"`
+	WorkerID string                  `json:"worker_id"`
+	Classes  []testshard.ClassResult `json:"classes"`
+	// Commit is the commit the worker checked out, empty for builds of a
+	// project path
+	Commit string `json:"commit,omitempty"`
+}
+
+type ReportTestResultsReply struct {
+	Message string `json:"message"`
+}
+
+// progressReporter streams build progress to the coordinator
+type progressReporter struct {
+	client      *rpc.Client
+	chaos       *chaos.Injector
+	workerID    string
+	buildID     string
+	totalTasks  int
+	doneTasks   int
+	currentTask string
+	cachedTasks int
+	runTasks    int
+	// commandLine is sent with the report of the build starting
+	commandLine string
+	// environment is sent with the reports of the build starting and
+	// ending; cache keys are added to it as Gradle logs them
+	environment *buildenv.Snapshot
+	// logLines buffers build output until it is sent with logSend held
+	logMutex sync.Mutex
+	logLines []string
+	logSend  sync.Mutex
+	logDone  chan struct{}
+	logWait  sync.WaitGroup
+}
+
 // WorkerService represents a build worker
 type WorkerService struct {
-	config     *WorkerConfig
-	rpcServer  *rpc.Server
-	httpServer *http.Server
-	shutdown   chan struct{}
+	config       *WorkerConfig
+	rpcServer    *rpc.Server
+	httpServer   *http.Server
+	telemetry    *telemetryCollector
+	activeBuilds int32
+	buildSlots   chan struct{}
+	shutdown     chan struct{}
+	gradle       *gradledist.Provisioner
+	chaos        *chaos.Injector
+	buildPolicy  validation.BuildPolicy
+	checkouts    *gitsource.Checkouts
+	updater      *selfUpdater
+	// dependencies is the dependency cache shared by the builds, nil if
+	// builds share the worker's Gradle user home instead
+	dependencies *dependencyCache
+	// proxyInitScript redirects the repositories of builds to the
+	// dependency proxy, empty without one
+	proxyInitScript string
+	// deviceLocks lock the Android devices of the worker to builds
+	deviceLocks devices.Locks
+	// toolchains caches the detected versions of each Gradle executable
+	toolchains sync.Map
+	// calibration is benchmarked once and sent with every registration
+	calibrateOnce sync.Once
+	calibration   *calibration.Scores
 }
 
 // loadWorkerConfig loads worker configuration from file and environment variables
@@ -85,7 +343,25 @@ func loadWorkerConfig(filename string) (*WorkerConfig, error) {
 		CacheEnabled:        getEnvBoolOrDefault("CACHE_ENABLED", true),
 		MaxConcurrentBuilds: getEnvIntOrDefault("MAX_BUILDS", 5),
 		WorkerType:          getEnvOrDefault("WORKER_TYPE", "standard"),
+		Pool:                os.Getenv("WORKER_POOL"),
+		UploadArtifacts:     getEnvBoolOrDefault("WORKER_UPLOAD_ARTIFACTS", false),
+		Calibrate:           getEnvBoolOrDefault("WORKER_CALIBRATION", true),
+		// Sampling a build's process tree reads /proc, so it is not done too often
+		ResourceSampleInterval:   getEnvDurationOrDefault("WORKER_RESOURCE_SAMPLE_INTERVAL", 2*time.Second),
+		BuildTimeout:             getEnvDurationOrDefault("WORKER_BUILD_TIMEOUT", 0),
+		SharedDependencyCache:    getEnvBoolOrDefault("WORKER_SHARED_DEPENDENCY_CACHE", false),
+		DependencyProxyURL:       os.Getenv("WORKER_DEPENDENCY_PROXY_URL"),
+		DependencyProxyUpstreams: os.Getenv("WORKER_DEPENDENCY_PROXY_UPSTREAMS"),
+		Spot:                     getEnvBoolOrDefault("WORKER_SPOT", false),
+		PreemptionNoticeURL:      os.Getenv("WORKER_PREEMPTION_NOTICE_URL"),
+		PreemptionPollInterval:   getEnvDurationOrDefault("WORKER_PREEMPTION_POLL_INTERVAL", 5*time.Second),
+		Transport:                getEnvOrDefault("WORKER_TRANSPORT", TransportTCP),
+		CoordinatorAPIKey:        os.Getenv("COORDINATOR_API_KEY"),
+		AndroidDevices:           getEnvBoolOrDefault("WORKER_ANDROID_DEVICES", false),
+		AndroidSDK:               getEnvOrDefault("ANDROID_HOME", os.Getenv("ANDROID_SDK_ROOT")),
+		AttestationKeyFile:       os.Getenv("WORKER_ATTESTATION_KEY_FILE"),
 	}
+	config.CoordinatorURL = getEnvOrDefault("COORDINATOR_URL", "http://"+config.CoordinatorHost+":8080")
 
 	// Try to load from file if it exists
 	if data, err := os.ReadFile(filename); err == nil {
@@ -94,6 +370,11 @@ func loadWorkerConfig(filename string) (*WorkerConfig, error) {
 		}
 	}
 
+	if config.Transport != TransportTCP && config.Transport != TransportHTTP && config.Transport != TransportPull {
+		log.Printf("Ignoring unknown transport %q, connecting over TCP", config.Transport)
+		config.Transport = TransportTCP
+	}
+
 	return config, nil
 }
 
@@ -114,6 +395,15 @@ func getEnvIntOrDefault(key string, defaultValue int) int {
 	return defaultValue
 }
 
+func getEnvDurationOrDefault(key string, defaultValue time.Duration) time.Duration {
+	if value := os.Getenv(key); value != "" {
+		if duration, err := time.ParseDuration(value); err == nil && duration >= 0 {
+			return duration
+		}
+	}
+	return defaultValue
+}
+
 func getEnvBoolOrDefault(key string, defaultValue bool) bool {
 	if value := os.Getenv(key); value != "" {
 		if boolValue, err := strconv.ParseBool(value); err == nil {
@@ -125,9 +415,40 @@ func getEnvBoolOrDefault(key string, defaultValue bool) bool {
 
 // NewWorkerService creates a new worker service
 func NewWorkerService(config *WorkerConfig) *WorkerService {
+	if config.MaxConcurrentBuilds <= 0 {
+		config.MaxConcurrentBuilds = 1
+	}
+
+	buildPolicy, err := validation.BuildPolicyFromEnv()
+	if err != nil {
+		log.Printf("Invalid build policy, using defaults: %v", err)
+	}
+
+	var dependencies *dependencyCache
+	if config.SharedDependencyCache {
+		dependencies, err = newDependencyCache(filepath.Join(config.BuildDir, "dependency-cache"))
+		if err != nil {
+			log.Printf("Shared dependency cache disabled: %v", err)
+		}
+	}
+
+	proxyInitScript, err := writeProxyInitScript(config)
+	if err != nil {
+		log.Printf("Dependency proxy disabled: %v", err)
+	}
+
 	return &WorkerService{
-		config:   config,
-		shutdown: make(chan struct{}),
+		config:          config,
+		telemetry:       newTelemetryCollector(config.BuildDir),
+		buildSlots:      make(chan struct{}, config.MaxConcurrentBuilds),
+		shutdown:        make(chan struct{}),
+		gradle:          gradledist.NewProvisionerFromEnv(),
+		chaos:           chaos.NewInjectorFromEnv(),
+		buildPolicy:     buildPolicy,
+		checkouts:       gitsource.NewCheckoutsFromEnv(),
+		updater:         newSelfUpdaterFromEnv(),
+		dependencies:    dependencies,
+		proxyInitScript: proxyInitScript,
 	}
 }
 
@@ -136,7 +457,7 @@ func (ws *WorkerService) registerWithCoordinator() error {
 	log.Printf("Registering worker %s with coordinator", ws.config.ID)
 
 	// Connect to coordinator RPC server
-	client, err := rpc.Dial("tcp", fmt.Sprintf("%s:%d", ws.config.CoordinatorHost, ws.config.CoordinatorRPCPort))
+	client, err := ws.dialCoordinator()
 	if err != nil {
 		return fmt.Errorf("failed to connect to coordinator: %v", err)
 	}
@@ -144,25 +465,61 @@ func (ws *WorkerService) registerWithCoordinator() error {
 
 	// Prepare registration args
 	args := RegisterWorkerArgs{
-		ID:           ws.config.ID,
-		Host:         ws.config.ID, // Use worker ID as host for now
-		Port:         ws.config.RPCPort,
-		Capabilities: []string{"gradle", "java"},
-		Status:       "idle",
+		ID:              ws.config.ID,
+		Host:            ws.config.ID, // Use worker ID as host for now
+		Port:            ws.config.RPCPort,
+		Capabilities:    []string{"gradle", "java"},
+		Status:          "idle",
+		MaxBuilds:       ws.config.MaxConcurrentBuilds,
+		Version:         protocol.BuildVersion,
+		ProtocolVersion: protocol.Version,
+		Pool:            ws.config.Pool,
+		Calibration:     ws.calibrate(),
+		Spot:            ws.config.Spot,
+		Transport:       ws.config.Transport,
+		Devices:         ws.attachedDevices(),
+		Attestation:     ws.attest(),
 	}
 
 	var reply RegisterWorkerReply
 
 	// Call RegisterWorker RPC method
+	ws.chaos.DelayRPC("BuildCoordinator.RegisterWorker")
 	err = client.Call("BuildCoordinator.RegisterWorker", args, &reply)
 	if err != nil {
+		// A coordinator rejecting this version still serves the release to
+		// update to
+		if updateErr := ws.checkForUpdate(client); updateErr != nil {
+			log.Printf("Worker self-update failed: %v", updateErr)
+		}
 		return fmt.Errorf("RPC registration failed: %v", err)
 	}
 
 	log.Printf("Worker %s registered successfully: %s", ws.config.ID, reply.Message)
+	if err := ws.updateTo(client, reply.Update); err != nil {
+		log.Printf("Worker self-update failed: %v", err)
+	}
 	return nil
 }
 
+// calibrate benchmarks the worker on the first call and returns the scores,
+// or nil if calibration is disabled
+func (ws *WorkerService) calibrate() *calibration.Scores {
+	if !ws.config.Calibrate {
+		return nil
+	}
+	ws.calibrateOnce.Do(func() {
+		scores, err := calibration.Run(calibration.DefaultConfig(ws.config.BuildDir))
+		if err != nil {
+			log.Printf("Worker calibration incomplete: %v", err)
+		}
+		log.Printf("Worker calibrated: single core %.0f MB/s, %d cores %.0f MB/s, disk %.0f MB/s, JVM startup %v",
+			scores.CPUSingleCore, scores.Cores, scores.CPUMultiCore, scores.DiskWrite, scores.JVMStartup)
+		ws.calibration = &scores
+	})
+	return ws.calibration
+}
+
 // startRPCServer starts the RPC server
 func (ws *WorkerService) startRPCServer() error {
 	log.Printf("Starting RPC server on port %d", ws.config.RPCPort)
@@ -171,6 +528,13 @@ func (ws *WorkerService) startRPCServer() error {
 	rpcServer := rpc.NewServer()
 	rpcServer.Register(ws)
 
+	// Workers the coordinator cannot connect to poll its calls instead
+	if ws.config.Transport != TransportTCP {
+		log.Printf("Polling %s for calls", ws.config.CoordinatorURL)
+		go ws.pollCalls(rpcServer)
+		return nil
+	}
+
 	// Start listening
 	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", ws.config.RPCPort))
 	if err != nil {
@@ -183,8 +547,9 @@ func (ws *WorkerService) startRPCServer() error {
 	return nil
 }
 
-// startHTTPServer starts the HTTP server for metrics
-func (ws *WorkerService) startHTTPServer() error {
+// startHTTPServer starts the HTTP server for metrics, stopping the worker
+// started with ctx if it fails
+func (ws *WorkerService) startHTTPServer(ctx context.Context) {
 	log.Printf("Starting HTTP server on port %d", ws.config.HTTPPort)
 
 	mux := http.NewServeMux()
@@ -194,19 +559,19 @@ func (ws *WorkerService) startHTTPServer() error {
 		json.NewEncoder(w).Encode(map[string]string{"status": "healthy"})
 	})
 
+	// Fault injection, only when enabled for resilience testing
+	if ws.chaos != nil {
+		mux.HandleFunc("GET /api/chaos", ws.chaos.Handler(nil))
+		mux.HandleFunc("PUT /api/chaos", ws.chaos.Handler(nil))
+	}
+
 	ws.httpServer = &http.Server{
 		Addr:    fmt.Sprintf(":%d", ws.config.HTTPPort),
 		Handler: mux,
 	}
 
 	log.Printf("HTTP server listening on port %d", ws.config.HTTPPort)
-	go func() {
-		if err := ws.httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Printf("HTTP server error: %v", err)
-		}
-	}()
-
-	return nil
+	app.Go(ctx, ws.httpServer.ListenAndServe)
 }
 
 // Heartbeat sends periodic heartbeat to coordinator
@@ -214,44 +579,117 @@ func (ws *WorkerService) Heartbeat() {
 	ticker := time.NewTicker(30 * time.Second)
 	defer ticker.Stop()
 
-	for range ticker.C {
+	for {
+		select {
+		case <-ticker.C:
+		case <-ws.shutdown:
+			return
+		}
+
+		if ws.chaos.DropHeartbeat() {
+			log.Printf("Chaos: dropping heartbeat of worker %s", ws.config.ID)
+			continue
+		}
+
 		log.Printf("Worker %s sending heartbeat", ws.config.ID)
 
 		// Connect to coordinator RPC
-		client, err := rpc.Dial("tcp", fmt.Sprintf("%s:%d", ws.config.CoordinatorHost, ws.config.CoordinatorRPCPort))
+		client, err := ws.dialCoordinator()
 		if err != nil {
 			log.Printf("Failed to connect to coordinator for heartbeat: %v", err)
 			continue
 		}
 
-		// Send heartbeat
-		args := HeartbeatArgs{
-			ID:        ws.config.ID,
-			Status:    "idle",
-			Timestamp: time.Now(),
-		}
+		// Send heartbeat with current resource telemetry
+		args := ws.heartbeatArgs()
 
 		var reply HeartbeatReply
+		ws.chaos.DelayRPC("BuildCoordinator.Heartbeat")
 		err = client.Call("BuildCoordinator.Heartbeat", args, &reply)
 		client.Close()
 
 		if err != nil {
 			log.Printf("Heartbeat failed: %v", err)
+			// A restarted coordinator that could not reach this worker
+			// has forgotten it
+			if _, rejected := err.(rpc.ServerError); rejected && strings.Contains(err.Error(), "not found") {
+				if err := ws.registerWithCoordinator(); err != nil {
+					log.Printf("Re-registration failed: %v", err)
+				}
+			}
 		} else {
 			log.Printf("Heartbeat successful")
 		}
 	}
 }
 
+// Ping reports the worker's identity and load to a coordinator reconnecting
+// to its registered workers after a restart (RPC method)
+func (ws *WorkerService) Ping(args PingArgs, reply *PingReply) error {
+	log.Printf("Ping from coordinator %s", args.Coordinator)
+	*reply = PingReply{
+		ID:              ws.config.ID,
+		ActiveBuilds:    int(atomic.LoadInt32(&ws.activeBuilds)),
+		MaxBuilds:       ws.config.MaxConcurrentBuilds,
+		Version:         protocol.BuildVersion,
+		ProtocolVersion: protocol.Version,
+		Pool:            ws.config.Pool,
+	}
+	return nil
+}
+
+// heartbeatArgs builds a heartbeat carrying the worker's resource telemetry
+func (ws *WorkerService) heartbeatArgs() HeartbeatArgs {
+	activeBuilds := int(atomic.LoadInt32(&ws.activeBuilds))
+	telemetry := ws.telemetry.Collect(activeBuilds)
+
+	status := "idle"
+	if activeBuilds >= ws.config.MaxConcurrentBuilds {
+		status = "busy"
+	}
+
+	return HeartbeatArgs{
+		ID:                   ws.config.ID,
+		Status:               status,
+		Timestamp:            telemetry.CollectedAt,
+		CPUUsage:             telemetry.CPUUsage,
+		MemoryUsage:          telemetry.MemoryUsage,
+		DiskUsage:            telemetry.DiskUsage,
+		LoadAverage:          telemetry.LoadAverage,
+		ActiveBuilds:         telemetry.ActiveBuilds,
+		Devices:              ws.attachedDevices(),
+		TelemetryUnavailable: telemetry.Unavailable,
+	}
+}
+
 // Build executes a build request (RPC method)
 func (ws *WorkerService) Build(request BuildRequest, response *string) error {
-	log.Printf("Received build request %s for project %s", request.RequestID, request.ProjectPath)
+	log.Printf("Received build request %s for project %s request_id=%s", request.RequestID, request.ProjectPath, request.CorrelationID)
+
+	// Reject builds beyond the configured concurrency instead of queueing them here;
+	// the coordinator tracks free slots and will retry elsewhere
+	select {
+	case ws.buildSlots <- struct{}{}:
+		defer func() { <-ws.buildSlots }()
+	default:
+		return protocol.NewBuildError(protocol.ErrorInfra, "worker %s is running the maximum of %d concurrent builds", ws.config.ID, ws.config.MaxConcurrentBuilds)
+	}
+
+	atomic.AddInt32(&ws.activeBuilds, 1)
+	defer atomic.AddInt32(&ws.activeBuilds, -1)
+	metrics.WorkerBuildsStarted.Inc()
 
 	// Execute the build
+	started := time.Now()
 	err := ws.executeBuild(request)
+	recordBuild(started, err)
 	if err != nil {
-		log.Printf("Build %s failed: %v", request.RequestID, err)
-		return err
+		// The class of the failure travels with its message, anything not
+		// classified failing for the worker rather than the project
+		failure := protocol.ClassifyError(protocol.ErrorInfra, err)
+		failure = &protocol.BuildError{Code: failure.Code, Message: request.mask(failure.Message)}
+		log.Printf("Build %s failed request_id=%s: %v", request.RequestID, request.CorrelationID, failure)
+		return failure
 	}
 
 	*response = fmt.Sprintf("Build request %s completed successfully", request.RequestID)
@@ -262,24 +700,556 @@ func (ws *WorkerService) Build(request BuildRequest, response *string) error {
 func (ws *WorkerService) executeBuild(request BuildRequest) error {
 	log.Printf("Executing build %s in %s", request.RequestID, request.ProjectPath)
 
-	// Change to project directory
-	if err := os.Chdir(request.ProjectPath); err != nil {
-		return fmt.Errorf("failed to change to project directory: %v", err)
+	var commit string
+	if request.RepoURL != "" {
+		// Builds of a repository run in a checkout of their own
+		checkout, projectPath, checkedOut, err := ws.checkout(request)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := ws.checkouts.Remove(request.RepoURL, checkout); err != nil {
+				log.Printf("Failed to remove checkout of build %s: %v", request.RequestID, err)
+			}
+		}()
+		request.ProjectPath, commit = projectPath, checkedOut
+	} else if request.Upload != nil {
+		// Uploaded projects are unpacked into a directory of their own
+		dir, projectPath, err := ws.unpackUpload(request)
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		request.ProjectPath = projectPath
+	} else {
+		// Builds run concurrently, so each command gets its own working
+		// directory rather than changing the process-wide one
+		if info, err := os.Stat(request.ProjectPath); err != nil || !info.IsDir() {
+			return protocol.NewBuildError(protocol.ErrorCompile, "invalid project directory: %s", request.ProjectPath)
+		}
+
+		// Check the request again where symlinks in the project path can be
+		// resolved
+		projectPath, err := ws.buildPolicy.ResolveProjectPath(request.ProjectPath)
+		if err != nil {
+			return protocol.NewBuildError(protocol.ErrorCompile, "invalid project path: %v", err)
+		}
+		request.ProjectPath = projectPath
+	}
+
+	// Never pass Gradle a task it could take for an option
+	if err := ws.buildPolicy.ValidateTaskName(request.TaskName); err != nil {
+		return protocol.NewBuildError(protocol.ErrorCompile, "invalid task name: %v", err)
+	}
+
+	// Fail fast if the wrapper or requested Gradle version is unavailable
+	executable, err := ws.gradle.Executable(request.ProjectPath, request.GradleVersion)
+	if err != nil {
+		return err
+	}
+
+	invocation, err := buildopts.Parse(request.BuildOptions)
+	if err != nil {
+		return protocol.NewBuildError(protocol.ErrorCompile, "invalid build options: %v", err)
+	}
+
+	// A replayed build runs with the environment variables of the build it
+	// replays, and only on a worker with the same toolchain and platform
+	env := append(os.Environ(), invocation.Env...)
+	if request.Environment != nil {
+		env = request.Environment.Environ(env)
+	}
+	environment := ws.snapshot(executable, request, commit, env)
+	if request.Environment != nil {
+		if drift := environment.Drift(*request.Environment); len(drift) > 0 {
+			return fmt.Errorf("environment differs from the pinned one: %s", strings.Join(drift, ", "))
+		}
 	}
 
-	// Execute gradle build
-	cmd := exec.Command("gradle", request.TaskName)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	// Secrets are only passed to Gradle through its environment, and masked
+	// in everything the build prints. They take precedence over the
+	// variables of the build options.
+	env = append(env, secrets.Environ(request.SecretEnv)...)
+	mask := request.mask
 
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("gradle build failed: %v", err)
+	// Instrumentation tests only see the devices locked to the build
+	if request.Devices != nil {
+		allocated, err := ws.acquireDevices(request)
+		if err != nil {
+			return err
+		}
+		defer ws.deviceLocks.Release(request.RequestID)
+		env = append(env, devices.Environ(allocated)...)
 	}
 
-	log.Printf("Build %s completed successfully", request.RequestID)
+	// The size of the build cache is measured in the worker's Gradle user
+	// home, which the build's own links to
+	cacheDir := buildCacheDir(env)
+	env, releaseDependencies, err := ws.dependencies.acquire(env)
+	if err != nil {
+		return err
+	}
+	succeeded := false
+	defer func() { releaseDependencies(succeeded) }()
+
+	// Gradle runs with plain console output so task transitions can be parsed
+	args := append([]string{request.TaskName, "--console=plain"}, invocation.Args...)
+	if ws.proxyInitScript != "" {
+		args = append(args, "--init-script", ws.proxyInitScript)
+	}
+	if request.Shard != nil {
+		script, err := writeShardInitScript(request.ProjectPath, *request.Shard)
+		if err != nil {
+			return fmt.Errorf("failed to shard tests: %v", err)
+		}
+		if script == "" {
+			log.Printf("Build %s has no test classes in shard %d of %d", request.RequestID, request.Shard.Index+1, request.Shard.Count)
+			return nil
+		}
+		defer os.Remove(script)
+		args = append(args, "--init-script", script)
+	}
+
+	reporter := ws.newProgressReporter(request.RequestID, countBuildTasks(executable, request.ProjectPath, args, env))
+	defer reporter.close()
+	reporter.commandLine = mask(buildopts.CommandLine(invocation.Env, append([]string{executable}, args...)))
+	reporter.environment = &environment
+
+	if err := reporter.downloadInputs(request.ProjectPath, request.Inputs); err != nil {
+		reporter.report(0, "failed", err.Error())
+		return err
+	}
+
+	// Hooks run with the build's environment and secrets. Post-build hooks
+	// that always run do so however the build ends.
+	var buildHooks hooks.Hooks
+	if request.Hooks != nil {
+		buildHooks = *request.Hooks
+	}
+	if err := reporter.runHooks(hooks.PhasePre, buildHooks.Pre, request.ProjectPath, env, mask, false); err != nil {
+		reporter.runHooks(hooks.PhasePost, buildHooks.Post, request.ProjectPath, env, mask, true)
+		reporter.report(0, "failed", err.Error())
+		return err
+	}
+	postHooksRun := false
+	defer func() {
+		if !postHooksRun {
+			reporter.runHooks(hooks.PhasePost, buildHooks.Post, request.ProjectPath, env, mask, true)
+		}
+	}()
+
+	cmd := exec.Command(executable, args...)
+	cmd.Dir = request.ProjectPath
+	cmd.Env = env
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("failed to capture build output: %v", err)
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return fmt.Errorf("failed to capture build output: %v", err)
+	}
+
+	// Test reports older than the build are left over from earlier builds.
+	// File systems may store modification times in whole seconds.
+	testsSince := time.Now().Truncate(time.Second)
+	cacheBefore := directorySize(cacheDir)
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start gradle build: %v", err)
+	}
+	sampler := startResourceSampler(cmd.Process.Pid, ws.config.ResourceSampleInterval)
+
+	started := ""
+	if commit != "" {
+		started = fmt.Sprintf("building %s at %s", request.RepoURL, commit)
+	}
+	// Gradle's output tells why a build failed
+	var classifier failureClassifier
+	cancelled := false
+	if reporter.report(0, "started", started) {
+		cancelled = true
+		cmd.Process.Kill()
+	}
+
+	// Builds running past the worker's time limit are killed
+	var timedOut atomic.Bool
+	if ws.config.BuildTimeout > 0 {
+		timer := time.AfterFunc(ws.config.BuildTimeout, func() {
+			timedOut.Store(true)
+			cmd.Process.Kill()
+		})
+		defer timer.Stop()
+	}
+
+	var stderrDone sync.WaitGroup
+	stderrDone.Add(1)
+	go func() {
+		defer stderrDone.Done()
+		lines := bufio.NewScanner(stderr)
+		for lines.Scan() {
+			line := mask(lines.Text())
+			fmt.Fprintln(os.Stderr, line)
+			reporter.log(line)
+			classifier.observe(line)
+		}
+	}()
+
+	killed := false
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		line := mask(scanner.Text())
+		fmt.Println(line)
+		reporter.log(line)
+		classifier.observe(line)
+		if task, key, ok := buildenv.ParseCacheKey(line); ok {
+			environment.CacheKeys[task] = key
+			continue
+		}
+
+		if !strings.HasPrefix(line, "> Task ") || cancelled || killed {
+			continue
+		}
+
+		if ws.chaos.KillBuild() {
+			log.Printf("Chaos: killing build %s", request.RequestID)
+			killed = true
+			cmd.Process.Kill()
+			continue
+		}
+
+		if reporter.taskStarted(strings.TrimPrefix(line, "> Task ")) {
+			log.Printf("Build %s cancelled by coordinator, stopping gradle", request.RequestID)
+			cancelled = true
+			cmd.Process.Kill()
+		}
+	}
+
+	stderrDone.Wait()
+	usage := sampler.stop()
+	err = cmd.Wait()
+	if usage != nil {
+		usage.CacheStorage = max(directorySize(cacheDir)-cacheBefore, 0)
+	}
+	if cancelled {
+		return protocol.NewBuildError(protocol.ErrorCancelled, "build %s cancelled by coordinator", request.RequestID)
+	}
+	if timedOut.Load() {
+		reporter.report(reporter.percent(), "failed", fmt.Sprintf("timed out after %v", ws.config.BuildTimeout))
+		return protocol.NewBuildError(protocol.ErrorTimeout, "build %s timed out after %v", request.RequestID, ws.config.BuildTimeout)
+	}
+	if killed {
+		reporter.report(reporter.percent(), "failed", "killed by chaos injection")
+		return protocol.NewBuildError(protocol.ErrorInfra, "build %s killed by chaos injection", request.RequestID)
+	}
+
+	// Failed tests fail the build, so their results are reported either way
+	classes, testsErr := testshard.ReadResults(request.ProjectPath, testsSince)
+	if testsErr != nil {
+		log.Printf("Failed to read test results of build %s: %v", request.RequestID, testsErr)
+	} else {
+		reporter.reportTestResults(classes, commit)
+	}
+	// Outputs were asked for, so they are uploaded whatever the worker's
+	// configuration, and for failed builds too, as their reports tell why
+	if len(request.Outputs) > 0 {
+		if _, err := reporter.uploadArtifacts(request.ProjectPath, findOutputs(request.ProjectPath, request.Outputs)); err != nil {
+			log.Printf("Failed to upload outputs of build %s: %v", request.RequestID, err)
+		}
+	}
+	if err != nil {
+		reporter.report(reporter.percent(), "failed", err.Error())
+		return protocol.NewBuildError(classifier.classify(err, classes), "gradle build failed: %v", err)
+	}
+
+	// Post-build hooks may sign or otherwise change the artifacts
+	postHooksRun = true
+	if err := reporter.runHooks(hooks.PhasePost, buildHooks.Post, request.ProjectPath, env, mask, false); err != nil {
+		reporter.report(reporter.percent(), "failed", err.Error())
+		return err
+	}
+
+	paths := findArtifacts(request.ProjectPath)
+	artifacts, err := provenance.DescribeArtifacts(paths, ws.config.ID, ws.toolchain(executable, request.ProjectPath))
+	if err != nil {
+		log.Printf("Failed to describe artifacts of build %s: %v", request.RequestID, err)
+	}
+	if ws.config.UploadArtifacts {
+		if _, err := reporter.uploadArtifacts(request.ProjectPath, paths); err != nil {
+			log.Printf("Failed to upload artifacts of build %s: %v", request.RequestID, err)
+		}
+	}
+	reporter.reportArtifacts(artifacts, usage)
+
+	reporter.report(100, "completed", "")
+	log.Printf("Build %s completed successfully request_id=%s", request.RequestID, request.CorrelationID)
+	succeeded = true
 	return nil
 }
 
+// checkout checks out the repository of a build into the build directory and
+// returns the checkout, the project directory in it and the commit built
+func (ws *WorkerService) checkout(request BuildRequest) (string, string, string, error) {
+	if err := gitsource.ValidateSource(request.RepoURL, request.Ref); err != nil {
+		return "", "", "", err
+	}
+
+	parent := filepath.Join(ws.config.BuildDir, "checkouts")
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return "", "", "", fmt.Errorf("failed to create checkout directory: %v", err)
+	}
+	checkout, err := os.MkdirTemp(parent, "build-")
+	if err != nil {
+		return "", "", "", fmt.Errorf("failed to create checkout directory: %v", err)
+	}
+
+	source := gitsource.Source{RepoURL: request.RepoURL, Ref: request.Ref, Credentials: request.GitCredentials}
+	commit, err := ws.checkouts.Checkout(source, checkout)
+	if err != nil {
+		os.RemoveAll(checkout)
+		return "", "", "", err
+	}
+	log.Printf("Checked out %s at %s for build %s", request.RepoURL, commit, request.RequestID)
+
+	projectPath, err := gitsource.ProjectDir(checkout, request.ProjectPath)
+	if err != nil {
+		ws.checkouts.Remove(request.RepoURL, checkout)
+		return "", "", "", fmt.Errorf("invalid project path: %v", err)
+	}
+	return checkout, projectPath, commit, nil
+}
+
+// toolchain returns the Gradle and JDK versions of a Gradle executable,
+// running it only the first time
+func (ws *WorkerService) toolchain(executable, projectPath string) provenance.Toolchain {
+	if cached, ok := ws.toolchains.Load(executable); ok {
+		return cached.(provenance.Toolchain)
+	}
+
+	toolchain := provenance.DetectToolchain(executable, projectPath)
+	ws.toolchains.Store(executable, toolchain)
+	return toolchain
+}
+
+// snapshot records the environment a build runs in on this worker: its
+// labels, toolchain and the variables of env other than secrets
+func (ws *WorkerService) snapshot(executable string, request BuildRequest, commit string, env []string) buildenv.Snapshot {
+	toolchain := ws.toolchain(executable, request.ProjectPath)
+	labels := map[string]string{
+		buildenv.LabelPool: ws.config.Pool,
+		buildenv.LabelType: ws.config.WorkerType,
+		buildenv.LabelOS:   runtime.GOOS,
+		buildenv.LabelArch: runtime.GOARCH,
+	}
+	if ws.config.Spot {
+		labels[buildenv.LabelSpot] = "true"
+	}
+
+	return buildenv.Snapshot{
+		WorkerID:      ws.config.ID,
+		WorkerVersion: protocol.BuildVersion,
+		Labels:        labels,
+		GradleVersion: toolchain.GradleVersion,
+		JDKVersion:    toolchain.JDKVersion,
+		Commit:        commit,
+		Env:           buildenv.Environment(env, request.SecretEnv),
+		CacheKeys:     make(map[string]string),
+	}
+}
+
+// findArtifacts finds build artifacts in the project directory
+func findArtifacts(projectPath string) []string {
+	var artifacts []string
+
+	// Look for common Gradle output directories
+	outputDirs := []string{
+		filepath.Join(projectPath, "build/libs"),
+		filepath.Join(projectPath, "build/distributions"),
+		filepath.Join(projectPath, "build/outputs/aar"),
+	}
+
+	for _, dir := range outputDirs {
+		if _, err := os.Stat(dir); err == nil {
+			filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+				if err == nil && !info.IsDir() {
+					artifacts = append(artifacts, path)
+				}
+				return nil
+			})
+		}
+	}
+
+	return artifacts
+}
+
+// countBuildTasks counts the tasks a build will run using a Gradle dry run
+// with the build's arguments. It returns 0 when the task graph cannot be
+// determined.
+func countBuildTasks(executable, projectPath string, args, env []string) int {
+	cmd := exec.Command(executable, append([]string{"--dry-run"}, args...)...)
+	cmd.Dir = projectPath
+	cmd.Env = env
+
+	output, err := cmd.Output()
+	if err != nil {
+		return 0
+	}
+
+	return countDryRunTasks(string(output))
+}
+
+// countDryRunTasks counts the tasks listed by "gradle --dry-run", which
+// prints every task of the graph as ":project:task SKIPPED"
+func countDryRunTasks(output string) int {
+	count := 0
+	for _, line := range strings.Split(output, "\n") {
+		if strings.HasPrefix(line, ":") && strings.HasSuffix(strings.TrimSpace(line), "SKIPPED") {
+			count++
+		}
+	}
+
+	return count
+}
+
+// newProgressReporter connects to the coordinator to stream progress for a build.
+// Progress reporting is best effort; builds run even if the coordinator is unreachable.
+func (ws *WorkerService) newProgressReporter(buildID string, totalTasks int) *progressReporter {
+	reporter := &progressReporter{
+		chaos:      ws.chaos,
+		workerID:   ws.config.ID,
+		buildID:    buildID,
+		totalTasks: totalTasks,
+	}
+
+	client, err := ws.dialCoordinator()
+	if err != nil {
+		log.Printf("Failed to connect to coordinator for progress reporting: %v", err)
+		return reporter
+	}
+
+	reporter.client = client
+	reporter.startLogs()
+	return reporter
+}
+
+// taskStarted records a task transition and reports whether the build was cancelled.
+// The previous task has finished once Gradle moves on to the next one.
+func (pr *progressReporter) taskStarted(task string) bool {
+	if pr.currentTask != "" {
+		pr.doneTasks++
+	}
+
+	task, outcome, _ := strings.Cut(task, " ")
+	switch outcome {
+	case "FROM-CACHE":
+		pr.cachedTasks++
+	case "":
+		pr.runTasks++
+	}
+
+	pr.currentTask = task
+	return pr.send(ReportProgressArgs{Progress: pr.percent(), Step: task, Outcome: outcome})
+}
+
+// cacheHitRate returns the fraction of executed tasks whose outputs were taken
+// from the build cache. Gradle prints the outcome next to the task name when
+// it is known up front; tasks without one actually ran. Up-to-date and
+// skipped tasks never consult the cache and are not counted.
+func (pr *progressReporter) cacheHitRate() float64 {
+	if pr.cachedTasks+pr.runTasks == 0 {
+		return 0
+	}
+	return float64(pr.cachedTasks) / float64(pr.cachedTasks+pr.runTasks)
+}
+
+// percent estimates build progress from completed tasks
+func (pr *progressReporter) percent() float64 {
+	if pr.totalTasks == 0 {
+		return 0
+	}
+	// Never report completion before the build process has exited
+	return math.Min(99, float64(pr.doneTasks)*100/float64(pr.totalTasks))
+}
+
+// report sends progress to the coordinator and reports whether the build was cancelled
+func (pr *progressReporter) report(progress float64, step, message string) bool {
+	return pr.send(ReportProgressArgs{Progress: progress, Step: step, Message: message})
+}
+
+// send reports the progress of args, stamped with the build and worker, and
+// reports whether the build was cancelled
+func (pr *progressReporter) send(args ReportProgressArgs) bool {
+	if pr.client == nil {
+		return false
+	}
+
+	args.BuildID = pr.buildID
+	args.WorkerID = pr.workerID
+	args.Timestamp = time.Now()
+	switch args.Step {
+	case "started":
+		args.CommandLine = pr.commandLine
+		args.Environment = pr.environment
+	case "completed", "failed":
+		args.Environment = pr.environment
+	}
+
+	var reply ReportProgressReply
+	pr.chaos.DelayRPC("BuildCoordinator.ReportProgress")
+	if err := pr.client.Call("BuildCoordinator.ReportProgress", args, &reply); err != nil {
+		log.Printf("Failed to report progress for build %s: %v", pr.buildID, err)
+		return false
+	}
+
+	return reply.Cancelled
+}
+
+// reportArtifacts sends the checksummed artifacts of the build, its cache
+// hit rate and its resource usage, if sampled, to the coordinator
+func (pr *progressReporter) reportArtifacts(artifacts []types.Artifact, usage *ResourceMetrics) {
+	if pr.client == nil {
+		return
+	}
+
+	args := ReportArtifactsArgs{
+		BuildID:       pr.buildID,
+		WorkerID:      pr.workerID,
+		Artifacts:     artifacts,
+		CacheHitRate:  pr.cacheHitRate(),
+		ResourceUsage: usage,
+	}
+
+	var reply ReportArtifactsReply
+	pr.chaos.DelayRPC("BuildCoordinator.ReportArtifacts")
+	if err := pr.client.Call("BuildCoordinator.ReportArtifacts", args, &reply); err != nil {
+		log.Printf("Failed to report artifacts for build %s: %v", pr.buildID, err)
+	}
+}
+
+// reportTestResults sends the JUnit results of the test classes the build
+// ran on a commit to the coordinator
+func (pr *progressReporter) reportTestResults(classes []testshard.ClassResult, commit string) {
+	if pr.client == nil || len(classes) == 0 {
+		return
+	}
+
+	args := ReportTestResultsArgs{BuildID: pr.buildID, WorkerID: pr.workerID, Classes: classes, Commit: commit}
+	var reply ReportTestResultsReply
+	pr.chaos.DelayRPC("BuildCoordinator.ReportTestResults")
+	if err := pr.client.Call("BuildCoordinator.ReportTestResults", args, &reply); err != nil {
+		log.Printf("Failed to report test results for build %s: %v", pr.buildID, err)
+	}
+}
+
+// close sends the remaining build output and releases the coordinator
+// connection
+func (pr *progressReporter) close() {
+	pr.stopLogs()
+	if pr.client != nil {
+		pr.client.Close()
+	}
+}
+
 // Shutdown gracefully shuts down the worker service
 func (ws *WorkerService) Shutdown() error {
 	close(ws.shutdown)
@@ -293,56 +1263,99 @@ func (ws *WorkerService) Shutdown() error {
 	return nil
 }
 
-// Main worker application entry point
-func workerMain() {
-	// Load configuration
-	configFile := "worker_config.json"
-	if len(os.Args) > 1 {
-		configFile = os.Args[1]
-	}
-
-	config, err := loadWorkerConfig(configFile)
-	if err != nil {
-		log.Fatalf("Failed to load worker config: %v", err)
-	}
+// workerProcess runs a worker as an app.Service
+type workerProcess struct {
+	service *WorkerService
+}
 
-	// Create worker service
-	service := NewWorkerService(config)
+func (p *workerProcess) Name() string {
+	return "worker"
+}
 
-	// Register with coordinator
-	err = service.registerWithCoordinator()
+// Init loads the configuration of the worker from the file named by the
+// first argument
+func (p *workerProcess) Init(ctx context.Context) error {
+	config, err := loadWorkerConfig(app.ConfigFile("worker_config.json"))
 	if err != nil {
-		log.Fatalf("Failed to register with coordinator: %v", err)
+		return fmt.Errorf("failed to load worker config: %v", err)
 	}
+	p.service = NewWorkerService(config)
+	return nil
+}
 
-	// Start RPC server
-	err = service.startRPCServer()
-	if err != nil {
-		log.Fatalf("Failed to start RPC server: %v", err)
+func (p *workerProcess) Collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		workerCollector{p.service},
+		metrics.WorkerBuildsStarted,
+		metrics.WorkerBuildsFinished,
+		metrics.WorkerBuildDurations,
+		metrics.WorkerCacheTransferBytes,
 	}
+}
 
-	// Start HTTP server for metrics
-	err = service.startHTTPServer()
-	if err != nil {
-		log.Fatalf("Failed to start HTTP server: %v", err)
+// Start registers the worker with the coordinator and starts its servers.
+// Spot workers stop once the termination notice of their instance is
+// posted.
+func (p *workerProcess) Start(ctx context.Context) error {
+	service := p.service
+	if err := service.registerWithCoordinator(); err != nil {
+		return fmt.Errorf("failed to register with coordinator: %v", err)
+	}
+	if err := service.startRPCServer(); err != nil {
+		return fmt.Errorf("failed to start RPC server: %v", err)
 	}
+	service.startHTTPServer(ctx)
 
-	log.Printf("Worker %s started successfully", config.ID)
+	// Report status and resource telemetry to the coordinator
+	go service.Heartbeat()
 
-	// Setup graceful shutdown
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	if service.updater.enabled {
+		go service.watchForUpdates()
+	}
 
-	// Wait for shutdown signal
-	sig := <-sigChan
-	log.Printf("Received signal %v, shutting down...", sig)
+	if service.config.Spot && service.config.PreemptionNoticeURL != "" && service.config.PreemptionPollInterval > 0 {
+		notices := make(chan string, 1)
+		go service.watchForPreemption(notices)
+		go func() {
+			select {
+			case notice := <-notices:
+				log.Printf("Instance of worker %s is being preempted", service.config.ID)
+				app.Stop(ctx, notice)
+			case <-ctx.Done():
+			}
+		}()
+	}
+	return nil
+}
+
+// Stop shuts the worker down and reports its preemption. Preemptible
+// instances are also sent SIGTERM before they are terminated.
+func (p *workerProcess) Stop(ctx context.Context, cause error) error {
+	service := p.service
+	preemption := ""
+	var stopped app.Stopped
+	var interrupted app.Interrupted
+	switch {
+	case errors.As(cause, &stopped):
+		preemption = stopped.Reason
+	case errors.As(cause, &interrupted) && service.config.Spot && interrupted.Signal == syscall.SIGTERM:
+		preemption = PreemptionSIGTERM
+	}
 
-	// Graceful shutdown
-	if err := service.Shutdown(); err != nil {
-		log.Printf("Error during shutdown: %v", err)
+	err := service.Shutdown()
+	// Heartbeats stopped with the shutdown, so the worker does not register
+	// again once the coordinator removed it
+	if preemption != "" {
+		if err := service.reportPreemption(preemption); err != nil {
+			log.Printf("Failed to report preemption: %v", err)
+		}
 	}
+	return err
+}
 
-	log.Printf("Worker %s shutdown complete", config.ID)
+// Main worker application entry point
+func workerMain() {
+	app.Main(&workerProcess{})
 }
 
 // Main function for worker
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"distributed-gradle-building/chaos"
+	"distributed-gradle-building/gradledist"
+	"distributed-gradle-building/validation"
+)
+
+func TestBuildRejectedAtCapacity(t *testing.T) {
+	service := NewWorkerService(&WorkerConfig{ID: "worker-1", BuildDir: t.TempDir(), MaxConcurrentBuilds: 2})
+
+	// Occupy every slot
+	service.buildSlots <- struct{}{}
+	service.buildSlots <- struct{}{}
+
+	var response string
+	err := service.Build(BuildRequest{RequestID: "build-1", ProjectPath: t.TempDir()}, &response)
+	if err == nil || !strings.Contains(err.Error(), "maximum of 2 concurrent builds") {
+		t.Errorf("Expected capacity error, got %v", err)
+	}
+
+	// Freeing a slot lets the next build through to execution
+	<-service.buildSlots
+	err = service.Build(BuildRequest{RequestID: "build-2", ProjectPath: "/non-existent"}, &response)
+	if err == nil || !strings.Contains(err.Error(), "invalid project directory") {
+		t.Errorf("Expected project directory error, got %v", err)
+	}
+	if len(service.buildSlots) != 1 {
+		t.Errorf("Expected finished build to release its slot, got %d slots in use", len(service.buildSlots))
+	}
+}
+
+func TestPingReportsLoad(t *testing.T) {
+	service := NewWorkerService(&WorkerConfig{ID: "worker-1", BuildDir: t.TempDir(), MaxConcurrentBuilds: 2, Pool: "android"})
+	service.activeBuilds = 1
+
+	var reply PingReply
+	if err := service.Ping(PingArgs{Coordinator: "coordinator"}, &reply); err != nil {
+		t.Fatalf("Ping failed: %v", err)
+	}
+	if reply.ID != "worker-1" || reply.ActiveBuilds != 1 || reply.MaxBuilds != 2 || reply.Pool != "android" || reply.ProtocolVersion == 0 {
+		t.Errorf("Unexpected ping reply %+v", reply)
+	}
+}
+
+func TestProgressFromTaskOutput(t *testing.T) {
+	dryRun := "> Configure project :app\n:app:compileJava SKIPPED\n:app:processResources SKIPPED\n:app:classes SKIPPED\n:app:jar SKIPPED\n\nBUILD SUCCESSFUL in 1s\n"
+	total := countDryRunTasks(dryRun)
+	if total != 4 {
+		t.Fatalf("Expected 4 tasks in dry run, got %d", total)
+	}
+
+	reporter := &progressReporter{buildID: "build-1", totalTasks: total}
+	expected := []float64{0, 25, 50, 75}
+	for i, task := range []string{":app:compileJava", ":app:processResources", ":app:classes", ":app:jar"} {
+		reporter.taskStarted(task)
+		if percent := reporter.percent(); percent != expected[i] {
+			t.Errorf("After starting %s expected %.0f%%, got %.0f%%", task, expected[i], percent)
+		}
+	}
+
+	// Unknown task graphs report no estimate rather than a wrong one
+	if percent := (&progressReporter{}).percent(); percent != 0 {
+		t.Errorf("Expected 0%% without a task count, got %.0f%%", percent)
+	}
+}
+
+func TestCacheHitRateFromTaskOutput(t *testing.T) {
+	reporter := &progressReporter{buildID: "build-1"}
+	for _, task := range []string{":app:compileJava FROM-CACHE", ":app:processResources NO-SOURCE", ":app:classes UP-TO-DATE", ":app:jar", ":app:test FROM-CACHE", ":app:check"} {
+		reporter.taskStarted(task)
+	}
+
+	if reporter.currentTask != ":app:check" {
+		t.Errorf("Expected task name without outcome, got %q", reporter.currentTask)
+	}
+	if rate := reporter.cacheHitRate(); rate != 0.5 {
+		t.Errorf("Expected cache hit rate 0.5, got %v", rate)
+	}
+	if rate := (&progressReporter{}).cacheHitRate(); rate != 0 {
+		t.Errorf("Expected cache hit rate 0 without tasks, got %v", rate)
+	}
+}
+
+func TestFindArtifacts(t *testing.T) {
+	projectPath := t.TempDir()
+	for _, artifact := range []string{"build/libs/app.jar", "build/distributions/app.zip", "build/outputs/aar/app-release.aar", "build/tmp/scratch.txt"} {
+		path := filepath.Join(projectPath, artifact)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		os.WriteFile(path, []byte(artifact), 0644)
+	}
+
+	artifacts := findArtifacts(projectPath)
+	expected := []string{
+		filepath.Join(projectPath, "build/libs/app.jar"),
+		filepath.Join(projectPath, "build/distributions/app.zip"),
+		filepath.Join(projectPath, "build/outputs/aar/app-release.aar"),
+	}
+	if len(artifacts) != len(expected) {
+		t.Fatalf("Expected artifacts %v, got %v", expected, artifacts)
+	}
+	for i := range expected {
+		if artifacts[i] != expected[i] {
+			t.Errorf("Expected artifact %s, got %s", expected[i], artifacts[i])
+		}
+	}
+}
+
+func TestBuildFailsFastForUnavailableGradleVersion(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+
+	service := NewWorkerService(&WorkerConfig{ID: "worker-1", BuildDir: t.TempDir(), MaxConcurrentBuilds: 1})
+	service.gradle = gradledist.NewProvisioner(t.TempDir())
+	service.gradle.DistributionURL = server.URL
+
+	var response string
+	err := service.Build(BuildRequest{RequestID: "build-1", ProjectPath: t.TempDir(), TaskName: "build", GradleVersion: "8.5"}, &response)
+	if err == nil || !strings.Contains(err.Error(), "gradle 8.5 could not be provisioned") {
+		t.Errorf("Expected provisioning error, got %v", err)
+	}
+}
+
+func TestBuildRejectsProjectOutsideRoots(t *testing.T) {
+	root := t.TempDir()
+	if err := os.Symlink(t.TempDir(), filepath.Join(root, "escape")); err != nil {
+		t.Skipf("Symlinks unavailable: %v", err)
+	}
+
+	service := NewWorkerService(&WorkerConfig{ID: "worker-1", BuildDir: t.TempDir(), MaxConcurrentBuilds: 1})
+	service.buildPolicy = validation.BuildPolicy{ProjectRoots: []string{root}}
+
+	var response string
+	err := service.Build(BuildRequest{RequestID: "build-1", ProjectPath: filepath.Join(root, "escape"), TaskName: "build"}, &response)
+	if err == nil || !strings.Contains(err.Error(), "outside the allowed project roots") {
+		t.Errorf("Expected project path error, got %v", err)
+	}
+}
+
+func TestBuildKilledByChaos(t *testing.T) {
+	project := t.TempDir()
+	wrapper := "#!/bin/sh\necho '> Task :compileJava'\necho '> Task :jar'\n"
+	if err := os.WriteFile(filepath.Join(project, "gradlew"), []byte(wrapper), 0755); err != nil {
+		t.Fatalf("Failed to write wrapper: %v", err)
+	}
+
+	service := NewWorkerService(&WorkerConfig{ID: "worker-1", BuildDir: t.TempDir(), MaxConcurrentBuilds: 1})
+
+	var response string
+	if err := service.Build(BuildRequest{RequestID: "build-1", ProjectPath: project, TaskName: "build"}, &response); err != nil {
+		t.Fatalf("Expected build to succeed without chaos, got %v", err)
+	}
+
+	service.chaos, _ = chaos.NewInjector(chaos.Config{BuildKillRate: 1})
+	err := service.Build(BuildRequest{RequestID: "build-2", ProjectPath: project, TaskName: "build"}, &response)
+	if err == nil || !strings.Contains(err.Error(), "killed by chaos injection") {
+		t.Errorf("Expected build to be killed, got %v", err)
+	}
+}
+
+func TestBuildReceivesSecrets(t *testing.T) {
+	project := t.TempDir()
+	// The wrapper is also run without secrets to detect the toolchain
+	wrapper := "#!/bin/sh\n[ -n \"$SIGNING_KEY\" ] && printf '%s' \"$SIGNING_KEY\" > secret.txt\nexit 0\n"
+	if err := os.WriteFile(filepath.Join(project, "gradlew"), []byte(wrapper), 0755); err != nil {
+		t.Fatalf("Failed to write wrapper: %v", err)
+	}
+
+	service := NewWorkerService(&WorkerConfig{ID: "worker-1", BuildDir: t.TempDir(), MaxConcurrentBuilds: 1})
+
+	var response string
+	request := BuildRequest{RequestID: "build-1", ProjectPath: project, TaskName: "build", SecretEnv: map[string]string{"SIGNING_KEY": "s3cr3t-key"}}
+	if err := service.Build(request, &response); err != nil {
+		t.Fatalf("Build failed: %v", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(project, "secret.txt"))
+	if err != nil || string(data) != "s3cr3t-key" {
+		t.Errorf("Expected the build environment to contain the secret, got %q, %v", data, err)
+	}
+}
+
+func TestBuildAppliesOptions(t *testing.T) {
+	project := t.TempDir()
+	// Only the build itself is recorded, not the dry run or version check
+	wrapper := "#!/bin/sh\n[ \"$1\" = build ] || exit 0\necho \"$@\" > args.txt\necho \"$CI $SIGNING_KEY\" > env.txt\n"
+	if err := os.WriteFile(filepath.Join(project, "gradlew"), []byte(wrapper), 0755); err != nil {
+		t.Fatalf("Failed to write wrapper: %v", err)
+	}
+
+	service := NewWorkerService(&WorkerConfig{ID: "worker-1", BuildDir: t.TempDir(), MaxConcurrentBuilds: 1})
+
+	var response string
+	request := BuildRequest{
+		RequestID:   "build-1",
+		ProjectPath: project,
+		TaskName:    "build",
+		BuildOptions: map[string]string{
+			"jvmArgs":     "-Xmx2g",
+			"offlineMode": "true",
+			"maxWorkers":  "2",
+			"envVars":     "CI=true,SIGNING_KEY=overridden",
+			"flavor":      "free",
+		},
+		SecretEnv: map[string]string{"SIGNING_KEY": "s3cr3t-key"},
+	}
+	if err := service.Build(request, &response); err != nil {
+		t.Fatalf("Build failed: %v", err)
+	}
+
+	args, _ := os.ReadFile(filepath.Join(project, "args.txt"))
+	if expected := "build --console=plain -Dorg.gradle.jvmargs=-Xmx2g --max-workers=2 --offline -Pflavor=free\n"; string(args) != expected {
+		t.Errorf("Expected gradle to be run with %q, got %q", expected, args)
+	}
+	if env, _ := os.ReadFile(filepath.Join(project, "env.txt")); string(env) != "true s3cr3t-key\n" {
+		t.Errorf("Expected the option variables with secrets taking precedence, got %q", env)
+	}
+
+	request.BuildOptions = map[string]string{"gradleArgs": "--init-script /tmp/init.gradle"}
+	if err := service.Build(request, &response); err == nil || !strings.Contains(err.Error(), "invalid build options") {
+		t.Errorf("Expected invalid options to be rejected, got %v", err)
+	}
+}
+
+// gitRepositoryServer serves a repository with a Gradle wrapper in app/ over
+// git's dumb HTTP protocol, requiring the given password
+func gitRepositoryServer(t *testing.T, wrapper, password string) *httptest.Server {
+	t.Helper()
+	for _, name := range []string{"GIT_AUTHOR_NAME", "GIT_COMMITTER_NAME"} {
+		t.Setenv(name, "test")
+	}
+	for _, name := range []string{"GIT_AUTHOR_EMAIL", "GIT_COMMITTER_EMAIL"} {
+		t.Setenv(name, "test@example.com")
+	}
+
+	source := t.TempDir()
+	os.MkdirAll(filepath.Join(source, "app"), 0755)
+	os.WriteFile(filepath.Join(source, "app", "gradlew"), []byte(wrapper), 0755)
+	bare := filepath.Join(t.TempDir(), "app.git")
+	for _, args := range [][]string{
+		{"-C", source, "init", "--quiet", "-b", "main"},
+		{"-C", source, "add", "."},
+		{"-C", source, "commit", "--quiet", "-m", "initial"},
+		{"clone", "--quiet", "--bare", source, bare},
+		{"-C", bare, "update-server-info"},
+	} {
+		if output, err := exec.Command("git", args...).CombinedOutput(); err != nil {
+			t.Fatalf("git %v failed: %v: %s", args, err, output)
+		}
+	}
+
+	files := http.StripPrefix("/app.git", http.FileServer(http.Dir(bare)))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, given, _ := r.BasicAuth(); given != password {
+			w.Header().Set("WWW-Authenticate", `Basic realm="git"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		files.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestBuildFromRepository(t *testing.T) {
+	built := filepath.Join(t.TempDir(), "built.txt")
+	wrapper := "#!/bin/sh\n[ \"$1\" = build ] && pwd > " + built + "\nexit 0\n"
+	server := gitRepositoryServer(t, wrapper, "s3cr3t-token")
+
+	buildDir := t.TempDir()
+	service := NewWorkerService(&WorkerConfig{ID: "worker-1", BuildDir: buildDir, MaxConcurrentBuilds: 1})
+	service.checkouts.CacheDir = t.TempDir()
+	// The dumb HTTP protocol cannot fetch shallowly
+	service.checkouts.Depth = 0
+
+	var response string
+	request := BuildRequest{
+		RequestID:      "build-1",
+		RepoURL:        server.URL + "/app.git",
+		Ref:            "main",
+		ProjectPath:    "app",
+		TaskName:       "build",
+		GitCredentials: "s3cr3t-token",
+	}
+	if err := service.Build(request, &response); err != nil {
+		t.Fatalf("Build failed: %v", err)
+	}
+
+	data, err := os.ReadFile(built)
+	if err != nil {
+		t.Fatalf("Expected the build to run: %v", err)
+	}
+	if dir := strings.TrimSpace(string(data)); !strings.HasPrefix(dir, filepath.Join(buildDir, "checkouts")) || filepath.Base(dir) != "app" {
+		t.Errorf("Expected the build to run in app/ of a checkout, got %s", dir)
+	}
+	if entries, _ := os.ReadDir(filepath.Join(buildDir, "checkouts")); len(entries) != 0 {
+		t.Errorf("Expected the checkout to be removed, got %d entries", len(entries))
+	}
+
+	// Failures never reveal the credentials
+	request.GitCredentials = "wrong-token"
+	err = service.Build(request, &response)
+	if err == nil || strings.Contains(err.Error(), "wrong-token") {
+		t.Errorf("Expected a masked checkout error, got %v", err)
+	}
+
+	request.GitCredentials = "s3cr3t-token"
+	request.ProjectPath = "missing"
+	if err := service.Build(request, &response); err == nil || !strings.Contains(err.Error(), "invalid project path") {
+		t.Errorf("Expected project directory error, got %v", err)
+	}
+
+	request.RepoURL = "file:///srv/app.git"
+	if err := service.Build(request, &response); err == nil || !strings.Contains(err.Error(), "unsupported repository URL") {
+		t.Errorf("Expected local repositories to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+
+	"distributed-gradle-building/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// workerCollector exports the running builds of the worker, the Gradle
+// daemons on its host and the disk usage of its build directory at scrape
+// time. Gauges a platform cannot measure are left out.
+type workerCollector struct {
+	ws *WorkerService
+}
+
+// Describe implements prometheus.Collector
+func (c workerCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- metrics.WorkerConcurrentBuildsDesc
+	ch <- metrics.WorkerGradleDaemonsDesc
+	ch <- metrics.WorkerWorkspaceDiskUsageDesc
+}
+
+// Collect implements prometheus.Collector
+func (c workerCollector) Collect(ch chan<- prometheus.Metric) {
+	ch <- prometheus.MustNewConstMetric(metrics.WorkerConcurrentBuildsDesc, prometheus.GaugeValue, float64(atomic.LoadInt32(&c.ws.activeBuilds)))
+	if daemons, err := readGradleDaemons(); err == nil {
+		ch <- prometheus.MustNewConstMetric(metrics.WorkerGradleDaemonsDesc, prometheus.GaugeValue, float64(daemons))
+	}
+	if usage, err := readDiskUsage(c.ws.config.BuildDir); err == nil {
+		ch <- prometheus.MustNewConstMetric(metrics.WorkerWorkspaceDiskUsageDesc, prometheus.GaugeValue, usage)
+	}
+}
+
+// recordBuild counts a build the worker finished and how long it took
+func recordBuild(started time.Time, err error) {
+	status := metrics.BuildSucceeded
+	if err != nil {
+		status = metrics.BuildFailed
+	}
+	metrics.WorkerBuildsFinished.WithLabelValues(status).Inc()
+	metrics.WorkerBuildDurations.WithLabelValues(status).Observe(time.Since(started).Seconds())
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"distributed-gradle-building/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// counterValue reads the current value of a counter
+func counterValue(counter prometheus.Counter) float64 {
+	var metric dto.Metric
+	counter.Write(&metric)
+	return metric.GetCounter().GetValue()
+}
+
+func TestBuildMetrics(t *testing.T) {
+	project := t.TempDir()
+	wrapper := "#!/bin/sh\n[ \"$1\" = build ] && [ -e fail ] && exit 1\necho '> Task :compileJava'\n"
+	if err := os.WriteFile(filepath.Join(project, "gradlew"), []byte(wrapper), 0755); err != nil {
+		t.Fatalf("Failed to write wrapper: %v", err)
+	}
+	service := NewWorkerService(&WorkerConfig{ID: "worker-1", BuildDir: t.TempDir(), MaxConcurrentBuilds: 1})
+
+	started := counterValue(metrics.WorkerBuildsStarted)
+	succeeded := counterValue(metrics.WorkerBuildsFinished.WithLabelValues(metrics.BuildSucceeded))
+	failed := counterValue(metrics.WorkerBuildsFinished.WithLabelValues(metrics.BuildFailed))
+
+	var response string
+	if err := service.Build(BuildRequest{RequestID: "build-1", ProjectPath: project, TaskName: "build"}, &response); err != nil {
+		t.Fatalf("Build failed: %v", err)
+	}
+	os.WriteFile(filepath.Join(project, "fail"), nil, 0644)
+	if err := service.Build(BuildRequest{RequestID: "build-2", ProjectPath: project, TaskName: "build"}, &response); err == nil {
+		t.Fatal("Expected the build to fail")
+	}
+
+	// Builds rejected at capacity never start
+	service.buildSlots <- struct{}{}
+	service.Build(BuildRequest{RequestID: "build-3", ProjectPath: project, TaskName: "build"}, &response)
+
+	if counted := counterValue(metrics.WorkerBuildsStarted) - started; counted != 2 {
+		t.Errorf("Expected 2 started builds, got %v", counted)
+	}
+	if counted := counterValue(metrics.WorkerBuildsFinished.WithLabelValues(metrics.BuildSucceeded)) - succeeded; counted != 1 {
+		t.Errorf("Expected 1 succeeded build, got %v", counted)
+	}
+	if counted := counterValue(metrics.WorkerBuildsFinished.WithLabelValues(metrics.BuildFailed)) - failed; counted != 1 {
+		t.Errorf("Expected 1 failed build, got %v", counted)
+	}
+}
+
+func TestWorkerCollector(t *testing.T) {
+	service := NewWorkerService(&WorkerConfig{ID: "worker-1", BuildDir: t.TempDir(), MaxConcurrentBuilds: 2})
+	service.activeBuilds = 2
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(workerCollector{service})
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("Gather failed: %v", err)
+	}
+
+	gauges := make(map[string]float64)
+	for _, family := range families {
+		gauges[family.GetName()] = family.GetMetric()[0].GetGauge().GetValue()
+	}
+	if gauges[metrics.WorkerConcurrentBuilds] != 2 {
+		t.Errorf("Expected 2 concurrent builds, got %v", gauges)
+	}
+	if runtime.GOOS != "linux" {
+		return
+	}
+	if usage, ok := gauges[metrics.WorkerWorkspaceDiskUsage]; !ok || usage <= 0 || usage > 1 {
+		t.Errorf("Expected the disk usage of the build directory, got %v", gauges)
+	}
+	if _, ok := gauges[metrics.WorkerGradleDaemons]; !ok {
+		t.Errorf("Expected the Gradle daemons to be counted, got %v", gauges)
+	}
+}
+
+func TestReadGradleDaemons(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("Gradle daemons are only counted on Linux")
+	}
+	before, err := readGradleDaemons()
+	if err != nil {
+		t.Fatalf("readGradleDaemons failed: %v", err)
+	}
+
+	// A process whose arguments name the daemon class stands in for a daemon
+	daemon := exec.Command("sh", "-c", "sleep 10; true", gradleDaemonClass)
+	if err := daemon.Start(); err != nil {
+		t.Fatalf("Failed to start process: %v", err)
+	}
+	defer func() {
+		daemon.Process.Kill()
+		daemon.Wait()
+	}()
+
+	// The arguments are visible once the process has started
+	after := before
+	for deadline := time.Now().Add(5 * time.Second); after != before+1 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		after, _ = readGradleDaemons()
+	}
+	if after != before+1 {
+		t.Errorf("Expected %d daemons, got %d", before+1, after)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Reasons a spot worker reports for its preemption
+const (
+	PreemptionMetadata = "metadata"
+	PreemptionSIGTERM  = "SIGTERM"
+)
+
+// RPC argument and reply types for preemption notices
+type ReportPreemptionArgs struct {
+	ID     string `json:"id"`
+	Reason string `json:"reason"`
+}
+
+type ReportPreemptionReply struct {
+	Message string `json:"message"`
+	Builds  int    `json:"builds"`
+}
+
+// watchForPreemption polls the instance metadata endpoint of a spot worker
+// and sends PreemptionMetadata on notices once it announces the instance's
+// termination
+func (ws *WorkerService) watchForPreemption(notices chan<- string) {
+	client := &http.Client{Timeout: 2 * time.Second}
+	ticker := time.NewTicker(ws.config.PreemptionPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ws.shutdown:
+			return
+		}
+
+		noticed, err := preemptionNoticed(client, ws.config.PreemptionNoticeURL)
+		if err != nil {
+			log.Printf("Failed to check for a preemption notice: %v", err)
+			continue
+		}
+		if noticed {
+			notices <- PreemptionMetadata
+			return
+		}
+	}
+}
+
+// preemptionNoticed reports whether a metadata endpoint announces that the
+// instance is being preempted. The spot interruption endpoint of AWS answers
+// 404 until an interruption is scheduled, the preempted endpoint of Google
+// Cloud FALSE until the instance is preempted.
+func preemptionNoticed(client *http.Client, url string) (bool, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return false, err
+	}
+	// Google Cloud's metadata server rejects requests without it
+	req.Header.Set("Metadata-Flavor", "Google")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if err != nil {
+		return false, err
+	}
+	return !strings.EqualFold(strings.TrimSpace(string(body)), "false"), nil
+}
+
+// reportPreemption tells the coordinator that the worker's instance is about
+// to be terminated, so it re-queues the worker's builds at once rather than
+// after they missed their heartbeats
+func (ws *WorkerService) reportPreemption(reason string) error {
+	client, err := ws.dialCoordinator()
+	if err != nil {
+		return fmt.Errorf("failed to connect to coordinator: %v", err)
+	}
+	defer client.Close()
+
+	var reply ReportPreemptionReply
+	if err := client.Call("BuildCoordinator.ReportPreemption", ReportPreemptionArgs{ID: ws.config.ID, Reason: reason}, &reply); err != nil {
+		return fmt.Errorf("failed to report preemption: %v", err)
+	}
+	log.Printf("Reported preemption of worker %s, %d builds handed back", ws.config.ID, reply.Builds)
+	return nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPreemptionNoticed(t *testing.T) {
+	var status int
+	var body string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata-Flavor") != "Google" {
+			t.Errorf("Expected the Google metadata header, got %v", r.Header)
+		}
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	defer server.Close()
+
+	for _, test := range []struct {
+		name    string
+		status  int
+		body    string
+		noticed bool
+	}{
+		{"no interruption scheduled", http.StatusNotFound, "", false},
+		{"interruption scheduled", http.StatusOK, `{"action": "terminate", "time": "2024-05-01T12:02:00Z"}`, true},
+		{"not preempted", http.StatusOK, "FALSE", false},
+		{"preempted", http.StatusOK, "TRUE\n", true},
+	} {
+		status, body = test.status, test.body
+		noticed, err := preemptionNoticed(server.Client(), server.URL)
+		if err != nil || noticed != test.noticed {
+			t.Errorf("%s: expected %v, got %v: %v", test.name, test.noticed, noticed, err)
+		}
+	}
+
+	status = http.StatusInternalServerError
+	if _, err := preemptionNoticed(server.Client(), server.URL); err == nil {
+		t.Error("Expected an error for a failing metadata endpoint")
+	}
+}
+
+func TestWatchForPreemption(t *testing.T) {
+	polls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if polls++; polls < 3 {
+			w.Write([]byte("FALSE"))
+			return
+		}
+		w.Write([]byte("TRUE"))
+	}))
+	defer server.Close()
+
+	service := NewWorkerService(&WorkerConfig{ID: "spot-1", BuildDir: t.TempDir(), Spot: true, PreemptionNoticeURL: server.URL, PreemptionPollInterval: time.Millisecond})
+	notices := make(chan string, 1)
+	go service.watchForPreemption(notices)
+
+	select {
+	case reason := <-notices:
+		if reason != PreemptionMetadata || polls != 3 {
+			t.Errorf("Expected a metadata notice on the third poll, got %s after %d polls", reason, polls)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected a preemption notice")
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"distributed-gradle-building/types"
+)
+
+// clockTicks is the kernel's USER_HZ, the unit of process CPU times
+const clockTicks = 100
+
+// maxResourceSamples bounds the time series of a build. Longer builds keep
+// every other sample and are sampled half as often from then on.
+const maxResourceSamples = 360
+
+// ResourceMetrics is the resource usage of a build's process tree, reported
+// with its artifacts. CPUUsage and MemoryUsage are averages over the build,
+// DiskIO the bytes read and written. CacheStorage is how much the local
+// build cache grew, which includes the entries of builds running alongside.
+type ResourceMetrics struct {
+	CPUUsage        float64                `json:"cpu_usage"`
+	MemoryUsage     int64                  `json:"memory_usage"`
+	DiskIO          int64                  `json:"disk_io"`
+	NetworkIO       int64                  `json:"network_io"`
+	PeakCPUUsage    float64                `json:"peak_cpu_usage,omitempty"`
+	PeakMemoryUsage int64                  `json:"peak_memory_usage,omitempty"`
+	CacheStorage    int64                  `json:"cache_storage,omitempty"`
+	Samples         []types.ResourceSample `json:"samples,omitempty"`
+}
+
+// processUsage is the cumulative CPU time in clock ticks, resident memory
+// in bytes and storage IO in bytes of a process tree
+type processUsage struct {
+	cpuTicks uint64
+	memory   int64
+	diskIO   int64
+}
+
+// parseProcessStat reads the process ID, parent process ID, CPU ticks and
+// resident memory from the contents of /proc/<pid>/stat
+func parseProcessStat(stat string) (int, int, processUsage, error) {
+	// The command name may contain spaces and parentheses
+	open, end := strings.IndexByte(stat, '('), strings.LastIndexByte(stat, ')')
+	if open < 0 || end < open {
+		return 0, 0, processUsage{}, fmt.Errorf("malformed process stat")
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(stat[:open]))
+	if err != nil {
+		return 0, 0, processUsage{}, err
+	}
+
+	// Fields from the state on: state ppid ... utime(12) stime(13) ... rss(22)
+	fields := strings.Fields(stat[end+1:])
+	if len(fields) < 22 {
+		return 0, 0, processUsage{}, fmt.Errorf("malformed process stat")
+	}
+	parent, _ := strconv.Atoi(fields[1])
+	utime, _ := strconv.ParseUint(fields[11], 10, 64)
+	stime, _ := strconv.ParseUint(fields[12], 10, 64)
+	rss, _ := strconv.ParseInt(fields[21], 10, 64)
+
+	return pid, parent, processUsage{cpuTicks: utime + stime, memory: rss * int64(os.Getpagesize())}, nil
+}
+
+// resourceSampler polls the process tree of a build until it is stopped
+type resourceSampler struct {
+	pid      int
+	interval time.Duration
+	cores    int
+	read     func(pid int) (processUsage, error)
+	stopped  chan struct{}
+	done     chan struct{}
+
+	last    processUsage
+	lastAt  time.Time
+	samples []types.ResourceSample
+}
+
+// startResourceSampler samples the process tree of pid every interval, or
+// returns nil if interval is not positive
+func startResourceSampler(pid int, interval time.Duration) *resourceSampler {
+	if interval <= 0 {
+		return nil
+	}
+	s := newResourceSampler(pid, interval, readProcessTree)
+	go s.run()
+	return s
+}
+
+func newResourceSampler(pid int, interval time.Duration, read func(pid int) (processUsage, error)) *resourceSampler {
+	return &resourceSampler{
+		pid:      pid,
+		interval: interval,
+		cores:    runtime.NumCPU(),
+		read:     read,
+		stopped:  make(chan struct{}),
+		done:     make(chan struct{}),
+		lastAt:   time.Now(),
+	}
+}
+
+func (s *resourceSampler) run() {
+	defer close(s.done)
+	timer := time.NewTimer(s.interval)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+		case <-s.stopped:
+			return
+		}
+		if usage, err := s.read(s.pid); err == nil {
+			s.record(usage, time.Now())
+		}
+		timer.Reset(s.interval)
+	}
+}
+
+// record adds a sample of the process tree taken at a time
+func (s *resourceSampler) record(usage processUsage, at time.Time) {
+	sample := types.ResourceSample{Time: at, MemoryUsage: usage.memory, DiskIO: usage.diskIO}
+	// CPU time falls when descendants exit, which is not an idle interval
+	if elapsed := at.Sub(s.lastAt).Seconds(); elapsed > 0 && usage.cpuTicks >= s.last.cpuTicks {
+		sample.CPUUsage = float64(usage.cpuTicks-s.last.cpuTicks) / clockTicks / elapsed / float64(s.cores)
+	}
+	s.last, s.lastAt = usage, at
+
+	if len(s.samples) == maxResourceSamples {
+		kept := s.samples[:0]
+		for i := 1; i < len(s.samples); i += 2 {
+			kept = append(kept, s.samples[i])
+		}
+		s.samples = kept
+		s.interval *= 2
+	}
+	s.samples = append(s.samples, sample)
+}
+
+// stop stops sampling and summarizes the samples, nil for a nil sampler
+func (s *resourceSampler) stop() *ResourceMetrics {
+	if s == nil {
+		return nil
+	}
+	close(s.stopped)
+	<-s.done
+	return s.summary()
+}
+
+func (s *resourceSampler) summary() *ResourceMetrics {
+	usage := &ResourceMetrics{Samples: s.samples}
+	if len(s.samples) == 0 {
+		return usage
+	}
+
+	var cpu float64
+	var memory int64
+	for _, sample := range s.samples {
+		cpu += sample.CPUUsage
+		memory += sample.MemoryUsage
+		usage.PeakCPUUsage = max(usage.PeakCPUUsage, sample.CPUUsage)
+		usage.PeakMemoryUsage = max(usage.PeakMemoryUsage, sample.MemoryUsage)
+		// IO of exited descendants is no longer counted, so keep the most seen
+		usage.DiskIO = max(usage.DiskIO, sample.DiskIO)
+	}
+	usage.CPUUsage = cpu / float64(len(s.samples))
+	usage.MemoryUsage = memory / int64(len(s.samples))
+	return usage
+}
+
+// buildCacheDir returns the local build cache directory of Gradle run with
+// env, in its user home
+func buildCacheDir(env []string) string {
+	home := gradleUserHome(env)
+	if home == "" {
+		return ""
+	}
+	return filepath.Join(home, "caches", "build-cache-1")
+}
+
+// gradleUserHome returns the user home of Gradle run with env,
+// GRADLE_USER_HOME or else ~/.gradle, empty if unknown
+func gradleUserHome(env []string) string {
+	if home := lookupEnv(env, "GRADLE_USER_HOME"); home != "" {
+		return home
+	}
+	userHome, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(userHome, ".gradle")
+}
+
+// directorySize returns the size of the files under dir, 0 if it does not
+// exist
+func directorySize(dir string) int64 {
+	var size int64
+	filepath.WalkDir(dir, func(_ string, entry fs.DirEntry, err error) error {
+		if err != nil || !entry.Type().IsRegular() {
+			return nil
+		}
+		if info, err := entry.Info(); err == nil {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
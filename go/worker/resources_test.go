@@ -0,0 +1,98 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestResourceSamplerSummary(t *testing.T) {
+	sampler := newResourceSampler(1, time.Second, nil)
+	sampler.cores = 2
+	start := sampler.lastAt
+
+	// 200 ticks are 2 CPU seconds, a full second of both cores
+	sampler.record(processUsage{cpuTicks: 200, memory: 100, diskIO: 10}, start.Add(time.Second))
+	sampler.record(processUsage{cpuTicks: 300, memory: 300, diskIO: 50}, start.Add(2*time.Second))
+	// A descendant exiting takes its CPU time and IO with it
+	sampler.record(processUsage{cpuTicks: 100, memory: 200, diskIO: 20}, start.Add(3*time.Second))
+
+	usage := sampler.summary()
+	if len(usage.Samples) != 3 {
+		t.Fatalf("Expected 3 samples, got %+v", usage.Samples)
+	}
+	expected := []float64{1, 0.5, 0}
+	for i, sample := range usage.Samples {
+		if sample.CPUUsage != expected[i] {
+			t.Errorf("Sample %d: expected CPU usage %v, got %v", i, expected[i], sample.CPUUsage)
+		}
+	}
+	if usage.CPUUsage != 0.5 || usage.PeakCPUUsage != 1 || usage.MemoryUsage != 200 || usage.PeakMemoryUsage != 300 || usage.DiskIO != 50 {
+		t.Errorf("Unexpected summary %+v", usage)
+	}
+
+	// Long builds keep every other sample and are sampled less often
+	for i := len(usage.Samples); i < maxResourceSamples+1; i++ {
+		sampler.record(processUsage{}, start.Add(time.Duration(i+1)*time.Second))
+	}
+	if len(sampler.samples) != maxResourceSamples/2+1 || sampler.interval != 2*time.Second {
+		t.Errorf("Expected %d samples every 2s, got %d every %v", maxResourceSamples/2+1, len(sampler.samples), sampler.interval)
+	}
+
+	if usage := (*resourceSampler)(nil).stop(); usage != nil {
+		t.Errorf("Expected no usage without sampling, got %+v", usage)
+	}
+}
+
+func TestResourceSamplerPollsProcessTree(t *testing.T) {
+	reads := make(chan int, 10)
+	sampler := newResourceSampler(42, time.Millisecond, func(pid int) (processUsage, error) {
+		reads <- pid
+		return processUsage{memory: 1 << 20}, nil
+	})
+	go sampler.run()
+	<-reads
+	usage := sampler.stop()
+	if len(usage.Samples) == 0 || usage.PeakMemoryUsage != 1<<20 {
+		t.Errorf("Expected samples of process 42, got %+v", usage)
+	}
+}
+
+func TestReadProcessTree(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("process telemetry is only collected on linux")
+	}
+
+	usage, err := readProcessTree(os.Getpid())
+	if err != nil {
+		t.Fatalf("readProcessTree failed: %v", err)
+	}
+	if usage.memory <= 0 {
+		t.Errorf("Expected resident memory of the test process, got %+v", usage)
+	}
+
+	pid, parent, stat, err := parseProcessStat("1234 (gradle (worker) 1) S 1000 1234 1234 0 -1 4194560 100 0 0 0 250 50 0 0 20 0 30 0 100 4096000 512 18446744073709551615")
+	if err != nil || pid != 1234 || parent != 1000 || stat.cpuTicks != 300 || stat.memory != 512*int64(os.Getpagesize()) {
+		t.Errorf("Unexpected stat %d %d %+v: %v", pid, parent, stat, err)
+	}
+}
+
+func TestBuildCacheDir(t *testing.T) {
+	home := t.TempDir()
+	cache := buildCacheDir([]string{"GRADLE_USER_HOME=/ignored", "GRADLE_USER_HOME=" + home})
+	if cache != filepath.Join(home, "caches", "build-cache-1") {
+		t.Errorf("Expected the build cache in the last GRADLE_USER_HOME, got %s", cache)
+	}
+	if size := directorySize(cache); size != 0 {
+		t.Errorf("Expected a missing cache to be empty, got %d", size)
+	}
+
+	os.MkdirAll(filepath.Join(cache, "entries"), 0755)
+	os.WriteFile(filepath.Join(cache, "gc.properties"), []byte("gc"), 0644)
+	os.WriteFile(filepath.Join(cache, "entries", "0a1b2c"), make([]byte, 1000), 0644)
+	if size := directorySize(cache); size != 1002 {
+		t.Errorf("Expected 1002 bytes in the cache, got %d", size)
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"distributed-gradle-building/testshard"
+)
+
+// writeShardInitScript writes the Gradle init script restricting the test
+// tasks of a build to the test classes of its shard and returns its path.
+// It returns an empty path when the shard has no classes to run.
+func writeShardInitScript(projectPath string, shard testshard.Shard) (string, error) {
+	classes, err := testshard.Discover(projectPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to find test classes: %v", err)
+	}
+	include, exclude, ok, err := testshard.Select(classes, shard)
+	if err != nil || !ok {
+		return "", err
+	}
+	script, err := testshard.InitScript(include, exclude)
+	if err != nil {
+		return "", err
+	}
+
+	file, err := os.CreateTemp("", "test-shard-*.gradle")
+	if err != nil {
+		return "", fmt.Errorf("failed to create init script: %v", err)
+	}
+	defer file.Close()
+	if _, err := file.WriteString(script); err != nil {
+		os.Remove(file.Name())
+		return "", fmt.Errorf("failed to write init script: %v", err)
+	}
+	return file.Name(), nil
+}
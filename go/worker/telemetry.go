@@ -0,0 +1,91 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// ResourceTelemetry is the resource usage a worker reports with each heartbeat.
+// Usage values are fractions between 0 and 1.
+type ResourceTelemetry struct {
+	CPUUsage     float64   `json:"cpu_usage"`
+	MemoryUsage  float64   `json:"memory_usage"`
+	DiskUsage    float64   `json:"disk_usage"`
+	LoadAverage  float64   `json:"load_average"`
+	ActiveBuilds int       `json:"active_builds"`
+	CollectedAt  time.Time `json:"collected_at"`
+	// Unavailable is set when the CPU or memory usage of the host could not
+	// be read, as on platforms other than Linux
+	Unavailable bool `json:"unavailable,omitempty"`
+}
+
+// gradleDaemonClass is the main class of Gradle daemon processes
+const gradleDaemonClass = "org.gradle.launcher.daemon.bootstrap.GradleDaemon"
+
+// cpuSample is a snapshot of cumulative CPU time counters
+type cpuSample struct {
+	idle  uint64
+	total uint64
+}
+
+// telemetryCollector samples host resource usage for heartbeats
+type telemetryCollector struct {
+	diskPath string
+	lastCPU  cpuSample
+	mutex    sync.Mutex
+}
+
+// newTelemetryCollector creates a collector reporting disk usage for diskPath
+func newTelemetryCollector(diskPath string) *telemetryCollector {
+	return &telemetryCollector{diskPath: diskPath}
+}
+
+// Collect samples current resource usage. CPU usage is measured since the
+// previous call, or since boot on the first call.
+func (tc *telemetryCollector) Collect(activeBuilds int) ResourceTelemetry {
+	tc.mutex.Lock()
+	defer tc.mutex.Unlock()
+
+	telemetry := ResourceTelemetry{
+		ActiveBuilds: activeBuilds,
+		CollectedAt:  time.Now(),
+	}
+
+	if sample, err := readCPUSample(); err == nil {
+		telemetry.CPUUsage = cpuUsageBetween(tc.lastCPU, sample)
+		tc.lastCPU = sample
+	} else {
+		telemetry.Unavailable = true
+	}
+
+	if usage, err := readMemoryUsage(); err == nil {
+		telemetry.MemoryUsage = usage
+	} else {
+		telemetry.Unavailable = true
+	}
+
+	if usage, err := readDiskUsage(tc.diskPath); err == nil {
+		telemetry.DiskUsage = usage
+	}
+
+	if load, err := readLoadAverage(); err == nil {
+		telemetry.LoadAverage = load
+	}
+
+	return telemetry
+}
+
+// cpuUsageBetween computes the busy fraction of CPU time between two samples
+func cpuUsageBetween(previous, current cpuSample) float64 {
+	total := current.total - previous.total
+	if current.total <= previous.total || total == 0 {
+		return 0
+	}
+
+	idle := current.idle - previous.idle
+	if current.idle < previous.idle || idle > total {
+		return 0
+	}
+
+	return float64(total-idle) / float64(total)
+}
@@ -0,0 +1,196 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// readCPUSample reads cumulative CPU counters from /proc/stat
+func readCPUSample() (cpuSample, error) {
+	file, err := os.Open("/proc/stat")
+	if err != nil {
+		return cpuSample{}, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 || fields[0] != "cpu" {
+			continue
+		}
+
+		var sample cpuSample
+		for i, field := range fields[1:] {
+			value, err := strconv.ParseUint(field, 10, 64)
+			if err != nil {
+				return cpuSample{}, fmt.Errorf("invalid /proc/stat value %q: %v", field, err)
+			}
+			sample.total += value
+			// idle and iowait columns
+			if i == 3 || i == 4 {
+				sample.idle += value
+			}
+		}
+		return sample, nil
+	}
+
+	return cpuSample{}, fmt.Errorf("cpu line not found in /proc/stat")
+}
+
+// readMemoryUsage reads the used memory fraction from /proc/meminfo
+func readMemoryUsage() (float64, error) {
+	file, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	var total, available uint64
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+
+		switch fields[0] {
+		case "MemTotal:":
+			total, _ = strconv.ParseUint(fields[1], 10, 64)
+		case "MemAvailable:":
+			available, _ = strconv.ParseUint(fields[1], 10, 64)
+		}
+	}
+
+	if total == 0 || available > total {
+		return 0, fmt.Errorf("memory totals not found in /proc/meminfo")
+	}
+
+	return float64(total-available) / float64(total), nil
+}
+
+// readDiskUsage returns the used fraction of the filesystem containing path
+func readDiskUsage(path string) (float64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		// Fall back to the root filesystem when the build directory does not exist yet
+		if err := syscall.Statfs("/", &stat); err != nil {
+			return 0, err
+		}
+	}
+
+	if stat.Blocks == 0 {
+		return 0, fmt.Errorf("filesystem reports no blocks")
+	}
+
+	return float64(stat.Blocks-stat.Bfree) / float64(stat.Blocks), nil
+}
+
+// readLoadAverage reads the one minute load average from /proc/loadavg
+func readLoadAverage() (float64, error) {
+	data, err := os.ReadFile("/proc/loadavg")
+	if err != nil {
+		return 0, err
+	}
+
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("empty /proc/loadavg")
+	}
+
+	return strconv.ParseFloat(fields[0], 64)
+}
+
+// readProcessTree sums the resource usage of a process and its descendants.
+// CPU time of descendants that already exited is not counted.
+func readProcessTree(root int) (processUsage, error) {
+	stats, err := filepath.Glob("/proc/[0-9]*/stat")
+	if err != nil {
+		return processUsage{}, err
+	}
+
+	children := make(map[int][]int)
+	usages := make(map[int]processUsage)
+	for _, path := range stats {
+		// Processes may exit while they are listed
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		pid, parent, usage, err := parseProcessStat(string(data))
+		if err != nil {
+			continue
+		}
+		children[parent] = append(children[parent], pid)
+		usages[pid] = usage
+	}
+
+	if _, exists := usages[root]; !exists {
+		return processUsage{}, fmt.Errorf("process %d not found", root)
+	}
+
+	var total processUsage
+	for pending := []int{root}; len(pending) > 0; {
+		pid := pending[0]
+		pending = append(pending[1:], children[pid]...)
+
+		usage := usages[pid]
+		usage.diskIO = readProcessIO(pid)
+		total.cpuTicks += usage.cpuTicks
+		total.memory += usage.memory
+		total.diskIO += usage.diskIO
+	}
+	return total, nil
+}
+
+// readProcessIO reads the bytes a process read from and wrote to storage,
+// zero if /proc/<pid>/io is not readable
+func readProcessIO(pid int) int64 {
+	file, err := os.Open(fmt.Sprintf("/proc/%d/io", pid))
+	if err != nil {
+		return 0
+	}
+	defer file.Close()
+
+	var total int64
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		name, value, found := strings.Cut(scanner.Text(), ":")
+		if found && (name == "read_bytes" || name == "write_bytes") {
+			bytes, _ := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+			total += bytes
+		}
+	}
+	return total
+}
+
+// readGradleDaemons counts the Gradle daemon processes in /proc
+func readGradleDaemons() (int, error) {
+	cmdlines, err := filepath.Glob("/proc/[0-9]*/cmdline")
+	if err != nil {
+		return 0, err
+	}
+
+	daemons := 0
+	for _, path := range cmdlines {
+		// Processes may exit while they are listed
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		for _, arg := range strings.Split(string(data), "\x00") {
+			if arg == gradleDaemonClass {
+				daemons++
+				break
+			}
+		}
+	}
+	return daemons, nil
+}
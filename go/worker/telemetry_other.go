@@ -0,0 +1,35 @@
+//go:build !linux
+
+package main
+
+import "fmt"
+
+// Resource telemetry is read from /proc, so only Linux hosts report it. A
+// portable library such as gopsutil would cover other platforms, but the
+// worker takes no dependency for it. Elsewhere the heartbeat marks the
+// telemetry unavailable, and the coordinator scores the worker's load as
+// unknown rather than idle.
+
+func readCPUSample() (cpuSample, error) {
+	return cpuSample{}, fmt.Errorf("cpu telemetry not supported on this platform")
+}
+
+func readMemoryUsage() (float64, error) {
+	return 0, fmt.Errorf("memory telemetry not supported on this platform")
+}
+
+func readDiskUsage(path string) (float64, error) {
+	return 0, fmt.Errorf("disk telemetry not supported on this platform")
+}
+
+func readLoadAverage() (float64, error) {
+	return 0, fmt.Errorf("load average not supported on this platform")
+}
+
+func readProcessTree(root int) (processUsage, error) {
+	return processUsage{}, fmt.Errorf("process telemetry not supported on this platform")
+}
+
+func readGradleDaemons() (int, error) {
+	return 0, fmt.Errorf("gradle daemon telemetry not supported on this platform")
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"runtime"
+	"testing"
+)
+
+func TestCPUUsageBetween(t *testing.T) {
+	tests := []struct {
+		previous cpuSample
+		current  cpuSample
+		expected float64
+	}{
+		{cpuSample{}, cpuSample{idle: 50, total: 200}, 0.75},
+		{cpuSample{idle: 50, total: 200}, cpuSample{idle: 150, total: 400}, 0.5},
+		{cpuSample{idle: 50, total: 200}, cpuSample{idle: 50, total: 200}, 0},
+		{cpuSample{idle: 50, total: 200}, cpuSample{idle: 10, total: 100}, 0},
+	}
+
+	for _, tt := range tests {
+		if usage := cpuUsageBetween(tt.previous, tt.current); usage != tt.expected {
+			t.Errorf("cpuUsageBetween(%+v, %+v) = %f, expected %f", tt.previous, tt.current, usage, tt.expected)
+		}
+	}
+}
+
+func TestTelemetryCollect(t *testing.T) {
+	collector := newTelemetryCollector(t.TempDir())
+
+	telemetry := collector.Collect(2)
+	if telemetry.ActiveBuilds != 2 {
+		t.Errorf("Expected 2 active builds, got %d", telemetry.ActiveBuilds)
+	}
+	if telemetry.CollectedAt.IsZero() {
+		t.Error("Expected collection timestamp to be set")
+	}
+
+	for name, value := range map[string]float64{
+		"cpu":    telemetry.CPUUsage,
+		"memory": telemetry.MemoryUsage,
+		"disk":   telemetry.DiskUsage,
+	} {
+		if value < 0 || value > 1 {
+			t.Errorf("Expected %s usage between 0 and 1, got %f", name, value)
+		}
+	}
+
+	if telemetry.Unavailable != (runtime.GOOS != "linux") {
+		t.Errorf("Expected telemetry to be unavailable only outside linux, got %v", telemetry.Unavailable)
+	}
+	if runtime.GOOS == "linux" && telemetry.MemoryUsage == 0 {
+		t.Error("Expected memory usage to be reported on linux")
+	}
+}
+
+func TestHeartbeatArgsStatus(t *testing.T) {
+	service := NewWorkerService(&WorkerConfig{ID: "worker-1", BuildDir: t.TempDir()})
+
+	args := service.heartbeatArgs()
+	if args.Status != "idle" || args.ActiveBuilds != 0 {
+		t.Errorf("Expected idle worker with no builds, got status %s with %d builds", args.Status, args.ActiveBuilds)
+	}
+
+	service.activeBuilds = 1
+	args = service.heartbeatArgs()
+	if args.Status != "busy" || args.ActiveBuilds != 1 {
+		t.Errorf("Expected busy worker with 1 build, got status %s with %d builds", args.Status, args.ActiveBuilds)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"net/rpc"
+	"net/url"
+	"strings"
+	"time"
+
+	"distributed-gradle-building/httprpc"
+)
+
+// Transports a worker reaches the coordinator with
+const (
+	// TransportTCP connects to the coordinator's RPC port and accepts the
+	// coordinator's connections on the worker's RPC port
+	TransportTCP = "tcp"
+	// TransportHTTP sends every call over the coordinator's HTTP port and
+	// long-polls the coordinator's calls to the worker, for sites whose
+	// firewalls only let HTTP(S) through
+	TransportHTTP = "http"
+	// TransportPull connects to the coordinator's RPC port and long-polls
+	// its calls over that connection, for workers the coordinator cannot
+	// connect to, such as those behind NAT
+	TransportPull = "pull"
+)
+
+// RPC argument and reply types for polling the coordinator's calls
+type PollCallsArgs struct {
+	WorkerID string `json:"worker_id"`
+}
+
+type PollCallsReply struct {
+	Call *httprpc.Call `json:"call,omitempty"`
+}
+
+type ReplyCallArgs struct {
+	WorkerID string `json:"worker_id"`
+	CallID   uint64 `json:"call_id"`
+	Reply    []byte `json:"reply"`
+}
+
+type ReplyCallReply struct{}
+
+// maxPollBackoff bounds the wait between failed polls of the coordinator
+const maxPollBackoff = 30 * time.Second
+
+// coordinatorClient sends the HTTP requests of workers connected over HTTP.
+// Its timeout outlasts the coordinator's long polls.
+var coordinatorClient = &http.Client{Timeout: 5 * time.Minute}
+
+// dialCoordinator connects to the coordinator's RPC service
+func (ws *WorkerService) dialCoordinator() (*rpc.Client, error) {
+	if ws.config.Transport == TransportHTTP {
+		return httprpc.Dial(ws.coordinatorURL("/api/rpc"), ws.coordinatorHeader(), coordinatorClient), nil
+	}
+	return rpc.Dial("tcp", fmt.Sprintf("%s:%d", ws.config.CoordinatorHost, ws.config.CoordinatorRPCPort))
+}
+
+// coordinatorURL returns the URL of a path on the coordinator's HTTP port
+func (ws *WorkerService) coordinatorURL(path string) string {
+	return strings.TrimRight(ws.config.CoordinatorURL, "/") + path
+}
+
+// coordinatorHeader authenticates the requests of a worker connected over
+// HTTP with its API key, if it has one
+func (ws *WorkerService) coordinatorHeader() http.Header {
+	header := make(http.Header)
+	if ws.config.CoordinatorAPIKey != "" {
+		header.Set("X-API-Key", ws.config.CoordinatorAPIKey)
+	}
+	return header
+}
+
+// pollCalls serves the coordinator's calls to a worker it cannot connect to
+// until the worker shuts down, backing off while the coordinator cannot be
+// reached
+func (ws *WorkerService) pollCalls(server *rpc.Server) {
+	poll := ws.pullCalls(server)
+	if ws.config.Transport == TransportHTTP {
+		calls := ws.coordinatorURL("/api/rpc/calls?worker=" + url.QueryEscape(ws.config.ID))
+		header := ws.coordinatorHeader()
+		poll = func() error {
+			return httprpc.Poll(coordinatorClient, calls, header, server)
+		}
+	}
+	backoff := time.Second
+
+	for {
+		select {
+		case <-ws.shutdown:
+			return
+		default:
+		}
+
+		err := poll()
+		if err == nil {
+			backoff = time.Second
+			continue
+		}
+		log.Printf("Failed to poll the coordinator for calls: %v", err)
+		select {
+		case <-time.After(backoff):
+		case <-ws.shutdown:
+			return
+		}
+		backoff = min(2*backoff, maxPollBackoff)
+	}
+}
+
+// pullCalls returns a function polling the next call of the coordinator over
+// a connection to its RPC port, which is kept open between polls. Calls are
+// served in the background and answered over connections of their own.
+func (ws *WorkerService) pullCalls(server *rpc.Server) func() error {
+	var client *rpc.Client
+	return func() error {
+		if client == nil {
+			var err error
+			if client, err = ws.dialCoordinator(); err != nil {
+				return err
+			}
+		}
+
+		var reply PollCallsReply
+		if err := client.Call("BuildCoordinator.PollCalls", PollCallsArgs{WorkerID: ws.config.ID}, &reply); err != nil {
+			if _, rejected := err.(rpc.ServerError); !rejected {
+				client.Close()
+				client = nil
+			}
+			return err
+		}
+		if call := reply.Call; call != nil {
+			go func() {
+				if err := ws.replyCall(server, *call); err != nil {
+					log.Printf("Failed to answer call %d: %v", call.ID, err)
+				}
+			}()
+		}
+		return nil
+	}
+}
+
+// replyCall serves a pulled call and sends its reply to the coordinator
+func (ws *WorkerService) replyCall(server *rpc.Server, call httprpc.Call) error {
+	data, err := httprpc.Serve(server, bytes.NewReader(call.Data))
+	if err != nil {
+		return err
+	}
+	client, err := ws.dialCoordinator()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	return client.Call("BuildCoordinator.ReplyCall", ReplyCallArgs{WorkerID: ws.config.ID, CallID: call.ID, Reply: data}, &ReplyCallReply{})
+}
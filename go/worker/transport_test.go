@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/rpc"
+	"testing"
+	"time"
+
+	"distributed-gradle-building/httprpc"
+)
+
+// pullCoordinator is a coordinator RPC service queueing calls to a pull
+// worker in a mailbox
+type pullCoordinator struct {
+	mailbox *httprpc.Mailbox
+}
+
+func (c *pullCoordinator) PollCalls(args PollCallsArgs, reply *PollCallsReply) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if call, ok := c.mailbox.Next(ctx); ok {
+		reply.Call = &call
+	}
+	return nil
+}
+
+func (c *pullCoordinator) ReplyCall(args ReplyCallArgs, reply *ReplyCallReply) error {
+	return c.mailbox.Deliver(args.CallID, args.Reply)
+}
+
+func TestPollCalls(t *testing.T) {
+	ping := func(mailbox *httprpc.Mailbox) {
+		t.Helper()
+		client := mailbox.Client()
+		defer client.Close()
+		var reply PingReply
+		if err := client.Call("WorkerService.Ping", PingArgs{Coordinator: "main"}, &reply); err != nil || reply.ID != "worker-1" {
+			t.Errorf("Expected the worker to answer the ping, got %+v: %v", reply, err)
+		}
+	}
+
+	// Pull workers poll over a connection to the RPC port
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+	coordinator := &pullCoordinator{mailbox: httprpc.NewMailbox()}
+	server := rpc.NewServer()
+	server.RegisterName("BuildCoordinator", coordinator)
+	go server.Accept(listener)
+
+	service := NewWorkerService(&WorkerConfig{
+		ID:                 "worker-1",
+		BuildDir:           t.TempDir(),
+		Transport:          TransportPull,
+		CoordinatorHost:    "127.0.0.1",
+		CoordinatorRPCPort: listener.Addr().(*net.TCPAddr).Port,
+	})
+	if err := service.startRPCServer(); err != nil {
+		t.Fatalf("startRPCServer failed: %v", err)
+	}
+	defer close(service.shutdown)
+	ping(coordinator.mailbox)
+
+	// HTTP workers poll the coordinator's HTTP port
+	mailbox := httprpc.NewMailbox()
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/rpc/calls", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("worker") != "worker-1" || r.Header.Get("X-API-Key") != "worker-key" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		mailbox.ServeNext(w, r, 100*time.Millisecond)
+	})
+	mux.HandleFunc("POST /api/rpc/calls", mailbox.ServeReply)
+	coordinatorHTTP := httptest.NewServer(mux)
+	defer coordinatorHTTP.Close()
+
+	service = NewWorkerService(&WorkerConfig{
+		ID:                "worker-1",
+		BuildDir:          t.TempDir(),
+		Transport:         TransportHTTP,
+		CoordinatorURL:    coordinatorHTTP.URL + "/",
+		CoordinatorAPIKey: "worker-key",
+	})
+	if err := service.startRPCServer(); err != nil {
+		t.Fatalf("startRPCServer failed: %v", err)
+	}
+	defer close(service.shutdown)
+	ping(mailbox)
+}
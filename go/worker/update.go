@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"distributed-gradle-building/protocol"
+)
+
+type GetWorkerReleaseArgs struct {
+	ID string `json:"id"`
+}
+
+type GetWorkerReleaseReply struct {
+	MinProtocolVersion int               `json:"min_protocol_version"`
+	Release            *protocol.Release `json:"release,omitempty"`
+}
+
+type DownloadWorkerBinaryArgs struct {
+	ID     string `json:"id"`
+	SHA256 string `json:"sha256"`
+}
+
+type DownloadWorkerBinaryReply struct {
+	Data []byte `json:"data"`
+}
+
+// selfUpdater replaces the worker binary with the release published by the
+// coordinator and restarts the worker with it
+type selfUpdater struct {
+	enabled    bool
+	interval   time.Duration
+	executable string
+	// exec replaces the running process; it only returns on failure
+	exec func(argv0 string, argv []string, envv []string) error
+}
+
+// newSelfUpdaterFromEnv enables self-update if WORKER_SELF_UPDATE is true,
+// checking for new releases every WORKER_UPDATE_INTERVAL (default 10m)
+func newSelfUpdaterFromEnv() *selfUpdater {
+	updater := &selfUpdater{
+		enabled:  getEnvBoolOrDefault("WORKER_SELF_UPDATE", false),
+		interval: 10 * time.Minute,
+		exec:     syscall.Exec,
+	}
+	if !updater.enabled {
+		return updater
+	}
+
+	if value := os.Getenv("WORKER_UPDATE_INTERVAL"); value != "" {
+		interval, err := time.ParseDuration(value)
+		if err != nil || interval <= 0 {
+			log.Printf("Invalid WORKER_UPDATE_INTERVAL %q, using %v", value, updater.interval)
+		} else {
+			updater.interval = interval
+		}
+	}
+
+	executable, err := os.Executable()
+	if err == nil {
+		executable, err = filepath.EvalSymlinks(executable)
+	}
+	if err != nil {
+		log.Printf("Worker self-update disabled: cannot locate the worker binary: %v", err)
+		updater.enabled = false
+		return updater
+	}
+	updater.executable = executable
+
+	return updater
+}
+
+// checkForUpdate asks the coordinator for its published worker release and
+// updates to it
+func (ws *WorkerService) checkForUpdate(client *rpc.Client) error {
+	if !ws.updater.enabled {
+		return nil
+	}
+
+	var reply GetWorkerReleaseReply
+	if err := client.Call("BuildCoordinator.GetWorkerRelease", GetWorkerReleaseArgs{ID: ws.config.ID}, &reply); err != nil {
+		return fmt.Errorf("failed to get worker release: %v", err)
+	}
+	if reply.Release == nil && protocol.Version < reply.MinProtocolVersion {
+		return fmt.Errorf("coordinator requires protocol version %d but publishes no worker release", reply.MinProtocolVersion)
+	}
+	return ws.updateTo(client, reply.Release)
+}
+
+// updateTo installs a published release unless the worker already runs it,
+// then restarts the worker with it. It only returns if the worker does not
+// restart.
+func (ws *WorkerService) updateTo(client *rpc.Client, release *protocol.Release) error {
+	if !ws.updater.enabled || release == nil {
+		return nil
+	}
+
+	current, err := protocol.FileSHA256(ws.updater.executable)
+	if err != nil {
+		return fmt.Errorf("failed to read worker binary: %v", err)
+	}
+	if current == release.SHA256 {
+		return nil
+	}
+
+	// Hold every build slot so no build runs while the binary is replaced;
+	// builds arriving meanwhile are rejected and retried elsewhere
+	if !ws.drain() {
+		return fmt.Errorf("builds are running, retrying release %s later", release.Version)
+	}
+	defer ws.undrain()
+
+	log.Printf("Updating worker %s from %s to release %s", ws.config.ID, protocol.BuildVersion, release.Version)
+	var reply DownloadWorkerBinaryReply
+	err = client.Call("BuildCoordinator.DownloadWorkerBinary", DownloadWorkerBinaryArgs{ID: ws.config.ID, SHA256: release.SHA256}, &reply)
+	if err != nil {
+		return fmt.Errorf("failed to download worker release %s: %v", release.Version, err)
+	}
+	if err := protocol.Install(reply.Data, *release, ws.updater.executable); err != nil {
+		return err
+	}
+
+	log.Printf("Restarting worker %s with release %s", ws.config.ID, release.Version)
+	if err := ws.updater.exec(ws.updater.executable, os.Args, os.Environ()); err != nil {
+		return fmt.Errorf("failed to restart worker: %v", err)
+	}
+	return nil
+}
+
+// drain takes every free build slot, reporting whether it got all of them
+func (ws *WorkerService) drain() bool {
+	for taken := 0; taken < cap(ws.buildSlots); taken++ {
+		select {
+		case ws.buildSlots <- struct{}{}:
+		default:
+			for ; taken > 0; taken-- {
+				<-ws.buildSlots
+			}
+			return false
+		}
+	}
+	return true
+}
+
+// undrain releases the build slots taken by drain
+func (ws *WorkerService) undrain() {
+	for i := 0; i < cap(ws.buildSlots); i++ {
+		<-ws.buildSlots
+	}
+}
+
+// watchForUpdates periodically checks the coordinator for a new worker release
+func (ws *WorkerService) watchForUpdates() {
+	ticker := time.NewTicker(ws.updater.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ws.shutdown:
+			return
+		}
+
+		client, err := ws.dialCoordinator()
+		if err != nil {
+			log.Printf("Failed to connect to coordinator for updates: %v", err)
+			continue
+		}
+
+		if err := ws.checkForUpdate(client); err != nil {
+			log.Printf("Worker self-update failed: %v", err)
+		}
+		client.Close()
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"distributed-gradle-building/protocol"
+)
+
+// releaseCoordinator is a coordinator RPC service publishing a worker release
+type releaseCoordinator struct {
+	publisher *protocol.Publisher
+}
+
+func (c *releaseCoordinator) GetWorkerRelease(args GetWorkerReleaseArgs, reply *GetWorkerReleaseReply) error {
+	reply.MinProtocolVersion = protocol.Version
+	reply.Release = c.publisher.Release()
+	return nil
+}
+
+func (c *releaseCoordinator) DownloadWorkerBinary(args DownloadWorkerBinaryArgs, reply *DownloadWorkerBinaryReply) error {
+	if args.SHA256 != c.publisher.Release().SHA256 {
+		return fmt.Errorf("release no longer published")
+	}
+	data, err := c.publisher.Binary()
+	reply.Data = data
+	return err
+}
+
+func newReleaseClient(t *testing.T, binary string) *rpc.Client {
+	publisher, err := protocol.NewPublisher(binary, "2.0.0", protocol.Version)
+	if err != nil {
+		t.Fatalf("NewPublisher failed: %v", err)
+	}
+
+	server := rpc.NewServer()
+	if err := server.RegisterName("BuildCoordinator", &releaseCoordinator{publisher: publisher}); err != nil {
+		t.Fatalf("Failed to register RPC service: %v", err)
+	}
+	serverConn, clientConn := net.Pipe()
+	go server.ServeConn(serverConn)
+
+	client := rpc.NewClient(clientConn)
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func TestSelfUpdate(t *testing.T) {
+	dir := t.TempDir()
+	release := filepath.Join(dir, "release")
+	os.WriteFile(release, []byte("worker 2.0.0"), 0755)
+	executable := filepath.Join(dir, "worker")
+	os.WriteFile(executable, []byte("worker 1.0.0"), 0755)
+
+	var restarted string
+	service := NewWorkerService(&WorkerConfig{ID: "worker-1", BuildDir: t.TempDir(), MaxConcurrentBuilds: 2})
+	service.updater = &selfUpdater{
+		enabled:    true,
+		executable: executable,
+		exec: func(argv0 string, argv []string, envv []string) error {
+			restarted = argv0
+			return nil
+		},
+	}
+	client := newReleaseClient(t, release)
+
+	// Builds in progress defer the update
+	service.buildSlots <- struct{}{}
+	if err := service.checkForUpdate(client); err == nil || !strings.Contains(err.Error(), "builds are running") {
+		t.Errorf("Expected update to wait for running builds, got %v", err)
+	}
+	if len(service.buildSlots) != 1 {
+		t.Errorf("Expected build slots to be released, got %d taken", len(service.buildSlots))
+	}
+	<-service.buildSlots
+
+	if err := service.checkForUpdate(client); err != nil {
+		t.Fatalf("checkForUpdate failed: %v", err)
+	}
+	if data, _ := os.ReadFile(executable); string(data) != "worker 2.0.0" {
+		t.Errorf("Expected the worker binary to be replaced, got %q", data)
+	}
+	if restarted != executable {
+		t.Errorf("Expected the worker to restart with %s, got %q", executable, restarted)
+	}
+	if len(service.buildSlots) != 0 {
+		t.Errorf("Expected build slots to be released, got %d taken", len(service.buildSlots))
+	}
+
+	// A worker already running the release does not restart again
+	restarted = ""
+	if err := service.checkForUpdate(client); err != nil || restarted != "" {
+		t.Errorf("Expected no update when running the release, got %v and restart %q", err, restarted)
+	}
+}
+
+func TestSelfUpdateDisabled(t *testing.T) {
+	dir := t.TempDir()
+	release := filepath.Join(dir, "release")
+	os.WriteFile(release, []byte("worker 2.0.0"), 0755)
+
+	service := NewWorkerService(&WorkerConfig{ID: "worker-1", BuildDir: t.TempDir(), MaxConcurrentBuilds: 1})
+	if service.updater.enabled {
+		t.Fatal("Expected self-update to be disabled by default")
+	}
+	if err := service.checkForUpdate(newReleaseClient(t, release)); err != nil {
+		t.Errorf("Expected no update when disabled, got %v", err)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"distributed-gradle-building/gitsource"
+	"distributed-gradle-building/metrics"
+	"distributed-gradle-building/projectarchive"
+	"distributed-gradle-building/transfer"
+)
+
+// maxUnpackedProject is the most an uploaded project may unpack to
+const maxUnpackedProject = 8 << 30
+
+// unpackUpload downloads the project archive uploaded for a build from the
+// coordinator and unpacks it into a new directory under the build
+// directory. It returns the directory, which the caller removes, and the
+// project directory inside it.
+func (ws *WorkerService) unpackUpload(request BuildRequest) (string, string, error) {
+	parent := filepath.Join(ws.config.BuildDir, "uploads")
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return "", "", fmt.Errorf("failed to create upload directory: %v", err)
+	}
+	dir, err := os.MkdirTemp(parent, "build-")
+	if err != nil {
+		return "", "", fmt.Errorf("failed to create upload directory: %v", err)
+	}
+
+	if err := ws.downloadUpload(request, dir); err != nil {
+		os.RemoveAll(dir)
+		return "", "", err
+	}
+
+	projectPath, err := gitsource.ProjectDir(dir, request.ProjectPath)
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", "", fmt.Errorf("invalid project path: %v", err)
+	}
+	return dir, projectPath, nil
+}
+
+// downloadUpload fetches the chunks of the uploaded archive over RPC and
+// unpacks it into dir
+func (ws *WorkerService) downloadUpload(request BuildRequest, dir string) error {
+	client, err := ws.dialCoordinator()
+	if err != nil {
+		return fmt.Errorf("cannot download the project of build %s: %v", request.RequestID, err)
+	}
+	defer client.Close()
+
+	archive := dir + ".tar.gz"
+	defer os.Remove(archive)
+	reporter := &progressReporter{chaos: ws.chaos, workerID: ws.config.ID, buildID: request.RequestID, client: client}
+	stats, err := transfer.Download(rpcSource{reporter}, *request.Upload, archive, nil)
+	metrics.WorkerCacheTransferBytes.WithLabelValues(metrics.TransferDownload).Add(float64(stats.WireBytes))
+	if err != nil {
+		return fmt.Errorf("failed to download the project of build %s: %v", request.RequestID, err)
+	}
+
+	file, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := projectarchive.Extract(file, dir, maxUnpackedProject); err != nil {
+		return fmt.Errorf("failed to unpack the project of build %s: %v", request.RequestID, err)
+	}
+
+	log.Printf("Unpacked the uploaded project of build %s: %d bytes", request.RequestID, request.Upload.Size)
+	return nil
+}
@@ -11,6 +11,8 @@ import (
 	"sync"
 	"time"
 
+	"distributed-gradle-building/gradledist"
+	"distributed-gradle-building/provenance"
 	"distributed-gradle-building/types"
 )
 
@@ -24,6 +26,7 @@ type WorkerService struct {
 	LastPing     time.Time
 	Mutex        sync.RWMutex
 	BuildDir     string
+	Gradle       *gradledist.Provisioner
 }
 
 // NewWorkerService creates a new worker service
@@ -36,6 +39,7 @@ func NewWorkerService(id, coordinator string, config types.WorkerConfig) *Worker
 		ActiveBuilds: make(map[string]*types.BuildResponse),
 		LastPing:     time.Now(),
 		BuildDir:     config.BuildDir,
+		Gradle:       gradledist.NewProvisionerFromEnv(),
 	}
 }
 
@@ -81,6 +85,7 @@ func (ws *WorkerService) ExecuteBuild(request types.BuildRequest, response *type
 	} else {
 		response.Success = true
 		response.Artifacts = ws.collectArtifacts(buildDir)
+		response.ArtifactDetails = ws.describeArtifacts(request, buildDir, response.Artifacts)
 	}
 
 	// Clean up build directory
@@ -152,8 +157,13 @@ func (ws *WorkerService) runGradleBuild(request types.BuildRequest, response *ty
 		args = append(args, fmt.Sprintf("--%s=%s", key, value))
 	}
 
+	executable, err := ws.Gradle.Executable(request.ProjectPath, request.GradleVersion)
+	if err != nil {
+		return err
+	}
+
 	// Create command
-	cmd := exec.Command("gradle", args...)
+	cmd := exec.Command(executable, args...)
 	cmd.Dir = request.ProjectPath
 
 	// Capture output
@@ -203,6 +213,27 @@ func (ws *WorkerService) collectArtifacts(buildDir string) []string {
 	return artifacts
 }
 
+// describeArtifacts checksums artifacts given relative to the build directory
+// and records the toolchain that produced them
+func (ws *WorkerService) describeArtifacts(request types.BuildRequest, buildDir string, artifacts []string) []types.Artifact {
+	paths := make([]string, len(artifacts))
+	for i, artifact := range artifacts {
+		paths[i] = filepath.Join(buildDir, artifact)
+	}
+
+	executable, _ := ws.Gradle.Executable(request.ProjectPath, request.GradleVersion)
+	details, err := provenance.DescribeArtifacts(paths, ws.ID, provenance.DetectToolchain(executable, request.ProjectPath))
+	if err != nil {
+		log.Printf("Failed to describe artifacts of build %s: %v", request.RequestID, err)
+		return nil
+	}
+
+	for i := range details {
+		details[i].Path = artifacts[i]
+	}
+	return details
+}
+
 // Shutdown gracefully shuts down the worker
 func (ws *WorkerService) Shutdown() error {
 	close(ws.BuildQueue)
@@ -462,6 +462,47 @@ func TestCollectArtifacts_NonExistentDirectory(t *testing.T) {
 	}
 }
 
+func TestDescribeArtifacts(t *testing.T) {
+	config := types.WorkerConfig{
+		ID:                  "test-worker",
+		CoordinatorURL:      "localhost:8080",
+		HTTPPort:            8081,
+		RPCPort:             9091,
+		BuildDir:            t.TempDir(),
+		CacheEnabled:        true,
+		MaxConcurrentBuilds: 5,
+		WorkerType:          "standard",
+	}
+
+	worker := NewWorkerService("test-worker", "localhost:8080", config)
+
+	buildDir := filepath.Join(t.TempDir(), "test-build")
+	artifactPath := filepath.Join(buildDir, "build/libs/app.jar")
+	os.MkdirAll(filepath.Dir(artifactPath), 0755)
+	os.WriteFile(artifactPath, []byte("test content"), 0644)
+
+	request := types.BuildRequest{ProjectPath: buildDir, TaskName: "build", RequestID: "build-1"}
+	details := worker.describeArtifacts(request, buildDir, []string{"build/libs/app.jar"})
+
+	if len(details) != 1 {
+		t.Fatalf("Expected 1 artifact, got %d", len(details))
+	}
+	if details[0].Path != "build/libs/app.jar" {
+		t.Errorf("Expected relative artifact path, got %s", details[0].Path)
+	}
+	// SHA-256 of "test content"
+	if details[0].SHA256 != "6ae8a75555209fd6c44157c0aed8016e763ff435a19cf186f76863140143ff72" {
+		t.Errorf("Unexpected checksum %s", details[0].SHA256)
+	}
+	if details[0].Size != 12 || details[0].WorkerID != "test-worker" {
+		t.Errorf("Unexpected artifact details %+v", details[0])
+	}
+
+	if details := worker.describeArtifacts(request, buildDir, []string{"missing.jar"}); details != nil {
+		t.Errorf("Expected no details for missing artifact, got %+v", details)
+	}
+}
+
 func TestShutdown(t *testing.T) {
 	config := types.WorkerConfig{
 		ID:                  "test-worker",
@@ -2,14 +2,20 @@ package com.distributedgradle.plugin;
 
 import okhttp3.*;
 import com.google.gson.Gson;
+import org.gradle.api.Action;
+import org.gradle.api.GradleException;
 import org.gradle.api.Plugin;
 import org.gradle.api.Project;
+import org.gradle.api.Task;
+import org.gradle.api.tasks.StopExecutionException;
 import org.gradle.api.tasks.TaskProvider;
 import org.gradle.api.DefaultTask;
 import org.gradle.api.tasks.TaskAction;
+import org.gradle.api.provider.ListProperty;
 import org.gradle.api.provider.Property;
 
 import java.io.IOException;
+import java.util.Arrays;
 import java.util.HashMap;
 import java.util.Map;
 import java.util.concurrent.TimeUnit;
@@ -29,6 +35,43 @@ public class DistributedGradlePlugin implements Plugin<Project> {
             task.getCacheEnabled().set(extension.getCacheEnabled());
             task.getTimeoutMinutes().set(extension.getTimeoutMinutes());
         });
+
+        // With -Pdistributed, the offloaded tasks of the build run on the
+        // build pool instead of locally
+        if (isDistributed(project)) {
+            project.afterEvaluate(evaluated -> evaluated.getTasks()
+                .matching(task -> extension.getOffloadTasks().get().contains(task.getName()))
+                .configureEach(task -> task.doFirst(new OffloadAction(extension))));
+        }
+    }
+
+    /** Reports whether the build was started with -Pdistributed. */
+    static boolean isDistributed(Project project) {
+        Object distributed = project.findProperty("distributed");
+        return distributed != null && !"false".equals(distributed.toString());
+    }
+
+    /**
+     * Runs a task on the build pool before its own actions and skips them,
+     * leaving the task's outputs as the remote run created them. Gradle still
+     * checks whether the task is up to date or in the build cache first.
+     */
+    static class OffloadAction implements Action<Task> {
+        private final DistributedGradleExtension extension;
+
+        OffloadAction(DistributedGradleExtension extension) {
+            this.extension = extension;
+        }
+
+        @Override
+        public void execute(Task task) {
+            try {
+                RemoteTaskExecutor.forBuild(task.getProject().getRootProject(), extension).run(task);
+            } catch (IOException e) {
+                throw new GradleException("Failed to run " + task.getPath() + " on the build pool: " + e.getMessage(), e);
+            }
+            throw new StopExecutionException();
+        }
     }
 
     public static class DistributedGradleExtension {
@@ -37,6 +80,7 @@ public class DistributedGradlePlugin implements Plugin<Project> {
         private final Property<String> taskName;
         private final Property<Boolean> cacheEnabled;
         private final Property<Integer> timeoutMinutes;
+        private final ListProperty<String> offloadTasks;
 
         public DistributedGradleExtension(Project project) {
             serviceUrl = project.getObjects().property(String.class);
@@ -51,6 +95,9 @@ public class DistributedGradlePlugin implements Plugin<Project> {
 
             timeoutMinutes = project.getObjects().property(Integer.class);
             timeoutMinutes.set(30);
+
+            offloadTasks = project.getObjects().listProperty(String.class);
+            offloadTasks.set(Arrays.asList("compileJava", "compileTestJava", "test"));
         }
 
         public Property<String> getServiceUrl() { return serviceUrl; }
@@ -58,6 +105,7 @@ public class DistributedGradlePlugin implements Plugin<Project> {
         public Property<String> getTaskName() { return taskName; }
         public Property<Boolean> getCacheEnabled() { return cacheEnabled; }
         public Property<Integer> getTimeoutMinutes() { return timeoutMinutes; }
+        public ListProperty<String> getOffloadTasks() { return offloadTasks; }
     }
 
     public static class DistributedBuildTask extends DefaultTask {
@@ -0,0 +1,373 @@
+package com.distributedgradle.plugin;
+
+import okhttp3.*;
+import com.google.gson.FieldNamingPolicy;
+import com.google.gson.Gson;
+import com.google.gson.GsonBuilder;
+import org.apache.commons.compress.archivers.tar.TarArchiveEntry;
+import org.apache.commons.compress.archivers.tar.TarArchiveOutputStream;
+import org.apache.commons.compress.compressors.gzip.GzipCompressorOutputStream;
+import org.gradle.api.GradleException;
+import org.gradle.api.Project;
+import org.gradle.api.Task;
+import org.gradle.api.plugins.ExtraPropertiesExtension;
+
+import java.io.BufferedOutputStream;
+import java.io.File;
+import java.io.IOException;
+import java.io.InputStream;
+import java.nio.file.FileVisitResult;
+import java.nio.file.Files;
+import java.nio.file.LinkOption;
+import java.nio.file.Path;
+import java.nio.file.SimpleFileVisitor;
+import java.nio.file.StandardCopyOption;
+import java.nio.file.attribute.BasicFileAttributes;
+import java.security.DigestInputStream;
+import java.security.MessageDigest;
+import java.security.NoSuchAlgorithmException;
+import java.util.ArrayList;
+import java.util.Arrays;
+import java.util.Comparator;
+import java.util.HashMap;
+import java.util.List;
+import java.util.Map;
+import java.util.concurrent.TimeUnit;
+import java.util.stream.Collectors;
+import java.util.stream.Stream;
+
+/**
+ * Runs tasks of a local build on the distributed build pool. The root project
+ * is uploaded to the coordinator once per build, each offloaded task then runs
+ * as a build of that upload, and its outputs are downloaded in place of
+ * running it locally.
+ */
+class RemoteTaskExecutor {
+    private static final String EXECUTOR_PROPERTY = "distributedGradleExecutor";
+    private static final Gson GSON = new GsonBuilder()
+        .setFieldNamingPolicy(FieldNamingPolicy.LOWER_CASE_WITH_UNDERSCORES)
+        .create();
+    private static final MediaType JSON = MediaType.parse("application/json");
+    private static final MediaType GZIP = MediaType.parse("application/gzip");
+
+    // Left out of uploads like the Go client does: version control, IDE and
+    // Gradle state, and the build directories of projects
+    private static final List<String> SKIPPED_DIRS = Arrays.asList(".git", ".gradle", ".idea", "node_modules");
+    private static final List<String> BUILD_SCRIPTS = Arrays.asList("build.gradle", "build.gradle.kts", "settings.gradle", "settings.gradle.kts");
+
+    private final Path rootDir;
+    private final String serviceUrl;
+    private final String authToken;
+    private final boolean cacheEnabled;
+    private final int timeoutMinutes;
+    private final OkHttpClient client;
+    private String uploadId;
+
+    private RemoteTaskExecutor(Path rootDir, DistributedGradlePlugin.DistributedGradleExtension extension) {
+        this.rootDir = rootDir.toAbsolutePath().normalize();
+        this.serviceUrl = extension.getServiceUrl().get();
+        this.authToken = extension.getAuthToken().getOrNull();
+        this.cacheEnabled = extension.getCacheEnabled().get();
+        this.timeoutMinutes = extension.getTimeoutMinutes().get();
+        this.client = new OkHttpClient.Builder()
+            .connectTimeout(30, TimeUnit.SECONDS)
+            .readTimeout(timeoutMinutes, TimeUnit.MINUTES)
+            .writeTimeout(timeoutMinutes, TimeUnit.MINUTES)
+            .build();
+    }
+
+    /**
+     * Returns the executor of the build rootProject belongs to, created with
+     * the configuration of the first project offloading a task.
+     */
+    static RemoteTaskExecutor forBuild(Project rootProject, DistributedGradlePlugin.DistributedGradleExtension extension) {
+        ExtraPropertiesExtension extra = rootProject.getExtensions().getExtraProperties();
+        synchronized (rootProject) {
+            if (!extra.has(EXECUTOR_PROPERTY)) {
+                extra.set(EXECUTOR_PROPERTY, new RemoteTaskExecutor(rootProject.getProjectDir().toPath(), extension));
+            }
+            return (RemoteTaskExecutor) extra.get(EXECUTOR_PROPERTY);
+        }
+    }
+
+    /**
+     * Runs task on the build pool and replaces its outputs with those of the
+     * remote run. Outputs are downloaded for failed runs too, so test reports
+     * tell why.
+     */
+    void run(Task task) throws IOException {
+        List<String> outputs = new ArrayList<>();
+        for (File output : task.getOutputs().getFiles()) {
+            String relative = relativePath(output.toPath());
+            if (relative != null) {
+                outputs.add(relative);
+            }
+        }
+
+        Map<String, Object> taskRequest = new HashMap<>();
+        taskRequest.put("upload_id", uploadId(task));
+        taskRequest.put("task", task.getPath());
+        taskRequest.put("outputs", outputs);
+        taskRequest.put("gradle_version", task.getProject().getGradle().getGradleVersion());
+        taskRequest.put("cache_enabled", cacheEnabled);
+
+        RequestBody body = RequestBody.create(GSON.toJson(taskRequest), JSON);
+        SubmitResponse submitted = GSON.fromJson(call(request(url().addPathSegments("api/tasks")).post(body).build()), SubmitResponse.class);
+        task.getLogger().lifecycle("Running {} on the build pool as {}", task.getPath(), submitted.buildId);
+
+        BuildStatus status = waitForBuild(task, submitted.buildId);
+        downloadOutputs(submitted.buildId, outputs);
+
+        if (!"completed".equals(status.progress.status)) {
+            String reason = status.errorMessage != null && !status.errorMessage.isEmpty() ? status.errorMessage : status.progress.message;
+            throw new GradleException("Remote run of " + task.getPath() + " " + status.progress.status + ": " + reason);
+        }
+    }
+
+    /** Uploads the root project the first time a task of the build needs it. */
+    private synchronized String uploadId(Task task) throws IOException {
+        if (uploadId != null) {
+            return uploadId;
+        }
+
+        File archive = File.createTempFile("distributed-gradle-", ".tar.gz");
+        try {
+            packProject(archive.toPath());
+            RequestBody body = RequestBody.create(archive, GZIP);
+            ProjectUpload upload = GSON.fromJson(call(request(url().addPathSegments("api/uploads")).post(body).build()), ProjectUpload.class);
+            task.getLogger().lifecycle("Uploaded {} to the build pool: {} of {} bytes sent", rootDir, upload.sentBytes, upload.size);
+            uploadId = upload.uploadId;
+            return uploadId;
+        } finally {
+            Files.deleteIfExists(archive.toPath());
+        }
+    }
+
+    /** Packs the regular files of the root project into a gzipped tar archive. */
+    private void packProject(Path archive) throws IOException {
+        try (TarArchiveOutputStream tar = new TarArchiveOutputStream(
+                new GzipCompressorOutputStream(new BufferedOutputStream(Files.newOutputStream(archive))))) {
+            tar.setLongFileMode(TarArchiveOutputStream.LONGFILE_POSIX);
+            tar.setBigNumberMode(TarArchiveOutputStream.BIGNUMBER_POSIX);
+
+            Files.walkFileTree(rootDir, new SimpleFileVisitor<Path>() {
+                @Override
+                public FileVisitResult preVisitDirectory(Path dir, BasicFileAttributes attrs) throws IOException {
+                    if (dir.equals(rootDir)) {
+                        return FileVisitResult.CONTINUE;
+                    }
+                    if (SKIPPED_DIRS.contains(dir.getFileName().toString()) || isBuildOutput(dir)) {
+                        return FileVisitResult.SKIP_SUBTREE;
+                    }
+                    tar.putArchiveEntry(new TarArchiveEntry(relativePath(dir) + "/"));
+                    tar.closeArchiveEntry();
+                    return FileVisitResult.CONTINUE;
+                }
+
+                @Override
+                public FileVisitResult visitFile(Path file, BasicFileAttributes attrs) throws IOException {
+                    // Symbolic links and special files are left out
+                    if (!attrs.isRegularFile()) {
+                        return FileVisitResult.CONTINUE;
+                    }
+                    TarArchiveEntry entry = new TarArchiveEntry(relativePath(file));
+                    entry.setSize(attrs.size());
+                    // Keeps the Gradle wrapper executable
+                    entry.setMode(Files.isExecutable(file) ? 0100755 : 0100644);
+                    tar.putArchiveEntry(entry);
+                    Files.copy(file, tar);
+                    tar.closeArchiveEntry();
+                    return FileVisitResult.CONTINUE;
+                }
+            });
+        }
+    }
+
+    /** Reports whether dir is the build directory of a Gradle project. */
+    private static boolean isBuildOutput(Path dir) {
+        if (!"build".equals(dir.getFileName().toString())) {
+            return false;
+        }
+        for (String script : BUILD_SCRIPTS) {
+            if (Files.exists(dir.getParent().resolve(script))) {
+                return true;
+            }
+        }
+        return false;
+    }
+
+    /** Polls the build of a task until it finishes. */
+    private BuildStatus waitForBuild(Task task, String buildId) throws IOException {
+        long deadline = System.currentTimeMillis() + TimeUnit.MINUTES.toMillis(timeoutMinutes);
+        Request statusRequest = request(url().addPathSegments("api/builds").addPathSegment(buildId)).get().build();
+
+        while (System.currentTimeMillis() < deadline) {
+            BuildStatus status = GSON.fromJson(call(statusRequest), BuildStatus.class);
+            switch (status.progress.status) {
+                case "completed":
+                case "failed":
+                case "cancelled":
+                    return status;
+                default:
+                    task.getLogger().info("Build {} of {} is {}", buildId, task.getPath(), status.progress.status);
+            }
+
+            try {
+                Thread.sleep(2000);
+            } catch (InterruptedException e) {
+                Thread.currentThread().interrupt();
+                throw new IOException("Interrupted waiting for build " + buildId, e);
+            }
+        }
+
+        throw new IOException("Build " + buildId + " did not finish within " + timeoutMinutes + " minutes");
+    }
+
+    /**
+     * Replaces the outputs of a task with the artifacts the remote run
+     * uploaded for them, each checked against its checksum.
+     */
+    private void downloadOutputs(String buildId, List<String> outputs) throws IOException {
+        StoredArtifact[] artifacts = GSON.fromJson(
+            call(request(url().addPathSegments("api/builds").addPathSegment(buildId).addPathSegment("artifacts")).get().build()),
+            StoredArtifact[].class);
+
+        for (String output : outputs) {
+            deleteRecursively(rootDir.resolve(output));
+        }
+        for (StoredArtifact artifact : artifacts) {
+            boolean isOutput = outputs.stream().anyMatch(output -> artifact.path.equals(output) || artifact.path.startsWith(output + "/"));
+            if (!isOutput) {
+                continue;
+            }
+            Path target = rootDir.resolve(artifact.path).normalize();
+            if (!target.startsWith(rootDir)) {
+                throw new IOException("Artifact " + artifact.path + " is outside of the project");
+            }
+            download(buildId, artifact, target);
+        }
+    }
+
+    /** Downloads an artifact to a temporary file moved into place once its checksum matches. */
+    private void download(String buildId, StoredArtifact artifact, Path target) throws IOException {
+        HttpUrl artifactUrl = url().addPathSegments("api/builds").addPathSegment(buildId)
+            .addPathSegment("artifacts").addPathSegments(artifact.path).build();
+
+        Files.createDirectories(target.getParent());
+        Path temp = Files.createTempFile(target.getParent(), "." + target.getFileName(), ".tmp");
+        try (Response response = client.newCall(request(artifactUrl).get().build()).execute()) {
+            if (!response.isSuccessful()) {
+                throw new IOException("Failed to download " + artifact.path + ": " + response.code());
+            }
+
+            MessageDigest digest = sha256();
+            try (InputStream in = new DigestInputStream(response.body().byteStream(), digest)) {
+                Files.copy(in, temp, StandardCopyOption.REPLACE_EXISTING);
+            }
+            String sum = hex(digest.digest());
+            if (!sum.equals(artifact.sha256)) {
+                throw new IOException("Checksum mismatch for " + artifact.path + ": expected " + artifact.sha256 + ", got " + sum);
+            }
+            Files.move(temp, target, StandardCopyOption.REPLACE_EXISTING);
+        } finally {
+            Files.deleteIfExists(temp);
+        }
+    }
+
+    /** Returns the slash-separated path of a file inside the root project, or null for others. */
+    private String relativePath(Path path) {
+        Path normalized = path.toAbsolutePath().normalize();
+        if (!normalized.startsWith(rootDir) || normalized.equals(rootDir)) {
+            return null;
+        }
+        return rootDir.relativize(normalized).toString().replace(File.separatorChar, '/');
+    }
+
+    private static void deleteRecursively(Path path) throws IOException {
+        if (!Files.exists(path, LinkOption.NOFOLLOW_LINKS)) {
+            return;
+        }
+        try (Stream<Path> paths = Files.walk(path)) {
+            for (Path file : paths.sorted(Comparator.reverseOrder()).collect(Collectors.toList())) {
+                Files.delete(file);
+            }
+        }
+    }
+
+    private static MessageDigest sha256() {
+        try {
+            return MessageDigest.getInstance("SHA-256");
+        } catch (NoSuchAlgorithmException e) {
+            throw new IllegalStateException(e);
+        }
+    }
+
+    private static String hex(byte[] bytes) {
+        StringBuilder builder = new StringBuilder(bytes.length * 2);
+        for (byte b : bytes) {
+            builder.append(String.format("%02x", b));
+        }
+        return builder.toString();
+    }
+
+    private HttpUrl.Builder url() {
+        HttpUrl base = HttpUrl.parse(serviceUrl);
+        if (base == null) {
+            throw new GradleException("Invalid serviceUrl " + serviceUrl);
+        }
+        return base.newBuilder();
+    }
+
+    private Request.Builder request(HttpUrl.Builder url) {
+        return request(url.build());
+    }
+
+    private Request.Builder request(HttpUrl url) {
+        Request.Builder builder = new Request.Builder().url(url);
+        if (authToken != null && !authToken.isEmpty()) {
+            builder.addHeader("Authorization", "Bearer " + authToken);
+            builder.addHeader("X-Auth-Token", authToken);
+        }
+        return builder;
+    }
+
+    private String call(Request request) throws IOException {
+        try (Response response = client.newCall(request).execute()) {
+            String body = response.body() != null ? response.body().string() : "";
+            if (!response.isSuccessful()) {
+                throw new IOException(request.method() + " " + request.url().encodedPath() + " failed: " + response.code() + " " + body.trim());
+            }
+            return body;
+        }
+    }
+
+    // Response classes, named by the coordinator's JSON fields
+    static class SubmitResponse {
+        String buildId;
+        String status;
+    }
+
+    static class ProjectUpload {
+        String uploadId;
+        long size;
+        String sha256;
+        long sentBytes;
+    }
+
+    static class Progress {
+        String status;
+        String message;
+    }
+
+    static class BuildStatus {
+        boolean success;
+        String errorMessage;
+        Progress progress;
+    }
+
+    static class StoredArtifact {
+        String path;
+        long size;
+        String sha256;
+    }
+}